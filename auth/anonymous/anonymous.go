@@ -0,0 +1,127 @@
+package anonymous
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// Hook is a hook that allows clients to connect without credentials, and confines them to sandbox
+// topics, eg. for public demo brokers. Clients with credentials are left to the other auth hooks
+type Hook struct {
+	config   Options
+	sessions acl.Sessions
+	mu       sync.RWMutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the anonymous hook
+type Options struct {
+	// ACL is the topics anonymous clients may access, which may contain +/# wildcards and the
+	// placeholder {clientid}, eg. "public/#": acl.ReadOnly and "sandbox/{clientid}/#": acl.ReadWrite
+	ACL acl.Templates
+
+	// Listeners are the ids of the listeners which allow anonymous clients, and defaults to all of them
+	Listeners []string
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "anonymous-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	anonymousHookConfig, err := parseOptions(config)
+	if err != nil {
+		return err
+	}
+
+	h.config = anonymousHookConfig
+	return nil
+}
+
+// Reload applies new options to clients connecting from then on, and the new ACL to the anonymous
+// clients already connected
+func (h *Hook) Reload(config any) error {
+	anonymousHookConfig, err := parseOptions(config)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.config = anonymousHookConfig
+	h.sessions.Refresh(func(cl *mqtt.Client) acl.Filters {
+		return anonymousHookConfig.ACL.Render(map[string]string{
+			"clientid": cl.ID,
+		})
+	})
+	return nil
+}
+
+// parseOptions returns the options of the config
+func parseOptions(config any) (Options, error) {
+	if config == nil {
+		return Options{}, errors.New("nil config")
+	}
+
+	anonymousHookConfig, ok := config.(Options)
+	if !ok {
+		return Options{}, errors.New("improper config")
+	}
+
+	if len(anonymousHookConfig.ACL) == 0 {
+		return Options{}, errors.New("acl is required")
+	}
+
+	return anonymousHookConfig, nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server, and allows it if it
+// has no credentials
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if pk.Connect.UsernameFlag || pk.Connect.PasswordFlag || len(pk.Connect.Username) > 0 || len(pk.Connect.Password) > 0 {
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.config.Listeners) > 0 && !slices.Contains(h.config.Listeners, cl.Net.Listener) {
+		return false
+	}
+
+	h.sessions.Set(cl, h.config.ACL.Render(map[string]string{
+		"clientid": cl.ID,
+	}))
+
+	h.Log.Debug("allowing anonymous client", "client", cl.ID, "listener", cl.Net.Listener)
+	return true
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
@@ -0,0 +1,192 @@
+package anonymous
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+var testACL = acl.Templates{
+	"public/#":             acl.ReadOnly,
+	"public/secret":        acl.Deny,
+	"sandbox/{clientid}/#": acl.ReadWrite,
+}
+
+func connectPacket(username, pass string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username:     []byte(username),
+			Password:     []byte(pass),
+			UsernameFlag: username != "",
+			PasswordFlag: pass != "",
+		},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	anonymousHook := new(Hook)
+	anonymousHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, anonymousHook.Init(options))
+	return anonymousHook
+}
+
+func TestID(t *testing.T) {
+	anonymousHook := new(Hook)
+
+	require.Equal(t, "anonymous-auth-hook", anonymousHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	anonymousHook := new(Hook)
+	require.True(t, anonymousHook.Provides(mqtt.OnACLCheck))
+	require.True(t, anonymousHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, anonymousHook.Provides(mqtt.OnDisconnect))
+	require.False(t, anonymousHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - acl",
+			config:      Options{ACL: testACL},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no acl",
+			config:      Options{},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			anonymousHook := new(Hook)
+			anonymousHook.Log = slog.Default()
+			err := anonymousHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  Options
+		username string
+		password string
+		listener string
+		expect   bool
+	}{
+		{
+			name:     "Success - anonymous",
+			options:  Options{ACL: testACL},
+			listener: "t1",
+			expect:   true,
+		},
+		{
+			name:     "Success - allowed listener",
+			options:  Options{ACL: testACL, Listeners: []string{"public"}},
+			listener: "public",
+			expect:   true,
+		},
+		{
+			name:     "Failure - username",
+			options:  Options{ACL: testACL},
+			username: "alice",
+			listener: "t1",
+		},
+		{
+			name:     "Failure - password",
+			options:  Options{ACL: testACL},
+			password: "password",
+			listener: "t1",
+		},
+		{
+			name:     "Failure - other listener",
+			options:  Options{ACL: testACL, Listeners: []string{"public"}},
+			listener: "internal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			anonymousHook := newHook(t, tt.options)
+			cl := &mqtt.Client{ID: "guest"}
+			cl.Net.Listener = tt.listener
+			require.Equal(t, tt.expect, anonymousHook.OnConnectAuthenticate(cl, connectPacket(tt.username, tt.password)))
+
+			_, ok := anonymousHook.sessions.Get(cl)
+			require.Equal(t, tt.expect, ok)
+
+		})
+	}
+}
+
+func TestOnACLCheck(t *testing.T) {
+	anonymousHook := newHook(t, Options{ACL: testACL})
+	cl := &mqtt.Client{ID: "guest"}
+	require.True(t, anonymousHook.OnConnectAuthenticate(cl, connectPacket("", "")))
+
+	require.True(t, anonymousHook.OnACLCheck(cl, "public/news", false))
+	require.False(t, anonymousHook.OnACLCheck(cl, "public/news", true))
+	require.False(t, anonymousHook.OnACLCheck(cl, "public/secret", false))
+	require.True(t, anonymousHook.OnACLCheck(cl, "sandbox/guest/a", true))
+	require.False(t, anonymousHook.OnACLCheck(cl, "sandbox/other/a", true))
+	require.False(t, anonymousHook.OnACLCheck(cl, "#", false))
+	require.False(t, anonymousHook.OnACLCheck(cl, "$SYS/broker/uptime", false))
+
+	// clients authenticated by other hooks are not granted the sandbox
+	require.False(t, anonymousHook.OnACLCheck(&mqtt.Client{ID: "alice"}, "public/news", false))
+
+	anonymousHook.OnDisconnect(cl, nil, true)
+	require.False(t, anonymousHook.OnACLCheck(cl, "public/news", false))
+}
+
+func TestReload(t *testing.T) {
+	anonymousHook := newHook(t, Options{ACL: testACL})
+	cl := &mqtt.Client{ID: "guest"}
+	require.True(t, anonymousHook.OnConnectAuthenticate(cl, connectPacket("", "")))
+	require.True(t, anonymousHook.OnACLCheck(cl, "sandbox/guest/a", true))
+
+	// connected clients are given the new acl
+	require.NoError(t, anonymousHook.Reload(Options{ACL: acl.Templates{"demo/{clientid}/#": acl.ReadWrite}, Listeners: []string{"ws"}}))
+	require.False(t, anonymousHook.OnACLCheck(cl, "sandbox/guest/a", true))
+	require.True(t, anonymousHook.OnACLCheck(cl, "demo/guest/a", true))
+
+	other := &mqtt.Client{ID: "other"}
+	other.Net.Listener = "tcp"
+	require.False(t, anonymousHook.OnConnectAuthenticate(other, connectPacket("", "")))
+
+	require.Error(t, anonymousHook.Reload(Options{}))
+	require.Error(t, anonymousHook.Reload(nil))
+	require.True(t, anonymousHook.OnACLCheck(cl, "demo/guest/a", true))
+}
@@ -0,0 +1,255 @@
+package apikey
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// Prefix starts every token, so leaked keys are easy to recognise and scan for
+const Prefix = "mqk_"
+
+// Key is an API key, of which only the hash of the secret is stored
+type Key struct {
+	ID   string `json:"id"`   // the public part of the token, which identifies the key
+	Hash string `json:"hash"` // the hex SHA-256 of the secret part of the token
+	Name string `json:"name,omitempty"`
+
+	// Username binds the key to a username, otherwise clients may connect with any username
+	Username string `json:"username,omitempty"`
+
+	// ACL is granted to clients connecting with the key, and may contain {username} and {clientid}
+	ACL acl.Templates `json:"acl,omitempty"`
+
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"` // the key never expires if it is zero
+}
+
+// Expired returns whether the key has expired at the time
+func (k Key) Expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
+}
+
+// Hook is a hook that authenticates devices connecting with an API key as their password, and grants
+// them the rules of the key. Keys are minted, listed and revoked at runtime, and revoking a key
+// disconnects the clients of this node using it
+type Hook struct {
+	config   Options
+	sessions acl.Sessions
+	clients  map[*mqtt.Client]string // the id of the key each client authenticated with
+	revoked  map[string]struct{}     // the ids of the keys revoked by this hook
+	mu       sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the apikey hook
+type Options struct {
+	Store   Store         // where the keys are kept, eg. a MemoryStore, FileStore or RedisStore
+	Server  *mqtt.Server  // the server whose clients are disconnected when their key is revoked
+	Timeout time.Duration // how long a store operation may take when a client connects, defaults to 5 seconds
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "apikey-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	apikeyHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if apikeyHookConfig.Store == nil {
+		return errors.New("store is required")
+	}
+
+	if apikeyHookConfig.Server == nil {
+		return errors.New("server is required to disconnect revoked keys")
+	}
+
+	if apikeyHookConfig.Timeout <= 0 {
+		apikeyHookConfig.Timeout = 5 * time.Second
+	}
+
+	h.config = apikeyHookConfig
+	h.clients = make(map[*mqtt.Client]string)
+	h.revoked = make(map[string]struct{})
+	return nil
+}
+
+// Mint creates a key with the name, username, ACL and expiry of the template and stores it. It returns
+// the token, which is the only time the secret is available, and the stored key
+func (h *Hook) Mint(ctx context.Context, template Key) (string, Key, error) {
+	b := make([]byte, 40)
+	if _, err := rand.Read(b); err != nil {
+		return "", Key{}, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b[8:])
+
+	key := template
+	key.ID = hex.EncodeToString(b[:8])
+	key.Hash = hashSecret(secret)
+	key.Created = time.Now().UTC()
+
+	if err := h.config.Store.Put(ctx, key); err != nil {
+		return "", Key{}, err
+	}
+
+	return Prefix + key.ID + "_" + secret, key, nil
+}
+
+// List returns the stored keys, oldest first
+func (h *Hook) List(ctx context.Context) ([]Key, error) {
+	return h.config.Store.List(ctx)
+}
+
+// Revoke deletes the key with the id and disconnects the clients which authenticated with it. Revoking
+// is node-local: the key is deleted from the shared store, so no node accepts it for new connections,
+// but clients which are connected to other nodes with it stay connected until they reconnect
+func (h *Hook) Revoke(ctx context.Context, id string) error {
+	// the key is marked first, so a client whose lookup raced the deletion isn't registered after the
+	// clients of the key were disconnected
+	h.mu.Lock()
+	_, marked := h.revoked[id]
+	h.revoked[id] = struct{}{}
+	h.mu.Unlock()
+
+	if err := h.config.Store.Delete(ctx, id); err != nil {
+		if !marked && !errors.Is(err, ErrKeyNotFound) {
+			h.mu.Lock()
+			delete(h.revoked, id)
+			h.mu.Unlock()
+		}
+		return err
+	}
+
+	h.mu.Lock()
+	var revoked []*mqtt.Client
+	for cl, keyID := range h.clients {
+		if keyID == id {
+			revoked = append(revoked, cl)
+			delete(h.clients, cl)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, cl := range revoked {
+		h.Log.Info("disconnecting client whose api key was revoked", "client", cl.ID, "key", id)
+		h.sessions.Delete(cl)
+		if err := h.config.Server.DisconnectClient(cl, packets.ErrAdministrativeAction); err != nil {
+			h.Log.Error("error occurred while disconnecting client", "error", err, "client", cl.ID)
+		}
+	}
+
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	id, secret, ok := parseToken(string(pk.Connect.Password))
+	if !ok {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	key, err := h.config.Store.Get(ctx, id)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false
+	}
+	if err != nil {
+		h.Log.Error("error occurred while looking up api key", "error", err, "key", id)
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(secret))) != 1 {
+		return false
+	}
+
+	if key.Expired(time.Now()) {
+		return false
+	}
+
+	username := string(pk.Connect.Username)
+	if key.Username != "" && key.Username != username {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// the key may have been revoked since it was looked up
+	if _, ok := h.revoked[id]; ok {
+		return false
+	}
+
+	h.sessions.Set(cl, key.ACL.Render(map[string]string{
+		"clientid": cl.ID,
+		"username": username,
+	}))
+	h.clients[cl] = id
+
+	return true
+}
+
+// parseToken splits a token into the id and secret of its key
+func parseToken(token string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(token, Prefix)
+	if !ok {
+		return "", "", false
+	}
+
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+// hashSecret returns the hex SHA-256 of the secret, which is random enough not to need a slow hash
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+	h.mu.Lock()
+	delete(h.clients, cl)
+	h.mu.Unlock()
+}
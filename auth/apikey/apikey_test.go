@@ -0,0 +1,344 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+func connectPacket(username, pass string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username: []byte(username),
+			Password: []byte(pass),
+		},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	if options.Server == nil {
+		options.Server = mqtt.New(nil)
+	}
+
+	apikeyHook := new(Hook)
+	apikeyHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, apikeyHook.Init(options))
+	return apikeyHook
+}
+
+func connectedClient(t *testing.T, s *mqtt.Server, id string) *mqtt.Client {
+	t.Helper()
+
+	r, w := net.Pipe()
+	go io.Copy(io.Discard, w)
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	cl := s.NewClient(r, "tcp", id, false)
+	cl.Properties.ProtocolVersion = 5
+	return cl
+}
+
+// failingStore fails every operation
+type failingStore struct{}
+
+func (failingStore) Get(ctx context.Context, id string) (Key, error) {
+	return Key{}, errors.New("store unavailable")
+}
+
+func (failingStore) Put(ctx context.Context, key Key) error {
+	return errors.New("store unavailable")
+}
+
+func (failingStore) Delete(ctx context.Context, id string) error {
+	return errors.New("store unavailable")
+}
+
+func (failingStore) List(ctx context.Context) ([]Key, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestID(t *testing.T) {
+	apikeyHook := new(Hook)
+
+	require.Equal(t, "apikey-auth-hook", apikeyHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	apikeyHook := newHook(t, Options{Store: NewMemoryStore()})
+	require.True(t, apikeyHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, apikeyHook.Provides(mqtt.OnACLCheck))
+	require.True(t, apikeyHook.Provides(mqtt.OnDisconnect))
+	require.False(t, apikeyHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - memory store",
+			config:      Options{Store: NewMemoryStore(), Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no store",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{Store: NewMemoryStore()},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			apikeyHook := new(Hook)
+			apikeyHook.Log = slog.Default()
+			err := apikeyHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 5*time.Second, apikeyHook.config.Timeout)
+
+		})
+	}
+}
+
+func TestMint(t *testing.T) {
+	store := NewMemoryStore()
+	apikeyHook := newHook(t, Options{Store: store})
+
+	token, key, err := apikeyHook.Mint(context.Background(), Key{Name: "sensor"})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(token, Prefix+key.ID+"_"))
+	require.Len(t, key.ID, 16)
+	require.NotContains(t, token, key.Hash)
+	require.Equal(t, "sensor", key.Name)
+	require.False(t, key.Created.IsZero())
+
+	stored, err := store.Get(context.Background(), key.ID)
+	require.NoError(t, err)
+	require.Equal(t, key, stored)
+
+	other, _, err := apikeyHook.Mint(context.Background(), Key{Name: "sensor"})
+	require.NoError(t, err)
+	require.NotEqual(t, token, other)
+
+	keys, err := apikeyHook.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	apikeyHook = newHook(t, Options{Store: failingStore{}})
+	_, _, err = apikeyHook.Mint(context.Background(), Key{})
+	require.Error(t, err)
+}
+
+func TestParseToken(t *testing.T) {
+	id, secret, ok := parseToken("mqk_0123abcd_se_cr-et")
+	require.True(t, ok)
+	require.Equal(t, "0123abcd", id)
+	require.Equal(t, "se_cr-et", secret)
+
+	for _, token := range []string{"", "password", "mqk_", "mqk_0123abcd", "mqk__secret", "mqk_0123abcd_", "abc_0123abcd_secret"} {
+		_, _, ok := parseToken(token)
+		require.False(t, ok, token)
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	apikeyHook := newHook(t, Options{Store: NewMemoryStore()})
+	ctx := context.Background()
+
+	token, key, err := apikeyHook.Mint(ctx, Key{Name: "any user"})
+	require.NoError(t, err)
+
+	bound, _, err := apikeyHook.Mint(ctx, Key{Name: "bound", Username: "sensor-1"})
+	require.NoError(t, err)
+
+	expired, _, err := apikeyHook.Mint(ctx, Key{Name: "expired", Expires: time.Now().Add(-time.Minute)})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		expectPass bool
+	}{
+		{
+			name:       "Success - valid key",
+			username:   "anyone",
+			password:   token,
+			expectPass: true,
+		},
+		{
+			name:       "Success - valid key without username",
+			username:   "",
+			password:   token,
+			expectPass: true,
+		},
+		{
+			name:       "Success - bound username",
+			username:   "sensor-1",
+			password:   bound,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - other username",
+			username:   "sensor-2",
+			password:   bound,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - wrong secret",
+			username:   "anyone",
+			password:   Prefix + key.ID + "_wrong",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unknown key",
+			username:   "anyone",
+			password:   Prefix + "0000000000000000_secret",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - expired key",
+			username:   "anyone",
+			password:   expired,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - not a key",
+			username:   "anyone",
+			password:   "password",
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &mqtt.Client{ID: "device-1"}
+			require.Equal(t, tt.expectPass, apikeyHook.OnConnectAuthenticate(cl, connectPacket(tt.username, tt.password)))
+
+		})
+	}
+
+	apikeyHook = newHook(t, Options{Store: failingStore{}})
+	require.False(t, apikeyHook.OnConnectAuthenticate(&mqtt.Client{ID: "device-1"}, connectPacket("anyone", token)))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	apikeyHook := newHook(t, Options{Store: NewMemoryStore()})
+
+	token, _, err := apikeyHook.Mint(context.Background(), Key{ACL: acl.Templates{
+		"devices/{clientid}/#": acl.ReadWrite,
+		"users/{username}/+":   acl.ReadOnly,
+	}})
+	require.NoError(t, err)
+
+	cl := &mqtt.Client{ID: "device-1"}
+	require.True(t, apikeyHook.OnConnectAuthenticate(cl, connectPacket("alice", token)))
+	require.True(t, apikeyHook.OnACLCheck(cl, "devices/device-1/status", true))
+	require.True(t, apikeyHook.OnACLCheck(cl, "users/alice/inbox", false))
+	require.False(t, apikeyHook.OnACLCheck(cl, "users/alice/inbox", true))
+	require.False(t, apikeyHook.OnACLCheck(cl, "devices/device-2/status", true))
+
+	apikeyHook.OnDisconnect(cl, nil, true)
+	require.False(t, apikeyHook.OnACLCheck(cl, "devices/device-1/status", true))
+}
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	s := mqtt.New(nil)
+	apikeyHook := newHook(t, Options{Store: NewMemoryStore(), Server: s})
+
+	revokedToken, revoked, err := apikeyHook.Mint(ctx, Key{ACL: acl.Templates{"#": acl.ReadWrite}})
+	require.NoError(t, err)
+
+	keptToken, _, err := apikeyHook.Mint(ctx, Key{ACL: acl.Templates{"#": acl.ReadWrite}})
+	require.NoError(t, err)
+
+	a := connectedClient(t, s, "a")
+	b := connectedClient(t, s, "b")
+	require.True(t, apikeyHook.OnConnectAuthenticate(a, connectPacket("", revokedToken)))
+	require.True(t, apikeyHook.OnConnectAuthenticate(b, connectPacket("", keptToken)))
+
+	require.NoError(t, apikeyHook.Revoke(ctx, revoked.ID))
+	require.True(t, a.Closed())
+	require.ErrorIs(t, a.StopCause(), packets.ErrAdministrativeAction)
+	require.False(t, apikeyHook.OnACLCheck(a, "topic", false))
+
+	require.False(t, b.Closed())
+	require.True(t, apikeyHook.OnACLCheck(b, "topic", false))
+
+	require.False(t, apikeyHook.OnConnectAuthenticate(connectedClient(t, s, "c"), connectPacket("", revokedToken)))
+	require.ErrorIs(t, apikeyHook.Revoke(ctx, revoked.ID), ErrKeyNotFound)
+
+	keys, err := apikeyHook.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+}
+
+// racingStore revokes the key while it is being looked up, as if Revoke ran concurrently
+type racingStore struct {
+	*MemoryStore
+	revoke func(id string)
+}
+
+func (s racingStore) Get(ctx context.Context, id string) (Key, error) {
+	key, err := s.MemoryStore.Get(ctx, id)
+	s.revoke(id)
+	return key, err
+}
+
+func TestRevokeDuringLookup(t *testing.T) {
+	ctx := context.Background()
+	s := mqtt.New(nil)
+	store := &racingStore{MemoryStore: NewMemoryStore()}
+	apikeyHook := newHook(t, Options{Store: store, Server: s})
+	store.revoke = func(id string) {
+		require.NoError(t, apikeyHook.Revoke(ctx, id))
+	}
+
+	token, _, err := apikeyHook.Mint(ctx, Key{ACL: acl.Templates{"#": acl.ReadWrite}})
+	require.NoError(t, err)
+
+	// the key was found, but is revoked before the client is registered
+	cl := connectedClient(t, s, "a")
+	require.False(t, apikeyHook.OnConnectAuthenticate(cl, connectPacket("", token)))
+	require.False(t, apikeyHook.OnACLCheck(cl, "topic", false))
+}
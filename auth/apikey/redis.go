@@ -0,0 +1,113 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mochi-mqtt/hooks/auth/redis"
+)
+
+// DefaultRedisPrefix is the prefix of the keys written by a RedisStore
+const DefaultRedisPrefix = "mqtt:apikey:"
+
+// RedisStore keeps each key as a JSON string at the prefix followed by its id, and the ids in a set at
+// the prefix followed by "ids", so that several brokers can share the keys
+type RedisStore struct {
+	client redis.Client
+	prefix string
+}
+
+// NewRedisStore returns a store using the client, eg. one returned by redis.NewClient. The prefix
+// defaults to DefaultRedisPrefix
+func NewRedisStore(client redis.Client, prefix string) *RedisStore {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+// Get returns the key with the id
+func (s *RedisStore) Get(ctx context.Context, id string) (Key, error) {
+	reply, err := s.client.Do(ctx, "GET", s.prefix+id)
+	if err != nil {
+		return Key{}, err
+	}
+
+	if reply == nil {
+		return Key{}, ErrKeyNotFound
+	}
+
+	data, ok := reply.(string)
+	if !ok {
+		return Key{}, fmt.Errorf("unexpected reply to GET %s", s.prefix+id)
+	}
+
+	var k Key
+	if err := json.Unmarshal([]byte(data), &k); err != nil {
+		return Key{}, err
+	}
+	return k, nil
+}
+
+// Put adds or replaces the key
+func (s *RedisStore) Put(ctx context.Context, key Key) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.client.Do(ctx, "SET", s.prefix+key.ID, data); err != nil {
+		return err
+	}
+
+	_, err = s.client.Do(ctx, "SADD", s.prefix+"ids", key.ID)
+	return err
+}
+
+// Delete removes the key with the id
+func (s *RedisStore) Delete(ctx context.Context, id string) error {
+	reply, err := s.client.Do(ctx, "DEL", s.prefix+id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.client.Do(ctx, "SREM", s.prefix+"ids", id); err != nil {
+		return err
+	}
+
+	if n, _ := reply.(int64); n == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// List returns the keys, oldest first
+func (s *RedisStore) List(ctx context.Context) ([]Key, error) {
+	reply, err := s.client.Do(ctx, "SMEMBERS", s.prefix+"ids")
+	if err != nil {
+		return nil, err
+	}
+
+	ids, _ := reply.([]any)
+	keys := make([]Key, 0, len(ids))
+	for _, v := range ids {
+		id, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected reply to SMEMBERS %s", s.prefix+"ids")
+		}
+
+		k, err := s.Get(ctx, id)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue // deleted since the ids were listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	sortKeys(keys)
+	return keys, nil
+}
@@ -0,0 +1,190 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrKeyNotFound indicates the key does not exist in the store
+var ErrKeyNotFound = errors.New("api key not found")
+
+// Store persists the keys, and must be safe for concurrent use
+type Store interface {
+	Get(ctx context.Context, id string) (Key, error) // returns ErrKeyNotFound if the key does not exist
+	Put(ctx context.Context, key Key) error
+	Delete(ctx context.Context, id string) error // returns ErrKeyNotFound if the key does not exist
+	List(ctx context.Context) ([]Key, error)
+}
+
+// MemoryStore keeps the keys in memory, so they are lost when the broker stops
+type MemoryStore struct {
+	keys map[string]Key
+	mu   sync.RWMutex
+}
+
+// NewMemoryStore returns a store holding the keys
+func NewMemoryStore(keys ...Key) *MemoryStore {
+	s := &MemoryStore{keys: make(map[string]Key, len(keys))}
+	for _, k := range keys {
+		s.keys[k.ID] = k
+	}
+	return s
+}
+
+// Get returns the key with the id
+func (s *MemoryStore) Get(ctx context.Context, id string) (Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return Key{}, ErrKeyNotFound
+	}
+	return k, nil
+}
+
+// Put adds or replaces the key
+func (s *MemoryStore) Put(ctx context.Context, key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key.ID] = key
+	return nil
+}
+
+// Delete removes the key with the id
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+// List returns the keys, oldest first
+func (s *MemoryStore) List(ctx context.Context) ([]Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sortKeys(keys)
+	return keys, nil
+}
+
+// sortKeys orders the keys by creation, then id
+func sortKeys(keys []Key) {
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.Before(keys[j].Created)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+}
+
+// FileStore keeps the keys in memory and writes them to a JSON file on every change. The file holds
+// only hashes of the keys, but should still only be readable by the broker
+type FileStore struct {
+	path string
+	MemoryStore
+}
+
+// NewFileStore returns a store for the file, loading its keys if it exists
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, MemoryStore: MemoryStore{keys: make(map[string]Key)}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+// Put adds or replaces the key and writes the file
+func (s *FileStore) Put(ctx context.Context, key Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.keys[key.ID]
+	s.keys[key.ID] = key
+	if err := s.write(); err != nil {
+		if existed {
+			s.keys[key.ID] = prev
+		} else {
+			delete(s.keys, key.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the key with the id and writes the file
+func (s *FileStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.keys[id]
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	delete(s.keys, id)
+	if err := s.write(); err != nil {
+		s.keys[id] = prev
+		return err
+	}
+	return nil
+}
+
+// write atomically replaces the file with the keys, and must be called with the lock held
+func (s *FileStore) write() error {
+	keys := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sortKeys(keys)
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
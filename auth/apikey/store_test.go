@@ -0,0 +1,170 @@
+package apikey
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/auth/redis"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// fakeRedis answers the commands of the RedisStore from memory
+type fakeRedis struct {
+	strings map[string]string
+	sets    map[string]map[string]bool
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{strings: make(map[string]string), sets: make(map[string]map[string]bool)}
+}
+
+func (r *fakeRedis) Do(ctx context.Context, args ...any) (any, error) {
+	key := args[1].(string)
+	switch args[0] {
+	case "GET":
+		if v, ok := r.strings[key]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "SET":
+		r.strings[key] = string(args[2].([]byte))
+		return "OK", nil
+	case "DEL":
+		if _, ok := r.strings[key]; !ok {
+			return int64(0), nil
+		}
+		delete(r.strings, key)
+		return int64(1), nil
+	case "SADD":
+		if r.sets[key] == nil {
+			r.sets[key] = make(map[string]bool)
+		}
+		r.sets[key][args[2].(string)] = true
+		return int64(1), nil
+	case "SREM":
+		delete(r.sets[key], args[2].(string))
+		return int64(1), nil
+	case "SMEMBERS":
+		out := []any{}
+		for m := range r.sets[key] {
+			out = append(out, m)
+		}
+		return out, nil
+	}
+	return nil, redis.Error("ERR unknown command")
+}
+
+func (r *fakeRedis) Close() error {
+	return nil
+}
+
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := store.Get(ctx, "a")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.ErrorIs(t, store.Delete(ctx, "a"), ErrKeyNotFound)
+
+	b := Key{ID: "b", Hash: "hash-b", Name: "second", Created: created.Add(time.Hour)}
+	a := Key{ID: "a", Hash: "hash-a", Name: "first", Username: "alice", ACL: acl.Templates{"users/{username}/#": acl.ReadWrite}, Created: created}
+	require.NoError(t, store.Put(ctx, b))
+	require.NoError(t, store.Put(ctx, a))
+
+	got, err := store.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, a, got)
+
+	keys, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Key{a, b}, keys)
+
+	a.Name = "renamed"
+	require.NoError(t, store.Put(ctx, a))
+	got, err = store.Get(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, "renamed", got.Name)
+
+	require.NoError(t, store.Delete(ctx, "a"))
+	_, err = store.Get(ctx, "a")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	keys, err = store.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []Key{b}, keys)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+
+	store := NewMemoryStore(Key{ID: "a"})
+	_, err := store.Get(context.Background(), "a")
+	require.NoError(t, err)
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+	testStore(t, store)
+
+	// the remaining key is loaded from the file
+	store, err = NewFileStore(path)
+	require.NoError(t, err)
+	keys, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, "b", keys[0].ID)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestFileStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+	_, err := NewFileStore(path)
+	require.Error(t, err)
+
+	_, err = NewFileStore(dir)
+	require.Error(t, err)
+
+	// the key is not kept if the file cannot be written
+	store, err := NewFileStore(filepath.Join(dir, "missing", "keys.json"))
+	require.NoError(t, err)
+	require.Error(t, store.Put(context.Background(), Key{ID: "a"}))
+	_, err = store.Get(context.Background(), "a")
+	require.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestRedisStore(t *testing.T) {
+	r := newFakeRedis()
+	testStore(t, NewRedisStore(r, ""))
+	require.Contains(t, r.strings, "mqtt:apikey:b")
+	require.Equal(t, map[string]bool{"b": true}, r.sets["mqtt:apikey:ids"])
+
+	r = newFakeRedis()
+	store := NewRedisStore(r, "keys:")
+	require.NoError(t, store.Put(context.Background(), Key{ID: "a"}))
+	require.Contains(t, r.strings, "keys:a")
+
+	// ids whose key was deleted are skipped
+	r.sets["keys:ids"]["stale"] = true
+	keys, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	r.strings["keys:a"] = "{"
+	_, err = store.Get(context.Background(), "a")
+	require.Error(t, err)
+}
@@ -0,0 +1,209 @@
+package auth0
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/auth/jwt"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// Hook is a hook that authenticates clients presenting an Auth0 access token as their password, and
+// optionally reads their topic permissions from app_metadata with the Auth0 Management API
+type Hook struct {
+	config     Options
+	jwks       *jwt.JWKS
+	validator  jwt.Validator
+	management *management
+	sessions   acl.Sessions
+	cancel     context.CancelFunc
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the Auth0 hook.
+// It is the responsibility of the configurer to pass a properly configured RoundTripper that takes
+// care of other requirements such as timeouts, retries, etc
+type Options struct {
+	Domain   string // tenant domain, eg. example.eu.auth0.com or a custom domain
+	Audience string // API identifier the token must have been issued for
+	Leeway   time.Duration
+
+	JWKSRefreshInterval time.Duration     // defaults to 1 hour
+	RoundTripper        http.RoundTripper // used for JWKS and Management API requests, http.DefaultTransport if nil
+
+	// ACL holds templates granted to every authenticated user. Templates may reference {clientid} and
+	// any scalar claim of the token, eg. "devices/{sub}/#"
+	ACL acl.Templates
+
+	// ManagementClientID and ManagementClientSecret are the credentials of a machine to machine
+	// application allowed to read:users. When set, the templates stored under MetadataKey in the
+	// user's app_metadata, eg. {"mqtt_acl": {"devices/{sub}/#": "rw"}}, are granted in addition to ACL
+	ManagementClientID     string
+	ManagementClientSecret string
+	MetadataKey            string        // defaults to mqtt_acl
+	CacheTTL               time.Duration // how long app_metadata is cached per user, defaults to 5 minutes
+	ManagementTimeout      time.Duration // bounds each Management API lookup, defaults to 5 seconds
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "auth0-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if len(h.config.ACL) == 0 && h.config.ManagementClientID == "" {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	auth0HookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if auth0HookConfig.Domain == "" || auth0HookConfig.Audience == "" {
+		return errors.New("domain and audience are required")
+	}
+
+	if auth0HookConfig.ManagementClientID != "" && auth0HookConfig.ManagementClientSecret == "" {
+		return errors.New("management client secret is required")
+	}
+
+	if auth0HookConfig.JWKSRefreshInterval <= 0 {
+		auth0HookConfig.JWKSRefreshInterval = time.Hour
+	}
+
+	if auth0HookConfig.MetadataKey == "" {
+		auth0HookConfig.MetadataKey = "mqtt_acl"
+	}
+
+	if auth0HookConfig.CacheTTL <= 0 {
+		auth0HookConfig.CacheTTL = 5 * time.Minute
+	}
+
+	if auth0HookConfig.ManagementTimeout <= 0 {
+		auth0HookConfig.ManagementTimeout = 5 * time.Second
+	}
+
+	baseURL := "https://" + strings.TrimSuffix(auth0HookConfig.Domain, "/")
+	jwksURL, err := url.Parse(baseURL + "/.well-known/jwks.json")
+	if err != nil {
+		return err
+	}
+
+	rt := auth0HookConfig.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	h.config = auth0HookConfig
+	h.validator = jwt.Validator{
+		Issuer:   baseURL + "/",
+		Audience: auth0HookConfig.Audience,
+		Leeway:   auth0HookConfig.Leeway,
+	}
+
+	h.management = nil
+	if auth0HookConfig.ManagementClientID != "" {
+		h.management = &management{
+			httpClient:   &http.Client{Transport: rt},
+			baseURL:      baseURL,
+			clientID:     auth0HookConfig.ManagementClientID,
+			clientSecret: auth0HookConfig.ManagementClientSecret,
+			metadataKey:  auth0HookConfig.MetadataKey,
+			users:        cache.New[string, acl.Templates](cache.Options{TTL: auth0HookConfig.CacheTTL}),
+		}
+	}
+
+	h.jwks = jwt.NewJWKS(jwksURL, rt, time.Minute)
+
+	// a failed initial fetch is not fatal, the keys are fetched again on the first unknown kid
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	if err := h.jwks.Refresh(ctx); err != nil {
+		h.Log.Error("error occurred while fetching jwks", "error", err)
+	}
+
+	go h.jwks.Run(ctx, auth0HookConfig.JWKSRefreshInterval, func(err error) {
+		h.Log.Error("error occurred while refreshing jwks", "error", err)
+	})
+
+	return nil
+}
+
+// Stop stops refreshing the JWKS
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	token, err := jwt.Parse(string(pk.Connect.Password), h.jwks.Key)
+	if err != nil {
+		h.Log.Debug("token verification failed", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if err := h.validator.Validate(token.Claims); err != nil {
+		h.Log.Debug("token validation failed", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if len(h.config.ACL) == 0 && h.management == nil {
+		return true
+	}
+
+	values := token.Claims.Values()
+	values["clientid"] = cl.ID
+
+	filters := h.config.ACL.Render(values)
+	if h.management != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), h.config.ManagementTimeout)
+		defer cancel()
+
+		templates, err := h.management.Templates(ctx, token.Claims.String("sub"))
+		if err != nil {
+			h.Log.Error("error occurred while fetching auth0 app_metadata", "error", err)
+			return false
+		}
+		filters.Merge(templates.Render(values))
+	}
+	h.sessions.Set(cl, filters)
+
+	return true
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
@@ -0,0 +1,382 @@
+package auth0
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/auth/jwt"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+const (
+	testDomain   = "example.eu.auth0.com"
+	testAudience = "https://mqtt.example.com"
+)
+
+var testKey *rsa.PrivateKey
+
+func init() {
+	testKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// tenant fakes the endpoints of an Auth0 tenant used by the hook
+type tenant struct {
+	t           *testing.T
+	appMetadata map[string]string // user id -> app_metadata json
+	userStatus  int
+	tokens      atomic.Int64
+	lookups     atomic.Int64
+}
+
+func response(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func (tn *tenant) RoundTrip(req *http.Request) (*http.Response, error) {
+	require.Equal(tn.t, testDomain, req.URL.Host)
+
+	switch {
+	case req.URL.Path == "/.well-known/jwks.json":
+		body, err := json.Marshal(map[string]any{"keys": []jwt.JWK{{
+			KeyType: "RSA",
+			KeyID:   "key-1",
+			N:       base64.RawURLEncoding.EncodeToString(testKey.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(testKey.E)).Bytes()),
+		}}})
+		require.NoError(tn.t, err)
+		return response(http.StatusOK, string(body)), nil
+
+	case req.URL.Path == "/oauth/token":
+		tn.tokens.Add(1)
+		require.NoError(tn.t, req.ParseForm())
+		require.Equal(tn.t, "client_credentials", req.PostForm.Get("grant_type"))
+		require.Equal(tn.t, "m2m", req.PostForm.Get("client_id"))
+		require.Equal(tn.t, "m2m-secret", req.PostForm.Get("client_secret"))
+		require.Equal(tn.t, "https://"+testDomain+"/api/v2/", req.PostForm.Get("audience"))
+		return response(http.StatusOK, `{"access_token":"mgmt-token","expires_in":86400}`), nil
+
+	case strings.HasPrefix(req.URL.Path, "/api/v2/users/"):
+		tn.lookups.Add(1)
+		require.Equal(tn.t, "Bearer mgmt-token", req.Header.Get("Authorization"))
+		if tn.userStatus != 0 {
+			return response(tn.userStatus, ``), nil
+		}
+
+		metadata, ok := tn.appMetadata[strings.TrimPrefix(req.URL.Path, "/api/v2/users/")]
+		if !ok {
+			return response(http.StatusNotFound, `{"statusCode":404}`), nil
+		}
+		return response(http.StatusOK, `{"app_metadata":`+metadata+`}`), nil
+	}
+
+	tn.t.Fatalf("unexpected request %s", req.URL)
+	return nil, nil
+}
+
+// signToken creates an RS256 token signed by the test key
+func signToken(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	hb, err := json.Marshal(jwt.Header{Algorithm: "RS256", KeyID: "key-1", Type: "JWT"})
+	require.NoError(t, err)
+	cb, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	input := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, testKey, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func userClaims(sub string) map[string]any {
+	return map[string]any{
+		"iss": "https://" + testDomain + "/",
+		"sub": sub,
+		"aud": []string{testAudience, "https://" + testDomain + "/userinfo"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func connectPacket(token string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{Password: []byte(token)},
+	}
+}
+
+func newHook(t *testing.T, tn *tenant, options Options) *Hook {
+	t.Helper()
+
+	options.Domain = testDomain
+	options.Audience = testAudience
+	options.RoundTripper = tn
+
+	auth0Hook := new(Hook)
+	auth0Hook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, auth0Hook.Init(options))
+	t.Cleanup(func() { auth0Hook.Stop() })
+	return auth0Hook
+}
+
+func TestID(t *testing.T) {
+	auth0Hook := new(Hook)
+
+	require.Equal(t, "auth0-auth-hook", auth0Hook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	auth0Hook := new(Hook)
+	require.True(t, auth0Hook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, auth0Hook.Provides(mqtt.OnACLCheck))
+
+	auth0Hook.config.ManagementClientID = "m2m"
+	require.True(t, auth0Hook.Provides(mqtt.OnACLCheck))
+	require.True(t, auth0Hook.Provides(mqtt.OnDisconnect))
+	require.False(t, auth0Hook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - Proper config",
+			config:      Options{Domain: testDomain, Audience: testAudience},
+			expectError: false,
+		},
+		{
+			name:        "Success - management api",
+			config:      Options{Domain: testDomain, Audience: testAudience, ManagementClientID: "m2m", ManagementClientSecret: "m2m-secret"},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing audience",
+			config:      Options{Domain: testDomain},
+			expectError: true,
+		},
+		{
+			name:        "Failure - management client without secret",
+			config:      Options{Domain: testDomain, Audience: testAudience, ManagementClientID: "m2m"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if options, ok := tt.config.(Options); ok {
+				options.RoundTripper = &tenant{t: t}
+				tt.config = options
+			}
+
+			auth0Hook := new(Hook)
+			auth0Hook.Log = slog.Default()
+			err := auth0Hook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, auth0Hook.Stop())
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		claims     func() map[string]any
+		expectPass bool
+	}{
+		{
+			name:       "Success - valid token",
+			claims:     func() map[string]any { return userClaims("auth0|alice") },
+			expectPass: true,
+		},
+		{
+			name: "Failure - other audience",
+			claims: func() map[string]any {
+				c := userClaims("auth0|alice")
+				c["aud"] = "https://other.example.com"
+				return c
+			},
+			expectPass: false,
+		},
+		{
+			name: "Failure - other tenant",
+			claims: func() map[string]any {
+				c := userClaims("auth0|alice")
+				c["iss"] = "https://other.auth0.com/"
+				return c
+			},
+			expectPass: false,
+		},
+		{
+			name: "Failure - expired",
+			claims: func() map[string]any {
+				c := userClaims("auth0|alice")
+				c["exp"] = time.Now().Add(-time.Hour).Unix()
+				return c
+			},
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			auth0Hook := newHook(t, &tenant{t: t}, Options{})
+			success := auth0Hook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, connectPacket(signToken(t, tt.claims())))
+			require.Equal(t, tt.expectPass, success)
+
+		})
+	}
+}
+
+func TestOnACLCheck(t *testing.T) {
+	tn := &tenant{
+		t: t,
+		appMetadata: map[string]string{
+			"auth0|alice": `{"plan":"pro","mqtt_acl":{"devices/{sub}/commands":"w","fleet/#":"r"}}`,
+			"auth0|bob":   `{"plan":"free"}`,
+		},
+	}
+
+	auth0Hook := newHook(t, tn, Options{
+		ACL:                    acl.Templates{"clients/{clientid}/#": acl.ReadWrite},
+		ManagementClientID:     "m2m",
+		ManagementClientSecret: "m2m-secret",
+	})
+
+	alice := &mqtt.Client{ID: "alice-laptop"}
+	require.True(t, auth0Hook.OnConnectAuthenticate(alice, connectPacket(signToken(t, userClaims("auth0|alice")))))
+	require.True(t, auth0Hook.OnConnectAuthenticate(&mqtt.Client{ID: "alice-phone"}, connectPacket(signToken(t, userClaims("auth0|alice")))))
+	require.Equal(t, int64(1), tn.lookups.Load(), "app_metadata should be cached")
+
+	bob := &mqtt.Client{ID: "bob"}
+	require.True(t, auth0Hook.OnConnectAuthenticate(bob, connectPacket(signToken(t, userClaims("auth0|bob")))))
+
+	// client credentials tokens have no user and only receive the static templates
+	service := &mqtt.Client{ID: "service"}
+	require.True(t, auth0Hook.OnConnectAuthenticate(service, connectPacket(signToken(t, userClaims("svc@clients")))))
+	require.Equal(t, int64(1), tn.tokens.Load(), "management token should be reused")
+
+	tests := []struct {
+		name       string
+		client     *mqtt.Client
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - static template",
+			client:     alice,
+			topic:      "clients/alice-laptop/status",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - app_metadata template",
+			client:     alice,
+			topic:      "devices/auth0|alice/commands",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - app_metadata read",
+			client:     alice,
+			topic:      "fleet/truck-1",
+			write:      false,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - app_metadata read only",
+			client:     alice,
+			topic:      "fleet/truck-1",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - user without mqtt_acl",
+			client:     bob,
+			topic:      "fleet/truck-1",
+			write:      false,
+			expectPass: false,
+		},
+		{
+			name:       "Success - machine to machine static template",
+			client:     service,
+			topic:      "clients/service/status",
+			write:      true,
+			expectPass: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, auth0Hook.OnACLCheck(tt.client, tt.topic, tt.write))
+
+		})
+	}
+
+	auth0Hook.OnDisconnect(alice, nil, true)
+	require.False(t, auth0Hook.OnACLCheck(alice, "fleet/truck-1", false))
+}
+
+func TestOnConnectAuthenticateManagementError(t *testing.T) {
+	tn := &tenant{t: t, userStatus: http.StatusTooManyRequests}
+	auth0Hook := newHook(t, tn, Options{
+		ManagementClientID:     "m2m",
+		ManagementClientSecret: "m2m-secret",
+	})
+
+	require.False(t, auth0Hook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, connectPacket(signToken(t, userClaims("auth0|alice")))))
+}
+
+func TestManagementTokenRevoked(t *testing.T) {
+	tn := &tenant{t: t, userStatus: http.StatusUnauthorized}
+	auth0Hook := newHook(t, tn, Options{
+		ManagementClientID:     "m2m",
+		ManagementClientSecret: "m2m-secret",
+	})
+
+	token := signToken(t, userClaims("auth0|alice"))
+	require.False(t, auth0Hook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, connectPacket(token)))
+	require.False(t, auth0Hook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, connectPacket(token)))
+	require.Equal(t, int64(2), tn.tokens.Load(), "a rejected management token should be replaced")
+}
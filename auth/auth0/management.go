@@ -0,0 +1,156 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// management is a minimal Auth0 Management API client which reads topic permissions from a user's
+// app_metadata. Both the API access token and the permissions of each user are cached
+type management struct {
+	httpClient   *http.Client
+	baseURL      string
+	clientID     string
+	clientSecret string
+	metadataKey  string
+	token        string
+	tokenExpires time.Time
+	tokenMu      sync.Mutex
+	users        *cache.Cache[string, acl.Templates]
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Templates returns the topic filter templates stored under the metadata key of the user's app_metadata
+func (m *management) Templates(ctx context.Context, userID string) (acl.Templates, error) {
+	if templates, ok := m.users.Get(userID); ok {
+		return templates, nil
+	}
+
+	templates, err := m.fetchTemplates(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.users.Set(userID, templates)
+
+	return templates, nil
+}
+
+func (m *management) fetchTemplates(ctx context.Context, userID string) (acl.Templates, error) {
+	token, err := m.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.baseURL+"/api/v2/users/"+url.PathEscape(userID)+"?fields=app_metadata", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// the token was revoked or rotated before it expired, fetch a new one on the next call
+		m.tokenMu.Lock()
+		m.token = ""
+		m.tokenMu.Unlock()
+	}
+
+	// machine to machine tokens have a sub which is not a user
+	if resp.StatusCode == http.StatusNotFound {
+		return acl.Templates{}, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected management api response status %d", resp.StatusCode)
+	}
+
+	var user struct {
+		AppMetadata map[string]json.RawMessage `json:"app_metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, err
+	}
+
+	raw, ok := user.AppMetadata[m.metadataKey]
+	if !ok {
+		return acl.Templates{}, nil
+	}
+
+	var templates acl.Templates
+	if err := json.Unmarshal(raw, &templates); err != nil {
+		return nil, fmt.Errorf("invalid %s app_metadata: %w", m.metadataKey, err)
+	}
+
+	return templates, nil
+}
+
+// accessToken returns a Management API token obtained with the client credentials grant
+func (m *management) accessToken(ctx context.Context) (string, error) {
+	m.tokenMu.Lock()
+	defer m.tokenMu.Unlock()
+
+	if m.token != "" && time.Now().Before(m.tokenExpires) {
+		return m.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {m.clientID},
+		"client_secret": {m.clientSecret},
+		"audience":      {m.baseURL + "/api/v2/"},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.baseURL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("unexpected token response status %d", resp.StatusCode)
+	}
+
+	var out tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+
+	if out.AccessToken == "" {
+		return "", errors.New("token response without access_token")
+	}
+
+	// renew a minute early so a token never expires in flight
+	m.token = out.AccessToken
+	m.tokenExpires = time.Now().Add(time.Duration(out.ExpiresIn)*time.Second - time.Minute)
+	return m.token, nil
+}
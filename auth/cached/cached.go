@@ -0,0 +1,218 @@
+package cached
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/auth/composite"
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// Hook is a hook that caches the results of an auth hook, eg. one which asks a remote service, and
+// deduplicates concurrent identical checks, so the backend is asked once for each
+type Hook struct {
+	config   Options
+	results  *cache.Cache[string, bool]
+	inflight map[string]*call
+	now      func() time.Time
+	mu       sync.Mutex
+	mqtt.HookBase
+}
+
+// call is a check in progress, which concurrent identical checks wait for
+type call struct {
+	done    chan struct{}
+	allowed bool
+	err     error
+}
+
+// Options is a struct that contains all the information required to configure the cached hook
+type Options struct {
+	// Hook is the wrapped auth hook, initialized with Config. It is initialized and stopped by the
+	// cached hook, so must not also be added to the server
+	Hook   mqtt.Hook
+	Config any
+
+	// TTL is how long allowed results are cached, defaults to 1 minute. NegativeTTL is how long denied
+	// results are cached, and 0 doesn't cache them. Failures reported by hooks implementing
+	// composite.Authenticator are never cached
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	// MaxEntries is how many results are cached before the least recently used are evicted, and
+	// defaults to 100000
+	MaxEntries int
+
+	// ACLOnly caches only the ACL checks, for hooks which keep state for each client they authenticate,
+	// eg. the rules of LDAP users, so must authenticate every client themselves
+	ACLOnly bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "cached-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook, which the wrapped hook must also
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b}) && h.config.Hook != nil && h.config.Hook.Provides(b)
+}
+
+// Init initializes the hook and the wrapped hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	cachedHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if cachedHookConfig.Hook == nil {
+		return errors.New("hook is required")
+	}
+
+	if cachedHookConfig.TTL <= 0 {
+		cachedHookConfig.TTL = time.Minute
+	}
+
+	if cachedHookConfig.MaxEntries <= 0 {
+		cachedHookConfig.MaxEntries = 100000
+	}
+
+	cachedHookConfig.Hook.SetOpts(h.Log, h.Opts)
+	if err := cachedHookConfig.Hook.Init(cachedHookConfig.Config); err != nil {
+		return fmt.Errorf("failed initialising %s hook: %w", cachedHookConfig.Hook.ID(), err)
+	}
+
+	h.config = cachedHookConfig
+	h.inflight = make(map[string]*call)
+	h.now = time.Now
+	h.results = cache.New[string, bool](cache.Options{
+		MaxEntries: cachedHookConfig.MaxEntries,
+		Now:        func() time.Time { return h.now() },
+	})
+	return nil
+}
+
+// Stop stops the wrapped hook
+func (h *Hook) Stop() error {
+	if h.config.Hook == nil {
+		return nil
+	}
+	return h.config.Hook.Stop()
+}
+
+// Purge forgets the cached results, eg. after changing permissions in the backend
+func (h *Hook) Purge() {
+	h.results.Purge()
+}
+
+// check returns the cached result of the key, or asks the wrapped hook with fn. Concurrent checks of
+// the same key wait for the first
+func (h *Hook) check(key string, fn func() (bool, error)) (bool, error) {
+	if allowed, ok := h.results.Get(key); ok {
+		return allowed, nil
+	}
+
+	h.mu.Lock()
+	if c, ok := h.inflight[key]; ok {
+		h.mu.Unlock()
+		<-c.done
+		return c.allowed, c.err
+	}
+
+	c := &call{done: make(chan struct{})}
+	h.inflight[key] = c
+	h.mu.Unlock()
+
+	c.allowed, c.err = fn()
+
+	h.store(key, c.allowed, c.err)
+
+	h.mu.Lock()
+	delete(h.inflight, key)
+	h.mu.Unlock()
+	close(c.done)
+
+	return c.allowed, c.err
+}
+
+// store caches the result for the TTL of allowed or denied results
+func (h *Hook) store(key string, allowed bool, err error) {
+	ttl := h.config.TTL
+	if !allowed {
+		ttl = h.config.NegativeTTL
+	}
+
+	if err != nil || ttl <= 0 {
+		return
+	}
+
+	h.results.SetTTL(key, allowed, ttl)
+}
+
+// hash returns a key for the fields which doesn't retain them, as they may contain passwords
+func hash(fields ...string) string {
+	sum := sha256.New()
+	for _, f := range fields {
+		sum.Write([]byte(strconv.Itoa(len(f))))
+		sum.Write([]byte{':'})
+		sum.Write([]byte(f))
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// Authenticate authenticates the client, passing on failures of the wrapped hook, so the cached hook
+// can itself be a backend of the composite hook
+func (h *Hook) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	authenticate := func() (bool, error) {
+		if a, ok := h.config.Hook.(composite.Authenticator); ok {
+			return a.Authenticate(cl, pk)
+		}
+		return h.config.Hook.OnConnectAuthenticate(cl, pk), nil
+	}
+
+	if h.config.ACLOnly {
+		return authenticate()
+	}
+
+	return h.check(hash("auth", string(pk.Connect.Username), string(pk.Connect.Password), cl.ID), authenticate)
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ok, err := h.Authenticate(cl, pk)
+	if err != nil {
+		h.Log.Error("error occurred while authenticating client", "error", err, "client", cl.ID)
+	}
+	return ok
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	key := hash("acl", string(cl.Properties.Username), cl.ID, topic, strconv.FormatBool(write))
+	ok, _ := h.check(key, func() (bool, error) {
+		return h.config.Hook.OnACLCheck(cl, topic, write), nil
+	})
+	return ok
+}
+
+// OnDisconnect is called when a client disconnects, and is passed on to the wrapped hook
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.config.Hook.OnDisconnect(cl, err, expire)
+}
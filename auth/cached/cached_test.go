@@ -0,0 +1,294 @@
+package cached
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBackend allows the password "password" and the topics in allowed, and counts how often it is asked
+type fakeBackend struct {
+	allowed      map[string]bool
+	auths        atomic.Int32
+	acls         atomic.Int32
+	release      chan struct{} // blocks checks until closed if set
+	initErr      error
+	stopped      bool
+	disconnected int
+	mqtt.HookBase
+}
+
+func (b *fakeBackend) ID() string {
+	return "fake"
+}
+
+func (b *fakeBackend) Provides(hook byte) bool {
+	return hook == mqtt.OnConnectAuthenticate || hook == mqtt.OnACLCheck
+}
+
+func (b *fakeBackend) Init(config any) error {
+	return b.initErr
+}
+
+func (b *fakeBackend) Stop() error {
+	b.stopped = true
+	return nil
+}
+
+func (b *fakeBackend) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	b.auths.Add(1)
+	if b.release != nil {
+		<-b.release
+	}
+	return string(pk.Connect.Password) == "password"
+}
+
+func (b *fakeBackend) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	b.acls.Add(1)
+	return b.allowed[topic]
+}
+
+func (b *fakeBackend) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	b.disconnected++
+}
+
+// fallibleBackend fails to authenticate every client while down
+type fallibleBackend struct {
+	down bool
+	fakeBackend
+}
+
+func (b *fallibleBackend) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	if b.down {
+		b.auths.Add(1)
+		return false, errors.New("backend unavailable")
+	}
+	return b.OnConnectAuthenticate(cl, pk), nil
+}
+
+func connectPacket(username, pass string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username: []byte(username),
+			Password: []byte(pass),
+		},
+	}
+}
+
+func client(id, username string) *mqtt.Client {
+	cl := &mqtt.Client{ID: id}
+	cl.Properties.Username = []byte(username)
+	return cl
+}
+
+func newHook(t *testing.T, options Options) (*Hook, *time.Time) {
+	t.Helper()
+
+	cachedHook := new(Hook)
+	cachedHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, cachedHook.Init(options))
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cachedHook.now = func() time.Time { return now }
+	return cachedHook, &now
+}
+
+func TestID(t *testing.T) {
+	cachedHook := new(Hook)
+
+	require.Equal(t, "cached-auth-hook", cachedHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	cachedHook, _ := newHook(t, Options{Hook: new(fakeBackend)})
+	require.True(t, cachedHook.Provides(mqtt.OnACLCheck))
+	require.True(t, cachedHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, cachedHook.Provides(mqtt.OnDisconnect))
+	require.False(t, cachedHook.Provides(mqtt.OnPublish))
+	require.False(t, new(Hook).Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - hook",
+			config:      Options{Hook: new(fakeBackend)},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no hook",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - hook fails",
+			config:      Options{Hook: &fakeBackend{initErr: errors.New("unreachable")}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cachedHook := new(Hook)
+			cachedHook.Log = slog.Default()
+			err := cachedHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, time.Minute, cachedHook.config.TTL)
+
+		})
+	}
+}
+
+func TestStop(t *testing.T) {
+	backend := new(fakeBackend)
+	cachedHook, _ := newHook(t, Options{Hook: backend})
+	require.NoError(t, cachedHook.Stop())
+	require.True(t, backend.stopped)
+
+	require.NoError(t, new(Hook).Stop())
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	backend := new(fakeBackend)
+	cachedHook, now := newHook(t, Options{Hook: backend, TTL: time.Minute, NegativeTTL: 10 * time.Second})
+
+	for i := 0; i < 3; i++ {
+		require.True(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "password")))
+		require.False(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "wrong")))
+	}
+	require.Equal(t, int32(2), backend.auths.Load())
+
+	// other clients of the user are checked separately
+	require.True(t, cachedHook.OnConnectAuthenticate(client("b", "alice"), connectPacket("alice", "password")))
+	require.Equal(t, int32(3), backend.auths.Load())
+
+	// denials expire first
+	*now = now.Add(30 * time.Second)
+	require.True(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "password")))
+	require.False(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "wrong")))
+	require.Equal(t, int32(4), backend.auths.Load())
+
+	*now = now.Add(time.Minute)
+	require.True(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "password")))
+	require.Equal(t, int32(5), backend.auths.Load())
+
+	// passwords are not kept
+	_, ok := cachedHook.results.Get(hash("auth", "alice", "password", "a"))
+	require.True(t, ok)
+
+	cachedHook.Purge()
+	require.True(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "password")))
+	require.Equal(t, int32(6), backend.auths.Load())
+}
+
+func TestNoNegativeCaching(t *testing.T) {
+	backend := new(fakeBackend)
+	cachedHook, _ := newHook(t, Options{Hook: backend})
+
+	require.False(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "wrong")))
+	require.False(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "wrong")))
+	require.Equal(t, int32(2), backend.auths.Load())
+}
+
+func TestFailuresNotCached(t *testing.T) {
+	backend := &fallibleBackend{down: true}
+	cachedHook, _ := newHook(t, Options{Hook: backend, NegativeTTL: time.Minute})
+
+	ok, err := cachedHook.Authenticate(client("a", "alice"), connectPacket("alice", "password"))
+	require.Error(t, err)
+	require.False(t, ok)
+	require.False(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "password")))
+
+	backend.down = false
+	require.True(t, cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "password")))
+	require.Equal(t, int32(3), backend.auths.Load())
+}
+
+func TestSingleFlight(t *testing.T) {
+	backend := &fakeBackend{release: make(chan struct{})}
+	cachedHook, _ := newHook(t, Options{Hook: backend})
+
+	var wg sync.WaitGroup
+	results := make([]bool, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cachedHook.OnConnectAuthenticate(client("a", "alice"), connectPacket("alice", "password"))
+		}(i)
+	}
+
+	require.Eventually(t, func() bool {
+		cachedHook.mu.Lock()
+		defer cachedHook.mu.Unlock()
+		return len(cachedHook.inflight) == 1 && backend.auths.Load() == 1
+	}, time.Second, time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), backend.auths.Load())
+	for _, ok := range results {
+		require.True(t, ok)
+	}
+}
+
+func TestOnACLCheck(t *testing.T) {
+	backend := &fakeBackend{allowed: map[string]bool{"a/b": true}}
+	cachedHook, now := newHook(t, Options{Hook: backend, NegativeTTL: time.Minute, ACLOnly: true})
+
+	cl := client("a", "alice")
+	for i := 0; i < 3; i++ {
+		require.True(t, cachedHook.OnACLCheck(cl, "a/b", true))
+		require.False(t, cachedHook.OnACLCheck(cl, "c/d", true))
+	}
+	require.Equal(t, int32(2), backend.acls.Load())
+
+	// reads, and other clients, are checked separately
+	require.True(t, cachedHook.OnACLCheck(cl, "a/b", false))
+	require.True(t, cachedHook.OnACLCheck(client("b", "alice"), "a/b", true))
+	require.Equal(t, int32(4), backend.acls.Load())
+
+	// expired results are checked again
+	*now = now.Add(2 * time.Minute)
+	require.True(t, cachedHook.OnACLCheck(cl, "a/b", true))
+	require.Equal(t, int32(5), backend.acls.Load())
+
+	// with ACLOnly, every client is authenticated by the wrapped hook
+	require.True(t, cachedHook.OnConnectAuthenticate(cl, connectPacket("alice", "password")))
+	require.True(t, cachedHook.OnConnectAuthenticate(cl, connectPacket("alice", "password")))
+	require.Equal(t, int32(2), backend.auths.Load())
+}
+
+func TestOnDisconnect(t *testing.T) {
+	backend := new(fakeBackend)
+	cachedHook, _ := newHook(t, Options{Hook: backend})
+	cachedHook.OnDisconnect(client("a", "alice"), nil, true)
+	require.Equal(t, 1, backend.disconnected)
+}
@@ -0,0 +1,252 @@
+package cognito
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/auth/jwt"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+const (
+	// TokenUseID accepts only ID tokens
+	TokenUseID = "id"
+
+	// TokenUseAccess accepts only access tokens
+	TokenUseAccess = "access"
+)
+
+var (
+	// ErrInvalidTokenUse indicates the token_use claim does not match the configured token type
+	ErrInvalidTokenUse = errors.New("invalid token use")
+
+	// ErrInvalidClient indicates the token was issued to an app client which is not allowed
+	ErrInvalidClient = errors.New("invalid app client")
+)
+
+// GroupResolver looks up the groups of a user pool user, eg. by calling AdminListGroupsForUser with the
+// AWS SDK. It is used when group membership should not be taken from the cognito:groups claim, which
+// is frozen at the time the token was issued
+type GroupResolver interface {
+	Groups(ctx context.Context, username string) ([]string, error)
+}
+
+// Hook is a hook that authenticates clients presenting a Cognito user pool ID or access token as their
+// password, and maps the user's Cognito groups to topic ACL templates
+type Hook struct {
+	config    Options
+	jwks      *jwt.JWKS
+	validator jwt.Validator
+	sessions  acl.Sessions
+	cancel    context.CancelFunc
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the Cognito hook.
+// It is the responsibility of the configurer to pass a properly configured RoundTripper that takes
+// care of other requirements such as timeouts, proxies, etc
+type Options struct {
+	Region     string   // AWS region of the user pool, eg. eu-west-1
+	UserPoolID string   // eg. eu-west-1_AbCdEf123
+	ClientIDs  []string // if set, the token must have been issued to one of these app clients
+	TokenUse   string   // TokenUseID or TokenUseAccess, either is accepted if empty
+	Leeway     time.Duration
+
+	JWKSRefreshInterval time.Duration     // defaults to 1 hour
+	RoundTripper        http.RoundTripper // used for JWKS requests, http.DefaultTransport if nil
+
+	// GroupResolver, if set, is asked for the user's groups instead of reading the cognito:groups claim
+	GroupResolver GroupResolver
+	GroupTimeout  time.Duration // bounds each GroupResolver call, defaults to 5 seconds
+
+	// ACL holds templates granted to every authenticated user and GroupACL the templates granted to
+	// members of each group. Templates may reference {clientid}, {username}, {sub} and any scalar claim
+	ACL      acl.Templates
+	GroupACL map[string]acl.Templates
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "cognito-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if len(h.config.ACL) == 0 && len(h.config.GroupACL) == 0 {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	cognitoHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if cognitoHookConfig.Region == "" || cognitoHookConfig.UserPoolID == "" {
+		return errors.New("region and user pool id are required")
+	}
+
+	switch cognitoHookConfig.TokenUse {
+	case "", TokenUseID, TokenUseAccess:
+	default:
+		return fmt.Errorf("unknown token use %q", cognitoHookConfig.TokenUse)
+	}
+
+	if cognitoHookConfig.JWKSRefreshInterval <= 0 {
+		cognitoHookConfig.JWKSRefreshInterval = time.Hour
+	}
+
+	if cognitoHookConfig.GroupTimeout <= 0 {
+		cognitoHookConfig.GroupTimeout = 5 * time.Second
+	}
+
+	issuer := Issuer(cognitoHookConfig.Region, cognitoHookConfig.UserPoolID)
+	jwksURL, err := url.Parse(issuer + "/.well-known/jwks.json")
+	if err != nil {
+		return err
+	}
+
+	h.config = cognitoHookConfig
+	h.validator = jwt.Validator{
+		Issuer: issuer,
+		Leeway: cognitoHookConfig.Leeway,
+	}
+	h.jwks = jwt.NewJWKS(jwksURL, cognitoHookConfig.RoundTripper, time.Minute)
+
+	// a failed initial fetch is not fatal, the keys are fetched again on the first unknown kid
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	if err := h.jwks.Refresh(ctx); err != nil {
+		h.Log.Error("error occurred while fetching jwks", "error", err)
+	}
+
+	go h.jwks.Run(ctx, cognitoHookConfig.JWKSRefreshInterval, func(err error) {
+		h.Log.Error("error occurred while refreshing jwks", "error", err)
+	})
+
+	return nil
+}
+
+// Issuer returns the iss claim of tokens issued by the user pool
+func Issuer(region, userPoolID string) string {
+	return "https://cognito-idp." + region + ".amazonaws.com/" + userPoolID
+}
+
+// Stop stops refreshing the JWKS
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	token, err := jwt.Parse(string(pk.Connect.Password), h.jwks.Key)
+	if err != nil {
+		h.Log.Debug("token verification failed", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if err := h.validate(token.Claims); err != nil {
+		h.Log.Debug("token validation failed", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if len(h.config.ACL) == 0 && len(h.config.GroupACL) == 0 {
+		return true
+	}
+
+	username := username(token.Claims)
+	groups := token.Claims.Strings("cognito:groups")
+	if h.config.GroupResolver != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), h.config.GroupTimeout)
+		defer cancel()
+
+		groups, err = h.config.GroupResolver.Groups(ctx, username)
+		if err != nil {
+			h.Log.Error("error occurred while resolving cognito groups", "error", err)
+			return false
+		}
+	}
+
+	values := token.Claims.Values()
+	values["clientid"] = cl.ID
+	values["username"] = username
+
+	filters := h.config.ACL.Render(values)
+	for _, group := range groups {
+		filters.Merge(h.config.GroupACL[group].Render(values))
+	}
+	h.sessions.Set(cl, filters)
+
+	return true
+}
+
+// validate checks the registered claims, the token type and the app client of a verified token
+func (h *Hook) validate(claims jwt.Claims) error {
+	if err := h.validator.Validate(claims); err != nil {
+		return err
+	}
+
+	// ID tokens carry the app client in aud, access tokens in client_id
+	var clientID string
+	switch claims.String("token_use") {
+	case TokenUseID:
+		clientID = claims.String("aud")
+	case TokenUseAccess:
+		clientID = claims.String("client_id")
+	default:
+		return ErrInvalidTokenUse
+	}
+
+	if h.config.TokenUse != "" && claims.String("token_use") != h.config.TokenUse {
+		return ErrInvalidTokenUse
+	}
+
+	if len(h.config.ClientIDs) > 0 && !slices.Contains(h.config.ClientIDs, clientID) {
+		return ErrInvalidClient
+	}
+
+	return nil
+}
+
+// username returns the user pool username, which ID tokens carry in cognito:username and access
+// tokens in username
+func username(claims jwt.Claims) string {
+	if name := claims.String("cognito:username"); name != "" {
+		return name
+	}
+	return claims.String("username")
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
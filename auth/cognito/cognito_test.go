@@ -0,0 +1,326 @@
+package cognito
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/auth/jwt"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+const (
+	testRegion = "eu-west-1"
+	testPoolID = "eu-west-1_AbCdEf123"
+	testClient = "app-client"
+)
+
+var testKey *rsa.PrivateKey
+
+func init() {
+	testKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// jwksRoundTripper serves the test key as the user pool's JWKS document
+type jwksRoundTripper struct {
+	t *testing.T
+}
+
+func (rt jwksRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	require.Equal(rt.t, Issuer(testRegion, testPoolID)+"/.well-known/jwks.json", req.URL.String())
+
+	body, err := json.Marshal(map[string]any{"keys": []jwt.JWK{{
+		KeyType: "RSA",
+		KeyID:   "key-1",
+		Use:     "sig",
+		N:       base64.RawURLEncoding.EncodeToString(testKey.N.Bytes()),
+		E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(testKey.E)).Bytes()),
+	}}})
+	require.NoError(rt.t, err)
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(string(body))),
+	}, nil
+}
+
+type groupResolverFunc func(ctx context.Context, username string) ([]string, error)
+
+func (f groupResolverFunc) Groups(ctx context.Context, username string) ([]string, error) {
+	return f(ctx, username)
+}
+
+// signToken creates an RS256 token signed by the test key
+func signToken(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	hb, err := json.Marshal(jwt.Header{Algorithm: "RS256", KeyID: "key-1", Type: "JWT"})
+	require.NoError(t, err)
+	cb, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	input := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, testKey, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func idClaims() map[string]any {
+	return map[string]any{
+		"iss":              Issuer(testRegion, testPoolID),
+		"sub":              "0000-1111",
+		"aud":              testClient,
+		"token_use":        "id",
+		"cognito:username": "alice",
+		"cognito:groups":   []string{"operators"},
+		"exp":              time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func accessClaims() map[string]any {
+	return map[string]any{
+		"iss":            Issuer(testRegion, testPoolID),
+		"sub":            "0000-1111",
+		"client_id":      testClient,
+		"token_use":      "access",
+		"username":       "alice",
+		"cognito:groups": []string{"viewers"},
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	options.Region = testRegion
+	options.UserPoolID = testPoolID
+	options.RoundTripper = jwksRoundTripper{t: t}
+
+	cognitoHook := new(Hook)
+	cognitoHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, cognitoHook.Init(options))
+	t.Cleanup(func() { cognitoHook.Stop() })
+	return cognitoHook
+}
+
+func TestID(t *testing.T) {
+	cognitoHook := new(Hook)
+
+	require.Equal(t, "cognito-auth-hook", cognitoHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	cognitoHook := new(Hook)
+	require.True(t, cognitoHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, cognitoHook.Provides(mqtt.OnACLCheck))
+
+	cognitoHook.config.GroupACL = map[string]acl.Templates{"operators": {"#": acl.ReadWrite}}
+	require.True(t, cognitoHook.Provides(mqtt.OnACLCheck))
+	require.True(t, cognitoHook.Provides(mqtt.OnDisconnect))
+	require.False(t, cognitoHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - Proper config",
+			config:      Options{Region: testRegion, UserPoolID: testPoolID, TokenUse: TokenUseAccess},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing user pool",
+			config:      Options{Region: testRegion},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown token use",
+			config:      Options{Region: testRegion, UserPoolID: testPoolID, TokenUse: "refresh"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if options, ok := tt.config.(Options); ok {
+				options.RoundTripper = jwksRoundTripper{t: t}
+				tt.config = options
+			}
+
+			cognitoHook := new(Hook)
+			cognitoHook.Log = slog.Default()
+			err := cognitoHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, cognitoHook.Stop())
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    Options
+		claims     func() map[string]any
+		expectPass bool
+	}{
+		{
+			name:       "Success - id token",
+			options:    Options{ClientIDs: []string{testClient}},
+			claims:     idClaims,
+			expectPass: true,
+		},
+		{
+			name:       "Success - access token",
+			options:    Options{ClientIDs: []string{testClient}},
+			claims:     accessClaims,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - wrong token use",
+			options:    Options{TokenUse: TokenUseAccess},
+			claims:     idClaims,
+			expectPass: false,
+		},
+		{
+			name:    "Failure - missing token use",
+			options: Options{},
+			claims: func() map[string]any {
+				c := idClaims()
+				delete(c, "token_use")
+				return c
+			},
+			expectPass: false,
+		},
+		{
+			name:       "Failure - other app client",
+			options:    Options{ClientIDs: []string{"other-client"}},
+			claims:     accessClaims,
+			expectPass: false,
+		},
+		{
+			name:    "Failure - other user pool",
+			options: Options{},
+			claims: func() map[string]any {
+				c := idClaims()
+				c["iss"] = Issuer(testRegion, "eu-west-1_Other")
+				return c
+			},
+			expectPass: false,
+		},
+		{
+			name:    "Failure - expired",
+			options: Options{},
+			claims: func() map[string]any {
+				c := accessClaims()
+				c["exp"] = time.Now().Add(-time.Hour).Unix()
+				return c
+			},
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cognitoHook := newHook(t, tt.options)
+			success := cognitoHook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, packets.Packet{
+				Connect: packets.ConnectParams{Password: []byte(signToken(t, tt.claims()))},
+			})
+			require.Equal(t, tt.expectPass, success)
+
+		})
+	}
+}
+
+func TestOnACLCheck(t *testing.T) {
+	options := Options{
+		ACL: acl.Templates{"users/{username}/#": acl.ReadWrite},
+		GroupACL: map[string]acl.Templates{
+			"operators": {"commands/{clientid}": acl.WriteOnly},
+			"viewers":   {"telemetry/#": acl.ReadOnly},
+		},
+	}
+
+	t.Run("Success - groups from id token claim", func(t *testing.T) {
+		cognitoHook := newHook(t, options)
+		cl := &mqtt.Client{ID: "device-1"}
+		require.True(t, cognitoHook.OnConnectAuthenticate(cl, packets.Packet{
+			Connect: packets.ConnectParams{Password: []byte(signToken(t, idClaims()))},
+		}))
+
+		require.True(t, cognitoHook.OnACLCheck(cl, "users/alice/inbox", true))
+		require.True(t, cognitoHook.OnACLCheck(cl, "commands/device-1", true))
+		require.False(t, cognitoHook.OnACLCheck(cl, "commands/device-2", true))
+		require.False(t, cognitoHook.OnACLCheck(cl, "telemetry/device-1", false))
+
+		cognitoHook.OnDisconnect(cl, nil, true)
+		require.False(t, cognitoHook.OnACLCheck(cl, "users/alice/inbox", true))
+	})
+
+	t.Run("Success - groups from resolver", func(t *testing.T) {
+		options := options
+		options.GroupResolver = groupResolverFunc(func(ctx context.Context, username string) ([]string, error) {
+			require.Equal(t, "alice", username)
+			return []string{"viewers"}, nil
+		})
+
+		cognitoHook := newHook(t, options)
+		cl := &mqtt.Client{ID: "device-1"}
+		require.True(t, cognitoHook.OnConnectAuthenticate(cl, packets.Packet{
+			Connect: packets.ConnectParams{Password: []byte(signToken(t, idClaims()))},
+		}))
+
+		require.True(t, cognitoHook.OnACLCheck(cl, "telemetry/device-1", false))
+		require.False(t, cognitoHook.OnACLCheck(cl, "commands/device-1", true))
+	})
+
+	t.Run("Error - resolver failure", func(t *testing.T) {
+		options := options
+		options.GroupResolver = groupResolverFunc(func(ctx context.Context, username string) ([]string, error) {
+			return nil, errors.New("throttled")
+		})
+
+		cognitoHook := newHook(t, options)
+		require.False(t, cognitoHook.OnConnectAuthenticate(&mqtt.Client{ID: "device-1"}, packets.Packet{
+			Connect: packets.ConnectParams{Password: []byte(signToken(t, accessClaims()))},
+		}))
+	})
+}
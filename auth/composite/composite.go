@@ -0,0 +1,208 @@
+package composite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Mode is how the results of the backends are combined
+type Mode int
+
+const (
+	FirstAllow      Mode = iota // the first backend which allows the client authenticates it
+	AllAllow                    // every backend must allow the client
+	FallbackOnError             // the first backend which doesn't fail decides, so later backends are only asked if earlier ones are unavailable
+)
+
+// Authenticator is implemented by hooks which report failing to authenticate a client, eg. because
+// their backend is unreachable, separately from rejecting it. The results of other hooks are final
+type Authenticator interface {
+	Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error)
+}
+
+// Backend is an auth hook wrapped by the composite hook, and the config it is initialized with
+type Backend struct {
+	Hook   mqtt.Hook
+	Config any
+}
+
+// Hook is a hook that chains several auth hooks, combining their results according to its mode, eg.
+// so that JWT authentication can fall back to the file hook for legacy devices. Topics are authorized
+// by the backends which authenticated the client
+type Hook struct {
+	config  Options
+	clients map[*mqtt.Client][]mqtt.Hook // the backends which authenticated each client
+	mu      sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the composite hook
+type Options struct {
+	// Backends are the wrapped hooks in the order they are asked. They are initialized and stopped by
+	// the composite hook, so must not also be added to the server
+	Backends []Backend
+	Mode     Mode
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "composite-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook and its backends with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	compositeHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if len(compositeHookConfig.Backends) == 0 {
+		return errors.New("backends are required")
+	}
+
+	if compositeHookConfig.Mode < FirstAllow || compositeHookConfig.Mode > FallbackOnError {
+		return errors.New("unsupported mode")
+	}
+
+	for i, b := range compositeHookConfig.Backends {
+		if b.Hook == nil || !b.Hook.Provides(mqtt.OnConnectAuthenticate) {
+			return fmt.Errorf("backend %d is not an auth hook", i)
+		}
+
+		b.Hook.SetOpts(h.Log, h.Opts)
+		if err := b.Hook.Init(b.Config); err != nil {
+			// stop the backends already started, eg. their background refreshes
+			for _, started := range compositeHookConfig.Backends[:i] {
+				started.Hook.Stop()
+			}
+			return fmt.Errorf("failed initialising %s hook: %w", b.Hook.ID(), err)
+		}
+	}
+
+	h.config = compositeHookConfig
+	h.clients = make(map[*mqtt.Client][]mqtt.Hook)
+	return nil
+}
+
+// Stop stops the backends
+func (h *Hook) Stop() error {
+	var errs []error
+	for _, b := range h.config.Backends {
+		errs = append(errs, b.Hook.Stop())
+	}
+	return errors.Join(errs...)
+}
+
+// authenticate asks the backend to authenticate the client
+func authenticate(hook mqtt.Hook, cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	if a, ok := hook.(Authenticator); ok {
+		return a.Authenticate(cl, pk)
+	}
+	return hook.OnConnectAuthenticate(cl, pk), nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server, and asks the
+// backends to authenticate it
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	var allowed []mqtt.Hook
+	for _, b := range h.config.Backends {
+		ok, err := authenticate(b.Hook, cl, pk)
+		if err != nil {
+			h.Log.Error("error occurred while authenticating client", "error", err, "client", cl.ID, "backend", b.Hook.ID())
+		}
+
+		if ok {
+			allowed = append(allowed, b.Hook)
+		}
+
+		if h.config.Mode == AllAllow && !ok {
+			h.release(cl, allowed)
+			return false
+		}
+
+		if h.config.Mode == FirstAllow && ok {
+			break
+		}
+
+		if h.config.Mode == FallbackOnError && err == nil {
+			break
+		}
+	}
+
+	if len(allowed) == 0 {
+		return false
+	}
+
+	h.mu.Lock()
+	h.clients[cl] = allowed
+	h.mu.Unlock()
+	return true
+}
+
+// release tells the backends which allowed the client that it isn't connecting, so they drop any state
+// they hold for it
+func (h *Hook) release(cl *mqtt.Client, backends []mqtt.Hook) {
+	for _, hook := range backends {
+		if hook.Provides(mqtt.OnDisconnect) {
+			hook.OnDisconnect(cl, packets.ErrNotAuthorized, true)
+		}
+	}
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic, and allows it if
+// the backends which authenticated the client allow it. With AllAllow, every one of them must
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	h.mu.Lock()
+	backends := h.clients[cl]
+	h.mu.Unlock()
+
+	allowed := false
+	for _, hook := range backends {
+		if !hook.Provides(mqtt.OnACLCheck) {
+			continue
+		}
+
+		ok := hook.OnACLCheck(cl, topic, write)
+		if ok && h.config.Mode != AllAllow {
+			return true
+		}
+
+		if !ok && h.config.Mode == AllAllow {
+			return false
+		}
+		allowed = allowed || ok
+	}
+
+	return allowed
+}
+
+// OnDisconnect is called when a client disconnects, and is passed on to the backends
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	delete(h.clients, cl)
+	h.mu.Unlock()
+
+	for _, b := range h.config.Backends {
+		if b.Hook.Provides(mqtt.OnDisconnect) {
+			b.Hook.OnDisconnect(cl, err, expire)
+		}
+	}
+}
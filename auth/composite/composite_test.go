@@ -0,0 +1,291 @@
+package composite
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/auth/anonymous"
+	auth "github.com/mochi-mqtt/hooks/auth/http"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// fakeBackend allows the usernames it knows, and grants them their topics
+type fakeBackend struct {
+	id           string
+	users        map[string][]string
+	initErr      error
+	initialized  bool
+	stopped      bool
+	disconnected []string
+	mqtt.HookBase
+}
+
+func (b *fakeBackend) ID() string {
+	return b.id
+}
+
+func (b *fakeBackend) Provides(hook byte) bool {
+	return hook == mqtt.OnConnectAuthenticate || hook == mqtt.OnACLCheck || hook == mqtt.OnDisconnect
+}
+
+func (b *fakeBackend) Init(config any) error {
+	b.initialized = true
+	return b.initErr
+}
+
+func (b *fakeBackend) Stop() error {
+	b.stopped = true
+	return nil
+}
+
+func (b *fakeBackend) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	_, ok := b.users[string(pk.Connect.Username)]
+	return ok
+}
+
+func (b *fakeBackend) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	for _, t := range b.users[string(cl.Properties.Username)] {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *fakeBackend) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	b.disconnected = append(b.disconnected, cl.ID)
+}
+
+// fallibleBackend fails to authenticate every client while down
+type fallibleBackend struct {
+	down bool
+	fakeBackend
+}
+
+func (b *fallibleBackend) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	if b.down {
+		return false, errors.New("backend unavailable")
+	}
+	return b.OnConnectAuthenticate(cl, pk), nil
+}
+
+func connectPacket(username, pass string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username: []byte(username),
+			Password: []byte(pass),
+		},
+	}
+}
+
+func client(id, username string) *mqtt.Client {
+	cl := &mqtt.Client{ID: id}
+	cl.Properties.Username = []byte(username)
+	return cl
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	compositeHook := new(Hook)
+	compositeHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, compositeHook.Init(options))
+	t.Cleanup(func() { compositeHook.Stop() })
+	return compositeHook
+}
+
+func TestID(t *testing.T) {
+	compositeHook := new(Hook)
+
+	require.Equal(t, "composite-auth-hook", compositeHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	compositeHook := new(Hook)
+	require.True(t, compositeHook.Provides(mqtt.OnACLCheck))
+	require.True(t, compositeHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, compositeHook.Provides(mqtt.OnDisconnect))
+	require.False(t, compositeHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - backends",
+			config:      Options{Backends: []Backend{{Hook: &fakeBackend{id: "a"}}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no backends",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unsupported mode",
+			config:      Options{Backends: []Backend{{Hook: &fakeBackend{id: "a"}}}, Mode: 7},
+			expectError: true,
+		},
+		{
+			name:        "Failure - not an auth hook",
+			config:      Options{Backends: []Backend{{Hook: new(mqtt.HookBase)}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			compositeHook := new(Hook)
+			compositeHook.Log = slog.Default()
+			err := compositeHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestInitBackends(t *testing.T) {
+	a := &fakeBackend{id: "a"}
+	b := &fakeBackend{id: "b", initErr: errors.New("unreachable")}
+	c := &fakeBackend{id: "c"}
+
+	compositeHook := new(Hook)
+	compositeHook.Log = slog.Default()
+	err := compositeHook.Init(Options{Backends: []Backend{{Hook: a}, {Hook: b}, {Hook: c}}})
+	require.ErrorContains(t, err, "failed initialising b hook")
+	require.True(t, a.stopped)
+	require.False(t, c.initialized)
+
+	// backends share the logger of the composite hook
+	compositeHook = newHook(t, Options{Backends: []Backend{{Hook: c}}})
+	require.Same(t, compositeHook.Log, c.Log)
+	require.NoError(t, compositeHook.Stop())
+	require.True(t, c.stopped)
+}
+
+func TestFirstAllow(t *testing.T) {
+	jwt := &fakeBackend{id: "jwt", users: map[string][]string{"alice": {"a"}, "bob": {"b"}}}
+	file := &fakeBackend{id: "file", users: map[string][]string{"bob": {"b2"}, "legacy": {"l"}}}
+	compositeHook := newHook(t, Options{Backends: []Backend{{Hook: jwt}, {Hook: file}}})
+
+	alice := client("alice", "alice")
+	require.True(t, compositeHook.OnConnectAuthenticate(alice, connectPacket("alice", "")))
+	require.True(t, compositeHook.OnACLCheck(alice, "a", true))
+
+	// bob is authorized by the backend which authenticated him
+	bob := client("bob", "bob")
+	require.True(t, compositeHook.OnConnectAuthenticate(bob, connectPacket("bob", "")))
+	require.True(t, compositeHook.OnACLCheck(bob, "b", true))
+	require.False(t, compositeHook.OnACLCheck(bob, "b2", true))
+
+	legacy := client("legacy", "legacy")
+	require.True(t, compositeHook.OnConnectAuthenticate(legacy, connectPacket("legacy", "")))
+	require.True(t, compositeHook.OnACLCheck(legacy, "l", true))
+
+	require.False(t, compositeHook.OnConnectAuthenticate(client("eve", "eve"), connectPacket("eve", "")))
+
+	compositeHook.OnDisconnect(legacy, nil, true)
+	require.False(t, compositeHook.OnACLCheck(legacy, "l", true))
+	require.Equal(t, []string{"legacy"}, jwt.disconnected)
+	require.Equal(t, []string{"legacy"}, file.disconnected)
+}
+
+func TestAllAllow(t *testing.T) {
+	a := &fakeBackend{id: "a", users: map[string][]string{"alice": {"x", "y"}, "bob": {"x"}}}
+	b := &fakeBackend{id: "b", users: map[string][]string{"alice": {"x"}}}
+	compositeHook := newHook(t, Options{Backends: []Backend{{Hook: a}, {Hook: b}}, Mode: AllAllow})
+
+	alice := client("alice", "alice")
+	require.True(t, compositeHook.OnConnectAuthenticate(alice, connectPacket("alice", "")))
+	require.True(t, compositeHook.OnACLCheck(alice, "x", true))
+	require.False(t, compositeHook.OnACLCheck(alice, "y", true))
+
+	// backends which allowed a client rejected by a later backend are told it isn't connecting
+	bob := client("bob", "bob")
+	require.False(t, compositeHook.OnConnectAuthenticate(bob, connectPacket("bob", "")))
+	require.Equal(t, []string{"bob"}, a.disconnected)
+	require.Empty(t, b.disconnected)
+	require.False(t, compositeHook.OnACLCheck(bob, "x", true))
+}
+
+func TestFallbackOnError(t *testing.T) {
+	primary := &fallibleBackend{fakeBackend: fakeBackend{id: "primary", users: map[string][]string{"alice": {"a"}}}}
+	secondary := &fakeBackend{id: "secondary", users: map[string][]string{"alice": {"a2"}, "bob": {"b"}}}
+	compositeHook := newHook(t, Options{Backends: []Backend{{Hook: primary}, {Hook: secondary}}, Mode: FallbackOnError})
+
+	// the primary rejecting a client is final
+	require.False(t, compositeHook.OnConnectAuthenticate(client("bob", "bob"), connectPacket("bob", "")))
+
+	alice := client("alice", "alice")
+	require.True(t, compositeHook.OnConnectAuthenticate(alice, connectPacket("alice", "")))
+	require.True(t, compositeHook.OnACLCheck(alice, "a", true))
+	require.False(t, compositeHook.OnACLCheck(alice, "a2", true))
+
+	primary.down = true
+	bob := client("bob", "bob")
+	require.True(t, compositeHook.OnConnectAuthenticate(bob, connectPacket("bob", "")))
+	require.True(t, compositeHook.OnACLCheck(bob, "b", true))
+}
+
+func TestFallbackOnErrorBackendDown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	secondary := &fakeBackend{id: "secondary", users: map[string][]string{"bob": {"b"}}}
+	compositeHook := newHook(t, Options{Backends: []Backend{
+		{Hook: new(auth.Hook), Config: auth.Options{ACLHost: endpoint, ClientAuthenticationHost: endpoint}},
+		{Hook: secondary},
+	}, Mode: FallbackOnError})
+
+	// the http backend rejecting a client is final
+	require.False(t, compositeHook.OnConnectAuthenticate(client("bob", "bob"), connectPacket("bob", "")))
+
+	// the next backend is asked while the http backend is down
+	server.Close()
+	bob := client("bob", "bob")
+	require.True(t, compositeHook.OnConnectAuthenticate(bob, connectPacket("bob", "")))
+	require.True(t, compositeHook.OnACLCheck(bob, "b", true))
+}
+
+func TestAnonymousFallback(t *testing.T) {
+	users := &fakeBackend{id: "users", users: map[string][]string{"alice": {"a"}}}
+	compositeHook := newHook(t, Options{Backends: []Backend{
+		{Hook: users},
+		{Hook: new(anonymous.Hook), Config: anonymous.Options{ACL: acl.Templates{"public/#": acl.ReadOnly}}},
+	}})
+
+	guest := client("guest", "")
+	require.True(t, compositeHook.OnConnectAuthenticate(guest, connectPacket("", "")))
+	require.True(t, compositeHook.OnACLCheck(guest, "public/news", false))
+	require.False(t, compositeHook.OnACLCheck(guest, "a", false))
+}
@@ -0,0 +1,266 @@
+package enhanced
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// ErrUnexpectedPacket indicates the client sent something other than an AUTH packet during an exchange
+var ErrUnexpectedPacket = errors.New("unexpected packet during authentication exchange")
+
+// Mechanism is an authentication method, eg. SCRAM-SHA-256, which clients select with the
+// Authentication Method property of their CONNECT packet
+type Mechanism interface {
+	Name() string                       // the authentication method, eg. "SCRAM-SHA-256"
+	Start(cl *mqtt.Client) Conversation // begins an exchange with the client
+}
+
+// Conversation is a single challenge-response exchange with a client
+type Conversation interface {
+	// Step consumes the authentication data sent by the client and returns the data to send back. If
+	// done is true the client is authenticated and the data is sent with the CONNACK or final AUTH
+	// packet, otherwise it is sent as a challenge in an AUTH packet
+	Step(data []byte) (response []byte, done bool, err error)
+
+	// Username returns the identity the client authenticated as, once done
+	Username() string
+}
+
+// Hook is a hook that authenticates MQTT 5 clients with the enhanced authentication exchange of
+// CONNECT and AUTH packets, using the mechanism named by the client, and supports re-authentication
+// of connected clients
+type Hook struct {
+	config        Options
+	mechanisms    map[string]Mechanism
+	final         map[*mqtt.Client][]byte       // authentication data to send with the CONNACK
+	conversations map[*mqtt.Client]Conversation // re-authentications in progress
+	mu            sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the enhanced auth hook
+type Options struct {
+	Mechanisms []Mechanism
+
+	// Timeout bounds how long the client may take to answer each challenge during CONNECT, defaults
+	// to 10 seconds
+	Timeout time.Duration
+
+	// SetUsername replaces the client's username with the identity it authenticated as, so that
+	// username based ACL hooks apply to it
+	SetUsername bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "enhanced-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnAuthPacket,
+		mqtt.OnPacketEncode,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	enhancedHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if len(enhancedHookConfig.Mechanisms) == 0 {
+		return errors.New("at least one mechanism is required")
+	}
+
+	if enhancedHookConfig.Timeout <= 0 {
+		enhancedHookConfig.Timeout = 10 * time.Second
+	}
+
+	h.mechanisms = make(map[string]Mechanism, len(enhancedHookConfig.Mechanisms))
+	for _, mechanism := range enhancedHookConfig.Mechanisms {
+		if _, ok := h.mechanisms[mechanism.Name()]; ok {
+			return errors.New("duplicate mechanism " + mechanism.Name())
+		}
+		h.mechanisms[mechanism.Name()] = mechanism
+	}
+
+	h.config = enhancedHookConfig
+	h.final = make(map[*mqtt.Client][]byte)
+	h.conversations = make(map[*mqtt.Client]Conversation)
+
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server. Clients which do
+// not request a known authentication method are left to other auth hooks
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	method := pk.Properties.AuthenticationMethod
+	mechanism, ok := h.mechanisms[method]
+	if !ok || cl.Properties.ProtocolVersion < 5 {
+		return false
+	}
+
+	conversation := mechanism.Start(cl)
+	data := pk.Properties.AuthenticationData
+	for {
+		response, done, err := conversation.Step(data)
+		if err != nil {
+			h.Log.Debug("enhanced authentication failed", "client", cl.ID, "method", method, "error", err)
+			return false
+		}
+
+		if done {
+			h.authenticated(cl, conversation)
+			h.mu.Lock()
+			h.final[cl] = response
+			h.mu.Unlock()
+			return true
+		}
+
+		data, err = h.challenge(cl, method, response)
+		if err != nil {
+			h.Log.Debug("enhanced authentication exchange failed", "client", cl.ID, "method", method, "error", err)
+			return false
+		}
+	}
+}
+
+// challenge sends an AUTH packet continuing the exchange and waits for the client's answer. The
+// server only processes AUTH packets once the client is connected, so the exchange before the CONNACK
+// is read directly from the connection
+func (h *Hook) challenge(cl *mqtt.Client, method string, data []byte) ([]byte, error) {
+	err := cl.WritePacket(authPacket(packets.CodeContinueAuthentication, method, data))
+	if err != nil {
+		return nil, err
+	}
+
+	if cl.Net.Conn != nil {
+		_ = cl.Net.Conn.SetReadDeadline(time.Now().Add(h.config.Timeout))
+	}
+
+	fh := new(packets.FixedHeader)
+	if err := cl.ReadFixedHeader(fh); err != nil {
+		return nil, err
+	}
+
+	pk, err := cl.ReadPacket(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	if pk.FixedHeader.Type != packets.Auth || pk.ReasonCode != packets.CodeContinueAuthentication.Code {
+		return nil, ErrUnexpectedPacket
+	}
+
+	if pk.Properties.AuthenticationMethod != method {
+		return nil, packets.ErrBadAuthenticationMethod
+	}
+
+	return pk.Properties.AuthenticationData, nil
+}
+
+// OnAuthPacket is called when a connected client sends an AUTH packet to re-authenticate
+func (h *Hook) OnAuthPacket(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	method := cl.Properties.Props.AuthenticationMethod
+	if pk.Properties.AuthenticationMethod != method {
+		return pk, packets.ErrBadAuthenticationMethod // [MQTT-4.12.1-1]
+	}
+
+	h.mu.Lock()
+	conversation, ok := h.conversations[cl]
+	delete(h.conversations, cl)
+	h.mu.Unlock()
+
+	switch pk.ReasonCode {
+	case packets.CodeReAuthenticate.Code:
+		mechanism, known := h.mechanisms[method]
+		if !known {
+			return pk, packets.ErrBadAuthenticationMethod
+		}
+		conversation = mechanism.Start(cl)
+	case packets.CodeContinueAuthentication.Code:
+		if !ok {
+			return pk, packets.ErrProtocolViolation
+		}
+	default:
+		return pk, packets.ErrProtocolViolation
+	}
+
+	response, done, err := conversation.Step(pk.Properties.AuthenticationData)
+	if err != nil {
+		h.Log.Info("re-authentication failed", "client", cl.ID, "method", method, "error", err)
+		return pk, packets.ErrNotAuthorized // [MQTT-4.12.1-2]
+	}
+
+	if done {
+		h.authenticated(cl, conversation)
+		return pk, cl.WritePacket(authPacket(packets.CodeSuccess, method, response))
+	}
+
+	h.mu.Lock()
+	h.conversations[cl] = conversation
+	h.mu.Unlock()
+
+	return pk, cl.WritePacket(authPacket(packets.CodeContinueAuthentication, method, response))
+}
+
+// authenticated records the outcome of a successful exchange on the client
+func (h *Hook) authenticated(cl *mqtt.Client, conversation Conversation) {
+	if h.config.SetUsername {
+		if username := conversation.Username(); username != "" {
+			cl.Properties.Username = []byte(username)
+		}
+	}
+}
+
+// OnPacketEncode adds the final authentication data to the CONNACK of clients authenticated by the hook
+func (h *Hook) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if pk.FixedHeader.Type != packets.Connack {
+		return pk
+	}
+
+	h.mu.Lock()
+	data, ok := h.final[cl]
+	delete(h.final, cl)
+	h.mu.Unlock()
+
+	if ok && pk.ReasonCode < packets.ErrUnspecifiedError.Code {
+		pk.Properties.AuthenticationMethod = cl.Properties.Props.AuthenticationMethod
+		pk.Properties.AuthenticationData = data
+	}
+
+	return pk
+}
+
+// OnDisconnect is called when a client disconnects and releases any exchange in progress
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	delete(h.final, cl)
+	delete(h.conversations, cl)
+	h.mu.Unlock()
+}
+
+func authPacket(reason packets.Code, method string, data []byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Auth},
+		ReasonCode:  reason.Code,
+		Properties: packets.Properties{
+			AuthenticationMethod: method,
+			AuthenticationData:   data,
+		},
+	}
+}
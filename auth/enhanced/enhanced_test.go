@@ -0,0 +1,346 @@
+package enhanced
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// newPair returns the server side of a connection and a peer speaking MQTT 5 on the other end
+func newPair(t *testing.T) (*mqtt.Client, *mqtt.Client) {
+	t.Helper()
+
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	// the peer fails rather than blocks if the hook stops reading or writing
+	require.NoError(t, w.SetDeadline(time.Now().Add(10*time.Second)))
+
+	s := mqtt.New(nil)
+	cl := s.NewClient(r, "tcp", "client-1", false)
+	cl.Properties.ProtocolVersion = 5
+	peer := s.NewClient(w, "tcp", "peer", false)
+	peer.Properties.ProtocolVersion = 5
+
+	return cl, peer
+}
+
+// readAuth reads the next packet sent to the peer, which must be an AUTH packet
+func readAuth(t *testing.T, peer *mqtt.Client) packets.Packet {
+	t.Helper()
+
+	fh := new(packets.FixedHeader)
+	require.NoError(t, peer.ReadFixedHeader(fh))
+	pk, err := peer.ReadPacket(fh)
+	require.NoError(t, err)
+	require.Equal(t, packets.Auth, pk.FixedHeader.Type)
+	return pk
+}
+
+func connectPacket(method string, data []byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Connect},
+		Properties: packets.Properties{
+			AuthenticationMethod: method,
+			AuthenticationData:   data,
+		},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	enhancedHook := new(Hook)
+	enhancedHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, enhancedHook.Init(options))
+	return enhancedHook
+}
+
+func TestID(t *testing.T) {
+	enhancedHook := new(Hook)
+
+	require.Equal(t, "enhanced-auth-hook", enhancedHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	enhancedHook := new(Hook)
+	require.True(t, enhancedHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, enhancedHook.Provides(mqtt.OnAuthPacket))
+	require.True(t, enhancedHook.Provides(mqtt.OnPacketEncode))
+	require.True(t, enhancedHook.Provides(mqtt.OnDisconnect))
+	require.False(t, enhancedHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	scram := &SCRAM{Store: StaticCredentials{}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - scram",
+			config:      Options{Mechanisms: []Mechanism{scram}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no mechanisms",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - duplicate mechanism",
+			config:      Options{Mechanisms: []Mechanism{scram, scram}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			enhancedHook := new(Hook)
+			enhancedHook.Log = slog.Default()
+			err := enhancedHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 10*time.Second, enhancedHook.config.Timeout)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	store := testCredentials(t)
+
+	tests := []struct {
+		name       string
+		password   string
+		answer     func(peer *mqtt.Client, data []byte) error
+		timeout    time.Duration // how long the hook waits for the answer, if not 5 seconds
+		expectPass bool
+	}{
+		{
+			name:       "Success - valid password",
+			password:   "pencil",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - wrong password",
+			password:   "crayon",
+			expectPass: false,
+		},
+		{
+			name:     "Failure - answer with another method",
+			password: "pencil",
+			answer: func(peer *mqtt.Client, data []byte) error {
+				return peer.WritePacket(authPacket(packets.CodeContinueAuthentication, "SCRAM-SHA-1", data))
+			},
+			expectPass: false,
+		},
+		{
+			name:     "Failure - answer with another packet",
+			password: "pencil",
+			answer: func(peer *mqtt.Client, data []byte) error {
+				return peer.WritePacket(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingreq}})
+			},
+			expectPass: false,
+		},
+		{
+			name:     "Failure - no answer",
+			password: "pencil",
+			answer: func(peer *mqtt.Client, data []byte) error {
+				return nil
+			},
+			timeout:    50 * time.Millisecond,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			timeout := 5 * time.Second
+			if tt.timeout > 0 {
+				timeout = tt.timeout
+			}
+
+			enhancedHook := newHook(t, Options{Mechanisms: []Mechanism{&SCRAM{Store: store}}, Timeout: timeout, SetUsername: true})
+			cl, peer := newPair(t)
+			client := newSCRAMClient("user", tt.password)
+
+			result := make(chan bool, 1)
+			go func() {
+				result <- enhancedHook.OnConnectAuthenticate(cl, connectPacket(SCRAMSHA256, client.first()))
+			}()
+
+			challenge := readAuth(t, peer)
+			require.Equal(t, packets.CodeContinueAuthentication.Code, challenge.ReasonCode)
+			require.Equal(t, SCRAMSHA256, challenge.Properties.AuthenticationMethod)
+
+			final, err := client.final(challenge.Properties.AuthenticationData)
+			require.NoError(t, err)
+
+			if tt.answer != nil {
+				require.NoError(t, tt.answer(peer, final))
+			} else {
+				require.NoError(t, peer.WritePacket(authPacket(packets.CodeContinueAuthentication, SCRAMSHA256, final)))
+			}
+
+			require.Equal(t, tt.expectPass, <-result)
+			if !tt.expectPass {
+				require.Empty(t, cl.Properties.Username)
+				return
+			}
+			require.Equal(t, []byte("user"), cl.Properties.Username)
+
+			// the server final message is sent with the connack
+			cl.Properties.Props.AuthenticationMethod = SCRAMSHA256
+			ack := enhancedHook.OnPacketEncode(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Connack}})
+			require.Equal(t, SCRAMSHA256, ack.Properties.AuthenticationMethod)
+			require.True(t, client.verify(ack.Properties.AuthenticationData))
+
+			// but only once
+			ack = enhancedHook.OnPacketEncode(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Connack}})
+			require.Empty(t, ack.Properties.AuthenticationData)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticateSkipped(t *testing.T) {
+	enhancedHook := newHook(t, Options{Mechanisms: []Mechanism{&SCRAM{Store: testCredentials(t)}}})
+
+	// other methods, and clients without a method, are left to other hooks
+	cl, _ := newPair(t)
+	require.False(t, enhancedHook.OnConnectAuthenticate(cl, connectPacket("", nil)))
+	require.False(t, enhancedHook.OnConnectAuthenticate(cl, connectPacket("GS2-KRB5", []byte("token"))))
+
+	cl.Properties.ProtocolVersion = 4
+	require.False(t, enhancedHook.OnConnectAuthenticate(cl, connectPacket(SCRAMSHA256, newSCRAMClient("user", "pencil").first())))
+
+	// malformed first messages fail without a challenge
+	cl.Properties.ProtocolVersion = 5
+	require.False(t, enhancedHook.OnConnectAuthenticate(cl, connectPacket(SCRAMSHA256, []byte("garbage"))))
+}
+
+func TestOnPacketEncode(t *testing.T) {
+	enhancedHook := newHook(t, Options{Mechanisms: []Mechanism{&SCRAM{Store: testCredentials(t)}}})
+	cl, _ := newPair(t)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}, TopicName: "a/b"}
+	require.Equal(t, pk, enhancedHook.OnPacketEncode(cl, pk))
+
+	// a rejected connection is not sent authentication data
+	enhancedHook.final[cl] = []byte("v=abc")
+	ack := enhancedHook.OnPacketEncode(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Connack}, ReasonCode: packets.ErrNotAuthorized.Code})
+	require.Empty(t, ack.Properties.AuthenticationData)
+}
+
+func TestOnAuthPacketReauthenticate(t *testing.T) {
+	store := testCredentials(t)
+	enhancedHook := newHook(t, Options{Mechanisms: []Mechanism{&SCRAM{Store: store}}})
+
+	tests := []struct {
+		name        string
+		password    string
+		expectError error
+	}{
+		{
+			name:     "Success - valid password",
+			password: "pencil",
+		},
+		{
+			name:        "Failure - wrong password",
+			password:    "crayon",
+			expectError: packets.ErrNotAuthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl, peer := newPair(t)
+			cl.Properties.Props.AuthenticationMethod = SCRAMSHA256
+			client := newSCRAMClient("user", tt.password)
+
+			errs := make(chan error, 1)
+			go func() {
+				_, err := enhancedHook.OnAuthPacket(cl, authPacket(packets.CodeReAuthenticate, SCRAMSHA256, client.first()))
+				errs <- err
+			}()
+
+			challenge := readAuth(t, peer)
+			require.Equal(t, packets.CodeContinueAuthentication.Code, challenge.ReasonCode)
+			require.NoError(t, <-errs)
+
+			final, err := client.final(challenge.Properties.AuthenticationData)
+			require.NoError(t, err)
+
+			if tt.expectError != nil {
+				_, err := enhancedHook.OnAuthPacket(cl, authPacket(packets.CodeContinueAuthentication, SCRAMSHA256, final))
+				require.ErrorIs(t, err, tt.expectError)
+				require.Empty(t, enhancedHook.conversations)
+				return
+			}
+
+			go func() {
+				_, err := enhancedHook.OnAuthPacket(cl, authPacket(packets.CodeContinueAuthentication, SCRAMSHA256, final))
+				errs <- err
+			}()
+
+			success := readAuth(t, peer)
+			require.Equal(t, packets.CodeSuccess.Code, success.ReasonCode)
+			require.True(t, client.verify(success.Properties.AuthenticationData))
+			require.NoError(t, <-errs)
+			require.Empty(t, enhancedHook.conversations)
+
+		})
+	}
+}
+
+func TestOnAuthPacketErrors(t *testing.T) {
+	enhancedHook := newHook(t, Options{Mechanisms: []Mechanism{&SCRAM{Store: testCredentials(t)}}})
+
+	cl, _ := newPair(t)
+	cl.Properties.Props.AuthenticationMethod = SCRAMSHA256
+
+	// continuing an exchange which was never started
+	_, err := enhancedHook.OnAuthPacket(cl, authPacket(packets.CodeContinueAuthentication, SCRAMSHA256, nil))
+	require.ErrorIs(t, err, packets.ErrProtocolViolation)
+
+	// switching methods is not allowed
+	_, err = enhancedHook.OnAuthPacket(cl, authPacket(packets.CodeReAuthenticate, "SCRAM-SHA-1", nil))
+	require.ErrorIs(t, err, packets.ErrBadAuthenticationMethod)
+
+	// clients which did not use enhanced authentication cannot re-authenticate
+	other, _ := newPair(t)
+	_, err = enhancedHook.OnAuthPacket(other, authPacket(packets.CodeReAuthenticate, "", nil))
+	require.ErrorIs(t, err, packets.ErrBadAuthenticationMethod)
+
+	enhancedHook.conversations[cl] = (&SCRAM{}).Start(cl)
+	enhancedHook.OnDisconnect(cl, nil, true)
+	require.Empty(t, enhancedHook.conversations)
+}
@@ -0,0 +1,304 @@
+package enhanced
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+)
+
+// SCRAMSHA256 is the name of the SCRAM-SHA-256 authentication method
+const SCRAMSHA256 = "SCRAM-SHA-256"
+
+// DefaultIterations is the PBKDF2 iteration count used by NewCredentials when none is given
+const DefaultIterations = 4096
+
+var (
+	// ErrUnknownUser is returned by a CredentialStore which has no credentials for a username
+	ErrUnknownUser = errors.New("unknown user")
+
+	// ErrInvalidProof indicates the client did not prove knowledge of the password
+	ErrInvalidProof = errors.New("invalid proof")
+
+	// ErrMalformedMessage indicates a SCRAM message could not be parsed
+	ErrMalformedMessage = errors.New("malformed scram message")
+
+	// ErrChannelBinding indicates the client requires channel binding, which is not supported
+	ErrChannelBinding = errors.New("channel binding not supported")
+)
+
+// Credentials are the SCRAM-SHA-256 verifiers of a password, which are stored instead of the password
+type Credentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewCredentials derives the SCRAM-SHA-256 credentials of a password. A random salt is generated if
+// salt is nil, and DefaultIterations are used if iterations is not positive
+func NewCredentials(password string, salt []byte, iterations int) (Credentials, error) {
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return Credentials{}, err
+		}
+	}
+
+	if iterations <= 0 {
+		iterations = DefaultIterations
+	}
+
+	salted := hi([]byte(password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+
+	return Credentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, []byte("Server Key")),
+	}, nil
+}
+
+// CredentialStore looks up the SCRAM credentials of a user, returning ErrUnknownUser if there are none
+type CredentialStore interface {
+	Credentials(username string) (Credentials, error)
+}
+
+// StaticCredentials is a CredentialStore with a fixed set of users
+type StaticCredentials map[string]Credentials
+
+// Credentials returns the credentials of the user
+func (s StaticCredentials) Credentials(username string) (Credentials, error) {
+	credentials, ok := s[username]
+	if !ok {
+		return Credentials{}, ErrUnknownUser
+	}
+	return credentials, nil
+}
+
+// SCRAM is the SCRAM-SHA-256 mechanism of RFC 7677, without channel binding
+type SCRAM struct {
+	Store CredentialStore
+}
+
+// Name returns the authentication method
+func (s *SCRAM) Name() string {
+	return SCRAMSHA256
+}
+
+// Start begins a SCRAM exchange
+func (s *SCRAM) Start(cl *mqtt.Client) Conversation {
+	return &scramConversation{store: s.Store}
+}
+
+// scramConversation is the server side of a SCRAM exchange
+type scramConversation struct {
+	store           CredentialStore
+	step            int
+	username        string
+	credentials     Credentials
+	known           bool
+	authenticated   bool
+	gs2Header       string
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+}
+
+// Step processes the client-first message, answering with the server-first message, and then the
+// client-final message, answering with the server-final message
+func (c *scramConversation) Step(data []byte) ([]byte, bool, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		out, err := c.clientFirst(string(data))
+		return out, false, err
+	case 2:
+		out, err := c.clientFinal(string(data))
+		return out, err == nil, err
+	default:
+		return nil, false, ErrMalformedMessage
+	}
+}
+
+// Username returns the authenticated user
+func (c *scramConversation) Username() string {
+	if !c.authenticated {
+		return ""
+	}
+	return c.username
+}
+
+func (c *scramConversation) clientFirst(msg string) ([]byte, error) {
+	// gs2-header is the channel binding flag and an optional authzid, eg. "n,,"
+	flag, rest, ok := strings.Cut(msg, ",")
+	if !ok {
+		return nil, ErrMalformedMessage
+	}
+
+	switch {
+	case flag == "n", flag == "y":
+	case strings.HasPrefix(flag, "p="):
+		return nil, ErrChannelBinding
+	default:
+		return nil, ErrMalformedMessage
+	}
+
+	authzid, bare, ok := strings.Cut(rest, ",")
+	if !ok || (authzid != "" && !strings.HasPrefix(authzid, "a=")) {
+		return nil, ErrMalformedMessage
+	}
+
+	attrs, err := parseAttributes(bare)
+	if err != nil {
+		return nil, err
+	}
+
+	username, err := decodeSaslname(attrs["n"])
+	if err != nil || username == "" || attrs["r"] == "" {
+		return nil, ErrMalformedMessage
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+
+	credentials, err := c.store.Credentials(username)
+	switch {
+	case err == nil:
+		c.known = true
+	case errors.Is(err, ErrUnknownUser):
+		// carry on with random credentials so unknown users cannot be told apart from wrong passwords
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		credentials = Credentials{Salt: salt, Iterations: DefaultIterations}
+	default:
+		return nil, err
+	}
+
+	c.username = username
+	c.credentials = credentials
+	c.gs2Header = flag + "," + authzid + ","
+	c.nonce = attrs["r"] + base64.RawStdEncoding.EncodeToString(serverNonce)
+	c.clientFirstBare = bare
+	c.serverFirst = "r=" + c.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(credentials.Salt) +
+		",i=" + strconv.Itoa(credentials.Iterations)
+
+	return []byte(c.serverFirst), nil
+}
+
+func (c *scramConversation) clientFinal(msg string) ([]byte, error) {
+	withoutProof, proofAttr, ok := cutLast(msg, ",p=")
+	if !ok {
+		return nil, ErrMalformedMessage
+	}
+
+	attrs, err := parseAttributes(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(c.gs2Header)) {
+		return nil, ErrChannelBinding
+	}
+
+	if attrs["r"] != c.nonce {
+		return nil, ErrInvalidProof
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(proofAttr)
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrMalformedMessage
+	}
+
+	if !c.known {
+		return nil, ErrInvalidProof
+	}
+
+	authMessage := []byte(c.clientFirstBare + "," + c.serverFirst + "," + withoutProof)
+	clientSignature := hmacSHA256(c.credentials.StoredKey, authMessage)
+
+	clientKey := make([]byte, sha256.Size)
+	subtle.XORBytes(clientKey, proof, clientSignature)
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], c.credentials.StoredKey) != 1 {
+		return nil, ErrInvalidProof
+	}
+
+	c.authenticated = true
+
+	serverSignature := hmacSHA256(c.credentials.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// parseAttributes parses comma separated attribute=value pairs
+func parseAttributes(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || len(key) != 1 {
+			return nil, ErrMalformedMessage
+		}
+		attrs[key] = value
+	}
+	return attrs, nil
+}
+
+// decodeSaslname unescapes the "=2C" and "=3D" sequences of a SCRAM username
+func decodeSaslname(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			sb.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			sb.WriteByte('=')
+		default:
+			return "", ErrMalformedMessage
+		}
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// hi is the Hi function of RFC 5802, which is PBKDF2 with HMAC-SHA-256 producing a single block
+func hi(password, salt []byte, iterations int) []byte {
+	u := hmacSHA256(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	out := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA256(password, u)
+		subtle.XORBytes(out, out, u)
+	}
+	return out
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,252 @@
+package enhanced
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// scramClient is the client side of a SCRAM-SHA-256 exchange
+type scramClient struct {
+	username        string
+	password        string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSCRAMClient(username, password string) *scramClient {
+	return &scramClient{username: username, password: password, nonce: "fyko+d2lbbFgONRv9qkxdawL"}
+}
+
+func (c *scramClient) first() []byte {
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.username)
+	c.clientFirstBare = "n=" + username + ",r=" + c.nonce
+	return []byte("n,," + c.clientFirstBare)
+}
+
+func (c *scramClient) final(serverFirst []byte) ([]byte, error) {
+	attrs, err := parseAttributes(string(serverFirst))
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(attrs["r"], c.nonce) {
+		return nil, errors.New("server nonce does not extend client nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, err
+	}
+
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := NewCredentials(c.password, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := []byte(c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof)
+
+	salted := hi([]byte(c.password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	signature := hmacSHA256(credentials.StoredKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	subtle.XORBytes(proof, clientKey, signature)
+
+	c.serverSignature = hmacSHA256(credentials.ServerKey, authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (c *scramClient) verify(serverFinal []byte) bool {
+	return hmac.Equal(serverFinal, []byte("v="+base64.StdEncoding.EncodeToString(c.serverSignature)))
+}
+
+func testCredentials(t *testing.T) StaticCredentials {
+	t.Helper()
+
+	credentials, err := NewCredentials("pencil", nil, 0)
+	require.NoError(t, err)
+	return StaticCredentials{"user": credentials}
+}
+
+func TestNewCredentials(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+
+	credentials, err := NewCredentials("pencil", salt, 4096)
+	require.NoError(t, err)
+	require.Equal(t, 4096, credentials.Iterations)
+	require.Len(t, credentials.StoredKey, sha256.Size)
+	require.Len(t, credentials.ServerKey, sha256.Size)
+
+	// a random salt is generated
+	other, err := NewCredentials("pencil", nil, 0)
+	require.NoError(t, err)
+	require.Len(t, other.Salt, 16)
+	require.Equal(t, DefaultIterations, other.Iterations)
+	require.NotEqual(t, credentials.StoredKey, other.StoredKey)
+}
+
+func TestSCRAMTestVector(t *testing.T) {
+	// the example exchange of RFC 7677
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	credentials, err := NewCredentials("pencil", salt, 4096)
+	require.NoError(t, err)
+
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	c := &scramConversation{
+		step:            1,
+		username:        "user",
+		credentials:     credentials,
+		known:           true,
+		gs2Header:       "n,,",
+		nonce:           "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+		clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst:     serverFirst,
+	}
+
+	out, done, err := c.Step([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+	require.NoError(t, err)
+	require.True(t, done)
+	require.Equal(t, "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", string(out))
+	require.Equal(t, "user", c.Username())
+}
+
+func TestSCRAMConversation(t *testing.T) {
+	store := testCredentials(t)
+	store["us,er="] = store["user"]
+
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		clientFirst string
+		tamper      func(string) string
+		expectError error
+	}{
+		{
+			name:     "Success - valid password",
+			username: "user",
+			password: "pencil",
+		},
+		{
+			name:     "Success - escaped username",
+			username: "us,er=",
+			password: "pencil",
+		},
+		{
+			name:        "Failure - wrong password",
+			username:    "user",
+			password:    "crayon",
+			expectError: ErrInvalidProof,
+		},
+		{
+			name:        "Failure - unknown user",
+			username:    "mallory",
+			password:    "pencil",
+			expectError: ErrInvalidProof,
+		},
+		{
+			name:     "Failure - nonce replaced",
+			username: "user",
+			password: "pencil",
+			tamper: func(s string) string {
+				return strings.Replace(s, "r=fyko", "r=abcd", 1)
+			},
+			expectError: ErrInvalidProof,
+		},
+		{
+			name:     "Failure - channel binding mismatch",
+			username: "user",
+			password: "pencil",
+			tamper: func(s string) string {
+				return strings.Replace(s, "c=biws", "c=eSws", 1)
+			},
+			expectError: ErrChannelBinding,
+		},
+		{
+			name:        "Failure - channel binding required",
+			clientFirst: "p=tls-unique,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+			expectError: ErrChannelBinding,
+		},
+		{
+			name:        "Failure - malformed client first",
+			clientFirst: "n,,user",
+			expectError: ErrMalformedMessage,
+		},
+		{
+			name:        "Failure - bad username escape",
+			clientFirst: "n,,n=us=2Der,r=fyko+d2lbbFgONRv9qkxdawL",
+			expectError: ErrMalformedMessage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			mechanism := &SCRAM{Store: store}
+			require.Equal(t, SCRAMSHA256, mechanism.Name())
+			conversation := mechanism.Start(nil)
+			client := newSCRAMClient(tt.username, tt.password)
+
+			first := client.first()
+			if tt.clientFirst != "" {
+				first = []byte(tt.clientFirst)
+			}
+
+			serverFirst, done, err := conversation.Step(first)
+			if err != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				return
+			}
+			require.False(t, done)
+
+			final, err := client.final(serverFirst)
+			require.NoError(t, err)
+			if tt.tamper != nil {
+				final = []byte(tt.tamper(string(final)))
+			}
+
+			serverFinal, done, err := conversation.Step(final)
+			if tt.expectError != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				require.False(t, done)
+				require.Empty(t, conversation.Username())
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, done)
+			require.True(t, client.verify(serverFinal))
+			require.Equal(t, tt.username, conversation.Username())
+
+			// the exchange is over
+			_, _, err = conversation.Step(final)
+			require.ErrorIs(t, err, ErrMalformedMessage)
+
+		})
+	}
+}
+
+func TestSCRAMStoreError(t *testing.T) {
+	conversation := (&SCRAM{Store: failingStore{}}).Start(nil)
+	_, _, err := conversation.Step(newSCRAMClient("user", "pencil").first())
+	require.EqualError(t, err, "store unavailable")
+}
+
+type failingStore struct{}
+
+func (failingStore) Credentials(username string) (Credentials, error) {
+	return Credentials{}, errors.New("store unavailable")
+}
@@ -0,0 +1,234 @@
+package entra
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/auth/jwt"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// DefaultAuthority is the login endpoint of the Azure public cloud
+const DefaultAuthority = "https://login.microsoftonline.com"
+
+var (
+	// ErrInvalidTenant indicates the token was issued by a tenant which is not allowed
+	ErrInvalidTenant = errors.New("invalid tenant")
+
+	// ErrInvalidApplication indicates the token was requested by a client application which is not allowed
+	ErrInvalidApplication = errors.New("invalid application")
+)
+
+// multiTenant lists the tenant values which accept tokens from more than one tenant
+var multiTenant = []string{"common", "organizations"}
+
+// Hook is a hook that authenticates clients presenting a Microsoft Entra ID (Azure AD) access token as
+// their password, and maps the app roles assigned to the calling identity to topic permissions
+type Hook struct {
+	config    Options
+	jwks      *jwt.JWKS
+	validator jwt.Validator
+	sessions  acl.Sessions
+	cancel    context.CancelFunc
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the Entra ID hook.
+// It is the responsibility of the configurer to pass a properly configured RoundTripper that takes
+// care of other requirements such as timeouts, proxies, etc
+type Options struct {
+	// TenantID is the directory the tokens are issued by. Use "organizations" or "common" for
+	// multi-tenant applications, in which case AllowedTenants must list the accepted tenant ids
+	TenantID       string
+	AllowedTenants []string
+
+	Audiences    []string // the aud claim must match one of these, eg. "api://mqtt-broker" or the application id
+	Applications []string // if set, the calling application (appid or azp claim) must be one of these
+	Authority    string   // defaults to DefaultAuthority, change for sovereign clouds
+	Leeway       time.Duration
+
+	JWKSRefreshInterval time.Duration     // defaults to 1 hour
+	RoundTripper        http.RoundTripper // used for JWKS requests, http.DefaultTransport if nil
+
+	// ACL holds templates granted to every authenticated identity and RoleACL the templates granted by
+	// each app role. Templates may reference {clientid}, {tid}, {oid}, {appid} and any scalar claim
+	ACL     acl.Templates
+	RoleACL map[string]acl.Templates
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "entra-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if len(h.config.ACL) == 0 && len(h.config.RoleACL) == 0 {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	entraHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if entraHookConfig.TenantID == "" {
+		return errors.New("tenant id is required")
+	}
+
+	if len(entraHookConfig.Audiences) == 0 {
+		return errors.New("at least one audience is required")
+	}
+
+	if slices.Contains(multiTenant, entraHookConfig.TenantID) && len(entraHookConfig.AllowedTenants) == 0 {
+		return errors.New("allowed tenants are required for multi-tenant applications")
+	}
+
+	if entraHookConfig.Authority == "" {
+		entraHookConfig.Authority = DefaultAuthority
+	}
+	entraHookConfig.Authority = strings.TrimSuffix(entraHookConfig.Authority, "/")
+
+	if entraHookConfig.JWKSRefreshInterval <= 0 {
+		entraHookConfig.JWKSRefreshInterval = time.Hour
+	}
+
+	jwksURL, err := url.Parse(entraHookConfig.Authority + "/" + entraHookConfig.TenantID + "/discovery/v2.0/keys")
+	if err != nil {
+		return err
+	}
+
+	h.config = entraHookConfig
+	h.validator = jwt.Validator{Leeway: entraHookConfig.Leeway}
+	h.jwks = jwt.NewJWKS(jwksURL, entraHookConfig.RoundTripper, time.Minute)
+
+	// a failed initial fetch is not fatal, the keys are fetched again on the first unknown kid
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	if err := h.jwks.Refresh(ctx); err != nil {
+		h.Log.Error("error occurred while fetching jwks", "error", err)
+	}
+
+	go h.jwks.Run(ctx, entraHookConfig.JWKSRefreshInterval, func(err error) {
+		h.Log.Error("error occurred while refreshing jwks", "error", err)
+	})
+
+	return nil
+}
+
+// Stop stops refreshing the JWKS
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	token, err := jwt.Parse(string(pk.Connect.Password), h.jwks.Key)
+	if err != nil {
+		h.Log.Debug("token verification failed", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if err := h.validate(token.Claims); err != nil {
+		h.Log.Debug("token validation failed", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if len(h.config.ACL) == 0 && len(h.config.RoleACL) == 0 {
+		return true
+	}
+
+	values := token.Claims.Values()
+	values["clientid"] = cl.ID
+	values["appid"] = application(token.Claims)
+
+	filters := h.config.ACL.Render(values)
+	for _, role := range token.Claims.Strings("roles") {
+		filters.Merge(h.config.RoleACL[role].Render(values))
+	}
+	h.sessions.Set(cl, filters)
+
+	return true
+}
+
+// validate checks the registered claims, the issuing tenant and the calling application of a verified token
+func (h *Hook) validate(claims jwt.Claims) error {
+	if err := h.validator.Validate(claims); err != nil {
+		return err
+	}
+
+	tenant := claims.String("tid")
+	if tenant == "" {
+		return ErrInvalidTenant
+	}
+
+	if slices.Contains(multiTenant, h.config.TenantID) {
+		if !slices.Contains(h.config.AllowedTenants, tenant) {
+			return ErrInvalidTenant
+		}
+	} else if tenant != h.config.TenantID {
+		return ErrInvalidTenant
+	}
+
+	// v2.0 tokens are issued by the authority, v1.0 tokens by the security token service
+	issuer := claims.String("iss")
+	if issuer != h.config.Authority+"/"+tenant+"/v2.0" && issuer != "https://sts.windows.net/"+tenant+"/" {
+		return jwt.ErrInvalidIssuer
+	}
+
+	if !slices.ContainsFunc(claims.Strings("aud"), func(aud string) bool {
+		return slices.Contains(h.config.Audiences, aud)
+	}) {
+		return jwt.ErrInvalidAudience
+	}
+
+	if len(h.config.Applications) > 0 && !slices.Contains(h.config.Applications, application(claims)) {
+		return ErrInvalidApplication
+	}
+
+	return nil
+}
+
+// application returns the id of the client application which requested the token, which v1.0 tokens
+// carry in appid and v2.0 tokens in azp
+func application(claims jwt.Claims) string {
+	if appid := claims.String("appid"); appid != "" {
+		return appid
+	}
+	return claims.String("azp")
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
@@ -0,0 +1,359 @@
+package entra
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/auth/jwt"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+const (
+	testTenant   = "11111111-1111-1111-1111-111111111111"
+	otherTenant  = "22222222-2222-2222-2222-222222222222"
+	testAudience = "api://mqtt-broker"
+	testApp      = "33333333-3333-3333-3333-333333333333"
+)
+
+var testKey *rsa.PrivateKey
+
+func init() {
+	testKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// jwksRoundTripper serves the test key as the tenant's signing keys
+type jwksRoundTripper struct {
+	t    *testing.T
+	path string
+}
+
+func (rt jwksRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	require.Equal(rt.t, DefaultAuthority+rt.path, req.URL.String())
+
+	body, err := json.Marshal(map[string]any{"keys": []jwt.JWK{{
+		KeyType: "RSA",
+		KeyID:   "key-1",
+		N:       base64.RawURLEncoding.EncodeToString(testKey.N.Bytes()),
+		E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(testKey.E)).Bytes()),
+	}}})
+	require.NoError(rt.t, err)
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(string(body))),
+	}, nil
+}
+
+// signToken creates an RS256 token signed by the test key
+func signToken(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	hb, err := json.Marshal(jwt.Header{Algorithm: "RS256", KeyID: "key-1", Type: "JWT"})
+	require.NoError(t, err)
+	cb, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	input := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, testKey, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// v2Claims returns the claims of a v2.0 app-only token issued to a device identity
+func v2Claims(tenant string) map[string]any {
+	return map[string]any{
+		"iss":   DefaultAuthority + "/" + tenant + "/v2.0",
+		"aud":   testAudience,
+		"tid":   tenant,
+		"oid":   "device-oid",
+		"azp":   testApp,
+		"roles": []string{"Telemetry.Write"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// v1Claims returns the claims of a v1.0 app-only token issued to a device identity
+func v1Claims(tenant string) map[string]any {
+	return map[string]any{
+		"iss":   "https://sts.windows.net/" + tenant + "/",
+		"aud":   testAudience,
+		"tid":   tenant,
+		"oid":   "device-oid",
+		"appid": testApp,
+		"roles": []string{"Commands.Read"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func connectPacket(token string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{Password: []byte(token)},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	if options.TenantID == "" {
+		options.TenantID = testTenant
+	}
+	options.Audiences = []string{testAudience}
+	options.RoundTripper = jwksRoundTripper{t: t, path: "/" + options.TenantID + "/discovery/v2.0/keys"}
+
+	entraHook := new(Hook)
+	entraHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, entraHook.Init(options))
+	t.Cleanup(func() { entraHook.Stop() })
+	return entraHook
+}
+
+func TestID(t *testing.T) {
+	entraHook := new(Hook)
+
+	require.Equal(t, "entra-auth-hook", entraHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	entraHook := new(Hook)
+	require.True(t, entraHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, entraHook.Provides(mqtt.OnACLCheck))
+
+	entraHook.config.RoleACL = map[string]acl.Templates{"Telemetry.Write": {"telemetry/#": acl.WriteOnly}}
+	require.True(t, entraHook.Provides(mqtt.OnACLCheck))
+	require.True(t, entraHook.Provides(mqtt.OnDisconnect))
+	require.False(t, entraHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - single tenant",
+			config:      Options{TenantID: testTenant, Audiences: []string{testAudience}},
+			expectError: false,
+		},
+		{
+			name:        "Success - multi tenant",
+			config:      Options{TenantID: "organizations", AllowedTenants: []string{testTenant}, Audiences: []string{testAudience}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing audience",
+			config:      Options{TenantID: testTenant},
+			expectError: true,
+		},
+		{
+			name:        "Failure - multi tenant without allowed tenants",
+			config:      Options{TenantID: "common", Audiences: []string{testAudience}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if options, ok := tt.config.(Options); ok {
+				options.RoundTripper = jwksRoundTripper{t: t, path: "/" + options.TenantID + "/discovery/v2.0/keys"}
+				tt.config = options
+			}
+
+			entraHook := new(Hook)
+			entraHook.Log = slog.Default()
+			err := entraHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, entraHook.Stop())
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    Options
+		claims     func() map[string]any
+		expectPass bool
+	}{
+		{
+			name:       "Success - v2.0 token",
+			options:    Options{Applications: []string{testApp}},
+			claims:     func() map[string]any { return v2Claims(testTenant) },
+			expectPass: true,
+		},
+		{
+			name:       "Success - v1.0 token",
+			options:    Options{Applications: []string{testApp}},
+			claims:     func() map[string]any { return v1Claims(testTenant) },
+			expectPass: true,
+		},
+		{
+			name:       "Success - multi tenant allowed tenant",
+			options:    Options{TenantID: "organizations", AllowedTenants: []string{testTenant, otherTenant}},
+			claims:     func() map[string]any { return v2Claims(otherTenant) },
+			expectPass: true,
+		},
+		{
+			name:       "Failure - multi tenant other tenant",
+			options:    Options{TenantID: "organizations", AllowedTenants: []string{testTenant}},
+			claims:     func() map[string]any { return v2Claims(otherTenant) },
+			expectPass: false,
+		},
+		{
+			name:       "Failure - other tenant",
+			options:    Options{},
+			claims:     func() map[string]any { return v2Claims(otherTenant) },
+			expectPass: false,
+		},
+		{
+			name:    "Failure - issuer of another tenant",
+			options: Options{},
+			claims: func() map[string]any {
+				c := v2Claims(testTenant)
+				c["iss"] = DefaultAuthority + "/" + otherTenant + "/v2.0"
+				return c
+			},
+			expectPass: false,
+		},
+		{
+			name:    "Failure - other audience",
+			options: Options{},
+			claims: func() map[string]any {
+				c := v2Claims(testTenant)
+				c["aud"] = "https://graph.microsoft.com"
+				return c
+			},
+			expectPass: false,
+		},
+		{
+			name:       "Failure - other application",
+			options:    Options{Applications: []string{"44444444-4444-4444-4444-444444444444"}},
+			claims:     func() map[string]any { return v1Claims(testTenant) },
+			expectPass: false,
+		},
+		{
+			name:    "Failure - expired",
+			options: Options{},
+			claims: func() map[string]any {
+				c := v2Claims(testTenant)
+				c["exp"] = time.Now().Add(-time.Hour).Unix()
+				return c
+			},
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			entraHook := newHook(t, tt.options)
+			success := entraHook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, connectPacket(signToken(t, tt.claims())))
+			require.Equal(t, tt.expectPass, success)
+
+		})
+	}
+}
+
+func TestOnACLCheck(t *testing.T) {
+	entraHook := newHook(t, Options{
+		ACL: acl.Templates{"devices/{oid}/status": acl.WriteOnly},
+		RoleACL: map[string]acl.Templates{
+			"Telemetry.Write": {"tenants/{tid}/telemetry/{clientid}": acl.WriteOnly},
+			"Commands.Read":   {"apps/{appid}/commands/#": acl.ReadOnly},
+		},
+	})
+
+	v2 := &mqtt.Client{ID: "device-1"}
+	require.True(t, entraHook.OnConnectAuthenticate(v2, connectPacket(signToken(t, v2Claims(testTenant)))))
+	v1 := &mqtt.Client{ID: "device-2"}
+	require.True(t, entraHook.OnConnectAuthenticate(v1, connectPacket(signToken(t, v1Claims(testTenant)))))
+
+	tests := []struct {
+		name       string
+		client     *mqtt.Client
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - static template",
+			client:     v2,
+			topic:      "devices/device-oid/status",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - role template",
+			client:     v2,
+			topic:      "tenants/" + testTenant + "/telemetry/device-1",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - role template of another client",
+			client:     v2,
+			topic:      "tenants/" + testTenant + "/telemetry/device-2",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Success - v1.0 appid template",
+			client:     v1,
+			topic:      "apps/" + testApp + "/commands/reboot",
+			write:      false,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - role not assigned",
+			client:     v2,
+			topic:      "apps/" + testApp + "/commands/reboot",
+			write:      false,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, entraHook.OnACLCheck(tt.client, tt.topic, tt.write))
+
+		})
+	}
+
+	entraHook.OnDisconnect(v2, nil, true)
+	require.False(t, entraHook.OnACLCheck(v2, "devices/device-oid/status", true))
+}
@@ -0,0 +1,364 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Actions of the requests
+const (
+	ActionConnect   = "connect"
+	ActionPublish   = "publish"
+	ActionSubscribe = "subscribe"
+)
+
+// maxLine is the longest response line read from the program
+const maxLine = 1 << 20
+
+// Request is written to the program as a line of JSON
+type Request struct {
+	ID       uint64 `json:"id"`
+	Action   string `json:"action"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	Listener string `json:"listener,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+}
+
+// Response is read from the program as a line of JSON, with the id of its request
+type Response struct {
+	ID    uint64 `json:"id"`
+	Allow bool   `json:"allow"`
+}
+
+// Hook is a hook that authenticates clients and checks their ACLs by exchanging requests with external
+// programs over their stdin and stdout
+type Hook struct {
+	config  Options
+	workers chan *worker  // the workers which aren't handling a request
+	stopped chan struct{} // closed once the hook is stopped
+	once    sync.Once
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the exec hook
+type Options struct {
+	// Command is the program which is run, with Args, and Env added to the environment of the server,
+	// in Dir, or the working directory of the server if empty. Required
+	Command string
+	Args    []string
+	Env     []string
+	Dir     string
+
+	// Workers is how many instances of the program are run, each handling one request at a time, and
+	// defaults to 1
+	Workers int
+
+	// Timeout bounds each request, and defaults to 5 seconds. Programs which don't respond in time
+	// are killed and restarted
+	Timeout time.Duration
+
+	// RestartInterval is the least time between the starts of each program, and defaults to 1 second.
+	// Requests are denied while a program which exited waits to be restarted
+	RestartInterval time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "exec-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts the programs
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	execHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if execHookConfig.Command == "" {
+		return errors.New("command is required")
+	}
+
+	if execHookConfig.Workers <= 0 {
+		execHookConfig.Workers = 1
+	}
+
+	if execHookConfig.Timeout <= 0 {
+		execHookConfig.Timeout = 5 * time.Second
+	}
+
+	if execHookConfig.RestartInterval <= 0 {
+		execHookConfig.RestartInterval = time.Second
+	}
+
+	h.config = execHookConfig
+	workers := make(chan *worker, execHookConfig.Workers)
+	for i := 0; i < execHookConfig.Workers; i++ {
+		w := new(worker)
+		if err := h.start(w); err != nil {
+			for j := 0; j < i; j++ {
+				(<-workers).stop(execHookConfig.Timeout)
+			}
+			return fmt.Errorf("failed starting %s: %w", execHookConfig.Command, err)
+		}
+		workers <- w
+	}
+
+	h.workers = workers
+	h.stopped = make(chan struct{})
+	return nil
+}
+
+// Stop closes the stdin of the programs once their requests have finished, and kills those which
+// don't exit within the timeout
+func (h *Hook) Stop() error {
+	if h.stopped == nil {
+		return nil
+	}
+
+	h.once.Do(func() {
+		close(h.stopped)
+		for i := 0; i < h.config.Workers; i++ {
+			(<-h.workers).stop(h.config.Timeout)
+		}
+	})
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	return h.check(Request{
+		Action:   ActionConnect,
+		ClientID: cl.ID,
+		Username: string(pk.Connect.Username),
+		Password: string(pk.Connect.Password),
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	})
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	action := ActionSubscribe
+	if write {
+		action = ActionPublish
+	}
+
+	return h.check(Request{
+		Action:   action,
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Topic:    topic,
+	})
+}
+
+// check sends the request to a program, restarting it if it exited, and returns whether it allowed
+// the request
+func (h *Hook) check(req Request) bool {
+	var w *worker
+	select {
+	case w = <-h.workers:
+	case <-h.stopped:
+		return false
+	}
+	defer func() { h.workers <- w }()
+
+	if w.exited() {
+		if time.Since(w.started) < h.config.RestartInterval {
+			h.Log.Warn("exec auth program is waiting to restart", "command", h.config.Command, "action", req.Action, "client", req.ClientID)
+			return false
+		}
+
+		h.Log.Warn("restarting exec auth program", "command", h.config.Command)
+		if err := h.start(w); err != nil {
+			h.Log.Error("error occurred while starting exec auth program", "error", err, "command", h.config.Command)
+			return false
+		}
+	}
+
+	allow, err := w.request(req, h.config.Timeout)
+	if err != nil {
+		h.Log.Error("error occurred while checking with exec auth program", "error", err, "command", h.config.Command, "action", req.Action, "client", req.ClientID)
+		return false
+	}
+
+	return allow
+}
+
+// worker is an instance of the program
+type worker struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan Response
+	done      chan struct{} // closed once the program has exited
+	started   time.Time
+	next      uint64 // the id of the last request
+}
+
+// start starts the program of the worker
+func (h *Hook) start(w *worker) error {
+	w.started = time.Now()
+
+	cmd := exec.Command(h.config.Command, h.config.Args...)
+	cmd.Env = append(os.Environ(), h.config.Env...)
+	cmd.Dir = h.config.Dir
+	cmd.Stderr = &logWriter{hook: h}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	w.cmd = cmd
+	w.stdin = stdin
+	w.responses = make(chan Response, 1)
+	w.done = make(chan struct{})
+	go h.read(w, stdout)
+	return nil
+}
+
+// read reads the responses of the program until it exits
+func (h *Hook) read(w *worker, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 4096), maxLine)
+	for scanner.Scan() {
+		var resp Response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			h.Log.Warn("exec auth program wrote an invalid response", "error", err, "command", h.config.Command, "response", scanner.Text())
+			continue
+		}
+
+		select {
+		case w.responses <- resp:
+		default: // nothing is waiting for a response
+		}
+	}
+
+	err := w.cmd.Wait()
+	if err == nil {
+		err = scanner.Err()
+	}
+	h.Log.Debug("exec auth program exited", "error", err, "command", h.config.Command)
+	close(w.done)
+}
+
+// exited returns whether the program of the worker has exited
+func (w *worker) exited() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// request writes the request to the program and waits for its response
+func (w *worker) request(req Request, timeout time.Duration) (bool, error) {
+	w.next++
+	req.ID = w.next
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// a response to an earlier request which timed out may still be waiting
+	select {
+	case <-w.responses:
+	default:
+	}
+
+	if _, err := w.stdin.Write(append(b, '\n')); err != nil {
+		return false, err
+	}
+
+	for {
+		select {
+		case resp := <-w.responses:
+			if resp.ID == req.ID {
+				return resp.Allow, nil
+			}
+		case <-w.done:
+			select {
+			case resp := <-w.responses:
+				if resp.ID == req.ID {
+					return resp.Allow, nil
+				}
+			default:
+			}
+			return false, errors.New("program exited")
+		case <-timer.C:
+			w.kill(timeout)
+			return false, errors.New("program timed out")
+		}
+	}
+}
+
+// stop closes the stdin of the program, and kills it if it doesn't exit within the timeout
+func (w *worker) stop(timeout time.Duration) {
+	_ = w.stdin.Close()
+
+	select {
+	case <-w.done:
+	case <-time.After(timeout):
+		w.kill(timeout)
+	}
+}
+
+// kill kills the program, and waits for it to exit within the timeout
+func (w *worker) kill(timeout time.Duration) {
+	_ = w.cmd.Process.Kill()
+
+	select {
+	case <-w.done:
+	case <-time.After(timeout):
+	}
+}
+
+// logWriter logs what the programs write to their stderr
+type logWriter struct {
+	hook *Hook
+}
+
+// Write logs the bytes
+func (l *logWriter) Write(b []byte) (int, error) {
+	l.hook.Log.Info("exec auth program", "command", l.hook.config.Command, "stderr", string(bytes.TrimSpace(b)))
+	return len(b), nil
+}
@@ -0,0 +1,227 @@
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain runs the test binary as the auth program when the tests start it
+func TestMain(m *testing.M) {
+	if os.Getenv("EXEC_AUTH_PROGRAM") == "1" {
+		program()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// program allows the clients with the password "p1" to connect, and to publish to topics prefixed by
+// their client id. The username "crash" exits it, "slow" delays its response and "noisy" makes it write
+// an invalid response first
+func program() {
+	fmt.Fprintln(os.Stderr, "started")
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			os.Exit(2)
+		}
+
+		switch req.Username {
+		case "crash":
+			os.Exit(1)
+		case "slow":
+			time.Sleep(time.Second)
+		case "noisy":
+			fmt.Println("not json")
+			fmt.Println(`{"id": 0, "allow": true}`)
+		}
+
+		allow := true
+		switch req.Action {
+		case ActionConnect:
+			allow = req.Password == "p1" && req.Listener == "tcp"
+		case ActionPublish:
+			allow = strings.HasPrefix(req.Topic, req.ClientID+"/")
+		}
+
+		b, _ := json.Marshal(Response{ID: req.ID, Allow: allow})
+		fmt.Println(string(b))
+	}
+}
+
+func newOptions() Options {
+	return Options{
+		Command: os.Args[0],
+		Args:    []string{"-test.run=^$"},
+		Env:     []string{"EXEC_AUTH_PROGRAM=1", "GORACE=atexit_sleep_ms=0"},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	execHook := new(Hook)
+	execHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, execHook.Init(options))
+	t.Cleanup(func() { execHook.Stop() })
+	return execHook
+}
+
+func newClient(id, username string) *mqtt.Client {
+	cl := &mqtt.Client{ID: id}
+	cl.Properties.Username = []byte(username)
+	cl.Net.Listener = "tcp"
+	return cl
+}
+
+func connect(username, password string) packets.Packet {
+	return packets.Packet{Connect: packets.ConnectParams{Username: []byte(username), Password: []byte(password)}}
+}
+
+func TestID(t *testing.T) {
+	execHook := new(Hook)
+
+	require.Equal(t, "exec-auth-hook", execHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	execHook := new(Hook)
+	require.True(t, execHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, execHook.Provides(mqtt.OnACLCheck))
+	require.False(t, execHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      newOptions(),
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no command",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing command",
+			config:      Options{Command: "/nonexistent/auth-program", Workers: 2},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			execHook := new(Hook)
+			execHook.Log = slog.Default()
+			err := execHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				require.NoError(t, execHook.Stop())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 1, execHook.config.Workers)
+			require.Equal(t, 5*time.Second, execHook.config.Timeout)
+			require.Equal(t, time.Second, execHook.config.RestartInterval)
+			require.NoError(t, execHook.Stop())
+			require.NoError(t, execHook.Stop())
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	execHook := newHook(t, newOptions())
+
+	require.True(t, execHook.OnConnectAuthenticate(newClient("c1", "u1"), connect("u1", "p1")))
+	require.False(t, execHook.OnConnectAuthenticate(newClient("c1", "u1"), connect("u1", "p2")))
+	require.False(t, execHook.OnConnectAuthenticate(&mqtt.Client{ID: "c1"}, connect("u1", "p1")))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	execHook := newHook(t, newOptions())
+
+	cl := newClient("c1", "u1")
+	require.True(t, execHook.OnACLCheck(cl, "c1/telemetry", true))
+	require.False(t, execHook.OnACLCheck(cl, "c2/telemetry", true))
+	require.True(t, execHook.OnACLCheck(cl, "c2/telemetry", false))
+
+	// invalid responses and responses to other requests are ignored
+	require.False(t, execHook.OnACLCheck(newClient("c1", "noisy"), "c2/telemetry", true))
+}
+
+func TestRestart(t *testing.T) {
+	options := newOptions()
+	options.RestartInterval = 500 * time.Millisecond
+	execHook := newHook(t, options)
+
+	cl := newClient("c1", "u1")
+	require.True(t, execHook.OnACLCheck(cl, "c1/telemetry", true))
+	require.False(t, execHook.OnACLCheck(newClient("c1", "crash"), "c1/telemetry", true))
+
+	// requests are denied until the program can be restarted
+	require.False(t, execHook.OnACLCheck(cl, "c1/telemetry", true))
+	time.Sleep(options.RestartInterval)
+	require.True(t, execHook.OnACLCheck(cl, "c1/telemetry", true))
+}
+
+func TestTimeout(t *testing.T) {
+	options := newOptions()
+	options.Timeout = 100 * time.Millisecond
+	options.RestartInterval = time.Millisecond
+	execHook := newHook(t, options)
+
+	require.False(t, execHook.OnACLCheck(newClient("c1", "slow"), "c1/telemetry", true))
+	require.True(t, execHook.OnACLCheck(newClient("c1", "u1"), "c1/telemetry", true))
+}
+
+func TestWorkers(t *testing.T) {
+	options := newOptions()
+	options.Workers = 4
+	execHook := newHook(t, options)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("c%d", i)
+			for j := 0; j < 20; j++ {
+				require.True(t, execHook.OnACLCheck(newClient(id, "u1"), id+"/telemetry", true))
+				require.False(t, execHook.OnACLCheck(newClient(id, "u1"), "other/telemetry", true))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.NoError(t, execHook.Stop())
+	require.False(t, execHook.OnACLCheck(newClient("c1", "u1"), "c1/telemetry", true))
+}
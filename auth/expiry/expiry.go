@@ -0,0 +1,141 @@
+package expiry
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/auth/jwt"
+)
+
+// ErrMaximumConnectTime is the v5 disconnect reason sent to clients whose credentials have expired
+var ErrMaximumConnectTime = packets.Code{Code: 0xA0, Reason: "maximum connect time"}
+
+// ExpiryFunc returns the time at which a client's credentials expire, and false if they do not expire
+type ExpiryFunc func(cl *mqtt.Client, pk packets.Packet) (time.Time, bool)
+
+// Hook is a hook that disconnects clients when the token they authenticated with expires, so long-lived
+// MQTT sessions cannot outlive their credentials
+type Hook struct {
+	server     *mqtt.Server
+	expiryFunc ExpiryFunc
+	timers     map[*mqtt.Client]*time.Timer
+	mu         sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the expiry hook
+type Options struct {
+	Server *mqtt.Server // the server used to disconnect expired clients
+
+	// ExpiryFunc resolves the expiry of a connecting client's credentials. If nil, the exp claim of a
+	// JWT presented as the password is used. Expiries from other sources, such as a field in an auth
+	// service response, can also be recorded directly with SetExpiry
+	ExpiryFunc ExpiryFunc
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "token-expiry-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	expiryHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if expiryHookConfig.Server == nil {
+		return errors.New("nil server")
+	}
+
+	h.server = expiryHookConfig.Server
+	h.expiryFunc = JWTExpiry
+	if expiryHookConfig.ExpiryFunc != nil {
+		h.expiryFunc = expiryHookConfig.ExpiryFunc
+	}
+	h.timers = make(map[*mqtt.Client]*time.Timer)
+	return nil
+}
+
+// Stop cancels all pending disconnects
+func (h *Hook) Stop() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for cl, timer := range h.timers {
+		timer.Stop()
+		delete(h.timers, cl)
+	}
+	return nil
+}
+
+// OnSessionEstablished is called when a client has connected and schedules its disconnect
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if at, ok := h.expiryFunc(cl, pk); ok {
+		h.SetExpiry(cl, at)
+	}
+}
+
+// OnDisconnect is called when a client disconnects and cancels any pending disconnect
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if timer, ok := h.timers[cl]; ok {
+		timer.Stop()
+		delete(h.timers, cl)
+	}
+}
+
+// SetExpiry schedules the client to be disconnected with reason 0xA0 at the given time, replacing
+// any previously recorded expiry. A time in the past disconnects the client immediately
+func (h *Hook) SetExpiry(cl *mqtt.Client, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if timer, ok := h.timers[cl]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(at), func() {
+		h.mu.Lock()
+		if h.timers[cl] != timer {
+			h.mu.Unlock()
+			return // the expiry was replaced or cancelled
+		}
+		delete(h.timers, cl)
+		h.mu.Unlock()
+
+		h.Log.Info("disconnecting client with expired credentials", "client", cl.ID, "expiry", at)
+		_ = h.server.DisconnectClient(cl, ErrMaximumConnectTime)
+	})
+	h.timers[cl] = timer
+}
+
+// JWTExpiry returns the exp claim of a JWT presented as the client's password. The token is not
+// verified, so this must be used alongside an auth hook which does
+func JWTExpiry(cl *mqtt.Client, pk packets.Packet) (time.Time, bool) {
+	claims, err := jwt.DecodeClaims(string(pk.Connect.Password))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return claims.Time("exp")
+}
@@ -0,0 +1,173 @@
+package expiry
+
+import (
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestID(t *testing.T) {
+	expiryHook := new(Hook)
+
+	require.Equal(t, "token-expiry-hook", expiryHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	expiryHook := new(Hook)
+
+	require.True(t, expiryHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, expiryHook.Provides(mqtt.OnDisconnect))
+	require.False(t, expiryHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	expiryHook := new(Hook)
+	expiryHook.Log = slog.Default()
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - Proper config",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - nil server",
+			config:      Options{},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := expiryHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	token := "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(`{"exp":1700000000}`)) + ".sig"
+
+	at, ok := JWTExpiry(nil, packets.Packet{Connect: packets.ConnectParams{Password: []byte(token)}})
+	require.True(t, ok)
+	require.Equal(t, time.Unix(1700000000, 0), at)
+
+	_, ok = JWTExpiry(nil, packets.Packet{Connect: packets.ConnectParams{Password: []byte("password")}})
+	require.False(t, ok)
+}
+
+func newClient(t *testing.T, s *mqtt.Server) *mqtt.Client {
+	r, w := net.Pipe()
+	t.Cleanup(func() { r.Close(); w.Close() })
+	go io.Copy(io.Discard, w)
+
+	cl := s.NewClient(r, "tcp", "client", false)
+	cl.Properties.ProtocolVersion = 5
+	return cl
+}
+
+func TestOnSessionEstablished(t *testing.T) {
+	s := mqtt.New(nil)
+
+	tests := []struct {
+		name             string
+		expiry           time.Duration
+		expectOk         bool
+		expectDisconnect bool
+	}{
+		{
+			name:             "Success - expired credentials disconnect",
+			expiry:           10 * time.Millisecond,
+			expectOk:         true,
+			expectDisconnect: true,
+		},
+		{
+			name:             "Success - past expiry disconnects immediately",
+			expiry:           -time.Minute,
+			expectOk:         true,
+			expectDisconnect: true,
+		},
+		{
+			name:             "Success - valid credentials stay connected",
+			expiry:           time.Hour,
+			expectOk:         true,
+			expectDisconnect: false,
+		},
+		{
+			name:             "Success - no expiry",
+			expectOk:         false,
+			expectDisconnect: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			expiryHook := new(Hook)
+			expiryHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			require.NoError(t, expiryHook.Init(Options{
+				Server: s,
+				ExpiryFunc: func(cl *mqtt.Client, pk packets.Packet) (time.Time, bool) {
+					return time.Now().Add(tt.expiry), tt.expectOk
+				},
+			}))
+			defer expiryHook.Stop()
+
+			cl := newClient(t, s)
+			expiryHook.OnSessionEstablished(cl, packets.Packet{})
+
+			if tt.expectDisconnect {
+				require.Eventually(t, cl.Closed, time.Second, time.Millisecond)
+				require.ErrorIs(t, cl.StopCause(), ErrMaximumConnectTime)
+				return
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			require.False(t, cl.Closed())
+
+		})
+	}
+}
+
+func TestOnDisconnect(t *testing.T) {
+	s := mqtt.New(nil)
+	expiryHook := new(Hook)
+	expiryHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, expiryHook.Init(Options{Server: s}))
+
+	cl := newClient(t, s)
+	expiryHook.SetExpiry(cl, time.Now().Add(20*time.Millisecond))
+	expiryHook.OnDisconnect(cl, nil, true)
+
+	time.Sleep(40 * time.Millisecond)
+	require.False(t, cl.Closed())
+	require.Empty(t, expiryHook.timers)
+}
@@ -0,0 +1,140 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// placeholders translates the mosquitto style substitutions to acl template placeholders
+var placeholders = strings.NewReplacer("%c", "{clientid}", "%u", "{username}")
+
+// Config is the contents of an auth file, which may be written in YAML or JSON, eg.
+//
+//	users:
+//	  alice:
+//	    password: $pbkdf2-sha256$29000$...
+//	    groups: [sensors]
+//	    acl:
+//	      alice/#: rw
+//	groups:
+//	  sensors:
+//	    acl:
+//	      sensors/%c/#: rw
+//	acl:
+//	  public/#: r
+//
+// ACL rules may contain +/# wildcards and the substitutions %c or {clientid} for the client id and %u
+// or {username} for the username
+type Config struct {
+	Users  map[string]User  `yaml:"users" json:"users"`
+	Groups map[string]Group `yaml:"groups" json:"groups"`
+	ACL    acl.Templates    `yaml:"acl" json:"acl"` // granted to every authenticated user
+}
+
+// User is a user of the auth file
+type User struct {
+	Password string        `yaml:"password" json:"password"` // a hash in a format supported by the hook's password schemes, or from the htpasswd file
+	Groups   []string      `yaml:"groups" json:"groups"`
+	ACL      acl.Templates `yaml:"acl" json:"acl"`
+}
+
+// Group is a set of ACL rules shared by its members
+type Group struct {
+	ACL acl.Templates `yaml:"acl" json:"acl"`
+}
+
+// LoadConfig reads and validates an auth file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(data)
+}
+
+// ParseConfig parses and validates the contents of an auth file. As YAML is a superset of JSON, both
+// are parsed as YAML
+func ParseConfig(data []byte) (*Config, error) {
+	config := new(Config)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	config.ACL = translate(config.ACL)
+	for name, group := range config.Groups {
+		group.ACL = translate(group.ACL)
+		config.Groups[name] = group
+	}
+	for name, user := range config.Users {
+		user.ACL = translate(user.ACL)
+		config.Users[name] = user
+	}
+
+	return config, nil
+}
+
+// validate checks every user only belongs to groups which exist. Passwords may instead come from an
+// htpasswd file, so are checked once the files are combined
+func (c *Config) validate() error {
+	for name, user := range c.Users {
+		for _, group := range user.Groups {
+			if _, ok := c.Groups[group]; !ok {
+				return fmt.Errorf("user %q belongs to unknown group %q", name, group)
+			}
+		}
+	}
+
+	return nil
+}
+
+// requirePasswords checks every user has a password
+func (c *Config) requirePasswords() error {
+	for name, user := range c.Users {
+		if user.Password == "" {
+			return fmt.Errorf("user %q has no password", name)
+		}
+	}
+
+	return nil
+}
+
+// Filters renders the rules which apply to the user
+func (c *Config) Filters(username, clientID string) acl.Filters {
+	values := map[string]string{
+		"clientid": clientID,
+		"username": username,
+	}
+
+	filters := c.ACL.Render(values)
+	user := c.Users[username]
+	for _, group := range user.Groups {
+		filters.Merge(c.Groups[group].ACL.Render(values))
+	}
+	filters.Merge(user.ACL.Render(values))
+
+	return filters
+}
+
+func translate(templates acl.Templates) acl.Templates {
+	out := make(acl.Templates, len(templates))
+	for template, access := range templates {
+		out[placeholders.Replace(template)] = access
+	}
+	return out
+}
@@ -0,0 +1,135 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+const testYAML = `
+users:
+  alice:
+    password: $pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA
+    groups: [sensors]
+    acl:
+      alice/#: rw
+      sensors/secret: deny
+  bob:
+    password: $pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA
+groups:
+  sensors:
+    acl:
+      sensors/%c/#: rw
+      sensors/+/status: r
+acl:
+  public/#: r
+  users/%u/inbox: r
+`
+
+const testJSON = `{
+  "users": {
+    "alice": {
+      "password": "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA",
+      "groups": ["sensors"]
+    }
+  },
+  "groups": {"sensors": {"acl": {"sensors/{clientid}/#": "rw"}}},
+  "acl": {"public/#": "r"}
+}`
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expectACL   acl.Templates
+		expectError bool
+	}{
+		{
+			name: "Success - yaml",
+			data: testYAML,
+			expectACL: acl.Templates{
+				"public/#":               acl.ReadOnly,
+				"users/{username}/inbox": acl.ReadOnly,
+			},
+		},
+		{
+			name:      "Success - json",
+			data:      testJSON,
+			expectACL: acl.Templates{"public/#": acl.ReadOnly},
+		},
+		{
+			name:      "Success - empty",
+			data:      "",
+			expectACL: acl.Templates{},
+		},
+		{
+			name:        "Failure - unknown group",
+			data:        "users:\n  alice:\n    password: x\n    groups: [admins]\n",
+			expectError: true,
+		},
+		{
+			name:      "Success - missing password",
+			data:      "users:\n  alice:\n    groups: []\n",
+			expectACL: acl.Templates{},
+		},
+		{
+			name:        "Failure - unknown access",
+			data:        "acl:\n  public/#: everything\n",
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown field",
+			data:        "userz:\n  alice:\n    password: x\n",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			config, err := ParseConfig([]byte(tt.data))
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectACL, config.ACL)
+
+		})
+	}
+}
+
+func TestConfigFilters(t *testing.T) {
+	config, err := ParseConfig([]byte(testYAML))
+	require.NoError(t, err)
+
+	require.Equal(t, acl.Filters{
+		"public/#":           acl.ReadOnly,
+		"users/alice/inbox":  acl.ReadOnly,
+		"sensors/sensor-1/#": acl.ReadWrite,
+		"sensors/+/status":   acl.ReadOnly,
+		"alice/#":            acl.ReadWrite,
+		"sensors/secret":     acl.Deny,
+	}, config.Filters("alice", "sensor-1"))
+
+	require.Equal(t, acl.Filters{
+		"public/#":        acl.ReadOnly,
+		"users/bob/inbox": acl.ReadOnly,
+	}, config.Filters("bob", "bob-laptop"))
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testYAML), 0600))
+
+	config, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Len(t, config.Users, 2)
+
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.Error(t, err)
+}
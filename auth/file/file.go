@@ -0,0 +1,297 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/password"
+)
+
+// Hook is a self-contained hook that authenticates clients against the users of an auth file, and
+// grants them the ACL rules of the file, their groups and themselves. Passwords may instead come
+// from an htpasswd file, and the files can be reloaded without restarting the broker
+type Hook struct {
+	config   Options
+	users    atomic.Pointer[Config]
+	sessions acl.Sessions
+	clients  map[*mqtt.Client]session
+	modified []time.Time
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	mqtt.HookBase
+}
+
+// session is the user a connected client authenticated as
+type session struct {
+	username string
+	password string // the hash the client was verified against
+}
+
+// Options is a struct that contains all the information required to configure the file auth hook
+type Options struct {
+	Path   string  // the auth file, in YAML or JSON
+	Config *Config // used instead of Path if set
+
+	// Htpasswd is an Apache htpasswd file which provides the passwords of the users, so they can be
+	// managed with the htpasswd tool. Its users are granted the rules of the auth file, and of their
+	// entry in it if there is one. Its passwords take precedence over those of the auth file
+	Htpasswd string
+
+	// Schemes verify the password hashes of the users, defaults to password.Default, and also
+	// password.Htpasswd if Htpasswd is set. Add schemes to support further formats, eg. scrypt from
+	// golang.org/x/crypto
+	Schemes password.Schemes
+
+	// ReloadInterval is how often the files are checked for changes, and ReloadOnSignal reloads them
+	// when the process receives SIGHUP. Files which fail to load leave the current rules in place
+	ReloadInterval time.Duration
+	ReloadOnSignal bool
+
+	// DisconnectRemoved disconnects clients whose user was removed or whose password changed when the
+	// file is reloaded, otherwise they keep their permissions until they reconnect. Requires Server
+	DisconnectRemoved bool
+	Server            *mqtt.Server
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "file-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	fileHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if fileHookConfig.Schemes == nil {
+		fileHookConfig.Schemes = password.Default
+		if fileHookConfig.Htpasswd != "" {
+			fileHookConfig.Schemes = append(append(password.Schemes{}, password.Default...), password.Htpasswd...)
+		}
+	}
+
+	if fileHookConfig.DisconnectRemoved && fileHookConfig.Server == nil {
+		return errors.New("server is required to disconnect removed users")
+	}
+
+	h.config = fileHookConfig
+	h.clients = make(map[*mqtt.Client]session)
+
+	if fileHookConfig.Path == "" && fileHookConfig.Config == nil {
+		return errors.New("path or config is required")
+	}
+
+	if err := h.Reload(); err != nil {
+		return err
+	}
+
+	if len(h.files()) > 0 && (fileHookConfig.ReloadInterval > 0 || fileHookConfig.ReloadOnSignal) {
+		ctx, cancel := context.WithCancel(context.Background())
+		h.cancel = cancel
+		go h.watch(ctx)
+	}
+
+	return nil
+}
+
+// Stop stops watching the files
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// watch reloads the files when they change or SIGHUP is received, until the context is cancelled
+func (h *Hook) watch(ctx context.Context) {
+	var tick <-chan time.Time
+	if h.config.ReloadInterval > 0 {
+		ticker := time.NewTicker(h.config.ReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var hup chan os.Signal
+	if h.config.ReloadOnSignal {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			if !h.changed() {
+				continue
+			}
+		case <-hup:
+		}
+
+		if err := h.Reload(); err != nil {
+			h.Log.Error("error occurred while reloading auth files", "error", err)
+		}
+	}
+}
+
+// files returns the files the users and rules are loaded from
+func (h *Hook) files() []string {
+	var files []string
+	if h.config.Path != "" {
+		files = append(files, h.config.Path)
+	}
+	if h.config.Htpasswd != "" {
+		files = append(files, h.config.Htpasswd)
+	}
+	return files
+}
+
+// modTimes returns the modification times of the files
+func (h *Hook) modTimes() ([]time.Time, error) {
+	var modified []time.Time
+	for _, file := range h.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modified = append(modified, info.ModTime())
+	}
+	return modified, nil
+}
+
+// changed returns whether any file was modified since they were last loaded
+func (h *Hook) changed() bool {
+	modified, err := h.modTimes()
+	if err != nil {
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !slices.EqualFunc(modified, h.modified, time.Time.Equal)
+}
+
+// Reload reads the files again and atomically swaps in their users and rules, which also apply to
+// connected clients. If the files cannot be loaded, the current rules are kept
+func (h *Hook) Reload() error {
+	modified, err := h.modTimes()
+	if err != nil {
+		return err
+	}
+
+	users := h.config.Config
+	if h.config.Path != "" {
+		if users, err = LoadConfig(h.config.Path); err != nil {
+			return err
+		}
+	}
+
+	if h.config.Htpasswd != "" {
+		passwords, err := LoadHtpasswd(h.config.Htpasswd)
+		if err != nil {
+			return err
+		}
+		users = users.withPasswords(passwords)
+	}
+
+	if err := users.requirePasswords(); err != nil {
+		return err
+	}
+
+	h.users.Store(users)
+
+	h.mu.Lock()
+	h.modified = modified
+	clients := make(map[*mqtt.Client]session, len(h.clients))
+	for cl, s := range h.clients {
+		clients[cl] = s
+	}
+	h.mu.Unlock()
+
+	for cl, s := range clients {
+		if user, ok := users.Users[s.username]; ok && user.Password == s.password {
+			h.sessions.Set(cl, users.Filters(s.username, cl.ID))
+			continue
+		}
+
+		if !h.config.DisconnectRemoved {
+			continue
+		}
+
+		h.Log.Info("disconnecting client whose credentials were removed", "client", cl.ID, "username", s.username)
+		h.sessions.Delete(cl)
+		if err := h.config.Server.DisconnectClient(cl, packets.ErrAdministrativeAction); err != nil {
+			h.Log.Error("error occurred while disconnecting client", "error", err, "client", cl.ID)
+		}
+	}
+
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	users := h.users.Load()
+	username := string(pk.Connect.Username)
+	user, ok := users.Users[username]
+	if !ok {
+		return false
+	}
+
+	match, err := h.config.Schemes.Verify(user.Password, string(pk.Connect.Password))
+	if err != nil {
+		h.Log.Error("error occurred while verifying password", "error", err, "username", username)
+		return false
+	}
+
+	if !match {
+		return false
+	}
+
+	h.sessions.Set(cl, users.Filters(username, cl.ID))
+	h.mu.Lock()
+	h.clients[cl] = session{username: username, password: user.Password}
+	h.mu.Unlock()
+
+	return true
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+	h.mu.Lock()
+	delete(h.clients, cl)
+	h.mu.Unlock()
+}
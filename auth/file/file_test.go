@@ -0,0 +1,481 @@
+package file
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/password"
+)
+
+// testHtpasswd has the password "password" for each user, hashed by htpasswd -B, -m and -s
+const testHtpasswd = `# managed with htpasswd
+alice:$2y$05$CCCCCCCCCCCCCCCCCCCCC.aDV7CQarKHMuNfh2oJkFzsHZya4whFe
+bob:$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0
+
+carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`
+
+func connectPacket(username, pass string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username: []byte(username),
+			Password: []byte(pass),
+		},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	fileHook := new(Hook)
+	fileHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, fileHook.Init(options))
+	return fileHook
+}
+
+func TestID(t *testing.T) {
+	fileHook := new(Hook)
+
+	require.Equal(t, "file-auth-hook", fileHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	fileHook := new(Hook)
+	require.True(t, fileHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, fileHook.Provides(mqtt.OnACLCheck))
+	require.True(t, fileHook.Provides(mqtt.OnDisconnect))
+	require.False(t, fileHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testYAML), 0600))
+	broken := filepath.Join(t.TempDir(), "broken.yaml")
+	require.NoError(t, os.WriteFile(broken, []byte("users: ["), 0600))
+	nopass := filepath.Join(t.TempDir(), "nopass.yaml")
+	require.NoError(t, os.WriteFile(nopass, []byte("users:\n  alice: {}\n"), 0600))
+	htpasswd := filepath.Join(t.TempDir(), ".htpasswd")
+	require.NoError(t, os.WriteFile(htpasswd, []byte(testHtpasswd), 0600))
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - path",
+			config:      Options{Path: path},
+			expectError: false,
+		},
+		{
+			name:        "Success - config",
+			config:      Options{Config: &Config{}},
+			expectError: false,
+		},
+		{
+			name:        "Success - htpasswd",
+			config:      Options{Path: nopass, Htpasswd: htpasswd},
+			expectError: false,
+		},
+		{
+			name:        "Success - htpasswd with config",
+			config:      Options{Config: &Config{}, Htpasswd: htpasswd},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no path or config",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing file",
+			config:      Options{Path: filepath.Join(t.TempDir(), "missing.yaml")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing password",
+			config:      Options{Path: nopass},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing htpasswd",
+			config:      Options{Path: path, Htpasswd: filepath.Join(t.TempDir(), ".htpasswd")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - broken file",
+			config:      Options{Path: broken},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			fileHook := new(Hook)
+			fileHook.Log = slog.Default()
+			err := fileHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, fileHook.config.Schemes)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	config, err := ParseConfig([]byte(testYAML))
+	require.NoError(t, err)
+	config.Users["carol"] = User{Password: "$2y$10$unsupported"}
+	config.Users["dave"] = User{Password: "plain:secret"}
+
+	schemes := append(password.Schemes{password.Func{
+		Prefixes: []string{"plain:"},
+		VerifyFunc: func(hash, pass string) (bool, error) {
+			return hash == "plain:"+pass, nil
+		},
+	}}, password.Default...)
+
+	fileHook := newHook(t, Options{Config: config, Schemes: schemes})
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		expectPass bool
+	}{
+		{
+			name:       "Success - valid password",
+			username:   "alice",
+			password:   "password",
+			expectPass: true,
+		},
+		{
+			name:       "Success - custom scheme",
+			username:   "dave",
+			password:   "secret",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - wrong password",
+			username:   "alice",
+			password:   "passw0rd",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unknown user",
+			username:   "mallory",
+			password:   "password",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unsupported hash",
+			username:   "carol",
+			password:   "password",
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &mqtt.Client{ID: "sensor-1"}
+			require.Equal(t, tt.expectPass, fileHook.OnConnectAuthenticate(cl, connectPacket(tt.username, tt.password)))
+
+		})
+	}
+}
+
+func TestOnACLCheck(t *testing.T) {
+	config, err := ParseConfig([]byte(testYAML))
+	require.NoError(t, err)
+	fileHook := newHook(t, Options{Config: config})
+
+	alice := &mqtt.Client{ID: "sensor-1"}
+	require.True(t, fileHook.OnConnectAuthenticate(alice, connectPacket("alice", "password")))
+	bob := &mqtt.Client{ID: "bob-laptop"}
+	require.True(t, fileHook.OnConnectAuthenticate(bob, connectPacket("bob", "password")))
+
+	tests := []struct {
+		name       string
+		client     *mqtt.Client
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - global rule",
+			client:     bob,
+			topic:      "public/news",
+			expectPass: true,
+		},
+		{
+			name:       "Success - username substitution",
+			client:     bob,
+			topic:      "users/bob/inbox",
+			expectPass: true,
+		},
+		{
+			name:       "Success - group rule with client id substitution",
+			client:     alice,
+			topic:      "sensors/sensor-1/temperature",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - group rule with wildcard",
+			client:     alice,
+			topic:      "sensors/sensor-2/status",
+			expectPass: true,
+		},
+		{
+			name:       "Success - user rule",
+			client:     alice,
+			topic:      "alice/notes",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - user deny rule",
+			client:     alice,
+			topic:      "sensors/secret",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - read only global rule",
+			client:     bob,
+			topic:      "public/news",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - another user's inbox",
+			client:     bob,
+			topic:      "users/alice/inbox",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - not in group",
+			client:     bob,
+			topic:      "sensors/bob-laptop/temperature",
+			write:      true,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, fileHook.OnACLCheck(tt.client, tt.topic, tt.write))
+
+		})
+	}
+
+	fileHook.OnDisconnect(alice, nil, true)
+	require.False(t, fileHook.OnACLCheck(alice, "alice/notes", true))
+}
+
+// connectedClient returns a client of the server whose peer discards everything sent to it
+func connectedClient(t *testing.T, s *mqtt.Server, id string) *mqtt.Client {
+	t.Helper()
+
+	r, w := net.Pipe()
+	go io.Copy(io.Discard, w)
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	cl := s.NewClient(r, "tcp", id, false)
+	cl.Properties.ProtocolVersion = 5
+	return cl
+}
+
+// writeConfig writes the auth file with a modification time in the past, so every write is seen as a change
+func writeConfig(t *testing.T, path, data string, age time.Duration) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+	modified := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, modified, modified))
+}
+
+func TestInitReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	writeConfig(t, path, testYAML, time.Hour)
+
+	fileHook := new(Hook)
+	fileHook.Log = slog.Default()
+	require.Error(t, fileHook.Init(Options{Path: path, DisconnectRemoved: true}))
+	require.NoError(t, fileHook.Init(Options{Path: path, DisconnectRemoved: true, Server: mqtt.New(nil)}))
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	writeConfig(t, path, testYAML, time.Hour)
+
+	s := mqtt.New(nil)
+	fileHook := newHook(t, Options{Path: path, Server: s, DisconnectRemoved: true})
+
+	alice := connectedClient(t, s, "sensor-1")
+	require.True(t, fileHook.OnConnectAuthenticate(alice, connectPacket("alice", "password")))
+	bob := connectedClient(t, s, "bob-laptop")
+	require.True(t, fileHook.OnConnectAuthenticate(bob, connectPacket("bob", "password")))
+	require.True(t, fileHook.OnACLCheck(bob, "public/news", false))
+
+	// a broken file keeps the current rules
+	writeConfig(t, path, "users: [", 30*time.Minute)
+	require.Error(t, fileHook.Reload())
+	require.True(t, fileHook.OnACLCheck(bob, "public/news", false))
+
+	// alice is removed and the public rules are narrowed
+	writeConfig(t, path, `
+users:
+  bob:
+    password: $pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA
+acl:
+  public/weather: r
+`, 15*time.Minute)
+	require.NoError(t, fileHook.Reload())
+
+	require.True(t, alice.Closed())
+	require.ErrorIs(t, alice.StopCause(), packets.ErrAdministrativeAction)
+	require.False(t, fileHook.OnACLCheck(alice, "alice/notes", true))
+
+	require.False(t, bob.Closed())
+	require.False(t, fileHook.OnACLCheck(bob, "public/news", false))
+	require.True(t, fileHook.OnACLCheck(bob, "public/weather", false))
+
+	// and can no longer connect
+	require.False(t, fileHook.OnConnectAuthenticate(connectedClient(t, s, "sensor-1"), connectPacket("alice", "password")))
+}
+
+func TestReloadPasswordChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	writeConfig(t, path, testYAML, time.Hour)
+
+	s := mqtt.New(nil)
+	fileHook := newHook(t, Options{Path: path})
+
+	bob := connectedClient(t, s, "bob-laptop")
+	require.True(t, fileHook.OnConnectAuthenticate(bob, connectPacket("bob", "password")))
+
+	hash, err := password.HashPBKDF2("changed", 1000)
+	require.NoError(t, err)
+	writeConfig(t, path, "users:\n  bob:\n    password: "+hash+"\n", 30*time.Minute)
+	require.NoError(t, fileHook.Reload())
+
+	// without DisconnectRemoved the client stays connected with its previous permissions
+	require.False(t, bob.Closed())
+	require.True(t, fileHook.OnACLCheck(bob, "public/news", false))
+
+	fileHook.OnDisconnect(bob, nil, true)
+	require.Empty(t, fileHook.clients)
+	require.False(t, fileHook.OnConnectAuthenticate(connectedClient(t, s, "bob-laptop"), connectPacket("bob", "password")))
+	require.True(t, fileHook.OnConnectAuthenticate(connectedClient(t, s, "bob-laptop"), connectPacket("bob", "changed")))
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	writeConfig(t, path, testYAML, time.Hour)
+
+	fileHook := newHook(t, Options{Path: path, ReloadInterval: 10 * time.Millisecond})
+	t.Cleanup(func() { fileHook.Stop() })
+
+	writeConfig(t, path, "users:\n  carol:\n    password: $pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA\n", 30*time.Minute)
+	require.Eventually(t, func() bool {
+		_, ok := fileHook.users.Load().Users["carol"]
+		return ok
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestWatchSignal(t *testing.T) {
+	// catch SIGHUP in the test as well, so the process survives if it arrives before the hook listens
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	process, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	writeConfig(t, path, testYAML, time.Hour)
+
+	fileHook := newHook(t, Options{Path: path, ReloadOnSignal: true})
+	t.Cleanup(func() { fileHook.Stop() })
+
+	writeConfig(t, path, "users: {}\n", time.Hour)
+	require.Eventually(t, func() bool {
+		if err := process.Signal(syscall.SIGHUP); err != nil {
+			t.Skip("signals are not supported on this platform")
+		}
+		return len(fileHook.users.Load().Users) == 0
+	}, time.Second, 20*time.Millisecond)
+}
+
+func TestHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.yaml")
+	writeConfig(t, path, `
+users:
+  alice:
+    groups: [sensors]
+groups:
+  sensors:
+    acl:
+      sensors/%c/#: rw
+acl:
+  public/#: r
+`, time.Hour)
+	htpasswd := filepath.Join(t.TempDir(), ".htpasswd")
+	writeConfig(t, htpasswd, testHtpasswd, time.Hour)
+
+	fileHook := newHook(t, Options{Path: path, Htpasswd: htpasswd})
+
+	alice := &mqtt.Client{ID: "sensor-1"}
+	require.True(t, fileHook.OnConnectAuthenticate(alice, connectPacket("alice", "password")))
+	require.True(t, fileHook.OnACLCheck(alice, "sensors/sensor-1/temperature", true))
+	require.True(t, fileHook.OnACLCheck(alice, "public/news", false))
+
+	// users only in the htpasswd file are granted the global rules
+	bob := &mqtt.Client{ID: "bob-laptop"}
+	require.True(t, fileHook.OnConnectAuthenticate(bob, connectPacket("bob", "password")))
+	require.True(t, fileHook.OnACLCheck(bob, "public/news", false))
+	require.False(t, fileHook.OnACLCheck(bob, "sensors/bob-laptop/temperature", true))
+
+	require.True(t, fileHook.OnConnectAuthenticate(&mqtt.Client{ID: "carol"}, connectPacket("carol", "password")))
+	require.False(t, fileHook.OnConnectAuthenticate(&mqtt.Client{ID: "carol"}, connectPacket("carol", "passw0rd")))
+
+	// changing the htpasswd file alone is picked up
+	require.False(t, fileHook.changed())
+
+	writeConfig(t, htpasswd, "bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", 30*time.Minute)
+	require.True(t, fileHook.changed())
+
+	// alice is still in the auth file, but now has no password
+	require.Error(t, fileHook.Reload())
+	require.True(t, fileHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("alice", "password")))
+}
@@ -0,0 +1,68 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadHtpasswd reads the password hashes of an Apache htpasswd file
+func LoadHtpasswd(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseHtpasswd(data)
+}
+
+// ParseHtpasswd parses the contents of an htpasswd file, one username:hash entry per line, into the
+// password hashes of the users. Blank lines and lines starting with # are ignored
+func ParseHtpasswd(data []byte) (map[string]string, error) {
+	passwords := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" || hash == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", n)
+		}
+
+		if _, ok := passwords[username]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, username)
+		}
+
+		passwords[username] = hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return passwords, nil
+}
+
+// withPasswords returns a copy of the config whose users have the given passwords, adding the users
+// which are only in passwords
+func (c *Config) withPasswords(passwords map[string]string) *Config {
+	out := *c
+	out.Users = make(map[string]User, len(c.Users)+len(passwords))
+	for name, user := range c.Users {
+		out.Users[name] = user
+	}
+
+	for name, hash := range passwords {
+		user := out.Users[name]
+		user.Password = hash
+		out.Users[name] = user
+	}
+
+	return &out
+}
@@ -0,0 +1,94 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expect      map[string]string
+		expectError bool
+	}{
+		{
+			name: "Success - entries",
+			data: testHtpasswd,
+			expect: map[string]string{
+				"alice": "$2y$05$CCCCCCCCCCCCCCCCCCCCC.aDV7CQarKHMuNfh2oJkFzsHZya4whFe",
+				"bob":   "$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0",
+				"carol": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+			},
+		},
+		{
+			name:   "Success - crlf",
+			data:   "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\r\n",
+			expect: map[string]string{"alice": "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="},
+		},
+		{
+			name:   "Success - empty",
+			data:   "",
+			expect: map[string]string{},
+		},
+		{
+			name:        "Failure - missing separator",
+			data:        "alice\n",
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing hash",
+			data:        "alice:\n",
+			expectError: true,
+		},
+		{
+			name:        "Failure - duplicate user",
+			data:        "alice:{SHA}a\nalice:{SHA}b\n",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			passwords, err := ParseHtpasswd([]byte(tt.data))
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, passwords)
+
+		})
+	}
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	require.NoError(t, os.WriteFile(path, []byte(testHtpasswd), 0600))
+
+	passwords, err := LoadHtpasswd(path)
+	require.NoError(t, err)
+	require.Len(t, passwords, 3)
+
+	_, err = LoadHtpasswd(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestConfigWithPasswords(t *testing.T) {
+	config, err := ParseConfig([]byte(testYAML))
+	require.NoError(t, err)
+
+	merged := config.withPasswords(map[string]string{"alice": "{SHA}a", "carol": "{SHA}c"})
+	require.Equal(t, "{SHA}a", merged.Users["alice"].Password)
+	require.Equal(t, []string{"sensors"}, merged.Users["alice"].Groups)
+	require.Equal(t, config.Users["bob"], merged.Users["bob"])
+	require.Equal(t, "{SHA}c", merged.Users["carol"].Password)
+
+	// the original is unchanged
+	require.NotEqual(t, "{SHA}a", config.Users["alice"].Password)
+	require.NotContains(t, config.Users, "carol")
+}
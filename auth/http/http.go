@@ -2,15 +2,23 @@ package auth
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
+	"time"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
 )
 
 // Hook is a hook that makes http requests to an external service
@@ -20,6 +28,9 @@ type Hook struct {
 	clientauthhost *url.URL
 	superuserhost  *url.URL // currently unused
 	callback       func(resp *http.Response) bool
+	cache          *cache.Cache[[32]byte, struct{}] // the checks which were allowed, if caching
+	retry          *retry.Policy
+	mu             sync.RWMutex
 	mqtt.HookBase
 }
 
@@ -32,6 +43,15 @@ type Options struct {
 	ClientAuthenticationHost *url.URL // currently unused
 	RoundTripper             http.RoundTripper
 	Callback                 func(resp *http.Response) bool
+
+	// CacheTTL is how long allowed checks are cached, so repeated checks don't make requests, and
+	// CacheSize is how many are kept, defaulting to 10000. Checks are not cached if CacheTTL is zero
+	CacheTTL  time.Duration
+	CacheSize int
+
+	// Retry retries requests which fail, or which the endpoint answers with a 429 or 5XX status,
+	// and must limit the attempts or the time spent. Requests are made once if it is nil
+	Retry *retry.Policy
 }
 
 // ClientCheckPOST is the struct that is sent to the client authentication endpoint
@@ -73,26 +93,89 @@ func (h *Hook) Init(config any) error {
 		return errors.New("improper config")
 	}
 
-	if !validateConfig(authHookConfig) {
-		return errors.New("hostname configs failed validation")
+	if err := checkOptions(authHookConfig); err != nil {
+		return err
 	}
 
 	h.callback = defaultCallback
-	if authHookConfig.Callback != nil {
-		h.Log.Debug("replacing default callback with one included in options")
-		h.callback = authHookConfig.Callback
+	h.httpClient = NewTransport(nil)
+	h.apply(authHookConfig)
+	return nil
+}
+
+// Reload applies new options, eg. moved endpoints, to the checks made from then on, and forgets the
+// cached checks. The callback and RoundTripper are kept unless the options replace them
+func (h *Hook) Reload(config any) error {
+	authHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
 	}
 
-	h.httpClient = NewTransport(authHookConfig.RoundTripper)
+	if err := checkOptions(authHookConfig); err != nil {
+		return err
+	}
 
-	h.aclhost = authHookConfig.ACLHost
-	h.clientauthhost = authHookConfig.ClientAuthenticationHost
-	h.superuserhost = authHookConfig.SuperUserHost
+	h.apply(authHookConfig)
 	return nil
 }
 
+// checkOptions returns an error if the options are invalid
+func checkOptions(options Options) error {
+	if !validateConfig(options) {
+		return errors.New("hostname configs failed validation")
+	}
+
+	if options.Retry != nil && options.Retry.MaxAttempts <= 0 && options.Retry.MaxElapsed <= 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	return nil
+}
+
+// apply sets the hosts, callback, transport, retries and cache of the options
+func (h *Hook) apply(options Options) {
+	var c *cache.Cache[[32]byte, struct{}]
+	if options.CacheTTL > 0 {
+		if options.CacheSize <= 0 {
+			options.CacheSize = 10000
+		}
+		c = cache.New[[32]byte, struct{}](cache.Options{
+			MaxEntries: options.CacheSize,
+			TTL:        options.CacheTTL,
+		})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if options.Callback != nil {
+		h.Log.Debug("replacing default callback with one included in options")
+		h.callback = options.Callback
+	}
+
+	if options.RoundTripper != nil {
+		h.httpClient = NewTransport(options.RoundTripper)
+	}
+
+	h.aclhost = options.ACLHost
+	h.clientauthhost = options.ClientAuthenticationHost
+	h.superuserhost = options.SuperUserHost
+	h.retry = options.Retry
+	h.cache = c
+}
+
 // OnConnectAuthenticate is called when a client attempts to connect to the server
 func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ok, err := h.Authenticate(cl, pk)
+	if err != nil {
+		h.Log.Error("error occurred while making http request", "error", err)
+	}
+	return ok
+}
+
+// Authenticate authenticates the client, and returns an error if the server couldn't be reached or
+// failed, rather than rejecting the client, eg. so the composite hook falls back to its next backend
+func (h *Hook) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
 
 	payload := ClientCheckPOST{
 		ClientID: cl.ID,
@@ -100,13 +183,11 @@ func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 		Username: string(pk.Connect.Username),
 	}
 
-	resp, err := h.makeRequest(http.MethodPost, h.clientauthhost, payload)
-	if err != nil {
-		h.Log.Error("error occurred while making http request", "error", err)
-		return false
-	}
+	h.mu.RLock()
+	host := h.clientauthhost
+	h.mu.RUnlock()
 
-	return h.callback(resp)
+	return h.check(host, payload)
 }
 
 // OnACLCheck is called when a client attempts to publish or subscribe to a topic
@@ -119,25 +200,103 @@ func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
 		ACC:      strconv.FormatBool(write),
 	}
 
-	resp, err := h.makeRequest(http.MethodPost, h.aclhost, payload)
+	h.mu.RLock()
+	host := h.aclhost
+	h.mu.RUnlock()
+
+	ok, err := h.check(host, payload)
 	if err != nil {
 		h.Log.Error("error occurred while making http request", "error", err)
-		return false
+	}
+	return ok
+}
+
+// check posts the payload to the url, unless the same check was allowed recently, and returns an error
+// if the request failed, or was rejected as the server is overloaded or failing
+func (h *Hook) check(url *url.URL, payload any) (bool, error) {
+	h.mu.RLock()
+	c, callback := h.cache, h.callback
+	h.mu.RUnlock()
+
+	var key [32]byte
+	if c != nil {
+		rb, err := json.Marshal(payload)
+		if err != nil {
+			return false, err
+		}
+
+		// the key is hashed as the payload may contain a password
+		key = sha256.Sum256(append([]byte(url.String()+"\n"), rb...))
+		if _, ok := c.Get(key); ok {
+			return true, nil
+		}
+	}
+
+	resp, err := h.makeRequest(http.MethodPost, url, payload)
+	if err != nil {
+		return false, err
+	}
+
+	ok := callback(resp)
+	if ok && c != nil {
+		c.Set(key, struct{}{})
 	}
 
-	return h.callback(resp)
+	if !ok && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500) {
+		return false, fmt.Errorf("%s responded with status %d", url.Host, resp.StatusCode)
+	}
+
+	return ok, nil
 }
 
 func (h *Hook) makeRequest(requestType string, url *url.URL, payload any) (*http.Response, error) {
-	var buffer io.Reader
-	if payload == nil {
-		buffer = http.NoBody
-	} else {
+	var body []byte
+	if payload != nil {
 		rb, err := json.Marshal(payload)
 		if err != nil {
 			return nil, err
 		}
-		buffer = bytes.NewBuffer(rb)
+		body = rb
+	}
+
+	h.mu.RLock()
+	policy := h.retry
+	h.mu.RUnlock()
+
+	if policy == nil {
+		return h.do(requestType, url, body)
+	}
+
+	var resp *http.Response
+	err := policy.Do(context.Background(), func(ctx context.Context) error {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close() // the response of the failed attempt is discarded
+		}
+
+		var err error
+		resp, err = h.do(requestType, url, body)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return fmt.Errorf("%s responded with status %d", url.Host, resp.StatusCode)
+		}
+		return nil
+	})
+
+	// the last response is passed to the callback once the retries are exhausted
+	if resp != nil {
+		return resp, nil
+	}
+	return nil, err
+}
+
+// do makes a single request with the body
+func (h *Hook) do(requestType string, url *url.URL, body []byte) (*http.Response, error) {
+	var buffer io.Reader = http.NoBody
+	if body != nil {
+		buffer = bytes.NewReader(body)
 	}
 
 	req, err := http.NewRequest(requestType, url.String(), buffer)
@@ -145,7 +304,11 @@ func (h *Hook) makeRequest(requestType string, url *url.URL, payload any) (*http
 		return nil, err
 	}
 
-	resp, err := h.httpClient.Do(req)
+	h.mu.RLock()
+	client := h.httpClient
+	h.mu.RUnlock()
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
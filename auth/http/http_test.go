@@ -3,6 +3,7 @@ package auth
 import (
 	"context"
 	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
@@ -14,6 +15,8 @@ import (
 	mqtt "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/packets"
 	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/retry"
 )
 
 var defaultClientID = "default_client_id"
@@ -99,6 +102,15 @@ func TestInit(t *testing.T) {
 			config:      Options{},
 			expectError: true,
 		},
+		{
+			name: "Failure - unlimited retries",
+			config: Options{
+				ACLHost:                  stringToURL("http://aclhost.com"),
+				ClientAuthenticationHost: stringToURL("http://clientauthenticationhost.com"),
+				Retry:                    &retry.Policy{},
+			},
+			expectError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -335,6 +347,146 @@ func TestOnConnectAuthenticate(t *testing.T) {
 	}
 }
 
+func TestAuthenticate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(Hook)
+	authHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, authHook.Init(Options{
+		RoundTripper:             mockRT,
+		ACLHost:                  stringToURL("http://aclhost.com"),
+		ClientAuthenticationHost: stringToURL("http://clientauthenticationhost.com"),
+	}))
+	cl := &mqtt.Client{ID: defaultClientID}
+
+	// denials aren't failures, but unreachable or failing servers are
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusUnauthorized}, nil)
+	ok, err := authHook.Authenticate(cl, packets.Packet{})
+	require.False(t, ok)
+	require.NoError(t, err)
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusBadGateway}, nil)
+	ok, err = authHook.Authenticate(cl, packets.Packet{})
+	require.False(t, ok)
+	require.Error(t, err)
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("connection refused"))
+	ok, err = authHook.Authenticate(cl, packets.Packet{})
+	require.False(t, ok)
+	require.Error(t, err)
+}
+
+func TestCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(Hook)
+	authHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, authHook.Init(Options{
+		RoundTripper:             mockRT,
+		ACLHost:                  stringToURL("http://aclhost.com"),
+		ClientAuthenticationHost: stringToURL("http://clientauthenticationhost.com"),
+		CacheTTL:                 time.Minute,
+	}))
+
+	// allowed checks are only requested once
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil).Times(3)
+	cl := &mqtt.Client{ID: defaultClientID}
+	pk := packets.Packet{Connect: packets.ConnectParams{Username: []byte("alice"), Password: []byte("password")}}
+	for i := 0; i < 3; i++ {
+		require.True(t, authHook.OnConnectAuthenticate(cl, pk))
+		require.True(t, authHook.OnACLCheck(cl, "a/b", false))
+		require.True(t, authHook.OnACLCheck(cl, "a/b", true))
+	}
+
+	// denied checks are requested every time
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusForbidden}, nil).Times(2)
+	require.False(t, authHook.OnACLCheck(cl, "c/d", true))
+	require.False(t, authHook.OnACLCheck(cl, "c/d", true))
+}
+
+func TestRetry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(Hook)
+	authHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, authHook.Init(Options{
+		RoundTripper:             mockRT,
+		ACLHost:                  stringToURL("http://aclhost.com"),
+		ClientAuthenticationHost: stringToURL("http://clientauthenticationhost.com"),
+		Retry:                    &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+	}))
+	cl := &mqtt.Client{ID: defaultClientID}
+
+	// transport errors and unavailable endpoints are retried
+	gomock.InOrder(
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("connection refused")),
+		mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusServiceUnavailable}, nil),
+		mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			require.Contains(t, string(body), `"topic":"a/b"`)
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}),
+	)
+	require.True(t, authHook.OnACLCheck(cl, "a/b", true))
+
+	// denials are not retried
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusForbidden}, nil)
+	require.False(t, authHook.OnACLCheck(cl, "a/b", true))
+
+	// the last response is used once the attempts are exhausted
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(&http.Response{StatusCode: http.StatusTooManyRequests}, nil).Times(3)
+	require.False(t, authHook.OnACLCheck(cl, "a/b", true))
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("connection refused")).Times(3)
+	require.False(t, authHook.OnACLCheck(cl, "a/b", true))
+}
+
+func TestReload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := NewMockRoundTripper(ctrl)
+
+	authHook := new(Hook)
+	authHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, authHook.Init(Options{
+		RoundTripper:             mockRT,
+		ACLHost:                  stringToURL("http://aclhost.com"),
+		ClientAuthenticationHost: stringToURL("http://clientauthenticationhost.com"),
+		CacheTTL:                 time.Minute,
+	}))
+	cl := &mqtt.Client{ID: defaultClientID}
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		require.Equal(t, "aclhost.com", req.URL.Host)
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	require.True(t, authHook.OnACLCheck(cl, "a/b", true))
+	require.True(t, authHook.OnACLCheck(cl, "a/b", true))
+
+	// the transport is kept, and the cached checks are forgotten
+	require.NoError(t, authHook.Reload(Options{
+		ACLHost:                  stringToURL("http://acl.example.com"),
+		ClientAuthenticationHost: stringToURL("http://auth.example.com"),
+		CacheTTL:                 time.Minute,
+	}))
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		require.Equal(t, "acl.example.com", req.URL.Host)
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+	require.True(t, authHook.OnACLCheck(cl, "a/b", true))
+
+	require.Error(t, authHook.Reload(Options{}))
+	require.Error(t, authHook.Reload("improper"))
+	require.Equal(t, "acl.example.com", authHook.aclhost.Host)
+}
+
 func stringToURL(s string) *url.URL {
 	parsedURL, _ := url.Parse(s)
 	return parsedURL
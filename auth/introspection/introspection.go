@@ -0,0 +1,232 @@
+package introspection
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// Hook is a hook that authenticates clients by sending the token presented as their password to an
+// RFC 7662 token introspection endpoint, and maps the token's scopes to topic permissions
+type Hook struct {
+	httpClient *http.Client
+	config     Options
+	cache      *cache.Cache[[32]byte, Response] // the responses for recently introspected tokens
+	sessions   acl.Sessions
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the introspection hook.
+// It is the responsibility of the configurer to pass a properly configured RoundTripper that takes
+// care of other requirements such as timeouts, retries, etc
+type Options struct {
+	IntrospectionURL *url.URL
+	ClientID         string // used for HTTP basic authentication against the introspection endpoint
+	ClientSecret     string
+	RoundTripper     http.RoundTripper
+
+	// CacheTTL caps how long an active result is cached. Results are never cached beyond the token's
+	// exp, and tokens without an exp are only cached if CacheTTL is set
+	CacheTTL time.Duration
+
+	// ScopeACL maps scope strings to the topic filter templates they grant. Templates may reference
+	// {clientid}, {username} and {sub}
+	ScopeACL map[string]acl.Templates
+}
+
+// Response is the introspection response of an RFC 7662 endpoint
+type Response struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Subject  string `json:"sub"`
+	Expiry   int64  `json:"exp"`
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "introspection-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if len(h.config.ScopeACL) == 0 {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	introspectionHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if introspectionHookConfig.IntrospectionURL == nil {
+		return errors.New("nil introspection url")
+	}
+
+	rt := introspectionHookConfig.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	h.httpClient = &http.Client{Transport: rt}
+	h.config = introspectionHookConfig
+	h.cache = cache.New[[32]byte, Response](cache.Options{})
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ok, err := h.Authenticate(cl, pk)
+	if err != nil {
+		h.Log.Error("error occurred while introspecting token", "error", err)
+	}
+	return ok
+}
+
+// Authenticate authenticates the client, and returns an error if the introspection endpoint couldn't be asked, rather
+// than rejecting the client, eg. so the composite hook falls back to its next backend
+func (h *Hook) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	token := string(pk.Connect.Password)
+	if token == "" {
+		return false, nil
+	}
+
+	resp, err := h.introspect(token)
+	if err != nil {
+		return false, err
+	}
+
+	if !resp.Active {
+		return false, nil
+	}
+
+	if len(h.config.ScopeACL) > 0 {
+		values := map[string]string{
+			"clientid": cl.ID,
+			"username": resp.Username,
+			"sub":      resp.Subject,
+		}
+
+		filters := acl.Filters{}
+		for _, scope := range strings.Fields(resp.Scope) {
+			filters.Merge(h.config.ScopeACL[scope].Render(values))
+		}
+
+		h.sessions.Set(cl, filters)
+	}
+
+	return true, nil
+}
+
+// introspect returns the introspection response for the token, from the cache if possible
+func (h *Hook) introspect(token string) (Response, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	if resp, ok := h.cache.Get(key); ok {
+		return resp, nil
+	}
+
+	resp, err := h.makeRequest(token)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if expires, ok := h.cacheExpiry(resp, now); ok {
+		h.cache.SetTTL(key, resp, expires.Sub(now))
+	}
+
+	return resp, nil
+}
+
+// cacheExpiry returns when an introspection response should be evicted, and false if it should not be cached
+func (h *Hook) cacheExpiry(resp Response, now time.Time) (time.Time, bool) {
+	if !resp.Active {
+		return time.Time{}, false
+	}
+
+	var expires time.Time
+	if h.config.CacheTTL > 0 {
+		expires = now.Add(h.config.CacheTTL)
+	}
+
+	if resp.Expiry > 0 {
+		exp := time.Unix(resp.Expiry, 0)
+		if expires.IsZero() || exp.Before(expires) {
+			expires = exp
+		}
+	}
+
+	return expires, now.Before(expires)
+}
+
+func (h *Hook) makeRequest(token string) (Response, error) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.config.IntrospectionURL.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return Response{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if h.config.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(h.config.ClientID), url.QueryEscape(h.config.ClientSecret))
+	}
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Response{}, fmt.Errorf("unexpected introspection response status %d", resp.StatusCode)
+	}
+
+	var out Response
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return Response{}, err
+	}
+
+	return out, nil
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
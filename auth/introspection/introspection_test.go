@@ -0,0 +1,280 @@
+package introspection
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	auth "github.com/mochi-mqtt/hooks/auth/http"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+func jsonResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func connectPacket(token string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{Password: []byte(token)},
+	}
+}
+
+func TestID(t *testing.T) {
+	introspectionHook := new(Hook)
+
+	require.Equal(t, "introspection-auth-hook", introspectionHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	introspectionHook := new(Hook)
+	require.True(t, introspectionHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, introspectionHook.Provides(mqtt.OnACLCheck))
+
+	introspectionHook.config.ScopeACL = map[string]acl.Templates{"read": {"#": acl.ReadOnly}}
+	require.True(t, introspectionHook.Provides(mqtt.OnACLCheck))
+	require.True(t, introspectionHook.Provides(mqtt.OnDisconnect))
+}
+
+func TestInit(t *testing.T) {
+	introspectionHook := new(Hook)
+	introspectionHook.Log = slog.Default()
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name: "Success - Proper config",
+			config: Options{
+				IntrospectionURL: stringToURL("http://idp.com/introspect"),
+			},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing url",
+			config:      Options{},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := introspectionHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := auth.NewMockRoundTripper(ctrl)
+
+	tests := []struct {
+		name        string
+		token       string
+		mocks       func()
+		expectPass  bool
+		expectError bool
+	}{
+		{
+			name:       "Success - active token",
+			token:      "token",
+			expectPass: true,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					require.NoError(t, req.ParseForm())
+					require.Equal(t, "token", req.PostForm.Get("token"))
+					user, pass, ok := req.BasicAuth()
+					require.True(t, ok)
+					require.Equal(t, "mqtt", user)
+					require.Equal(t, "secret", pass)
+					return jsonResponse(http.StatusOK, `{"active":true}`), nil
+				})
+			},
+		},
+		{
+			name:       "Failure - inactive token",
+			token:      "token",
+			expectPass: false,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusOK, `{"active":false}`), nil)
+			},
+		},
+		{
+			name:       "Failure - empty token",
+			expectPass: false,
+			mocks:      func() {},
+		},
+		{
+			name:        "Error - HTTP error",
+			token:       "token",
+			expectPass:  false,
+			expectError: true,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("Oh Crap"))
+			},
+		},
+		{
+			name:        "Error - Non 2xx",
+			token:       "token",
+			expectPass:  false,
+			expectError: true,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusUnauthorized, ``), nil)
+			},
+		},
+		{
+			name:        "Error - malformed body",
+			token:       "token",
+			expectPass:  false,
+			expectError: true,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusOK, `{`), nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mocks()
+
+			introspectionHook := new(Hook)
+			introspectionHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			require.NoError(t, introspectionHook.Init(Options{
+				IntrospectionURL: stringToURL("http://idp.com/introspect"),
+				ClientID:         "mqtt",
+				ClientSecret:     "secret",
+				RoundTripper:     mockRT,
+			}))
+
+			success, err := introspectionHook.Authenticate(&mqtt.Client{ID: "client"}, connectPacket(tt.token))
+			require.Equal(t, tt.expectPass, success)
+			require.Equal(t, tt.expectError, err != nil)
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := auth.NewMockRoundTripper(ctrl)
+
+	introspectionHook := new(Hook)
+	introspectionHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, introspectionHook.Init(Options{
+		IntrospectionURL: stringToURL("http://idp.com/introspect"),
+		RoundTripper:     mockRT,
+	}))
+
+	exp := time.Now().Add(time.Hour).Unix()
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusOK, `{"active":true,"exp":`+itoa(exp)+`}`), nil).Times(1)
+	require.True(t, introspectionHook.OnConnectAuthenticate(&mqtt.Client{ID: "a"}, connectPacket("cached")))
+	require.True(t, introspectionHook.OnConnectAuthenticate(&mqtt.Client{ID: "b"}, connectPacket("cached")))
+
+	// tokens without an exp are not cached unless a ttl is configured
+	mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{"active":true}`), nil
+	}).Times(2)
+	require.True(t, introspectionHook.OnConnectAuthenticate(&mqtt.Client{ID: "a"}, connectPacket("no-exp")))
+	require.True(t, introspectionHook.OnConnectAuthenticate(&mqtt.Client{ID: "b"}, connectPacket("no-exp")))
+
+	// expired results are fetched again
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusOK, `{"active":false}`), nil).Times(1)
+	introspectionHook.cache.SetTTL(sha256.Sum256([]byte("cached")), Response{Active: true}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	require.False(t, introspectionHook.OnConnectAuthenticate(&mqtt.Client{ID: "a"}, connectPacket("cached")))
+}
+
+func TestCacheExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	h := new(Hook)
+
+	_, ok := h.cacheExpiry(Response{Active: false, Expiry: 1700003600}, now)
+	require.False(t, ok)
+
+	expires, ok := h.cacheExpiry(Response{Active: true, Expiry: 1700003600}, now)
+	require.True(t, ok)
+	require.Equal(t, time.Unix(1700003600, 0), expires)
+
+	h.config.CacheTTL = time.Minute
+	expires, ok = h.cacheExpiry(Response{Active: true, Expiry: 1700003600}, now)
+	require.True(t, ok)
+	require.Equal(t, now.Add(time.Minute), expires)
+
+	_, ok = h.cacheExpiry(Response{Active: true, Expiry: 1600000000}, now)
+	require.False(t, ok)
+}
+
+func TestOnACLCheck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := auth.NewMockRoundTripper(ctrl)
+
+	introspectionHook := new(Hook)
+	introspectionHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, introspectionHook.Init(Options{
+		IntrospectionURL: stringToURL("http://idp.com/introspect"),
+		RoundTripper:     mockRT,
+		ScopeACL: map[string]acl.Templates{
+			"telemetry:write": {"devices/{sub}/telemetry": acl.WriteOnly},
+			"commands:read":   {"devices/{sub}/commands/#": acl.ReadOnly},
+			"admin":           {"#": acl.ReadWrite},
+		},
+	}))
+
+	mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusOK, `{"active":true,"sub":"dev1","scope":"telemetry:write commands:read"}`), nil)
+	cl := &mqtt.Client{ID: "client"}
+	require.True(t, introspectionHook.OnConnectAuthenticate(cl, connectPacket("token")))
+
+	require.True(t, introspectionHook.OnACLCheck(cl, "devices/dev1/telemetry", true))
+	require.True(t, introspectionHook.OnACLCheck(cl, "devices/dev1/commands/reboot", false))
+	require.False(t, introspectionHook.OnACLCheck(cl, "devices/dev1/commands/reboot", true))
+	require.False(t, introspectionHook.OnACLCheck(cl, "devices/dev2/telemetry", true))
+	require.False(t, introspectionHook.OnACLCheck(&mqtt.Client{ID: "other"}, "devices/dev1/telemetry", true))
+
+	introspectionHook.OnDisconnect(cl, nil, true)
+	require.False(t, introspectionHook.OnACLCheck(cl, "devices/dev1/telemetry", true))
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
+
+func stringToURL(s string) *url.URL {
+	parsedURL, _ := url.Parse(s)
+	return parsedURL
+}
@@ -0,0 +1,214 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWK is a single JSON Web Key as published in a JWKS document
+type JWK struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// PublicKey converts the JWK into an *rsa.PublicKey or *ecdsa.PublicKey
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// JWKS is a set of signing keys fetched from a remote JWKS endpoint. Keys are refreshed on an
+// interval by Run, and on demand when a token references an unknown kid, no more often than
+// the configured minimum refresh interval
+type JWKS struct {
+	url         *url.URL
+	httpClient  *http.Client
+	minInterval time.Duration
+	keys        map[string]crypto.PublicKey
+	lastFetch   time.Time
+	mu          sync.RWMutex
+	fetchMu     sync.Mutex
+}
+
+// NewJWKS returns a key set for the given JWKS endpoint. The round tripper may be nil, in which case
+// the default transport is used. Unknown kid lookups trigger a refresh at most once per minInterval
+func NewJWKS(u *url.URL, rt http.RoundTripper, minInterval time.Duration) *JWKS {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	return &JWKS{
+		url:         u,
+		httpClient:  &http.Client{Transport: rt},
+		minInterval: minInterval,
+		keys:        map[string]crypto.PublicKey{},
+	}
+}
+
+// Refresh fetches the JWKS document and atomically replaces the current keys
+func (j *JWKS) Refresh(ctx context.Context) error {
+	j.fetchMu.Lock()
+	defer j.fetchMu.Unlock()
+	return j.refresh(ctx)
+}
+
+func (j *JWKS) refresh(ctx context.Context) error {
+	j.mu.Lock()
+	j.lastFetch = time.Now()
+	j.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url.String(), http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := j.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected jwks response status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		pub, err := k.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.KeyID] = pub
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+// Key returns the key for the header's kid, refreshing the set if the kid is unknown and the
+// minimum refresh interval has passed. It satisfies KeyFunc
+func (j *JWKS) Key(header Header) (crypto.PublicKey, error) {
+	if key, ok := j.lookup(header.KeyID); ok {
+		return key, nil
+	}
+
+	j.fetchMu.Lock()
+	defer j.fetchMu.Unlock()
+
+	// another caller may have refreshed while we waited for the lock
+	if key, ok := j.lookup(header.KeyID); ok {
+		return key, nil
+	}
+
+	j.mu.RLock()
+	limited := time.Since(j.lastFetch) < j.minInterval
+	j.mu.RUnlock()
+	if !limited {
+		if err := j.refresh(context.Background()); err != nil {
+			return nil, err
+		}
+
+		if key, ok := j.lookup(header.KeyID); ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownKey, header.KeyID)
+}
+
+func (j *JWKS) lookup(kid string) (crypto.PublicKey, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// Run refreshes the key set every interval until the context is cancelled. Refresh errors are
+// passed to onError, and the previously fetched keys remain in use
+func (j *JWKS) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := j.Refresh(ctx); err != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func rsaJWK(kid string, key *rsa.PublicKey) JWK {
+	return JWK{
+		KeyType: "RSA",
+		KeyID:   kid,
+		Use:     "sig",
+		N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) JWK {
+	return JWK{
+		KeyType: "EC",
+		KeyID:   kid,
+		Curve:   "P-256",
+		X:       base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:       base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+}
+
+// jwksServer serves a mutable key set and counts how often it is fetched
+type jwksServer struct {
+	*httptest.Server
+	keys    []JWK
+	fetches atomic.Int64
+	mu      sync.Mutex
+}
+
+func newJWKSServer(keys ...JWK) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": s.keys})
+	}))
+	return s
+}
+
+func (s *jwksServer) setKeys(keys ...JWK) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func TestJWKPublicKey(t *testing.T) {
+	pub, err := rsaJWK("rsa", &testRSAKey.PublicKey).PublicKey()
+	require.NoError(t, err)
+	require.True(t, testRSAKey.PublicKey.Equal(pub))
+
+	pub, err = ecJWK("ec", &testECKey.PublicKey).PublicKey()
+	require.NoError(t, err)
+	require.True(t, testECKey.PublicKey.Equal(pub))
+
+	_, err = JWK{KeyType: "oct"}.PublicKey()
+	require.Error(t, err)
+
+	_, err = JWK{KeyType: "EC", Curve: "P-192"}.PublicKey()
+	require.Error(t, err)
+}
+
+func TestJWKSKey(t *testing.T) {
+	rotated, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := newJWKSServer(rsaJWK("rsa", &testRSAKey.PublicKey), JWK{KeyType: "RSA", KeyID: "enc", Use: "enc"})
+	defer server.Close()
+
+	jwks := NewJWKS(stringToURL(server.URL), nil, time.Hour)
+	require.NoError(t, jwks.Refresh(context.Background()))
+	require.Equal(t, int64(1), server.fetches.Load())
+
+	key, err := jwks.Key(Header{KeyID: "rsa"})
+	require.NoError(t, err)
+	require.True(t, testRSAKey.PublicKey.Equal(key))
+
+	_, err = jwks.Key(Header{KeyID: "enc"})
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	// the key rotates at the idp, but the refresh is rate limited
+	server.setKeys(ecJWK("rotated", &rotated.PublicKey))
+	_, err = jwks.Key(Header{KeyID: "rotated"})
+	require.ErrorIs(t, err, ErrUnknownKey)
+	require.Equal(t, int64(1), server.fetches.Load())
+
+	// once the minimum interval has passed an unknown kid triggers a refresh
+	jwks.minInterval = 0
+	key, err = jwks.Key(Header{KeyID: "rotated"})
+	require.NoError(t, err)
+	require.True(t, rotated.PublicKey.Equal(key))
+	require.Equal(t, int64(2), server.fetches.Load())
+
+	_, err = jwks.Key(Header{KeyID: "rsa"})
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestJWKSRun(t *testing.T) {
+	server := newJWKSServer(rsaJWK("rsa", &testRSAKey.PublicKey))
+	defer server.Close()
+
+	jwks := NewJWKS(stringToURL(server.URL), nil, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go jwks.Run(ctx, 10*time.Millisecond, func(err error) {})
+
+	require.Eventually(t, func() bool {
+		_, ok := jwks.lookup("rsa")
+		return ok
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestJWKSRefreshError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	jwks := NewJWKS(stringToURL(server.URL), nil, time.Hour)
+	require.Error(t, jwks.Refresh(context.Background()))
+}
+
+func TestOnConnectAuthenticateJWKS(t *testing.T) {
+	server := newJWKSServer(rsaJWK("rsa", &testRSAKey.PublicKey))
+	defer server.Close()
+
+	jwtHook := new(Hook)
+	jwtHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, jwtHook.Init(Options{
+		JWKSURL:                stringToURL(server.URL),
+		JWKSMinRefreshInterval: time.Nanosecond,
+	}))
+	defer jwtHook.Stop()
+
+	token := signToken(t, Header{Algorithm: "RS256", KeyID: "rsa"}, map[string]any{"sub": "device-1"}, testRSAKey)
+	require.True(t, jwtHook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, packets.Packet{
+		Connect: packets.ConnectParams{Password: []byte(token)},
+	}))
+
+	// rotate the key at the idp without restarting the hook
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server.setKeys(rsaJWK("rotated", &rotated.PublicKey))
+	token = signToken(t, Header{Algorithm: "RS256", KeyID: "rotated"}, map[string]any{"sub": "device-1"}, rotated)
+	require.True(t, jwtHook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, packets.Packet{
+		Connect: packets.ConnectParams{Password: []byte(token)},
+	}))
+}
@@ -0,0 +1,174 @@
+package jwt
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// Hook is a hook that authenticates clients presenting a signed JWT as their password and
+// authorizes topic access from the token claims
+type Hook struct {
+	keyFunc   KeyFunc
+	validator Validator
+	acl       acl.Templates
+	sessions  acl.Sessions
+	jwks      *JWKS
+	cancel    context.CancelFunc
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the jwt hook
+type Options struct {
+	Secret     []byte                      // HMAC secret used to verify HS256/HS384/HS512 tokens
+	PublicKeys map[string]crypto.PublicKey // RSA/ECDSA keys keyed on the kid header, "" for tokens without a kid
+	Issuer     string                      // if set, the iss claim must match
+	Audience   string                      // if set, the aud claim must contain this value
+	Leeway     time.Duration               // allowed clock skew when checking exp and nbf
+
+	// JWKSURL is the endpoint of the identity provider's signing keys. Keys are fetched at startup,
+	// every JWKSRefreshInterval, and whenever a token references an unknown kid (at most once per
+	// JWKSMinRefreshInterval), so key rotation does not require a broker restart
+	JWKSURL                *url.URL
+	JWKSRefreshInterval    time.Duration     // defaults to 1 hour
+	JWKSMinRefreshInterval time.Duration     // defaults to 1 minute
+	RoundTripper           http.RoundTripper // used for JWKS requests, http.DefaultTransport if nil
+
+	// ACL maps topic filter templates to the access they grant. Placeholders are replaced with
+	// claims from the client's token, eg. "devices/{sub}/#": rw, "tenants/{tenant}/+/status": r.
+	// When set, topic access is evaluated locally in OnACLCheck
+	ACL acl.Templates
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "jwt-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if len(h.acl) == 0 {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	jwtHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if len(jwtHookConfig.Secret) == 0 && len(jwtHookConfig.PublicKeys) == 0 && jwtHookConfig.JWKSURL == nil {
+		return errors.New("no verification keys configured")
+	}
+
+	h.keyFunc = staticKeys(jwtHookConfig.Secret, jwtHookConfig.PublicKeys)
+	if jwtHookConfig.JWKSURL != nil {
+		h.startJWKS(jwtHookConfig)
+	}
+
+	h.validator = Validator{
+		Issuer:   jwtHookConfig.Issuer,
+		Audience: jwtHookConfig.Audience,
+		Leeway:   jwtHookConfig.Leeway,
+	}
+	h.acl = jwtHookConfig.ACL
+	return nil
+}
+
+func (h *Hook) startJWKS(config Options) {
+	refreshInterval := config.JWKSRefreshInterval
+	if refreshInterval <= 0 {
+		refreshInterval = time.Hour
+	}
+
+	minRefreshInterval := config.JWKSMinRefreshInterval
+	if minRefreshInterval <= 0 {
+		minRefreshInterval = time.Minute
+	}
+
+	h.jwks = NewJWKS(config.JWKSURL, config.RoundTripper, minRefreshInterval)
+
+	// a failed initial fetch is not fatal, the keys are fetched again on the first unknown kid
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	if err := h.jwks.Refresh(ctx); err != nil {
+		h.Log.Error("error occurred while fetching jwks", "error", err)
+	}
+
+	go h.jwks.Run(ctx, refreshInterval, func(err error) {
+		h.Log.Error("error occurred while refreshing jwks", "error", err)
+	})
+
+	static := h.keyFunc
+	h.keyFunc = func(header Header) (crypto.PublicKey, error) {
+		if strings.HasPrefix(header.Algorithm, "HS") {
+			return static(header)
+		}
+
+		if key, err := static(header); err == nil {
+			return key, nil
+		}
+
+		return h.jwks.Key(header)
+	}
+}
+
+// Stop stops refreshing the JWKS
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	token, err := Parse(string(pk.Connect.Password), h.keyFunc)
+	if err != nil {
+		h.Log.Debug("token verification failed", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if err := h.validator.Validate(token.Claims); err != nil {
+		h.Log.Debug("token validation failed", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if len(h.acl) > 0 {
+		h.sessions.Set(cl, h.acl.Render(token.Claims.Values()))
+	}
+
+	return true
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
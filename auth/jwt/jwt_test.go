@@ -0,0 +1,217 @@
+package jwt
+
+import (
+	"crypto"
+	"log/slog"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+func TestID(t *testing.T) {
+	jwtHook := new(Hook)
+
+	require.Equal(t, "jwt-auth-hook", jwtHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	jwtHook := new(Hook)
+	require.True(t, jwtHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, jwtHook.Provides(mqtt.OnACLCheck))
+
+	jwtHook.acl = acl.Templates{"devices/{sub}/#": acl.ReadWrite}
+	require.True(t, jwtHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, jwtHook.Provides(mqtt.OnACLCheck))
+	require.True(t, jwtHook.Provides(mqtt.OnDisconnect))
+	require.False(t, jwtHook.Provides(mqtt.OnClientExpired))
+}
+
+func TestInit(t *testing.T) {
+	jwtHook := new(Hook)
+	jwtHook.Log = slog.Default()
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name: "Success - HMAC secret",
+			config: Options{
+				Secret: testSecret,
+			},
+			expectError: false,
+		},
+		{
+			name: "Success - public keys",
+			config: Options{
+				PublicKeys: map[string]crypto.PublicKey{"": &testRSAKey.PublicKey},
+			},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no keys",
+			config:      Options{},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := jwtHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		config     Options
+		password   string
+		expectPass bool
+	}{
+		{
+			name:       "Success - valid token",
+			config:     Options{Secret: testSecret, Issuer: "idp"},
+			password:   signToken(t, Header{Algorithm: "HS256"}, map[string]any{"iss": "idp", "exp": now.Add(time.Hour).Unix()}, testSecret),
+			expectPass: true,
+		},
+		{
+			name:       "Failure - expired token",
+			config:     Options{Secret: testSecret},
+			password:   signToken(t, Header{Algorithm: "HS256"}, map[string]any{"exp": now.Add(-time.Hour).Unix()}, testSecret),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - wrong issuer",
+			config:     Options{Secret: testSecret, Issuer: "idp"},
+			password:   signToken(t, Header{Algorithm: "HS256"}, map[string]any{"iss": "other"}, testSecret),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - not a token",
+			config:     Options{Secret: testSecret},
+			password:   "password",
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			jwtHook := new(Hook)
+			jwtHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			require.NoError(t, jwtHook.Init(tt.config))
+
+			success := jwtHook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, packets.Packet{
+				Connect: packets.ConnectParams{Password: []byte(tt.password)},
+			})
+			require.Equal(t, tt.expectPass, success)
+
+		})
+	}
+}
+
+func TestOnACLCheck(t *testing.T) {
+	jwtHook := new(Hook)
+	jwtHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, jwtHook.Init(Options{
+		Secret: testSecret,
+		ACL: acl.Templates{
+			"devices/{sub}/#":           acl.ReadWrite,
+			"tenants/{tenant}/+/status": acl.ReadOnly,
+		},
+	}))
+
+	cl := &mqtt.Client{ID: "client"}
+	token := signToken(t, Header{Algorithm: "HS256"}, map[string]any{"sub": "device-1", "tenant": "acme"}, testSecret)
+	require.True(t, jwtHook.OnConnectAuthenticate(cl, packets.Packet{
+		Connect: packets.ConnectParams{Password: []byte(token)},
+	}))
+
+	tests := []struct {
+		name       string
+		client     *mqtt.Client
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - publish to own device topic",
+			client:     cl,
+			topic:      "devices/device-1/telemetry",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - subscribe to tenant status",
+			client:     cl,
+			topic:      "tenants/acme/device-2/status",
+			write:      false,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - publish to tenant status",
+			client:     cl,
+			topic:      "tenants/acme/device-2/status",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - other device",
+			client:     cl,
+			topic:      "devices/device-2/telemetry",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unauthenticated client",
+			client:     &mqtt.Client{ID: "other"},
+			topic:      "devices/device-1/telemetry",
+			write:      true,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, jwtHook.OnACLCheck(tt.client, tt.topic, tt.write))
+
+		})
+	}
+
+	jwtHook.OnDisconnect(cl, nil, true)
+	require.False(t, jwtHook.OnACLCheck(cl, "devices/device-1/telemetry", true))
+}
+
+func stringToURL(s string) *url.URL {
+	parsedURL, _ := url.Parse(s)
+	return parsedURL
+}
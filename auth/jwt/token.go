@@ -0,0 +1,320 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for HS256, RS256, PS256 and ES256
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for the 384 and 512 variants
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMalformedToken indicates the token is not a compact serialized JWS
+	ErrMalformedToken = errors.New("malformed token")
+	// ErrUnsupportedAlgorithm indicates the token is signed with an algorithm the hook does not verify
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	// ErrUnknownKey indicates no key is configured for the token's kid or algorithm
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrInvalidSignature indicates the token signature did not verify
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrExpired indicates the token exp claim has passed
+	ErrExpired = errors.New("token expired")
+	// ErrNotYetValid indicates the token nbf claim has not been reached
+	ErrNotYetValid = errors.New("token not yet valid")
+	// ErrInvalidIssuer indicates the token iss claim did not match the configured issuer
+	ErrInvalidIssuer = errors.New("invalid issuer")
+	// ErrInvalidAudience indicates the token aud claim did not contain the configured audience
+	ErrInvalidAudience = errors.New("invalid audience")
+)
+
+// Header is the decoded JOSE header of a token
+type Header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ"`
+}
+
+// Claims is the decoded claim set of a token
+type Claims map[string]any
+
+// Token is a parsed and verified JWT
+type Token struct {
+	Header Header
+	Claims Claims
+}
+
+// KeyFunc returns the key used to verify a token with the given header. HMAC algorithms expect a
+// []byte, RSA algorithms an *rsa.PublicKey and ECDSA algorithms an *ecdsa.PublicKey
+type KeyFunc func(header Header) (crypto.PublicKey, error)
+
+// Parse decodes a compact serialized token and verifies its signature with the key returned by keyFunc.
+// Time based and registered claims are not validated, see Validator for that
+func Parse(raw string, keyFunc KeyFunc) (*Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var token Token
+	if err := decodeSegment(parts[0], &token.Header); err != nil {
+		return nil, err
+	}
+
+	if err := decodeSegment(parts[1], &token.Claims); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	if _, err := algorithmHash(token.Header.Algorithm); err != nil {
+		return nil, err
+	}
+
+	key, err := keyFunc(token.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verify(token.Header.Algorithm, parts[0]+"."+parts[1], signature, key); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// DecodeClaims decodes the claims of a compact serialized token WITHOUT verifying its signature.
+// It must only be used on tokens which have already been verified, eg. by the auth hook
+func DecodeClaims(raw string) (Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+func verify(alg, signingInput string, signature []byte, key crypto.PublicKey) error {
+	hash, err := algorithmHash(alg)
+	if err != nil {
+		return err
+	}
+
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrUnknownKey
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return ErrInvalidSignature
+		}
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrUnknownKey
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return ErrInvalidSignature
+		}
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrUnknownKey
+		}
+		if rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) != nil {
+			return ErrInvalidSignature
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrUnknownKey
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrInvalidSignature
+		}
+	}
+
+	return nil
+}
+
+func algorithmHash(alg string) (crypto.Hash, error) {
+	if len(alg) != 5 {
+		return 0, ErrUnsupportedAlgorithm
+	}
+
+	switch alg[:2] {
+	case "HS", "RS", "PS", "ES":
+	default:
+		return 0, ErrUnsupportedAlgorithm
+	}
+
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, nil
+	case "384":
+		return crypto.SHA384, nil
+	case "512":
+		return crypto.SHA512, nil
+	}
+
+	return 0, ErrUnsupportedAlgorithm
+}
+
+// Validator checks the registered claims of a verified token
+type Validator struct {
+	Issuer   string        // if set, the iss claim must match
+	Audience string        // if set, the aud claim must contain this value
+	Leeway   time.Duration // allowed clock skew for exp and nbf
+	Now      func() time.Time
+}
+
+// Validate returns an error if the token is expired, not yet valid, or was issued by or for someone else
+func (v Validator) Validate(claims Claims) error {
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+
+	if exp, ok := claims.Time("exp"); ok && now.After(exp.Add(v.Leeway)) {
+		return ErrExpired
+	}
+
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(v.Leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return ErrInvalidIssuer
+	}
+
+	if v.Audience != "" && !slices.Contains(claims.Strings("aud"), v.Audience) {
+		return ErrInvalidAudience
+	}
+
+	return nil
+}
+
+// String returns the claim as a string. Numbers and booleans are formatted, other types return ""
+func (c Claims) String(name string) string {
+	switch v := c[name].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// Strings returns a claim which may be either a single string or an array of strings
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Time returns a NumericDate claim such as exp, nbf or iat
+func (c Claims) Time(name string) (time.Time, bool) {
+	n, ok := c[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	// the seconds are clamped, as the dates past them overflow a time.Time, and the nanoseconds are
+	// split from them, as the dates past 2262 overflow an int64 of nanoseconds
+	f = max(-maxNumericDate, min(maxNumericDate, f))
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), true
+}
+
+// maxNumericDate is the most seconds of a NumericDate claim, long past any date a token is valid until
+const maxNumericDate = 1 << 62
+
+// Values returns all scalar claims formatted as strings, for use in topic templates
+func (c Claims) Values() map[string]string {
+	values := make(map[string]string, len(c))
+	for name := range c {
+		if s := c.String(name); s != "" {
+			values[name] = s
+		}
+	}
+	return values
+}
+
+// staticKeys returns a KeyFunc which resolves keys from a fixed set of keys
+func staticKeys(secret []byte, keys map[string]crypto.PublicKey) KeyFunc {
+	return func(header Header) (crypto.PublicKey, error) {
+		if strings.HasPrefix(header.Algorithm, "HS") {
+			if len(secret) == 0 {
+				return nil, ErrUnknownKey
+			}
+			return secret, nil
+		}
+
+		if key, ok := keys[header.KeyID]; ok {
+			return key, nil
+		}
+
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, header.KeyID)
+	}
+}
@@ -0,0 +1,259 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testSecret = []byte("super-secret")
+	testRSAKey *rsa.PrivateKey
+	testECKey  *ecdsa.PrivateKey
+)
+
+func init() {
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// signToken creates a compact serialized token for use in tests
+func signToken(t *testing.T, header Header, claims map[string]any, key any) string {
+	t.Helper()
+
+	hb, err := json.Marshal(header)
+	require.NoError(t, err)
+	cb, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	input := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	hash, err := algorithmHash(header.Algorithm)
+	require.NoError(t, err)
+
+	h := hash.New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if header.Algorithm[:2] == "PS" {
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		require.NoError(t, err)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestParse(t *testing.T) {
+	keyFunc := staticKeys(testSecret, map[string]crypto.PublicKey{
+		"rsa": &testRSAKey.PublicKey,
+		"ec":  &testECKey.PublicKey,
+	})
+	claims := map[string]any{"sub": "device-1"}
+
+	tests := []struct {
+		name        string
+		token       string
+		expectError error
+	}{
+		{
+			name:  "Success - HS256",
+			token: signToken(t, Header{Algorithm: "HS256"}, claims, testSecret),
+		},
+		{
+			name:  "Success - RS256",
+			token: signToken(t, Header{Algorithm: "RS256", KeyID: "rsa"}, claims, testRSAKey),
+		},
+		{
+			name:  "Success - PS384",
+			token: signToken(t, Header{Algorithm: "PS384", KeyID: "rsa"}, claims, testRSAKey),
+		},
+		{
+			name:  "Success - ES256",
+			token: signToken(t, Header{Algorithm: "ES256", KeyID: "ec"}, claims, testECKey),
+		},
+		{
+			name:        "Failure - malformed",
+			token:       "not-a-token",
+			expectError: ErrMalformedToken,
+		},
+		{
+			name:        "Failure - alg none",
+			token:       "eyJhbGciOiJub25lIn0.eyJzdWIiOiJkZXZpY2UtMSJ9.",
+			expectError: ErrUnsupportedAlgorithm,
+		},
+		{
+			name:        "Failure - wrong secret",
+			token:       signToken(t, Header{Algorithm: "HS256"}, claims, []byte("other")),
+			expectError: ErrInvalidSignature,
+		},
+		{
+			name:        "Failure - unknown kid",
+			token:       signToken(t, Header{Algorithm: "RS256", KeyID: "missing"}, claims, testRSAKey),
+			expectError: ErrUnknownKey,
+		},
+		{
+			name:        "Failure - key type confusion",
+			token:       signToken(t, Header{Algorithm: "RS256", KeyID: "ec"}, claims, testRSAKey),
+			expectError: ErrUnknownKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			token, err := Parse(tt.token, keyFunc)
+			if tt.expectError != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "device-1", token.Claims.String("sub"))
+
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name        string
+		validator   Validator
+		claims      Claims
+		expectError error
+	}{
+		{
+			name:      "Success - no registered claims",
+			validator: Validator{},
+			claims:    Claims{},
+		},
+		{
+			name:      "Success - issuer and audience array",
+			validator: Validator{Issuer: "idp", Audience: "mqtt"},
+			claims:    Claims{"iss": "idp", "aud": []any{"api", "mqtt"}},
+		},
+		{
+			name:      "Success - expired within leeway",
+			validator: Validator{Leeway: time.Minute},
+			claims:    Claims{"exp": json.Number("1699999990")},
+		},
+		{
+			name:        "Failure - expired",
+			validator:   Validator{},
+			claims:      Claims{"exp": json.Number("1699999990")},
+			expectError: ErrExpired,
+		},
+		{
+			name:        "Failure - not yet valid",
+			validator:   Validator{},
+			claims:      Claims{"nbf": json.Number("1700000100")},
+			expectError: ErrNotYetValid,
+		},
+		{
+			name:      "Success - expires after 2262",
+			validator: Validator{},
+			claims:    Claims{"exp": json.Number("10000000000"), "nbf": json.Number("1699999990")},
+		},
+		{
+			name:      "Success - expires after any time",
+			validator: Validator{},
+			claims:    Claims{"exp": json.Number("1e300")},
+		},
+		{
+			name:        "Failure - not valid until after 2262",
+			validator:   Validator{},
+			claims:      Claims{"nbf": json.Number("10000000000")},
+			expectError: ErrNotYetValid,
+		},
+		{
+			name:        "Failure - expired before any time",
+			validator:   Validator{},
+			claims:      Claims{"exp": json.Number("-1e300")},
+			expectError: ErrExpired,
+		},
+		{
+			name:        "Failure - wrong issuer",
+			validator:   Validator{Issuer: "idp"},
+			claims:      Claims{"iss": "other"},
+			expectError: ErrInvalidIssuer,
+		},
+		{
+			name:        "Failure - wrong audience",
+			validator:   Validator{Audience: "mqtt"},
+			claims:      Claims{"aud": "api"},
+			expectError: ErrInvalidAudience,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tt.validator.Now = func() time.Time { return now }
+			err := tt.validator.Validate(tt.claims)
+			if tt.expectError != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestClaimsTime(t *testing.T) {
+	claims := Claims{"iat": json.Number("1700000000.25"), "exp": json.Number("10000000000"), "nbf": "soon"}
+
+	iat, ok := claims.Time("iat")
+	require.True(t, ok)
+	require.Equal(t, time.Unix(1700000000, 250000000), iat)
+
+	exp, ok := claims.Time("exp")
+	require.True(t, ok)
+	require.Equal(t, int64(10000000000), exp.Unix())
+
+	_, ok = claims.Time("nbf")
+	require.False(t, ok)
+}
+
+func TestClaimsValues(t *testing.T) {
+	claims := Claims{
+		"sub":    "device-1",
+		"tenant": "acme",
+		"num":    json.Number("42"),
+		"admin":  true,
+		"groups": []any{"a", "b"},
+	}
+
+	require.Equal(t, map[string]string{
+		"sub":    "device-1",
+		"tenant": "acme",
+		"num":    "42",
+		"admin":  "true",
+	}, claims.Values())
+}
@@ -0,0 +1,348 @@
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+const (
+	// DefaultAPIServer is the address of the API server from within the cluster
+	DefaultAPIServer = "https://kubernetes.default.svc"
+
+	// DefaultTokenFile is where the broker's own ServiceAccount token is mounted
+	DefaultTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// DefaultCAFile is where the cluster CA is mounted, which the RoundTripper should trust
+	DefaultCAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	serviceAccountPrefix = "system:serviceaccount:"
+	podNameExtra         = "authentication.kubernetes.io/pod-name"
+)
+
+// Hook is a hook that authenticates in-cluster clients presenting a ServiceAccount token as their
+// password, by submitting it to the TokenReview API, and maps the namespace and ServiceAccount of the
+// token to topic permissions
+type Hook struct {
+	httpClient *http.Client
+	config     Options
+	cache      *cache.Cache[[32]byte, ServiceAccount] // the accounts of recently reviewed tokens
+	sessions   acl.Sessions
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the Kubernetes hook.
+// It is the responsibility of the configurer to pass a properly configured RoundTripper that trusts
+// the cluster CA, usually DefaultCAFile, and takes care of other requirements such as timeouts, etc
+type Options struct {
+	APIServer    *url.URL // defaults to DefaultAPIServer
+	RoundTripper http.RoundTripper
+
+	// Token authenticates the broker against the API server, and needs permission to create
+	// tokenreviews. If empty, TokenFile is read for every review, so that rotated tokens are picked up
+	Token     string
+	TokenFile string // defaults to DefaultTokenFile
+
+	// Audiences are passed to the review, so only tokens projected for one of them are accepted. If
+	// empty, the API server's audience is assumed
+	Audiences []string
+
+	Namespaces      []string // if set, the ServiceAccount must be in one of these namespaces
+	ServiceAccounts []string // if set, the ServiceAccount must be one of these, as "namespace/name"
+
+	// CacheTTL is how long a successful review is cached. Reviews are not cached if it is zero
+	CacheTTL time.Duration
+
+	// ACL holds templates granted to every authenticated ServiceAccount and NamespaceACL the templates
+	// granted to the ServiceAccounts of each namespace. Templates may reference {clientid}, {namespace},
+	// {serviceaccount} and {podname}, eg. "pods/{namespace}/{serviceaccount}/#"
+	ACL          acl.Templates
+	NamespaceACL map[string]acl.Templates
+}
+
+// TokenReview is the TokenReview resource of the authentication.k8s.io/v1 API
+type TokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       TokenReviewSpec   `json:"spec"`
+	Status     TokenReviewStatus `json:"status,omitempty"`
+}
+
+// TokenReviewSpec is the token to review
+type TokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+// TokenReviewStatus is the result of a review
+type TokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	User          UserInfo `json:"user"`
+	Audiences     []string `json:"audiences"`
+	Error         string   `json:"error"`
+}
+
+// UserInfo is the identity a token belongs to
+type UserInfo struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid"`
+	Groups   []string            `json:"groups"`
+	Extra    map[string][]string `json:"extra"`
+}
+
+// ServiceAccount is the identity of an authenticated pod
+type ServiceAccount struct {
+	Namespace string
+	Name      string
+	PodName   string // set for tokens bound to a pod
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "kubernetes-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if len(h.config.ACL) == 0 && len(h.config.NamespaceACL) == 0 {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	kubernetesHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if kubernetesHookConfig.APIServer == nil {
+		kubernetesHookConfig.APIServer, _ = url.Parse(DefaultAPIServer)
+	}
+
+	if kubernetesHookConfig.Token == "" && kubernetesHookConfig.TokenFile == "" {
+		kubernetesHookConfig.TokenFile = DefaultTokenFile
+	}
+
+	for _, account := range kubernetesHookConfig.ServiceAccounts {
+		if namespace, name, ok := strings.Cut(account, "/"); !ok || namespace == "" || name == "" {
+			return errors.New("invalid service account " + account)
+		}
+	}
+
+	rt := kubernetesHookConfig.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	h.httpClient = &http.Client{Transport: rt}
+	h.config = kubernetesHookConfig
+	h.cache = cache.New[[32]byte, ServiceAccount](cache.Options{TTL: kubernetesHookConfig.CacheTTL})
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ok, err := h.Authenticate(cl, pk)
+	if err != nil {
+		h.Log.Error("error occurred while reviewing token", "error", err)
+	}
+	return ok
+}
+
+// Authenticate authenticates the client, and returns an error if the api server couldn't be asked, rather
+// than rejecting the client, eg. so the composite hook falls back to its next backend
+func (h *Hook) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	token := string(pk.Connect.Password)
+	if token == "" {
+		return false, nil
+	}
+
+	account, ok, err := h.authenticate(token)
+	if err != nil {
+		return false, err
+	}
+
+	if !ok || !h.allowed(account) {
+		return false, nil
+	}
+
+	if len(h.config.ACL) == 0 && len(h.config.NamespaceACL) == 0 {
+		return true, nil
+	}
+
+	values := map[string]string{
+		"clientid":       cl.ID,
+		"namespace":      account.Namespace,
+		"serviceaccount": account.Name,
+		"podname":        account.PodName,
+	}
+
+	filters := h.config.ACL.Render(values)
+	filters.Merge(h.config.NamespaceACL[account.Namespace].Render(values))
+	h.sessions.Set(cl, filters)
+
+	return true, nil
+}
+
+// allowed returns whether the ServiceAccount passes the namespace and ServiceAccount restrictions
+func (h *Hook) allowed(account ServiceAccount) bool {
+	if len(h.config.Namespaces) > 0 && !slices.Contains(h.config.Namespaces, account.Namespace) {
+		return false
+	}
+
+	if len(h.config.ServiceAccounts) > 0 && !slices.Contains(h.config.ServiceAccounts, account.Namespace+"/"+account.Name) {
+		return false
+	}
+
+	return true
+}
+
+// authenticate returns the ServiceAccount the token belongs to, from the cache if possible, and false
+// if the token was not accepted
+func (h *Hook) authenticate(token string) (ServiceAccount, bool, error) {
+	key := sha256.Sum256([]byte(token))
+	if account, ok := h.cache.Get(key); ok {
+		return account, true, nil
+	}
+
+	status, err := h.review(token)
+	if err != nil {
+		return ServiceAccount{}, false, err
+	}
+
+	if !status.Authenticated {
+		h.Log.Debug("token review rejected token", "error", status.Error)
+		return ServiceAccount{}, false, nil
+	}
+
+	if len(h.config.Audiences) > 0 && !slices.ContainsFunc(status.Audiences, func(aud string) bool {
+		return slices.Contains(h.config.Audiences, aud)
+	}) {
+		return ServiceAccount{}, false, nil
+	}
+
+	account, ok := serviceAccount(status.User)
+	if !ok {
+		h.Log.Debug("token does not belong to a service account", "username", status.User.Username)
+		return ServiceAccount{}, false, nil
+	}
+
+	if h.config.CacheTTL > 0 {
+		h.cache.Set(key, account)
+	}
+
+	return account, true, nil
+}
+
+// serviceAccount returns the ServiceAccount of a user named system:serviceaccount:<namespace>:<name>
+func serviceAccount(user UserInfo) (ServiceAccount, bool) {
+	rest, ok := strings.CutPrefix(user.Username, serviceAccountPrefix)
+	if !ok {
+		return ServiceAccount{}, false
+	}
+
+	namespace, name, ok := strings.Cut(rest, ":")
+	if !ok || namespace == "" || name == "" {
+		return ServiceAccount{}, false
+	}
+
+	account := ServiceAccount{Namespace: namespace, Name: name}
+	if pods := user.Extra[podNameExtra]; len(pods) > 0 {
+		account.PodName = pods[0]
+	}
+
+	return account, true
+}
+
+// review submits the token to the TokenReview API and returns the review status
+func (h *Hook) review(token string) (TokenReviewStatus, error) {
+	bearer, err := h.bearerToken()
+	if err != nil {
+		return TokenReviewStatus{}, err
+	}
+
+	body, err := json.Marshal(TokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       TokenReviewSpec{Token: token, Audiences: h.config.Audiences},
+	})
+	if err != nil {
+		return TokenReviewStatus{}, err
+	}
+
+	endpoint := h.config.APIServer.JoinPath("/apis/authentication.k8s.io/v1/tokenreviews")
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return TokenReviewStatus{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+bearer)
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return TokenReviewStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return TokenReviewStatus{}, fmt.Errorf("unexpected token review response status %d", resp.StatusCode)
+	}
+
+	var out TokenReview
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return TokenReviewStatus{}, err
+	}
+
+	return out.Status, nil
+}
+
+// bearerToken returns the token the broker authenticates with
+func (h *Hook) bearerToken() (string, error) {
+	if h.config.Token != "" {
+		return h.config.Token, nil
+	}
+
+	b, err := os.ReadFile(h.config.TokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
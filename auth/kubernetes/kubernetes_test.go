@@ -0,0 +1,401 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// apiServer answers token reviews for the tokens it knows, and counts them
+type apiServer struct {
+	t        *testing.T
+	bearer   string
+	users    map[string]TokenReviewStatus
+	status   int
+	fail     bool
+	requests atomic.Int32
+}
+
+func (a *apiServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	a.requests.Add(1)
+	if a.fail {
+		return nil, errors.New("connection refused")
+	}
+
+	require.Equal(a.t, http.MethodPost, req.Method)
+	require.Equal(a.t, "https://kubernetes.default.svc/apis/authentication.k8s.io/v1/tokenreviews", req.URL.String())
+	require.Equal(a.t, "Bearer "+a.bearer, req.Header.Get("Authorization"))
+
+	if a.status != 0 {
+		return &http.Response{StatusCode: a.status, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+	}
+
+	var review TokenReview
+	require.NoError(a.t, json.NewDecoder(req.Body).Decode(&review))
+	require.Equal(a.t, "TokenReview", review.Kind)
+
+	status, ok := a.users[review.Spec.Token]
+	if !ok {
+		status = TokenReviewStatus{Error: "invalid bearer token"}
+	}
+	if status.Authenticated && len(status.Audiences) == 0 {
+		status.Audiences = review.Spec.Audiences
+	}
+	review.Status = status
+
+	body, err := json.Marshal(review)
+	require.NoError(a.t, err)
+	return &http.Response{StatusCode: http.StatusCreated, Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func newAPIServer(t *testing.T) *apiServer {
+	return &apiServer{
+		t:      t,
+		bearer: "broker-token",
+		users: map[string]TokenReviewStatus{
+			"sensor-token": {
+				Authenticated: true,
+				User: UserInfo{
+					Username: "system:serviceaccount:factory:sensor",
+					Extra:    map[string][]string{podNameExtra: {"sensor-7d9f"}},
+				},
+			},
+			"dashboard-token": {
+				Authenticated: true,
+				User:          UserInfo{Username: "system:serviceaccount:monitoring:dashboard"},
+			},
+			"user-token": {
+				Authenticated: true,
+				User:          UserInfo{Username: "jane@example.com"},
+			},
+			"other-audience-token": {
+				Authenticated: true,
+				User:          UserInfo{Username: "system:serviceaccount:factory:sensor"},
+				Audiences:     []string{"https://kubernetes.default.svc"},
+			},
+		},
+	}
+}
+
+func connectPacket(token string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{Password: []byte(token)},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	kubernetesHook := new(Hook)
+	kubernetesHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, kubernetesHook.Init(options))
+	return kubernetesHook
+}
+
+func TestID(t *testing.T) {
+	kubernetesHook := new(Hook)
+
+	require.Equal(t, "kubernetes-auth-hook", kubernetesHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	kubernetesHook := new(Hook)
+	require.True(t, kubernetesHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, kubernetesHook.Provides(mqtt.OnACLCheck))
+
+	kubernetesHook.config.NamespaceACL = map[string]acl.Templates{"factory": {"factory/#": acl.ReadWrite}}
+	require.True(t, kubernetesHook.Provides(mqtt.OnACLCheck))
+	require.True(t, kubernetesHook.Provides(mqtt.OnDisconnect))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - in cluster defaults",
+			config:      Options{},
+			expectError: false,
+		},
+		{
+			name:        "Success - service accounts",
+			config:      Options{Token: "broker-token", ServiceAccounts: []string{"factory/sensor"}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid service account",
+			config:      Options{ServiceAccounts: []string{"sensor"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			kubernetesHook := new(Hook)
+			kubernetesHook.Log = slog.Default()
+			err := kubernetesHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, DefaultAPIServer, kubernetesHook.config.APIServer.String())
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     Options
+		token       string
+		apiStatus   int
+		apiFail     bool
+		expectPass  bool
+		expectError bool
+	}{
+		{
+			name:       "Success - service account",
+			token:      "sensor-token",
+			expectPass: true,
+		},
+		{
+			name:       "Success - allowed namespace",
+			options:    Options{Namespaces: []string{"factory"}},
+			token:      "sensor-token",
+			expectPass: true,
+		},
+		{
+			name:       "Success - allowed service account",
+			options:    Options{ServiceAccounts: []string{"factory/sensor"}},
+			token:      "sensor-token",
+			expectPass: true,
+		},
+		{
+			name:       "Success - audience",
+			options:    Options{Audiences: []string{"mqtt"}},
+			token:      "sensor-token",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - empty token",
+			token:      "",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unauthenticated token",
+			token:      "stolen-token",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - not a service account",
+			token:      "user-token",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - namespace not allowed",
+			options:    Options{Namespaces: []string{"factory"}},
+			token:      "dashboard-token",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - service account not allowed",
+			options:    Options{ServiceAccounts: []string{"factory/controller"}},
+			token:      "sensor-token",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - token for another audience",
+			options:    Options{Audiences: []string{"mqtt"}},
+			token:      "other-audience-token",
+			expectPass: false,
+		},
+		{
+			name:        "Error - forbidden",
+			token:       "sensor-token",
+			apiStatus:   http.StatusForbidden,
+			expectPass:  false,
+			expectError: true,
+		},
+		{
+			name:        "Error - api server down",
+			token:       "sensor-token",
+			apiFail:     true,
+			expectPass:  false,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			rt := newAPIServer(t)
+			rt.status = tt.apiStatus
+			rt.fail = tt.apiFail
+
+			options := tt.options
+			options.Token = "broker-token"
+			options.RoundTripper = rt
+			kubernetesHook := newHook(t, options)
+
+			cl := &mqtt.Client{ID: "sensor-1"}
+			success, err := kubernetesHook.Authenticate(cl, connectPacket(tt.token))
+			require.Equal(t, tt.expectPass, success)
+			require.Equal(t, tt.expectError, err != nil)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticateTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("broker-token\n"), 0600))
+
+	rt := newAPIServer(t)
+	kubernetesHook := newHook(t, Options{TokenFile: tokenFile, RoundTripper: rt})
+	require.True(t, kubernetesHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("sensor-token")))
+
+	// the rotated token is used for the next review
+	rt.bearer = "rotated-token"
+	require.NoError(t, os.WriteFile(tokenFile, []byte("rotated-token"), 0600))
+	require.True(t, kubernetesHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("sensor-token")))
+
+	require.NoError(t, os.Remove(tokenFile))
+	require.False(t, kubernetesHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("sensor-token")))
+}
+
+func TestOnConnectAuthenticateCache(t *testing.T) {
+	rt := newAPIServer(t)
+	kubernetesHook := newHook(t, Options{Token: "broker-token", RoundTripper: rt, CacheTTL: time.Minute})
+
+	require.True(t, kubernetesHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("sensor-token")))
+	require.True(t, kubernetesHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("sensor-token")))
+	require.Equal(t, int32(1), rt.requests.Load())
+
+	// rejected tokens are not cached
+	require.False(t, kubernetesHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("stolen-token")))
+	require.False(t, kubernetesHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("stolen-token")))
+	require.Equal(t, int32(3), rt.requests.Load())
+}
+
+func TestOnACLCheck(t *testing.T) {
+	kubernetesHook := newHook(t, Options{
+		APIServer:    stringToURL(DefaultAPIServer),
+		Token:        "broker-token",
+		RoundTripper: newAPIServer(t),
+		ACL: acl.Templates{
+			"pods/{namespace}/{serviceaccount}/#": acl.ReadWrite,
+			"pods/{namespace}/{podname}/status":   acl.WriteOnly,
+		},
+		NamespaceACL: map[string]acl.Templates{
+			"factory":    {"factory/{clientid}/#": acl.ReadWrite},
+			"monitoring": {"factory/#": acl.ReadOnly},
+		},
+	})
+
+	sensor := &mqtt.Client{ID: "sensor-1"}
+	require.True(t, kubernetesHook.OnConnectAuthenticate(sensor, connectPacket("sensor-token")))
+	dashboard := &mqtt.Client{ID: "dashboard-1"}
+	require.True(t, kubernetesHook.OnConnectAuthenticate(dashboard, connectPacket("dashboard-token")))
+
+	tests := []struct {
+		name       string
+		client     *mqtt.Client
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - service account prefix",
+			client:     sensor,
+			topic:      "pods/factory/sensor/readings",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - pod name",
+			client:     sensor,
+			topic:      "pods/factory/sensor-7d9f/status",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - namespace acl",
+			client:     sensor,
+			topic:      "factory/sensor-1/commands",
+			expectPass: true,
+		},
+		{
+			name:       "Success - other namespace acl",
+			client:     dashboard,
+			topic:      "factory/sensor-1/commands",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - other namespace acl is read only",
+			client:     dashboard,
+			topic:      "factory/sensor-1/commands",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - another service account's prefix",
+			client:     sensor,
+			topic:      "pods/monitoring/dashboard/readings",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - token without pod binding",
+			client:     dashboard,
+			topic:      "pods/monitoring//status",
+			write:      true,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, kubernetesHook.OnACLCheck(tt.client, tt.topic, tt.write))
+
+		})
+	}
+
+	kubernetesHook.OnDisconnect(sensor, nil, true)
+	require.False(t, kubernetesHook.OnACLCheck(sensor, "pods/factory/sensor/readings", true))
+}
+
+func stringToURL(s string) *url.URL {
+	u, _ := url.Parse(s)
+	return u
+}
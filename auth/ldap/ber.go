@@ -0,0 +1,193 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// the subset of BER identifiers used by LDAPv3 (RFC 4511)
+const (
+	tagBoolean     byte = 0x01
+	tagInteger     byte = 0x02
+	tagOctetString byte = 0x04
+	tagEnumerated  byte = 0x0a
+	tagSequence    byte = 0x30
+	tagSet         byte = 0x31
+
+	tagBindRequest        byte = 0x60
+	tagBindResponse       byte = 0x61
+	tagUnbindRequest      byte = 0x42
+	tagSearchRequest      byte = 0x63
+	tagSearchResultEntry  byte = 0x64
+	tagSearchResultDone   byte = 0x65
+	tagSearchResultRef    byte = 0x73
+	tagExtendedRequest    byte = 0x77
+	tagExtendedResponse   byte = 0x78
+	tagSimpleAuth         byte = 0x80
+	tagExtendedRequestOID byte = 0x80
+
+	constructed byte = 0x20
+)
+
+var errMalformedPacket = errors.New("malformed ldap packet")
+
+// maxPacketSize bounds the size of a single response read from the server
+const maxPacketSize = 16 << 20
+
+// element is a decoded BER element
+type element struct {
+	tag      byte
+	value    []byte
+	children []element
+}
+
+func (e element) constructed() bool {
+	return e.tag&constructed != 0
+}
+
+func (e element) int() int64 {
+	var v int64
+	for i, b := range e.value {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+func (e element) string() string {
+	return string(e.value)
+}
+
+func encode(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	n := len(value)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, value...)
+}
+
+func encodeInt(tag byte, v int64) []byte {
+	b := []byte{byte(v)}
+	for v > 0x7f || v < -0x80 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return encode(tag, b)
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+func encodeBool(v bool) []byte {
+	if v {
+		return encode(tagBoolean, []byte{0xff})
+	}
+	return encode(tagBoolean, []byte{0x00})
+}
+
+func encodeConstructed(tag byte, children ...[]byte) []byte {
+	var value []byte
+	for _, c := range children {
+		value = append(value, c...)
+	}
+	return encode(tag, value)
+}
+
+// readElement reads a single BER element from the reader
+func readElement(r *bufio.Reader) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+
+	l, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+
+	length := int(l)
+	if l&0x80 != 0 {
+		octets := int(l & 0x7f)
+		if octets == 0 || octets > 4 {
+			return element{}, errMalformedPacket
+		}
+		length = 0
+		for i := 0; i < octets; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return element{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+
+	if length > maxPacketSize {
+		return element{}, errMalformedPacket
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return element{}, err
+	}
+
+	return parseElement(tag, value)
+}
+
+func parseElement(tag byte, value []byte) (element, error) {
+	e := element{tag: tag, value: value}
+	if !e.constructed() {
+		return e, nil
+	}
+
+	for len(value) > 0 {
+		child, rest, err := splitElement(value)
+		if err != nil {
+			return element{}, err
+		}
+		e.children = append(e.children, child)
+		value = rest
+	}
+
+	return e, nil
+}
+
+func splitElement(b []byte) (element, []byte, error) {
+	if len(b) < 2 {
+		return element{}, nil, errMalformedPacket
+	}
+
+	tag, l := b[0], b[1]
+	b = b[2:]
+
+	length := int(l)
+	if l&0x80 != 0 {
+		octets := int(l & 0x7f)
+		if octets == 0 || octets > 4 || len(b) < octets {
+			return element{}, nil, errMalformedPacket
+		}
+		length = 0
+		for _, o := range b[:octets] {
+			length = length<<8 | int(o)
+		}
+		b = b[octets:]
+	}
+
+	if length < 0 || length > len(b) {
+		return element{}, nil, errMalformedPacket
+	}
+
+	e, err := parseElement(tag, b[:length])
+	return e, b[length:], err
+}
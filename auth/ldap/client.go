@@ -0,0 +1,280 @@
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	scopeWholeSubtree = 2
+	neverDerefAliases = 0
+
+	// ResultInvalidCredentials is returned by the server when a bind fails due to bad credentials
+	ResultInvalidCredentials = 49
+)
+
+// ResultError is a non-success result returned by the LDAP server. The connection remains usable
+type ResultError struct {
+	Code    int
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("ldap result code %d: %s", e.Code, e.Message)
+}
+
+// Entry is a single search result entry
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Conn is an LDAP connection used by the hook. It is satisfied by the connections returned by Dial,
+// and can be implemented over other LDAP client libraries
+type Conn interface {
+	Bind(dn, password string) error
+	Search(baseDN, filter string, attributes []string) ([]Entry, error)
+	Close() error
+}
+
+// DialOptions contains the options for establishing a connection
+type DialOptions struct {
+	StartTLS  bool          // upgrade an ldap:// connection with the StartTLS extended operation
+	TLSConfig *tls.Config   // used for ldaps:// and StartTLS, the server name defaults to the url host
+	Timeout   time.Duration // applied to dialing and to each operation
+}
+
+// client is a minimal synchronous LDAPv3 client supporting simple bind, search and StartTLS
+type client struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	msgID   int64
+}
+
+// Dial connects to an ldap:// or ldaps:// url
+func Dial(rawURL string, opts DialOptions) (Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	tlsConfig := opts.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("unsupported ldap scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := newClient(conn, opts.Timeout)
+	if opts.StartTLS && u.Scheme == "ldap" {
+		if err := c.startTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func newClient(conn net.Conn, timeout time.Duration) *client {
+	return &client{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: timeout,
+	}
+}
+
+func (c *client) startTLS(config *tls.Config) error {
+	_, err := c.request(encodeConstructed(tagExtendedRequest,
+		encodeString(tagExtendedRequestOID, startTLSOID),
+	), tagExtendedResponse)
+	if err != nil {
+		return fmt.Errorf("starttls: %w", err)
+	}
+
+	tlsConn := tls.Client(c.conn, config)
+	if c.timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("starttls: %w", err)
+	}
+
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// Bind performs a simple bind. Empty passwords are rejected, as servers treat them as an
+// unauthenticated bind which always succeeds (RFC 4513 section 5.1.2)
+func (c *client) Bind(dn, password string) error {
+	if password == "" {
+		return &ResultError{Code: ResultInvalidCredentials, Message: "empty password"}
+	}
+
+	_, err := c.request(encodeConstructed(tagBindRequest,
+		encodeInt(tagInteger, 3),
+		encodeString(tagOctetString, dn),
+		encodeString(tagSimpleAuth, password),
+	), tagBindResponse)
+	return err
+}
+
+// Search performs a whole subtree search and returns the matching entries
+func (c *client) Search(baseDN, filter string, attributes []string) ([]Entry, error) {
+	compiled, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([][]byte, 0, len(attributes))
+	for _, a := range attributes {
+		attrs = append(attrs, encodeString(tagOctetString, a))
+	}
+
+	return c.request(encodeConstructed(tagSearchRequest,
+		encodeString(tagOctetString, baseDN),
+		encodeInt(tagEnumerated, scopeWholeSubtree),
+		encodeInt(tagEnumerated, neverDerefAliases),
+		encodeInt(tagInteger, 0),
+		encodeInt(tagInteger, 0),
+		encodeBool(false),
+		compiled,
+		encodeConstructed(tagSequence, attrs...),
+	), tagSearchResultDone)
+}
+
+// Close sends an unbind request and closes the connection
+func (c *client) Close() error {
+	c.msgID++
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.conn.Write(encodeConstructed(tagSequence,
+		encodeInt(tagInteger, c.msgID),
+		encode(tagUnbindRequest, nil),
+	))
+	return c.conn.Close()
+}
+
+// request writes an operation and reads responses until the one with the done tag, collecting any
+// search result entries along the way
+func (c *client) request(op []byte, done byte) ([]Entry, error) {
+	c.msgID++
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	if _, err := c.conn.Write(encodeConstructed(tagSequence, encodeInt(tagInteger, c.msgID), op)); err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for {
+		msg, err := readElement(c.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.tag != tagSequence || len(msg.children) < 2 {
+			return nil, errMalformedPacket
+		}
+
+		if msg.children[0].int() != c.msgID {
+			continue // unsolicited notification or stale response
+		}
+
+		resp := msg.children[1]
+		switch resp.tag {
+		case tagSearchResultEntry:
+			entry, err := parseEntry(resp)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case tagSearchResultRef:
+			continue
+		case done:
+			return entries, parseResult(resp)
+		default:
+			return nil, errMalformedPacket
+		}
+	}
+}
+
+func parseResult(e element) error {
+	if len(e.children) < 3 {
+		return errMalformedPacket
+	}
+
+	code := int(e.children[0].int())
+	if code != 0 {
+		return &ResultError{Code: code, Message: e.children[2].string()}
+	}
+	return nil
+}
+
+func parseEntry(e element) (Entry, error) {
+	if len(e.children) < 2 {
+		return Entry{}, errMalformedPacket
+	}
+
+	entry := Entry{
+		DN:         e.children[0].string(),
+		Attributes: map[string][]string{},
+	}
+
+	for _, attr := range e.children[1].children {
+		if len(attr.children) < 2 {
+			return Entry{}, errMalformedPacket
+		}
+
+		name := strings.ToLower(attr.children[0].string())
+		for _, v := range attr.children[1].children {
+			entry.Attributes[name] = append(entry.Attributes[name], v.string())
+		}
+	}
+
+	return entry, nil
+}
+
+// isResultError returns whether the error came from the server rather than the connection, in which
+// case the connection can be reused
+func isResultError(err error) bool {
+	var re *ResultError
+	return errors.As(err, &re)
+}
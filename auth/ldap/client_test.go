@@ -0,0 +1,141 @@
+package ldap
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ldapResult(tag byte, code int64, message string) []byte {
+	return encodeConstructed(tag,
+		encodeInt(tagEnumerated, code),
+		encodeString(tagOctetString, ""),
+		encodeString(tagOctetString, message),
+	)
+}
+
+// fakeServer answers requests from a client with the responses returned by handle
+func fakeServer(t *testing.T, handle func(op element) [][]byte) *client {
+	server, conn := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			msg, err := readElement(r)
+			if err != nil {
+				return
+			}
+
+			for _, resp := range handle(msg.children[1]) {
+				server.Write(encodeConstructed(tagSequence, encodeInt(tagInteger, msg.children[0].int()), resp))
+			}
+		}
+	}()
+
+	return newClient(conn, time.Second)
+}
+
+func TestEncodeInt(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 255, 256, 65535, 1 << 24, -1, -129} {
+		e, rest, err := splitElement(encodeInt(tagInteger, v))
+		require.NoError(t, err)
+		require.Empty(t, rest)
+		require.Equal(t, v, e.int())
+	}
+}
+
+func TestEncodeLongLength(t *testing.T) {
+	long := string(make([]byte, 70000))
+	e, rest, err := splitElement(encodeString(tagOctetString, long))
+	require.NoError(t, err)
+	require.Empty(t, rest)
+	require.Equal(t, long, e.string())
+
+	_, _, err = splitElement([]byte{tagOctetString, 0x85, 0, 0, 0, 0, 1})
+	require.Error(t, err)
+}
+
+func TestClientBind(t *testing.T) {
+	c := fakeServer(t, func(op element) [][]byte {
+		require.Equal(t, tagBindRequest, op.tag)
+		if op.children[2].string() == "secret" {
+			return [][]byte{ldapResult(tagBindResponse, 0, "")}
+		}
+		return [][]byte{ldapResult(tagBindResponse, ResultInvalidCredentials, "invalid credentials")}
+	})
+
+	require.NoError(t, c.Bind("uid=alice,dc=example", "secret"))
+
+	err := c.Bind("uid=alice,dc=example", "wrong")
+	require.Error(t, err)
+	require.True(t, isResultError(err))
+	require.Equal(t, ResultInvalidCredentials, err.(*ResultError).Code)
+
+	err = c.Bind("uid=alice,dc=example", "")
+	require.True(t, isResultError(err))
+}
+
+func TestClientSearch(t *testing.T) {
+	c := fakeServer(t, func(op element) [][]byte {
+		require.Equal(t, tagSearchRequest, op.tag)
+		require.Equal(t, "ou=groups,dc=example", op.children[0].string())
+
+		return [][]byte{
+			encodeConstructed(tagSearchResultEntry,
+				encodeString(tagOctetString, "cn=admins,ou=groups,dc=example"),
+				encodeConstructed(tagSequence,
+					encodeConstructed(tagSequence,
+						encodeString(tagOctetString, "CN"),
+						encodeConstructed(tagSet, encodeString(tagOctetString, "admins")),
+					),
+				),
+			),
+			encodeConstructed(tagSearchResultRef, encodeString(tagOctetString, "ldap://other")),
+			ldapResult(tagSearchResultDone, 0, ""),
+		}
+	})
+
+	entries, err := c.Search("ou=groups,dc=example", "(member=uid=alice,dc=example)", []string{"cn"})
+	require.NoError(t, err)
+	require.Equal(t, []Entry{{
+		DN:         "cn=admins,ou=groups,dc=example",
+		Attributes: map[string][]string{"cn": {"admins"}},
+	}}, entries)
+
+	_, err = c.Search("ou=groups,dc=example", "(member=", nil)
+	require.Error(t, err)
+}
+
+func TestClientStartTLSRejected(t *testing.T) {
+	c := fakeServer(t, func(op element) [][]byte {
+		require.Equal(t, tagExtendedRequest, op.tag)
+		require.Equal(t, startTLSOID, op.children[0].string())
+		return [][]byte{ldapResult(tagExtendedResponse, 2, "unsupported")}
+	})
+
+	require.Error(t, c.startTLS(nil))
+}
+
+func TestDial(t *testing.T) {
+	_, err := Dial("http://example.com", DialOptions{})
+	require.Error(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := Dial("ldap://"+listener.Addr().String(), DialOptions{Timeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
@@ -0,0 +1,217 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// filter choice tags (RFC 4511 section 4.5.1)
+const (
+	filterAnd            byte = 0xa0
+	filterOr             byte = 0xa1
+	filterNot            byte = 0xa2
+	filterEquality       byte = 0xa3
+	filterSubstrings     byte = 0xa4
+	filterGreaterOrEqual byte = 0xa5
+	filterLessOrEqual    byte = 0xa6
+	filterPresent        byte = 0x87
+	filterApprox         byte = 0xa8
+
+	substringInitial byte = 0x80
+	substringAny     byte = 0x81
+	substringFinal   byte = 0x82
+)
+
+var errInvalidFilter = errors.New("invalid ldap filter")
+
+// EscapeFilter escapes a value for safe inclusion in a search filter (RFC 4515)
+func EscapeFilter(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '*' || c == '(' || c == ')' || c == '\\' || c == 0 || c >= 0x80:
+			fmt.Fprintf(&sb, "\\%02x", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// EscapeDN escapes a value for safe inclusion as an attribute value in a distinguished name (RFC 4514)
+func EscapeDN(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case (c == ' ' || c == '#') && i == 0, c == ' ' && i == len(s)-1:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == 0:
+			sb.WriteString(`\00`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// compileFilter converts a string filter such as (&(objectClass=person)(uid=alice)) into its BER encoding
+func compileFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+
+	b, rest, err := compileItem(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if rest != "" {
+		return nil, errInvalidFilter
+	}
+	return b, nil
+}
+
+func compileItem(s string) ([]byte, string, error) {
+	if len(s) < 3 || s[0] != '(' {
+		return nil, "", errInvalidFilter
+	}
+
+	switch s[1] {
+	case '&', '|':
+		tag := filterAnd
+		if s[1] == '|' {
+			tag = filterOr
+		}
+
+		var children [][]byte
+		rest := s[2:]
+		for len(rest) > 0 && rest[0] == '(' {
+			child, r, err := compileItem(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, child)
+			rest = r
+		}
+
+		if len(children) == 0 || len(rest) == 0 || rest[0] != ')' {
+			return nil, "", errInvalidFilter
+		}
+		return encodeConstructed(tag, children...), rest[1:], nil
+
+	case '!':
+		child, rest, err := compileItem(s[2:])
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", errInvalidFilter
+		}
+		return encodeConstructed(filterNot, child), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errInvalidFilter
+	}
+
+	b, err := compileSimple(s[1:end])
+	return b, s[end+1:], err
+}
+
+func compileSimple(s string) ([]byte, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 1 {
+		return nil, errInvalidFilter
+	}
+
+	attr, value := s[:i], s[i+1:]
+	tag := filterEquality
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = filterGreaterOrEqual, attr[:len(attr)-1]
+	case '<':
+		tag, attr = filterLessOrEqual, attr[:len(attr)-1]
+	case '~':
+		tag, attr = filterApprox, attr[:len(attr)-1]
+	}
+
+	if attr == "" {
+		return nil, errInvalidFilter
+	}
+
+	if tag == filterEquality && value == "*" {
+		return encodeString(filterPresent, attr), nil
+	}
+
+	if tag == filterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var subs [][]byte
+		for n, part := range parts {
+			if part == "" {
+				continue
+			}
+
+			v, err := unescapeFilterValue(part)
+			if err != nil {
+				return nil, err
+			}
+
+			switch n {
+			case 0:
+				subs = append(subs, encode(substringInitial, v))
+			case len(parts) - 1:
+				subs = append(subs, encode(substringFinal, v))
+			default:
+				subs = append(subs, encode(substringAny, v))
+			}
+		}
+
+		return encodeConstructed(filterSubstrings,
+			encodeString(tagOctetString, attr),
+			encodeConstructed(tagSequence, subs...),
+		), nil
+	}
+
+	v, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeConstructed(tag,
+		encodeString(tagOctetString, attr),
+		encode(tagOctetString, v),
+	), nil
+}
+
+func unescapeFilterValue(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+
+		if i+3 > len(s) {
+			return nil, errInvalidFilter
+		}
+
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return nil, errInvalidFilter
+		}
+		out = append(out, b[0])
+		i += 2
+	}
+	return out, nil
+}
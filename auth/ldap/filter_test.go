@@ -0,0 +1,109 @@
+package ldap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	require.Equal(t, "alice", EscapeFilter("alice"))
+	require.Equal(t, `\2a\29\28\5c`, EscapeFilter(`*)(\`))
+}
+
+func TestEscapeDN(t *testing.T) {
+	require.Equal(t, "alice", EscapeDN("alice"))
+	require.Equal(t, `a\,b\=c`, EscapeDN("a,b=c"))
+	require.Equal(t, `\ a\ `, EscapeDN(" a "))
+	require.Equal(t, `\#a`, EscapeDN("#a"))
+}
+
+func TestCompileFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		filter      string
+		expect      []byte
+		expectError bool
+	}{
+		{
+			name:   "Success - equality",
+			filter: "(uid=a)",
+			expect: encodeConstructed(filterEquality, encodeString(tagOctetString, "uid"), encodeString(tagOctetString, "a")),
+		},
+		{
+			name:   "Success - equality without parentheses",
+			filter: "uid=a",
+			expect: encodeConstructed(filterEquality, encodeString(tagOctetString, "uid"), encodeString(tagOctetString, "a")),
+		},
+		{
+			name:   "Success - present",
+			filter: "(objectClass=*)",
+			expect: encodeString(filterPresent, "objectClass"),
+		},
+		{
+			name:   "Success - escaped value",
+			filter: `(cn=a\2ab)`,
+			expect: encodeConstructed(filterEquality, encodeString(tagOctetString, "cn"), encodeString(tagOctetString, "a*b")),
+		},
+		{
+			name:   "Success - substrings",
+			filter: "(cn=a*b*c)",
+			expect: encodeConstructed(filterSubstrings,
+				encodeString(tagOctetString, "cn"),
+				encodeConstructed(tagSequence,
+					encodeString(substringInitial, "a"),
+					encodeString(substringAny, "b"),
+					encodeString(substringFinal, "c"),
+				),
+			),
+		},
+		{
+			name:   "Success - and, or, not",
+			filter: "(&(objectClass=person)(|(uid=a)(!(uid>=b))))",
+			expect: encodeConstructed(filterAnd,
+				encodeConstructed(filterEquality, encodeString(tagOctetString, "objectClass"), encodeString(tagOctetString, "person")),
+				encodeConstructed(filterOr,
+					encodeConstructed(filterEquality, encodeString(tagOctetString, "uid"), encodeString(tagOctetString, "a")),
+					encodeConstructed(filterNot,
+						encodeConstructed(filterGreaterOrEqual, encodeString(tagOctetString, "uid"), encodeString(tagOctetString, "b")),
+					),
+				),
+			),
+		},
+		{
+			name:        "Failure - unbalanced",
+			filter:      "(&(uid=a)",
+			expectError: true,
+		},
+		{
+			name:        "Failure - trailing data",
+			filter:      "(uid=a)(uid=b)",
+			expectError: true,
+		},
+		{
+			name:        "Failure - bad escape",
+			filter:      `(uid=a\2)`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - no attribute",
+			filter:      "(=a)",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			b, err := compileFilter(tt.filter)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, b)
+
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package ldap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+const (
+	// BindAsUser binds directly with a DN built from the UserDN template and the client's username
+	BindAsUser Mode = iota
+	// SearchAndBind binds with a service account, searches for the user's DN, then binds as the user
+	SearchAndBind
+)
+
+// errUserNotFound is returned when the user search is ambiguous or empty. The connection is still healthy
+var errUserNotFound = &ResultError{Code: 32, Message: "user search did not return exactly one entry"}
+
+// Mode determines how the user's DN is resolved before binding with their password
+type Mode byte
+
+// Hook is a hook that authenticates clients against an LDAP or Active Directory server, and optionally
+// maps the user's group memberships to topic ACL templates
+type Hook struct {
+	config   Options
+	pool     *pool
+	sessions acl.Sessions
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the ldap hook
+type Options struct {
+	URL       string        // ldap://host:389 or ldaps://host:636
+	StartTLS  bool          // upgrade ldap:// connections with StartTLS
+	TLSConfig *tls.Config   // used for ldaps:// and StartTLS
+	Timeout   time.Duration // dial and per-operation timeout
+	PoolSize  int           // maximum number of idle connections kept open, defaults to 4
+
+	Mode   Mode
+	UserDN string // BindAsUser: DN template, eg. "uid={username},ou=people,dc=example,dc=com"
+
+	BindDN       string // SearchAndBind: service account used for user and group searches
+	BindPassword string
+	BaseDN       string // SearchAndBind: base of the user search
+	UserFilter   string // SearchAndBind: eg. "(&(objectClass=person)(uid={username}))"
+
+	GroupBaseDN    string // base of the group search, group lookups are disabled if empty
+	GroupFilter    string // eg. "(member={dn})", {dn} is the user's DN and {username} the username
+	GroupAttribute string // attribute holding the group name, defaults to "cn"
+
+	// ACL templates are granted to every authenticated user, and GroupACL templates to members of the
+	// named group. Templates may reference {username}, {clientid} and {group}
+	ACL      acl.Templates
+	GroupACL map[string]acl.Templates
+
+	// Dial overrides how connections are established, eg. to use another LDAP client library
+	Dial func() (Conn, error)
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "ldap-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if len(h.config.ACL) == 0 && len(h.config.GroupACL) == 0 {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	ldapHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if err := validateConfig(ldapHookConfig); err != nil {
+		return err
+	}
+
+	if ldapHookConfig.GroupAttribute == "" {
+		ldapHookConfig.GroupAttribute = "cn"
+	}
+
+	if ldapHookConfig.PoolSize <= 0 {
+		ldapHookConfig.PoolSize = 4
+	}
+
+	dial := ldapHookConfig.Dial
+	if dial == nil {
+		dial = func() (Conn, error) {
+			return Dial(ldapHookConfig.URL, DialOptions{
+				StartTLS:  ldapHookConfig.StartTLS,
+				TLSConfig: ldapHookConfig.TLSConfig,
+				Timeout:   ldapHookConfig.Timeout,
+			})
+		}
+	}
+
+	h.config = ldapHookConfig
+	h.pool = newPool(dial, ldapHookConfig.PoolSize)
+	return nil
+}
+
+func validateConfig(config Options) error {
+	if config.URL == "" && config.Dial == nil {
+		return errors.New("no url configured")
+	}
+
+	switch config.Mode {
+	case BindAsUser:
+		if !strings.Contains(config.UserDN, "{username}") {
+			return errors.New("user dn template must contain {username}")
+		}
+	case SearchAndBind:
+		if config.BaseDN == "" || !strings.Contains(config.UserFilter, "{username}") {
+			return errors.New("search and bind requires a base dn and a user filter containing {username}")
+		}
+	default:
+		return errors.New("unknown mode")
+	}
+
+	if config.GroupBaseDN != "" && config.GroupFilter == "" {
+		return errors.New("group base dn configured without a group filter")
+	}
+
+	return nil
+}
+
+// Stop closes all idle connections
+func (h *Hook) Stop() error {
+	if h.pool != nil {
+		h.pool.close()
+	}
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ok, err := h.Authenticate(cl, pk)
+	if err != nil {
+		h.Log.Error("error occurred while authenticating with ldap", "error", err, "client", cl.ID)
+	}
+	return ok
+}
+
+// Authenticate authenticates the client, and returns an error if the directory couldn't be asked,
+// rather than rejecting the client, eg. so the composite hook falls back to its next backend
+func (h *Hook) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	username := string(pk.Connect.Username)
+	password := string(pk.Connect.Password)
+	if username == "" || password == "" {
+		return false, nil
+	}
+
+	conn, err := h.pool.get()
+	if err != nil {
+		return false, err
+	}
+
+	groups, err := h.authenticate(conn, username, password)
+	h.pool.put(conn, err == nil || isResultError(err))
+	if isResultError(err) || errors.Is(err, errUserNotFound) {
+		h.Log.Debug("ldap authentication failed", "client", cl.ID, "username", username, "error", err)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if len(h.config.ACL) > 0 || len(h.config.GroupACL) > 0 {
+		values := map[string]string{
+			"username": username,
+			"clientid": cl.ID,
+		}
+
+		filters := h.config.ACL.Render(values)
+		for _, group := range groups {
+			values["group"] = group
+			filters.Merge(h.config.GroupACL[group].Render(values))
+		}
+
+		h.sessions.Set(cl, filters)
+	}
+
+	return true, nil
+}
+
+// authenticate binds as the user and returns the names of the groups they are a member of
+func (h *Hook) authenticate(conn Conn, username, password string) ([]string, error) {
+	var dn string
+	switch h.config.Mode {
+	case BindAsUser:
+		dn = strings.ReplaceAll(h.config.UserDN, "{username}", EscapeDN(username))
+	case SearchAndBind:
+		if err := conn.Bind(h.config.BindDN, h.config.BindPassword); err != nil {
+			return nil, err
+		}
+
+		filter := strings.ReplaceAll(h.config.UserFilter, "{username}", EscapeFilter(username))
+		entries, err := conn.Search(h.config.BaseDN, filter, []string{"1.1"}) // 1.1 requests no attributes
+		if err != nil {
+			return nil, err
+		}
+
+		if len(entries) != 1 {
+			return nil, errUserNotFound
+		}
+		dn = entries[0].DN
+	}
+
+	if err := conn.Bind(dn, password); err != nil {
+		return nil, err
+	}
+
+	if h.config.GroupBaseDN == "" {
+		return nil, nil
+	}
+
+	// search for groups as the service account if there is one, otherwise as the user
+	if h.config.BindDN != "" {
+		if err := conn.Bind(h.config.BindDN, h.config.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	filter := strings.NewReplacer(
+		"{dn}", EscapeFilter(dn),
+		"{username}", EscapeFilter(username),
+	).Replace(h.config.GroupFilter)
+
+	entries, err := conn.Search(h.config.GroupBaseDN, filter, []string{h.config.GroupAttribute})
+	if err != nil {
+		return nil, err
+	}
+
+	attr := strings.ToLower(h.config.GroupAttribute)
+	groups := make([]string, 0, len(entries))
+	for _, e := range entries {
+		groups = append(groups, e.Attributes[attr]...)
+	}
+
+	return groups, nil
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
+
+// pool keeps a bounded number of idle connections for reuse
+type pool struct {
+	dial func() (Conn, error)
+	idle chan Conn
+}
+
+func newPool(dial func() (Conn, error), size int) *pool {
+	return &pool{
+		dial: dial,
+		idle: make(chan Conn, size),
+	}
+}
+
+func (p *pool) get() (Conn, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+		return p.dial()
+	}
+}
+
+// put returns a connection to the pool, closing it if it is unhealthy or the pool is full
+func (p *pool) put(conn Conn, healthy bool) {
+	if !healthy {
+		conn.Close()
+		return
+	}
+
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (p *pool) close() {
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
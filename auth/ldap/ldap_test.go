@@ -0,0 +1,366 @@
+package ldap
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// fakeConn is an in-memory directory with a service account, users and groups
+type fakeConn struct {
+	passwords map[string]string // dn -> password
+	users     map[string]string // filter -> dn
+	groups    map[string][]Entry
+	bound     string
+	closed    bool
+	failNet   bool
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		passwords: map[string]string{
+			"cn=svc,dc=example":         "svc-secret",
+			"uid=alice,ou=people,dc=ex": "alice-secret",
+		},
+		users: map[string]string{
+			"(uid=alice)": "uid=alice,ou=people,dc=ex",
+		},
+		groups: map[string][]Entry{
+			"(member=uid=alice,ou=people,dc=ex)": {
+				{DN: "cn=operators", Attributes: map[string][]string{"cn": {"operators"}}},
+				{DN: "cn=viewers", Attributes: map[string][]string{"cn": {"viewers"}}},
+			},
+		},
+	}
+}
+
+func (c *fakeConn) Bind(dn, password string) error {
+	if c.failNet {
+		return errors.New("connection reset")
+	}
+
+	if p, ok := c.passwords[dn]; !ok || p != password {
+		return &ResultError{Code: ResultInvalidCredentials}
+	}
+	c.bound = dn
+	return nil
+}
+
+func (c *fakeConn) Search(baseDN, filter string, attributes []string) ([]Entry, error) {
+	if c.bound == "" {
+		return nil, &ResultError{Code: 50}
+	}
+
+	if dn, ok := c.users[filter]; ok {
+		return []Entry{{DN: dn}}, nil
+	}
+	return c.groups[filter], nil
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestID(t *testing.T) {
+	ldapHook := new(Hook)
+
+	require.Equal(t, "ldap-auth-hook", ldapHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	ldapHook := new(Hook)
+	require.True(t, ldapHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, ldapHook.Provides(mqtt.OnACLCheck))
+
+	ldapHook.config.GroupACL = map[string]acl.Templates{"operators": {"#": acl.ReadWrite}}
+	require.True(t, ldapHook.Provides(mqtt.OnACLCheck))
+	require.True(t, ldapHook.Provides(mqtt.OnDisconnect))
+	require.False(t, ldapHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	ldapHook := new(Hook)
+	ldapHook.Log = slog.Default()
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name: "Success - bind as user",
+			config: Options{
+				URL:    "ldap://localhost",
+				UserDN: "uid={username},ou=people,dc=ex",
+			},
+			expectError: false,
+		},
+		{
+			name: "Success - search and bind",
+			config: Options{
+				URL:        "ldaps://localhost",
+				Mode:       SearchAndBind,
+				BaseDN:     "dc=ex",
+				UserFilter: "(uid={username})",
+			},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no url",
+			config:      Options{UserDN: "uid={username}"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - user dn without username",
+			config:      Options{URL: "ldap://localhost", UserDN: "uid=alice"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - search and bind without filter",
+			config:      Options{URL: "ldap://localhost", Mode: SearchAndBind, BaseDN: "dc=ex"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - group base without filter",
+			config:      Options{URL: "ldap://localhost", UserDN: "uid={username}", GroupBaseDN: "dc=ex"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown mode",
+			config:      Options{URL: "ldap://localhost", Mode: 9},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := ldapHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     Options
+		username   string
+		password   string
+		failNet    bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - bind as user",
+			config:     Options{UserDN: "uid={username},ou=people,dc=ex"},
+			username:   "alice",
+			password:   "alice-secret",
+			expectPass: true,
+		},
+		{
+			name: "Success - search and bind",
+			config: Options{
+				Mode:         SearchAndBind,
+				BindDN:       "cn=svc,dc=example",
+				BindPassword: "svc-secret",
+				BaseDN:       "dc=ex",
+				UserFilter:   "(uid={username})",
+			},
+			username:   "alice",
+			password:   "alice-secret",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - wrong password",
+			config:     Options{UserDN: "uid={username},ou=people,dc=ex"},
+			username:   "alice",
+			password:   "wrong",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - empty password",
+			config:     Options{UserDN: "uid={username},ou=people,dc=ex"},
+			username:   "alice",
+			expectPass: false,
+		},
+		{
+			name: "Failure - search and bind unknown user",
+			config: Options{
+				Mode:         SearchAndBind,
+				BindDN:       "cn=svc,dc=example",
+				BindPassword: "svc-secret",
+				BaseDN:       "dc=ex",
+				UserFilter:   "(uid={username})",
+			},
+			username:   "bob",
+			password:   "bob-secret",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - filter injection is escaped",
+			config:     Options{Mode: SearchAndBind, BindDN: "cn=svc,dc=example", BindPassword: "svc-secret", BaseDN: "dc=ex", UserFilter: "(uid={username})"},
+			username:   "*",
+			password:   "alice-secret",
+			expectPass: false,
+		},
+		{
+			name:       "Error - connection failure",
+			config:     Options{UserDN: "uid={username},ou=people,dc=ex"},
+			username:   "alice",
+			password:   "alice-secret",
+			failNet:    true,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conn := newFakeConn()
+			conn.failNet = tt.failNet
+			tt.config.Dial = func() (Conn, error) { return conn, nil }
+
+			ldapHook := new(Hook)
+			ldapHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			require.NoError(t, ldapHook.Init(tt.config))
+
+			success, err := ldapHook.Authenticate(&mqtt.Client{ID: "client"}, packets.Packet{
+				Connect: packets.ConnectParams{
+					Username: []byte(tt.username),
+					Password: []byte(tt.password),
+				},
+			})
+			require.Equal(t, tt.expectPass, success)
+
+			// rejected credentials aren't failures of the directory
+			require.Equal(t, tt.failNet, err != nil)
+
+			// connections are only discarded after network errors
+			require.Equal(t, tt.failNet, conn.closed)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticateDialError(t *testing.T) {
+	ldapHook := new(Hook)
+	ldapHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, ldapHook.Init(Options{
+		UserDN: "uid={username},ou=people,dc=ex",
+		Dial:   func() (Conn, error) { return nil, errors.New("refused") },
+	}))
+
+	pk := packets.Packet{
+		Connect: packets.ConnectParams{Username: []byte("alice"), Password: []byte("alice-secret")},
+	}
+	require.False(t, ldapHook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, pk))
+
+	_, err := ldapHook.Authenticate(&mqtt.Client{ID: "client"}, pk)
+	require.Error(t, err)
+}
+
+func TestOnACLCheck(t *testing.T) {
+	dials := 0
+	ldapHook := new(Hook)
+	ldapHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, ldapHook.Init(Options{
+		UserDN:       "uid={username},ou=people,dc=ex",
+		BindDN:       "cn=svc,dc=example",
+		BindPassword: "svc-secret",
+		GroupBaseDN:  "ou=groups,dc=ex",
+		GroupFilter:  "(member={dn})",
+		ACL: acl.Templates{
+			"users/{username}/#": acl.ReadWrite,
+		},
+		GroupACL: map[string]acl.Templates{
+			"operators": {"commands/#": acl.WriteOnly},
+			"viewers":   {"telemetry/#": acl.ReadOnly},
+			"admins":    {"#": acl.ReadWrite},
+		},
+		Dial: func() (Conn, error) {
+			dials++
+			return newFakeConn(), nil
+		},
+	}))
+
+	cl := &mqtt.Client{ID: "client"}
+	for i := 0; i < 2; i++ {
+		require.True(t, ldapHook.OnConnectAuthenticate(cl, packets.Packet{
+			Connect: packets.ConnectParams{Username: []byte("alice"), Password: []byte("alice-secret")},
+		}))
+	}
+	require.Equal(t, 1, dials, "connection should be reused from the pool")
+
+	tests := []struct {
+		name       string
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - user template",
+			topic:      "users/alice/inbox",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - operators group publish",
+			topic:      "commands/device-1",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - viewers group subscribe",
+			topic:      "telemetry/#",
+			write:      false,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - viewers group publish",
+			topic:      "telemetry/device-1",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - not a member of admins",
+			topic:      "admin/settings",
+			write:      true,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, ldapHook.OnACLCheck(cl, tt.topic, tt.write))
+
+		})
+	}
+
+	ldapHook.OnDisconnect(cl, nil, true)
+	require.False(t, ldapHook.OnACLCheck(cl, "users/alice/inbox", true))
+	require.NoError(t, ldapHook.Stop())
+}
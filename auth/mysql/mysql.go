@@ -0,0 +1,164 @@
+package mysql
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/password"
+	"github.com/mochi-mqtt/hooks/pkg/sqlauth"
+)
+
+// TLSConfigKey is the name the TLSConfig is registered under and referenced by in the DSN
+const TLSConfigKey = "mochi-mqtt-auth"
+
+// DefaultQueries look up users in the tables
+//
+//	CREATE TABLE mqtt_users (
+//		username      VARCHAR(255) PRIMARY KEY,
+//		password_hash VARCHAR(255) NOT NULL,
+//		is_admin      BOOLEAN NOT NULL DEFAULT FALSE
+//	);
+//	CREATE TABLE mqtt_acls (
+//		username VARCHAR(255) NOT NULL,
+//		topic    VARCHAR(255) NOT NULL,
+//		rw       TINYINT NOT NULL, -- 0 deny, 1 read, 2 write, 3 read and write
+//		INDEX (username),
+//		FOREIGN KEY (username) REFERENCES mqtt_users (username) ON DELETE CASCADE
+//	);
+var DefaultQueries = sqlauth.Queries{
+	User:      "SELECT password_hash FROM mqtt_users WHERE username = ? LIMIT 1",
+	Superuser: "SELECT COUNT(*) FROM mqtt_users WHERE username = ? AND is_admin",
+	ACL:       "SELECT topic, rw FROM mqtt_acls WHERE username = ?",
+}
+
+// Hook is a hook that authenticates clients against users and ACL rules stored in MySQL or MariaDB
+type Hook struct {
+	config Options
+	sqlauth.Hook
+}
+
+// Options is a struct that contains all the information required to configure the mysql hook
+type Options struct {
+	// DSN is the data source name of the database, eg. mqtt:secret@tcp(localhost:3306)/mqtt. Driver is
+	// the registered database/sql driver it is opened with, defaults to "mysql", which is registered by
+	// importing github.com/go-sql-driver/mysql
+	DSN    string
+	Driver string
+
+	// TLSConfig secures the connections of a database opened from DSN. It is registered with
+	// RegisterTLSConfig, which is mysql.RegisterTLSConfig of the driver, and referenced in the DSN
+	TLSConfig         *tls.Config
+	RegisterTLSConfig func(key string, config *tls.Config) error
+
+	// DB is an open database used instead of DSN
+	DB *sql.DB
+
+	// MaxOpenConns, MaxIdleConns, ConnMaxLifetime and ConnMaxIdleTime tune the connection pool of a
+	// database opened from DSN, and are left at the database/sql defaults if zero. Keep them below the
+	// wait_timeout of the server, which closes idle connections
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	Queries sqlauth.Queries // defaults to DefaultQueries, each query is prepared once
+
+	// Schemes verify the password hashes, defaults to password.Default. Set a single scheme, eg.
+	// password.Schemes{password.Bcrypt{}}, to only accept hashes of that algorithm
+	Schemes password.Schemes
+
+	CacheTTL time.Duration // how long users are cached, users are not cached if it is zero
+	Timeout  time.Duration // how long a lookup may take, defaults to 5 seconds
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "mysql-auth-hook"
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	mysqlHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if mysqlHookConfig.DB == nil && mysqlHookConfig.DSN == "" {
+		return errors.New("dsn or db is required")
+	}
+
+	if mysqlHookConfig.TLSConfig != nil && mysqlHookConfig.RegisterTLSConfig == nil {
+		return errors.New("tls config requires a function to register it with the driver")
+	}
+
+	if mysqlHookConfig.Driver == "" {
+		mysqlHookConfig.Driver = "mysql"
+	}
+
+	if mysqlHookConfig.Queries.User == "" {
+		mysqlHookConfig.Queries = DefaultQueries
+	}
+
+	db := mysqlHookConfig.DB
+	if db == nil {
+		var err error
+		dsn := mysqlHookConfig.DSN
+		if mysqlHookConfig.TLSConfig != nil {
+			if dsn, err = withTLS(dsn); err != nil {
+				return err
+			}
+
+			if err = mysqlHookConfig.RegisterTLSConfig(TLSConfigKey, mysqlHookConfig.TLSConfig); err != nil {
+				return err
+			}
+		}
+
+		db, err = sql.Open(mysqlHookConfig.Driver, dsn)
+		if err != nil {
+			return err
+		}
+
+		db.SetMaxOpenConns(mysqlHookConfig.MaxOpenConns)
+		db.SetMaxIdleConns(mysqlHookConfig.MaxIdleConns)
+		db.SetConnMaxLifetime(mysqlHookConfig.ConnMaxLifetime)
+		db.SetConnMaxIdleTime(mysqlHookConfig.ConnMaxIdleTime)
+	}
+
+	err := h.Setup(sqlauth.Config{
+		DB:       db,
+		CloseDB:  mysqlHookConfig.DB == nil,
+		Queries:  mysqlHookConfig.Queries,
+		Schemes:  mysqlHookConfig.Schemes,
+		CacheTTL: mysqlHookConfig.CacheTTL,
+		Timeout:  mysqlHookConfig.Timeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.config = mysqlHookConfig
+	return nil
+}
+
+// withTLS adds the tls parameter referencing the registered TLS config to the DSN
+func withTLS(dsn string) (string, error) {
+	_, query, ok := strings.Cut(dsn, "?")
+	if !ok {
+		return dsn + "?tls=" + TLSConfigKey, nil
+	}
+
+	for _, param := range strings.Split(query, "&") {
+		if strings.HasPrefix(param, "tls=") {
+			return "", errors.New("dsn sets tls as well as the tls config")
+		}
+	}
+
+	return dsn + "&tls=" + TLSConfigKey, nil
+}
@@ -0,0 +1,264 @@
+package opa
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Actions passed to the policy as input.action
+const (
+	ActionConnect   = "connect"
+	ActionPublish   = "publish"
+	ActionSubscribe = "subscribe"
+)
+
+// Input is the document passed to the policy as input
+type Input struct {
+	Action string      `json:"action"`
+	Client ClientInput `json:"client"`
+	Topic  string      `json:"topic,omitempty"`
+}
+
+// ClientInput describes the client a decision is made for
+type ClientInput struct {
+	ID              string `json:"id"`
+	Username        string `json:"username"`
+	Password        string `json:"password,omitempty"`
+	Remote          string `json:"remote"`
+	Listener        string `json:"listener"`
+	ProtocolVersion byte   `json:"protocol_version"`
+	CleanSession    bool   `json:"clean_session"`
+}
+
+// Evaluator evaluates the decision at a policy path, eg. mqtt/acl/allow, for an input document.
+// HTTPEvaluator queries a remote OPA; an embedded engine can be used by wrapping a prepared rego query
+type Evaluator interface {
+	Evaluate(ctx context.Context, path string, input Input) (bool, error)
+}
+
+// HTTPEvaluator evaluates decisions with the Data API of a remote OPA server
+type HTTPEvaluator struct {
+	URL        *url.URL // base url of the OPA server, eg. http://localhost:8181
+	HTTPClient *http.Client
+}
+
+// Evaluate queries /v1/data/{path}. The decision is the result if it is a boolean, or its allow field
+// if it is an object. Undefined decisions deny
+func (e *HTTPEvaluator) Evaluate(ctx context.Context, path string, input Input) (bool, error) {
+	body, err := json.Marshal(map[string]Input{"input": input})
+	if err != nil {
+		return false, err
+	}
+
+	u := e.URL.JoinPath("v1", "data", strings.Trim(path, "/"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := e.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, fmt.Errorf("unexpected opa response status %d", resp.StatusCode)
+	}
+
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, err
+	}
+
+	return Decision(out.Result)
+}
+
+// Decision interprets a JSON policy result, which is either a boolean or an object with an allow field
+func Decision(result json.RawMessage) (bool, error) {
+	if len(result) == 0 {
+		return false, nil
+	}
+
+	var allow bool
+	if err := json.Unmarshal(result, &allow); err == nil {
+		return allow, nil
+	}
+
+	var object struct {
+		Allow bool `json:"allow"`
+	}
+	if err := json.Unmarshal(result, &object); err != nil {
+		return false, fmt.Errorf("unexpected policy result %s", result)
+	}
+
+	return object.Allow, nil
+}
+
+// Hook is a hook that delegates connect and topic access decisions to Open Policy Agent, so policy can
+// be managed centrally in Rego
+type Hook struct {
+	config    Options
+	evaluator Evaluator
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the OPA hook.
+// It is the responsibility of the configurer to pass a properly configured RoundTripper that takes
+// care of other requirements such as timeouts, retries, etc
+type Options struct {
+	// Evaluator makes the decisions. If nil, decisions are queried from the OPA server at URL
+	Evaluator    Evaluator
+	URL          *url.URL
+	RoundTripper http.RoundTripper
+
+	ConnectPath     string        // policy path of connect decisions, eg. mqtt/connect/allow
+	ACLPath         string        // policy path of publish and subscribe decisions, eg. mqtt/acl/allow
+	IncludePassword bool          // pass the client's password to connect decisions
+	Timeout         time.Duration // bounds each decision, defaults to 2 seconds
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "opa-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	switch b {
+	case mqtt.OnConnectAuthenticate:
+		return h.config.ConnectPath != ""
+	case mqtt.OnACLCheck:
+		return h.config.ACLPath != ""
+	}
+	return false
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	opaHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if opaHookConfig.ConnectPath == "" && opaHookConfig.ACLPath == "" {
+		return errors.New("a connect or acl policy path is required")
+	}
+
+	if opaHookConfig.Timeout <= 0 {
+		opaHookConfig.Timeout = 2 * time.Second
+	}
+
+	h.evaluator = opaHookConfig.Evaluator
+	if h.evaluator == nil {
+		if opaHookConfig.URL == nil {
+			return errors.New("an evaluator or opa url is required")
+		}
+
+		rt := opaHookConfig.RoundTripper
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+
+		h.evaluator = &HTTPEvaluator{
+			URL:        opaHookConfig.URL,
+			HTTPClient: &http.Client{Transport: rt},
+		}
+	}
+
+	h.config = opaHookConfig
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ok, err := h.Authenticate(cl, pk)
+	if err != nil {
+		h.Log.Error("error occurred while evaluating opa policy", "error", err, "path", h.config.ConnectPath)
+	}
+	return ok
+}
+
+// Authenticate authenticates the client, and returns an error if the policy couldn't be asked, rather
+// than rejecting the client, eg. so the composite hook falls back to its next backend
+func (h *Hook) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	input := Input{
+		Action: ActionConnect,
+		Client: clientInput(cl),
+	}
+
+	// the connect packet is the source of truth while the client is still connecting
+	input.Client.Username = string(pk.Connect.Username)
+	input.Client.CleanSession = pk.Connect.Clean
+	input.Client.ProtocolVersion = pk.ProtocolVersion
+	if h.config.IncludePassword {
+		input.Client.Password = string(pk.Connect.Password)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	allow, err := h.evaluator.Evaluate(ctx, h.config.ConnectPath, input)
+	if err != nil {
+		return false, err
+	}
+
+	return allow, nil
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	action := ActionSubscribe
+	if write {
+		action = ActionPublish
+	}
+
+	return h.evaluate(h.config.ACLPath, Input{
+		Action: action,
+		Client: clientInput(cl),
+		Topic:  topic,
+	})
+}
+
+func (h *Hook) evaluate(path string, input Input) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	allow, err := h.evaluator.Evaluate(ctx, path, input)
+	if err != nil {
+		h.Log.Error("error occurred while evaluating opa policy", "error", err, "path", path)
+		return false
+	}
+
+	return allow
+}
+
+func clientInput(cl *mqtt.Client) ClientInput {
+	return ClientInput{
+		ID:              cl.ID,
+		Username:        string(cl.Properties.Username),
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		CleanSession:    cl.Properties.Clean,
+	}
+}
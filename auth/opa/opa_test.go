@@ -0,0 +1,290 @@
+package opa
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	auth "github.com/mochi-mqtt/hooks/auth/http"
+)
+
+func jsonResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// evaluatorFunc adapts a function to an Evaluator, as an embedded rego query would be
+type evaluatorFunc func(ctx context.Context, path string, input Input) (bool, error)
+
+func (f evaluatorFunc) Evaluate(ctx context.Context, path string, input Input) (bool, error) {
+	return f(ctx, path, input)
+}
+
+func TestID(t *testing.T) {
+	opaHook := new(Hook)
+
+	require.Equal(t, "opa-auth-hook", opaHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	opaHook := new(Hook)
+	opaHook.config.ACLPath = "mqtt/acl/allow"
+	require.True(t, opaHook.Provides(mqtt.OnACLCheck))
+	require.False(t, opaHook.Provides(mqtt.OnConnectAuthenticate))
+
+	opaHook.config.ConnectPath = "mqtt/connect/allow"
+	require.True(t, opaHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, opaHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	opaHook := new(Hook)
+	opaHook.Log = slog.Default()
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - remote opa",
+			config:      Options{URL: stringToURL("http://localhost:8181"), ACLPath: "mqtt/acl/allow"},
+			expectError: false,
+		},
+		{
+			name: "Success - custom evaluator",
+			config: Options{
+				Evaluator:   evaluatorFunc(func(context.Context, string, Input) (bool, error) { return true, nil }),
+				ConnectPath: "mqtt/connect/allow",
+			},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no policy path",
+			config:      Options{URL: stringToURL("http://localhost:8181")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no url or evaluator",
+			config:      Options{ACLPath: "mqtt/acl/allow"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := opaHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockRT := auth.NewMockRoundTripper(ctrl)
+
+	tests := []struct {
+		name            string
+		includePassword bool
+		mocks           func()
+		expectPass      bool
+		expectError     bool
+	}{
+		{
+			name:       "Success - allowed",
+			expectPass: true,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					require.Equal(t, "http://opa:8181/v1/data/mqtt/connect/allow", req.URL.String())
+
+					var body map[string]Input
+					require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+					require.Equal(t, Input{
+						Action: ActionConnect,
+						Client: ClientInput{
+							ID:              "client",
+							Username:        "alice",
+							Remote:          "10.0.0.1:5555",
+							Listener:        "tcp1",
+							ProtocolVersion: 5,
+							CleanSession:    true,
+						},
+					}, body["input"])
+
+					return jsonResponse(http.StatusOK, `{"result":true}`), nil
+				})
+			},
+		},
+		{
+			name:            "Success - password included",
+			includePassword: true,
+			expectPass:      true,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					var body map[string]Input
+					require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+					require.Equal(t, "secret", body["input"].Client.Password)
+					return jsonResponse(http.StatusOK, `{"result":{"allow":true,"reason":"ok"}}`), nil
+				})
+			},
+		},
+		{
+			name:       "Failure - denied",
+			expectPass: false,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusOK, `{"result":false}`), nil)
+			},
+		},
+		{
+			name:       "Failure - undefined decision",
+			expectPass: false,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusOK, `{}`), nil)
+			},
+		},
+		{
+			name:        "Error - HTTP error",
+			expectPass:  false,
+			expectError: true,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(nil, errors.New("Oh Crap"))
+			},
+		},
+		{
+			name:        "Error - Non 2xx",
+			expectPass:  false,
+			expectError: true,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusInternalServerError, ``), nil)
+			},
+		},
+		{
+			name:        "Error - unexpected result",
+			expectPass:  false,
+			expectError: true,
+			mocks: func() {
+				mockRT.EXPECT().RoundTrip(gomock.Any()).Return(jsonResponse(http.StatusOK, `{"result":"yes"}`), nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mocks()
+
+			opaHook := new(Hook)
+			opaHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			require.NoError(t, opaHook.Init(Options{
+				URL:             stringToURL("http://opa:8181"),
+				RoundTripper:    mockRT,
+				ConnectPath:     "/mqtt/connect/allow",
+				IncludePassword: tt.includePassword,
+			}))
+
+			cl := &mqtt.Client{ID: "client"}
+			cl.Net.Remote = "10.0.0.1:5555"
+			cl.Net.Listener = "tcp1"
+
+			success, err := opaHook.Authenticate(cl, packets.Packet{
+				ProtocolVersion: 5,
+				Connect: packets.ConnectParams{
+					Username: []byte("alice"),
+					Password: []byte("secret"),
+					Clean:    true,
+				},
+			})
+			require.Equal(t, tt.expectPass, success)
+			require.Equal(t, tt.expectError, err != nil)
+		})
+	}
+}
+
+func TestOnACLCheck(t *testing.T) {
+	var inputs []Input
+	opaHook := new(Hook)
+	opaHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, opaHook.Init(Options{
+		ACLPath: "mqtt/acl/allow",
+		Evaluator: evaluatorFunc(func(ctx context.Context, path string, input Input) (bool, error) {
+			require.Equal(t, "mqtt/acl/allow", path)
+			inputs = append(inputs, input)
+			return input.Action == ActionSubscribe, nil
+		}),
+	}))
+
+	cl := &mqtt.Client{ID: "client"}
+	cl.Properties.Username = []byte("alice")
+
+	require.True(t, opaHook.OnACLCheck(cl, "a/b", false))
+	require.False(t, opaHook.OnACLCheck(cl, "a/b", true))
+	require.Equal(t, []Input{
+		{Action: ActionSubscribe, Client: ClientInput{ID: "client", Username: "alice"}, Topic: "a/b"},
+		{Action: ActionPublish, Client: ClientInput{ID: "client", Username: "alice"}, Topic: "a/b"},
+	}, inputs)
+}
+
+func TestDecision(t *testing.T) {
+	tests := []struct {
+		name        string
+		result      string
+		expectAllow bool
+		expectError bool
+	}{
+		{name: "Success - true", result: `true`, expectAllow: true},
+		{name: "Success - false", result: `false`, expectAllow: false},
+		{name: "Success - object", result: `{"allow":true}`, expectAllow: true},
+		{name: "Success - object without allow", result: `{"reason":"none"}`, expectAllow: false},
+		{name: "Success - undefined", result: ``, expectAllow: false},
+		{name: "Error - string", result: `"true"`, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			allow, err := Decision(json.RawMessage(tt.result))
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectAllow, allow)
+
+		})
+	}
+}
+
+func stringToURL(s string) *url.URL {
+	parsedURL, _ := url.Parse(s)
+	return parsedURL
+}
@@ -0,0 +1,306 @@
+package postgres
+
+import (
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/sqlauth"
+	"github.com/mochi-mqtt/hooks/pkg/sqlauth/sqlauthtest"
+)
+
+// newDriver returns a database with alice, an admin whose password is a bcrypt hash, bob, whose
+// password is a PBKDF2 hash, and carol, whose password is an argon2 hash. Their passwords are "password"
+func newDriver() *sqlauthtest.Driver {
+	return &sqlauthtest.Driver{
+		Queries: map[string]sqlauthtest.QueryFunc{
+			DefaultQueries.User: func(args []driver.Value) ([][]driver.Value, error) {
+				switch args[0] {
+				case "alice":
+					return [][]driver.Value{{"$2b$05$CCCCCCCCCCCCCCCCCCCCC.aDV7CQarKHMuNfh2oJkFzsHZya4whFe"}}, nil
+				case "bob":
+					return [][]driver.Value{{"$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA"}}, nil
+				case "carol":
+					return [][]driver.Value{{"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0"}}, nil
+				case "dave":
+					return [][]driver.Value{{"$scrypt$ln=16,r=8,p=1$c2FsdA$aGFzaA"}}, nil
+				case "error":
+					return nil, errors.New("connection reset")
+				}
+				return nil, nil
+			},
+			DefaultQueries.Superuser: func(args []driver.Value) ([][]driver.Value, error) {
+				if args[0] == "alice" {
+					return [][]driver.Value{{int64(1)}}, nil
+				}
+				return [][]driver.Value{{int64(0)}}, nil
+			},
+			DefaultQueries.ACL: func(args []driver.Value) ([][]driver.Value, error) {
+				return [][]driver.Value{
+					{"users/%u/#", int64(3)},
+					{"devices/%c/status", int64(2)},
+					{"public/#", int64(1)},
+				}, nil
+			},
+		},
+	}
+}
+
+func connectPacket(username, pass string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username: []byte(username),
+			Password: []byte(pass),
+		},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	postgresHook := new(Hook)
+	postgresHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, postgresHook.Init(options))
+	t.Cleanup(func() { postgresHook.Stop() })
+	return postgresHook
+}
+
+func TestID(t *testing.T) {
+	postgresHook := new(Hook)
+
+	require.Equal(t, "postgres-auth-hook", postgresHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	postgresHook := newHook(t, Options{DB: newDriver().DB()})
+	require.True(t, postgresHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, postgresHook.Provides(mqtt.OnACLCheck))
+	require.True(t, postgresHook.Provides(mqtt.OnDisconnect))
+	require.False(t, postgresHook.Provides(mqtt.OnPublish))
+
+	postgresHook = newHook(t, Options{DB: newDriver().DB(), Queries: sqlauth.Queries{User: DefaultQueries.User}})
+	require.True(t, postgresHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, postgresHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - db",
+			config:      Options{DB: newDriver().DB()},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no dsn or db",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unregistered driver",
+			config:      Options{DSN: "postgres://localhost/mqtt"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid query",
+			config:      Options{DB: newDriver().DB(), Queries: sqlauth.Queries{User: "SELECT nonsense"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			postgresHook := new(Hook)
+			postgresHook.Log = slog.Default()
+			err := postgresHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, DefaultQueries, postgresHook.config.Queries)
+			require.NoError(t, postgresHook.Stop())
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	d := newDriver()
+	postgresHook := newHook(t, Options{DB: d.DB()})
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		expectPass bool
+	}{
+		{
+			name:       "Success - bcrypt",
+			username:   "alice",
+			password:   "password",
+			expectPass: true,
+		},
+		{
+			name:       "Success - pbkdf2",
+			username:   "bob",
+			password:   "password",
+			expectPass: true,
+		},
+		{
+			name:       "Success - argon2",
+			username:   "carol",
+			password:   "password",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - wrong password",
+			username:   "bob",
+			password:   "passw0rd",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unknown user",
+			username:   "mallory",
+			password:   "password",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - no username",
+			username:   "",
+			password:   "password",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unsupported hash",
+			username:   "dave",
+			password:   "password",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - database error",
+			username:   "error",
+			password:   "password",
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &mqtt.Client{ID: "device-1"}
+			require.Equal(t, tt.expectPass, postgresHook.OnConnectAuthenticate(cl, connectPacket(tt.username, tt.password)))
+
+		})
+	}
+
+	// statements are prepared once
+	require.Equal(t, 1, d.Prepared(DefaultQueries.User))
+
+	// failures of the database are reported apart from rejections
+	_, err := postgresHook.Authenticate(&mqtt.Client{ID: "device-1"}, connectPacket("error", "password"))
+	require.Error(t, err)
+	_, err = postgresHook.Authenticate(&mqtt.Client{ID: "device-1"}, connectPacket("mallory", "password"))
+	require.NoError(t, err)
+}
+
+func TestOnACLCheck(t *testing.T) {
+	postgresHook := newHook(t, Options{DB: newDriver().DB()})
+
+	alice := &mqtt.Client{ID: "alice-laptop"}
+	require.True(t, postgresHook.OnConnectAuthenticate(alice, connectPacket("alice", "password")))
+	bob := &mqtt.Client{ID: "device-1"}
+	require.True(t, postgresHook.OnConnectAuthenticate(bob, connectPacket("bob", "password")))
+
+	tests := []struct {
+		name       string
+		client     *mqtt.Client
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - superuser",
+			client:     alice,
+			topic:      "users/bob/inbox",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - superuser $SYS",
+			client:     alice,
+			topic:      "$SYS/broker/clients/connected",
+			expectPass: true,
+		},
+		{
+			name:       "Success - username substitution",
+			client:     bob,
+			topic:      "users/bob/inbox",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - client id substitution",
+			client:     bob,
+			topic:      "devices/device-1/status",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - read rule",
+			client:     bob,
+			topic:      "public/news",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - read only rule",
+			client:     bob,
+			topic:      "public/news",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - write only rule",
+			client:     bob,
+			topic:      "devices/device-1/status",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - another user",
+			client:     bob,
+			topic:      "users/alice/inbox",
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, postgresHook.OnACLCheck(tt.client, tt.topic, tt.write))
+
+		})
+	}
+
+	postgresHook.OnDisconnect(bob, nil, true)
+	require.False(t, postgresHook.OnACLCheck(bob, "public/news", false))
+}
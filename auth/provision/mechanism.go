@@ -0,0 +1,72 @@
+package provision
+
+import (
+	"encoding/json"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+
+	"github.com/mochi-mqtt/hooks/auth/enhanced"
+)
+
+// Method is the default name of the authentication method of the Mechanism
+const Method = "provision"
+
+// Mechanism is an enhanced authentication mechanism for the enhanced hook, which provisions MQTT 5
+// clients presenting a claim token as their authentication data, and sends them the JSON of their
+// credentials as the authentication data of the CONNACK
+type Mechanism struct {
+	Method      string        // the name of the authentication method, defaults to Method
+	Provisioner Provisioner   // required
+	Timeout     time.Duration // bounds the calls to the provisioner, defaults to 10 seconds
+}
+
+// Name returns the name of the authentication method
+func (m *Mechanism) Name() string {
+	if m.Method == "" {
+		return Method
+	}
+	return m.Method
+}
+
+// Start begins provisioning the client
+func (m *Mechanism) Start(cl *mqtt.Client) enhanced.Conversation {
+	return &conversation{mechanism: m, cl: cl}
+}
+
+// conversation provisions a client in a single step
+type conversation struct {
+	mechanism *Mechanism
+	cl        *mqtt.Client
+	device    Device
+}
+
+// Step provisions the device with the claim token in the data, and returns its credentials
+func (c *conversation) Step(data []byte) ([]byte, bool, error) {
+	if len(data) == 0 {
+		return nil, false, ErrDenied
+	}
+
+	timeout := c.mechanism.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	device, err := provision(c.mechanism.Provisioner, timeout, c.cl, string(data))
+	if err != nil {
+		return nil, false, err
+	}
+
+	credentials, err := json.Marshal(device)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.device = device
+	return credentials, true, nil
+}
+
+// Username returns the username of the provisioned device
+func (c *conversation) Username() string {
+	return c.device.Username
+}
@@ -0,0 +1,86 @@
+package provision
+
+import (
+	"encoding/json"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/auth/enhanced"
+)
+
+func TestMechanismName(t *testing.T) {
+	require.Equal(t, Method, new(Mechanism).Name())
+	require.Equal(t, "claim", (&Mechanism{Method: "claim"}).Name())
+}
+
+func TestMechanism(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expectError error
+	}{
+		{
+			name: "Success",
+			data: "claim-1",
+		},
+		{
+			name:        "Failure - no token",
+			data:        "",
+			expectError: ErrDenied,
+		},
+		{
+			name:        "Failure - denied",
+			data:        "claim-2",
+			expectError: ErrDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			conversation := (&Mechanism{Provisioner: claims}).Start(&mqtt.Client{ID: "c1"})
+			response, done, err := conversation.Step([]byte(tt.data))
+			if tt.expectError != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				require.False(t, done)
+				require.Empty(t, conversation.Username())
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, done)
+			require.Equal(t, "device-1", conversation.Username())
+
+			var device Device
+			require.NoError(t, json.Unmarshal(response, &device))
+			require.Equal(t, "secret", device.Password)
+
+		})
+	}
+}
+
+func TestMechanismEnhancedHook(t *testing.T) {
+	enhancedHook := new(enhanced.Hook)
+	require.NoError(t, enhancedHook.Init(enhanced.Options{
+		Mechanisms:  []enhanced.Mechanism{&Mechanism{Provisioner: claims}},
+		SetUsername: true,
+	}))
+
+	cl := &mqtt.Client{ID: "c1"}
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Props.AuthenticationMethod = Method
+	require.True(t, enhancedHook.OnConnectAuthenticate(cl, packets.Packet{
+		Properties: packets.Properties{AuthenticationMethod: Method, AuthenticationData: []byte("claim-1")},
+	}))
+	require.Equal(t, []byte("device-1"), cl.Properties.Username)
+
+	// the credentials are sent with the connack
+	ack := enhancedHook.OnPacketEncode(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Connack}})
+	require.Equal(t, Method, ack.Properties.AuthenticationMethod)
+
+	var device Device
+	require.NoError(t, json.Unmarshal(ack.Properties.AuthenticationData, &device))
+	require.Equal(t, "d1", device.ID)
+}
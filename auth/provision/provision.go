@@ -0,0 +1,234 @@
+// Package provision provides a hook which provisions unknown devices connecting with a claim token
+// for zero-touch onboarding. The identity of the device is created by a Provisioner, eg. a
+// provisioning API, and the device is admitted and sent its credentials on a provisioning topic, or
+// with the CONNACK of an MQTT 5 enhanced authentication exchange with the Mechanism.
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// Stats are the totals of the provisioning attempts since the hook was initialized
+type Stats struct {
+	Provisioned int64 // the number of devices provisioned
+	Denied      int64 // the number of claim tokens the provisioner refused
+	Failed      int64 // the number of attempts which failed, eg. as the provisioner was unavailable
+	Delivered   int64 // the number of credentials sent on the provisioning topic
+}
+
+// Hook is a hook that admits clients connecting with the bootstrap username and a claim token as their
+// password once their devices are provisioned, and sends them their credentials when they subscribe to
+// the provisioning topic
+type Hook struct {
+	config   Options
+	sessions map[*mqtt.Client]*session // the connections of provisioned devices
+	stats    Stats
+	mu       sync.Mutex
+	mqtt.HookBase
+}
+
+// session is the connection of a provisioned device
+type session struct {
+	device    Device
+	delivered bool
+}
+
+// Options is a struct that contains all the information required to configure the provision hook
+type Options struct {
+	// Provisioner creates the identities of the devices. Required
+	Provisioner Provisioner
+
+	// Username is the bootstrap username clients connect with to be provisioned, with the claim token
+	// as their password, and defaults to "$provision"
+	Username string
+
+	// Topic is the topic provisioned clients subscribe to for the JSON of their credentials, which is
+	// sent only to them, and the only topic this hook allows them to subscribe to until they reconnect
+	// with their credentials. As the server allows a topic when any hook does, other auth hooks must not
+	// allow the bootstrap username if it is to be the only one. It defaults to "$provision/credentials"
+	Topic string
+
+	// Timeout bounds the calls to the provisioner, and defaults to 10 seconds
+	Timeout time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "provision-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnACLCheck,
+		mqtt.OnSubscribed,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	provisionHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if provisionHookConfig.Provisioner == nil {
+		return errors.New("provisioner is required")
+	}
+
+	if provisionHookConfig.Username == "" {
+		provisionHookConfig.Username = "$provision"
+	}
+
+	if provisionHookConfig.Topic == "" {
+		provisionHookConfig.Topic = "$provision/credentials"
+	}
+
+	if !mqtt.IsValidFilter(provisionHookConfig.Topic, true) {
+		return errors.New("invalid provisioning topic")
+	}
+
+	if provisionHookConfig.Timeout <= 0 {
+		provisionHookConfig.Timeout = 10 * time.Second
+	}
+
+	h.config = provisionHookConfig
+	h.sessions = make(map[*mqtt.Client]*session)
+	return nil
+}
+
+// Stats returns the totals of the provisioning attempts so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update(&h.stats)
+}
+
+// provision provisions the device of the client presenting the token
+func provision(p Provisioner, timeout time.Duration, cl *mqtt.Client, token string) (Device, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return p.Provision(ctx, Request{
+		ClientID: cl.ID,
+		Token:    token,
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	})
+}
+
+// OnConnectAuthenticate is called when a client connects, and admits clients connecting with the
+// bootstrap username whose devices are provisioned. Other clients are left to other auth hooks
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	if string(pk.Connect.Username) != h.config.Username || len(pk.Connect.Password) == 0 {
+		return false
+	}
+
+	device, err := provision(h.config.Provisioner, h.config.Timeout, cl, string(pk.Connect.Password))
+	if errors.Is(err, ErrDenied) {
+		h.Log.Info("claim token denied", "client", cl.ID, "remote", cl.Net.Remote)
+		h.count(func(s *Stats) { s.Denied++ })
+		return false
+	}
+
+	if err != nil {
+		h.Log.Error("error occurred while provisioning device", "error", err, "client", cl.ID)
+		h.count(func(s *Stats) { s.Failed++ })
+		return false
+	}
+
+	h.Log.Info("device provisioned", "client", cl.ID, "device", device.ID)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sessions[cl] = &session{device: device}
+	h.stats.Provisioned++
+	return true
+}
+
+// OnACLCheck is called when a client publishes or subscribes to a topic, and allows provisioned
+// clients to subscribe to the provisioning topic. Other topics are left to other auth hooks
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	h.mu.Lock()
+	_, ok := h.sessions[cl]
+	h.mu.Unlock()
+
+	return ok && !write && topic == h.config.Topic
+}
+
+// OnSubscribed is called when a client has subscribed, and sends provisioned clients subscribing to
+// the provisioning topic their credentials, once
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	subscribed := false
+	for i, sub := range pk.Filters {
+		if i < len(reasonCodes) && reasonCodes[i] < packets.ErrUnspecifiedError.Code && acl.Match(sub.Filter, h.config.Topic) {
+			subscribed = true
+		}
+	}
+
+	if !subscribed {
+		return
+	}
+
+	h.mu.Lock()
+	s, ok := h.sessions[cl]
+	if !ok || s.delivered {
+		h.mu.Unlock()
+		return
+	}
+	s.delivered = true
+	device := s.device
+	h.mu.Unlock()
+
+	payload, err := json.Marshal(device)
+	if err != nil {
+		h.Log.Error("error occurred while encoding credentials", "error", err, "client", cl.ID)
+		return
+	}
+
+	credentials := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   h.config.Topic,
+		Payload:     payload,
+	}
+	if cl.Properties.ProtocolVersion == 5 {
+		credentials.Properties.ContentType = "application/json"
+	}
+
+	if err := cl.WritePacket(credentials); err != nil {
+		h.Log.Error("error occurred while sending credentials", "error", err, "client", cl.ID, "device", device.ID)
+		return
+	}
+
+	h.count(func(s *Stats) { s.Delivered++ })
+}
+
+// OnDisconnect is called when a client disconnects, and forgets its provisioned device
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sessions, cl)
+}
@@ -0,0 +1,240 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// provisionerFunc is a function which is a Provisioner
+type provisionerFunc func(ctx context.Context, req Request) (Device, error)
+
+func (f provisionerFunc) Provision(ctx context.Context, req Request) (Device, error) {
+	return f(ctx, req)
+}
+
+// claims provisions the devices with the claim tokens "claim-1", refuses other tokens and fails for
+// "unavailable"
+var claims = provisionerFunc(func(ctx context.Context, req Request) (Device, error) {
+	switch req.Token {
+	case "claim-1":
+		return Device{ID: "d1", ClientID: req.ClientID, Username: "device-1", Password: "secret"}, nil
+	case "unavailable":
+		return Device{}, errors.New("unavailable")
+	}
+	return Device{}, ErrDenied
+})
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	provisionHook := new(Hook)
+	provisionHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, provisionHook.Init(options))
+	return provisionHook
+}
+
+// newPair returns the server side of a connection and a peer reading what it is sent
+func newPair(t *testing.T, version byte) (*mqtt.Client, *mqtt.Client) {
+	t.Helper()
+
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	s := mqtt.New(nil)
+	cl := s.NewClient(r, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = version
+	peer := s.NewClient(w, "tcp", "peer", false)
+	peer.Properties.ProtocolVersion = version
+
+	return cl, peer
+}
+
+func connect(username, password string) packets.Packet {
+	return packets.Packet{Connect: packets.ConnectParams{Username: []byte(username), Password: []byte(password)}}
+}
+
+func subscribe(filters ...string) packets.Packet {
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Subscribe}}
+	for _, filter := range filters {
+		pk.Filters = append(pk.Filters, packets.Subscription{Filter: filter})
+	}
+	return pk
+}
+
+func TestID(t *testing.T) {
+	provisionHook := new(Hook)
+
+	require.Equal(t, "provision-auth-hook", provisionHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	provisionHook := new(Hook)
+	require.True(t, provisionHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, provisionHook.Provides(mqtt.OnACLCheck))
+	require.True(t, provisionHook.Provides(mqtt.OnSubscribed))
+	require.True(t, provisionHook.Provides(mqtt.OnDisconnect))
+	require.False(t, provisionHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Provisioner: claims},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no provisioner",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid topic",
+			config:      Options{Provisioner: claims, Topic: "$provision/+"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			provisionHook := new(Hook)
+			provisionHook.Log = slog.Default()
+			err := provisionHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "$provision", provisionHook.config.Username)
+			require.Equal(t, "$provision/credentials", provisionHook.config.Topic)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	provisionHook := newHook(t, Options{Provisioner: claims})
+
+	tests := []struct {
+		name       string
+		connect    packets.Packet
+		expectPass bool
+	}{
+		{
+			name:       "Success - provisioned",
+			connect:    connect("$provision", "claim-1"),
+			expectPass: true,
+		},
+		{
+			name:       "Failure - other username",
+			connect:    connect("device-1", "claim-1"),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - no token",
+			connect:    connect("$provision", ""),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - denied",
+			connect:    connect("$provision", "claim-2"),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unavailable",
+			connect:    connect("$provision", "unavailable"),
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &mqtt.Client{ID: "c1"}
+			require.Equal(t, tt.expectPass, provisionHook.OnConnectAuthenticate(cl, tt.connect))
+
+		})
+	}
+
+	require.Equal(t, Stats{Provisioned: 1, Denied: 1, Failed: 1}, provisionHook.Stats())
+}
+
+func TestOnACLCheck(t *testing.T) {
+	provisionHook := newHook(t, Options{Provisioner: claims})
+
+	cl := &mqtt.Client{ID: "c1"}
+	require.False(t, provisionHook.OnACLCheck(cl, "$provision/credentials", false))
+
+	require.True(t, provisionHook.OnConnectAuthenticate(cl, connect("$provision", "claim-1")))
+	require.True(t, provisionHook.OnACLCheck(cl, "$provision/credentials", false))
+	require.False(t, provisionHook.OnACLCheck(cl, "$provision/credentials", true))
+	require.False(t, provisionHook.OnACLCheck(cl, "devices/d1/telemetry", false))
+
+	provisionHook.OnDisconnect(cl, nil, false)
+	require.False(t, provisionHook.OnACLCheck(cl, "$provision/credentials", false))
+}
+
+func TestOnSubscribed(t *testing.T) {
+	for _, version := range []byte{4, 5} {
+		provisionHook := newHook(t, Options{Provisioner: claims})
+		cl, peer := newPair(t, version)
+
+		// clients which weren't provisioned are sent nothing
+		provisionHook.OnSubscribed(cl, subscribe("$provision/credentials"), []byte{0})
+
+		require.True(t, provisionHook.OnConnectAuthenticate(cl, connect("$provision", "claim-1")))
+		provisionHook.OnSubscribed(cl, subscribe("$provision/credentials"), []byte{packets.ErrNotAuthorized.Code})
+		provisionHook.OnSubscribed(cl, subscribe("devices/#"), []byte{0})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			provisionHook.OnSubscribed(cl, subscribe("a/b", "$provision/+"), []byte{0, 1})
+		}()
+
+		fh := new(packets.FixedHeader)
+		require.NoError(t, peer.ReadFixedHeader(fh))
+		pk, err := peer.ReadPacket(fh)
+		require.NoError(t, err)
+		require.Equal(t, "$provision/credentials", pk.TopicName)
+		if version == 5 {
+			require.Equal(t, "application/json", pk.Properties.ContentType)
+		}
+
+		var device Device
+		require.NoError(t, json.Unmarshal(pk.Payload, &device))
+		require.Equal(t, Device{ID: "d1", ClientID: "c1", Username: "device-1", Password: "secret"}, device)
+
+		// credentials are sent once
+		<-done
+		provisionHook.OnSubscribed(cl, subscribe("$provision/credentials"), []byte{0})
+		require.Equal(t, int64(1), provisionHook.Stats().Delivered)
+	}
+}
@@ -0,0 +1,93 @@
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrDenied is returned by a Provisioner which refuses the claim token, eg. as it is unknown or was
+// already used
+var ErrDenied = errors.New("claim token denied")
+
+// Request is a request to provision a device
+type Request struct {
+	ClientID string `json:"client_id"`
+	Token    string `json:"token"` // the claim token or bootstrap credential presented by the client
+	Remote   string `json:"remote,omitempty"`
+	Listener string `json:"listener,omitempty"`
+}
+
+// Device is the identity created for a provisioned device, and the credentials it is sent
+type Device struct {
+	ID       string `json:"device_id"`
+	ClientID string `json:"client_id,omitempty"` // the client id to connect with from then on, if it should change
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Provisioner creates the identities of devices presenting claim tokens, returning ErrDenied for
+// tokens it refuses
+type Provisioner interface {
+	Provision(ctx context.Context, req Request) (Device, error)
+}
+
+// HTTP is a Provisioner which posts the JSON of requests to a provisioning API, which responds with
+// the JSON of the device with a 2XX status, or refuses the token with 401, 403, 404 or 409
+type HTTP struct {
+	URL    string
+	Header http.Header  // added to each request, eg. for the API key of the broker
+	Client *http.Client // defaults to http.DefaultClient
+}
+
+// Provision posts the request to the provisioning API
+func (p *HTTP) Provision(ctx context.Context, req Request) (Device, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Device{}, err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return Device{}, err
+	}
+
+	for key, values := range p.Header {
+		r.Header[key] = values
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(r)
+	if err != nil {
+		return Device{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden,
+		resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusConflict:
+		return Device{}, ErrDenied
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return Device{}, fmt.Errorf("provisioning api responded with status %d", resp.StatusCode)
+	}
+
+	var device Device
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&device); err != nil {
+		return Device{}, fmt.Errorf("invalid provisioning api response: %w", err)
+	}
+
+	if device.ID == "" {
+		return Device{}, errors.New("provisioning api responded without a device id")
+	}
+
+	return device, nil
+}
@@ -0,0 +1,96 @@
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		expect      Device
+		expectError error
+	}{
+		{
+			name:   "Success",
+			status: http.StatusCreated,
+			body:   `{"device_id": "d1", "client_id": "device-1", "username": "device-1", "password": "secret"}`,
+			expect: Device{ID: "d1", ClientID: "device-1", Username: "device-1", Password: "secret"},
+		},
+		{
+			name:        "Failure - denied",
+			status:      http.StatusForbidden,
+			expectError: ErrDenied,
+		},
+		{
+			name:        "Failure - token used",
+			status:      http.StatusConflict,
+			expectError: ErrDenied,
+		},
+		{
+			name:   "Failure - unavailable",
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name:   "Failure - invalid response",
+			status: http.StatusOK,
+			body:   `{"device_id":`,
+		},
+		{
+			name:   "Failure - no device id",
+			status: http.StatusOK,
+			body:   `{"username": "device-1"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, http.MethodPost, r.Method)
+				require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				require.Equal(t, "key", r.Header.Get("X-Api-Key"))
+
+				var req Request
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+				require.Equal(t, Request{ClientID: "c1", Token: "claim-1", Listener: "tcp"}, req)
+
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			p := &HTTP{URL: server.URL, Header: http.Header{"X-Api-Key": []string{"key"}}}
+			device, err := p.Provision(context.Background(), Request{ClientID: "c1", Token: "claim-1", Listener: "tcp"})
+			if tt.expectError != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				return
+			}
+			if tt.expect.ID == "" {
+				require.Error(t, err)
+				require.NotErrorIs(t, err, ErrDenied)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, device)
+
+		})
+	}
+}
+
+func TestHTTPUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	p := &HTTP{URL: server.URL}
+	_, err := p.Provision(context.Background(), Request{ClientID: "c1", Token: "claim-1"})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrDenied)
+}
@@ -0,0 +1,24 @@
+package redis
+
+import (
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// The client is shared with the other Redis hooks, and aliased here for compatibility
+type (
+	Client        = redisclient.Client
+	ClientOptions = redisclient.ClientOptions
+	Mode          = redisclient.Mode
+	Error         = redisclient.Error
+)
+
+const (
+	Single   = redisclient.Single
+	Cluster  = redisclient.Cluster
+	Sentinel = redisclient.Sentinel
+)
+
+// NewClient returns a client for the servers. Connections are established when commands are run
+func NewClient(opts ClientOptions) (Client, error) {
+	return redisclient.NewClient(opts)
+}
@@ -0,0 +1,276 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/password"
+)
+
+// placeholders translates the mosquitto style substitutions to acl template placeholders
+var placeholders = strings.NewReplacer("%c", "{clientid}", "%u", "{username}")
+
+// DefaultKeys is the layout of the Redis backend of mosquitto-go-auth
+var DefaultKeys = Keys{
+	User:         "{username}",
+	Superuser:    "{username}:su",
+	ReadACL:      []string{"{username}:racls", "common:racls"},
+	WriteACL:     []string{"{username}:wacls", "common:wacls"},
+	ReadWriteACL: []string{"{username}:rwacls", "common:rwacls"},
+}
+
+// Keys are the patterns of the keys holding a user's password and rules, in which {username} is
+// replaced by the username. Empty patterns are not looked up
+type Keys struct {
+	User      string // a string holding the password hash, eg. mqtt:user:{username}
+	Superuser string // a string which is "true" if the user may access every topic
+
+	// sets of topic filters the user may read, write, or read and write. Filters may contain %u or
+	// {username} and %c or {clientid}
+	ReadACL      []string
+	WriteACL     []string
+	ReadWriteACL []string
+
+	// hashes mapping topic filters to their access, such as "r", "w", "rw" or "deny", eg. mqtt:acl:{username}
+	ACL []string
+}
+
+// Hook is a hook that authenticates clients against users and ACL rules stored in Redis
+type Hook struct {
+	config   Options
+	client   Client
+	sessions acl.Sessions
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the redis hook
+type Options struct {
+	ClientOptions // how to connect to the server, cluster or sentinels
+
+	// Client is used instead of connecting with the ClientOptions, eg. to use another Redis client library
+	Client Client
+
+	Keys    Keys             // defaults to DefaultKeys
+	Schemes password.Schemes // verify the password hashes, defaults to password.Default
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "redis-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	redisHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if redisHookConfig.Keys.User == "" {
+		redisHookConfig.Keys = DefaultKeys
+	}
+
+	if redisHookConfig.Schemes == nil {
+		redisHookConfig.Schemes = password.Default
+	}
+
+	if redisHookConfig.Timeout <= 0 {
+		redisHookConfig.Timeout = 5 * time.Second
+	}
+
+	client := redisHookConfig.Client
+	if client == nil {
+		var err error
+		if client, err = NewClient(redisHookConfig.ClientOptions); err != nil {
+			return err
+		}
+	}
+
+	h.config = redisHookConfig
+	h.client = client
+	return nil
+}
+
+// Stop closes the connections of the client
+func (h *Hook) Stop() error {
+	if h.client == nil {
+		return nil
+	}
+	return h.client.Close()
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ok, err := h.Authenticate(cl, pk)
+	if err != nil {
+		h.Log.Error("error occurred while authenticating client", "error", err, "username", string(pk.Connect.Username))
+	}
+	return ok
+}
+
+// Authenticate authenticates the client, and returns an error if redis couldn't be asked, rather
+// than rejecting the client, eg. so the composite hook falls back to its next backend
+func (h *Hook) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	username := string(pk.Connect.Username)
+	if username == "" {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	hash, err := h.get(ctx, h.key(h.config.Keys.User, username))
+	if err != nil {
+		return false, fmt.Errorf("failed looking up user: %w", err)
+	}
+
+	if hash == "" {
+		return false, nil
+	}
+
+	match, err := h.config.Schemes.Verify(hash, string(pk.Connect.Password))
+	if err != nil {
+		// a hash which can't be verified is a rejection rather than a failure of the backend
+		h.Log.Error("error occurred while verifying password", "error", err, "username", username)
+		return false, nil
+	}
+
+	if !match {
+		return false, nil
+	}
+
+	filters, err := h.filters(ctx, username, cl.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed looking up acl: %w", err)
+	}
+
+	h.sessions.Set(cl, filters)
+	return true, nil
+}
+
+// filters looks up and renders the rules of the user
+func (h *Hook) filters(ctx context.Context, username, clientID string) (acl.Filters, error) {
+	if h.config.Keys.Superuser != "" {
+		su, err := h.get(ctx, h.key(h.config.Keys.Superuser, username))
+		if err != nil {
+			return nil, err
+		}
+
+		if su == "true" {
+			return acl.Filters{"#": acl.ReadWrite}, nil
+		}
+	}
+
+	values := map[string]string{
+		"clientid": clientID,
+		"username": username,
+	}
+
+	filters := make(acl.Filters)
+	for access, keys := range map[acl.Access][]string{
+		acl.ReadOnly:  h.config.Keys.ReadACL,
+		acl.WriteOnly: h.config.Keys.WriteACL,
+		acl.ReadWrite: h.config.Keys.ReadWriteACL,
+	} {
+		for _, key := range keys {
+			members, err := h.strings(ctx, "SMEMBERS", h.key(key, username))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, member := range members {
+				filters.Merge(acl.Templates{placeholders.Replace(member): access}.Render(values))
+			}
+		}
+	}
+
+	for _, key := range h.config.Keys.ACL {
+		fields, err := h.strings(ctx, "HGETALL", h.key(key, username))
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i+1 < len(fields); i += 2 {
+			access, err := acl.ParseAccess(fields[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", fields[i], err)
+			}
+			filters.Merge(acl.Templates{placeholders.Replace(fields[i]): access}.Render(values))
+		}
+	}
+
+	return filters, nil
+}
+
+// key replaces {username} in the pattern
+func (h *Hook) key(pattern, username string) string {
+	return strings.ReplaceAll(pattern, "{username}", username)
+}
+
+// get returns the value of a string key, or an empty string if it does not exist
+func (h *Hook) get(ctx context.Context, key string) (string, error) {
+	reply, err := h.client.Do(ctx, "GET", key)
+	if err != nil || reply == nil {
+		return "", err
+	}
+
+	s, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected reply to GET %s", key)
+	}
+	return s, nil
+}
+
+// strings runs a command replying with an array of strings
+func (h *Hook) strings(ctx context.Context, command, key string) ([]string, error) {
+	reply, err := h.client.Do(ctx, command, key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to %s %s", command, key)
+	}
+
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected reply to %s %s", command, key)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
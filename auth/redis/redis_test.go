@@ -0,0 +1,297 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+const testHash = "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA"
+
+// fakeClient answers GET, SMEMBERS and HGETALL from memory
+type fakeClient struct {
+	strings map[string]string
+	sets    map[string][]string
+	hashes  map[string]map[string]string
+	err     error
+	closed  bool
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		strings: map[string]string{
+			"alice":    testHash,
+			"admin":    testHash,
+			"admin:su": "true",
+		},
+		sets: map[string][]string{
+			"alice:racls":  {"users/%u/#"},
+			"alice:wacls":  {"devices/%c/status"},
+			"alice:rwacls": {"chat/{username}"},
+			"common:racls": {"public/#"},
+		},
+		hashes: map[string]map[string]string{},
+	}
+}
+
+func (c *fakeClient) Do(ctx context.Context, args ...any) (any, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	key := args[1].(string)
+	switch args[0] {
+	case "GET":
+		if v, ok := c.strings[key]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "SMEMBERS":
+		out := []any{}
+		for _, v := range c.sets[key] {
+			out = append(out, v)
+		}
+		return out, nil
+	case "HGETALL":
+		var fields []string
+		for f := range c.hashes[key] {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+
+		out := []any{}
+		for _, f := range fields {
+			out = append(out, f, c.hashes[key][f])
+		}
+		return out, nil
+	}
+	return nil, Error("ERR unknown command")
+}
+
+func (c *fakeClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+func connectPacket(username, pass string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username: []byte(username),
+			Password: []byte(pass),
+		},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	redisHook := new(Hook)
+	redisHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, redisHook.Init(options))
+	t.Cleanup(func() { redisHook.Stop() })
+	return redisHook
+}
+
+func TestID(t *testing.T) {
+	redisHook := new(Hook)
+
+	require.Equal(t, "redis-auth-hook", redisHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	redisHook := newHook(t, Options{Client: newFakeClient()})
+	require.True(t, redisHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, redisHook.Provides(mqtt.OnACLCheck))
+	require.True(t, redisHook.Provides(mqtt.OnDisconnect))
+	require.False(t, redisHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - client",
+			config:      Options{Client: newFakeClient()},
+			expectError: false,
+		},
+		{
+			name:        "Success - addresses",
+			config:      Options{ClientOptions: ClientOptions{Addrs: []string{"localhost:6379"}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no addresses",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - sentinel without master",
+			config:      Options{ClientOptions: ClientOptions{Addrs: []string{"localhost:26379"}, Mode: Sentinel}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			redisHook := new(Hook)
+			redisHook.Log = slog.Default()
+			err := redisHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, DefaultKeys, redisHook.config.Keys)
+			require.NoError(t, redisHook.Stop())
+
+		})
+	}
+}
+
+func TestStop(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client})
+	require.NoError(t, redisHook.Stop())
+	require.True(t, client.closed)
+
+	require.NoError(t, new(Hook).Stop())
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	client := newFakeClient()
+	client.strings["mallory"] = "plaintext"
+	redisHook := newHook(t, Options{Client: client})
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		expectPass bool
+	}{
+		{
+			name:       "Success - valid password",
+			username:   "alice",
+			password:   "password",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - wrong password",
+			username:   "alice",
+			password:   "passw0rd",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unknown user",
+			username:   "bob",
+			password:   "password",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - no username",
+			username:   "",
+			password:   "password",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unsupported hash",
+			username:   "mallory",
+			password:   "plaintext",
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &mqtt.Client{ID: "device-1"}
+			require.Equal(t, tt.expectPass, redisHook.OnConnectAuthenticate(cl, connectPacket(tt.username, tt.password)))
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticateError(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client})
+
+	client.err = errors.New("connection refused")
+	require.False(t, redisHook.OnConnectAuthenticate(&mqtt.Client{ID: "device-1"}, connectPacket("alice", "password")))
+	_, err := redisHook.Authenticate(&mqtt.Client{ID: "device-1"}, connectPacket("alice", "password"))
+	require.Error(t, err)
+
+	// invalid access in a rule
+	client.err = nil
+	client.hashes["acl:alice"] = map[string]string{"sensors/#": "sometimes"}
+	redisHook = newHook(t, Options{Client: client, Keys: Keys{User: "{username}", ACL: []string{"acl:{username}"}}})
+	require.False(t, redisHook.OnConnectAuthenticate(&mqtt.Client{ID: "device-1"}, connectPacket("alice", "password")))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	redisHook := newHook(t, Options{Client: newFakeClient()})
+
+	alice := &mqtt.Client{ID: "device-1"}
+	require.True(t, redisHook.OnConnectAuthenticate(alice, connectPacket("alice", "password")))
+
+	require.True(t, redisHook.OnACLCheck(alice, "users/alice/inbox", false))
+	require.False(t, redisHook.OnACLCheck(alice, "users/alice/inbox", true))
+	require.True(t, redisHook.OnACLCheck(alice, "devices/device-1/status", true))
+	require.False(t, redisHook.OnACLCheck(alice, "devices/device-1/status", false))
+	require.True(t, redisHook.OnACLCheck(alice, "chat/alice", true))
+	require.True(t, redisHook.OnACLCheck(alice, "public/news", false))
+	require.False(t, redisHook.OnACLCheck(alice, "users/bob/inbox", false))
+
+	admin := &mqtt.Client{ID: "console"}
+	require.True(t, redisHook.OnConnectAuthenticate(admin, connectPacket("admin", "password")))
+	require.True(t, redisHook.OnACLCheck(admin, "users/bob/inbox", true))
+
+	redisHook.OnDisconnect(alice, nil, true)
+	require.False(t, redisHook.OnACLCheck(alice, "users/alice/inbox", false))
+}
+
+func TestCustomKeys(t *testing.T) {
+	client := newFakeClient()
+	client.strings["mqtt:user:bob"] = testHash
+	client.hashes["mqtt:acl:bob"] = map[string]string{
+		"sensors/%c/#":   "rw",
+		"sensors/+/cmd":  "w",
+		"sensors/secret": "deny",
+	}
+
+	redisHook := newHook(t, Options{
+		Client: client,
+		Keys: Keys{
+			User: "mqtt:user:{username}",
+			ACL:  []string{"mqtt:acl:{username}"},
+		},
+	})
+
+	require.False(t, redisHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("alice", "password")))
+
+	bob := &mqtt.Client{ID: "sensor-1"}
+	require.True(t, redisHook.OnConnectAuthenticate(bob, connectPacket("bob", "password")))
+	require.True(t, redisHook.OnACLCheck(bob, "sensors/sensor-1/temperature", true))
+	require.True(t, redisHook.OnACLCheck(bob, "sensors/sensor-2/cmd", true))
+	require.False(t, redisHook.OnACLCheck(bob, "sensors/sensor-2/cmd", false))
+	require.False(t, redisHook.OnACLCheck(bob, "sensors/secret", false))
+}
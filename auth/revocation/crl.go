@@ -0,0 +1,92 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"time"
+)
+
+// CRL is a parsed certificate revocation list
+type CRL struct {
+	rawIssuer      []byte
+	authorityKeyID []byte
+	revoked        map[string]time.Time // serial number -> revocation time
+	nextUpdate     time.Time
+}
+
+// LoadCRL reads a PEM or DER encoded CRL from the file and, if issuer is not nil, verifies it was
+// signed by the issuer
+func LoadCRL(path string, issuer *x509.Certificate) (*CRL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseCRL(data, issuer)
+}
+
+// ParseCRL parses a PEM or DER encoded CRL and, if issuer is not nil, verifies it was signed by the issuer
+func ParseCRL(data []byte, issuer *x509.Certificate) (*CRL, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, errors.New("unexpected pem block " + block.Type)
+		}
+		data = block.Bytes
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if issuer != nil {
+		if err := list.CheckSignatureFrom(issuer); err != nil {
+			return nil, err
+		}
+	}
+
+	crl := &CRL{
+		rawIssuer:      list.RawIssuer,
+		authorityKeyID: list.AuthorityKeyId,
+		revoked:        make(map[string]time.Time, len(list.RevokedCertificateEntries)),
+		nextUpdate:     list.NextUpdate,
+	}
+
+	for _, entry := range list.RevokedCertificateEntries {
+		crl.revoked[entry.SerialNumber.String()] = entry.RevocationTime
+	}
+
+	return crl, nil
+}
+
+// Covers returns whether the CRL was issued by the issuer of the certificate. The authority key
+// identifiers are compared when both are present, as issuer names need not be unique
+func (c *CRL) Covers(cert *x509.Certificate) bool {
+	if !bytes.Equal(c.rawIssuer, cert.RawIssuer) {
+		return false
+	}
+
+	if len(c.authorityKeyID) > 0 && len(cert.AuthorityKeyId) > 0 {
+		return bytes.Equal(c.authorityKeyID, cert.AuthorityKeyId)
+	}
+
+	return true
+}
+
+// Revoked returns whether the certificate is listed in the CRL
+func (c *CRL) Revoked(cert *x509.Certificate) bool {
+	if !c.Covers(cert) {
+		return false
+	}
+
+	_, ok := c.revoked[cert.SerialNumber.String()]
+	return ok
+}
+
+// NextUpdate returns when the issuer will publish the next CRL, or zero if unknown
+func (c *CRL) NextUpdate() time.Time {
+	return c.nextUpdate
+}
@@ -0,0 +1,123 @@
+package revocation
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// crl creates a DER encoded CRL signed by the CA listing the serial numbers
+func (p *testPKI) crl(t *testing.T, number int64, serials ...int64) []byte {
+	t.Helper()
+
+	var entries []x509.RevocationListEntry
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Hour),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(number),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, p.ca, p.caKey)
+	require.NoError(t, err)
+
+	return der
+}
+
+func TestParseCRL(t *testing.T) {
+	p := newTestPKI(t)
+	der := p.crl(t, 1, 1001)
+
+	tests := []struct {
+		name          string
+		data          []byte
+		issuer        *x509.Certificate
+		expectRevoked bool
+		expectError   bool
+	}{
+		{
+			name:          "Success - der",
+			data:          der,
+			expectRevoked: true,
+		},
+		{
+			name:          "Success - pem verified by issuer",
+			data:          pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}),
+			issuer:        p.ca,
+			expectRevoked: true,
+		},
+		{
+			name:          "Success - not revoked",
+			data:          p.crl(t, 2, 5),
+			expectRevoked: false,
+		},
+		{
+			name:        "Failure - signed by another issuer",
+			data:        der,
+			issuer:      p.responder,
+			expectError: true,
+		},
+		{
+			name:        "Failure - wrong pem block",
+			data:        pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.ca.Raw}),
+			expectError: true,
+		},
+		{
+			name:        "Failure - malformed",
+			data:        []byte("not a crl"),
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			crl, err := ParseCRL(tt.data, tt.issuer)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, crl.Covers(p.leaf))
+			require.Equal(t, tt.expectRevoked, crl.Revoked(p.leaf))
+			require.False(t, crl.NextUpdate().IsZero())
+
+		})
+	}
+}
+
+func TestCRLOtherIssuer(t *testing.T) {
+	p := newTestPKI(t)
+	other := newTestPKI(t)
+
+	// the serial matches, but the certificate was issued by another ca
+	crl, err := ParseCRL(other.crl(t, 1, 1001), nil)
+	require.NoError(t, err)
+	require.False(t, crl.Covers(p.leaf))
+	require.False(t, crl.Revoked(p.leaf))
+}
+
+func TestLoadCRL(t *testing.T) {
+	p := newTestPKI(t)
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	require.NoError(t, os.WriteFile(path, p.crl(t, 1, 1001), 0600))
+
+	crl, err := LoadCRL(path, p.ca)
+	require.NoError(t, err)
+	require.True(t, crl.Revoked(p.leaf))
+
+	_, err = LoadCRL(filepath.Join(t.TempDir(), "missing.crl"), nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,285 @@
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Status is the revocation status of a certificate
+type Status byte
+
+const (
+	Good    Status = iota // the certificate is not revoked
+	Revoked               // the certificate is revoked
+	Unknown               // the responder does not know the certificate
+)
+
+var (
+	// ErrMalformedResponse indicates an OCSP response could not be decoded
+	ErrMalformedResponse = errors.New("malformed ocsp response")
+
+	// ErrResponseNotSuccessful indicates the OCSP responder returned an error status, eg. tryLater
+	ErrResponseNotSuccessful = errors.New("ocsp response not successful")
+
+	// ErrNoMatchingResponse indicates the OCSP response does not cover the certificate
+	ErrNoMatchingResponse = errors.New("ocsp response does not match certificate")
+
+	// ErrResponderNotAuthorized indicates the OCSP response was signed by a certificate which is neither
+	// the issuer nor a responder delegated by it
+	ErrResponderNotAuthorized = errors.New("ocsp responder not authorized")
+)
+
+var (
+	oidSHA1            = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidBasicResponse   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	signatureAlgorithm = map[string]x509.SignatureAlgorithm{
+		"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+		"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+		"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+		"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+		"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+		"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+		"1.3.101.112":           x509.PureEd25519,
+	}
+)
+
+// The ASN.1 structures of RFC 6960, limited to what is needed to check a single certificate
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type tbsRequest struct {
+	Version     int `asn1:"explicit,tag:0,default:0,optional"`
+	RequestList []singleRequest
+}
+
+type singleRequest struct {
+	Cert certID
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []singleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type singleResponse struct {
+	CertID           certID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          revokedInfo      `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// OCSPResult is the verified status of a single certificate
+type OCSPResult struct {
+	Status     Status
+	RevokedAt  time.Time
+	ThisUpdate time.Time
+	NextUpdate time.Time // zero if the responder always has newer information
+}
+
+// newCertID returns the SHA-1 CertID identifying the certificate to the responder
+func newCertID(cert, issuer *x509.Certificate) (certID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return certID{}, err
+	}
+
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return certID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  cert.SerialNumber,
+	}, nil
+}
+
+// matches compares CertIDs, ignoring the encoding of the hash algorithm parameters
+func (id certID) matches(other certID) bool {
+	return id.HashAlgorithm.Algorithm.Equal(other.HashAlgorithm.Algorithm) &&
+		bytes.Equal(id.NameHash, other.NameHash) &&
+		bytes.Equal(id.IssuerKeyHash, other.IssuerKeyHash) &&
+		id.SerialNumber.Cmp(other.SerialNumber) == 0
+}
+
+// CreateOCSPRequest returns a DER encoded OCSP request for the certificate
+func CreateOCSPRequest(cert, issuer *x509.Certificate) ([]byte, error) {
+	id, err := newCertID(cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ocspRequest{
+		TBSRequest: tbsRequest{RequestList: []singleRequest{{Cert: id}}},
+	})
+}
+
+// ParseOCSPResponse decodes a DER encoded OCSP response for the certificate and verifies it was signed
+// by the issuer, or by a responder certificate the issuer delegated OCSP signing to
+func ParseOCSPResponse(der []byte, cert, issuer *x509.Certificate) (OCSPResult, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(der, &resp); err != nil || len(rest) > 0 {
+		return OCSPResult{}, ErrMalformedResponse
+	}
+
+	if resp.Status != 0 {
+		return OCSPResult{}, fmt.Errorf("%w: status %d", ErrResponseNotSuccessful, resp.Status)
+	}
+
+	if !resp.Response.ResponseType.Equal(oidBasicResponse) {
+		return OCSPResult{}, ErrMalformedResponse
+	}
+
+	var basic basicResponse
+	if rest, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil || len(rest) > 0 {
+		return OCSPResult{}, ErrMalformedResponse
+	}
+
+	if err := basic.verify(issuer); err != nil {
+		return OCSPResult{}, err
+	}
+
+	id, err := newCertID(cert, issuer)
+	if err != nil {
+		return OCSPResult{}, err
+	}
+
+	for _, single := range basic.TBSResponseData.Responses {
+		if !id.matches(single.CertID) {
+			continue
+		}
+
+		result := OCSPResult{
+			Status:     Unknown,
+			ThisUpdate: single.ThisUpdate,
+			NextUpdate: single.NextUpdate,
+		}
+
+		switch {
+		case bool(single.Good):
+			result.Status = Good
+		case !single.Revoked.RevocationTime.IsZero():
+			result.Status = Revoked
+			result.RevokedAt = single.Revoked.RevocationTime
+		}
+
+		return result, nil
+	}
+
+	return OCSPResult{}, ErrNoMatchingResponse
+}
+
+// verify checks the response signature against the issuer or a delegated responder
+func (b basicResponse) verify(issuer *x509.Certificate) error {
+	algorithm, ok := signatureAlgorithm[b.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("unsupported ocsp signature algorithm %s", b.SignatureAlgorithm.Algorithm)
+	}
+
+	signer := issuer
+	if len(b.Certificates) > 0 {
+		responder, err := x509.ParseCertificate(b.Certificates[0].FullBytes)
+		if err != nil {
+			return ErrMalformedResponse
+		}
+
+		if !responder.Equal(issuer) {
+			if err := responder.CheckSignatureFrom(issuer); err != nil {
+				return ErrResponderNotAuthorized
+			}
+
+			delegated := false
+			for _, usage := range responder.ExtKeyUsage {
+				delegated = delegated || usage == x509.ExtKeyUsageOCSPSigning
+			}
+			if !delegated {
+				return ErrResponderNotAuthorized
+			}
+			signer = responder
+		}
+	}
+
+	return signer.CheckSignature(algorithm, b.TBSResponseData.Raw, b.Signature.RightAlign())
+}
+
+// queryOCSP posts an OCSP request for the certificate to the responder
+func queryOCSP(ctx context.Context, client *http.Client, responder string, cert, issuer *x509.Certificate) (OCSPResult, error) {
+	body, err := CreateOCSPRequest(cert, issuer)
+	if err != nil {
+		return OCSPResult{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responder, bytes.NewReader(body))
+	if err != nil {
+		return OCSPResult{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return OCSPResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return OCSPResult{}, fmt.Errorf("unexpected ocsp response status %d", resp.StatusCode)
+	}
+
+	der, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return OCSPResult{}, err
+	}
+
+	return ParseOCSPResponse(der, cert, issuer)
+}
@@ -0,0 +1,243 @@
+package revocation
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+// testPKI is a CA with a client certificate and a delegated OCSP responder
+type testPKI struct {
+	ca           *x509.Certificate
+	caKey        *ecdsa.PrivateKey
+	leaf         *x509.Certificate
+	leafKey      *ecdsa.PrivateKey
+	responder    *x509.Certificate
+	responderKey *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	p := new(testPKI)
+	p.ca, p.caKey = newCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+
+	p.leaf, p.leafKey = newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1001),
+		Subject:      pkix.Name{CommonName: "device-1"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		OCSPServer:   []string{"http://ocsp.example.com"},
+	}, p.ca, p.caKey)
+
+	p.responder, p.responderKey = newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test ocsp responder"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, p.ca, p.caKey)
+
+	return p
+}
+
+// newCert creates a certificate from the template, self-signed if parent is nil
+func newCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+// ocspResponse creates a DER encoded OCSP response for the certificate signed by the signer, which is
+// included in the response if it is not the issuer
+func (p *testPKI) ocspResponse(t *testing.T, cert *x509.Certificate, status Status, nextUpdate time.Time, signer *x509.Certificate, signerKey crypto.Signer) []byte {
+	t.Helper()
+
+	id, err := newCertID(cert, p.ca)
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	single := singleResponse{CertID: id, ThisUpdate: now.Add(-time.Minute), NextUpdate: nextUpdate}
+	switch status {
+	case Good:
+		single.Good = true
+	case Revoked:
+		single.Revoked = revokedInfo{RevocationTime: now.Add(-time.Hour)}
+	default:
+		single.Unknown = true
+	}
+
+	keyHash, err := asn1.Marshal(id.IssuerKeyHash)
+	require.NoError(t, err)
+
+	tbs, err := asn1.Marshal(responseData{
+		RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHash},
+		ProducedAt:     now,
+		Responses:      []singleResponse{single},
+	})
+	require.NoError(t, err)
+
+	digest := sha256.Sum256(tbs)
+	sig, err := signerKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+
+	basic := basicResponse{
+		TBSResponseData:    responseData{Raw: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+		Signature:          asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	}
+	if !signer.Equal(p.ca) {
+		basic.Certificates = []asn1.RawValue{{FullBytes: signer.Raw}}
+	}
+
+	basicDER, err := asn1.Marshal(basic)
+	require.NoError(t, err)
+
+	der, err := asn1.Marshal(ocspResponse{
+		Response: responseBytes{ResponseType: oidBasicResponse, Response: basicDER},
+	})
+	require.NoError(t, err)
+
+	return der
+}
+
+func TestCreateOCSPRequest(t *testing.T) {
+	p := newTestPKI(t)
+
+	der, err := CreateOCSPRequest(p.leaf, p.ca)
+	require.NoError(t, err)
+
+	var req ocspRequest
+	rest, err := asn1.Unmarshal(der, &req)
+	require.NoError(t, err)
+	require.Empty(t, rest)
+	require.Len(t, req.TBSRequest.RequestList, 1)
+
+	id := req.TBSRequest.RequestList[0].Cert
+	require.True(t, id.HashAlgorithm.Algorithm.Equal(oidSHA1))
+	require.Equal(t, int64(1001), id.SerialNumber.Int64())
+	require.Len(t, id.NameHash, 20)
+	require.Len(t, id.IssuerKeyHash, 20)
+}
+
+func TestParseOCSPResponse(t *testing.T) {
+	p := newTestPKI(t)
+	other, otherKey := newCert(t, &x509.Certificate{SerialNumber: big.NewInt(9), Subject: pkix.Name{CommonName: "other"}}, nil, nil)
+	undelegated, undelegatedKey := newCert(t, &x509.Certificate{SerialNumber: big.NewInt(10), Subject: pkix.Name{CommonName: "undelegated"}}, p.ca, p.caKey)
+	nextUpdate := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name         string
+		der          func() []byte
+		expectStatus Status
+		expectError  error
+	}{
+		{
+			name:         "Success - good signed by issuer",
+			der:          func() []byte { return p.ocspResponse(t, p.leaf, Good, nextUpdate, p.ca, p.caKey) },
+			expectStatus: Good,
+		},
+		{
+			name:         "Success - revoked signed by delegated responder",
+			der:          func() []byte { return p.ocspResponse(t, p.leaf, Revoked, nextUpdate, p.responder, p.responderKey) },
+			expectStatus: Revoked,
+		},
+		{
+			name:         "Success - unknown",
+			der:          func() []byte { return p.ocspResponse(t, p.leaf, Unknown, time.Time{}, p.ca, p.caKey) },
+			expectStatus: Unknown,
+		},
+		{
+			name:        "Failure - responder not delegated",
+			der:         func() []byte { return p.ocspResponse(t, p.leaf, Good, nextUpdate, undelegated, undelegatedKey) },
+			expectError: ErrResponderNotAuthorized,
+		},
+		{
+			name:        "Failure - responder of another ca",
+			der:         func() []byte { return p.ocspResponse(t, p.leaf, Good, nextUpdate, other, otherKey) },
+			expectError: ErrResponderNotAuthorized,
+		},
+		{
+			name:        "Failure - other certificate",
+			der:         func() []byte { return p.ocspResponse(t, p.responder, Good, nextUpdate, p.ca, p.caKey) },
+			expectError: ErrNoMatchingResponse,
+		},
+		{
+			name: "Failure - try later",
+			der: func() []byte {
+				der, _ := asn1.Marshal(ocspResponse{Status: 3})
+				return der
+			},
+			expectError: ErrResponseNotSuccessful,
+		},
+		{
+			name:        "Failure - malformed",
+			der:         func() []byte { return []byte{0x30, 0x01} },
+			expectError: ErrMalformedResponse,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			result, err := ParseOCSPResponse(tt.der(), p.leaf, p.ca)
+			if tt.expectError != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectStatus, result.Status)
+
+		})
+	}
+}
+
+func TestParseOCSPResponseBadSignature(t *testing.T) {
+	p := newTestPKI(t)
+
+	// signed with a key which does not belong to the issuer
+	der := p.ocspResponse(t, p.leaf, Good, time.Time{}, p.ca, p.leafKey)
+	_, err := ParseOCSPResponse(der, p.leaf, p.ca)
+	require.Error(t, err)
+}
+
+func TestParseOCSPResponseNextUpdate(t *testing.T) {
+	p := newTestPKI(t)
+	nextUpdate := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+
+	result, err := ParseOCSPResponse(p.ocspResponse(t, p.leaf, Good, nextUpdate, p.ca, p.caKey), p.leaf, p.ca)
+	require.NoError(t, err)
+	require.True(t, nextUpdate.Equal(result.NextUpdate))
+	require.False(t, result.ThisUpdate.IsZero())
+}
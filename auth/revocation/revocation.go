@@ -0,0 +1,357 @@
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// errRevoked indicates a client certificate was found to be revoked
+var errRevoked = errors.New("certificate revoked")
+
+// Hook is a hook that rejects clients on mTLS listeners whose certificate has been revoked, checked
+// via OCSP and/or a CRL file, and disconnects connected clients once their certificate is revoked
+type Hook struct {
+	config     Options
+	httpClient *http.Client
+	crl        *CRL
+	cache      *cache.Cache[string, OCSPResult] // the ocsp status of recently checked certificates
+	clients    map[*mqtt.Client]chain
+	cancel     context.CancelFunc
+	mu         sync.RWMutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the revocation hook.
+// It is the responsibility of the configurer to pass a properly configured RoundTripper that takes
+// care of other requirements such as proxies, etc
+type Options struct {
+	Server *mqtt.Server // required, used to disconnect clients whose certificate is revoked
+
+	// OCSP enables checking certificates with the OCSP responder named in the certificate, or with
+	// OCSPResponder if set. Responses are cached until their nextUpdate, or for CacheTTL if the responder
+	// does not set one
+	OCSP          bool
+	OCSPResponder string
+	RoundTripper  http.RoundTripper
+	Timeout       time.Duration // bounds each OCSP request, defaults to 5 seconds
+	CacheTTL      time.Duration // defaults to 1 hour
+
+	// CRLFile is the path of a PEM or DER encoded CRL, reloaded every CRLRefreshInterval. If CRLIssuer
+	// is set, the CRL must be signed by it
+	CRLFile            string
+	CRLIssuer          *x509.Certificate
+	CRLRefreshInterval time.Duration // defaults to 5 minutes
+
+	// Issuers are used to find the issuer of client certificates when the TLS config does not verify
+	// chains and the client does not send its intermediate
+	Issuers []*x509.Certificate
+
+	// RecheckInterval is how often the certificates of connected clients are checked again, defaults to
+	// 1 hour. Clients are also checked whenever the CRL changes
+	RecheckInterval time.Duration
+
+	// SoftFail allows clients whose status cannot be determined, eg. because the responder is down
+	SoftFail bool
+}
+
+// chain is the client certificate and its issuer
+type chain struct {
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "revocation-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	revocationHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if revocationHookConfig.Server == nil {
+		return errors.New("nil server")
+	}
+
+	if !revocationHookConfig.OCSP && revocationHookConfig.CRLFile == "" {
+		return errors.New("ocsp or a crl file is required")
+	}
+
+	if revocationHookConfig.Timeout <= 0 {
+		revocationHookConfig.Timeout = 5 * time.Second
+	}
+
+	if revocationHookConfig.CacheTTL <= 0 {
+		revocationHookConfig.CacheTTL = time.Hour
+	}
+
+	if revocationHookConfig.CRLRefreshInterval <= 0 {
+		revocationHookConfig.CRLRefreshInterval = 5 * time.Minute
+	}
+
+	if revocationHookConfig.RecheckInterval <= 0 {
+		revocationHookConfig.RecheckInterval = time.Hour
+	}
+
+	rt := revocationHookConfig.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	h.config = revocationHookConfig
+	h.httpClient = &http.Client{Transport: rt}
+	h.cache = cache.New[string, OCSPResult](cache.Options{})
+	h.clients = make(map[*mqtt.Client]chain)
+
+	if revocationHookConfig.CRLFile != "" {
+		crl, err := LoadCRL(revocationHookConfig.CRLFile, revocationHookConfig.CRLIssuer)
+		if err != nil {
+			return err
+		}
+		h.crl = crl
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go h.run(ctx)
+
+	return nil
+}
+
+// Stop stops refreshing the CRL and rechecking connected clients
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// run reloads the CRL and rechecks connected clients until the context is cancelled
+func (h *Hook) run(ctx context.Context) {
+	recheck := time.NewTicker(h.config.RecheckInterval)
+	defer recheck.Stop()
+
+	var reload <-chan time.Time
+	if h.config.CRLFile != "" {
+		ticker := time.NewTicker(h.config.CRLRefreshInterval)
+		defer ticker.Stop()
+		reload = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-recheck.C:
+			h.Recheck()
+		case <-reload:
+			if h.ReloadCRL() {
+				h.Recheck()
+			}
+		}
+	}
+}
+
+// ReloadCRL reads the CRL file again and returns whether it could be loaded
+func (h *Hook) ReloadCRL() bool {
+	crl, err := LoadCRL(h.config.CRLFile, h.config.CRLIssuer)
+	if err != nil {
+		h.Log.Error("error occurred while reloading crl", "error", err)
+		return false
+	}
+
+	h.mu.Lock()
+	h.crl = crl
+	h.mu.Unlock()
+	return true
+}
+
+// Recheck checks the certificates of all connected clients and disconnects those which were revoked
+func (h *Hook) Recheck() {
+	h.mu.RLock()
+	clients := make(map[*mqtt.Client]chain, len(h.clients))
+	for cl, c := range h.clients {
+		clients[cl] = c
+	}
+	h.mu.RUnlock()
+
+	for cl, c := range clients {
+		if err := h.check(c); errors.Is(err, errRevoked) {
+			h.Log.Info("disconnecting client with revoked certificate", "client", cl.ID, "serial", c.leaf.SerialNumber.String())
+			if err := h.config.Server.DisconnectClient(cl, packets.ErrAdministrativeAction); err != nil {
+				h.Log.Error("error occurred while disconnecting client", "error", err, "client", cl.ID)
+			}
+		}
+	}
+}
+
+// OnConnect rejects clients presenting a revoked certificate. Clients without a certificate are left
+// to the TLS configuration of the listener
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	c, ok := h.chainOf(cl)
+	if !ok {
+		return nil
+	}
+
+	err := h.check(c)
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, errRevoked) {
+		h.Log.Info("rejecting client with revoked certificate", "client", cl.ID, "serial", c.leaf.SerialNumber.String())
+		return packets.ErrNotAuthorized
+	}
+
+	h.Log.Error("error occurred while checking certificate revocation", "error", err, "client", cl.ID)
+	if h.config.SoftFail {
+		return nil
+	}
+	return packets.ErrNotAuthorized
+}
+
+// OnSessionEstablished starts tracking the client's certificate for rechecks
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	c, ok := h.chainOf(cl)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	h.clients[cl] = c
+	h.mu.Unlock()
+}
+
+// OnDisconnect stops tracking the client's certificate
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	delete(h.clients, cl)
+	h.mu.Unlock()
+}
+
+// chainOf returns the client certificate and its issuer, preferring the chain verified by the TLS handshake
+func (h *Hook) chainOf(cl *mqtt.Client) (chain, bool) {
+	conn, ok := cl.Net.Conn.(*tls.Conn)
+	if !ok {
+		return chain{}, false
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 1 {
+		return chain{leaf: state.VerifiedChains[0][0], issuer: state.VerifiedChains[0][1]}, true
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return chain{}, false
+	}
+
+	c := chain{leaf: state.PeerCertificates[0]}
+	if len(state.PeerCertificates) > 1 {
+		c.issuer = state.PeerCertificates[1]
+	}
+
+	for _, issuer := range h.config.Issuers {
+		if c.issuer == nil && bytes.Equal(issuer.RawSubject, c.leaf.RawIssuer) {
+			c.issuer = issuer
+		}
+	}
+
+	return c, true
+}
+
+// check returns errRevoked if the certificate is revoked, or an error if its status could not be determined
+func (h *Hook) check(c chain) error {
+	h.mu.RLock()
+	crl := h.crl
+	h.mu.RUnlock()
+
+	if crl != nil && crl.Revoked(c.leaf) {
+		return errRevoked
+	}
+
+	if !h.config.OCSP {
+		return nil
+	}
+
+	result, err := h.ocsp(c)
+	if err != nil {
+		return err
+	}
+
+	switch result.Status {
+	case Revoked:
+		return errRevoked
+	case Unknown:
+		return errors.New("ocsp status unknown")
+	}
+
+	return nil
+}
+
+// ocsp returns the OCSP status of the certificate, from the cache if possible
+func (h *Hook) ocsp(c chain) (OCSPResult, error) {
+	if c.issuer == nil {
+		return OCSPResult{}, errors.New("issuer of client certificate not found")
+	}
+
+	responder := h.config.OCSPResponder
+	if responder == "" {
+		if len(c.leaf.OCSPServer) == 0 {
+			return OCSPResult{}, errors.New("client certificate has no ocsp responder")
+		}
+		responder = c.leaf.OCSPServer[0]
+	}
+
+	key := string(c.leaf.RawIssuer) + "/" + c.leaf.SerialNumber.String()
+	now := time.Now()
+
+	if result, ok := h.cache.Get(key); ok {
+		return result, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	result, err := queryOCSP(ctx, h.httpClient, responder, c.leaf, c.issuer)
+	if err != nil {
+		return OCSPResult{}, err
+	}
+
+	expires := now.Add(h.config.CacheTTL)
+	if !result.NextUpdate.IsZero() && result.NextUpdate.Before(expires) {
+		expires = result.NextUpdate
+	}
+
+	if expires.After(now) {
+		h.cache.SetTTL(key, result, expires.Sub(now))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,309 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// responder answers OCSP requests for the test pki and counts them
+type responder struct {
+	t        *testing.T
+	pki      *testPKI
+	status   atomic.Int32
+	requests atomic.Int32
+	fail     atomic.Bool
+}
+
+func (r *responder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.requests.Add(1)
+	if r.fail.Load() {
+		return nil, errors.New("connection refused")
+	}
+
+	require.Equal(r.t, "http://ocsp.example.com", req.URL.String())
+	require.Equal(r.t, "application/ocsp-request", req.Header.Get("Content-Type"))
+
+	der := r.pki.ocspResponse(r.t, r.pki.leaf, Status(r.status.Load()), time.Now().Add(time.Hour), r.pki.responder, r.pki.responderKey)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(der)),
+	}, nil
+}
+
+// tlsClient returns a server side mTLS connection on which the client presented the leaf certificate
+func tlsClient(t *testing.T, p *testPKI) net.Conn {
+	t.Helper()
+
+	serverCert, serverKey := newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "broker"},
+		DNSNames:     []string{"broker"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, p.ca, p.caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca)
+
+	r, w := net.Pipe()
+	server := tls.Server(r, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	client := tls.Client(w, &tls.Config{
+		ServerName:   "broker",
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{p.leaf.Raw}, PrivateKey: p.leafKey}},
+	})
+
+	go func() {
+		if client.Handshake() == nil {
+			io.Copy(io.Discard, client)
+		}
+	}()
+	require.NoError(t, server.Handshake())
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	return server
+}
+
+func newClient(t *testing.T, s *mqtt.Server, conn net.Conn) *mqtt.Client {
+	cl := s.NewClient(conn, "tls", "device-1", false)
+	cl.Properties.ProtocolVersion = 5
+	return cl
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	revocationHook := new(Hook)
+	revocationHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, revocationHook.Init(options))
+	t.Cleanup(func() { revocationHook.Stop() })
+	return revocationHook
+}
+
+func TestID(t *testing.T) {
+	revocationHook := new(Hook)
+
+	require.Equal(t, "revocation-hook", revocationHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	revocationHook := new(Hook)
+	require.True(t, revocationHook.Provides(mqtt.OnConnect))
+	require.True(t, revocationHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, revocationHook.Provides(mqtt.OnDisconnect))
+	require.False(t, revocationHook.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInit(t *testing.T) {
+	p := newTestPKI(t)
+	crlFile := filepath.Join(t.TempDir(), "ca.crl")
+	require.NoError(t, os.WriteFile(crlFile, p.crl(t, 1), 0600))
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - ocsp",
+			config:      Options{Server: mqtt.New(nil), OCSP: true},
+			expectError: false,
+		},
+		{
+			name:        "Success - crl",
+			config:      Options{Server: mqtt.New(nil), CRLFile: crlFile, CRLIssuer: p.ca},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - nil server",
+			config:      Options{OCSP: true},
+			expectError: true,
+		},
+		{
+			name:        "Failure - nothing to check",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing crl file",
+			config:      Options{Server: mqtt.New(nil), CRLFile: filepath.Join(t.TempDir(), "missing.crl")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - crl signed by another issuer",
+			config:      Options{Server: mqtt.New(nil), CRLFile: crlFile, CRLIssuer: p.responder},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			revocationHook := new(Hook)
+			revocationHook.Log = slog.Default()
+			err := revocationHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, revocationHook.Stop())
+
+		})
+	}
+}
+
+func TestOnConnectOCSP(t *testing.T) {
+	p := newTestPKI(t)
+
+	tests := []struct {
+		name        string
+		status      Status
+		fail        bool
+		softFail    bool
+		expectError bool
+	}{
+		{
+			name:        "Success - good",
+			status:      Good,
+			expectError: false,
+		},
+		{
+			name:        "Failure - revoked",
+			status:      Revoked,
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown",
+			status:      Unknown,
+			expectError: true,
+		},
+		{
+			name:        "Error - responder down",
+			fail:        true,
+			expectError: true,
+		},
+		{
+			name:        "Success - responder down with soft fail",
+			fail:        true,
+			softFail:    true,
+			expectError: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			rt := &responder{t: t, pki: p}
+			rt.status.Store(int32(tt.status))
+			rt.fail.Store(tt.fail)
+
+			s := mqtt.New(nil)
+			revocationHook := newHook(t, Options{Server: s, OCSP: true, RoundTripper: rt, SoftFail: tt.softFail})
+
+			err := revocationHook.OnConnect(newClient(t, s, tlsClient(t, p)), packets.Packet{})
+			if tt.expectError {
+				require.ErrorIs(t, err, packets.ErrNotAuthorized)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnConnectOCSPCache(t *testing.T) {
+	p := newTestPKI(t)
+	rt := &responder{t: t, pki: p}
+	s := mqtt.New(nil)
+	revocationHook := newHook(t, Options{Server: s, OCSP: true, RoundTripper: rt})
+
+	require.NoError(t, revocationHook.OnConnect(newClient(t, s, tlsClient(t, p)), packets.Packet{}))
+	require.NoError(t, revocationHook.OnConnect(newClient(t, s, tlsClient(t, p)), packets.Packet{}))
+	require.Equal(t, int32(1), rt.requests.Load())
+}
+
+func TestOnConnectWithoutCertificate(t *testing.T) {
+	s := mqtt.New(nil)
+	revocationHook := newHook(t, Options{Server: s, OCSP: true})
+
+	r, w := net.Pipe()
+	defer w.Close()
+	require.NoError(t, revocationHook.OnConnect(newClient(t, s, r), packets.Packet{}))
+}
+
+func TestRecheckCRL(t *testing.T) {
+	p := newTestPKI(t)
+	crlFile := filepath.Join(t.TempDir(), "ca.crl")
+	require.NoError(t, os.WriteFile(crlFile, p.crl(t, 1), 0600))
+
+	s := mqtt.New(nil)
+	revocationHook := newHook(t, Options{Server: s, CRLFile: crlFile, CRLIssuer: p.ca})
+
+	cl := newClient(t, s, tlsClient(t, p))
+	require.NoError(t, revocationHook.OnConnect(cl, packets.Packet{}))
+	revocationHook.OnSessionEstablished(cl, packets.Packet{})
+
+	revocationHook.Recheck()
+	require.False(t, cl.Closed())
+
+	// the certificate is revoked while the client is connected
+	require.NoError(t, os.WriteFile(crlFile, p.crl(t, 2, p.leaf.SerialNumber.Int64()), 0600))
+	require.True(t, revocationHook.ReloadCRL())
+	revocationHook.Recheck()
+	require.True(t, cl.Closed())
+	require.ErrorIs(t, cl.StopCause(), packets.ErrAdministrativeAction)
+
+	// and can no longer connect
+	require.ErrorIs(t, revocationHook.OnConnect(newClient(t, s, tlsClient(t, p)), packets.Packet{}), packets.ErrNotAuthorized)
+
+	revocationHook.OnDisconnect(cl, nil, true)
+	require.Empty(t, revocationHook.clients)
+}
+
+func TestReloadCRLError(t *testing.T) {
+	p := newTestPKI(t)
+	crlFile := filepath.Join(t.TempDir(), "ca.crl")
+	require.NoError(t, os.WriteFile(crlFile, p.crl(t, 1, p.leaf.SerialNumber.Int64()), 0600))
+
+	revocationHook := newHook(t, Options{Server: mqtt.New(nil), CRLFile: crlFile})
+
+	// a broken file keeps the previous crl
+	require.NoError(t, os.WriteFile(crlFile, []byte("garbage"), 0600))
+	require.False(t, revocationHook.ReloadCRL())
+	require.True(t, revocationHook.crl.Revoked(p.leaf))
+}
@@ -0,0 +1,173 @@
+package spiffe
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrNoBundle indicates no trust bundle is known for a trust domain
+var ErrNoBundle = errors.New("no trust bundle for trust domain")
+
+// BundleSource provides the X.509 authorities of trust domains. It can be implemented on top of the
+// Workload API, eg. with an X509Source from go-spiffe
+type BundleSource interface {
+	X509Authorities(trustDomain string) ([]*x509.Certificate, error)
+}
+
+// StaticBundles is a BundleSource with a fixed set of authorities per trust domain
+type StaticBundles map[string][]*x509.Certificate
+
+// X509Authorities returns the authorities of the trust domain
+func (b StaticBundles) X509Authorities(trustDomain string) ([]*x509.Certificate, error) {
+	authorities, ok := b[trustDomain]
+	if !ok {
+		return nil, ErrNoBundle
+	}
+	return authorities, nil
+}
+
+// BundleSources dispatches to a BundleSource per trust domain, eg. one BundleEndpoint per federated domain
+type BundleSources map[string]BundleSource
+
+// X509Authorities returns the authorities of the trust domain from its source
+func (b BundleSources) X509Authorities(trustDomain string) ([]*x509.Certificate, error) {
+	source, ok := b[trustDomain]
+	if !ok {
+		return nil, ErrNoBundle
+	}
+	return source.X509Authorities(trustDomain)
+}
+
+// BundleEndpoint is a BundleSource which fetches the bundle of a single trust domain from a SPIFFE
+// bundle endpoint, such as the federation endpoint of a SPIRE server
+type BundleEndpoint struct {
+	trustDomain string
+	url         *url.URL
+	httpClient  *http.Client
+	authorities []*x509.Certificate
+	refreshHint time.Duration
+	mu          sync.RWMutex
+}
+
+// bundleDocument is the JWKS based SPIFFE trust bundle format
+type bundleDocument struct {
+	Keys []struct {
+		Use string   `json:"use"`
+		X5C []string `json:"x5c"`
+	} `json:"keys"`
+	RefreshHint int64 `json:"spiffe_refresh_hint"`
+}
+
+// NewBundleEndpoint returns a source for the trust domain's bundle served at the url. The round
+// tripper may be nil, in which case the default transport is used
+func NewBundleEndpoint(trustDomain string, u *url.URL, rt http.RoundTripper) *BundleEndpoint {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	return &BundleEndpoint{
+		trustDomain: trustDomain,
+		url:         u,
+		httpClient:  &http.Client{Transport: rt},
+	}
+}
+
+// Refresh fetches the bundle and replaces the current authorities
+func (b *BundleEndpoint) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected bundle response status %d", resp.StatusCode)
+	}
+
+	var doc bundleDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+
+	var authorities []*x509.Certificate
+	for _, key := range doc.Keys {
+		if key.Use != "x509-svid" {
+			continue
+		}
+
+		if len(key.X5C) != 1 {
+			return errors.New("x509-svid key must contain exactly one certificate")
+		}
+
+		der, err := base64.StdEncoding.DecodeString(key.X5C[0])
+		if err != nil {
+			return err
+		}
+
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		authorities = append(authorities, cert)
+	}
+
+	if len(authorities) == 0 {
+		return errors.New("bundle contains no x509 authorities")
+	}
+
+	b.mu.Lock()
+	b.authorities = authorities
+	b.refreshHint = time.Duration(doc.RefreshHint) * time.Second
+	b.mu.Unlock()
+	return nil
+}
+
+// X509Authorities returns the most recently fetched authorities
+func (b *BundleEndpoint) X509Authorities(trustDomain string) ([]*x509.Certificate, error) {
+	if trustDomain != b.trustDomain {
+		return nil, ErrNoBundle
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.authorities) == 0 {
+		return nil, ErrNoBundle
+	}
+	return b.authorities, nil
+}
+
+// Run refreshes the bundle every interval, or as often as the bundle's refresh hint asks if it is
+// shorter, until the context is cancelled
+func (b *BundleEndpoint) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	for {
+		wait := interval
+		b.mu.RLock()
+		if b.refreshHint > 0 && b.refreshHint < wait {
+			wait = b.refreshHint
+		}
+		b.mu.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if err := b.Refresh(ctx); err != nil && ctx.Err() == nil {
+			onError(err)
+		}
+	}
+}
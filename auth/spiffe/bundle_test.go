@@ -0,0 +1,190 @@
+package spiffe
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// bundleServer serves a SPIFFE bundle document with the authorities
+type bundleServer struct {
+	authorities atomic.Pointer[[]*x509.Certificate]
+	refreshHint int64
+	status      int
+	requests    atomic.Int32
+}
+
+func (b *bundleServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.requests.Add(1)
+	if b.status != 0 {
+		return &http.Response{StatusCode: b.status, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+	}
+
+	type key struct {
+		Use string   `json:"use"`
+		Kty string   `json:"kty"`
+		X5C []string `json:"x5c,omitempty"`
+	}
+	doc := struct {
+		Keys        []key `json:"keys"`
+		RefreshHint int64 `json:"spiffe_refresh_hint,omitempty"`
+	}{
+		// jwt authorities are ignored
+		Keys:        []key{{Use: "jwt-svid", Kty: "EC"}},
+		RefreshHint: b.refreshHint,
+	}
+	for _, cert := range *b.authorities.Load() {
+		doc.Keys = append(doc.Keys, key{Use: "x509-svid", Kty: "EC", X5C: []string{base64.StdEncoding.EncodeToString(cert.Raw)}})
+	}
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func newBundleServer(authorities ...*x509.Certificate) *bundleServer {
+	b := new(bundleServer)
+	b.authorities.Store(&authorities)
+	return b
+}
+
+func stringToURL(s string) *url.URL {
+	u, _ := url.Parse(s)
+	return u
+}
+
+func TestStaticBundles(t *testing.T) {
+	p := newTestPKI(t, "example.org")
+	bundles := StaticBundles{"example.org": {p.ca}}
+
+	authorities, err := bundles.X509Authorities("example.org")
+	require.NoError(t, err)
+	require.Equal(t, []*x509.Certificate{p.ca}, authorities)
+
+	_, err = bundles.X509Authorities("example.com")
+	require.ErrorIs(t, err, ErrNoBundle)
+}
+
+func TestBundleSources(t *testing.T) {
+	p := newTestPKI(t, "example.org")
+	sources := BundleSources{"example.org": StaticBundles{"example.org": {p.ca}}}
+
+	authorities, err := sources.X509Authorities("example.org")
+	require.NoError(t, err)
+	require.Equal(t, []*x509.Certificate{p.ca}, authorities)
+
+	_, err = sources.X509Authorities("example.com")
+	require.ErrorIs(t, err, ErrNoBundle)
+}
+
+func TestBundleEndpointRefresh(t *testing.T) {
+	p := newTestPKI(t, "example.org")
+
+	tests := []struct {
+		name        string
+		server      *bundleServer
+		expectError bool
+	}{
+		{
+			name:   "Success - x509 authorities",
+			server: newBundleServer(p.ca),
+		},
+		{
+			name:        "Failure - no x509 authorities",
+			server:      newBundleServer(),
+			expectError: true,
+		},
+		{
+			name:        "Error - status",
+			server:      &bundleServer{status: http.StatusInternalServerError},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			endpoint := NewBundleEndpoint("example.org", stringToURL("https://spire.example.org/bundle"), tt.server)
+
+			err := endpoint.Refresh(context.Background())
+			if tt.expectError {
+				require.Error(t, err)
+				_, err = endpoint.X509Authorities("example.org")
+				require.ErrorIs(t, err, ErrNoBundle)
+				return
+			}
+			require.NoError(t, err)
+
+			authorities, err := endpoint.X509Authorities("example.org")
+			require.NoError(t, err)
+			require.Len(t, authorities, 1)
+			require.True(t, authorities[0].Equal(p.ca))
+
+			_, err = endpoint.X509Authorities("example.com")
+			require.ErrorIs(t, err, ErrNoBundle)
+
+		})
+	}
+}
+
+func TestBundleEndpointRun(t *testing.T) {
+	p := newTestPKI(t, "example.org")
+	rotated := newTestPKI(t, "example.org")
+
+	server := newBundleServer(p.ca)
+	endpoint := NewBundleEndpoint("example.org", stringToURL("https://spire.example.org/bundle"), server)
+	require.NoError(t, endpoint.Refresh(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		endpoint.Run(ctx, 10*time.Millisecond, func(err error) { t.Error(err) })
+		close(done)
+	}()
+
+	// the authorities are rotated
+	server.authorities.Store(&[]*x509.Certificate{p.ca, rotated.ca})
+	require.Eventually(t, func() bool {
+		authorities, err := endpoint.X509Authorities("example.org")
+		return err == nil && len(authorities) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	<-done
+}
+
+func TestBundleEndpointRunError(t *testing.T) {
+	endpoint := NewBundleEndpoint("example.org", stringToURL("https://spire.example.org/bundle"), &bundleServer{status: http.StatusNotFound})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go endpoint.Run(ctx, 10*time.Millisecond, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+
+	select {
+	case err := <-errs:
+		require.Error(t, err)
+		require.False(t, errors.Is(err, context.Canceled))
+	case <-time.After(time.Second):
+		t.Fatal("expected refresh error")
+	}
+}
@@ -0,0 +1,85 @@
+package spiffe
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ErrInvalidID indicates a URI is not a valid SPIFFE ID
+var ErrInvalidID = errors.New("invalid spiffe id")
+
+// ID is a SPIFFE ID, eg. spiffe://example.org/ns/prod/sa/api
+type ID struct {
+	TrustDomain string
+	Path        string // with a leading slash, or empty
+}
+
+// ParseID parses and validates a SPIFFE ID according to the SPIFFE ID specification
+func ParseID(s string) (ID, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ID{}, ErrInvalidID
+	}
+
+	return idFromURL(u)
+}
+
+func idFromURL(u *url.URL) (ID, error) {
+	if u.Scheme != "spiffe" || u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		return ID{}, ErrInvalidID
+	}
+
+	if u.Host == "" || !validChars(u.Host, false) {
+		return ID{}, ErrInvalidID
+	}
+
+	if u.RawPath != "" || u.Path == "/" {
+		return ID{}, ErrInvalidID
+	}
+
+	if u.Path != "" {
+		for _, segment := range strings.Split(u.Path[1:], "/") {
+			if segment == "" || segment == "." || segment == ".." || !validChars(segment, true) {
+				return ID{}, ErrInvalidID
+			}
+		}
+	}
+
+	return ID{TrustDomain: u.Host, Path: u.Path}, nil
+}
+
+// validChars reports whether s only contains the characters allowed in trust domains, or in path
+// segments, which additionally allow upper case letters
+func validChars(s string, path bool) bool {
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		case path && c >= 'A' && c <= 'Z':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the ID as a URI
+func (id ID) String() string {
+	return "spiffe://" + id.TrustDomain + id.Path
+}
+
+// Segments returns the path segments of the ID
+func (id ID) Segments() []string {
+	if id.Path == "" {
+		return nil
+	}
+	return strings.Split(id.Path[1:], "/")
+}
+
+// HasPrefix returns whether the ID equals the prefix or lies below it, eg. spiffe://example.org/ns/prod
+// is a prefix of spiffe://example.org/ns/prod/sa/api but not of spiffe://example.org/ns/production
+func (id ID) HasPrefix(prefix string) bool {
+	s := id.String()
+	prefix = strings.TrimSuffix(prefix, "/")
+	return s == prefix || strings.HasPrefix(s, prefix+"/")
+}
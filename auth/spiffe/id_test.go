@@ -0,0 +1,125 @@
+package spiffe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseID(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          string
+		expect      ID
+		expectError bool
+	}{
+		{
+			name:   "Success - workload",
+			id:     "spiffe://example.org/ns/prod/sa/api",
+			expect: ID{TrustDomain: "example.org", Path: "/ns/prod/sa/api"},
+		},
+		{
+			name:   "Success - trust domain only",
+			id:     "spiffe://example.org",
+			expect: ID{TrustDomain: "example.org"},
+		},
+		{
+			name:   "Success - upper case path",
+			id:     "spiffe://example.org/Billing_API-v2.1",
+			expect: ID{TrustDomain: "example.org", Path: "/Billing_API-v2.1"},
+		},
+		{
+			name:        "Failure - wrong scheme",
+			id:          "https://example.org/ns/prod",
+			expectError: true,
+		},
+		{
+			name:        "Failure - upper case trust domain",
+			id:          "spiffe://Example.org/ns",
+			expectError: true,
+		},
+		{
+			name:        "Failure - port",
+			id:          "spiffe://example.org:8443/ns",
+			expectError: true,
+		},
+		{
+			name:        "Failure - userinfo",
+			id:          "spiffe://user@example.org/ns",
+			expectError: true,
+		},
+		{
+			name:        "Failure - query",
+			id:          "spiffe://example.org/ns?a=b",
+			expectError: true,
+		},
+		{
+			name:        "Failure - trailing slash",
+			id:          "spiffe://example.org/ns/",
+			expectError: true,
+		},
+		{
+			name:        "Failure - empty segment",
+			id:          "spiffe://example.org/ns//sa",
+			expectError: true,
+		},
+		{
+			name:        "Failure - dot segment",
+			id:          "spiffe://example.org/ns/../sa",
+			expectError: true,
+		},
+		{
+			name:        "Failure - wildcard",
+			id:          "spiffe://example.org/ns/+",
+			expectError: true,
+		},
+		{
+			name:        "Failure - escaped character",
+			id:          "spiffe://example.org/ns%2Fprod",
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing trust domain",
+			id:          "spiffe:///ns",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			id, err := ParseID(tt.id)
+			if tt.expectError {
+				require.ErrorIs(t, err, ErrInvalidID)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, id)
+			require.Equal(t, tt.id, id.String())
+
+		})
+	}
+}
+
+func TestSegments(t *testing.T) {
+	id, err := ParseID("spiffe://example.org/ns/prod/sa/api")
+	require.NoError(t, err)
+	require.Equal(t, []string{"ns", "prod", "sa", "api"}, id.Segments())
+
+	id, err = ParseID("spiffe://example.org")
+	require.NoError(t, err)
+	require.Empty(t, id.Segments())
+}
+
+func TestHasPrefix(t *testing.T) {
+	id, err := ParseID("spiffe://example.org/ns/prod/sa/api")
+	require.NoError(t, err)
+
+	require.True(t, id.HasPrefix("spiffe://example.org"))
+	require.True(t, id.HasPrefix("spiffe://example.org/ns/prod"))
+	require.True(t, id.HasPrefix("spiffe://example.org/ns/prod/"))
+	require.True(t, id.HasPrefix("spiffe://example.org/ns/prod/sa/api"))
+	require.False(t, id.HasPrefix("spiffe://example.org/ns/pro"))
+	require.False(t, id.HasPrefix("spiffe://example.org/ns/prod/sa/api/v2"))
+	require.False(t, id.HasPrefix("spiffe://example.com"))
+}
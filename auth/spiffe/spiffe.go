@@ -0,0 +1,236 @@
+package spiffe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+var (
+	// ErrNoSVID indicates the client did not present an X.509-SVID
+	ErrNoSVID = errors.New("no x509-svid presented")
+
+	// ErrInvalidSVID indicates the presented certificate is not a valid X.509-SVID leaf
+	ErrInvalidSVID = errors.New("invalid x509-svid")
+
+	// ErrUntrustedTrustDomain indicates the SPIFFE ID belongs to a trust domain which is not accepted
+	ErrUntrustedTrustDomain = errors.New("untrusted trust domain")
+
+	// ErrIDNotAllowed indicates the SPIFFE ID is not below any of the allowed prefixes
+	ErrIDNotAllowed = errors.New("spiffe id not allowed")
+)
+
+// Hook is a hook that authenticates workloads by the SPIFFE ID in the X.509-SVID they present on an
+// mTLS listener, and maps the trust domain and path of the ID to topic permissions
+type Hook struct {
+	config   Options
+	sessions acl.Sessions
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the SPIFFE hook. The
+// listener must request client certificates without verifying them itself, eg. with
+// tls.RequireAnyClientCert, as SVIDs are verified against the bundle of their own trust domain
+type Options struct {
+	// Bundles provides the X.509 authorities of each trust domain, eg. from the Workload API or a
+	// BundleEndpoint per federated trust domain
+	Bundles BundleSource
+
+	TrustDomains []string // the trust domains whose workloads are accepted
+	IDPrefixes   []string // if set, the SPIFFE ID must equal or lie below one of these, eg. spiffe://example.org/ns/prod
+
+	// ACL holds templates granted to every authenticated workload and PrefixACL the templates granted
+	// to the workloads below each SPIFFE ID prefix. Templates may reference {clientid}, {trustdomain},
+	// {path} for the whole path of the ID and {path0}, {path1}, ... for its segments, so that
+	// "workloads/{trustdomain}/{path}/#" gives spiffe://example.org/ns/prod/sa/api the namespace
+	// workloads/example.org/ns/prod/sa/api/#
+	ACL       acl.Templates
+	PrefixACL map[string]acl.Templates
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "spiffe-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if len(h.config.ACL) == 0 && len(h.config.PrefixACL) == 0 {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	spiffeHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if spiffeHookConfig.Bundles == nil {
+		return errors.New("bundle source is required")
+	}
+
+	if len(spiffeHookConfig.TrustDomains) == 0 {
+		return errors.New("at least one trust domain is required")
+	}
+
+	for _, prefix := range spiffeHookConfig.IDPrefixes {
+		if _, err := ParseID(strings.TrimSuffix(prefix, "/")); err != nil {
+			return errors.New("invalid spiffe id prefix " + prefix)
+		}
+	}
+
+	for prefix := range spiffeHookConfig.PrefixACL {
+		if _, err := ParseID(strings.TrimSuffix(prefix, "/")); err != nil {
+			return errors.New("invalid spiffe id prefix " + prefix)
+		}
+	}
+
+	h.config = spiffeHookConfig
+
+	return nil
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	id, err := h.authenticate(cl)
+	if err != nil {
+		h.Log.Debug("svid verification failed", "client", cl.ID, "error", err)
+		return false
+	}
+
+	if len(h.config.ACL) == 0 && len(h.config.PrefixACL) == 0 {
+		return true
+	}
+
+	values := map[string]string{
+		"clientid":    cl.ID,
+		"trustdomain": id.TrustDomain,
+	}
+	segments := id.Segments()
+	for i, segment := range segments {
+		values["path"+strconv.Itoa(i)] = segment
+	}
+
+	filters := render(h.config.ACL, segments, values)
+	for prefix, templates := range h.config.PrefixACL {
+		if id.HasPrefix(prefix) {
+			filters.Merge(render(templates, segments, values))
+		}
+	}
+	h.sessions.Set(cl, filters)
+
+	return true
+}
+
+// render renders the templates, substituting {path} with the path segments of the ID. Segments are
+// restricted to letters, digits, dots, dashes and underscores, so they cannot inject wildcards
+func render(templates acl.Templates, segments []string, values map[string]string) acl.Filters {
+	if len(segments) == 0 {
+		return templates.Render(values)
+	}
+
+	path := strings.Join(segments, "/")
+	expanded := make(acl.Templates, len(templates))
+	for template, access := range templates {
+		expanded[strings.ReplaceAll(template, "{path}", path)] = access
+	}
+
+	return expanded.Render(values)
+}
+
+// authenticate verifies the client's X.509-SVID against the bundle of its trust domain and returns its SPIFFE ID
+func (h *Hook) authenticate(cl *mqtt.Client) (ID, error) {
+	conn, ok := cl.Net.Conn.(*tls.Conn)
+	if !ok {
+		return ID{}, ErrNoSVID
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ID{}, ErrNoSVID
+	}
+
+	leaf := certs[0]
+	id, err := svidID(leaf)
+	if err != nil {
+		return ID{}, err
+	}
+
+	if !slices.Contains(h.config.TrustDomains, id.TrustDomain) {
+		return ID{}, ErrUntrustedTrustDomain
+	}
+
+	if len(h.config.IDPrefixes) > 0 && !slices.ContainsFunc(h.config.IDPrefixes, id.HasPrefix) {
+		return ID{}, ErrIDNotAllowed
+	}
+
+	authorities, err := h.config.Bundles.X509Authorities(id.TrustDomain)
+	if err != nil {
+		return ID{}, err
+	}
+
+	roots := x509.NewCertPool()
+	for _, authority := range authorities {
+		roots.AddCert(authority)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return ID{}, err
+	}
+
+	return id, nil
+}
+
+// svidID returns the SPIFFE ID of an X.509-SVID leaf, which must carry exactly one URI SAN and must
+// not be a CA
+func svidID(leaf *x509.Certificate) (ID, error) {
+	if leaf.IsCA || leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return ID{}, ErrInvalidSVID
+	}
+
+	if len(leaf.URIs) != 1 {
+		return ID{}, ErrInvalidSVID
+	}
+
+	return idFromURL(leaf.URIs[0])
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
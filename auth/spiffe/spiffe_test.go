@@ -0,0 +1,434 @@
+package spiffe
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// testPKI is the signing authority of a trust domain
+type testPKI struct {
+	trustDomain string
+	ca          *x509.Certificate
+	caKey       *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T, trustDomain string) *testPKI {
+	t.Helper()
+
+	p := &testPKI{trustDomain: trustDomain}
+	p.ca, p.caKey = newCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"SPIRE"}},
+		URIs:                  []*url.URL{stringToURL("spiffe://" + trustDomain)},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+
+	return p
+}
+
+// svid issues an X.509-SVID leaf with the uri SANs
+func (p *testPKI) svid(t *testing.T, uris ...string) tls.Certificate {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, uri := range uris {
+		template.URIs = append(template.URIs, stringToURL(uri))
+	}
+
+	cert, key := newCert(t, template, p.ca, p.caKey)
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+// newCert creates a certificate from the template, self-signed if parent is nil
+func newCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+// tlsClient returns a server side mTLS connection on which the client presented the certificate
+func tlsClient(t *testing.T, p *testPKI, cert tls.Certificate) net.Conn {
+	t.Helper()
+
+	serverCert, serverKey := newCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"broker"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, p.ca, p.caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca)
+
+	r, w := net.Pipe()
+	server := tls.Server(r, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	client := tls.Client(w, &tls.Config{
+		ServerName:   "broker",
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+	})
+
+	go func() {
+		if client.Handshake() == nil {
+			io.Copy(io.Discard, client)
+		}
+	}()
+	require.NoError(t, server.Handshake())
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	return server
+}
+
+func newClient(s *mqtt.Server, conn net.Conn) *mqtt.Client {
+	cl := s.NewClient(conn, "tls", "api-1", false)
+	cl.Properties.ProtocolVersion = 5
+	return cl
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	spiffeHook := new(Hook)
+	spiffeHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, spiffeHook.Init(options))
+	return spiffeHook
+}
+
+func TestID(t *testing.T) {
+	spiffeHook := new(Hook)
+
+	require.Equal(t, "spiffe-auth-hook", spiffeHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	spiffeHook := new(Hook)
+	require.True(t, spiffeHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, spiffeHook.Provides(mqtt.OnACLCheck))
+
+	spiffeHook.config.ACL = acl.Templates{"workloads/{path}/#": acl.ReadWrite}
+	require.True(t, spiffeHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, spiffeHook.Provides(mqtt.OnACLCheck))
+	require.True(t, spiffeHook.Provides(mqtt.OnDisconnect))
+	require.False(t, spiffeHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	bundles := StaticBundles{}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - trust domain",
+			config:      Options{Bundles: bundles, TrustDomains: []string{"example.org"}},
+			expectError: false,
+		},
+		{
+			name: "Success - prefixes",
+			config: Options{
+				Bundles:      bundles,
+				TrustDomains: []string{"example.org"},
+				IDPrefixes:   []string{"spiffe://example.org/ns/prod/"},
+				PrefixACL:    map[string]acl.Templates{"spiffe://example.org/ns/prod": {"prod/#": acl.ReadOnly}},
+			},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing bundles",
+			config:      Options{TrustDomains: []string{"example.org"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing trust domains",
+			config:      Options{Bundles: bundles},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid id prefix",
+			config:      Options{Bundles: bundles, TrustDomains: []string{"example.org"}, IDPrefixes: []string{"example.org/ns"}},
+			expectError: true,
+		},
+		{
+			name: "Failure - invalid acl prefix",
+			config: Options{
+				Bundles:      bundles,
+				TrustDomains: []string{"example.org"},
+				PrefixACL:    map[string]acl.Templates{"spiffe://example.org/ns/#": {"prod/#": acl.ReadOnly}},
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			spiffeHook := new(Hook)
+			spiffeHook.Log = slog.Default()
+			err := spiffeHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	p := newTestPKI(t, "example.org")
+	other := newTestPKI(t, "example.com")
+	impostor := newTestPKI(t, "example.org")
+
+	options := Options{
+		Bundles:      StaticBundles{"example.org": {p.ca}, "example.com": {other.ca}},
+		TrustDomains: []string{"example.org", "example.com"},
+		IDPrefixes:   []string{"spiffe://example.org/ns/prod", "spiffe://example.com"},
+	}
+
+	tests := []struct {
+		name       string
+		pki        *testPKI
+		cert       tls.Certificate
+		expectPass bool
+	}{
+		{
+			name:       "Success - workload",
+			pki:        p,
+			cert:       p.svid(t, "spiffe://example.org/ns/prod/sa/api"),
+			expectPass: true,
+		},
+		{
+			name:       "Success - federated trust domain",
+			pki:        other,
+			cert:       other.svid(t, "spiffe://example.com/billing"),
+			expectPass: true,
+		},
+		{
+			name:       "Failure - id outside the allowed prefixes",
+			pki:        p,
+			cert:       p.svid(t, "spiffe://example.org/ns/staging/sa/api"),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - signed by another trust domain",
+			pki:        other,
+			cert:       other.svid(t, "spiffe://example.org/ns/prod/sa/api"),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - signed by an unknown authority",
+			pki:        impostor,
+			cert:       impostor.svid(t, "spiffe://example.org/ns/prod/sa/api"),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - untrusted trust domain",
+			pki:        p,
+			cert:       p.svid(t, "spiffe://example.net/ns/prod"),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - no uri san",
+			pki:        p,
+			cert:       p.svid(t),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - multiple uri sans",
+			pki:        p,
+			cert:       p.svid(t, "spiffe://example.org/ns/prod/sa/api", "spiffe://example.org/ns/prod/sa/admin"),
+			expectPass: false,
+		},
+		{
+			name:       "Failure - not a spiffe id",
+			pki:        p,
+			cert:       p.svid(t, "https://example.org/ns/prod/sa/api"),
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := mqtt.New(nil)
+			spiffeHook := newHook(t, options)
+
+			cl := newClient(s, tlsClient(t, tt.pki, tt.cert))
+			require.Equal(t, tt.expectPass, spiffeHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticateWithoutTLS(t *testing.T) {
+	s := mqtt.New(nil)
+	spiffeHook := newHook(t, Options{Bundles: StaticBundles{}, TrustDomains: []string{"example.org"}})
+
+	r, w := net.Pipe()
+	defer w.Close()
+	require.False(t, spiffeHook.OnConnectAuthenticate(newClient(s, r), packets.Packet{}))
+}
+
+func TestOnConnectAuthenticateMissingBundle(t *testing.T) {
+	p := newTestPKI(t, "example.org")
+	s := mqtt.New(nil)
+	spiffeHook := newHook(t, Options{Bundles: StaticBundles{}, TrustDomains: []string{"example.org"}})
+
+	cl := newClient(s, tlsClient(t, p, p.svid(t, "spiffe://example.org/api")))
+	require.False(t, spiffeHook.OnConnectAuthenticate(cl, packets.Packet{}))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	p := newTestPKI(t, "example.org")
+	s := mqtt.New(nil)
+	spiffeHook := newHook(t, Options{
+		Bundles:      StaticBundles{"example.org": {p.ca}},
+		TrustDomains: []string{"example.org"},
+		ACL: acl.Templates{
+			"workloads/{trustdomain}/{path}/#": acl.ReadWrite,
+			"namespaces/{path1}/events":        acl.ReadOnly,
+			"clients/{clientid}/status":        acl.WriteOnly,
+		},
+		PrefixACL: map[string]acl.Templates{
+			"spiffe://example.org/ns/prod":    {"prod/telemetry/#": acl.ReadOnly},
+			"spiffe://example.org/ns/staging": {"staging/#": acl.ReadWrite},
+		},
+	})
+
+	cl := newClient(s, tlsClient(t, p, p.svid(t, "spiffe://example.org/ns/prod/sa/api")))
+	require.True(t, spiffeHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	tests := []struct {
+		name       string
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - own namespace",
+			topic:      "workloads/example.org/ns/prod/sa/api/commands",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - path segment",
+			topic:      "namespaces/prod/events",
+			expectPass: true,
+		},
+		{
+			name:       "Success - client id",
+			topic:      "clients/api-1/status",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - prefix acl",
+			topic:      "prod/telemetry/cpu",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - another workload's namespace",
+			topic:      "workloads/example.org/ns/prod/sa/admin/commands",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - another prefix acl",
+			topic:      "staging/telemetry",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - read only",
+			topic:      "namespaces/prod/events",
+			write:      true,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, spiffeHook.OnACLCheck(cl, tt.topic, tt.write))
+
+		})
+	}
+
+	spiffeHook.OnDisconnect(cl, nil, true)
+	require.False(t, spiffeHook.OnACLCheck(cl, "workloads/example.org/ns/prod/sa/api/commands", true))
+}
+
+func TestOnACLCheckTrustDomainOnly(t *testing.T) {
+	p := newTestPKI(t, "example.org")
+	s := mqtt.New(nil)
+	spiffeHook := newHook(t, Options{
+		Bundles:      StaticBundles{"example.org": {p.ca}},
+		TrustDomains: []string{"example.org"},
+		ACL: acl.Templates{
+			"domains/{trustdomain}/#":          acl.ReadOnly,
+			"workloads/{trustdomain}/{path}/#": acl.ReadWrite,
+		},
+	})
+
+	// an id without a path only gets the templates which do not reference it
+	cl := newClient(s, tlsClient(t, p, p.svid(t, "spiffe://example.org")))
+	require.True(t, spiffeHook.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, spiffeHook.OnACLCheck(cl, "domains/example.org/news", false))
+	require.False(t, spiffeHook.OnACLCheck(cl, "workloads/example.org/api", false))
+}
@@ -0,0 +1,230 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/password"
+	"github.com/mochi-mqtt/hooks/pkg/sqlauth"
+)
+
+// Schema creates the tables of the DefaultQueries if they don't exist
+const Schema = `
+CREATE TABLE IF NOT EXISTS mqtt_users (
+	username      TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	is_admin      INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS mqtt_acls (
+	username TEXT NOT NULL REFERENCES mqtt_users (username) ON DELETE CASCADE,
+	topic    TEXT NOT NULL,
+	rw       INTEGER NOT NULL, -- 0 deny, 1 read, 2 write, 3 read and write
+	PRIMARY KEY (username, topic)
+);`
+
+// DefaultQueries look up users in the tables created by Schema
+var DefaultQueries = sqlauth.Queries{
+	User:      "SELECT password_hash FROM mqtt_users WHERE username = ? LIMIT 1",
+	Superuser: "SELECT COUNT(*) FROM mqtt_users WHERE username = ? AND is_admin",
+	ACL:       "SELECT topic, rw FROM mqtt_acls WHERE username = ?",
+}
+
+// statements used by the user management methods, which write to the tables created by Schema
+const (
+	upsertUser = "INSERT INTO mqtt_users (username, password_hash, is_admin) VALUES (?, ?, ?) " +
+		"ON CONFLICT (username) DO UPDATE SET password_hash = excluded.password_hash, is_admin = excluded.is_admin"
+	deleteUser = "DELETE FROM mqtt_users WHERE username = ?"
+	upsertRule = "INSERT INTO mqtt_acls (username, topic, rw) VALUES (?, ?, ?) " +
+		"ON CONFLICT (username, topic) DO UPDATE SET rw = excluded.rw"
+	deleteRule  = "DELETE FROM mqtt_acls WHERE username = ? AND topic = ?"
+	deleteRules = "DELETE FROM mqtt_acls WHERE username = ?"
+)
+
+// ErrUserNotFound indicates the user to change does not exist
+var ErrUserNotFound = errors.New("user not found")
+
+// Hook is a hook that authenticates clients against users and ACL rules stored in a local SQLite
+// database, which can be managed at runtime with AddUser, RemoveUser, SetRule and RemoveRule
+type Hook struct {
+	config Options
+	sqlauth.Hook
+}
+
+// Options is a struct that contains all the information required to configure the sqlite hook
+type Options struct {
+	// Path is the database file, eg. /var/lib/mqtt/auth.DB(). Driver is the registered database/sql driver
+	// it is opened with, defaults to "sqlite", which is registered by the pure Go modernc.org/sqlite and
+	// so needs no cgo
+	Path   string
+	Driver string
+
+	// DB is an open database used instead of Path
+	DB *sql.DB
+
+	// CreateTables creates the tables of the DefaultQueries with Schema if they don't exist
+	CreateTables bool
+
+	Queries  sqlauth.Queries  // defaults to DefaultQueries, each query is prepared once
+	Schemes  password.Schemes // verify the password hashes, defaults to password.Default
+	CacheTTL time.Duration    // how long users are cached, users are not cached if it is zero
+	Timeout  time.Duration    // how long a lookup may take, defaults to 5 seconds
+
+	// Hash hashes the passwords given to AddUser, defaults to password.HashPBKDF2 with the default
+	// iterations
+	Hash func(password string) (string, error)
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "sqlite-auth-hook"
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	sqliteHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if sqliteHookConfig.DB == nil && sqliteHookConfig.Path == "" {
+		return errors.New("path or db is required")
+	}
+
+	if sqliteHookConfig.Driver == "" {
+		sqliteHookConfig.Driver = "sqlite"
+	}
+
+	if sqliteHookConfig.Queries.User == "" {
+		sqliteHookConfig.Queries = DefaultQueries
+	}
+
+	if sqliteHookConfig.Timeout <= 0 {
+		sqliteHookConfig.Timeout = 5 * time.Second
+	}
+
+	if sqliteHookConfig.Hash == nil {
+		sqliteHookConfig.Hash = func(pw string) (string, error) {
+			return password.HashPBKDF2(pw, 0)
+		}
+	}
+
+	db := sqliteHookConfig.DB
+	if db == nil {
+		var err error
+		db, err = sql.Open(sqliteHookConfig.Driver, sqliteHookConfig.Path)
+		if err != nil {
+			return err
+		}
+
+		// writes to SQLite are serialised anyway, and a single connection avoids busy errors
+		db.SetMaxOpenConns(1)
+	}
+
+	if sqliteHookConfig.CreateTables {
+		ctx, cancel := context.WithTimeout(context.Background(), sqliteHookConfig.Timeout)
+		defer cancel()
+
+		if _, err := db.ExecContext(ctx, Schema); err != nil {
+			if sqliteHookConfig.DB == nil {
+				db.Close()
+			}
+			return err
+		}
+	}
+
+	err := h.Setup(sqlauth.Config{
+		DB:       db,
+		CloseDB:  sqliteHookConfig.DB == nil,
+		Queries:  sqliteHookConfig.Queries,
+		Schemes:  sqliteHookConfig.Schemes,
+		CacheTTL: sqliteHookConfig.CacheTTL,
+		Timeout:  sqliteHookConfig.Timeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.config = sqliteHookConfig
+	return nil
+}
+
+// AddUser adds a user with the password, or replaces the password and superuser status of an existing
+// user, keeping its rules. Connected clients keep their permissions until they reconnect
+func (h *Hook) AddUser(ctx context.Context, username, pw string, superuser bool) error {
+	if username == "" || pw == "" {
+		return errors.New("username and password are required")
+	}
+
+	hash, err := h.config.Hash(pw)
+	if err != nil {
+		return err
+	}
+
+	if _, err := h.DB().ExecContext(ctx, upsertUser, username, hash, superuser); err != nil {
+		return err
+	}
+
+	h.Forget(username)
+	return nil
+}
+
+// RemoveUser removes the user and its rules
+func (h *Hook) RemoveUser(ctx context.Context, username string) error {
+	tx, err := h.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, deleteRules, username); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, deleteUser, username)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrUserNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	h.Forget(username)
+	return nil
+}
+
+// SetRule grants the user the access to the topic filter, which may contain %u or {username} and %c or
+// {clientid}, replacing any access previously set for the filter
+func (h *Hook) SetRule(ctx context.Context, username, filter string, access acl.Access) error {
+	if filter == "" {
+		return errors.New("filter is required")
+	}
+
+	if _, err := h.DB().ExecContext(ctx, upsertRule, username, filter, int64(access)); err != nil {
+		return err
+	}
+
+	h.Forget(username)
+	return nil
+}
+
+// RemoveRule removes the rule of the user for the topic filter
+func (h *Hook) RemoveRule(ctx context.Context, username, filter string) error {
+	if _, err := h.DB().ExecContext(ctx, deleteRule, username, filter); err != nil {
+		return err
+	}
+
+	h.Forget(username)
+	return nil
+}
@@ -0,0 +1,329 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/password"
+	"github.com/mochi-mqtt/hooks/pkg/sqlauth"
+	"github.com/mochi-mqtt/hooks/pkg/sqlauth/sqlauthtest"
+)
+
+// fakeDB holds the tables of the schema in memory and answers the statements of the hook
+type fakeDB struct {
+	users   map[string]fakeUser
+	rules   map[[2]string]int64
+	created bool
+}
+
+type fakeUser struct {
+	hash  string
+	admin bool
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		users: map[string]fakeUser{
+			"bob":   {hash: "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA"},
+			"carol": {hash: "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0"},
+		},
+		rules: map[[2]string]int64{
+			{"bob", "users/%u/#"}:        3,
+			{"bob", "devices/%c/status"}: 2,
+		},
+	}
+}
+
+func (f *fakeDB) driver() *sqlauthtest.Driver {
+	return &sqlauthtest.Driver{
+		Queries: map[string]sqlauthtest.QueryFunc{
+			Schema: func(args []driver.Value) ([][]driver.Value, error) {
+				f.created = true
+				return nil, nil
+			},
+			DefaultQueries.User: func(args []driver.Value) ([][]driver.Value, error) {
+				if args[0] == "error" {
+					return nil, errors.New("database is locked")
+				}
+
+				if u, ok := f.users[args[0].(string)]; ok {
+					return [][]driver.Value{{u.hash}}, nil
+				}
+				return nil, nil
+			},
+			DefaultQueries.Superuser: func(args []driver.Value) ([][]driver.Value, error) {
+				if f.users[args[0].(string)].admin {
+					return [][]driver.Value{{int64(1)}}, nil
+				}
+				return [][]driver.Value{{int64(0)}}, nil
+			},
+			DefaultQueries.ACL: func(args []driver.Value) ([][]driver.Value, error) {
+				var rows [][]driver.Value
+				for k, rw := range f.rules {
+					if k[0] == args[0] {
+						rows = append(rows, []driver.Value{k[1], rw})
+					}
+				}
+				sort.Slice(rows, func(i, j int) bool { return rows[i][0].(string) < rows[j][0].(string) })
+				return rows, nil
+			},
+			upsertUser: func(args []driver.Value) ([][]driver.Value, error) {
+				f.users[args[0].(string)] = fakeUser{hash: args[1].(string), admin: args[2].(bool)}
+				return [][]driver.Value{{}}, nil
+			},
+			deleteUser: func(args []driver.Value) ([][]driver.Value, error) {
+				if _, ok := f.users[args[0].(string)]; !ok {
+					return nil, nil
+				}
+				delete(f.users, args[0].(string))
+				return [][]driver.Value{{}}, nil
+			},
+			upsertRule: func(args []driver.Value) ([][]driver.Value, error) {
+				if _, ok := f.users[args[0].(string)]; !ok {
+					return nil, errors.New("FOREIGN KEY constraint failed")
+				}
+				f.rules[[2]string{args[0].(string), args[1].(string)}] = args[2].(int64)
+				return [][]driver.Value{{}}, nil
+			},
+			deleteRule: func(args []driver.Value) ([][]driver.Value, error) {
+				delete(f.rules, [2]string{args[0].(string), args[1].(string)})
+				return nil, nil
+			},
+			deleteRules: func(args []driver.Value) ([][]driver.Value, error) {
+				for k := range f.rules {
+					if k[0] == args[0] {
+						delete(f.rules, k)
+					}
+				}
+				return nil, nil
+			},
+		},
+	}
+}
+
+func connectPacket(username, pass string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{
+			Username: []byte(username),
+			Password: []byte(pass),
+		},
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	sqliteHook := new(Hook)
+	sqliteHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, sqliteHook.Init(options))
+	t.Cleanup(func() { sqliteHook.Stop() })
+	return sqliteHook
+}
+
+// cheapHash keeps the tests fast, the default hash uses many iterations
+func cheapHash(pw string) (string, error) {
+	return password.HashPBKDF2(pw, 1000)
+}
+
+func TestID(t *testing.T) {
+	sqliteHook := new(Hook)
+
+	require.Equal(t, "sqlite-auth-hook", sqliteHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	sqliteHook := newHook(t, Options{DB: newFakeDB().driver().DB()})
+	require.True(t, sqliteHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, sqliteHook.Provides(mqtt.OnACLCheck))
+	require.True(t, sqliteHook.Provides(mqtt.OnDisconnect))
+	require.False(t, sqliteHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - db",
+			config:      Options{DB: newFakeDB().driver().DB()},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no path or db",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unregistered driver",
+			config:      Options{Path: "auth.db"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid query",
+			config:      Options{DB: newFakeDB().driver().DB(), Queries: sqlauth.Queries{User: "SELECT nonsense"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			sqliteHook := new(Hook)
+			sqliteHook.Log = slog.Default()
+			err := sqliteHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, DefaultQueries, sqliteHook.config.Queries)
+			require.NotNil(t, sqliteHook.config.Hash)
+			require.NoError(t, sqliteHook.Stop())
+
+		})
+	}
+}
+
+func TestInitCreateTables(t *testing.T) {
+	db := newFakeDB()
+	newHook(t, Options{DB: db.driver().DB()})
+	require.False(t, db.created)
+
+	newHook(t, Options{DB: db.driver().DB(), CreateTables: true})
+	require.True(t, db.created)
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	sqliteHook := newHook(t, Options{DB: newFakeDB().driver().DB()})
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		expectPass bool
+	}{
+		{
+			name:       "Success - valid password",
+			username:   "bob",
+			password:   "password",
+			expectPass: true,
+		},
+		{
+			name:       "Success - argon2",
+			username:   "carol",
+			password:   "password",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - wrong password",
+			username:   "bob",
+			password:   "passw0rd",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unknown user",
+			username:   "mallory",
+			password:   "password",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - no username",
+			username:   "",
+			password:   "password",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - database error",
+			username:   "error",
+			password:   "password",
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &mqtt.Client{ID: "device-1"}
+			require.Equal(t, tt.expectPass, sqliteHook.OnConnectAuthenticate(cl, connectPacket(tt.username, tt.password)))
+
+		})
+	}
+
+	// failures of the database are reported apart from rejections
+	_, err := sqliteHook.Authenticate(&mqtt.Client{ID: "device-1"}, connectPacket("error", "password"))
+	require.Error(t, err)
+	_, err = sqliteHook.Authenticate(&mqtt.Client{ID: "device-1"}, connectPacket("mallory", "password"))
+	require.NoError(t, err)
+}
+
+func TestOnACLCheck(t *testing.T) {
+	sqliteHook := newHook(t, Options{DB: newFakeDB().driver().DB()})
+
+	bob := &mqtt.Client{ID: "device-1"}
+	require.True(t, sqliteHook.OnConnectAuthenticate(bob, connectPacket("bob", "password")))
+
+	require.True(t, sqliteHook.OnACLCheck(bob, "users/bob/inbox", false))
+	require.True(t, sqliteHook.OnACLCheck(bob, "devices/device-1/status", true))
+	require.False(t, sqliteHook.OnACLCheck(bob, "devices/device-1/status", false))
+	require.False(t, sqliteHook.OnACLCheck(bob, "users/alice/inbox", false))
+
+	sqliteHook.OnDisconnect(bob, nil, true)
+	require.False(t, sqliteHook.OnACLCheck(bob, "users/bob/inbox", false))
+}
+
+func TestManageUsers(t *testing.T) {
+	ctx := context.Background()
+	db := newFakeDB()
+	sqliteHook := newHook(t, Options{DB: db.driver().DB(), CacheTTL: time.Hour, Hash: cheapHash})
+
+	// cache the unknown user, changes must still apply to the next connection
+	require.False(t, sqliteHook.OnConnectAuthenticate(&mqtt.Client{ID: "sensor-1"}, connectPacket("alice", "secret")))
+
+	require.Error(t, sqliteHook.AddUser(ctx, "alice", "", false))
+	require.NoError(t, sqliteHook.AddUser(ctx, "alice", "secret", false))
+	require.NotEqual(t, "secret", db.users["alice"].hash)
+	require.NoError(t, sqliteHook.SetRule(ctx, "alice", "sensors/%c/#", acl.ReadWrite))
+	require.Error(t, sqliteHook.SetRule(ctx, "mallory", "sensors/#", acl.ReadOnly))
+	require.Error(t, sqliteHook.SetRule(ctx, "alice", "", acl.ReadOnly))
+
+	alice := &mqtt.Client{ID: "sensor-1"}
+	require.True(t, sqliteHook.OnConnectAuthenticate(alice, connectPacket("alice", "secret")))
+	require.True(t, sqliteHook.OnACLCheck(alice, "sensors/sensor-1/temperature", true))
+	require.False(t, sqliteHook.OnACLCheck(alice, "admin/config", true))
+
+	require.NoError(t, sqliteHook.AddUser(ctx, "alice", "changed", true))
+	require.NoError(t, sqliteHook.RemoveRule(ctx, "alice", "sensors/%c/#"))
+	require.False(t, sqliteHook.OnConnectAuthenticate(alice, connectPacket("alice", "secret")))
+	require.True(t, sqliteHook.OnConnectAuthenticate(alice, connectPacket("alice", "changed")))
+	require.True(t, sqliteHook.OnACLCheck(alice, "admin/config", true))
+	require.True(t, sqliteHook.OnACLCheck(alice, "$SYS/broker/uptime", false))
+
+	require.NoError(t, sqliteHook.RemoveUser(ctx, "bob"))
+	require.NotContains(t, db.users, "bob")
+	require.Empty(t, db.rules)
+	require.False(t, sqliteHook.OnConnectAuthenticate(&mqtt.Client{ID: "device-1"}, connectPacket("bob", "password")))
+	require.ErrorIs(t, sqliteHook.RemoveUser(ctx, "bob"), ErrUserNotFound)
+}
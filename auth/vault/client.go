@@ -0,0 +1,98 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrPermissionDenied indicates Vault rejected the request with a 403, eg. invalid credentials or an
+// expired token
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Secret is the response envelope shared by the Vault HTTP API endpoints used by the hook
+type Secret struct {
+	Data map[string]any `json:"data"`
+	Auth *SecretAuth    `json:"auth"`
+}
+
+// SecretAuth holds the token created by a login request
+type SecretAuth struct {
+	ClientToken   string            `json:"client_token"`
+	EntityID      string            `json:"entity_id"`
+	Policies      []string          `json:"policies"`
+	Metadata      map[string]string `json:"metadata"`
+	LeaseDuration int64             `json:"lease_duration"`
+	Renewable     bool              `json:"renewable"`
+}
+
+// TTL returns the lease duration of the token
+func (a *SecretAuth) TTL() time.Duration {
+	return time.Duration(a.LeaseDuration) * time.Second
+}
+
+// client is a minimal Vault HTTP API client
+type client struct {
+	httpClient *http.Client
+	address    string
+	namespace  string
+}
+
+// do sends a request to the Vault API path, eg. auth/token/lookup-self, and decodes the response into a
+// Secret. A nil Secret is returned for 404 responses
+func (c *client) do(ctx context.Context, method, path, token string, body any) (*Secret, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.address+"/v1/"+strings.TrimPrefix(path, "/"), reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusBadRequest && strings.Contains(path, "login"):
+		return nil, ErrPermissionDenied
+	case resp.StatusCode == http.StatusNoContent:
+		return &Secret{}, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, fmt.Errorf("unexpected vault response status %d", resp.StatusCode)
+	}
+
+	var secret Secret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+
+	return &secret, nil
+}
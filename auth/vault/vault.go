@@ -0,0 +1,483 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// Method is the Vault auth method MQTT credentials are checked against
+type Method byte
+
+const (
+	// Userpass authenticates the MQTT username and password against a userpass auth method
+	Userpass Method = iota
+
+	// AppRole authenticates the MQTT username as role_id and the password as secret_id against an
+	// approle auth method
+	AppRole
+
+	// TokenLookup treats the MQTT password as a Vault token and looks it up. The identity is the
+	// username in the token's metadata, or its display name, and a CONNECT with any other username
+	// is rejected
+	TokenLookup
+)
+
+// errInvalidSegment is returned for the values which can't be substituted into ACLPath
+var errInvalidSegment = errors.New("invalid acl path segment")
+
+// Hook is a hook that authenticates clients against HashiCorp Vault, and optionally reads the topic
+// permissions of each identity from a KV secret
+type Hook struct {
+	config   Options
+	client   *client
+	token    string // the hook's own token, used to read ACL secrets
+	tokenMu  sync.RWMutex
+	cancel   context.CancelFunc
+	sessions acl.Sessions
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the Vault hook.
+// It is the responsibility of the configurer to pass a properly configured RoundTripper that takes
+// care of other requirements such as TLS, timeouts, etc
+type Options struct {
+	Address      string // eg. https://vault.example.com:8200
+	Namespace    string // Vault Enterprise namespace, if any
+	RoundTripper http.RoundTripper
+	Timeout      time.Duration // bounds each request to Vault, defaults to 5 seconds
+
+	Method Method // the auth method MQTT credentials are checked against
+	Mount  string // mount path of the auth method, defaults to userpass or approle
+
+	// ACLPath is a KV path template holding the topic filter templates of an identity, eg.
+	// "secret/data/mqtt/{username}" for KV v2. It may reference {username}, {clientid} and {entity_id},
+	// and the secret, eg. {"devices/{username}/#": "rw"}, may reference the same values and the
+	// identity's metadata
+	ACLPath   string
+	KVVersion int // 1 or 2, defaults to 2
+
+	// Token, or RoleID and SecretID, are the credentials the hook reads ACL secrets with. Renewable
+	// tokens are renewed in the background, and AppRole logins are repeated once renewal fails
+	Token      string
+	RoleID     string
+	SecretID   string
+	LoginMount string // mount path of the approle the hook logs in with, defaults to approle
+
+	// ACL holds templates granted to every authenticated identity
+	ACL acl.Templates
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "vault-auth-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if len(h.config.ACL) == 0 && h.config.ACLPath == "" {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	vaultHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if vaultHookConfig.Address == "" {
+		return errors.New("vault address is required")
+	}
+
+	switch vaultHookConfig.Method {
+	case Userpass:
+		if vaultHookConfig.Mount == "" {
+			vaultHookConfig.Mount = "userpass"
+		}
+	case AppRole:
+		if vaultHookConfig.Mount == "" {
+			vaultHookConfig.Mount = "approle"
+		}
+	case TokenLookup:
+	default:
+		return fmt.Errorf("unknown auth method %d", vaultHookConfig.Method)
+	}
+
+	if vaultHookConfig.ACLPath != "" && vaultHookConfig.Token == "" && vaultHookConfig.RoleID == "" {
+		return errors.New("a token or approle credentials are required to read acl secrets")
+	}
+
+	if vaultHookConfig.KVVersion == 0 {
+		vaultHookConfig.KVVersion = 2
+	}
+
+	if vaultHookConfig.KVVersion != 1 && vaultHookConfig.KVVersion != 2 {
+		return fmt.Errorf("unsupported kv version %d", vaultHookConfig.KVVersion)
+	}
+
+	if vaultHookConfig.LoginMount == "" {
+		vaultHookConfig.LoginMount = "approle"
+	}
+
+	if vaultHookConfig.Timeout <= 0 {
+		vaultHookConfig.Timeout = 5 * time.Second
+	}
+
+	rt := vaultHookConfig.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	h.config = vaultHookConfig
+	h.client = &client{
+		httpClient: &http.Client{Transport: rt},
+		address:    strings.TrimSuffix(vaultHookConfig.Address, "/"),
+		namespace:  vaultHookConfig.Namespace,
+	}
+
+	if vaultHookConfig.ACLPath == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultHookConfig.Timeout)
+	defer cancel()
+
+	auth, err := h.login(ctx)
+	if err != nil {
+		return fmt.Errorf("vault login: %w", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	h.cancel = cancel
+	go h.maintainToken(ctx, auth)
+
+	return nil
+}
+
+// Stop stops renewing the hook's token
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// login obtains the hook's own token, either by logging in with AppRole or by looking up the static token
+func (h *Hook) login(ctx context.Context) (*SecretAuth, error) {
+	if h.config.RoleID != "" {
+		secret, err := h.client.do(ctx, http.MethodPost, "auth/"+h.config.LoginMount+"/login", "", map[string]string{
+			"role_id":   h.config.RoleID,
+			"secret_id": h.config.SecretID,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if secret == nil || secret.Auth == nil {
+			return nil, errors.New("approle login returned no token")
+		}
+
+		h.setToken(secret.Auth.ClientToken)
+		return secret.Auth, nil
+	}
+
+	secret, err := h.client.do(ctx, http.MethodGet, "auth/token/lookup-self", h.config.Token, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil {
+		return nil, errors.New("token lookup returned no data")
+	}
+
+	h.setToken(h.config.Token)
+	return &SecretAuth{
+		ClientToken:   h.config.Token,
+		LeaseDuration: int64(number(secret.Data["ttl"])),
+		Renewable:     secret.Data["renewable"] == true,
+	}, nil
+}
+
+// maintainToken renews the hook's token at two thirds of its lease, and logs in again once the token
+// can no longer be renewed
+func (h *Hook) maintainToken(ctx context.Context, auth *SecretAuth) {
+	for {
+		// tokens without a ttl, eg. root tokens, never expire
+		if auth.LeaseDuration <= 0 {
+			<-ctx.Done()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(auth.TTL() * 2 / 3):
+		}
+
+		next, err := h.renew(ctx, auth)
+		if err != nil {
+			h.Log.Error("error occurred while renewing vault token", "error", err)
+
+			// retry well before the current lease runs out
+			next = &SecretAuth{LeaseDuration: max(auth.LeaseDuration/3, 3)}
+		}
+		auth = next
+	}
+}
+
+// renew extends the lease of the hook's token, falling back to a new AppRole login
+func (h *Hook) renew(ctx context.Context, auth *SecretAuth) (*SecretAuth, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	if auth.Renewable {
+		secret, err := h.client.do(ctx, http.MethodPost, "auth/token/renew-self", h.currentToken(), map[string]string{})
+		if err == nil && secret != nil && secret.Auth != nil && secret.Auth.LeaseDuration >= auth.LeaseDuration/2 {
+			return secret.Auth, nil
+		}
+
+		// renewal is capped by the token's max ttl, so a shrinking lease means a new login is due
+		if err != nil {
+			h.Log.Warn("vault token renewal failed", "error", err)
+		}
+	}
+
+	return h.login(ctx)
+}
+
+func (h *Hook) setToken(token string) {
+	h.tokenMu.Lock()
+	defer h.tokenMu.Unlock()
+	h.token = token
+}
+
+func (h *Hook) currentToken() string {
+	h.tokenMu.RLock()
+	defer h.tokenMu.RUnlock()
+	return h.token
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ok, err := h.Authenticate(cl, pk)
+	if err != nil {
+		h.Log.Error("error occurred while authenticating with vault", "error", err)
+	}
+	return ok
+}
+
+// Authenticate authenticates the client, and returns an error if Vault couldn't be asked, rather than
+// rejecting the client, eg. so the composite hook falls back to its next backend
+func (h *Hook) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	if len(pk.Connect.Password) == 0 {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	identity, err := h.authenticate(ctx, string(pk.Connect.Username), string(pk.Connect.Password))
+	if errors.Is(err, ErrPermissionDenied) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(h.config.ACL) == 0 && h.config.ACLPath == "" {
+		return true, nil
+	}
+
+	values := map[string]string{}
+	for k, v := range identity.Metadata {
+		values[k] = v
+	}
+	values["username"] = string(pk.Connect.Username)
+	if h.config.Method == TokenLookup {
+		values["username"] = identity.Metadata["username"]
+	}
+	values["clientid"] = cl.ID
+	values["entity_id"] = identity.EntityID
+
+	filters := h.config.ACL.Render(values)
+	if h.config.ACLPath != "" {
+		templates, err := h.readACL(ctx, values)
+		if errors.Is(err, errInvalidSegment) {
+			h.Log.Warn("rejecting client with invalid acl path", "error", err, "client", cl.ID)
+			return false, nil
+		}
+
+		if err != nil {
+			return false, fmt.Errorf("failed reading vault acl: %w", err)
+		}
+		filters.Merge(templates.Render(values))
+	}
+	h.sessions.Set(cl, filters)
+
+	return true, nil
+}
+
+// authenticate checks the credentials with the configured auth method and returns the identity
+func (h *Hook) authenticate(ctx context.Context, username, password string) (*SecretAuth, error) {
+	var secret *Secret
+	var err error
+
+	switch h.config.Method {
+	case TokenLookup:
+		secret, err = h.client.do(ctx, http.MethodGet, "auth/token/lookup-self", password, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if secret == nil {
+			return nil, ErrPermissionDenied
+		}
+
+		metadata := map[string]string{}
+		if meta, ok := secret.Data["meta"].(map[string]any); ok {
+			for k, v := range meta {
+				if s, ok := v.(string); ok {
+					metadata[k] = s
+				}
+			}
+		}
+
+		// the username is taken from the token, as the one sent by the client proves nothing
+		name, _ := secret.Data["display_name"].(string)
+		if metadata["username"] != "" {
+			name = metadata["username"]
+		}
+
+		if username != "" && username != name {
+			return nil, ErrPermissionDenied
+		}
+		metadata["username"] = name
+
+		entityID, _ := secret.Data["entity_id"].(string)
+		return &SecretAuth{EntityID: entityID, Metadata: metadata}, nil
+
+	case AppRole:
+		secret, err = h.client.do(ctx, http.MethodPost, "auth/"+h.config.Mount+"/login", "", map[string]string{
+			"role_id":   username,
+			"secret_id": password,
+		})
+
+	default:
+		if username == "" {
+			return nil, ErrPermissionDenied
+		}
+
+		secret, err = h.client.do(ctx, http.MethodPost, "auth/"+h.config.Mount+"/login/"+url.PathEscape(username), "", map[string]string{
+			"password": password,
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil || secret.Auth == nil {
+		return nil, ErrPermissionDenied
+	}
+
+	// the login token is only a proof of the credentials, so it is revoked straight away
+	if _, err := h.client.do(ctx, http.MethodPost, "auth/token/revoke-self", secret.Auth.ClientToken, map[string]string{}); err != nil {
+		h.Log.Warn("failed to revoke vault login token", "error", err)
+	}
+
+	return secret.Auth, nil
+}
+
+// readACL reads the topic filter templates of an identity from the KV secret at ACLPath
+func (h *Hook) readACL(ctx context.Context, values map[string]string) (acl.Templates, error) {
+	path := h.config.ACLPath
+	for _, key := range []string{"username", "clientid", "entity_id"} {
+		if !strings.Contains(path, "{"+key+"}") {
+			continue
+		}
+
+		// escaping leaves dot segments as they are, which would walk up the path
+		if v := values[key]; v == "" || v == "." || v == ".." {
+			return nil, fmt.Errorf("%w: %s %q", errInvalidSegment, key, v)
+		}
+		path = strings.ReplaceAll(path, "{"+key+"}", url.PathEscape(values[key]))
+	}
+
+	secret, err := h.client.do(ctx, http.MethodGet, path, h.currentToken(), nil)
+	if errors.Is(err, ErrPermissionDenied) {
+		// the token may have been revoked or expired early, so log in again and retry once
+		if _, err := h.login(ctx); err != nil {
+			return nil, err
+		}
+		secret, err = h.client.do(ctx, http.MethodGet, path, h.currentToken(), nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil {
+		return acl.Templates{}, nil
+	}
+
+	data := secret.Data
+	if h.config.KVVersion == 2 {
+		data, _ = secret.Data["data"].(map[string]any)
+	}
+
+	templates := acl.Templates{}
+	for filter, v := range data {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid access for %q in %s", filter, path)
+		}
+
+		access, err := acl.ParseAccess(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access for %q in %s: %w", filter, path, err)
+		}
+		templates[filter] = access
+	}
+
+	return templates, nil
+}
+
+// number returns a JSON number as a float64, or 0
+func number(v any) float64 {
+	f, _ := v.(float64)
+	return f
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
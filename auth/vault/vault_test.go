@@ -0,0 +1,535 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// fakeVault implements the subset of the Vault HTTP API used by the hook
+type fakeVault struct {
+	t         *testing.T
+	users     map[string]string         // userpass username -> password
+	roles     map[string]string         // approle role_id -> secret_id
+	tokens    map[string]map[string]any // token -> lookup-self data
+	kv        map[string]map[string]any // path -> data
+	lease     int64
+	renewTTL  int64
+	logins    int
+	renewals  int
+	revoked   []string
+	serverErr bool
+	mu        sync.Mutex
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+	return &fakeVault{
+		t:     t,
+		users: map[string]string{"alice": "alice-secret"},
+		roles: map[string]string{"hook-role": "hook-secret", "device-role": "device-secret"},
+		tokens: map[string]map[string]any{
+			"s.device": {"entity_id": "ent-device", "meta": map[string]any{"fleet": "north"}},
+			"s.alice":  {"entity_id": "ent-alice", "display_name": "userpass-alice", "meta": map[string]any{"username": "alice"}},
+			"s.bob":    {"entity_id": "ent-bob", "display_name": "bob"},
+			"s.static": {"ttl": 0, "renewable": false},
+		},
+		kv: map[string]map[string]any{
+			"secret/data/mqtt/alice": {"data": map[string]any{"users/{username}/#": "rw", "fleet/{fleet}/#": "r"}},
+			"kv/mqtt/alice":          {"devices/#": "w"},
+		},
+		lease:    3600,
+		renewTTL: 3600,
+	}
+}
+
+func (v *fakeVault) reply(status int, body any) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	require.NoError(v.t, err)
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader(string(b))),
+	}, nil
+}
+
+func (v *fakeVault) RoundTrip(req *http.Request) (*http.Response, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.serverErr {
+		return v.reply(http.StatusInternalServerError, map[string]any{"errors": []string{"sealed"}})
+	}
+
+	require.Equal(v.t, "ns1", req.Header.Get("X-Vault-Namespace"))
+
+	body := map[string]string{}
+	if req.Body != nil && req.Method == http.MethodPost {
+		require.NoError(v.t, json.NewDecoder(req.Body).Decode(&body))
+	}
+
+	token := req.Header.Get("X-Vault-Token")
+	path := strings.TrimPrefix(req.URL.Path, "/v1/")
+	switch {
+	case strings.HasPrefix(path, "auth/userpass/login/"):
+		if p, ok := v.users[strings.TrimPrefix(path, "auth/userpass/login/")]; !ok || p != body["password"] {
+			return v.reply(http.StatusBadRequest, map[string]any{"errors": []string{"invalid username or password"}})
+		}
+		return v.reply(http.StatusOK, map[string]any{"auth": map[string]any{
+			"client_token": "s.login",
+			"entity_id":    "ent-alice",
+			"metadata":     map[string]string{"fleet": "south"},
+		}})
+
+	case path == "auth/approle/login":
+		if s, ok := v.roles[body["role_id"]]; !ok || s != body["secret_id"] {
+			return v.reply(http.StatusBadRequest, map[string]any{"errors": []string{"invalid role or secret id"}})
+		}
+
+		if body["role_id"] != "hook-role" {
+			return v.reply(http.StatusOK, map[string]any{"auth": map[string]any{"client_token": "s.login", "entity_id": "ent-role"}})
+		}
+
+		v.logins++
+		v.tokens["s.hook"] = map[string]any{}
+		return v.reply(http.StatusOK, map[string]any{"auth": map[string]any{
+			"client_token":   "s.hook",
+			"lease_duration": v.lease,
+			"renewable":      true,
+		}})
+
+	case path == "auth/token/renew-self":
+		v.renewals++
+		return v.reply(http.StatusOK, map[string]any{"auth": map[string]any{
+			"client_token":   token,
+			"lease_duration": v.renewTTL,
+			"renewable":      true,
+		}})
+
+	case path == "auth/token/revoke-self":
+		v.revoked = append(v.revoked, token)
+		return &http.Response{StatusCode: http.StatusNoContent, Body: io.NopCloser(strings.NewReader(""))}, nil
+
+	case path == "auth/token/lookup-self":
+		data, ok := v.tokens[token]
+		if !ok {
+			return v.reply(http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+		}
+		return v.reply(http.StatusOK, map[string]any{"data": data})
+	}
+
+	if _, ok := v.tokens[token]; !ok {
+		return v.reply(http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+	}
+
+	data, ok := v.kv[path]
+	if !ok {
+		return v.reply(http.StatusNotFound, map[string]any{"errors": []string{}})
+	}
+	return v.reply(http.StatusOK, map[string]any{"data": data})
+}
+
+func connectPacket(username, password string) packets.Packet {
+	return packets.Packet{
+		Connect: packets.ConnectParams{Username: []byte(username), Password: []byte(password)},
+	}
+}
+
+func newHook(t *testing.T, vault *fakeVault, options Options) *Hook {
+	t.Helper()
+
+	options.Address = "https://vault.example.com:8200/"
+	options.Namespace = "ns1"
+	options.RoundTripper = vault
+
+	vaultHook := new(Hook)
+	vaultHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, vaultHook.Init(options))
+	t.Cleanup(func() { vaultHook.Stop() })
+	return vaultHook
+}
+
+func TestID(t *testing.T) {
+	vaultHook := new(Hook)
+
+	require.Equal(t, "vault-auth-hook", vaultHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	vaultHook := new(Hook)
+	require.True(t, vaultHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, vaultHook.Provides(mqtt.OnACLCheck))
+
+	vaultHook.config.ACLPath = "secret/data/mqtt/{username}"
+	require.True(t, vaultHook.Provides(mqtt.OnACLCheck))
+	require.True(t, vaultHook.Provides(mqtt.OnDisconnect))
+	require.False(t, vaultHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - userpass",
+			config:      Options{Address: "https://vault.example.com:8200", Namespace: "ns1"},
+			expectError: false,
+		},
+		{
+			name:        "Success - acl path with approle",
+			config:      Options{Address: "https://vault.example.com:8200", Namespace: "ns1", ACLPath: "secret/data/mqtt/{username}", RoleID: "hook-role", SecretID: "hook-secret"},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing address",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown method",
+			config:      Options{Address: "https://vault.example.com:8200", Method: 9},
+			expectError: true,
+		},
+		{
+			name:        "Failure - acl path without credentials",
+			config:      Options{Address: "https://vault.example.com:8200", ACLPath: "secret/data/mqtt/{username}"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unsupported kv version",
+			config:      Options{Address: "https://vault.example.com:8200", KVVersion: 3},
+			expectError: true,
+		},
+		{
+			name:        "Error - approle login rejected",
+			config:      Options{Address: "https://vault.example.com:8200", Namespace: "ns1", ACLPath: "secret/data/mqtt/{username}", RoleID: "hook-role", SecretID: "wrong"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if options, ok := tt.config.(Options); ok {
+				options.RoundTripper = newFakeVault(t)
+				tt.config = options
+			}
+
+			vaultHook := new(Hook)
+			vaultHook.Log = slog.Default()
+			err := vaultHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, vaultHook.Stop())
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     Method
+		username   string
+		password   string
+		serverErr  bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - userpass",
+			method:     Userpass,
+			username:   "alice",
+			password:   "alice-secret",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - userpass wrong password",
+			method:     Userpass,
+			username:   "alice",
+			password:   "wrong",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - userpass path traversal",
+			method:     Userpass,
+			username:   "../../sys/health",
+			password:   "alice-secret",
+			expectPass: false,
+		},
+		{
+			name:       "Success - approle",
+			method:     AppRole,
+			username:   "device-role",
+			password:   "device-secret",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - approle wrong secret",
+			method:     AppRole,
+			username:   "device-role",
+			password:   "wrong",
+			expectPass: false,
+		},
+		{
+			name:       "Success - token lookup",
+			method:     TokenLookup,
+			password:   "s.device",
+			expectPass: true,
+		},
+		{
+			name:       "Success - token lookup with username of token",
+			method:     TokenLookup,
+			username:   "alice",
+			password:   "s.alice",
+			expectPass: true,
+		},
+		{
+			name:       "Success - token lookup with display name",
+			method:     TokenLookup,
+			username:   "bob",
+			password:   "s.bob",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - token lookup with username of another identity",
+			method:     TokenLookup,
+			username:   "alice",
+			password:   "s.bob",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unknown token",
+			method:     TokenLookup,
+			password:   "s.unknown",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - empty password",
+			method:     TokenLookup,
+			expectPass: false,
+		},
+		{
+			name:       "Error - vault unavailable",
+			method:     Userpass,
+			username:   "alice",
+			password:   "alice-secret",
+			serverErr:  true,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			vault := newFakeVault(t)
+			vault.serverErr = tt.serverErr
+			vaultHook := newHook(t, vault, Options{Method: tt.method})
+
+			success, err := vaultHook.Authenticate(&mqtt.Client{ID: "client"}, connectPacket(tt.username, tt.password))
+			require.Equal(t, tt.expectPass, success)
+
+			// rejected credentials aren't failures of vault
+			require.Equal(t, tt.serverErr, err != nil)
+
+			// login tokens are revoked once the credentials are verified
+			if tt.expectPass && tt.method != TokenLookup {
+				require.Equal(t, []string{"s.login"}, vault.revoked)
+			}
+
+		})
+	}
+}
+
+func TestOnACLCheck(t *testing.T) {
+	vault := newFakeVault(t)
+	vaultHook := newHook(t, vault, Options{
+		ACLPath:  "secret/data/mqtt/{username}",
+		RoleID:   "hook-role",
+		SecretID: "hook-secret",
+		ACL:      acl.Templates{"clients/{clientid}/#": acl.ReadWrite},
+	})
+
+	cl := &mqtt.Client{ID: "alice-laptop"}
+	require.True(t, vaultHook.OnConnectAuthenticate(cl, connectPacket("alice", "alice-secret")))
+
+	tests := []struct {
+		name       string
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - static template",
+			topic:      "clients/alice-laptop/status",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - kv template",
+			topic:      "users/alice/inbox",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - kv template with metadata",
+			topic:      "fleet/south/truck-1",
+			write:      false,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - kv template read only",
+			topic:      "fleet/south/truck-1",
+			write:      true,
+			expectPass: false,
+		},
+		{
+			name:       "Failure - other fleet",
+			topic:      "fleet/north/truck-1",
+			write:      false,
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, vaultHook.OnACLCheck(cl, tt.topic, tt.write))
+
+		})
+	}
+
+	vaultHook.OnDisconnect(cl, nil, true)
+	require.False(t, vaultHook.OnACLCheck(cl, "users/alice/inbox", true))
+}
+
+func TestOnACLCheckTokenLookup(t *testing.T) {
+	vault := newFakeVault(t)
+	vaultHook := newHook(t, vault, Options{
+		Method:   TokenLookup,
+		ACLPath:  "secret/data/mqtt/{username}",
+		RoleID:   "hook-role",
+		SecretID: "hook-secret",
+	})
+
+	// the identity of the token is used, rather than the username the client sent
+	cl := &mqtt.Client{ID: "client"}
+	require.True(t, vaultHook.OnConnectAuthenticate(cl, connectPacket("", "s.alice")))
+	require.True(t, vaultHook.OnACLCheck(cl, "users/alice/inbox", true))
+
+	require.False(t, vaultHook.OnConnectAuthenticate(&mqtt.Client{ID: "client"}, connectPacket("alice", "s.device")))
+}
+
+func TestReadACLDotSegments(t *testing.T) {
+	vault := newFakeVault(t)
+	vaultHook := newHook(t, vault, Options{
+		ACLPath:  "secret/data/mqtt/{username}/{clientid}",
+		RoleID:   "hook-role",
+		SecretID: "hook-secret",
+	})
+
+	for _, id := range []string{"..", "."} {
+		require.False(t, vaultHook.OnConnectAuthenticate(&mqtt.Client{ID: id}, connectPacket("alice", "alice-secret")), id)
+	}
+
+	_, err := vaultHook.readACL(context.Background(), map[string]string{"username": "alice"})
+	require.ErrorIs(t, err, errInvalidSegment)
+}
+
+func TestReadACLKVVersion1(t *testing.T) {
+	vault := newFakeVault(t)
+	vaultHook := newHook(t, vault, Options{
+		ACLPath:   "kv/mqtt/{username}",
+		KVVersion: 1,
+		Token:     "s.static",
+	})
+
+	cl := &mqtt.Client{ID: "client"}
+	require.True(t, vaultHook.OnConnectAuthenticate(cl, connectPacket("alice", "alice-secret")))
+	require.True(t, vaultHook.OnACLCheck(cl, "devices/a", true))
+	require.False(t, vaultHook.OnACLCheck(cl, "devices/a", false))
+}
+
+func TestReadACLRelogin(t *testing.T) {
+	vault := newFakeVault(t)
+	vaultHook := newHook(t, vault, Options{
+		ACLPath:  "secret/data/mqtt/{username}",
+		RoleID:   "hook-role",
+		SecretID: "hook-secret",
+	})
+	require.Equal(t, 1, vault.logins)
+
+	// the hook's token is revoked behind its back
+	vault.mu.Lock()
+	delete(vault.tokens, "s.hook")
+	vault.mu.Unlock()
+
+	cl := &mqtt.Client{ID: "client"}
+	require.True(t, vaultHook.OnConnectAuthenticate(cl, connectPacket("alice", "alice-secret")))
+	require.True(t, vaultHook.OnACLCheck(cl, "users/alice/inbox", true))
+	require.Equal(t, 2, vault.logins)
+}
+
+func TestRenew(t *testing.T) {
+	vault := newFakeVault(t)
+	vaultHook := newHook(t, vault, Options{
+		ACLPath:  "secret/data/mqtt/{username}",
+		RoleID:   "hook-role",
+		SecretID: "hook-secret",
+	})
+
+	auth, err := vaultHook.renew(context.Background(), &SecretAuth{LeaseDuration: 3600, Renewable: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(3600), auth.LeaseDuration)
+	require.Equal(t, 1, vault.renewals)
+	require.Equal(t, 1, vault.logins)
+
+	// the lease is capped by the max ttl, so the hook logs in again
+	vault.renewTTL = 60
+	_, err = vaultHook.renew(context.Background(), &SecretAuth{LeaseDuration: 3600, Renewable: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, vault.renewals)
+	require.Equal(t, 2, vault.logins)
+}
+
+func TestMaintainToken(t *testing.T) {
+	vault := newFakeVault(t)
+	vault.lease = 1
+	vault.renewTTL = 1
+	newHook(t, vault, Options{
+		ACLPath:  "secret/data/mqtt/{username}",
+		RoleID:   "hook-role",
+		SecretID: "hook-secret",
+	})
+
+	require.Eventually(t, func() bool {
+		vault.mu.Lock()
+		defer vault.mu.Unlock()
+		return vault.renewals >= 1
+	}, 3*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,717 @@
+// Package awsiot provides a bridge hook which maintains an MQTT connection to AWS IoT Core, mirroring
+// the messages published to matching local topics upstream and publishing the messages received on
+// matching AWS IoT topics to the broker, so the broker can act as an on-premises gateway for devices
+// which don't connect to AWS IoT themselves.
+//
+// The connection is authenticated by the X.509 certificate of an AWS IoT thing, eg.
+//
+//	cert, err := tls.LoadX509KeyPair("gateway.cert.pem", "gateway.private.key")
+//	if err != nil {
+//		return err
+//	}
+//
+//	err = server.AddHook(new(awsiot.Hook), awsiot.Options{
+//		Server:    server,
+//		Endpoint:  "a1b2c3d4e5f6g7-ats.iot.eu-west-1.amazonaws.com",
+//		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+//		ClientID:  "gateway",
+//		Rules: []awsiot.Rule{
+//			{Filter: "sensors/#", Topic: "sites/lyon/sensors/#"},
+//			{Filter: "commands/+", Topic: "sites/lyon/commands/+", Direction: awsiot.Down, Qos: 1},
+//		},
+//		Shadows: []string{"gateway", "thermostat-1"},
+//	})
+//
+// and the policy of the certificate must allow it to connect with the client id, to publish to the
+// mapped topics, and to subscribe to and receive from those of the inbound rules and shadows.
+package awsiot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+const (
+	// LocalClientID is the id of the inline client which publishes the messages received from aws iot
+	LocalClientID = "awsiot-bridge"
+
+	// maxPayload is the largest message aws iot core accepts, which closes the connection of clients
+	// publishing larger ones
+	maxPayload = 128 << 10
+
+	// echoWindow is how long a mirrored message is expected to be received back through a rule in
+	// both directions
+	echoWindow = 10 * time.Second
+)
+
+// Direction is which way a rule bridges messages
+type Direction int
+
+const (
+	Up   Direction = iota // from the broker to aws iot
+	Down                  // from aws iot to the broker
+	Both
+)
+
+var directionNames = []string{"up", "down", "both"}
+
+// String returns the name of the direction
+func (d Direction) String() string {
+	if d < 0 || int(d) >= len(directionNames) {
+		return fmt.Sprintf("direction(%d)", int(d))
+	}
+	return directionNames[d]
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler so the direction can be written as "up", "down" or
+// "both" in config files
+func (d *Direction) UnmarshalText(b []byte) error {
+	for i, name := range directionNames {
+		if string(b) == name {
+			*d = Direction(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown direction %q", b)
+}
+
+// Rule maps the local topics matching Filter to the aws iot topics matching Topic, and back. The
+// wildcards of the filter correspond to those of the topic, in the same order, so the levels matched by
+// one are substituted for the other, eg. a Filter of "sensors/#" and a Topic of "sites/lyon/sensors/#"
+// map "sensors/t1/temperature" to "sites/lyon/sensors/t1/temperature". Where is an optional filter
+// expression (see pkg/filter) messages mirrored upstream must also match, eg. "json.temperature > 30".
+// Transform is an optional template (see pkg/transform) the payloads of the messages are rewritten
+// with, eg. transform.Envelope
+type Rule struct {
+	Filter    string    `yaml:"filter" json:"filter"`
+	Where     string    `yaml:"where" json:"where"`
+	Transform string    `yaml:"transform" json:"transform"`
+	Topic     string    `yaml:"topic" json:"topic"`
+	Direction Direction `yaml:"direction" json:"direction"`
+
+	// Qos is that of the messages mirrored upstream, of the subscription of inbound rules, and of the
+	// messages published to the broker. Aws iot core only supports qos 0 and 1
+	Qos byte `yaml:"qos" json:"qos"`
+}
+
+// Metrics are called as messages are bridged and the connection changes. Unset funcs are skipped
+type Metrics struct {
+	// Forwarded is called for each message sent to aws iot, once acknowledged if its qos is 1
+	Forwarded func(topic string)
+
+	// Received is called for each message received from aws iot and published to the broker
+	Received func(topic string)
+
+	// Failed is called for each message which could not be bridged, and is discarded
+	Failed func(err error)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+
+	// Connected is called once connected, and Disconnected once the connection is lost
+	Connected    func()
+	Disconnected func(err error)
+}
+
+// Stats are the totals of the messages bridged since the hook was initialized
+type Stats struct {
+	Forwarded int64 // the number of messages sent to aws iot
+	Received  int64 // the number of messages received from aws iot and published to the broker
+	Failed    int64 // the number of messages which could not be bridged
+	Dropped   int64 // the number of messages discarded as the queue was full
+	Connects  int64 // the number of times the hook connected to aws iot
+}
+
+// message is a message waiting to be mirrored upstream, which is queued as JSON in buffers
+type message struct {
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Echo    bool   `json:"echo"` // whether it may be received back
+}
+
+// Hook is a hook that bridges messages between the broker and aws iot core
+type Hook struct {
+	config    Options
+	address   string
+	tlsConfig *tls.Config
+	client    *mqtt.Client // publishes the messages received from aws iot
+	bridge    *bridge.Bridge[message]
+	routes    []int                  // the rules bridging upstream of the routes of the bridge
+	echoes    map[[32]byte]time.Time // the mirrored messages which may be received back, until when
+	pruned    time.Time              // when the expired echoes were last deleted
+	conn      *conn                  // the connection to aws iot, while connected
+	ready     chan struct{}          // closed once connected
+	ctx       context.Context        // done once the hook has stopped
+	cancel    context.CancelFunc
+	started   bool
+	closed    bool
+	stats     Stats // of the messages received, and those which could not be
+	wg        sync.WaitGroup
+	mu        sync.Mutex // guards started and closed
+	echoMu    sync.Mutex // guards echoes and pruned
+	statsMu   sync.Mutex // guards stats, conn and ready
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the awsiot hook
+type Options struct {
+	// Server is the server inbound messages are published to, and is required if a rule is inbound
+	// or shadows are passed through. It is published a bridge.Warning to $SYS/bridges/awsiot/dropped
+	// when messages are dropped, if it is set
+	Server *mqtt.Server
+
+	// Endpoint is the device data endpoint of the aws account, whose port defaults to 8883. On port
+	// 443, the connection negotiates the x-amzn-mqtt-ca protocol, unless the tls config sets another
+	Endpoint string
+
+	// TLSConfig holds the certificate of the thing the hook connects as, and optionally the root
+	// certificates of aws iot
+	TLSConfig *tls.Config
+
+	// ClientID is the client id the hook connects with, usually the name of the thing
+	ClientID string
+
+	// Rules map local topics to aws iot topics. The first rule bridging upstream whose filter matches
+	// the topic of a message applies, and messages matching none aren't mirrored. Likewise the first
+	// rule bridging downstream whose topic matches that of a received message applies
+	Rules []Rule
+
+	// Shadows are the names of the things whose device shadow topics are passed through unchanged in
+	// both directions, so local devices can use them as if connected to aws iot
+	Shadows []string
+
+	// KeepAlive is how often the connection is checked while idle, defaults to 30 seconds, which is
+	// the least aws iot core allows
+	KeepAlive time.Duration
+
+	// Timeout is how long connecting, and aws iot acknowledging a message, may take, defaults to
+	// 10 seconds. When the hook stops, it is also how long the queued messages may take to be mirrored
+	Timeout time.Duration
+
+	// QueueSize is how many messages wait to be mirrored, defaults to 1000. Messages published while
+	// the queue is full, eg. because the connection is lost, wait for up to Block for room, and are
+	// then dropped by the Drop policy, which defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Buffer queues messages on disk rather than in memory if it is set, so the messages which haven't
+	// been mirrored survive restarts of the broker and long outages of the connection
+	Buffer *bridge.Buffer
+
+	// Backoff is the policy of the intervals between reconnections, which are retried by its Forever so
+	// they never give up
+	Backoff retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "awsiot-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	awsiotHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if awsiotHookConfig.Endpoint == "" {
+		return errors.New("endpoint is required")
+	}
+
+	if awsiotHookConfig.TLSConfig == nil || (len(awsiotHookConfig.TLSConfig.Certificates) == 0 && awsiotHookConfig.TLSConfig.GetClientCertificate == nil) {
+		return errors.New("tls config with a client certificate is required")
+	}
+
+	if awsiotHookConfig.ClientID == "" || len(awsiotHookConfig.ClientID) > 128 {
+		return errors.New("client id of at most 128 bytes is required")
+	}
+
+	if len(awsiotHookConfig.Rules) == 0 && len(awsiotHookConfig.Shadows) == 0 {
+		return errors.New("at least one rule or shadow is required")
+	}
+
+	var rules []Rule
+	for i, rule := range awsiotHookConfig.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	for _, thing := range awsiotHookConfig.Shadows {
+		if thing == "" || strings.ContainsAny(thing, "/+#") {
+			return fmt.Errorf("shadow of thing %q is invalid", thing)
+		}
+		rules = append(rules, shadowRule(thing))
+	}
+	awsiotHookConfig.Rules = rules
+
+	for i, rule := range rules {
+		if rule.Direction != Up && awsiotHookConfig.Server == nil {
+			return fmt.Errorf("rule %d is inbound, which requires a server", i)
+		}
+	}
+
+	host, port, err := net.SplitHostPort(awsiotHookConfig.Endpoint)
+	if err != nil {
+		host, port = awsiotHookConfig.Endpoint, "8883"
+	}
+
+	if awsiotHookConfig.KeepAlive <= 0 {
+		awsiotHookConfig.KeepAlive = 30 * time.Second
+	}
+
+	if awsiotHookConfig.Timeout <= 0 {
+		awsiotHookConfig.Timeout = 10 * time.Second
+	}
+
+	if awsiotHookConfig.QueueSize <= 0 {
+		awsiotHookConfig.QueueSize = 1000
+	}
+
+	h.config = awsiotHookConfig
+	h.address = net.JoinHostPort(host, port)
+	h.tlsConfig = awsiotHookConfig.TLSConfig.Clone()
+	if h.tlsConfig.ServerName == "" {
+		h.tlsConfig.ServerName = host
+	}
+	if port == "443" && len(h.tlsConfig.NextProtos) == 0 {
+		h.tlsConfig.NextProtos = []string{"x-amzn-mqtt-ca"}
+	}
+
+	h.echoes = map[[32]byte]time.Time{}
+	h.ready = make(chan struct{})
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	if awsiotHookConfig.Server != nil {
+		h.client = awsiotHookConfig.Server.NewClient(nil, "local", LocalClientID, true)
+		h.client.Properties.ProtocolVersion = 5
+	}
+
+	var filters, where, transforms []string
+	for i, rule := range rules {
+		if rule.Direction != Down {
+			h.routes = append(h.routes, i)
+			filters = append(filters, rule.Filter)
+			where = append(where, rule.Where)
+			transforms = append(transforms, rule.Transform)
+		}
+	}
+
+	if len(filters) == 0 {
+		return nil
+	}
+
+	h.bridge, err = bridge.New[message](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		Transform: transforms,
+		QueueSize: awsiotHookConfig.QueueSize,
+		Block:     awsiotHookConfig.Block,
+		Drop:      awsiotHookConfig.Drop,
+		Server:    awsiotHookConfig.Server,
+		Name:      "awsiot",
+		Buffer:    awsiotHookConfig.Buffer,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// OnStarted is called when the server has started, and connects to aws iot
+func (h *Hook) OnStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed || h.started {
+		return
+	}
+
+	h.started = true
+	h.wg.Add(1)
+	go h.run(h.ctx)
+}
+
+// Stop mirrors the queued messages, for at most the timeout, and disconnects from aws iot
+func (h *Hook) Stop() error {
+	h.mu.Lock()
+	if h.ctx == nil || h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	h.mu.Unlock()
+
+	if !h.started {
+		h.cancel() // the messages can't be mirrored without a connection
+	}
+
+	t := time.AfterFunc(h.config.Timeout, h.cancel)
+	var err error
+	if h.bridge != nil {
+		err = h.bridge.Close()
+	}
+	t.Stop()
+	h.cancel()
+	h.wg.Wait()
+
+	return err
+}
+
+// Stats returns the totals of the messages bridged so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	stats := h.stats
+	h.statsMu.Unlock()
+
+	if h.bridge != nil {
+		bridged := h.bridge.Stats()
+		stats.Forwarded = bridged.Sent
+		stats.Failed += bridged.Failed
+		stats.Dropped = bridged.Dropped
+	}
+	return stats
+}
+
+// Connected returns whether the hook is connected to aws iot
+func (h *Hook) Connected() bool {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.conn != nil
+}
+
+// OnPublished is called when a client has published a message, and queues it to be mirrored if a rule
+// bridging upstream matches its topic. Messages received from aws iot aren't mirrored back
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if h.bridge == nil || cl.ID == LocalClientID && cl.Net.Inline {
+		return
+	}
+
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, messages int, err error) {
+			for i := 0; i < messages; i++ {
+				h.config.Metrics.Failed(err)
+			}
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// run connects to aws iot, reconnecting whenever the connection is lost, until the context is done
+func (h *Hook) run(ctx context.Context) {
+	defer h.wg.Done()
+
+	h.config.Backoff.Forever(ctx, func(ctx context.Context) error {
+		c, err := h.connect(ctx)
+		if err == nil {
+			err = h.serve(ctx, c)
+		}
+
+		if err != nil && ctx.Err() == nil {
+			h.Log.Error("error occurred while connecting to aws iot", "error", err, "endpoint", h.address)
+		}
+		return err
+	})
+}
+
+// connect connects to aws iot, and subscribes to the topics of the rules bridging downstream
+func (h *Hook) connect(ctx context.Context) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	c, err := dial(ctx, h.address, h.tlsConfig, h.config.ClientID, h.config.KeepAlive, h.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	go c.serve(h.receive)
+
+	var filters packets.Subscriptions
+	for _, rule := range h.config.Rules {
+		if rule.Direction != Up {
+			filters = append(filters, packets.Subscription{Filter: rule.Topic, Qos: rule.Qos})
+		}
+	}
+
+	if err := c.subscribe(ctx, filters); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	h.statsMu.Lock()
+	h.stats.Connects++
+	h.conn = c
+	close(h.ready)
+	h.statsMu.Unlock()
+
+	h.Log.Info("connected to aws iot", "endpoint", h.address, "client", h.config.ClientID)
+	if h.config.Metrics.Connected != nil {
+		h.config.Metrics.Connected()
+	}
+
+	return c, nil
+}
+
+// serve keeps the connection, which the messages are mirrored through, until it is lost, returning
+// why, or the context is done
+func (h *Hook) serve(ctx context.Context, c *conn) error {
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-c.done:
+		err = c.err
+	}
+
+	c.close()
+
+	h.statsMu.Lock()
+	h.conn = nil
+	h.ready = make(chan struct{})
+	h.statsMu.Unlock()
+
+	if ctx.Err() == nil {
+		h.Log.Warn("disconnected from aws iot", "error", err, "endpoint", h.address)
+	}
+	if h.config.Metrics.Disconnected != nil {
+		h.config.Metrics.Disconnected(err)
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// current returns the connection to aws iot, waiting until the hook is connected or has stopped
+func (h *Hook) current() (*conn, error) {
+	for {
+		h.statsMu.Lock()
+		c, ready := h.conn, h.ready
+		h.statsMu.Unlock()
+
+		if c != nil {
+			return c, nil
+		}
+
+		select {
+		case <-ready:
+		case <-h.ctx.Done():
+			return nil, errors.New("stopped before connecting to aws iot")
+		}
+	}
+}
+
+// mirror publishes the message once connected. A message which fails closes the connection, as aws
+// iot closes it for most errors, and is published once more on the next connection
+func (h *Hook) mirror(msg message) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		c, cerr := h.current()
+		if cerr != nil {
+			return errors.Join(err, cerr)
+		}
+
+		if err = h.publish(c, msg); err == nil {
+			return nil
+		}
+		c.close()
+	}
+	return err
+}
+
+// publish mirrors the message through the connection, within the timeout
+func (h *Hook) publish(c *conn, msg message) error {
+	ctx, cancel := context.WithTimeout(h.ctx, h.config.Timeout)
+	defer cancel()
+
+	if msg.Echo {
+		h.expectEcho(msg.Topic, msg.Payload)
+	}
+
+	if err := c.publish(ctx, msg.Topic, msg.Payload, msg.Qos, msg.Retain); err != nil {
+		return err
+	}
+
+	if h.config.Metrics.Forwarded != nil {
+		h.config.Metrics.Forwarded(msg.Topic)
+	}
+	return nil
+}
+
+// sink encodes and mirrors the messages of the bridge of the hook
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the message mirroring that published by the client, with its topic mapped by the
+// rule of the route
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (message, error) {
+	rule := s.h.config.Rules[s.h.routes[route]]
+	topic, _ := rule.remote(pk.TopicName)
+	if len(pk.Payload) > maxPayload {
+		return message{}, fmt.Errorf("payload of %d bytes to %s is larger than %d", len(pk.Payload), topic, maxPayload)
+	}
+
+	return message{
+		Topic:   topic,
+		Payload: pk.Payload,
+		Qos:     rule.Qos,
+		Retain:  pk.FixedHeader.Retain,
+		Echo:    rule.Direction == Both,
+	}, nil
+}
+
+// Send mirrors the messages in order. It waits for the connection for as long as the hook runs rather
+// than the timeout of ctx, so messages are held while aws iot is unreachable, and each message is given
+// the Timeout of the hook once connected. The messages from the first which fails are returned in a
+// *bridge.PartialError
+func (s sink) Send(ctx context.Context, route int, msgs []message) error {
+	for i, msg := range msgs {
+		if err := s.h.mirror(msg); err != nil {
+			failed := make([]int, 0, len(msgs)-i)
+			for j := i; j < len(msgs); j++ {
+				failed = append(failed, j)
+			}
+			return &bridge.PartialError{Failed: failed, Err: err}
+		}
+	}
+	return nil
+}
+
+// receive publishes a message received from aws iot to the broker, through the first rule bridging
+// downstream which matches its topic
+func (h *Hook) receive(pk packets.Packet) {
+	for _, rule := range h.config.Rules {
+		if rule.Direction == Up {
+			continue
+		}
+
+		topic, ok := rule.local(pk.TopicName)
+		if !ok {
+			continue
+		}
+
+		if rule.Direction == Both && h.isEcho(pk.TopicName, pk.Payload) {
+			return
+		}
+
+		err := h.config.Server.InjectPacket(h.client, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Qos:    rule.Qos,
+				Retain: pk.FixedHeader.Retain,
+			},
+			TopicName: topic,
+			Payload:   pk.Payload,
+			PacketID:  uint16(rule.Qos), // as the server publishes, the packet id is only checked to be set
+		})
+		if err != nil {
+			h.fail(err, pk.TopicName)
+			return
+		}
+
+		h.statsMu.Lock()
+		h.stats.Received++
+		h.statsMu.Unlock()
+
+		if h.config.Metrics.Received != nil {
+			h.config.Metrics.Received(topic)
+		}
+		return
+	}
+}
+
+// fail counts a message to or from the aws iot topic which could not be bridged
+func (h *Hook) fail(err error, topic string) {
+	h.statsMu.Lock()
+	h.stats.Failed++
+	h.statsMu.Unlock()
+
+	h.Log.Error("error occurred while bridging message with aws iot", "error", err, "topic", topic)
+	if h.config.Metrics.Failed != nil {
+		h.config.Metrics.Failed(err)
+	}
+}
+
+// expectEcho records that the message mirrored to the topic may be received back, as aws iot delivers
+// messages to the subscriptions of the client which published them
+func (h *Hook) expectEcho(topic string, payload []byte) {
+	h.echoMu.Lock()
+	defer h.echoMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.pruned) > echoWindow {
+		for key, until := range h.echoes {
+			if now.After(until) {
+				delete(h.echoes, key)
+			}
+		}
+		h.pruned = now
+	}
+	h.echoes[echoKey(topic, payload)] = now.Add(echoWindow)
+}
+
+// isEcho returns whether the message received on the topic was mirrored by the hook
+func (h *Hook) isEcho(topic string, payload []byte) bool {
+	h.echoMu.Lock()
+	defer h.echoMu.Unlock()
+
+	key := echoKey(topic, payload)
+	until, ok := h.echoes[key]
+	delete(h.echoes, key)
+	return ok && time.Now().Before(until)
+}
+
+// echoKey returns the key of a message in the echoes
+func echoKey(topic string, payload []byte) [32]byte {
+	s := sha256.New()
+	s.Write([]byte(topic))
+	s.Write([]byte{0})
+	s.Write(payload)
+
+	var key [32]byte
+	s.Sum(key[:0])
+	return key
+}
@@ -0,0 +1,433 @@
+package awsiot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// certificates returns the tls configs of a server requiring client certificates, and of a client
+func certificates(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, ca, ca, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) tls.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"localhost"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}, ca, &key.PublicKey, key)
+		require.NoError(t, err)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	return &tls.Config{
+			Certificates: []tls.Certificate{issue(2, x509.ExtKeyUsageServerAuth)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}, &tls.Config{
+			Certificates: []tls.Certificate{issue(3, x509.ExtKeyUsageClientAuth)},
+			RootCAs:      pool,
+		}
+}
+
+// collector records the messages received by a subscription
+type collector struct {
+	received []packets.Packet
+	mu       sync.Mutex
+}
+
+func (c *collector) receive(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.received = append(c.received, pk)
+}
+
+func (c *collector) topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var topics []string
+	for _, pk := range c.received {
+		topics = append(topics, pk.TopicName)
+	}
+	return topics
+}
+
+// newCloud returns a started server standing in for aws iot core, and its endpoint
+func newCloud(t *testing.T, config *tls.Config) (*mqtt.Server, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	cloud := mqtt.New(&mqtt.Options{InlineClient: true})
+	cloud.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, cloud.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, cloud.AddListener(listeners.NewTCP("tls", address, &listeners.Config{TLSConfig: config})))
+	require.NoError(t, cloud.Serve())
+	t.Cleanup(func() { cloud.Close() })
+
+	_, port, _ := net.SplitHostPort(address)
+	return cloud, net.JoinHostPort("localhost", port)
+}
+
+// newGateway returns a started server with the hook
+func newGateway(t *testing.T, options Options) (*mqtt.Server, *Hook) {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	options.Server = server
+	awsiotHook := new(Hook)
+	require.NoError(t, server.AddHook(awsiotHook, options))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() {
+		awsiotHook.Stop()
+		server.Close()
+	})
+
+	return server, awsiotHook
+}
+
+func TestID(t *testing.T) {
+	awsiotHook := new(Hook)
+
+	require.Equal(t, "awsiot-bridge-hook", awsiotHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	awsiotHook := new(Hook)
+
+	require.True(t, awsiotHook.Provides(mqtt.OnStarted))
+	require.True(t, awsiotHook.Provides(mqtt.OnPublished))
+	require.False(t, awsiotHook.Provides(mqtt.OnPublish))
+}
+
+func TestDirection(t *testing.T) {
+	require.Equal(t, "down", Down.String())
+	require.Equal(t, "direction(7)", Direction(7).String())
+
+	var d Direction
+	require.NoError(t, d.UnmarshalText([]byte("both")))
+	require.Equal(t, Both, d)
+	require.Error(t, d.UnmarshalText([]byte("sideways")))
+}
+
+func TestInit(t *testing.T) {
+	server := mqtt.New(nil)
+	config := &tls.Config{Certificates: []tls.Certificate{{}}}
+	rules := []Rule{{Filter: "sensors/#", Topic: "sites/lyon/sensors/#"}}
+
+	tests := []struct {
+		name          string
+		config        any
+		expectError   bool
+		expectAddress string
+	}{
+		{
+			name:          "Success - rules",
+			config:        Options{Endpoint: "iot.example.com", TLSConfig: config, ClientID: "gateway", Rules: rules},
+			expectAddress: "iot.example.com:8883",
+		},
+		{
+			name:          "Success - shadows",
+			config:        Options{Server: server, Endpoint: "iot.example.com:443", TLSConfig: config, ClientID: "gateway", Shadows: []string{"gateway"}},
+			expectAddress: "iot.example.com:443",
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no endpoint",
+			config:      Options{TLSConfig: config, ClientID: "gateway", Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no client certificate",
+			config:      Options{Endpoint: "iot.example.com", TLSConfig: new(tls.Config), ClientID: "gateway", Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no client id",
+			config:      Options{Endpoint: "iot.example.com", TLSConfig: config, Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Endpoint: "iot.example.com", TLSConfig: config, ClientID: "gateway"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Endpoint: "iot.example.com", TLSConfig: config, ClientID: "gateway", Rules: []Rule{{Filter: "sensors/#", Topic: "sensors/+"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid shadow",
+			config:      Options{Server: server, Endpoint: "iot.example.com", TLSConfig: config, ClientID: "gateway", Shadows: []string{"site/gateway"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - inbound rule without server",
+			config:      Options{Endpoint: "iot.example.com", TLSConfig: config, ClientID: "gateway", Rules: []Rule{{Filter: "a", Topic: "b", Direction: Down}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			awsiotHook := new(Hook)
+			awsiotHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := awsiotHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.expectAddress, awsiotHook.address)
+				require.Equal(t, "iot.example.com", awsiotHook.tlsConfig.ServerName)
+				require.Equal(t, 30*time.Second, awsiotHook.config.KeepAlive)
+				require.NoError(t, awsiotHook.Stop())
+			}
+
+		})
+	}
+
+	// the tls config of port 443 negotiates the protocol of aws iot, and isn't modified in place
+	awsiotHook := new(Hook)
+	require.NoError(t, awsiotHook.Init(tests[1].config))
+	require.Equal(t, []string{"x-amzn-mqtt-ca"}, awsiotHook.tlsConfig.NextProtos)
+	require.Empty(t, config.NextProtos)
+}
+
+func TestBridge(t *testing.T) {
+	serverConfig, clientConfig := certificates(t)
+	cloud, endpoint := newCloud(t, serverConfig)
+
+	upstream := new(collector)
+	require.NoError(t, cloud.Subscribe("sites/lyon/sensors/#", 1, upstream.receive))
+	require.NoError(t, cloud.Subscribe("$aws/things/gateway/shadow/#", 2, upstream.receive))
+
+	var connected atomic.Int32
+	gateway, awsiotHook := newGateway(t, Options{
+		Endpoint:  endpoint,
+		TLSConfig: clientConfig,
+		ClientID:  "gateway",
+		Rules: []Rule{
+			{Filter: "sensors/#", Topic: "sites/lyon/sensors/#", Qos: 1},
+			{Filter: "commands/+", Topic: "sites/lyon/commands/+", Direction: Down, Qos: 1},
+		},
+		Shadows: []string{"gateway"},
+		Metrics: Metrics{
+			Connected: func() { connected.Add(1) },
+		},
+	})
+
+	downstream := new(collector)
+	require.NoError(t, gateway.Subscribe("commands/#", 1, downstream.receive))
+	require.NoError(t, gateway.Subscribe("$aws/things/gateway/shadow/#", 2, downstream.receive))
+
+	require.Eventually(t, awsiotHook.Connected, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool { return connected.Load() == 1 }, time.Second, time.Millisecond)
+
+	// local messages matching a rule are mirrored upstream with their topics mapped
+	require.NoError(t, gateway.Publish("sensors/t1/temperature", []byte("21.5"), false, 1))
+	require.NoError(t, gateway.Publish("other/t1", []byte("ignored"), false, 0))
+	require.Eventually(t, func() bool {
+		return len(upstream.topics()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{"sites/lyon/sensors/t1/temperature"}, upstream.topics())
+
+	// and messages received on the topics of inbound rules are published locally
+	require.NoError(t, cloud.Publish("sites/lyon/commands/reboot", []byte("now"), false, 1))
+	require.Eventually(t, func() bool {
+		return len(downstream.topics()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{"commands/reboot"}, downstream.topics())
+
+	// shadow topics pass through in both directions, without the updates being received back
+	require.NoError(t, gateway.Publish("$aws/things/gateway/shadow/update", []byte(`{"state":{}}`), false, 1))
+	require.Eventually(t, func() bool {
+		return len(upstream.topics()) == 2
+	}, time.Second, time.Millisecond)
+	require.NoError(t, cloud.Publish("$aws/things/gateway/shadow/update/accepted", []byte(`{}`), false, 1))
+	require.Eventually(t, func() bool {
+		return len(downstream.topics()) == 3
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{
+		"commands/reboot",
+		"$aws/things/gateway/shadow/update",
+		"$aws/things/gateway/shadow/update/accepted",
+	}, downstream.topics())
+
+	require.NoError(t, awsiotHook.Stop())
+	require.False(t, awsiotHook.Connected())
+	require.Equal(t, Stats{Forwarded: 2, Received: 2, Connects: 1}, awsiotHook.Stats())
+}
+
+func TestReconnect(t *testing.T) {
+	serverConfig, clientConfig := certificates(t)
+	cloud, endpoint := newCloud(t, serverConfig)
+
+	upstream := new(collector)
+	require.NoError(t, cloud.Subscribe("sites/#", 1, upstream.receive))
+
+	var disconnected []error
+	gateway, awsiotHook := newGateway(t, Options{
+		Endpoint:  endpoint,
+		TLSConfig: clientConfig,
+		ClientID:  "gateway",
+		Rules:     []Rule{{Filter: "sensors/#", Topic: "sites/lyon/sensors/#"}},
+		Backoff:   retry.Policy{InitialInterval: time.Millisecond},
+		Metrics: Metrics{
+			Disconnected: func(err error) { disconnected = append(disconnected, err) },
+		},
+	})
+	require.Eventually(t, awsiotHook.Connected, time.Second, time.Millisecond)
+
+	// the connection is lost, and the hook reconnects
+	cl, ok := cloud.Clients.Get("gateway")
+	require.True(t, ok)
+	cloud.DisconnectClient(cl, packets.ErrAdministrativeAction)
+	require.Eventually(t, func() bool {
+		return awsiotHook.Stats().Connects == 2 && awsiotHook.Connected()
+	}, time.Second, time.Millisecond)
+	require.Len(t, disconnected, 1)
+	require.ErrorIs(t, disconnected[0], ErrConnectionLost)
+
+	require.NoError(t, gateway.Publish("sensors/t1/temperature", []byte("21.5"), false, 0))
+	require.Eventually(t, func() bool {
+		return len(upstream.topics()) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestUnreachable(t *testing.T) {
+	_, clientConfig := certificates(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	endpoint := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	var dropped int
+	gateway, awsiotHook := newGateway(t, Options{
+		Endpoint:  endpoint,
+		TLSConfig: clientConfig,
+		ClientID:  "gateway",
+		Rules:     []Rule{{Filter: "sensors/#", Topic: "sites/lyon/sensors/#"}},
+		Timeout:   10 * time.Millisecond,
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// messages wait for the connection while disconnected, and are queued until the queue is full
+	require.NoError(t, gateway.Publish("sensors/t1", []byte("a"), false, 0))
+	require.Eventually(t, func() bool {
+		return awsiotHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, gateway.Publish("sensors/t2", []byte("b"), false, 0))
+	require.NoError(t, gateway.Publish("sensors/t3", []byte("c"), false, 0))
+	require.NoError(t, gateway.Publish("sensors/t4", make([]byte, maxPayload+1), false, 0))
+	require.Equal(t, 1, dropped)
+
+	// and the hook stops once the timeout has passed, failing the messages which were waiting
+	require.NoError(t, awsiotHook.Stop())
+	require.False(t, awsiotHook.Connected())
+	require.Equal(t, Stats{Dropped: 1, Failed: 3}, awsiotHook.Stats())
+}
+
+func TestBuffer(t *testing.T) {
+	serverConfig, clientConfig := certificates(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, l.Close())
+
+	options := Options{
+		Endpoint:  net.JoinHostPort("localhost", port),
+		TLSConfig: clientConfig,
+		ClientID:  "gateway",
+		Rules:     []Rule{{Filter: "sensors/#", Topic: "sites/lyon/sensors/#"}},
+		Timeout:   10 * time.Millisecond,
+		Buffer:    &bridge.Buffer{Dir: t.TempDir()},
+	}
+	gateway, awsiotHook := newGateway(t, options)
+
+	// the first message is waiting for the connection when the hook stops, and the second is kept in
+	// the buffer
+	require.NoError(t, gateway.Publish("sensors/t1", []byte("a"), false, 0))
+	require.Eventually(t, func() bool {
+		return awsiotHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, gateway.Publish("sensors/t2", []byte("b"), false, 0))
+	require.NoError(t, awsiotHook.Stop())
+	require.Equal(t, Stats{Failed: 1}, awsiotHook.Stats())
+
+	// and is mirrored once the hook is restarted and connects
+	cloud, endpoint := newCloud(t, serverConfig)
+	upstream := new(collector)
+	require.NoError(t, cloud.Subscribe("sites/#", 1, upstream.receive))
+
+	options.Endpoint = endpoint
+	options.Timeout = time.Second
+	newGateway(t, options)
+	require.Eventually(t, func() bool {
+		return len(upstream.topics()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{"sites/lyon/sensors/t2"}, upstream.topics())
+}
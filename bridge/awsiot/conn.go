@@ -0,0 +1,325 @@
+package awsiot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// maxFilters is the most topic filters aws iot core accepts in a subscribe packet
+const maxFilters = 8
+
+// ErrConnectionLost is returned for the messages and subscriptions which were waiting to be
+// acknowledged when the connection was lost
+var ErrConnectionLost = errors.New("connection lost")
+
+// conn is an MQTT 3.1.1 connection to aws iot core, which publishes at most once or at least once
+type conn struct {
+	nc      *tls.Conn
+	r       *bufio.Reader
+	timeout time.Duration         // how long writes may take
+	idle    time.Duration         // how long the connection may be silent before it is considered lost
+	acks    map[uint16]chan error // the acks awaited, by packet id
+	next    uint16                // the id of the next packet awaiting an ack
+	err     error                 // why the connection was lost
+	done    chan struct{}         // closed once the connection is lost
+	mu      sync.Mutex            // guards acks, next and err
+	writeMu sync.Mutex
+}
+
+// dial connects to the address with the client id, and returns once the connection is accepted
+func dial(ctx context.Context, address string, config *tls.Config, clientID string, keepAlive, timeout time.Duration) (*conn, error) {
+	d := tls.Dialer{Config: config}
+	nc, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &conn{
+		nc:      nc.(*tls.Conn),
+		r:       bufio.NewReader(nc),
+		timeout: timeout,
+		idle:    keepAlive * 3 / 2,
+		acks:    map[uint16]chan error{},
+		done:    make(chan struct{}),
+	}
+
+	err = c.write(packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 4,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			ClientIdentifier: clientID,
+			Keepalive:        uint16(keepAlive / time.Second),
+			Clean:            true,
+		},
+	})
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	nc.SetReadDeadline(deadline)
+	pk, err := c.read()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if pk.FixedHeader.Type != packets.Connack {
+		nc.Close()
+		return nil, fmt.Errorf("unexpected packet type %d instead of connack", pk.FixedHeader.Type)
+	}
+
+	if pk.ReasonCode != 0 {
+		nc.Close()
+		return nil, fmt.Errorf("connection refused with code %d", pk.ReasonCode)
+	}
+
+	return c, nil
+}
+
+// serve reads the packets of the connection until it is lost, calling receive with the messages, and
+// sends pings so the connection is kept alive while it is idle
+func (c *conn) serve(receive func(pk packets.Packet)) {
+	go c.ping()
+
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(c.idle))
+		pk, err := c.read()
+		if err != nil {
+			c.lose(err)
+			return
+		}
+
+		switch pk.FixedHeader.Type {
+		case packets.Publish:
+			if pk.FixedHeader.Qos > 0 {
+				err := c.write(packets.Packet{
+					FixedHeader:     packets.FixedHeader{Type: packets.Puback},
+					ProtocolVersion: 4,
+					PacketID:        pk.PacketID,
+				})
+				if err != nil {
+					c.lose(err)
+					return
+				}
+			}
+			receive(pk)
+		case packets.Puback:
+			c.ack(pk.PacketID, nil)
+		case packets.Suback:
+			var err error
+			if bytes.IndexByte(pk.ReasonCodes, 0x80) >= 0 {
+				err = errors.New("subscription refused")
+			}
+			c.ack(pk.PacketID, err)
+		}
+	}
+}
+
+// ping sends a ping each half of the keep alive, until the connection is lost
+func (c *conn) ping() {
+	t := time.NewTicker(c.idle / 3)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+
+		if err := c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingreq}}); err != nil {
+			c.lose(err)
+			return
+		}
+	}
+}
+
+// publish sends a message, waiting until it is acknowledged if its qos is 1
+func (c *conn) publish(ctx context.Context, topic string, payload []byte, qos byte, retain bool) error {
+	pk := packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Qos: qos, Retain: retain},
+		ProtocolVersion: 4,
+		TopicName:       topic,
+		Payload:         payload,
+	}
+
+	if qos == 0 {
+		return c.write(pk)
+	}
+
+	return c.await(ctx, func(id uint16) error {
+		pk.PacketID = id
+		return c.write(pk)
+	})
+}
+
+// subscribe subscribes to the filters, waiting until the subscriptions are acknowledged
+func (c *conn) subscribe(ctx context.Context, filters packets.Subscriptions) error {
+	for len(filters) > 0 {
+		n := min(len(filters), maxFilters)
+		err := c.await(ctx, func(id uint16) error {
+			return c.write(packets.Packet{
+				FixedHeader:     packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+				ProtocolVersion: 4,
+				PacketID:        id,
+				Filters:         filters[:n],
+			})
+		})
+		if err != nil {
+			return err
+		}
+		filters = filters[n:]
+	}
+	return nil
+}
+
+// await sends a packet with a new id, and waits until it is acknowledged
+func (c *conn) await(ctx context.Context, send func(id uint16) error) error {
+	ack := make(chan error, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+
+	c.next++
+	if c.next == 0 {
+		c.next = 1
+	}
+	id := c.next
+	c.acks[id] = ack
+	c.mu.Unlock()
+
+	if err := send(id); err != nil {
+		c.lose(err)
+		return err
+	}
+
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.acks, id)
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// ack completes the wait for the packet id
+func (c *conn) ack(id uint16, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ack, ok := c.acks[id]; ok {
+		ack <- err
+		delete(c.acks, id)
+	}
+}
+
+// lose closes the connection, failing the packets awaiting an ack
+func (c *conn) lose(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	for id, ack := range c.acks {
+		ack <- c.err
+		delete(c.acks, id)
+	}
+
+	c.nc.Close()
+	close(c.done)
+}
+
+// close disconnects gracefully
+func (c *conn) close() {
+	c.write(packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}, ProtocolVersion: 4})
+	c.lose(errors.New("closed"))
+}
+
+// write sends the packet
+func (c *conn) write(pk packets.Packet) error {
+	var buf bytes.Buffer
+	var err error
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectEncode(&buf)
+	case packets.Publish:
+		err = pk.PublishEncode(&buf)
+	case packets.Puback:
+		err = pk.PubackEncode(&buf)
+	case packets.Subscribe:
+		err = pk.SubscribeEncode(&buf)
+	case packets.Pingreq:
+		err = pk.PingreqEncode(&buf)
+	case packets.Disconnect:
+		err = pk.DisconnectEncode(&buf)
+	default:
+		err = fmt.Errorf("unsupported packet type %d", pk.FixedHeader.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.nc.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err = c.nc.Write(buf.Bytes())
+	return err
+}
+
+// read reads the next packet
+func (c *conn) read() (packets.Packet, error) {
+	pk := packets.Packet{ProtocolVersion: 4}
+
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return pk, err
+	}
+
+	if err := pk.FixedHeader.Decode(b); err != nil {
+		return pk, err
+	}
+
+	n, _, err := packets.DecodeLength(c.r)
+	if err != nil {
+		return pk, err
+	}
+	pk.FixedHeader.Remaining = n
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return pk, err
+	}
+
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		err = pk.ConnackDecode(buf)
+	case packets.Publish:
+		err = pk.PublishDecode(buf)
+	case packets.Puback:
+		err = pk.PubackDecode(buf)
+	case packets.Suback:
+		err = pk.SubackDecode(buf)
+	}
+	return pk, err
+}
@@ -0,0 +1,116 @@
+package awsiot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+)
+
+// shadowRule returns the rule passing the shadow topics of the thing through in both directions
+func shadowRule(thing string) Rule {
+	filter := "$aws/things/" + thing + "/shadow/#"
+	return Rule{
+		Filter:    filter,
+		Topic:     filter,
+		Direction: Both,
+		Qos:       1,
+	}
+}
+
+// validate checks the filter and topic of the rule, and that their wildcards correspond
+func (r Rule) validate() error {
+	if r.Direction < Up || r.Direction > Both {
+		return fmt.Errorf("has invalid direction %d", r.Direction)
+	}
+
+	if !mqtt.IsValidFilter(r.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Filter)
+	}
+
+	if !mqtt.IsValidFilter(r.Topic, false) || strings.HasPrefix(r.Topic, "$share/") {
+		return fmt.Errorf("has invalid topic %q", r.Topic)
+	}
+
+	if wildcards(r.Filter) != wildcards(r.Topic) {
+		return fmt.Errorf("has wildcards in topic %q which don't correspond to those of %q", r.Topic, r.Filter)
+	}
+
+	if r.Qos > 1 {
+		return errors.New("has qos 2, which aws iot core doesn't support")
+	}
+	return nil
+}
+
+// remote returns the aws iot topic a message published to the local topic is mirrored to, and false
+// if the topic doesn't match the filter of the rule
+func (r Rule) remote(topic string) (string, bool) {
+	return mapTopic(r.Filter, r.Topic, topic)
+}
+
+// local returns the local topic a message received on the aws iot topic is published to, and false if
+// the topic doesn't match that of the rule
+func (r Rule) local(topic string) (string, bool) {
+	return mapTopic(r.Topic, r.Filter, topic)
+}
+
+// wildcards returns the wildcards of the filter, in order
+func wildcards(filter string) string {
+	var b strings.Builder
+	for _, level := range strings.Split(filter, "/") {
+		if level == "+" || level == "#" {
+			b.WriteString(level)
+		}
+	}
+	return b.String()
+}
+
+// mapTopic matches the topic against the from filter, and substitutes the levels matched by each of
+// its wildcards for the corresponding wildcard of the to filter. It returns false if the topic doesn't
+// match, or maps to an empty topic
+func mapTopic(from, to, topic string) (string, bool) {
+	if strings.HasPrefix(topic, "$") && (from[0] == '+' || from[0] == '#') {
+		return "", false
+	}
+
+	filter := strings.Split(from, "/")
+	levels := strings.Split(topic, "/")
+	if filter[len(filter)-1] != "#" && len(levels) != len(filter) {
+		return "", false
+	}
+
+	var captures [][]string
+	for i, f := range filter {
+		if f == "#" {
+			captures = append(captures, levels[i:]) // a multi level wildcard also matches its parent
+			break
+		}
+
+		if i >= len(levels) {
+			return "", false
+		}
+
+		switch {
+		case f == "+":
+			captures = append(captures, levels[i:i+1])
+		case f != levels[i]:
+			return "", false
+		}
+	}
+
+	var mapped []string
+	for _, t := range strings.Split(to, "/") {
+		if t == "+" || t == "#" {
+			mapped = append(mapped, captures[0]...)
+			captures = captures[1:]
+			continue
+		}
+		mapped = append(mapped, t)
+	}
+
+	if len(mapped) == 0 {
+		return "", false // the topic was only a wildcard matching no levels
+	}
+	return strings.Join(mapped, "/"), true
+}
@@ -0,0 +1,147 @@
+package awsiot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectError bool
+	}{
+		{
+			name: "Success - wildcards",
+			rule: Rule{Filter: "devices/+/telemetry/#", Topic: "sites/lyon/+/#", Direction: Both, Qos: 1},
+		},
+		{
+			name: "Success - shadow",
+			rule: shadowRule("gateway"),
+		},
+		{
+			name:        "Failure - invalid direction",
+			rule:        Rule{Filter: "a", Topic: "b", Direction: 3},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			rule:        Rule{Filter: "a/#/b", Topic: "b"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no topic",
+			rule:        Rule{Filter: "a"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - shared topic",
+			rule:        Rule{Filter: "a", Topic: "$share/group/a"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - wildcards which don't correspond",
+			rule:        Rule{Filter: "a/+/#", Topic: "b/#/+"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - qos 2",
+			rule:        Rule{Filter: "a", Topic: "b", Qos: 2},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestRuleMapping(t *testing.T) {
+	tests := []struct {
+		name         string
+		rule         Rule
+		topic        string
+		expectRemote string
+		expectMatch  bool
+	}{
+		{
+			name:         "Success - prefix",
+			rule:         Rule{Filter: "sensors/#", Topic: "sites/lyon/sensors/#"},
+			topic:        "sensors/t1/temperature",
+			expectRemote: "sites/lyon/sensors/t1/temperature",
+			expectMatch:  true,
+		},
+		{
+			name:         "Success - parent of multi level wildcard",
+			rule:         Rule{Filter: "sensors/#", Topic: "sites/lyon/sensors/#"},
+			topic:        "sensors",
+			expectRemote: "sites/lyon/sensors",
+			expectMatch:  true,
+		},
+		{
+			name:         "Success - reordered levels",
+			rule:         Rule{Filter: "devices/+/+", Topic: "telemetry/+/+"},
+			topic:        "devices/d1/temperature",
+			expectRemote: "telemetry/d1/temperature",
+			expectMatch:  true,
+		},
+		{
+			name:         "Success - literal",
+			rule:         Rule{Filter: "status", Topic: "sites/lyon/status"},
+			topic:        "status",
+			expectRemote: "sites/lyon/status",
+			expectMatch:  true,
+		},
+		{
+			name:  "Failure - too many levels",
+			rule:  Rule{Filter: "devices/+", Topic: "telemetry/+"},
+			topic: "devices/d1/temperature",
+		},
+		{
+			name:  "Failure - too few levels",
+			rule:  Rule{Filter: "devices/+/temperature", Topic: "telemetry/+"},
+			topic: "devices/d1",
+		},
+		{
+			name:  "Failure - other level",
+			rule:  Rule{Filter: "devices/+/temperature", Topic: "telemetry/+"},
+			topic: "devices/d1/humidity",
+		},
+		{
+			name:  "Failure - reserved topic",
+			rule:  Rule{Filter: "#", Topic: "sites/lyon/#"},
+			topic: "$SYS/broker/uptime",
+		},
+		{
+			name:  "Failure - empty topic",
+			rule:  Rule{Filter: "sensors/#", Topic: "#"},
+			topic: "sensors",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			remote, ok := tt.rule.remote(tt.topic)
+			require.Equal(t, tt.expectMatch, ok)
+			require.Equal(t, tt.expectRemote, remote)
+
+			if ok {
+				local, ok := tt.rule.local(remote)
+				require.True(t, ok)
+				require.Equal(t, tt.topic, local)
+			}
+
+		})
+	}
+}
@@ -0,0 +1,483 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// InboundClientID is the id of the inline client which publishes the consumed records
+const InboundClientID = "kafka-inbound-bridge"
+
+// Consumer reads records from Kafka as a member of a consumer group, usually a thin adapter of a Kafka
+// client, which manages the group and the partitions assigned to it, eg. for kafka-go with a Reader
+// created with a GroupID:
+//
+//	type consumer struct{ *kafka.Reader }
+//
+//	func (c consumer) Poll(ctx context.Context) ([]mqttkafka.Record, error) {
+//		m, err := c.FetchMessage(ctx)
+//		if err != nil {
+//			return nil, err
+//		}
+//		r := mqttkafka.Record{Topic: m.Topic, Key: m.Key, Value: m.Value, Time: m.Time, Partition: int32(m.Partition), Offset: m.Offset}
+//		for _, h := range m.Headers {
+//			r.Headers = append(r.Headers, mqttkafka.Header{Key: h.Key, Value: h.Value})
+//		}
+//		return []mqttkafka.Record{r}, nil
+//	}
+//
+//	func (c consumer) Commit(ctx context.Context, records []mqttkafka.Record) error {
+//		msgs := make([]kafka.Message, len(records))
+//		for i, r := range records {
+//			msgs[i] = kafka.Message{Topic: r.Topic, Partition: int(r.Partition), Offset: r.Offset}
+//		}
+//		return c.CommitMessages(ctx, msgs...)
+//	}
+type Consumer interface {
+	// Poll returns the next records, waiting for at least one until the context ends
+	Poll(ctx context.Context) ([]Record, error)
+
+	// Commit commits the offsets of the records, so the group resumes after them
+	Commit(ctx context.Context, records []Record) error
+
+	// Close leaves the group and closes the consumer
+	Close() error
+}
+
+// Pauser is implemented by consumers which can stop fetching records while they aren't polled, eg.
+// with PauseFetchTopics of franz-go, rather than buffering them
+type Pauser interface {
+	Pause()
+	Resume()
+}
+
+// CommitPolicy is when the offsets of consumed records are committed
+type CommitPolicy int
+
+const (
+	// CommitAfterPublish commits the records of each poll once they are published, so none are lost
+	// but some may be published again after a crash
+	CommitAfterPublish CommitPolicy = iota
+
+	// CommitInterval commits the records published every CommitInterval, so more may be published
+	// again after a crash, for fewer commits
+	CommitInterval
+
+	// CommitBeforePublish commits the records of each poll before they are published, so none are
+	// published twice but some may be lost after a crash
+	CommitBeforePublish
+)
+
+var commitPolicyNames = []string{"after-publish", "interval", "before-publish"}
+
+// String returns the name of the commit policy
+func (p CommitPolicy) String() string {
+	if p < 0 || int(p) >= len(commitPolicyNames) {
+		return "commit-policy(" + strconv.Itoa(int(p)) + ")"
+	}
+	return commitPolicyNames[p]
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler so the commit policy can be written as
+// "after-publish", "interval" or "before-publish" in config files
+func (p *CommitPolicy) UnmarshalText(b []byte) error {
+	for i, name := range commitPolicyNames {
+		if string(b) == name {
+			*p = CommitPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown commit policy %q", b)
+}
+
+// InboundRule publishes the records of a Kafka topic to an MQTT topic. MQTTTopic is a template, in
+// which {topic} is the Kafka topic with its dots replaced by slashes, {1}, {2}... are the parts of the
+// Kafka topic between dots, {key} is the key of the record and {partition} its partition, eg.
+// "devices/{key}/commands"
+type InboundRule struct {
+	// Topic is the Kafka topic the rule applies to, and an empty topic applies to every topic
+	Topic string `yaml:"topic" json:"topic"`
+
+	MQTTTopic string `yaml:"mqtt_topic" json:"mqtt_topic"`
+	Qos       byte   `yaml:"qos" json:"qos"`
+	Retain    bool   `yaml:"retain" json:"retain"`
+}
+
+// values returns the values of the placeholders of the MQTT topic template of the rule for the record
+func (r InboundRule) values(record Record) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		switch name {
+		case "topic":
+			return strings.ReplaceAll(record.Topic, ".", "/"), true
+		case "key":
+			return string(record.Key), true
+		case "partition":
+			return strconv.Itoa(int(record.Partition)), true
+		}
+		return level(strings.Split(record.Topic, "."), name)
+	}
+}
+
+// InboundMetrics are called as records are consumed. Unset funcs are skipped
+type InboundMetrics struct {
+	// Published is called for each record published to the broker
+	Published func(topic string)
+
+	// Failed is called for each record which could not be published, and is skipped
+	Failed func(err error)
+
+	// Paused is called when consuming is paused because the broker is backed up, and resumed
+	Paused func(paused bool)
+}
+
+// InboundStats are the totals of the records consumed since the hook was initialized
+type InboundStats struct {
+	Published int64 // the number of records published to the broker
+	Failed    int64 // the number of records which could not be published
+	Skipped   int64 // the number of records matching no rule
+	Pauses    int64 // the number of times consuming was paused
+}
+
+// InboundHook is a hook that consumes records from Kafka and publishes them to the broker
+type InboundHook struct {
+	config  InboundOptions
+	client  *mqtt.Client // publishes the consumed records
+	pending []Record     // the records published since the last commit with CommitInterval
+	paused  atomic.Bool
+	stats   InboundStats
+	statsMu sync.Mutex
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mqtt.HookBase
+}
+
+// InboundOptions is a struct that contains all the information required to configure the kafka
+// inbound hook
+type InboundOptions struct {
+	// Server is the server the records are published to
+	Server *mqtt.Server
+
+	// Consumer reads the records, and is closed when the hook stops
+	Consumer Consumer
+
+	// Rules map Kafka topics to MQTT topics, and the first whose topic matches a record applies.
+	// Records matching no rule are skipped
+	Rules []InboundRule
+
+	// Commit is when offsets are committed, and CommitInterval how often with CommitInterval,
+	// defaulting to 5 seconds
+	Commit         CommitPolicy
+	CommitInterval time.Duration
+
+	// MaxInflight pauses consuming while the broker has as many QoS 1 and 2 messages in flight to its
+	// clients, until they fall below it. Consuming is never paused if it is 0
+	MaxInflight int64
+
+	// Timeout is how long committing offsets may take, defaults to 10 seconds
+	Timeout time.Duration
+
+	// Backoff spaces polls which fail, defaulting to intervals from 100ms to 10 seconds. Polls are
+	// retried by its Forever, so polling never gives up
+	Backoff retry.Policy
+
+	Metrics InboundMetrics
+}
+
+// ID returns the ID of the hook
+func (h *InboundHook) ID() string {
+	return "kafka-inbound-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *InboundHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *InboundHook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	inboundHookConfig, ok := config.(InboundOptions)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if inboundHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if inboundHookConfig.Consumer == nil {
+		return errors.New("consumer is required")
+	}
+
+	if len(inboundHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range inboundHookConfig.Rules {
+		if err := bridge.Render(rule.MQTTTopic, rule.values(Record{}), func(string) {}); err != nil {
+			return fmt.Errorf("rule %d has invalid mqtt topic %q: %w", i, rule.MQTTTopic, err)
+		}
+
+		if rule.MQTTTopic == "" {
+			return fmt.Errorf("rule %d has no mqtt topic", i)
+		}
+
+		if rule.Qos > 2 {
+			return fmt.Errorf("rule %d has invalid qos %d", i, rule.Qos)
+		}
+	}
+
+	if inboundHookConfig.CommitInterval <= 0 {
+		inboundHookConfig.CommitInterval = 5 * time.Second
+	}
+
+	if inboundHookConfig.Timeout <= 0 {
+		inboundHookConfig.Timeout = 10 * time.Second
+	}
+
+	h.config = inboundHookConfig
+	h.client = inboundHookConfig.Server.NewClient(nil, "local", InboundClientID, true)
+	h.client.Properties.ProtocolVersion = 5
+	return nil
+}
+
+// OnStarted is called when the server has started, and starts consuming records
+func (h *InboundHook) OnStarted() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	h.wg.Add(1)
+	go h.consume(ctx)
+}
+
+// Stop stops consuming, commits the records published since the last commit, and closes the consumer
+func (h *InboundHook) Stop() error {
+	if h.cancel == nil {
+		return nil
+	}
+
+	h.cancel()
+	h.wg.Wait()
+	h.cancel = nil
+
+	return errors.Join(h.commit(h.pending), h.config.Consumer.Close())
+}
+
+// Stats returns the totals of the records consumed so far
+func (h *InboundHook) Stats() InboundStats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// Paused returns whether consuming is paused because the broker is backed up
+func (h *InboundHook) Paused() bool {
+	return h.paused.Load()
+}
+
+// consume polls records and publishes them until the context is cancelled
+func (h *InboundHook) consume(ctx context.Context) {
+	defer h.wg.Done()
+
+	lastCommit := time.Now()
+	for ctx.Err() == nil {
+		if h.backpressure(ctx) {
+			continue
+		}
+
+		var records []Record
+		err := h.config.Backoff.Forever(ctx, func(ctx context.Context) error {
+			var err error
+			records, err = h.config.Consumer.Poll(ctx)
+			if err != nil && ctx.Err() == nil {
+				h.Log.Error("error occurred while polling kafka", "error", err)
+			}
+			return err
+		})
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+
+		if h.config.Commit == CommitBeforePublish {
+			if err := h.commit(records); err != nil {
+				continue // at most once, so they are skipped rather than published uncommitted
+			}
+		}
+
+		for _, r := range records {
+			h.publish(r)
+		}
+
+		switch h.config.Commit {
+		case CommitAfterPublish:
+			h.commit(records)
+		case CommitInterval:
+			h.pending = append(h.pending, records...)
+			if time.Since(lastCommit) >= h.config.CommitInterval && h.commit(h.pending) == nil {
+				h.pending, lastCommit = nil, time.Now()
+			}
+		}
+	}
+}
+
+// backpressure pauses the consumer while the broker is backed up, returning whether it is, after
+// waiting a little for it to catch up
+func (h *InboundHook) backpressure(ctx context.Context) bool {
+	backedUp := h.config.MaxInflight > 0 && atomic.LoadInt64(&h.config.Server.Info.Inflight) >= h.config.MaxInflight
+	if backedUp != h.paused.Load() {
+		h.paused.Store(backedUp)
+		if backedUp {
+			h.statsMu.Lock()
+			h.stats.Pauses++
+			h.statsMu.Unlock()
+		}
+
+		if pauser, ok := h.config.Consumer.(Pauser); ok {
+			if backedUp {
+				pauser.Pause()
+			} else {
+				pauser.Resume()
+			}
+		}
+
+		h.Log.Info("kafka consumer paused while broker is backed up", "paused", backedUp)
+		if h.config.Metrics.Paused != nil {
+			h.config.Metrics.Paused(backedUp)
+		}
+	}
+
+	if backedUp {
+		sleep(ctx, 50*time.Millisecond)
+	}
+	return backedUp
+}
+
+// commit commits the offsets of the records
+func (h *InboundHook) commit(records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	err := h.config.Consumer.Commit(ctx, records)
+	if err != nil {
+		h.Log.Error("error occurred while committing kafka offsets", "error", err, "records", len(records))
+	}
+	return err
+}
+
+// publish publishes the record to the broker with the first rule matching its topic
+func (h *InboundHook) publish(r Record) {
+	for _, rule := range h.config.Rules {
+		if rule.Topic != "" && rule.Topic != r.Topic {
+			continue
+		}
+
+		var topic strings.Builder
+		bridge.Render(rule.MQTTTopic, rule.values(r), func(s string) { topic.WriteString(s) })
+
+		err := h.inject(r, topic.String(), rule)
+
+		h.statsMu.Lock()
+		if err != nil {
+			h.stats.Failed++
+		} else {
+			h.stats.Published++
+		}
+		h.statsMu.Unlock()
+
+		if err != nil {
+			h.Log.Error("error occurred while publishing kafka record", "error", err, "topic", r.Topic, "partition", r.Partition, "offset", r.Offset)
+			if h.config.Metrics.Failed != nil {
+				h.config.Metrics.Failed(err)
+			}
+			return
+		}
+
+		if h.config.Metrics.Published != nil {
+			h.config.Metrics.Published(topic.String())
+		}
+		return
+	}
+
+	h.statsMu.Lock()
+	h.stats.Skipped++
+	h.statsMu.Unlock()
+}
+
+// inject publishes the record to the topic
+func (h *InboundHook) inject(r Record, topic string, rule InboundRule) error {
+	if topic == "" || !mqtt.IsValidFilter(topic, true) {
+		return fmt.Errorf("invalid mqtt topic %q", topic)
+	}
+
+	return h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    rule.Qos,
+			Retain: rule.Retain,
+		},
+		TopicName:  topic,
+		Payload:    r.Value,
+		PacketID:   uint16(rule.Qos), // as the server publishes, the packet id is only checked to be set
+		Properties: properties(r.Headers),
+	})
+}
+
+// properties returns the MQTT properties of the headers of a record, reversing those the hook gives
+// produced records, with the other headers as user properties
+func properties(headers []Header) packets.Properties {
+	var p packets.Properties
+	for _, h := range headers {
+		switch h.Key {
+		case HeaderTopic, HeaderClient, HeaderQos, HeaderRetain:
+		case HeaderContentType:
+			p.ContentType = string(h.Value)
+		case HeaderPayloadFormat:
+			p.PayloadFormat, p.PayloadFormatFlag = 0, true
+			if string(h.Value) == "1" {
+				p.PayloadFormat = 1
+			}
+		case HeaderResponseTopic:
+			p.ResponseTopic = string(h.Value)
+		case HeaderCorrelationData:
+			p.CorrelationData = h.Value
+		default:
+			p.User = append(p.User, packets.UserProperty{Key: h.Key, Val: string(h.Value)})
+		}
+	}
+	return p
+}
+
+// sleep waits for the duration, returning false if the context ended first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
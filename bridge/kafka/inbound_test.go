@@ -0,0 +1,404 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConsumer returns the batches sent to it, and records the records it commits
+type fakeConsumer struct {
+	polls     chan []Record
+	commits   [][]Record
+	commitErr error
+	paused    []bool
+	closed    bool
+	mu        sync.Mutex
+}
+
+func newFakeConsumer() *fakeConsumer {
+	return &fakeConsumer{polls: make(chan []Record, 10)}
+}
+
+func (c *fakeConsumer) Poll(ctx context.Context) ([]Record, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case records := <-c.polls:
+		if records == nil {
+			return nil, errors.New("broker not available")
+		}
+		return records, nil
+	}
+}
+
+func (c *fakeConsumer) Commit(ctx context.Context, records []Record) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.commitErr != nil {
+		return c.commitErr
+	}
+	c.commits = append(c.commits, records)
+	return nil
+}
+
+func (c *fakeConsumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConsumer) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = append(c.paused, true)
+}
+
+func (c *fakeConsumer) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = append(c.paused, false)
+}
+
+func (c *fakeConsumer) committed() [][]Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commits
+}
+
+// newInboundServer returns a started server with the inbound hook, and the messages published to
+// the broker
+func newInboundServer(t *testing.T, options InboundOptions) (*mqtt.Server, *InboundHook, func() []packets.Packet) {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	var mu sync.Mutex
+	var received []packets.Packet
+	require.NoError(t, server.Subscribe("#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		if strings.HasPrefix(pk.TopicName, "$") {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, pk)
+	}))
+
+	options.Server = server
+	inboundHook := new(InboundHook)
+	require.NoError(t, server.AddHook(inboundHook, options))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() {
+		inboundHook.Stop()
+		server.Close()
+	})
+
+	return server, inboundHook, func() []packets.Packet {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]packets.Packet(nil), received...)
+	}
+}
+
+func TestInboundID(t *testing.T) {
+	inboundHook := new(InboundHook)
+
+	require.Equal(t, "kafka-inbound-bridge-hook", inboundHook.ID())
+}
+
+func TestInboundProvides(t *testing.T) {
+	inboundHook := new(InboundHook)
+
+	require.True(t, inboundHook.Provides(mqtt.OnStarted))
+	require.False(t, inboundHook.Provides(mqtt.OnPublished))
+}
+
+func TestCommitPolicy(t *testing.T) {
+	require.Equal(t, "before-publish", CommitBeforePublish.String())
+	require.Equal(t, "commit-policy(7)", CommitPolicy(7).String())
+
+	var p CommitPolicy
+	require.NoError(t, p.UnmarshalText([]byte("interval")))
+	require.Equal(t, CommitInterval, p)
+	require.Error(t, p.UnmarshalText([]byte("never")))
+}
+
+func TestInboundInit(t *testing.T) {
+	server := mqtt.New(nil)
+	rules := []InboundRule{{MQTTTopic: "kafka/{topic}"}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - rules",
+			config:      InboundOptions{Server: server, Consumer: newFakeConsumer(), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      InboundOptions{Consumer: newFakeConsumer(), Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no consumer",
+			config:      InboundOptions{Server: server, Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      InboundOptions{Server: server, Consumer: newFakeConsumer()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no mqtt topic",
+			config:      InboundOptions{Server: server, Consumer: newFakeConsumer(), Rules: []InboundRule{{Topic: "a"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown placeholder",
+			config:      InboundOptions{Server: server, Consumer: newFakeConsumer(), Rules: []InboundRule{{MQTTTopic: "a/{client}"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid qos",
+			config:      InboundOptions{Server: server, Consumer: newFakeConsumer(), Rules: []InboundRule{{MQTTTopic: "a", Qos: 3}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			inboundHook := new(InboundHook)
+			inboundHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := inboundHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, 5*time.Second, inboundHook.config.CommitInterval)
+				require.Equal(t, InboundClientID, inboundHook.client.ID)
+				require.NoError(t, inboundHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestInboundPublish(t *testing.T) {
+	consumer := newFakeConsumer()
+	var published []string
+	_, inboundHook, received := newInboundServer(t, InboundOptions{
+		Consumer: consumer,
+		Rules: []InboundRule{
+			{Topic: "devices.commands", MQTTTopic: "devices/{key}/commands", Qos: 1},
+			{Topic: "", MQTTTopic: "kafka/{topic}/{partition}"},
+		},
+		Metrics: InboundMetrics{
+			Published: func(topic string) { published = append(published, topic) },
+		},
+	})
+
+	records := []Record{
+		{
+			Topic: "devices.commands",
+			Key:   []byte("d1"),
+			Value: []byte("reboot"),
+			Headers: []Header{
+				{Key: HeaderContentType, Value: []byte("text/plain")},
+				{Key: HeaderResponseTopic, Value: []byte("devices/d1/replies")},
+				{Key: HeaderClient, Value: []byte("c1")},
+				{Key: "site", Value: []byte("north")},
+			},
+		},
+		{Topic: "alerts.fire", Value: []byte("!"), Partition: 3, Offset: 9},
+		{Topic: "bad", Key: []byte("+"), Value: []byte("x")},
+	}
+	consumer.polls <- records
+
+	require.Eventually(t, func() bool {
+		return len(consumer.committed()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, records, consumer.committed()[0])
+	require.Equal(t, []string{"devices/d1/commands", "kafka/alerts/fire/3", "kafka/bad/0"}, published)
+
+	got := received()
+	require.Len(t, got, 3)
+	require.Equal(t, "devices/d1/commands", got[0].TopicName)
+	require.Equal(t, []byte("reboot"), got[0].Payload)
+	require.Equal(t, "text/plain", got[0].Properties.ContentType)
+	require.Equal(t, "devices/d1/replies", got[0].Properties.ResponseTopic)
+	require.Equal(t, []packets.UserProperty{{Key: "site", Val: "north"}}, got[0].Properties.User)
+	require.Equal(t, "kafka/alerts/fire/3", got[1].TopicName)
+
+	require.NoError(t, inboundHook.Stop())
+	require.True(t, consumer.closed)
+	require.Equal(t, InboundStats{Published: 3}, inboundHook.Stats())
+}
+
+func TestInboundInvalidTopic(t *testing.T) {
+	consumer := newFakeConsumer()
+	var failed int
+	_, inboundHook, received := newInboundServer(t, InboundOptions{
+		Consumer: consumer,
+		Rules:    []InboundRule{{Topic: "commands", MQTTTopic: "devices/{key}/commands"}},
+		Metrics: InboundMetrics{
+			Failed: func(err error) { failed++ },
+		},
+	})
+
+	// a key making the topic a filter fails, and a record of another topic matches no rule
+	consumer.polls <- []Record{
+		{Topic: "commands", Key: []byte("#"), Value: []byte("x")},
+		{Topic: "other", Value: []byte("y")},
+	}
+	require.Eventually(t, func() bool {
+		return len(consumer.committed()) == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, inboundHook.Stop())
+	require.Empty(t, received())
+	require.Equal(t, 1, failed)
+	require.Equal(t, InboundStats{Failed: 1, Skipped: 1}, inboundHook.Stats())
+}
+
+func TestInboundCommitPolicies(t *testing.T) {
+	t.Run("Success - interval commits on stop", func(t *testing.T) {
+
+		consumer := newFakeConsumer()
+		_, inboundHook, received := newInboundServer(t, InboundOptions{
+			Consumer:       consumer,
+			Rules:          []InboundRule{{MQTTTopic: "{topic}"}},
+			Commit:         CommitInterval,
+			CommitInterval: time.Hour,
+		})
+
+		consumer.polls <- []Record{{Topic: "a", Value: []byte("1")}}
+		consumer.polls <- []Record{{Topic: "b", Value: []byte("2")}}
+		require.Eventually(t, func() bool {
+			return len(received()) == 2
+		}, time.Second, time.Millisecond)
+		require.Empty(t, consumer.committed())
+
+		require.NoError(t, inboundHook.Stop())
+		require.Len(t, consumer.committed(), 1)
+		require.Len(t, consumer.committed()[0], 2)
+
+	})
+
+	t.Run("Failure - before publish skips uncommitted records", func(t *testing.T) {
+
+		consumer := newFakeConsumer()
+		consumer.commitErr = errors.New("rebalance in progress")
+		_, inboundHook, received := newInboundServer(t, InboundOptions{
+			Consumer: consumer,
+			Rules:    []InboundRule{{MQTTTopic: "{topic}"}},
+			Commit:   CommitBeforePublish,
+		})
+
+		consumer.polls <- []Record{{Topic: "a", Value: []byte("1")}}
+		consumer.polls <- nil // fails, so the record above has been handled once it is polled
+		require.Eventually(t, func() bool {
+			return len(consumer.polls) == 0
+		}, time.Second, time.Millisecond)
+
+		require.NoError(t, inboundHook.Stop())
+		require.Empty(t, received())
+		require.Equal(t, InboundStats{}, inboundHook.Stats())
+
+	})
+}
+
+func TestInboundBackpressure(t *testing.T) {
+	consumer := newFakeConsumer()
+	var paused atomic.Int64
+	server, inboundHook, received := newInboundServer(t, InboundOptions{
+		Consumer:    consumer,
+		Rules:       []InboundRule{{MQTTTopic: "{topic}"}},
+		MaxInflight: 10,
+		Metrics: InboundMetrics{
+			Paused: func(p bool) {
+				if p {
+					paused.Add(1)
+				}
+			},
+		},
+	})
+
+	// records aren't polled while the broker is backed up
+	atomic.StoreInt64(&server.Info.Inflight, 10)
+	require.Eventually(t, inboundHook.Paused, time.Second, time.Millisecond)
+	consumer.polls <- []Record{{Topic: "a", Value: []byte("1")}}
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, received())
+
+	atomic.StoreInt64(&server.Info.Inflight, 0)
+	require.Eventually(t, func() bool {
+		return len(received()) == 1
+	}, time.Second, time.Millisecond)
+	require.False(t, inboundHook.Paused())
+
+	require.NoError(t, inboundHook.Stop())
+	require.Equal(t, []bool{true, false}, consumer.paused)
+	require.Equal(t, int64(1), paused.Load())
+	require.Equal(t, int64(1), inboundHook.Stats().Pauses)
+}
+
+func TestInboundNotProducedBack(t *testing.T) {
+	producer := new(fakeProducer)
+	consumer := newFakeConsumer()
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	kafkaHook := new(Hook)
+	require.NoError(t, server.AddHook(kafkaHook, Options{
+		Producer: producer,
+		Rules:    []Rule{{Filter: "#", Topic: "mqtt"}},
+		Linger:   time.Millisecond,
+	}))
+	inboundHook := new(InboundHook)
+	require.NoError(t, server.AddHook(inboundHook, InboundOptions{
+		Server:   server,
+		Consumer: consumer,
+		Rules:    []InboundRule{{MQTTTopic: "{topic}"}},
+	}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	consumer.polls <- []Record{{Topic: "from-kafka", Value: []byte("1")}}
+	require.Eventually(t, func() bool {
+		return len(consumer.committed()) == 1
+	}, time.Second, time.Millisecond)
+	require.NoError(t, server.Publish("from-mqtt", []byte("2"), false, 0))
+
+	require.Eventually(t, func() bool {
+		return len(producer.produced()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []byte("2"), producer.produced()[0][0].Value)
+}
@@ -0,0 +1,355 @@
+// Package kafka provides a bridge hook producing the messages published to matching MQTT topics to
+// Kafka topics, in batches and in the background, so publishes don't wait for Kafka.
+//
+// Records are written by a Producer, which is a thin adapter of the Kafka client of the application,
+// eg. for kafka-go with a Writer created without a Topic, as each record names its own:
+//
+//	type producer struct{ *kafka.Writer }
+//
+//	func (p producer) Produce(ctx context.Context, records []mqttkafka.Record) error {
+//		msgs := make([]kafka.Message, len(records))
+//		for i, r := range records {
+//			msgs[i] = kafka.Message{Topic: r.Topic, Key: r.Key, Value: r.Value, Time: r.Time}
+//			for _, h := range r.Headers {
+//				msgs[i].Headers = append(msgs[i].Headers, kafka.Header{Key: h.Key, Value: h.Value})
+//			}
+//		}
+//		return p.WriteMessages(ctx, msgs...)
+//	}
+//
+//	func (p producer) SetCompression(c mqttkafka.Compression) error {
+//		p.Writer.Compression = kafka.Compression(c)
+//		return nil
+//	}
+//
+// Close is that of the *kafka.Writer
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// Record is a message produced to or consumed from Kafka
+type Record struct {
+	Topic   string
+	Key     []byte // nil if the rule has no key
+	Value   []byte
+	Headers []Header
+	Time    time.Time
+
+	// Partition and Offset locate consumed records, and are ignored when producing
+	Partition int32
+	Offset    int64
+}
+
+// Header is a header of a record
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Producer writes records to Kafka, usually a thin adapter of a Kafka client
+type Producer interface {
+	// Produce writes the records, which may be for several topics, and returns once Kafka has
+	// acknowledged them
+	Produce(ctx context.Context, records []Record) error
+
+	// Close flushes and closes the producer
+	Close() error
+}
+
+// Compression is the codec Kafka record batches are compressed with, numbered as in the Kafka
+// protocol
+type Compression int8
+
+const (
+	None Compression = iota
+	Gzip
+	Snappy
+	LZ4
+	Zstd
+)
+
+var compressionNames = []string{"none", "gzip", "snappy", "lz4", "zstd"}
+
+// String returns the name of the codec
+func (c Compression) String() string {
+	if c < 0 || int(c) >= len(compressionNames) {
+		return "compression(" + strconv.Itoa(int(c)) + ")"
+	}
+	return compressionNames[c]
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler so the codec can be written as "none", "gzip",
+// "snappy", "lz4" or "zstd" in config files
+func (c *Compression) UnmarshalText(b []byte) error {
+	for i, name := range compressionNames {
+		if string(b) == name {
+			*c = Compression(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown compression %q", b)
+}
+
+// Compressor is implemented by producers whose compression codec can be set by the hook
+type Compressor interface {
+	SetCompression(c Compression) error
+}
+
+// Rule maps the messages of the MQTT topics matching Filter, which may contain +/# wildcards, to a
+// Kafka topic. Topic and Key are templates, in which {topic} is the MQTT topic with its levels joined
+// by dots, {client} is the id of the publishing client, and {1}, {2}... are the levels of the MQTT
+// topic, eg. a Topic of "telemetry.{2}" and a Key of "{client}". Characters Kafka doesn't allow in
+// topic names are replaced by underscores, and records have no key if Key is empty. Where is an
+// optional filter expression (see pkg/filter) messages must also match, eg. "json.temperature > 30".
+// Transform is an optional template (see pkg/transform) the payloads of the messages are rewritten
+// with, eg. transform.Envelope
+type Rule struct {
+	Filter    string `yaml:"filter" json:"filter"`
+	Where     string `yaml:"where" json:"where"`
+	Transform string `yaml:"transform" json:"transform"`
+	Topic     string `yaml:"topic" json:"topic"`
+	Key       string `yaml:"key" json:"key"`
+}
+
+// Metrics are called as records are produced, eg. to export their delivery. Unset funcs are skipped
+type Metrics struct {
+	// Delivered is called after a batch has been acknowledged, with how long producing it took
+	Delivered func(records int, took time.Duration)
+
+	// Failed is called after a batch could not be produced, and its records are discarded
+	Failed func(records int, err error)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+}
+
+// Stats are the totals of the records produced since the hook was initialized
+type Stats struct {
+	Batches   int64 // the number of batches produced, or which failed
+	Delivered int64 // the number of records acknowledged by Kafka
+	Failed    int64 // the number of records which could not be produced
+	Dropped   int64 // the number of messages discarded as the queue was full
+}
+
+// Hook is a hook that produces the messages published to matching topics to Kafka
+type Hook struct {
+	config  Options
+	bridge  *bridge.Bridge[Record]
+	stopped atomic.Bool
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the kafka hook
+type Options struct {
+	// Producer writes the records, and is closed when the hook stops
+	Producer Producer
+
+	// Rules map MQTT topics to Kafka topics, and the first whose filter matches the topic of a
+	// message applies. Messages matching no rule aren't produced
+	Rules []Rule
+
+	// Compression is set on the producer, which must be a Compressor unless it is None
+	Compression Compression
+
+	BatchSize int           // the most records of a rule produced at once, defaults to 100
+	Linger    time.Duration // how long a batch waits for more records, defaults to 10ms
+	Timeout   time.Duration // how long producing a batch may take, defaults to 10 seconds
+
+	// QueueSize is how many records wait to be produced, defaults to 10000. Messages published while
+	// the queue is full, eg. because Kafka is unavailable, wait for up to Block for room, and are then
+	// dropped by the Drop policy, which defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Server publishes a bridge.Warning to $SYS/bridges/kafka/dropped when messages are dropped, if set
+	Server *mqtt.Server
+
+	// Buffer queues records on disk rather than in memory if it is set, so the records which haven't
+	// been produced survive restarts of the broker and long outages of Kafka
+	Buffer *bridge.Buffer
+
+	// Retry retries batches which fail, and must limit the attempts or the time spent. Batches are
+	// produced once if it is nil
+	Retry *retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "kafka-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts producing records
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	kafkaHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if kafkaHookConfig.Producer == nil {
+		return errors.New("producer is required")
+	}
+
+	if len(kafkaHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range kafkaHookConfig.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+	}
+
+	if kafkaHookConfig.Retry != nil && kafkaHookConfig.Retry.MaxAttempts == 0 && kafkaHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if kafkaHookConfig.Compression != None {
+		compressor, ok := kafkaHookConfig.Producer.(Compressor)
+		if !ok {
+			return fmt.Errorf("producer doesn't support %s compression", kafkaHookConfig.Compression)
+		}
+
+		if err := compressor.SetCompression(kafkaHookConfig.Compression); err != nil {
+			return err
+		}
+	}
+
+	if kafkaHookConfig.BatchSize <= 0 {
+		kafkaHookConfig.BatchSize = 100
+	}
+
+	if kafkaHookConfig.Linger <= 0 {
+		kafkaHookConfig.Linger = 10 * time.Millisecond
+	}
+
+	if kafkaHookConfig.Timeout <= 0 {
+		kafkaHookConfig.Timeout = 10 * time.Second
+	}
+
+	if kafkaHookConfig.QueueSize <= 0 {
+		kafkaHookConfig.QueueSize = 10000
+	}
+
+	h.config = kafkaHookConfig
+
+	filters := make([]string, len(kafkaHookConfig.Rules))
+	where := make([]string, len(kafkaHookConfig.Rules))
+	transforms := make([]string, len(kafkaHookConfig.Rules))
+	for i, rule := range kafkaHookConfig.Rules {
+		filters[i], where[i], transforms[i] = rule.Filter, rule.Where, rule.Transform
+	}
+
+	var err error
+	h.bridge, err = bridge.New[Record](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		Transform: transforms,
+		BatchSize: kafkaHookConfig.BatchSize,
+		Linger:    kafkaHookConfig.Linger,
+		Timeout:   kafkaHookConfig.Timeout,
+		QueueSize: kafkaHookConfig.QueueSize,
+		Block:     kafkaHookConfig.Block,
+		Drop:      kafkaHookConfig.Drop,
+		Server:    kafkaHookConfig.Server,
+		Name:      "kafka",
+		Buffer:    kafkaHookConfig.Buffer,
+		Retry:     kafkaHookConfig.Retry,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// Stop produces the queued records and closes the producer
+func (h *Hook) Stop() error {
+	if h.bridge == nil || h.stopped.Swap(true) {
+		return nil
+	}
+
+	return errors.Join(h.bridge.Close(), h.config.Producer.Close())
+}
+
+// Stats returns the totals of the records produced so far
+func (h *Hook) Stats() Stats {
+	if h.bridge == nil {
+		return Stats{}
+	}
+
+	stats := h.bridge.Stats()
+	return Stats{Batches: stats.Batches, Delivered: stats.Sent, Failed: stats.Failed, Dropped: stats.Dropped}
+}
+
+// OnPublished is called when a client has published a message, and queues it to be produced if a rule
+// matches its topic. Messages consumed from Kafka by the inbound hook aren't produced back
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if cl.ID == InboundClientID {
+		return
+	}
+
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Delivered != nil {
+		m.Sent = func(route, records int, took time.Duration) {
+			h.config.Metrics.Delivered(records, took)
+		}
+	}
+
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, records int, err error) {
+			h.config.Metrics.Failed(records, err)
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// sink encodes and produces the records of the bridge of the hook
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the record of the message published by the client
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (Record, error) {
+	return s.h.config.Rules[route].record(cl, pk), nil
+}
+
+// Send produces the records
+func (s sink) Send(ctx context.Context, route int, records []Record) error {
+	return s.h.config.Producer.Produce(ctx, records)
+}
@@ -0,0 +1,459 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// fakeProducer records the batches it produces
+type fakeProducer struct {
+	batches     [][]Record
+	errs        []error       // returned by the next attempts
+	block       chan struct{} // produce waits for it to be closed, if set
+	compression Compression
+	closed      bool
+	mu          sync.Mutex
+}
+
+func (p *fakeProducer) Produce(ctx context.Context, records []Record) error {
+	if p.block != nil {
+		<-p.block
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.errs) > 0 {
+		err := p.errs[0]
+		p.errs = p.errs[1:]
+		return err
+	}
+
+	p.batches = append(p.batches, records)
+	return nil
+}
+
+func (p *fakeProducer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *fakeProducer) produced() [][]Record {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.batches
+}
+
+// compressingProducer is a producer whose compression can be set
+type compressingProducer struct {
+	*fakeProducer
+}
+
+func (p compressingProducer) SetCompression(c Compression) error {
+	if c == Snappy {
+		return errors.New("snappy is not supported")
+	}
+	p.compression = c
+	return nil
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	kafkaHook := new(Hook)
+	kafkaHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, kafkaHook.Init(options))
+	t.Cleanup(func() { kafkaHook.Stop() })
+	return kafkaHook
+}
+
+func publish(h *Hook, topic string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(topic)})
+}
+
+func TestID(t *testing.T) {
+	kafkaHook := new(Hook)
+
+	require.Equal(t, "kafka-bridge-hook", kafkaHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	kafkaHook := new(Hook)
+
+	require.True(t, kafkaHook.Provides(mqtt.OnPublished))
+	require.False(t, kafkaHook.Provides(mqtt.OnPublish))
+}
+
+func TestCompression(t *testing.T) {
+	require.Equal(t, "zstd", Zstd.String())
+	require.Equal(t, "compression(9)", Compression(9).String())
+
+	var c Compression
+	require.NoError(t, c.UnmarshalText([]byte("lz4")))
+	require.Equal(t, LZ4, c)
+	require.Error(t, c.UnmarshalText([]byte("brotli")))
+}
+
+func TestInit(t *testing.T) {
+	rules := []Rule{{Filter: "#", Topic: "mqtt"}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - rules",
+			config:      Options{Producer: new(fakeProducer), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Success - compression",
+			config:      Options{Producer: compressingProducer{new(fakeProducer)}, Rules: rules, Compression: Zstd},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no producer",
+			config:      Options{Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Producer: new(fakeProducer)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Producer: new(fakeProducer), Rules: []Rule{{Filter: "#"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid where",
+			config:      Options{Producer: new(fakeProducer), Rules: []Rule{{Filter: "#", Topic: "mqtt", Where: "qos =="}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid transform",
+			config:      Options{Producer: new(fakeProducer), Rules: []Rule{{Filter: "#", Topic: "mqtt", Transform: "{{.Topic"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Producer: new(fakeProducer), Rules: rules, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - producer without compression",
+			config:      Options{Producer: new(fakeProducer), Rules: rules, Compression: Gzip},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unsupported compression",
+			config:      Options{Producer: compressingProducer{new(fakeProducer)}, Rules: rules, Compression: Snappy},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			kafkaHook := new(Hook)
+			kafkaHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := kafkaHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, 100, kafkaHook.config.BatchSize)
+				require.Equal(t, 10000, kafkaHook.config.QueueSize)
+				if p, ok := kafkaHook.config.Producer.(compressingProducer); ok {
+					require.Equal(t, Zstd, p.compression)
+				}
+				require.NoError(t, kafkaHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestBatches(t *testing.T) {
+	producer := new(fakeProducer)
+	var delivered []int
+	kafkaHook := newHook(t, Options{
+		Producer: producer,
+		Rules: []Rule{
+			{Filter: "devices/+/telemetry", Topic: "telemetry", Key: "{2}"},
+			{Filter: "devices/#", Topic: "devices"},
+		},
+		BatchSize: 2,
+		Linger:    time.Hour,
+		Metrics: Metrics{
+			Delivered: func(records int, took time.Duration) {
+				delivered = append(delivered, records)
+			},
+		},
+	})
+
+	// the first rule matching a topic applies, and the batches of each rule are produced once full
+	publish(kafkaHook, "devices/d1/telemetry")
+	publish(kafkaHook, "other")
+	publish(kafkaHook, "devices/d1/status")
+	publish(kafkaHook, "devices/d2/telemetry")
+	require.Eventually(t, func() bool {
+		return len(producer.produced()) == 1
+	}, time.Second, time.Millisecond)
+
+	batch := producer.produced()[0]
+	require.Equal(t, "telemetry", batch[0].Topic)
+	require.Equal(t, []byte("d1"), batch[0].Key)
+	require.Equal(t, []byte("devices/d1/telemetry"), batch[0].Value)
+	require.Equal(t, []byte("d2"), batch[1].Key)
+
+	// the last batch is produced when the hook stops
+	require.NoError(t, kafkaHook.Stop())
+	require.Len(t, producer.produced(), 2)
+	require.Equal(t, "devices", producer.produced()[1][0].Topic)
+	require.Nil(t, producer.produced()[1][0].Key)
+	require.True(t, producer.closed)
+	require.Equal(t, []int{2, 1}, delivered)
+	require.Equal(t, Stats{Batches: 2, Delivered: 3}, kafkaHook.Stats())
+
+	// messages published once the hook has stopped are ignored
+	publish(kafkaHook, "devices/d3/status")
+	require.NoError(t, kafkaHook.Stop())
+}
+
+func TestWhere(t *testing.T) {
+	producer := new(fakeProducer)
+	kafkaHook := newHook(t, Options{
+		Producer: producer,
+		Rules: []Rule{
+			{Filter: "sensors/#", Where: "json.temperature > 30", Topic: "alerts"},
+			{Filter: "sensors/#", Topic: "readings"},
+		},
+		BatchSize: 2,
+		Linger:    time.Hour,
+	})
+
+	// messages not matching the expression of a rule fall through to the next, whose batch is produced
+	// apart
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	kafkaHook.OnPublished(cl, packets.Packet{TopicName: "sensors/d1", Payload: []byte(`{"temperature":31}`)})
+	kafkaHook.OnPublished(cl, packets.Packet{TopicName: "sensors/d1", Payload: []byte(`{"temperature":20}`)})
+	require.NoError(t, kafkaHook.Stop())
+
+	var topics []string
+	for _, batch := range producer.produced() {
+		for _, r := range batch {
+			topics = append(topics, r.Topic)
+		}
+	}
+	require.ElementsMatch(t, []string{"alerts", "readings"}, topics)
+}
+
+func TestTransform(t *testing.T) {
+	producer := new(fakeProducer)
+	kafkaHook := newHook(t, Options{
+		Producer: producer,
+		Rules: []Rule{
+			{Filter: "devices/+/status", Topic: "status", Transform: `{{index .Levels 5}}`},
+			{Filter: "devices/#", Topic: "devices", Transform: `{"device":{{json (index .Levels 1)}},"payload":{{json .Payload}}}`},
+		},
+	})
+
+	publish(kafkaHook, "devices/d1/status")
+	publish(kafkaHook, "devices/d1/telemetry")
+	require.NoError(t, kafkaHook.Stop())
+
+	// messages which can't be transformed fail
+	require.Len(t, producer.produced(), 1)
+	require.Equal(t, `{"device":"d1","payload":"devices/d1/telemetry"}`, string(producer.produced()[0][0].Value))
+	require.Equal(t, Stats{Batches: 1, Delivered: 1, Failed: 1}, kafkaHook.Stats())
+}
+
+func TestLinger(t *testing.T) {
+	producer := new(fakeProducer)
+	kafkaHook := newHook(t, Options{
+		Producer: producer,
+		Rules:    []Rule{{Filter: "#", Topic: "mqtt"}},
+		Linger:   time.Millisecond,
+	})
+
+	publish(kafkaHook, "a")
+	require.Eventually(t, func() bool {
+		return len(producer.produced()) == 1
+	}, time.Second, time.Millisecond)
+
+	publish(kafkaHook, "b")
+	require.Eventually(t, func() bool {
+		return len(producer.produced()) == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestQueueFull(t *testing.T) {
+	producer := &fakeProducer{block: make(chan struct{})}
+	var dropped int
+	kafkaHook := newHook(t, Options{
+		Producer:  producer,
+		Rules:     []Rule{{Filter: "#", Topic: "mqtt"}},
+		BatchSize: 1,
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// the first message is being produced, the second is queued, and the third is dropped
+	publish(kafkaHook, "a")
+	require.Eventually(t, func() bool {
+		return kafkaHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(kafkaHook, "b")
+	publish(kafkaHook, "c")
+	require.Equal(t, 1, dropped)
+
+	close(producer.block)
+	require.NoError(t, kafkaHook.Stop())
+	require.Equal(t, Stats{Batches: 2, Delivered: 2, Dropped: 1}, kafkaHook.Stats())
+}
+
+func TestDrop(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	warnings := make(chan bridge.Warning, 1)
+	require.NoError(t, server.Subscribe("$SYS/bridges/kafka/dropped", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		var w bridge.Warning
+		require.NoError(t, json.Unmarshal(pk.Payload, &w))
+		warnings <- w
+	}))
+
+	producer := &fakeProducer{block: make(chan struct{})}
+	kafkaHook := newHook(t, Options{
+		Producer:  producer,
+		Rules:     []Rule{{Filter: "#", Topic: "mqtt"}},
+		BatchSize: 1,
+		QueueSize: 1,
+		Drop:      bridge.DropOldest,
+		Server:    server,
+	})
+
+	// the first message is being produced, and the second is dropped for the third
+	publish(kafkaHook, "a")
+	require.Eventually(t, func() bool {
+		return kafkaHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(kafkaHook, "b")
+	publish(kafkaHook, "c")
+	require.Equal(t, bridge.Warning{Bridge: "kafka", Dropped: 1, Total: 1}, <-warnings)
+
+	close(producer.block)
+	require.NoError(t, kafkaHook.Stop())
+	require.Equal(t, []byte("c"), producer.produced()[1][0].Value)
+	require.Equal(t, Stats{Batches: 2, Delivered: 2, Dropped: 1}, kafkaHook.Stats())
+}
+
+func TestBuffer(t *testing.T) {
+	producer := &fakeProducer{block: make(chan struct{})}
+	options := Options{
+		Producer:  producer,
+		Rules:     []Rule{{Filter: "#", Topic: "mqtt", Key: "{client}"}},
+		BatchSize: 1,
+		Buffer:    &bridge.Buffer{Dir: t.TempDir()},
+	}
+	kafkaHook := newHook(t, options)
+
+	// the first message is being produced when the hook stops, and the second is kept in the buffer
+	publish(kafkaHook, "a")
+	require.Eventually(t, func() bool {
+		return kafkaHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(kafkaHook, "b")
+
+	stopped := make(chan error)
+	go func() { stopped <- kafkaHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(producer.block)
+	require.NoError(t, <-stopped)
+	require.Len(t, producer.produced(), 1)
+
+	// and is produced once the hook is restarted
+	producer = new(fakeProducer)
+	options.Producer = producer
+	kafkaHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return len(producer.produced()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []byte("b"), producer.produced()[0][0].Value)
+	require.Equal(t, []byte("c1"), producer.produced()[0][0].Key)
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := errors.New("leader not available")
+	producer := &fakeProducer{errs: []error{unavailable, unavailable, unavailable, unavailable}}
+	var failed []error
+	kafkaHook := newHook(t, Options{
+		Producer:  producer,
+		Rules:     []Rule{{Filter: "#", Topic: "mqtt"}},
+		BatchSize: 1,
+		Retry:     &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+		Metrics: Metrics{
+			Failed: func(records int, err error) { failed = append(failed, err) },
+		},
+	})
+
+	// the first batch fails three times and is discarded, and the second succeeds when retried
+	publish(kafkaHook, "a")
+	publish(kafkaHook, "b")
+	require.NoError(t, kafkaHook.Stop())
+
+	require.Equal(t, []error{unavailable}, failed)
+	require.Len(t, producer.produced(), 1)
+	require.Equal(t, []byte("b"), producer.produced()[0][0].Value)
+	require.Equal(t, Stats{Batches: 2, Delivered: 1, Failed: 1}, kafkaHook.Stats())
+}
+
+func TestServer(t *testing.T) {
+	producer := new(fakeProducer)
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	kafkaHook := new(Hook)
+	require.NoError(t, server.AddHook(kafkaHook, Options{
+		Producer: producer,
+		Rules:    []Rule{{Filter: "a/#", Topic: "mqtt.{topic}"}},
+		Linger:   time.Millisecond,
+	}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	require.NoError(t, server.Publish("a/b", []byte("hello"), false, 0))
+	require.Eventually(t, func() bool {
+		return len(producer.produced()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, "mqtt.a.b", producer.produced()[0][0].Topic)
+}
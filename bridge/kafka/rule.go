@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+// the headers records are given from the message, besides one for each of its user properties
+const (
+	HeaderTopic           = "mqtt_topic"
+	HeaderClient          = "mqtt_client"
+	HeaderQos             = "mqtt_qos"
+	HeaderRetain          = "mqtt_retain"
+	HeaderContentType     = "content-type"
+	HeaderPayloadFormat   = "mqtt_payload_format"
+	HeaderResponseTopic   = "mqtt_response_topic"
+	HeaderCorrelationData = "mqtt_correlation_data"
+)
+
+// validate checks the filter and templates of the rule
+func (r Rule) validate() error {
+	if !mqtt.IsValidFilter(r.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Filter)
+	}
+
+	if r.Topic == "" {
+		return errors.New("has no kafka topic")
+	}
+
+	for _, template := range []string{r.Topic, r.Key} {
+		if err := bridge.Render(template, r.values(nil, ""), func(string) {}); err != nil {
+			return fmt.Errorf("has invalid template %q: %w", template, err)
+		}
+	}
+	return nil
+}
+
+// record returns the record of the message published by the client
+func (r Rule) record(cl *mqtt.Client, pk packets.Packet) Record {
+	values := r.values(strings.Split(pk.TopicName, "/"), cl.ID)
+
+	var topic strings.Builder
+	bridge.Render(r.Topic, values, func(s string) { topic.WriteString(s) })
+
+	record := Record{
+		Topic:   sanitize(topic.String()),
+		Value:   pk.Payload,
+		Headers: headers(cl, pk),
+		Time:    time.Now(),
+	}
+
+	if pk.Created > 0 {
+		record.Time = time.Unix(pk.Created, 0)
+	}
+
+	if r.Key != "" {
+		var key []byte
+		bridge.Render(r.Key, values, func(s string) { key = append(key, s...) })
+		record.Key = key
+	}
+	return record
+}
+
+// values returns the values of the placeholders of the templates of the rule, for a message published
+// to the topic with the levels by the client
+func (r Rule) values(levels []string, client string) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		switch name {
+		case "topic":
+			return strings.Join(levels, "."), true
+		case "client":
+			return client, true
+		}
+		return level(levels, name)
+	}
+}
+
+// level returns the level of a {1}, {2}... placeholder, which is empty if there are fewer levels, and
+// false if the name isn't a level
+func level(levels []string, name string) (string, bool) {
+	n, err := strconv.Atoi(name)
+	if err != nil || n < 1 {
+		return "", false
+	}
+
+	if n > len(levels) {
+		return "", true
+	}
+	return levels[n-1], true
+}
+
+// sanitize replaces the characters which Kafka doesn't allow in topic names with underscores
+func sanitize(topic string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, topic)
+}
+
+// headers returns the headers of the record of the message, from its properties
+func headers(cl *mqtt.Client, pk packets.Packet) []Header {
+	h := []Header{
+		{Key: HeaderTopic, Value: []byte(pk.TopicName)},
+		{Key: HeaderClient, Value: []byte(cl.ID)},
+		{Key: HeaderQos, Value: []byte(strconv.Itoa(int(pk.FixedHeader.Qos)))},
+	}
+
+	if pk.FixedHeader.Retain {
+		h = append(h, Header{Key: HeaderRetain, Value: []byte("true")})
+	}
+
+	if pk.Properties.ContentType != "" {
+		h = append(h, Header{Key: HeaderContentType, Value: []byte(pk.Properties.ContentType)})
+	}
+
+	if pk.Properties.PayloadFormatFlag {
+		h = append(h, Header{Key: HeaderPayloadFormat, Value: []byte(strconv.Itoa(int(pk.Properties.PayloadFormat)))})
+	}
+
+	if pk.Properties.ResponseTopic != "" {
+		h = append(h, Header{Key: HeaderResponseTopic, Value: []byte(pk.Properties.ResponseTopic)})
+	}
+
+	if len(pk.Properties.CorrelationData) > 0 {
+		h = append(h, Header{Key: HeaderCorrelationData, Value: pk.Properties.CorrelationData})
+	}
+
+	for _, p := range pk.Properties.User {
+		h = append(h, Header{Key: p.Key, Value: []byte(p.Val)})
+	}
+	return h
+}
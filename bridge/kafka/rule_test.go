@@ -0,0 +1,144 @@
+package kafka
+
+import (
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectError bool
+	}{
+		{
+			name: "Success - templates",
+			rule: Rule{Filter: "devices/+/telemetry", Topic: "telemetry.{2}", Key: "{client}"},
+		},
+		{
+			name: "Success - literal topic",
+			rule: Rule{Filter: "#", Topic: "mqtt"},
+		},
+		{
+			name:        "Failure - invalid filter",
+			rule:        Rule{Filter: "a/#/b", Topic: "mqtt"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no topic",
+			rule:        Rule{Filter: "#"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unclosed placeholder",
+			rule:        Rule{Filter: "#", Topic: "mqtt.{1"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown placeholder",
+			rule:        Rule{Filter: "#", Topic: "mqtt", Key: "{username}"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - level zero",
+			rule:        Rule{Filter: "#", Topic: "mqtt.{0}"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestRuleRecord(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "sensor-1", false)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "devices/sensor 1/telemetry",
+		Payload:     []byte("21.5"),
+		Created:     1700000000,
+	}
+
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectTopic string
+		expectKey   []byte
+	}{
+		{
+			name:        "Success - topic level and client key",
+			rule:        Rule{Topic: "telemetry.{2}", Key: "{client}"},
+			expectTopic: "telemetry.sensor_1",
+			expectKey:   []byte("sensor-1"),
+		},
+		{
+			name:        "Success - whole topic",
+			rule:        Rule{Topic: "mqtt.{topic}", Key: "{1}/{2}"},
+			expectTopic: "mqtt.devices.sensor_1.telemetry",
+			expectKey:   []byte("devices/sensor 1"),
+		},
+		{
+			name:        "Success - missing level and no key",
+			rule:        Rule{Topic: "mqtt-{9}"},
+			expectTopic: "mqtt-",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			record := tt.rule.record(cl, pk)
+			require.Equal(t, tt.expectTopic, record.Topic)
+			require.Equal(t, tt.expectKey, record.Key)
+			require.Equal(t, []byte("21.5"), record.Value)
+			require.Equal(t, int64(1700000000), record.Time.Unix())
+
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+
+	require.Equal(t, []Header{
+		{Key: HeaderTopic, Value: []byte("a/b")},
+		{Key: HeaderClient, Value: []byte("c1")},
+		{Key: HeaderQos, Value: []byte("0")},
+	}, headers(cl, packets.Packet{TopicName: "a/b"}))
+
+	require.Equal(t, []Header{
+		{Key: HeaderTopic, Value: []byte("a/b")},
+		{Key: HeaderClient, Value: []byte("c1")},
+		{Key: HeaderQos, Value: []byte("2")},
+		{Key: HeaderRetain, Value: []byte("true")},
+		{Key: HeaderContentType, Value: []byte("application/json")},
+		{Key: HeaderPayloadFormat, Value: []byte("1")},
+		{Key: HeaderResponseTopic, Value: []byte("a/reply")},
+		{Key: HeaderCorrelationData, Value: []byte{1, 2}},
+		{Key: "site", Value: []byte("north")},
+	}, headers(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 2, Retain: true},
+		TopicName:   "a/b",
+		Properties: packets.Properties{
+			ContentType:       "application/json",
+			PayloadFormat:     1,
+			PayloadFormatFlag: true,
+			ResponseTopic:     "a/reply",
+			CorrelationData:   []byte{1, 2},
+			User:              []packets.UserProperty{{Key: "site", Val: "north"}},
+		},
+	}))
+}
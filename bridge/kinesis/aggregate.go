@@ -0,0 +1,127 @@
+package kinesis
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+)
+
+// magic prefixes records aggregated in the format of the Kinesis Producer Library, which the Kinesis
+// Client Library and the deaggregation modules of awslabs/kinesis-aggregation split into the user
+// records again
+var magic = []byte{0xf3, 0x89, 0x9a, 0xc2}
+
+// the protobuf fields of the AggregatedRecord and Record messages of the format
+const (
+	fieldPartitionKeyTable = 1 // AggregatedRecord.partition_key_table
+	fieldRecords           = 3 // AggregatedRecord.records
+	fieldPartitionKeyIndex = 1 // Record.partition_key_index
+	fieldData              = 3 // Record.data
+
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// aggregator aggregates user records into a record in the format of the Kinesis Producer Library,
+// whose partition key is that of its first user record, as with awslabs/kinesis-aggregation
+type aggregator struct {
+	keys    []string
+	index   map[string]int
+	first   Record // the first user record, which isn't aggregated if it is the only one
+	records []byte // the encoded Record messages
+	count   int
+	size    int // the size of the encoded AggregatedRecord
+}
+
+// add adds the user record to the aggregate
+func (a *aggregator) add(r Record) {
+	if a.index == nil {
+		a.index = map[string]int{}
+		a.first = r
+	}
+
+	i, ok := a.index[r.PartitionKey]
+	if !ok {
+		i = len(a.keys)
+		a.index[r.PartitionKey] = i
+		a.keys = append(a.keys, r.PartitionKey)
+		a.size += bytesFieldSize(fieldPartitionKeyTable, len(r.PartitionKey))
+	}
+
+	record := appendVarintField(nil, fieldPartitionKeyIndex, uint64(i))
+	record = appendBytesField(record, fieldData, r.Data)
+	a.records = appendBytesField(a.records, fieldRecords, record)
+	a.size += bytesFieldSize(fieldRecords, len(record))
+	a.count++
+}
+
+// sizeWith returns the size of the aggregated record if the user record were added to it
+func (a *aggregator) sizeWith(r Record) int {
+	size := len(magic) + a.size + md5.Size
+	if _, ok := a.index[r.PartitionKey]; !ok {
+		size += bytesFieldSize(fieldPartitionKeyTable, len(r.PartitionKey))
+	}
+
+	record := varintFieldSize(fieldPartitionKeyIndex, uint64(len(a.keys))) + bytesFieldSize(fieldData, len(r.Data))
+	return size + bytesFieldSize(fieldRecords, record)
+}
+
+// record returns the aggregated record, which is the only user record if there is one, and resets
+// the aggregator
+func (a *aggregator) record() Record {
+	defer a.reset()
+
+	if a.count == 1 {
+		return a.first
+	}
+
+	msg := make([]byte, 0, a.size)
+	for _, key := range a.keys {
+		msg = appendBytesField(msg, fieldPartitionKeyTable, []byte(key))
+	}
+	msg = append(msg, a.records...)
+
+	sum := md5.Sum(msg)
+	data := make([]byte, 0, len(magic)+len(msg)+md5.Size)
+	data = append(data, magic...)
+	data = append(data, msg...)
+	data = append(data, sum[:]...)
+	return Record{PartitionKey: a.keys[0], Data: data}
+}
+
+// reset empties the aggregator
+func (a *aggregator) reset() {
+	a.keys, a.index, a.first, a.records, a.count, a.size = nil, nil, Record{}, nil, 0, 0
+}
+
+// appendVarintField appends a protobuf varint field
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|wireVarint))
+	return binary.AppendUvarint(b, v)
+}
+
+// appendBytesField appends a protobuf length delimited field
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field<<3|wireBytes))
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// varintFieldSize returns the encoded size of a protobuf varint field
+func varintFieldSize(field int, v uint64) int {
+	return uvarintSize(uint64(field<<3|wireVarint)) + uvarintSize(v)
+}
+
+// bytesFieldSize returns the encoded size of a protobuf length delimited field of n bytes
+func bytesFieldSize(field, n int) int {
+	return uvarintSize(uint64(field<<3|wireBytes)) + uvarintSize(uint64(n)) + n
+}
+
+// uvarintSize returns the encoded size of a varint
+func uvarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
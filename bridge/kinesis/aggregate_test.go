@@ -0,0 +1,142 @@
+package kinesis
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// deaggregate splits an aggregated record into its user records, as the Kinesis Client Library does
+func deaggregate(r Record) ([]Record, error) {
+	if !bytes.HasPrefix(r.Data, magic) || len(r.Data) < len(magic)+md5.Size {
+		return []Record{r}, nil
+	}
+
+	msg := r.Data[len(magic) : len(r.Data)-md5.Size]
+	if sum := md5.Sum(msg); !bytes.Equal(sum[:], r.Data[len(r.Data)-md5.Size:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	var keys []string
+	var records []Record
+	err := fields(msg, func(field int, v uint64, b []byte) error {
+		switch field {
+		case fieldPartitionKeyTable:
+			keys = append(keys, string(b))
+		case fieldRecords:
+			var record Record
+			err := fields(b, func(field int, v uint64, b []byte) error {
+				switch field {
+				case fieldPartitionKeyIndex:
+					if int(v) >= len(keys) {
+						return fmt.Errorf("partition key index %d out of range", v)
+					}
+					record.PartitionKey = keys[v]
+				case fieldData:
+					record.Data = b
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// fields calls fn with each varint and length delimited field of a protobuf message
+func fields(b []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid tag")
+		}
+		b = b[n:]
+
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("invalid value")
+		}
+		b = b[n:]
+
+		var data []byte
+		switch tag & 7 {
+		case wireVarint:
+		case wireBytes:
+			if uint64(len(b)) < v {
+				return errors.New("truncated field")
+			}
+			data, b = b[:v], b[v:]
+		default:
+			return fmt.Errorf("unexpected wire type %d", tag&7)
+		}
+
+		if err := fn(int(tag>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAggregator(t *testing.T) {
+	user := []Record{
+		{PartitionKey: "c1", Data: []byte("a")},
+		{PartitionKey: "c2", Data: bytes.Repeat([]byte("b"), 200)},
+		{PartitionKey: "c1", Data: []byte("c")},
+	}
+
+	var a aggregator
+	for _, r := range user {
+		size := a.sizeWith(r)
+		a.add(r)
+		require.Equal(t, len(magic)+a.size+md5.Size, size)
+	}
+
+	record := a.record()
+	require.Equal(t, "c1", record.PartitionKey)
+	require.True(t, bytes.HasPrefix(record.Data, magic))
+
+	got, err := deaggregate(record)
+	require.NoError(t, err)
+	require.Equal(t, user, got)
+
+	// the aggregator is reset, and a single record isn't aggregated
+	require.Zero(t, a.count)
+	a.add(user[0])
+	require.Equal(t, user[0], a.record())
+}
+
+func TestAggregate(t *testing.T) {
+	var batch []Record
+	for i := 0; i < 100; i++ {
+		batch = append(batch, Record{PartitionKey: fmt.Sprintf("c%d", i%3), Data: bytes.Repeat([]byte{byte(i)}, 100)})
+	}
+
+	records, counts := aggregate(batch, 1024)
+	require.Greater(t, len(records), 1)
+	require.Len(t, counts, len(records))
+
+	var got []Record
+	for i, r := range records {
+		require.LessOrEqual(t, len(r.Data), 1024)
+
+		user, err := deaggregate(r)
+		require.NoError(t, err)
+		require.Len(t, user, counts[i])
+		got = append(got, user...)
+	}
+	require.Equal(t, batch, got)
+
+	// a record larger than the aggregate size is put alone
+	records, counts = aggregate([]Record{{PartitionKey: "a", Data: make([]byte, 2048)}, {PartitionKey: "b", Data: []byte("b")}}, 1024)
+	require.Equal(t, []int{1, 1}, counts)
+	require.Len(t, records[0].Data, 2048)
+}
@@ -0,0 +1,440 @@
+// Package kinesis provides a bridge hook streaming the messages published to matching MQTT topics to
+// AWS Kinesis Data Streams, in batches and in the background so publishes don't wait for AWS,
+// optionally aggregating them as the Kinesis Producer Library does.
+//
+// Records are put by a Client, which is a thin adapter of the Kinesis client of the application, eg.
+// for aws-sdk-go-v2:
+//
+//	type client struct{ *kinesis.Client }
+//
+//	func (c client) PutRecords(ctx context.Context, stream string, records []mqttkinesis.Record) ([]error, error) {
+//		in := &kinesis.PutRecordsInput{StreamName: aws.String(stream)}
+//		for _, r := range records {
+//			in.Records = append(in.Records, types.PutRecordsRequestEntry{PartitionKey: aws.String(r.PartitionKey), Data: r.Data})
+//		}
+//		out, err := c.Client.PutRecords(ctx, in)
+//		var throughput *types.ProvisionedThroughputExceededException
+//		if errors.As(err, &throughput) {
+//			return nil, mqttkinesis.ErrThrottled
+//		} else if err != nil {
+//			return nil, err
+//		}
+//		errs := make([]error, len(records))
+//		for i, r := range out.Records {
+//			switch aws.ToString(r.ErrorCode) {
+//			case "":
+//			case "ProvisionedThroughputExceededException":
+//				errs[i] = mqttkinesis.ErrThrottled
+//			default:
+//				errs[i] = errors.New(aws.ToString(r.ErrorMessage))
+//			}
+//		}
+//		return errs, nil
+//	}
+package kinesis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+const (
+	maxRecords   = 500     // the most records Kinesis puts at once
+	maxPutSize   = 5 << 20 // the most bytes Kinesis puts at once
+	maxAggregate = 1 << 20 // the largest record Kinesis allows
+)
+
+// ErrThrottled is returned by clients for records, or a whole put, which exceeded the throughput of
+// the shards of a stream
+var ErrThrottled = errors.New("provisioned throughput exceeded")
+
+// Record is a record put to a stream
+type Record struct {
+	PartitionKey string
+	Data         []byte
+}
+
+// Client puts records to Kinesis, usually a thin adapter of a Kinesis client
+type Client interface {
+	// PutRecords puts the records to the stream, returning an error for each record, which is nil for
+	// those put, or an error if the whole put failed. Errors of throttled records wrap ErrThrottled
+	PutRecords(ctx context.Context, stream string, records []Record) ([]error, error)
+}
+
+// Rule streams the messages of the MQTT topics matching Filter, which may contain +/# wildcards, to
+// Stream. PartitionKey is a template, in which {topic} is the MQTT topic, {client} is the id of the
+// publishing client, and {1}, {2}... are the levels of the topic, and defaults to {client}, so the
+// messages of each client are put to one shard in order. Where is an optional filter expression (see
+// pkg/filter) messages must also match, eg. "json.temperature > 30". Transform is an optional template
+// (see pkg/transform) the payloads of the messages are rewritten with, eg. transform.Envelope
+type Rule struct {
+	Filter       string `yaml:"filter" json:"filter"`
+	Where        string `yaml:"where" json:"where"`
+	Transform    string `yaml:"transform" json:"transform"`
+	Stream       string `yaml:"stream" json:"stream"`
+	PartitionKey string `yaml:"partition_key" json:"partition_key"`
+}
+
+// Metrics are called as records are put, eg. to export their delivery. Unset funcs are skipped
+type Metrics struct {
+	// Put is called after messages have been put, with how long putting their batch took
+	Put func(stream string, messages int, took time.Duration)
+
+	// Failed is called after messages could not be put, and are discarded
+	Failed func(stream string, messages int, err error)
+
+	// Throttled is called when messages are throttled by the stream, before they are retried
+	Throttled func(stream string, messages int)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+}
+
+// Stats are the totals of the messages streamed since the hook was initialized
+type Stats struct {
+	Batches   int64 // the number of batches put, or which failed
+	Records   int64 // the number of records put, which are fewer than the messages if aggregated
+	Put       int64 // the number of messages put
+	Failed    int64 // the number of messages which could not be put
+	Throttled int64 // the number of times messages were throttled
+	Dropped   int64 // the number of messages discarded as the queue was full
+}
+
+// Hook is a hook that streams the messages published to matching topics to Kinesis
+type Hook struct {
+	config  Options
+	bridge  *bridge.Bridge[Record]
+	stats   Stats // of the records put and throttled
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the kinesis hook
+type Options struct {
+	// Client puts the records
+	Client Client
+
+	// Rules map MQTT topics to streams, and the first whose filter matches the topic of a message
+	// applies. Messages matching no rule aren't streamed
+	Rules []Rule
+
+	// Aggregate aggregates the messages of a batch into records of up to AggregateSize bytes, which
+	// defaults to 50KiB, in the format of the Kinesis Producer Library, so more messages are put for
+	// the records per second a shard allows. An aggregated record is put with the partition key of its
+	// first message, so consumers must deaggregate records, eg. with the Kinesis Client Library
+	Aggregate     bool
+	AggregateSize int
+
+	BatchSize int           // the most messages of a rule put at once, defaults to 500
+	Linger    time.Duration // how long a batch waits for more messages, defaults to 100ms
+	Timeout   time.Duration // how long putting a batch may take, defaults to 10 seconds
+
+	// QueueSize is how many messages wait to be put, defaults to 10000. Messages published while the
+	// queue is full, eg. while the stream is throttled, wait for up to Block for room, and are then
+	// dropped by the Drop policy, which defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Server publishes a bridge.Warning to $SYS/bridges/kinesis/dropped when messages are dropped, if
+	// set
+	Server *mqtt.Server
+
+	// Buffer queues messages on disk rather than in memory if it is set, so the messages which haven't
+	// been put survive restarts of the broker and long outages of Kinesis
+	Buffer *bridge.Buffer
+
+	// Retry retries the records of a batch which fail or are throttled, and must limit the attempts or
+	// the time spent. Batches are put once if it is nil. Batches are put one at a time, so the queue
+	// backs up while a throttled batch is retried
+	Retry *retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "kinesis-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts putting records
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	kinesisHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if kinesisHookConfig.Client == nil {
+		return errors.New("client is required")
+	}
+
+	if len(kinesisHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range kinesisHookConfig.Rules {
+		if rule.PartitionKey == "" {
+			kinesisHookConfig.Rules[i].PartitionKey = "{client}"
+		}
+
+		if err := kinesisHookConfig.Rules[i].validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+
+	}
+
+	if kinesisHookConfig.Retry != nil && kinesisHookConfig.Retry.MaxAttempts == 0 && kinesisHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if kinesisHookConfig.AggregateSize <= 0 {
+		kinesisHookConfig.AggregateSize = 50 << 10
+	}
+	kinesisHookConfig.AggregateSize = min(kinesisHookConfig.AggregateSize, maxAggregate)
+
+	if kinesisHookConfig.BatchSize <= 0 {
+		kinesisHookConfig.BatchSize = maxRecords
+	}
+
+	if kinesisHookConfig.Linger <= 0 {
+		kinesisHookConfig.Linger = 100 * time.Millisecond
+	}
+
+	if kinesisHookConfig.Timeout <= 0 {
+		kinesisHookConfig.Timeout = 10 * time.Second
+	}
+
+	if kinesisHookConfig.QueueSize <= 0 {
+		kinesisHookConfig.QueueSize = 10000
+	}
+
+	h.config = kinesisHookConfig
+
+	filters := make([]string, len(kinesisHookConfig.Rules))
+	where := make([]string, len(kinesisHookConfig.Rules))
+	transforms := make([]string, len(kinesisHookConfig.Rules))
+	for i, rule := range kinesisHookConfig.Rules {
+		filters[i], where[i], transforms[i] = rule.Filter, rule.Where, rule.Transform
+	}
+
+	var err error
+	h.bridge, err = bridge.New[Record](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		Transform: transforms,
+		BatchSize: kinesisHookConfig.BatchSize,
+		Linger:    kinesisHookConfig.Linger,
+		Timeout:   kinesisHookConfig.Timeout,
+		QueueSize: kinesisHookConfig.QueueSize,
+		Block:     kinesisHookConfig.Block,
+		Drop:      kinesisHookConfig.Drop,
+		Server:    kinesisHookConfig.Server,
+		Name:      "kinesis",
+		Buffer:    kinesisHookConfig.Buffer,
+		Retry:     kinesisHookConfig.Retry,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// Stop puts the queued records
+func (h *Hook) Stop() error {
+	if h.bridge == nil {
+		return nil
+	}
+	return h.bridge.Close()
+}
+
+// Stats returns the totals of the messages streamed so far
+func (h *Hook) Stats() Stats {
+	if h.bridge == nil {
+		return Stats{}
+	}
+
+	h.statsMu.Lock()
+	stats := h.stats
+	h.statsMu.Unlock()
+
+	b := h.bridge.Stats()
+	stats.Batches, stats.Put, stats.Failed, stats.Dropped = b.Batches, b.Sent, b.Failed, b.Dropped
+	return stats
+}
+
+// OnPublished is called when a client has published a message, and queues it to be put if a rule
+// matches its topic
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Put != nil {
+		m.Sent = func(route, messages int, took time.Duration) {
+			h.config.Metrics.Put(h.config.Rules[route].Stream, messages, took)
+		}
+	}
+
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, messages int, err error) {
+			h.config.Metrics.Failed(h.config.Rules[route].Stream, messages, err)
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// put puts the records, of counts messages, to the stream, returning the error of each record, which
+// is nil for those put, and the errors joined
+func (h *Hook) put(ctx context.Context, stream string, records []Record, counts []int) ([]error, error) {
+	errs, err := h.config.Client.PutRecords(ctx, stream, records)
+	if err != nil {
+		errs = make([]error, len(records))
+		for i := range errs {
+			errs[i] = err
+		}
+	} else {
+		// the errors of the last records may be omitted if they were put
+		errs = append(errs, make([]error, max(len(records)-len(errs), 0))...)
+		err = errors.Join(errs...)
+	}
+
+	var put, throttled int
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			put++
+		case errors.Is(err, ErrThrottled):
+			throttled += counts[i]
+		}
+	}
+
+	h.statsMu.Lock()
+	h.stats.Records += int64(put)
+	h.statsMu.Unlock()
+
+	if throttled > 0 {
+		h.throttled(stream, throttled)
+	}
+	return errs, err
+}
+
+// throttled counts messages which were throttled
+func (h *Hook) throttled(stream string, messages int) {
+	h.statsMu.Lock()
+	h.stats.Throttled++
+	h.statsMu.Unlock()
+
+	h.Log.Warn("kinesis stream throttled messages", "stream", stream, "messages", messages)
+	if h.config.Metrics.Throttled != nil {
+		h.config.Metrics.Throttled(stream, messages)
+	}
+}
+
+// sink encodes and puts the messages of the bridge of the hook
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the user record of the message published by the client
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (Record, error) {
+	return s.h.config.Rules[route].record(cl, pk), nil
+}
+
+// Send puts the messages to the stream of the rule, aggregating them if enabled, in as many puts as
+// Kinesis requires. It returns a *bridge.PartialError for the messages of the records which failed
+func (s sink) Send(ctx context.Context, route int, batch []Record) error {
+	stream := s.h.config.Rules[route].Stream
+	records, counts := batch, make([]int, len(batch))
+	for i := range counts {
+		counts[i] = 1
+	}
+
+	if s.h.config.Aggregate {
+		records, counts = aggregate(batch, s.h.config.AggregateSize)
+	}
+
+	var failed []int // the indexes of the messages which failed
+	var errs []error
+	var first int // the index of the first message of the next record
+	for len(records) > 0 {
+		n, size := 0, 0
+		for n < len(records) && n < maxRecords {
+			size += len(records[n].PartitionKey) + len(records[n].Data)
+			if n > 0 && size > maxPutSize {
+				break
+			}
+			n++
+		}
+
+		putErrs, err := s.h.put(ctx, stream, records[:n], counts[:n])
+		for i, err := range putErrs {
+			if err != nil {
+				for j := first; j < first+counts[i]; j++ {
+					failed = append(failed, j)
+				}
+			}
+			first += counts[i]
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+		records, counts = records[n:], counts[n:]
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	return &bridge.PartialError{
+		Failed: failed,
+		Err:    fmt.Errorf("%d of %d messages failed: %w", len(failed), len(batch), errors.Join(errs...)),
+	}
+}
+
+// aggregate aggregates the user records into records of up to size bytes, returning the number of
+// user records in each
+func aggregate(batch []Record, size int) ([]Record, []int) {
+	var records []Record
+	var counts []int
+	var a aggregator
+	for _, r := range batch {
+		if a.count > 0 && a.sizeWith(r) > size {
+			counts = append(counts, a.count)
+			records = append(records, a.record())
+		}
+		a.add(r)
+	}
+
+	if a.count > 0 {
+		counts = append(counts, a.count)
+		records = append(records, a.record())
+	}
+	return records, counts
+}
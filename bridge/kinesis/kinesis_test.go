@@ -0,0 +1,364 @@
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// fakeClient records the records it puts
+type fakeClient struct {
+	puts    [][]Record
+	results []putResult   // returned by the next puts
+	block   chan struct{} // put waits for it to be closed, if set
+	mu      sync.Mutex
+}
+
+// putResult is the result of a put
+type putResult struct {
+	errs []error
+	err  error
+}
+
+func (c *fakeClient) PutRecords(ctx context.Context, stream string, records []Record) ([]error, error) {
+	if c.block != nil {
+		<-c.block
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var result putResult
+	if len(c.results) > 0 {
+		result, c.results = c.results[0], c.results[1:]
+	}
+
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	var put []Record
+	for i, r := range records {
+		if i >= len(result.errs) || result.errs[i] == nil {
+			put = append(put, r)
+		}
+	}
+	c.puts = append(c.puts, put)
+	return result.errs, nil
+}
+
+func (c *fakeClient) put() [][]Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.puts
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	kinesisHook := new(Hook)
+	kinesisHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, kinesisHook.Init(options))
+	t.Cleanup(func() { kinesisHook.Stop() })
+	return kinesisHook
+}
+
+func publish(h *Hook, client, topic string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", client, false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(topic)})
+}
+
+func TestID(t *testing.T) {
+	kinesisHook := new(Hook)
+
+	require.Equal(t, "kinesis-bridge-hook", kinesisHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	kinesisHook := new(Hook)
+
+	require.True(t, kinesisHook.Provides(mqtt.OnPublished))
+	require.False(t, kinesisHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - rules",
+			config:      Options{Client: new(fakeClient), Rules: []Rule{{Filter: "#", Stream: "telemetry"}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no client",
+			config:      Options{Rules: []Rule{{Filter: "#", Stream: "telemetry"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Client: new(fakeClient)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Client: new(fakeClient), Rules: []Rule{{Filter: "#", Stream: "tele metry"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Client: new(fakeClient), Rules: []Rule{{Filter: "#", Stream: "telemetry"}}, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			kinesisHook := new(Hook)
+			kinesisHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := kinesisHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, maxRecords, kinesisHook.config.BatchSize)
+				require.Equal(t, 50<<10, kinesisHook.config.AggregateSize)
+				require.Equal(t, "{client}", kinesisHook.config.Rules[0].PartitionKey)
+				require.NoError(t, kinesisHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestBatches(t *testing.T) {
+	client := new(fakeClient)
+	kinesisHook := newHook(t, Options{
+		Client: client,
+		Rules: []Rule{
+			{Filter: "devices/+/telemetry", Stream: "telemetry", PartitionKey: "{2}"},
+			{Filter: "devices/#", Stream: "devices"},
+		},
+		BatchSize: 2,
+		Linger:    time.Hour,
+	})
+
+	// the first rule matching a topic applies, and batches are put once full
+	publish(kinesisHook, "c1", "devices/d1/telemetry")
+	publish(kinesisHook, "c1", "other")
+	publish(kinesisHook, "c2", "devices/d2/status")
+	publish(kinesisHook, "c1", "devices/d3/telemetry")
+	require.Eventually(t, func() bool {
+		return len(client.put()) == 1
+	}, time.Second, time.Millisecond)
+
+	require.Equal(t, []Record{
+		{PartitionKey: "d1", Data: []byte("devices/d1/telemetry")},
+		{PartitionKey: "d3", Data: []byte("devices/d3/telemetry")},
+	}, client.put()[0])
+
+	// the other batches are put when the hook stops
+	require.NoError(t, kinesisHook.Stop())
+	require.Len(t, client.put(), 2)
+	require.Equal(t, []Record{{PartitionKey: "c2", Data: []byte("devices/d2/status")}}, client.put()[1])
+	require.Equal(t, Stats{Batches: 2, Records: 3, Put: 3}, kinesisHook.Stats())
+
+	// messages published once the hook has stopped are ignored
+	publish(kinesisHook, "c1", "devices/d1/status")
+	require.NoError(t, kinesisHook.Stop())
+}
+
+func TestAggregation(t *testing.T) {
+	client := new(fakeClient)
+	var put []int
+	kinesisHook := newHook(t, Options{
+		Client:    client,
+		Rules:     []Rule{{Filter: "#", Stream: "telemetry"}},
+		Aggregate: true,
+		Linger:    time.Hour,
+		Metrics: Metrics{
+			Put: func(stream string, messages int, took time.Duration) { put = append(put, messages) },
+		},
+	})
+
+	publish(kinesisHook, "c1", "a")
+	publish(kinesisHook, "c2", "b")
+	publish(kinesisHook, "c1", "c")
+	require.NoError(t, kinesisHook.Stop())
+
+	require.Len(t, client.put(), 1)
+	require.Len(t, client.put()[0], 1)
+	user, err := deaggregate(client.put()[0][0])
+	require.NoError(t, err)
+	require.Equal(t, []Record{
+		{PartitionKey: "c1", Data: []byte("a")},
+		{PartitionKey: "c2", Data: []byte("b")},
+		{PartitionKey: "c1", Data: []byte("c")},
+	}, user)
+	require.Equal(t, []int{3}, put)
+	require.Equal(t, Stats{Batches: 1, Records: 1, Put: 3}, kinesisHook.Stats())
+}
+
+func TestThrottling(t *testing.T) {
+	client := &fakeClient{results: []putResult{
+		{err: ErrThrottled},
+		{errs: []error{nil, ErrThrottled, nil}},
+	}}
+	var throttled []int
+	kinesisHook := newHook(t, Options{
+		Client: client,
+		Rules:  []Rule{{Filter: "#", Stream: "telemetry"}},
+		Linger: time.Hour,
+		Retry:  &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+		Metrics: Metrics{
+			Throttled: func(stream string, messages int) { throttled = append(throttled, messages) },
+		},
+	})
+
+	// the whole put is throttled, then one record, which is retried alone
+	publish(kinesisHook, "c1", "a")
+	publish(kinesisHook, "c1", "b")
+	publish(kinesisHook, "c1", "c")
+	require.NoError(t, kinesisHook.Stop())
+
+	puts := client.put()
+	require.Len(t, puts, 2)
+	require.Len(t, puts[0], 2)
+	require.Equal(t, []Record{{PartitionKey: "c1", Data: []byte("b")}}, puts[1])
+	require.Equal(t, []int{3, 1}, throttled)
+	require.Equal(t, Stats{Batches: 1, Records: 3, Put: 3, Throttled: 2}, kinesisHook.Stats())
+}
+
+func TestFailure(t *testing.T) {
+	unavailable := errors.New("internal failure")
+	client := &fakeClient{results: []putResult{{errs: []error{unavailable, nil}}}}
+	var failed int
+	kinesisHook := newHook(t, Options{
+		Client: client,
+		Rules:  []Rule{{Filter: "#", Stream: "telemetry"}},
+		Linger: time.Hour,
+		Metrics: Metrics{
+			Failed: func(stream string, messages int, err error) {
+				failed += messages
+				require.ErrorIs(t, err, unavailable)
+			},
+		},
+	})
+
+	// without a retry policy, the failed record is discarded
+	publish(kinesisHook, "c1", "a")
+	publish(kinesisHook, "c1", "b")
+	require.NoError(t, kinesisHook.Stop())
+
+	require.Equal(t, 1, failed)
+	require.Equal(t, Stats{Batches: 1, Records: 1, Put: 1, Failed: 1}, kinesisHook.Stats())
+}
+
+func TestQueueFull(t *testing.T) {
+	client := &fakeClient{block: make(chan struct{})}
+	var dropped int
+	kinesisHook := newHook(t, Options{
+		Client:    client,
+		Rules:     []Rule{{Filter: "#", Stream: "telemetry"}},
+		BatchSize: 1,
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// the first message is being put, the second is queued, and the third is dropped
+	publish(kinesisHook, "c1", "a")
+	require.Eventually(t, func() bool {
+		return kinesisHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(kinesisHook, "c1", "b")
+	publish(kinesisHook, "c1", "c")
+	require.Equal(t, 1, dropped)
+
+	close(client.block)
+	require.NoError(t, kinesisHook.Stop())
+	require.Equal(t, Stats{Batches: 2, Records: 2, Put: 2, Dropped: 1}, kinesisHook.Stats())
+}
+
+func TestBuffer(t *testing.T) {
+	client := &fakeClient{block: make(chan struct{})}
+	options := Options{
+		Client:    client,
+		Rules:     []Rule{{Filter: "#", Stream: "telemetry", PartitionKey: "{client}"}},
+		BatchSize: 1,
+		Buffer:    &bridge.Buffer{Dir: t.TempDir()},
+	}
+	kinesisHook := newHook(t, options)
+
+	// the first message is being put when the hook stops, and the second is kept in the buffer
+	publish(kinesisHook, "c1", "a")
+	require.Eventually(t, func() bool {
+		return kinesisHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(kinesisHook, "c2", "b")
+
+	stopped := make(chan error)
+	go func() { stopped <- kinesisHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(client.block)
+	require.NoError(t, <-stopped)
+	require.Len(t, client.put(), 1)
+
+	// and is put once the hook is restarted
+	client = new(fakeClient)
+	options.Client = client
+	kinesisHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return len(client.put()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []Record{{PartitionKey: "c2", Data: []byte("b")}}, client.put()[0])
+}
+
+func TestPutLimits(t *testing.T) {
+	client := new(fakeClient)
+	kinesisHook := newHook(t, Options{
+		Client: client,
+		Rules:  []Rule{{Filter: "#", Stream: "telemetry"}},
+	})
+
+	// batches are split into puts of at most 500 records and 5MiB
+	batch := make([]Record, 600)
+	for i := range batch {
+		batch[i] = Record{PartitionKey: "c1", Data: make([]byte, 10)}
+	}
+	require.NoError(t, sink{kinesisHook}.Send(context.Background(), 0, batch))
+	require.Len(t, client.put(), 2)
+	require.Len(t, client.put()[0], maxRecords)
+
+	client.puts = nil
+	require.NoError(t, sink{kinesisHook}.Send(context.Background(), 0, []Record{
+		{PartitionKey: "a", Data: make([]byte, 3<<20)},
+		{PartitionKey: "b", Data: make([]byte, 3<<20)},
+	}))
+	require.Len(t, client.put(), 2)
+}
@@ -0,0 +1,54 @@
+package kinesis
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+// maxPartitionKey is the most characters Kinesis allows in a partition key
+const maxPartitionKey = 256
+
+// validate checks the filter, stream and partition key template of the rule
+func (r Rule) validate() error {
+	if !mqtt.IsValidFilter(r.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Filter)
+	}
+
+	if r.Stream == "" || len(r.Stream) > 128 || strings.IndexFunc(r.Stream, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.')
+	}) >= 0 {
+		return fmt.Errorf("has invalid stream %q", r.Stream)
+	}
+
+	if err := bridge.Render(r.PartitionKey, bridge.TopicValues(nil, ""), func(string) {}); err != nil {
+		return fmt.Errorf("has invalid partition key %q: %w", r.PartitionKey, err)
+	}
+	return nil
+}
+
+// record returns the record of the message published by the client, whose partition key is that of
+// the client if the template renders an empty key
+func (r Rule) record(cl *mqtt.Client, pk packets.Packet) Record {
+	var key strings.Builder
+	bridge.Render(r.PartitionKey, bridge.TopicValues(strings.Split(pk.TopicName, "/"), cl.ID), func(s string) { key.WriteString(s) })
+
+	partitionKey := key.String()
+	if partitionKey == "" {
+		partitionKey = cl.ID
+	}
+
+	if utf8.RuneCountInString(partitionKey) > maxPartitionKey {
+		partitionKey = string([]rune(partitionKey)[:maxPartitionKey])
+	}
+
+	return Record{
+		PartitionKey: partitionKey,
+		Data:         pk.Payload,
+	}
+}
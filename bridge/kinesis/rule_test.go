@@ -0,0 +1,109 @@
+package kinesis
+
+import (
+	"strings"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectError bool
+	}{
+		{
+			name: "Success - topic level key",
+			rule: Rule{Filter: "devices/+/telemetry", Stream: "telemetry.eu-1", PartitionKey: "{2}"},
+		},
+		{
+			name: "Success - literal key",
+			rule: Rule{Filter: "#", Stream: "telemetry", PartitionKey: "all"},
+		},
+		{
+			name:        "Failure - invalid filter",
+			rule:        Rule{Filter: "a/#/b", Stream: "telemetry"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no stream",
+			rule:        Rule{Filter: "#"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid stream",
+			rule:        Rule{Filter: "#", Stream: "telemetry/eu"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown placeholder",
+			rule:        Rule{Filter: "#", Stream: "telemetry", PartitionKey: "{username}"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestRuleRecord(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "sensor-1", false)
+	pk := packets.Packet{TopicName: "devices/d1/telemetry", Payload: []byte("21.5")}
+
+	tests := []struct {
+		name      string
+		key       string
+		topic     string
+		expectKey string
+	}{
+		{
+			name:      "Success - client",
+			key:       "{client}",
+			expectKey: "sensor-1",
+		},
+		{
+			name:      "Success - topic level",
+			key:       "{1}-{2}",
+			expectKey: "devices-d1",
+		},
+		{
+			name:      "Success - missing level falls back to client",
+			key:       "{9}",
+			expectKey: "sensor-1",
+		},
+		{
+			name:      "Success - long key is truncated",
+			key:       "{topic}",
+			topic:     strings.Repeat("é", 300),
+			expectKey: strings.Repeat("é", maxPartitionKey),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			pk := pk
+			if tt.topic != "" {
+				pk.TopicName = tt.topic
+			}
+
+			record := Rule{PartitionKey: tt.key}.record(cl, pk)
+			require.Equal(t, tt.expectKey, record.PartitionKey)
+			require.Equal(t, []byte("21.5"), record.Data)
+
+		})
+	}
+}
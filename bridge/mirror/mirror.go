@@ -0,0 +1,330 @@
+// Package mirror provides a bridge hook duplicating a sample of the messages published to matching
+// MQTT topics to a secondary broker, or to the broker itself under a topic prefix, so staging
+// environments can receive a copy of production traffic.
+//
+// Copies are published to a secondary broker by a Client, which is a thin adapter of the MQTT client
+// of the application, eg. for paho.mqtt.golang:
+//
+//	type client struct{ mqtt.Client }
+//
+//	func (c client) Publish(ctx context.Context, m *mirror.Message) error {
+//		t := c.Client.Publish(m.Topic, m.Qos, m.Retain, m.Payload)
+//		select {
+//		case <-t.Done():
+//			return t.Error()
+//		case <-ctx.Done():
+//			return ctx.Err()
+//		}
+//	}
+//
+// Without a Client, copies are published to the Server under the Prefix of their rule by an inline
+// client, whose messages aren't mirrored again.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// ClientID is the id of the inline client which publishes copies to the server
+const ClientID = "mirror"
+
+// Message is a copy of a message, published to Topic
+type Message struct {
+	Topic       string
+	Payload     []byte
+	Qos         byte
+	Retain      bool
+	ContentType string
+	User        []packets.UserProperty
+}
+
+// Client publishes copies to a secondary broker, usually a thin adapter of an MQTT client
+type Client interface {
+	Publish(ctx context.Context, msg *Message) error
+}
+
+// Rule mirrors the messages of the MQTT topics matching Filter, which may contain +/# wildcards, to
+// their topic prefixed by Prefix, eg. "staging/". Where is an optional filter expression (see
+// pkg/filter) messages must also match, eg. "json.temperature > 30"
+type Rule struct {
+	Filter string `yaml:"filter" json:"filter"`
+	Where  string `yaml:"where" json:"where"`
+	Prefix string `yaml:"prefix" json:"prefix"`
+}
+
+// Metrics are called as messages are mirrored. Unset funcs are skipped
+type Metrics struct {
+	// Mirrored is called after the copies of messages have been published
+	Mirrored func(copies int)
+
+	// Failed is called after copies could not be published, and are discarded
+	Failed func(copies int, err error)
+
+	// Dropped is called for a copy which is discarded as the queue is full
+	Dropped func()
+}
+
+// Stats are the totals of the messages mirrored since the hook was initialized
+type Stats struct {
+	Mirrored int64 // the number of copies published
+	Skipped  int64 // the number of messages whose topic matches a rule which weren't sampled
+	Failed   int64 // the number of copies which could not be published
+	Dropped  int64 // the number of copies discarded as the queue was full
+}
+
+// Hook is a hook that mirrors the messages published to matching topics
+type Hook struct {
+	config  Options
+	client  *mqtt.Client // publishes copies to the server
+	bridge  *bridge.Bridge[*Message]
+	skipped int64
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the mirror hook
+type Options struct {
+	// Client publishes the copies to a secondary broker. Copies are published to Server if it is nil
+	Client Client
+
+	// Server is the server copies are published to without a Client, and publishes a bridge.Warning
+	// to $SYS/bridges/mirror/dropped when copies are dropped, if set
+	Server *mqtt.Server
+
+	// Rules select the messages which are mirrored, and the first whose filter matches the topic of a
+	// message applies. Messages matching no rule aren't mirrored
+	Rules []Rule
+
+	// Percent is the percentage of the messages matching a rule which are mirrored, chosen at random,
+	// and defaults to 100
+	Percent float64
+
+	Workers   int           // how many batches of copies are published at once, defaults to 1
+	BatchSize int           // how many copies are published at once, defaults to 100
+	Timeout   time.Duration // how long publishing a batch may take, defaults to 10 seconds
+
+	// QueueSize is how many copies wait to be published, defaults to 10000. Copies queued while the
+	// queue is full wait for up to Block for room, and are then dropped by the Drop policy, which
+	// defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Retry retries copies which fail, and must limit the attempts or the time spent. Copies are
+	// published once if it is nil
+	Retry *retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "mirror-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts publishing copies
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	mirrorHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if mirrorHookConfig.Client == nil && mirrorHookConfig.Server == nil {
+		return errors.New("client or server is required")
+	}
+
+	if len(mirrorHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range mirrorHookConfig.Rules {
+		if strings.ContainsAny(rule.Prefix, "+#") {
+			return fmt.Errorf("rule %d has invalid prefix %q", i, rule.Prefix)
+		}
+
+		if rule.Prefix == "" && mirrorHookConfig.Client == nil {
+			return fmt.Errorf("rule %d mirrors to the server, which requires a prefix", i)
+		}
+	}
+
+	if mirrorHookConfig.Percent < 0 || mirrorHookConfig.Percent > 100 {
+		return fmt.Errorf("invalid percent %v", mirrorHookConfig.Percent)
+	}
+
+	if mirrorHookConfig.Percent == 0 {
+		mirrorHookConfig.Percent = 100
+	}
+
+	if mirrorHookConfig.BatchSize <= 0 {
+		mirrorHookConfig.BatchSize = 100
+	}
+
+	h.config = mirrorHookConfig
+	if mirrorHookConfig.Server != nil {
+		h.client = mirrorHookConfig.Server.NewClient(nil, "local", ClientID, true)
+		h.client.Properties.ProtocolVersion = 5
+	}
+
+	filters := make([]string, len(mirrorHookConfig.Rules))
+	where := make([]string, len(mirrorHookConfig.Rules))
+	for i, rule := range mirrorHookConfig.Rules {
+		filters[i], where[i] = rule.Filter, rule.Where
+	}
+
+	var err error
+	h.bridge, err = bridge.New[*Message](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		BatchSize: mirrorHookConfig.BatchSize,
+		Linger:    10 * time.Millisecond,
+		Workers:   mirrorHookConfig.Workers,
+		Timeout:   mirrorHookConfig.Timeout,
+		QueueSize: mirrorHookConfig.QueueSize,
+		Block:     mirrorHookConfig.Block,
+		Drop:      mirrorHookConfig.Drop,
+		Server:    mirrorHookConfig.Server,
+		Name:      "mirror",
+		Retry:     mirrorHookConfig.Retry,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// Stop publishes the queued copies
+func (h *Hook) Stop() error {
+	if h.bridge == nil {
+		return nil
+	}
+	return h.bridge.Close()
+}
+
+// Stats returns the totals of the messages mirrored so far
+func (h *Hook) Stats() Stats {
+	if h.bridge == nil {
+		return Stats{}
+	}
+
+	h.statsMu.Lock()
+	skipped := h.skipped
+	h.statsMu.Unlock()
+
+	stats := h.bridge.Stats()
+	return Stats{Mirrored: stats.Sent, Skipped: skipped, Failed: stats.Failed, Dropped: stats.Dropped}
+}
+
+// OnPublished is called when a client has published a message, and queues a copy of it to be
+// published if a rule matches its topic and it is sampled. Copies aren't mirrored again
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if cl.ID == ClientID && cl.Net.Inline {
+		return
+	}
+
+	if h.config.Percent >= 100 || rand.Float64()*100 < h.config.Percent {
+		h.bridge.Publish(cl, pk)
+		return
+	}
+
+	for _, rule := range h.config.Rules {
+		if acl.Match(rule.Filter, pk.TopicName) {
+			h.statsMu.Lock()
+			h.skipped++
+			h.statsMu.Unlock()
+			return
+		}
+	}
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Mirrored != nil {
+		m.Sent = func(route, records int, took time.Duration) {
+			h.config.Metrics.Mirrored(records)
+		}
+	}
+
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, records int, err error) {
+			h.config.Metrics.Failed(records, err)
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// sink encodes and publishes the copies of the bridge of the hook
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the copy of the message published by the client
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (*Message, error) {
+	return &Message{
+		Topic:       s.h.config.Rules[route].Prefix + pk.TopicName,
+		Payload:     pk.Payload,
+		Qos:         pk.FixedHeader.Qos,
+		Retain:      pk.FixedHeader.Retain,
+		ContentType: pk.Properties.ContentType,
+		User:        pk.Properties.User,
+	}, nil
+}
+
+// Send publishes the copies to the secondary broker, or to the server
+func (s sink) Send(ctx context.Context, route int, msgs []*Message) error {
+	for _, msg := range msgs {
+		var err error
+		if s.h.config.Client != nil {
+			err = s.h.config.Client.Publish(ctx, msg)
+		} else {
+			err = s.h.config.Server.InjectPacket(s.h.client, packets.Packet{
+				FixedHeader: packets.FixedHeader{
+					Type:   packets.Publish,
+					Qos:    msg.Qos,
+					Retain: msg.Retain,
+				},
+				TopicName: msg.Topic,
+				Payload:   msg.Payload,
+				PacketID:  uint16(msg.Qos), // as the server publishes, the packet id is only checked to be set
+				Properties: packets.Properties{
+					ContentType: msg.ContentType,
+					User:        msg.User,
+				},
+			})
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// fakeClient records the copies it publishes
+type fakeClient struct {
+	messages []*Message
+	errs     []error // returned by the next attempts
+	mu       sync.Mutex
+}
+
+func (c *fakeClient) Publish(ctx context.Context, msg *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return err
+	}
+
+	c.messages = append(c.messages, msg)
+	return nil
+}
+
+func (c *fakeClient) published() []*Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Message(nil), c.messages...)
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	mirrorHook := new(Hook)
+	mirrorHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, mirrorHook.Init(options))
+	t.Cleanup(func() { mirrorHook.Stop() })
+	return mirrorHook
+}
+
+func publish(h *Hook, topic string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{FixedHeader: packets.FixedHeader{Qos: 1}, TopicName: topic, Payload: []byte(topic)})
+}
+
+func TestID(t *testing.T) {
+	mirrorHook := new(Hook)
+
+	require.Equal(t, "mirror-bridge-hook", mirrorHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	mirrorHook := new(Hook)
+
+	require.True(t, mirrorHook.Provides(mqtt.OnPublished))
+	require.False(t, mirrorHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	rules := []Rule{{Filter: "#"}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - client",
+			config:      Options{Client: new(fakeClient), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Success - server",
+			config:      Options{Server: mqtt.New(nil), Rules: []Rule{{Filter: "#", Prefix: "staging/"}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no client or server",
+			config:      Options{Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Client: new(fakeClient)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Client: new(fakeClient), Rules: []Rule{{Filter: "a/#/b"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid prefix",
+			config:      Options{Client: new(fakeClient), Rules: []Rule{{Filter: "#", Prefix: "staging/+/"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - server without prefix",
+			config:      Options{Server: mqtt.New(nil), Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid percent",
+			config:      Options{Client: new(fakeClient), Rules: rules, Percent: 101},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Client: new(fakeClient), Rules: rules, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			mirrorHook := new(Hook)
+			mirrorHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := mirrorHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, 100.0, mirrorHook.config.Percent)
+				require.Equal(t, 100, mirrorHook.config.BatchSize)
+				require.NoError(t, mirrorHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestMirror(t *testing.T) {
+	client := new(fakeClient)
+	var mirrored int
+	mirrorHook := newHook(t, Options{
+		Client: client,
+		Rules: []Rule{
+			{Filter: "devices/+/events", Prefix: "staging/"},
+			{Filter: "devices/#"},
+		},
+		Metrics: Metrics{
+			Mirrored: func(copies int) { mirrored += copies },
+		},
+	})
+
+	// the first rule matching a topic applies, and the queued copies are published when the hook stops
+	publish(mirrorHook, "devices/d1/events")
+	publish(mirrorHook, "other")
+	publish(mirrorHook, "devices/d1/status")
+	require.NoError(t, mirrorHook.Stop())
+
+	var topics []string
+	for _, msg := range client.published() {
+		topics = append(topics, msg.Topic)
+		require.Equal(t, byte(1), msg.Qos)
+	}
+	require.ElementsMatch(t, []string{"staging/devices/d1/events", "devices/d1/status"}, topics)
+	require.Equal(t, 2, mirrored)
+	require.Equal(t, Stats{Mirrored: 2}, mirrorHook.Stats())
+}
+
+func TestSample(t *testing.T) {
+	client := new(fakeClient)
+	mirrorHook := newHook(t, Options{
+		Client:  client,
+		Rules:   []Rule{{Filter: "devices/#"}},
+		Percent: 0.000001,
+	})
+
+	// messages matching no rule aren't counted as skipped
+	for i := 0; i < 10; i++ {
+		publish(mirrorHook, "devices/d1/status")
+	}
+	publish(mirrorHook, "other")
+	require.NoError(t, mirrorHook.Stop())
+
+	require.Empty(t, client.published())
+	require.Equal(t, Stats{Skipped: 10}, mirrorHook.Stats())
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := errors.New("unavailable")
+	client := &fakeClient{errs: []error{unavailable, unavailable}}
+	var failed []error
+	mirrorHook := newHook(t, Options{
+		Client:    client,
+		Rules:     []Rule{{Filter: "#"}},
+		BatchSize: 1,
+		Retry:     &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 2},
+		Metrics: Metrics{
+			Failed: func(copies int, err error) { failed = append(failed, err) },
+		},
+	})
+
+	// the first copy fails twice and is discarded, and the second is published
+	publish(mirrorHook, "a")
+	require.Eventually(t, func() bool {
+		return mirrorHook.Stats().Failed == 1
+	}, time.Second, time.Millisecond)
+	publish(mirrorHook, "b")
+	require.NoError(t, mirrorHook.Stop())
+
+	require.Equal(t, []error{unavailable}, failed)
+	require.Len(t, client.published(), 1)
+	require.Equal(t, Stats{Mirrored: 1, Failed: 1}, mirrorHook.Stats())
+}
+
+func TestServer(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	mirrorHook := new(Hook)
+	require.NoError(t, server.AddHook(mirrorHook, Options{
+		Server: server,
+		Rules:  []Rule{{Filter: "#", Prefix: "staging/"}},
+	}))
+	t.Cleanup(func() { server.Close() })
+
+	var topics []string
+	var mu sync.Mutex
+	require.NoError(t, server.Subscribe("#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		topics = append(topics, pk.TopicName)
+	}))
+
+	// copies are published under the prefix, and aren't mirrored again
+	require.NoError(t, server.Publish("devices/d1", []byte("on"), false, 0))
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(topics) == 2
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, mirrorHook.Stop())
+	require.Equal(t, []string{"devices/d1", "staging/devices/d1"}, topics)
+	require.Equal(t, Stats{Mirrored: 1}, mirrorHook.Stats())
+}
@@ -0,0 +1,486 @@
+// Package nats provides a bridge hook forwarding the messages published to matching MQTT topics to
+// NATS subjects, optionally as JetStream streams, and publishing the messages received on matching
+// NATS subjects back to the broker, so MQTT edges can be glued to a NATS backbone.
+//
+// Messages are sent and received through a Conn, which is a thin adapter of the NATS client of the
+// application, eg. for nats.go:
+//
+//	type conn struct{ *nats.Conn }
+//
+//	func (c conn) Publish(m *mqttnats.Msg) error {
+//		return c.PublishMsg(&nats.Msg{Subject: m.Subject, Header: nats.Header(m.Header), Data: m.Data})
+//	}
+//
+//	func (c conn) Subscribe(subject, queue string, handler func(m *mqttnats.Msg)) (func() error, error) {
+//		sub, err := c.QueueSubscribe(subject, queue, func(m *nats.Msg) {
+//			handler(&mqttnats.Msg{Subject: m.Subject, Reply: m.Reply, Header: m.Header, Data: m.Data})
+//		})
+//		if err != nil {
+//			return nil, err
+//		}
+//		return sub.Unsubscribe, nil
+//	}
+//
+// and messages are published to JetStream streams, which acknowledge them once stored, through a
+// JetStream, eg. for the jetstream package of nats.go:
+//
+//	type stream struct{ jetstream.JetStream }
+//
+//	func (s stream) Publish(ctx context.Context, m *mqttnats.Msg) error {
+//		_, err := s.PublishMsg(ctx, &nats.Msg{Subject: m.Subject, Header: nats.Header(m.Header), Data: m.Data})
+//		return err
+//	}
+package nats
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// ClientID is the id of the inline client which publishes the messages received from NATS
+const ClientID = "nats-bridge"
+
+// Msg is a message sent to or received from NATS
+type Msg struct {
+	Subject string
+	Reply   string // the reply subject of a received message
+	Header  map[string][]string
+	Data    []byte
+}
+
+// Conn sends and receives NATS messages, usually a thin adapter of a NATS client
+type Conn interface {
+	// Publish sends the message, without waiting for it to be received
+	Publish(msg *Msg) error
+
+	// Subscribe calls the handler with the messages received on the subject, which may contain * and >
+	// wildcards. Only one member of a non empty queue group receives each message. It returns a func
+	// which unsubscribes
+	Subscribe(subject, queue string, handler func(msg *Msg)) (func() error, error)
+}
+
+// JetStream publishes messages to JetStream streams, usually a thin adapter of a JetStream client
+type JetStream interface {
+	// Publish sends the message, and returns once the stream has acknowledged it
+	Publish(ctx context.Context, msg *Msg) error
+}
+
+// Direction is which way a rule bridges messages
+type Direction int
+
+const (
+	Outbound Direction = iota // from MQTT to NATS
+	Inbound                   // from NATS to MQTT
+	Both
+)
+
+var directionNames = []string{"out", "in", "both"}
+
+// String returns the name of the direction
+func (d Direction) String() string {
+	if d < 0 || int(d) >= len(directionNames) {
+		return fmt.Sprintf("direction(%d)", int(d))
+	}
+	return directionNames[d]
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler so the direction can be written as "out", "in" or
+// "both" in config files
+func (d *Direction) UnmarshalText(b []byte) error {
+	for i, name := range directionNames {
+		if string(b) == name {
+			*d = Direction(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown direction %q", b)
+}
+
+// Rule maps the MQTT topics matching the Topic filter to the NATS subjects matching Subject, and back.
+// The + and # wildcards of the filter correspond to the * and > wildcards of the subject, in the same
+// order, so levels and tokens matched by one are substituted for the other, eg. a Topic of
+// "devices/+/telemetry" and a Subject of "telemetry.*" map "devices/d1/telemetry" to "telemetry.d1".
+// Characters which aren't allowed in tokens or levels are replaced by underscores. Where is an optional
+// filter expression (see pkg/filter) messages forwarded to NATS must also match, eg. "json.temperature
+// > 30". Transform is an optional template (see pkg/transform) the payloads of the messages are
+// rewritten with, eg. transform.Envelope
+type Rule struct {
+	Topic     string    `yaml:"topic" json:"topic"`
+	Where     string    `yaml:"where" json:"where"`
+	Transform string    `yaml:"transform" json:"transform"`
+	Subject   string    `yaml:"subject" json:"subject"`
+	Direction Direction `yaml:"direction" json:"direction"`
+
+	// JetStream publishes outbound messages to a stream, which must capture the subject
+	JetStream bool `yaml:"jetstream" json:"jetstream"`
+
+	// Queue is the queue group of the inbound subscription, so only one of several brokers publishes
+	// each message, and Qos and Retain are those of the messages published to the broker
+	Queue  string `yaml:"queue" json:"queue"`
+	Qos    byte   `yaml:"qos" json:"qos"`
+	Retain bool   `yaml:"retain" json:"retain"`
+}
+
+// Metrics are called as messages are bridged. Unset funcs are skipped
+type Metrics struct {
+	// Forwarded is called for each message sent to NATS, or acknowledged by JetStream
+	Forwarded func(subject string)
+
+	// Received is called for each message received from NATS and published to the broker
+	Received func(topic string)
+
+	// Failed is called for each message which could not be bridged, and is discarded
+	Failed func(err error)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+}
+
+// Stats are the totals of the messages bridged since the hook was initialized
+type Stats struct {
+	Forwarded int64 // the number of messages sent to NATS
+	Received  int64 // the number of messages received from NATS and published to the broker
+	Failed    int64 // the number of messages which could not be bridged
+	Dropped   int64 // the number of messages discarded as the queue was full
+}
+
+// Hook is a hook that bridges messages between the broker and NATS
+type Hook struct {
+	config      Options
+	client      *mqtt.Client // publishes the messages received from NATS
+	bridge      *bridge.Bridge[*Msg]
+	routes      []int // the outbound rules of the routes of the bridge
+	unsubscribe []func() error
+	stopped     atomic.Bool
+	stats       Stats // of the received messages
+	statsMu     sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the nats hook
+type Options struct {
+	// Server is the server inbound messages are published to, and is required if a rule is inbound. It
+	// is published a bridge.Warning to $SYS/bridges/nats/dropped when messages are dropped, if it is set
+	Server *mqtt.Server
+
+	// Conn sends and receives the messages
+	Conn Conn
+
+	// JetStream publishes the messages of JetStream rules, and is required if there are any
+	JetStream JetStream
+
+	// Rules map MQTT topics to NATS subjects. The first outbound rule whose filter matches the topic of
+	// a message applies, and messages matching none aren't forwarded. Each inbound rule subscribes
+	Rules []Rule
+
+	// Origin identifies the hook in the HeaderOrigin header of the messages it forwards, so those
+	// received back through inbound rules are skipped. It defaults to a random id, and brokers sharing
+	// an origin don't receive each other's messages
+	Origin string
+
+	// QueueSize is how many messages wait to be forwarded, defaults to 1000. Messages published while
+	// the queue is full, eg. because JetStream is unavailable, wait for up to Block for room, and are
+	// then dropped by the Drop policy, which defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Buffer queues messages on disk rather than in memory if it is set, so the messages which haven't
+	// been forwarded survive restarts of the broker and long outages of NATS
+	Buffer *bridge.Buffer
+
+	// Timeout is how long JetStream may take to acknowledge a message, defaults to 5 seconds
+	Timeout time.Duration
+
+	// Retry retries messages which fail, and must limit the attempts or the time spent. Messages are
+	// forwarded once if it is nil
+	Retry *retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "nats-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	natsHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if natsHookConfig.Conn == nil {
+		return errors.New("conn is required")
+	}
+
+	if len(natsHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range natsHookConfig.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+
+		if rule.Direction != Outbound && natsHookConfig.Server == nil {
+			return fmt.Errorf("rule %d is inbound, which requires a server", i)
+		}
+
+		if rule.JetStream && natsHookConfig.JetStream == nil {
+			return fmt.Errorf("rule %d publishes to jetstream, which is required", i)
+		}
+	}
+
+	if natsHookConfig.Retry != nil && natsHookConfig.Retry.MaxAttempts == 0 && natsHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if natsHookConfig.Origin == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		natsHookConfig.Origin = hex.EncodeToString(b)
+	}
+
+	if natsHookConfig.QueueSize <= 0 {
+		natsHookConfig.QueueSize = 1000
+	}
+
+	if natsHookConfig.Timeout <= 0 {
+		natsHookConfig.Timeout = 5 * time.Second
+	}
+
+	h.config = natsHookConfig
+	if natsHookConfig.Server != nil {
+		h.client = natsHookConfig.Server.NewClient(nil, "local", ClientID, true)
+		h.client.Properties.ProtocolVersion = 5
+	}
+
+	var filters, where, transforms []string
+	for i, rule := range natsHookConfig.Rules {
+		if rule.Direction != Inbound {
+			h.routes = append(h.routes, i)
+			filters = append(filters, rule.Topic)
+			where = append(where, rule.Where)
+			transforms = append(transforms, rule.Transform)
+		}
+	}
+
+	if len(filters) == 0 {
+		return nil // only inbound rules
+	}
+
+	var err error
+	h.bridge, err = bridge.New[*Msg](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		Transform: transforms,
+		Timeout:   natsHookConfig.Timeout,
+		QueueSize: natsHookConfig.QueueSize,
+		Block:     natsHookConfig.Block,
+		Drop:      natsHookConfig.Drop,
+		Server:    natsHookConfig.Server,
+		Name:      "nats",
+		Buffer:    natsHookConfig.Buffer,
+		Retry:     natsHookConfig.Retry,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// OnStarted is called when the server has started, and subscribes to the subjects of inbound rules
+func (h *Hook) OnStarted() {
+	for _, rule := range h.config.Rules {
+		if rule.Direction == Outbound {
+			continue
+		}
+
+		rule := rule
+		unsubscribe, err := h.config.Conn.Subscribe(rule.Subject, rule.Queue, func(msg *Msg) {
+			h.receive(rule, msg)
+		})
+		if err != nil {
+			h.Log.Error("error occurred while subscribing to nats subject", "error", err, "subject", rule.Subject)
+			continue
+		}
+		h.unsubscribe = append(h.unsubscribe, unsubscribe)
+	}
+}
+
+// Stop unsubscribes from NATS, and forwards the queued messages
+func (h *Hook) Stop() error {
+	if h.stopped.Swap(true) {
+		return nil
+	}
+
+	var errs []error
+	for _, unsubscribe := range h.unsubscribe {
+		errs = append(errs, unsubscribe())
+	}
+
+	if h.bridge != nil {
+		errs = append(errs, h.bridge.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the totals of the messages bridged so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	stats := h.stats
+	h.statsMu.Unlock()
+
+	if h.bridge != nil {
+		b := h.bridge.Stats()
+		stats.Forwarded, stats.Failed, stats.Dropped = b.Sent, stats.Failed+b.Failed, b.Dropped
+	}
+	return stats
+}
+
+// OnPublished is called when a client has published a message, and queues it to be forwarded to NATS
+// if an outbound rule matches its topic. Messages received from NATS aren't forwarded back
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if h.bridge == nil || cl.ID == ClientID && cl.Net.Inline {
+		return
+	}
+
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook. Forwarded is called by the
+// sink for each message
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, records int, err error) {
+			for i := 0; i < records; i++ {
+				h.config.Metrics.Failed(err)
+			}
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// sink encodes and forwards the messages of the bridge of the hook
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the NATS message of the message published by the client
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (*Msg, error) {
+	subject, ok := s.h.config.Rules[s.h.routes[route]].subject(pk.TopicName)
+	if !ok {
+		return nil, fmt.Errorf("topic %q has no subject", pk.TopicName)
+	}
+
+	return &Msg{
+		Subject: subject,
+		Header:  headers(cl, pk, s.h.config.Origin),
+		Data:    pk.Payload,
+	}, nil
+}
+
+// Send sends the messages to NATS, or publishes them to JetStream if the rule does. It returns a
+// *bridge.PartialError for the messages from the first which failed
+func (s sink) Send(ctx context.Context, route int, msgs []*Msg) error {
+	rule := s.h.config.Rules[s.h.routes[route]]
+	for i, msg := range msgs {
+		var err error
+		if rule.JetStream {
+			err = s.h.config.JetStream.Publish(ctx, msg)
+		} else {
+			err = s.h.config.Conn.Publish(msg)
+		}
+
+		if err != nil {
+			failed := make([]int, len(msgs)-i)
+			for j := range failed {
+				failed[j] = i + j
+			}
+			return &bridge.PartialError{Failed: failed, Err: err}
+		}
+
+		if s.h.config.Metrics.Forwarded != nil {
+			s.h.config.Metrics.Forwarded(msg.Subject)
+		}
+	}
+	return nil
+}
+
+// receive publishes a message received from NATS through the inbound rule to the broker
+func (h *Hook) receive(rule Rule, msg *Msg) {
+	if origin := msg.Header[HeaderOrigin]; len(origin) > 0 && origin[0] == h.config.Origin {
+		return
+	}
+
+	topic, ok := rule.topic(msg.Subject)
+	if !ok {
+		return
+	}
+
+	err := h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    rule.Qos,
+			Retain: rule.Retain,
+		},
+		TopicName:  topic,
+		Payload:    msg.Data,
+		PacketID:   uint16(rule.Qos), // as the server publishes, the packet id is only checked to be set
+		Properties: properties(msg.Header),
+	})
+
+	h.statsMu.Lock()
+	if err != nil {
+		h.stats.Failed++
+	} else {
+		h.stats.Received++
+	}
+	h.statsMu.Unlock()
+
+	if err != nil {
+		h.Log.Error("error occurred while publishing nats message", "error", err, "subject", msg.Subject)
+		if h.config.Metrics.Failed != nil {
+			h.config.Metrics.Failed(err)
+		}
+		return
+	}
+
+	if h.config.Metrics.Received != nil {
+		h.config.Metrics.Received(topic)
+	}
+}
@@ -0,0 +1,393 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// fakeConn records the messages it publishes, and delivers them to its matching subscriptions
+type fakeConn struct {
+	published []*Msg
+	subs      map[string]func(msg *Msg)
+	queues    []string
+	err       error // returned by publish and subscribe, if set
+	mu        sync.Mutex
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{subs: map[string]func(msg *Msg){}}
+}
+
+func (c *fakeConn) Publish(msg *Msg) error {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.published = append(c.published, msg)
+	var handlers []func(msg *Msg)
+	for subject, handler := range c.subs {
+		if _, ok := (Rule{Subject: subject, Topic: strings.NewReplacer("*", "+", ">", "#", ".", "/").Replace(subject)}).topic(msg.Subject); ok {
+			handlers = append(handlers, handler)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (c *fakeConn) Subscribe(subject, queue string, handler func(msg *Msg)) (func() error, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	c.subs[subject] = handler
+	c.queues = append(c.queues, queue)
+	return func() error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.subs, subject)
+		return nil
+	}, nil
+}
+
+func (c *fakeConn) messages() []*Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Msg(nil), c.published...)
+}
+
+// fakeJetStream records the messages it publishes
+type fakeJetStream struct {
+	published []*Msg
+	block     chan struct{} // publish waits for it to be closed, if set
+	mu        sync.Mutex
+}
+
+func (js *fakeJetStream) Publish(ctx context.Context, msg *Msg) error {
+	if js.block != nil {
+		<-js.block
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.published = append(js.published, msg)
+	return nil
+}
+
+func (js *fakeJetStream) messages() []*Msg {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return append([]*Msg(nil), js.published...)
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	natsHook := new(Hook)
+	natsHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, natsHook.Init(options))
+	t.Cleanup(func() { natsHook.Stop() })
+	return natsHook
+}
+
+func publish(h *Hook, topic string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(topic)})
+}
+
+func TestID(t *testing.T) {
+	natsHook := new(Hook)
+
+	require.Equal(t, "nats-bridge-hook", natsHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	natsHook := new(Hook)
+
+	require.True(t, natsHook.Provides(mqtt.OnStarted))
+	require.True(t, natsHook.Provides(mqtt.OnPublished))
+	require.False(t, natsHook.Provides(mqtt.OnPublish))
+}
+
+func TestDirection(t *testing.T) {
+	require.Equal(t, "both", Both.String())
+	require.Equal(t, "direction(5)", Direction(5).String())
+
+	var d Direction
+	require.NoError(t, d.UnmarshalText([]byte("in")))
+	require.Equal(t, Inbound, d)
+	require.Error(t, d.UnmarshalText([]byte("sideways")))
+}
+
+func TestInit(t *testing.T) {
+	server := mqtt.New(nil)
+	rules := []Rule{{Topic: "#", Subject: "mqtt.>"}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - outbound",
+			config:      Options{Conn: newFakeConn(), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Success - inbound and jetstream",
+			config:      Options{Server: server, Conn: newFakeConn(), JetStream: new(fakeJetStream), Rules: []Rule{{Topic: "a", Subject: "a", Direction: Both, JetStream: true}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no conn",
+			config:      Options{Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Conn: newFakeConn()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Conn: newFakeConn(), Rules: []Rule{{Topic: "+", Subject: "a"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - inbound without server",
+			config:      Options{Conn: newFakeConn(), Rules: []Rule{{Topic: "a", Subject: "a", Direction: Inbound}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - jetstream rule without jetstream",
+			config:      Options{Conn: newFakeConn(), Rules: []Rule{{Topic: "a", Subject: "a", JetStream: true}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Conn: newFakeConn(), Rules: rules, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			natsHook := new(Hook)
+			natsHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := natsHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Len(t, natsHook.config.Origin, 16)
+				require.Equal(t, 1000, natsHook.config.QueueSize)
+				require.NoError(t, natsHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestOutbound(t *testing.T) {
+	conn := newFakeConn()
+	var forwarded []string
+	natsHook := newHook(t, Options{
+		Server: mqtt.New(nil),
+		Conn:   conn,
+		Rules: []Rule{
+			{Topic: "commands/#", Subject: "commands.>", Direction: Inbound},
+			{Topic: "devices/+/telemetry", Subject: "telemetry.*"},
+			{Topic: "devices/#", Subject: "devices.>"},
+		},
+		Origin: "edge-1",
+		Metrics: Metrics{
+			Forwarded: func(subject string) { forwarded = append(forwarded, subject) },
+		},
+	})
+
+	// the first outbound rule matching a topic applies
+	publish(natsHook, "devices/d1/telemetry")
+	publish(natsHook, "devices/d1/status")
+	publish(natsHook, "commands/d1")
+	publish(natsHook, "other")
+	require.Eventually(t, func() bool {
+		return natsHook.Stats().Forwarded == 2
+	}, time.Second, time.Millisecond)
+
+	require.Equal(t, []string{"telemetry.d1", "devices.d1.status"}, forwarded)
+	msgs := conn.messages()
+	require.Equal(t, []byte("devices/d1/telemetry"), msgs[0].Data)
+	require.Equal(t, []string{"c1"}, msgs[0].Header[HeaderClient])
+	require.Equal(t, []string{"edge-1"}, msgs[0].Header[HeaderOrigin])
+
+	conn.mu.Lock()
+	conn.err = errors.New("connection closed")
+	conn.mu.Unlock()
+	publish(natsHook, "devices/d1/status")
+	require.NoError(t, natsHook.Stop())
+	require.Equal(t, Stats{Forwarded: 2, Failed: 1}, natsHook.Stats())
+}
+
+func TestJetStream(t *testing.T) {
+	js := &fakeJetStream{block: make(chan struct{})}
+	var dropped int
+	natsHook := newHook(t, Options{
+		Conn:      newFakeConn(),
+		JetStream: js,
+		Rules:     []Rule{{Topic: "#", Subject: "mqtt.>", JetStream: true}},
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// the first message is being published, the second is queued, and the third is dropped
+	publish(natsHook, "a")
+	require.Eventually(t, func() bool {
+		return natsHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(natsHook, "b")
+	publish(natsHook, "c")
+	require.Equal(t, 1, dropped)
+
+	// the queued messages are published when the hook stops
+	close(js.block)
+	require.NoError(t, natsHook.Stop())
+	require.Len(t, js.messages(), 2)
+	require.Equal(t, "mqtt.b", js.messages()[1].Subject)
+	require.Equal(t, Stats{Forwarded: 2, Dropped: 1}, natsHook.Stats())
+
+	// messages published once the hook has stopped are ignored
+	publish(natsHook, "d")
+	require.NoError(t, natsHook.Stop())
+}
+
+func TestBuffer(t *testing.T) {
+	js := &fakeJetStream{block: make(chan struct{})}
+	options := Options{
+		Conn:      newFakeConn(),
+		JetStream: js,
+		Rules:     []Rule{{Topic: "#", Subject: "mqtt.>", JetStream: true}},
+		Buffer:    &bridge.Buffer{Dir: t.TempDir()},
+	}
+	natsHook := newHook(t, options)
+
+	// the first message is being published when the hook stops, and the second is kept in the buffer
+	publish(natsHook, "a")
+	require.Eventually(t, func() bool {
+		return natsHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(natsHook, "b")
+
+	stopped := make(chan error)
+	go func() { stopped <- natsHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(js.block)
+	require.NoError(t, <-stopped)
+	require.Len(t, js.messages(), 1)
+
+	// and is published with its headers once the hook is restarted
+	js = new(fakeJetStream)
+	options.JetStream = js
+	natsHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return len(js.messages()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, "mqtt.b", js.messages()[0].Subject)
+	require.Equal(t, []byte("b"), js.messages()[0].Data)
+	require.Equal(t, []string{"b"}, js.messages()[0].Header[HeaderTopic])
+}
+
+func TestServer(t *testing.T) {
+	conn := newFakeConn()
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	var mu sync.Mutex
+	var received []packets.Packet
+	require.NoError(t, server.Subscribe("devices/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, pk)
+	}))
+
+	natsHook := new(Hook)
+	require.NoError(t, server.AddHook(natsHook, Options{
+		Server: server,
+		Conn:   conn,
+		Rules: []Rule{
+			{Topic: "devices/+/commands", Subject: "commands.*", Direction: Inbound, Queue: "brokers", Qos: 1},
+			{Topic: "devices/+/status", Subject: "status.*", Direction: Both},
+		},
+	}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+	require.Equal(t, []string{"brokers", ""}, conn.queues)
+
+	// messages from NATS are published to the broker with their properties
+	require.NoError(t, conn.Publish(&Msg{
+		Subject: "commands.d1",
+		Header:  map[string][]string{HeaderContentType: {"text/plain"}, "site": {"north"}},
+		Data:    []byte("reboot"),
+	}))
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 1
+	}, time.Second, time.Millisecond)
+
+	mu.Lock()
+	require.Equal(t, "devices/d1/commands", received[0].TopicName)
+	require.Equal(t, []byte("reboot"), received[0].Payload)
+	require.Equal(t, "text/plain", received[0].Properties.ContentType)
+	require.Equal(t, []packets.UserProperty{{Key: "site", Val: "north"}}, received[0].Properties.User)
+	mu.Unlock()
+
+	// messages published to the broker are forwarded once, and not received back from NATS
+	require.NoError(t, server.Publish("devices/d2/status", []byte("online"), false, 0))
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 2
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	require.Len(t, conn.messages(), 2)
+	require.Equal(t, "status.d2", conn.messages()[1].Subject)
+	require.Equal(t, Stats{Forwarded: 1, Received: 1}, natsHook.Stats())
+
+	// the subscriptions end when the hook stops
+	require.NoError(t, natsHook.Stop())
+	require.Empty(t, conn.subs)
+}
@@ -0,0 +1,245 @@
+package nats
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// the headers messages are given from the MQTT message, besides one for each of its user properties
+const (
+	HeaderTopic           = "Mqtt-Topic"
+	HeaderClient          = "Mqtt-Client"
+	HeaderQos             = "Mqtt-Qos"
+	HeaderRetain          = "Mqtt-Retain"
+	HeaderContentType     = "Content-Type"
+	HeaderPayloadFormat   = "Mqtt-Payload-Format"
+	HeaderResponseTopic   = "Mqtt-Response-Topic"
+	HeaderCorrelationData = "Mqtt-Correlation-Data" // base64 encoded
+
+	// HeaderOrigin is the origin of the hook which forwarded the message, so the hook doesn't
+	// publish the messages it forwarded back to the broker
+	HeaderOrigin = "Mqtt-Bridge"
+)
+
+// validate checks the topic filter and subject of the rule, and that their wildcards correspond
+func (r Rule) validate() error {
+	if r.Direction < Outbound || r.Direction > Both {
+		return fmt.Errorf("has invalid direction %d", r.Direction)
+	}
+
+	if !mqtt.IsValidFilter(r.Topic, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Topic)
+	}
+
+	if r.Subject == "" {
+		return errors.New("has no subject")
+	}
+
+	var filter, subject []string
+	for _, level := range strings.Split(r.Topic, "/") {
+		switch level {
+		case "+":
+			filter = append(filter, "*")
+		case "#":
+			filter = append(filter, ">")
+		}
+	}
+
+	tokens := strings.Split(r.Subject, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "" || strings.ContainsAny(token, " \t\r\n"):
+			return fmt.Errorf("has invalid subject %q", r.Subject)
+		case token == "*", token == ">" && i == len(tokens)-1:
+			subject = append(subject, token)
+		case strings.ContainsAny(token, "*>"):
+			return fmt.Errorf("has invalid subject wildcard in %q", r.Subject)
+		}
+	}
+
+	if strings.Join(filter, "") != strings.Join(subject, "") {
+		return fmt.Errorf("has wildcards in subject %q which don't correspond to those of %q", r.Subject, r.Topic)
+	}
+
+	if r.Qos > 2 {
+		return fmt.Errorf("has invalid qos %d", r.Qos)
+	}
+	return nil
+}
+
+// subject returns the subject a message published to the topic is forwarded to, and false if the
+// topic doesn't match the filter of the rule
+func (r Rule) subject(topic string) (string, bool) {
+	if strings.HasPrefix(topic, "$") && (r.Topic[0] == '+' || r.Topic[0] == '#') {
+		return "", false
+	}
+
+	captures, ok := capture(strings.Split(r.Topic, "/"), strings.Split(topic, "/"), "+", "#")
+	if !ok {
+		return "", false
+	}
+
+	for _, c := range captures {
+		for i, level := range c {
+			c[i] = sanitize(level, ". \t\r\n*>")
+		}
+	}
+
+	subject := substitute(strings.Split(r.Subject, "."), captures, "*", ">")
+	if len(subject) == 0 {
+		return "", false // the subject was only a wildcard matching no levels
+	}
+	return strings.Join(subject, "."), true
+}
+
+// topic returns the topic a message received on the subject is published to, and false if the
+// subject doesn't match that of the rule
+func (r Rule) topic(subject string) (string, bool) {
+	captures, ok := capture(strings.Split(r.Subject, "."), strings.Split(subject, "."), "*", ">")
+	if !ok {
+		return "", false
+	}
+
+	for _, c := range captures {
+		for i, token := range c {
+			c[i] = sanitize(token, "/+#")
+		}
+	}
+	return strings.Join(substitute(strings.Split(r.Topic, "/"), captures, "+", "#"), "/"), true
+}
+
+// capture matches the parts against the pattern, returning the parts matched by each of its single
+// and multi part wildcards, and false if they don't match. A multi part wildcard matches no parts in
+// MQTT, but at least one in NATS
+func capture(pattern, parts []string, one, rest string) ([][]string, bool) {
+	var captures [][]string
+	for i, p := range pattern {
+		switch {
+		case p == rest:
+			if rest == ">" && i == len(parts) {
+				return nil, false
+			}
+			return append(captures, parts[min(i, len(parts)):]), true
+		case i >= len(parts):
+			return nil, false
+		case p == one:
+			captures = append(captures, parts[i:i+1:i+1])
+		case p != parts[i]:
+			return nil, false
+		}
+	}
+
+	if len(parts) != len(pattern) {
+		return nil, false
+	}
+	return captures, true
+}
+
+// substitute replaces the wildcards of the pattern with the parts they captured in the other pattern
+func substitute(pattern []string, captures [][]string, one, rest string) []string {
+	var parts []string
+	for _, p := range pattern {
+		if p == one || p == rest {
+			parts = append(parts, captures[0]...)
+			captures = captures[1:]
+			continue
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// sanitize replaces the characters which aren't allowed in a subject token or topic level with
+// underscores, as is an empty token or level
+func sanitize(s, disallowed string) string {
+	if s == "" {
+		return "_"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(disallowed, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// headers returns the headers of the message forwarded from the MQTT message, from its properties
+func headers(cl *mqtt.Client, pk packets.Packet, origin string) map[string][]string {
+	h := map[string][]string{
+		HeaderTopic:  {pk.TopicName},
+		HeaderClient: {cl.ID},
+		HeaderQos:    {strconv.Itoa(int(pk.FixedHeader.Qos))},
+		HeaderOrigin: {origin},
+	}
+
+	if pk.FixedHeader.Retain {
+		h[HeaderRetain] = []string{"true"}
+	}
+
+	if pk.Properties.ContentType != "" {
+		h[HeaderContentType] = []string{pk.Properties.ContentType}
+	}
+
+	if pk.Properties.PayloadFormatFlag {
+		h[HeaderPayloadFormat] = []string{strconv.Itoa(int(pk.Properties.PayloadFormat))}
+	}
+
+	if pk.Properties.ResponseTopic != "" {
+		h[HeaderResponseTopic] = []string{pk.Properties.ResponseTopic}
+	}
+
+	if len(pk.Properties.CorrelationData) > 0 {
+		h[HeaderCorrelationData] = []string{base64.StdEncoding.EncodeToString(pk.Properties.CorrelationData)}
+	}
+
+	for _, p := range pk.Properties.User {
+		h[p.Key] = append(h[p.Key], p.Val)
+	}
+	return h
+}
+
+// properties returns the MQTT properties of the headers of a message received from NATS, reversing
+// those of forwarded messages, with the other headers as user properties in the order of their keys
+func properties(header map[string][]string) packets.Properties {
+	var p packets.Properties
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		values := header[k]
+		if len(values) == 0 {
+			continue
+		}
+
+		switch k {
+		case HeaderTopic, HeaderClient, HeaderQos, HeaderRetain, HeaderOrigin:
+		case HeaderContentType:
+			p.ContentType = values[0]
+		case HeaderPayloadFormat:
+			p.PayloadFormat, p.PayloadFormatFlag = 0, true
+			if values[0] == "1" {
+				p.PayloadFormat = 1
+			}
+		case HeaderResponseTopic:
+			p.ResponseTopic = values[0]
+		case HeaderCorrelationData:
+			p.CorrelationData, _ = base64.StdEncoding.DecodeString(values[0])
+		default:
+			for _, v := range values {
+				p.User = append(p.User, packets.UserProperty{Key: k, Val: v})
+			}
+		}
+	}
+	return p
+}
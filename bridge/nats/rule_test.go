@@ -0,0 +1,234 @@
+package nats
+
+import (
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectError bool
+	}{
+		{
+			name: "Success - wildcards",
+			rule: Rule{Topic: "devices/+/telemetry/#", Subject: "telemetry.*.>"},
+		},
+		{
+			name: "Success - literal",
+			rule: Rule{Topic: "alerts", Subject: "mqtt.alerts", Direction: Both, Qos: 1},
+		},
+		{
+			name:        "Failure - invalid filter",
+			rule:        Rule{Topic: "a/#/b", Subject: "a"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no subject",
+			rule:        Rule{Topic: "a"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - empty token",
+			rule:        Rule{Topic: "a", Subject: "a..b"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - partial wildcard",
+			rule:        Rule{Topic: "+", Subject: "a*"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - wildcard not last",
+			rule:        Rule{Topic: "#", Subject: ">.a"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - wildcards don't correspond",
+			rule:        Rule{Topic: "a/+/#", Subject: "a.>.*"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing wildcard",
+			rule:        Rule{Topic: "a/+", Subject: "a"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid direction",
+			rule:        Rule{Topic: "a", Subject: "a", Direction: 3},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid qos",
+			rule:        Rule{Topic: "a", Subject: "a", Qos: 3},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestRuleSubject(t *testing.T) {
+	tests := []struct {
+		name          string
+		rule          Rule
+		topic         string
+		expectSubject string
+		expectMatch   bool
+	}{
+		{
+			name:          "Success - single level",
+			rule:          Rule{Topic: "devices/+/telemetry", Subject: "telemetry.*"},
+			topic:         "devices/d1/telemetry",
+			expectSubject: "telemetry.d1",
+			expectMatch:   true,
+		},
+		{
+			name:          "Success - multi level",
+			rule:          Rule{Topic: "devices/#", Subject: "mqtt.devices.>"},
+			topic:         "devices/d1/status",
+			expectSubject: "mqtt.devices.d1.status",
+			expectMatch:   true,
+		},
+		{
+			name:          "Success - multi level matching no levels",
+			rule:          Rule{Topic: "devices/#", Subject: "mqtt.devices.>"},
+			topic:         "devices",
+			expectSubject: "mqtt.devices",
+			expectMatch:   true,
+		},
+		{
+			name:          "Success - sanitized levels",
+			rule:          Rule{Topic: "#", Subject: ">"},
+			topic:         "a.b/c d//*",
+			expectSubject: "a_b.c_d._._",
+			expectMatch:   true,
+		},
+		{
+			name:  "Failure - no match",
+			rule:  Rule{Topic: "devices/+/telemetry", Subject: "telemetry.*"},
+			topic: "devices/d1/status",
+		},
+		{
+			name:  "Failure - too many levels",
+			rule:  Rule{Topic: "devices/+", Subject: "devices.*"},
+			topic: "devices/d1/status",
+		},
+		{
+			name:  "Failure - system topic",
+			rule:  Rule{Topic: "#", Subject: "mqtt.>"},
+			topic: "$SYS/broker/uptime",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			subject, ok := tt.rule.subject(tt.topic)
+			require.Equal(t, tt.expectMatch, ok)
+			require.Equal(t, tt.expectSubject, subject)
+
+		})
+	}
+}
+
+func TestRuleTopic(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		subject     string
+		expectTopic string
+		expectMatch bool
+	}{
+		{
+			name:        "Success - single token",
+			rule:        Rule{Topic: "devices/+/commands", Subject: "commands.*"},
+			subject:     "commands.d1",
+			expectTopic: "devices/d1/commands",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - multi token",
+			rule:        Rule{Topic: "nats/#", Subject: "events.>"},
+			subject:     "events.a.b",
+			expectTopic: "nats/a/b",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - sanitized tokens",
+			rule:        Rule{Topic: "nats/+", Subject: "*"},
+			subject:     "a/b+#",
+			expectTopic: "nats/a_b__",
+			expectMatch: true,
+		},
+		{
+			name:    "Failure - multi token matching no tokens",
+			rule:    Rule{Topic: "nats/#", Subject: "events.>"},
+			subject: "events",
+		},
+		{
+			name:    "Failure - no match",
+			rule:    Rule{Topic: "nats/+", Subject: "events.*"},
+			subject: "alerts.a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			topic, ok := tt.rule.topic(tt.subject)
+			require.Equal(t, tt.expectMatch, ok)
+			require.Equal(t, tt.expectTopic, topic)
+
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "a/b",
+		Properties: packets.Properties{
+			ContentType:       "application/json",
+			PayloadFormat:     1,
+			PayloadFormatFlag: true,
+			ResponseTopic:     "a/reply",
+			CorrelationData:   []byte{1, 2},
+			User:              []packets.UserProperty{{Key: "site", Val: "north"}, {Key: "site", Val: "south"}},
+		},
+	}
+
+	header := headers(cl, pk, "origin")
+	require.Equal(t, map[string][]string{
+		HeaderTopic:           {"a/b"},
+		HeaderClient:          {"c1"},
+		HeaderQos:             {"1"},
+		HeaderOrigin:          {"origin"},
+		HeaderRetain:          {"true"},
+		HeaderContentType:     {"application/json"},
+		HeaderPayloadFormat:   {"1"},
+		HeaderResponseTopic:   {"a/reply"},
+		HeaderCorrelationData: {"AQI="},
+		"site":                {"north", "south"},
+	}, header)
+
+	// the properties are restored from the headers
+	require.Equal(t, pk.Properties, properties(header))
+	require.Equal(t, packets.Properties{}, properties(nil))
+}
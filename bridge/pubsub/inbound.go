@@ -0,0 +1,668 @@
+// Package pubsub provides a bridge hook which pulls the messages of Google Cloud Pub/Sub
+// subscriptions and publishes them to the broker, on topics rendered from their attributes.
+//
+// Messages are pulled, acknowledged and leased through a Subscriber, which is a thin adapter of the
+// Pub/Sub client of the application, eg. for the apiv1 SubscriberClient of cloud.google.com/go/pubsub:
+//
+//	type subscriber struct{ *pubsubv1.SubscriberClient }
+//
+//	func (s subscriber) Pull(ctx context.Context, subscription string, max int) ([]mqttpubsub.Message, error) {
+//		res, err := s.SubscriberClient.Pull(ctx, &pubsubpb.PullRequest{Subscription: subscription, MaxMessages: int32(max)})
+//		if err != nil {
+//			return nil, err
+//		}
+//		msgs := make([]mqttpubsub.Message, len(res.ReceivedMessages))
+//		for i, m := range res.ReceivedMessages {
+//			msgs[i] = mqttpubsub.Message{
+//				ID: m.Message.MessageId, AckID: m.AckId, Data: m.Message.Data, Attributes: m.Message.Attributes,
+//				OrderingKey: m.Message.OrderingKey, PublishTime: m.Message.PublishTime.AsTime(), DeliveryAttempt: int(m.DeliveryAttempt),
+//			}
+//		}
+//		return msgs, nil
+//	}
+//
+//	func (s subscriber) Acknowledge(ctx context.Context, subscription string, ackIDs []string) error {
+//		return s.SubscriberClient.Acknowledge(ctx, &pubsubpb.AcknowledgeRequest{Subscription: subscription, AckIds: ackIDs})
+//	}
+//
+//	func (s subscriber) ModifyAckDeadline(ctx context.Context, subscription string, ackIDs []string, deadline time.Duration) error {
+//		return s.SubscriberClient.ModifyAckDeadline(ctx, &pubsubpb.ModifyAckDeadlineRequest{
+//			Subscription: subscription, AckIds: ackIDs, AckDeadlineSeconds: int32(deadline / time.Second),
+//		})
+//	}
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// InboundClientID is the id of the inline client which publishes the pulled messages
+const InboundClientID = "pubsub-inbound-bridge"
+
+const (
+	maxPull    = 1000 // the most messages pulled at once
+	maxAckIDs  = 1000 // the most ack ids acknowledged or modified at once, keeping requests small
+	ackEvery   = 100 * time.Millisecond
+	minLease   = 10 * time.Second  // the shortest ack deadline Pub/Sub allows
+	maxLease   = 600 * time.Second // the longest ack deadline Pub/Sub allows
+	leaseShare = 2                 // leases are extended once this share of the ack deadline is left
+)
+
+// Message is a message pulled from a subscription
+type Message struct {
+	ID              string
+	AckID           string
+	Data            []byte
+	Attributes      map[string]string
+	OrderingKey     string
+	PublishTime     time.Time
+	DeliveryAttempt int // set if the subscription has a dead letter policy
+}
+
+// Subscriber pulls messages from Pub/Sub subscriptions, usually a thin adapter of a Pub/Sub client
+type Subscriber interface {
+	// Pull returns up to max messages of the subscription, waiting for at least one until the context
+	// ends
+	Pull(ctx context.Context, subscription string, max int) ([]Message, error)
+
+	// Acknowledge acknowledges the messages, so they aren't delivered again
+	Acknowledge(ctx context.Context, subscription string, ackIDs []string) error
+
+	// ModifyAckDeadline sets the deadline by which the messages must be acknowledged from now, and a
+	// deadline of 0 makes them available to be delivered again at once
+	ModifyAckDeadline(ctx context.Context, subscription string, ackIDs []string, deadline time.Duration) error
+}
+
+// InboundRule publishes the messages of a subscription to the broker. Topic is a template, in which
+// each placeholder is replaced by the attribute of the message of the same name, eg.
+// "devices/{device}/commands", and defaults to "{mqtt_topic}". Messages lacking an attribute of the
+// template are nacked, so they are delivered again, or to the dead letter topic of the subscription
+type InboundRule struct {
+	// Subscription is the full name of the subscription, "projects/{project}/subscriptions/{id}"
+	Subscription string `yaml:"subscription" json:"subscription"`
+
+	Topic  string `yaml:"topic" json:"topic"`
+	Qos    byte   `yaml:"qos" json:"qos"`
+	Retain bool   `yaml:"retain" json:"retain"`
+}
+
+// InboundMetrics are called as messages are pulled. Unset funcs are skipped
+type InboundMetrics struct {
+	// Published is called for each message published to the broker
+	Published func(topic string)
+
+	// Failed is called for each message which could not be published, and is nacked
+	Failed func(subscription string, err error)
+
+	// Expired is called for each message held for longer than MaxExtension, whose lease is no longer
+	// extended so it may be delivered again
+	Expired func(subscription string)
+
+	// Paused is called when publishing is paused because the broker is backed up, and resumed
+	Paused func(paused bool)
+}
+
+// InboundStats are the totals of the messages pulled since the hook was initialized
+type InboundStats struct {
+	Pulled    int64 // the number of messages pulled
+	Published int64 // the number of messages published to the broker and acknowledged
+	Failed    int64 // the number of messages which could not be published, and were nacked
+	Expired   int64 // the number of messages whose lease was no longer extended
+	Pauses    int64 // the number of times publishing was paused
+}
+
+// InboundHook is a hook that pulls messages from Pub/Sub subscriptions and publishes them to the broker
+type InboundHook struct {
+	config  InboundOptions
+	client  *mqtt.Client // publishes the pulled messages
+	subs    []*subscription
+	paused  atomic.Bool
+	stats   InboundStats
+	statsMu sync.Mutex
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mqtt.HookBase
+}
+
+// InboundOptions is a struct that contains all the information required to configure the pubsub
+// inbound hook
+type InboundOptions struct {
+	// Server is the server the messages are published to
+	Server *mqtt.Server
+
+	// Subscriber pulls the messages
+	Subscriber Subscriber
+
+	// Rules are the subscriptions to pull, and the topics their messages are published to
+	Rules []InboundRule
+
+	// MaxOutstandingMessages and MaxOutstandingBytes limit the messages of each subscription which
+	// are pulled but not yet acknowledged, defaulting to 1000 messages and 100MiB. Pulling waits while
+	// either is reached
+	MaxOutstandingMessages int
+	MaxOutstandingBytes    int
+
+	// Workers is how many messages of each subscription are published at once, defaults to 1 so they
+	// are published in the order they are pulled
+	Workers int
+
+	// AckDeadline is the deadline the leases of outstanding messages are extended by, between 10
+	// seconds and 10 minutes, defaulting to 1 minute. Leases are extended until the messages are
+	// acknowledged, or until they have been held for MaxExtension, defaulting to 1 hour
+	AckDeadline  time.Duration
+	MaxExtension time.Duration
+
+	// MaxInflight pauses publishing while the broker has as many QoS 1 and 2 messages in flight to its
+	// clients, until they fall below it, so messages are held, with their leases extended, rather than
+	// buffered by the broker. Publishing is never paused if it is 0
+	MaxInflight int64
+
+	// Timeout is how long acknowledging and modifying deadlines may take, defaults to 10 seconds
+	Timeout time.Duration
+
+	// Backoff spaces pulls which fail, defaulting to intervals from 100ms to 10 seconds. Pulls are
+	// retried by its Forever, so pulling never gives up
+	Backoff retry.Policy
+
+	Metrics InboundMetrics
+}
+
+// lease is a message which is pulled but not yet acknowledged
+type lease struct {
+	received time.Time
+	size     int
+}
+
+// subscription tracks the messages of a subscription from when they are pulled until they are
+// acknowledged or nacked
+type subscription struct {
+	rule     InboundRule
+	messages chan Message     // the pulled messages waiting to be published
+	released chan struct{}    // signalled when outstanding messages are released
+	leases   map[string]lease // the outstanding messages, by ack id
+	bytes    int              // the size of the outstanding messages
+	acks     []string         // the ack ids of the messages to acknowledge
+	nacks    []string         // the ack ids of the messages to nack
+	workers  sync.WaitGroup
+	mu       sync.Mutex // guards leases, bytes, acks and nacks
+}
+
+// ID returns the ID of the hook
+func (h *InboundHook) ID() string {
+	return "pubsub-inbound-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *InboundHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *InboundHook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	inboundHookConfig, ok := config.(InboundOptions)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if inboundHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if inboundHookConfig.Subscriber == nil {
+		return errors.New("subscriber is required")
+	}
+
+	if len(inboundHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	seen := map[string]bool{}
+	for i, rule := range inboundHookConfig.Rules {
+		if rule.Topic == "" {
+			inboundHookConfig.Rules[i].Topic = "{" + AttributeTopic + "}"
+		}
+
+		if err := inboundHookConfig.Rules[i].validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+
+		if seen[rule.Subscription] {
+			return fmt.Errorf("rule %d has duplicate subscription %q", i, rule.Subscription)
+		}
+		seen[rule.Subscription] = true
+	}
+
+	if inboundHookConfig.AckDeadline == 0 {
+		inboundHookConfig.AckDeadline = time.Minute
+	}
+
+	if inboundHookConfig.AckDeadline < minLease || inboundHookConfig.AckDeadline > maxLease {
+		return fmt.Errorf("ack deadline must be between %s and %s", minLease, maxLease)
+	}
+
+	if inboundHookConfig.MaxOutstandingMessages <= 0 {
+		inboundHookConfig.MaxOutstandingMessages = 1000
+	}
+
+	if inboundHookConfig.MaxOutstandingBytes <= 0 {
+		inboundHookConfig.MaxOutstandingBytes = 100 << 20
+	}
+
+	if inboundHookConfig.Workers <= 0 {
+		inboundHookConfig.Workers = 1
+	}
+
+	if inboundHookConfig.MaxExtension <= 0 {
+		inboundHookConfig.MaxExtension = time.Hour
+	}
+
+	if inboundHookConfig.Timeout <= 0 {
+		inboundHookConfig.Timeout = 10 * time.Second
+	}
+
+	h.config = inboundHookConfig
+	h.client = inboundHookConfig.Server.NewClient(nil, "local", InboundClientID, true)
+	h.client.Properties.ProtocolVersion = 5
+	return nil
+}
+
+// OnStarted is called when the server has started, and starts pulling the subscriptions
+func (h *InboundHook) OnStarted() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	for _, rule := range h.config.Rules {
+		s := &subscription{
+			rule:     rule,
+			messages: make(chan Message, h.config.MaxOutstandingMessages),
+			released: make(chan struct{}, 1),
+			leases:   map[string]lease{},
+		}
+		h.subs = append(h.subs, s)
+
+		h.wg.Add(2)
+		go h.pull(ctx, s)
+		go h.manage(ctx, s)
+
+		s.workers.Add(h.config.Workers)
+		for i := 0; i < h.config.Workers; i++ {
+			go h.work(ctx, s)
+		}
+	}
+}
+
+// Stop stops pulling, acknowledges the published messages, and nacks those not yet published
+func (h *InboundHook) Stop() error {
+	if h.cancel == nil {
+		return nil
+	}
+
+	h.cancel()
+	h.wg.Wait()
+	h.cancel = nil
+	return nil
+}
+
+// Stats returns the totals of the messages pulled so far
+func (h *InboundHook) Stats() InboundStats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// Paused returns whether publishing is paused because the broker is backed up
+func (h *InboundHook) Paused() bool {
+	return h.paused.Load()
+}
+
+// pull pulls the messages of the subscription while it has fewer outstanding than allowed, until the
+// context is cancelled
+func (h *InboundHook) pull(ctx context.Context, s *subscription) {
+	defer h.wg.Done()
+
+	for ctx.Err() == nil {
+		n := s.available(h.config.MaxOutstandingMessages, h.config.MaxOutstandingBytes)
+		if n == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.released:
+			}
+			continue
+		}
+
+		var msgs []Message
+		err := h.config.Backoff.Forever(ctx, func(ctx context.Context) error {
+			var err error
+			msgs, err = h.config.Subscriber.Pull(ctx, s.rule.Subscription, min(n, maxPull))
+			if err != nil && ctx.Err() == nil {
+				h.Log.Error("error occurred while pulling pubsub messages", "error", err, "subscription", s.rule.Subscription)
+			}
+			return err
+		})
+		if err != nil || ctx.Err() != nil {
+			if len(msgs) > 0 {
+				h.nack(s.rule.Subscription, ackIDs(msgs))
+			}
+			return
+		}
+
+		s.lease(msgs)
+		h.statsMu.Lock()
+		h.stats.Pulled += int64(len(msgs))
+		h.statsMu.Unlock()
+
+		for _, msg := range msgs {
+			select {
+			case s.messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// work publishes the pulled messages of the subscription until the context is cancelled
+func (h *InboundHook) work(ctx context.Context, s *subscription) {
+	defer s.workers.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.messages:
+			for h.backpressure(ctx) {
+				// the message is held, and its lease extended, until the broker catches up
+			}
+			if ctx.Err() != nil {
+				s.release(msg.AckID, false)
+				return
+			}
+
+			err := h.publish(s.rule, msg)
+			if err != nil {
+				h.statsMu.Lock()
+				h.stats.Failed++
+				h.statsMu.Unlock()
+
+				h.Log.Error("error occurred while publishing pubsub message", "error", err, "subscription", s.rule.Subscription, "message_id", msg.ID)
+				if h.config.Metrics.Failed != nil {
+					h.config.Metrics.Failed(s.rule.Subscription, err)
+				}
+			}
+			s.release(msg.AckID, err == nil)
+		}
+	}
+}
+
+// manage acknowledges and nacks the released messages of the subscription, and extends the leases of
+// the outstanding ones, until the context is cancelled, when it nacks those which weren't published
+func (h *InboundHook) manage(ctx context.Context, s *subscription) {
+	defer h.wg.Done()
+
+	t := time.NewTicker(ackEvery)
+	defer t.Stop()
+
+	extended := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			s.workers.Wait()
+			h.flush(s)
+
+			s.mu.Lock()
+			var outstanding []string
+			for id := range s.leases {
+				outstanding = append(outstanding, id)
+			}
+			clear(s.leases)
+			s.mu.Unlock()
+
+			h.nack(s.rule.Subscription, outstanding)
+			return
+		case <-t.C:
+		}
+
+		h.flush(s)
+		if time.Since(extended) >= h.config.AckDeadline/leaseShare {
+			h.extend(s)
+			extended = time.Now()
+		}
+	}
+}
+
+// flush acknowledges and nacks the messages released since the last flush
+func (h *InboundHook) flush(s *subscription) {
+	s.mu.Lock()
+	acks, nacks := s.acks, s.nacks
+	s.acks, s.nacks = nil, nil
+	s.mu.Unlock()
+
+	for _, ids := range chunks(acks) {
+		ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+		err := h.config.Subscriber.Acknowledge(ctx, s.rule.Subscription, ids)
+		cancel()
+
+		if err != nil {
+			h.Log.Error("error occurred while acknowledging pubsub messages", "error", err, "subscription", s.rule.Subscription, "messages", len(ids))
+		}
+	}
+
+	h.nack(s.rule.Subscription, nacks)
+}
+
+// extend extends the leases of the outstanding messages by the ack deadline, and releases the
+// messages held for longer than the max extension
+func (h *InboundHook) extend(s *subscription) {
+	now := time.Now()
+	var ids []string
+	var expired int
+
+	s.mu.Lock()
+	for id, l := range s.leases {
+		if now.Sub(l.received) < h.config.MaxExtension {
+			ids = append(ids, id)
+			continue
+		}
+
+		delete(s.leases, id)
+		s.bytes -= l.size
+		expired++
+	}
+	s.mu.Unlock()
+
+	if expired > 0 {
+		s.signal()
+
+		h.statsMu.Lock()
+		h.stats.Expired += int64(expired)
+		h.statsMu.Unlock()
+
+		h.Log.Warn("stopped extending leases of pubsub messages held for too long", "subscription", s.rule.Subscription, "messages", expired)
+		if h.config.Metrics.Expired != nil {
+			for i := 0; i < expired; i++ {
+				h.config.Metrics.Expired(s.rule.Subscription)
+			}
+		}
+	}
+
+	for _, ids := range chunks(ids) {
+		ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+		err := h.config.Subscriber.ModifyAckDeadline(ctx, s.rule.Subscription, ids, h.config.AckDeadline)
+		cancel()
+
+		if err != nil {
+			h.Log.Error("error occurred while extending pubsub message leases", "error", err, "subscription", s.rule.Subscription, "messages", len(ids))
+		}
+	}
+}
+
+// nack makes the messages available to be delivered again at once
+func (h *InboundHook) nack(subscription string, ids []string) {
+	for _, ids := range chunks(ids) {
+		ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+		err := h.config.Subscriber.ModifyAckDeadline(ctx, subscription, ids, 0)
+		cancel()
+
+		if err != nil {
+			h.Log.Error("error occurred while nacking pubsub messages", "error", err, "subscription", subscription, "messages", len(ids))
+		}
+	}
+}
+
+// backpressure returns whether the broker is backed up, after waiting a little for it to catch up
+func (h *InboundHook) backpressure(ctx context.Context) bool {
+	backedUp := h.config.MaxInflight > 0 && atomic.LoadInt64(&h.config.Server.Info.Inflight) >= h.config.MaxInflight
+	if h.paused.CompareAndSwap(!backedUp, backedUp) {
+		if backedUp {
+			h.statsMu.Lock()
+			h.stats.Pauses++
+			h.statsMu.Unlock()
+		}
+
+		h.Log.Info("pubsub publishing paused while broker is backed up", "paused", backedUp)
+		if h.config.Metrics.Paused != nil {
+			h.config.Metrics.Paused(backedUp)
+		}
+	}
+
+	if backedUp {
+		return sleep(ctx, 50*time.Millisecond)
+	}
+	return false
+}
+
+// publish publishes the message to the broker with the rule
+func (h *InboundHook) publish(rule InboundRule, msg Message) error {
+	topic, err := rule.topic(msg)
+	if err != nil {
+		return err
+	}
+
+	if topic == "" || !mqtt.IsValidFilter(topic, true) {
+		return fmt.Errorf("invalid mqtt topic %q", topic)
+	}
+
+	err = h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    rule.Qos,
+			Retain: rule.Retain,
+		},
+		TopicName:  topic,
+		Payload:    msg.Data,
+		PacketID:   uint16(rule.Qos), // as the server publishes, the packet id is only checked to be set
+		Properties: properties(msg.Attributes),
+	})
+	if err != nil {
+		return err
+	}
+
+	h.statsMu.Lock()
+	h.stats.Published++
+	h.statsMu.Unlock()
+
+	if h.config.Metrics.Published != nil {
+		h.config.Metrics.Published(topic)
+	}
+	return nil
+}
+
+// available returns how many more messages may be pulled
+func (s *subscription) available(maxMessages, maxBytes int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bytes >= maxBytes {
+		return 0
+	}
+	return max(maxMessages-len(s.leases), 0)
+}
+
+// lease adds the pulled messages to those outstanding
+func (s *subscription) lease(msgs []Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, msg := range msgs {
+		s.leases[msg.AckID] = lease{received: now, size: len(msg.Data)}
+		s.bytes += len(msg.Data)
+	}
+}
+
+// release removes the message from those outstanding, to be acknowledged or nacked
+func (s *subscription) release(ackID string, ack bool) {
+	s.mu.Lock()
+	if l, ok := s.leases[ackID]; ok {
+		delete(s.leases, ackID)
+		s.bytes -= l.size
+	}
+
+	if ack {
+		s.acks = append(s.acks, ackID)
+	} else {
+		s.nacks = append(s.nacks, ackID)
+	}
+	s.mu.Unlock()
+
+	s.signal()
+}
+
+// signal wakes the puller if it waits for outstanding messages to be released
+func (s *subscription) signal() {
+	select {
+	case s.released <- struct{}{}:
+	default:
+	}
+}
+
+// ackIDs returns the ack ids of the messages
+func ackIDs(msgs []Message) []string {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.AckID
+	}
+	return ids
+}
+
+// chunks splits the ack ids into chunks of at most maxAckIDs
+func chunks(ids []string) [][]string {
+	var c [][]string
+	for len(ids) > 0 {
+		n := min(len(ids), maxAckIDs)
+		c = append(c, ids[:n])
+		ids = ids[n:]
+	}
+	return c
+}
+
+// sleep waits for the duration, returning false if the context ended first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
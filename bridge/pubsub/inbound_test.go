@@ -0,0 +1,408 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// modification is a call to ModifyAckDeadline
+type modification struct {
+	ids      []string
+	deadline time.Duration
+}
+
+// fakeSubscriber returns the batches sent to it, and records the acks and deadline modifications
+type fakeSubscriber struct {
+	pulls         chan []Message
+	maxes         []int
+	acks          []string
+	modifications []modification
+	mu            sync.Mutex
+}
+
+func newFakeSubscriber() *fakeSubscriber {
+	return &fakeSubscriber{pulls: make(chan []Message, 10)}
+}
+
+func (s *fakeSubscriber) Pull(ctx context.Context, subscription string, max int) ([]Message, error) {
+	s.mu.Lock()
+	s.maxes = append(s.maxes, max)
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case msgs := <-s.pulls:
+		if msgs == nil {
+			return nil, errors.New("service unavailable")
+		}
+		return msgs, nil
+	}
+}
+
+func (s *fakeSubscriber) Acknowledge(ctx context.Context, subscription string, ackIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks = append(s.acks, ackIDs...)
+	return nil
+}
+
+func (s *fakeSubscriber) ModifyAckDeadline(ctx context.Context, subscription string, ackIDs []string, deadline time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := append([]string(nil), ackIDs...)
+	sort.Strings(ids)
+	s.modifications = append(s.modifications, modification{ids: ids, deadline: deadline})
+	return nil
+}
+
+func (s *fakeSubscriber) acked() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.acks...)
+}
+
+func (s *fakeSubscriber) modified() []modification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]modification(nil), s.modifications...)
+}
+
+func (s *fakeSubscriber) pulled() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.maxes...)
+}
+
+// nacked returns the sorted ack ids of the messages the subscriber was asked to deliver again
+func nacked(s *fakeSubscriber) []string {
+	var ids []string
+	for _, m := range s.modified() {
+		if m.deadline == 0 {
+			ids = append(ids, m.ids...)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// newInboundServer returns a started server with the inbound hook, and the messages published to
+// the broker
+func newInboundServer(t *testing.T, options InboundOptions) (*mqtt.Server, *InboundHook, func() []packets.Packet) {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	var mu sync.Mutex
+	var received []packets.Packet
+	require.NoError(t, server.Subscribe("#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		if strings.HasPrefix(pk.TopicName, "$") {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, pk)
+	}))
+
+	options.Server = server
+	inboundHook := new(InboundHook)
+	require.NoError(t, server.AddHook(inboundHook, options))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() {
+		inboundHook.Stop()
+		server.Close()
+	})
+
+	return server, inboundHook, func() []packets.Packet {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]packets.Packet(nil), received...)
+	}
+}
+
+func TestInboundID(t *testing.T) {
+	inboundHook := new(InboundHook)
+
+	require.Equal(t, "pubsub-inbound-bridge-hook", inboundHook.ID())
+}
+
+func TestInboundProvides(t *testing.T) {
+	inboundHook := new(InboundHook)
+
+	require.True(t, inboundHook.Provides(mqtt.OnStarted))
+	require.False(t, inboundHook.Provides(mqtt.OnPublished))
+}
+
+func TestInboundInit(t *testing.T) {
+	server := mqtt.New(nil)
+	rules := []InboundRule{{Subscription: "projects/p/subscriptions/commands"}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - rules",
+			config:      InboundOptions{Server: server, Subscriber: newFakeSubscriber(), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      InboundOptions{Subscriber: newFakeSubscriber(), Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no subscriber",
+			config:      InboundOptions{Server: server, Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      InboundOptions{Server: server, Subscriber: newFakeSubscriber()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      InboundOptions{Server: server, Subscriber: newFakeSubscriber(), Rules: []InboundRule{{Subscription: "commands"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - duplicate subscription",
+			config:      InboundOptions{Server: server, Subscriber: newFakeSubscriber(), Rules: append(rules, rules...)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - short ack deadline",
+			config:      InboundOptions{Server: server, Subscriber: newFakeSubscriber(), Rules: rules, AckDeadline: time.Second},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			inboundHook := new(InboundHook)
+			inboundHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := inboundHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "{mqtt_topic}", inboundHook.config.Rules[0].Topic)
+				require.Equal(t, time.Minute, inboundHook.config.AckDeadline)
+				require.Equal(t, 1000, inboundHook.config.MaxOutstandingMessages)
+				require.Equal(t, InboundClientID, inboundHook.client.ID)
+				require.NoError(t, inboundHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestInboundPublish(t *testing.T) {
+	commands := newFakeSubscriber()
+	var published []string
+	var failed int
+	_, inboundHook, received := newInboundServer(t, InboundOptions{
+		Subscriber: commands,
+		Rules: []InboundRule{
+			{Subscription: "projects/p/subscriptions/commands", Topic: "devices/{device}/commands", Qos: 1},
+		},
+		Metrics: InboundMetrics{
+			Published: func(topic string) { published = append(published, topic) },
+			Failed:    func(subscription string, err error) { failed++ },
+		},
+	})
+
+	commands.pulls <- []Message{
+		{
+			ID:    "1",
+			AckID: "a1",
+			Data:  []byte("reboot"),
+			Attributes: map[string]string{
+				"device":             "d1",
+				"site":               "north",
+				AttributeContentType: "text/plain",
+				AttributeClient:      "c1",
+			},
+		},
+		{ID: "2", AckID: "a2", Data: []byte("x")},                                                 // lacks the device attribute
+		{ID: "3", AckID: "a3", Data: []byte("y"), Attributes: map[string]string{"device": "d/+"}}, // renders a filter
+	}
+
+	// the published message is acknowledged, and the others nacked
+	require.Eventually(t, func() bool {
+		return len(commands.acked()) == 1 && len(nacked(commands)) == 2
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{"a1"}, commands.acked())
+	require.Equal(t, []string{"a2", "a3"}, nacked(commands))
+
+	got := received()
+	require.Len(t, got, 1)
+	require.Equal(t, "devices/d1/commands", got[0].TopicName)
+	require.Equal(t, []byte("reboot"), got[0].Payload)
+	require.Equal(t, byte(1), got[0].FixedHeader.Qos)
+	require.Equal(t, "text/plain", got[0].Properties.ContentType)
+	require.Equal(t, []packets.UserProperty{{Key: "device", Val: "d1"}, {Key: "site", Val: "north"}}, got[0].Properties.User)
+	require.Equal(t, []string{"devices/d1/commands"}, published)
+	require.Equal(t, 2, failed)
+
+	require.NoError(t, inboundHook.Stop())
+	require.Equal(t, InboundStats{Pulled: 3, Published: 1, Failed: 2}, inboundHook.Stats())
+}
+
+func TestInboundPullFailure(t *testing.T) {
+	subscriber := newFakeSubscriber()
+	_, inboundHook, received := newInboundServer(t, InboundOptions{
+		Subscriber: subscriber,
+		Rules:      []InboundRule{{Subscription: "projects/p/subscriptions/s"}},
+	})
+
+	// pulling is retried after a failure
+	subscriber.pulls <- nil
+	subscriber.pulls <- []Message{{AckID: "a1", Data: []byte("1"), Attributes: map[string]string{AttributeTopic: "a/b"}}}
+	require.Eventually(t, func() bool {
+		return len(received()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, "a/b", received()[0].TopicName)
+
+	require.NoError(t, inboundHook.Stop())
+	require.Equal(t, []string{"a1"}, subscriber.acked())
+}
+
+func TestInboundFlowControl(t *testing.T) {
+	subscriber := newFakeSubscriber()
+	var paused atomic.Int64
+	server, inboundHook, received := newInboundServer(t, InboundOptions{
+		Subscriber:             subscriber,
+		Rules:                  []InboundRule{{Subscription: "projects/p/subscriptions/s", Topic: "t"}},
+		MaxOutstandingMessages: 2,
+		MaxInflight:            10,
+		Metrics: InboundMetrics{
+			Paused: func(p bool) {
+				if p {
+					paused.Add(1)
+				}
+			},
+		},
+	})
+
+	// messages are held while the broker is backed up, and no more are pulled than may be outstanding
+	atomic.StoreInt64(&server.Info.Inflight, 10)
+	subscriber.pulls <- []Message{{AckID: "a1"}, {AckID: "a2"}}
+	require.Eventually(t, inboundHook.Paused, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, received())
+	require.Equal(t, []int{2}, subscriber.pulled())
+
+	// and their leases are extended meanwhile
+	inboundHook.extend(inboundHook.subs[0])
+	require.Equal(t, []modification{{ids: []string{"a1", "a2"}, deadline: time.Minute}}, subscriber.modified())
+
+	// once the broker catches up they are published and acknowledged, and pulling resumes
+	atomic.StoreInt64(&server.Info.Inflight, 0)
+	require.Eventually(t, func() bool {
+		return len(subscriber.acked()) == 2 && len(subscriber.pulled()) == 2
+	}, time.Second, time.Millisecond)
+	require.Len(t, received(), 2)
+	require.False(t, inboundHook.Paused())
+
+	require.NoError(t, inboundHook.Stop())
+	require.Equal(t, int64(1), paused.Load())
+	require.Equal(t, int64(1), inboundHook.Stats().Pauses)
+}
+
+func TestInboundOutstandingBytes(t *testing.T) {
+	subscriber := newFakeSubscriber()
+	server, inboundHook, _ := newInboundServer(t, InboundOptions{
+		Subscriber:          subscriber,
+		Rules:               []InboundRule{{Subscription: "projects/p/subscriptions/s", Topic: "t"}},
+		MaxOutstandingBytes: 4,
+		MaxInflight:         10,
+	})
+
+	// pulling waits while the outstanding messages are as large as allowed
+	atomic.StoreInt64(&server.Info.Inflight, 10)
+	subscriber.pulls <- []Message{{AckID: "a1", Data: []byte("1234")}}
+	require.Eventually(t, inboundHook.Paused, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, subscriber.pulled(), 1)
+
+	atomic.StoreInt64(&server.Info.Inflight, 0)
+	require.Eventually(t, func() bool {
+		return len(subscriber.pulled()) == 2
+	}, time.Second, time.Millisecond)
+	require.NoError(t, inboundHook.Stop())
+}
+
+func TestInboundExpiry(t *testing.T) {
+	subscriber := newFakeSubscriber()
+	var expired int
+	server, inboundHook, _ := newInboundServer(t, InboundOptions{
+		Subscriber:   subscriber,
+		Rules:        []InboundRule{{Subscription: "projects/p/subscriptions/s", Topic: "t"}},
+		MaxExtension: time.Millisecond,
+		MaxInflight:  10,
+		Metrics: InboundMetrics{
+			Expired: func(subscription string) { expired++ },
+		},
+	})
+
+	atomic.StoreInt64(&server.Info.Inflight, 10)
+	subscriber.pulls <- []Message{{AckID: "a1"}}
+	require.Eventually(t, inboundHook.Paused, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	// a message held for longer than the max extension is released without its lease being extended
+	inboundHook.extend(inboundHook.subs[0])
+	require.Empty(t, subscriber.modified())
+	require.Equal(t, 1, expired)
+	require.Equal(t, int64(1), inboundHook.Stats().Expired)
+
+	require.NoError(t, inboundHook.Stop())
+}
+
+func TestInboundStopNacks(t *testing.T) {
+	subscriber := newFakeSubscriber()
+	server, inboundHook, received := newInboundServer(t, InboundOptions{
+		Subscriber:  subscriber,
+		Rules:       []InboundRule{{Subscription: "projects/p/subscriptions/s", Topic: "t"}},
+		MaxInflight: 10,
+	})
+
+	atomic.StoreInt64(&server.Info.Inflight, 10)
+	subscriber.pulls <- []Message{{AckID: "a1"}, {AckID: "a2"}}
+	require.Eventually(t, inboundHook.Paused, time.Second, time.Millisecond)
+
+	// the messages which weren't published are nacked, so they are delivered again at once
+	require.NoError(t, inboundHook.Stop())
+	require.Empty(t, received())
+	require.Empty(t, subscriber.acked())
+
+	require.Equal(t, []string{"a1", "a2"}, nacked(subscriber))
+}
@@ -0,0 +1,71 @@
+package pubsub
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+// the attributes which messages published by MQTT bridges conventionally carry, which aren't given
+// to published messages as user properties
+const (
+	AttributeTopic       = "mqtt_topic"
+	AttributeClient      = "mqtt_client"
+	AttributeQos         = "mqtt_qos"
+	AttributeRetain      = "mqtt_retain"
+	AttributeContentType = "content_type"
+)
+
+// validate checks the subscription, topic template and QoS of the rule
+func (r InboundRule) validate() error {
+	parts := strings.Split(r.Subscription, "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[1] == "" || parts[2] != "subscriptions" || parts[3] == "" {
+		return fmt.Errorf("has invalid subscription %q", r.Subscription)
+	}
+
+	if err := bridge.Render(r.Topic, func(string) (string, bool) { return "", true }, func(string) {}); err != nil {
+		return fmt.Errorf("has invalid topic %q: %w", r.Topic, err)
+	}
+
+	if r.Qos > 2 {
+		return fmt.Errorf("has invalid qos %d", r.Qos)
+	}
+	return nil
+}
+
+// topic returns the topic the message is published to, whose template placeholders are replaced by
+// the attributes of the message
+func (r InboundRule) topic(msg Message) (string, error) {
+	var topic strings.Builder
+	err := bridge.Render(r.Topic, func(name string) (string, bool) {
+		value, ok := msg.Attributes[name]
+		return value, ok
+	}, func(s string) { topic.WriteString(s) })
+	return topic.String(), err
+}
+
+// properties returns the MQTT properties of the attributes of a message, the content type attribute
+// being its content type and the others, besides those MQTT bridges set, user properties
+func properties(attributes map[string]string) packets.Properties {
+	var p packets.Properties
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch name {
+		case AttributeTopic, AttributeClient, AttributeQos, AttributeRetain:
+		case AttributeContentType:
+			p.ContentType = attributes[name]
+		default:
+			p.User = append(p.User, packets.UserProperty{Key: name, Val: attributes[name]})
+		}
+	}
+	return p
+}
@@ -0,0 +1,78 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        InboundRule
+		expectError bool
+	}{
+		{
+			name: "Success - attribute template",
+			rule: InboundRule{Subscription: "projects/p/subscriptions/s", Topic: "devices/{device}/commands", Qos: 2},
+		},
+		{
+			name:        "Failure - subscription id only",
+			rule:        InboundRule{Subscription: "s", Topic: "t"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - topic name",
+			rule:        InboundRule{Subscription: "projects/p/topics/t", Topic: "t"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unclosed placeholder",
+			rule:        InboundRule{Subscription: "projects/p/subscriptions/s", Topic: "devices/{device"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid qos",
+			rule:        InboundRule{Subscription: "projects/p/subscriptions/s", Topic: "t", Qos: 3},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestRuleTopic(t *testing.T) {
+	rule := InboundRule{Topic: "sites/{site}/devices/{device}"}
+
+	topic, err := rule.topic(Message{Attributes: map[string]string{"site": "north", "device": "d1"}})
+	require.NoError(t, err)
+	require.Equal(t, "sites/north/devices/d1", topic)
+
+	_, err = rule.topic(Message{Attributes: map[string]string{"site": "north"}})
+	require.Error(t, err)
+}
+
+func TestProperties(t *testing.T) {
+	p := properties(map[string]string{
+		AttributeTopic:       "a/b",
+		AttributeQos:         "1",
+		AttributeContentType: "application/json",
+		"zone":               "2",
+		"site":               "north",
+	})
+
+	require.Equal(t, "application/json", p.ContentType)
+	require.Equal(t, []packets.UserProperty{{Key: "site", Val: "north"}, {Key: "zone", Val: "2"}}, p.User)
+}
@@ -0,0 +1,263 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// entry is an entry read from a stream, whose fields are nil if it was deleted since it was read
+type entry struct {
+	id     string
+	fields map[string]string
+}
+
+// read reads the stream of the rule through its group and publishes the entries until the context is
+// cancelled. The entries the consumer read but didn't acknowledge before, eg. as the broker stopped,
+// are read first
+func (h *Hook) read(ctx context.Context, rule InboundRule) {
+	defer h.readers.Done()
+
+	grouped := false
+	next := "0"     // the id after which entries are read, or > for new entries
+	cursor := "0-0" // where claiming continues
+	var claimed time.Time
+	for ctx.Err() == nil {
+		var entries []entry
+		err := h.config.Backoff.Forever(ctx, func(ctx context.Context) error {
+			var err error
+			entries = nil
+			switch {
+			case !grouped:
+				err = h.createGroup(ctx, rule)
+				grouped = err == nil
+			case h.config.ClaimIdle > 0 && time.Since(claimed) >= h.config.ClaimIdle:
+				entries, cursor, err = h.claim(ctx, rule, cursor)
+				if err == nil && cursor == "0-0" {
+					claimed = time.Now() // every pending entry has been checked
+				}
+			default:
+				entries, err = h.readGroup(ctx, rule, next)
+				if err == nil && next != ">" {
+					if len(entries) == 0 {
+						next = ">"
+					} else {
+						next = entries[len(entries)-1].id
+					}
+				}
+			}
+
+			if err != nil && ctx.Err() == nil {
+				var reply redisclient.Error
+				if errors.As(err, &reply) && strings.HasPrefix(string(reply), "NOGROUP") {
+					grouped = false // the stream or group was deleted
+				}
+
+				h.Log.Error("error occurred while reading redis stream", "error", err, "stream", rule.Stream, "group", rule.Group)
+			}
+			return err
+		})
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+
+		h.handle(rule, entries)
+	}
+}
+
+// createGroup creates the group of the rule, and the stream if it doesn't exist
+func (h *Hook) createGroup(ctx context.Context, rule InboundRule) error {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	_, err := h.redis.Do(ctx, "XGROUP", "CREATE", rule.Stream, rule.Group, rule.Start, "MKSTREAM")
+	var reply redisclient.Error
+	if errors.As(err, &reply) && strings.HasPrefix(string(reply), "BUSYGROUP") {
+		return nil // the group exists
+	}
+	return err
+}
+
+// readGroup reads the entries of the stream after the id, or the new entries, waiting for them for up
+// to Block, if it is >
+func (h *Hook) readGroup(ctx context.Context, rule InboundRule, id string) ([]entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	args := []any{"XREADGROUP", "GROUP", rule.Group, h.config.Consumer, "COUNT", h.config.Count}
+	if id == ">" {
+		args = append(args, "BLOCK", h.config.Block.Milliseconds())
+	}
+
+	reply, err := h.redis.Do(ctx, append(args, "STREAMS", rule.Stream, id)...)
+	if err != nil || reply == nil {
+		return nil, err // nil when no entries were added while blocked
+	}
+
+	streams, ok := reply.([]any)
+	if !ok || len(streams) != 1 {
+		return nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	stream, ok := streams[0].([]any)
+	if !ok || len(stream) != 2 {
+		return nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+	return parseEntries(stream[1])
+}
+
+// claim claims the entries of the group idle for ClaimIdle from the cursor, returning them with the
+// cursor claiming continues from, which is 0-0 once every pending entry has been checked
+func (h *Hook) claim(ctx context.Context, rule InboundRule, cursor string) ([]entry, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	reply, err := h.redis.Do(ctx, "XAUTOCLAIM", rule.Stream, rule.Group, h.config.Consumer,
+		h.config.ClaimIdle.Milliseconds(), cursor, "COUNT", h.config.Count)
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	// the reply has the deleted ids as a third element since Redis 7
+	values, ok := reply.([]any)
+	if !ok || len(values) < 2 {
+		return nil, cursor, fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	next, ok := values[0].(string)
+	if !ok {
+		return nil, cursor, fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	entries, err := parseEntries(values[1])
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	if len(entries) > 0 {
+		h.statsMu.Lock()
+		h.stats.Claimed += int64(len(entries))
+		h.statsMu.Unlock()
+	}
+	return entries, next, nil
+}
+
+// handle publishes the entries, and acknowledges them. Entries which can't be published are
+// acknowledged anyway, as they would fail again
+func (h *Hook) handle(rule InboundRule, entries []entry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	ids := make([]any, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.id)
+		if e.fields == nil {
+			continue
+		}
+
+		if err := h.publish(rule, e); err != nil {
+			h.reject(rule.Stream, e, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	if _, err := h.redis.Do(ctx, append([]any{"XACK", rule.Stream, rule.Group}, ids...)...); err != nil {
+		h.Log.Error("error occurred while acknowledging redis stream entries", "error", err, "stream", rule.Stream, "entries", len(ids))
+	}
+}
+
+// publish publishes the entry to the broker with the rule
+func (h *Hook) publish(rule InboundRule, e entry) error {
+	var topic strings.Builder
+	err := bridge.Render(rule.Topic, func(name string) (string, bool) {
+		value, ok := e.fields[name]
+		return value, ok
+	}, func(s string) { topic.WriteString(s) })
+	if err != nil {
+		return err
+	}
+
+	if topic.Len() == 0 || !mqtt.IsValidFilter(topic.String(), true) {
+		return fmt.Errorf("invalid mqtt topic %q", topic.String())
+	}
+
+	err = h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    rule.Qos,
+			Retain: rule.Retain,
+		},
+		TopicName:  topic.String(),
+		Payload:    []byte(e.fields[FieldPayload]),
+		PacketID:   uint16(rule.Qos), // as the server publishes, the packet id is only checked to be set
+		Properties: properties(e.fields),
+	})
+	if err != nil {
+		return err
+	}
+
+	h.statsMu.Lock()
+	h.stats.Received++
+	h.statsMu.Unlock()
+
+	if h.config.Metrics.Received != nil {
+		h.config.Metrics.Received(topic.String())
+	}
+	return nil
+}
+
+// reject counts and logs an entry which could not be published
+func (h *Hook) reject(stream string, e entry, err error) {
+	h.statsMu.Lock()
+	h.stats.Rejected++
+	h.statsMu.Unlock()
+
+	h.Log.Error("error occurred while publishing redis stream entry", "error", err, "stream", stream, "entry_id", e.id)
+	if h.config.Metrics.Rejected != nil {
+		h.config.Metrics.Rejected(stream, err)
+	}
+}
+
+// parseEntries parses the entries of a stream reply, each an id and a flat list of fields and values
+func parseEntries(reply any) ([]entry, error) {
+	values, ok := reply.([]any)
+	if !ok && reply != nil {
+		return nil, fmt.Errorf("unexpected entries %v", reply)
+	}
+
+	entries := make([]entry, 0, len(values))
+	for _, v := range values {
+		pair, ok := v.([]any)
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("unexpected entry %v", v)
+		}
+
+		id, ok := pair[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected entry id %v", pair[0])
+		}
+
+		e := entry{id: id}
+		if fields, ok := pair[1].([]any); ok {
+			e.fields = make(map[string]string, len(fields)/2)
+			for i := 0; i+1 < len(fields); i += 2 {
+				name, _ := fields[i].(string)
+				value, _ := fields[i+1].(string)
+				e.fields[name] = value
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,432 @@
+// Package redis provides a bridge hook appending the messages published to matching MQTT topics to
+// Redis Streams, trimmed to a maximum length, and reading streams through consumer groups to publish
+// their entries to the broker, so MQTT can be integrated with applications already running Redis.
+//
+// Entries are appended with XADD in pipelines, and have the fields topic, client, qos, payload, and
+// retain and content_type when set, besides one for each user property of the message. Entries read
+// from streams are published with the payload field as their payload, the content_type field as
+// their content type, and the fields the hook doesn't set as user properties.
+package redis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// ClientID is the id of the inline client which publishes the entries read from streams
+const ClientID = "redis-streams-bridge"
+
+// Rule appends the messages of the MQTT topics matching Filter, which may contain +/# wildcards, to the
+// stream Stream, a template in which {topic} is the MQTT topic, {client} is the id of the publishing
+// client, and {1}, {2}... are the levels of the topic, eg. "devices:{2}". Streams are trimmed to about
+// MaxLen entries as they are appended to, and aren't trimmed if it is 0. Where is an optional filter
+// expression (see pkg/filter) messages must also match, eg. "json.temperature > 30". Transform is an
+// optional template (see pkg/transform) the payloads of the messages are rewritten with, eg.
+// transform.Envelope
+type Rule struct {
+	Filter    string `yaml:"filter" json:"filter"`
+	Where     string `yaml:"where" json:"where"`
+	Transform string `yaml:"transform" json:"transform"`
+	Stream    string `yaml:"stream" json:"stream"`
+	MaxLen    int64  `yaml:"max_len" json:"max_len"`
+}
+
+// InboundRule publishes the entries of the stream Stream read by the consumer group Group, which is
+// created from Start, the id of the last entry it has read, if it doesn't exist. Start defaults to $,
+// so only entries added since are read, and is 0 to read the whole stream. Topic is a template, in
+// which {name} is the value of the field name of the entry, and defaults to {topic}, eg.
+// "devices/{device}/commands"
+type InboundRule struct {
+	Stream string `yaml:"stream" json:"stream"`
+	Group  string `yaml:"group" json:"group"`
+	Start  string `yaml:"start" json:"start"`
+	Topic  string `yaml:"topic" json:"topic"`
+	Qos    byte   `yaml:"qos" json:"qos"`
+	Retain bool   `yaml:"retain" json:"retain"`
+}
+
+// Metrics are called as messages are bridged. Unset funcs are skipped
+type Metrics struct {
+	// Sent is called after messages of a rule have been appended to streams, with how long their
+	// pipeline took
+	Sent func(messages int, took time.Duration)
+
+	// Failed is called after messages could not be appended, and are discarded
+	Failed func(messages int, err error)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+
+	// Received is called for each entry read from a stream and published to the broker
+	Received func(topic string)
+
+	// Rejected is called for each entry which could not be published, and is acknowledged anyway
+	Rejected func(stream string, err error)
+}
+
+// Stats are the totals of the messages bridged since the hook was initialized
+type Stats struct {
+	Batches  int64 // the number of pipelines sent, or which failed
+	Sent     int64 // the number of messages appended to streams
+	Failed   int64 // the number of messages which could not be appended
+	Dropped  int64 // the number of messages discarded as the queue was full
+	Received int64 // the number of entries read from streams and published to the broker
+	Rejected int64 // the number of entries read which could not be published
+	Claimed  int64 // the number of entries claimed from other consumers
+}
+
+// Hook is a hook that bridges messages between the broker and Redis Streams
+type Hook struct {
+	config  Options
+	redis   redisclient.Client
+	client  *mqtt.Client // publishes the entries read from streams
+	bridge  *bridge.Bridge[command]
+	stats   Stats              // of the entries read
+	cancel  context.CancelFunc // stops reading
+	readers sync.WaitGroup
+	stopped atomic.Bool
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// command is the XADD command appending a message to a stream, which is queued as JSON in buffers
+type command struct {
+	Stream  string   `json:"stream"`
+	MaxLen  int64    `json:"max_len,omitempty"`
+	Fields  []string `json:"fields"` // the names and values of the fields besides the payload
+	Payload []byte   `json:"payload"`
+}
+
+// Options is a struct that contains all the information required to configure the redis streams hook
+type Options struct {
+	redisclient.ClientOptions // how to connect to the server, cluster or sentinels
+
+	// Client is used instead of connecting with the ClientOptions, eg. to use another Redis client library
+	Client redisclient.Client
+
+	// Server is the server entries are published to, and is required with inbound rules. It is
+	// published a bridge.Warning to $SYS/bridges/redis/dropped when messages are dropped, if it is set
+	Server *mqtt.Server
+
+	// Rules map MQTT topics to streams, and the first whose filter matches the topic of a message
+	// applies. Messages matching no rule aren't appended
+	Rules []Rule
+
+	// Inbound rules read streams through consumer groups to publish their entries to the broker
+	Inbound []InboundRule
+
+	// BatchSize is how many messages of a rule are appended in a pipeline, defaults to 100, and a
+	// pipeline is sent once it is full or its first message has waited for Linger, which defaults to 10ms
+	BatchSize int
+	Linger    time.Duration
+
+	// QueueSize is how many messages wait to be appended, defaults to 10000. Messages published while
+	// the queue is full, eg. because Redis is unavailable, wait for up to QueueBlock for room, and are
+	// then dropped by the Drop policy, which defaults to bridge.DropNewest
+	QueueSize  int
+	QueueBlock time.Duration
+	Drop       string
+
+	// Buffer queues messages on disk rather than in memory if it is set, so the messages which haven't
+	// been appended survive restarts of the broker and long outages of Redis
+	Buffer *bridge.Buffer
+
+	// Retry retries the messages of a pipeline which fail, and must limit the attempts or the time
+	// spent. Messages whose replies were lost may be appended twice. Pipelines are sent once if it is nil
+	Retry *retry.Policy
+
+	// Consumer is the name of the consumer reading the groups of inbound rules, which is unique to
+	// each broker sharing a group, and defaults to the hostname
+	Consumer string
+
+	// Count is the most entries read at once, defaults to 100. Block is how long a read waits for
+	// entries, defaults to 1 second, and must be shorter than the Timeout of the client
+	Count int
+	Block time.Duration
+
+	// ClaimIdle claims the entries other consumers of a group have read but not acknowledged for this
+	// long, eg. as their broker stopped, checking for them at the same interval. Entries of other
+	// consumers aren't claimed if it is 0
+	ClaimIdle time.Duration
+
+	// Backoff spaces reads which fail, defaulting to intervals from 100ms to 10 seconds. Reads are
+	// retried by its Forever, so reading never gives up
+	Backoff retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "redis-streams-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, checks that Redis can be reached, and starts
+// appending messages
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	redisHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if len(redisHookConfig.Rules) == 0 && len(redisHookConfig.Inbound) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range redisHookConfig.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+	}
+
+	if len(redisHookConfig.Inbound) > 0 && redisHookConfig.Server == nil {
+		return errors.New("server is required with inbound rules")
+	}
+
+	for i, rule := range redisHookConfig.Inbound {
+		if rule.Start == "" {
+			redisHookConfig.Inbound[i].Start = "$"
+		}
+
+		if rule.Topic == "" {
+			redisHookConfig.Inbound[i].Topic = "{" + FieldTopic + "}"
+		}
+
+		if err := redisHookConfig.Inbound[i].validate(); err != nil {
+			return fmt.Errorf("inbound rule %d %w", i, err)
+		}
+	}
+
+	if redisHookConfig.Retry != nil && redisHookConfig.Retry.MaxAttempts == 0 && redisHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if redisHookConfig.Timeout <= 0 {
+		redisHookConfig.Timeout = 5 * time.Second
+	}
+
+	if redisHookConfig.BatchSize <= 0 {
+		redisHookConfig.BatchSize = 100
+	}
+
+	if redisHookConfig.Linger <= 0 {
+		redisHookConfig.Linger = 10 * time.Millisecond
+	}
+
+	if redisHookConfig.QueueSize <= 0 {
+		redisHookConfig.QueueSize = 10000
+	}
+
+	if redisHookConfig.Count <= 0 {
+		redisHookConfig.Count = 100
+	}
+
+	if redisHookConfig.Block <= 0 {
+		redisHookConfig.Block = time.Second
+	}
+
+	if redisHookConfig.Block >= redisHookConfig.Timeout {
+		return errors.New("block must be shorter than the timeout")
+	}
+
+	if redisHookConfig.Consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get consumer name: %w", err)
+		}
+		redisHookConfig.Consumer = hostname
+	}
+
+	client := redisHookConfig.Client
+	if client == nil {
+		var err error
+		if client, err = redisclient.NewClient(redisHookConfig.ClientOptions); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisHookConfig.Timeout)
+	defer cancel()
+	if _, err := client.Do(ctx, "PING"); err != nil {
+		client.Close()
+		return fmt.Errorf("failed to ping redis: %w", err)
+	}
+
+	h.config = redisHookConfig
+	h.redis = client
+	if redisHookConfig.Server != nil {
+		h.client = redisHookConfig.Server.NewClient(nil, "local", ClientID, true)
+		h.client.Properties.ProtocolVersion = 5
+	}
+
+	if len(redisHookConfig.Rules) == 0 {
+		return nil
+	}
+
+	filters := make([]string, len(redisHookConfig.Rules))
+	where := make([]string, len(redisHookConfig.Rules))
+	transforms := make([]string, len(redisHookConfig.Rules))
+	for i, rule := range redisHookConfig.Rules {
+		filters[i], where[i], transforms[i] = rule.Filter, rule.Where, rule.Transform
+	}
+
+	var err error
+	h.bridge, err = bridge.New[command](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		Transform: transforms,
+		BatchSize: redisHookConfig.BatchSize,
+		Linger:    redisHookConfig.Linger,
+		Timeout:   redisHookConfig.Timeout,
+		QueueSize: redisHookConfig.QueueSize,
+		Block:     redisHookConfig.QueueBlock,
+		Drop:      redisHookConfig.Drop,
+		Server:    redisHookConfig.Server,
+		Name:      "redis",
+		Buffer:    redisHookConfig.Buffer,
+		Retry:     redisHookConfig.Retry,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	return nil
+}
+
+// OnStarted is called when the server has started, and starts reading the streams of inbound rules
+func (h *Hook) OnStarted() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	for _, rule := range h.config.Inbound {
+		h.readers.Add(1)
+		go h.read(ctx, rule)
+	}
+}
+
+// Stop stops reading, which may wait for a blocked read, appends the queued messages and closes the
+// connections of the client
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+		h.readers.Wait()
+	}
+
+	if h.redis == nil || h.stopped.Swap(true) {
+		return nil
+	}
+
+	var err error
+	if h.bridge != nil {
+		err = h.bridge.Close()
+	}
+	return errors.Join(err, h.redis.Close())
+}
+
+// Stats returns the totals of the messages bridged so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	stats := h.stats
+	h.statsMu.Unlock()
+
+	if h.bridge != nil {
+		bridged := h.bridge.Stats()
+		stats.Batches, stats.Sent, stats.Failed, stats.Dropped = bridged.Batches, bridged.Sent, bridged.Failed, bridged.Dropped
+	}
+	return stats
+}
+
+// OnPublished is called when a client has published a message, and queues it to be appended if a
+// rule matches its topic. Entries read from streams aren't appended back
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if h.bridge == nil || cl.ID == ClientID && cl.Net.Inline {
+		return
+	}
+
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Sent != nil {
+		m.Sent = func(route, messages int, took time.Duration) {
+			h.config.Metrics.Sent(messages, took)
+		}
+	}
+
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, messages int, err error) {
+			h.config.Metrics.Failed(messages, err)
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// sink encodes and appends the commands of the bridge of the hook
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the command appending the message published by the client
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (command, error) {
+	return s.h.config.Rules[route].command(cl, pk), nil
+}
+
+// Send appends the messages of the commands in a pipeline. Messages whose replies were errors are
+// returned in a *bridge.PartialError
+func (s sink) Send(ctx context.Context, route int, cmds []command) error {
+	args := make([][]any, len(cmds))
+	for i, cmd := range cmds {
+		args[i] = cmd.args()
+	}
+
+	replies, err := redisclient.Pipeline(ctx, s.h.redis, args...)
+	if replies == nil {
+		return err // the whole pipeline failed
+	}
+
+	var failed []int
+	for i, reply := range replies {
+		if _, ok := reply.(redisclient.Error); ok {
+			failed = append(failed, i)
+		}
+	}
+
+	if len(failed) > 0 {
+		return &bridge.PartialError{Failed: failed, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,589 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// fakeClient keeps streams and their consumer groups in memory
+type fakeClient struct {
+	streams map[string][]entry
+	groups  map[string]*group // by stream and group name
+	added   [][]any           // the XADD commands
+	errs    []error           // returned by the next commands besides PING
+	acked   []string
+	block   chan struct{} // XADD waits for it to be closed, if set
+	closed  bool
+	mu      sync.Mutex
+}
+
+// group is a consumer group, with the consumers of its pending entries by id
+type group struct {
+	last    int
+	pending map[string]string
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		streams: map[string][]entry{},
+		groups:  map[string]*group{},
+	}
+}
+
+func (c *fakeClient) Do(ctx context.Context, args ...any) (any, error) {
+	if c.block != nil && args[0] == "XADD" {
+		<-c.block
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if args[0] == "PING" {
+		return "PONG", nil
+	}
+
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch args[0] {
+	case "XADD":
+		c.added = append(c.added, args)
+		stream := args[1].(string)
+		return c.add(stream, args[2:]), nil
+	case "XGROUP":
+		key := args[2].(string) + "/" + args[3].(string)
+		if c.groups[key] != nil {
+			return nil, redisclient.Error("BUSYGROUP Consumer Group name already exists")
+		}
+		c.groups[key] = &group{pending: map[string]string{}}
+		if args[4] == "$" {
+			c.groups[key].last = len(c.streams[args[2].(string)])
+		}
+		return "OK", nil
+	case "XREADGROUP":
+		return c.readGroup(args)
+	case "XAUTOCLAIM":
+		g := c.groups[args[1].(string)+"/"+args[2].(string)]
+		var claimed []any
+		for _, e := range c.streams[args[1].(string)] {
+			if consumer, ok := g.pending[e.id]; ok && consumer != args[3] {
+				g.pending[e.id] = args[3].(string)
+				claimed = append(claimed, reply(e))
+			}
+		}
+		return []any{"0-0", claimed, []any{}}, nil
+	case "XACK":
+		g := c.groups[args[1].(string)+"/"+args[2].(string)]
+		for _, id := range args[3:] {
+			delete(g.pending, id.(string))
+			c.acked = append(c.acked, id.(string))
+		}
+		return int64(len(args) - 3), nil
+	}
+	return nil, redisclient.Error("ERR unknown command")
+}
+
+// add appends an entry of the fields to the stream, ignoring trimming
+func (c *fakeClient) add(stream string, args []any) string {
+	for len(args) > 0 && args[0] != "*" {
+		args = args[1:]
+	}
+
+	e := entry{id: strconv.Itoa(len(c.streams[stream])+1) + "-0", fields: map[string]string{}}
+	for i := 1; i+1 < len(args); i += 2 {
+		e.fields[fmt.Sprint(args[i])] = string(toBytes(args[i+1]))
+	}
+	c.streams[stream] = append(c.streams[stream], e)
+	return e.id
+}
+
+// readGroup reads the new entries of the stream, or the pending entries of the consumer after the id
+func (c *fakeClient) readGroup(args []any) (any, error) {
+	stream, id := args[len(args)-2].(string), args[len(args)-1].(string)
+	g := c.groups[stream+"/"+args[2].(string)]
+	if g == nil {
+		return nil, redisclient.Error("NOGROUP No such key or consumer group")
+	}
+
+	var entries []any
+	if id == ">" {
+		for _, e := range c.streams[stream][g.last:] {
+			g.pending[e.id] = args[3].(string)
+			entries = append(entries, reply(e))
+		}
+		g.last = len(c.streams[stream])
+	} else {
+		for _, e := range c.streams[stream] {
+			if consumer, ok := g.pending[e.id]; ok && consumer == args[3] && sequence(e.id) > sequence(id) {
+				entries = append(entries, reply(e))
+			}
+		}
+	}
+
+	if len(entries) == 0 && id == ">" {
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond) // as if blocked
+		c.mu.Lock()
+		return nil, nil
+	}
+	return []any{[]any{stream, entries}}, nil
+}
+
+func (c *fakeClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// sequence returns the sequence of the stream of the id
+func sequence(id string) int {
+	ms, _, _ := strings.Cut(id, "-")
+	n, _ := strconv.Atoi(ms)
+	return n
+}
+
+// reply returns the reply of the entry
+func reply(e entry) []any {
+	fields := []any{}
+	for name, value := range e.fields {
+		fields = append(fields, name, value)
+	}
+	return []any{e.id, fields}
+}
+
+func toBytes(v any) []byte {
+	if b, ok := v.([]byte); ok {
+		return b
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+func refuse(ctx context.Context, addr string) (net.Conn, error) {
+	return nil, errors.New("connection refused")
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	redisHook := new(Hook)
+	redisHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, redisHook.Init(options))
+	t.Cleanup(func() { redisHook.Stop() })
+	return redisHook
+}
+
+func publish(h *Hook, topic string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(topic)})
+}
+
+func TestID(t *testing.T) {
+	redisHook := new(Hook)
+
+	require.Equal(t, "redis-streams-bridge-hook", redisHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	redisHook := new(Hook)
+
+	require.True(t, redisHook.Provides(mqtt.OnStarted))
+	require.True(t, redisHook.Provides(mqtt.OnPublished))
+	require.False(t, redisHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	server := mqtt.New(nil)
+	rules := []Rule{{Filter: "#", Stream: "events"}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - rules",
+			config:      Options{Client: newFakeClient(), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Success - inbound rules",
+			config:      Options{Client: newFakeClient(), Server: server, Inbound: []InboundRule{{Stream: "commands", Group: "mqtt"}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Client: newFakeClient()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Client: newFakeClient(), Rules: []Rule{{Filter: "#"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - inbound without server",
+			config:      Options{Client: newFakeClient(), Inbound: []InboundRule{{Stream: "commands", Group: "mqtt"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid inbound rule",
+			config:      Options{Client: newFakeClient(), Server: server, Inbound: []InboundRule{{Stream: "commands"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Client: newFakeClient(), Rules: rules, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - block longer than timeout",
+			config:      Options{Client: newFakeClient(), Rules: rules, Block: 10 * time.Second},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no connection",
+			config:      Options{ClientOptions: redisclient.ClientOptions{Addrs: []string{"127.0.0.1:1"}, Dial: refuse}, Rules: rules},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			redisHook := new(Hook)
+			redisHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := redisHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, 100, redisHook.config.Count)
+				require.Equal(t, time.Second, redisHook.config.Block)
+				require.NotEmpty(t, redisHook.config.Consumer)
+				require.NoError(t, redisHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestAppend(t *testing.T) {
+	client := newFakeClient()
+	var sent int
+	redisHook := newHook(t, Options{
+		Client: client,
+		Rules: []Rule{
+			{Filter: "devices/+/events", Stream: "events:{2}", MaxLen: 1000},
+			{Filter: "devices/#", Stream: "devices"},
+		},
+		Linger: time.Hour,
+		Metrics: Metrics{
+			Sent: func(messages int, took time.Duration) { sent += messages },
+		},
+	})
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	redisHook.OnPublished(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "devices/d1/events",
+		Payload:     []byte("on"),
+		Properties: packets.Properties{
+			ContentType: "text/plain",
+			User:        []packets.UserProperty{{Key: "site", Val: "north"}, {Key: "topic", Val: "other"}},
+		},
+	})
+	publish(redisHook, "devices/d1/status")
+	publish(redisHook, "other")
+
+	// the queued messages are appended when the hook stops
+	require.NoError(t, redisHook.Stop())
+	require.True(t, client.closed)
+	require.Equal(t, 2, sent)
+	require.Equal(t, Stats{Batches: 2, Sent: 2}, redisHook.Stats())
+
+	require.Len(t, client.added, 2)
+	require.Len(t, client.streams["devices"], 1)
+	require.Equal(t, map[string]string{
+		FieldTopic:       "devices/d1/events",
+		FieldClient:      "c1",
+		FieldQos:         "1",
+		FieldRetain:      "true",
+		FieldContentType: "text/plain",
+		FieldPayload:     "on",
+		"site":           "north",
+	}, client.streams["events:d1"][0].fields)
+
+	// messages published once the hook has stopped are ignored
+	publish(redisHook, "devices/d1/status")
+	require.NoError(t, redisHook.Stop())
+}
+
+func TestAppendBatches(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{
+		Client:    client,
+		Rules:     []Rule{{Filter: "#", Stream: "events"}},
+		BatchSize: 2,
+		Linger:    time.Hour,
+	})
+
+	// a pipeline is sent once it is full
+	publish(redisHook, "a")
+	publish(redisHook, "b")
+	publish(redisHook, "c")
+	require.Eventually(t, func() bool {
+		return redisHook.Stats().Batches == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, redisHook.Stop())
+	require.Equal(t, Stats{Batches: 2, Sent: 3}, redisHook.Stats())
+}
+
+func TestAppendRetry(t *testing.T) {
+	client := newFakeClient()
+	client.errs = []error{nil, redisclient.Error("LOADING Redis is loading the dataset in memory")}
+	redisHook := newHook(t, Options{
+		Client: client,
+		Rules:  []Rule{{Filter: "#", Stream: "events"}},
+		Linger: time.Hour,
+		Retry:  &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+	})
+
+	// the failed message is retried alone, until it is appended
+	publish(redisHook, "a")
+	publish(redisHook, "b")
+	require.NoError(t, redisHook.Stop())
+
+	require.Len(t, client.added, 2)
+	require.Equal(t, "a", client.streams["events"][0].fields[FieldPayload])
+	require.Equal(t, "b", client.streams["events"][1].fields[FieldPayload])
+	require.Equal(t, Stats{Batches: 1, Sent: 2}, redisHook.Stats())
+}
+
+func TestAppendFailure(t *testing.T) {
+	client := newFakeClient()
+	client.errs = []error{errors.New("connection reset")}
+	var failed int
+	redisHook := newHook(t, Options{
+		Client: client,
+		Rules:  []Rule{{Filter: "#", Stream: "events"}},
+		Linger: time.Hour,
+		Metrics: Metrics{
+			Failed: func(messages int, err error) { failed += messages },
+		},
+	})
+
+	// without a retry policy, the messages of a failed pipeline are discarded
+	publish(redisHook, "a")
+	publish(redisHook, "b")
+	require.NoError(t, redisHook.Stop())
+
+	require.Equal(t, 2, failed)
+	require.Equal(t, Stats{Batches: 1, Failed: 2}, redisHook.Stats())
+}
+
+func TestQueueFull(t *testing.T) {
+	client := newFakeClient()
+	client.block = make(chan struct{})
+	var dropped int
+	redisHook := newHook(t, Options{
+		Client:    client,
+		Rules:     []Rule{{Filter: "#", Stream: "events"}},
+		Linger:    time.Millisecond,
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// the first message is being appended, the second is queued, and the third is dropped
+	publish(redisHook, "a")
+	require.Eventually(t, func() bool {
+		return redisHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	publish(redisHook, "b")
+	publish(redisHook, "c")
+	require.Equal(t, 1, dropped)
+
+	close(client.block)
+	require.NoError(t, redisHook.Stop())
+	require.Equal(t, Stats{Batches: 2, Sent: 2, Dropped: 1}, redisHook.Stats())
+}
+
+func TestBuffer(t *testing.T) {
+	client := newFakeClient()
+	client.block = make(chan struct{})
+	options := Options{
+		Client:    client,
+		Rules:     []Rule{{Filter: "#", Stream: "events"}},
+		BatchSize: 1,
+		Buffer:    &bridge.Buffer{Dir: t.TempDir()},
+	}
+	redisHook := newHook(t, options)
+
+	// the first message is being appended when the hook stops, and the second is kept in the buffer
+	publish(redisHook, "a")
+	require.Eventually(t, func() bool {
+		return redisHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(redisHook, "b")
+
+	stopped := make(chan error)
+	go func() { stopped <- redisHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(client.block)
+	require.NoError(t, <-stopped)
+	require.Len(t, client.streams["events"], 1)
+
+	// and is appended once the hook is restarted
+	client = newFakeClient()
+	options.Client = client
+	redisHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return redisHook.Stats().Sent == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, "b", client.streams["events"][0].fields[FieldPayload])
+	require.Equal(t, []any{"XADD", "events", "*"}, client.added[0][:3])
+}
+
+func newInboundServer(t *testing.T, client *fakeClient, options Options) (*Hook, func() []packets.Packet) {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	var mu sync.Mutex
+	var received []packets.Packet
+	require.NoError(t, server.Subscribe("devices/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, pk)
+	}))
+
+	redisHook := new(Hook)
+	options.Server = server
+	options.Client = client
+	options.Backoff = retry.Policy{InitialInterval: time.Millisecond}
+	require.NoError(t, server.AddHook(redisHook, options))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { server.Close() })
+
+	return redisHook, func() []packets.Packet {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]packets.Packet(nil), received...)
+	}
+}
+
+func TestInbound(t *testing.T) {
+	client := newFakeClient()
+	client.errs = []error{errors.New("connection refused")} // creating the group is retried
+
+	// an entry read before the broker stopped is read again first
+	client.add("commands", []any{"*", "device", "d0", FieldPayload, "reset"})
+	client.groups["commands/mqtt"] = &group{last: 1, pending: map[string]string{"1-0": "broker-1"}}
+
+	var rejected int
+	redisHook, received := newInboundServer(t, client, Options{
+		Rules:    []Rule{{Filter: "devices/#", Stream: "events"}},
+		Inbound:  []InboundRule{{Stream: "commands", Group: "mqtt", Topic: "devices/{device}/commands", Qos: 1}},
+		Consumer: "broker-1",
+		Block:    time.Millisecond,
+		Linger:   time.Millisecond,
+		Metrics: Metrics{
+			Rejected: func(stream string, err error) { rejected++ },
+		},
+	})
+
+	require.Eventually(t, func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return len(client.acked) == 1
+	}, time.Second, time.Millisecond)
+
+	client.mu.Lock()
+	client.add("commands", []any{"*", "device", "d1", FieldContentType, "text/plain", FieldPayload, "reboot"})
+	client.add("commands", []any{"*", FieldPayload, "reboot"})
+	client.mu.Unlock()
+
+	require.Eventually(t, func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return len(client.acked) == 3
+	}, time.Second, time.Millisecond)
+
+	// every entry is acknowledged, including the one without a device which couldn't be published
+	client.mu.Lock()
+	require.Equal(t, []string{"1-0", "2-0", "3-0"}, client.acked)
+	client.mu.Unlock()
+	require.Equal(t, 1, rejected)
+
+	pks := received()
+	require.Len(t, pks, 2)
+	require.Equal(t, "devices/d0/commands", pks[0].TopicName)
+	require.Equal(t, "devices/d1/commands", pks[1].TopicName)
+	require.Equal(t, []byte("reboot"), pks[1].Payload)
+	require.Equal(t, "text/plain", pks[1].Properties.ContentType)
+	require.Equal(t, []packets.UserProperty{{Key: "device", Val: "d1"}}, pks[1].Properties.User)
+
+	// published entries aren't appended back
+	require.NoError(t, redisHook.Stop())
+	require.Empty(t, client.added)
+	require.Equal(t, Stats{Received: 2, Rejected: 1}, redisHook.Stats())
+}
+
+func TestInboundClaim(t *testing.T) {
+	client := newFakeClient()
+	client.add("commands", []any{"*", FieldTopic, "devices/d1/commands", FieldPayload, "reboot"})
+	client.groups["commands/mqtt"] = &group{last: 1, pending: map[string]string{"1-0": "broker-2"}}
+
+	redisHook, received := newInboundServer(t, client, Options{
+		Inbound:   []InboundRule{{Stream: "commands", Group: "mqtt"}},
+		Consumer:  "broker-1",
+		Block:     time.Millisecond,
+		ClaimIdle: time.Minute,
+	})
+
+	// the entry another broker read but didn't acknowledge is claimed and published
+	require.Eventually(t, func() bool {
+		return len(received()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, "devices/d1/commands", received()[0].TopicName)
+
+	require.NoError(t, redisHook.Stop())
+	require.Equal(t, Stats{Received: 1, Claimed: 1}, redisHook.Stats())
+}
@@ -0,0 +1,147 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+// the fields entries are given from the MQTT message, besides one for each of its user properties.
+// Entries read from streams are published with the payload, the content type and the other fields as
+// user properties
+const (
+	FieldTopic       = "topic"
+	FieldClient      = "client"
+	FieldQos         = "qos"
+	FieldRetain      = "retain"
+	FieldContentType = "content_type"
+	FieldPayload     = "payload"
+)
+
+// validate checks the filter, stream template and maximum length of the rule
+func (r Rule) validate() error {
+	if !mqtt.IsValidFilter(r.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Filter)
+	}
+
+	if r.Stream == "" {
+		return errors.New("has no stream")
+	}
+
+	if err := bridge.Render(r.Stream, bridge.TopicValues(nil, ""), func(string) {}); err != nil {
+		return fmt.Errorf("has invalid stream %q: %w", r.Stream, err)
+	}
+
+	if r.MaxLen < 0 {
+		return fmt.Errorf("has invalid max length %d", r.MaxLen)
+	}
+	return nil
+}
+
+// validate checks the stream, group, topic template and QoS of the inbound rule
+func (r InboundRule) validate() error {
+	if r.Stream == "" {
+		return errors.New("has no stream")
+	}
+
+	if r.Group == "" {
+		return errors.New("has no group")
+	}
+
+	if err := bridge.Render(r.Topic, func(string) (string, bool) { return "", true }, func(string) {}); err != nil {
+		return fmt.Errorf("has invalid topic %q: %w", r.Topic, err)
+	}
+
+	if r.Qos > 2 {
+		return fmt.Errorf("has invalid qos %d", r.Qos)
+	}
+	return nil
+}
+
+// command returns the XADD command appending the message published by the client
+func (r Rule) command(cl *mqtt.Client, pk packets.Packet) command {
+	levels := strings.Split(pk.TopicName, "/")
+	var stream strings.Builder
+	bridge.Render(r.Stream, bridge.TopicValues(levels, cl.ID), func(s string) { stream.WriteString(s) })
+
+	cmd := command{
+		Stream: stream.String(),
+		MaxLen: r.MaxLen,
+		Fields: []string{
+			FieldTopic, pk.TopicName,
+			FieldClient, cl.ID,
+			FieldQos, strconv.Itoa(int(pk.FixedHeader.Qos)),
+		},
+		Payload: pk.Payload,
+	}
+
+	if pk.FixedHeader.Retain {
+		cmd.Fields = append(cmd.Fields, FieldRetain, "true")
+	}
+
+	if pk.Properties.ContentType != "" {
+		cmd.Fields = append(cmd.Fields, FieldContentType, pk.Properties.ContentType)
+	}
+
+	seen := map[string]bool{}
+	for _, p := range pk.Properties.User {
+		if reserved(p.Key) || seen[p.Key] {
+			continue // the first of repeated user properties is kept
+		}
+		seen[p.Key] = true
+		cmd.Fields = append(cmd.Fields, p.Key, p.Val)
+	}
+
+	return cmd
+}
+
+// args returns the arguments of the XADD command, with the payload field last
+func (c command) args() []any {
+	args := []any{"XADD", c.Stream}
+	if c.MaxLen > 0 {
+		args = append(args, "MAXLEN", "~", c.MaxLen)
+	}
+
+	args = append(args, "*")
+	for _, field := range c.Fields {
+		args = append(args, field)
+	}
+	return append(args, FieldPayload, c.Payload)
+}
+
+// properties returns the MQTT properties of the fields of an entry, with the content type and the
+// fields which aren't those of the hook as user properties, in the order of their names
+func properties(fields map[string]string) packets.Properties {
+	var p packets.Properties
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch {
+		case name == FieldContentType:
+			p.ContentType = fields[name]
+		case !reserved(name):
+			p.User = append(p.User, packets.UserProperty{Key: name, Val: fields[name]})
+		}
+	}
+	return p
+}
+
+// reserved returns whether the field is set by the hook
+func reserved(name string) bool {
+	switch name {
+	case FieldTopic, FieldClient, FieldQos, FieldRetain, FieldContentType, FieldPayload:
+		return true
+	}
+	return false
+}
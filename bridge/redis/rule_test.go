@@ -0,0 +1,154 @@
+package redis
+
+import (
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectError bool
+	}{
+		{
+			name: "Success - stream template",
+			rule: Rule{Filter: "devices/+/events", Stream: "events:{2}", MaxLen: 1000},
+		},
+		{
+			name:        "Failure - invalid filter",
+			rule:        Rule{Filter: "devices/#/events", Stream: "events"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no stream",
+			rule:        Rule{Filter: "#"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown placeholder",
+			rule:        Rule{Filter: "#", Stream: "events:{device}"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - negative max length",
+			rule:        Rule{Filter: "#", Stream: "events", MaxLen: -1},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestInboundRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        InboundRule
+		expectError bool
+	}{
+		{
+			name: "Success - field template",
+			rule: InboundRule{Stream: "commands", Group: "mqtt", Topic: "devices/{device}/commands", Qos: 2},
+		},
+		{
+			name:        "Failure - no stream",
+			rule:        InboundRule{Group: "mqtt", Topic: "t"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no group",
+			rule:        InboundRule{Stream: "commands", Topic: "t"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unclosed placeholder",
+			rule:        InboundRule{Stream: "commands", Group: "mqtt", Topic: "devices/{device"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid qos",
+			rule:        InboundRule{Stream: "commands", Group: "mqtt", Topic: "t", Qos: 3},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestCommand(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	rule := Rule{Filter: "#", Stream: "{client}:{1}"}
+
+	cmd := rule.command(cl, packets.Packet{
+		TopicName: "sensors/t1",
+		Payload:   []byte("21.5"),
+		Properties: packets.Properties{
+			User: []packets.UserProperty{{Key: "unit", Val: "C"}, {Key: "unit", Val: "F"}},
+		},
+	})
+	require.Equal(t, []any{
+		"XADD", "c1:sensors", "*",
+		FieldTopic, "sensors/t1",
+		FieldClient, "c1",
+		FieldQos, "0",
+		"unit", "C",
+		FieldPayload, []byte("21.5"),
+	}, cmd.args())
+
+	cmd.MaxLen = 1000
+	require.Equal(t, []any{"XADD", "c1:sensors", "MAXLEN", "~", int64(1000), "*"}, cmd.args()[:6])
+}
+
+func TestProperties(t *testing.T) {
+	p := properties(map[string]string{
+		FieldTopic:       "a/b",
+		FieldQos:         "1",
+		FieldPayload:     "on",
+		FieldContentType: "application/json",
+		"zone":           "2",
+		"site":           "north",
+	})
+
+	require.Equal(t, "application/json", p.ContentType)
+	require.Equal(t, []packets.UserProperty{{Key: "site", Val: "north"}, {Key: "zone", Val: "2"}}, p.User)
+}
+
+func TestParseEntries(t *testing.T) {
+	entries, err := parseEntries([]any{
+		[]any{"1-0", []any{"topic", "a/b", "payload", "on"}},
+		[]any{"2-0", nil},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []entry{
+		{id: "1-0", fields: map[string]string{"topic": "a/b", "payload": "on"}},
+		{id: "2-0"},
+	}, entries)
+
+	_, err = parseEntries([]any{"1-0"})
+	require.Error(t, err)
+}
@@ -0,0 +1,157 @@
+package sns
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+// the attributes messages are given from the MQTT message, besides one for each of its user
+// properties, up to the most SNS allows
+const (
+	AttributeTopic       = "mqtt_topic"
+	AttributeClient      = "mqtt_client"
+	AttributeQos         = "mqtt_qos"
+	AttributeRetain      = "mqtt_retain"
+	AttributeContentType = "content_type"
+
+	// AttributeEncoding is base64 when the payload isn't UTF-8, which SNS messages must be, and is
+	// base64 encoded in the body
+	AttributeEncoding = "mqtt_encoding"
+)
+
+const (
+	maxAttributes = 10  // the most attributes SNS allows a message
+	maxGroupID    = 128 // the longest message group id SNS allows
+)
+
+// validate checks the filter, topic ARN and group template of the rule
+func (r Rule) validate() error {
+	if !mqtt.IsValidFilter(r.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Filter)
+	}
+
+	if !strings.HasPrefix(r.TopicARN, "arn:") {
+		return fmt.Errorf("has invalid topic arn %q", r.TopicARN)
+	}
+
+	if err := bridge.Render(r.Group, bridge.TopicValues(nil, ""), func(string) {}); err != nil {
+		return fmt.Errorf("has invalid group %q: %w", r.Group, err)
+	}
+	return nil
+}
+
+// message returns the SNS message of the message published by the client
+func (r Rule) message(cl *mqtt.Client, pk packets.Packet) *Message {
+	msg := &Message{
+		TopicARN:   r.TopicARN,
+		Attributes: attributes(cl, pk),
+	}
+
+	if utf8.Valid(pk.Payload) {
+		msg.Body = string(pk.Payload)
+	} else {
+		msg.Body = base64.StdEncoding.EncodeToString(pk.Payload)
+		msg.Attributes[AttributeEncoding] = Attribute{DataType: "String", Value: "base64"}
+	}
+
+	if fifo(r.TopicARN) {
+		var group strings.Builder
+		bridge.Render(r.Group, bridge.TopicValues(strings.Split(pk.TopicName, "/"), cl.ID), func(s string) { group.WriteString(s) })
+		msg.GroupID = groupID(group.String())
+		msg.DeduplicationID = deduplicationID(cl, pk)
+	}
+	return msg
+}
+
+// attributes returns the attributes of the SNS message of the message, from its properties
+func attributes(cl *mqtt.Client, pk packets.Packet) map[string]Attribute {
+	a := map[string]Attribute{
+		AttributeTopic:  {DataType: "String", Value: pk.TopicName},
+		AttributeClient: {DataType: "String", Value: cl.ID},
+		AttributeQos:    {DataType: "Number", Value: strconv.Itoa(int(pk.FixedHeader.Qos))},
+	}
+
+	if pk.FixedHeader.Retain {
+		a[AttributeRetain] = Attribute{DataType: "String", Value: "true"}
+	}
+
+	if pk.Properties.ContentType != "" {
+		a[AttributeContentType] = Attribute{DataType: "String", Value: pk.Properties.ContentType}
+	}
+
+	reserved := 1 // for the encoding of the payload
+	for _, p := range pk.Properties.User {
+		if len(a)+reserved >= maxAttributes {
+			break
+		}
+
+		name := attributeName(p.Key)
+		if _, ok := a[name]; ok || p.Val == "" {
+			continue // the first of repeated user properties is kept, and SNS doesn't allow empty values
+		}
+		a[name] = Attribute{DataType: "String", Value: p.Val}
+	}
+	return a
+}
+
+// attributeName returns the name of the attribute of a user property, replacing the characters SNS
+// doesn't allow in attribute names with underscores, and prefixing those it reserves
+func attributeName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, key)
+
+	lower := strings.ToLower(key)
+	if name == "" || strings.HasPrefix(lower, "aws.") || strings.HasPrefix(lower, "amazon.") {
+		name = "_" + name
+	}
+	return name
+}
+
+// groupID returns the message group id, replacing the characters SNS doesn't allow in it with
+// underscores, and truncating it to the longest SNS allows
+func groupID(group string) string {
+	group = strings.Map(func(r rune) rune {
+		if r > ' ' && r <= '~' {
+			return r
+		}
+		return '_'
+	}, group)
+
+	if group == "" {
+		return "_"
+	}
+	return group[:min(len(group), maxGroupID)]
+}
+
+// deduplicationID returns the deduplication id of the message, so SNS discards the copies of QoS 1
+// messages the client sends again with the same packet id. QoS 0 messages are never sent again, so
+// their ids are unique
+func deduplicationID(cl *mqtt.Client, pk packets.Packet) string {
+	sum := sha256.New()
+	sum.Write([]byte(cl.ID))
+	sum.Write([]byte{0})
+	sum.Write([]byte(pk.TopicName))
+	sum.Write([]byte{0})
+	sum.Write(binary.BigEndian.AppendUint16(nil, pk.PacketID))
+	if pk.FixedHeader.Qos == 0 {
+		sum.Write(binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+	}
+	sum.Write(pk.Payload)
+	return hex.EncodeToString(sum.Sum(nil))
+}
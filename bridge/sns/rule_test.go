@@ -0,0 +1,140 @@
+package sns
+
+import (
+	"strings"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	standardARN = "arn:aws:sns:eu-west-1:123456789012:events"
+	fifoARN     = "arn:aws:sns:eu-west-1:123456789012:events.fifo"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectError bool
+	}{
+		{
+			name: "Success - standard topic",
+			rule: Rule{Filter: "devices/#", TopicARN: standardARN},
+		},
+		{
+			name: "Success - fifo topic with group",
+			rule: Rule{Filter: "devices/+/events", TopicARN: fifoARN, Group: "{2}"},
+		},
+		{
+			name:        "Failure - invalid filter",
+			rule:        Rule{Filter: "a/#/b", TopicARN: standardARN},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no topic arn",
+			rule:        Rule{Filter: "#"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown placeholder",
+			rule:        Rule{Filter: "#", TopicARN: fifoARN, Group: "{username}"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unclosed placeholder",
+			rule:        Rule{Filter: "#", TopicARN: fifoARN, Group: "{client"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestRuleMessage(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "sensor-1", false)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Retain: true},
+		TopicName:   "devices/sensor-1/events",
+		Payload:     []byte(`{"door":"open"}`),
+		PacketID:    7,
+		Properties: packets.Properties{
+			ContentType: "application/json",
+			User: []packets.UserProperty{
+				{Key: "site", Val: "north"},
+				{Key: "site", Val: "south"},
+				{Key: "AWS.trace", Val: "1"},
+				{Key: "empty", Val: ""},
+			},
+		},
+	}
+
+	msg := Rule{TopicARN: standardARN}.message(cl, pk)
+	require.Equal(t, standardARN, msg.TopicARN)
+	require.Equal(t, `{"door":"open"}`, msg.Body)
+	require.Equal(t, map[string]Attribute{
+		AttributeTopic:       {DataType: "String", Value: "devices/sensor-1/events"},
+		AttributeClient:      {DataType: "String", Value: "sensor-1"},
+		AttributeQos:         {DataType: "Number", Value: "1"},
+		AttributeRetain:      {DataType: "String", Value: "true"},
+		AttributeContentType: {DataType: "String", Value: "application/json"},
+		"site":               {DataType: "String", Value: "north"},
+		"_AWS_trace":         {DataType: "String", Value: "1"},
+	}, msg.Attributes)
+	require.Empty(t, msg.GroupID)
+	require.Empty(t, msg.DeduplicationID)
+
+	// fifo topics have a group and the same deduplication id for a message sent again
+	msg = Rule{TopicARN: fifoARN, Group: "site {2}"}.message(cl, pk)
+	require.Equal(t, "site_sensor-1", msg.GroupID)
+	require.Len(t, msg.DeduplicationID, 64)
+	require.Equal(t, msg.DeduplicationID, Rule{TopicARN: fifoARN, Group: "{topic}"}.message(cl, pk).DeduplicationID)
+
+	pk.PacketID = 8
+	require.NotEqual(t, msg.DeduplicationID, Rule{TopicARN: fifoARN}.message(cl, pk).DeduplicationID)
+
+	// identical qos 0 messages are not deduplicated
+	pk.FixedHeader.Qos, pk.PacketID = 0, 0
+	require.NotEqual(t, Rule{TopicARN: fifoARN}.message(cl, pk).DeduplicationID, Rule{TopicARN: fifoARN}.message(cl, pk).DeduplicationID)
+}
+
+func TestRuleMessageBinary(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	msg := Rule{TopicARN: standardARN}.message(cl, packets.Packet{TopicName: "a", Payload: []byte{0xff, 0x00}})
+
+	require.Equal(t, "/wA=", msg.Body)
+	require.Equal(t, Attribute{DataType: "String", Value: "base64"}, msg.Attributes[AttributeEncoding])
+}
+
+func TestAttributesLimit(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	pk := packets.Packet{TopicName: "a"}
+	for _, k := range strings.Split("a b c d e f g h i j k", " ") {
+		pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: k, Val: k})
+	}
+
+	// one attribute is left for the encoding of the payload
+	a := attributes(cl, pk)
+	require.Len(t, a, maxAttributes-1)
+	require.Contains(t, a, "a")
+	require.NotContains(t, a, "g")
+}
+
+func TestGroupID(t *testing.T) {
+	require.Equal(t, "_", groupID(""))
+	require.Equal(t, "a_b/c", groupID("a b/c"))
+	require.Len(t, groupID(strings.Repeat("a", 200)), maxGroupID)
+}
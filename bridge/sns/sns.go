@@ -0,0 +1,291 @@
+// Package sns provides a bridge hook forwarding the messages published to matching MQTT topics to
+// AWS SNS topics, in the background so publishes don't wait for AWS, so device events can fan out to
+// existing SNS subscribers.
+//
+// Messages are published by a Client, which is a thin adapter of the SNS client of the application,
+// eg. for aws-sdk-go-v2:
+//
+//	type client struct{ *sns.Client }
+//
+//	func (c client) Publish(ctx context.Context, m *mqttsns.Message) error {
+//		in := &sns.PublishInput{TopicArn: aws.String(m.TopicARN), Message: aws.String(m.Body)}
+//		if m.GroupID != "" {
+//			in.MessageGroupId = aws.String(m.GroupID)
+//			in.MessageDeduplicationId = aws.String(m.DeduplicationID)
+//		}
+//		in.MessageAttributes = make(map[string]types.MessageAttributeValue, len(m.Attributes))
+//		for name, a := range m.Attributes {
+//			in.MessageAttributes[name] = types.MessageAttributeValue{DataType: aws.String(a.DataType), StringValue: aws.String(a.Value)}
+//		}
+//		_, err := c.Client.Publish(ctx, in)
+//		return err
+//	}
+package sns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// Message is a message published to an SNS topic
+type Message struct {
+	TopicARN   string
+	Body       string
+	Attributes map[string]Attribute
+
+	// GroupID and DeduplicationID are set for FIFO topics, whose ARN ends with .fifo
+	GroupID         string
+	DeduplicationID string
+}
+
+// Attribute is a message attribute, whose DataType is String or Number
+type Attribute struct {
+	DataType string
+	Value    string
+}
+
+// Client publishes messages to SNS, usually a thin adapter of an SNS client
+type Client interface {
+	Publish(ctx context.Context, msg *Message) error
+}
+
+// Rule forwards the messages of the MQTT topics matching Filter, which may contain +/# wildcards, to
+// the SNS topic TopicARN. Group is the message group of FIFO topics, a template in which {topic} is
+// the MQTT topic, {client} is the id of the publishing client, and {1}, {2}... are the levels of the
+// topic, and defaults to {topic} so the messages of each topic are delivered in order. Where is an
+// optional filter expression (see pkg/filter) messages must also match, eg. "json.temperature > 30".
+// Transform is an optional template (see pkg/transform) the payloads of the messages are rewritten
+// with, eg. transform.Envelope
+type Rule struct {
+	Filter    string `yaml:"filter" json:"filter"`
+	Where     string `yaml:"where" json:"where"`
+	Transform string `yaml:"transform" json:"transform"`
+	TopicARN  string `yaml:"topic_arn" json:"topic_arn"`
+	Group     string `yaml:"group" json:"group"`
+}
+
+// Metrics are called as messages are forwarded. Unset funcs are skipped
+type Metrics struct {
+	// Published is called after a message has been published, with how long publishing it took
+	Published func(topicARN string, took time.Duration)
+
+	// Failed is called after a message could not be published, and is discarded
+	Failed func(topicARN string, err error)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+}
+
+// Stats are the totals of the messages forwarded since the hook was initialized
+type Stats struct {
+	Published int64 // the number of messages published to SNS
+	Failed    int64 // the number of messages which could not be published
+	Dropped   int64 // the number of messages discarded as the queue was full
+}
+
+// Hook is a hook that forwards the messages published to matching topics to SNS
+type Hook struct {
+	config Options
+	bridge *bridge.Bridge[*Message]
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the sns hook
+type Options struct {
+	// Client publishes the messages
+	Client Client
+
+	// Rules map MQTT topics to SNS topics, and the first whose filter matches the topic of a message
+	// applies. Messages matching no rule aren't forwarded
+	Rules []Rule
+
+	Workers int           // how many messages are published at once, defaults to 4
+	Timeout time.Duration // how long publishing a message may take, defaults to 10 seconds
+
+	// QueueSize is how many messages wait to be published, defaults to 10000. Messages published while
+	// the queue is full, eg. because SNS is throttling, wait for up to Block for room, and are then
+	// dropped by the Drop policy, which defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Server publishes a bridge.Warning to $SYS/bridges/sns/dropped when messages are dropped, if set
+	Server *mqtt.Server
+
+	// Buffer queues messages on disk rather than in memory if it is set, so the messages which haven't
+	// been published survive restarts of the broker and long outages of SNS
+	Buffer *bridge.Buffer
+
+	// Retry retries messages which fail, and must limit the attempts or the time spent. Messages are
+	// published once if it is nil
+	Retry *retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "sns-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts publishing messages
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	snsHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if snsHookConfig.Client == nil {
+		return errors.New("client is required")
+	}
+
+	if len(snsHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range snsHookConfig.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+
+		if rule.Group == "" {
+			snsHookConfig.Rules[i].Group = "{topic}"
+		}
+	}
+
+	if snsHookConfig.Retry != nil && snsHookConfig.Retry.MaxAttempts == 0 && snsHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if snsHookConfig.Workers <= 0 {
+		snsHookConfig.Workers = 4
+	}
+
+	if snsHookConfig.Timeout <= 0 {
+		snsHookConfig.Timeout = 10 * time.Second
+	}
+
+	if snsHookConfig.QueueSize <= 0 {
+		snsHookConfig.QueueSize = 10000
+	}
+
+	h.config = snsHookConfig
+
+	filters := make([]string, len(snsHookConfig.Rules))
+	where := make([]string, len(snsHookConfig.Rules))
+	transforms := make([]string, len(snsHookConfig.Rules))
+	for i, rule := range snsHookConfig.Rules {
+		filters[i], where[i], transforms[i] = rule.Filter, rule.Where, rule.Transform
+	}
+
+	var err error
+	h.bridge, err = bridge.New[*Message](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		Transform: transforms,
+		Workers:   snsHookConfig.Workers,
+		Timeout:   snsHookConfig.Timeout,
+		QueueSize: snsHookConfig.QueueSize,
+		Block:     snsHookConfig.Block,
+		Drop:      snsHookConfig.Drop,
+		Server:    snsHookConfig.Server,
+		Name:      "sns",
+		Buffer:    snsHookConfig.Buffer,
+		Retry:     snsHookConfig.Retry,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// Stop publishes the queued messages
+func (h *Hook) Stop() error {
+	if h.bridge == nil {
+		return nil
+	}
+	return h.bridge.Close()
+}
+
+// Stats returns the totals of the messages forwarded so far
+func (h *Hook) Stats() Stats {
+	if h.bridge == nil {
+		return Stats{}
+	}
+
+	stats := h.bridge.Stats()
+	return Stats{Published: stats.Sent, Failed: stats.Failed, Dropped: stats.Dropped}
+}
+
+// OnPublished is called when a client has published a message, and queues it to be published if a
+// rule matches its topic
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Published != nil {
+		m.Sent = func(route, records int, took time.Duration) {
+			h.config.Metrics.Published(h.config.Rules[route].TopicARN, took)
+		}
+	}
+
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, records int, err error) {
+			h.config.Metrics.Failed(h.config.Rules[route].TopicARN, err)
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// sink encodes and publishes the messages of the bridge of the hook
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the SNS message of the message published by the client
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (*Message, error) {
+	return s.h.config.Rules[route].message(cl, pk), nil
+}
+
+// Send publishes the messages
+func (s sink) Send(ctx context.Context, route int, msgs []*Message) error {
+	for _, msg := range msgs {
+		if err := s.h.config.Client.Publish(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fifo returns whether the topic is a FIFO topic
+func fifo(topicARN string) bool {
+	return strings.HasSuffix(topicARN, ".fifo")
+}
@@ -0,0 +1,235 @@
+package sns
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// fakeClient records the messages it publishes
+type fakeClient struct {
+	messages []*Message
+	errs     []error       // returned by the next attempts
+	block    chan struct{} // publish waits for it to be closed, if set
+	mu       sync.Mutex
+}
+
+func (c *fakeClient) Publish(ctx context.Context, msg *Message) error {
+	if c.block != nil {
+		<-c.block
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return err
+	}
+
+	c.messages = append(c.messages, msg)
+	return nil
+}
+
+func (c *fakeClient) published() []*Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Message(nil), c.messages...)
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	snsHook := new(Hook)
+	snsHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, snsHook.Init(options))
+	t.Cleanup(func() { snsHook.Stop() })
+	return snsHook
+}
+
+func publish(h *Hook, topic string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(topic)})
+}
+
+func TestID(t *testing.T) {
+	snsHook := new(Hook)
+
+	require.Equal(t, "sns-bridge-hook", snsHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	snsHook := new(Hook)
+
+	require.True(t, snsHook.Provides(mqtt.OnPublished))
+	require.False(t, snsHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	rules := []Rule{{Filter: "#", TopicARN: standardARN}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - rules",
+			config:      Options{Client: new(fakeClient), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no client",
+			config:      Options{Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Client: new(fakeClient)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Client: new(fakeClient), Rules: []Rule{{Filter: "#"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Client: new(fakeClient), Rules: rules, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			snsHook := new(Hook)
+			snsHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := snsHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, 4, snsHook.config.Workers)
+				require.Equal(t, 10000, snsHook.config.QueueSize)
+				require.Equal(t, "{topic}", snsHook.config.Rules[0].Group)
+				require.NoError(t, snsHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestForward(t *testing.T) {
+	client := new(fakeClient)
+	var published []string
+	var mu sync.Mutex
+	snsHook := newHook(t, Options{
+		Client: client,
+		Rules: []Rule{
+			{Filter: "devices/+/events", TopicARN: fifoARN, Group: "{client}"},
+			{Filter: "devices/#", TopicARN: standardARN},
+		},
+		Metrics: Metrics{
+			Published: func(topicARN string, took time.Duration) {
+				mu.Lock()
+				defer mu.Unlock()
+				published = append(published, topicARN)
+			},
+		},
+	})
+
+	// the first rule matching a topic applies, and the queued messages are published when the hook stops
+	publish(snsHook, "devices/d1/events")
+	publish(snsHook, "other")
+	publish(snsHook, "devices/d1/status")
+	require.NoError(t, snsHook.Stop())
+
+	require.ElementsMatch(t, []string{fifoARN, standardARN}, published)
+	for _, msg := range client.published() {
+		if msg.TopicARN == fifoARN {
+			require.Equal(t, "c1", msg.GroupID)
+			require.Equal(t, "devices/d1/events", msg.Body)
+		} else {
+			require.Empty(t, msg.GroupID)
+		}
+	}
+	require.Equal(t, Stats{Published: 2}, snsHook.Stats())
+
+	// messages published once the hook has stopped are ignored
+	publish(snsHook, "devices/d1/status")
+	require.NoError(t, snsHook.Stop())
+}
+
+func TestQueueFull(t *testing.T) {
+	client := &fakeClient{block: make(chan struct{})}
+	var dropped int
+	snsHook := newHook(t, Options{
+		Client:    client,
+		Rules:     []Rule{{Filter: "#", TopicARN: standardARN}},
+		Workers:   1,
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// the first message is being published, the second is queued, and the third is dropped
+	publish(snsHook, "a")
+	require.Eventually(t, func() bool {
+		return snsHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(snsHook, "b")
+	publish(snsHook, "c")
+	require.Equal(t, 1, dropped)
+
+	close(client.block)
+	require.NoError(t, snsHook.Stop())
+	require.Equal(t, Stats{Published: 2, Dropped: 1}, snsHook.Stats())
+}
+
+func TestRetry(t *testing.T) {
+	throttled := errors.New("throttled")
+	client := &fakeClient{errs: []error{throttled, throttled, throttled, throttled}}
+	var failed []error
+	snsHook := newHook(t, Options{
+		Client:  client,
+		Rules:   []Rule{{Filter: "#", TopicARN: standardARN}},
+		Workers: 1,
+		Retry:   &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+		Metrics: Metrics{
+			Failed: func(topicARN string, err error) { failed = append(failed, err) },
+		},
+	})
+
+	// the first message fails three times and is discarded, and the second succeeds when retried
+	publish(snsHook, "a")
+	publish(snsHook, "b")
+	require.NoError(t, snsHook.Stop())
+
+	require.Equal(t, []error{throttled}, failed)
+	require.Len(t, client.published(), 1)
+	require.Equal(t, "b", client.published()[0].Body)
+	require.Equal(t, Stats{Published: 1, Failed: 1}, snsHook.Stats())
+}
@@ -0,0 +1,136 @@
+package sqs
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+// poll receives the messages of the queue of the rule and publishes them until the context is
+// cancelled
+func (h *Hook) poll(ctx context.Context, rule InboundRule) {
+	defer h.pollers.Done()
+
+	for ctx.Err() == nil {
+		var received []Received
+		err := h.config.Backoff.Forever(ctx, func(ctx context.Context) error {
+			var err error
+			received, err = h.receive(ctx, rule.QueueURL)
+			if err != nil && ctx.Err() == nil {
+				h.Log.Error("error occurred while receiving sqs messages", "error", err, "queue_url", rule.QueueURL)
+			}
+			return err
+		})
+		if err != nil || ctx.Err() != nil {
+			return
+		}
+
+		var handles []string
+		for _, msg := range received {
+			if err := h.publish(rule, msg); err != nil {
+				h.reject(rule.QueueURL, msg, err)
+				continue
+			}
+			handles = append(handles, msg.ReceiptHandle)
+		}
+
+		h.delete(rule.QueueURL, handles)
+	}
+}
+
+// receive receives a batch of messages from the queue, waiting for them for up to WaitTime
+func (h *Hook) receive(ctx context.Context, queueURL string) ([]Received, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.config.WaitTime+h.config.Timeout)
+	defer cancel()
+
+	return h.config.Client.Receive(ctx, queueURL, maxBatch, h.config.VisibilityTimeout, h.config.WaitTime)
+}
+
+// publish publishes the received message to the broker with the rule
+func (h *Hook) publish(rule InboundRule, msg Received) error {
+	var topic strings.Builder
+	err := bridge.Render(rule.Topic, func(name string) (string, bool) {
+		a, ok := msg.Attributes[name]
+		return a.Value, ok
+	}, func(s string) { topic.WriteString(s) })
+	if err != nil {
+		return err
+	}
+
+	if topic.Len() == 0 || !mqtt.IsValidFilter(topic.String(), true) {
+		return fmt.Errorf("invalid mqtt topic %q", topic.String())
+	}
+
+	payload := []byte(msg.Body)
+	if msg.Attributes[AttributeEncoding].Value == "base64" {
+		payload, err = base64.StdEncoding.DecodeString(msg.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    rule.Qos,
+			Retain: rule.Retain,
+		},
+		TopicName:  topic.String(),
+		Payload:    payload,
+		PacketID:   uint16(rule.Qos), // as the server publishes, the packet id is only checked to be set
+		Properties: properties(msg.Attributes),
+	})
+	if err != nil {
+		return err
+	}
+
+	h.statsMu.Lock()
+	h.stats.Received++
+	h.statsMu.Unlock()
+
+	if h.config.Metrics.Received != nil {
+		h.config.Metrics.Received(topic.String())
+	}
+	return nil
+}
+
+// reject makes a received message which could not be published visible again after RetryDelay,
+// rather than the rest of its visibility timeout
+func (h *Hook) reject(queueURL string, msg Received, err error) {
+	h.statsMu.Lock()
+	h.stats.Rejected++
+	h.statsMu.Unlock()
+
+	h.Log.Error("error occurred while publishing sqs message", "error", err, "queue_url", queueURL, "message_id", msg.ID)
+	if h.config.Metrics.Rejected != nil {
+		h.config.Metrics.Rejected(queueURL, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	if err := h.config.Client.ChangeVisibility(ctx, queueURL, msg.ReceiptHandle, h.config.RetryDelay); err != nil {
+		h.Log.Error("error occurred while changing sqs message visibility", "error", err, "queue_url", queueURL, "message_id", msg.ID)
+	}
+}
+
+// delete deletes the published messages, which are received again once their visibility timeout
+// ends if deleting them fails
+func (h *Hook) delete(queueURL string, handles []string) {
+	if len(handles) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	if err := h.config.Client.Delete(ctx, queueURL, handles); err != nil {
+		h.Log.Error("error occurred while deleting sqs messages", "error", err, "queue_url", queueURL, "messages", len(handles))
+	}
+}
@@ -0,0 +1,197 @@
+package sqs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+// the attributes messages are given from the MQTT message, besides one for each of its user
+// properties, up to the most SQS allows. Received messages are given the content type and other
+// attributes as properties
+const (
+	AttributeTopic       = "mqtt_topic"
+	AttributeClient      = "mqtt_client"
+	AttributeQos         = "mqtt_qos"
+	AttributeRetain      = "mqtt_retain"
+	AttributeContentType = "content_type"
+
+	// AttributeEncoding is base64 when the payload isn't UTF-8, which SQS messages must be, and is
+	// base64 encoded in the body
+	AttributeEncoding = "mqtt_encoding"
+)
+
+const (
+	maxAttributes = 10  // the most attributes SQS allows a message
+	maxGroupID    = 128 // the longest message group id SQS allows
+)
+
+// validate checks the filter, queue URL and group template of the rule
+func (r Rule) validate() error {
+	if !mqtt.IsValidFilter(r.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Filter)
+	}
+
+	if !strings.HasPrefix(r.QueueURL, "https://") && !strings.HasPrefix(r.QueueURL, "http://") {
+		return fmt.Errorf("has invalid queue url %q", r.QueueURL)
+	}
+
+	if err := bridge.Render(r.Group, bridge.TopicValues(nil, ""), func(string) {}); err != nil {
+		return fmt.Errorf("has invalid group %q: %w", r.Group, err)
+	}
+	return nil
+}
+
+// validate checks the queue URL, topic template and QoS of the inbound rule
+func (r InboundRule) validate() error {
+	if !strings.HasPrefix(r.QueueURL, "https://") && !strings.HasPrefix(r.QueueURL, "http://") {
+		return fmt.Errorf("has invalid queue url %q", r.QueueURL)
+	}
+
+	if err := bridge.Render(r.Topic, func(string) (string, bool) { return "", true }, func(string) {}); err != nil {
+		return fmt.Errorf("has invalid topic %q: %w", r.Topic, err)
+	}
+
+	if r.Qos > 2 {
+		return fmt.Errorf("has invalid qos %d", r.Qos)
+	}
+	return nil
+}
+
+// entry returns the entry of the message published by the client
+func (r Rule) entry(cl *mqtt.Client, pk packets.Packet) Entry {
+	e := Entry{
+		Attributes: attributes(cl, pk),
+	}
+
+	if utf8.Valid(pk.Payload) {
+		e.Body = string(pk.Payload)
+	} else {
+		e.Body = base64.StdEncoding.EncodeToString(pk.Payload)
+		e.Attributes[AttributeEncoding] = Attribute{DataType: "String", Value: "base64"}
+	}
+
+	if strings.HasSuffix(r.QueueURL, ".fifo") {
+		var group strings.Builder
+		bridge.Render(r.Group, bridge.TopicValues(strings.Split(pk.TopicName, "/"), cl.ID), func(s string) { group.WriteString(s) })
+		e.GroupID = groupID(group.String())
+		e.DeduplicationID = deduplicationID(cl, pk)
+	}
+	return e
+}
+
+// attributes returns the attributes of the entry of the message, from its properties
+func attributes(cl *mqtt.Client, pk packets.Packet) map[string]Attribute {
+	a := map[string]Attribute{
+		AttributeTopic:  {DataType: "String", Value: pk.TopicName},
+		AttributeClient: {DataType: "String", Value: cl.ID},
+		AttributeQos:    {DataType: "Number", Value: strconv.Itoa(int(pk.FixedHeader.Qos))},
+	}
+
+	if pk.FixedHeader.Retain {
+		a[AttributeRetain] = Attribute{DataType: "String", Value: "true"}
+	}
+
+	if pk.Properties.ContentType != "" {
+		a[AttributeContentType] = Attribute{DataType: "String", Value: pk.Properties.ContentType}
+	}
+
+	reserved := 1 // for the encoding of the payload
+	for _, p := range pk.Properties.User {
+		if len(a)+reserved >= maxAttributes {
+			break
+		}
+
+		name := attributeName(p.Key)
+		if _, ok := a[name]; ok || p.Val == "" {
+			continue // the first of repeated user properties is kept, and SQS doesn't allow empty values
+		}
+		a[name] = Attribute{DataType: "String", Value: p.Val}
+	}
+	return a
+}
+
+// properties returns the MQTT properties of the attributes of a received message, with the content
+// type and the attributes which aren't those of the hook as user properties, in the order of their
+// names
+func properties(attributes map[string]Attribute) packets.Properties {
+	var p packets.Properties
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch name {
+		case AttributeTopic, AttributeClient, AttributeQos, AttributeRetain, AttributeEncoding:
+		case AttributeContentType:
+			p.ContentType = attributes[name].Value
+		default:
+			p.User = append(p.User, packets.UserProperty{Key: name, Val: attributes[name].Value})
+		}
+	}
+	return p
+}
+
+// attributeName returns the name of the attribute of a user property, replacing the characters SQS
+// doesn't allow in attribute names with underscores, and prefixing those it reserves
+func attributeName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, key)
+
+	lower := strings.ToLower(key)
+	if name == "" || strings.HasPrefix(lower, "aws.") || strings.HasPrefix(lower, "amazon.") {
+		name = "_" + name
+	}
+	return name
+}
+
+// groupID returns the message group id, replacing the characters SQS doesn't allow in it with
+// underscores, and truncating it to the longest SQS allows
+func groupID(group string) string {
+	group = strings.Map(func(r rune) rune {
+		if r > ' ' && r <= '~' {
+			return r
+		}
+		return '_'
+	}, group)
+
+	if group == "" {
+		return "_"
+	}
+	return group[:min(len(group), maxGroupID)]
+}
+
+// deduplicationID returns the deduplication id of the message, so SQS discards the copies of QoS 1
+// messages the client sends again with the same packet id. QoS 0 messages are never sent again, so
+// their ids are unique
+func deduplicationID(cl *mqtt.Client, pk packets.Packet) string {
+	sum := sha256.New()
+	sum.Write([]byte(cl.ID))
+	sum.Write([]byte{0})
+	sum.Write([]byte(pk.TopicName))
+	sum.Write([]byte{0})
+	sum.Write(binary.BigEndian.AppendUint16(nil, pk.PacketID))
+	if pk.FixedHeader.Qos == 0 {
+		sum.Write(binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+	}
+	sum.Write(pk.Payload)
+	return hex.EncodeToString(sum.Sum(nil))
+}
@@ -0,0 +1,115 @@
+package sqs
+
+import (
+	"strings"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectError bool
+	}{
+		{
+			name: "Success - standard queue",
+			rule: Rule{Filter: "devices/#", QueueURL: standardURL},
+		},
+		{
+			name: "Success - fifo queue with group",
+			rule: Rule{Filter: "devices/+/events", QueueURL: fifoURL, Group: "{client}-{2}"},
+		},
+		{
+			name:        "Failure - invalid filter",
+			rule:        Rule{Filter: "a/#/b", QueueURL: standardURL},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid queue url",
+			rule:        Rule{Filter: "#", QueueURL: "events"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown placeholder",
+			rule:        Rule{Filter: "#", QueueURL: fifoURL, Group: "{username}"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestInboundRuleValidate(t *testing.T) {
+	require.NoError(t, InboundRule{QueueURL: commandsURL, Topic: "devices/{device}/commands"}.validate())
+	require.Error(t, InboundRule{QueueURL: "commands", Topic: "a"}.validate())
+	require.Error(t, InboundRule{QueueURL: commandsURL, Topic: "devices/{device"}.validate())
+	require.Error(t, InboundRule{QueueURL: commandsURL, Topic: "a", Qos: 3}.validate())
+}
+
+func TestRuleEntry(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "sensor-1", false)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "devices/sensor-1/events",
+		Payload:     []byte("open"),
+		PacketID:    7,
+		Properties: packets.Properties{
+			User: []packets.UserProperty{{Key: "site id", Val: "north"}},
+		},
+	}
+
+	e := Rule{QueueURL: standardURL}.entry(cl, pk)
+	require.Equal(t, "open", e.Body)
+	require.Equal(t, map[string]Attribute{
+		AttributeTopic:  {DataType: "String", Value: "devices/sensor-1/events"},
+		AttributeClient: {DataType: "String", Value: "sensor-1"},
+		AttributeQos:    {DataType: "Number", Value: "1"},
+		"site_id":       {DataType: "String", Value: "north"},
+	}, e.Attributes)
+	require.Empty(t, e.GroupID)
+
+	// fifo queues have a group and the same deduplication id for a message sent again
+	e = Rule{QueueURL: fifoURL, Group: "{topic}"}.entry(cl, pk)
+	require.Equal(t, "devices/sensor-1/events", e.GroupID)
+	require.Len(t, e.DeduplicationID, 64)
+	require.Equal(t, e.DeduplicationID, Rule{QueueURL: fifoURL, Group: "{1}"}.entry(cl, pk).DeduplicationID)
+
+	// payloads which aren't utf-8 are base64 encoded
+	pk.Payload = []byte{0xff}
+	e = Rule{QueueURL: standardURL}.entry(cl, pk)
+	require.Equal(t, "/w==", e.Body)
+	require.Equal(t, "base64", e.Attributes[AttributeEncoding].Value)
+}
+
+func TestAttributes(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	pk := packets.Packet{TopicName: "a"}
+	for _, k := range strings.Split("a b c d e f g h i j k", " ") {
+		pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: k, Val: k})
+	}
+
+	// one attribute is left for the encoding of the payload
+	a := attributes(cl, pk)
+	require.Len(t, a, maxAttributes-1)
+	require.Equal(t, "_Amazon_x", attributeName("Amazon.x"))
+
+	// the attributes of the hook aren't user properties
+	require.Equal(t, packets.Properties{
+		User: []packets.UserProperty{{Key: "a", Val: "a"}, {Key: "b", Val: "b"}, {Key: "c", Val: "c"}, {Key: "d", Val: "d"}, {Key: "e", Val: "e"}, {Key: "f", Val: "f"}},
+	}, properties(a))
+}
@@ -0,0 +1,444 @@
+// Package sqs provides a bridge hook sending the messages published to matching MQTT topics to AWS SQS
+// queues in batches, and polling SQS queues to publish their messages to the broker, eg. commands for
+// devices, so MQTT can be integrated with existing SQS workers.
+//
+// Messages are sent and received through a Client, which is a thin adapter of the SQS client of the
+// application, eg. for aws-sdk-go-v2:
+//
+//	type client struct{ *sqs.Client }
+//
+//	func (c client) Send(ctx context.Context, queueURL string, entries []mqttsqs.Entry) ([]string, error) {
+//		in := &sqs.SendMessageBatchInput{QueueUrl: aws.String(queueURL)}
+//		for _, e := range entries {
+//			entry := types.SendMessageBatchRequestEntry{Id: aws.String(e.ID), MessageBody: aws.String(e.Body)}
+//			if e.GroupID != "" {
+//				entry.MessageGroupId, entry.MessageDeduplicationId = aws.String(e.GroupID), aws.String(e.DeduplicationID)
+//			}
+//			entry.MessageAttributes = make(map[string]types.MessageAttributeValue, len(e.Attributes))
+//			for name, a := range e.Attributes {
+//				entry.MessageAttributes[name] = types.MessageAttributeValue{DataType: aws.String(a.DataType), StringValue: aws.String(a.Value)}
+//			}
+//			in.Entries = append(in.Entries, entry)
+//		}
+//		out, err := c.SendMessageBatch(ctx, in)
+//		if err != nil {
+//			return nil, err
+//		}
+//		var failed []string
+//		for _, f := range out.Failed {
+//			failed = append(failed, aws.ToString(f.Id))
+//		}
+//		return failed, nil
+//	}
+//
+// with Receive, Delete and ChangeVisibility calling ReceiveMessage with the MessageAttributeNames
+// "All", DeleteMessageBatch and ChangeMessageVisibility.
+package sqs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// ClientID is the id of the inline client which publishes the messages received from SQS
+const ClientID = "sqs-bridge"
+
+// maxBatch is the most messages SQS sends, receives or deletes at once
+const maxBatch = 10
+
+// Entry is a message sent to a queue
+type Entry struct {
+	ID         string // unique within its batch
+	Body       string
+	Attributes map[string]Attribute
+
+	// GroupID and DeduplicationID are set for FIFO queues, whose URL ends with .fifo
+	GroupID         string
+	DeduplicationID string
+}
+
+// Received is a message received from a queue
+type Received struct {
+	ID            string
+	ReceiptHandle string
+	Body          string
+	Attributes    map[string]Attribute
+}
+
+// Attribute is a message attribute, whose DataType is String or Number
+type Attribute struct {
+	DataType string
+	Value    string
+}
+
+// Client sends and receives SQS messages, usually a thin adapter of an SQS client
+type Client interface {
+	// Send sends a batch of entries, returning the ids of those which failed, or an error if the whole
+	// batch did
+	Send(ctx context.Context, queueURL string, entries []Entry) (failed []string, err error)
+
+	// Receive returns up to max messages, which are hidden from other receivers for the visibility
+	// timeout, waiting for them for up to wait
+	Receive(ctx context.Context, queueURL string, max int, visibility, wait time.Duration) ([]Received, error)
+
+	// Delete deletes the received messages with the receipt handles
+	Delete(ctx context.Context, queueURL string, receiptHandles []string) error
+
+	// ChangeVisibility hides the received message with the receipt handle for the timeout, from now
+	ChangeVisibility(ctx context.Context, queueURL, receiptHandle string, timeout time.Duration) error
+}
+
+// Rule sends the messages of the MQTT topics matching Filter, which may contain +/# wildcards, to the
+// queue QueueURL. Group is the message group of FIFO queues, a template in which {topic} is the MQTT
+// topic, {client} is the id of the publishing client, and {1}, {2}... are the levels of the topic, and
+// defaults to {topic} so the messages of each topic are delivered in order. Where is an optional filter
+// expression (see pkg/filter) messages must also match, eg. "json.temperature > 30". Transform is an
+// optional template (see pkg/transform) the payloads of the messages are rewritten with, eg.
+// transform.Envelope
+type Rule struct {
+	Filter    string `yaml:"filter" json:"filter"`
+	Where     string `yaml:"where" json:"where"`
+	Transform string `yaml:"transform" json:"transform"`
+	QueueURL  string `yaml:"queue_url" json:"queue_url"`
+	Group     string `yaml:"group" json:"group"`
+}
+
+// InboundRule publishes the messages of the queue QueueURL to the broker. Topic is a template, in
+// which {name} is the value of the message attribute name, and defaults to {mqtt_topic}, eg.
+// "devices/{device}/commands"
+type InboundRule struct {
+	QueueURL string `yaml:"queue_url" json:"queue_url"`
+	Topic    string `yaml:"topic" json:"topic"`
+	Qos      byte   `yaml:"qos" json:"qos"`
+	Retain   bool   `yaml:"retain" json:"retain"`
+}
+
+// Metrics are called as messages are bridged. Unset funcs are skipped
+type Metrics struct {
+	// Sent is called after messages have been sent, with how long sending their batch took
+	Sent func(queueURL string, messages int, took time.Duration)
+
+	// Failed is called after messages could not be sent, and are discarded
+	Failed func(queueURL string, messages int, err error)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+
+	// Received is called for each message received from a queue and published to the broker
+	Received func(topic string)
+
+	// Rejected is called for each received message which could not be published, and is made
+	// visible again after RetryDelay
+	Rejected func(queueURL string, err error)
+}
+
+// Stats are the totals of the messages bridged since the hook was initialized
+type Stats struct {
+	Batches  int64 // the number of batches sent, or which failed
+	Sent     int64 // the number of messages sent to SQS
+	Failed   int64 // the number of messages which could not be sent
+	Dropped  int64 // the number of messages discarded as the queue was full
+	Received int64 // the number of messages received from SQS and published to the broker
+	Rejected int64 // the number of received messages which could not be published
+}
+
+// Hook is a hook that bridges messages between the broker and SQS
+type Hook struct {
+	config  Options
+	client  *mqtt.Client // publishes the messages received from SQS
+	bridge  *bridge.Bridge[Entry]
+	stats   Stats              // of the batches and received messages
+	cancel  context.CancelFunc // stops polling
+	pollers sync.WaitGroup
+	stopped atomic.Bool
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the sqs hook
+type Options struct {
+	// Server is the server received messages are published to, and is required with inbound rules. It
+	// is published a bridge.Warning to $SYS/bridges/sqs/dropped when messages are dropped, if it is set
+	Server *mqtt.Server
+
+	// Client sends and receives the messages
+	Client Client
+
+	// Rules map MQTT topics to queues, and the first whose filter matches the topic of a message
+	// applies. Messages matching no rule aren't sent
+	Rules []Rule
+
+	// Inbound rules poll queues for messages to publish to the broker
+	Inbound []InboundRule
+
+	Linger  time.Duration // how long a batch waits for more messages, defaults to 10ms
+	Timeout time.Duration // how long sending, deleting or changing messages may take, defaults to 10 seconds
+
+	// QueueSize is how many messages wait to be sent, defaults to 10000. Messages published while the
+	// queue is full, eg. because SQS is unavailable, wait for up to Block for room, and are then
+	// dropped by the Drop policy, which defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Buffer queues messages on disk rather than in memory if it is set, so the messages which haven't
+	// been sent survive restarts of the broker and long outages of SQS
+	Buffer *bridge.Buffer
+
+	// Retry retries the messages of a batch which fail, and must limit the attempts or the time spent.
+	// Batches are sent once if it is nil
+	Retry *retry.Policy
+
+	// VisibilityTimeout hides received messages from other receivers while they are published, and
+	// defaults to 30 seconds. WaitTime is how long a poll waits for messages, defaults to 20 seconds
+	VisibilityTimeout time.Duration
+	WaitTime          time.Duration
+
+	// RetryDelay is when a received message which could not be published is received again, defaults
+	// to 10 seconds. A redrive policy of the queue moves messages received too often to a dead letter
+	// queue
+	RetryDelay time.Duration
+
+	// Backoff spaces polls which fail, defaulting to intervals from 100ms to 10 seconds. Polls are
+	// retried by its Forever, so polling never gives up
+	Backoff retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "sqs-bridge-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts sending messages
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	sqsHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if sqsHookConfig.Client == nil {
+		return errors.New("client is required")
+	}
+
+	if len(sqsHookConfig.Rules) == 0 && len(sqsHookConfig.Inbound) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range sqsHookConfig.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+
+		if rule.Group == "" {
+			sqsHookConfig.Rules[i].Group = "{topic}"
+		}
+	}
+
+	if len(sqsHookConfig.Inbound) > 0 && sqsHookConfig.Server == nil {
+		return errors.New("server is required with inbound rules")
+	}
+
+	for i, rule := range sqsHookConfig.Inbound {
+		if rule.Topic == "" {
+			sqsHookConfig.Inbound[i].Topic = "{" + AttributeTopic + "}"
+		}
+
+		if err := sqsHookConfig.Inbound[i].validate(); err != nil {
+			return fmt.Errorf("inbound rule %d %w", i, err)
+		}
+	}
+
+	if sqsHookConfig.Retry != nil && sqsHookConfig.Retry.MaxAttempts == 0 && sqsHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if sqsHookConfig.Linger <= 0 {
+		sqsHookConfig.Linger = 10 * time.Millisecond
+	}
+
+	if sqsHookConfig.Timeout <= 0 {
+		sqsHookConfig.Timeout = 10 * time.Second
+	}
+
+	if sqsHookConfig.QueueSize <= 0 {
+		sqsHookConfig.QueueSize = 10000
+	}
+
+	if sqsHookConfig.VisibilityTimeout <= 0 {
+		sqsHookConfig.VisibilityTimeout = 30 * time.Second
+	}
+
+	if sqsHookConfig.WaitTime <= 0 {
+		sqsHookConfig.WaitTime = 20 * time.Second
+	}
+
+	if sqsHookConfig.RetryDelay <= 0 {
+		sqsHookConfig.RetryDelay = 10 * time.Second
+	}
+
+	h.config = sqsHookConfig
+	if sqsHookConfig.Server != nil {
+		h.client = sqsHookConfig.Server.NewClient(nil, "local", ClientID, true)
+		h.client.Properties.ProtocolVersion = 5
+	}
+
+	filters := make([]string, len(sqsHookConfig.Rules))
+	where := make([]string, len(sqsHookConfig.Rules))
+	transforms := make([]string, len(sqsHookConfig.Rules))
+	for i, rule := range sqsHookConfig.Rules {
+		filters[i], where[i], transforms[i] = rule.Filter, rule.Where, rule.Transform
+	}
+
+	if len(filters) == 0 {
+		return nil // only inbound rules
+	}
+
+	var err error
+	h.bridge, err = bridge.New[Entry](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		Transform: transforms,
+		BatchSize: maxBatch,
+		Linger:    sqsHookConfig.Linger,
+		Timeout:   sqsHookConfig.Timeout,
+		QueueSize: sqsHookConfig.QueueSize,
+		Block:     sqsHookConfig.Block,
+		Drop:      sqsHookConfig.Drop,
+		Server:    sqsHookConfig.Server,
+		Name:      "sqs",
+		Buffer:    sqsHookConfig.Buffer,
+		Retry:     sqsHookConfig.Retry,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// OnStarted is called when the server has started, and starts polling the queues of inbound rules
+func (h *Hook) OnStarted() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	for _, rule := range h.config.Inbound {
+		h.pollers.Add(1)
+		go h.poll(ctx, rule)
+	}
+}
+
+// Stop stops polling, and sends the queued messages
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+		h.pollers.Wait()
+	}
+
+	if h.bridge == nil || h.stopped.Swap(true) {
+		return nil
+	}
+	return h.bridge.Close()
+}
+
+// Stats returns the totals of the messages bridged so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	stats := h.stats
+	h.statsMu.Unlock()
+
+	if h.bridge != nil {
+		b := h.bridge.Stats()
+		stats.Batches, stats.Sent, stats.Failed, stats.Dropped = b.Batches, b.Sent, b.Failed, b.Dropped
+	}
+	return stats
+}
+
+// OnPublished is called when a client has published a message, and queues it to be sent if a rule
+// matches its topic. Messages received from SQS aren't sent back
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if h.bridge == nil || cl.ID == ClientID && cl.Net.Inline {
+		return
+	}
+
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Sent != nil {
+		m.Sent = func(route, messages int, took time.Duration) {
+			h.config.Metrics.Sent(h.config.Rules[route].QueueURL, messages, took)
+		}
+	}
+
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, messages int, err error) {
+			h.config.Metrics.Failed(h.config.Rules[route].QueueURL, messages, err)
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// sink encodes and sends the entries of the bridge of the hook
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the entry of the message published by the client
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (Entry, error) {
+	return s.h.config.Rules[route].entry(cl, pk), nil
+}
+
+// Send sends the entries to the queue of the rule, giving those without an id their index in the
+// batch, which entries sent again keep. It returns a *bridge.PartialError for the entries which failed
+func (s sink) Send(ctx context.Context, route int, entries []Entry) error {
+	for i := range entries {
+		if entries[i].ID == "" {
+			entries[i].ID = strconv.Itoa(i)
+		}
+	}
+
+	failed, err := s.h.config.Client.Send(ctx, s.h.config.Rules[route].QueueURL, entries)
+	if err != nil || len(failed) == 0 {
+		return err
+	}
+
+	var indexes []int
+	for i, e := range entries {
+		if slices.Contains(failed, e.ID) {
+			indexes = append(indexes, i)
+		}
+	}
+	return &bridge.PartialError{Failed: indexes, Err: fmt.Errorf("%d of %d messages failed", len(failed), len(entries))}
+}
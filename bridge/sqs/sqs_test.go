@@ -0,0 +1,504 @@
+package sqs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+const (
+	standardURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/events"
+	fifoURL     = "https://sqs.eu-west-1.amazonaws.com/123456789012/events.fifo"
+	commandsURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/commands"
+)
+
+// fakeClient records the batches it sends, and returns the messages sent to its receive channel
+type fakeClient struct {
+	batches  map[string][][]Entry
+	results  []sendResult // returned by the next sends
+	received chan []Received
+	deleted  []string
+	hidden   map[string]time.Duration
+	block    chan struct{} // send waits for it to be closed, if set
+	mu       sync.Mutex
+}
+
+// sendResult is the result of a send
+type sendResult struct {
+	failed []string
+	err    error
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		batches:  map[string][][]Entry{},
+		received: make(chan []Received, 10),
+		hidden:   map[string]time.Duration{},
+	}
+}
+
+func (c *fakeClient) Send(ctx context.Context, queueURL string, entries []Entry) ([]string, error) {
+	if c.block != nil {
+		<-c.block
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var result sendResult
+	if len(c.results) > 0 {
+		result, c.results = c.results[0], c.results[1:]
+	}
+
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	var sent []Entry
+	for _, e := range entries {
+		if !slices.Contains(result.failed, e.ID) {
+			sent = append(sent, e)
+		}
+	}
+	c.batches[queueURL] = append(c.batches[queueURL], sent)
+	return result.failed, nil
+}
+
+func (c *fakeClient) Receive(ctx context.Context, queueURL string, max int, visibility, wait time.Duration) ([]Received, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case received := <-c.received:
+		if received == nil {
+			return nil, errors.New("service unavailable")
+		}
+		return received, nil
+	}
+}
+
+func (c *fakeClient) Delete(ctx context.Context, queueURL string, receiptHandles []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleted = append(c.deleted, receiptHandles...)
+	return nil
+}
+
+func (c *fakeClient) ChangeVisibility(ctx context.Context, queueURL, receiptHandle string, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hidden[receiptHandle] = timeout
+	return nil
+}
+
+func (c *fakeClient) sent(queueURL string) [][]Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batches[queueURL]
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	sqsHook := new(Hook)
+	sqsHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, sqsHook.Init(options))
+	t.Cleanup(func() { sqsHook.Stop() })
+	return sqsHook
+}
+
+func publish(h *Hook, topic string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(topic)})
+}
+
+func TestID(t *testing.T) {
+	sqsHook := new(Hook)
+
+	require.Equal(t, "sqs-bridge-hook", sqsHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	sqsHook := new(Hook)
+
+	require.True(t, sqsHook.Provides(mqtt.OnStarted))
+	require.True(t, sqsHook.Provides(mqtt.OnPublished))
+	require.False(t, sqsHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	server := mqtt.New(nil)
+	rules := []Rule{{Filter: "#", QueueURL: standardURL}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - rules",
+			config:      Options{Client: newFakeClient(), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Success - inbound rules",
+			config:      Options{Server: server, Client: newFakeClient(), Inbound: []InboundRule{{QueueURL: commandsURL}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no client",
+			config:      Options{Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Client: newFakeClient()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Client: newFakeClient(), Rules: []Rule{{Filter: "#", QueueURL: "events"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - inbound without server",
+			config:      Options{Client: newFakeClient(), Inbound: []InboundRule{{QueueURL: commandsURL}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid inbound rule",
+			config:      Options{Server: server, Client: newFakeClient(), Inbound: []InboundRule{{QueueURL: commandsURL, Qos: 3}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Client: newFakeClient(), Rules: rules, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			sqsHook := new(Hook)
+			sqsHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := sqsHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, 30*time.Second, sqsHook.config.VisibilityTimeout)
+				require.Equal(t, 20*time.Second, sqsHook.config.WaitTime)
+				require.Equal(t, 10*time.Second, sqsHook.config.RetryDelay)
+				require.NoError(t, sqsHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestBatches(t *testing.T) {
+	client := newFakeClient()
+	sqsHook := newHook(t, Options{
+		Client: client,
+		Rules: []Rule{
+			{Filter: "devices/+/events", QueueURL: fifoURL, Group: "{2}"},
+			{Filter: "devices/#", QueueURL: standardURL},
+		},
+		Linger: time.Hour,
+	})
+
+	// batches are sent to each queue once they are full
+	for i := 0; i < maxBatch; i++ {
+		publish(sqsHook, "devices/d1/events")
+	}
+	publish(sqsHook, "devices/d1/status")
+	publish(sqsHook, "other")
+	require.Eventually(t, func() bool {
+		return len(client.sent(fifoURL)) == 1
+	}, time.Second, time.Millisecond)
+
+	batch := client.sent(fifoURL)[0]
+	require.Len(t, batch, maxBatch)
+	require.Equal(t, "0", batch[0].ID)
+	require.Equal(t, "9", batch[9].ID)
+	require.Equal(t, "d1", batch[0].GroupID)
+	require.Equal(t, "devices/d1/events", batch[0].Body)
+	require.Empty(t, client.sent(standardURL))
+
+	// the other batches are sent when the hook stops
+	require.NoError(t, sqsHook.Stop())
+	require.Len(t, client.sent(standardURL), 1)
+	require.Empty(t, client.sent(standardURL)[0][0].GroupID)
+	require.Equal(t, Stats{Batches: 2, Sent: 11}, sqsHook.Stats())
+
+	// messages published once the hook has stopped are ignored
+	publish(sqsHook, "devices/d1/status")
+	require.NoError(t, sqsHook.Stop())
+}
+
+func TestQueueFull(t *testing.T) {
+	client := newFakeClient()
+	client.block = make(chan struct{})
+	var dropped int
+	sqsHook := newHook(t, Options{
+		Client:    client,
+		Rules:     []Rule{{Filter: "#", QueueURL: standardURL}},
+		Linger:    time.Millisecond,
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// the first message is being sent, the second is queued, and the third is dropped
+	publish(sqsHook, "a")
+	require.Eventually(t, func() bool {
+		return sqsHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	publish(sqsHook, "b")
+	publish(sqsHook, "c")
+	require.Equal(t, 1, dropped)
+
+	close(client.block)
+	require.NoError(t, sqsHook.Stop())
+	require.Equal(t, Stats{Batches: 2, Sent: 2, Dropped: 1}, sqsHook.Stats())
+}
+
+func TestDrop(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	warnings := make(chan bridge.Warning, 1)
+	require.NoError(t, server.Subscribe("$SYS/bridges/sqs/dropped", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		var w bridge.Warning
+		require.NoError(t, json.Unmarshal(pk.Payload, &w))
+		warnings <- w
+	}))
+
+	client := newFakeClient()
+	client.block = make(chan struct{})
+	sqsHook := newHook(t, Options{
+		Server:    server,
+		Client:    client,
+		Rules:     []Rule{{Filter: "#", QueueURL: standardURL}},
+		Linger:    time.Millisecond,
+		QueueSize: 1,
+		Block:     20 * time.Millisecond,
+		Drop:      bridge.DropOldest,
+	})
+
+	// the first message is being sent, and the second is dropped for the third once it has waited for
+	// room
+	publish(sqsHook, "a")
+	require.Eventually(t, func() bool {
+		return sqsHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	publish(sqsHook, "b")
+	start := time.Now()
+	publish(sqsHook, "c")
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	require.Equal(t, bridge.Warning{Bridge: "sqs", Dropped: 1, Total: 1}, <-warnings)
+
+	close(client.block)
+	require.NoError(t, sqsHook.Stop())
+	sent := client.sent(standardURL)
+	require.Len(t, sent, 2)
+	require.Equal(t, "c", sent[1][0].Body)
+	require.Equal(t, Stats{Batches: 2, Sent: 2, Dropped: 1}, sqsHook.Stats())
+}
+
+func TestBuffer(t *testing.T) {
+	client := newFakeClient()
+	client.block = make(chan struct{})
+	options := Options{
+		Client: client,
+		Rules:  []Rule{{Filter: "#", QueueURL: standardURL}},
+		Linger: time.Millisecond,
+		Buffer: &bridge.Buffer{Dir: t.TempDir()},
+	}
+	sqsHook := newHook(t, options)
+
+	// the first message is being sent when the hook stops, and the second is kept in the buffer
+	publish(sqsHook, "a")
+	require.Eventually(t, func() bool {
+		return sqsHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	publish(sqsHook, "b")
+
+	stopped := make(chan error)
+	go func() { stopped <- sqsHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(client.block)
+	require.NoError(t, <-stopped)
+	require.Len(t, client.sent(standardURL), 1)
+
+	// and is sent once the hook is restarted
+	client = newFakeClient()
+	options.Client = client
+	sqsHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return len(client.sent(standardURL)) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, "b", client.sent(standardURL)[0][0].Body)
+	require.Equal(t, "0", client.sent(standardURL)[0][0].ID)
+}
+
+func TestPartialBatchRetry(t *testing.T) {
+	client := newFakeClient()
+	client.results = []sendResult{
+		{failed: []string{"1"}},
+		{err: errors.New("throttled")},
+	}
+	var sent []int
+	sqsHook := newHook(t, Options{
+		Client: client,
+		Rules:  []Rule{{Filter: "#", QueueURL: standardURL}},
+		Linger: time.Hour,
+		Retry:  &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+		Metrics: Metrics{
+			Sent: func(queueURL string, messages int, took time.Duration) { sent = append(sent, messages) },
+		},
+	})
+
+	// the failed message is retried alone, until it is sent
+	publish(sqsHook, "a")
+	publish(sqsHook, "b")
+	publish(sqsHook, "c")
+	require.NoError(t, sqsHook.Stop())
+
+	batches := client.sent(standardURL)
+	require.Len(t, batches, 2)
+	require.Len(t, batches[0], 2)
+	require.Equal(t, []Entry{{ID: "1", Body: "b", Attributes: batches[1][0].Attributes}}, batches[1])
+	require.Equal(t, []int{3}, sent)
+	require.Equal(t, Stats{Batches: 1, Sent: 3}, sqsHook.Stats())
+}
+
+func TestPartialBatchFailure(t *testing.T) {
+	client := newFakeClient()
+	client.results = []sendResult{{failed: []string{"0"}}}
+	var failed, sent int
+	sqsHook := newHook(t, Options{
+		Client: client,
+		Rules:  []Rule{{Filter: "#", QueueURL: standardURL}},
+		Linger: time.Hour,
+		Metrics: Metrics{
+			Sent:   func(queueURL string, messages int, took time.Duration) { sent += messages },
+			Failed: func(queueURL string, messages int, err error) { failed += messages },
+		},
+	})
+
+	// without a retry policy, the failed message is discarded
+	publish(sqsHook, "a")
+	publish(sqsHook, "b")
+	require.NoError(t, sqsHook.Stop())
+
+	require.Equal(t, 1, sent)
+	require.Equal(t, 1, failed)
+	require.Equal(t, Stats{Batches: 1, Sent: 1, Failed: 1}, sqsHook.Stats())
+}
+
+func TestInbound(t *testing.T) {
+	client := newFakeClient()
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	var mu sync.Mutex
+	var received []packets.Packet
+	require.NoError(t, server.Subscribe("devices/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, pk)
+	}))
+
+	var rejected int
+	sqsHook := new(Hook)
+	require.NoError(t, server.AddHook(sqsHook, Options{
+		Server:  server,
+		Client:  client,
+		Rules:   []Rule{{Filter: "devices/#", QueueURL: standardURL}},
+		Inbound: []InboundRule{{QueueURL: commandsURL, Topic: "devices/{device}/commands", Qos: 1}},
+		Linger:  time.Millisecond,
+		Backoff: retry.Policy{InitialInterval: time.Millisecond},
+		Metrics: Metrics{
+			Rejected: func(queueURL string, err error) { rejected++ },
+		},
+	}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	client.received <- nil // a failed poll is retried
+	client.received <- []Received{
+		{
+			ID:            "m1",
+			ReceiptHandle: "h1",
+			Body:          "reboot",
+			Attributes: map[string]Attribute{
+				"device":             {DataType: "String", Value: "d1"},
+				AttributeContentType: {DataType: "String", Value: "text/plain"},
+			},
+		},
+		{ID: "m2", ReceiptHandle: "h2", Body: "reboot"},
+		{
+			ID:            "m3",
+			ReceiptHandle: "h3",
+			Body:          "/wA=",
+			Attributes: map[string]Attribute{
+				"device":          {DataType: "String", Value: "d2"},
+				AttributeEncoding: {DataType: "String", Value: "base64"},
+			},
+		},
+	}
+
+	require.Eventually(t, func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return len(client.deleted) == 2
+	}, time.Second, time.Millisecond)
+
+	// published messages are deleted, and the message without a device is visible again soon
+	client.mu.Lock()
+	require.Equal(t, []string{"h1", "h3"}, client.deleted)
+	require.Equal(t, map[string]time.Duration{"h2": 10 * time.Second}, client.hidden)
+	client.mu.Unlock()
+	require.Equal(t, 1, rejected)
+
+	mu.Lock()
+	require.Len(t, received, 2)
+	require.Equal(t, "devices/d1/commands", received[0].TopicName)
+	require.Equal(t, []byte("reboot"), received[0].Payload)
+	require.Equal(t, "text/plain", received[0].Properties.ContentType)
+	require.Equal(t, []packets.UserProperty{{Key: "device", Val: "d1"}}, received[0].Properties.User)
+	require.Equal(t, []byte{0xff, 0x00}, received[1].Payload)
+	mu.Unlock()
+
+	// received messages aren't sent back
+	require.NoError(t, sqsHook.Stop())
+	require.Empty(t, client.sent(standardURL))
+	require.Equal(t, Stats{Received: 2, Rejected: 1}, sqsHook.Stats())
+}
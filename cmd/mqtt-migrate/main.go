@@ -0,0 +1,169 @@
+// Command mqtt-migrate copies the sessions, subscriptions, retained and inflight messages persisted by
+// one storage hook to another, eg. to move a broker from snapshots to Redis. It should run while the
+// broker is stopped, so that nothing is written to the source during the copy.
+//
+//	mqtt-migrate -from snapshot:///var/backups/mqtt -to redis://:secret@localhost:6379/0
+//
+// Storages are given as URLs:
+//
+//	redis://[user:password@]host:port[,host:port...][/db][?prefix=&mode=cluster|sentinel&master=]
+//	rediss://...                                       with TLS
+//	snapshot:///path/to/directory[?prefix=]            snapshots in a directory
+//
+// Storages whose databases are opened by the application, such as BadgerDB, Pebble or SQL, are
+// migrated with the migrate package instead
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+
+	"github.com/mochi-mqtt/hooks/pkg/migrate"
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+	"github.com/mochi-mqtt/hooks/storage/redis"
+	"github.com/mochi-mqtt/hooks/storage/snapshot"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "mqtt-migrate:", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the arguments and copies the records
+func run(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("mqtt-migrate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	from := flags.String("from", "", "URL of the storage to copy from")
+	to := flags.String("to", "", "URL of the storage to copy to")
+	verbose := flags.Bool("v", false, "log what the hooks do")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == "" || *to == "" {
+		flags.Usage()
+		return errors.New("-from and -to are required")
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	log := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level}))
+
+	src, err := start(*from, log)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	defer src.Stop()
+
+	dst, err := start(*to, log)
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+
+	counts, err := migrate.Copy(src, dst)
+	if err = errors.Join(err, dst.Stop()); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "copied %s\n", counts)
+	return nil
+}
+
+// start initializes the hook of the storage at the URL
+func start(rawURL string, log *slog.Logger) (mqtt.Hook, error) {
+	hook, config, err := open(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	hook.SetOpts(log, &mqtt.HookOptions{})
+	if err := hook.Init(config); err != nil {
+		return nil, fmt.Errorf("failed initialising %s: %w", hook.ID(), err)
+	}
+	return hook, nil
+}
+
+// open returns the hook of the storage at the URL and its config
+func open(rawURL string) (mqtt.Hook, any, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		options, err := redisOptions(u)
+		return new(redis.Hook), options, err
+	case "snapshot":
+		dir := u.Path
+		if u.Opaque != "" {
+			dir = u.Opaque
+		}
+
+		if dir == "" {
+			return nil, nil, errors.New("snapshot directory is required")
+		}
+
+		return new(snapshot.Hook), snapshot.Options{
+			Bucket: snapshot.Dir(dir),
+			Prefix: u.Query().Get("prefix"),
+		}, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported storage %q", u.Scheme)
+}
+
+// redisOptions returns the options of the redis storage hook at the URL
+func redisOptions(u *url.URL) (redis.Options, error) {
+	options := redis.Options{
+		ClientOptions: redisclient.ClientOptions{
+			Addrs:      strings.Split(u.Host, ","),
+			Username:   u.User.Username(),
+			MasterName: u.Query().Get("master"),
+		},
+		Prefix: u.Query().Get("prefix"),
+	}
+	options.Password, _ = u.User.Password()
+
+	if u.Host == "" {
+		return options, errors.New("redis address is required")
+	}
+
+	if u.Scheme == "rediss" {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return options, fmt.Errorf("invalid redis database %q", db)
+		}
+		options.DB = n
+	}
+
+	switch mode := u.Query().Get("mode"); mode {
+	case "":
+	case "cluster":
+		options.Mode = redisclient.Cluster
+	case "sentinel":
+		options.Mode = redisclient.Sentinel
+	default:
+		return options, fmt.Errorf("invalid redis mode %q", mode)
+	}
+
+	return options, nil
+}
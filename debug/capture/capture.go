@@ -0,0 +1,319 @@
+// Package capture provides a diagnostics hook recording the packets read from and sent to selected
+// clients to a capture file, and a Replayer feeding the packets of the clients back to a test broker,
+// for reproducing interoperability bugs seen in the field.
+//
+// Packets sent to clients are captured as they were written. Packets read from clients are captured
+// re-encoded from how the server decoded them, as the server doesn't keep their bytes, so they may
+// differ from what the client sent in ways which don't change their meaning, such as the order of
+// properties. The passwords and authentication data of connect packets aren't captured.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// Stats are the totals of the packets captured since the hook was initialized
+type Stats struct {
+	Captured int64 // the number of packets written to the capture file
+	Skipped  int64 // the number of packets not captured as the capture file was full
+	Failed   int64 // the number of packets which could not be captured
+}
+
+// conn is a connection of a client
+type conn struct {
+	id       uint64
+	selected bool // whether the packets of the connection are captured
+}
+
+// Hook is a hook that captures the packets of clients to a file
+type Hook struct {
+	config  Options
+	conns   *cache.Cache[*mqtt.Client, conn] // the connections seen, by their clients
+	next    uint64                           // the id of the next connection
+	file    *os.File
+	buf     *bufio.Writer
+	size    int64  // the size of the capture file
+	enc     []byte // reused to encode records
+	full    bool   // whether the capture file has reached its maximum size
+	stats   Stats
+	done    chan struct{}
+	wg      sync.WaitGroup // the flusher
+	mu      sync.Mutex     // guards conns, next and the file
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the capture hook
+type Options struct {
+	// Path is the path of the capture file, which is replaced if it exists. Required
+	Path string
+
+	// Clients are patterns of the ids of the clients whose packets are captured, eg. "sensor-*", and
+	// default to all clients
+	Clients []string
+
+	// MaxSize is the size the capture file grows to before capturing stops, and defaults to 100 MiB
+	MaxSize int64
+
+	// FlushInterval is how often the capture file is flushed, and defaults to 1 second
+	FlushInterval time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "capture-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPacketRead,
+		mqtt.OnPacketSent,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and creates the capture file
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	captureHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if captureHookConfig.Path == "" {
+		return errors.New("path is required")
+	}
+
+	for _, pattern := range captureHookConfig.Clients {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid client pattern %q: %w", pattern, err)
+		}
+	}
+
+	if captureHookConfig.MaxSize <= 0 {
+		captureHookConfig.MaxSize = 100 << 20
+	}
+
+	if captureHookConfig.FlushInterval <= 0 {
+		captureHookConfig.FlushInterval = time.Second
+	}
+
+	file, err := os.OpenFile(captureHookConfig.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	h.config = captureHookConfig
+	h.conns = cache.New[*mqtt.Client, conn](cache.Options{MaxEntries: 100000})
+	h.next = 1
+	h.file = file
+	h.buf = bufio.NewWriter(file)
+	h.size = int64(len(magic))
+	h.full = false
+	if _, err := h.buf.WriteString(magic); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	h.done = make(chan struct{})
+	h.wg.Add(1)
+	go h.flusher()
+
+	return nil
+}
+
+// Stop flushes and closes the capture file
+func (h *Hook) Stop() error {
+	if h.done == nil {
+		return nil
+	}
+
+	select {
+	case <-h.done:
+		return nil
+	default:
+	}
+
+	close(h.done)
+	h.wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	err := h.buf.Flush()
+	if cerr := h.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Stats returns the totals of the packets captured so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// OnPacketRead is called when a packet is received from a client, and captures it
+func (h *Hook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	id := cl.ID
+	if pk.FixedHeader.Type == packets.Connect {
+		if id == "" {
+			id = pk.Connect.ClientIdentifier // the id isn't set until the connect packet is parsed
+		}
+
+		connect := pk
+		connect.Connect.Password = nil
+		connect.Connect.PasswordFlag = false
+		connect.Properties.AuthenticationData = nil
+		if b, err := encode(connect); err == nil {
+			h.capture(cl, id, Inbound, connect.ProtocolVersion, b)
+		} else {
+			h.failed(err, cl)
+		}
+		return pk, nil
+	}
+
+	b, err := encode(pk)
+	if err != nil {
+		h.failed(err, cl)
+		return pk, nil
+	}
+
+	h.capture(cl, id, Inbound, pk.ProtocolVersion, b)
+	return pk, nil
+}
+
+// OnPacketSent is called when a packet has been written to a client, and captures it
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if cl.Net.Inline {
+		return
+	}
+
+	h.capture(cl, cl.ID, Outbound, cl.Properties.ProtocolVersion, b)
+}
+
+// OnDisconnect is called when a client which had connected disconnects, and forgets its connection
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conns.Delete(cl)
+}
+
+// capture writes the packet of the client to the capture file, if the client is selected. Whether it
+// is selected is decided by its id when the first packet of its connection is captured
+func (h *Hook) capture(cl *mqtt.Client, id string, direction Direction, version byte, b []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.full {
+		h.count(func(s *Stats) { s.Skipped++ })
+		return
+	}
+
+	c, ok := h.conns.Get(cl)
+	if !ok {
+		c = conn{id: h.next, selected: h.selected(id)}
+		h.next++
+		h.conns.Set(cl, c)
+	}
+
+	if !c.selected {
+		return
+	}
+
+	h.enc = appendRecord(h.enc[:0], Record{
+		Time:            time.Now(),
+		Conn:            c.id,
+		Client:          id,
+		Listener:        cl.Net.Listener,
+		Remote:          cl.Net.Remote,
+		Direction:       direction,
+		ProtocolVersion: version,
+		Packet:          b,
+	})
+
+	if h.size+int64(len(h.enc)) > h.config.MaxSize {
+		h.full = true
+		h.Log.Warn("stopped capturing packets as capture file is full", "path", h.config.Path, "size", h.size)
+		h.count(func(s *Stats) { s.Skipped++ })
+		return
+	}
+
+	if _, err := h.buf.Write(h.enc); err != nil {
+		h.Log.Error("error occurred while capturing packet", "error", err, "client", id)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.size += int64(len(h.enc))
+	h.count(func(s *Stats) { s.Captured++ })
+}
+
+// selected returns whether the packets of the client are captured
+func (h *Hook) selected(id string) bool {
+	if len(h.config.Clients) == 0 {
+		return true
+	}
+
+	for _, pattern := range h.config.Clients {
+		if matched, _ := path.Match(pattern, id); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// failed counts a packet which could not be encoded to be captured
+func (h *Hook) failed(err error, cl *mqtt.Client) {
+	h.Log.Error("error occurred while encoding captured packet", "error", err, "client", cl.ID)
+	h.count(func(s *Stats) { s.Failed++ })
+}
+
+// flusher flushes the capture file every flush interval until the hook stops
+func (h *Hook) flusher() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			h.mu.Lock()
+			if err := h.buf.Flush(); err != nil {
+				h.Log.Error("error occurred while flushing capture file", "error", err, "path", h.config.Path)
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
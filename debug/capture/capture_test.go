@@ -0,0 +1,339 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(nil)
+	server.Log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, server *mqtt.Server, options Options) *Hook {
+	t.Helper()
+
+	captureHook := new(Hook)
+	require.NoError(t, server.AddHook(captureHook, options))
+	t.Cleanup(func() { _ = captureHook.Stop() })
+	return captureHook
+}
+
+func connect(id string) packets.Packet {
+	return packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 4,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			Clean:            true,
+			Keepalive:        30,
+			ClientIdentifier: id,
+			UsernameFlag:     true,
+			Username:         []byte("user"),
+			PasswordFlag:     true,
+			Password:         []byte("secret"),
+		},
+	}
+}
+
+func publish(topic, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish, Retain: true},
+		ProtocolVersion: 4,
+		TopicName:       topic,
+		Payload:         []byte(payload),
+	}
+}
+
+// session connects the client to the server, publishes the messages and disconnects, waiting until the
+// server has closed the connection
+func session(t *testing.T, server *mqtt.Server, id string, messages ...packets.Packet) {
+	t.Helper()
+
+	conn, err := Pipe(server, "t1")(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	pks := append([]packets.Packet{connect(id)}, messages...)
+	pks = append(pks, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Disconnect}})
+	for _, pk := range pks {
+		b, err := encode(pk)
+		require.NoError(t, err)
+		_, err = conn.Write(b)
+		require.NoError(t, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't closed")
+	}
+}
+
+// records returns the records of the capture file
+func records(t *testing.T, name string) []Record {
+	t.Helper()
+
+	var recs []Record
+	require.NoError(t, ReadFile(name, func(r Record) error {
+		recs = append(recs, r)
+		return nil
+	}))
+	return recs
+}
+
+func TestID(t *testing.T) {
+	captureHook := new(Hook)
+
+	require.Equal(t, "capture-hook", captureHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	captureHook := new(Hook)
+
+	require.True(t, captureHook.Provides(mqtt.OnPacketRead))
+	require.True(t, captureHook.Provides(mqtt.OnPacketSent))
+	require.True(t, captureHook.Provides(mqtt.OnDisconnect))
+	require.False(t, captureHook.Provides(mqtt.OnPublished))
+}
+
+func TestInit(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:   "Success",
+			config: Options{Path: filepath.Join(dir, "capture.bin"), Clients: []string{"sensor-*"}},
+		},
+		{
+			name:        "Error - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Error - improper config",
+			config:      "not valid",
+			expectError: true,
+		},
+		{
+			name:        "Error - no path",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid client pattern",
+			config:      Options{Path: filepath.Join(dir, "capture.bin"), Clients: []string{"sensor-["}},
+			expectError: true,
+		},
+		{
+			name:        "Error - path not writable",
+			config:      Options{Path: filepath.Join(dir, "missing", "capture.bin")},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureHook := new(Hook)
+			err := captureHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, int64(100<<20), captureHook.config.MaxSize)
+			require.Equal(t, time.Second, captureHook.config.FlushInterval)
+			require.NoError(t, captureHook.Stop())
+			require.NoError(t, captureHook.Stop())
+		})
+	}
+}
+
+func TestCapture(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture.bin")
+	server := newServer(t)
+	captureHook := newHook(t, server, Options{Path: name, Clients: []string{"sensor-*"}})
+
+	session(t, server, "sensor-1", publish("a/b", "hello"))
+	session(t, server, "other-1", publish("c/d", "ignored"))
+	require.NoError(t, captureHook.Stop())
+
+	recs := records(t, name)
+	require.Len(t, recs, 4)
+	require.Equal(t, captureHook.Stats(), Stats{Captured: 4})
+
+	var types []byte
+	for _, rec := range recs {
+		require.Equal(t, recs[0].Conn, rec.Conn)
+		require.Equal(t, "sensor-1", rec.Client)
+		require.Equal(t, "t1", rec.Listener)
+		require.Equal(t, byte(4), rec.ProtocolVersion)
+
+		pk, err := rec.Decode()
+		require.NoError(t, err)
+		types = append(types, pk.FixedHeader.Type)
+	}
+	require.Equal(t, []byte{packets.Connect, packets.Connack, packets.Publish, packets.Disconnect}, types)
+	require.Equal(t, []Direction{Inbound, Outbound, Inbound, Inbound}, []Direction{recs[0].Direction, recs[1].Direction, recs[2].Direction, recs[3].Direction})
+
+	pk, err := recs[0].Decode()
+	require.NoError(t, err)
+	require.Equal(t, "sensor-1", pk.Connect.ClientIdentifier)
+	require.Equal(t, []byte("user"), pk.Connect.Username)
+	require.False(t, pk.Connect.PasswordFlag)
+	require.Empty(t, pk.Connect.Password)
+
+	pk, err = recs[2].Decode()
+	require.NoError(t, err)
+	require.Equal(t, "a/b", pk.TopicName)
+	require.Equal(t, []byte("hello"), pk.Payload)
+	require.True(t, pk.FixedHeader.Retain)
+}
+
+func TestMaxSize(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture.bin")
+	server := newServer(t)
+	captureHook := newHook(t, server, Options{Path: name, MaxSize: 100})
+
+	session(t, server, "sensor-1", publish("a/b", "hello"))
+	require.NoError(t, captureHook.Stop())
+
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	require.LessOrEqual(t, info.Size(), int64(100))
+
+	stats := captureHook.Stats()
+	require.Positive(t, stats.Captured)
+	require.Positive(t, stats.Skipped)
+	require.Len(t, records(t, name), int(stats.Captured))
+}
+
+func TestReader(t *testing.T) {
+	rec := Record{
+		Time:            time.Unix(0, 1700000000123456789),
+		Conn:            300,
+		Client:          "sensor-1",
+		Listener:        "t1",
+		Remote:          "10.0.0.1:51234",
+		Direction:       Outbound,
+		ProtocolVersion: 5,
+		Packet:          []byte{0x20, 0x03, 0x00, 0x00, 0x00},
+	}
+
+	b := append([]byte(magic), appendRecord(nil, rec)...)
+	r, err := NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	got, err := r.Read()
+	require.NoError(t, err)
+	require.True(t, rec.Time.Equal(got.Time))
+	got.Time = rec.Time
+	require.Equal(t, rec, got)
+
+	_, err = r.Read()
+	require.ErrorIs(t, err, io.EOF)
+
+	pk, err := got.Decode()
+	require.NoError(t, err)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+
+	r, err = NewReader(bytes.NewReader(b[:len(b)-2]))
+	require.NoError(t, err)
+	_, err = r.Read()
+	require.ErrorIs(t, err, errTruncated)
+
+	_, err = NewReader(bytes.NewReader([]byte("not a capture")))
+	require.Error(t, err)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	_, err := Record{}.Decode()
+	require.Error(t, err)
+
+	_, err = Record{Packet: []byte{0x30, 0x05, 0x00}}.Decode()
+	require.Error(t, err)
+}
+
+func TestReplay(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture.bin")
+	server := newServer(t)
+	captureHook := newHook(t, server, Options{Path: name})
+
+	session(t, server, "sensor-1", publish("a/b", "hello"))
+	session(t, server, "sensor-2", publish("c/d", "world"))
+	require.NoError(t, captureHook.Stop())
+
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := NewReader(bufio.NewReader(f))
+	require.NoError(t, err)
+
+	replayed := newServer(t)
+	received := make(chan Record, 10)
+	replayer := &Replayer{
+		Dial:     Pipe(replayed, "replay"),
+		Clients:  []string{"sensor-1"},
+		Received: func(r Record) { received <- r },
+	}
+	require.NoError(t, replayer.Replay(context.Background(), r))
+
+	retained, ok := replayed.Topics.Retained.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), retained.Payload)
+
+	_, ok = replayed.Topics.Retained.Get("c/d")
+	require.False(t, ok)
+
+	require.Len(t, received, 1)
+	rec := <-received
+	require.Equal(t, "sensor-1", rec.Client)
+	require.Equal(t, Outbound, rec.Direction)
+	pk, err := rec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, packets.Connack, pk.FixedHeader.Type)
+}
+
+func TestReplayErrors(t *testing.T) {
+	b := append([]byte(magic), appendRecord(nil, Record{Client: "sensor-1", Packet: []byte{0xc0, 0x00}})...)
+
+	r, err := NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Error(t, new(Replayer).Replay(context.Background(), r))
+
+	r, err = NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	replayer := &Replayer{
+		Dial: func(ctx context.Context) (net.Conn, error) { return nil, errors.New("refused") },
+	}
+	require.ErrorContains(t, replayer.Replay(context.Background(), r), "refused")
+}
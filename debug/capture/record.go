@@ -0,0 +1,265 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// magic starts capture files, and is followed by the records
+const magic = "MQTTCAP1"
+
+// errTruncated is returned for a record which was only partly written, eg. when the broker crashed
+var errTruncated = errors.New("truncated record")
+
+// Direction is whether a packet was read from or sent to a client
+type Direction byte
+
+// the directions of packets
+const (
+	Inbound  Direction = iota // read from the client
+	Outbound                  // sent to the client
+)
+
+// Record is a captured packet
+type Record struct {
+	Time            time.Time
+	Conn            uint64 // identifies the connection the packet was read or sent on, within the capture
+	Client          string
+	Listener        string
+	Remote          string
+	Direction       Direction
+	ProtocolVersion byte
+	Packet          []byte // the packet as it is encoded on the wire, starting with its fixed header
+}
+
+// Decode decodes the packet of the record
+func (r Record) Decode() (packets.Packet, error) {
+	var pk packets.Packet
+	if len(r.Packet) == 0 {
+		return pk, errors.New("empty packet")
+	}
+
+	if err := pk.FixedHeader.Decode(r.Packet[0]); err != nil {
+		return pk, err
+	}
+
+	br := bytes.NewReader(r.Packet[1:])
+	remaining, _, err := packets.DecodeLength(br)
+	if err != nil {
+		return pk, err
+	}
+
+	body := r.Packet[len(r.Packet)-br.Len():]
+	if len(body) != remaining {
+		return pk, fmt.Errorf("packet has %d remaining bytes, expected %d", len(body), remaining)
+	}
+
+	pk.FixedHeader.Remaining = remaining
+	pk.ProtocolVersion = r.ProtocolVersion
+	body = append([]byte{}, body...)
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectDecode(body)
+	case packets.Connack:
+		err = pk.ConnackDecode(body)
+	case packets.Publish:
+		err = pk.PublishDecode(body)
+	case packets.Puback:
+		err = pk.PubackDecode(body)
+	case packets.Pubrec:
+		err = pk.PubrecDecode(body)
+	case packets.Pubrel:
+		err = pk.PubrelDecode(body)
+	case packets.Pubcomp:
+		err = pk.PubcompDecode(body)
+	case packets.Subscribe:
+		err = pk.SubscribeDecode(body)
+	case packets.Suback:
+		err = pk.SubackDecode(body)
+	case packets.Unsubscribe:
+		err = pk.UnsubscribeDecode(body)
+	case packets.Unsuback:
+		err = pk.UnsubackDecode(body)
+	case packets.Pingreq, packets.Pingresp:
+	case packets.Disconnect:
+		err = pk.DisconnectDecode(body)
+	case packets.Auth:
+		err = pk.AuthDecode(body)
+	default:
+		err = fmt.Errorf("invalid packet type %d", pk.FixedHeader.Type)
+	}
+
+	return pk, err
+}
+
+// encode encodes the packet as it is encoded on the wire
+func encode(pk packets.Packet) ([]byte, error) {
+	var err error
+	buf := new(bytes.Buffer)
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectEncode(buf)
+	case packets.Connack:
+		err = pk.ConnackEncode(buf)
+	case packets.Publish:
+		err = pk.PublishEncode(buf)
+	case packets.Puback:
+		err = pk.PubackEncode(buf)
+	case packets.Pubrec:
+		err = pk.PubrecEncode(buf)
+	case packets.Pubrel:
+		err = pk.PubrelEncode(buf)
+	case packets.Pubcomp:
+		err = pk.PubcompEncode(buf)
+	case packets.Subscribe:
+		err = pk.SubscribeEncode(buf)
+	case packets.Suback:
+		err = pk.SubackEncode(buf)
+	case packets.Unsubscribe:
+		err = pk.UnsubscribeEncode(buf)
+	case packets.Unsuback:
+		err = pk.UnsubackEncode(buf)
+	case packets.Pingreq:
+		err = pk.PingreqEncode(buf)
+	case packets.Pingresp:
+		err = pk.PingrespEncode(buf)
+	case packets.Disconnect:
+		err = pk.DisconnectEncode(buf)
+	case packets.Auth:
+		err = pk.AuthEncode(buf)
+	default:
+		err = fmt.Errorf("invalid packet type %d", pk.FixedHeader.Type)
+	}
+
+	return buf.Bytes(), err
+}
+
+// appendRecord appends the record as its length as a 4 byte big endian integer, followed by its time
+// in unix nanoseconds, connection, direction, protocol version, length prefixed client id, listener
+// and remote address, and its packet
+func appendRecord(b []byte, r Record) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Time.UnixNano()))
+	b = binary.AppendUvarint(b, r.Conn)
+	b = append(b, byte(r.Direction), r.ProtocolVersion)
+	b = appendField(b, r.Client)
+	b = appendField(b, r.Listener)
+	b = appendField(b, r.Remote)
+	b = append(b, r.Packet...)
+
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+// appendField appends a length prefixed field
+func appendField(b []byte, field string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(field)))
+	return append(b, field...)
+}
+
+// Reader reads the records of a capture file
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader returns a reader of the records of the capture read from r
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, header); err != nil || string(header) != magic {
+		return nil, errors.New("not a capture file")
+	}
+
+	return &Reader{r: br}, nil
+}
+
+// Read returns the next record, or io.EOF after the last
+func (r *Reader) Read() (Record, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r.r, size[:]); errors.Is(err, io.EOF) {
+		return Record{}, io.EOF
+	} else if err != nil {
+		return Record{}, errTruncated
+	}
+
+	b := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return Record{}, errTruncated
+	}
+
+	if len(b) < 8 {
+		return Record{}, errTruncated
+	}
+
+	rec := Record{Time: time.Unix(0, int64(binary.BigEndian.Uint64(b)))}
+	b = b[8:]
+
+	conn, read := binary.Uvarint(b)
+	if read <= 0 || len(b) < read+2 {
+		return Record{}, errTruncated
+	}
+	rec.Conn = conn
+	rec.Direction, rec.ProtocolVersion = Direction(b[read]), b[read+1]
+	b = b[read+2:]
+
+	var ok bool
+	if rec.Client, b, ok = readField(b); !ok {
+		return Record{}, errTruncated
+	}
+
+	if rec.Listener, b, ok = readField(b); !ok {
+		return Record{}, errTruncated
+	}
+
+	if rec.Remote, b, ok = readField(b); !ok {
+		return Record{}, errTruncated
+	}
+
+	rec.Packet = b
+	return rec, nil
+}
+
+// readField reads a length prefixed field from b, returning the rest of b
+func readField(b []byte) (string, []byte, bool) {
+	n, read := binary.Uvarint(b)
+	if read <= 0 || uint64(len(b)-read) < n {
+		return "", nil, false
+	}
+	return string(b[read : read+int(n)]), b[read+int(n):], true
+}
+
+// ReadFile calls fn with each record of the capture file, until fn returns an error
+func ReadFile(name string, fn func(r Record) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader, err := NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	for {
+		rec, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
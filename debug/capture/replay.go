@@ -0,0 +1,224 @@
+package capture
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// writeTimeout is how long writing a packet to the broker may take
+const writeTimeout = 10 * time.Second
+
+// Replayer replays the packets captured from clients to a broker, each connection of the capture on a
+// connection of its own, to reproduce what the broker was sent
+type Replayer struct {
+	// Dial connects to the broker, eg. Pipe(server, "t1") or a net.Dialer. Required
+	Dial func(ctx context.Context) (net.Conn, error)
+
+	// Clients are patterns of the ids of the clients whose packets are replayed, eg. "sensor-*", and
+	// default to all clients
+	Clients []string
+
+	// Speed is how fast the packets are replayed relative to when they were captured, eg. 1 for the
+	// time they were captured at and 2 for twice as fast. The packets are replayed as fast as
+	// possible if it is 0
+	Speed float64
+
+	// Linger is how long the connections are kept open after the last packet is replayed, for the
+	// responses of the broker, and defaults to 100 milliseconds
+	Linger time.Duration
+
+	// Received is called with the packets the broker sends to the connections, as outbound records, from
+	// the goroutines reading the connections
+	Received func(r Record)
+}
+
+// replayConn is a connection to the broker replaying a connection of the capture
+type replayConn struct {
+	conn   net.Conn
+	closed bool // the connection failed, and its packets are skipped
+}
+
+// Pipe returns a Dial func connecting to the server in memory, as a client of the named listener
+func Pipe(server *mqtt.Server, listener string) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		client, broker := net.Pipe()
+		go func() {
+			_ = server.EstablishConnection(listener, broker)
+		}()
+		return client, nil
+	}
+}
+
+// Replay writes the inbound packets read from r to the broker, in the order they were captured. A
+// connection which the broker closes skips the rest of its packets
+func (rp *Replayer) Replay(ctx context.Context, r *Reader) error {
+	if rp.Dial == nil {
+		return errors.New("dial is required")
+	}
+
+	for _, pattern := range rp.Clients {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid client pattern %q: %w", pattern, err)
+		}
+	}
+
+	linger := rp.Linger
+	if linger <= 0 {
+		linger = 100 * time.Millisecond
+	}
+
+	var wg sync.WaitGroup
+	conns := make(map[uint64]*replayConn)
+	defer func() {
+		for _, c := range conns {
+			_ = c.conn.Close()
+		}
+		wg.Wait()
+	}()
+
+	var last time.Time
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if rec.Direction != Inbound || !rp.selected(rec.Client) {
+			continue
+		}
+
+		if rp.Speed > 0 && !last.IsZero() && rec.Time.After(last) {
+			if err := sleep(ctx, time.Duration(float64(rec.Time.Sub(last))/rp.Speed)); err != nil {
+				return err
+			}
+		}
+		last = rec.Time
+
+		c, ok := conns[rec.Conn]
+		if !ok {
+			conn, err := rp.Dial(ctx)
+			if err != nil {
+				return fmt.Errorf("dial connection %d of client %s: %w", rec.Conn, rec.Client, err)
+			}
+
+			c = &replayConn{conn: conn}
+			conns[rec.Conn] = c
+
+			wg.Add(1)
+			go func(rec Record) {
+				defer wg.Done()
+				rp.read(conn, rec)
+			}(rec)
+		}
+
+		if c.closed {
+			continue
+		}
+
+		_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := c.conn.Write(rec.Packet); err != nil {
+			c.closed = true
+		}
+	}
+
+	return sleep(ctx, linger)
+}
+
+// read reads the packets the broker sends to the connection until it is closed, passing them to
+// Received
+func (rp *Replayer) read(conn net.Conn, first Record) {
+	br := bufio.NewReader(conn)
+	for {
+		b, err := readPacket(br)
+		if err != nil {
+			return
+		}
+
+		if rp.Received != nil {
+			rp.Received(Record{
+				Time:            time.Now(),
+				Conn:            first.Conn,
+				Client:          first.Client,
+				Listener:        first.Listener,
+				Remote:          first.Remote,
+				Direction:       Outbound,
+				ProtocolVersion: first.ProtocolVersion,
+				Packet:          b,
+			})
+		}
+	}
+}
+
+// selected returns whether the packets of the client are replayed
+func (rp *Replayer) selected(id string) bool {
+	if len(rp.Clients) == 0 {
+		return true
+	}
+
+	for _, pattern := range rp.Clients {
+		if matched, _ := path.Match(pattern, id); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// readPacket reads the next packet as it is encoded on the wire
+func readPacket(br *bufio.Reader) ([]byte, error) {
+	header, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	b := []byte{header}
+	remaining, _, err := packets.DecodeLength(&recorder{br: br, b: &b})
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, remaining)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	return append(b, body...), nil
+}
+
+// recorder is a byte reader keeping the bytes it reads
+type recorder struct {
+	br *bufio.Reader
+	b  *[]byte
+}
+
+// ReadByte reads the next byte, and keeps it
+func (r *recorder) ReadByte() (byte, error) {
+	c, err := r.br.ReadByte()
+	if err == nil {
+		*r.b = append(*r.b, c)
+	}
+	return c, err
+}
+
+// sleep waits for the duration, or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,463 @@
+// Package trace provides a diagnostics hook logging the events of the broker for selected clients and
+// topics, eg. the packets they send and receive, the messages they publish, and the acks rejecting
+// them, to make "why was this message dropped?" debuggable in production.
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// the verbosities of the hook, each of which logs the events of those before it
+const (
+	// VerbosityEvents logs connections, disconnections, subscriptions, dropped messages, wills,
+	// expiries, and the acks and errors rejecting packets
+	VerbosityEvents = iota + 1
+
+	// VerbosityMessages also logs the messages published, and their delivery
+	VerbosityMessages
+
+	// VerbosityPackets also logs every packet read and sent
+	VerbosityPackets
+)
+
+// Redacted replaces the values of the redacted fields of payloads
+const Redacted = "[redacted]"
+
+// events are the events logged at each verbosity
+var events = map[byte]int{
+	mqtt.OnConnect:            VerbosityEvents,
+	mqtt.OnSessionEstablished: VerbosityEvents,
+	mqtt.OnDisconnect:         VerbosityEvents,
+	mqtt.OnSubscribed:         VerbosityEvents,
+	mqtt.OnUnsubscribed:       VerbosityEvents,
+	mqtt.OnPublishDropped:     VerbosityEvents,
+	mqtt.OnQosDropped:         VerbosityEvents,
+	mqtt.OnPacketIDExhausted:  VerbosityEvents,
+	mqtt.OnPacketProcessed:    VerbosityEvents,
+	mqtt.OnPacketSent:         VerbosityEvents,
+	mqtt.OnWillSent:           VerbosityEvents,
+	mqtt.OnClientExpired:      VerbosityEvents,
+	mqtt.OnRetainedExpired:    VerbosityEvents,
+	mqtt.OnPublish:            VerbosityMessages,
+	mqtt.OnPublished:          VerbosityMessages,
+	mqtt.OnRetainPublished:    VerbosityMessages,
+	mqtt.OnQosPublish:         VerbosityMessages,
+	mqtt.OnQosComplete:        VerbosityMessages,
+	mqtt.OnPacketRead:         VerbosityPackets,
+}
+
+// Hook is a hook that logs the events of the broker
+type Hook struct {
+	config Options
+	log    *slog.Logger
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the trace hook
+type Options struct {
+	// Verbosity is which events are logged, and defaults to VerbosityEvents
+	Verbosity int
+
+	// Level is the level events are logged at, and defaults to info. Levels overrides it for events,
+	// by the names of their hook methods, eg. {"OnPublishDropped": slog.LevelWarn}
+	Level  slog.Level
+	Levels map[string]slog.Level
+
+	// Logger is the logger events are logged to, and defaults to the logger of the server
+	Logger *slog.Logger
+
+	// Clients are patterns of the ids of the clients whose events are logged, eg. "sensor-*", and
+	// Topics are the filters of the topics whose events are logged, which may contain +/# wildcards.
+	// The events of all the clients and topics are logged if they are empty
+	Clients []string
+	Topics  []string
+
+	// Payload is how many bytes of payloads are logged, which aren't logged if it is 0, and all of
+	// them if it is negative. Redact are the fields of JSON payloads whose values are replaced before
+	// they are logged, eg. "password" or "location.lat"
+	Payload int
+	Redact  []string
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "trace-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook, at its verbosity
+func (h *Hook) Provides(b byte) bool {
+	verbosity, ok := events[b]
+	return ok && verbosity <= h.config.Verbosity
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	traceHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if traceHookConfig.Verbosity == 0 {
+		traceHookConfig.Verbosity = VerbosityEvents
+	}
+
+	if traceHookConfig.Verbosity < VerbosityEvents || traceHookConfig.Verbosity > VerbosityPackets {
+		return fmt.Errorf("invalid verbosity %d", traceHookConfig.Verbosity)
+	}
+
+	for _, pattern := range traceHookConfig.Clients {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid client pattern %q: %w", pattern, err)
+		}
+	}
+
+	for _, filter := range traceHookConfig.Topics {
+		if !mqtt.IsValidFilter(filter, false) {
+			return fmt.Errorf("invalid topic filter %q", filter)
+		}
+	}
+
+	h.config = traceHookConfig
+	h.log = traceHookConfig.Logger
+	if h.log == nil {
+		h.log = h.Log
+	}
+
+	return nil
+}
+
+// OnConnect is called when a client sends a connect packet
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	h.trace("OnConnect", cl, "",
+		slog.String("username", string(pk.Connect.Username)),
+		slog.Int("protocol", int(pk.ProtocolVersion)),
+		slog.Bool("clean", pk.Connect.Clean),
+		slog.Int("keepalive", int(pk.Connect.Keepalive)),
+		slog.Bool("will", pk.Connect.WillFlag),
+	)
+	return nil
+}
+
+// OnSessionEstablished is called when a client has connected and authenticated
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.trace("OnSessionEstablished", cl, "", slog.String("username", string(cl.Properties.Username)))
+}
+
+// OnDisconnect is called when a client which had connected disconnects
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.trace("OnDisconnect", cl, "", slog.Any("error", err), slog.Bool("expire", expire))
+}
+
+// OnSubscribed is called when a client has subscribed to filters, with the reason codes of each
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	for i, sub := range pk.Filters {
+		attrs := []slog.Attr{slog.Int("qos", int(sub.Qos))}
+		if i < len(reasonCodes) {
+			attrs = append(attrs, reason(reasonCodes[i]))
+		}
+		h.trace("OnSubscribed", cl, sub.Filter, attrs...)
+	}
+}
+
+// OnUnsubscribed is called when a client has unsubscribed from filters
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	for _, sub := range pk.Filters {
+		h.trace("OnUnsubscribed", cl, sub.Filter)
+	}
+}
+
+// OnPublish is called when a client publishes a message, before it is processed by the other hooks
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	h.trace("OnPublish", cl, pk.TopicName, h.message(pk)...)
+	return pk, nil
+}
+
+// OnPublished is called when a client has published a message to its subscribers
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.trace("OnPublished", cl, pk.TopicName, h.message(pk)...)
+}
+
+// OnPublishDropped is called when a message to a client is dropped, as the client is too slow
+func (h *Hook) OnPublishDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.trace("OnPublishDropped", cl, pk.TopicName, h.message(pk)...)
+}
+
+// OnRetainPublished is called when a retained message is published to a client which subscribed
+func (h *Hook) OnRetainPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.trace("OnRetainPublished", cl, pk.TopicName, h.message(pk)...)
+}
+
+// OnQosPublish is called when a qos message is sent to a client, or acknowledged by the server
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	h.trace("OnQosPublish", cl, pk.TopicName,
+		slog.String("type", packets.PacketNames[pk.FixedHeader.Type]),
+		slog.Int("packet_id", int(pk.PacketID)),
+		slog.Int("resends", resends),
+	)
+}
+
+// OnQosComplete is called when the flow of a qos message has completed
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	h.trace("OnQosComplete", cl, pk.TopicName,
+		slog.String("type", packets.PacketNames[pk.FixedHeader.Type]),
+		slog.Int("packet_id", int(pk.PacketID)),
+	)
+}
+
+// OnQosDropped is called when an inflight message to a client is dropped
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.trace("OnQosDropped", cl, pk.TopicName, slog.Int("packet_id", int(pk.PacketID)))
+}
+
+// OnPacketIDExhausted is called when a client has no packet ids left for a message to it
+func (h *Hook) OnPacketIDExhausted(cl *mqtt.Client, pk packets.Packet) {
+	h.trace("OnPacketIDExhausted", cl, pk.TopicName)
+}
+
+// OnPacketRead is called when a packet is received from a client
+func (h *Hook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	h.trace("OnPacketRead", cl, pk.TopicName, h.packet(pk)...)
+	return pk, nil
+}
+
+// OnPacketSent is called when a packet has been written to a client, which is logged at
+// VerbosityPackets, or at VerbosityEvents if it is an ack rejecting a packet of the client
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if h.config.Verbosity < VerbosityPackets && !rejects(pk) {
+		return
+	}
+
+	h.trace("OnPacketSent", cl, pk.TopicName, h.packet(pk)...)
+}
+
+// OnPacketProcessed is called when a packet of a client has been processed, and logs the errors
+func (h *Hook) OnPacketProcessed(cl *mqtt.Client, pk packets.Packet, err error) {
+	if err == nil {
+		return
+	}
+
+	h.trace("OnPacketProcessed", cl, pk.TopicName,
+		slog.String("type", packets.PacketNames[pk.FixedHeader.Type]),
+		slog.Any("error", err),
+	)
+}
+
+// OnWillSent is called when the will message of a client has been published
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.trace("OnWillSent", cl, pk.TopicName, h.message(pk)...)
+}
+
+// OnClientExpired is called when the session of a disconnected client expires
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	h.trace("OnClientExpired", cl, "")
+}
+
+// OnRetainedExpired is called when a retained message expires
+func (h *Hook) OnRetainedExpired(filter string) {
+	h.trace("OnRetainedExpired", nil, filter)
+}
+
+// trace logs the event of the client and topic if they are selected
+func (h *Hook) trace(event string, cl *mqtt.Client, topic string, attrs ...slog.Attr) {
+	if !h.selected(cl, topic) {
+		return
+	}
+
+	level, ok := h.config.Levels[event]
+	if !ok {
+		level = h.config.Level
+	}
+
+	ctx := context.Background()
+	if !h.log.Enabled(ctx, level) {
+		return
+	}
+
+	base := []slog.Attr{slog.String("event", event)}
+	if cl != nil {
+		base = append(base, slog.String("client", cl.ID), slog.String("listener", cl.Net.Listener), slog.String("remote", cl.Net.Remote))
+	}
+	if topic != "" {
+		base = append(base, slog.String("topic", topic))
+	}
+
+	h.log.LogAttrs(ctx, level, "trace", append(base, attrs...)...)
+}
+
+// selected returns whether the events of the client and topic are logged. Events without a client or
+// topic are logged unless the clients or topics are selected
+func (h *Hook) selected(cl *mqtt.Client, topic string) bool {
+	if len(h.config.Clients) > 0 {
+		if cl == nil {
+			return false
+		}
+
+		ok := false
+		for _, pattern := range h.config.Clients {
+			if matched, _ := path.Match(pattern, cl.ID); matched {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(h.config.Topics) > 0 && topic != "" {
+		for _, filter := range h.config.Topics {
+			if acl.Match(filter, topic) || filter == topic {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// message returns the attributes of a published message
+func (h *Hook) message(pk packets.Packet) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.Int("qos", int(pk.FixedHeader.Qos)),
+		slog.Bool("retain", pk.FixedHeader.Retain),
+		slog.Int("size", len(pk.Payload)),
+	}
+
+	if pk.Origin != "" {
+		attrs = append(attrs, slog.String("origin", pk.Origin))
+	}
+
+	if h.config.Payload != 0 {
+		attrs = append(attrs, h.payload(pk.Payload))
+	}
+	return attrs
+}
+
+// packet returns the attributes of a packet read or sent
+func (h *Hook) packet(pk packets.Packet) []slog.Attr {
+	attrs := []slog.Attr{slog.String("type", packets.PacketNames[pk.FixedHeader.Type])}
+	switch pk.FixedHeader.Type {
+	case packets.Publish:
+		attrs = append(attrs, slog.Int("packet_id", int(pk.PacketID)))
+		attrs = append(attrs, h.message(pk)...)
+	case packets.Connack, packets.Puback, packets.Pubrec, packets.Pubrel, packets.Pubcomp, packets.Disconnect:
+		attrs = append(attrs, slog.Int("packet_id", int(pk.PacketID)), reason(pk.ReasonCode))
+	case packets.Suback, packets.Unsuback:
+		codes := make([]string, len(pk.ReasonCodes))
+		for i, code := range pk.ReasonCodes {
+			codes[i] = fmt.Sprintf("0x%02x", code)
+		}
+		attrs = append(attrs, slog.Int("packet_id", int(pk.PacketID)), slog.String("reason_codes", strings.Join(codes, ",")))
+	case packets.Subscribe, packets.Unsubscribe:
+		filters := make([]string, len(pk.Filters))
+		for i, sub := range pk.Filters {
+			filters[i] = sub.Filter
+		}
+		attrs = append(attrs, slog.Int("packet_id", int(pk.PacketID)), slog.String("filters", strings.Join(filters, ",")))
+	}
+	return attrs
+}
+
+// payload returns the attribute of the payload, redacted and truncated
+func (h *Hook) payload(b []byte) slog.Attr {
+	if len(h.config.Redact) > 0 {
+		b = redact(b, h.config.Redact)
+	}
+
+	truncated := h.config.Payload > 0 && len(b) > h.config.Payload
+	if truncated {
+		b = b[:h.config.Payload]
+		for i := 1; i < utf8.UTFMax && i < len(b); i++ {
+			if !utf8.Valid(b) && utf8.Valid(b[:len(b)-i]) {
+				b = b[:len(b)-i] // a rune was cut short by the truncation
+			}
+		}
+	}
+
+	if !utf8.Valid(b) {
+		return slog.String("payload_base64", base64.StdEncoding.EncodeToString(b))
+	}
+
+	s := string(b)
+	if truncated {
+		s += "..."
+	}
+	return slog.String("payload", s)
+}
+
+// redact returns the JSON payload with the values of the fields replaced, or the payload unchanged if
+// it isn't a JSON object
+func redact(b []byte, fields []string) []byte {
+	var doc map[string]any
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return b
+	}
+
+	for _, field := range fields {
+		replace(doc, strings.Split(field, "."))
+	}
+
+	redacted, err := json.Marshal(doc)
+	if err != nil {
+		return b
+	}
+	return redacted
+}
+
+// replace replaces the value of the field at the path in the document
+func replace(doc map[string]any, path []string) {
+	value, ok := doc[path[0]]
+	if !ok {
+		return
+	}
+
+	if len(path) == 1 {
+		doc[path[0]] = Redacted
+		return
+	}
+
+	if child, ok := value.(map[string]any); ok {
+		replace(child, path[1:])
+	}
+}
+
+// rejects returns whether the packet is an ack rejecting a packet of the client
+func rejects(pk packets.Packet) bool {
+	switch pk.FixedHeader.Type {
+	case packets.Connack, packets.Puback, packets.Pubrec, packets.Pubcomp, packets.Disconnect:
+		return pk.ReasonCode >= packets.ErrUnspecifiedError.Code || pk.FixedHeader.Type == packets.Connack && pk.ReasonCode != 0
+	case packets.Suback, packets.Unsuback:
+		for _, code := range pk.ReasonCodes {
+			if code >= packets.ErrUnspecifiedError.Code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reason returns the attribute of the reason code
+func reason(code byte) slog.Attr {
+	return slog.String("reason_code", fmt.Sprintf("0x%02x", code))
+}
@@ -0,0 +1,320 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newHook(t *testing.T, options Options) (*Hook, *bytes.Buffer) {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	traceHook := new(Hook)
+	traceHook.Log = slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	require.NoError(t, traceHook.Init(options))
+	return traceHook, buf
+}
+
+func newClient(id string) *mqtt.Client {
+	cl := mqtt.New(nil).NewClient(nil, "t1", id, false)
+	cl.Net.Remote = "10.0.0.1:51234"
+	return cl
+}
+
+// logs returns the records logged to the buffer
+func logs(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := make(map[string]any)
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func publish(topic, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+		PacketID:    7,
+	}
+}
+
+func TestID(t *testing.T) {
+	traceHook := new(Hook)
+
+	require.Equal(t, "trace-hook", traceHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	traceHook, _ := newHook(t, Options{})
+
+	require.True(t, traceHook.Provides(mqtt.OnConnect))
+	require.True(t, traceHook.Provides(mqtt.OnPacketSent))
+	require.False(t, traceHook.Provides(mqtt.OnPublish))
+	require.False(t, traceHook.Provides(mqtt.OnPacketRead))
+	require.False(t, traceHook.Provides(mqtt.OnACLCheck))
+
+	traceHook, _ = newHook(t, Options{Verbosity: VerbosityMessages})
+	require.True(t, traceHook.Provides(mqtt.OnPublish))
+	require.False(t, traceHook.Provides(mqtt.OnPacketRead))
+
+	traceHook, _ = newHook(t, Options{Verbosity: VerbosityPackets})
+	require.True(t, traceHook.Provides(mqtt.OnPacketRead))
+	require.False(t, traceHook.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:   "Success - defaults",
+			config: Options{},
+		},
+		{
+			name: "Success - filtered",
+			config: Options{
+				Verbosity: VerbosityPackets,
+				Clients:   []string{"sensor-*"},
+				Topics:    []string{"sensors/+/temp", "alerts/#"},
+			},
+		},
+		{
+			name:        "Error - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Error - improper config",
+			config:      "not valid",
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid verbosity",
+			config:      Options{Verbosity: 4},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid client pattern",
+			config:      Options{Clients: []string{"sensor-["}},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid topic filter",
+			config:      Options{Topics: []string{"sensors/#/temp"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traceHook := new(Hook)
+			err := traceHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, traceHook.config.Verbosity, VerbosityEvents)
+		})
+	}
+}
+
+func TestEvents(t *testing.T) {
+	traceHook, buf := newHook(t, Options{Verbosity: VerbosityMessages})
+	cl := newClient("device-1")
+
+	traceHook.OnDisconnect(cl, errors.New("keepalive timeout"), false)
+	pk, err := traceHook.OnPublish(cl, publish("sensors/1/temp", "21.5"))
+	require.NoError(t, err)
+	require.Equal(t, "sensors/1/temp", pk.TopicName)
+
+	records := logs(t, buf)
+	require.Len(t, records, 2)
+	require.Equal(t, "trace", records[0]["msg"])
+	require.Equal(t, "OnDisconnect", records[0]["event"])
+	require.Equal(t, "device-1", records[0]["client"])
+	require.Equal(t, "t1", records[0]["listener"])
+	require.Equal(t, "keepalive timeout", records[0]["error"])
+	require.Equal(t, "OnPublish", records[1]["event"])
+	require.Equal(t, "sensors/1/temp", records[1]["topic"])
+	require.Equal(t, float64(1), records[1]["qos"])
+	require.Equal(t, float64(4), records[1]["size"])
+	require.NotContains(t, records[1], "payload")
+}
+
+func TestSubscribed(t *testing.T) {
+	traceHook, buf := newHook(t, Options{})
+	cl := newClient("device-1")
+
+	traceHook.OnSubscribed(cl, packets.Packet{
+		Filters: packets.Subscriptions{{Filter: "a/b", Qos: 1}, {Filter: "c/#"}},
+	}, []byte{1, packets.ErrNotAuthorized.Code})
+
+	records := logs(t, buf)
+	require.Len(t, records, 2)
+	require.Equal(t, "a/b", records[0]["topic"])
+	require.Equal(t, "0x01", records[0]["reason_code"])
+	require.Equal(t, "c/#", records[1]["topic"])
+	require.Equal(t, "0x87", records[1]["reason_code"])
+}
+
+func TestPacketSent(t *testing.T) {
+	traceHook, buf := newHook(t, Options{})
+	cl := newClient("device-1")
+
+	traceHook.OnPacketSent(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: 3}, nil)
+	traceHook.OnPacketSent(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Connack}, ReasonCode: packets.Err3NotAuthorized.Code}, nil)
+	traceHook.OnPacketSent(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Suback}, ReasonCodes: []byte{0, packets.ErrTopicFilterInvalid.Code}}, nil)
+
+	records := logs(t, buf)
+	require.Len(t, records, 2)
+	require.Equal(t, "Connack", records[0]["type"])
+	require.Equal(t, "0x05", records[0]["reason_code"])
+	require.Equal(t, "Suback", records[1]["type"])
+	require.Equal(t, "0x00,0x8f", records[1]["reason_codes"])
+
+	traceHook, buf = newHook(t, Options{Verbosity: VerbosityPackets})
+	traceHook.OnPacketSent(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: 3}, nil)
+	records = logs(t, buf)
+	require.Len(t, records, 1)
+	require.Equal(t, "Puback", records[0]["type"])
+	require.Equal(t, float64(3), records[0]["packet_id"])
+}
+
+func TestPacketProcessed(t *testing.T) {
+	traceHook, buf := newHook(t, Options{})
+	cl := newClient("device-1")
+
+	traceHook.OnPacketProcessed(cl, publish("a/b", ""), nil)
+	traceHook.OnPacketProcessed(cl, publish("a/b", ""), packets.ErrTopicNameInvalid)
+
+	records := logs(t, buf)
+	require.Len(t, records, 1)
+	require.Equal(t, "Publish", records[0]["type"])
+	require.Equal(t, packets.ErrTopicNameInvalid.Error(), records[0]["error"])
+}
+
+func TestFilters(t *testing.T) {
+	traceHook, buf := newHook(t, Options{
+		Verbosity: VerbosityMessages,
+		Clients:   []string{"sensor-*"},
+		Topics:    []string{"sensors/+/temp"},
+	})
+
+	traceHook.OnPublished(newClient("sensor-1"), publish("sensors/1/temp", ""))
+	traceHook.OnPublished(newClient("sensor-1"), publish("sensors/1/humidity", ""))
+	traceHook.OnPublished(newClient("device-1"), publish("sensors/1/temp", ""))
+	traceHook.OnSessionEstablished(newClient("sensor-2"), packets.Packet{})
+	traceHook.OnRetainedExpired("sensors/1/temp")
+
+	records := logs(t, buf)
+	require.Len(t, records, 2)
+	require.Equal(t, "OnPublished", records[0]["event"])
+	require.Equal(t, "sensor-1", records[0]["client"])
+	require.Equal(t, "OnSessionEstablished", records[1]["event"])
+	require.Equal(t, "sensor-2", records[1]["client"])
+}
+
+func TestLevels(t *testing.T) {
+	buf := new(bytes.Buffer)
+	traceHook := new(Hook)
+	require.NoError(t, traceHook.Init(Options{
+		Level:  slog.LevelDebug,
+		Levels: map[string]slog.Level{"OnPublishDropped": slog.LevelWarn},
+		Logger: slog.New(slog.NewJSONHandler(buf, nil)),
+	}))
+	cl := newClient("device-1")
+
+	traceHook.OnClientExpired(cl)
+	traceHook.OnPublishDropped(cl, publish("a/b", ""))
+
+	records := logs(t, buf)
+	require.Len(t, records, 1)
+	require.Equal(t, "OnPublishDropped", records[0]["event"])
+	require.Equal(t, "WARN", records[0]["level"])
+}
+
+func TestPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		payload string
+		key     string
+		expect  string
+	}{
+		{
+			name:    "all",
+			options: Options{Payload: -1},
+			payload: "hello world",
+			key:     "payload",
+			expect:  "hello world",
+		},
+		{
+			name:    "truncated",
+			options: Options{Payload: 5},
+			payload: "hello world",
+			key:     "payload",
+			expect:  "hello...",
+		},
+		{
+			name:    "truncated rune",
+			options: Options{Payload: 4},
+			payload: "abc€",
+			key:     "payload",
+			expect:  "abc...",
+		},
+		{
+			name:    "binary",
+			options: Options{Payload: -1},
+			payload: "\xff\x00\x01",
+			key:     "payload_base64",
+			expect:  "/wAB",
+		},
+		{
+			name:    "redacted",
+			options: Options{Payload: -1, Redact: []string{"password", "location.lat", "missing.field"}},
+			payload: `{"location":{"lat":51.5,"lon":-0.1},"password":"secret","user":"a"}`,
+			key:     "payload",
+			expect:  `{"location":{"lat":"[redacted]","lon":-0.1},"password":"[redacted]","user":"a"}`,
+		},
+		{
+			name:    "redacted not json",
+			options: Options{Payload: -1, Redact: []string{"password"}},
+			payload: "password=secret",
+			key:     "payload",
+			expect:  "password=secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.options.Verbosity = VerbosityMessages
+			traceHook, buf := newHook(t, tt.options)
+
+			traceHook.OnPublished(newClient("device-1"), publish("a/b", tt.payload))
+
+			records := logs(t, buf)
+			require.Len(t, records, 1)
+			require.Equal(t, tt.expect, records[0][tt.key])
+		})
+	}
+}
@@ -0,0 +1,488 @@
+// Package cloudwatch provides a hook publishing the metrics of the broker to AWS CloudWatch, or writing
+// them as Embedded Metric Format (EMF) logs, eg. to stdout on ECS or EKS, which CloudWatch Logs
+// extracts the metrics from, so deployments integrate with existing dashboards and alarms.
+//
+// Metrics are published through a Client, which is a thin adapter of the CloudWatch client of the
+// application, eg. for aws-sdk-go-v2:
+//
+//	type client struct{ *cloudwatch.Client }
+//
+//	func (c client) PutMetricData(ctx context.Context, namespace string, data []mqttcw.Datum) error {
+//		in := &cloudwatch.PutMetricDataInput{Namespace: aws.String(namespace)}
+//		for _, d := range data {
+//			datum := types.MetricDatum{
+//				MetricName: aws.String(d.Name),
+//				Unit:       types.StandardUnit(d.Unit),
+//				Value:      aws.Float64(d.Value),
+//				Timestamp:  aws.Time(d.Timestamp),
+//			}
+//			for _, dim := range d.Dimensions {
+//				datum.Dimensions = append(datum.Dimensions, types.Dimension{Name: aws.String(dim.Name), Value: aws.String(dim.Value)})
+//			}
+//			in.MetricData = append(in.MetricData, datum)
+//		}
+//		_, err := c.Client.PutMetricData(ctx, in)
+//		return err
+//	}
+package cloudwatch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+)
+
+// maxBatch is the most metrics CloudWatch accepts at once
+const maxBatch = 1000
+
+// the names of the metrics
+const (
+	MetricConnections      = "Connections"      // count
+	MetricDisconnections   = "Disconnections"   // count
+	MetricMessagesReceived = "MessagesReceived" // count
+	MetricMessagesSent     = "MessagesSent"     // count
+	MetricMessagesDropped  = "MessagesDropped"  // count
+	MetricInflightDropped  = "InflightDropped"  // count
+	MetricSubscribes       = "Subscribes"       // count
+	MetricBytesReceived    = "BytesReceived"    // bytes
+	MetricBytesSent        = "BytesSent"        // bytes
+	MetricClientsConnected = "ClientsConnected" // count, of the server
+	MetricRetained         = "Retained"         // count, of the server
+	MetricSubscriptions    = "Subscriptions"    // count, of the server
+	MetricInflight         = "Inflight"         // count, of the server
+)
+
+// the units of the metrics
+const (
+	UnitCount = "Count"
+	UnitBytes = "Bytes"
+)
+
+// counters are the metrics counted for each listener, in the order they are published
+var counters = []string{
+	MetricConnections,
+	MetricDisconnections,
+	MetricMessagesReceived,
+	MetricMessagesSent,
+	MetricMessagesDropped,
+	MetricInflightDropped,
+	MetricSubscribes,
+	MetricBytesReceived,
+	MetricBytesSent,
+}
+
+// Datum is the value of a metric over an interval
+type Datum struct {
+	Name       string
+	Unit       string // UnitCount or UnitBytes
+	Value      float64
+	Dimensions []Dimension
+	Timestamp  time.Time
+}
+
+// Dimension is a dimension of a metric
+type Dimension struct {
+	Name  string
+	Value string
+}
+
+// Client publishes metrics to CloudWatch, usually a thin adapter of a CloudWatch client
+type Client interface {
+	// PutMetricData publishes the metrics to the namespace
+	PutMetricData(ctx context.Context, namespace string, data []Datum) error
+}
+
+// Stats are the totals of the metrics published since the hook was initialized
+type Stats struct {
+	Published int64 // the number of metrics published or written
+	Failed    int64 // the number of metrics which could not be published or written
+}
+
+// Hook is a hook that publishes the metrics of the broker to CloudWatch
+type Hook struct {
+	config     Options
+	dimensions []Dimension                 // the constant dimensions, sorted by name
+	counts     map[string]map[string]int64 // the counters of each listener over the interval
+	gauges     map[string]int64            // the gauges of the server, once ticked
+	stats      Stats
+	done       chan struct{}
+	wg         sync.WaitGroup // the flusher
+	mu         sync.Mutex     // guards counts and gauges
+	statsMu    sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the cloudwatch hook
+type Options struct {
+	// Client publishes the metrics to CloudWatch, and Writer is written EMF logs of them, one JSON
+	// object per line. At least one is required
+	Client Client
+	Writer io.Writer
+
+	// Namespace is the CloudWatch namespace of the metrics, and defaults to MQTT
+	Namespace string
+
+	// Dimensions are added to each metric, eg. the cluster and service, and Listener adds the
+	// listener of the clients to their metrics. Each combination of dimensions is a separate metric
+	Dimensions map[string]string
+	Listener   bool
+
+	Interval time.Duration // how often metrics are published, defaults to 60 seconds
+	Timeout  time.Duration // how long publishing the metrics may take, defaults to 10 seconds
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "cloudwatch-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSysInfoTick,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnPacketRead,
+		mqtt.OnPacketSent,
+		mqtt.OnPublished,
+		mqtt.OnPublishDropped,
+		mqtt.OnQosDropped,
+		mqtt.OnSubscribed,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts publishing metrics
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	cloudwatchHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if cloudwatchHookConfig.Client == nil && cloudwatchHookConfig.Writer == nil {
+		return errors.New("client or writer is required")
+	}
+
+	if cloudwatchHookConfig.Namespace == "" {
+		cloudwatchHookConfig.Namespace = "MQTT"
+	}
+
+	if cloudwatchHookConfig.Interval <= 0 {
+		cloudwatchHookConfig.Interval = time.Minute
+	}
+
+	if cloudwatchHookConfig.Timeout <= 0 {
+		cloudwatchHookConfig.Timeout = 10 * time.Second
+	}
+
+	h.config = cloudwatchHookConfig
+	h.dimensions = nil
+	for name, value := range cloudwatchHookConfig.Dimensions {
+		h.dimensions = append(h.dimensions, Dimension{Name: name, Value: value})
+	}
+	sort.Slice(h.dimensions, func(i, j int) bool {
+		return h.dimensions[i].Name < h.dimensions[j].Name
+	})
+	h.counts = make(map[string]map[string]int64)
+	h.gauges = nil
+	h.done = make(chan struct{})
+
+	h.wg.Add(1)
+	go h.flusher()
+
+	return nil
+}
+
+// Stop publishes the metrics of the current interval
+func (h *Hook) Stop() error {
+	if h.done == nil {
+		return nil
+	}
+
+	select {
+	case <-h.done:
+		return nil
+	default:
+	}
+
+	close(h.done)
+	h.wg.Wait()
+	h.flush(time.Now())
+	return nil
+}
+
+// Stats returns the totals of the metrics published so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// flusher publishes the metrics every Interval until the hook stops
+func (h *Hook) flusher() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			h.flush(now)
+		}
+	}
+}
+
+// flush publishes the metrics of the interval, and starts the next
+func (h *Hook) flush(now time.Time) {
+	data := h.collect(now)
+	if len(data) == 0 {
+		return
+	}
+
+	if h.config.Client != nil {
+		for i := 0; i < len(data); i += maxBatch {
+			h.put(data[i:min(i+maxBatch, len(data))])
+		}
+	}
+
+	if h.config.Writer != nil {
+		h.writeEMF(data)
+	}
+}
+
+// collect returns the metrics of the interval, and resets the counters. Listeners which have been seen
+// keep being published, so their metrics are zero rather than missing when they are idle
+func (h *Hook) collect(now time.Time) []Datum {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	listeners := make([]string, 0, len(h.counts))
+	for listener := range h.counts {
+		listeners = append(listeners, listener)
+	}
+	sort.Strings(listeners)
+
+	var data []Datum
+	for _, listener := range listeners {
+		dimensions := h.dimensions
+		if h.config.Listener {
+			dimensions = append([]Dimension{{Name: "Listener", Value: listener}}, h.dimensions...)
+		}
+
+		counts := h.counts[listener]
+		for _, name := range counters {
+			unit := UnitCount
+			if name == MetricBytesReceived || name == MetricBytesSent {
+				unit = UnitBytes
+			}
+			data = append(data, Datum{Name: name, Unit: unit, Value: float64(counts[name]), Dimensions: dimensions, Timestamp: now})
+			counts[name] = 0
+		}
+	}
+
+	if h.gauges != nil {
+		for _, name := range []string{MetricClientsConnected, MetricRetained, MetricSubscriptions, MetricInflight} {
+			data = append(data, Datum{Name: name, Unit: UnitCount, Value: float64(h.gauges[name]), Dimensions: h.dimensions, Timestamp: now})
+		}
+	}
+
+	return data
+}
+
+// put publishes a batch of metrics
+func (h *Hook) put(data []Datum) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	err := h.config.Client.PutMetricData(ctx, h.config.Namespace, data)
+	if err != nil {
+		h.Log.Error("error occurred while publishing cloudwatch metrics", "error", err, "metrics", len(data))
+	}
+	h.count(int64(len(data)), err)
+}
+
+// writeEMF writes the metrics as EMF logs, one for each combination of dimensions
+func (h *Hook) writeEMF(data []Datum) {
+	var logs [][]Datum
+	for i, d := range data {
+		if i == 0 || !sameDimensions(d.Dimensions, data[i-1].Dimensions) {
+			logs = append(logs, nil)
+		}
+		logs[len(logs)-1] = append(logs[len(logs)-1], d)
+	}
+
+	for _, data := range logs {
+		b, err := emf(h.config.Namespace, data)
+		if err == nil {
+			_, err = h.config.Writer.Write(append(b, '\n'))
+		}
+		if err != nil {
+			h.Log.Error("error occurred while writing cloudwatch emf log", "error", err, "metrics", len(data))
+		}
+		h.count(int64(len(data)), err)
+	}
+}
+
+// count counts the metrics which were published, or failed
+func (h *Hook) count(n int64, err error) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+
+	if err != nil {
+		h.stats.Failed += n
+	} else {
+		h.stats.Published += n
+	}
+}
+
+// emf returns the EMF log of the metrics, which all have the same dimensions and timestamp
+func emf(namespace string, data []Datum) ([]byte, error) {
+	type metric struct {
+		Name string `json:"Name"`
+		Unit string `json:"Unit"`
+	}
+
+	type directive struct {
+		Namespace  string     `json:"Namespace"`
+		Dimensions [][]string `json:"Dimensions"`
+		Metrics    []metric   `json:"Metrics"`
+	}
+
+	d := directive{Namespace: namespace, Dimensions: [][]string{{}}}
+	fields := make(map[string]any, len(data)+len(data[0].Dimensions)+1)
+	for _, dim := range data[0].Dimensions {
+		d.Dimensions[0] = append(d.Dimensions[0], dim.Name)
+		fields[dim.Name] = dim.Value
+	}
+
+	for _, datum := range data {
+		d.Metrics = append(d.Metrics, metric{Name: datum.Name, Unit: datum.Unit})
+		fields[datum.Name] = datum.Value
+	}
+
+	fields["_aws"] = map[string]any{
+		"Timestamp":         data[0].Timestamp.UnixMilli(),
+		"CloudWatchMetrics": []directive{d},
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling emf log: %w", err)
+	}
+	return b, nil
+}
+
+// sameDimensions returns whether the dimensions are the same
+func sameDimensions(a, b []Dimension) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds n to the counter of the listener of the client
+func (h *Hook) add(cl *mqtt.Client, name string, n int64) {
+	listener := ""
+	if h.config.Listener {
+		listener = cl.Net.Listener
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts, ok := h.counts[listener]
+	if !ok {
+		counts = make(map[string]int64, len(counters))
+		h.counts[listener] = counts
+	}
+	counts[name] += n
+}
+
+// OnSysInfoTick is called when the $SYS topic values are published, and sets the gauges of the server
+func (h *Hook) OnSysInfoTick(info *system.Info) {
+	gauges := map[string]int64{
+		MetricClientsConnected: atomic.LoadInt64(&info.ClientsConnected),
+		MetricRetained:         atomic.LoadInt64(&info.Retained),
+		MetricSubscriptions:    atomic.LoadInt64(&info.Subscriptions),
+		MetricInflight:         atomic.LoadInt64(&info.Inflight),
+	}
+
+	h.mu.Lock()
+	h.gauges = gauges
+	h.mu.Unlock()
+}
+
+// OnSessionEstablished is called when a client has connected and authenticated
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.add(cl, MetricConnections, 1)
+}
+
+// OnDisconnect is called when a client which had connected disconnects
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.add(cl, MetricDisconnections, 1)
+}
+
+// OnPacketRead is called when a packet is received from a client, and counts its bytes
+func (h *Hook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	h.add(cl, MetricBytesReceived, int64(size(pk.FixedHeader.Remaining)))
+	return pk, nil
+}
+
+// OnPacketSent is called when a packet has been written to a client
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if pk.FixedHeader.Type == packets.Publish {
+		h.add(cl, MetricMessagesSent, 1)
+	}
+	h.add(cl, MetricBytesSent, int64(len(b)))
+}
+
+// OnPublished is called when a client has published a message
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.add(cl, MetricMessagesReceived, 1)
+}
+
+// OnPublishDropped is called when a message to a client is dropped, as the client is too slow
+func (h *Hook) OnPublishDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.add(cl, MetricMessagesDropped, 1)
+}
+
+// OnQosDropped is called when an inflight message to a client is dropped
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.add(cl, MetricInflightDropped, 1)
+}
+
+// OnSubscribed is called when a client has subscribed to filters
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	h.add(cl, MetricSubscribes, int64(len(pk.Filters)))
+}
+
+// size returns the size of a packet with the remaining length, including its fixed header
+func size(remaining int) int {
+	n := 2 // the type and flags, and the first byte of the remaining length
+	for r := remaining; r >= 128; r /= 128 {
+		n++
+	}
+	return n + remaining
+}
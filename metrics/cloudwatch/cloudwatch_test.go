@@ -0,0 +1,270 @@
+package cloudwatch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient records the metrics it is given
+type fakeClient struct {
+	namespace string
+	data      []Datum
+	err       error
+	mu        sync.Mutex
+}
+
+func (c *fakeClient) PutMetricData(ctx context.Context, namespace string, data []Datum) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	c.namespace = namespace
+	c.data = append(c.data, data...)
+	return nil
+}
+
+// values returns the values of the metrics, by name and the value of their first dimension
+func (c *fakeClient) values() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make(map[string]float64)
+	for _, d := range c.data {
+		key := d.Name
+		if len(d.Dimensions) > 0 {
+			key += "/" + d.Dimensions[0].Value
+		}
+		values[key] = d.Value
+	}
+	return values
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	cloudwatchHook := new(Hook)
+	cloudwatchHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, cloudwatchHook.Init(options))
+	t.Cleanup(func() { cloudwatchHook.Stop() })
+	return cloudwatchHook
+}
+
+func newClient(listener string) *mqtt.Client {
+	return mqtt.New(nil).NewClient(nil, listener, "c1", false)
+}
+
+func TestID(t *testing.T) {
+	cloudwatchHook := new(Hook)
+
+	require.Equal(t, "cloudwatch-hook", cloudwatchHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	cloudwatchHook := new(Hook)
+
+	require.True(t, cloudwatchHook.Provides(mqtt.OnPublished))
+	require.True(t, cloudwatchHook.Provides(mqtt.OnSysInfoTick))
+	require.False(t, cloudwatchHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - client",
+			config:      Options{Client: new(fakeClient)},
+			expectError: false,
+		},
+		{
+			name:        "Success - writer",
+			config:      Options{Writer: new(bytes.Buffer), Dimensions: map[string]string{"Cluster": "c1"}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no client or writer",
+			config:      Options{},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cloudwatchHook := new(Hook)
+			cloudwatchHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := cloudwatchHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "MQTT", cloudwatchHook.config.Namespace)
+				require.Equal(t, time.Minute, cloudwatchHook.config.Interval)
+				require.Equal(t, 10*time.Second, cloudwatchHook.config.Timeout)
+				require.NoError(t, cloudwatchHook.Stop())
+				require.NoError(t, cloudwatchHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestPutMetricData(t *testing.T) {
+	client := new(fakeClient)
+	cloudwatchHook := newHook(t, Options{
+		Client:     client,
+		Namespace:  "Broker",
+		Dimensions: map[string]string{"Service": "mqtt", "Cluster": "prod"},
+		Listener:   true,
+		Interval:   time.Hour,
+	})
+
+	t1, ws := newClient("t1"), newClient("ws")
+	cloudwatchHook.OnSessionEstablished(t1, packets.Packet{})
+	cloudwatchHook.OnSessionEstablished(ws, packets.Packet{})
+	cloudwatchHook.OnPacketRead(t1, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Remaining: 200}})
+	cloudwatchHook.OnPublished(t1, packets.Packet{})
+	cloudwatchHook.OnPacketSent(ws, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}}, make([]byte, 10))
+	cloudwatchHook.OnSubscribed(ws, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}, {Filter: "b"}}}, nil)
+	cloudwatchHook.OnPublishDropped(ws, packets.Packet{})
+	cloudwatchHook.OnQosDropped(ws, packets.Packet{})
+	cloudwatchHook.OnDisconnect(t1, nil, false)
+	cloudwatchHook.OnSysInfoTick(&system.Info{ClientsConnected: 1, Retained: 4})
+
+	now := time.Now()
+	cloudwatchHook.flush(now)
+
+	require.Equal(t, "Broker", client.namespace)
+	require.Len(t, client.data, 2*len(counters)+4)
+	require.Equal(t, Datum{
+		Name:  MetricConnections,
+		Unit:  UnitCount,
+		Value: 1,
+		Dimensions: []Dimension{
+			{Name: "Listener", Value: "t1"},
+			{Name: "Cluster", Value: "prod"},
+			{Name: "Service", Value: "mqtt"},
+		},
+		Timestamp: now,
+	}, client.data[0])
+
+	values := client.values()
+	require.Equal(t, 1.0, values["Connections/ws"])
+	require.Equal(t, 1.0, values["Disconnections/t1"])
+	require.Equal(t, 0.0, values["Disconnections/ws"])
+	require.Equal(t, 1.0, values["MessagesReceived/t1"])
+	require.Equal(t, 1.0, values["MessagesSent/ws"])
+	require.Equal(t, 203.0, values["BytesReceived/t1"])
+	require.Equal(t, 10.0, values["BytesSent/ws"])
+	require.Equal(t, 2.0, values["Subscribes/ws"])
+	require.Equal(t, 1.0, values["MessagesDropped/ws"])
+	require.Equal(t, 1.0, values["InflightDropped/ws"])
+	require.Equal(t, 1.0, values["ClientsConnected/prod"])
+	require.Equal(t, 4.0, values["Retained/prod"])
+	require.Equal(t, UnitBytes, client.data[7].Unit)
+
+	// the counters start over each interval, and idle listeners are zero
+	cloudwatchHook.OnPublished(t1, packets.Packet{})
+	client.data = nil
+	cloudwatchHook.flush(now)
+	values = client.values()
+	require.Equal(t, 1.0, values["MessagesReceived/t1"])
+	require.Equal(t, 0.0, values["Connections/t1"])
+	require.Equal(t, 0.0, values["Connections/ws"])
+	require.Equal(t, Stats{Published: 2 * int64(2*len(counters)+4)}, cloudwatchHook.Stats())
+}
+
+func TestPutMetricDataFailed(t *testing.T) {
+	client := &fakeClient{err: errors.New("throttled")}
+	cloudwatchHook := newHook(t, Options{Client: client, Interval: time.Hour})
+
+	cloudwatchHook.OnPublished(newClient("t1"), packets.Packet{})
+	cloudwatchHook.flush(time.Now())
+	require.Equal(t, Stats{Failed: int64(len(counters))}, cloudwatchHook.Stats())
+}
+
+func TestEMF(t *testing.T) {
+	buf := new(bytes.Buffer)
+	cloudwatchHook := newHook(t, Options{
+		Writer:     buf,
+		Dimensions: map[string]string{"Cluster": "prod"},
+		Listener:   true,
+		Interval:   time.Hour,
+	})
+
+	cloudwatchHook.OnSessionEstablished(newClient("t1"), packets.Packet{})
+	cloudwatchHook.OnSysInfoTick(&system.Info{ClientsConnected: 1})
+	cloudwatchHook.flush(time.UnixMilli(1700000000000))
+
+	// a log is written for the listener, and for the server
+	logs := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, logs, 2)
+
+	var log map[string]any
+	require.NoError(t, json.Unmarshal([]byte(logs[0]), &log))
+	require.Equal(t, "t1", log["Listener"])
+	require.Equal(t, "prod", log["Cluster"])
+	require.Equal(t, 1.0, log["Connections"])
+	require.Equal(t, 0.0, log["BytesSent"])
+
+	aws := log["_aws"].(map[string]any)
+	require.Equal(t, 1700000000000.0, aws["Timestamp"])
+	directive := aws["CloudWatchMetrics"].([]any)[0].(map[string]any)
+	require.Equal(t, "MQTT", directive["Namespace"])
+	require.Equal(t, []any{[]any{"Listener", "Cluster"}}, directive["Dimensions"])
+	require.Len(t, directive["Metrics"], len(counters))
+	require.Equal(t, map[string]any{"Name": "BytesSent", "Unit": "Bytes"}, directive["Metrics"].([]any)[len(counters)-1])
+
+	log = nil
+	require.NoError(t, json.Unmarshal([]byte(logs[1]), &log))
+	require.Equal(t, 1.0, log["ClientsConnected"])
+	require.Nil(t, log["Listener"])
+	require.Equal(t, Stats{Published: int64(len(counters) + 4)}, cloudwatchHook.Stats())
+}
+
+func TestInterval(t *testing.T) {
+	client := new(fakeClient)
+	cloudwatchHook := newHook(t, Options{Client: client, Interval: 10 * time.Millisecond})
+
+	cloudwatchHook.OnPublished(newClient("t1"), packets.Packet{})
+	require.Eventually(t, func() bool {
+		return client.values()[MetricMessagesReceived] == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestStop(t *testing.T) {
+	client := new(fakeClient)
+	cloudwatchHook := newHook(t, Options{Client: client, Interval: time.Hour})
+
+	// the metrics of the current interval are published when the hook stops
+	cloudwatchHook.OnPublished(newClient("t1"), packets.Packet{})
+	require.NoError(t, cloudwatchHook.Stop())
+	require.Equal(t, 1.0, client.values()[MetricMessagesReceived])
+}
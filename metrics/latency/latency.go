@@ -0,0 +1,528 @@
+// Package latency provides a decorator recording how long the callbacks of hooks take, how many
+// errors they return, and how often they exceed a timeout, to find which hook is slowing down the
+// publish path. Any hook can be wrapped, eg.
+//
+//	recorder, err := latency.New(latency.Options{Timeout: 50 * time.Millisecond})
+//	err = server.AddHook(recorder.Wrap(new(kafka.Hook)), kafka.Options{...})
+//
+// The recorder is a prometheus.Collector, so the recordings are exported through the prometheus hook
+// by adding the recorder to its Collectors, and through the $SYS topics by setting Latencies as the
+// Latencies of the sys hook.
+package latency
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// names are the names of the callbacks which are recorded
+var names = map[byte]string{
+	mqtt.OnSysInfoTick:          "OnSysInfoTick",
+	mqtt.OnStarted:              "OnStarted",
+	mqtt.OnStopped:              "OnStopped",
+	mqtt.OnConnectAuthenticate:  "OnConnectAuthenticate",
+	mqtt.OnACLCheck:             "OnACLCheck",
+	mqtt.OnConnect:              "OnConnect",
+	mqtt.OnSessionEstablish:     "OnSessionEstablish",
+	mqtt.OnSessionEstablished:   "OnSessionEstablished",
+	mqtt.OnDisconnect:           "OnDisconnect",
+	mqtt.OnAuthPacket:           "OnAuthPacket",
+	mqtt.OnPacketRead:           "OnPacketRead",
+	mqtt.OnPacketEncode:         "OnPacketEncode",
+	mqtt.OnPacketSent:           "OnPacketSent",
+	mqtt.OnPacketProcessed:      "OnPacketProcessed",
+	mqtt.OnSubscribe:            "OnSubscribe",
+	mqtt.OnSubscribed:           "OnSubscribed",
+	mqtt.OnSelectSubscribers:    "OnSelectSubscribers",
+	mqtt.OnUnsubscribe:          "OnUnsubscribe",
+	mqtt.OnUnsubscribed:         "OnUnsubscribed",
+	mqtt.OnPublish:              "OnPublish",
+	mqtt.OnPublished:            "OnPublished",
+	mqtt.OnPublishDropped:       "OnPublishDropped",
+	mqtt.OnRetainMessage:        "OnRetainMessage",
+	mqtt.OnRetainPublished:      "OnRetainPublished",
+	mqtt.OnQosPublish:           "OnQosPublish",
+	mqtt.OnQosComplete:          "OnQosComplete",
+	mqtt.OnQosDropped:           "OnQosDropped",
+	mqtt.OnPacketIDExhausted:    "OnPacketIDExhausted",
+	mqtt.OnWill:                 "OnWill",
+	mqtt.OnWillSent:             "OnWillSent",
+	mqtt.OnClientExpired:        "OnClientExpired",
+	mqtt.OnRetainedExpired:      "OnRetainedExpired",
+	mqtt.StoredClients:          "StoredClients",
+	mqtt.StoredSubscriptions:    "StoredSubscriptions",
+	mqtt.StoredInflightMessages: "StoredInflightMessages",
+	mqtt.StoredRetainedMessages: "StoredRetainedMessages",
+	mqtt.StoredSysInfo:          "StoredSysInfo",
+}
+
+// metrics are the Prometheus metrics of the recordings of a callback, in the order of their values
+var metrics = []struct {
+	name string
+	help string
+	typ  prometheus.ValueType
+}{
+	{"calls_total", "The number of calls of the callbacks of hooks.", prometheus.CounterValue},
+	{"errors_total", "The number of calls of the callbacks of hooks which returned an error.", prometheus.CounterValue},
+	{"timeouts_total", "The number of calls of the callbacks of hooks which took longer than the timeout.", prometheus.CounterValue},
+	{"duration_seconds_total", "The time the callbacks of hooks took.", prometheus.CounterValue},
+	{"duration_seconds_max", "The longest time a call of the callbacks of hooks took.", prometheus.GaugeValue},
+}
+
+// callbacks is the number of callbacks, which are indexed by their bytes
+const callbacks = int(mqtt.StoredSysInfo) + 1
+
+// Stat is the recording of a callback of a hook
+type Stat struct {
+	Hook     string // the id of the hook
+	Callback string // the name of the callback, eg. OnPublish
+	Calls    int64
+	Errors   int64 // the number of calls which returned an error
+	Timeouts int64 // the number of calls which took longer than the timeout
+	Total    time.Duration
+	Max      time.Duration
+}
+
+// counters are the counters of a callback of a hook
+type counters struct {
+	calls    atomic.Int64
+	errors   atomic.Int64
+	timeouts atomic.Int64
+	total    atomic.Int64
+	max      atomic.Int64
+}
+
+// Options is a struct that contains all the information required to configure the recorder
+type Options struct {
+	// Timeout is how long a callback may take before it is counted as a timeout, and defaults to 100
+	// milliseconds. Timeouts overrides it for callbacks, by their names, eg. {"OnPublish": time.Millisecond}.
+	// Callbacks aren't interrupted when they time out
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+
+	// Namespace starts the names of the Prometheus metrics, and defaults to mqtt, eg.
+	// mqtt_hook_calls_total
+	Namespace string
+}
+
+// Recorder records the callbacks of the hooks it wraps
+type Recorder struct {
+	options  Options
+	timeouts [callbacks]time.Duration
+	descs    []*prometheus.Desc // of the metrics
+	hooks    []*Hook
+	mu       sync.RWMutex // guards hooks
+}
+
+// New returns a recorder with the options
+func New(options Options) (*Recorder, error) {
+	if options.Timeout <= 0 {
+		options.Timeout = 100 * time.Millisecond
+	}
+
+	if options.Namespace == "" {
+		options.Namespace = "mqtt"
+	}
+
+	r := &Recorder{options: options}
+	for i := range r.timeouts {
+		r.timeouts[i] = options.Timeout
+	}
+
+	for name, timeout := range options.Timeouts {
+		b, ok := callback(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown callback %q", name)
+		}
+
+		if timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %s of %s", timeout, name)
+		}
+		r.timeouts[b] = timeout
+	}
+
+	for _, m := range metrics {
+		r.descs = append(r.descs, prometheus.NewDesc(options.Namespace+"_hook_"+m.name, m.help, []string{"hook", "callback"}, nil))
+	}
+
+	return r, nil
+}
+
+// callback returns the byte of the named callback
+func callback(name string) (byte, bool) {
+	for b, n := range names {
+		if n == name {
+			return b, true
+		}
+	}
+	return 0, false
+}
+
+// Wrap returns the hook wrapped to record its callbacks, to add to the server in place of the hook
+func (r *Recorder) Wrap(hook mqtt.Hook) *Hook {
+	h := &Hook{Hook: hook, recorder: r}
+
+	r.mu.Lock()
+	r.hooks = append(r.hooks, h)
+	r.mu.Unlock()
+
+	return h
+}
+
+// Stats returns the recordings of the callbacks which were called, by hook and callback
+func (r *Recorder) Stats() []Stat {
+	r.mu.RLock()
+	hooks := r.hooks
+	r.mu.RUnlock()
+
+	var stats []Stat
+	for _, h := range hooks {
+		id := h.ID()
+		for b := range h.counters {
+			c := &h.counters[b]
+			calls := c.calls.Load()
+			if calls == 0 {
+				continue
+			}
+
+			stats = append(stats, Stat{
+				Hook:     id,
+				Callback: names[byte(b)],
+				Calls:    calls,
+				Errors:   c.errors.Load(),
+				Timeouts: c.timeouts.Load(),
+				Total:    time.Duration(c.total.Load()),
+				Max:      time.Duration(c.max.Load()),
+			})
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Hook != stats[j].Hook {
+			return stats[i].Hook < stats[j].Hook
+		}
+		return stats[i].Callback < stats[j].Callback
+	})
+	return stats
+}
+
+// Latencies returns the mean time the callbacks of each hook took, by the ids of the hooks, eg. to
+// set as the Latencies of the sys hook
+func (r *Recorder) Latencies() map[string]time.Duration {
+	calls := make(map[string]int64)
+	totals := make(map[string]time.Duration)
+	for _, s := range r.Stats() {
+		calls[s.Hook] += s.Calls
+		totals[s.Hook] += s.Total
+	}
+
+	latencies := make(map[string]time.Duration, len(calls))
+	for id, n := range calls {
+		latencies[id] = totals[id] / time.Duration(n)
+	}
+	return latencies
+}
+
+// Describe sends the descriptors of the Prometheus metrics of the recordings, as a prometheus.Collector
+func (r *Recorder) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range r.descs {
+		ch <- d
+	}
+}
+
+// Collect sends the recordings as Prometheus metrics, as a prometheus.Collector, eg. added to the
+// Collectors of the prometheus hook
+func (r *Recorder) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range r.Stats() {
+		values := []float64{float64(s.Calls), float64(s.Errors), float64(s.Timeouts), s.Total.Seconds(), s.Max.Seconds()}
+		for i, v := range values {
+			ch <- prometheus.MustNewConstMetric(r.descs[i], metrics[i].typ, v, s.Hook, s.Callback)
+		}
+	}
+}
+
+// Hook is a hook whose callbacks are recorded. Its other methods are those of the hook it wraps
+type Hook struct {
+	mqtt.Hook
+	recorder *Recorder
+	counters [callbacks]counters
+}
+
+// Unwrap returns the hook which is wrapped
+func (h *Hook) Unwrap() mqtt.Hook {
+	return h.Hook
+}
+
+// observe records a call of the callback which started at start
+func (h *Hook) observe(b byte, start time.Time, err error) {
+	d := time.Since(start)
+	c := &h.counters[b]
+	c.calls.Add(1)
+	c.total.Add(int64(d))
+
+	for {
+		max := c.max.Load()
+		if int64(d) <= max || c.max.CompareAndSwap(max, int64(d)) {
+			break
+		}
+	}
+
+	if err != nil {
+		c.errors.Add(1)
+	}
+
+	if d > h.recorder.timeouts[b] {
+		c.timeouts.Add(1)
+	}
+}
+
+// OnSysInfoTick calls the OnSysInfoTick of the hook
+func (h *Hook) OnSysInfoTick(info *system.Info) {
+	defer h.observe(mqtt.OnSysInfoTick, time.Now(), nil)
+	h.Hook.OnSysInfoTick(info)
+}
+
+// OnStarted calls the OnStarted of the hook
+func (h *Hook) OnStarted() {
+	defer h.observe(mqtt.OnStarted, time.Now(), nil)
+	h.Hook.OnStarted()
+}
+
+// OnStopped calls the OnStopped of the hook
+func (h *Hook) OnStopped() {
+	defer h.observe(mqtt.OnStopped, time.Now(), nil)
+	h.Hook.OnStopped()
+}
+
+// OnConnectAuthenticate calls the OnConnectAuthenticate of the hook
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	defer h.observe(mqtt.OnConnectAuthenticate, time.Now(), nil)
+	return h.Hook.OnConnectAuthenticate(cl, pk)
+}
+
+// OnACLCheck calls the OnACLCheck of the hook
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	defer h.observe(mqtt.OnACLCheck, time.Now(), nil)
+	return h.Hook.OnACLCheck(cl, topic, write)
+}
+
+// OnConnect calls the OnConnect of the hook
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	start := time.Now()
+	err := h.Hook.OnConnect(cl, pk)
+	h.observe(mqtt.OnConnect, start, err)
+	return err
+}
+
+// OnSessionEstablish calls the OnSessionEstablish of the hook
+func (h *Hook) OnSessionEstablish(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnSessionEstablish, time.Now(), nil)
+	h.Hook.OnSessionEstablish(cl, pk)
+}
+
+// OnSessionEstablished calls the OnSessionEstablished of the hook
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnSessionEstablished, time.Now(), nil)
+	h.Hook.OnSessionEstablished(cl, pk)
+}
+
+// OnDisconnect calls the OnDisconnect of the hook
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	defer h.observe(mqtt.OnDisconnect, time.Now(), nil)
+	h.Hook.OnDisconnect(cl, err, expire)
+}
+
+// OnAuthPacket calls the OnAuthPacket of the hook
+func (h *Hook) OnAuthPacket(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	start := time.Now()
+	pk, err := h.Hook.OnAuthPacket(cl, pk)
+	h.observe(mqtt.OnAuthPacket, start, err)
+	return pk, err
+}
+
+// OnPacketRead calls the OnPacketRead of the hook
+func (h *Hook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	start := time.Now()
+	pk, err := h.Hook.OnPacketRead(cl, pk)
+	h.observe(mqtt.OnPacketRead, start, err)
+	return pk, err
+}
+
+// OnPacketEncode calls the OnPacketEncode of the hook
+func (h *Hook) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	defer h.observe(mqtt.OnPacketEncode, time.Now(), nil)
+	return h.Hook.OnPacketEncode(cl, pk)
+}
+
+// OnPacketSent calls the OnPacketSent of the hook
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	defer h.observe(mqtt.OnPacketSent, time.Now(), nil)
+	h.Hook.OnPacketSent(cl, pk, b)
+}
+
+// OnPacketProcessed calls the OnPacketProcessed of the hook
+func (h *Hook) OnPacketProcessed(cl *mqtt.Client, pk packets.Packet, err error) {
+	defer h.observe(mqtt.OnPacketProcessed, time.Now(), nil)
+	h.Hook.OnPacketProcessed(cl, pk, err)
+}
+
+// OnSubscribe calls the OnSubscribe of the hook
+func (h *Hook) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	defer h.observe(mqtt.OnSubscribe, time.Now(), nil)
+	return h.Hook.OnSubscribe(cl, pk)
+}
+
+// OnSubscribed calls the OnSubscribed of the hook
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	defer h.observe(mqtt.OnSubscribed, time.Now(), nil)
+	h.Hook.OnSubscribed(cl, pk, reasonCodes)
+}
+
+// OnSelectSubscribers calls the OnSelectSubscribers of the hook
+func (h *Hook) OnSelectSubscribers(subs *mqtt.Subscribers, pk packets.Packet) *mqtt.Subscribers {
+	defer h.observe(mqtt.OnSelectSubscribers, time.Now(), nil)
+	return h.Hook.OnSelectSubscribers(subs, pk)
+}
+
+// OnUnsubscribe calls the OnUnsubscribe of the hook
+func (h *Hook) OnUnsubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	defer h.observe(mqtt.OnUnsubscribe, time.Now(), nil)
+	return h.Hook.OnUnsubscribe(cl, pk)
+}
+
+// OnUnsubscribed calls the OnUnsubscribed of the hook
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnUnsubscribed, time.Now(), nil)
+	h.Hook.OnUnsubscribed(cl, pk)
+}
+
+// OnPublish calls the OnPublish of the hook
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	start := time.Now()
+	pk, err := h.Hook.OnPublish(cl, pk)
+	h.observe(mqtt.OnPublish, start, err)
+	return pk, err
+}
+
+// OnPublished calls the OnPublished of the hook
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnPublished, time.Now(), nil)
+	h.Hook.OnPublished(cl, pk)
+}
+
+// OnPublishDropped calls the OnPublishDropped of the hook
+func (h *Hook) OnPublishDropped(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnPublishDropped, time.Now(), nil)
+	h.Hook.OnPublishDropped(cl, pk)
+}
+
+// OnRetainMessage calls the OnRetainMessage of the hook
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	defer h.observe(mqtt.OnRetainMessage, time.Now(), nil)
+	h.Hook.OnRetainMessage(cl, pk, r)
+}
+
+// OnRetainPublished calls the OnRetainPublished of the hook
+func (h *Hook) OnRetainPublished(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnRetainPublished, time.Now(), nil)
+	h.Hook.OnRetainPublished(cl, pk)
+}
+
+// OnQosPublish calls the OnQosPublish of the hook
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	defer h.observe(mqtt.OnQosPublish, time.Now(), nil)
+	h.Hook.OnQosPublish(cl, pk, sent, resends)
+}
+
+// OnQosComplete calls the OnQosComplete of the hook
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnQosComplete, time.Now(), nil)
+	h.Hook.OnQosComplete(cl, pk)
+}
+
+// OnQosDropped calls the OnQosDropped of the hook
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnQosDropped, time.Now(), nil)
+	h.Hook.OnQosDropped(cl, pk)
+}
+
+// OnPacketIDExhausted calls the OnPacketIDExhausted of the hook
+func (h *Hook) OnPacketIDExhausted(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnPacketIDExhausted, time.Now(), nil)
+	h.Hook.OnPacketIDExhausted(cl, pk)
+}
+
+// OnWill calls the OnWill of the hook
+func (h *Hook) OnWill(cl *mqtt.Client, will mqtt.Will) (mqtt.Will, error) {
+	start := time.Now()
+	will, err := h.Hook.OnWill(cl, will)
+	h.observe(mqtt.OnWill, start, err)
+	return will, err
+}
+
+// OnWillSent calls the OnWillSent of the hook
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	defer h.observe(mqtt.OnWillSent, time.Now(), nil)
+	h.Hook.OnWillSent(cl, pk)
+}
+
+// OnClientExpired calls the OnClientExpired of the hook
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	defer h.observe(mqtt.OnClientExpired, time.Now(), nil)
+	h.Hook.OnClientExpired(cl)
+}
+
+// OnRetainedExpired calls the OnRetainedExpired of the hook
+func (h *Hook) OnRetainedExpired(filter string) {
+	defer h.observe(mqtt.OnRetainedExpired, time.Now(), nil)
+	h.Hook.OnRetainedExpired(filter)
+}
+
+// StoredClients calls the StoredClients of the hook
+func (h *Hook) StoredClients() ([]storage.Client, error) {
+	start := time.Now()
+	v, err := h.Hook.StoredClients()
+	h.observe(mqtt.StoredClients, start, err)
+	return v, err
+}
+
+// StoredSubscriptions calls the StoredSubscriptions of the hook
+func (h *Hook) StoredSubscriptions() ([]storage.Subscription, error) {
+	start := time.Now()
+	v, err := h.Hook.StoredSubscriptions()
+	h.observe(mqtt.StoredSubscriptions, start, err)
+	return v, err
+}
+
+// StoredInflightMessages calls the StoredInflightMessages of the hook
+func (h *Hook) StoredInflightMessages() ([]storage.Message, error) {
+	start := time.Now()
+	v, err := h.Hook.StoredInflightMessages()
+	h.observe(mqtt.StoredInflightMessages, start, err)
+	return v, err
+}
+
+// StoredRetainedMessages calls the StoredRetainedMessages of the hook
+func (h *Hook) StoredRetainedMessages() ([]storage.Message, error) {
+	start := time.Now()
+	v, err := h.Hook.StoredRetainedMessages()
+	h.observe(mqtt.StoredRetainedMessages, start, err)
+	return v, err
+}
+
+// StoredSysInfo calls the StoredSysInfo of the hook
+func (h *Hook) StoredSysInfo() (storage.SystemInfo, error) {
+	start := time.Now()
+	v, err := h.Hook.StoredSysInfo()
+	h.observe(mqtt.StoredSysInfo, start, err)
+	return v, err
+}
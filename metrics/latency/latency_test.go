@@ -0,0 +1,219 @@
+package latency
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	mqttprom "github.com/mochi-mqtt/hooks/metrics/prometheus"
+)
+
+// slowHook is a hook whose OnPublish takes delay, and rejects messages to the reject topic
+type slowHook struct {
+	delay  time.Duration
+	inits  int
+	config any
+	mqtt.HookBase
+}
+
+func (h *slowHook) ID() string {
+	return "slow-hook"
+}
+
+func (h *slowHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+func (h *slowHook) Init(config any) error {
+	h.inits++
+	h.config = config
+	return nil
+}
+
+func (h *slowHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	time.Sleep(h.delay)
+	if pk.TopicName == "reject" {
+		return pk, packets.ErrRejectPacket
+	}
+	pk.Payload = []byte("changed")
+	return pk, nil
+}
+
+func newRecorder(t *testing.T, options Options) *Recorder {
+	t.Helper()
+
+	recorder, err := New(options)
+	require.NoError(t, err)
+	return recorder
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     Options
+		expectError bool
+	}{
+		{
+			name:    "Success - defaults",
+			options: Options{},
+		},
+		{
+			name:    "Success - timeouts",
+			options: Options{Timeouts: map[string]time.Duration{"OnPublish": time.Millisecond, "StoredClients": time.Second}},
+		},
+		{
+			name:        "Error - unknown callback",
+			options:     Options{Timeouts: map[string]time.Duration{"OnPublsh": time.Millisecond}},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid timeout",
+			options:     Options{Timeouts: map[string]time.Duration{"OnPublish": 0}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder, err := New(tt.options)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "mqtt", recorder.options.Namespace)
+			require.Equal(t, 100*time.Millisecond, recorder.timeouts[mqtt.OnPublished])
+			if d, ok := tt.options.Timeouts["OnPublish"]; ok {
+				require.Equal(t, d, recorder.timeouts[mqtt.OnPublish])
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	require.Len(t, names, callbacks-1)
+	for b := byte(mqtt.OnSysInfoTick); int(b) < callbacks; b++ {
+		require.NotEmpty(t, names[b])
+	}
+}
+
+func TestWrap(t *testing.T) {
+	recorder := newRecorder(t, Options{})
+	inner := new(slowHook)
+	server := mqtt.New(nil)
+
+	wrapped := recorder.Wrap(inner)
+	require.NoError(t, server.AddHook(wrapped, "config"))
+	require.Equal(t, "slow-hook", wrapped.ID())
+	require.Equal(t, 1, inner.inits)
+	require.Equal(t, "config", inner.config)
+	require.NotNil(t, inner.Log)
+	require.True(t, wrapped.Provides(mqtt.OnPublish))
+	require.False(t, wrapped.Provides(mqtt.OnConnect))
+	require.Same(t, inner, wrapped.Unwrap())
+
+	pk, err := wrapped.OnPublish(nil, packets.Packet{TopicName: "a/b"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("changed"), pk.Payload)
+}
+
+func TestStats(t *testing.T) {
+	recorder := newRecorder(t, Options{Timeouts: map[string]time.Duration{"OnPublish": 5 * time.Millisecond}})
+	fast := recorder.Wrap(new(slowHook))
+	slow := recorder.Wrap(&slowHook{delay: 10 * time.Millisecond})
+	require.Equal(t, "slow-hook", slow.ID())
+
+	_, err := fast.OnPublish(nil, packets.Packet{TopicName: "a/b"})
+	require.NoError(t, err)
+	_, err = fast.OnPublish(nil, packets.Packet{TopicName: "reject"})
+	require.True(t, errors.Is(err, packets.ErrRejectPacket))
+	fast.OnPublished(nil, packets.Packet{})
+	_, err = slow.OnPublish(nil, packets.Packet{TopicName: "a/b"})
+	require.NoError(t, err)
+
+	stats := recorder.Stats()
+	require.Len(t, stats, 3)
+
+	var publish, published, slowPublish Stat
+	for _, s := range stats {
+		require.Equal(t, "slow-hook", s.Hook)
+		switch {
+		case s.Callback == "OnPublished":
+			published = s
+		case s.Callback == "OnPublish" && s.Calls == 2:
+			publish = s
+		default:
+			slowPublish = s
+		}
+	}
+
+	require.Equal(t, int64(2), publish.Calls)
+	require.Equal(t, int64(1), publish.Errors)
+	require.Equal(t, int64(0), publish.Timeouts)
+	require.Equal(t, int64(1), published.Calls)
+	require.Equal(t, int64(1), slowPublish.Calls)
+	require.Equal(t, int64(1), slowPublish.Timeouts)
+	require.GreaterOrEqual(t, slowPublish.Max, 10*time.Millisecond)
+	require.Equal(t, slowPublish.Max, slowPublish.Total)
+}
+
+func TestLatencies(t *testing.T) {
+	recorder := newRecorder(t, Options{})
+	wrapped := recorder.Wrap(&slowHook{delay: 2 * time.Millisecond})
+
+	require.Empty(t, recorder.Latencies())
+
+	_, _ = wrapped.OnPublish(nil, packets.Packet{})
+	_, _ = wrapped.OnPublish(nil, packets.Packet{})
+
+	latencies := recorder.Latencies()
+	require.Len(t, latencies, 1)
+	require.GreaterOrEqual(t, latencies["slow-hook"], 2*time.Millisecond)
+}
+
+func TestCollect(t *testing.T) {
+	recorder := newRecorder(t, Options{Namespace: "broker", Timeout: time.Nanosecond})
+	wrapped := recorder.Wrap(&slowHook{delay: time.Millisecond})
+	_, _ = wrapped.OnPublish(nil, packets.Packet{TopicName: "reject"})
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(recorder))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			require.Len(t, m.GetLabel(), 2)
+			require.Equal(t, "callback", m.GetLabel()[0].GetName())
+			require.Equal(t, "OnPublish", m.GetLabel()[0].GetValue())
+			require.Equal(t, "hook", m.GetLabel()[1].GetName())
+			require.Equal(t, "slow-hook", m.GetLabel()[1].GetValue())
+			values[f.GetName()] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+
+	require.Equal(t, float64(1), values["broker_hook_calls_total"])
+	require.Equal(t, float64(1), values["broker_hook_errors_total"])
+	require.Equal(t, float64(1), values["broker_hook_timeouts_total"])
+	require.GreaterOrEqual(t, values["broker_hook_duration_seconds_total"], 0.001)
+	require.Equal(t, values["broker_hook_duration_seconds_total"], values["broker_hook_duration_seconds_max"])
+
+	prometheusHook := new(mqttprom.Hook)
+	require.NoError(t, prometheusHook.Init(mqttprom.Options{Collectors: []prometheus.Collector{recorder}}))
+	rec := httptest.NewRecorder()
+	prometheusHook.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, rec.Body.String(), `broker_hook_calls_total{callback="OnPublish",hook="slow-hook"} 1`)
+}
@@ -0,0 +1,308 @@
+// Package prometheus provides a hook exporting the events of the broker as Prometheus metrics: the
+// connections, disconnections, messages, subscriptions, packets and bytes of each listener, the
+// messages dropped, and the gauges of the $SYS topics, eg. the number of retained messages.
+//
+// The hook is a prometheus.Collector. It serves its metrics itself on Addr, or its Handler is mounted
+// on the server of the application, and it registers them into the Registerer of the application if
+// one is given, eg.
+//
+//	err := server.AddHook(new(mqttprom.Hook), mqttprom.Options{
+//		Registerer: prometheus.DefaultRegisterer,
+//	})
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Hook is a hook that exports the events of the broker as Prometheus metrics
+type Hook struct {
+	config     Options
+	registry   *prometheus.Registry // the metrics are served from
+	collectors []prometheus.Collector
+
+	connections   *prometheus.CounterVec
+	disconnects   *prometheus.CounterVec
+	connected     *prometheus.GaugeVec
+	received      *prometheus.CounterVec
+	dropped       *prometheus.CounterVec
+	qosDropped    *prometheus.CounterVec
+	subscribes    *prometheus.CounterVec
+	unsubscribes  *prometheus.CounterVec
+	packetsIn     *prometheus.CounterVec
+	packetsOut    *prometheus.CounterVec
+	bytesIn       *prometheus.CounterVec
+	bytesOut      *prometheus.CounterVec
+	retained      prometheus.Gauge
+	subscriptions prometheus.Gauge
+	inflight      prometheus.Gauge
+	clients       prometheus.Gauge
+	uptime        prometheus.Gauge
+
+	ln     net.Listener // the metrics are served on
+	server *http.Server
+	wg     sync.WaitGroup // the server
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the prometheus hook
+type Options struct {
+	// Namespace starts the names of the metrics, and defaults to mqtt, eg. mqtt_connections_total
+	Namespace string
+
+	// Addr is the address the metrics are served on at Path, which defaults to /metrics, eg. ":9100".
+	// The metrics aren't served if it is empty
+	Addr string
+	Path string
+
+	// Registerer is registered with the metrics of the hook, eg. prometheus.DefaultRegisterer, so they
+	// are served along with those of the application. They are unregistered when the hook stops
+	Registerer prometheus.Registerer
+
+	// Collectors are collected along with the metrics of the hook, eg. a latency recorder
+	Collectors []prometheus.Collector
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "prometheus-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSysInfoTick,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnPacketRead,
+		mqtt.OnPacketSent,
+		mqtt.OnPublished,
+		mqtt.OnPublishDropped,
+		mqtt.OnQosDropped,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts serving the metrics if Addr is set
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	prometheusHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if prometheusHookConfig.Namespace == "" {
+		prometheusHookConfig.Namespace = "mqtt"
+	}
+
+	if prometheusHookConfig.Path == "" {
+		prometheusHookConfig.Path = "/metrics"
+	}
+
+	h.config = prometheusHookConfig
+	h.collectors = nil
+	h.connections = h.newCounterVec("connections_total", "The number of clients which connected.", "listener")
+	h.disconnects = h.newCounterVec("disconnections_total", "The number of clients which disconnected.", "listener")
+	h.connected = h.newGaugeVec("clients_connected", "The number of clients connected.", "listener")
+	h.received = h.newCounterVec("messages_received_total", "The number of messages published by clients.", "listener", "qos")
+	h.dropped = h.newCounterVec("messages_dropped_total", "The number of messages dropped as clients were too slow.", "listener")
+	h.qosDropped = h.newCounterVec("inflight_dropped_total", "The number of inflight messages which were dropped.", "listener")
+	h.subscribes = h.newCounterVec("subscribes_total", "The number of filters clients subscribed to.", "listener")
+	h.unsubscribes = h.newCounterVec("unsubscribes_total", "The number of filters clients unsubscribed from.", "listener")
+	h.packetsIn = h.newCounterVec("packets_received_total", "The number of packets received from clients.", "listener", "type")
+	h.packetsOut = h.newCounterVec("packets_sent_total", "The number of packets sent to clients.", "listener", "type")
+	h.bytesIn = h.newCounterVec("bytes_received_total", "The number of bytes received from clients.", "listener")
+	h.bytesOut = h.newCounterVec("bytes_sent_total", "The number of bytes sent to clients.", "listener")
+	h.retained = h.newGauge("retained_messages", "The number of retained messages.")
+	h.subscriptions = h.newGauge("subscriptions", "The number of subscriptions.")
+	h.inflight = h.newGauge("inflight_messages", "The number of messages in flight.")
+	h.clients = h.newGauge("clients", "The number of connected clients and disconnected clients with a persistent session.")
+	h.uptime = h.newGauge("uptime_seconds", "The number of seconds the broker has been running.")
+
+	h.registry = prometheus.NewRegistry()
+	if err := h.registry.Register(h); err != nil {
+		return err
+	}
+
+	for _, c := range prometheusHookConfig.Collectors {
+		if err := h.registry.Register(c); err != nil {
+			return err
+		}
+	}
+
+	if prometheusHookConfig.Registerer != nil {
+		if err := prometheusHookConfig.Registerer.Register(h); err != nil {
+			return err
+		}
+	}
+
+	if prometheusHookConfig.Addr == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", prometheusHookConfig.Addr)
+	if err != nil {
+		if prometheusHookConfig.Registerer != nil {
+			prometheusHookConfig.Registerer.Unregister(h)
+		}
+		return err
+	}
+	h.ln = ln
+
+	mux := http.NewServeMux()
+	mux.Handle(prometheusHookConfig.Path, h.Handler())
+	h.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := h.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			h.Log.Error("error occurred while serving prometheus metrics", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops serving the metrics, and unregisters them from the Registerer
+func (h *Hook) Stop() error {
+	if h.config.Registerer != nil {
+		h.config.Registerer.Unregister(h)
+	}
+
+	if h.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := h.server.Shutdown(ctx)
+	h.wg.Wait()
+	return err
+}
+
+// newCounterVec returns a counter with the labels, which is collected by the hook
+func (h *Hook) newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: h.config.Namespace, Name: name, Help: help}, labels)
+	h.collectors = append(h.collectors, c)
+	return c
+}
+
+// newGaugeVec returns a gauge with the labels, which is collected by the hook
+func (h *Hook) newGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: h.config.Namespace, Name: name, Help: help}, labels)
+	h.collectors = append(h.collectors, g)
+	return g
+}
+
+// newGauge returns a gauge without labels, which is collected by the hook
+func (h *Hook) newGauge(name, help string) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: h.config.Namespace, Name: name, Help: help})
+	h.collectors = append(h.collectors, g)
+	return g
+}
+
+// Describe sends the descriptors of the metrics of the hook, as a prometheus.Collector
+func (h *Hook) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range h.collectors {
+		c.Describe(ch)
+	}
+}
+
+// Collect sends the metrics of the hook, as a prometheus.Collector
+func (h *Hook) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range h.collectors {
+		c.Collect(ch)
+	}
+}
+
+// Handler returns a handler serving the metrics in the Prometheus exposition formats
+func (h *Hook) Handler() http.Handler {
+	return promhttp.HandlerFor(h.registry, promhttp.HandlerOpts{})
+}
+
+// OnSysInfoTick is called when the $SYS topic values are published, and sets the gauges of the server
+func (h *Hook) OnSysInfoTick(info *system.Info) {
+	h.retained.Set(float64(atomic.LoadInt64(&info.Retained)))
+	h.subscriptions.Set(float64(atomic.LoadInt64(&info.Subscriptions)))
+	h.inflight.Set(float64(atomic.LoadInt64(&info.Inflight)))
+	h.clients.Set(float64(atomic.LoadInt64(&info.ClientsTotal)))
+	h.uptime.Set(float64(atomic.LoadInt64(&info.Uptime)))
+}
+
+// OnSessionEstablished is called when a client has connected and authenticated
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.connections.WithLabelValues(cl.Net.Listener).Inc()
+	h.connected.WithLabelValues(cl.Net.Listener).Inc()
+}
+
+// OnDisconnect is called when a client which had connected disconnects
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.disconnects.WithLabelValues(cl.Net.Listener).Inc()
+	h.connected.WithLabelValues(cl.Net.Listener).Dec()
+}
+
+// OnPacketRead is called when a packet is received from a client, and counts it and its bytes
+func (h *Hook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	h.packetsIn.WithLabelValues(cl.Net.Listener, packets.PacketNames[pk.FixedHeader.Type]).Inc()
+	h.bytesIn.WithLabelValues(cl.Net.Listener).Add(float64(size(pk.FixedHeader.Remaining)))
+	return pk, nil
+}
+
+// OnPacketSent is called when a packet has been written to a client
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	h.packetsOut.WithLabelValues(cl.Net.Listener, packets.PacketNames[pk.FixedHeader.Type]).Inc()
+	h.bytesOut.WithLabelValues(cl.Net.Listener).Add(float64(len(b)))
+}
+
+// OnPublished is called when a client has published a message
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.received.WithLabelValues(cl.Net.Listener, strconv.Itoa(int(pk.FixedHeader.Qos))).Inc()
+}
+
+// OnPublishDropped is called when a message to a client is dropped, as the client is too slow
+func (h *Hook) OnPublishDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.dropped.WithLabelValues(cl.Net.Listener).Inc()
+}
+
+// OnQosDropped is called when an inflight message to a client is dropped
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.qosDropped.WithLabelValues(cl.Net.Listener).Inc()
+}
+
+// OnSubscribed is called when a client has subscribed to filters
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	h.subscribes.WithLabelValues(cl.Net.Listener).Add(float64(len(pk.Filters)))
+}
+
+// OnUnsubscribed is called when a client has unsubscribed from filters
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	h.unsubscribes.WithLabelValues(cl.Net.Listener).Add(float64(len(pk.Filters)))
+}
+
+// size returns the size of a packet with the remaining length, including its fixed header
+func size(remaining int) int {
+	n := 2 // the type and flags, and the first byte of the remaining length
+	for r := remaining; r >= 128; r /= 128 {
+		n++
+	}
+	return n + remaining
+}
@@ -0,0 +1,218 @@
+package prometheus
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	prometheusHook := new(Hook)
+	prometheusHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, prometheusHook.Init(options))
+	t.Cleanup(func() { prometheusHook.Stop() })
+	return prometheusHook
+}
+
+func newClient(listener string) *mqtt.Client {
+	return mqtt.New(nil).NewClient(nil, listener, "c1", false)
+}
+
+// gather returns the values of the metrics gathered from g, by their names and label values
+func gather(t *testing.T, g prometheus.Gatherer) map[string]float64 {
+	t.Helper()
+
+	families, err := g.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			key := f.GetName()
+			for _, l := range m.GetLabel() {
+				key += "," + l.GetName() + "=" + l.GetValue()
+			}
+			values[key] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestID(t *testing.T) {
+	prometheusHook := new(Hook)
+
+	require.Equal(t, "prometheus-hook", prometheusHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	prometheusHook := new(Hook)
+
+	require.True(t, prometheusHook.Provides(mqtt.OnPublished))
+	require.True(t, prometheusHook.Provides(mqtt.OnSysInfoTick))
+	require.False(t, prometheusHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - defaults",
+			config:      Options{},
+			expectError: false,
+		},
+		{
+			name:        "Success - serve",
+			config:      Options{Addr: "127.0.0.1:0"},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid addr",
+			config:      Options{Addr: "invalid"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			prometheusHook := new(Hook)
+			prometheusHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := prometheusHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "mqtt", prometheusHook.config.Namespace)
+				require.Equal(t, "/metrics", prometheusHook.config.Path)
+				require.NoError(t, prometheusHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestEvents(t *testing.T) {
+	prometheusHook := newHook(t, Options{Namespace: "broker"})
+	tcp, ws := newClient("tcp1"), newClient("ws1")
+
+	prometheusHook.OnSessionEstablished(tcp, packets.Packet{})
+	prometheusHook.OnSessionEstablished(ws, packets.Packet{})
+	prometheusHook.OnDisconnect(ws, nil, false)
+
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Remaining: 200}, TopicName: "a"}
+	_, err := prometheusHook.OnPacketRead(tcp, pk)
+	require.NoError(t, err)
+	prometheusHook.OnPublished(tcp, pk)
+	prometheusHook.OnPacketSent(tcp, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}}, make([]byte, 4))
+	prometheusHook.OnPublishDropped(ws, pk)
+	prometheusHook.OnQosDropped(ws, pk)
+	prometheusHook.OnSubscribed(tcp, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}, {Filter: "b"}}}, []byte{0, 0})
+	prometheusHook.OnUnsubscribed(tcp, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}}})
+	prometheusHook.OnSysInfoTick(&system.Info{Retained: 7, Subscriptions: 1, ClientsTotal: 1, Uptime: 60})
+
+	require.Equal(t, map[string]float64{
+		"broker_connections_total,listener=tcp1":                   1,
+		"broker_connections_total,listener=ws1":                    1,
+		"broker_disconnections_total,listener=ws1":                 1,
+		"broker_clients_connected,listener=tcp1":                   1,
+		"broker_clients_connected,listener=ws1":                    0,
+		"broker_messages_received_total,listener=tcp1,qos=1":       1,
+		"broker_messages_dropped_total,listener=ws1":               1,
+		"broker_inflight_dropped_total,listener=ws1":               1,
+		"broker_subscribes_total,listener=tcp1":                    2,
+		"broker_unsubscribes_total,listener=tcp1":                  1,
+		"broker_packets_received_total,listener=tcp1,type=Publish": 1,
+		"broker_packets_sent_total,listener=tcp1,type=Puback":      1,
+		"broker_bytes_received_total,listener=tcp1":                203,
+		"broker_bytes_sent_total,listener=tcp1":                    4,
+		"broker_retained_messages":                                 7,
+		"broker_subscriptions":                                     1,
+		"broker_inflight_messages":                                 0,
+		"broker_clients":                                           1,
+		"broker_uptime_seconds":                                    60,
+	}, gather(t, prometheusHook.registry))
+}
+
+func TestHandler(t *testing.T) {
+	prometheusHook := newHook(t, Options{})
+	prometheusHook.OnSessionEstablished(newClient(`tcp"1`), packets.Packet{})
+	prometheusHook.OnSysInfoTick(&system.Info{Retained: 3})
+
+	rec := httptest.NewRecorder()
+	prometheusHook.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.Contains(t, rec.Body.String(), "# HELP mqtt_connections_total The number of clients which connected.\n"+
+		"# TYPE mqtt_connections_total counter\n"+
+		`mqtt_connections_total{listener="tcp\"1"} 1`+"\n")
+	require.Contains(t, rec.Body.String(), "# TYPE mqtt_retained_messages gauge\nmqtt_retained_messages 3\n")
+	require.NotContains(t, rec.Body.String(), "mqtt_messages_received_total")
+}
+
+func TestRegisterer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	prometheusHook := newHook(t, Options{Registerer: registry})
+	prometheusHook.OnSysInfoTick(&system.Info{Uptime: 5})
+	require.Equal(t, float64(5), gather(t, registry)["mqtt_uptime_seconds"])
+
+	// the metrics of another hook would collide with those registered
+	require.Error(t, new(Hook).Init(Options{Registerer: registry}))
+
+	require.NoError(t, prometheusHook.Stop())
+	require.Empty(t, gather(t, registry))
+	newHook(t, Options{Registerer: registry})
+}
+
+func TestCollectors(t *testing.T) {
+	calls := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "mqtt_hook_calls_total", Help: "Calls."}, []string{"hook"})
+	calls.WithLabelValues("kafka-hook").Add(2.5)
+	prometheusHook := newHook(t, Options{Collectors: []prometheus.Collector{calls}})
+
+	rec := httptest.NewRecorder()
+	prometheusHook.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Contains(t, rec.Body.String(), "# TYPE mqtt_hook_calls_total counter\n"+`mqtt_hook_calls_total{hook="kafka-hook"} 2.5`+"\n")
+
+	// collectors whose metrics collide with those of the hook are rejected
+	uptime := prometheus.NewGauge(prometheus.GaugeOpts{Name: "mqtt_uptime_seconds", Help: "Uptime."})
+	require.Error(t, new(Hook).Init(Options{Collectors: []prometheus.Collector{uptime}}))
+}
+
+func TestServe(t *testing.T) {
+	prometheusHook := newHook(t, Options{Addr: "127.0.0.1:0", Path: "/stats"})
+	prometheusHook.OnSysInfoTick(&system.Info{Uptime: 5})
+
+	resp, err := http.Get("http://" + prometheusHook.ln.Addr().String() + "/stats")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "mqtt_uptime_seconds 5\n")
+
+	require.NoError(t, prometheusHook.Stop())
+	_, err = http.Get("http://" + prometheusHook.ln.Addr().String() + "/stats")
+	require.Error(t, err)
+}
@@ -0,0 +1,352 @@
+// Package statsd provides a hook pushing the connection, message and latency metrics of the broker
+// over StatsD, or DogStatsD with tags, eg. to the Datadog agent.
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// the names of the metrics, which are prefixed by Prefix
+const (
+	MetricConnections     = "connections"       // counter
+	MetricDisconnections  = "disconnections"    // counter
+	MetricMessagesIn      = "messages.received" // counter, tagged with the qos
+	MetricMessagesOut     = "messages.sent"     // counter
+	MetricMessagesDropped = "messages.dropped"  // counter
+	MetricInflightDropped = "inflight.dropped"  // counter
+	MetricSubscribes      = "subscribes"        // counter
+	MetricBytesIn         = "bytes.received"    // counter
+	MetricBytesOut        = "bytes.sent"        // counter
+	MetricPublishLatency  = "publish.latency"   // timing of processing a message and sending it to subscribers
+	MetricDeliveryLatency = "delivery.latency"  // timing of a qos 1 or 2 message until the client acknowledged it
+	MetricClients         = "clients.connected" // gauge
+	MetricRetained        = "retained"          // gauge
+	MetricSubscriptions   = "subscriptions"     // gauge
+	MetricInflight        = "inflight"          // gauge
+)
+
+// Stats are the totals of the metrics pushed since the hook was initialized
+type Stats struct {
+	Packets int64 // the number of packets sent
+	Failed  int64 // the number of packets which could not be sent
+}
+
+// Hook is a hook that pushes the metrics of the broker over StatsD
+type Hook struct {
+	config   Options
+	conn     net.Conn
+	tags     string                          // the constant tags, formatted
+	buf      []byte                          // the metrics waiting to be sent
+	reading  sync.Map                        // the time each client started publishing a message
+	inflight *cache.Cache[string, time.Time] // when each qos message was sent to a client
+	packets  atomic.Int64
+	failed   atomic.Int64
+	done     chan struct{}
+	wg       sync.WaitGroup // the flusher
+	mu       sync.Mutex     // guards buf
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the statsd hook
+type Options struct {
+	// Addr is the UDP address of the StatsD server or agent, and defaults to 127.0.0.1:8125
+	Addr string
+
+	// Prefix starts the names of the metrics, and defaults to "mqtt.", eg. mqtt.connections
+	Prefix string
+
+	// DogStatsD sends tags in the DogStatsD format, which plain StatsD doesn't support. Tags are sent
+	// with each metric, eg. "env:prod", along with the listener of the client, and its tenant if
+	// Tenant is set
+	DogStatsD bool
+	Tags      []string
+	Tenant    func(cl *mqtt.Client) string
+
+	// FlushInterval is how often metrics are sent, defaults to 1 second, and MaxPacketSize is the
+	// most bytes of metrics sent at once, defaults to 1432 so packets aren't fragmented
+	FlushInterval time.Duration
+	MaxPacketSize int
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "statsd-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSysInfoTick,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnPacketRead,
+		mqtt.OnPacketSent,
+		mqtt.OnPublished,
+		mqtt.OnPublishDropped,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnSubscribed,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts pushing metrics
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	statsdHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if statsdHookConfig.Addr == "" {
+		statsdHookConfig.Addr = "127.0.0.1:8125"
+	}
+
+	if statsdHookConfig.Prefix == "" {
+		statsdHookConfig.Prefix = "mqtt."
+	}
+
+	if statsdHookConfig.FlushInterval <= 0 {
+		statsdHookConfig.FlushInterval = time.Second
+	}
+
+	if statsdHookConfig.MaxPacketSize <= 0 {
+		statsdHookConfig.MaxPacketSize = 1432
+	}
+
+	conn, err := net.Dial("udp", statsdHookConfig.Addr)
+	if err != nil {
+		return err
+	}
+
+	h.config = statsdHookConfig
+	h.conn = conn
+	h.tags = ""
+	for _, tag := range statsdHookConfig.Tags {
+		h.tags += "," + tag
+	}
+	h.inflight = cache.New[string, time.Time](cache.Options{MaxEntries: 100000, TTL: time.Hour})
+	h.done = make(chan struct{})
+
+	h.wg.Add(1)
+	go h.flusher()
+
+	return nil
+}
+
+// Stop sends the metrics waiting to be sent
+func (h *Hook) Stop() error {
+	if h.done == nil {
+		return nil
+	}
+
+	select {
+	case <-h.done:
+		return nil
+	default:
+	}
+
+	close(h.done)
+	h.wg.Wait()
+	h.flush()
+	return h.conn.Close()
+}
+
+// Stats returns the totals of the metrics pushed so far
+func (h *Hook) Stats() Stats {
+	return Stats{Packets: h.packets.Load(), Failed: h.failed.Load()}
+}
+
+// flusher sends the metrics every FlushInterval until the hook stops
+func (h *Hook) flusher() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			h.flush()
+		}
+	}
+}
+
+// flush sends the metrics waiting to be sent
+func (h *Hook) flush() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.send()
+}
+
+// send sends the buffered metrics, and must be called with mu held
+func (h *Hook) send() {
+	if len(h.buf) == 0 {
+		return
+	}
+
+	h.packets.Add(1)
+	if _, err := h.conn.Write(h.buf); err != nil {
+		h.failed.Add(1)
+		h.Log.Warn("failed to send statsd metrics", "error", err)
+	}
+	h.buf = h.buf[:0]
+}
+
+// metric buffers a metric of the type, eg. c for counters, sending the buffered metrics first if it
+// doesn't fit in the packet
+func (h *Hook) metric(name string, value int64, typ string, cl *mqtt.Client, tags ...string) {
+	line := make([]byte, 0, 64)
+	line = append(line, h.config.Prefix...)
+	line = append(line, name...)
+	line = append(line, ':')
+	line = strconv.AppendInt(line, value, 10)
+	line = append(line, '|')
+	line = append(line, typ...)
+
+	if h.config.DogStatsD {
+		all := h.tags
+		if cl != nil {
+			all += ",listener:" + cl.Net.Listener
+			if h.config.Tenant != nil {
+				if tenant := h.config.Tenant(cl); tenant != "" {
+					all += ",tenant:" + tenant
+				}
+			}
+		}
+		for _, tag := range tags {
+			all += "," + tag
+		}
+		if all != "" {
+			line = append(line, "|#"...)
+			line = append(line, all[1:]...)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.buf) > 0 && len(h.buf)+1+len(line) > h.config.MaxPacketSize {
+		h.send()
+	}
+
+	if len(h.buf) > 0 {
+		h.buf = append(h.buf, '\n')
+	}
+	h.buf = append(h.buf, line...)
+}
+
+// count buffers a counter of the client
+func (h *Hook) count(name string, n int64, cl *mqtt.Client, tags ...string) {
+	h.metric(name, n, "c", cl, tags...)
+}
+
+// OnSysInfoTick is called when the $SYS topic values are published, and sends the gauges of the server
+func (h *Hook) OnSysInfoTick(info *system.Info) {
+	h.metric(MetricClients, atomic.LoadInt64(&info.ClientsConnected), "g", nil)
+	h.metric(MetricRetained, atomic.LoadInt64(&info.Retained), "g", nil)
+	h.metric(MetricSubscriptions, atomic.LoadInt64(&info.Subscriptions), "g", nil)
+	h.metric(MetricInflight, atomic.LoadInt64(&info.Inflight), "g", nil)
+}
+
+// OnSessionEstablished is called when a client has connected and authenticated
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.count(MetricConnections, 1, cl)
+}
+
+// OnDisconnect is called when a client which had connected disconnects
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.reading.Delete(cl)
+	h.count(MetricDisconnections, 1, cl)
+}
+
+// OnPacketRead is called when a packet is received from a client, and counts its bytes
+func (h *Hook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if pk.FixedHeader.Type == packets.Publish {
+		h.reading.Store(cl, time.Now())
+	}
+
+	h.count(MetricBytesIn, int64(size(pk.FixedHeader.Remaining)), cl)
+	return pk, nil
+}
+
+// OnPacketSent is called when a packet has been written to a client
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if pk.FixedHeader.Type == packets.Publish {
+		h.count(MetricMessagesOut, 1, cl)
+	}
+	h.count(MetricBytesOut, int64(len(b)), cl)
+}
+
+// OnPublished is called when a client has published a message, and times how long it took since the
+// message was read
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.count(MetricMessagesIn, 1, cl, "qos:"+strconv.Itoa(int(pk.FixedHeader.Qos)))
+	if start, ok := h.reading.LoadAndDelete(cl); ok {
+		h.metric(MetricPublishLatency, time.Since(start.(time.Time)).Milliseconds(), "ms", cl)
+	}
+}
+
+// OnPublishDropped is called when a message to a client is dropped, as the client is too slow
+func (h *Hook) OnPublishDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.count(MetricMessagesDropped, 1, cl)
+}
+
+// OnQosPublish is called when a qos message is sent to a client, or acknowledged by the server
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if pk.FixedHeader.Type == packets.Publish && resends == 0 {
+		h.inflight.Set(inflightKey(cl, pk.PacketID), time.Now())
+	}
+}
+
+// OnQosComplete is called when the flow of a qos message has completed, and times the delivery of
+// messages sent to the client
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	key := inflightKey(cl, pk.PacketID)
+	if sent, ok := h.inflight.Get(key); ok {
+		h.inflight.Delete(key)
+		h.metric(MetricDeliveryLatency, time.Since(sent).Milliseconds(), "ms", cl)
+	}
+}
+
+// OnQosDropped is called when an inflight message to a client is dropped
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.inflight.Delete(inflightKey(cl, pk.PacketID))
+	h.count(MetricInflightDropped, 1, cl)
+}
+
+// OnSubscribed is called when a client has subscribed to filters
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	h.count(MetricSubscribes, int64(len(pk.Filters)), cl)
+}
+
+// inflightKey returns the key of the inflight message of the client
+func inflightKey(cl *mqtt.Client, id uint16) string {
+	return cl.ID + "\xff" + strconv.Itoa(int(id))
+}
+
+// size returns the size of a packet with the remaining length, including its fixed header
+func size(remaining int) int {
+	n := 2 // the type and flags, and the first byte of the remaining length
+	for r := remaining; r >= 128; r /= 128 {
+		n++
+	}
+	return n + remaining
+}
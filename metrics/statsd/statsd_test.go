@@ -0,0 +1,233 @@
+package statsd
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/stretchr/testify/require"
+)
+
+// newAgent returns a UDP listener standing in for the statsd agent
+func newAgent(t *testing.T) net.PacketConn {
+	t.Helper()
+
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { agent.Close() })
+	return agent
+}
+
+// receive returns the metrics of the next packet the agent receives
+func receive(t *testing.T, agent net.PacketConn) []string {
+	t.Helper()
+
+	buf := make([]byte, 65536)
+	require.NoError(t, agent.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := agent.ReadFrom(buf)
+	require.NoError(t, err)
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	statsdHook := new(Hook)
+	statsdHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, statsdHook.Init(options))
+	t.Cleanup(func() { statsdHook.Stop() })
+	return statsdHook
+}
+
+func newClient(listener, id string) *mqtt.Client {
+	return mqtt.New(nil).NewClient(nil, listener, id, false)
+}
+
+func TestID(t *testing.T) {
+	statsdHook := new(Hook)
+
+	require.Equal(t, "statsd-hook", statsdHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	statsdHook := new(Hook)
+
+	require.True(t, statsdHook.Provides(mqtt.OnPublished))
+	require.True(t, statsdHook.Provides(mqtt.OnQosComplete))
+	require.False(t, statsdHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - defaults",
+			config:      Options{},
+			expectError: false,
+		},
+		{
+			name:        "Success - dogstatsd",
+			config:      Options{Addr: "127.0.0.1:8125", DogStatsD: true, Tags: []string{"env:test"}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid addr",
+			config:      Options{Addr: "invalid"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			statsdHook := new(Hook)
+			statsdHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := statsdHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "mqtt.", statsdHook.config.Prefix)
+				require.Equal(t, time.Second, statsdHook.config.FlushInterval)
+				require.Equal(t, 1432, statsdHook.config.MaxPacketSize)
+				require.NoError(t, statsdHook.Stop())
+				require.NoError(t, statsdHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	agent := newAgent(t)
+	statsdHook := newHook(t, Options{Addr: agent.LocalAddr().String(), FlushInterval: time.Hour})
+
+	cl := newClient("tcp", "c1")
+	statsdHook.OnSessionEstablished(cl, packets.Packet{})
+	statsdHook.OnPublished(cl, packets.Packet{FixedHeader: packets.FixedHeader{Qos: 1}})
+	statsdHook.OnSysInfoTick(&system.Info{ClientsConnected: 3})
+	statsdHook.flush()
+
+	// plain statsd doesn't support tags
+	require.Equal(t, []string{
+		"mqtt.connections:1|c",
+		"mqtt.messages.received:1|c",
+		"mqtt.clients.connected:3|g",
+		"mqtt.retained:0|g",
+		"mqtt.subscriptions:0|g",
+		"mqtt.inflight:0|g",
+	}, receive(t, agent))
+	require.Equal(t, Stats{Packets: 1}, statsdHook.Stats())
+}
+
+func TestDogStatsD(t *testing.T) {
+	agent := newAgent(t)
+	statsdHook := newHook(t, Options{
+		Addr:          agent.LocalAddr().String(),
+		Prefix:        "broker.",
+		DogStatsD:     true,
+		Tags:          []string{"env:test"},
+		Tenant:        func(cl *mqtt.Client) string { return strings.Split(cl.ID, "/")[0] },
+		FlushInterval: time.Hour,
+	})
+
+	cl := newClient("ws", "acme/c1")
+	statsdHook.OnSessionEstablished(cl, packets.Packet{})
+	statsdHook.OnPublished(cl, packets.Packet{FixedHeader: packets.FixedHeader{Qos: 2}})
+	statsdHook.OnPacketRead(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingreq}})
+	statsdHook.OnPacketSent(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}}, make([]byte, 10))
+	statsdHook.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}, {Filter: "b"}}}, nil)
+	statsdHook.OnPublishDropped(cl, packets.Packet{})
+	statsdHook.OnDisconnect(cl, nil, false)
+	statsdHook.OnSysInfoTick(&system.Info{Retained: 5})
+	statsdHook.flush()
+
+	tags := "|#env:test,listener:ws,tenant:acme"
+	require.Equal(t, []string{
+		"broker.connections:1|c" + tags,
+		"broker.messages.received:1|c" + tags + ",qos:2",
+		"broker.bytes.received:2|c" + tags,
+		"broker.messages.sent:1|c" + tags,
+		"broker.bytes.sent:10|c" + tags,
+		"broker.subscribes:2|c" + tags,
+		"broker.messages.dropped:1|c" + tags,
+		"broker.disconnections:1|c" + tags,
+		"broker.clients.connected:0|g|#env:test",
+		"broker.retained:5|g|#env:test",
+		"broker.subscriptions:0|g|#env:test",
+		"broker.inflight:0|g|#env:test",
+	}, receive(t, agent))
+}
+
+func TestLatency(t *testing.T) {
+	agent := newAgent(t)
+	statsdHook := newHook(t, Options{Addr: agent.LocalAddr().String(), FlushInterval: time.Hour})
+
+	cl := newClient("tcp", "c1")
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 7}
+	statsdHook.OnPacketRead(cl, pk)
+	statsdHook.OnPublished(cl, pk)
+
+	// the delivery of messages sent to clients is timed until they are acknowledged
+	statsdHook.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	time.Sleep(20 * time.Millisecond)
+	statsdHook.OnQosComplete(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: 7})
+	statsdHook.OnQosComplete(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}, PacketID: 8})
+
+	// dropped messages aren't timed
+	pk.PacketID = 9
+	statsdHook.OnQosPublish(cl, pk, time.Now().Unix(), 0)
+	statsdHook.OnQosDropped(cl, pk)
+	statsdHook.OnQosComplete(cl, pk)
+	statsdHook.flush()
+
+	metrics := receive(t, agent)
+	require.Len(t, metrics, 5)
+	require.Regexp(t, `^mqtt\.publish\.latency:\d+\|ms$`, metrics[2])
+	require.Regexp(t, `^mqtt\.delivery\.latency:\d+\|ms$`, metrics[3])
+	require.NotEqual(t, "mqtt.delivery.latency:0|ms", metrics[3])
+	require.Equal(t, "mqtt.inflight.dropped:1|c", metrics[4])
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	agent := newAgent(t)
+	statsdHook := newHook(t, Options{Addr: agent.LocalAddr().String(), FlushInterval: time.Hour, MaxPacketSize: 50})
+
+	// metrics which don't fit are sent in another packet
+	cl := newClient("tcp", "c1")
+	statsdHook.OnSessionEstablished(cl, packets.Packet{})
+	statsdHook.OnSessionEstablished(cl, packets.Packet{})
+	statsdHook.OnSessionEstablished(cl, packets.Packet{})
+
+	require.Equal(t, []string{"mqtt.connections:1|c", "mqtt.connections:1|c"}, receive(t, agent))
+	require.NoError(t, statsdHook.Stop())
+	require.Equal(t, []string{"mqtt.connections:1|c"}, receive(t, agent))
+	require.Equal(t, Stats{Packets: 2}, statsdHook.Stats())
+}
+
+func TestFlushInterval(t *testing.T) {
+	agent := newAgent(t)
+	statsdHook := newHook(t, Options{Addr: agent.LocalAddr().String(), FlushInterval: 10 * time.Millisecond})
+
+	statsdHook.OnSessionEstablished(newClient("tcp", "c1"), packets.Packet{})
+	require.Equal(t, []string{"mqtt.connections:1|c"}, receive(t, agent))
+}
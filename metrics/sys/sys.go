@@ -0,0 +1,302 @@
+// Package sys provides a hook periodically publishing the statistics of the broker to retained $SYS
+// topics in the format of mosquitto, eg. $SYS/broker/load/messages/received/1min, so existing MQTT
+// dashboards and probes work unchanged.
+package sys
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// ClientID is the id of the inline client which publishes the statistics
+const ClientID = "sys-publisher"
+
+// loadPeriods are the minutes the load averages are over, and the suffixes of their topics
+var loadPeriods = []struct {
+	minutes float64
+	suffix  string
+}{
+	{1, "1min"},
+	{5, "5min"},
+	{15, "15min"},
+}
+
+// Stats are the totals of the statistics published since the hook was initialized
+type Stats struct {
+	Published int64 // the number of topics published
+	Failed    int64 // the number of topics which could not be published
+}
+
+// Hook is a hook that publishes the statistics of the broker to $SYS topics
+type Hook struct {
+	config      Options
+	client      *mqtt.Client
+	last        time.Time              // when the statistics were last published
+	prev        map[string]int64       // the counters the load averages are of, when last published
+	loads       map[string]*[3]float64 // the load averages of the counters, for each period
+	payloads    map[string]string      // the payloads last published to each topic
+	heapMax     int64
+	own         int64 // the messages published by the hook, which aren't counted as received
+	connections atomic.Int64
+	stats       Stats
+	done        chan struct{}
+	wg          sync.WaitGroup // the publisher
+	mu          sync.Mutex     // guards publishing
+	statsMu     sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the sys hook
+type Options struct {
+	// Server is the server the statistics are of, and are published to. Required
+	Server *mqtt.Server
+
+	// Prefix starts the topics, and defaults to $SYS/broker
+	Prefix string
+
+	// Interval is how often the statistics are published, and defaults to 10 seconds. Topics are only
+	// published when their values have changed
+	Interval time.Duration
+
+	// Version is published to the version topic, and defaults to "mochi-mqtt version" and the version
+	// of the server
+	Version string
+
+	// Latencies returns the latency of the hooks, by their ids, eg. of the hooks instrumented by the
+	// latency decorator, which are published to {prefix}/hooks/{id}/latency in milliseconds
+	Latencies func() map[string]time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "sys-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts publishing the statistics
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	sysHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if sysHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if sysHookConfig.Prefix == "" {
+		sysHookConfig.Prefix = "$SYS/broker"
+	}
+
+	if sysHookConfig.Interval <= 0 {
+		sysHookConfig.Interval = 10 * time.Second
+	}
+
+	if sysHookConfig.Version == "" {
+		sysHookConfig.Version = "mochi-mqtt version " + sysHookConfig.Server.Info.Version
+	}
+
+	h.config = sysHookConfig
+	h.client = sysHookConfig.Server.NewClient(nil, "local", ClientID, true)
+	h.client.Properties.ProtocolVersion = 5
+	h.last = time.Time{}
+	h.prev = make(map[string]int64)
+	h.loads = make(map[string]*[3]float64)
+	h.payloads = make(map[string]string)
+	h.done = make(chan struct{})
+
+	h.wg.Add(1)
+	go h.publisher()
+
+	return nil
+}
+
+// Stop stops publishing the statistics
+func (h *Hook) Stop() error {
+	if h.done == nil {
+		return nil
+	}
+
+	select {
+	case <-h.done:
+		return nil
+	default:
+	}
+
+	close(h.done)
+	h.wg.Wait()
+	return nil
+}
+
+// Stats returns the totals of the statistics published so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// OnSessionEstablished is called when a client has connected and authenticated, and counts the
+// connections
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.connections.Add(1)
+}
+
+// publisher publishes the statistics every Interval until the hook stops
+func (h *Hook) publisher() {
+	defer h.wg.Done()
+
+	h.publish(time.Now())
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			h.publish(now)
+		}
+	}
+}
+
+// publish publishes the statistics which have changed since they were last published
+func (h *Hook) publish(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	topics := h.topics(now)
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+
+	for _, topic := range names {
+		payload := topics[topic]
+		if last, ok := h.payloads[topic]; ok && last == payload {
+			continue
+		}
+
+		err := h.config.Server.InjectPacket(h.client, packets.Packet{
+			FixedHeader: packets.FixedHeader{
+				Type:   packets.Publish,
+				Retain: true,
+			},
+			TopicName: h.config.Prefix + "/" + topic,
+			Payload:   []byte(payload),
+		})
+		if err != nil {
+			h.Log.Error("error occurred while publishing $SYS topic", "error", err, "topic", topic)
+		} else {
+			h.payloads[topic] = payload
+			h.own++
+		}
+
+		h.statsMu.Lock()
+		if err != nil {
+			h.stats.Failed++
+		} else {
+			h.stats.Published++
+		}
+		h.statsMu.Unlock()
+	}
+}
+
+// topics returns the payloads of the topics, after the prefix, and updates the load averages
+func (h *Hook) topics(now time.Time) map[string]string {
+	info := h.config.Server.Info.Clone()
+	info.MessagesReceived -= h.own
+	info.PacketsReceived -= h.own
+
+	if info.MemoryAlloc > h.heapMax {
+		h.heapMax = info.MemoryAlloc
+	}
+
+	topics := map[string]string{
+		"version":                   h.config.Version,
+		"uptime":                    strconv.FormatInt(now.Unix()-info.Started, 10) + " seconds",
+		"clients/connected":         strconv.FormatInt(info.ClientsConnected, 10),
+		"clients/active":            strconv.FormatInt(info.ClientsConnected, 10),
+		"clients/disconnected":      strconv.FormatInt(info.ClientsDisconnected, 10),
+		"clients/inactive":          strconv.FormatInt(info.ClientsDisconnected, 10),
+		"clients/maximum":           strconv.FormatInt(info.ClientsMaximum, 10),
+		"clients/total":             strconv.FormatInt(info.ClientsTotal, 10),
+		"messages/received":         strconv.FormatInt(info.PacketsReceived, 10),
+		"messages/sent":             strconv.FormatInt(info.PacketsSent, 10),
+		"messages/inflight":         strconv.FormatInt(info.Inflight, 10),
+		"publish/messages/received": strconv.FormatInt(info.MessagesReceived, 10),
+		"publish/messages/sent":     strconv.FormatInt(info.MessagesSent, 10),
+		"publish/messages/dropped":  strconv.FormatInt(info.MessagesDropped, 10),
+		"bytes/received":            strconv.FormatInt(info.BytesReceived, 10),
+		"bytes/sent":                strconv.FormatInt(info.BytesSent, 10),
+		"retained messages/count":   strconv.FormatInt(info.Retained, 10),
+		"subscriptions/count":       strconv.FormatInt(info.Subscriptions, 10),
+		"heap/current":              strconv.FormatInt(info.MemoryAlloc, 10),
+		"heap/maximum":              strconv.FormatInt(h.heapMax, 10),
+	}
+
+	counters := map[string]int64{
+		"messages/received": info.PacketsReceived,
+		"messages/sent":     info.PacketsSent,
+		"publish/received":  info.MessagesReceived,
+		"publish/sent":      info.MessagesSent,
+		"publish/dropped":   info.MessagesDropped,
+		"bytes/received":    info.BytesReceived,
+		"bytes/sent":        info.BytesSent,
+		"connections":       h.connections.Load(),
+	}
+
+	// the load averages are exponentially weighted moving averages of the rates per minute, as
+	// mosquitto calculates them, and start once there is an interval to calculate a rate over
+	elapsed := now.Sub(h.last).Seconds()
+	for name, n := range counters {
+		if !h.last.IsZero() && elapsed > 0 {
+			rate := float64(n-h.prev[name]) * 60 / elapsed
+			loads, ok := h.loads[name]
+			if !ok {
+				loads = new([3]float64)
+				h.loads[name] = loads
+			}
+			for i, period := range loadPeriods {
+				exponent := math.Exp(-elapsed / (60 * period.minutes))
+				loads[i] = rate + exponent*(loads[i]-rate)
+			}
+		}
+		h.prev[name] = n
+
+		if loads, ok := h.loads[name]; ok {
+			for i, period := range loadPeriods {
+				topics["load/"+name+"/"+period.suffix] = strconv.FormatFloat(loads[i], 'f', 2, 64)
+			}
+		}
+	}
+	h.last = now
+
+	if h.config.Latencies != nil {
+		for id, latency := range h.config.Latencies() {
+			topics["hooks/"+id+"/latency"] = strconv.FormatFloat(float64(latency)/float64(time.Millisecond), 'f', 3, 64)
+		}
+	}
+
+	return topics
+}
@@ -0,0 +1,189 @@
+package sys
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	sysHook := new(Hook)
+	sysHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, sysHook.Init(options))
+	t.Cleanup(func() { sysHook.Stop() })
+	return sysHook
+}
+
+// retained returns the payloads of the retained messages of the topics under the prefix
+func retained(server *mqtt.Server, prefix string) map[string]string {
+	payloads := make(map[string]string)
+	for _, pk := range server.Topics.Messages(prefix + "/#") {
+		payloads[strings.TrimPrefix(pk.TopicName, prefix+"/")] = string(pk.Payload)
+	}
+	return payloads
+}
+
+func TestID(t *testing.T) {
+	sysHook := new(Hook)
+
+	require.Equal(t, "sys-hook", sysHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	sysHook := new(Hook)
+
+	require.True(t, sysHook.Provides(mqtt.OnSessionEstablished))
+	require.False(t, sysHook.Provides(mqtt.OnPublished))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			sysHook := new(Hook)
+			sysHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := sysHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "$SYS/broker", sysHook.config.Prefix)
+				require.Equal(t, 10*time.Second, sysHook.config.Interval)
+				require.Equal(t, "mochi-mqtt version "+mqtt.Version, sysHook.config.Version)
+				require.NoError(t, sysHook.Stop())
+				require.NoError(t, sysHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestPublish(t *testing.T) {
+	server := newServer(t)
+	sysHook := newHook(t, Options{
+		Server:   server,
+		Prefix:   "$SYS/test",
+		Interval: time.Hour,
+		Latencies: func() map[string]time.Duration {
+			return map[string]time.Duration{"auth-hook": 1500 * time.Microsecond}
+		},
+	})
+
+	require.Eventually(t, func() bool {
+		return retained(server, "$SYS/test")["version"] != ""
+	}, time.Second, 5*time.Millisecond)
+
+	atomic.StoreInt64(&server.Info.ClientsConnected, 3)
+	atomic.StoreInt64(&server.Info.Started, time.Now().Unix()-42)
+	require.NoError(t, server.Publish("a/b", []byte("hello"), true, 0))
+
+	sysHook.publish(time.Now())
+	payloads := retained(server, "$SYS/test")
+	require.Equal(t, "mochi-mqtt version "+mqtt.Version, payloads["version"])
+	require.Equal(t, "42 seconds", payloads["uptime"])
+	require.Equal(t, "3", payloads["clients/connected"])
+	require.Equal(t, "1.500", payloads["hooks/auth-hook/latency"])
+
+	// the messages published by the hook aren't counted
+	require.Equal(t, "1", payloads["publish/messages/received"])
+}
+
+func TestChanged(t *testing.T) {
+	server := newServer(t)
+	sysHook := newHook(t, Options{Server: server, Interval: time.Hour})
+	require.Eventually(t, func() bool {
+		return retained(server, "$SYS/broker")["version"] != ""
+	}, time.Second, 5*time.Millisecond)
+
+	// the retained messages are counted once the load averages are first published
+	now := time.Now()
+	sysHook.publish(now)
+	sysHook.publish(now)
+	published := sysHook.Stats().Published
+
+	// only the topics which have changed are published again
+	sysHook.publish(now)
+	require.Equal(t, published, sysHook.Stats().Published)
+
+	atomic.StoreInt64(&server.Info.ClientsConnected, 5)
+	sysHook.publish(now)
+	require.Equal(t, published+2, sysHook.Stats().Published)
+	require.Equal(t, "5", retained(server, "$SYS/broker")["clients/connected"])
+	require.Equal(t, "5", retained(server, "$SYS/broker")["clients/active"])
+}
+
+func TestLoad(t *testing.T) {
+	server := newServer(t)
+	sysHook := newHook(t, Options{Server: server, Interval: time.Hour})
+	require.Eventually(t, func() bool {
+		return sysHook.Stats().Published > 0
+	}, time.Second, 5*time.Millisecond)
+
+	// the load averages start once there is an interval to calculate a rate over
+	require.NotContains(t, retained(server, "$SYS/broker"), "load/connections/1min")
+
+	sysHook.mu.Lock()
+	start := sysHook.last
+	sysHook.mu.Unlock()
+
+	// 60 connections over a minute are a rate of 60 a minute, which the averages move towards
+	for i := 0; i < 60; i++ {
+		sysHook.OnSessionEstablished(nil, packets.Packet{})
+	}
+	sysHook.publish(start.Add(time.Minute))
+	payloads := retained(server, "$SYS/broker")
+	require.Equal(t, "37.93", payloads["load/connections/1min"])
+	require.Equal(t, "10.88", payloads["load/connections/5min"])
+	require.Equal(t, "3.87", payloads["load/connections/15min"])
+	require.Equal(t, "0.00", payloads["load/publish/received/1min"])
+
+	// and decay once the connections stop
+	sysHook.publish(start.Add(2 * time.Minute))
+	payloads = retained(server, "$SYS/broker")
+	require.Equal(t, "13.95", payloads["load/connections/1min"])
+}
@@ -0,0 +1,230 @@
+package acl
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	Deny      Access = iota // client cannot access the topic
+	ReadOnly                // client can only subscribe to the topic
+	WriteOnly               // client can only publish to the topic
+	ReadWrite               // client can both publish and subscribe to the topic
+)
+
+// Access determines the read/write privileges granted by a topic filter
+type Access byte
+
+// ParseAccess converts a short access string such as "r", "w" or "rw" into an Access
+func ParseAccess(s string) (Access, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "deny", "none":
+		return Deny, nil
+	case "r", "read":
+		return ReadOnly, nil
+	case "w", "write":
+		return WriteOnly, nil
+	case "rw", "wr", "readwrite":
+		return ReadWrite, nil
+	}
+
+	return Deny, fmt.Errorf("unknown access %q", s)
+}
+
+// String returns the short form of the access
+func (a Access) String() string {
+	switch a {
+	case ReadOnly:
+		return "r"
+	case WriteOnly:
+		return "w"
+	case ReadWrite:
+		return "rw"
+	}
+	return "deny"
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (a Access) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler so access can be written as "r", "w" or "rw" in config files
+func (a *Access) UnmarshalText(b []byte) error {
+	v, err := ParseAccess(string(b))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Allows returns whether the access permits a publish (write) or subscribe (read)
+func (a Access) Allows(write bool) bool {
+	if write {
+		return a == WriteOnly || a == ReadWrite
+	}
+	return a == ReadOnly || a == ReadWrite
+}
+
+// Templates maps topic filter templates to the access they grant, eg. "devices/{sub}/#": ReadWrite
+type Templates map[string]Access
+
+// Render substitutes the {placeholders} in each template with the given values. A template which
+// references a missing value, or a value that would inject topic levels or wildcards, is dropped
+// rather than widened
+func (t Templates) Render(values map[string]string) Filters {
+	filters := make(Filters, len(t))
+	for template, access := range t {
+		filter, ok := render(template, values)
+		if !ok {
+			continue
+		}
+
+		if existing, ok := filters[filter]; ok {
+			access = merge(existing, access)
+		}
+		filters[filter] = access
+	}
+
+	return filters
+}
+
+// merge combines the access of two templates which render to the same filter. A deny always wins,
+// otherwise the read and write grants are combined
+func merge(a, b Access) Access {
+	if a == Deny || b == Deny {
+		return Deny
+	}
+
+	if a != b {
+		return ReadWrite
+	}
+	return a
+}
+
+func render(template string, values map[string]string) (string, bool) {
+	var sb strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			sb.WriteString(template)
+			return sb.String(), true
+		}
+
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", false
+		}
+		end += start
+
+		value, ok := values[template[start+1:end]]
+		if !ok || value == "" || strings.ContainsAny(value, "/+#") {
+			return "", false
+		}
+
+		sb.WriteString(template[:start])
+		sb.WriteString(value)
+		template = template[end+1:]
+	}
+}
+
+// Filters maps rendered topic filters to the access they grant
+type Filters map[string]Access
+
+// Merge adds the filters from other, combining the access of filters present in both
+func (f Filters) Merge(other Filters) {
+	for filter, access := range other {
+		if existing, ok := f[filter]; ok {
+			access = merge(existing, access)
+		}
+		f[filter] = access
+	}
+}
+
+// Allowed returns whether the filters permit access to the topic. Subscription filters are
+// checked level by level, so a wildcard subscription is only allowed when it is fully covered by
+// a granted filter. A Deny filter always takes precedence, and denies subscriptions which overlap it
+func (f Filters) Allowed(topic string, write bool) bool {
+	allowed := false
+	for filter, access := range f {
+		if access == Deny {
+			if Overlaps(filter, topic) {
+				return false
+			}
+			continue
+		}
+
+		if access.Allows(write) && Match(filter, topic) {
+			allowed = true
+		}
+	}
+
+	return allowed
+}
+
+// Match returns whether a topic (or subscription filter) matches the given filter. Wildcards in the
+// topic are only matched by wildcards covering them, so a # level only by #, and a + level by + or #,
+// and $ prefixed topics are never matched by a leading wildcard
+func Match(filter, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+
+	if strings.HasPrefix(topic, "$") && (filterParts[0] == "+" || filterParts[0] == "#") {
+		return false
+	}
+
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+
+		if i >= len(topicParts) {
+			return false
+		}
+
+		switch level := topicParts[i]; {
+		case level == "#":
+			return false
+		case level == "+":
+			if part != "+" {
+				return false
+			}
+		case part != "+" && part != level:
+			return false
+		}
+	}
+
+	return len(filterParts) == len(topicParts)
+}
+
+// Overlaps returns whether any topic matches both filters, eg. whether a subscription may receive
+// messages of a denied filter. $ prefixed levels are never matched by a leading wildcard
+func Overlaps(a, b string) bool {
+	aParts := strings.Split(a, "/")
+	bParts := strings.Split(b, "/")
+
+	if strings.HasPrefix(aParts[0], "$") && wildcard(bParts[0]) || strings.HasPrefix(bParts[0], "$") && wildcard(aParts[0]) {
+		return false
+	}
+
+	for i := 0; ; i++ {
+		aEnd, bEnd := i >= len(aParts), i >= len(bParts)
+		if !aEnd && aParts[i] == "#" || !bEnd && bParts[i] == "#" {
+			return true
+		}
+
+		if aEnd || bEnd {
+			return aEnd && bEnd
+		}
+
+		if aParts[i] != "+" && bParts[i] != "+" && aParts[i] != bParts[i] {
+			return false
+		}
+	}
+}
+
+// wildcard returns whether the level is a wildcard
+func wildcard(level string) bool {
+	return level == "+" || level == "#"
+}
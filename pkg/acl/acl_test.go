@@ -0,0 +1,265 @@
+package acl
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAccess(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		expectAccess Access
+		expectError  bool
+	}{
+		{
+			name:         "Success - read",
+			value:        "r",
+			expectAccess: ReadOnly,
+		},
+		{
+			name:         "Success - write",
+			value:        "w",
+			expectAccess: WriteOnly,
+		},
+		{
+			name:         "Success - read write",
+			value:        "RW",
+			expectAccess: ReadWrite,
+		},
+		{
+			name:         "Success - deny",
+			value:        "deny",
+			expectAccess: Deny,
+		},
+		{
+			name:        "Failure - unknown",
+			value:       "x",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			access, err := ParseAccess(tt.value)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expectAccess, access)
+
+		})
+	}
+}
+
+func TestTemplatesUnmarshal(t *testing.T) {
+	var templates Templates
+	err := json.Unmarshal([]byte(`{"devices/{sub}/#":"rw","tenants/{tenant}/+/status":"r"}`), &templates)
+	require.NoError(t, err)
+	require.Equal(t, Templates{
+		"devices/{sub}/#":           ReadWrite,
+		"tenants/{tenant}/+/status": ReadOnly,
+	}, templates)
+
+	err = json.Unmarshal([]byte(`{"devices/{sub}/#":"rwx"}`), &templates)
+	require.Error(t, err)
+}
+
+func TestRender(t *testing.T) {
+	templates := Templates{
+		"devices/{sub}/#":           ReadWrite,
+		"tenants/{tenant}/+/status": ReadOnly,
+		"shared/{sub}":              WriteOnly,
+		"shared/{id}":               ReadOnly,
+		"broken/{sub":               ReadOnly,
+	}
+
+	tests := []struct {
+		name          string
+		values        map[string]string
+		expectFilters Filters
+	}{
+		{
+			name: "Success - all values present",
+			values: map[string]string{
+				"sub":    "abc",
+				"tenant": "acme",
+				"id":     "abc",
+			},
+			expectFilters: Filters{
+				"devices/abc/#":         ReadWrite,
+				"tenants/acme/+/status": ReadOnly,
+				"shared/abc":            ReadWrite,
+			},
+		},
+		{
+			name: "Success - missing value drops template",
+			values: map[string]string{
+				"sub": "abc",
+			},
+			expectFilters: Filters{
+				"devices/abc/#": ReadWrite,
+				"shared/abc":    WriteOnly,
+			},
+		},
+		{
+			name: "Failure - wildcard injection drops template",
+			values: map[string]string{
+				"sub":    "#",
+				"tenant": "acme/other",
+			},
+			expectFilters: Filters{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectFilters, templates.Render(tt.values))
+
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	filters := Filters{
+		"a/#": ReadOnly,
+		"b/#": ReadWrite,
+	}
+
+	filters.Merge(Filters{
+		"a/#": WriteOnly,
+		"b/#": Deny,
+		"c/#": ReadOnly,
+	})
+
+	require.Equal(t, Filters{
+		"a/#": ReadWrite,
+		"b/#": Deny,
+		"c/#": ReadOnly,
+	}, filters)
+}
+
+func TestAllowed(t *testing.T) {
+	filters := Filters{
+		"devices/abc/#":         ReadWrite,
+		"tenants/acme/+/status": ReadOnly,
+		"devices/abc/secret":    Deny,
+	}
+
+	tests := []struct {
+		name        string
+		topic       string
+		write       bool
+		expectAllow bool
+	}{
+		{
+			name:        "Success - publish to own device",
+			topic:       "devices/abc/telemetry",
+			write:       true,
+			expectAllow: true,
+		},
+		{
+			name:        "Success - subscribe to tenant status",
+			topic:       "tenants/acme/def/status",
+			expectAllow: true,
+		},
+		{
+			name:        "Success - subscribe with covered wildcard",
+			topic:       "devices/abc/+/temp",
+			expectAllow: true,
+		},
+		{
+			name:        "Failure - publish to read only",
+			topic:       "tenants/acme/def/status",
+			write:       true,
+			expectAllow: false,
+		},
+		{
+			name:        "Failure - subscribe with wider wildcard",
+			topic:       "devices/#",
+			expectAllow: false,
+		},
+		{
+			name:        "Failure - denied topic",
+			topic:       "devices/abc/secret",
+			expectAllow: false,
+		},
+		{
+			name:        "Failure - subscription overlapping denied topic",
+			topic:       "devices/abc/+",
+			expectAllow: false,
+		},
+		{
+			name:        "Failure - other device",
+			topic:       "devices/def/telemetry",
+			write:       true,
+			expectAllow: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectAllow, filters.Allowed(tt.topic, tt.write))
+
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	require.True(t, Match("a/+/c", "a/b/c"))
+	require.True(t, Match("a/#", "a"))
+	require.True(t, Match("a/#", "a/b/c"))
+	require.True(t, Match("#", "a/b"))
+	require.False(t, Match("a/b", "a/b/c"))
+	require.False(t, Match("a/b/c", "a/b"))
+	require.False(t, Match("#", "$SYS/broker"))
+	require.False(t, Match("+/broker", "$SYS/broker"))
+	require.True(t, Match("$SYS/#", "$SYS/broker"))
+
+	// wildcards in the topic are only matched by wildcards covering them
+	require.True(t, Match("a/+", "a/+"))
+	require.True(t, Match("a/#", "a/+"))
+	require.True(t, Match("a/#", "a/#"))
+	require.False(t, Match("a/b", "a/+"))
+	require.False(t, Match("a/+", "a/#"))
+	require.False(t, Match("a/b", "a/#"))
+	require.False(t, Match("a/+/c", "a/#"))
+}
+
+func TestAllowedWildcards(t *testing.T) {
+	filters := Filters{"devices/alice/+": ReadOnly}
+	require.True(t, filters.Allowed("devices/alice/a", false))
+	require.True(t, filters.Allowed("devices/alice/+", false))
+	require.False(t, filters.Allowed("devices/alice/a/b", false))
+	require.False(t, filters.Allowed("devices/alice/#", false))
+
+	filters = Filters{"devices/#": ReadOnly, "devices/secret/#": Deny}
+	require.True(t, filters.Allowed("devices/public/a", false))
+	require.False(t, filters.Allowed("devices/secret/a", false))
+	require.False(t, filters.Allowed("devices/#", false))
+	require.False(t, filters.Allowed("devices/+/a", false))
+	require.False(t, filters.Allowed("+/secret", false))
+	require.True(t, filters.Allowed("devices/public/#", false))
+}
+
+func TestOverlaps(t *testing.T) {
+	require.True(t, Overlaps("a/b", "a/b"))
+	require.True(t, Overlaps("a/+", "+/b"))
+	require.True(t, Overlaps("a/#", "a"))
+	require.True(t, Overlaps("a", "a/#"))
+	require.True(t, Overlaps("#", "a/b/c"))
+	require.True(t, Overlaps("a/secret/#", "a/#"))
+	require.True(t, Overlaps("$SYS/#", "$SYS/+"))
+	require.False(t, Overlaps("a/b", "a/c"))
+	require.False(t, Overlaps("a/+", "a/b/c"))
+	require.False(t, Overlaps("a/b", "a"))
+	require.False(t, Overlaps("#", "$SYS/broker"))
+	require.False(t, Overlaps("$SYS/#", "+/broker"))
+}
@@ -0,0 +1,58 @@
+package acl
+
+import (
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+)
+
+// Sessions holds the rendered filters of each connected client. The zero value is ready to use
+type Sessions struct {
+	filters map[*mqtt.Client]Filters
+	mu      sync.RWMutex
+}
+
+// Set stores the filters for the client, replacing any previous filters
+func (s *Sessions) Set(cl *mqtt.Client, filters Filters) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.filters == nil {
+		s.filters = make(map[*mqtt.Client]Filters)
+	}
+	s.filters[cl] = filters
+}
+
+// Get returns the filters stored for the client
+func (s *Sessions) Get(cl *mqtt.Client) (Filters, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	filters, ok := s.filters[cl]
+	return filters, ok
+}
+
+// Allowed returns whether the client's filters permit access to the topic. Clients without
+// stored filters are denied
+func (s *Sessions) Allowed(cl *mqtt.Client, topic string, write bool) bool {
+	filters, ok := s.Get(cl)
+	if !ok {
+		return false
+	}
+	return filters.Allowed(topic, write)
+}
+
+// Delete removes the filters stored for the client
+func (s *Sessions) Delete(cl *mqtt.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.filters, cl)
+}
+
+// Refresh replaces the filters of every client with those the render func returns, eg. after the
+// rules they are rendered from are reloaded
+func (s *Sessions) Refresh(render func(cl *mqtt.Client) Filters) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for cl := range s.filters {
+		s.filters[cl] = render(cl)
+	}
+}
@@ -0,0 +1,47 @@
+package acl
+
+import (
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	var sessions Sessions
+	cl := &mqtt.Client{ID: "client"}
+
+	require.False(t, sessions.Allowed(cl, "a/b", true))
+
+	sessions.Set(cl, Filters{"a/#": WriteOnly})
+	filters, ok := sessions.Get(cl)
+	require.True(t, ok)
+	require.Equal(t, Filters{"a/#": WriteOnly}, filters)
+	require.True(t, sessions.Allowed(cl, "a/b", true))
+	require.False(t, sessions.Allowed(cl, "a/b", false))
+	require.False(t, sessions.Allowed(&mqtt.Client{ID: "client"}, "a/b", true))
+
+	sessions.Delete(cl)
+	require.False(t, sessions.Allowed(cl, "a/b", true))
+}
+
+func TestSessionsRefresh(t *testing.T) {
+	var sessions Sessions
+	sessions.Refresh(func(cl *mqtt.Client) Filters { return Filters{"#": ReadWrite} })
+
+	a := &mqtt.Client{ID: "a"}
+	b := &mqtt.Client{ID: "b"}
+	sessions.Set(a, Filters{"old/#": ReadWrite})
+	sessions.Set(b, Filters{"old/#": ReadWrite})
+
+	templates := Templates{"new/{clientid}": ReadWrite}
+	sessions.Refresh(func(cl *mqtt.Client) Filters {
+		return templates.Render(map[string]string{"clientid": cl.ID})
+	})
+
+	require.False(t, sessions.Allowed(a, "old/x", true))
+	require.True(t, sessions.Allowed(a, "new/a", true))
+	require.True(t, sessions.Allowed(b, "new/b", true))
+	require.False(t, sessions.Allowed(b, "new/a", true))
+	require.False(t, sessions.Allowed(&mqtt.Client{ID: "c"}, "new/c", true))
+}
@@ -0,0 +1,637 @@
+// Package bridge is the framework of the hooks forwarding messages published to the broker to external
+// systems, such as Kafka, SNS or Pub/Sub. A bridge routes each message to the first route whose topic
+// filter matches it, has the Sink of the connector encode it as a record, queues the record, and sends
+// the records of each route in batches from workers in the background, retrying those which fail, so
+// a connector only implements Encode and Send.
+//
+// The queue holds QueueSize records in memory. Records queued while it is full are dropped, or
+// overflow into more memory or into a spool of files on disk by the Overflow policy, and are sent once
+// the queue has drained. With a Buffer, records are queued in segment files on disk instead, so those
+// which haven't been sent survive restarts of the broker and long outages of the external system.
+// Records overflowing or buffered to disk are stored as JSON, so the records of connectors using
+// OverflowDisk or a Buffer must survive being marshalled and unmarshalled.
+//
+// A connector embeds a bridge in its hook, eg.
+//
+//	func (h *Hook) Init(config any) error {
+//		...
+//		h.bridge, err = bridge.New[*Message](sink{client, rules}, options.Bridge, h.Log)
+//		return err
+//	}
+//
+//	func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+//		h.bridge.Publish(cl, pk)
+//	}
+//
+//	func (h *Hook) Stop() error {
+//		return h.bridge.Close()
+//	}
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/filter"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+	"github.com/mochi-mqtt/hooks/pkg/transform"
+)
+
+// the overflow policies of the queue
+const (
+	OverflowDrop   = "drop"   // records queued while the queue is full are dropped
+	OverflowMemory = "memory" // records overflow into up to OverflowSize more records in memory
+	OverflowDisk   = "disk"   // records overflow into up to OverflowSize records spooled to OverflowDir
+)
+
+// the drop policies of the queue, once it and its overflow are full
+const (
+	DropNewest = "newest" // the record being queued is dropped
+	DropOldest = "oldest" // the oldest record queued is dropped
+	DropQoS    = "qos"    // the oldest QoS 0 record in memory is dropped for a record with a higher QoS
+)
+
+// Sink is the connector of a bridge, which encodes messages as records and sends them to an external
+// system
+type Sink[R any] interface {
+	// Encode returns the record of the message published by the client, which matched the filter of the
+	// route. Messages whose records can't be encoded are discarded
+	Encode(route int, cl *mqtt.Client, pk packets.Packet) (R, error)
+
+	// Send sends a batch of records of the route. A batch which fails is sent again by the retry policy,
+	// unless the error is marked by retry.Permanent. If only some of the records failed, Send returns a
+	// *PartialError, so only those are sent again
+	Send(ctx context.Context, route int, records []R) error
+}
+
+// PartialError is returned by the Send of a sink when only some records of a batch failed, with the
+// indexes of those records in the batch
+type PartialError struct {
+	Failed []int
+	Err    error
+}
+
+// Error returns the error of the failed records
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error of the failed records
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Metrics are called as records are sent. Unset funcs are skipped
+type Metrics struct {
+	// Sent is called after the records of a batch of the route have been sent, with how long sending
+	// the batch took
+	Sent func(route int, records int, took time.Duration)
+
+	// Retried is called after records of a batch of the route could not be sent, and are to be retried
+	Retried func(route int, records int, err error)
+
+	// Failed is called after records of the route could not be encoded, or those of a batch sent, and
+	// are discarded
+	Failed func(route int, records int, err error)
+
+	// Dropped is called for a record of the route which is discarded as the queue is full
+	Dropped func(route int)
+
+	// Overflowed is called for a record of the route which is queued in the overflow
+	Overflowed func(route int)
+
+	// Blocked is called after a record of the route has waited for room in the queue, with how long
+	Blocked func(route int, waited time.Duration)
+}
+
+// Warning is the JSON payload published to the warning topic while records are dropped
+type Warning struct {
+	Bridge  string `json:"bridge"`
+	Dropped int64  `json:"dropped"` // the records dropped since the last warning
+	Total   int64  `json:"total"`   // the records dropped since the bridge was created
+}
+
+// Stats are the totals of the records of a bridge since it was created
+type Stats struct {
+	Queued     int64 // the number of records waiting to be sent, including those in the overflow or buffer
+	Batches    int64 // the number of batches sent, or which failed
+	Sent       int64 // the number of records sent
+	Failed     int64 // the number of records which could not be encoded or sent
+	Dropped    int64 // the number of records discarded as the queue was full
+	Overflowed int64 // the number of records which were queued in the overflow
+	Blocked    int64 // the number of records which waited for room in the queue
+}
+
+// Buffer configures the persistent buffer of a bridge, which queues records in segment files in Dir.
+// Records are kept until they have been sent or failed, and records read but not sent when the broker
+// stops are sent again once it restarts, so they are delivered at least once
+type Buffer struct {
+	Dir string
+
+	// MaxSize is the most bytes of records waiting to be sent, defaults to 1 GiB. Records queued while
+	// the buffer is full are dropped, or drop the oldest records waiting if DropOldest is set
+	MaxSize    int64
+	DropOldest bool
+
+	// SegmentSize is the size segments grow to before records are appended to a new one, defaults to
+	// 16 MiB. Segments are deleted once all of their records have been sent
+	SegmentSize int64
+}
+
+// Options configures a bridge
+type Options struct {
+	// Filters are the MQTT topic filters of the routes, which may contain +/# wildcards. A message is
+	// encoded by the first route whose filter matches its topic, or by every such route if Fanout is
+	// set, and messages matching none aren't sent
+	Filters []string
+	Fanout  bool
+
+	// Where are the filter expressions of the routes with the same indexes, which messages must also
+	// match, eg. json.temperature > 30. Routes without one match every message of their filter
+	Where []string
+
+	// Transform are the templates (see pkg/transform) of the routes with the same indexes, which the
+	// payloads of messages are rewritten with before they are encoded, eg. transform.Envelope
+	Transform []string
+
+	// BatchSize is how many records of a route are sent at once, and defaults to 1. A batch is sent once
+	// it is full or its first record has waited for Linger, which defaults to 1 second. BatchSizes are
+	// those of the routes with the same indexes, which default to BatchSize
+	BatchSize  int
+	BatchSizes []int
+	Linger     time.Duration
+
+	Workers int           // how many batches are sent at once, defaults to 1, so records are sent in order
+	Timeout time.Duration // how long sending a batch may take, defaults to 10 seconds
+
+	// QueueSize is how many records wait to be sent in memory, defaults to 10000. Records queued while
+	// it is full are handled by the Overflow policy, which defaults to OverflowDrop
+	QueueSize int
+	Overflow  string
+
+	// OverflowSize is how many records the overflow holds, defaults to 10 times QueueSize, and
+	// OverflowDir is the directory records are spooled to with OverflowDisk. Its spool is deleted when
+	// the bridge is created and closed, so records are only kept on disk while the broker runs
+	OverflowSize int
+	OverflowDir  string
+
+	// Drop is the policy dropping records once the queue and its overflow are full, and defaults to
+	// DropNewest. Records queued while the queue is full first wait for up to Block for room, blocking
+	// the publishing client, which defaults to not waiting
+	Drop  string
+	Block time.Duration
+
+	// Server publishes a Warning to WarningTopic when records are dropped, at most once every
+	// WarningInterval, which defaults to 10 seconds. The server needs its inline client enabled.
+	// WarningTopic defaults to $SYS/bridges/{name}/dropped, where {name} is Name, which defaults to
+	// bridge
+	Server          *mqtt.Server
+	Name            string
+	WarningTopic    string
+	WarningInterval time.Duration
+
+	// Buffer queues records on disk rather than in memory if it is set, and QueueSize, Overflow and
+	// Drop are ignored. Records waiting in the buffer when the bridge closes are sent once it is created again
+	Buffer *Buffer
+
+	// Retry retries batches which fail, and must limit the attempts or the time spent. Batches are sent
+	// once if it is nil
+	Retry *retry.Policy
+
+	Metrics Metrics
+}
+
+// Bridge routes, queues and sends the records of messages through its sink
+type Bridge[R any] struct {
+	options  Options
+	where    []*filter.Expr        // of the routes
+	tmpls    []*transform.Template // of the routes
+	batches  []int                 // the batch sizes of the routes
+	sink     Sink[R]
+	log      *slog.Logger
+	queue    *queue[R]
+	stats    Stats
+	warned   time.Time // when the last warning was published
+	warnedAt int64     // the records dropped when the last warning was published
+	wg       sync.WaitGroup
+	statsMu  sync.Mutex
+}
+
+// New returns a bridge sending the records of messages through the sink, and starts its workers
+func New[R any](sink Sink[R], options Options, log *slog.Logger) (*Bridge[R], error) {
+	if sink == nil {
+		return nil, errors.New("sink is required")
+	}
+
+	if len(options.Filters) == 0 {
+		return nil, errors.New("at least one route is required")
+	}
+
+	for i, f := range options.Filters {
+		if !mqtt.IsValidFilter(f, false) {
+			return nil, fmt.Errorf("route %d has invalid topic filter %q", i, f)
+		}
+	}
+
+	if len(options.Where) > len(options.Filters) {
+		return nil, errors.New("more filter expressions than routes")
+	}
+
+	where := make([]*filter.Expr, len(options.Filters))
+	for i, src := range options.Where {
+		var err error
+		if where[i], err = filter.Compile(src); err != nil {
+			return nil, fmt.Errorf("route %d %w", i, err)
+		}
+	}
+
+	if len(options.Transform) > len(options.Filters) {
+		return nil, errors.New("more transforms than routes")
+	}
+
+	tmpls := make([]*transform.Template, len(options.Filters))
+	for i, src := range options.Transform {
+		var err error
+		if tmpls[i], err = transform.Compile(src); err != nil {
+			return nil, fmt.Errorf("route %d %w", i, err)
+		}
+	}
+
+	if options.Retry != nil && options.Retry.MaxAttempts == 0 && options.Retry.MaxElapsed == 0 {
+		return nil, errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1
+	}
+
+	if len(options.BatchSizes) > len(options.Filters) {
+		return nil, errors.New("more batch sizes than routes")
+	}
+
+	batches := make([]int, len(options.Filters))
+	for i := range batches {
+		batches[i] = options.BatchSize
+		if i < len(options.BatchSizes) && options.BatchSizes[i] > 0 {
+			batches[i] = options.BatchSizes[i]
+		}
+	}
+
+	if options.Linger <= 0 {
+		options.Linger = time.Second
+	}
+
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = 10 * time.Second
+	}
+
+	if options.QueueSize <= 0 {
+		options.QueueSize = 10000
+	}
+
+	if options.OverflowSize <= 0 {
+		options.OverflowSize = 10 * options.QueueSize
+	}
+
+	switch options.Drop {
+	case "":
+		options.Drop = DropNewest
+	case DropNewest, DropOldest, DropQoS:
+	default:
+		return nil, fmt.Errorf("invalid drop policy %q", options.Drop)
+	}
+
+	if options.Name == "" {
+		options.Name = "bridge"
+	}
+
+	if options.WarningTopic == "" {
+		options.WarningTopic = "$SYS/bridges/{name}/dropped"
+	}
+	options.WarningTopic = strings.ReplaceAll(options.WarningTopic, "{name}", options.Name)
+
+	if options.WarningInterval <= 0 {
+		options.WarningInterval = 10 * time.Second
+	}
+
+	if options.Buffer != nil {
+		if options.Buffer.Dir == "" {
+			return nil, errors.New("buffer dir is required")
+		}
+
+		buffer := *options.Buffer
+		if buffer.MaxSize <= 0 {
+			buffer.MaxSize = 1 << 30
+		}
+
+		if buffer.SegmentSize <= 0 {
+			buffer.SegmentSize = 16 << 20
+		}
+		options.Buffer = &buffer
+	}
+
+	b := &Bridge[R]{options: options, where: where, tmpls: tmpls, batches: batches, sink: sink, log: log}
+
+	var sp *spool
+	switch options.Overflow {
+	case "", OverflowDrop:
+		b.options.Overflow = OverflowDrop
+	case OverflowMemory:
+	case OverflowDisk:
+		if options.OverflowDir == "" {
+			return nil, errors.New("overflow dir is required to overflow to disk")
+		}
+
+		if options.Buffer != nil {
+			break // the overflow is ignored
+		}
+
+		var err error
+		if sp, err = openSpool(options.OverflowDir, 4<<20); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid overflow policy %q", options.Overflow)
+	}
+
+	b.queue = newQueue[R](options.QueueSize, b.options.Overflow, options.Drop, options.OverflowSize, sp, func(err error) {
+		log.Error("error occurred while spooling bridge records", "error", err)
+	})
+	b.queue.onDrop = b.drop
+
+	if options.Buffer != nil {
+		buf, err := openBuffer(options.Buffer.Dir, options.Buffer.SegmentSize, options.Buffer.MaxSize, options.Buffer.DropOldest)
+		if err != nil {
+			return nil, err
+		}
+
+		b.queue.buffer = buf
+	}
+
+	for i := 0; i < options.Workers; i++ {
+		b.wg.Add(1)
+		go b.work()
+	}
+
+	return b, nil
+}
+
+// Close stops queueing records, and waits for the queued records to be sent, or for the batches being
+// sent if there is a buffer
+func (b *Bridge[R]) Close() error {
+	b.queue.close()
+	b.wg.Wait()
+
+	if b.queue.spool != nil {
+		return b.queue.spool.close()
+	}
+
+	if b.queue.buffer != nil {
+		return b.queue.buffer.close()
+	}
+	return nil
+}
+
+// Stats returns the totals of the records so far
+func (b *Bridge[R]) Stats() Stats {
+	b.statsMu.Lock()
+	stats := b.stats
+	b.statsMu.Unlock()
+
+	stats.Queued = int64(b.queue.len())
+	return stats
+}
+
+// Publish encodes the message published by the client with the first route whose filter matches its
+// topic, and whose filter expression it matches, once its payload is transformed by the template of
+// the route, and queues its record to be sent. With Fanout, it does so with every such route. It
+// returns whether a route matched
+func (b *Bridge[R]) Publish(cl *mqtt.Client, pk packets.Packet) bool {
+	matched := false
+	for route, f := range b.options.Filters {
+		if !acl.Match(f, pk.TopicName) || !b.where[route].Match(cl, pk) {
+			continue
+		}
+
+		matched = true
+		pk, err := b.tmpls[route].Apply(cl, pk)
+		var record R
+		if err == nil {
+			record, err = b.sink.Encode(route, cl, pk)
+		}
+
+		if err != nil {
+			b.statsMu.Lock()
+			b.stats.Failed++
+			b.statsMu.Unlock()
+
+			b.log.Error("error occurred while encoding bridge record", "error", err, "topic", pk.TopicName)
+			if b.options.Metrics.Failed != nil {
+				b.options.Metrics.Failed(route, 1, err)
+			}
+		} else {
+			b.enqueue(item[R]{Route: route, Qos: pk.FixedHeader.Qos, Record: record})
+		}
+
+		if !b.options.Fanout {
+			break
+		}
+	}
+	return matched
+}
+
+// enqueue queues the item, counting it as overflowed, blocked or dropped
+func (b *Bridge[R]) enqueue(it item[R]) {
+	start := time.Now()
+	result, waited := b.queue.push(it, b.options.Block)
+	if waited {
+		b.statsMu.Lock()
+		b.stats.Blocked++
+		b.statsMu.Unlock()
+
+		if b.options.Metrics.Blocked != nil {
+			b.options.Metrics.Blocked(it.Route, time.Since(start))
+		}
+	}
+
+	switch result {
+	case pushOverflowed:
+		b.statsMu.Lock()
+		b.stats.Overflowed++
+		b.statsMu.Unlock()
+
+		if b.options.Metrics.Overflowed != nil {
+			b.options.Metrics.Overflowed(it.Route)
+		}
+	case pushDropped:
+		b.drop(it.Route)
+	}
+}
+
+// drop counts a record of the route which was discarded as the queue is full, and publishes a warning
+// if one hasn't been published for the warning interval. It's called while the queue is locked, so the
+// warning is published in the background, as publishing it may queue it
+func (b *Bridge[R]) drop(route int) {
+	b.statsMu.Lock()
+	b.stats.Dropped++
+	w := Warning{Bridge: b.options.Name, Dropped: b.stats.Dropped - b.warnedAt, Total: b.stats.Dropped}
+	warn := b.options.Server != nil && time.Since(b.warned) >= b.options.WarningInterval
+	if warn {
+		b.warned, b.warnedAt = time.Now(), b.stats.Dropped
+	}
+	b.statsMu.Unlock()
+
+	b.log.Warn("dropped bridge record as queue is full", "route", b.options.Filters[route])
+	if b.options.Metrics.Dropped != nil {
+		b.options.Metrics.Dropped(route)
+	}
+
+	if warn {
+		b.wg.Add(1)
+		go b.warn(w)
+	}
+}
+
+// warn publishes the warning to the warning topic
+func (b *Bridge[R]) warn(w Warning) {
+	defer b.wg.Done()
+
+	payload, err := json.Marshal(w)
+	if err != nil {
+		return
+	}
+
+	if err := b.options.Server.Publish(b.options.WarningTopic, payload, false, 0); err != nil {
+		b.log.Error("error occurred while publishing bridge warning", "error", err, "topic", b.options.WarningTopic)
+	}
+}
+
+// work sends the queued records in a batch for each route until the queue is closed and empty. A batch
+// is sent once it is full, or when the first record popped since the last batches were sent has
+// lingered
+func (b *Bridge[R]) work() {
+	defer b.wg.Done()
+
+	batches := map[int][]item[R]{}
+	var linger <-chan time.Time
+	flush := func() {
+		for route, batch := range batches {
+			b.send(route, batch)
+		}
+		clear(batches)
+		linger = nil
+	}
+
+	for {
+		it, ok := b.queue.pop(linger)
+		if !ok {
+			flush()
+			if b.queue.closedAndEmpty() {
+				return
+			}
+			continue
+		}
+
+		batch := append(batches[it.Route], it)
+		if len(batch) >= b.batches[it.Route] {
+			b.send(it.Route, batch)
+			delete(batches, it.Route)
+			if len(batches) == 0 {
+				linger = nil
+			}
+			continue
+		}
+
+		batches[it.Route] = batch
+		if linger == nil {
+			linger = time.After(b.options.Linger)
+		}
+	}
+}
+
+// send sends the batch of records of the route, retrying those which fail if there is a policy, and
+// acknowledges them once they have been sent or failed
+func (b *Bridge[R]) send(route int, items []item[R]) {
+	defer b.queue.ack(items)
+
+	records := make([]R, len(items))
+	for i, it := range items {
+		records[i] = it.Record
+	}
+
+	pending := records // the records not sent yet
+	attempt := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, b.options.Timeout)
+		defer cancel()
+
+		err := b.sink.Send(ctx, route, pending)
+		var partial *PartialError
+		if errors.As(err, &partial) {
+			failed := make([]R, 0, len(partial.Failed))
+			for _, i := range partial.Failed {
+				failed = append(failed, pending[i])
+			}
+			pending = failed
+			return partial.Err
+		}
+
+		if err == nil {
+			pending = nil
+		}
+		return err
+	}
+
+	start := time.Now()
+	err := attempt(context.Background())
+	if b.options.Retry != nil {
+		backoff := b.options.Retry.NewBackoff()
+		for err != nil && !retry.IsPermanent(err) {
+			d, ok := backoff.Next()
+			if !ok {
+				break
+			}
+
+			if b.options.Metrics.Retried != nil {
+				b.options.Metrics.Retried(route, len(pending), err)
+			}
+			time.Sleep(d)
+			err = attempt(context.Background())
+		}
+	}
+
+	if err == nil {
+		pending = nil
+	}
+
+	sent := len(records) - len(pending)
+	b.statsMu.Lock()
+	b.stats.Batches++
+	b.stats.Sent += int64(sent)
+	b.stats.Failed += int64(len(pending))
+	b.statsMu.Unlock()
+
+	if err != nil {
+		b.log.Error("error occurred while sending bridge records", "error", err, "route", b.options.Filters[route], "records", len(pending))
+		if b.options.Metrics.Failed != nil {
+			b.options.Metrics.Failed(route, len(pending), err)
+		}
+	}
+
+	if sent > 0 && b.options.Metrics.Sent != nil {
+		b.options.Metrics.Sent(route, sent, time.Since(start))
+	}
+}
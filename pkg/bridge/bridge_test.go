@@ -0,0 +1,666 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// record is the record of the test sink
+type record struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+}
+
+// testSink records the batches it sends, failing the next sends with the queued errors
+type testSink struct {
+	batches map[int][][]record
+	errs    []error
+	sends   int
+	block   chan struct{} // sends wait for it to be closed, if set
+	mu      sync.Mutex
+}
+
+func newTestSink() *testSink {
+	return &testSink{batches: map[int][][]record{}}
+}
+
+func (s *testSink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (record, error) {
+	if string(pk.Payload) == "invalid" {
+		return record{}, errors.New("invalid payload")
+	}
+	return record{Topic: pk.TopicName, Payload: string(pk.Payload)}, nil
+}
+
+func (s *testSink) Send(ctx context.Context, route int, records []record) error {
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sends++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		return err
+	}
+
+	s.batches[route] = append(s.batches[route], append([]record(nil), records...))
+	return nil
+}
+
+// sent returns the payloads sent for the route, in order
+func (s *testSink) sent(route int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var payloads []string
+	for _, batch := range s.batches[route] {
+		for _, r := range batch {
+			payloads = append(payloads, r.Payload)
+		}
+	}
+	return payloads
+}
+
+func newBridge(t *testing.T, sink *testSink, options Options) *Bridge[record] {
+	t.Helper()
+
+	b, err := New[record](sink, options, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	require.NoError(t, err)
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func publish(b *Bridge[record], topic, payload string) bool {
+	return publishQos(b, topic, payload, 0)
+}
+
+func publishQos(b *Bridge[record], topic, payload string, qos byte) bool {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	return b.Publish(cl, packets.Packet{FixedHeader: packets.FixedHeader{Qos: qos}, TopicName: topic, Payload: []byte(payload)})
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     Options
+		expectError bool
+	}{
+		{
+			name:        "Success - defaults",
+			options:     Options{Filters: []string{"#"}},
+			expectError: false,
+		},
+		{
+			name:        "Success - disk overflow",
+			options:     Options{Filters: []string{"#"}, Overflow: OverflowDisk, OverflowDir: t.TempDir()},
+			expectError: false,
+		},
+		{
+			name:        "Success - buffer",
+			options:     Options{Filters: []string{"#"}, Buffer: &Buffer{Dir: t.TempDir()}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - no routes",
+			options:     Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			options:     Options{Filters: []string{"a/#/b"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid where",
+			options:     Options{Filters: []string{"#"}, Where: []string{"size >"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - more batch sizes than routes",
+			options:     Options{Filters: []string{"#"}, BatchSizes: []int{1, 1}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - more where than routes",
+			options:     Options{Filters: []string{"#"}, Where: []string{"", ""}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid transform",
+			options:     Options{Filters: []string{"#"}, Transform: []string{"{{.Topic"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - more transforms than routes",
+			options:     Options{Filters: []string{"#"}, Transform: []string{"", ""}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			options:     Options{Filters: []string{"#"}, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid overflow",
+			options:     Options{Filters: []string{"#"}, Overflow: "block"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid drop policy",
+			options:     Options{Filters: []string{"#"}, Drop: "random"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no buffer dir",
+			options:     Options{Filters: []string{"#"}, Buffer: &Buffer{}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no overflow dir",
+			options:     Options{Filters: []string{"#"}, Overflow: OverflowDisk},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := New[record](newTestSink(), tt.options, slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, b.Close())
+			require.Equal(t, 1, b.options.BatchSize)
+			require.Equal(t, 1, b.options.Workers)
+			require.Equal(t, 10000, b.options.QueueSize)
+			require.Equal(t, 100000, b.options.OverflowSize)
+			require.Equal(t, DropNewest, b.options.Drop)
+			require.Equal(t, "$SYS/bridges/bridge/dropped", b.options.WarningTopic)
+		})
+	}
+}
+
+func TestRoute(t *testing.T) {
+	sink := newTestSink()
+	var sent, failed []int
+	b := newBridge(t, sink, Options{
+		Filters: []string{"devices/+/events", "devices/#"},
+		Metrics: Metrics{
+			Sent:   func(route, records int, took time.Duration) { sent = append(sent, route) },
+			Failed: func(route, records int, err error) { failed = append(failed, route) },
+		},
+	})
+
+	// the first route matching a topic applies, and the queued records are sent when the bridge closes
+	require.True(t, publish(b, "devices/d1/events", "1"))
+	require.True(t, publish(b, "devices/d1/status", "2"))
+	require.False(t, publish(b, "other", "3"))
+	require.True(t, publish(b, "devices/d1/status", "invalid"))
+	require.NoError(t, b.Close())
+
+	require.Equal(t, []string{"1"}, sink.sent(0))
+	require.Equal(t, []string{"2"}, sink.sent(1))
+	require.Equal(t, []int{0, 1}, sent)
+	require.Equal(t, []int{1}, failed)
+	require.Equal(t, Stats{Batches: 2, Sent: 2, Failed: 1}, b.Stats())
+
+	// records published once the bridge has closed are ignored
+	require.True(t, publish(b, "devices/d1/status", "4"))
+	require.Equal(t, Stats{Batches: 2, Sent: 2, Failed: 1}, b.Stats())
+}
+
+func TestWhere(t *testing.T) {
+	sink := newTestSink()
+	b := newBridge(t, sink, Options{
+		Filters: []string{"devices/#", "devices/#"},
+		Where:   []string{`payload contains "alarm"`},
+	})
+
+	// messages not matching the expression of a route fall through to the next
+	require.True(t, publish(b, "devices/d1", "alarm 1"))
+	require.True(t, publish(b, "devices/d1", "2"))
+	require.NoError(t, b.Close())
+
+	require.Equal(t, []string{"alarm 1"}, sink.sent(0))
+	require.Equal(t, []string{"2"}, sink.sent(1))
+}
+
+func TestTransform(t *testing.T) {
+	sink := newTestSink()
+	b := newBridge(t, sink, Options{
+		Filters:   []string{"devices/+/events", "devices/#"},
+		Transform: []string{`{{index .Levels 1}}:{{.Payload}}`, `{{index .Levels 5}}`},
+	})
+
+	// messages which can't be transformed fail
+	require.True(t, publish(b, "devices/d1/events", "1"))
+	require.True(t, publish(b, "devices/d1/status", "2"))
+	require.NoError(t, b.Close())
+
+	require.Equal(t, []string{"d1:1"}, sink.sent(0))
+	require.Empty(t, sink.sent(1))
+	require.Equal(t, Stats{Batches: 1, Sent: 1, Failed: 1}, b.Stats())
+}
+
+func TestBatch(t *testing.T) {
+	sink := newTestSink()
+	b := newBridge(t, sink, Options{Filters: []string{"a", "b"}, BatchSize: 2, Linger: time.Hour})
+
+	// full batches are sent at once, and the rest once the bridge closes
+	publish(b, "a", "1")
+	publish(b, "b", "2")
+	publish(b, "a", "3")
+	require.Eventually(t, func() bool {
+		return len(sink.sent(0)) == 2
+	}, time.Second, time.Millisecond)
+	require.Empty(t, sink.sent(1))
+
+	require.NoError(t, b.Close())
+	require.Equal(t, [][]record{{{Topic: "a", Payload: "1"}, {Topic: "a", Payload: "3"}}}, sink.batches[0])
+	require.Equal(t, []string{"2"}, sink.sent(1))
+}
+
+func TestBatchSizes(t *testing.T) {
+	sink := newTestSink()
+	b := newBridge(t, sink, Options{Filters: []string{"a", "b"}, BatchSize: 2, BatchSizes: []int{0, 1}, Linger: time.Hour})
+
+	// the batches of routes with their own size are sent once they are full
+	publish(b, "a", "1")
+	publish(b, "b", "2")
+	require.Eventually(t, func() bool {
+		return len(sink.sent(1)) == 1
+	}, time.Second, time.Millisecond)
+	require.Empty(t, sink.sent(0))
+
+	require.NoError(t, b.Close())
+	require.Equal(t, []string{"1"}, sink.sent(0))
+}
+
+func TestFanout(t *testing.T) {
+	sink := newTestSink()
+	b := newBridge(t, sink, Options{Filters: []string{"devices/#", "devices/+/events", "other"}, Fanout: true})
+
+	// messages are encoded by every route whose filter matches
+	require.True(t, publish(b, "devices/d1/events", "1"))
+	require.True(t, publish(b, "devices/d1/status", "2"))
+	require.False(t, publish(b, "none", "3"))
+	require.NoError(t, b.Close())
+
+	require.Equal(t, []string{"1", "2"}, sink.sent(0))
+	require.Equal(t, []string{"1"}, sink.sent(1))
+	require.Empty(t, sink.sent(2))
+	require.Equal(t, Stats{Batches: 3, Sent: 3}, b.Stats())
+}
+
+func TestBatchLinger(t *testing.T) {
+	sink := newTestSink()
+	b := newBridge(t, sink, Options{Filters: []string{"#"}, BatchSize: 10, Linger: 10 * time.Millisecond})
+
+	publish(b, "a", "1")
+	publish(b, "a", "2")
+	require.Eventually(t, func() bool {
+		return len(sink.sent(0)) == 2
+	}, time.Second, time.Millisecond)
+	require.Len(t, sink.batches[0], 1)
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := errors.New("unavailable")
+	sink := newTestSink()
+	sink.errs = []error{unavailable, unavailable, unavailable, unavailable}
+	var retried, failed []error
+	b := newBridge(t, sink, Options{
+		Filters: []string{"#"},
+		Retry:   &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+		Metrics: Metrics{
+			Retried: func(route, records int, err error) { retried = append(retried, err) },
+			Failed:  func(route, records int, err error) { failed = append(failed, err) },
+		},
+	})
+
+	// the first record fails three times and is discarded, and the second succeeds when retried
+	publish(b, "a", "1")
+	publish(b, "a", "2")
+	require.NoError(t, b.Close())
+
+	require.Equal(t, []error{unavailable, unavailable, unavailable}, retried)
+	require.Equal(t, []error{unavailable}, failed)
+	require.Equal(t, []string{"2"}, sink.sent(0))
+	require.Equal(t, 5, sink.sends)
+	require.Equal(t, Stats{Batches: 2, Sent: 1, Failed: 1}, b.Stats())
+}
+
+func TestPartialRetry(t *testing.T) {
+	throttled := errors.New("throttled")
+	sink := newTestSink()
+	sink.errs = []error{&PartialError{Failed: []int{1}, Err: throttled}, throttled}
+	var sent []int
+	b := newBridge(t, sink, Options{
+		Filters:   []string{"#"},
+		BatchSize: 3,
+		Linger:    time.Hour,
+		Retry:     &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+		Metrics: Metrics{
+			Sent: func(route, records int, took time.Duration) { sent = append(sent, records) },
+		},
+	})
+
+	// the record which failed is sent again alone, until it is sent
+	publish(b, "a", "1")
+	publish(b, "a", "2")
+	publish(b, "a", "3")
+	require.NoError(t, b.Close())
+
+	require.Equal(t, [][]record{{{Topic: "a", Payload: "2"}}}, sink.batches[0])
+	require.Equal(t, []int{3}, sent)
+	require.Equal(t, Stats{Batches: 1, Sent: 3}, b.Stats())
+}
+
+func TestPartialFailure(t *testing.T) {
+	sink := newTestSink()
+	sink.errs = []error{&PartialError{Failed: []int{0}, Err: errors.New("invalid")}}
+	var sent, failed int
+	b := newBridge(t, sink, Options{
+		Filters:   []string{"#"},
+		BatchSize: 2,
+		Linger:    time.Hour,
+		Metrics: Metrics{
+			Sent:   func(route, records int, took time.Duration) { sent += records },
+			Failed: func(route, records int, err error) { failed += records },
+		},
+	})
+
+	// without a retry policy, the record which failed is discarded
+	publish(b, "a", "1")
+	publish(b, "a", "2")
+	require.NoError(t, b.Close())
+
+	require.Equal(t, 1, sent)
+	require.Equal(t, 1, failed)
+	require.Equal(t, Stats{Batches: 1, Sent: 1, Failed: 1}, b.Stats())
+}
+
+func TestOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		overflow string
+		expect   []string
+		stats    Stats
+	}{
+		{
+			name:     "drop",
+			overflow: OverflowDrop,
+			expect:   []string{"1", "2"},
+			stats:    Stats{Batches: 2, Sent: 2, Dropped: 3},
+		},
+		{
+			name:     "memory",
+			overflow: OverflowMemory,
+			expect:   []string{"1", "2", "3", "4"},
+			stats:    Stats{Batches: 4, Sent: 4, Dropped: 1, Overflowed: 2},
+		},
+		{
+			name:     "disk",
+			overflow: OverflowDisk,
+			expect:   []string{"1", "2", "3", "4"},
+			stats:    Stats{Batches: 4, Sent: 4, Dropped: 1, Overflowed: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := newTestSink()
+			sink.block = make(chan struct{})
+			var dropped int
+			b := newBridge(t, sink, Options{
+				Filters:      []string{"#"},
+				QueueSize:    1,
+				Overflow:     tt.overflow,
+				OverflowSize: 2,
+				OverflowDir:  t.TempDir(),
+				Metrics: Metrics{
+					Dropped: func(route int) { dropped++ },
+				},
+			})
+
+			// the first record is being sent, the second is queued, and the rest overflow or are dropped
+			publish(b, "a", "1")
+			require.Eventually(t, func() bool {
+				return b.Stats().Queued == 0
+			}, time.Second, time.Millisecond)
+			for _, payload := range []string{"2", "3", "4", "5"} {
+				publish(b, "a", payload)
+			}
+			require.Equal(t, int(tt.stats.Dropped), dropped)
+
+			close(sink.block)
+			require.NoError(t, b.Close())
+			require.Equal(t, tt.expect, sink.sent(0))
+			require.Equal(t, tt.stats, b.Stats())
+		})
+	}
+}
+
+func TestDrop(t *testing.T) {
+	tests := []struct {
+		name     string
+		drop     string
+		overflow string
+		expect   []string
+	}{
+		{
+			name:   "newest",
+			drop:   DropNewest,
+			expect: []string{"1", "2", "3"},
+		},
+		{
+			name:   "oldest",
+			drop:   DropOldest,
+			expect: []string{"1", "4", "5"},
+		},
+		{
+			name:     "oldest overflow",
+			drop:     DropOldest,
+			overflow: OverflowMemory,
+			expect:   []string{"1", "4", "5"},
+		},
+		{
+			name:   "qos",
+			drop:   DropQoS,
+			expect: []string{"1", "2", "4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := newTestSink()
+			sink.block = make(chan struct{})
+			options := Options{Filters: []string{"#"}, QueueSize: 2, Drop: tt.drop}
+			if tt.overflow != "" {
+				options.QueueSize, options.Overflow, options.OverflowSize = 1, tt.overflow, 1
+			}
+			b := newBridge(t, sink, options)
+			unblock := sync.OnceFunc(func() { close(sink.block) })
+			t.Cleanup(unblock)
+
+			// the first record is being sent, the next two are queued, and the last two drop a record
+			publish(b, "a", "1")
+			require.Eventually(t, func() bool {
+				return b.Stats().Queued == 0
+			}, time.Second, time.Millisecond)
+			publishQos(b, "a", "2", 1)
+			publishQos(b, "a", "3", 0)
+			publishQos(b, "a", "4", 1)
+			publishQos(b, "a", "5", 0)
+
+			unblock()
+			require.NoError(t, b.Close())
+			require.Equal(t, tt.expect, sink.sent(0))
+			require.Equal(t, int64(2), b.Stats().Dropped)
+		})
+	}
+}
+
+func TestBlock(t *testing.T) {
+	sink := newTestSink()
+	sink.block = make(chan struct{})
+	var waited []time.Duration
+	b := newBridge(t, sink, Options{
+		Filters:   []string{"#"},
+		QueueSize: 1,
+		Block:     time.Second,
+		Metrics: Metrics{
+			Blocked: func(route int, took time.Duration) { waited = append(waited, took) },
+		},
+	})
+	unblock := sync.OnceFunc(func() { close(sink.block) })
+	t.Cleanup(unblock)
+
+	publish(b, "a", "1")
+	require.Eventually(t, func() bool {
+		return b.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(b, "a", "2")
+
+	// the third record waits until the first has been sent, and the second popped
+	done := make(chan struct{})
+	go func() {
+		publish(b, "a", "3")
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	unblock()
+	<-done
+	require.NoError(t, b.Close())
+
+	require.Equal(t, []string{"1", "2", "3"}, sink.sent(0))
+	require.Equal(t, Stats{Batches: 3, Sent: 3, Blocked: 1}, b.Stats())
+	require.Len(t, waited, 1)
+	require.GreaterOrEqual(t, waited[0], 10*time.Millisecond)
+}
+
+func TestBlockTimeout(t *testing.T) {
+	sink := newTestSink()
+	sink.block = make(chan struct{})
+	b := newBridge(t, sink, Options{Filters: []string{"#"}, QueueSize: 1, Block: 10 * time.Millisecond})
+	unblock := sync.OnceFunc(func() { close(sink.block) })
+	t.Cleanup(unblock)
+
+	publish(b, "a", "1")
+	require.Eventually(t, func() bool {
+		return b.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(b, "a", "2")
+	publish(b, "a", "3")
+
+	unblock()
+	require.NoError(t, b.Close())
+	require.Equal(t, []string{"1", "2"}, sink.sent(0))
+	require.Equal(t, Stats{Batches: 2, Sent: 2, Dropped: 1, Blocked: 1}, b.Stats())
+}
+
+func TestWarning(t *testing.T) {
+	s := mqtt.New(&mqtt.Options{InlineClient: true})
+	var warnings []Warning
+	var mu sync.Mutex
+	require.NoError(t, s.Subscribe("$SYS/bridges/+/dropped", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		var w Warning
+		require.NoError(t, json.Unmarshal(pk.Payload, &w))
+		mu.Lock()
+		warnings = append(warnings, w)
+		mu.Unlock()
+	}))
+
+	sink := newTestSink()
+	sink.block = make(chan struct{})
+	b := newBridge(t, sink, Options{Filters: []string{"#"}, QueueSize: 1, Server: s, Name: "kafka"})
+	unblock := sync.OnceFunc(func() { close(sink.block) })
+	t.Cleanup(unblock)
+
+	// the first record dropped publishes a warning, and the second is only counted by the next one
+	publish(b, "a", "1")
+	require.Eventually(t, func() bool {
+		return b.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	for _, payload := range []string{"2", "3", "4"} {
+		publish(b, "a", payload)
+	}
+
+	unblock()
+	require.NoError(t, b.Close())
+	require.Equal(t, []Warning{{Bridge: "kafka", Dropped: 1, Total: 1}}, warnings)
+}
+
+func TestBuffered(t *testing.T) {
+	dir := t.TempDir()
+	sink := newTestSink()
+	sink.block = make(chan struct{})
+	var dropped []int
+	options := Options{
+		Filters: []string{"a", "b"},
+		Buffer:  &Buffer{Dir: dir, MaxSize: 200, DropOldest: true},
+		Metrics: Metrics{
+			Dropped: func(route int) { dropped = append(dropped, route) },
+		},
+	}
+	b := newBridge(t, sink, options)
+	unblock := sync.OnceFunc(func() { close(sink.block) })
+	t.Cleanup(unblock)
+
+	// each buffered record takes 64 bytes, so the first record is being sent, the next three are buffered, and the last drops the oldest
+	publish(b, "a", "1")
+	require.Eventually(t, func() bool {
+		return b.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	for _, payload := range []string{"2", "3", "4", "5"} {
+		publish(b, "b", payload)
+	}
+	require.Equal(t, []int{1}, dropped)
+	require.Equal(t, int64(3), b.Stats().Queued)
+
+	// the buffered records are kept once the bridge closes, and sent once it is created again
+	unblock()
+	require.NoError(t, b.Close())
+	require.Equal(t, []string{"1"}, sink.sent(0))
+	require.Empty(t, sink.sent(1))
+
+	b = newBridge(t, sink, options)
+	require.Eventually(t, func() bool {
+		return len(sink.sent(1)) == 3
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{"3", "4", "5"}, sink.sent(1))
+	require.NoError(t, b.Close())
+
+	b = newBridge(t, sink, options)
+	require.Equal(t, int64(0), b.Stats().Queued)
+}
+
+func TestWorkers(t *testing.T) {
+	sink := newTestSink()
+	b := newBridge(t, sink, Options{Filters: []string{"#"}, Workers: 4})
+
+	for i := 0; i < 100; i++ {
+		publish(b, "a", "x")
+	}
+	require.NoError(t, b.Close())
+	require.Len(t, sink.sent(0), 100)
+	require.Equal(t, int64(100), b.Stats().Sent)
+}
@@ -0,0 +1,422 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	bufferExt  = ".buf"
+	cursorName = "cursor"
+)
+
+// errBufferFull is returned when an entry doesn't fit in a buffer which doesn't drop its oldest entries
+var errBufferFull = errors.New("buffer is full")
+
+// errTorn is returned for an entry which was only partly written, eg. when the broker crashed
+var errTorn = errors.New("torn entry")
+
+// position is the position of an entry in a buffer, or of the end of one
+type position struct {
+	seq    uint64 // the sequence number of the segment
+	offset int64
+}
+
+// less returns whether the position is before p
+func (pos position) less(p position) bool {
+	return pos.seq < p.seq || pos.seq == p.seq && pos.offset < p.offset
+}
+
+// segment is a file of a buffer
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// mark is an entry which has been read from a buffer, and is acknowledged once it has been sent
+type mark struct {
+	end  position
+	done bool
+}
+
+// buffer is a persistent FIFO of entries appended to segment files in a directory, which survives
+// restarts of the broker. Each entry is its length as a 4 byte big endian integer, the CRC-32 checksum
+// of its data, and its data. Read entries are acknowledged once they have been sent, and the position
+// of the first entry which hasn't been acknowledged is kept in the cursor file, so entries which were
+// read but not sent are read again when the buffer is reopened. Segments are deleted once all of their
+// entries have been acknowledged
+type buffer struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64 // the most bytes of entries which haven't been read
+	dropOldest  bool  // whether entries which don't fit drop the oldest ones, rather than being dropped
+	segments    []*segment
+	writer      *os.File
+	reader      *bufio.Reader
+	readFile    *os.File
+	read        position // of the next entry to read
+	readSeg     int      // the index of the segment being read
+	unread      int64    // the bytes of the entries which haven't been read
+	entries     int      // the number of entries which haven't been read
+	marks       []mark   // the entries read, in order, until they are acknowledged
+	first       uint64   // the id of the first mark
+	committed   position // of the first entry which hasn't been acknowledged
+}
+
+// openBuffer opens the buffer in the directory, which is created if it doesn't exist, reading the
+// entries of its segments which haven't been acknowledged. Segments ending with a torn entry are
+// truncated before it, and new entries are appended to a new segment once the current one grows
+// beyond segmentSize
+func openBuffer(dir string, segmentSize, maxSize int64, dropOldest bool) (*buffer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	b := &buffer{dir: dir, segmentSize: segmentSize, maxSize: maxSize, dropOldest: dropOldest}
+	if err := b.readCursor(); err != nil {
+		return nil, err
+	}
+
+	seqs, err := bufferSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seq := range seqs {
+		if seq < b.committed.seq {
+			if err := os.Remove(b.path(seq)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		seg, err := b.scan(seq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read buffer segment %d: %w", seq, err)
+		}
+		b.segments = append(b.segments, seg)
+	}
+
+	// new entries are appended to a new segment, so the segments being read are never written
+	b.read = position{seq: b.committed.seq + 1}
+	next := b.read.seq
+	if len(b.segments) > 0 {
+		b.read = b.committed
+		if b.segments[0].seq != b.read.seq {
+			b.read = position{seq: b.segments[0].seq} // the segment of the cursor was deleted
+		}
+		next = b.segments[len(b.segments)-1].seq + 1
+	}
+
+	if err := b.create(next); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// bufferSegments returns the sequence numbers of the segments in the directory, in order
+func bufferSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || filepath.Ext(name) != bufferExt {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, bufferExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// path returns the path of the segment with the sequence number
+func (b *buffer) path(seq uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d%s", seq, bufferExt))
+}
+
+// readCursor reads the position of the first entry which hasn't been acknowledged, which is the start
+// of the buffer if there is no cursor
+func (b *buffer) readCursor() error {
+	data, err := os.ReadFile(filepath.Join(b.dir, cursorName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(data) != 16 {
+		return errors.New("invalid buffer cursor")
+	}
+
+	b.committed = position{
+		seq:    binary.BigEndian.Uint64(data),
+		offset: int64(binary.BigEndian.Uint64(data[8:])),
+	}
+	return nil
+}
+
+// writeCursor atomically replaces the cursor with the position of the first entry which hasn't been
+// acknowledged
+func (b *buffer) writeCursor() error {
+	data := binary.BigEndian.AppendUint64(nil, b.committed.seq)
+	data = binary.BigEndian.AppendUint64(data, uint64(b.committed.offset))
+
+	path := filepath.Join(b.dir, cursorName)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// scan counts the entries of the segment after the cursor, truncating it before a torn entry
+func (b *buffer) scan(seq uint64) (*segment, error) {
+	f, err := os.OpenFile(b.path(seq), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seg := &segment{seq: seq}
+	r := bufio.NewReader(f)
+	for {
+		data, err := readBufferEntry(r)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if errors.Is(err, errTorn) {
+			if err := f.Truncate(seg.size); err != nil {
+				return nil, err
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		size := int64(8 + len(data))
+		if seq == b.committed.seq && seg.size < b.committed.offset {
+			seg.size += size // acknowledged before the buffer was closed
+			continue
+		}
+
+		seg.size += size
+		b.entries++
+		b.unread += size
+	}
+
+	if seq == b.committed.seq && seg.size < b.committed.offset {
+		return nil, errors.New("buffer cursor is beyond the end of its segment")
+	}
+	return seg, nil
+}
+
+// readBufferEntry reads the data of the next entry, returning io.EOF at the end of the segment and
+// errTorn if the entry is incomplete or its checksum doesn't match
+func readBufferEntry(r *bufio.Reader) ([]byte, error) {
+	var header [8]byte
+	n, err := io.ReadFull(r, header[:])
+	if n == 0 && errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errTorn
+	}
+
+	// the data is read as it arrives rather than allocated up front, so a corrupt size fails at the
+	// end of the segment
+	size := binary.BigEndian.Uint32(header[:])
+	data, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint32(len(data)) != size || crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errTorn
+	}
+	return data, nil
+}
+
+// create starts appending entries to a new segment with the sequence number
+func (b *buffer) create(seq uint64) error {
+	f, err := os.OpenFile(b.path(seq), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	b.writer = f
+	b.segments = append(b.segments, &segment{seq: seq})
+	return nil
+}
+
+// len returns the number of entries which haven't been read
+func (b *buffer) len() int {
+	return b.entries
+}
+
+// fits returns whether an entry of the size fits in the buffer, or drops the oldest entries to fit
+func (b *buffer) fits(size int) bool {
+	return b.dropOldest || b.unread+int64(8+size) <= b.maxSize
+}
+
+// push appends the entry, starting a new segment if the current one is full. If the entry doesn't fit,
+// it returns errBufferFull, or drops the oldest entries which haven't been read, calling drop with each
+// of them
+func (b *buffer) push(data []byte, drop func(data []byte)) error {
+	size := int64(8 + len(data))
+	for b.unread+size > b.maxSize {
+		if !b.dropOldest || b.entries == 0 {
+			return errBufferFull
+		}
+
+		old, id, err := b.pop()
+		if err != nil {
+			return err
+		}
+
+		drop(old)
+		if err := b.ack(id); err != nil {
+			return err
+		}
+	}
+
+	last := b.segments[len(b.segments)-1]
+	if last.size >= b.segmentSize {
+		if err := b.writer.Close(); err != nil {
+			return err
+		}
+
+		if err := b.create(last.seq + 1); err != nil {
+			return err
+		}
+		last = b.segments[len(b.segments)-1]
+	}
+
+	entry := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(entry, uint32(len(data)))
+	binary.BigEndian.PutUint32(entry[4:], crc32.ChecksumIEEE(data))
+	entry = append(entry, data...)
+	if _, err := b.writer.Write(entry); err != nil {
+		return err
+	}
+
+	last.size += size
+	b.entries++
+	b.unread += size
+	return nil
+}
+
+// pop returns the oldest entry which hasn't been read, and the id it is acknowledged by
+func (b *buffer) pop() ([]byte, uint64, error) {
+	if b.entries == 0 {
+		return nil, 0, io.EOF
+	}
+
+	for {
+		seg := b.segments[b.readSeg]
+		if b.read.offset >= seg.size {
+			b.closeReader()
+			b.readSeg++
+			b.read = position{seq: b.segments[b.readSeg].seq}
+			continue
+		}
+
+		if b.reader == nil {
+			f, err := os.Open(b.path(seg.seq))
+			if err != nil {
+				return nil, 0, err
+			}
+
+			if _, err := f.Seek(b.read.offset, io.SeekStart); err != nil {
+				f.Close()
+				return nil, 0, err
+			}
+			b.readFile, b.reader = f, bufio.NewReader(f)
+		}
+
+		data, err := readBufferEntry(b.reader)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		size := int64(8 + len(data))
+		b.read.offset += size
+		b.entries--
+		b.unread -= size
+
+		b.marks = append(b.marks, mark{end: b.read})
+		return data, b.first + uint64(len(b.marks)-1), nil
+	}
+}
+
+// closeReader closes the segment being read
+func (b *buffer) closeReader() {
+	if b.readFile != nil {
+		b.readFile.Close()
+		b.reader, b.readFile = nil, nil
+	}
+}
+
+// ack acknowledges the entry with the id, which has been sent or discarded. Once the oldest entries
+// read have been acknowledged, the cursor is moved past them and the segments before it are deleted
+func (b *buffer) ack(id uint64) error {
+	if id < b.first || id-b.first >= uint64(len(b.marks)) {
+		return nil
+	}
+	b.marks[id-b.first].done = true
+
+	committed := b.committed
+	for len(b.marks) > 0 && b.marks[0].done {
+		committed = b.marks[0].end
+		b.marks[0] = mark{}
+		b.marks = b.marks[1:]
+		b.first++
+	}
+
+	if !b.committed.less(committed) {
+		return nil
+	}
+
+	b.committed = committed
+	if err := b.writeCursor(); err != nil {
+		return err
+	}
+
+	// the segment being read is kept, even once all of its entries have been acknowledged
+	var errs []error
+	for len(b.segments) > 1 && b.readSeg > 0 && b.segments[0].seq < b.committed.seq {
+		errs = append(errs, os.Remove(b.path(b.segments[0].seq)))
+		b.segments = b.segments[1:]
+		b.readSeg--
+	}
+	return errors.Join(errs...)
+}
+
+// close closes the segments, keeping the entries which haven't been acknowledged to be read again when
+// the buffer is reopened
+func (b *buffer) close() error {
+	b.closeReader()
+	if b.writer == nil {
+		return nil
+	}
+
+	err := b.writer.Close()
+	b.writer = nil
+	return err
+}
@@ -0,0 +1,123 @@
+package bridge
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuffer(t *testing.T) {
+	dir := t.TempDir()
+	buf, err := openBuffer(dir, 32, 1<<20, false)
+	require.NoError(t, err)
+
+	for i := 0; i < 6; i++ {
+		require.NoError(t, buf.push([]byte(fmt.Sprintf("entry %d", i)), nil))
+	}
+	require.Equal(t, 6, buf.len())
+
+	// the first two entries are read and acknowledged, and the third is read but not acknowledged
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		data, id, err := buf.pop()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("entry %d", i), string(data))
+		ids = append(ids, id)
+	}
+	require.NoError(t, buf.ack(ids[1]))
+	require.NoError(t, buf.ack(ids[0]))
+	require.NoError(t, buf.close())
+
+	// the entries which weren't acknowledged are read again once the buffer is reopened
+	buf, err = openBuffer(dir, 32, 1<<20, false)
+	require.NoError(t, err)
+	require.Equal(t, 4, buf.len())
+	require.NoError(t, buf.push([]byte("entry 6"), nil))
+
+	for i := 2; i < 7; i++ {
+		data, id, err := buf.pop()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("entry %d", i), string(data))
+		require.NoError(t, buf.ack(id))
+	}
+
+	_, _, err = buf.pop()
+	require.ErrorIs(t, err, io.EOF)
+
+	// segments are deleted once their entries have been acknowledged
+	seqs, err := bufferSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3}, seqs)
+	require.NoError(t, buf.close())
+
+	buf, err = openBuffer(dir, 32, 1<<20, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, buf.len())
+	require.NoError(t, buf.close())
+}
+
+func TestBufferFull(t *testing.T) {
+	buf, err := openBuffer(t.TempDir(), 1024, 30, false)
+	require.NoError(t, err)
+	t.Cleanup(func() { buf.close() })
+
+	// each entry takes 15 bytes, so the third doesn't fit
+	require.NoError(t, buf.push([]byte("entry 0"), nil))
+	require.NoError(t, buf.push([]byte("entry 1"), nil))
+	require.ErrorIs(t, buf.push([]byte("entry 2"), nil), errBufferFull)
+
+	// entries fit again once others have been read
+	_, _, err = buf.pop()
+	require.NoError(t, err)
+	require.NoError(t, buf.push([]byte("entry 2"), nil))
+	require.Equal(t, 2, buf.len())
+}
+
+func TestBufferDropOldest(t *testing.T) {
+	buf, err := openBuffer(t.TempDir(), 1024, 30, true)
+	require.NoError(t, err)
+	t.Cleanup(func() { buf.close() })
+
+	var dropped []string
+	drop := func(data []byte) { dropped = append(dropped, string(data)) }
+	for i := 0; i < 4; i++ {
+		require.NoError(t, buf.push([]byte(fmt.Sprintf("entry %d", i)), drop))
+	}
+	require.Equal(t, []string{"entry 0", "entry 1"}, dropped)
+
+	data, _, err := buf.pop()
+	require.NoError(t, err)
+	require.Equal(t, "entry 2", string(data))
+}
+
+func TestBufferTorn(t *testing.T) {
+	dir := t.TempDir()
+	buf, err := openBuffer(dir, 1024, 1<<20, false)
+	require.NoError(t, err)
+	require.NoError(t, buf.push([]byte("entry 0"), nil))
+	require.NoError(t, buf.push([]byte("entry 1"), nil))
+	require.NoError(t, buf.close())
+
+	// the second entry was only partly written when the broker crashed
+	path := filepath.Join(dir, "00000000000000000001.buf")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-2))
+
+	buf, err = openBuffer(dir, 1024, 1<<20, false)
+	require.NoError(t, err)
+	t.Cleanup(func() { buf.close() })
+	require.Equal(t, 1, buf.len())
+
+	data, _, err := buf.pop()
+	require.NoError(t, err)
+	require.Equal(t, "entry 0", string(data))
+
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(15), info.Size())
+}
@@ -0,0 +1,54 @@
+package bridge
+
+import (
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Message is a message as it was published, for connectors which compute what they send from the
+// message when a batch is sent rather than when it is queued, eg. the rows of a table. It survives
+// being marshalled as JSON, so it can be overflowed or buffered to disk
+type Message struct {
+	Time        time.Time              `json:"time"` // when the message was published
+	ClientID    string                 `json:"client_id"`
+	Topic       string                 `json:"topic"`
+	Payload     []byte                 `json:"payload"`
+	Qos         byte                   `json:"qos"`
+	Retain      bool                   `json:"retain"`
+	ContentType string                 `json:"content_type,omitempty"`
+	User        []packets.UserProperty `json:"user,omitempty"`
+}
+
+// NewMessage returns the message published by the client at the time
+func NewMessage(cl *mqtt.Client, pk packets.Packet, at time.Time) Message {
+	return Message{
+		Time:        at,
+		ClientID:    cl.ID,
+		Topic:       pk.TopicName,
+		Payload:     pk.Payload,
+		Qos:         pk.FixedHeader.Qos,
+		Retain:      pk.FixedHeader.Retain,
+		ContentType: pk.Properties.ContentType,
+		User:        pk.Properties.User,
+	}
+}
+
+// Client returns a client with the id of the client which published the message
+func (m Message) Client() *mqtt.Client {
+	return &mqtt.Client{ID: m.ClientID}
+}
+
+// Packet returns the publish packet of the message
+func (m Message) Packet() packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: m.Qos, Retain: m.Retain},
+		TopicName:   m.Topic,
+		Payload:     m.Payload,
+		Properties: packets.Properties{
+			ContentType: m.ContentType,
+			User:        m.User,
+		},
+	}
+}
@@ -0,0 +1,35 @@
+package bridge
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage(t *testing.T) {
+	cl := &mqtt.Client{ID: "c1"}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Retain: true},
+		TopicName:   "devices/d1",
+		Payload:     []byte{0, 1, 2},
+		Properties: packets.Properties{
+			ContentType: "application/octet-stream",
+			User:        []packets.UserProperty{{Key: "site", Val: "north"}},
+		},
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// the message survives being marshalled, and gives back its client and packet
+	b, err := json.Marshal(NewMessage(cl, pk, at))
+	require.NoError(t, err)
+	var msg Message
+	require.NoError(t, json.Unmarshal(b, &msg))
+
+	require.Equal(t, at, msg.Time)
+	require.Equal(t, "c1", msg.Client().ID)
+	require.Equal(t, pk, msg.Packet())
+}
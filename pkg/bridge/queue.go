@@ -0,0 +1,360 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// the results of pushing an item onto a queue
+const (
+	pushQueued     = iota // the item is in memory
+	pushOverflowed        // the item is in the overflow
+	pushDropped           // the item was discarded as the queue is full
+	pushClosed            // the item was discarded as the queue is closed
+)
+
+// item is a queued record, with the index of the route it was encoded by
+type item[R any] struct {
+	Route  int    `json:"route"`
+	Qos    byte   `json:"qos"`
+	Record R      `json:"record"`
+	id     uint64 // acknowledges the item in the buffer
+}
+
+// queue is a FIFO of items, which holds up to size items in memory, and overflows into more memory or
+// a spool on disk by its overflow policy. Once the overflow has items, pushed items go to the overflow
+// until it is drained, so items are popped in the order they were pushed. A queue with a buffer holds
+// all of its items in the buffer instead, and they are acknowledged once they have been sent
+type queue[R any] struct {
+	size         int
+	policy       string
+	drop         string
+	overflowSize int
+	items        []item[R]
+	overflow     []item[R] // with OverflowMemory
+	spool        *spool    // with OverflowDisk
+	buffer       *buffer
+	closed       bool
+	ready        chan struct{} // signalled when items are pushed or the queue is closed
+	popped       chan struct{} // closed when an item is popped or the queue is closed, if pushes wait
+	onError      func(err error)
+	onDrop       func(route int) // called for the queued items dropped
+	mu           sync.Mutex
+}
+
+// newQueue returns a queue holding size items in memory, whose overflow holds overflowSize more items
+// in memory or in the spool by the policy, and which drops items by the drop policy once it is full
+func newQueue[R any](size int, policy, drop string, overflowSize int, sp *spool, onError func(err error)) *queue[R] {
+	return &queue[R]{
+		size:         size,
+		policy:       policy,
+		drop:         drop,
+		overflowSize: overflowSize,
+		spool:        sp,
+		ready:        make(chan struct{}, 1),
+		onError:      onError,
+	}
+}
+
+// overflowLen returns the number of items in the overflow
+func (q *queue[R]) overflowLen() int {
+	if q.buffer != nil {
+		return q.buffer.len()
+	}
+
+	if q.spool != nil {
+		return q.spool.len()
+	}
+	return len(q.overflow)
+}
+
+// len returns the number of items in the queue, in memory and in the overflow
+func (q *queue[R]) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items) + q.overflowLen()
+}
+
+// closedAndEmpty returns whether the queue is closed, and all of its items have been popped. The items
+// of a buffer are kept once it is closed
+func (q *queue[R]) closedAndEmpty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed && (q.buffer != nil || len(q.items) == 0 && q.overflowLen() == 0)
+}
+
+// push queues the item, returning whether it was queued in memory, overflowed, dropped or the queue
+// is closed, and whether it waited for room. While the queue is full, it waits for up to block for an
+// item to be popped, and then the item or a queued one is dropped by the drop policy
+func (q *queue[R]) push(it item[R], block time.Duration) (result int, waited bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var timeout <-chan time.Time
+	for {
+		if q.closed {
+			return pushClosed, waited
+		}
+
+		if result, ok := q.tryPush(it); ok {
+			return result, waited
+		}
+
+		if block <= 0 {
+			break
+		}
+
+		if timeout == nil {
+			timer := time.NewTimer(block)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		if q.popped == nil {
+			q.popped = make(chan struct{})
+		}
+		popped := q.popped
+
+		q.mu.Unlock()
+		waited = true
+		select {
+		case <-popped:
+		case <-timeout:
+			block = 0
+		}
+		q.mu.Lock()
+	}
+
+	return q.evict(it), waited
+}
+
+// tryPush queues the item if there is room, returning whether it was queued in memory or overflowed
+func (q *queue[R]) tryPush(it item[R]) (int, bool) {
+	result := pushQueued
+	switch {
+	case q.buffer != nil:
+		data, err := json.Marshal(it)
+		if err == nil && !q.buffer.fits(len(data)) {
+			return 0, false
+		}
+
+		if err == nil {
+			err = q.buffer.push(data, func(data []byte) {
+				var old item[R]
+				if err := json.Unmarshal(data, &old); err == nil {
+					q.onDrop(old.Route)
+				}
+			})
+		}
+		if err != nil {
+			q.onError(err)
+			return pushDropped, true
+		}
+	case q.overflowLen() == 0 && len(q.items) < q.size:
+		q.items = append(q.items, it)
+	case q.policy == OverflowMemory && len(q.overflow) < q.overflowSize:
+		q.overflow = append(q.overflow, it)
+		result = pushOverflowed
+	case q.policy == OverflowDisk && q.spool.len() < q.overflowSize:
+		data, err := json.Marshal(it)
+		if err == nil {
+			err = q.spool.push(data)
+		}
+		if err != nil {
+			q.onError(err)
+			return pushDropped, true
+		}
+		result = pushOverflowed
+	default:
+		return 0, false
+	}
+
+	q.signal()
+	return result, true
+}
+
+// evict makes room for the item in the full queue by the drop policy, dropping the oldest item, or
+// the oldest QoS 0 item for an item with a higher QoS, or else the item itself. The items of a buffer
+// are dropped by the policy of the buffer instead
+func (q *queue[R]) evict(it item[R]) int {
+	if q.buffer != nil {
+		return pushDropped
+	}
+
+	var old item[R]
+	switch q.drop {
+	case DropOldest:
+		old, _ = q.next()
+	case DropQoS:
+		if it.Qos == 0 || !q.removeQos0(&old) {
+			return pushDropped
+		}
+	default:
+		return pushDropped
+	}
+	q.onDrop(old.Route)
+
+	// the overflow is only pushed to while it has items, so an item moves from it to the memory freed
+	if len(q.items) < q.size && q.overflowLen() > 0 {
+		if next, ok := q.next(); ok {
+			q.items = append(q.items, next)
+		}
+	}
+
+	if result, ok := q.tryPush(it); ok {
+		return result
+	}
+	return pushDropped
+}
+
+// removeQos0 removes the oldest QoS 0 item in memory, returning whether there was one. The items
+// spooled to disk aren't searched
+func (q *queue[R]) removeQos0(old *item[R]) bool {
+	if i := slices.IndexFunc(q.items, func(it item[R]) bool { return it.Qos == 0 }); i >= 0 {
+		*old = q.items[i]
+		q.items = slices.Delete(q.items, i, i+1)
+		return true
+	}
+
+	if i := slices.IndexFunc(q.overflow, func(it item[R]) bool { return it.Qos == 0 }); i >= 0 {
+		*old = q.overflow[i]
+		q.overflow = slices.Delete(q.overflow, i, i+1)
+		return true
+	}
+	return false
+}
+
+// signal wakes a goroutine waiting to pop
+func (q *queue[R]) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the oldest item, waiting for one to be pushed until the timeout fires, if it isn't nil.
+// It returns false if the timeout fired, or if the queue is closed and has no more items
+func (q *queue[R]) pop(timeout <-chan time.Time) (item[R], bool) {
+	for {
+		q.mu.Lock()
+		if q.closed && q.buffer != nil {
+			q.mu.Unlock()
+			q.signal()
+			return item[R]{}, false
+		}
+
+		it, ok := q.next()
+		closed := q.closed
+		more := len(q.items) > 0 || q.overflowLen() > 0
+		if ok {
+			q.wake()
+		}
+		q.mu.Unlock()
+
+		if ok {
+			if more || closed {
+				q.signal() // for the other goroutines waiting to pop
+			}
+			return it, true
+		}
+
+		if closed {
+			q.signal()
+			return it, false
+		}
+
+		select {
+		case <-q.ready:
+		case <-timeout:
+			return it, false
+		}
+	}
+}
+
+// next removes and returns the oldest item, if there is one
+func (q *queue[R]) next() (item[R], bool) {
+	var it item[R]
+	if len(q.items) > 0 {
+		it = q.items[0]
+		q.items[0] = item[R]{}
+		q.items = q.items[1:]
+		return it, true
+	}
+
+	if len(q.overflow) > 0 {
+		it = q.overflow[0]
+		q.overflow[0] = item[R]{}
+		q.overflow = q.overflow[1:]
+		return it, true
+	}
+
+	for q.buffer != nil && q.buffer.len() > 0 {
+		data, id, err := q.buffer.pop()
+		if err != nil {
+			q.onError(err)
+			break
+		}
+
+		if err := json.Unmarshal(data, &it); err != nil {
+			q.onError(errors.Join(err, q.buffer.ack(id)))
+			continue
+		}
+
+		it.id = id
+		return it, true
+	}
+
+	for q.spool != nil && q.spool.len() > 0 {
+		data, err := q.spool.pop()
+		if err != nil {
+			q.onError(errors.Join(err, q.spool.reset())) // the rest of the spool can't be read
+			break
+		}
+
+		if err := json.Unmarshal(data, &it); err != nil {
+			q.onError(err)
+			continue
+		}
+		return it, true
+	}
+	return it, false
+}
+
+// ack acknowledges the items which have been sent or discarded, so they aren't popped from the buffer
+// again once it is reopened
+func (q *queue[R]) ack(items []item[R]) {
+	if q.buffer == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, it := range items {
+		if err := q.buffer.ack(it.id); err != nil {
+			q.onError(err)
+		}
+	}
+}
+
+// close stops items being pushed, and wakes the goroutines waiting to pop once the queue is empty, or
+// at once if it has a buffer
+func (q *queue[R]) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.signal()
+	q.wake()
+}
+
+// wake wakes the goroutines waiting to push
+func (q *queue[R]) wake() {
+	if q.popped != nil {
+		close(q.popped)
+		q.popped = nil
+	}
+}
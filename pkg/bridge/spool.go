@@ -0,0 +1,160 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// spoolExt is the extension of the segment files of spools
+const spoolExt = ".spool"
+
+// spool is a FIFO of entries appended to segment files in a directory, for the messages overflowing
+// the queue of a bridge. Each entry is its length as a 4 byte big endian integer, followed by its data,
+// and segments are deleted once they have been read
+type spool struct {
+	dir         string
+	segmentSize int64
+	writer      *os.File // the segment being appended to
+	writeSeq    uint64
+	writeSize   int64
+	reader      *bufio.Reader // reads the oldest segment
+	readFile    *os.File
+	readSeq     uint64
+	entries     int // the number of entries which haven't been read
+}
+
+// openSpool returns a spool in the directory, which is created if it doesn't exist, deleting the
+// segments of a previous spool. Segments are started once they grow beyond segmentSize
+func openSpool(dir string, segmentSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), spoolExt) {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &spool{dir: dir, segmentSize: segmentSize}, nil
+}
+
+// path returns the path of the segment with the sequence number
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+}
+
+// len returns the number of entries which haven't been read
+func (s *spool) len() int {
+	return s.entries
+}
+
+// push appends the entry, starting a new segment if the current one is full
+func (s *spool) push(data []byte) error {
+	if s.writer != nil && s.writeSize >= s.segmentSize {
+		if err := s.writer.Close(); err != nil {
+			return err
+		}
+		s.writer = nil
+		s.writeSeq++
+	}
+
+	if s.writer == nil {
+		f, err := os.OpenFile(s.path(s.writeSeq), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		s.writer, s.writeSize = f, 0
+	}
+
+	entry := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	entry = append(entry, data...)
+	if _, err := s.writer.Write(entry); err != nil {
+		return err
+	}
+
+	s.writeSize += int64(len(entry))
+	s.entries++
+	return nil
+}
+
+// pop returns the oldest entry which hasn't been read, deleting its segment once it has been read
+func (s *spool) pop() ([]byte, error) {
+	if s.entries == 0 {
+		return nil, io.EOF
+	}
+
+	for {
+		if s.reader == nil {
+			f, err := os.Open(s.path(s.readSeq))
+			if err != nil {
+				return nil, err
+			}
+			s.readFile, s.reader = f, bufio.NewReader(f)
+		}
+
+		var size [4]byte
+		_, err := io.ReadFull(s.reader, size[:])
+		if errors.Is(err, io.EOF) && s.readSeq < s.writeSeq {
+			s.readFile.Close()
+			os.Remove(s.path(s.readSeq))
+			s.reader, s.readFile = nil, nil
+			s.readSeq++
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(s.reader, data); err != nil {
+			return nil, err
+		}
+
+		s.entries--
+		return data, nil
+	}
+}
+
+// close closes the segments, and deletes them
+func (s *spool) close() error {
+	var errs []error
+	if s.writer != nil {
+		errs = append(errs, s.writer.Close())
+		s.writer = nil
+	}
+
+	if s.readFile != nil {
+		errs = append(errs, s.readFile.Close())
+		s.reader, s.readFile = nil, nil
+	}
+
+	for seq := s.readSeq; seq <= s.writeSeq; seq++ {
+		if err := os.Remove(s.path(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	s.entries = 0
+	return errors.Join(errs...)
+}
+
+// reset deletes the entries which haven't been read, eg. when a segment is corrupt, and starts a new
+// segment
+func (s *spool) reset() error {
+	err := s.close()
+	s.writeSeq++
+	s.readSeq = s.writeSeq
+	return err
+}
@@ -0,0 +1,74 @@
+package bridge
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000007.spool"), []byte("old"), 0o600))
+
+	// the segments of a previous spool are deleted
+	sp, err := openSpool(dir, 16)
+	require.NoError(t, err)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// entries are appended to segments of about 16 bytes, which are deleted once read
+	for i := 0; i < 5; i++ {
+		require.NoError(t, sp.push([]byte(fmt.Sprintf("entry %d", i))))
+	}
+	require.Equal(t, 5, sp.len())
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	for i := 0; i < 3; i++ {
+		data, err := sp.pop()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("entry %d", i), string(data))
+	}
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	require.NoError(t, sp.push([]byte("entry 5")))
+	for i := 3; i < 6; i++ {
+		data, err := sp.pop()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("entry %d", i), string(data))
+	}
+
+	_, err = sp.pop()
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 0, sp.len())
+
+	require.NoError(t, sp.close())
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestSpoolReset(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := openSpool(dir, 1024)
+	require.NoError(t, err)
+	t.Cleanup(func() { sp.close() })
+
+	require.NoError(t, sp.push([]byte("a")))
+	require.NoError(t, sp.push([]byte("b")))
+	require.NoError(t, sp.reset())
+	require.Equal(t, 0, sp.len())
+
+	require.NoError(t, sp.push([]byte("c")))
+	data, err := sp.pop()
+	require.NoError(t, err)
+	require.Equal(t, "c", string(data))
+}
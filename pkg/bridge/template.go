@@ -0,0 +1,60 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Render calls write with the literal parts of the template and the values of its {placeholders},
+// eg. those of TopicValues. It returns an error for unclosed placeholders, and for those without a
+// value
+func Render(template string, values func(name string) (string, bool), write func(s string)) error {
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			write(template)
+			return nil
+		}
+
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return errors.New("unclosed placeholder")
+		}
+
+		write(template[:start])
+		name := template[start+1 : start+end]
+		template = template[start+end+1:]
+
+		value, ok := values(name)
+		if !ok {
+			return fmt.Errorf("no value of placeholder {%s}", name)
+		}
+		write(value)
+	}
+}
+
+// TopicValues returns the values of the placeholders of a message published to the topic with the
+// levels by the client: {topic} is the topic, {client} is the id of the client, and {1}, {2}... are
+// the levels of the topic, which are empty beyond its last level
+func TopicValues(levels []string, client string) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		switch name {
+		case "topic":
+			return strings.Join(levels, "/"), true
+		case "client":
+			return client, true
+		}
+
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 1 {
+			return "", false
+		}
+
+		if n > len(levels) {
+			return "", true
+		}
+		return levels[n-1], true
+	}
+}
@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	values := TopicValues([]string{"devices", "d1", "events"}, "c1")
+	tests := []struct {
+		name        string
+		template    string
+		expect      string
+		expectError bool
+	}{
+		{
+			name:     "Success - literal",
+			template: "events",
+			expect:   "events",
+		},
+		{
+			name:     "Success - placeholders",
+			template: "mqtt.{2}.{client}.{topic}",
+			expect:   "mqtt.d1.c1.devices/d1/events",
+		},
+		{
+			name:     "Success - level beyond the topic",
+			template: "a{4}b",
+			expect:   "ab",
+		},
+		{
+			name:        "Failure - unknown placeholder",
+			template:    "{user}",
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid level",
+			template:    "{0}",
+			expectError: true,
+		},
+		{
+			name:        "Failure - unclosed placeholder",
+			template:    "a{topic",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			err := Render(tt.template, values, func(s string) { b.WriteString(s) })
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, b.String())
+		})
+	}
+}
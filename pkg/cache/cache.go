@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Reason is why an entry was evicted
+type Reason int
+
+const (
+	Expired  Reason = iota // the entry outlived its ttl
+	Capacity               // the entry was the least recently used when the cache was full
+)
+
+// Metrics are called as the cache is used, eg. to count its hits and misses. Unset funcs are skipped,
+// and they are called with the lock of the cache held, so must not use the cache
+type Metrics struct {
+	Hit   func()
+	Miss  func()
+	Evict func(reason Reason)
+}
+
+// Options configures a cache
+type Options struct {
+	// MaxEntries is how many entries are kept before the least recently used are evicted, and 0 is
+	// unlimited
+	MaxEntries int
+
+	// TTL is how long entries stored with Set are kept, and 0 keeps them until they are evicted
+	TTL time.Duration
+
+	Metrics Metrics
+
+	// Now returns the current time, defaults to time.Now, eg. for tests
+	Now func() time.Time
+}
+
+// Cache is a concurrency-safe LRU cache whose entries expire, for hooks caching the results of
+// remote checks
+type Cache[K comparable, V any] struct {
+	options Options
+	items   map[K]*list.Element
+	lru     *list.List // of *item, most recently used first
+	swept   int        // the number of entries after the last sweep
+	mu      sync.Mutex
+}
+
+// item is an entry of the cache
+type item[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time // zero if the entry doesn't expire
+}
+
+// New returns an empty cache
+func New[K comparable, V any](options Options) *Cache[K, V] {
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+
+	return &Cache[K, V]{
+		options: options,
+		items:   make(map[K]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the value of the key, and false if it isn't cached or has expired
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	e, ok := c.items[key]
+	if !ok {
+		c.miss()
+		return zero, false
+	}
+
+	it := e.Value.(*item[K, V])
+	if c.expired(it, c.options.Now()) {
+		c.remove(e, Expired)
+		c.miss()
+		return zero, false
+	}
+
+	c.lru.MoveToFront(e)
+	if c.options.Metrics.Hit != nil {
+		c.options.Metrics.Hit()
+	}
+	return it.value, true
+}
+
+// Set stores the value of the key for the TTL of the cache
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetTTL(key, value, c.options.TTL)
+}
+
+// SetTTL stores the value of the key for the ttl, and 0 keeps it until it is evicted. A negative ttl
+// deletes the key, eg. for a result which has already expired
+func (c *Cache[K, V]) SetTTL(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.options.Now()
+	if ttl < 0 {
+		if e, ok := c.items[key]; ok {
+			c.lru.Remove(e)
+			delete(c.items, key)
+		}
+		return
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	if e, ok := c.items[key]; ok {
+		it := e.Value.(*item[K, V])
+		it.value, it.expires = value, expires
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(&item[K, V]{key: key, value: value, expires: expires})
+
+	// expired entries which are never read again are swept once the cache has doubled in size
+	if len(c.items) >= 2*c.swept && len(c.items) >= 64 {
+		c.sweep(now)
+	}
+
+	for c.options.MaxEntries > 0 && len(c.items) > c.options.MaxEntries {
+		c.remove(c.lru.Back(), Capacity)
+	}
+}
+
+// Delete removes the key
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.lru.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+// Purge removes every entry
+func (c *Cache[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.items)
+	c.lru.Init()
+	c.swept = 0
+}
+
+// Len returns the number of entries, including expired entries which haven't been evicted yet
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.items)
+}
+
+// expired returns whether the item has expired
+func (c *Cache[K, V]) expired(it *item[K, V], now time.Time) bool {
+	return !it.expires.IsZero() && !now.Before(it.expires)
+}
+
+// sweep evicts the expired entries, and must be called with the lock held
+func (c *Cache[K, V]) sweep(now time.Time) {
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if c.expired(e.Value.(*item[K, V]), now) {
+			c.remove(e, Expired)
+		}
+		e = next
+	}
+	c.swept = len(c.items)
+}
+
+// remove evicts the entry, and must be called with the lock held
+func (c *Cache[K, V]) remove(e *list.Element, reason Reason) {
+	c.lru.Remove(e)
+	delete(c.items, e.Value.(*item[K, V]).key)
+	if c.options.Metrics.Evict != nil {
+		c.options.Metrics.Evict(reason)
+	}
+}
+
+// miss counts a miss, and must be called with the lock held
+func (c *Cache[K, V]) miss() {
+	if c.options.Metrics.Miss != nil {
+		c.options.Metrics.Miss()
+	}
+}
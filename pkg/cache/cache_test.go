@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// clock is a time which tests move forward
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newClock() *clock {
+	return &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestGetSet(t *testing.T) {
+	c := New[string, int](Options{})
+
+	_, ok := c.Get("a")
+	require.False(t, ok)
+
+	c.Set("a", 1)
+	v, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	c.Set("a", 2)
+	v, ok = c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 2, v)
+	require.Equal(t, 1, c.Len())
+
+	c.Delete("a")
+	_, ok = c.Get("a")
+	require.False(t, ok)
+	c.Delete("a")
+}
+
+func TestTTL(t *testing.T) {
+	clk := newClock()
+	c := New[string, int](Options{TTL: time.Minute, Now: clk.Now})
+
+	c.Set("a", 1)
+	c.SetTTL("b", 2, time.Hour)
+	c.SetTTL("c", 3, 0)
+
+	clk.now = clk.now.Add(time.Minute)
+	_, ok := c.Get("a")
+	require.False(t, ok)
+	_, ok = c.Get("b")
+	require.True(t, ok)
+
+	clk.now = clk.now.Add(365 * 24 * time.Hour)
+	_, ok = c.Get("b")
+	require.False(t, ok)
+	_, ok = c.Get("c")
+	require.True(t, ok)
+
+	// a negative ttl deletes the key
+	c.SetTTL("c", 3, -time.Second)
+	_, ok = c.Get("c")
+	require.False(t, ok)
+	require.Zero(t, c.Len())
+}
+
+func TestMaxEntries(t *testing.T) {
+	var evicted []Reason
+	c := New[string, int](Options{MaxEntries: 2, Metrics: Metrics{
+		Evict: func(reason Reason) { evicted = append(evicted, reason) },
+	}})
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	_, ok := c.Get("a")
+	require.True(t, ok)
+
+	// b is the least recently used
+	c.Set("c", 3)
+	_, ok = c.Get("b")
+	require.False(t, ok)
+	_, ok = c.Get("a")
+	require.True(t, ok)
+	_, ok = c.Get("c")
+	require.True(t, ok)
+	require.Equal(t, []Reason{Capacity}, evicted)
+	require.Equal(t, 2, c.Len())
+}
+
+func TestSweep(t *testing.T) {
+	clk := newClock()
+	var expired int
+	c := New[string, int](Options{TTL: time.Minute, Now: clk.Now, Metrics: Metrics{
+		Evict: func(reason Reason) {
+			if reason == Expired {
+				expired++
+			}
+		},
+	}})
+
+	for i := 0; i < 63; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	clk.now = clk.now.Add(time.Minute)
+
+	// expired entries which are never read again are swept as the cache grows
+	c.SetTTL("kept", 0, 0)
+	require.Equal(t, 1, c.Len())
+	require.Equal(t, 63, expired)
+}
+
+func TestMetrics(t *testing.T) {
+	clk := newClock()
+	var hits, misses int
+	var evicted []Reason
+	c := New[string, int](Options{TTL: time.Minute, Now: clk.Now, Metrics: Metrics{
+		Hit:   func() { hits++ },
+		Miss:  func() { misses++ },
+		Evict: func(reason Reason) { evicted = append(evicted, reason) },
+	}})
+
+	c.Get("a")
+	c.Set("a", 1)
+	c.Get("a")
+	c.Get("a")
+	clk.now = clk.now.Add(time.Minute)
+	c.Get("a")
+
+	require.Equal(t, 2, hits)
+	require.Equal(t, 2, misses)
+	require.Equal(t, []Reason{Expired}, evicted)
+}
+
+func TestPurge(t *testing.T) {
+	c := New[int, int](Options{})
+	for i := 0; i < 10; i++ {
+		c.Set(i, i)
+	}
+
+	c.Purge()
+	require.Zero(t, c.Len())
+	_, ok := c.Get(1)
+	require.False(t, ok)
+
+	c.Set(1, 1)
+	require.Equal(t, 1, c.Len())
+}
+
+func TestConcurrent(t *testing.T) {
+	c := New[int, int](Options{MaxEntries: 100, TTL: time.Minute})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Set(g*1000+i, i)
+				c.Get(g*1000 + i/2)
+				if i%100 == 0 {
+					c.Delete(i)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	require.LessOrEqual(t, c.Len(), 100)
+}
@@ -0,0 +1,279 @@
+// Package coalesce buffers the writes of storage hooks and flushes them in batches, since writing each
+// packet synchronously to an external store is what limits a busy broker. Writes are keyed by the
+// record they change, and a write replaces the pending write of the same record, eg. an inflight
+// message completed before it was flushed is deleted without ever being stored
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDropped is returned for writes which were dropped because too many writes were pending
+var ErrDropped = errors.New("write dropped, too many writes pending")
+
+// Options configures when writes are flushed
+type Options struct {
+	MaxBatch int           // how many pending writes are flushed at once, defaults to 500
+	Interval time.Duration // how often pending writes are flushed, defaults to 100 milliseconds
+	Timeout  time.Duration // how long a flush may take, defaults to 5 seconds
+
+	// MaxPending is how many writes may be pending, defaults to 10 times MaxBatch. Writes wait for a
+	// flush to make space, for up to MaxWait, which defaults to 5 seconds, and are dropped after
+	MaxPending int
+	MaxWait    time.Duration
+}
+
+// Stats counts the writes of a coalescer
+type Stats struct {
+	Pending   int    // writes waiting to be flushed
+	Flushed   uint64 // writes flushed
+	Batches   uint64 // batches flushed
+	Coalesced uint64 // writes replaced by a later write of the same record before they were flushed
+	Dropped   uint64 // writes dropped because too many were pending
+	Failed    uint64 // batches which failed to flush, whose writes are retried
+}
+
+// FlushFunc writes a batch of values
+type FlushFunc[V any] func(ctx context.Context, values []V) error
+
+// entry is a pending write
+type entry[V any] struct {
+	key   string
+	value V
+}
+
+// Coalescer buffers writes and flushes them in batches
+type Coalescer[V any] struct {
+	options Options
+	flush   FlushFunc[V]
+	onError func(error)
+	queue   []entry[V]     // pending writes, in the order their records were first written
+	index   map[string]int // the position of the pending write of each record in the queue
+	full    chan struct{}  // signals that a batch is ready
+	drained chan struct{}  // closed when a flush has made space
+	stats   Stats
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mu      sync.Mutex
+	flushMu sync.Mutex // flushes are serialized so writes of the same record are applied in order
+}
+
+// New returns a coalescer flushing batches of writes with flush, and reporting failed flushes to
+// onError, which may be nil
+func New[V any](options Options, flush FlushFunc[V], onError func(error)) *Coalescer[V] {
+	if options.MaxBatch <= 0 {
+		options.MaxBatch = 500
+	}
+
+	if options.Interval <= 0 {
+		options.Interval = 100 * time.Millisecond
+	}
+
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+
+	if options.MaxPending < options.MaxBatch {
+		options.MaxPending = 10 * options.MaxBatch
+	}
+
+	if options.MaxWait <= 0 {
+		options.MaxWait = 5 * time.Second
+	}
+
+	if onError == nil {
+		onError = func(error) {}
+	}
+
+	return &Coalescer[V]{
+		options: options,
+		flush:   flush,
+		onError: onError,
+		index:   map[string]int{},
+		full:    make(chan struct{}, 1),
+		drained: make(chan struct{}),
+	}
+}
+
+// Start flushes the pending writes at the interval, or once a batch is ready, until it is stopped
+func (c *Coalescer[V]) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(c.options.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-c.full:
+			}
+
+			if err := c.Flush(); err != nil {
+				c.onError(err)
+			}
+		}
+	}()
+}
+
+// Stop stops flushing at the interval, and flushes the pending writes
+func (c *Coalescer[V]) Stop() error {
+	if c.cancel != nil {
+		c.cancel()
+		<-c.done
+		c.cancel = nil
+	}
+	return c.Flush()
+}
+
+// Add queues the write of a record, replacing its pending write. It waits for space while too many
+// writes are pending, and returns ErrDropped if there was no space in time
+func (c *Coalescer[V]) Add(key string, value V) error {
+	var timeout <-chan time.Time
+
+	c.mu.Lock()
+	for {
+		if i, ok := c.index[key]; ok {
+			c.queue[i].value = value
+			c.stats.Coalesced++
+			c.mu.Unlock()
+			return nil
+		}
+
+		if len(c.queue) < c.options.MaxPending {
+			break
+		}
+
+		drained := c.drained
+		c.mu.Unlock()
+		c.signal()
+
+		if timeout == nil {
+			timer := time.NewTimer(c.options.MaxWait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-drained:
+		case <-timeout:
+			c.mu.Lock()
+			c.stats.Dropped++
+			c.mu.Unlock()
+			return ErrDropped
+		}
+		c.mu.Lock()
+	}
+
+	c.index[key] = len(c.queue)
+	c.queue = append(c.queue, entry[V]{key: key, value: value})
+	ready := len(c.queue) >= c.options.MaxBatch
+	c.mu.Unlock()
+
+	if ready {
+		c.signal()
+	}
+	return nil
+}
+
+// signal wakes the flushing goroutine
+func (c *Coalescer[V]) signal() {
+	select {
+	case c.full <- struct{}{}:
+	default:
+	}
+}
+
+// Flush writes the pending writes in batches, returning the first error. The writes of a batch
+// which fails are retried by the next flush, unless their records were written again since
+func (c *Coalescer[V]) Flush() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	for {
+		batch := c.take()
+		if len(batch) == 0 {
+			return nil
+		}
+
+		values := make([]V, len(batch))
+		for i, e := range batch {
+			values[i] = e.value
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.options.Timeout)
+		err := c.flush(ctx, values)
+		cancel()
+
+		if err != nil {
+			c.requeue(batch)
+			return err
+		}
+
+		c.mu.Lock()
+		c.stats.Flushed += uint64(len(batch))
+		c.stats.Batches++
+		c.mu.Unlock()
+	}
+}
+
+// take removes a batch of pending writes from the queue
+func (c *Coalescer[V]) take() []entry[V] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := min(len(c.queue), c.options.MaxBatch)
+	batch := c.queue[:n:n]
+	c.queue = append([]entry[V](nil), c.queue[n:]...)
+
+	clear(c.index)
+	for i, e := range c.queue {
+		c.index[e.key] = i
+	}
+
+	if n > 0 {
+		close(c.drained)
+		c.drained = make(chan struct{})
+	}
+	return batch
+}
+
+// requeue puts the writes of a failed batch back in front of the queue, except those whose records
+// were written again since
+func (c *Coalescer[V]) requeue(batch []entry[V]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Failed++
+
+	var retry []entry[V]
+	for _, e := range batch {
+		if _, ok := c.index[e.key]; !ok {
+			retry = append(retry, e)
+		}
+	}
+
+	c.queue = append(retry, c.queue...)
+	for i, e := range c.queue {
+		c.index[e.key] = i
+	}
+}
+
+// Stats returns the counts of the writes
+func (c *Coalescer[V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Pending = len(c.queue)
+	return stats
+}
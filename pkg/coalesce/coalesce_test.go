@@ -0,0 +1,147 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sink records the batches it is given, and fails while err is set
+type sink struct {
+	batches [][]string
+	err     error
+	block   chan struct{} // flushes wait until it is closed, if set
+	mu      sync.Mutex
+}
+
+func (s *sink) flush(ctx context.Context, values []string) error {
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, values)
+	return nil
+}
+
+func (s *sink) flushed() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.batches...)
+}
+
+func (s *sink) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func TestNew(t *testing.T) {
+	c := New(Options{}, new(sink).flush, nil)
+	require.Equal(t, Options{
+		MaxBatch:   500,
+		Interval:   100 * time.Millisecond,
+		Timeout:    5 * time.Second,
+		MaxPending: 5000,
+		MaxWait:    5 * time.Second,
+	}, c.options)
+}
+
+func TestCoalesce(t *testing.T) {
+	s := new(sink)
+	c := New(Options{MaxBatch: 2}, s.flush, nil)
+
+	require.NoError(t, c.Add("a", "a1"))
+	require.NoError(t, c.Add("b", "b1"))
+	require.NoError(t, c.Add("a", "a2"))
+	require.NoError(t, c.Add("c", "c1"))
+	require.Equal(t, Stats{Pending: 3, Coalesced: 1}, c.Stats())
+
+	require.NoError(t, c.Flush())
+	require.Equal(t, [][]string{{"a2", "b1"}, {"c1"}}, s.flushed())
+	require.Equal(t, Stats{Flushed: 3, Batches: 2, Coalesced: 1}, c.Stats())
+
+	// records are written again once their writes were flushed
+	require.NoError(t, c.Add("a", "a3"))
+	require.NoError(t, c.Stop())
+	require.Equal(t, []string{"a3"}, s.flushed()[2])
+}
+
+func TestRetry(t *testing.T) {
+	s := new(sink)
+	c := New(Options{}, s.flush, nil)
+
+	s.fail(errors.New("connection refused"))
+	c.Add("a", "a1")
+	c.Add("b", "b1")
+	require.Error(t, c.Flush())
+	require.Equal(t, Stats{Pending: 2, Failed: 1}, c.Stats())
+
+	// writes of the failed batch are superseded by later writes of the same records
+	c.Add("b", "b2")
+	c.Add("c", "c1")
+	s.fail(nil)
+	require.NoError(t, c.Flush())
+	require.Equal(t, [][]string{{"a1", "b2", "c1"}}, s.flushed())
+}
+
+func TestStart(t *testing.T) {
+	s := new(sink)
+	c := New(Options{Interval: time.Hour, MaxBatch: 2}, s.flush, nil)
+	c.Start()
+	defer c.Stop()
+
+	// a full batch is flushed without waiting for the interval
+	c.Add("a", "a1")
+	c.Add("b", "b1")
+	require.Eventually(t, func() bool {
+		return len(s.flushed()) == 1
+	}, time.Second, time.Millisecond)
+
+	c.Add("c", "c1")
+	require.NoError(t, c.Stop())
+	require.Equal(t, [][]string{{"a1", "b1"}, {"c1"}}, s.flushed())
+
+	c2 := New(Options{Interval: time.Millisecond}, s.flush, nil)
+	c2.Start()
+	defer c2.Stop()
+	c2.Add("d", "d1")
+	require.Eventually(t, func() bool {
+		return len(s.flushed()) == 3
+	}, time.Second, time.Millisecond)
+}
+
+func TestBackpressure(t *testing.T) {
+	s := &sink{block: make(chan struct{})}
+	c := New(Options{MaxBatch: 1, MaxPending: 1, MaxWait: 10 * time.Millisecond, Interval: time.Hour}, s.flush, nil)
+
+	require.NoError(t, c.Add("a", "a1"))
+
+	// writes of pending records don't need space
+	require.NoError(t, c.Add("a", "a2"))
+
+	// without a flush to make space, the write is dropped after waiting
+	require.ErrorIs(t, c.Add("b", "b1"), ErrDropped)
+	require.Equal(t, uint64(1), c.Stats().Dropped)
+
+	// a flush makes space for the waiting write
+	c.options.MaxWait = time.Second
+	c.Start()
+	added := make(chan error)
+	go func() {
+		added <- c.Add("c", "c1")
+	}()
+	close(s.block)
+	require.NoError(t, <-added)
+
+	require.NoError(t, c.Stop())
+	require.Equal(t, [][]string{{"a2"}, {"c1"}}, s.flushed())
+}
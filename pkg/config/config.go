@@ -0,0 +1,463 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Source is where the options of a hook are read from. Options keep the values they already have
+// unless a source sets them, so defaults can be set before loading, eg.
+//
+//	options := auth.Options{CacheTTL: time.Minute}
+//	err := config.Load(&options, config.Source{
+//		Path:      "config.yml",
+//		Key:       "hooks.http",
+//		EnvPrefix: "MQTT_HTTP",
+//	})
+//
+// reads the options from the hooks.http section of config.yml, and then from environment variables
+// such as MQTT_HTTP_ACL_HOST and MQTT_HTTP_CACHE_TTL
+type Source struct {
+	// Path is a YAML or JSON file, and is optional
+	Path string
+
+	// Key is the dot separated path of the hook's section of the file, and the whole file if empty
+	Key string
+
+	// EnvPrefix is the prefix of the environment variables, which are not read if it is empty
+	EnvPrefix string
+}
+
+// Validator is implemented by options which check themselves once loaded
+type Validator interface {
+	Validate() error
+}
+
+// Load populates the options, which must be a pointer to a struct, from the file and then the
+// environment, and validates them if they implement Validator
+func Load(options any, src Source) error {
+	if src.Path != "" {
+		data, err := os.ReadFile(src.Path)
+		if err != nil {
+			return err
+		}
+
+		if err := Decode(data, src.Key, options); err != nil {
+			return fmt.Errorf("%s: %w", src.Path, err)
+		}
+	}
+
+	if src.EnvPrefix != "" {
+		if err := Env(src.EnvPrefix, options); err != nil {
+			return err
+		}
+	}
+
+	if v, ok := options.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return fmt.Errorf("invalid options: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Decode populates the options from the section of the YAML or JSON document at the key. As YAML is
+// a superset of JSON, both are parsed as YAML.
+//
+// Keys are matched to the fields of the options ignoring case, underscores and dashes, so acl_host
+// and aclHost both set ACLHost, unless a field names itself with a config or yaml tag. Unknown keys
+// are an error, so typos are not ignored
+func Decode(data []byte, key string, options any) error {
+	v, err := target(options)
+	if err != nil {
+		return err
+	}
+
+	var doc any
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if key != "" {
+		for _, k := range strings.Split(key, ".") {
+			m, ok := doc.(map[string]any)
+			if !ok {
+				return fmt.Errorf("section %s not found", key)
+			}
+			if doc, ok = m[k]; !ok {
+				return fmt.Errorf("section %s not found", key)
+			}
+		}
+	}
+
+	if doc == nil {
+		return nil
+	}
+
+	return assign(v, doc, key)
+}
+
+// Env populates the options from environment variables, named by the prefix and the names of the
+// fields in upper snake case, eg. MQTT_HTTP_CACHE_TTL for the CacheTTL field with the prefix
+// MQTT_HTTP, and MQTT_HTTP_RETRY_MAX_ATTEMPTS for a field of the Retry struct. Names are matched
+// like the keys of files, ignoring case and underscores. Lists are comma separated, and maps are
+// comma separated key=value pairs
+func Env(prefix string, options any) error {
+	v, err := target(options)
+	if err != nil {
+		return err
+	}
+
+	vars := make(map[string]variable)
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		vars[normalize(name)] = variable{name: name, value: value}
+	}
+
+	return env(v, normalize(prefix), vars)
+}
+
+// variable is an environment variable
+type variable struct {
+	name  string
+	value string
+}
+
+// target returns the struct the options point to
+func target(options any) (reflect.Value, error) {
+	v := reflect.ValueOf(options)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, errors.New("options must be a pointer to a struct")
+	}
+	return v.Elem(), nil
+}
+
+// field is a configurable field of a struct
+type field struct {
+	name  string // the name given by a tag, or the Go name
+	value reflect.Value
+}
+
+// fields returns the configurable fields of the struct, including the fields of embedded structs
+func fields(v reflect.Value) []field {
+	var out []field
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		name, _, _ := strings.Cut(sf.Tag.Get("config"), ",")
+		if name == "" {
+			name, _, _ = strings.Cut(sf.Tag.Get("yaml"), ",")
+		}
+
+		if name == "-" {
+			continue
+		}
+
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct && name == "" {
+			out = append(out, fields(v.Field(i))...)
+			continue
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+		out = append(out, field{name: name, value: v.Field(i)})
+	}
+	return out
+}
+
+// normalize returns the key in the form compared to the names of fields
+func normalize(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+}
+
+// assign sets v to the raw value decoded from a document or read from the environment
+func assign(v reflect.Value, raw any, path string) error {
+	if raw == nil {
+		v.SetZero()
+		return nil
+	}
+
+	s, isString := raw.(string)
+	if isString {
+		if ok, err := assignString(v, s); ok {
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			return nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return assign(v.Elem(), raw, path)
+
+	case reflect.Interface:
+		if v.NumMethod() > 0 || !reflect.TypeOf(raw).AssignableTo(v.Type()) {
+			return fmt.Errorf("%s: cannot be configured", path)
+		}
+		v.Set(reflect.ValueOf(raw))
+		return nil
+
+	case reflect.Struct:
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected a mapping", path)
+		}
+
+		fs := fields(v)
+		for k, rv := range m {
+			i := fieldIndex(fs, k)
+			if i < 0 {
+				return fmt.Errorf("%s: unknown key", join(path, k))
+			}
+			if err := assign(fs[i].value, rv, join(path, k)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Slice:
+		items, ok := raw.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected a list", path)
+		}
+
+		out := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := assign(out.Index(i), item, path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+		v.Set(out)
+		return nil
+
+	case reflect.Map:
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected a mapping", path)
+		}
+
+		out := reflect.MakeMapWithSize(v.Type(), len(m))
+		for k, rv := range m {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := assign(key, k, path); err != nil {
+				return err
+			}
+			val := reflect.New(v.Type().Elem()).Elem()
+			if err := assign(val, rv, join(path, k)); err != nil {
+				return err
+			}
+			out.SetMapIndex(key, val)
+		}
+		v.Set(out)
+		return nil
+	}
+
+	// scalars decoded from documents are converted through their string form, eg. 10 into a
+	// time.Duration is rejected but "10s" isn't
+	switch raw.(type) {
+	case bool, int, int64, uint64, float64:
+		if ok, err := assignString(v, fmt.Sprint(raw)); ok {
+			if err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: cannot be configured from %T", path, raw)
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	urlType      = reflect.TypeOf(url.URL{})
+	regexpType   = reflect.TypeOf(regexp.Regexp{})
+)
+
+// assignString sets v from its string form, returning false if v has no string form
+func assignString(v reflect.Value, s string) (bool, error) {
+	switch v.Type() {
+	case durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return true, err
+		}
+		v.SetInt(int64(d))
+		return true, nil
+
+	case urlType:
+		u, err := url.Parse(s)
+		if err != nil {
+			return true, err
+		}
+		v.Set(reflect.ValueOf(*u))
+		return true, nil
+
+	case regexpType:
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return true, err
+		}
+		v.Set(reflect.ValueOf(*re))
+		return true, nil
+	}
+
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return true, u.UnmarshalText([]byte(s))
+		}
+	}
+
+	var err error
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(s, 0, v.Type().Bits())
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		u, err = strconv.ParseUint(s, 0, v.Type().Bits())
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(s, v.Type().Bits())
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return false, nil
+		}
+		v.SetBytes([]byte(s))
+	default:
+		return false, nil
+	}
+
+	return true, err
+}
+
+// env sets the fields of the struct from the environment variables, keyed by their normalized names,
+// with the normalized prefix
+func env(v reflect.Value, prefix string, vars map[string]variable) error {
+	for _, f := range fields(v) {
+		name := prefix + normalize(f.name)
+
+		fv := f.value
+		if fv.Kind() == reflect.Pointer && fv.Type().Elem().Kind() == reflect.Struct && !scalar(fv.Type().Elem()) {
+			if !hasPrefix(vars, name) {
+				continue
+			}
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			fv = fv.Elem()
+		}
+
+		if fv.Kind() == reflect.Struct && !scalar(fv.Type()) {
+			if err := env(fv, name, vars); err != nil {
+				return err
+			}
+			continue
+		}
+
+		e, ok := vars[name]
+		if !ok {
+			continue
+		}
+
+		if err := assign(f.value, envValue(f.value.Type(), e.value), e.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envValue returns the raw value of an environment variable, splitting lists and maps
+func envValue(t reflect.Type, s string) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if scalar(t) || s == "" {
+		return s
+	}
+
+	switch {
+	case t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8:
+		var items []any
+		for _, item := range strings.Split(s, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+		return items
+
+	case t.Kind() == reflect.Map:
+		m := make(map[string]any)
+		for _, pair := range strings.Split(s, ",") {
+			k, val, _ := strings.Cut(pair, "=")
+			m[strings.TrimSpace(k)] = strings.TrimSpace(val)
+		}
+		return m
+	}
+
+	return s
+}
+
+// scalar returns whether the type is set from a single string, rather than from its fields
+func scalar(t reflect.Type) bool {
+	if t == urlType || t == regexpType {
+		return true
+	}
+	return reflect.PointerTo(t).Implements(reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem())
+}
+
+// hasPrefix returns whether any environment variable is within the prefix
+func hasPrefix(vars map[string]variable, prefix string) bool {
+	for name := range vars {
+		if strings.HasPrefix(name, prefix) && name != prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldIndex returns the index of the field named by the key, or -1
+func fieldIndex(fs []field, key string) int {
+	for i, f := range fs {
+		if normalize(f.name) == normalize(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// join returns the path of the key within the path
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
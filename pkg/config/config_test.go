@@ -0,0 +1,233 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+type retryOptions struct {
+	MaxAttempts int
+	MaxElapsed  time.Duration
+}
+
+type limits struct {
+	MaxPayload int `yaml:"max_payload"`
+}
+
+type testOptions struct {
+	ACLHost   *url.URL
+	Pattern   *regexp.Regexp
+	CacheTTL  time.Duration
+	CacheSize int
+	Enabled   bool
+	Ratio     float64
+	Qos       *byte
+	Listeners []string
+	Limits    map[string]int
+	ACL       acl.Templates
+	Retry     *retryOptions
+	Config    any
+	Renamed   string `config:"name"`
+	Ignored   string `config:"-"`
+	Callback  func() bool
+	limits
+}
+
+// validatedOptions fails validation without a host
+type validatedOptions struct {
+	Host string
+}
+
+func (o *validatedOptions) Validate() error {
+	if o.Host == "" {
+		return errors.New("host is required")
+	}
+	return nil
+}
+
+func TestDecode(t *testing.T) {
+	data := `
+hooks:
+  http:
+    acl_host: http://acl.example.com/check
+    pattern: ^[a-z]+$
+    cacheTTL: 30s
+    cache-size: 100
+    enabled: true
+    ratio: 0.5
+    qos: 1
+    listeners: [tcp, ws]
+    limits:
+      a: 1
+    acl:
+      "devices/{clientid}/#": rw
+    retry:
+      max_attempts: 3
+    config:
+      anything: goes
+    name: renamed
+    max_payload: 1024
+`
+
+	options := testOptions{CacheSize: 10, Renamed: "default"}
+	require.NoError(t, Decode([]byte(data), "hooks.http", &options))
+
+	require.Equal(t, "acl.example.com", options.ACLHost.Host)
+	require.True(t, options.Pattern.MatchString("abc"))
+	require.Equal(t, 30*time.Second, options.CacheTTL)
+	require.Equal(t, 100, options.CacheSize)
+	require.True(t, options.Enabled)
+	require.Equal(t, 0.5, options.Ratio)
+	require.Equal(t, byte(1), *options.Qos)
+	require.Equal(t, []string{"tcp", "ws"}, options.Listeners)
+	require.Equal(t, map[string]int{"a": 1}, options.Limits)
+	require.Equal(t, acl.Templates{"devices/{clientid}/#": acl.ReadWrite}, options.ACL)
+	require.Equal(t, &retryOptions{MaxAttempts: 3}, options.Retry)
+	require.Equal(t, map[string]any{"anything": "goes"}, options.Config)
+	require.Equal(t, "renamed", options.Renamed)
+	require.Equal(t, 1024, options.MaxPayload)
+}
+
+func TestDecodeJSON(t *testing.T) {
+	options := testOptions{CacheSize: 10}
+	require.NoError(t, Decode([]byte(`{"CacheTTL": "1m", "Listeners": ["tcp"]}`), "", &options))
+	require.Equal(t, time.Minute, options.CacheTTL)
+	require.Equal(t, []string{"tcp"}, options.Listeners)
+
+	// fields which aren't set keep their defaults
+	require.Equal(t, 10, options.CacheSize)
+
+	require.NoError(t, Decode(nil, "", &options))
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		key     string
+		options any
+	}{
+		{
+			name:    "Failure - not a pointer",
+			data:    "{}",
+			options: testOptions{},
+		},
+		{
+			name:    "Failure - invalid yaml",
+			data:    "a: [",
+			options: new(testOptions),
+		},
+		{
+			name:    "Failure - missing section",
+			data:    "hooks: {}",
+			key:     "hooks.http",
+			options: new(testOptions),
+		},
+		{
+			name:    "Failure - unknown key",
+			data:    "cache_tll: 1m",
+			options: new(testOptions),
+		},
+		{
+			name:    "Failure - ignored key",
+			data:    "ignored: x",
+			options: new(testOptions),
+		},
+		{
+			name:    "Failure - duration without unit",
+			data:    "cache_ttl: 10",
+			options: new(testOptions),
+		},
+		{
+			name:    "Failure - invalid pattern",
+			data:    "pattern: '['",
+			options: new(testOptions),
+		},
+		{
+			name:    "Failure - overflow",
+			data:    "qos: 256",
+			options: new(testOptions),
+		},
+		{
+			name:    "Failure - invalid access",
+			data:    "acl: {a: x}",
+			options: new(testOptions),
+		},
+		{
+			name:    "Failure - list expected",
+			data:    "listeners: tcp",
+			options: new(testOptions),
+		},
+		{
+			name:    "Failure - func",
+			data:    "callback: x",
+			options: new(testOptions),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Error(t, Decode([]byte(tt.data), tt.key, tt.options))
+
+		})
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Setenv("MQTT_HTTP_ACL_HOST", "http://acl.example.com")
+	t.Setenv("MQTT_HTTP_CACHE_TTL", "5s")
+	t.Setenv("MQTT_HTTP_ENABLED", "true")
+	t.Setenv("MQTT_HTTP_QoS", "2")
+	t.Setenv("MQTT_HTTP_LISTENERS", "tcp, ws")
+	t.Setenv("MQTT_HTTP_LIMITS", "a=1,b=2")
+	t.Setenv("MQTT_HTTP_ACL", "public/#=r")
+	t.Setenv("MQTT_HTTP_RETRY_MAX_ATTEMPTS", "4")
+	t.Setenv("MQTT_HTTP_NAME", "renamed")
+	t.Setenv("MQTT_HTTP_MAX_PAYLOAD", "64")
+
+	options := testOptions{CacheSize: 10}
+	require.NoError(t, Env("MQTT_HTTP", &options))
+
+	require.Equal(t, "acl.example.com", options.ACLHost.Host)
+	require.Equal(t, 5*time.Second, options.CacheTTL)
+	require.Equal(t, 10, options.CacheSize)
+	require.True(t, options.Enabled)
+	require.Equal(t, byte(2), *options.Qos)
+	require.Equal(t, []string{"tcp", "ws"}, options.Listeners)
+	require.Equal(t, map[string]int{"a": 1, "b": 2}, options.Limits)
+	require.Equal(t, acl.Templates{"public/#": acl.ReadOnly}, options.ACL)
+	require.Equal(t, &retryOptions{MaxAttempts: 4}, options.Retry)
+	require.Equal(t, "renamed", options.Renamed)
+	require.Equal(t, 64, options.MaxPayload)
+
+	t.Setenv("MQTT_HTTP_CACHE_SIZE", "many")
+	require.ErrorContains(t, Env("MQTT_HTTP", &options), "MQTT_HTTP_CACHE_SIZE")
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"hooks": {"http": {"host": "file"}}}`), 0o600))
+
+	options := new(validatedOptions)
+	require.NoError(t, Load(options, Source{Path: path, Key: "hooks.http"}))
+	require.Equal(t, "file", options.Host)
+
+	// the environment overrides the file
+	t.Setenv("MQTT_TEST_HOST", "env")
+	require.NoError(t, Load(options, Source{Path: path, Key: "hooks.http", EnvPrefix: "MQTT_TEST"}))
+	require.Equal(t, "env", options.Host)
+
+	require.ErrorContains(t, Load(new(validatedOptions), Source{}), "host is required")
+	require.Error(t, Load(options, Source{Path: filepath.Join(t.TempDir(), "missing.yml")}))
+	require.ErrorContains(t, Load(options, Source{Path: path, Key: "hooks.ldap"}), path)
+}
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+)
+
+// Reloader is implemented by hooks which can apply new options without restarting the broker, eg.
+// changed ACLs, endpoints or limits. The config is of the same type as the one passed to Init, and
+// the current options are kept if it returns an error
+type Reloader interface {
+	Reload(config any) error
+}
+
+// WatcherOptions configures a watcher
+type WatcherOptions struct {
+	// Interval is how often the files are checked for changes, defaults to 5 seconds
+	Interval time.Duration
+
+	// ReloadOnSignal reloads every hook when SIGHUP is received
+	ReloadOnSignal bool
+
+	// Log is where failed reloads are reported, defaults to slog.Default
+	Log *slog.Logger
+}
+
+// Watcher reloads hooks when their config files change, eg.
+//
+//	w := config.NewWatcher(config.WatcherOptions{ReloadOnSignal: true})
+//	err := w.Add(rateLimitHook, config.Source{Path: "config.yml", Key: "hooks.ratelimit"}, func() any {
+//		return &ratelimit.Options{Window: time.Minute}
+//	})
+//	w.Start()
+//	defer w.Stop()
+type Watcher struct {
+	options WatcherOptions
+	watches []*watch
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+}
+
+// watch is a hook reloaded from a source
+type watch struct {
+	hook     mqtt.Hook
+	src      Source
+	options  func() any
+	modified time.Time // of the file when the hook was last reloaded
+}
+
+// NewWatcher returns a watcher which isn't watching any hooks yet
+func NewWatcher(options WatcherOptions) *Watcher {
+	if options.Interval <= 0 {
+		options.Interval = 5 * time.Second
+	}
+
+	if options.Log == nil {
+		options.Log = slog.Default()
+	}
+
+	return &Watcher{options: options}
+}
+
+// Add reloads the hook, which must implement Reloader, whenever the file of the source changes.
+// The options func returns a pointer to the hook's options with their defaults, which is populated
+// from the source, eg. func() any { return &auth.Options{CacheTTL: time.Minute} }. The hook is
+// expected to have been initialized from the current file already
+func (w *Watcher) Add(hook mqtt.Hook, src Source, options func() any) error {
+	if _, ok := hook.(Reloader); !ok {
+		return fmt.Errorf("%s hook cannot be reloaded", hook.ID())
+	}
+
+	if src.Path == "" {
+		return errors.New("path is required")
+	}
+
+	info, err := os.Stat(src.Path)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watches = append(w.watches, &watch{
+		hook:     hook,
+		src:      src,
+		options:  options,
+		modified: info.ModTime(),
+	})
+	return nil
+}
+
+// Start checks the files for changes until the watcher is stopped
+func (w *Watcher) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w.mu.Lock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.cancel = cancel
+	w.mu.Unlock()
+
+	go w.run(ctx)
+}
+
+// Stop stops checking the files
+func (w *Watcher) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+}
+
+// run checks the files at the interval, and reloads every hook on SIGHUP, until the context is
+// cancelled
+func (w *Watcher) run(ctx context.Context) {
+	ticker := time.NewTicker(w.options.Interval)
+	defer ticker.Stop()
+
+	var hup chan os.Signal
+	if w.options.ReloadOnSignal {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Check()
+		case <-hup:
+			if err := w.Reload(); err != nil {
+				w.options.Log.Error("error occurred while reloading hooks", "error", err)
+			}
+		}
+	}
+}
+
+// Check reloads the hooks whose files changed since they were last reloaded, logging failures. A
+// file which fails to load is retried at each check until it is fixed
+func (w *Watcher) Check() {
+	for _, wt := range w.list() {
+		info, err := os.Stat(wt.src.Path)
+		if err != nil {
+			continue
+		}
+
+		w.mu.Lock()
+		changed := !info.ModTime().Equal(wt.modified)
+		w.mu.Unlock()
+		if !changed {
+			continue
+		}
+
+		if err := w.reload(wt); err != nil {
+			w.options.Log.Error("error occurred while reloading hook", "error", err, "hook", wt.hook.ID(), "path", wt.src.Path)
+		}
+	}
+}
+
+// Reload reloads every hook, returning the failures
+func (w *Watcher) Reload() error {
+	var errs []error
+	for _, wt := range w.list() {
+		if err := w.reload(wt); err != nil {
+			errs = append(errs, fmt.Errorf("%s hook: %w", wt.hook.ID(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// list returns the watched hooks
+func (w *Watcher) list() []*watch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*watch(nil), w.watches...)
+}
+
+// reload loads the options of the hook from its source and reloads the hook with them
+func (w *Watcher) reload(wt *watch) error {
+	info, err := os.Stat(wt.src.Path)
+	if err != nil {
+		return err
+	}
+
+	options := wt.options()
+	if err := Load(options, wt.src); err != nil {
+		return err
+	}
+
+	if err := wt.hook.(Reloader).Reload(reflect.ValueOf(options).Elem().Interface()); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	wt.modified = info.ModTime()
+	w.mu.Unlock()
+
+	w.options.Log.Info("reloaded hook", "hook", wt.hook.ID(), "path", wt.src.Path)
+	return nil
+}
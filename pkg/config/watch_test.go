@@ -0,0 +1,167 @@
+package config
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type limitOptions struct {
+	Limit  int
+	Window time.Duration
+}
+
+// reloadableHook records the options it is reloaded with, rejecting negative limits
+type reloadableHook struct {
+	reloads []limitOptions
+	mu      sync.Mutex
+	mqtt.HookBase
+}
+
+func (h *reloadableHook) ID() string {
+	return "reloadable"
+}
+
+func (h *reloadableHook) Reload(config any) error {
+	options, ok := config.(limitOptions)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if options.Limit < 0 {
+		return errors.New("limit must not be negative")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reloads = append(h.reloads, options)
+	return nil
+}
+
+func (h *reloadableHook) last() (limitOptions, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.reloads) == 0 {
+		return limitOptions{}, 0
+	}
+	return h.reloads[len(h.reloads)-1], len(h.reloads)
+}
+
+// write writes the file with a modification time which differs from the previous write
+func write(t *testing.T, path, data string, modified time.Time) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	require.NoError(t, os.Chtimes(path, modified, modified))
+}
+
+func newWatcher(t *testing.T, options WatcherOptions) *Watcher {
+	t.Helper()
+
+	options.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	w := NewWatcher(options)
+	t.Cleanup(w.Stop)
+	return w
+}
+
+func defaultLimits() any {
+	return &limitOptions{Window: time.Minute}
+}
+
+func TestWatcherAdd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	write(t, path, "limit: 1", time.Now())
+
+	w := newWatcher(t, WatcherOptions{})
+	require.Equal(t, 5*time.Second, w.options.Interval)
+
+	require.NoError(t, w.Add(new(reloadableHook), Source{Path: path}, defaultLimits))
+	require.ErrorContains(t, w.Add(new(mqtt.HookBase), Source{Path: path}, defaultLimits), "cannot be reloaded")
+	require.Error(t, w.Add(new(reloadableHook), Source{}, defaultLimits))
+	require.Error(t, w.Add(new(reloadableHook), Source{Path: filepath.Join(t.TempDir(), "missing.yml")}, defaultLimits))
+}
+
+func TestWatcherCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	start := time.Now().Add(-time.Hour)
+	write(t, path, "hooks:\n  limits:\n    limit: 1", start)
+
+	hook := new(reloadableHook)
+	w := newWatcher(t, WatcherOptions{})
+	require.NoError(t, w.Add(hook, Source{Path: path, Key: "hooks.limits"}, defaultLimits))
+
+	// unchanged files are not reloaded
+	w.Check()
+	_, n := hook.last()
+	require.Zero(t, n)
+
+	write(t, path, "hooks:\n  limits:\n    limit: 2", start.Add(time.Second))
+	w.Check()
+	options, n := hook.last()
+	require.Equal(t, 1, n)
+	require.Equal(t, limitOptions{Limit: 2, Window: time.Minute}, options)
+
+	w.Check()
+	_, n = hook.last()
+	require.Equal(t, 1, n)
+
+	// options the hook rejects, and files which fail to load, are retried until they are fixed
+	write(t, path, "hooks:\n  limits:\n    limit: -1", start.Add(2*time.Second))
+	w.Check()
+	write(t, path, "hooks:\n  limits:\n    limt: 3", start.Add(3*time.Second))
+	w.Check()
+	_, n = hook.last()
+	require.Equal(t, 1, n)
+
+	write(t, path, "hooks:\n  limits:\n    limit: 3", start.Add(3*time.Second))
+	w.Check()
+	options, n = hook.last()
+	require.Equal(t, 2, n)
+	require.Equal(t, 3, options.Limit)
+}
+
+func TestWatcherReload(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.yml")
+	bad := filepath.Join(dir, "bad.yml")
+	write(t, good, "limit: 1", time.Now())
+	write(t, bad, "limit: 1", time.Now())
+
+	a := new(reloadableHook)
+	b := new(reloadableHook)
+	w := newWatcher(t, WatcherOptions{})
+	require.NoError(t, w.Add(a, Source{Path: good}, defaultLimits))
+	require.NoError(t, w.Add(b, Source{Path: bad}, defaultLimits))
+	write(t, bad, "limit: -1", time.Now())
+
+	err := w.Reload()
+	require.ErrorContains(t, err, "reloadable hook: limit must not be negative")
+	_, n := a.last()
+	require.Equal(t, 1, n)
+}
+
+func TestWatcherStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	start := time.Now().Add(-time.Hour)
+	write(t, path, "limit: 1", start)
+
+	hook := new(reloadableHook)
+	w := newWatcher(t, WatcherOptions{Interval: time.Millisecond})
+	require.NoError(t, w.Add(hook, Source{Path: path}, defaultLimits))
+	w.Start()
+
+	write(t, path, "limit: 2", start.Add(time.Second))
+	require.Eventually(t, func() bool {
+		options, _ := hook.last()
+		return options.Limit == 2
+	}, time.Second, time.Millisecond)
+
+	w.Stop()
+	w.Stop()
+}
@@ -0,0 +1,642 @@
+// Package filter is the language in which bridge and sink hooks select the messages they forward,
+// combining the topic of a message with predicates on its payload and properties, eg.
+//
+//	topic matches "sensors/+/readings" && qos >= 1 && json.temperature > 30 && !retain
+//
+// An expression compares the fields of a message with literals, or with other fields, and combines
+// the comparisons with && (and), || (or), ! (not) and parentheses. The fields are
+//
+//	topic         the topic of the message
+//	client        the id of the publishing client
+//	username      the username of the publishing client
+//	qos           the QoS of the message
+//	retain        whether the message is retained
+//	size          the size of the payload in bytes
+//	payload       the payload, as a string
+//	content_type  the MQTT 5 content type of the message
+//	level.N       the Nth level of the topic, counting from 1
+//	user.KEY      the value of the user property KEY
+//	json.PATH     the field of a JSON payload, whose PATH is its keys and array indexes joined by dots
+//
+// Literals are strings in double or single quotes, numbers, true, false and null, which fields the
+// message doesn't have are equal to. The operators are == and != for any values, <, <=, > and >= for
+// numbers and strings, matches for MQTT topic filters, =~ for regular expressions, contains for
+// substrings, and in for lists of literals, eg. client in ["a", "b"]. Comparisons of values of
+// different types are false, and a field on its own is true if it is the boolean true.
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// Expr is a compiled filter expression
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile parses the expression. An empty expression compiles to nil, which matches every message
+func Compile(src string) (*Expr, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, nil
+	}
+
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", src, err)
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = fmt.Errorf("unexpected %s", p.peek())
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", src, err)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// MustCompile parses the expression, and panics if it is invalid
+func MustCompile(src string) *Expr {
+	e, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	if e == nil {
+		return ""
+	}
+	return e.src
+}
+
+// Match returns whether the message published by the client matches the expression. A nil
+// expression matches every message
+func (e *Expr) Match(cl *mqtt.Client, pk packets.Packet) bool {
+	if e == nil {
+		return true
+	}
+	return e.root.eval(&message{cl: cl, pk: pk}) == true
+}
+
+// message is a message being matched, whose JSON payload is decoded once it is needed
+type message struct {
+	cl      *mqtt.Client
+	pk      packets.Packet
+	doc     any
+	decoded bool
+}
+
+// json returns the decoded JSON payload, or nil if it isn't JSON
+func (m *message) json() any {
+	if !m.decoded {
+		m.decoded = true
+		if json.Unmarshal(m.pk.Payload, &m.doc) != nil {
+			m.doc = nil
+		}
+	}
+	return m.doc
+}
+
+// node is a node of the syntax tree of an expression, evaluating to nil, a bool, a float64 or a
+// string, or to a []any or map[string]any of a JSON payload
+type node interface {
+	eval(m *message) any
+}
+
+type literal struct {
+	value any
+}
+
+func (n literal) eval(*message) any {
+	return n.value
+}
+
+type field func(m *message) any
+
+func (n field) eval(m *message) any {
+	return n(m)
+}
+
+type not struct {
+	operand node
+}
+
+func (n not) eval(m *message) any {
+	return n.operand.eval(m) != true
+}
+
+type and struct {
+	left, right node
+}
+
+func (n and) eval(m *message) any {
+	return n.left.eval(m) == true && n.right.eval(m) == true
+}
+
+type or struct {
+	left, right node
+}
+
+func (n or) eval(m *message) any {
+	return n.left.eval(m) == true || n.right.eval(m) == true
+}
+
+type compare struct {
+	op          string
+	left, right node
+}
+
+func (n compare) eval(m *message) any {
+	l, r := n.left.eval(m), n.right.eval(m)
+	switch n.op {
+	case "==":
+		return equal(l, r)
+	case "!=":
+		return !equal(l, r)
+	case "contains":
+		ls, lok := l.(string)
+		rs, rok := r.(string)
+		return lok && rok && strings.Contains(ls, rs)
+	}
+
+	switch l := l.(type) {
+	case float64:
+		r, ok := r.(float64)
+		return ok && order(n.op, compareFloats(l, r))
+	case string:
+		r, ok := r.(string)
+		return ok && order(n.op, strings.Compare(l, r))
+	}
+	return false
+}
+
+type matches struct {
+	operand node
+	filter  string
+}
+
+func (n matches) eval(m *message) any {
+	s, ok := n.operand.eval(m).(string)
+	return ok && acl.Match(n.filter, s)
+}
+
+type regex struct {
+	operand node
+	re      *regexp.Regexp
+}
+
+func (n regex) eval(m *message) any {
+	s, ok := n.operand.eval(m).(string)
+	return ok && n.re.MatchString(s)
+}
+
+type in struct {
+	operand node
+	values  []any
+}
+
+func (n in) eval(m *message) any {
+	v := n.operand.eval(m)
+	for _, value := range n.values {
+		if equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal returns whether the values are equal, comparing JSON objects and arrays by their encoding
+func equal(a, b any) bool {
+	switch a.(type) {
+	case map[string]any, []any:
+		x, _ := json.Marshal(a)
+		y, _ := json.Marshal(b)
+		return string(x) == string(y)
+	}
+
+	switch b.(type) {
+	case map[string]any, []any:
+		return false
+	}
+	return a == b
+}
+
+// compareFloats returns -1, 0 or 1 as a is less than, equal to or greater than b
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// order returns whether the result of a comparison satisfies the ordering operator
+func order(op string, c int) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// fieldOf returns the field with the name
+func fieldOf(name string) (node, error) {
+	switch name {
+	case "topic":
+		return field(func(m *message) any { return m.pk.TopicName }), nil
+	case "client":
+		return field(func(m *message) any { return m.cl.ID }), nil
+	case "username":
+		return field(func(m *message) any { return string(m.cl.Properties.Username) }), nil
+	case "qos":
+		return field(func(m *message) any { return float64(m.pk.FixedHeader.Qos) }), nil
+	case "retain":
+		return field(func(m *message) any { return m.pk.FixedHeader.Retain }), nil
+	case "size":
+		return field(func(m *message) any { return float64(len(m.pk.Payload)) }), nil
+	case "payload":
+		return field(func(m *message) any { return string(m.pk.Payload) }), nil
+	case "content_type":
+		return field(func(m *message) any { return m.pk.Properties.ContentType }), nil
+	}
+
+	prefix, rest, ok := strings.Cut(name, ".")
+	if !ok || rest == "" {
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+
+	switch prefix {
+	case "level":
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid topic level %q", rest)
+		}
+
+		return field(func(m *message) any {
+			levels := strings.Split(m.pk.TopicName, "/")
+			if n > len(levels) {
+				return nil
+			}
+			return levels[n-1]
+		}), nil
+	case "user":
+		return field(func(m *message) any {
+			for _, p := range m.pk.Properties.User {
+				if p.Key == rest {
+					return p.Val
+				}
+			}
+			return nil
+		}), nil
+	case "json":
+		keys := strings.Split(rest, ".")
+		return field(func(m *message) any {
+			return lookup(m.json(), keys)
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown field %q", name)
+}
+
+// lookup returns the field of the document at the keys, or nil if it has no such field
+func lookup(doc any, keys []string) any {
+	for _, key := range keys {
+		switch v := doc.(type) {
+		case map[string]any:
+			doc = v[key]
+		case []any:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(v) {
+				return nil
+			}
+			doc = v[n]
+		default:
+			return nil
+		}
+	}
+	return doc
+}
+
+// parser is a recursive descent parser of the tokens of an expression
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// or parses operands joined by || or or
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is("||", "or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+// and parses operands joined by && or and
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is("&&", "and") {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+// unary parses a negated operand, or a comparison
+func (p *parser) unary() (node, error) {
+	if p.peek().is("!", "not") {
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{operand}, nil
+	}
+	return p.comparison()
+}
+
+// comparison parses an operand, optionally compared with another
+func (p *parser) comparison() (node, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+	switch {
+	case op.is("==", "!=", "<", "<=", ">", ">=", "contains"):
+		p.next()
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return compare{op: op.text, left: left, right: right}, nil
+	case op.is("matches"):
+		p.next()
+		t := p.next()
+		if t.kind != tokenString || !mqtt.IsValidFilter(t.text, false) {
+			return nil, fmt.Errorf("matches needs a topic filter, not %s", t)
+		}
+		return matches{operand: left, filter: t.text}, nil
+	case op.is("=~"):
+		p.next()
+		t := p.next()
+		if t.kind != tokenString {
+			return nil, fmt.Errorf("=~ needs a regular expression, not %s", t)
+		}
+
+		re, err := regexp.Compile(t.text)
+		if err != nil {
+			return nil, err
+		}
+		return regex{operand: left, re: re}, nil
+	case op.is("in"):
+		p.next()
+		values, err := p.list()
+		if err != nil {
+			return nil, err
+		}
+		return in{operand: left, values: values}, nil
+	}
+	return left, nil
+}
+
+// list parses a list of literals in brackets
+func (p *parser) list() ([]any, error) {
+	if t := p.next(); !t.is("[") {
+		return nil, fmt.Errorf("in needs a list, not %s", t)
+	}
+
+	var values []any
+	for !p.peek().is("]") {
+		if len(values) > 0 {
+			if t := p.next(); !t.is(",") {
+				return nil, fmt.Errorf("expected , not %s", t)
+			}
+		}
+
+		t := p.next()
+		value, ok := t.literal()
+		if !ok {
+			return nil, fmt.Errorf("expected a literal, not %s", t)
+		}
+		values = append(values, value)
+	}
+	p.next()
+	return values, nil
+}
+
+// operand parses a literal, a field or a parenthesized expression
+func (p *parser) operand() (node, error) {
+	t := p.next()
+	if value, ok := t.literal(); ok {
+		return literal{value}, nil
+	}
+
+	switch {
+	case t.kind == tokenIdent:
+		return fieldOf(t.text)
+	case t.is("("):
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if t := p.next(); !t.is(")") {
+			return nil, fmt.Errorf("expected ) not %s", t)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", t)
+}
+
+// the kinds of tokens
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+// is returns whether the token is one of the operators or keywords
+func (t token) is(texts ...string) bool {
+	if t.kind != tokenOperator && t.kind != tokenIdent {
+		return false
+	}
+
+	for _, text := range texts {
+		if t.text == text {
+			return true
+		}
+	}
+	return false
+}
+
+// literal returns the value of a literal token
+func (t token) literal() (any, bool) {
+	switch t.kind {
+	case tokenString:
+		return t.text, true
+	case tokenNumber:
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return f, true
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		case "null":
+			return nil, true
+		}
+	}
+	return nil, false
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of filter"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// operators are the operators, longest first
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "<", ">", "!", "(", ")", "[", "]", ","}
+
+// tokenize splits the expression into tokens
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			s, n, err := unquote(src[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenString, s})
+			i += n
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(src) && strings.IndexByte("0123456789.eE+-", src[j]) >= 0 {
+				j++
+			}
+
+			if _, err := strconv.ParseFloat(src[i:j], 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q", src[i:j])
+			}
+			tokens = append(tokens, token{tokenNumber, src[i:j]})
+			i = j
+		case isIdent(c):
+			j := i + 1
+			for j < len(src) && (isIdent(src[j]) || src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == '-') {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdent, src[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q", c)
+			}
+			tokens = append(tokens, token{tokenOperator, op})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+// isIdent returns whether the character can start an identifier
+func isIdent(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$'
+}
+
+// unquote returns the string quoted at the start of s, in which a backslash escapes the next
+// character, and the length of the quoted string
+func unquote(s string) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", 0, errors.New("unterminated string")
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return "", 0, errors.New("unterminated string")
+}
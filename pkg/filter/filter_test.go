@@ -0,0 +1,146 @@
+package filter
+
+import (
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name        string
+		src         string
+		expectError bool
+	}{
+		{
+			name:        "Success - comparison",
+			src:         `qos >= 1`,
+			expectError: false,
+		},
+		{
+			name:        "Success - combined",
+			src:         `topic matches "sensors/#" and (json.temperature > 30.5 or not retain) && client in ["a", 'b']`,
+			expectError: false,
+		},
+		{
+			name:        "Success - empty",
+			src:         ``,
+			expectError: false,
+		},
+		{
+			name:        "Failure - unknown field",
+			src:         `color == "red"`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid level",
+			src:         `level.0 == "a"`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid topic filter",
+			src:         `topic matches "a/#/b"`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid regular expression",
+			src:         `payload =~ "("`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - unterminated string",
+			src:         `client == "a`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - unbalanced parentheses",
+			src:         `(qos == 1`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - trailing tokens",
+			src:         `qos == 1 2`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - list of fields",
+			src:         `client in [topic]`,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Compile(tt.src)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.src, e.String())
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.Username = []byte("alice")
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "sensors/d1/readings",
+		Payload:     []byte(`{"temperature":31.5,"unit":"C","ok":true,"readings":[{"value":4}],"tags":["a"]}`),
+		Properties: packets.Properties{
+			ContentType: "application/json",
+			User:        []packets.UserProperty{{Key: "site", Val: "north"}},
+		},
+	}
+
+	tests := []struct {
+		src    string
+		expect bool
+	}{
+		{`topic == "sensors/d1/readings"`, true},
+		{`topic matches "sensors/+/readings"`, true},
+		{`topic matches "alerts/#"`, false},
+		{`client == "c1" && username == 'alice'`, true},
+		{`qos >= 1 && retain`, true},
+		{`!retain`, false},
+		{`not (qos == 0)`, true},
+		{`size < 10`, false},
+		{`payload contains "temperature"`, true},
+		{`content_type == "application/json"`, true},
+		{`level.2 == "d1" && level.4 == null`, true},
+		{`user.site in ["north", "south"]`, true},
+		{`user.missing == null`, true},
+		{`json.temperature > 30 and json.unit == "C"`, true},
+		{`json.temperature <= -1`, false},
+		{`json.ok`, true},
+		{`json.readings.0.value == 4`, true},
+		{`json.tags == json.tags`, true},
+		{`json.unit > 1`, false},
+		{`json.unit != 1`, true},
+		{`client =~ "^c[0-9]+$"`, true},
+		{`qos == 2 || topic =~ "readings$"`, true},
+		{`json.missing.field == null`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			require.Equal(t, tt.expect, MustCompile(tt.src).Match(cl, pk))
+		})
+	}
+}
+
+func TestMatchNotJSON(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	pk := packets.Packet{TopicName: "a", Payload: []byte("21.5")}
+
+	require.True(t, MustCompile(`json.value == null`).Match(cl, pk))
+	require.False(t, MustCompile(`json.value > 0`).Match(cl, pk))
+
+	var e *Expr
+	require.True(t, e.Match(cl, pk))
+}
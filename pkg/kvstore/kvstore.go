@@ -0,0 +1,606 @@
+// Package kvstore persists the state of the server to an embedded key-value store, such as BadgerDB
+// or Pebble, and is the base of the storage hooks built on them
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+
+	"github.com/mochi-mqtt/hooks/pkg/coalesce"
+	"github.com/mochi-mqtt/hooks/pkg/records"
+)
+
+// Store is an embedded key-value store, usually a thin adapter of a database opened by the application
+type Store interface {
+	// NewBatch returns a batch of writes which are applied atomically when it is committed
+	NewBatch() Batch
+
+	// Get returns the value of the key, or nil if it doesn't exist
+	Get(key []byte) ([]byte, error)
+
+	// Iterate calls fn with each key with the prefix and its value in key order, which are only
+	// valid during the call, stopping at the first error
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+
+	// Sync writes everything committed so far to disk
+	Sync() error
+
+	// Close closes the store
+	Close() error
+}
+
+// Batch is a set of writes which are applied atomically
+type Batch interface {
+	// Set sets the key to the value. Stores with native expiry may drop the key once the ttl has
+	// passed, if it isn't 0, and the others keep it until it is read
+	Set(key, value []byte, ttl time.Duration) error
+
+	// Delete deletes the key
+	Delete(key []byte) error
+
+	// Commit applies the writes, and only returns once they are on disk if sync is true
+	Commit(sync bool) error
+
+	// Discard releases a batch which won't be committed
+	Discard()
+}
+
+// SyncMode is when committed writes are synced to disk
+type SyncMode int
+
+const (
+	// SyncAlways syncs the writes of each event before the event returns, so none are lost if the
+	// machine crashes
+	SyncAlways SyncMode = iota
+
+	// SyncInterval syncs the writes every SyncInterval, so the writes of the last interval may be lost
+	// if the machine crashes, but not if only the broker does
+	SyncInterval
+
+	// SyncNever leaves syncing to the store and the operating system
+	SyncNever
+)
+
+// String returns the name of the sync mode
+func (m SyncMode) String() string {
+	switch m {
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	}
+	return "always"
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler so the sync mode can be written as "always",
+// "interval" or "never" in config files
+func (m *SyncMode) UnmarshalText(b []byte) error {
+	for _, v := range []SyncMode{SyncAlways, SyncInterval, SyncNever} {
+		if string(b) == v.String() {
+			*m = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sync mode %q", b)
+}
+
+// the key prefixes of each kind of record, as used by the storage hooks of the server
+var (
+	clientPrefix       = []byte(storage.ClientKey + "_")
+	subscriptionPrefix = []byte(storage.SubscriptionKey + "_")
+	retainedPrefix     = []byte(storage.RetainedKey + "_")
+	inflightPrefix     = []byte(storage.InflightKey + "_")
+	sysInfoKey         = []byte(storage.SysInfoKey)
+)
+
+// KeyRange returns the range of the keys of the records, from start inclusive to end exclusive, eg.
+// to compact them
+func KeyRange() (start, end []byte) {
+	return clientPrefix, append(append([]byte{}, sysInfoKey...), 0)
+}
+
+// Options configures how the records are written
+type Options struct {
+	SyncMode     SyncMode      // when writes are synced to disk, defaults to SyncAlways
+	SyncInterval time.Duration // how often writes are synced with SyncInterval, defaults to 1 second
+
+	// SessionTTL is how long the sessions of disconnected clients without a session expiry interval,
+	// ie. MQTT v3 clients, are kept. They are kept until they are taken over or expire in the server if 0
+	SessionTTL time.Duration
+
+	// Coalesce buffers the writes of events and commits them in batches, in which later writes of a
+	// record replace earlier ones, rather than committing a batch for every event. The writes which
+	// are pending when the broker crashes are lost
+	Coalesce *coalesce.Options
+}
+
+// Storage is the base of storage hooks persisting the clients, subscriptions, retained and inflight
+// messages and system info of the server to a Store, from which they are restored when it starts.
+// Sessions expire after their session expiry interval once their clients disconnect, and messages
+// after their message expiry interval, even while the broker is down. Storage hooks embed it, and
+// open it with their store when they are initialized
+type Storage struct {
+	store   Store
+	options Options
+	clients map[string]bool // the ids of the restored clients, whose other records are restored
+	writes  *coalesce.Coalescer[write]
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mqtt.HookBase
+}
+
+// Open starts storing the records in the store
+func (s *Storage) Open(store Store, options Options) error {
+	if store == nil {
+		return errors.New("store is required")
+	}
+
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = time.Second
+	}
+
+	s.store = store
+	s.options = options
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	if options.Coalesce != nil {
+		s.writes = coalesce.New(*options.Coalesce, s.flush, func(err error) {
+			s.Log.Error("error occurred while flushing writes", "error", err)
+		})
+		s.writes.Start()
+	}
+
+	if options.SyncMode == SyncInterval {
+		s.Every(options.SyncInterval, func() {
+			if err := store.Sync(); err != nil {
+				s.Log.Error("error occurred while syncing store", "error", err)
+			}
+		})
+	}
+
+	return nil
+}
+
+// Every runs fn at the interval until the storage is closed, eg. to collect the garbage of the store
+func (s *Storage) Every(interval time.Duration, fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// Close stops the background tasks, syncs the writes and closes the store
+func (s *Storage) Close() error {
+	if s.store == nil {
+		return nil
+	}
+
+	s.cancel()
+	s.wg.Wait()
+
+	var err error
+	if s.writes != nil {
+		err = s.writes.Stop()
+	}
+	return errors.Join(err, s.store.Sync(), s.store.Close())
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (s *Storage) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b})
+}
+
+// record is a record to store, with how long it is kept
+type record struct {
+	key  []byte
+	data interface{ MarshalBinary() ([]byte, error) }
+	ttl  time.Duration
+}
+
+// write is a coalesced write, which deletes the key if it has no record
+type write struct {
+	key    []byte
+	record *record
+}
+
+// write stores the records and deletes the keys in one batch, or queues them if writes are coalesced
+func (s *Storage) write(what string, set []record, del ...[]byte) {
+	if err := s.queue(set, del); err != nil {
+		s.Log.Error("error occurred while writing "+what, "error", err)
+	}
+}
+
+// queue stores the records and deletes the keys in one batch, or queues them if writes are coalesced
+func (s *Storage) queue(set []record, del [][]byte) error {
+	if s.writes == nil {
+		return s.apply(set, del)
+	}
+
+	for i := range set {
+		if err := s.writes.Add(string(set[i].key), write{key: set[i].key, record: &set[i]}); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range del {
+		if err := s.writes.Add(string(key), write{key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush applies a batch of coalesced writes
+func (s *Storage) flush(ctx context.Context, writes []write) error {
+	var set []record
+	var del [][]byte
+	for _, w := range writes {
+		if w.record != nil {
+			set = append(set, *w.record)
+		} else {
+			del = append(del, w.key)
+		}
+	}
+	return s.apply(set, del)
+}
+
+// apply stores the records and deletes the keys in one batch
+func (s *Storage) apply(set []record, del [][]byte) error {
+	if len(set) == 0 && len(del) == 0 {
+		return nil
+	}
+
+	values := make([][]byte, len(set))
+	for i, r := range set {
+		data, err := r.data.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		values[i] = encode(data, r.ttl)
+	}
+
+	b := s.store.NewBatch()
+	for i, r := range set {
+		if err := b.Set(r.key, values[i], r.ttl); err != nil {
+			b.Discard()
+			return err
+		}
+	}
+
+	for _, key := range del {
+		if err := b.Delete(key); err != nil {
+			b.Discard()
+			return err
+		}
+	}
+
+	return b.Commit(s.options.SyncMode == SyncAlways)
+}
+
+// encode prefixes the data with the unix time it expires at, or 0 if it doesn't
+func encode(data []byte, ttl time.Duration) []byte {
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).Unix()
+	}
+
+	value := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(value, uint64(expires))
+	return append(value, data...)
+}
+
+// decode returns the data of a value, and whether it has expired
+func decode(value []byte) ([]byte, bool, error) {
+	if len(value) < 8 {
+		return nil, false, errors.New("value too short")
+	}
+
+	expires := int64(binary.BigEndian.Uint64(value))
+	return value[8:], expires > 0 && expires <= time.Now().Unix(), nil
+}
+
+// key returns the key of a record
+func key(prefix []byte, id string) []byte {
+	return append(append([]byte{}, prefix...), id...)
+}
+
+// sessionTTL returns how long the session of a disconnected client is kept
+func (s *Storage) sessionTTL(cl *mqtt.Client) time.Duration {
+	props := cl.Properties.Props
+	if cl.Properties.ProtocolVersion < 5 || !props.SessionExpiryIntervalFlag {
+		return s.options.SessionTTL
+	}
+
+	if props.SessionExpiryInterval == math.MaxUint32 {
+		return 0
+	}
+	return time.Duration(props.SessionExpiryInterval) * time.Second
+}
+
+// messageTTL returns how long a message is kept, and whether it has expired already
+func messageTTL(pk packets.Packet) (time.Duration, bool) {
+	if pk.Expiry <= 0 {
+		return 0, false
+	}
+
+	ttl := time.Unix(pk.Expiry, 0).Sub(time.Now())
+	return ttl, ttl <= 0
+}
+
+// OnSessionEstablished is called when a client has connected, and stores the client, which is kept
+// while it is connected
+func (s *Storage) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	s.write("client", []record{{key: key(clientPrefix, cl.ID), data: records.Client(cl)}})
+}
+
+// OnWillSent is called when the will message of a client has been sent, and stores the client
+// without it
+func (s *Storage) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	var ttl time.Duration
+	if cl.Closed() {
+		ttl = s.sessionTTL(cl)
+	}
+	s.write("client", []record{{key: key(clientPrefix, cl.ID), data: records.Client(cl), ttl: ttl}})
+}
+
+// OnDisconnect is called when a client disconnects, and deletes it if its session has expired, or
+// keeps it for its session expiry interval. Sessions taken over by a new connection are left to it
+func (s *Storage) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if errors.Is(cl.StopCause(), packets.ErrSessionTakenOver) {
+		return
+	}
+
+	if expire {
+		s.write("client", nil, key(clientPrefix, cl.ID))
+		return
+	}
+
+	s.write("client", []record{{key: key(clientPrefix, cl.ID), data: records.Client(cl), ttl: s.sessionTTL(cl)}})
+}
+
+// OnClientExpired is called when the session of a client expires, and deletes the client
+func (s *Storage) OnClientExpired(cl *mqtt.Client) {
+	s.write("client", nil, key(clientPrefix, cl.ID))
+}
+
+// OnSubscribed is called when a client subscribes, and stores its subscriptions
+func (s *Storage) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	var set []record
+	for _, sub := range records.Subscriptions(cl, pk, reasonCodes) {
+		set = append(set, record{key: key(subscriptionPrefix, sub.ID), data: sub})
+	}
+	s.write("subscriptions", set)
+}
+
+// OnUnsubscribed is called when a client unsubscribes, and deletes its subscriptions
+func (s *Storage) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	var del [][]byte
+	for _, f := range pk.Filters {
+		del = append(del, key(subscriptionPrefix, records.SubscriptionID(cl, f.Filter)))
+	}
+	s.write("subscriptions", nil, del...)
+}
+
+// OnRetainMessage is called when a message is retained, and stores it until it expires, or deletes
+// the retained message of the topic if it was cleared
+func (s *Storage) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	ttl, expired := messageTTL(pk)
+	if r == -1 || expired {
+		s.write("retained message", nil, key(retainedPrefix, pk.TopicName))
+		return
+	}
+
+	s.write("retained message", []record{{key: key(retainedPrefix, pk.TopicName), data: records.Retained(pk), ttl: ttl}})
+}
+
+// OnRetainedExpired is called when a retained message expires, and deletes it
+func (s *Storage) OnRetainedExpired(topic string) {
+	s.write("retained message", nil, key(retainedPrefix, topic))
+}
+
+// OnQosPublish is called when a QoS message is sent to a client, and stores it until it completes
+// or expires
+func (s *Storage) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	ttl, expired := messageTTL(pk)
+	if expired {
+		s.write("inflight message", nil, key(inflightPrefix, records.InflightID(cl, pk)))
+		return
+	}
+
+	s.write("inflight message", []record{{key: key(inflightPrefix, records.InflightID(cl, pk)), data: records.Inflight(cl, pk, sent), ttl: ttl}})
+}
+
+// OnQosComplete is called when the QoS flow of a message completes, and deletes it
+func (s *Storage) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	s.write("inflight message", nil, key(inflightPrefix, records.InflightID(cl, pk)))
+}
+
+// OnQosDropped is called when an inflight message is dropped, and deletes it
+func (s *Storage) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	s.OnQosComplete(cl, pk)
+}
+
+// OnSysInfoTick is called when the system info is updated, and stores it
+func (s *Storage) OnSysInfoTick(sys *system.Info) {
+	s.write("system info", []record{{key: sysInfoKey, data: records.SysInfo(sys)}})
+}
+
+// load calls fn with the data of each record with the prefix, and deletes the records which have
+// expired, or which fn rejects by returning false
+func (s *Storage) load(prefix []byte, fn func(data []byte) (bool, error)) error {
+	var stale [][]byte
+	err := s.store.Iterate(prefix, func(k, value []byte) error {
+		data, expired, err := decode(value)
+		if err != nil {
+			return fmt.Errorf("failed decoding %s: %w", k, err)
+		}
+
+		if !expired {
+			keep, err := fn(data)
+			if err != nil {
+				return fmt.Errorf("failed decoding %s: %w", k, err)
+			}
+
+			if keep {
+				return nil
+			}
+		}
+
+		stale = append(stale, append([]byte{}, k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.apply(nil, stale)
+}
+
+// restored returns whether the records of a client are restored, which they aren't if the client
+// has expired
+func (s *Storage) restored(client string) bool {
+	return s.clients == nil || s.clients[client]
+}
+
+// StoredClients returns the stored clients whose sessions haven't expired, which the server restores
+// when it starts
+func (s *Storage) StoredClients() ([]storage.Client, error) {
+	var clients []storage.Client
+	err := s.load(clientPrefix, func(data []byte) (bool, error) {
+		var cl storage.Client
+		if err := cl.UnmarshalBinary(data); err != nil {
+			return false, err
+		}
+		clients = append(clients, cl)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.clients = make(map[string]bool, len(clients))
+	for _, cl := range clients {
+		s.clients[cl.ID] = true
+	}
+	return clients, nil
+}
+
+// StoredSubscriptions returns the stored subscriptions of the restored clients, deleting those of
+// the clients whose sessions expired
+func (s *Storage) StoredSubscriptions() ([]storage.Subscription, error) {
+	var subs []storage.Subscription
+	err := s.load(subscriptionPrefix, func(data []byte) (bool, error) {
+		var sub storage.Subscription
+		if err := sub.UnmarshalBinary(data); err != nil {
+			return false, err
+		}
+
+		if !s.restored(sub.Client) {
+			return false, nil
+		}
+		subs = append(subs, sub)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// StoredRetainedMessages returns the stored retained messages which haven't expired
+func (s *Storage) StoredRetainedMessages() ([]storage.Message, error) {
+	return s.messages(retainedPrefix, func(storage.Message) bool {
+		return true
+	})
+}
+
+// StoredInflightMessages returns the stored inflight messages of the restored clients which haven't
+// expired
+func (s *Storage) StoredInflightMessages() ([]storage.Message, error) {
+	return s.messages(inflightPrefix, func(msg storage.Message) bool {
+		return s.restored(msg.ID[:max(strings.LastIndex(msg.ID, ":"), 0)])
+	})
+}
+
+// messages returns the stored messages with the prefix which are kept
+func (s *Storage) messages(prefix []byte, keep func(storage.Message) bool) ([]storage.Message, error) {
+	var msgs []storage.Message
+	err := s.load(prefix, func(data []byte) (bool, error) {
+		var msg storage.Message
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return false, err
+		}
+
+		if !keep(msg) {
+			return false, nil
+		}
+		msgs = append(msgs, msg)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// StoredSysInfo returns the stored system info
+func (s *Storage) StoredSysInfo() (storage.SystemInfo, error) {
+	var info storage.SystemInfo
+	value, err := s.store.Get(sysInfoKey)
+	if err != nil || value == nil {
+		return info, err
+	}
+
+	data, _, err := decode(value)
+	if err != nil {
+		return info, err
+	}
+
+	if err := info.UnmarshalBinary(data); err != nil {
+		return info, fmt.Errorf("failed decoding system info: %w", err)
+	}
+	return info, nil
+}
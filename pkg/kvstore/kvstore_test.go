@@ -0,0 +1,416 @@
+package kvstore_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/coalesce"
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+	"github.com/mochi-mqtt/hooks/pkg/kvstore/kvstoretest"
+)
+
+// testHook is a storage hook on an in-memory store
+type testHook struct {
+	kvstore.Storage
+}
+
+func (h *testHook) ID() string {
+	return "test-storage-hook"
+}
+
+func (h *testHook) Init(config any) error {
+	return h.Open(config.(*kvstoretest.Store), kvstore.Options{})
+}
+
+func (h *testHook) Stop() error {
+	return h.Close()
+}
+
+func newStorage(t *testing.T, store *kvstoretest.Store, options kvstore.Options) *kvstore.Storage {
+	t.Helper()
+
+	s := new(kvstore.Storage)
+	s.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, s.Open(store, options))
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func newClient(id string, version byte) *mqtt.Client {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", id, false)
+	cl.Properties.Username = []byte("alice")
+	cl.Properties.ProtocolVersion = version
+	return cl
+}
+
+// value encodes a record which expires at the time
+func value(t *testing.T, record interface{ MarshalBinary() ([]byte, error) }, expires time.Time) []byte {
+	t.Helper()
+
+	data, err := record.MarshalBinary()
+	require.NoError(t, err)
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(expires.Unix()))
+	return append(v, data...)
+}
+
+func TestOpen(t *testing.T) {
+	require.Error(t, new(kvstore.Storage).Open(nil, kvstore.Options{}))
+	require.NoError(t, new(kvstore.Storage).Close())
+
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{})
+	require.True(t, s.Provides(mqtt.StoredClients))
+	require.True(t, s.Provides(mqtt.OnQosPublish))
+	require.False(t, s.Provides(mqtt.OnACLCheck))
+
+	require.NoError(t, s.Close())
+	require.True(t, store.Closed())
+	require.Equal(t, 1, store.Syncs())
+}
+
+func TestSyncMode(t *testing.T) {
+	var mode kvstore.SyncMode
+	require.NoError(t, mode.UnmarshalText([]byte("interval")))
+	require.Equal(t, kvstore.SyncInterval, mode)
+	require.Equal(t, "interval", mode.String())
+	require.Error(t, mode.UnmarshalText([]byte("sometimes")))
+
+	tests := []struct {
+		name   string
+		mode   kvstore.SyncMode
+		synced bool
+	}{
+		{
+			name:   "Success - always",
+			mode:   kvstore.SyncAlways,
+			synced: true,
+		},
+		{
+			name:   "Success - interval",
+			mode:   kvstore.SyncInterval,
+			synced: false,
+		},
+		{
+			name:   "Success - never",
+			mode:   kvstore.SyncNever,
+			synced: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			store := kvstoretest.NewStore()
+			s := newStorage(t, store, kvstore.Options{SyncMode: tt.mode, SyncInterval: time.Millisecond})
+			s.OnSessionEstablished(newClient("c1", 5), packets.Packet{})
+			require.Equal(t, []bool{tt.synced}, store.Commits())
+
+			if tt.mode == kvstore.SyncInterval {
+				require.Eventually(t, func() bool {
+					return store.Syncs() > 1
+				}, time.Second, time.Millisecond)
+			}
+
+		})
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{Coalesce: &coalesce.Options{Interval: time.Hour}})
+
+	cl := newClient("c1", 5)
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}
+	s.OnSessionEstablished(cl, packets.Packet{})
+	s.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}}}, []byte{0})
+	s.OnQosPublish(cl, pk, 1, 0)
+	s.OnQosComplete(cl, pk)
+	require.Empty(t, store.Keys(""))
+
+	// the writes are committed in one batch, where the completed message is only deleted
+	require.NoError(t, s.Close())
+	require.Equal(t, []string{"CL_c1", "SUB_c1:a"}, store.Keys(""))
+	require.Len(t, store.Commits(), 1)
+}
+
+func TestSessionTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  byte
+		interval uint32
+		flag     bool
+		ttl      time.Duration
+	}{
+		{
+			name:     "Success - session expiry interval",
+			version:  5,
+			interval: 60,
+			flag:     true,
+			ttl:      time.Minute,
+		},
+		{
+			name:     "Success - never expires",
+			version:  5,
+			interval: math.MaxUint32,
+			flag:     true,
+			ttl:      0,
+		},
+		{
+			name:    "Success - session ttl without interval",
+			version: 4,
+			ttl:     time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			store := kvstoretest.NewStore()
+			s := newStorage(t, store, kvstore.Options{SessionTTL: time.Hour})
+
+			cl := newClient("c1", tt.version)
+			cl.Properties.Props.SessionExpiryInterval = tt.interval
+			cl.Properties.Props.SessionExpiryIntervalFlag = tt.flag
+
+			s.OnSessionEstablished(cl, packets.Packet{})
+			require.Zero(t, store.TTL("CL_c1"))
+
+			s.OnDisconnect(cl, nil, false)
+			require.Equal(t, tt.ttl, store.TTL("CL_c1"))
+
+		})
+	}
+}
+
+func TestClients(t *testing.T) {
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{})
+
+	cl := newClient("c1", 5)
+	cl.Properties.Will = mqtt.Will{TopicName: "lwt"}
+	s.OnSessionEstablished(cl, packets.Packet{})
+
+	clients, err := s.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, "c1", clients[0].ID)
+	require.Equal(t, "lwt", clients[0].Will.TopicName)
+
+	// sessions taken over are left to the new connection
+	cl.Stop(packets.ErrSessionTakenOver)
+	s.OnDisconnect(cl, nil, true)
+	require.Equal(t, []string{"CL_c1"}, store.Keys("CL_"))
+
+	s.OnDisconnect(newClient("c1", 5), nil, true)
+	require.Empty(t, store.Keys("CL_"))
+
+	s.OnWillSent(cl, packets.Packet{})
+	require.Equal(t, []string{"CL_c1"}, store.Keys("CL_"))
+	s.OnClientExpired(cl)
+	require.Empty(t, store.Keys("CL_"))
+}
+
+func TestSubscriptions(t *testing.T) {
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{})
+
+	cl := newClient("c1", 5)
+	s.OnSubscribed(cl, packets.Packet{
+		Filters: packets.Subscriptions{{Filter: "a/b", Qos: 1}, {Filter: "denied"}},
+	}, []byte{1, packets.ErrNotAuthorized.Code})
+	require.Equal(t, []string{"SUB_c1:a/b"}, store.Keys("SUB_"))
+
+	subs, err := s.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "a/b", subs[0].Filter)
+	require.Equal(t, byte(1), subs[0].Qos)
+
+	s.OnUnsubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b"}}})
+	require.Empty(t, store.Keys("SUB_"))
+}
+
+func TestMessages(t *testing.T) {
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{})
+
+	cl := newClient("c1", 5)
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Retain: true},
+		TopicName:   "a/b",
+		PacketID:    7,
+		Payload:     []byte("hello"),
+		Expiry:      time.Now().Add(time.Hour).Unix(),
+	}
+
+	s.OnRetainMessage(cl, pk, 1)
+	require.InDelta(t, time.Hour, store.TTL("RET_a/b"), float64(2*time.Second))
+	s.OnQosPublish(cl, pk, 100, 0)
+	require.Equal(t, []string{"IFM_c1:7"}, store.Keys("IFM_"))
+
+	retained, err := s.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, retained, 1)
+	require.Equal(t, []byte("hello"), retained[0].Payload)
+
+	inflight, err := s.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+	require.Equal(t, uint16(7), inflight[0].PacketID)
+	require.Equal(t, int64(100), inflight[0].Sent)
+
+	s.OnQosComplete(cl, pk)
+	require.Empty(t, store.Keys("IFM_"))
+	s.OnQosPublish(cl, pk, 100, 0)
+	s.OnQosDropped(cl, pk)
+	require.Empty(t, store.Keys("IFM_"))
+
+	s.OnRetainMessage(cl, pk, -1)
+	require.Empty(t, store.Keys("RET_"))
+	s.OnRetainMessage(cl, pk, 1)
+	s.OnRetainedExpired("a/b")
+	require.Empty(t, store.Keys("RET_"))
+
+	// messages which have expired already aren't stored
+	pk.Expiry = time.Now().Add(-time.Second).Unix()
+	s.OnRetainMessage(cl, pk, 1)
+	s.OnQosPublish(cl, pk, 100, 0)
+	require.Empty(t, store.Keys("RET_"))
+	require.Empty(t, store.Keys("IFM_"))
+}
+
+func TestSysInfo(t *testing.T) {
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{})
+
+	info, err := s.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, info.ID)
+
+	s.OnSysInfoTick(&system.Info{Version: "2.4.1", Uptime: 10})
+	info, err = s.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, storage.SysInfoKey, info.ID)
+	require.Equal(t, int64(10), info.Uptime)
+}
+
+func TestExpired(t *testing.T) {
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{})
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+	store.Put("CL_c1", value(t, &storage.Client{ID: "c1", T: storage.ClientKey}, future))
+	store.Put("CL_c2", value(t, &storage.Client{ID: "c2", T: storage.ClientKey}, past))
+	store.Put("SUB_c1:a", value(t, &storage.Subscription{ID: "c1:a", Client: "c1", Filter: "a"}, time.Unix(0, 0)))
+	store.Put("SUB_c2:a", value(t, &storage.Subscription{ID: "c2:a", Client: "c2", Filter: "a"}, time.Unix(0, 0)))
+	store.Put("IFM_c1:1", value(t, &storage.Message{ID: "c1:1", PacketID: 1}, time.Unix(0, 0)))
+	store.Put("IFM_c2:1", value(t, &storage.Message{ID: "c2:1", PacketID: 1}, time.Unix(0, 0)))
+	store.Put("RET_a", value(t, &storage.Message{ID: "a", TopicName: "a"}, past))
+
+	// the records of expired sessions, and expired messages, are deleted as they are restored
+	clients, err := s.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, "c1", clients[0].ID)
+
+	subs, err := s.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	require.Equal(t, "c1", subs[0].Client)
+
+	inflight, err := s.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, inflight, 1)
+
+	retained, err := s.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Empty(t, retained)
+
+	require.Equal(t, []string{"CL_c1", "IFM_c1:1", "SUB_c1:a"}, store.Keys(""))
+}
+
+func TestKeyRange(t *testing.T) {
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{})
+
+	cl := newClient("c1", 5)
+	pk := packets.Packet{TopicName: "a", PacketID: 1}
+	s.OnSessionEstablished(cl, pk)
+	s.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}}}, []byte{0})
+	s.OnRetainMessage(cl, pk, 1)
+	s.OnQosPublish(cl, pk, 0, 0)
+	s.OnSysInfoTick(new(system.Info))
+
+	start, end := kvstore.KeyRange()
+	keys := store.Keys("")
+	require.Len(t, keys, 5)
+	for _, k := range keys {
+		require.GreaterOrEqual(t, k, string(start))
+		require.Less(t, k, string(end))
+	}
+}
+
+func TestStoredErrors(t *testing.T) {
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{})
+
+	store.Put("CL_c1", []byte("short"))
+	_, err := s.StoredClients()
+	require.Error(t, err)
+
+	store.Put("CL_c1", append(make([]byte, 8), "not json"...))
+	_, err = s.StoredClients()
+	require.ErrorContains(t, err, "CL_c1")
+
+	store.Err = errors.New("disk full")
+	_, err = s.StoredRetainedMessages()
+	require.Error(t, err)
+	_, err = s.StoredSysInfo()
+	require.Error(t, err)
+
+	// failed writes are logged
+	s.OnSessionEstablished(newClient("c2", 5), packets.Packet{})
+}
+
+func TestRestore(t *testing.T) {
+	store := kvstoretest.NewStore()
+	s := newStorage(t, store, kvstore.Options{})
+
+	cl := newClient("c1", 5)
+	cl.Properties.Props.SessionExpiryInterval = 3600
+	s.OnSessionEstablished(cl, packets.Packet{})
+	s.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/#", Qos: 1}}}, []byte{1})
+	s.OnRetainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+	}, 1)
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, server.AddHook(new(testHook), store))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	restored, ok := server.Clients.Get("c1")
+	require.True(t, ok)
+	_, ok = restored.State.Subscriptions.Get("a/#")
+	require.True(t, ok)
+	retained, ok := server.Topics.Retained.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), retained.Payload)
+}
@@ -0,0 +1,196 @@
+// Package kvstoretest provides an in-memory kvstore.Store, for testing the storage hooks without a
+// database
+package kvstoretest
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+)
+
+// Store keeps the keys in memory, and records how it was used
+type Store struct {
+	Err error // returned by every operation if set
+
+	values  map[string][]byte
+	ttls    map[string]time.Duration
+	commits []bool // whether each commit was synced
+	syncs   int
+	closed  bool
+	mu      sync.Mutex
+}
+
+// NewStore returns an empty store
+func NewStore() *Store {
+	return &Store{
+		values: map[string][]byte{},
+		ttls:   map[string]time.Duration{},
+	}
+}
+
+// NewBatch implements kvstore.Store
+func (s *Store) NewBatch() kvstore.Batch {
+	return &batch{store: s}
+}
+
+// Get implements kvstore.Store
+func (s *Store) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	return s.values[string(key)], nil
+}
+
+// Iterate implements kvstore.Store
+func (s *Store) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	s.mu.Lock()
+	if s.Err != nil {
+		s.mu.Unlock()
+		return s.Err
+	}
+
+	var keys []string
+	for k := range s.values {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = s.values[k]
+	}
+	s.mu.Unlock()
+
+	for i, k := range keys {
+		if err := fn([]byte(k), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync implements kvstore.Store
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncs++
+	return s.Err
+}
+
+// Close implements kvstore.Store
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// Keys returns the keys with the prefix in order
+func (s *Store) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for k := range s.values {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Put sets the raw value of a key, eg. to corrupt a record
+func (s *Store) Put(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+// TTL returns the ttl the key was last set with
+func (s *Store) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ttls[key]
+}
+
+// Commits returns whether each commit so far was synced
+func (s *Store) Commits() []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bool(nil), s.commits...)
+}
+
+// Syncs returns how often the store was synced
+func (s *Store) Syncs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncs
+}
+
+// Closed returns whether the store was closed
+func (s *Store) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// batch applies its writes to the store when committed
+type batch struct {
+	store  *Store
+	writes []func()
+	done   bool
+}
+
+// Set implements kvstore.Batch
+func (b *batch) Set(key, value []byte, ttl time.Duration) error {
+	k, v := string(key), append([]byte(nil), value...)
+	b.writes = append(b.writes, func() {
+		b.store.values[k] = v
+		b.store.ttls[k] = ttl
+	})
+	return nil
+}
+
+// Delete implements kvstore.Batch
+func (b *batch) Delete(key []byte) error {
+	k := string(key)
+	b.writes = append(b.writes, func() {
+		delete(b.store.values, k)
+		delete(b.store.ttls, k)
+	})
+	return nil
+}
+
+// Commit implements kvstore.Batch
+func (b *batch) Commit(sync bool) error {
+	if b.done {
+		return errors.New("batch already committed")
+	}
+	b.done = true
+
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+	if b.store.Err != nil {
+		return b.store.Err
+	}
+
+	for _, w := range b.writes {
+		w()
+	}
+	b.store.commits = append(b.store.commits, sync)
+	return nil
+}
+
+// Discard implements kvstore.Batch
+func (b *batch) Discard() {
+	b.done = true
+}
@@ -0,0 +1,241 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryMagic starts the encoding of a memory store
+const memoryMagic = "MQKV1"
+
+// Memory is a Store which keeps the keys in memory, for hooks which persist them elsewhere, eg. by
+// writing the store to snapshots
+type Memory struct {
+	values  map[string][]byte
+	changes uint64 // the number of batches committed
+	mu      sync.RWMutex
+}
+
+// NewMemory returns an empty memory store
+func NewMemory() *Memory {
+	return &Memory{
+		values: map[string][]byte{},
+	}
+}
+
+// NewBatch implements Store
+func (m *Memory) NewBatch() Batch {
+	return &memoryBatch{memory: m}
+}
+
+// Get implements Store
+func (m *Memory) Get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.values[string(key)], nil
+}
+
+// Iterate implements Store
+func (m *Memory) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	keys, values := m.entries(string(prefix))
+	for i, k := range keys {
+		if err := fn([]byte(k), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entries returns the keys with the prefix in order, and their values
+func (m *Memory) entries(prefix string) ([]string, [][]byte) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []string
+	for k := range m.values {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = m.values[k]
+	}
+	return keys, values
+}
+
+// Sync implements Store, and does nothing
+func (m *Memory) Sync() error {
+	return nil
+}
+
+// Close implements Store, and does nothing
+func (m *Memory) Close() error {
+	return nil
+}
+
+// Changes returns the number of batches committed, which changes whenever the keys do
+func (m *Memory) Changes() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.changes
+}
+
+// WriteTo writes the keys and their values to w, implementing io.WriterTo
+func (m *Memory) WriteTo(w io.Writer) (int64, error) {
+	keys, values := m.entries("")
+
+	bw := bufio.NewWriter(w)
+	n, _ := bw.WriteString(memoryMagic)
+	written := int64(n)
+
+	var size [binary.MaxVarintLen64]byte
+	for i, k := range keys {
+		for _, field := range [][]byte{[]byte(k), values[i]} {
+			n, _ = bw.Write(size[:binary.PutUvarint(size[:], uint64(len(field)))])
+			written += int64(n)
+			n, _ = bw.Write(field)
+			written += int64(n)
+		}
+	}
+
+	return written, bw.Flush()
+}
+
+// ReadFrom replaces the keys with those read from r, which were written by WriteTo, implementing
+// io.ReaderFrom
+func (m *Memory) ReadFrom(r io.Reader) (int64, error) {
+	cr := &countingReader{r: bufio.NewReader(r)}
+
+	magic := make([]byte, len(memoryMagic))
+	if _, err := io.ReadFull(cr, magic); err != nil || string(magic) != memoryMagic {
+		return cr.n, errors.New("not a memory store")
+	}
+
+	values := map[string][]byte{}
+	for {
+		key, err := readField(cr)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return cr.n, err
+		}
+
+		value, err := readField(cr)
+		if err != nil {
+			return cr.n, fmt.Errorf("value of %q: %w", key, noEOF(err))
+		}
+		values[string(key)] = value
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values = values
+	m.changes++
+	return cr.n, nil
+}
+
+// readField reads a length prefixed field
+func readField(r *countingReader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// the field is read as it arrives rather than allocated up front, so a corrupt size fails at the
+	// end of the data
+	field, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(field)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return field, nil
+}
+
+// noEOF returns io.ErrUnexpectedEOF instead of io.EOF, for reads which end early
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// countingReader counts the bytes read
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// memoryBatch applies its writes to the memory store when committed
+type memoryBatch struct {
+	memory *Memory
+	writes map[string][]byte // nil values are deletes
+}
+
+// Set implements Batch. Keys are kept until they are deleted, regardless of their ttl
+func (b *memoryBatch) Set(key, value []byte, ttl time.Duration) error {
+	b.put(string(key), append([]byte{}, value...))
+	return nil
+}
+
+// Delete implements Batch
+func (b *memoryBatch) Delete(key []byte) error {
+	b.put(string(key), nil)
+	return nil
+}
+
+// put records the write of the key
+func (b *memoryBatch) put(key string, value []byte) {
+	if b.writes == nil {
+		b.writes = map[string][]byte{}
+	}
+	b.writes[key] = value
+}
+
+// Commit implements Batch
+func (b *memoryBatch) Commit(sync bool) error {
+	b.memory.mu.Lock()
+	defer b.memory.mu.Unlock()
+
+	for k, v := range b.writes {
+		if v != nil {
+			b.memory.values[k] = v
+		} else {
+			delete(b.memory.values, k)
+		}
+	}
+	b.memory.changes++
+	b.writes = nil
+	return nil
+}
+
+// Discard implements Batch
+func (b *memoryBatch) Discard() {
+	b.writes = nil
+}
@@ -0,0 +1,116 @@
+package kvstore_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+)
+
+// keys returns the keys with the prefix and their values
+func keys(t *testing.T, store kvstore.Store, prefix string) map[string]string {
+	t.Helper()
+
+	found := map[string]string{}
+	require.NoError(t, store.Iterate([]byte(prefix), func(k, v []byte) error {
+		found[string(k)] = string(v)
+		return nil
+	}))
+	return found
+}
+
+func TestMemory(t *testing.T) {
+	m := kvstore.NewMemory()
+
+	b := m.NewBatch()
+	require.NoError(t, b.Set([]byte("CL_a"), []byte("1"), 0))
+	require.NoError(t, b.Set([]byte("CL_b"), []byte{}, 0))
+	require.NoError(t, b.Set([]byte("SUB_a"), []byte("2"), 0))
+	require.Empty(t, keys(t, m, ""))
+	require.NoError(t, b.Commit(true))
+	require.Equal(t, uint64(1), m.Changes())
+
+	require.Equal(t, map[string]string{"CL_a": "1", "CL_b": ""}, keys(t, m, "CL_"))
+	v, err := m.Get([]byte("SUB_a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), v)
+
+	b = m.NewBatch()
+	require.NoError(t, b.Delete([]byte("CL_a")))
+	require.NoError(t, b.Set([]byte("CL_a"), []byte("3"), 0))
+	require.NoError(t, b.Delete([]byte("SUB_a")))
+	require.NoError(t, b.Commit(false))
+	require.Equal(t, map[string]string{"CL_a": "3", "CL_b": ""}, keys(t, m, ""))
+
+	b = m.NewBatch()
+	require.NoError(t, b.Delete([]byte("CL_a")))
+	b.Discard()
+	require.Len(t, keys(t, m, ""), 2)
+	require.Equal(t, uint64(2), m.Changes())
+
+	v, err = m.Get([]byte("missing"))
+	require.NoError(t, err)
+	require.Nil(t, v)
+}
+
+func TestMemoryWriteTo(t *testing.T) {
+	m := kvstore.NewMemory()
+	b := m.NewBatch()
+	require.NoError(t, b.Set([]byte("CL_a"), []byte("client"), 0))
+	require.NoError(t, b.Set([]byte("RET_a/b"), bytes.Repeat([]byte("x"), 300), 0))
+	require.NoError(t, b.Set([]byte("SYS"), []byte{}, 0))
+	require.NoError(t, b.Commit(true))
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(buf.Len()), n)
+	data := buf.Bytes()
+
+	restored := kvstore.NewMemory()
+	n, err = restored.ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, keys(t, m, ""), keys(t, restored, ""))
+	require.Equal(t, uint64(1), restored.Changes())
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "Failure - empty",
+			data: nil,
+		},
+		{
+			name: "Failure - not a store",
+			data: []byte("{}"),
+		},
+		{
+			name: "Failure - truncated",
+			data: data[:len(data)-10],
+		},
+		{
+			name: "Failure - missing value",
+			data: append([]byte("MQKV1"), 1, 'k'),
+		},
+		{
+			name: "Failure - corrupt size",
+			data: append([]byte("MQKV1"), 0xff, 0xff, 0xff, 0xff, 0x0f, 'k'),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, err := restored.ReadFrom(bytes.NewReader(tt.data))
+			require.Error(t, err)
+
+			// the keys are kept when reading fails
+			require.Len(t, keys(t, restored, ""), 3)
+
+		})
+	}
+}
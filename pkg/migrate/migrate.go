@@ -0,0 +1,176 @@
+// Package migrate copies the state persisted by one storage hook to another, so a broker can change
+// its storage backend without losing sessions, subscriptions, retained and inflight messages. The
+// records are read as the server restores them, with the Stored methods of the source, and written as
+// the server writes them, by replaying the events the destination stores them on
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Counts are how many records of each kind were copied
+type Counts struct {
+	Clients       int
+	Subscriptions int
+	Retained      int
+	Inflight      int
+	SysInfo       bool
+}
+
+// String summarizes the counts
+func (c Counts) String() string {
+	return fmt.Sprintf("%d clients, %d subscriptions, %d retained messages, %d inflight messages",
+		c.Clients, c.Subscriptions, c.Retained, c.Inflight)
+}
+
+// Copy copies every record stored by the source hook to the destination hook. Both hooks must be
+// initialized, and the destination should be stopped afterwards so it flushes any writes it batches.
+// It fails if the source has records of a kind which the destination doesn't store
+func Copy(src, dst mqtt.Hook) (Counts, error) {
+	var counts Counts
+	if src == nil || dst == nil {
+		return counts, errors.New("source and destination hooks are required")
+	}
+
+	if src.Provides(mqtt.StoredClients) {
+		clients, err := src.StoredClients()
+		if err != nil {
+			return counts, fmt.Errorf("failed to read clients: %w", err)
+		}
+
+		if err := provides(dst, mqtt.OnSessionEstablished, "clients", len(clients)); err != nil {
+			return counts, err
+		}
+
+		for _, c := range clients {
+			dst.OnSessionEstablished(Client(c), packets.Packet{})
+			counts.Clients++
+		}
+	}
+
+	if src.Provides(mqtt.StoredSubscriptions) {
+		subs, err := src.StoredSubscriptions()
+		if err != nil {
+			return counts, fmt.Errorf("failed to read subscriptions: %w", err)
+		}
+
+		if err := provides(dst, mqtt.OnSubscribed, "subscriptions", len(subs)); err != nil {
+			return counts, err
+		}
+
+		for _, sub := range subs {
+			dst.OnSubscribed(client(sub.Client), packets.Packet{
+				Filters: packets.Subscriptions{{
+					Filter:            sub.Filter,
+					Identifier:        sub.Identifier,
+					NoLocal:           sub.NoLocal,
+					RetainHandling:    sub.RetainHandling,
+					RetainAsPublished: sub.RetainAsPublished,
+				}},
+			}, []byte{sub.Qos})
+			counts.Subscriptions++
+		}
+	}
+
+	if src.Provides(mqtt.StoredRetainedMessages) {
+		msgs, err := src.StoredRetainedMessages()
+		if err != nil {
+			return counts, fmt.Errorf("failed to read retained messages: %w", err)
+		}
+
+		if err := provides(dst, mqtt.OnRetainMessage, "retained messages", len(msgs)); err != nil {
+			return counts, err
+		}
+
+		for _, msg := range msgs {
+			dst.OnRetainMessage(client(msg.Origin), msg.ToPacket(), 1)
+			counts.Retained++
+		}
+	}
+
+	if src.Provides(mqtt.StoredInflightMessages) {
+		msgs, err := src.StoredInflightMessages()
+		if err != nil {
+			return counts, fmt.Errorf("failed to read inflight messages: %w", err)
+		}
+
+		if err := provides(dst, mqtt.OnQosPublish, "inflight messages", len(msgs)); err != nil {
+			return counts, err
+		}
+
+		for _, msg := range msgs {
+			dst.OnQosPublish(client(Recipient(msg)), msg.ToPacket(), msg.Sent, 0)
+			counts.Inflight++
+		}
+	}
+
+	if src.Provides(mqtt.StoredSysInfo) && dst.Provides(mqtt.OnSysInfoTick) {
+		info, err := src.StoredSysInfo()
+		if err != nil {
+			return counts, fmt.Errorf("failed to read system info: %w", err)
+		}
+
+		if info.ID != "" || info.Started != 0 {
+			dst.OnSysInfoTick(&info.Info)
+			counts.SysInfo = true
+		}
+	}
+
+	return counts, nil
+}
+
+// provides returns an error if there are records of a kind which the destination doesn't store
+func provides(dst mqtt.Hook, b byte, what string, n int) error {
+	if n > 0 && !dst.Provides(b) {
+		return fmt.Errorf("%s hook does not store %s", dst.ID(), what)
+	}
+	return nil
+}
+
+// Client returns the client of a stored client record, as the server restores it
+func Client(c storage.Client) *mqtt.Client {
+	cl := client(c.ID)
+	cl.Net.Remote = c.Remote
+	cl.Net.Listener = c.Listener
+	cl.Properties.Username = c.Username
+	cl.Properties.Clean = c.Clean
+	cl.Properties.ProtocolVersion = c.ProtocolVersion
+	cl.Properties.Props = packets.Properties{
+		SessionExpiryInterval:     c.Properties.SessionExpiryInterval,
+		SessionExpiryIntervalFlag: c.Properties.SessionExpiryIntervalFlag,
+		AuthenticationMethod:      c.Properties.AuthenticationMethod,
+		AuthenticationData:        c.Properties.AuthenticationData,
+		RequestProblemInfoFlag:    c.Properties.RequestProblemInfoFlag,
+		RequestProblemInfo:        c.Properties.RequestProblemInfo,
+		RequestResponseInfo:       c.Properties.RequestResponseInfo,
+		ReceiveMaximum:            c.Properties.ReceiveMaximum,
+		TopicAliasMaximum:         c.Properties.TopicAliasMaximum,
+		User:                      c.Properties.User,
+		MaximumPacketSize:         c.Properties.MaximumPacketSize,
+	}
+	cl.Properties.Will = mqtt.Will(c.Will)
+	return cl
+}
+
+// client returns a client with the id, for the events which only need to know which client
+func client(id string) *mqtt.Client {
+	return &mqtt.Client{ID: id}
+}
+
+// Recipient returns the id of the client an inflight message is sent to, from the id of its record,
+// which is the client id and packet id as written by the hooks of this module, optionally prefixed
+// with the kind of record as written by the hooks of the server. It is the origin of the message if
+// the id has neither form
+func Recipient(msg storage.Message) string {
+	id := strings.TrimPrefix(msg.ID, storage.InflightKey+"_")
+	if i := strings.LastIndexByte(id, ':'); i > 0 {
+		return id[:i]
+	}
+	return msg.Origin
+}
@@ -0,0 +1,151 @@
+package migrate
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+	"github.com/mochi-mqtt/hooks/storage/tiered"
+)
+
+// noStorage is a hook which stores nothing
+type noStorage struct {
+	mqtt.HookBase
+}
+
+func newHook(t *testing.T, cold *kvstore.Memory) *tiered.Hook {
+	t.Helper()
+
+	h := new(tiered.Hook)
+	h.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, h.Init(tiered.Options{Cold: cold}))
+	t.Cleanup(func() { h.Stop() })
+	return h
+}
+
+func TestCopy(t *testing.T) {
+	from := kvstore.NewMemory()
+	src := newHook(t, from)
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte("alice")
+	cl.Properties.Props.SessionExpiryInterval = 60
+	cl.Properties.Props.SessionExpiryIntervalFlag = true
+	cl.Properties.Will = mqtt.Will{Flag: 1, TopicName: "lwt", Payload: []byte("gone")}
+	src.OnSessionEstablished(cl, packets.Packet{})
+	src.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/#", NoLocal: true}}}, []byte{1})
+	src.OnRetainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+	}, 1)
+	src.OnQosPublish(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/c",
+		Origin:      "c2",
+		PacketID:    7,
+	}, 10, 0)
+	src.OnSysInfoTick(&system.Info{Version: "2.4.1", Started: 100})
+	require.NoError(t, src.Stop())
+
+	to := kvstore.NewMemory()
+	src, dst := newHook(t, from), newHook(t, to)
+	counts, err := Copy(src, dst)
+	require.NoError(t, err)
+	require.Equal(t, Counts{Clients: 1, Subscriptions: 1, Retained: 1, Inflight: 1, SysInfo: true}, counts)
+	require.Equal(t, "1 clients, 1 subscriptions, 1 retained messages, 1 inflight messages", counts.String())
+	require.NoError(t, dst.Stop())
+
+	// the destination stores the same records as the source
+	copied := newHook(t, to)
+	want, err := src.StoredClients()
+	require.NoError(t, err)
+	got, err := copied.StoredClients()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	wantSubs, err := src.StoredSubscriptions()
+	require.NoError(t, err)
+	gotSubs, err := copied.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Equal(t, wantSubs, gotSubs)
+
+	wantMsgs, err := src.StoredInflightMessages()
+	require.NoError(t, err)
+	gotMsgs, err := copied.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Equal(t, wantMsgs, gotMsgs)
+
+	wantMsgs, err = src.StoredRetainedMessages()
+	require.NoError(t, err)
+	gotMsgs, err = copied.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Equal(t, wantMsgs, gotMsgs)
+
+	info, err := copied.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, int64(100), info.Started)
+}
+
+func TestCopyErrors(t *testing.T) {
+	from := kvstore.NewMemory()
+	src := newHook(t, from)
+	src.OnSessionEstablished(mqtt.New(nil).NewClient(nil, "tcp", "c1", false), packets.Packet{})
+
+	_, err := Copy(src, nil)
+	require.Error(t, err)
+
+	// records which the destination doesn't store aren't silently dropped
+	_, err = Copy(src, new(noStorage))
+	require.ErrorContains(t, err, "does not store clients")
+
+	// nothing is copied from a hook which stores nothing
+	counts, err := Copy(new(noStorage), src)
+	require.NoError(t, err)
+	require.Equal(t, Counts{}, counts)
+}
+
+func TestRecipient(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    storage.Message
+		expect string
+	}{
+		{
+			name:   "Success - hooks of this module",
+			msg:    storage.Message{ID: "c1:7", Origin: "c2"},
+			expect: "c1",
+		},
+		{
+			name:   "Success - hooks of the server",
+			msg:    storage.Message{ID: "IFM_c1:7", Origin: "c2"},
+			expect: "c1",
+		},
+		{
+			name:   "Success - client id with colon",
+			msg:    storage.Message{ID: "a:b:7"},
+			expect: "a:b",
+		},
+		{
+			name:   "Success - unknown form",
+			msg:    storage.Message{ID: "7", Origin: "c2"},
+			expect: "c2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expect, Recipient(tt.msg))
+
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2Params are the costs of an argon2 hash
+type Argon2Params struct {
+	Memory      uint32 // the memory used in KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultArgon2Params are the costs used by HashArgon2 when none are given, the second recommended
+// option of RFC 9106
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 4}
+
+// Argon2 verifies argon2id and argon2i hashes in the PHC string format written by the reference
+// implementation and most libraries, eg. $argon2id$v=19$m=65536,t=3,p=4$<base64 salt>$<base64 hash>
+type Argon2 struct{}
+
+// Supports returns whether the hash is an argon2id or argon2i hash
+func (Argon2) Supports(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$") || strings.HasPrefix(hash, "$argon2i$")
+}
+
+// Verify returns whether the password matches the hash
+func (Argon2) Verify(encoded, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return false, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, ErrMalformedHash
+	}
+	if version != argon2.Version {
+		return false, ErrUnsupportedHash
+	}
+
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return false, ErrMalformedHash
+	}
+	if params.Iterations == 0 || params.Parallelism == 0 {
+		return false, ErrMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrMalformedHash
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(expected) == 0 {
+		return false, ErrMalformedHash
+	}
+
+	key := argon2.IDKey
+	if parts[1] == "argon2i" {
+		key = argon2.Key
+	}
+
+	sum := key([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(sum, expected) == 1, nil
+}
+
+// HashArgon2 hashes the password with argon2id and a random salt in the PHC string format. If params is
+// the zero value, DefaultArgon2Params are used
+func HashArgon2(password string, params Argon2Params) (string, error) {
+	if params == (Argon2Params{}) {
+		params = DefaultArgon2Params
+	}
+
+	if params.Iterations == 0 || params.Parallelism == 0 {
+		return "", errors.New("argon2 iterations and parallelism must be positive")
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	sum := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Iterations,
+		params.Parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sum)), nil
+}
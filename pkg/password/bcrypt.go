@@ -0,0 +1,60 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// DefaultBcryptCost is the cost used by HashBcrypt when none is given
+	DefaultBcryptCost = 10
+
+	// MinBcryptCost and MaxBcryptCost are the bounds of the cost of a bcrypt hash
+	MinBcryptCost = bcrypt.MinCost
+	MaxBcryptCost = bcrypt.MaxCost
+)
+
+// Bcrypt verifies bcrypt hashes with the $2a$, $2b$ and $2y$ prefixes, as written by htpasswd -B and
+// most other tools, eg. $2y$10$<22 character salt><31 character hash>. As in OpenBSD, passwords are
+// truncated to 72 bytes
+type Bcrypt struct{}
+
+// Supports returns whether the hash is a bcrypt hash
+func (Bcrypt) Supports(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Verify returns whether the password matches the hash
+func (Bcrypt) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrMalformedHash, err)
+	}
+
+	return true, nil
+}
+
+// HashBcrypt hashes the password with bcrypt and a random salt in the $2a$ format. If cost is not
+// positive, DefaultBcryptCost is used. Passwords longer than 72 bytes are rejected rather than truncated
+func HashBcrypt(password string, cost int) (string, error) {
+	if cost <= 0 {
+		cost = DefaultBcryptCost
+	}
+
+	if cost < MinBcryptCost || cost > MaxBcryptCost {
+		return "", fmt.Errorf("bcrypt cost must be between %d and %d", MinBcryptCost, MaxBcryptCost)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
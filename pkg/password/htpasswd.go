@@ -0,0 +1,109 @@
+package password
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+)
+
+// Htpasswd are the schemes of Apache htpasswd files, bcrypt (htpasswd -B), APR1 (htpasswd -m, the
+// default) and SHA-1 (htpasswd -s). crypt(3) and plaintext entries are not supported
+var Htpasswd = Schemes{Bcrypt{}, APR1{}, SHA{}}
+
+// crypt64 is the alphabet of the MD5 based crypt, which encodes the least significant bits first
+const crypt64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// APR1 verifies the MD5 based hashes of Apache, eg. $apr1$<salt>$<hash>, and of crypt(3), which
+// use the $1$ prefix. These are weak and should only be accepted for existing files
+type APR1 struct{}
+
+// Supports returns whether the hash is an APR1 or MD5 crypt hash
+func (APR1) Supports(hash string) bool {
+	return strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "$1$")
+}
+
+// Verify returns whether the password matches the hash
+func (APR1) Verify(encoded, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || len(parts[2]) > 8 || len(parts[3]) != 22 {
+		return false, ErrMalformedHash
+	}
+
+	sum := md5Crypt("$"+parts[1]+"$", parts[2], password)
+	return subtle.ConstantTimeCompare([]byte(sum), []byte(parts[3])) == 1, nil
+}
+
+// md5Crypt returns the encoded hash of the password as computed by the MD5 based crypt
+func md5Crypt(magic, salt, password string) string {
+	alt := md5.Sum([]byte(password + salt + password))
+
+	ctx := []byte(password + magic + salt)
+	for i := len(password); i > 0; i -= 16 {
+		ctx = append(ctx, alt[:min(i, 16)]...)
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx = append(ctx, 0)
+		} else {
+			ctx = append(ctx, password[0])
+		}
+	}
+	sum := md5.Sum(ctx)
+
+	for i := 0; i < 1000; i++ {
+		ctx = ctx[:0]
+		if i&1 == 1 {
+			ctx = append(ctx, password...)
+		} else {
+			ctx = append(ctx, sum[:]...)
+		}
+		if i%3 != 0 {
+			ctx = append(ctx, salt...)
+		}
+		if i%7 != 0 {
+			ctx = append(ctx, password...)
+		}
+		if i&1 == 1 {
+			ctx = append(ctx, sum[:]...)
+		} else {
+			ctx = append(ctx, password...)
+		}
+		sum = md5.Sum(ctx)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, crypt64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+
+	return string(out)
+}
+
+// SHA verifies the unsalted SHA-1 hashes of htpasswd -s, eg. {SHA}<base64 hash>. These are weak
+// and should only be accepted for existing files
+type SHA struct{}
+
+// Supports returns whether the hash is a SHA-1 hash
+func (SHA) Supports(hash string) bool {
+	return strings.HasPrefix(hash, "{SHA}")
+}
+
+// Verify returns whether the password matches the hash
+func (SHA) Verify(encoded, password string) (bool, error) {
+	expected, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, "{SHA}"))
+	if err != nil || len(expected) != sha1.Size {
+		return false, ErrMalformedHash
+	}
+
+	sum := sha1.Sum([]byte(password))
+	return subtle.ConstantTimeCompare(sum[:], expected) == 1, nil
+}
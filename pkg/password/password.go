@@ -0,0 +1,66 @@
+package password
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrUnsupportedHash indicates no scheme recognises the format of a hash
+	ErrUnsupportedHash = errors.New("unsupported password hash")
+
+	// ErrMalformedHash indicates a hash was recognised but could not be parsed
+	ErrMalformedHash = errors.New("malformed password hash")
+)
+
+// Scheme verifies passwords against hashes of one format
+type Scheme interface {
+	Supports(hash string) bool                  // whether the hash is in the format of the scheme
+	Verify(hash, password string) (bool, error) // whether the password matches the hash
+}
+
+// Schemes verifies passwords with the first scheme which supports the hash
+type Schemes []Scheme
+
+// Default are the schemes of the recommended password hashes
+var Default = Schemes{PBKDF2{}, Bcrypt{}, Argon2{}}
+
+// Verify returns whether the password matches the hash
+func (s Schemes) Verify(hash, password string) (bool, error) {
+	for _, scheme := range s {
+		if scheme.Supports(hash) {
+			return scheme.Verify(hash, password)
+		}
+	}
+
+	return false, ErrUnsupportedHash
+}
+
+// Func adapts a verification function to a Scheme for the hashes starting with one of the prefixes,
+// eg. scrypt from golang.org/x/crypto:
+//
+//	password.Func{
+//		Prefixes: []string{"$scrypt$"},
+//		VerifyFunc: func(hash, pw string) (bool, error) {
+//			return verifyScrypt(hash, pw) // decodes the parameters and compares scrypt.Key
+//		},
+//	}
+type Func struct {
+	Prefixes   []string
+	VerifyFunc func(hash, password string) (bool, error)
+}
+
+// Supports returns whether the hash starts with one of the prefixes
+func (f Func) Supports(hash string) bool {
+	for _, prefix := range f.Prefixes {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify returns whether the password matches the hash
+func (f Func) Verify(hash, password string) (bool, error) {
+	return f.VerifyFunc(hash, password)
+}
@@ -0,0 +1,347 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name        string
+		hash        string
+		password    string
+		expectMatch bool
+		expectError error
+	}{
+		{
+			name:        "Success - passlib sha256",
+			hash:        "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - passlib sha1",
+			hash:        "$pbkdf2$1000$c2FsdHNhbHRzYWx0c2FsdA$2FWw/oC7TQkskizC.81lWlmFAMM",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - mosquitto-go-auth sha512",
+			hash:        "PBKDF2$sha512$1000$c2FsdHNhbHRzYWx0c2FsdA==$715rqIr5dXOVPpBhqqsugl037zT5bWJTWYmZtIcK8hBnisKpwfY7kokvwjDrNHqHhF50Pb7MD6HvkJwiDQw4ww==",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - bcrypt",
+			hash:        "$2b$05$CCCCCCCCCCCCCCCCCCCCC.aDV7CQarKHMuNfh2oJkFzsHZya4whFe",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - argon2id",
+			hash:        "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - argon2i",
+			hash:        "$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$IMit9qkFULCMA/ViizL57cnTLOa5DiVM9eMwpAvPwr4",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Failure - argon2id wrong password",
+			hash:        "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0",
+			password:    "passw0rd",
+			expectMatch: false,
+		},
+		{
+			name:        "Failure - wrong password",
+			hash:        "$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA",
+			password:    "passw0rd",
+			expectMatch: false,
+		},
+		{
+			name:        "Error - unsupported digest",
+			hash:        "$pbkdf2-md5$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8w",
+			password:    "password",
+			expectError: ErrUnsupportedHash,
+		},
+		{
+			name:        "Error - unsupported scheme",
+			hash:        "$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0",
+			password:    "password",
+			expectError: ErrUnsupportedHash,
+		},
+		{
+			name:        "Error - missing fields",
+			hash:        "PBKDF2$sha256$1000$c2FsdA==",
+			password:    "password",
+			expectError: ErrMalformedHash,
+		},
+		{
+			name:        "Error - invalid iterations",
+			hash:        "$pbkdf2-sha256$0$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA",
+			password:    "password",
+			expectError: ErrMalformedHash,
+		},
+		{
+			name:        "Error - argon2 version",
+			hash:        "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0",
+			password:    "password",
+			expectError: ErrUnsupportedHash,
+		},
+		{
+			name:        "Error - argon2 parameters",
+			hash:        "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$Wb9DOLKUgwlL5fjad9tfCPU0SBAo0PEY/evJRhwtUR0",
+			password:    "password",
+			expectError: ErrMalformedHash,
+		},
+		{
+			name:        "Error - invalid salt",
+			hash:        "$pbkdf2-sha256$1000$c2F*$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA",
+			password:    "password",
+			expectError: ErrMalformedHash,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			match, err := Default.Verify(tt.hash, tt.password)
+			if tt.expectError != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				require.False(t, match)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectMatch, match)
+
+		})
+	}
+}
+
+func TestHashPBKDF2(t *testing.T) {
+	hash, err := HashPBKDF2("secret", 1000)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$pbkdf2-sha256$1000$"))
+
+	match, err := Default.Verify(hash, "secret")
+	require.NoError(t, err)
+	require.True(t, match)
+
+	match, err = Default.Verify(hash, "Secret")
+	require.NoError(t, err)
+	require.False(t, match)
+
+	// salts are random
+	other, err := HashPBKDF2("secret", 1000)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other)
+
+	hash, err = HashPBKDF2("secret", 0)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$pbkdf2-sha256$210000$"))
+}
+
+func TestHtpasswd(t *testing.T) {
+	tests := []struct {
+		name        string
+		hash        string
+		password    string
+		expectMatch bool
+		expectError error
+	}{
+		{
+			name:        "Success - bcrypt 2b",
+			hash:        "$2b$05$CCCCCCCCCCCCCCCCCCCCC.aDV7CQarKHMuNfh2oJkFzsHZya4whFe",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - bcrypt 2y",
+			hash:        "$2y$05$CCCCCCCCCCCCCCCCCCCCC.aDV7CQarKHMuNfh2oJkFzsHZya4whFe",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - bcrypt empty password",
+			hash:        "$2b$04$abcdefghijklmnopqrstuubyCG3zY1GIXMyxfivm.ClDiInHzxjiq",
+			password:    "",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - bcrypt 71 byte password",
+			hash:        "$2b$04$abcdefghijklmnopqrstuuMCu.k1vM/ywQwiONaEn3oEMlZoCVBd6",
+			password:    strings.Repeat("a", 71),
+			expectMatch: true,
+		},
+		{
+			name:        "Success - bcrypt truncates at 72 bytes",
+			hash:        "$2b$04$abcdefghijklmnopqrstuuBzzIgyKkz7xMWYSzkIjUSnxEQFQ0WNe",
+			password:    strings.Repeat("a", 72) + "ignored",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - apr1",
+			hash:        "$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - apr1 long password",
+			hash:        "$apr1$ab$ZgbyBttfAvWjwKDroS41O1",
+			password:    "a much longer password than sixteen bytes",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - md5 crypt",
+			hash:        "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Success - sha",
+			hash:        "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+			password:    "password",
+			expectMatch: true,
+		},
+		{
+			name:        "Failure - bcrypt wrong password",
+			hash:        "$2b$05$CCCCCCCCCCCCCCCCCCCCC.aDV7CQarKHMuNfh2oJkFzsHZya4whFe",
+			password:    "passw0rd",
+			expectMatch: false,
+		},
+		{
+			name:        "Failure - apr1 wrong password",
+			hash:        "$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0",
+			password:    "passw0rd",
+			expectMatch: false,
+		},
+		{
+			name:        "Failure - sha wrong password",
+			hash:        "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+			password:    "passw0rd",
+			expectMatch: false,
+		},
+		{
+			name:        "Error - bcrypt truncated",
+			hash:        "$2b$05$CCCCCCCCCCCCCCCCCCCCC.aDV7CQarKHMuNfh2oJkFzsHZya4wh",
+			password:    "password",
+			expectError: ErrMalformedHash,
+		},
+		{
+			name:        "Error - bcrypt cost",
+			hash:        "$2b$03$CCCCCCCCCCCCCCCCCCCCC.aDV7CQarKHMuNfh2oJkFzsHZya4whFe",
+			password:    "password",
+			expectError: ErrMalformedHash,
+		},
+		{
+			name:        "Error - apr1 missing hash",
+			hash:        "$apr1$xxxxxxxx",
+			password:    "password",
+			expectError: ErrMalformedHash,
+		},
+		{
+			name:        "Error - sha invalid base64",
+			hash:        "{SHA}W6ph5Mm5Pz8G*iULbPgzG37mj9g=",
+			password:    "password",
+			expectError: ErrMalformedHash,
+		},
+		{
+			name:        "Error - crypt",
+			hash:        "abJnggxhB/yWI",
+			password:    "password",
+			expectError: ErrUnsupportedHash,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			match, err := Htpasswd.Verify(tt.hash, tt.password)
+			if tt.expectError != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				require.False(t, match)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectMatch, match)
+
+		})
+	}
+}
+
+func TestHashBcrypt(t *testing.T) {
+	hash, err := HashBcrypt("secret", 4)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$2a$04$"))
+	require.Len(t, hash, 60)
+
+	match, err := Default.Verify(hash, "secret")
+	require.NoError(t, err)
+	require.True(t, match)
+
+	match, err = Default.Verify(hash, "Secret")
+	require.NoError(t, err)
+	require.False(t, match)
+
+	_, err = HashBcrypt("secret", 32)
+	require.Error(t, err)
+
+	_, err = HashBcrypt(strings.Repeat("a", 73), 4)
+	require.Error(t, err)
+}
+
+func TestHashArgon2(t *testing.T) {
+	hash, err := HashArgon2("secret", Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$"))
+
+	match, err := Default.Verify(hash, "secret")
+	require.NoError(t, err)
+	require.True(t, match)
+
+	match, err = Default.Verify(hash, "Secret")
+	require.NoError(t, err)
+	require.False(t, match)
+
+	// salts are random
+	other, err := HashArgon2("secret", Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1})
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other)
+
+	_, err = HashArgon2("secret", Argon2Params{Memory: 64})
+	require.Error(t, err)
+}
+
+func TestFunc(t *testing.T) {
+	schemes := append(Schemes{Func{
+		Prefixes: []string{"$2a$", "$2y$"},
+		VerifyFunc: func(hash, password string) (bool, error) {
+			if hash == "$2y$broken" {
+				return false, errors.New("broken hash")
+			}
+			return hash == "$2y$"+password, nil
+		},
+	}}, Default...)
+
+	match, err := schemes.Verify("$2y$secret", "secret")
+	require.NoError(t, err)
+	require.True(t, match)
+
+	match, err = schemes.Verify("$2y$secret", "guess")
+	require.NoError(t, err)
+	require.False(t, match)
+
+	_, err = schemes.Verify("$2y$broken", "secret")
+	require.EqualError(t, err, "broken hash")
+
+	// other hashes fall through to the next scheme
+	match, err = schemes.Verify("$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA", "password")
+	require.NoError(t, err)
+	require.True(t, match)
+}
@@ -0,0 +1,111 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// DefaultPBKDF2Iterations is the iteration count used by HashPBKDF2 when none is given
+const DefaultPBKDF2Iterations = 210000
+
+// ab64 is the adapted base64 of passlib, which uses "." instead of "+" and omits padding
+var ab64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+// PBKDF2 verifies PBKDF2-HMAC hashes in the modular crypt format of passlib, eg.
+// $pbkdf2-sha256$29000$<salt>$<hash>, and in the format of mosquitto-go-auth, eg.
+// PBKDF2$sha512$100000$<base64 salt>$<base64 hash>. SHA-1, SHA-256 and SHA-512 are supported
+type PBKDF2 struct{}
+
+// Supports returns whether the hash is a PBKDF2 hash
+func (PBKDF2) Supports(hash string) bool {
+	return strings.HasPrefix(hash, "$pbkdf2") || strings.HasPrefix(hash, "PBKDF2$")
+}
+
+// Verify returns whether the password matches the hash
+func (PBKDF2) Verify(encoded, password string) (bool, error) {
+	var digest, iterations, salt, sum string
+	var decode func(string) ([]byte, error)
+
+	if rest, ok := strings.CutPrefix(encoded, "PBKDF2$"); ok {
+		parts := strings.Split(rest, "$")
+		if len(parts) != 4 {
+			return false, ErrMalformedHash
+		}
+		digest, iterations, salt, sum = parts[0], parts[1], parts[2], parts[3]
+		decode = base64.StdEncoding.DecodeString
+	} else {
+		parts := strings.Split(encoded, "$")
+		if len(parts) != 5 || parts[0] != "" {
+			return false, ErrMalformedHash
+		}
+
+		digest = "sha1"
+		if name, ok := strings.CutPrefix(parts[1], "pbkdf2-"); ok {
+			digest = name
+		} else if parts[1] != "pbkdf2" {
+			return false, ErrMalformedHash
+		}
+		iterations, salt, sum = parts[2], parts[3], parts[4]
+		decode = ab64.DecodeString
+	}
+
+	h := hashFunc(digest)
+	if h == nil {
+		return false, ErrUnsupportedHash
+	}
+
+	iter, err := strconv.Atoi(iterations)
+	if err != nil || iter < 1 {
+		return false, ErrMalformedHash
+	}
+
+	saltBytes, err := decode(salt)
+	if err != nil {
+		return false, ErrMalformedHash
+	}
+
+	expected, err := decode(sum)
+	if err != nil || len(expected) == 0 {
+		return false, ErrMalformedHash
+	}
+
+	key := pbkdf2.Key([]byte(password), saltBytes, iter, len(expected), h)
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
+
+// HashPBKDF2 hashes the password with PBKDF2-HMAC-SHA256 and a random salt in the passlib format. If
+// iterations is not positive, DefaultPBKDF2Iterations is used
+func HashPBKDF2(password string, iterations int) (string, error) {
+	if iterations <= 0 {
+		iterations = DefaultPBKDF2Iterations
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	return "$pbkdf2-sha256$" + strconv.Itoa(iterations) + "$" + ab64.EncodeToString(salt) + "$" + ab64.EncodeToString(key), nil
+}
+
+func hashFunc(name string) func() hash.Hash {
+	switch name {
+	case "sha1":
+		return sha1.New
+	case "sha256":
+		return sha256.New
+	case "sha512":
+		return sha512.New
+	}
+	return nil
+}
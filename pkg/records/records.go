@@ -0,0 +1,115 @@
+// Package records builds the storage records of clients, subscriptions, messages and system info
+// which storage hooks persist, and from which the server restores its state when it starts
+package records
+
+import (
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+)
+
+// SubscriptionID returns the id of the subscription of a client to the filter
+func SubscriptionID(cl *mqtt.Client, filter string) string {
+	return cl.ID + ":" + filter
+}
+
+// InflightID returns the id of a message inflight to a client
+func InflightID(cl *mqtt.Client, pk packets.Packet) string {
+	return cl.ID + ":" + pk.FormatID()
+}
+
+// Client returns the record of the client
+func Client(cl *mqtt.Client) *storage.Client {
+	props := cl.Properties.Props.Copy(false)
+	return &storage.Client{
+		ID:              cl.ID,
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	}
+}
+
+// Subscriptions returns the records of the filters of a subscribe packet which were granted, given
+// the reason codes the client was sent
+func Subscriptions(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) []*storage.Subscription {
+	var subs []*storage.Subscription
+	for i, f := range pk.Filters {
+		if i >= len(reasonCodes) || reasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+			continue
+		}
+
+		subs = append(subs, &storage.Subscription{
+			ID:                SubscriptionID(cl, f.Filter),
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Qos:               reasonCodes[i],
+			Filter:            f.Filter,
+			Identifier:        f.Identifier,
+			NoLocal:           f.NoLocal,
+			RetainHandling:    f.RetainHandling,
+			RetainAsPublished: f.RetainAsPublished,
+		})
+	}
+	return subs
+}
+
+// Retained returns the record of a retained message
+func Retained(pk packets.Packet) *storage.Message {
+	return message(pk.TopicName, storage.RetainedKey, pk, 0)
+}
+
+// Inflight returns the record of a message inflight to a client, which was last sent at the time
+func Inflight(cl *mqtt.Client, pk packets.Packet, sent int64) *storage.Message {
+	return message(InflightID(cl, pk), storage.InflightKey, pk, sent)
+}
+
+// message returns the record of a retained or inflight message
+func message(id, kind string, pk packets.Packet, sent int64) *storage.Message {
+	props := pk.Properties.Copy(false)
+	return &storage.Message{
+		ID:          id,
+		T:           kind,
+		Origin:      pk.Origin,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		PacketID:    pk.PacketID,
+		Sent:        sent,
+		Created:     pk.Created,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+}
+
+// SysInfo returns the record of the system info
+func SysInfo(sys *system.Info) *storage.SystemInfo {
+	return &storage.SystemInfo{
+		ID:   storage.SysInfoKey,
+		T:    storage.SysInfoKey,
+		Info: *sys.Clone(),
+	}
+}
@@ -0,0 +1,878 @@
+package redisclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Single connects to the first of the addresses
+	Single Mode = iota
+	// Cluster discovers the nodes of a Redis Cluster from the addresses and routes each command to the
+	// node serving its key
+	Cluster
+	// Sentinel asks the sentinels at the addresses for the master named MasterName
+	Sentinel
+)
+
+// maxBulkLength bounds the replies read from a server
+const maxBulkLength = 64 << 20
+
+// slotCount is the number of hash slots of a Redis Cluster
+const slotCount = 16384
+
+// Mode determines how the servers at the addresses of a client are used
+type Mode byte
+
+// Error is an error reply from a server
+type Error string
+
+// Error returns the message of the reply
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Client runs commands against Redis. It is satisfied by the client returned by NewClient, and can be
+// implemented over other Redis client libraries, eg. for go-redis:
+//
+//	func (c adapter) Do(ctx context.Context, args ...any) (any, error) {
+//		v, err := c.UniversalClient.Do(ctx, args...).Result()
+//		if errors.Is(err, redis.Nil) {
+//			return nil, nil
+//		}
+//		return v, err
+//	}
+type Client interface {
+	// Do runs the command and returns its reply, which is a string, an int64, a []any, or nil for nil
+	// replies. Error replies are returned as errors
+	Do(ctx context.Context, args ...any) (any, error)
+	Close() error
+}
+
+// Pipeliner is implemented by clients which send several commands in one round trip, such as the
+// client returned by NewClient
+type Pipeliner interface {
+	// Pipeline runs the commands and returns their replies in order, with error replies in place of
+	// the replies of the commands which failed, and the first of them as the error. Other errors fail
+	// the whole pipeline
+	Pipeline(ctx context.Context, cmds ...[]any) ([]any, error)
+}
+
+// Pipeline runs the commands in one round trip if the client is a Pipeliner, or one by one if not,
+// with the semantics of Pipeliner
+func Pipeline(ctx context.Context, c Client, cmds ...[]any) ([]any, error) {
+	if p, ok := c.(Pipeliner); ok {
+		return p.Pipeline(ctx, cmds...)
+	}
+
+	replies := make([]any, len(cmds))
+	var first error
+	for i, cmd := range cmds {
+		reply, err := c.Do(ctx, cmd...)
+		if err != nil && !isReplyError(err) {
+			return nil, err
+		}
+
+		if err != nil {
+			reply = asReplyError(err)
+			if first == nil {
+				first = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, first
+}
+
+// Script is a Lua script, which is run by its SHA1 digest so its source is sent once to each server
+type Script struct {
+	src string
+	sha string
+}
+
+// NewScript returns the script with the source
+func NewScript(src string) *Script {
+	sum := sha1.Sum([]byte(src))
+	return &Script{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// Run runs the script with the keys and arguments with EVALSHA, and with EVAL if the server hasn't
+// loaded it, which loads it. On a cluster, the keys must hash to the same slot
+func (s *Script) Run(ctx context.Context, c Client, keys []string, args ...any) (any, error) {
+	cmd := make([]any, 0, 3+len(keys)+len(args))
+	cmd = append(cmd, "EVALSHA", s.sha, len(keys))
+	for _, key := range keys {
+		cmd = append(cmd, key)
+	}
+	cmd = append(cmd, args...)
+
+	reply, err := c.Do(ctx, cmd...)
+	if err == nil || !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		return reply, err
+	}
+
+	cmd[0], cmd[1] = "EVAL", s.src
+	return c.Do(ctx, cmd...)
+}
+
+// ClientOptions contains the options for connecting to Redis
+type ClientOptions struct {
+	Addrs      []string // host:port of the server, the seed nodes of a cluster, or the sentinels
+	Mode       Mode
+	MasterName string // Sentinel: the name of the monitored master
+
+	Username string // Redis 6 ACL user, leave empty to authenticate with only a password
+	Password string
+	DB       int // the database selected on each connection, not supported by Cluster
+
+	SentinelUsername string // Sentinel: credentials of the sentinels, if they differ from the servers
+	SentinelPassword string
+
+	TLSConfig *tls.Config   // connect with TLS, the server name defaults to the host of each address
+	Timeout   time.Duration // applied to dialing and to each command, defaults to 5 seconds
+	PoolSize  int           // maximum number of idle connections kept open per server, defaults to 4
+
+	// Dial overrides how connections are established, eg. to connect through a proxy
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// client is a minimal RESP2 client with a connection pool per server
+type client struct {
+	opts   ClientOptions
+	pools  map[string]*pool
+	slots  []string // Cluster: the address serving each slot, loaded on demand
+	master string   // Sentinel: the address of the master, resolved on demand
+	mu     sync.Mutex
+}
+
+// NewClient returns a client for the servers. Connections are established when commands are run
+func NewClient(opts ClientOptions) (Client, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, errors.New("no addresses configured")
+	}
+
+	if opts.Mode == Sentinel && opts.MasterName == "" {
+		return nil, errors.New("sentinel requires a master name")
+	}
+
+	if opts.Mode == Cluster && opts.DB != 0 {
+		return nil, errors.New("cluster does not support selecting a database")
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 4
+	}
+
+	if opts.Dial == nil {
+		dialer := &net.Dialer{Timeout: opts.Timeout}
+		opts.Dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}
+	}
+
+	return &client{
+		opts:  opts,
+		pools: make(map[string]*pool),
+	}, nil
+}
+
+// Do runs the command on the server, the node serving its key, or the master
+func (c *client) Do(ctx context.Context, args ...any) (any, error) {
+	switch c.opts.Mode {
+	case Cluster:
+		return c.doCluster(ctx, args)
+	case Sentinel:
+		addr, err := c.resolveMaster(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err := c.doAt(ctx, addr, false, args)
+		if err != nil && (!isReplyError(err) || strings.HasPrefix(err.Error(), "READONLY")) {
+			// the master may have failed over, so ask the sentinels again for the next command
+			c.forgetMaster(addr)
+		}
+		return reply, err
+	}
+
+	return c.doAt(ctx, c.opts.Addrs[0], false, args)
+}
+
+// Pipeline runs the commands in one round trip on the server, the node serving their keys, or the
+// master. On a cluster, commands whose keys hash to different slots, or which are redirected, are
+// run one by one, so keys which are pipelined together should share a {hash tag}
+func (c *client) Pipeline(ctx context.Context, cmds ...[]any) ([]any, error) {
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+
+	switch c.opts.Mode {
+	case Cluster:
+		return c.pipelineCluster(ctx, cmds)
+	case Sentinel:
+		addr, err := c.resolveMaster(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		replies, err := c.pipelineAt(ctx, addr, cmds)
+		if err != nil && (!isReplyError(err) || strings.HasPrefix(err.Error(), "READONLY")) {
+			c.forgetMaster(addr)
+		}
+		return replies, err
+	}
+
+	return c.pipelineAt(ctx, c.opts.Addrs[0], cmds)
+}
+
+// Close closes the idle connections of every server
+func (c *client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, p := range c.pools {
+		p.close()
+		delete(c.pools, addr)
+	}
+	return nil
+}
+
+// doAt runs the command on the server at the address, preceded by ASKING if asking is set
+func (c *client) doAt(ctx context.Context, addr string, asking bool, args []any) (any, error) {
+	p := c.pool(addr)
+	cn, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if asking {
+		if _, err := cn.do("ASKING"); err != nil {
+			p.put(cn, isReplyError(err))
+			return nil, err
+		}
+	}
+
+	reply, err := cn.do(args...)
+	p.put(cn, err == nil || isReplyError(err))
+	return reply, err
+}
+
+// pipelineAt runs the commands in one round trip on the server at the address
+func (c *client) pipelineAt(ctx context.Context, addr string, cmds [][]any) ([]any, error) {
+	p := c.pool(addr)
+	cn, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := cn.pipeline(cmds)
+	p.put(cn, err == nil || isReplyError(err))
+	return replies, err
+}
+
+// pool returns the connection pool of the server at the address
+func (c *client) pool(addr string) *pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pools[addr]
+	if !ok {
+		p = newPool(func(ctx context.Context) (*conn, error) {
+			return c.connect(ctx, addr, c.opts.Username, c.opts.Password, c.opts.DB)
+		}, c.opts.PoolSize)
+		c.pools[addr] = p
+	}
+	return p
+}
+
+// connect establishes an authenticated connection to the server at the address
+func (c *client) connect(ctx context.Context, addr, username, password string, db int) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	nc, err := c.opts.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.opts.TLSConfig != nil {
+		config := c.opts.TLSConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+
+		tc := tls.Client(nc, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	cn := newConn(nc, c.opts.Timeout)
+	if password != "" {
+		args := []any{"AUTH", password}
+		if username != "" {
+			args = []any{"AUTH", username, password}
+		}
+
+		if _, err := cn.do(args...); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+
+	if db != 0 {
+		if _, err := cn.do("SELECT", db); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+// resolveMaster returns the address of the master, asking the sentinels if it is not known
+func (c *client) resolveMaster(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	master := c.master
+	c.mu.Unlock()
+	if master != "" {
+		return master, nil
+	}
+
+	var errs []error
+	for _, addr := range c.opts.Addrs {
+		master, err := c.askSentinel(ctx, addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sentinel %s: %w", addr, err))
+			continue
+		}
+
+		c.mu.Lock()
+		c.master = master
+		c.mu.Unlock()
+		return master, nil
+	}
+
+	return "", errors.Join(errs...)
+}
+
+// askSentinel asks the sentinel at the address for the address of the master
+func (c *client) askSentinel(ctx context.Context, addr string) (string, error) {
+	cn, err := c.connect(ctx, addr, c.opts.SentinelUsername, c.opts.SentinelPassword, 0)
+	if err != nil {
+		return "", err
+	}
+	defer cn.Close()
+
+	reply, err := cn.do("SENTINEL", "get-master-addr-by-name", c.opts.MasterName)
+	if err != nil {
+		return "", err
+	}
+
+	parts, ok := reply.([]any)
+	if !ok || len(parts) != 2 {
+		return "", fmt.Errorf("master %q is unknown", c.opts.MasterName)
+	}
+
+	host, _ := parts[0].(string)
+	port, _ := parts[1].(string)
+	return net.JoinHostPort(host, port), nil
+}
+
+// forgetMaster discards the master address and its connections, if it is still the given address
+func (c *client) forgetMaster(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.master != addr {
+		return
+	}
+
+	c.master = ""
+	if p, ok := c.pools[addr]; ok {
+		p.close()
+		delete(c.pools, addr)
+	}
+}
+
+// doCluster runs the command on the node serving its key, following MOVED and ASK redirections
+func (c *client) doCluster(ctx context.Context, args []any) (any, error) {
+	slot := commandSlot(args)
+	addr, err := c.slotAddr(ctx, slot)
+	if err != nil {
+		return nil, err
+	}
+
+	asking := false
+	for redirects := 0; ; redirects++ {
+		reply, err := c.doAt(ctx, addr, asking, args)
+		if !isReplyError(err) || redirects == 5 {
+			if err != nil && !isReplyError(err) {
+				// the node may have left the cluster, so reload the slots for the next command
+				c.forgetSlots()
+			}
+			return reply, err
+		}
+
+		kind, target, ok := parseRedirect(err.Error())
+		if !ok {
+			return reply, err
+		}
+
+		addr, asking = target, kind == "ASK"
+		if kind == "MOVED" && slot >= 0 {
+			c.mu.Lock()
+			if c.slots != nil {
+				c.slots[slot] = target
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// pipelineCluster runs the commands in one round trip on the node serving their keys if they share a
+// slot, and one by one otherwise. Commands redirected to another node are run again on their own
+func (c *client) pipelineCluster(ctx context.Context, cmds [][]any) ([]any, error) {
+	slot := commandSlot(cmds[0])
+	for _, cmd := range cmds[1:] {
+		if commandSlot(cmd) != slot {
+			slot = -1
+			break
+		}
+	}
+
+	replies := make([]any, len(cmds))
+	if slot >= 0 {
+		addr, err := c.slotAddr(ctx, slot)
+		if err != nil {
+			return nil, err
+		}
+
+		if replies, err = c.pipelineAt(ctx, addr, cmds); err != nil && !isReplyError(err) {
+			c.forgetSlots()
+			return nil, err
+		}
+	}
+
+	var first error
+	for i, cmd := range cmds {
+		if slot >= 0 {
+			replyErr, failed := replies[i].(Error)
+			if !failed {
+				continue
+			}
+
+			if _, _, redirected := parseRedirect(string(replyErr)); !redirected {
+				if first == nil {
+					first = replyErr
+				}
+				continue
+			}
+		}
+
+		reply, err := c.doCluster(ctx, cmd)
+		if err != nil && !isReplyError(err) {
+			return nil, err
+		}
+
+		if err != nil {
+			reply = asReplyError(err)
+			if first == nil {
+				first = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, first
+}
+
+// commandSlot returns the slot of the key of the command, or -1 if it has no key. The key of most
+// commands is their first argument, but stream commands with a subcommand or options, and scripts, have
+// it after them
+func commandSlot(args []any) int {
+	if len(args) == 0 {
+		return -1
+	}
+
+	key := 1
+	switch strings.ToUpper(fmt.Sprint(args[0])) {
+	case "XGROUP", "XINFO":
+		key = 2
+	case "EVAL", "EVALSHA":
+		key = 3
+		if len(args) < 3 || fmt.Sprint(args[2]) == "0" {
+			key = len(args)
+		}
+	case "XREAD", "XREADGROUP":
+		key = len(args)
+		for i, arg := range args {
+			if strings.EqualFold(fmt.Sprint(arg), "STREAMS") {
+				key = i + 1
+				break
+			}
+		}
+	}
+
+	if key >= len(args) {
+		return -1
+	}
+	return keySlot(fmt.Sprint(args[key]))
+}
+
+// slotAddr returns the address of the node serving the slot, loading the slots of the cluster if they
+// are not known. Commands without a key are run on the first address
+func (c *client) slotAddr(ctx context.Context, slot int) (string, error) {
+	if slot < 0 {
+		return c.opts.Addrs[0], nil
+	}
+
+	c.mu.Lock()
+	slots := c.slots
+	c.mu.Unlock()
+
+	if slots == nil {
+		var err error
+		if slots, err = c.loadSlots(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if addr := slots[slot]; addr != "" {
+		return addr, nil
+	}
+	return c.opts.Addrs[0], nil
+}
+
+// loadSlots asks the nodes at the addresses which node serves each slot
+func (c *client) loadSlots(ctx context.Context) ([]string, error) {
+	var errs []error
+	for _, addr := range c.opts.Addrs {
+		reply, err := c.doAt(ctx, addr, false, []any{"CLUSTER", "SLOTS"})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", addr, err))
+			continue
+		}
+
+		slots, err := parseSlots(reply, addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", addr, err))
+			continue
+		}
+
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return slots, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// forgetSlots discards the slots, so they are loaded again by the next command
+func (c *client) forgetSlots() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slots = nil
+}
+
+// parseSlots converts a CLUSTER SLOTS reply into the address serving each slot. Nodes with an empty
+// host are on the host of the node which was asked
+func parseSlots(reply any, asked string) ([]string, error) {
+	ranges, ok := reply.([]any)
+	if !ok {
+		return nil, errors.New("unexpected cluster slots reply")
+	}
+
+	askedHost, _, _ := net.SplitHostPort(asked)
+	slots := make([]string, slotCount)
+	for _, r := range ranges {
+		fields, ok := r.([]any)
+		if !ok || len(fields) < 3 {
+			return nil, errors.New("unexpected cluster slots range")
+		}
+
+		start, ok1 := fields[0].(int64)
+		end, ok2 := fields[1].(int64)
+		node, ok3 := fields[2].([]any)
+		if !ok1 || !ok2 || !ok3 || len(node) < 2 || start < 0 || end >= slotCount || start > end {
+			return nil, errors.New("unexpected cluster slots range")
+		}
+
+		host, _ := node[0].(string)
+		port, _ := node[1].(int64)
+		if host == "" {
+			host = askedHost
+		}
+
+		addr := net.JoinHostPort(host, strconv.FormatInt(port, 10))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = addr
+		}
+	}
+
+	return slots, nil
+}
+
+// parseRedirect parses a MOVED or ASK error reply, eg. "MOVED 3999 127.0.0.1:6381"
+func parseRedirect(msg string) (kind, addr string, ok bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", "", false
+	}
+	return fields[0], fields[2], true
+}
+
+// keySlot returns the cluster slot of the key, hashing only its hash tag if it has one
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % slotCount
+}
+
+// crc16 is the CRC-16/XMODEM checksum used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func isReplyError(err error) bool {
+	var replyErr Error
+	return errors.As(err, &replyErr)
+}
+
+// asReplyError returns the error reply of the error
+func asReplyError(err error) Error {
+	var replyErr Error
+	errors.As(err, &replyErr)
+	return replyErr
+}
+
+// conn is a connection to a server
+type conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+func newConn(nc net.Conn, timeout time.Duration) *conn {
+	return &conn{
+		conn:    nc,
+		reader:  bufio.NewReader(nc),
+		timeout: timeout,
+	}
+}
+
+// do sends the command and reads its reply
+func (c *conn) do(args ...any) (any, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := c.conn.Write(encodeCommand(args)); err != nil {
+		return nil, err
+	}
+
+	return readReply(c.reader)
+}
+
+// pipeline sends the commands together and reads their replies
+func (c *conn) pipeline(cmds [][]any) ([]any, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, encodeCommand(cmd)...)
+	}
+
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	var first error
+	for i := range cmds {
+		reply, err := readReply(c.reader)
+		if err != nil && !isReplyError(err) {
+			return nil, err
+		}
+
+		if err != nil {
+			reply = asReplyError(err)
+			if first == nil {
+				first = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, first
+}
+
+func (c *conn) Close() error {
+	return c.conn.Close()
+}
+
+// encodeCommand encodes the command as an array of bulk strings
+func encodeCommand(args []any) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		default:
+			s = fmt.Sprint(v)
+		}
+
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(s)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, s...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	return buf
+}
+
+// readReply reads a RESP2 reply
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply")
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, Error(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < -1 || n > maxBulkLength {
+			return nil, errors.New("malformed bulk string length")
+		}
+		if n == -1 {
+			return nil, nil
+		}
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < -1 || n > maxBulkLength {
+			return nil, errors.New("malformed array length")
+		}
+		if n == -1 {
+			return nil, nil
+		}
+
+		values := make([]any, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			v, err := readReply(r)
+			if err != nil && !isReplyError(err) {
+				return nil, err
+			}
+			if err != nil {
+				v = err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("unknown reply type %q", kind)
+}
+
+// pool keeps a bounded number of idle connections to a server for reuse
+type pool struct {
+	dial func(ctx context.Context) (*conn, error)
+	idle chan *conn
+}
+
+func newPool(dial func(ctx context.Context) (*conn, error), size int) *pool {
+	return &pool{
+		dial: dial,
+		idle: make(chan *conn, size),
+	}
+}
+
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-p.idle:
+		return cn, nil
+	default:
+		return p.dial(ctx)
+	}
+}
+
+// put returns a connection to the pool, closing it if it is unhealthy or the pool is full
+func (p *pool) put(cn *conn, healthy bool) {
+	if !healthy {
+		cn.Close()
+		return
+	}
+
+	select {
+	case p.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+func (p *pool) close() {
+	for {
+		select {
+		case cn := <-p.idle:
+			cn.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package redisclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer answers commands with the replies returned by handle, recording the commands it receives
+type fakeServer struct {
+	handle   func(args []string) any
+	commands [][]string
+	mu       sync.Mutex
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+
+		var args []string
+		for _, v := range reply.([]any) {
+			args = append(args, v.(string))
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		s.mu.Unlock()
+
+		if _, err := conn.Write(encodeReply(s.handle(args))); err != nil {
+			return
+		}
+	}
+}
+
+// received returns the names of the commands received
+func (s *fakeServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for _, args := range s.commands {
+		names = append(names, args[0])
+	}
+	return names
+}
+
+func encodeReply(v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return []byte("$-1\r\n")
+	case Error:
+		return []byte("-" + string(v) + "\r\n")
+	case int64:
+		return []byte(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case string:
+		return []byte("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case []any:
+		out := []byte("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, e := range v {
+			out = append(out, encodeReply(e)...)
+		}
+		return out
+	}
+	panic(fmt.Sprintf("unsupported reply %T", v))
+}
+
+// dialer connects to the fake servers by address
+func dialer(servers map[string]*fakeServer) func(ctx context.Context, addr string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		s, ok := servers[addr]
+		if !ok {
+			return nil, errors.New("connection refused")
+		}
+
+		client, server := net.Pipe()
+		go s.serve(server)
+		return client, nil
+	}
+}
+
+// dataServer serves string keys, replying to other commands with OK
+func dataServer(values map[string]string) *fakeServer {
+	return &fakeServer{handle: func(args []string) any {
+		if args[0] == "GET" {
+			if v, ok := values[args[1]]; ok {
+				return v
+			}
+			return nil
+		}
+		return "OK"
+	}}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expect      any
+		expectError bool
+	}{
+		{
+			name:   "Success - simple string",
+			data:   "+OK\r\n",
+			expect: "OK",
+		},
+		{
+			name:   "Success - integer",
+			data:   ":42\r\n",
+			expect: int64(42),
+		},
+		{
+			name:   "Success - bulk string",
+			data:   "$5\r\nhe\r\no\r\n",
+			expect: "he\r\no",
+		},
+		{
+			name:   "Success - nil",
+			data:   "$-1\r\n",
+			expect: nil,
+		},
+		{
+			name:   "Success - array",
+			data:   "*3\r\n$1\r\na\r\n:1\r\n*-1\r\n",
+			expect: []any{"a", int64(1), nil},
+		},
+		{
+			name:        "Failure - error",
+			data:        "-ERR unknown command\r\n",
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown type",
+			data:        "?1\r\n",
+			expectError: true,
+		},
+		{
+			name:        "Failure - bulk string too long",
+			data:        "$999999999999\r\n",
+			expectError: true,
+		},
+		{
+			name:        "Failure - truncated",
+			data:        "$5\r\nhe",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			reply, err := readReply(bufio.NewReader(strings.NewReader(tt.data)))
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, reply)
+
+		})
+	}
+}
+
+func TestEncodeCommand(t *testing.T) {
+	require.Equal(t, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$2\r\n42\r\n", string(encodeCommand([]any{"SET", []byte("key"), 42})))
+}
+
+func TestKeySlot(t *testing.T) {
+	require.Equal(t, uint16(0x31c3), crc16("123456789"))
+	require.Equal(t, 12182, keySlot("foo"))
+	require.Equal(t, 5061, keySlot("bar"))
+	require.Equal(t, keySlot("user1000"), keySlot("{user1000}.following"))
+	require.Equal(t, keySlot("{}.following"), keySlot("{}.following"))
+	require.NotEqual(t, keySlot(""), keySlot("{}.following"))
+}
+
+func TestCommandSlot(t *testing.T) {
+	require.Equal(t, -1, commandSlot([]any{"PING"}))
+	require.Equal(t, keySlot("foo"), commandSlot([]any{"GET", "foo"}))
+	require.Equal(t, keySlot("foo"), commandSlot([]any{"XGROUP", "CREATE", "foo", "g", "$"}))
+	require.Equal(t, keySlot("foo"), commandSlot([]any{"XREADGROUP", "GROUP", "g", "c", "COUNT", 10, "STREAMS", "foo", ">"}))
+	require.Equal(t, -1, commandSlot([]any{"XREAD", "COUNT", 10}))
+	require.Equal(t, keySlot("foo"), commandSlot([]any{"EVALSHA", "abc", 1, "foo", "bar"}))
+	require.Equal(t, -1, commandSlot([]any{"EVAL", "return 1", 0, "foo"}))
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient(ClientOptions{})
+	require.Error(t, err)
+
+	_, err = NewClient(ClientOptions{Addrs: []string{"s:26379"}, Mode: Sentinel})
+	require.Error(t, err)
+
+	_, err = NewClient(ClientOptions{Addrs: []string{"a:7000"}, Mode: Cluster, DB: 1})
+	require.Error(t, err)
+
+	c, err := NewClient(ClientOptions{Addrs: []string{"localhost:6379"}})
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+}
+
+func TestClientSingle(t *testing.T) {
+	server := dataServer(map[string]string{"alice": "hash"})
+	c, err := NewClient(ClientOptions{
+		Addrs:    []string{"redis:6379"},
+		Username: "mqtt",
+		Password: "secret",
+		DB:       2,
+		Dial:     dialer(map[string]*fakeServer{"redis:6379": server}),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	reply, err := c.Do(context.Background(), "GET", "alice")
+	require.NoError(t, err)
+	require.Equal(t, "hash", reply)
+
+	reply, err = c.Do(context.Background(), "GET", "bob")
+	require.NoError(t, err)
+	require.Nil(t, reply)
+
+	// the connection is authenticated once and reused
+	require.Equal(t, []string{"AUTH", "SELECT", "GET", "GET"}, server.received())
+	require.Equal(t, []string{"AUTH", "mqtt", "secret"}, server.commands[0])
+}
+
+func TestClientAuthFailure(t *testing.T) {
+	server := &fakeServer{handle: func(args []string) any {
+		return Error("WRONGPASS invalid username-password pair")
+	}}
+	c, err := NewClient(ClientOptions{
+		Addrs:    []string{"redis:6379"},
+		Password: "wrong",
+		Dial:     dialer(map[string]*fakeServer{"redis:6379": server}),
+	})
+	require.NoError(t, err)
+
+	_, err = c.Do(context.Background(), "GET", "alice")
+	require.ErrorContains(t, err, "WRONGPASS")
+}
+
+func TestClientCluster(t *testing.T) {
+	slots := []any{
+		[]any{int64(0), int64(8191), []any{"", int64(7000), "id-a"}},
+		[]any{int64(8192), int64(16383), []any{"b", int64(7001), "id-b"}, []any{"c", int64(7002), "id-c"}},
+	}
+
+	a := &fakeServer{handle: func(args []string) any {
+		switch {
+		case args[0] == "CLUSTER":
+			return slots
+		case args[0] == "GET" && args[1] == "bar":
+			return "bar-on-a"
+		case args[0] == "GET" && args[1] == "migrating":
+			return Error("ASK 1234 b:7001")
+		}
+		return Error("MOVED " + strconv.Itoa(keySlot(args[1])) + " b:7001")
+	}}
+
+	asked := false
+	b := &fakeServer{handle: func(args []string) any {
+		switch {
+		case args[0] == "ASKING":
+			asked = true
+			return "OK"
+		case args[0] == "GET" && args[1] == "migrating":
+			if !asked {
+				return Error("MOVED 1234 a:7000")
+			}
+			return "migrating-on-b"
+		case args[0] == "GET" && args[1] == "foo":
+			return "foo-on-b"
+		case args[0] == "GET" && args[1] == "moved":
+			return "moved-to-b"
+		}
+		return nil
+	}}
+
+	c, err := NewClient(ClientOptions{
+		Addrs: []string{"a:7000"},
+		Mode:  Cluster,
+		Dial:  dialer(map[string]*fakeServer{"a:7000": a, "b:7001": b}),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	reply, err := c.Do(context.Background(), "GET", "bar")
+	require.NoError(t, err)
+	require.Equal(t, "bar-on-a", reply)
+
+	reply, err = c.Do(context.Background(), "GET", "foo")
+	require.NoError(t, err)
+	require.Equal(t, "foo-on-b", reply)
+	require.Equal(t, []string{"GET"}, b.received())
+
+	// "moved" is served by a according to the slots, but has moved to b
+	require.Less(t, keySlot("moved"), 8192)
+	reply, err = c.Do(context.Background(), "GET", "moved")
+	require.NoError(t, err)
+	require.Equal(t, "moved-to-b", reply)
+	require.Equal(t, "b:7001", c.(*client).slots[keySlot("moved")])
+
+	reply, err = c.Do(context.Background(), "GET", "migrating")
+	require.NoError(t, err)
+	require.Equal(t, "migrating-on-b", reply)
+	require.Equal(t, []string{"CLUSTER", "GET", "GET", "GET"}, a.received())
+}
+
+// plainClient is a Client which doesn't pipeline
+type plainClient struct {
+	Client
+}
+
+func TestPipeline(t *testing.T) {
+	server := &fakeServer{handle: func(args []string) any {
+		if args[0] == "HGET" {
+			return Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		return int64(1)
+	}}
+	c, err := NewClient(ClientOptions{
+		Addrs: []string{"redis:6379"},
+		Dial:  dialer(map[string]*fakeServer{"redis:6379": server}),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for _, client := range []Client{c, plainClient{c}} {
+		replies, err := Pipeline(context.Background(), client, []any{"HSET", "h", "a", "1"}, []any{"HGET", "s", "a"}, []any{"HDEL", "h", "b"})
+		require.ErrorContains(t, err, "WRONGTYPE")
+		require.Len(t, replies, 3)
+		require.Equal(t, int64(1), replies[0])
+		require.IsType(t, Error(""), replies[1])
+		require.Equal(t, int64(1), replies[2])
+	}
+	require.Equal(t, []string{"HSET", "HGET", "HDEL", "HSET", "HGET", "HDEL"}, server.received())
+
+	replies, err := c.(Pipeliner).Pipeline(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, replies)
+
+	// other errors fail the whole pipeline
+	broken, err := NewClient(ClientOptions{Addrs: []string{"down:6379"}, Dial: dialer(nil)})
+	require.NoError(t, err)
+	_, err = Pipeline(context.Background(), broken, []any{"HSET", "h", "a", "1"})
+	require.ErrorContains(t, err, "connection refused")
+	_, err = Pipeline(context.Background(), plainClient{broken}, []any{"HSET", "h", "a", "1"})
+	require.ErrorContains(t, err, "connection refused")
+}
+
+func TestScript(t *testing.T) {
+	script := NewScript("return redis.call('GET', KEYS[1])")
+	loaded := false
+	server := &fakeServer{handle: func(args []string) any {
+		switch args[0] {
+		case "EVAL":
+			require.Equal(t, []string{"EVAL", script.src, "1", "a", "b"}, args)
+			loaded = true
+		case "EVALSHA":
+			require.Equal(t, []string{"EVALSHA", script.sha, "1", "a", "b"}, args)
+			if !loaded {
+				return Error("NOSCRIPT No matching script. Please use EVAL.")
+			}
+		}
+		return "value"
+	}}
+	c, err := NewClient(ClientOptions{
+		Addrs: []string{"redis:6379"},
+		Dial:  dialer(map[string]*fakeServer{"redis:6379": server}),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		reply, err := script.Run(context.Background(), c, []string{"a"}, "b")
+		require.NoError(t, err)
+		require.Equal(t, "value", reply)
+	}
+	require.Equal(t, []string{"EVALSHA", "EVAL", "EVALSHA"}, server.received())
+}
+
+// hashTag returns a hash tag whose slot is within the range
+func hashTag(from, to int) string {
+	for i := 0; ; i++ {
+		tag := "tag" + strconv.Itoa(i)
+		if slot := keySlot(tag); slot >= from && slot <= to {
+			return tag
+		}
+	}
+}
+
+func TestPipelineCluster(t *testing.T) {
+	slots := []any{
+		[]any{int64(0), int64(8191), []any{"a", int64(7000)}},
+		[]any{int64(8192), int64(16383), []any{"b", int64(7001)}},
+	}
+	onA := "{" + hashTag(0, 8191) + "}"
+	onB := "{" + hashTag(8192, 16383) + "}"
+	moved := "{" + hashTag(0, 8191) + "-moved}"
+	require.Less(t, keySlot(moved), 8192)
+
+	a := &fakeServer{handle: func(args []string) any {
+		switch {
+		case args[0] == "CLUSTER":
+			return slots
+		case args[1] == moved:
+			return Error("MOVED " + strconv.Itoa(keySlot(moved)) + " b:7001")
+		case strings.HasPrefix(args[1], onA):
+			return "a"
+		}
+		return Error("MOVED " + strconv.Itoa(keySlot(args[1])) + " b:7001")
+	}}
+	b := &fakeServer{handle: func(args []string) any {
+		return "b"
+	}}
+
+	c, err := NewClient(ClientOptions{
+		Addrs: []string{"a:7000"},
+		Mode:  Cluster,
+		Dial:  dialer(map[string]*fakeServer{"a:7000": a, "b:7001": b}),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// keys sharing a hash tag are pipelined to their node
+	replies, err := Pipeline(context.Background(), c, []any{"GET", onA + ":1"}, []any{"GET", onA + ":2"})
+	require.NoError(t, err)
+	require.Equal(t, []any{"a", "a"}, replies)
+
+	replies, err = Pipeline(context.Background(), c, []any{"GET", onA + ":1"}, []any{"GET", onB + ":1"})
+	require.NoError(t, err)
+	require.Equal(t, []any{"a", "b"}, replies)
+
+	// redirected commands are run again at their new node
+	replies, err = Pipeline(context.Background(), c, []any{"GET", moved}, []any{"GET", moved})
+	require.NoError(t, err)
+	require.Equal(t, []any{"b", "b"}, replies)
+	require.Equal(t, []string{"GET", "GET", "GET"}, b.received())
+}
+
+func TestParseSlots(t *testing.T) {
+	_, err := parseSlots("OK", "a:7000")
+	require.Error(t, err)
+
+	_, err = parseSlots([]any{[]any{int64(0), int64(16384), []any{"a", int64(7000)}}}, "a:7000")
+	require.Error(t, err)
+
+	slots, err := parseSlots([]any{[]any{int64(0), int64(100), []any{"", int64(7000)}}}, "10.0.0.1:7000")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:7000", slots[100])
+	require.Equal(t, "", slots[101])
+}
+
+func TestClientSentinel(t *testing.T) {
+	master := "m1"
+	sentinel := &fakeServer{handle: func(args []string) any {
+		if args[0] == "SENTINEL" && args[2] == "mymaster" {
+			return []any{master, "6379"}
+		}
+		if args[0] == "AUTH" {
+			return "OK"
+		}
+		return nil
+	}}
+
+	m1 := dataServer(map[string]string{"alice": "hash-from-m1"})
+	m2 := dataServer(map[string]string{"alice": "hash-from-m2"})
+	servers := map[string]*fakeServer{"s2:26379": sentinel, "m1:6379": m1, "m2:6379": m2}
+
+	c, err := NewClient(ClientOptions{
+		Addrs:            []string{"s1:26379", "s2:26379"},
+		Mode:             Sentinel,
+		MasterName:       "mymaster",
+		SentinelPassword: "sentinel-secret",
+		Dial:             dialer(servers),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	reply, err := c.Do(context.Background(), "GET", "alice")
+	require.NoError(t, err)
+	require.Equal(t, "hash-from-m1", reply)
+	require.Equal(t, []string{"AUTH", "SENTINEL"}, sentinel.received())
+
+	// the master is remembered
+	_, err = c.Do(context.Background(), "GET", "alice")
+	require.NoError(t, err)
+	require.Len(t, sentinel.received(), 2)
+
+	// after a failover the old master is a read only replica
+	master = "m2"
+	m1.handle = func(args []string) any {
+		return Error("READONLY You can't write against a read only replica.")
+	}
+	_, err = c.Do(context.Background(), "GET", "alice")
+	require.Error(t, err)
+
+	reply, err = c.Do(context.Background(), "GET", "alice")
+	require.NoError(t, err)
+	require.Equal(t, "hash-from-m2", reply)
+
+	// unknown masters
+	c, err = NewClient(ClientOptions{
+		Addrs:      []string{"s2:26379"},
+		Mode:       Sentinel,
+		MasterName: "other",
+		Dial:       dialer(servers),
+	})
+	require.NoError(t, err)
+	_, err = c.Do(context.Background(), "GET", "alice")
+	require.Error(t, err)
+}
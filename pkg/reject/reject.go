@@ -0,0 +1,17 @@
+// Package reject returns the errors with which hooks reject the messages clients publish, as the server
+// only acknowledges a rejected message with its reason code if the error is one and the client expects it
+package reject
+
+import (
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Publish returns the error rejecting the publish from OnPublish, which is the reason code for MQTT 5
+// clients expecting an ack, and drops the message silently for the others
+func Publish(cl *mqtt.Client, pk packets.Packet, code packets.Code) error {
+	if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+		return code
+	}
+	return packets.ErrRejectPacket
+}
@@ -0,0 +1,35 @@
+package reject
+
+import (
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  byte
+		qos      byte
+		expected error
+	}{
+		{"v5 qos 1", 5, 1, packets.ErrQuotaExceeded},
+		{"v5 qos 2", 5, 2, packets.ErrQuotaExceeded},
+		{"v5 qos 0", 5, 0, packets.ErrRejectPacket},
+		{"v4 qos 1", 4, 1, packets.ErrRejectPacket},
+		{"v3 qos 0", 3, 0, packets.ErrRejectPacket},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &mqtt.Client{}
+			cl.Properties.ProtocolVersion = tt.version
+			pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: tt.qos}}
+			require.Equal(t, tt.expected, Publish(cl, pk, packets.ErrQuotaExceeded))
+
+		})
+	}
+}
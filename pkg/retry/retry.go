@@ -0,0 +1,171 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Policy configures how an operation is retried. The interval before each retry grows by Multiplier
+// from InitialInterval up to MaxInterval, and is randomized by Jitter so that clients which failed
+// together don't retry together
+type Policy struct {
+	// InitialInterval is the interval before the first retry, defaults to 100ms
+	InitialInterval time.Duration
+
+	// MaxInterval caps the interval between retries, defaults to 10s
+	MaxInterval time.Duration
+
+	// Multiplier is how much the interval grows after each retry, defaults to 2
+	Multiplier float64
+
+	// Jitter is the fraction by which each interval is randomly shortened or lengthened, eg. 0.2 gives
+	// intervals between 80% and 120% of the nominal interval. It is 0 by default, and capped at 1
+	Jitter float64
+
+	// MaxAttempts is how many times the operation is attempted, including the first, and
+	// MaxElapsed is how long it is retried for. 0 is unlimited, so the context should end the retries
+	// if neither is set
+	MaxAttempts int
+	MaxElapsed  time.Duration
+}
+
+// permanent is an error which isn't retried
+type permanent struct {
+	err error
+}
+
+func (p *permanent) Error() string {
+	return p.err.Error()
+}
+
+func (p *permanent) Unwrap() error {
+	return p.err
+}
+
+// Permanent marks the error as not worth retrying, eg. a rejected request, so Do returns it at once
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanent{err: err}
+}
+
+// IsPermanent returns whether the error was marked by Permanent
+func IsPermanent(err error) bool {
+	var p *permanent
+	return errors.As(err, &p)
+}
+
+// Backoff returns the intervals between the attempts of an operation
+type Backoff struct {
+	policy  Policy
+	next    time.Duration
+	attempt int
+	start   time.Time
+	now     func() time.Time
+	rand    func() float64
+}
+
+// NewBackoff returns the intervals of the policy, with its defaults applied
+func (p Policy) NewBackoff() *Backoff {
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = 100 * time.Millisecond
+	}
+
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = 10 * time.Second
+	}
+
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+
+	p.Jitter = min(max(p.Jitter, 0), 1)
+
+	b := &Backoff{
+		policy: p,
+		now:    time.Now,
+		rand:   rand.Float64,
+	}
+	b.Reset()
+	return b
+}
+
+// Reset starts the intervals again, eg. after the operation has succeeded
+func (b *Backoff) Reset() {
+	b.next = b.policy.InitialInterval
+	b.attempt = 1
+	b.start = b.now()
+}
+
+// Next returns the interval before the next attempt, and false if the policy doesn't allow another
+func (b *Backoff) Next() (time.Duration, bool) {
+	if b.policy.MaxAttempts > 0 && b.attempt >= b.policy.MaxAttempts {
+		return 0, false
+	}
+
+	d := b.next
+	if b.policy.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + b.policy.Jitter*(2*b.rand()-1)))
+	}
+
+	if b.policy.MaxElapsed > 0 && b.now().Add(d).Sub(b.start) > b.policy.MaxElapsed {
+		return 0, false
+	}
+
+	b.attempt++
+	b.next = min(time.Duration(float64(b.next)*b.policy.Multiplier), b.policy.MaxInterval)
+	return d, true
+}
+
+// Do calls fn until it succeeds, returns a permanent error, or the policy or context ends the
+// retries, returning the last error of fn
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	return p.do(ctx, fn, false)
+}
+
+// Forever calls fn like Do, but starts the intervals over from InitialInterval rather than giving up
+// once the attempts or time of the policy run out, so it only returns an error if fn returns a
+// permanent error, or the context ends the retries. It suits the loops of connectors which poll or
+// stay connected for as long as the broker runs
+func (p Policy) Forever(ctx context.Context, fn func(ctx context.Context) error) error {
+	return p.do(ctx, fn, true)
+}
+
+// do calls fn until it succeeds, starting the intervals over once they run out if forever is set
+func (p Policy) do(ctx context.Context, fn func(ctx context.Context) error, forever bool) error {
+	b := p.NewBackoff()
+	for {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+
+		var perm *permanent
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+
+		d, ok := b.Next()
+		if !ok {
+			if !forever {
+				return err
+			}
+
+			b.Reset()
+			if d, ok = b.Next(); !ok {
+				d = b.policy.InitialInterval // a single attempt, or less time than an interval
+			}
+		}
+
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
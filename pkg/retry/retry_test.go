@@ -0,0 +1,251 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		expected []time.Duration
+	}{
+		{
+			name:     "Success - defaults",
+			policy:   Policy{MaxAttempts: 4},
+			expected: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond},
+		},
+		{
+			name:     "Success - max interval",
+			policy:   Policy{InitialInterval: time.Second, MaxInterval: 3 * time.Second, Multiplier: 2, MaxAttempts: 5},
+			expected: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			name:     "Success - single attempt",
+			policy:   Policy{MaxAttempts: 1},
+			expected: nil,
+		},
+		{
+			name:     "Success - max elapsed",
+			policy:   Policy{InitialInterval: time.Second, Multiplier: 2, MaxElapsed: 5 * time.Second},
+			expected: []time.Duration{time.Second, 2 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			b := tt.policy.NewBackoff()
+			b.now = func() time.Time { return now }
+			b.Reset()
+
+			var got []time.Duration
+			for d, ok := b.Next(); ok; d, ok = b.Next() {
+				got = append(got, d)
+				now = now.Add(d)
+			}
+			require.Equal(t, tt.expected, got)
+
+		})
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := Policy{MaxAttempts: 2}.NewBackoff()
+	d, ok := b.Next()
+	require.True(t, ok)
+	require.Equal(t, 100*time.Millisecond, d)
+	_, ok = b.Next()
+	require.False(t, ok)
+
+	b.Reset()
+	d, ok = b.Next()
+	require.True(t, ok)
+	require.Equal(t, 100*time.Millisecond, d)
+}
+
+func TestJitter(t *testing.T) {
+	b := Policy{InitialInterval: time.Second, MaxInterval: time.Second, Jitter: 0.5}.NewBackoff()
+
+	b.rand = func() float64 { return 0 }
+	d, _ := b.Next()
+	require.Equal(t, 500*time.Millisecond, d)
+
+	b.rand = func() float64 { return 1 }
+	d, _ = b.Next()
+	require.Equal(t, 1500*time.Millisecond, d)
+
+	b.rand = func() float64 { return 0.5 }
+	d, _ = b.Next()
+	require.Equal(t, time.Second, d)
+
+	// jitter is capped, so intervals are never negative
+	b = Policy{Jitter: 3}.NewBackoff()
+	b.rand = func() float64 { return 0 }
+	d, _ = b.Next()
+	require.Zero(t, d)
+}
+
+func TestDo(t *testing.T) {
+	policy := Policy{InitialInterval: time.Millisecond, MaxAttempts: 3}
+	failure := errors.New("unavailable")
+
+	tests := []struct {
+		name     string
+		fails    int
+		err      error
+		attempts int
+		expected error
+	}{
+		{
+			name:     "Success - first attempt",
+			fails:    0,
+			attempts: 1,
+		},
+		{
+			name:     "Success - after retries",
+			fails:    2,
+			err:      failure,
+			attempts: 3,
+		},
+		{
+			name:     "Failure - attempts exhausted",
+			fails:    3,
+			err:      failure,
+			attempts: 3,
+			expected: failure,
+		},
+		{
+			name:     "Failure - permanent",
+			fails:    3,
+			err:      Permanent(failure),
+			attempts: 1,
+			expected: failure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			attempts := 0
+			err := policy.Do(context.Background(), func(ctx context.Context) error {
+				attempts++
+				if attempts <= tt.fails {
+					return tt.err
+				}
+				return nil
+			})
+			require.Equal(t, tt.expected, err)
+			require.Equal(t, tt.attempts, attempts)
+
+		})
+	}
+}
+
+func TestDoContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	failure := errors.New("unavailable")
+
+	attempts := 0
+	start := time.Now()
+	err := Policy{InitialInterval: time.Hour}.Do(ctx, func(ctx context.Context) error {
+		attempts++
+		cancel()
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, 1, attempts)
+	require.Less(t, time.Since(start), time.Minute)
+}
+
+func TestForever(t *testing.T) {
+	failure := errors.New("unavailable")
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		fails    int
+		err      error
+		attempts int
+		expected error
+	}{
+		{
+			name:     "Success - attempts start over",
+			policy:   Policy{InitialInterval: time.Millisecond, MaxAttempts: 2},
+			fails:    5,
+			err:      failure,
+			attempts: 6,
+		},
+		{
+			name:     "Success - single attempt",
+			policy:   Policy{InitialInterval: time.Millisecond, MaxAttempts: 1},
+			fails:    3,
+			err:      failure,
+			attempts: 4,
+		},
+		{
+			name:     "Success - elapsed starts over",
+			policy:   Policy{InitialInterval: time.Millisecond, MaxElapsed: time.Nanosecond},
+			fails:    3,
+			err:      failure,
+			attempts: 4,
+		},
+		{
+			name:     "Failure - permanent",
+			policy:   Policy{InitialInterval: time.Millisecond, MaxAttempts: 2},
+			fails:    5,
+			err:      Permanent(failure),
+			attempts: 1,
+			expected: failure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			attempts := 0
+			err := tt.policy.Forever(context.Background(), func(ctx context.Context) error {
+				attempts++
+				if attempts <= tt.fails {
+					return tt.err
+				}
+				return nil
+			})
+			require.Equal(t, tt.expected, err)
+			require.Equal(t, tt.attempts, attempts)
+
+		})
+	}
+}
+
+func TestForeverContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	failure := errors.New("unavailable")
+
+	attempts := 0
+	err := Policy{InitialInterval: time.Millisecond, MaxAttempts: 1}.Forever(ctx, func(ctx context.Context) error {
+		attempts++
+		if attempts == 3 {
+			cancel()
+		}
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, 3, attempts)
+}
+
+func TestPermanent(t *testing.T) {
+	require.Nil(t, Permanent(nil))
+
+	err := Permanent(context.Canceled)
+	require.True(t, IsPermanent(err))
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, context.Canceled.Error(), err.Error())
+	require.False(t, IsPermanent(context.Canceled))
+}
@@ -0,0 +1,155 @@
+package sqlauth
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/password"
+)
+
+// Hook authenticates clients against the users of a Store, and checks their topics against the rules
+// of their record. The hooks for SQL databases embed it, and only open the database in their Init
+type Hook struct {
+	config   Config
+	store    *Store
+	sessions acl.Sessions
+	mqtt.HookBase
+}
+
+// Config is the configuration the hook of a database sets up the Hook with
+type Config struct {
+	DB      *sql.DB // the database the queries are prepared on
+	CloseDB bool    // whether the database is closed by Stop, set if the hook opened it
+
+	Queries  Queries
+	Schemes  password.Schemes // verify the password hashes, defaults to password.Default
+	CacheTTL time.Duration    // how long users are cached, users are not cached if it is zero
+	Timeout  time.Duration    // how long a lookup may take, defaults to 5 seconds
+}
+
+// Setup prepares the queries on the database. If this fails, the database is closed if CloseDB is set
+func (h *Hook) Setup(config Config) error {
+	if config.Schemes == nil {
+		config.Schemes = password.Default
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+
+	store, err := New(ctx, config.DB, config.Queries, config.CacheTTL)
+	if err != nil {
+		if config.CloseDB {
+			config.DB.Close()
+		}
+		return err
+	}
+
+	h.config = config
+	h.store = store
+	return nil
+}
+
+// DB returns the database the hook was set up with
+func (h *Hook) DB() *sql.DB {
+	return h.config.DB
+}
+
+// Forget removes the user from the cache, so changes to it apply to its next connection
+func (h *Hook) Forget(username string) {
+	h.store.Forget(username)
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	if h.config.Queries.ACL == "" && h.config.Queries.Superuser == "" {
+		return b == mqtt.OnConnectAuthenticate
+	}
+
+	return bytes.Contains([]byte{
+		mqtt.OnACLCheck,
+		mqtt.OnConnectAuthenticate,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Stop closes the prepared statements, and the database if CloseDB is set
+func (h *Hook) Stop() error {
+	if h.store == nil {
+		return nil
+	}
+
+	err := h.store.Close()
+	if h.config.CloseDB {
+		err = errors.Join(err, h.config.DB.Close())
+	}
+	return err
+}
+
+// OnConnectAuthenticate is called when a client attempts to connect to the server
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	ok, err := h.Authenticate(cl, pk)
+	if err != nil {
+		h.Log.Error("error occurred while authenticating client", "error", err, "username", string(pk.Connect.Username))
+	}
+	return ok
+}
+
+// Authenticate authenticates the client, and returns an error if the database couldn't be asked, rather
+// than rejecting the client, eg. so the composite hook falls back to its next backend
+func (h *Hook) Authenticate(cl *mqtt.Client, pk packets.Packet) (bool, error) {
+	username := string(pk.Connect.Username)
+	if username == "" {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	record, err := h.store.Lookup(ctx, username)
+	if err != nil {
+		return false, fmt.Errorf("failed looking up user: %w", err)
+	}
+
+	if record.Password == "" {
+		return false, nil
+	}
+
+	match, err := h.config.Schemes.Verify(record.Password, string(pk.Connect.Password))
+	if err != nil {
+		// a hash which can't be verified is a rejection rather than a failure of the backend
+		h.Log.Error("error occurred while verifying password", "error", err, "username", username)
+		return false, nil
+	}
+
+	if !match {
+		return false, nil
+	}
+
+	// filters are only kept for the clients whose topics are checked, as OnDisconnect releases them
+	if h.config.Queries.ACL != "" || h.config.Queries.Superuser != "" {
+		h.sessions.Set(cl, record.Filters(username, cl.ID))
+	}
+	return true, nil
+}
+
+// OnACLCheck is called when a client attempts to publish or subscribe to a topic
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return h.sessions.Allowed(cl, topic, write)
+}
+
+// OnDisconnect is called when a client disconnects and releases the client's rendered filters
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.sessions.Delete(cl)
+}
@@ -0,0 +1,225 @@
+package sqlauth
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/password"
+)
+
+// testSchemes verify the hashes of newDriver, which are the password prefixed with hash-
+var testSchemes = password.Schemes{password.Func{
+	Prefixes: []string{"hash-"},
+	VerifyFunc: func(hash, pw string) (bool, error) {
+		return hash == "hash-"+pw, nil
+	},
+}}
+
+func newHook(t *testing.T, config Config) *Hook {
+	t.Helper()
+
+	var calls int
+	config.DB = newDriver(&calls).DB()
+	config.Schemes = testSchemes
+
+	sqlHook := new(Hook)
+	sqlHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, sqlHook.Setup(config))
+	t.Cleanup(func() { sqlHook.Stop() })
+	return sqlHook
+}
+
+func connectPacket(username, pw string) packets.Packet {
+	return packets.Packet{Connect: packets.ConnectParams{
+		Username: []byte(username),
+		Password: []byte(pw),
+	}}
+}
+
+func TestSetup(t *testing.T) {
+	var calls int
+	db := newDriver(&calls).DB()
+
+	sqlHook := new(Hook)
+	require.NoError(t, sqlHook.Setup(Config{DB: db, Queries: testQueries}))
+	require.Equal(t, db, sqlHook.DB())
+	require.NoError(t, sqlHook.Stop())
+	require.NoError(t, db.Ping())
+
+	sqlHook = new(Hook)
+	require.NoError(t, sqlHook.Setup(Config{DB: db, CloseDB: true, Queries: testQueries}))
+	require.NoError(t, sqlHook.Stop())
+	require.Error(t, db.Ping())
+
+	db = newDriver(&calls).DB()
+	require.Error(t, new(Hook).Setup(Config{DB: db, CloseDB: true, Queries: Queries{User: "SELECT nonsense"}}))
+	require.Error(t, db.Ping())
+}
+
+func TestHookProvides(t *testing.T) {
+	sqlHook := newHook(t, Config{Queries: testQueries})
+	require.True(t, sqlHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, sqlHook.Provides(mqtt.OnACLCheck))
+	require.True(t, sqlHook.Provides(mqtt.OnDisconnect))
+	require.False(t, sqlHook.Provides(mqtt.OnPublish))
+
+	sqlHook = newHook(t, Config{Queries: Queries{User: testQueries.User}})
+	require.True(t, sqlHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, sqlHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestHookAuthenticate(t *testing.T) {
+	sqlHook := newHook(t, Config{Queries: testQueries})
+
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		expectPass  bool
+		expectError bool
+	}{
+		{
+			name:       "Success",
+			username:   "bob",
+			password:   "bob",
+			expectPass: true,
+		},
+		{
+			name:       "Failure - wrong password",
+			username:   "bob",
+			password:   "alice",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - unknown user",
+			username:   "mallory",
+			password:   "mallory",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - no password",
+			username:   "dave",
+			password:   "",
+			expectPass: false,
+		},
+		{
+			name:        "Error - database",
+			username:    "error",
+			password:    "error",
+			expectPass:  false,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ok, err := sqlHook.Authenticate(&mqtt.Client{ID: "bob-1"}, connectPacket(tt.username, tt.password))
+			require.Equal(t, tt.expectPass, ok)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestHookAuthenticateWithoutACL(t *testing.T) {
+	sqlHook := newHook(t, Config{Queries: Queries{User: testQueries.User}})
+
+	// no filters are kept for clients whose topics are never checked
+	cl := &mqtt.Client{ID: "alice-1"}
+	require.True(t, sqlHook.OnConnectAuthenticate(cl, connectPacket("alice", "alice")))
+	_, ok := sqlHook.sessions.Get(cl)
+	require.False(t, ok)
+}
+
+func TestHookOnACLCheck(t *testing.T) {
+	sqlHook := newHook(t, Config{Queries: testQueries})
+
+	alice := &mqtt.Client{ID: "alice-1"}
+	require.True(t, sqlHook.OnConnectAuthenticate(alice, connectPacket("alice", "alice")))
+	bob := &mqtt.Client{ID: "bob-1"}
+	require.True(t, sqlHook.OnConnectAuthenticate(bob, connectPacket("bob", "bob")))
+
+	tests := []struct {
+		name       string
+		client     *mqtt.Client
+		topic      string
+		write      bool
+		expectPass bool
+	}{
+		{
+			name:       "Success - superuser",
+			client:     alice,
+			topic:      "users/bob/inbox",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Success - superuser $SYS",
+			client:     alice,
+			topic:      "$SYS/broker/clients/connected",
+			expectPass: true,
+		},
+		{
+			name:       "Success - rule",
+			client:     bob,
+			topic:      "users/bob/inbox",
+			write:      true,
+			expectPass: true,
+		},
+		{
+			name:       "Failure - $SYS",
+			client:     bob,
+			topic:      "$SYS/broker/clients/connected",
+			expectPass: false,
+		},
+		{
+			name:       "Failure - denied rule",
+			client:     bob,
+			topic:      "public/secret",
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			require.Equal(t, tt.expectPass, sqlHook.OnACLCheck(tt.client, tt.topic, tt.write))
+
+		})
+	}
+
+	sqlHook.OnDisconnect(bob, nil, true)
+	require.False(t, sqlHook.OnACLCheck(bob, "users/bob/inbox", false))
+}
+
+func TestHookForget(t *testing.T) {
+	var calls int
+	sqlHook := new(Hook)
+	sqlHook.Log = slog.Default()
+	require.NoError(t, sqlHook.Setup(Config{
+		DB:       newDriver(&calls).DB(),
+		Queries:  Queries{User: testQueries.User},
+		Schemes:  testSchemes,
+		CacheTTL: time.Minute,
+	}))
+	t.Cleanup(func() { sqlHook.Stop() })
+
+	require.True(t, sqlHook.OnConnectAuthenticate(&mqtt.Client{ID: "bob-1"}, connectPacket("bob", "bob")))
+	require.True(t, sqlHook.OnConnectAuthenticate(&mqtt.Client{ID: "bob-1"}, connectPacket("bob", "bob")))
+	require.Equal(t, 1, calls)
+
+	sqlHook.Forget("bob")
+	require.True(t, sqlHook.OnConnectAuthenticate(&mqtt.Client{ID: "bob-1"}, connectPacket("bob", "bob")))
+	require.Equal(t, 2, calls)
+}
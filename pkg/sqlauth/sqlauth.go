@@ -0,0 +1,219 @@
+// Package sqlauth looks up users and their ACL rules with SQL queries. It is shared by the hooks
+// for SQL databases, which supply the driver and the default queries of their database
+package sqlauth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// placeholders translates the mosquitto style substitutions to acl template placeholders
+var placeholders = strings.NewReplacer("%c", "{clientid}", "%u", "{username}")
+
+// Queries are the statements used to look up a user, each given the username as its only argument.
+// The placeholder syntax depends on the database, eg. $1 for PostgreSQL and ? for MySQL or SQLite
+type Queries struct {
+	// User selects the password hash of the user, eg. SELECT password_hash FROM mqtt_users WHERE
+	// username = $1. Users without a row cannot connect
+	User string
+
+	// Superuser selects a count, and the user may access every topic if it is positive, eg. SELECT
+	// COUNT(*) FROM mqtt_users WHERE username = $1 AND is_admin. Optional
+	Superuser string
+
+	// ACL selects the topic filter and access of each rule of the user, eg. SELECT topic, rw FROM
+	// mqtt_acls WHERE username = $1. The access is 0 (deny), 1 (read), 2 (write) or 3 (read and
+	// write) as in mosquitto-go-auth, or a string such as "r" or "rw". Filters may contain %u or
+	// {username} and %c or {clientid}. Optional
+	ACL string
+}
+
+// Record is what is known about a user
+type Record struct {
+	Password  string // the password hash, empty if the user does not exist
+	Superuser bool
+	ACL       acl.Templates
+}
+
+// Filters renders the rules of the user for the client. Superusers are granted every topic, including
+// the $SYS topics, which a leading # does not match
+func (r Record) Filters(username, clientID string) acl.Filters {
+	if r.Superuser {
+		return acl.Filters{"#": acl.ReadWrite, "$SYS/#": acl.ReadWrite}
+	}
+
+	return r.ACL.Render(map[string]string{
+		"clientid": clientID,
+		"username": username,
+	})
+}
+
+// Store looks up users with prepared statements, optionally caching the results
+type Store struct {
+	user      *sql.Stmt
+	superuser *sql.Stmt
+	acl       *sql.Stmt
+	cache     *cache.Cache[string, Record] // nil if records are not cached
+}
+
+// New prepares the queries on the database. Records are cached for ttl if it is positive, including
+// records of users which do not exist
+func New(ctx context.Context, db *sql.DB, queries Queries, ttl time.Duration) (*Store, error) {
+	if queries.User == "" {
+		return nil, errors.New("user query is required")
+	}
+
+	s := new(Store)
+	if ttl > 0 {
+		s.cache = cache.New[string, Record](cache.Options{TTL: ttl})
+	}
+
+	for _, q := range []struct {
+		query string
+		stmt  **sql.Stmt
+	}{
+		{queries.User, &s.user},
+		{queries.Superuser, &s.superuser},
+		{queries.ACL, &s.acl},
+	} {
+		if q.query == "" {
+			continue
+		}
+
+		stmt, err := db.PrepareContext(ctx, q.query)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("preparing %q: %w", q.query, err)
+		}
+		*q.stmt = stmt
+	}
+
+	return s, nil
+}
+
+// Close closes the prepared statements
+func (s *Store) Close() error {
+	var errs []error
+	for _, stmt := range []*sql.Stmt{s.user, s.superuser, s.acl} {
+		if stmt != nil {
+			errs = append(errs, stmt.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Lookup returns the record of the user, from the cache if possible
+func (s *Store) Lookup(ctx context.Context, username string) (Record, error) {
+	if s.cache != nil {
+		if record, ok := s.cache.Get(username); ok {
+			return record, nil
+		}
+	}
+
+	record, err := s.lookup(ctx, username)
+	if err != nil {
+		return Record{}, err
+	}
+
+	if s.cache != nil {
+		s.cache.Set(username, record)
+	}
+
+	return record, nil
+}
+
+// Forget removes the user from the cache, so changes to it apply to its next connection
+func (s *Store) Forget(username string) {
+	if s.cache != nil {
+		s.cache.Delete(username)
+	}
+}
+
+// lookup queries the record of the user
+func (s *Store) lookup(ctx context.Context, username string) (Record, error) {
+	var record Record
+
+	var hash sql.NullString
+	err := s.user.QueryRowContext(ctx, username).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return record, nil
+	}
+	if err != nil {
+		return record, err
+	}
+	record.Password = hash.String
+
+	if record.Password == "" {
+		return record, nil
+	}
+
+	if s.superuser != nil {
+		var count int64
+		if err := s.superuser.QueryRowContext(ctx, username).Scan(&count); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return record, err
+		}
+		record.Superuser = count > 0
+	}
+
+	if s.acl == nil || record.Superuser {
+		return record, nil
+	}
+
+	rows, err := s.acl.QueryContext(ctx, username)
+	if err != nil {
+		return record, err
+	}
+	defer rows.Close()
+
+	record.ACL = make(acl.Templates)
+	for rows.Next() {
+		var topic string
+		var access any
+		if err := rows.Scan(&topic, &access); err != nil {
+			return record, err
+		}
+
+		a, err := parseAccess(access)
+		if err != nil {
+			return record, fmt.Errorf("rule %q: %w", topic, err)
+		}
+
+		template := placeholders.Replace(topic)
+		if existing, ok := record.ACL[template]; ok {
+			merged := acl.Filters{template: existing}
+			merged.Merge(acl.Filters{template: a})
+			a = merged[template]
+		}
+		record.ACL[template] = a
+	}
+
+	return record, rows.Err()
+}
+
+// parseAccess converts the access column of a rule, which may be numeric or a string
+func parseAccess(v any) (acl.Access, error) {
+	switch v := v.(type) {
+	case int64:
+		if v < int64(acl.Deny) || v > int64(acl.ReadWrite) {
+			return acl.Deny, fmt.Errorf("unknown access %d", v)
+		}
+		return acl.Access(v), nil
+	case []byte:
+		return parseAccess(string(v))
+	case string:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return parseAccess(n)
+		}
+		return acl.ParseAccess(v)
+	}
+
+	return acl.Deny, fmt.Errorf("unknown access %v", v)
+}
@@ -0,0 +1,195 @@
+package sqlauth
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/sqlauth/sqlauthtest"
+)
+
+var testQueries = Queries{
+	User:      "SELECT password_hash FROM mqtt_users WHERE username = $1",
+	Superuser: "SELECT COUNT(*) FROM mqtt_users WHERE username = $1 AND is_admin",
+	ACL:       "SELECT topic, rw FROM mqtt_acls WHERE username = $1",
+}
+
+// newDriver returns a database with the users alice, an admin, bob and carol, whose rules are broken
+func newDriver(calls *int) *sqlauthtest.Driver {
+	return &sqlauthtest.Driver{
+		Queries: map[string]sqlauthtest.QueryFunc{
+			testQueries.User: func(args []driver.Value) ([][]driver.Value, error) {
+				*calls++
+				switch args[0] {
+				case "alice", "bob", "carol":
+					return [][]driver.Value{{"hash-" + args[0].(string)}}, nil
+				case "dave":
+					return [][]driver.Value{{nil}}, nil
+				case "error":
+					return nil, errors.New("connection reset")
+				}
+				return nil, nil
+			},
+			testQueries.Superuser: func(args []driver.Value) ([][]driver.Value, error) {
+				if args[0] == "alice" {
+					return [][]driver.Value{{int64(1)}}, nil
+				}
+				return [][]driver.Value{{int64(0)}}, nil
+			},
+			testQueries.ACL: func(args []driver.Value) ([][]driver.Value, error) {
+				switch args[0] {
+				case "bob":
+					return [][]driver.Value{
+						{"users/%u/#", int64(3)},
+						{"devices/%c/status", int64(2)},
+						{"devices/%c/status", "r"},
+						{"public/#", []byte("1")},
+						{"public/secret", int64(0)},
+					}, nil
+				case "carol":
+					return [][]driver.Value{{"public/#", int64(7)}}, nil
+				}
+				return nil, nil
+			},
+		},
+	}
+}
+
+func TestNew(t *testing.T) {
+	var calls int
+	d := newDriver(&calls)
+
+	store, err := New(context.Background(), d.DB(), testQueries, 0)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	require.Equal(t, 1, d.Prepared(testQueries.ACL))
+
+	_, err = New(context.Background(), d.DB(), Queries{User: testQueries.User}, 0)
+	require.NoError(t, err)
+
+	_, err = New(context.Background(), d.DB(), Queries{}, 0)
+	require.Error(t, err)
+
+	_, err = New(context.Background(), d.DB(), Queries{User: testQueries.User, ACL: "SELECT nonsense"}, 0)
+	require.Error(t, err)
+}
+
+func TestLookup(t *testing.T) {
+	var calls int
+	store, err := New(context.Background(), newDriver(&calls).DB(), testQueries, 0)
+	require.NoError(t, err)
+	defer store.Close()
+
+	tests := []struct {
+		name        string
+		username    string
+		expect      Record
+		expectError bool
+	}{
+		{
+			name:     "Success - superuser",
+			username: "alice",
+			expect:   Record{Password: "hash-alice", Superuser: true},
+		},
+		{
+			name:     "Success - rules",
+			username: "bob",
+			expect: Record{Password: "hash-bob", ACL: acl.Templates{
+				"users/{username}/#":        acl.ReadWrite,
+				"devices/{clientid}/status": acl.ReadWrite,
+				"public/#":                  acl.ReadOnly,
+				"public/secret":             acl.Deny,
+			}},
+		},
+		{
+			name:     "Success - unknown user",
+			username: "mallory",
+			expect:   Record{},
+		},
+		{
+			name:     "Success - null password",
+			username: "dave",
+			expect:   Record{},
+		},
+		{
+			name:        "Failure - unknown access",
+			username:    "carol",
+			expectError: true,
+		},
+		{
+			name:        "Failure - query error",
+			username:    "error",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			record, err := store.Lookup(context.Background(), tt.username)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, record)
+
+		})
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	var calls int
+	store, err := New(context.Background(), newDriver(&calls).DB(), testQueries, time.Minute)
+	require.NoError(t, err)
+	defer store.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := store.Lookup(context.Background(), "bob")
+		require.NoError(t, err)
+		_, err = store.Lookup(context.Background(), "mallory")
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, calls)
+
+	// errors are not cached
+	for i := 0; i < 2; i++ {
+		_, err := store.Lookup(context.Background(), "error")
+		require.Error(t, err)
+	}
+	require.Equal(t, 4, calls)
+
+	store.Forget("bob")
+	_, err = store.Lookup(context.Background(), "bob")
+	require.NoError(t, err)
+	require.Equal(t, 5, calls)
+
+	// expired entries are looked up again
+	store.cache.SetTTL("bob", Record{Password: "stale"}, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	record, err := store.Lookup(context.Background(), "bob")
+	require.NoError(t, err)
+	require.Equal(t, "hash-bob", record.Password)
+	require.Equal(t, 6, calls)
+}
+
+func TestRecordFilters(t *testing.T) {
+	record := Record{ACL: acl.Templates{
+		"users/{username}/#":        acl.ReadWrite,
+		"devices/{clientid}/status": acl.WriteOnly,
+	}}
+	require.Equal(t, acl.Filters{
+		"users/bob/#":          acl.ReadWrite,
+		"devices/bob-1/status": acl.WriteOnly,
+	}, record.Filters("bob", "bob-1"))
+
+	record.Superuser = true
+	filters := record.Filters("bob", "bob-1")
+	require.True(t, filters.Allowed("users/alice/inbox", true))
+	require.True(t, filters.Allowed("$SYS/broker/clients/connected", false))
+}
@@ -0,0 +1,149 @@
+// Package sqlauthtest provides a database/sql driver which answers queries with functions, for
+// testing the SQL auth hooks without a database
+package sqlauthtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// QueryFunc answers a query with rows, given its arguments
+type QueryFunc func(args []driver.Value) ([][]driver.Value, error)
+
+// Driver is a database which knows a fixed set of queries. Preparing any other query fails
+type Driver struct {
+	Queries map[string]QueryFunc
+
+	prepared map[string]int
+	mu       sync.Mutex
+}
+
+// DB returns a database using the driver
+func (d *Driver) DB() *sql.DB {
+	return sql.OpenDB(connector{d})
+}
+
+// Prepared returns how often the query was prepared
+func (d *Driver) Prepared(query string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.prepared[query]
+}
+
+// Open implements driver.Driver
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	return conn{d}, nil
+}
+
+type connector struct {
+	d *Driver
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return conn(c), nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return c.d
+}
+
+type conn struct {
+	d *Driver
+}
+
+func (c conn) Prepare(query string) (driver.Stmt, error) {
+	f, ok := c.d.Queries[query]
+	if !ok {
+		return nil, fmt.Errorf("unknown query %q", query)
+	}
+
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	if c.d.prepared == nil {
+		c.d.prepared = make(map[string]int)
+	}
+	c.d.prepared[query]++
+
+	return stmt{f}, nil
+}
+
+func (c conn) Close() error {
+	return nil
+}
+
+// Begin starts a transaction, whose statements are applied immediately as the driver has no state
+func (c conn) Begin() (driver.Tx, error) {
+	return tx{}, nil
+}
+
+type tx struct{}
+
+func (tx) Commit() error {
+	return nil
+}
+
+func (tx) Rollback() error {
+	return nil
+}
+
+type stmt struct {
+	f QueryFunc
+}
+
+func (s stmt) Close() error {
+	return nil
+}
+
+func (s stmt) NumInput() int {
+	return -1
+}
+
+func (s stmt) Exec(args []driver.Value) (driver.Result, error) {
+	values, err := s.f(args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(len(values)), nil
+}
+
+func (s stmt) Query(args []driver.Value) (driver.Rows, error) {
+	values, err := s.f(args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{values: values}, nil
+}
+
+type rows struct {
+	values [][]driver.Value
+	next   int
+}
+
+func (r *rows) Columns() []string {
+	if len(r.values) == 0 {
+		return nil
+	}
+
+	columns := make([]string, len(r.values[0]))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("column%d", i)
+	}
+	return columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,195 @@
+// Package transform rewrites the payloads of the messages bridge hooks forward with Go templates, eg.
+// to wrap them in an envelope with their topic, client id and timestamp:
+//
+//	{"topic":{{json .Topic}},"device":{{json (index .Levels 1)}},"reading":{{.JSON | path "value" | json}}}
+//
+// Templates are executed with a Message, and may call the functions
+//
+//	json    the JSON encoding of a value, eg. {{json .Topic}}
+//	path    the field of a decoded JSON value at a path of keys and array indexes joined by dots, or
+//	        nil if it has none, eg. {{.JSON | path "readings.0.value"}}
+//	base64  the standard base64 encoding of a string, eg. {{base64 .Payload}}
+//
+// besides those of text/template.
+package transform
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Envelope wraps the payload in a JSON object with the topic and QoS of the message, the id of the
+// publishing client and the time it was transformed at, in unix milliseconds. The payload is
+// embedded as JSON if it is valid JSON, and as a string otherwise
+const Envelope = `{"topic":{{json .Topic}},"client_id":{{json .Client}},"qos":{{.Qos}},"timestamp":{{.Timestamp.UnixMilli}},"payload":{{json .Value}}}`
+
+// funcs are the functions templates may call
+var funcs = template.FuncMap{
+	"json":   encodeJSON,
+	"path":   path,
+	"base64": encodeBase64,
+}
+
+// Message is the message a template is executed with
+type Message struct {
+	Topic       string
+	Levels      []string // the levels of the topic
+	Client      string   // the id of the publishing client
+	Username    string
+	Qos         byte
+	Retain      bool
+	ContentType string
+	User        map[string]string // the user properties of the message
+	Payload     string
+	Timestamp   time.Time // when the message was transformed
+
+	decoded bool
+	json    any
+}
+
+// JSON returns the decoded JSON payload, whose numbers are json.Number, or nil if the payload isn't
+// valid JSON
+func (m *Message) JSON() any {
+	if !m.decoded {
+		m.decoded = true
+		dec := json.NewDecoder(strings.NewReader(m.Payload))
+		dec.UseNumber()
+		if err := dec.Decode(&m.json); err != nil || dec.More() {
+			m.json = nil
+		}
+	}
+	return m.json
+}
+
+// Value returns the decoded JSON payload, or the payload as a string if it isn't valid JSON
+func (m *Message) Value() any {
+	if v := m.JSON(); v != nil {
+		return v
+	}
+	return m.Payload
+}
+
+// Template is a compiled payload template
+type Template struct {
+	src  string
+	tmpl *template.Template
+}
+
+// Compile parses the template. An empty template compiles to nil, which leaves payloads unchanged
+func Compile(src string) (*Template, error) {
+	if src == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("transform").Funcs(funcs).Option("missingkey=zero").Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transform: %w", err)
+	}
+	return &Template{src: src, tmpl: tmpl}, nil
+}
+
+// MustCompile is like Compile, but panics if the template is invalid
+func MustCompile(src string) *Template {
+	t, err := Compile(src)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the source of the template
+func (t *Template) String() string {
+	if t == nil {
+		return ""
+	}
+	return t.src
+}
+
+// Execute returns the payload of the message published by the client, transformed by the template
+func (t *Template) Execute(cl *mqtt.Client, pk packets.Packet) ([]byte, error) {
+	if t == nil {
+		return pk.Payload, nil
+	}
+
+	m := &Message{
+		Topic:       pk.TopicName,
+		Levels:      strings.Split(pk.TopicName, "/"),
+		Client:      cl.ID,
+		Username:    string(cl.Properties.Username),
+		Qos:         pk.FixedHeader.Qos,
+		Retain:      pk.FixedHeader.Retain,
+		ContentType: pk.Properties.ContentType,
+		Payload:     string(pk.Payload),
+		Timestamp:   time.Now(),
+	}
+
+	if len(pk.Properties.User) > 0 {
+		m.User = make(map[string]string, len(pk.Properties.User))
+		for _, p := range pk.Properties.User {
+			m.User[p.Key] = p.Val
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, m); err != nil {
+		return nil, fmt.Errorf("failed to transform payload: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Apply returns the message published by the client with its payload transformed by the template
+func (t *Template) Apply(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	payload, err := t.Execute(cl, pk)
+	if err != nil {
+		return pk, err
+	}
+
+	pk.Payload = payload
+	return pk, nil
+}
+
+// encodeJSON returns the JSON encoding of the value
+func encodeJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// encodeBase64 returns the standard base64 encoding of the string
+func encodeBase64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// path returns the field of the decoded JSON value at the path, or nil if it has none
+func path(p string, v any) any {
+	if p == "" {
+		return v
+	}
+
+	for _, key := range strings.Split(p, ".") {
+		switch val := v.(type) {
+		case map[string]any:
+			v = val[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(val) {
+				return nil
+			}
+			v = val[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
@@ -0,0 +1,132 @@
+package transform
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name        string
+		src         string
+		expectError bool
+	}{
+		{
+			name:        "Success - template",
+			src:         `{{.Topic}}`,
+			expectError: false,
+		},
+		{
+			name:        "Success - envelope",
+			src:         Envelope,
+			expectError: false,
+		},
+		{
+			name:        "Success - empty",
+			src:         ``,
+			expectError: false,
+		},
+		{
+			name:        "Failure - unterminated action",
+			src:         `{{.Topic`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown function",
+			src:         `{{yaml .Topic}}`,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Compile(tt.src)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.src, tmpl.String())
+		})
+	}
+}
+
+func TestExecute(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.Username = []byte("alice")
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "sensors/d1/readings",
+		Payload:     []byte(`{"temperature":31.50,"readings":[{"value":4}]}`),
+		Properties: packets.Properties{
+			ContentType: "application/json",
+			User:        []packets.UserProperty{{Key: "site", Val: "north"}},
+		},
+	}
+
+	tests := []struct {
+		src    string
+		expect string
+	}{
+		{`{{.Topic}} {{index .Levels 1}} {{.Client}} {{.Username}}`, `sensors/d1/readings d1 c1 alice`},
+		{`{{.Qos}} {{.Retain}} {{.ContentType}} {{.User.site}} {{.User.missing}}`, `1 true application/json north `},
+		{`{{.JSON.temperature}}`, `31.50`},
+		{`{{.JSON | path "readings.0.value" | json}}`, `4`},
+		{`{{.JSON | path "readings.1.value" | json}}`, `null`},
+		{`{"t":{{json .Topic}},"p":{{.Payload}}}`, `{"t":"sensors/d1/readings","p":{"temperature":31.50,"readings":[{"value":4}]}}`},
+		{`{{base64 .Topic}}`, `c2Vuc29ycy9kMS9yZWFkaW5ncw==`},
+		{`{{if gt (len .Payload) 10}}long{{end}}`, `long`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			payload, err := MustCompile(tt.src).Execute(cl, pk)
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, string(payload))
+		})
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+
+	var envelope struct {
+		Topic     string `json:"topic"`
+		ClientID  string `json:"client_id"`
+		Qos       byte   `json:"qos"`
+		Timestamp int64  `json:"timestamp"`
+		Payload   any    `json:"payload"`
+	}
+
+	pk, err := MustCompile(Envelope).Apply(cl, packets.Packet{TopicName: "a/b", Payload: []byte(`{"on":true}`)})
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(pk.Payload, &envelope))
+	require.Equal(t, "a/b", envelope.Topic)
+	require.Equal(t, "c1", envelope.ClientID)
+	require.Equal(t, map[string]any{"on": true}, envelope.Payload)
+	require.InDelta(t, time.Now().UnixMilli(), envelope.Timestamp, 1000)
+
+	// payloads which aren't JSON are embedded as strings
+	pk, err = MustCompile(Envelope).Apply(cl, packets.Packet{TopicName: "a/b", Payload: []byte("21.5 C")})
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(pk.Payload, &envelope))
+	require.Equal(t, "21.5 C", envelope.Payload)
+}
+
+func TestExecuteNil(t *testing.T) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+
+	var tmpl *Template
+	payload, err := tmpl.Execute(cl, packets.Packet{Payload: []byte("raw")})
+	require.NoError(t, err)
+	require.Equal(t, "raw", string(payload))
+
+	_, err = MustCompile(`{{index .Levels 5}}`).Execute(cl, packets.Packet{TopicName: "a"})
+	require.Error(t, err)
+}
@@ -0,0 +1,157 @@
+package clientid
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Action is what happens to a client whose id doesn't conform to the policy
+type Action int
+
+const (
+	Reject Action = iota // reject the connection
+	Assign               // assign the client a new id which conforms
+)
+
+// Hook is a hook that checks the client ids of connecting clients against a pattern, a prefix derived
+// from their username and a max length, so that the clients of different tenants cannot collide
+type Hook struct {
+	config Options
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the clientid hook
+type Options struct {
+	// Pattern is a regular expression which client ids must match, eg. ^[a-z0-9-]+$
+	Pattern *regexp.Regexp
+
+	// Prefix is a prefix which client ids must start with, in which {username} is replaced with the
+	// username of the client, eg. {username}/. Clients without a username are rejected if the prefix
+	// contains {username}
+	Prefix string
+
+	// MaxLength is the longest client id in bytes, and 0 is unlimited
+	MaxLength int
+
+	// Action is what happens to clients whose id doesn't conform. Assigned ids are the prefix followed
+	// by random characters, and are sent to v5 clients as their assigned client identifier. v3 clients
+	// are not told their assigned id, so cannot resume their session. Clients which connect without an
+	// id are always assigned one which conforms
+	Action Action
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "clientid-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	clientidHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if clientidHookConfig.Pattern == nil && clientidHookConfig.Prefix == "" && clientidHookConfig.MaxLength <= 0 {
+		return errors.New("pattern, prefix or max length is required")
+	}
+
+	if clientidHookConfig.Action != Reject && clientidHookConfig.Action != Assign {
+		return errors.New("unsupported action")
+	}
+
+	h.config = clientidHookConfig
+	return nil
+}
+
+// prefix returns the prefix of the client's id, and false if it has none because it has no username
+func (h *Hook) prefix(cl *mqtt.Client) (string, bool) {
+	if !strings.Contains(h.config.Prefix, "{username}") {
+		return h.config.Prefix, true
+	}
+
+	username := string(cl.Properties.Username)
+	if username == "" {
+		return "", false
+	}
+
+	return strings.ReplaceAll(h.config.Prefix, "{username}", username), true
+}
+
+// conforms returns whether the id conforms to the policy
+func (h *Hook) conforms(id, prefix string) bool {
+	if h.config.MaxLength > 0 && len(id) > h.config.MaxLength {
+		return false
+	}
+
+	if !strings.HasPrefix(id, prefix) {
+		return false
+	}
+
+	return h.config.Pattern == nil || h.config.Pattern.MatchString(id)
+}
+
+// assign returns a new random id with the prefix
+func assign(prefix string) (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// OnConnect is called when a client connects, and rejects it or assigns it a new id if its id doesn't
+// conform to the policy
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	prefix, ok := h.prefix(cl)
+	if !ok {
+		h.Log.Info("rejecting client without username", "client", cl.ID)
+		return packets.ErrClientIdentifierNotValid
+	}
+
+	if h.conforms(cl.ID, prefix) {
+		return nil
+	}
+
+	// ids assigned by the server may be replaced, as the client doesn't know them yet
+	assigned := cl.Properties.Props.AssignedClientID != ""
+	if !assigned && h.config.Action == Reject {
+		h.Log.Info("rejecting client with nonconforming id", "client", cl.ID)
+		return packets.ErrClientIdentifierNotValid
+	}
+
+	id, err := assign(prefix)
+	if err != nil {
+		h.Log.Error("error occurred while assigning client id", "error", err, "client", cl.ID)
+		return packets.ErrClientIdentifierNotValid
+	}
+
+	if !h.conforms(id, prefix) {
+		h.Log.Info("rejecting client as no conforming id can be assigned", "client", cl.ID, "assigned", id)
+		return packets.ErrClientIdentifierNotValid
+	}
+
+	h.Log.Debug("assigning client id", "client", cl.ID, "assigned", id)
+	cl.ID = id
+	cl.Properties.Props.AssignedClientID = id // only sent to v5 clients
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package clientid
+
+import (
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	clientidHook := new(Hook)
+	clientidHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, clientidHook.Init(options))
+	return clientidHook
+}
+
+func TestID(t *testing.T) {
+	clientidHook := new(Hook)
+
+	require.Equal(t, "clientid-policy-hook", clientidHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	clientidHook := new(Hook)
+	require.True(t, clientidHook.Provides(mqtt.OnConnect))
+	require.False(t, clientidHook.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - pattern",
+			config:      Options{Pattern: regexp.MustCompile(`^[a-z]+$`)},
+			expectError: false,
+		},
+		{
+			name:        "Success - prefix with assign",
+			config:      Options{Prefix: "{username}/", Action: Assign},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no policy",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unsupported action",
+			config:      Options{MaxLength: 10, Action: 7},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			clientidHook := new(Hook)
+			clientidHook.Log = slog.Default()
+			err := clientidHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      Options
+		id           string
+		username     string
+		version      byte
+		serverAssign bool
+		expectPrefix string // the prefix of an assigned id
+		expectError  bool
+	}{
+		{
+			name:     "Success - prefix",
+			options:  Options{Prefix: "{username}/"},
+			id:       "acme/sensor-1",
+			username: "acme",
+		},
+		{
+			name:    "Success - pattern and max length",
+			options: Options{Pattern: regexp.MustCompile(`^[a-z0-9-]+$`), MaxLength: 8},
+			id:      "sensor-1",
+		},
+		{
+			name:         "Success - assign",
+			options:      Options{Prefix: "{username}/", Action: Assign},
+			id:           "globex/sensor-1",
+			username:     "acme",
+			version:      5,
+			expectPrefix: "acme/",
+		},
+		{
+			name:         "Success - assign v3",
+			options:      Options{Prefix: "{username}/", Action: Assign},
+			id:           "sensor-1",
+			username:     "acme",
+			version:      4,
+			expectPrefix: "acme/",
+		},
+		{
+			name:         "Success - server assigned id is replaced",
+			options:      Options{Prefix: "dev-"},
+			id:           "cnqk1j3g1r2lv4pv0bd0",
+			serverAssign: true,
+			version:      5,
+			expectPrefix: "dev-",
+		},
+		{
+			name:        "Failure - wrong prefix",
+			options:     Options{Prefix: "{username}/"},
+			id:          "globex/sensor-1",
+			username:    "acme",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no username",
+			options:     Options{Prefix: "{username}/", Action: Assign},
+			id:          "/sensor-1",
+			expectError: true,
+		},
+		{
+			name:        "Failure - pattern",
+			options:     Options{Pattern: regexp.MustCompile(`^[a-z0-9-]+$`)},
+			id:          "Sensor 1",
+			expectError: true,
+		},
+		{
+			name:        "Failure - max length",
+			options:     Options{MaxLength: 8},
+			id:          "sensor-10",
+			expectError: true,
+		},
+		{
+			name:        "Failure - assigned id doesn't conform",
+			options:     Options{MaxLength: 8, Action: Assign},
+			id:          "sensor-10",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			clientidHook := newHook(t, tt.options)
+			cl := &mqtt.Client{ID: tt.id}
+			cl.Properties.Username = []byte(tt.username)
+			cl.Properties.ProtocolVersion = tt.version
+			if tt.serverAssign {
+				cl.Properties.Props.AssignedClientID = tt.id
+			}
+
+			err := clientidHook.OnConnect(cl, packets.Packet{})
+			if tt.expectError {
+				require.ErrorIs(t, err, packets.ErrClientIdentifierNotValid)
+				return
+			}
+			require.NoError(t, err)
+
+			if tt.expectPrefix == "" {
+				require.Equal(t, tt.id, cl.ID)
+				require.Empty(t, cl.Properties.Props.AssignedClientID)
+				return
+			}
+			require.True(t, strings.HasPrefix(cl.ID, tt.expectPrefix))
+			require.Len(t, cl.ID, len(tt.expectPrefix)+20)
+			require.Equal(t, cl.ID, cl.Properties.Props.AssignedClientID)
+
+		})
+	}
+}
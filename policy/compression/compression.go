@@ -0,0 +1,336 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// the encodings of compressed payloads
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// suffixes are the encodings of the suffixes of the topics of compressed payloads
+var suffixes = map[string]string{
+	".gz":  Gzip,
+	".zst": Zstd,
+}
+
+// errTooLarge is returned for payloads which decompress to more than the largest size
+var errTooLarge = errors.New("decompressed payload exceeds the maximum size")
+
+// Stats are the totals of the payloads handled since the hook was initialized
+type Stats struct {
+	Decompressed int64 // the number of payloads decompressed
+	Rejected     int64 // the number of messages rejected as their payloads could not be decompressed
+	Compressed   int64 // the number of payloads compressed for subscribers
+}
+
+// Hook is a hook that decompresses the compressed payloads of published messages, and compresses large
+// payloads for subscribers which accept them
+type Hook struct {
+	config  Options
+	zstd    *zstd.Decoder
+	writers sync.Pool
+	stats   Stats
+	mu      sync.Mutex // guards stats
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the compression hook
+type Options struct {
+	// Property is the user property naming the encoding of compressed payloads, gzip or zstd, and
+	// defaults to content-encoding. It is removed from the messages once decompressed
+	Property string
+
+	// Suffix decompresses the payloads of topics ending with .gz or .zst, and removes the suffix, eg.
+	// sensors/1/batch.gz is published to sensors/1/batch
+	Suffix bool
+
+	// Auth is the auth hook clients are checked against to publish to topics without their suffix, as
+	// the server only checks they may publish to the topic with it. Clients which may publish to a topic
+	// with a suffix may publish to it without one if nil
+	Auth mqtt.Hook
+
+	// MaxSize is the largest size of decompressed payloads, and defaults to 1MB. Messages whose payloads
+	// decompress to more are rejected, with quota exceeded for MQTT 5 clients
+	MaxSize int
+
+	// MinSize is the smallest size of the payloads compressed with gzip for MQTT 5 subscribers which
+	// accept it, with the Accept user property of their CONNECT packet. Payloads aren't compressed if 0
+	MinSize int
+
+	// Accept is the user property of the CONNECT packets of subscribers accepting compressed payloads,
+	// eg. accept-encoding: gzip, and defaults to accept-encoding
+	Accept string
+
+	// Level is the gzip compression level, eg. gzip.BestSpeed, and defaults to gzip.DefaultCompression
+	// if nil
+	Level *int
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "compression-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+		mqtt.OnPacketEncode,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	compressionHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if compressionHookConfig.Property == "" {
+		compressionHookConfig.Property = "content-encoding"
+	}
+
+	if compressionHookConfig.Accept == "" {
+		compressionHookConfig.Accept = "accept-encoding"
+	}
+
+	if compressionHookConfig.MaxSize == 0 {
+		compressionHookConfig.MaxSize = 1 << 20
+	}
+
+	if compressionHookConfig.MaxSize < 0 || compressionHookConfig.MinSize < 0 {
+		return errors.New("sizes must not be negative")
+	}
+
+	level := gzip.DefaultCompression
+	if compressionHookConfig.Level != nil {
+		level = *compressionHookConfig.Level
+	}
+
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return fmt.Errorf("invalid gzip level %d", level)
+	}
+
+	decoder, err := newZstdDecoder(compressionHookConfig.MaxSize)
+	if err != nil {
+		return err
+	}
+
+	h.config = compressionHookConfig
+	h.zstd = decoder
+	h.writers.New = func() any {
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	}
+
+	return nil
+}
+
+// Stop releases the zstd decoder
+func (h *Hook) Stop() error {
+	if h.zstd != nil {
+		h.zstd.Close()
+	}
+	return nil
+}
+
+// Stats returns the totals of the payloads handled so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// OnPublish is called when a client publishes a message, and decompresses its payload if it's flagged
+// as compressed by the user property or the suffix of its topic, so it's retained and forwarded
+// decompressed. Messages whose payloads cannot be decompressed are rejected
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	encoding, topic, property := h.encoding(pk)
+	if encoding == "" {
+		return pk, nil
+	}
+
+	if topic != pk.TopicName && (topic == "" || !mqtt.IsValidFilter(topic, true)) {
+		h.Log.Debug("rejecting compressed message", "error", "invalid topic", "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Rejected++ })
+		return pk, reject.Publish(cl, pk, packets.ErrTopicNameInvalid)
+	}
+
+	if topic != pk.TopicName && h.config.Auth != nil && !cl.Net.Inline && !h.config.Auth.OnACLCheck(cl, topic, true) {
+		h.Log.Debug("rejecting compressed message", "error", "not authorized", "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Rejected++ })
+		return pk, reject.Publish(cl, pk, packets.ErrNotAuthorized)
+	}
+
+	// empty messages, which clear retained messages, aren't compressed
+	if len(pk.Payload) > 0 {
+		payload, err := h.decompress(encoding, pk.Payload)
+		if err != nil {
+			h.Log.Debug("rejecting compressed message", "error", err, "client", cl.ID, "topic", pk.TopicName, "encoding", encoding)
+			h.count(func(s *Stats) { s.Rejected++ })
+			if errors.Is(err, errTooLarge) {
+				return pk, reject.Publish(cl, pk, packets.ErrQuotaExceeded)
+			}
+			return pk, reject.Publish(cl, pk, packets.ErrPayloadFormatInvalid)
+		}
+		pk.Payload = payload
+		h.count(func(s *Stats) { s.Decompressed++ })
+	}
+
+	pk.TopicName = topic
+	if property >= 0 {
+		user := make([]packets.UserProperty, 0, len(pk.Properties.User)-1)
+		user = append(user, pk.Properties.User[:property]...)
+		pk.Properties.User = append(user, pk.Properties.User[property+1:]...)
+	}
+
+	return pk, nil
+}
+
+// encoding returns the encoding of the payload of the message, or none if it isn't flagged as
+// compressed, the topic it's published to, and the index of its encoding user property, or -1 if it
+// was flagged by the suffix of its topic
+func (h *Hook) encoding(pk packets.Packet) (string, string, int) {
+	for i, p := range pk.Properties.User {
+		if p.Key != h.config.Property {
+			continue
+		}
+
+		for _, encoding := range []string{Gzip, Zstd} {
+			if strings.EqualFold(p.Val, encoding) {
+				return encoding, pk.TopicName, i
+			}
+		}
+		return "", pk.TopicName, -1
+	}
+
+	if h.config.Suffix {
+		for suffix, encoding := range suffixes {
+			if topic, ok := strings.CutSuffix(pk.TopicName, suffix); ok {
+				return encoding, topic, -1
+			}
+		}
+	}
+
+	return "", pk.TopicName, -1
+}
+
+// decompress returns the payload in the encoding decompressed, if it doesn't exceed MaxSize bytes
+func (h *Hook) decompress(encoding string, payload []byte) ([]byte, error) {
+	max := h.config.MaxSize
+	if encoding == Zstd {
+		return zstdDecompress(h.zstd, payload, max)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) > max {
+		return nil, errTooLarge
+	}
+	return out, nil
+}
+
+// OnPacketEncode is called before a packet is sent to a client, and compresses the payload of messages
+// of at least MinSize with gzip if the client accepts it, unless they are already compressed or would
+// not be smaller
+func (h *Hook) OnPacketEncode(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	if h.config.MinSize == 0 ||
+		pk.FixedHeader.Type != packets.Publish ||
+		len(pk.Payload) < h.config.MinSize ||
+		cl.Properties.ProtocolVersion != 5 ||
+		!h.accepts(cl) {
+		return pk
+	}
+
+	for _, p := range pk.Properties.User {
+		if p.Key == h.config.Property {
+			return pk
+		}
+	}
+
+	payload, err := h.compress(pk.Payload)
+	if err != nil {
+		h.Log.Warn("payload could not be compressed", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		return pk
+	}
+
+	if len(payload) >= len(pk.Payload) {
+		return pk
+	}
+
+	// the payload is no longer utf-8, so its format is unspecified
+	pk.Payload = payload
+	pk.Properties.PayloadFormat = 0
+	user := make([]packets.UserProperty, 0, len(pk.Properties.User)+1)
+	user = append(user, pk.Properties.User...)
+	pk.Properties.User = append(user, packets.UserProperty{Key: h.config.Property, Val: Gzip})
+
+	h.count(func(s *Stats) { s.Compressed++ })
+	return pk
+}
+
+// accepts returns whether the client accepts payloads compressed with gzip
+func (h *Hook) accepts(cl *mqtt.Client) bool {
+	for _, p := range cl.Properties.Props.User {
+		if !strings.EqualFold(p.Key, h.config.Accept) {
+			continue
+		}
+
+		for _, encoding := range strings.Split(p.Val, ",") {
+			if strings.EqualFold(strings.TrimSpace(encoding), Gzip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compress returns the payload compressed with gzip
+func (h *Hook) compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := h.writers.Get().(*gzip.Writer)
+	defer h.writers.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update(&h.stats)
+}
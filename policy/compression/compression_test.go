@@ -0,0 +1,446 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// denyHook is an auth hook which denies publishing to secret/#
+type denyHook struct {
+	mqtt.HookBase
+}
+
+func (h *denyHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return !strings.HasPrefix(topic, "secret/")
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	compressionHook := new(Hook)
+	compressionHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, compressionHook.Init(options))
+	t.Cleanup(func() { compressionHook.Stop() })
+	return compressionHook
+}
+
+func newClient(version byte, accept string) *mqtt.Client {
+	cl := &mqtt.Client{ID: "a"}
+	cl.Properties.ProtocolVersion = version
+	if accept != "" {
+		cl.Properties.Props.User = []packets.UserProperty{{Key: "accept-encoding", Val: accept}}
+	}
+	return cl
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func gunzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return out
+}
+
+func level(l int) *int {
+	return &l
+}
+
+func TestID(t *testing.T) {
+	compressionHook := new(Hook)
+
+	require.Equal(t, "compression-policy-hook", compressionHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	compressionHook := new(Hook)
+	require.True(t, compressionHook.Provides(mqtt.OnPublish))
+	require.True(t, compressionHook.Provides(mqtt.OnPacketEncode))
+	require.False(t, compressionHook.Provides(mqtt.OnConnect))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - defaults",
+			config:      Options{},
+			expectError: false,
+		},
+		{
+			name:        "Success - compression",
+			config:      Options{Suffix: true, MinSize: 1024, Level: level(gzip.BestSpeed)},
+			expectError: false,
+		},
+		{
+			name:        "Success - no compression",
+			config:      Options{MinSize: 1024, Level: level(gzip.NoCompression)},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - negative size",
+			config:      Options{MinSize: -1},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid level",
+			config:      Options{Level: level(10)},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			compressionHook := new(Hook)
+			compressionHook.Log = slog.Default()
+			err := compressionHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "content-encoding", compressionHook.config.Property)
+			require.Equal(t, 1<<20, compressionHook.config.MaxSize)
+			require.NoError(t, compressionHook.Stop())
+
+		})
+	}
+}
+
+func TestOnPublish(t *testing.T) {
+	compressionHook := newHook(t, Options{Suffix: true, Auth: new(denyHook), MaxSize: len(readings())})
+	zstd := decodeVector(t, zstdLevel19)
+	gz := gzipped(t, readings())
+
+	tests := []struct {
+		name     string
+		version  byte
+		topic    string
+		qos      byte
+		encoding string
+		payload  []byte
+		expect   error
+		topicOut string
+		want     []byte
+	}{
+		{
+			name:     "Success - uncompressed",
+			version:  5,
+			topic:    "sensors/a",
+			payload:  []byte("reading"),
+			topicOut: "sensors/a",
+			want:     []byte("reading"),
+		},
+		{
+			name:     "Success - gzip property",
+			version:  5,
+			topic:    "sensors/a",
+			encoding: "gzip",
+			payload:  gz,
+			topicOut: "sensors/a",
+			want:     readings(),
+		},
+		{
+			name:     "Success - zstd property",
+			version:  5,
+			topic:    "sensors/a",
+			encoding: "ZSTD",
+			payload:  zstd,
+			topicOut: "sensors/a",
+			want:     readings(),
+		},
+		{
+			name:     "Success - unknown encoding",
+			version:  5,
+			topic:    "sensors/a.gz",
+			encoding: "identity",
+			payload:  []byte("reading"),
+			topicOut: "sensors/a.gz",
+			want:     []byte("reading"),
+		},
+		{
+			name:     "Success - gzip suffix",
+			version:  4,
+			topic:    "sensors/a.gz",
+			payload:  gz,
+			topicOut: "sensors/a",
+			want:     readings(),
+		},
+		{
+			name:     "Success - zstd suffix",
+			version:  4,
+			topic:    "sensors/a.zst",
+			payload:  zstd,
+			topicOut: "sensors/a",
+			want:     readings(),
+		},
+		{
+			name:     "Success - clearing retained",
+			version:  5,
+			topic:    "sensors/a.gz",
+			topicOut: "sensors/a",
+			want:     []byte{},
+		},
+		{
+			name:    "Failure - invalid payload",
+			version: 5,
+			topic:   "sensors/a.gz",
+			qos:     1,
+			payload: []byte("reading"),
+			expect:  packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:     "Failure - invalid zstd payload",
+			version:  5,
+			topic:    "sensors/a",
+			qos:      1,
+			encoding: "zstd",
+			payload:  gz,
+			expect:   packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:    "Failure - invalid payload v3",
+			version: 4,
+			topic:   "sensors/a.zst",
+			qos:     1,
+			payload: gz,
+			expect:  packets.ErrRejectPacket,
+		},
+		{
+			name:    "Failure - too large",
+			version: 5,
+			topic:   "sensors/a.gz",
+			qos:     1,
+			payload: gzipped(t, append(readings(), 'x')),
+			expect:  packets.ErrQuotaExceeded,
+		},
+		{
+			name:    "Failure - zstd too large",
+			version: 5,
+			topic:   "sensors/a.zst",
+			qos:     2,
+			payload: append(zstd, zstd...),
+			expect:  packets.ErrQuotaExceeded,
+		},
+		{
+			name:    "Failure - not authorized",
+			version: 5,
+			topic:   "secret/a.gz",
+			qos:     1,
+			payload: gz,
+			expect:  packets.ErrNotAuthorized,
+		},
+		{
+			name:    "Failure - invalid topic",
+			version: 5,
+			topic:   "sensors/#.gz",
+			qos:     1,
+			payload: gz,
+			expect:  packets.ErrTopicNameInvalid,
+		},
+		{
+			name:    "Failure - empty topic",
+			version: 5,
+			topic:   ".gz",
+			payload: gz,
+			expect:  packets.ErrRejectPacket,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			pk := packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: tt.qos},
+				TopicName:   tt.topic,
+				Payload:     tt.payload,
+			}
+			pk.Properties.User = []packets.UserProperty{{Key: "source", Val: "sensor"}}
+			if tt.encoding != "" {
+				pk.Properties.User = append(pk.Properties.User, packets.UserProperty{Key: "content-encoding", Val: tt.encoding})
+			}
+
+			out, err := compressionHook.OnPublish(newClient(tt.version, ""), pk)
+			if tt.expect != nil {
+				require.ErrorIs(t, err, tt.expect)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.topicOut, out.TopicName)
+			require.Equal(t, string(tt.want), string(out.Payload))
+			if tt.encoding == "gzip" || tt.encoding == "ZSTD" {
+				require.Equal(t, []packets.UserProperty{{Key: "source", Val: "sensor"}}, out.Properties.User)
+			}
+
+		})
+	}
+
+	stats := compressionHook.Stats()
+	require.Equal(t, int64(4), stats.Decompressed)
+	require.Equal(t, int64(8), stats.Rejected)
+}
+
+func TestOnPublishWithoutSuffix(t *testing.T) {
+	compressionHook := newHook(t, Options{})
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "sensors/a.gz",
+		Payload:     []byte("reading"),
+	}
+	out, err := compressionHook.OnPublish(newClient(5, ""), pk)
+	require.NoError(t, err)
+	require.Equal(t, pk, out)
+}
+
+func TestOnPacketEncode(t *testing.T) {
+	compressionHook := newHook(t, Options{MinSize: 100, Level: level(gzip.BestCompression)})
+
+	tests := []struct {
+		name       string
+		client     *mqtt.Client
+		packetType byte
+		payload    []byte
+		property   string
+		compressed bool
+	}{
+		{
+			name:       "compressed",
+			client:     newClient(5, "gzip"),
+			packetType: packets.Publish,
+			payload:    readings(),
+			compressed: true,
+		},
+		{
+			name:       "compressed - accepting several",
+			client:     newClient(5, "zstd, GZIP"),
+			packetType: packets.Publish,
+			payload:    readings(),
+			compressed: true,
+		},
+		{
+			name:       "not accepted",
+			client:     newClient(5, "zstd"),
+			packetType: packets.Publish,
+			payload:    readings(),
+		},
+		{
+			name:       "no accept property",
+			client:     newClient(5, ""),
+			packetType: packets.Publish,
+			payload:    readings(),
+		},
+		{
+			name:       "v3 client",
+			client:     newClient(4, "gzip"),
+			packetType: packets.Publish,
+			payload:    readings(),
+		},
+		{
+			name:       "too small",
+			client:     newClient(5, "gzip"),
+			packetType: packets.Publish,
+			payload:    readings()[:99],
+		},
+		{
+			name:       "not smaller",
+			client:     newClient(5, "gzip"),
+			packetType: packets.Publish,
+			payload:    decodeVector(t, zstdLevel19),
+		},
+		{
+			name:       "already flagged",
+			client:     newClient(5, "gzip"),
+			packetType: packets.Publish,
+			payload:    readings(),
+			property:   "identity",
+		},
+		{
+			name:       "not a publish",
+			client:     newClient(5, "gzip"),
+			packetType: packets.Connack,
+			payload:    readings(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			pk := packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: tt.packetType},
+				TopicName:   "sensors/a",
+				Payload:     tt.payload,
+			}
+			pk.Properties.PayloadFormat = 1
+			if tt.property != "" {
+				pk.Properties.User = []packets.UserProperty{{Key: "content-encoding", Val: tt.property}}
+			}
+
+			out := compressionHook.OnPacketEncode(tt.client, pk)
+			if !tt.compressed {
+				require.Equal(t, pk, out)
+				return
+			}
+
+			require.Equal(t, readings(), gunzipped(t, out.Payload))
+			require.Less(t, len(out.Payload), len(pk.Payload))
+			require.Equal(t, byte(0), out.Properties.PayloadFormat)
+			require.Equal(t, []packets.UserProperty{{Key: "content-encoding", Val: "gzip"}}, out.Properties.User)
+			require.Nil(t, pk.Properties.User)
+
+			// subscribers' payloads decompress as they were published
+			decompressed, err := compressionHook.OnPublish(tt.client, out)
+			require.NoError(t, err)
+			require.Equal(t, readings(), decompressed.Payload)
+
+		})
+	}
+
+	require.Equal(t, int64(2), compressionHook.Stats().Compressed)
+}
+
+func TestOnPacketEncodeDisabled(t *testing.T) {
+	compressionHook := newHook(t, Options{})
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "sensors/a",
+		Payload:     readings(),
+	}
+	require.Equal(t, pk, compressionHook.OnPacketEncode(newClient(5, "gzip"), pk))
+}
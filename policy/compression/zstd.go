@@ -0,0 +1,36 @@
+package compression
+
+import (
+	"errors"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMaxWindow is the largest window of the zstd frames which are decompressed, the 8MB decoders
+// should support according to RFC 8878
+const zstdMaxWindow = 8 << 20
+
+// newZstdDecoder returns a decoder of zstd payloads, which holds at most the larger of the window and
+// maxSize bytes in memory while decompressing a payload
+func newZstdDecoder(maxSize int) (*zstd.Decoder, error) {
+	return zstd.NewReader(nil,
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(uint64(max(maxSize, zstdMaxWindow))),
+	)
+}
+
+// zstdDecompress returns the zstd frames of b decompressed, if they don't exceed max bytes
+func zstdDecompress(d *zstd.Decoder, b []byte, max int) ([]byte, error) {
+	out, err := d.DecodeAll(b, nil)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, errTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out) > max {
+		return nil, errTooLarge
+	}
+	return out, nil
+}
@@ -0,0 +1,117 @@
+package compression
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+// the readings compressed with the zstd cli
+var (
+	zstdLevel19    = "KLUv/WQAGEUNAAYkSBeAK2oOWkjHEIAyML/YRESIyJ3BzAh6CE4AOgA7AJSJ8TDcm7bUQbOztEd5kC+2cPEm2sO6NGfpwVlZGkfD4T7boq6iieaZ3nJSFgHwIA4OCFBAQQMGBBQUSGCgAIMAAmJAAAUIFhwosCCAg/24ycWYGB7etVkLHTPbpTwqh/jCdhdtYj2kO7MLD5mNpeHoHeyrjS7OxD7klRlLOG7WltZROszXjVfSOdoDP9niYph4D+3WpGWOznKpHI1D+G6zizWRHs7t5CJHzIald9QO9dE2FzuRD+XGDMsdNltL6egcAj0rmlIinBVNKRHOiqaUCGdFU0qEs6IpJcJZ0ZQS4XCfbXWRJs7DXk5Z4gizt9SO1oG+2XqRE+Vh3DBvsaNm6YDPqBFQBTTf/w3QG4XpETxCwBA4hBFhpyv4Q3D5uEzd5TJql5OpnVym7HIxtYvL1Fwuo3Y5mdpJ+Nj4Z5fpt9gKM3KwwzK9h4zvYUvMSMMO1fQ6MvaHTTEjDjtY0/bI8B9mxQw5zGGN3iPFf7AVY+RghzVmvM4smAVmwSwYC2bBWAwDIFXNaEbH"
+	zstdNoChecksum = "KLUv/WAAGL0MAOYeQBmAKUkHWvENgVF0ZEKrTwjZeydJdjWBNaIhRgAzADMAI61RqqGns2ONnr+lJN1oFdHMt+RW0/OlKCUF4SjGqqiigmiKmYtv0bIgDQsr1oADIpGAIJBAGAwgEA4ACzgkCg4IEAcHhdf0lE7aUdaohp7Oju+aSof00RZpU1OHr/NdpUQ6o1eJs6vE2Xe+0iKl0ampw9cibf7O0leJs+98pUVKo1NTh69F2vydpSOtUaqhp7NjjZ6/pSTdaBXRzLfkVtPzpSXl6KqIZr4lt4aFUsy35FbT86Ul5eiqiGa+Jbdrekon7ShrVENPZ8d3TaVD+miLtKmpw9f5rlIindGrxFmBjqgRgLf97/FrrAERPEKAEJDZD+hIgH+w23qiEwGe+3D2SU0CvA6D3SM9CfCy33dPdCKB5z7MPqmZAK9hsHukTwJc9vvuGZ0I8NyH2U9qEuA1DPYe6UmAy/6+e6ITAZ73YfZJTQJ6DYPdIz0p4LLfd090RoDnPsw+aZMAyNA/YTQfzUfz0Xw0P5qP5qP5DZpjAGoV"
+	zstdStreamed   = "KLUv/QRYvQsAxpk2FZBbcqtA2UcbuevVCKFNSZGZ7j8FLj4AKwArAHVbFo5QgzO/3ZKbNH3dFlFIBNkQQyNmLn4Lu6KlICc2gAcJcSCgQKGBgUChIMGggCFAQAMBCggLBwULAQ4B5Ozy9PQqdlWn8IQe7PCzOvysll1VOIQf9PT0Ks4ut2VXKMIZ/Pg1O2qjB6PXbVk4Qg3O/HZLbtL0dVtIwg1q5rdbcpM6fV1YQg5u9PFrdtSqTl9owo7lNHc5zV1Oc5fT3OU0dznNXU5zl9Pc5TT39PQqzi63ZVcowhn8+DU7agGBUagh4Lb+d+FrLHMRPELAEDDFmZG8D/z+/f375u/fv799+/39+/P329+/b3+HJ4ZgCAAJANjqCnT0AQAAAFctwWIbQIAAZDUvWWwDBAiArPaSxWyAAAGI1V6y2AYIIABZ7UUW2wABAiCrvWSxDSBAALK0lyy2AQIIQFZ7ycQ2QIAAyCYO2R+HdpzG+jiN9XEa6+P0jesYwF8FzWhGxw=="
+)
+
+// readings returns the readings compressed by the vectors
+func readings() []byte {
+	var b strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&b, "{\"sensor\":%d,\"temperature\":%d.%d}\n", i%7, 20+i%13, i%10)
+	}
+	return []byte(b.String())
+}
+
+func decodeVector(t *testing.T, s string) []byte {
+	b, err := base64.StdEncoding.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func newDecoder(t *testing.T, maxSize int) *zstd.Decoder {
+	t.Helper()
+
+	d, err := newZstdDecoder(maxSize)
+	require.NoError(t, err)
+	t.Cleanup(d.Close)
+	return d
+}
+
+func TestZstdDecompress(t *testing.T) {
+	d := newDecoder(t, 1<<20)
+	magic := []byte{0x28, 0xb5, 0x2f, 0xfd}
+	frame := func(b ...byte) []byte {
+		return append(append([]byte{}, magic...), b...)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{"huffman and fse", decodeVector(t, zstdLevel19), readings()},
+		{"no checksum", decodeVector(t, zstdNoChecksum), readings()},
+		{"streamed", decodeVector(t, zstdStreamed), readings()},
+		{
+			"concatenated",
+			append(decodeVector(t, zstdLevel19), decodeVector(t, zstdStreamed)...),
+			append(readings(), readings()...),
+		},
+		{
+			"skippable",
+			append([]byte{0x53, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 1, 2, 3}, frame(0x20, 3, 0x19, 0, 0, 'a', 'b', 'c')...),
+			[]byte("abc"),
+		},
+		{"raw block", frame(0x20, 3, 0x19, 0, 0, 'a', 'b', 'c'), []byte("abc")},
+		{"rle block", frame(0x20, 5, 0x2b, 0, 0, 'b'), []byte("bbbbb")},
+		{"rle literals", frame(0x20, 5, 0x1d, 0, 0, 0x29, 'a', 0), []byte("aaaaa")},
+		{"empty frame", frame(0x20, 0, 0x01, 0, 0), []byte{}},
+		{"empty", []byte{}, []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := zstdDecompress(d, tt.input, 1<<20)
+			require.NoError(t, err)
+			require.Equal(t, string(tt.want), string(out))
+		})
+	}
+}
+
+func TestZstdDecompressErrors(t *testing.T) {
+	valid := decodeVector(t, zstdLevel19)
+	corrupt := append([]byte{}, valid...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	tests := []struct {
+		name  string
+		input []byte
+		max   int
+		err   error
+	}{
+		{"invalid magic", []byte("not zstd"), 1 << 20, nil},
+		{"short", valid[:3], 1 << 20, nil},
+		{"truncated", valid[:len(valid)/2], 1 << 20, nil},
+		{"truncated skippable", []byte{0x50, 0x2a, 0x4d, 0x18, 8, 0, 0, 0, 1}, 1 << 20, nil},
+		{"checksum mismatch", corrupt, 1 << 20, nil},
+		{"content size too large", valid, 100, errTooLarge},
+		{"streamed too large", decodeVector(t, zstdStreamed), 100, errTooLarge},
+		{"dictionary", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x21, 1, 3, 0x19, 0, 0}, 1 << 20, nil},
+		{"reserved block type", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 3, 0x07, 0, 0}, 1 << 20, nil},
+		{"content size mismatch", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 4, 0x19, 0, 0, 'a', 'b', 'c'}, 1 << 20, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := zstdDecompress(newDecoder(t, tt.max), tt.input, tt.max)
+			require.Error(t, err)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package connlimit
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Policy is what happens when a key connects more clients than its limit
+type Policy int
+
+const (
+	Reject     Policy = iota // reject the new connection
+	KickOldest               // accept the new connection and disconnect the oldest session
+)
+
+// ByUsername limits the clients of each username
+func ByUsername(cl *mqtt.Client) string {
+	return string(cl.Properties.Username)
+}
+
+// Hook is a hook that limits the number of simultaneous sessions of each username or tenant
+type Hook struct {
+	config   Options
+	sessions map[string][]*mqtt.Client // the established clients of each key, oldest first
+	mu       sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the connlimit hook
+type Options struct {
+	// Max is the number of simultaneous sessions of each key, and Limits overrides it for particular
+	// keys. Keys without a limit, or a limit of 0, are not limited
+	Max    int
+	Limits map[string]int
+
+	// Key returns what is limited for the client, defaults to ByUsername, and may return a tenant
+	// derived from the username. Clients with an empty key are not limited
+	Key func(cl *mqtt.Client) string
+
+	// Policy is what happens when the limit is reached. Connections taking over the session of an
+	// existing client with the same client id don't count as new sessions
+	Policy Policy
+
+	// Server disconnects the oldest sessions with KickOldest
+	Server *mqtt.Server
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "connlimit-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+		mqtt.OnSessionEstablish,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	connlimitHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if connlimitHookConfig.Max <= 0 && len(connlimitHookConfig.Limits) == 0 {
+		return errors.New("max or limits is required")
+	}
+
+	if connlimitHookConfig.Policy != Reject && connlimitHookConfig.Policy != KickOldest {
+		return errors.New("unsupported policy")
+	}
+
+	if connlimitHookConfig.Policy == KickOldest && connlimitHookConfig.Server == nil {
+		return errors.New("server is required to kick the oldest sessions")
+	}
+
+	if connlimitHookConfig.Key == nil {
+		connlimitHookConfig.Key = ByUsername
+	}
+
+	h.config = connlimitHookConfig
+	h.sessions = make(map[string][]*mqtt.Client)
+	return nil
+}
+
+// limit returns the limit of the key, or 0 if it is not limited
+func (h *Hook) limit(key string) int {
+	if l, ok := h.config.Limits[key]; ok {
+		return l
+	}
+	return h.config.Max
+}
+
+// Count returns the number of sessions of the key
+func (h *Hook) Count(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.sessions[key])
+}
+
+// others returns the sessions of the key which the client would not take over, and must be called
+// with the lock held
+func (h *Hook) others(key string, cl *mqtt.Client) []*mqtt.Client {
+	return slices.DeleteFunc(slices.Clone(h.sessions[key]), func(existing *mqtt.Client) bool {
+		return existing == cl || existing.ID == cl.ID
+	})
+}
+
+// OnConnect is called when a client connects, and rejects it if its key has reached the limit
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	if h.config.Policy != Reject {
+		return nil
+	}
+
+	key := h.config.Key(cl)
+	limit := h.limit(key)
+	if key == "" || limit <= 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	n := len(h.others(key, cl))
+	h.mu.Unlock()
+
+	if n >= limit {
+		h.Log.Info("rejecting client exceeding session limit", "client", cl.ID, "key", key, "limit", limit)
+		return packets.ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// OnSessionEstablish is called when a client has authenticated, and counts its session. With
+// KickOldest, the oldest sessions beyond the limit are disconnected
+func (h *Hook) OnSessionEstablish(cl *mqtt.Client, pk packets.Packet) {
+	key := h.config.Key(cl)
+	limit := h.limit(key)
+	if key == "" || limit <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	others := h.others(key, cl)
+
+	var kicked []*mqtt.Client
+	if h.config.Policy == KickOldest && len(others) >= limit {
+		kicked = others[:len(others)-limit+1]
+		others = others[len(others)-limit+1:]
+	}
+
+	// sessions taken over by the client, and kicked sessions, no longer count
+	h.sessions[key] = append(others, cl)
+	h.mu.Unlock()
+
+	for _, old := range kicked {
+		h.Log.Info("disconnecting oldest session exceeding session limit", "client", old.ID, "key", key, "limit", limit)
+		if err := h.config.Server.DisconnectClient(old, packets.ErrSessionTakenOver); err != nil {
+			h.Log.Error("error occurred while disconnecting client", "error", err, "client", old.ID)
+		}
+	}
+}
+
+// OnDisconnect is called when a client disconnects, and releases its session
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	key := h.config.Key(cl)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sessions := slices.DeleteFunc(h.sessions[key], func(existing *mqtt.Client) bool {
+		return existing == cl
+	})
+
+	if len(sessions) == 0 {
+		delete(h.sessions, key)
+		return
+	}
+	h.sessions[key] = sessions
+}
@@ -0,0 +1,209 @@
+package connlimit
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	connlimitHook := new(Hook)
+	connlimitHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, connlimitHook.Init(options))
+	return connlimitHook
+}
+
+func connectedClient(t *testing.T, s *mqtt.Server, id, username string) *mqtt.Client {
+	t.Helper()
+
+	r, w := net.Pipe()
+	go io.Copy(io.Discard, w)
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	cl := s.NewClient(r, "tcp", id, false)
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte(username)
+	return cl
+}
+
+// connect runs the hooks of a client connecting and authenticating
+func connect(h *Hook, cl *mqtt.Client) error {
+	if err := h.OnConnect(cl, packets.Packet{}); err != nil {
+		return err
+	}
+	h.OnSessionEstablish(cl, packets.Packet{})
+	return nil
+}
+
+func TestID(t *testing.T) {
+	connlimitHook := new(Hook)
+
+	require.Equal(t, "connlimit-policy-hook", connlimitHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	connlimitHook := new(Hook)
+	require.True(t, connlimitHook.Provides(mqtt.OnConnect))
+	require.True(t, connlimitHook.Provides(mqtt.OnSessionEstablish))
+	require.True(t, connlimitHook.Provides(mqtt.OnDisconnect))
+	require.False(t, connlimitHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - max",
+			config:      Options{Max: 2},
+			expectError: false,
+		},
+		{
+			name:        "Success - limits with kick oldest",
+			config:      Options{Limits: map[string]int{"acme": 2}, Policy: KickOldest, Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no limit",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unsupported policy",
+			config:      Options{Max: 2, Policy: 7},
+			expectError: true,
+		},
+		{
+			name:        "Failure - kick oldest without server",
+			config:      Options{Max: 2, Policy: KickOldest},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			connlimitHook := new(Hook)
+			connlimitHook.Log = slog.Default()
+			err := connlimitHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, connlimitHook.config.Key)
+
+		})
+	}
+}
+
+func TestReject(t *testing.T) {
+	s := mqtt.New(nil)
+	connlimitHook := newHook(t, Options{Max: 2, Limits: map[string]int{"vip": 3, "free": 0}})
+
+	a := connectedClient(t, s, "a", "acme")
+	b := connectedClient(t, s, "b", "acme")
+	require.NoError(t, connect(connlimitHook, a))
+	require.NoError(t, connect(connlimitHook, b))
+	require.Equal(t, 2, connlimitHook.Count("acme"))
+
+	c := connectedClient(t, s, "c", "acme")
+	require.ErrorIs(t, connect(connlimitHook, c), packets.ErrQuotaExceeded)
+	require.Equal(t, 2, connlimitHook.Count("acme"))
+
+	// a reconnect taking over its own session is not a new session
+	a2 := connectedClient(t, s, "a", "acme")
+	require.NoError(t, connect(connlimitHook, a2))
+	require.Equal(t, 2, connlimitHook.Count("acme"))
+	connlimitHook.OnDisconnect(a, nil, false)
+	require.Equal(t, 2, connlimitHook.Count("acme"))
+
+	// a disconnect frees a session
+	connlimitHook.OnDisconnect(b, nil, false)
+	require.NoError(t, connect(connlimitHook, c))
+
+	// other usernames, overridden limits and anonymous clients are counted separately
+	require.NoError(t, connect(connlimitHook, connectedClient(t, s, "d", "other")))
+	for _, id := range []string{"v1", "v2", "v3"} {
+		require.NoError(t, connect(connlimitHook, connectedClient(t, s, id, "vip")))
+	}
+	require.ErrorIs(t, connect(connlimitHook, connectedClient(t, s, "v4", "vip")), packets.ErrQuotaExceeded)
+	for _, id := range []string{"f1", "f2", "f3", "n1", "n2", "n3"} {
+		username := "free"
+		if strings.HasPrefix(id, "n") {
+			username = ""
+		}
+		require.NoError(t, connect(connlimitHook, connectedClient(t, s, id, username)))
+	}
+	require.Zero(t, connlimitHook.Count("free"))
+}
+
+func TestKickOldest(t *testing.T) {
+	s := mqtt.New(nil)
+	connlimitHook := newHook(t, Options{Max: 2, Policy: KickOldest, Server: s})
+
+	a := connectedClient(t, s, "a", "acme")
+	b := connectedClient(t, s, "b", "acme")
+	c := connectedClient(t, s, "c", "acme")
+	require.NoError(t, connect(connlimitHook, a))
+	require.NoError(t, connect(connlimitHook, b))
+	require.NoError(t, connect(connlimitHook, c))
+
+	require.True(t, a.Closed())
+	require.ErrorIs(t, a.StopCause(), packets.ErrSessionTakenOver)
+	require.False(t, b.Closed())
+	require.False(t, c.Closed())
+	require.Equal(t, 2, connlimitHook.Count("acme"))
+
+	// the kicked client disconnecting later doesn't free a session of the others
+	connlimitHook.OnDisconnect(a, nil, false)
+	require.Equal(t, 2, connlimitHook.Count("acme"))
+
+	// a reconnect taking over its own session kicks nobody
+	b2 := connectedClient(t, s, "b", "acme")
+	require.NoError(t, connect(connlimitHook, b2))
+	require.False(t, c.Closed())
+	require.Equal(t, 2, connlimitHook.Count("acme"))
+
+	connlimitHook.OnDisconnect(b2, nil, false)
+	connlimitHook.OnDisconnect(c, nil, false)
+	require.Zero(t, connlimitHook.Count("acme"))
+	require.Empty(t, connlimitHook.sessions)
+}
+
+func TestKey(t *testing.T) {
+	s := mqtt.New(nil)
+	tenant := func(cl *mqtt.Client) string {
+		tenant, _, _ := strings.Cut(string(cl.Properties.Username), "/")
+		return tenant
+	}
+	connlimitHook := newHook(t, Options{Max: 1, Key: tenant})
+
+	require.NoError(t, connect(connlimitHook, connectedClient(t, s, "a", "acme/alice")))
+	require.ErrorIs(t, connect(connlimitHook, connectedClient(t, s, "b", "acme/bob")), packets.ErrQuotaExceeded)
+	require.NoError(t, connect(connlimitHook, connectedClient(t, s, "c", "globex/carol")))
+}
@@ -0,0 +1,171 @@
+package e2e
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// Stats are the totals of the messages decrypted since the hook was initialized
+type Stats struct {
+	Decrypted   int64 // the number of payloads decrypted
+	Rejected    int64 // the number of messages rejected as they could not be decrypted
+	Unavailable int64 // the number of messages rejected as the key provider failed
+}
+
+// Hook is a hook that decrypts the payloads of the messages published by devices with their own keys,
+// so that the server and the other hooks can route, validate and store them as plaintext
+type Hook struct {
+	config  Options
+	keyring *keyring
+	stats   Stats
+	mu      sync.Mutex // guards stats
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the e2e hook. Payloads
+// are encrypted with AES-GCM, and are the 12 byte nonce followed by the ciphertext and its tag
+type Options struct {
+	// Keys is the provider of the keys of the devices. Required
+	Keys KeyProvider
+
+	// Filters are the topic filters of the encrypted payloads, and default to every topic. Messages
+	// published by inline clients aren't decrypted
+	Filters []string
+
+	// ByUsername looks up the keys of devices by their username rather than their client id
+	ByUsername bool
+
+	// BindTopic authenticates the topic of each message as additional data, so payloads can't be
+	// published again to other topics
+	BindTopic bool
+
+	// Timeout bounds the calls to the key provider, and defaults to 5 seconds. CacheTTL is how long
+	// keys are cached, and defaults to 5 minutes
+	Timeout  time.Duration
+	CacheTTL time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "e2e-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	e2eHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if e2eHookConfig.Keys == nil {
+		return errors.New("key provider is required")
+	}
+
+	if len(e2eHookConfig.Filters) == 0 {
+		e2eHookConfig.Filters = []string{"#"}
+	}
+
+	for _, filter := range e2eHookConfig.Filters {
+		if !mqtt.IsValidFilter(filter, false) {
+			return fmt.Errorf("invalid topic filter %q", filter)
+		}
+	}
+
+	if e2eHookConfig.Timeout <= 0 {
+		e2eHookConfig.Timeout = 5 * time.Second
+	}
+
+	if e2eHookConfig.CacheTTL <= 0 {
+		e2eHookConfig.CacheTTL = 5 * time.Minute
+	}
+
+	h.config = e2eHookConfig
+	h.keyring = newKeyring(e2eHookConfig.Keys, e2eHookConfig.CacheTTL, e2eHookConfig.Timeout)
+	return nil
+}
+
+// Stats returns the totals of the messages decrypted so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update(&h.stats)
+}
+
+// matches returns whether the topic matches any of the filters
+func matches(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if acl.Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// additional returns the additional data authenticated with the payloads of the topic
+func additional(topic string, bind bool) []byte {
+	if bind {
+		return []byte(topic)
+	}
+	return nil
+}
+
+// OnPublish is called when a client publishes a message, and decrypts its payload with the key of the
+// client. Messages of clients without keys, or which could not be decrypted, are rejected
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	// empty messages, which clear retained messages, aren't encrypted
+	if cl.Net.Inline || len(pk.Payload) == 0 || !matches(h.config.Filters, pk.TopicName) {
+		return pk, nil
+	}
+
+	id := keyID(cl, h.config.ByUsername)
+	aead, err := h.keyring.cipher(id)
+	if errors.Is(err, ErrNoKey) {
+		h.Log.Debug("rejecting encrypted message", "error", err, "client", cl.ID, "key", id, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Rejected++ })
+		return pk, reject.Publish(cl, pk, packets.ErrNotAuthorized)
+	}
+
+	if err != nil {
+		h.Log.Warn("failed to get key", "error", err, "client", cl.ID, "key", id)
+		h.count(func(s *Stats) { s.Unavailable++ })
+		return pk, reject.Publish(cl, pk, packets.ErrUnspecifiedError)
+	}
+
+	payload, err := open(aead, pk.Payload, additional(pk.TopicName, h.config.BindTopic))
+	if err != nil {
+		h.Log.Debug("rejecting encrypted message", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Rejected++ })
+		return pk, reject.Publish(cl, pk, packets.ErrPayloadFormatInvalid)
+	}
+
+	pk.Payload = payload
+	h.count(func(s *Stats) { s.Decrypted++ })
+	return pk, nil
+}
@@ -0,0 +1,269 @@
+package e2e
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	e2eHook := new(Hook)
+	e2eHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, e2eHook.Init(options))
+	return e2eHook
+}
+
+func newClient(id, username string, version byte) *mqtt.Client {
+	cl := &mqtt.Client{ID: id}
+	cl.Properties.Username = []byte(username)
+	cl.Properties.ProtocolVersion = version
+	return cl
+}
+
+func encrypt(t *testing.T, key []byte, payload string, topic string) []byte {
+	t.Helper()
+
+	b, err := seal(newCipher(t, key), []byte(payload), []byte(topic))
+	require.NoError(t, err)
+	return b
+}
+
+func TestID(t *testing.T) {
+	e2eHook := new(Hook)
+
+	require.Equal(t, "e2e-policy-hook", e2eHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	e2eHook := new(Hook)
+	require.True(t, e2eHook.Provides(mqtt.OnPublish))
+	require.False(t, e2eHook.Provides(mqtt.OnPublished))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - defaults",
+			config:      Options{Keys: Keys{}},
+			expectError: false,
+		},
+		{
+			name:        "Success - filters",
+			config:      Options{Keys: Keys{}, Filters: []string{"devices/+/telemetry"}, BindTopic: true},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no key provider",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Keys: Keys{}, Filters: []string{"a/#/b"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			e2eHook := new(Hook)
+			e2eHook.Log = slog.Default()
+			err := e2eHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NotEmpty(t, e2eHook.config.Filters)
+			require.Equal(t, 5*time.Second, e2eHook.config.Timeout)
+			require.Equal(t, 5*time.Minute, e2eHook.config.CacheTTL)
+
+		})
+	}
+}
+
+func TestOnPublish(t *testing.T) {
+	provider := &countingKeys{keys: Keys{"d1": deviceKey, "user1": bridgeKey}}
+	e2eHook := newHook(t, Options{Keys: provider, Filters: []string{"devices/#"}, BindTopic: true})
+	byUsername := newHook(t, Options{Keys: provider, ByUsername: true})
+
+	tests := []struct {
+		name    string
+		hook    *Hook
+		client  *mqtt.Client
+		topic   string
+		qos     byte
+		payload []byte
+		fail    error
+		expect  error
+		want    string
+	}{
+		{
+			name:    "Success - decrypted",
+			hook:    e2eHook,
+			client:  newClient("d1", "", 5),
+			topic:   "devices/d1/telemetry",
+			qos:     1,
+			payload: encrypt(t, deviceKey, "21.5", "devices/d1/telemetry"),
+			want:    "21.5",
+		},
+		{
+			name:    "Success - by username",
+			hook:    byUsername,
+			client:  newClient("d1", "user1", 4),
+			topic:   "devices/d1/telemetry",
+			payload: encrypt(t, bridgeKey, "21.5", ""),
+			want:    "21.5",
+		},
+		{
+			name:    "Success - other topic",
+			hook:    e2eHook,
+			client:  newClient("d1", "", 5),
+			topic:   "status/d1",
+			payload: []byte("online"),
+			want:    "online",
+		},
+		{
+			name:   "Success - clearing retained",
+			hook:   e2eHook,
+			client: newClient("d2", "", 5),
+			topic:  "devices/d2/telemetry",
+			want:   "",
+		},
+		{
+			name:    "Success - inline client",
+			hook:    e2eHook,
+			client:  &mqtt.Client{ID: "inline", Net: mqtt.ClientConnection{Inline: true}},
+			topic:   "devices/d1/telemetry",
+			payload: []byte("21.5"),
+			want:    "21.5",
+		},
+		{
+			name:    "Failure - no key",
+			hook:    e2eHook,
+			client:  newClient("d2", "", 5),
+			topic:   "devices/d2/telemetry",
+			qos:     1,
+			payload: encrypt(t, deviceKey, "21.5", "devices/d2/telemetry"),
+			expect:  packets.ErrNotAuthorized,
+		},
+		{
+			name:    "Failure - other topic bound",
+			hook:    e2eHook,
+			client:  newClient("d1", "", 5),
+			topic:   "devices/d1/commands",
+			qos:     2,
+			payload: encrypt(t, deviceKey, "21.5", "devices/d1/telemetry"),
+			expect:  packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:    "Failure - plaintext",
+			hook:    e2eHook,
+			client:  newClient("d1", "", 5),
+			topic:   "devices/d1/telemetry",
+			payload: []byte("21.5"),
+			expect:  packets.ErrRejectPacket,
+		},
+		{
+			name:    "Failure - plaintext v3",
+			hook:    e2eHook,
+			client:  newClient("d1", "", 4),
+			topic:   "devices/d1/telemetry",
+			qos:     1,
+			payload: []byte("21.5"),
+			expect:  packets.ErrRejectPacket,
+		},
+		{
+			name:    "Failure - provider unavailable",
+			hook:    e2eHook,
+			client:  newClient("d3", "", 5),
+			topic:   "devices/d3/telemetry",
+			qos:     1,
+			payload: []byte("21.5"),
+			fail:    errors.New("unavailable"),
+			expect:  packets.ErrUnspecifiedError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			provider.err = tt.fail
+			defer func() { provider.err = nil }()
+
+			pk, err := tt.hook.OnPublish(tt.client, packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: tt.qos},
+				TopicName:   tt.topic,
+				Payload:     tt.payload,
+			})
+			if tt.expect != nil {
+				require.ErrorIs(t, err, tt.expect)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, string(pk.Payload))
+
+		})
+	}
+
+	require.Equal(t, Stats{Decrypted: 1, Rejected: 4, Unavailable: 1}, e2eHook.Stats())
+	require.Equal(t, Stats{Decrypted: 1}, byUsername.Stats())
+}
+
+func TestSubscribers(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, server.AddHook(new(Hook), Options{Keys: Keys{"d1": deviceKey}, Filters: []string{"devices/#"}}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	received := make(chan []byte, 1)
+	require.NoError(t, server.Subscribe("devices/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk.Payload
+	}))
+
+	cl := server.NewClient(nil, "tcp", "d1", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.State.Inflight.ResetReceiveQuota(10)
+	require.NoError(t, server.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "devices/d1/telemetry",
+		Payload:     encrypt(t, deviceKey, `{"temperature":21.5}`, ""),
+	}))
+
+	select {
+	case got := <-received:
+		require.Equal(t, `{"temperature":21.5}`, string(got))
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	retained, ok := server.Topics.Retained.Get("devices/d1/telemetry")
+	require.True(t, ok)
+	require.Equal(t, `{"temperature":21.5}`, string(retained.Payload))
+}
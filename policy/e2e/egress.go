@@ -0,0 +1,179 @@
+package e2e
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// EgressStats are the totals of the messages encrypted since the hook was initialized
+type EgressStats struct {
+	Encrypted int64 // the number of messages passed encrypted to the wrapped hook
+	Dropped   int64 // the number of messages not passed as they could not be encrypted
+}
+
+// EgressHook is a hook that encrypts the payloads of the messages the wrapped bridge hook forwards, so
+// they stay encrypted beyond the server
+type EgressHook struct {
+	config  EgressOptions
+	keyring *keyring
+	stats   EgressStats
+	mu      sync.Mutex // guards stats
+	mqtt.HookBase
+}
+
+// EgressOptions is a struct that contains all the information required to configure the e2e egress
+// hook. Payloads are encrypted as they are decrypted by the e2e hook
+type EgressOptions struct {
+	// Hook is the wrapped bridge hook, initialized with Config, which is given the published messages
+	// encrypted. It is initialized and stopped by the egress hook, so must not also be added to the
+	// server
+	Hook   mqtt.Hook
+	Config any
+
+	// Keys is the provider of the keys the messages are encrypted with. Required
+	Keys KeyProvider
+
+	// KeyID is the id of the key all messages are encrypted with. The messages of each device are
+	// encrypted with its own key, by its username if ByUsername or its client id otherwise, if empty
+	KeyID      string
+	ByUsername bool
+
+	// Filters are the topic filters of the messages which are encrypted, and default to every topic.
+	// Other messages are passed as they are
+	Filters []string
+
+	// BindTopic authenticates the topic of each message as additional data
+	BindTopic bool
+
+	// Timeout bounds the calls to the key provider, and defaults to 5 seconds. CacheTTL is how long
+	// keys are cached, and defaults to 5 minutes
+	Timeout  time.Duration
+	CacheTTL time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *EgressHook) ID() string {
+	return "e2e-egress-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook, which the wrapped hook must also
+func (h *EgressHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnStopped,
+		mqtt.OnPublished,
+	}, []byte{b}) && h.config.Hook != nil && h.config.Hook.Provides(b)
+}
+
+// Init initializes the hook and the wrapped hook with the given config
+func (h *EgressHook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	egressHookConfig, ok := config.(EgressOptions)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if egressHookConfig.Hook == nil {
+		return errors.New("hook is required")
+	}
+
+	if egressHookConfig.Keys == nil {
+		return errors.New("key provider is required")
+	}
+
+	if len(egressHookConfig.Filters) == 0 {
+		egressHookConfig.Filters = []string{"#"}
+	}
+
+	for _, filter := range egressHookConfig.Filters {
+		if !mqtt.IsValidFilter(filter, false) {
+			return fmt.Errorf("invalid topic filter %q", filter)
+		}
+	}
+
+	if egressHookConfig.Timeout <= 0 {
+		egressHookConfig.Timeout = 5 * time.Second
+	}
+
+	if egressHookConfig.CacheTTL <= 0 {
+		egressHookConfig.CacheTTL = 5 * time.Minute
+	}
+
+	egressHookConfig.Hook.SetOpts(h.Log, h.Opts)
+	if err := egressHookConfig.Hook.Init(egressHookConfig.Config); err != nil {
+		return fmt.Errorf("failed initialising %s hook: %w", egressHookConfig.Hook.ID(), err)
+	}
+
+	h.config = egressHookConfig
+	h.keyring = newKeyring(egressHookConfig.Keys, egressHookConfig.CacheTTL, egressHookConfig.Timeout)
+	return nil
+}
+
+// Stop stops the wrapped hook
+func (h *EgressHook) Stop() error {
+	if h.config.Hook == nil {
+		return nil
+	}
+	return h.config.Hook.Stop()
+}
+
+// Stats returns the totals of the messages encrypted so far
+func (h *EgressHook) Stats() EgressStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *EgressHook) count(update func(s *EgressStats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update(&h.stats)
+}
+
+// OnStarted is called when the server has started
+func (h *EgressHook) OnStarted() {
+	h.config.Hook.OnStarted()
+}
+
+// OnStopped is called when the server has stopped
+func (h *EgressHook) OnStopped() {
+	h.config.Hook.OnStopped()
+}
+
+// OnPublished is called when a client has published a message, and passes it encrypted to the wrapped
+// hook. Messages which could not be encrypted, eg. of devices without keys, are not passed
+func (h *EgressHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if len(pk.Payload) == 0 || !matches(h.config.Filters, pk.TopicName) {
+		h.config.Hook.OnPublished(cl, pk)
+		return
+	}
+
+	id := h.config.KeyID
+	if id == "" {
+		id = keyID(cl, h.config.ByUsername)
+	}
+
+	aead, err := h.keyring.cipher(id)
+	if err == nil {
+		pk.Payload, err = seal(aead, pk.Payload, additional(pk.TopicName, h.config.BindTopic))
+	}
+
+	if err != nil {
+		h.Log.Warn("message not passed to wrapped hook", "error", err, "hook", h.config.Hook.ID(), "client", cl.ID, "key", id, "topic", pk.TopicName)
+		h.count(func(s *EgressStats) { s.Dropped++ })
+		return
+	}
+
+	h.count(func(s *EgressStats) { s.Encrypted++ })
+	h.config.Hook.OnPublished(cl, pk)
+}
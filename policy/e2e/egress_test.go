@@ -0,0 +1,230 @@
+package e2e
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBridge records the messages it is given
+type fakeBridge struct {
+	published []packets.Packet
+	started   bool
+	initErr   error
+	stopped   bool
+	mqtt.HookBase
+}
+
+func (b *fakeBridge) ID() string {
+	return "fake"
+}
+
+func (b *fakeBridge) Provides(hook byte) bool {
+	return hook == mqtt.OnStarted || hook == mqtt.OnPublished
+}
+
+func (b *fakeBridge) Init(config any) error {
+	return b.initErr
+}
+
+func (b *fakeBridge) Stop() error {
+	b.stopped = true
+	return nil
+}
+
+func (b *fakeBridge) OnStarted() {
+	b.started = true
+}
+
+func (b *fakeBridge) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	b.published = append(b.published, pk)
+}
+
+func newEgressHook(t *testing.T, options EgressOptions) *EgressHook {
+	t.Helper()
+
+	egressHook := new(EgressHook)
+	egressHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, egressHook.Init(options))
+	t.Cleanup(func() { egressHook.Stop() })
+	return egressHook
+}
+
+func TestEgressID(t *testing.T) {
+	egressHook := new(EgressHook)
+
+	require.Equal(t, "e2e-egress-policy-hook", egressHook.ID())
+}
+
+func TestEgressProvides(t *testing.T) {
+	egressHook := new(EgressHook)
+	require.False(t, egressHook.Provides(mqtt.OnPublished))
+
+	egressHook.config.Hook = new(fakeBridge)
+	require.True(t, egressHook.Provides(mqtt.OnPublished))
+	require.True(t, egressHook.Provides(mqtt.OnStarted))
+	require.False(t, egressHook.Provides(mqtt.OnStopped))
+	require.False(t, egressHook.Provides(mqtt.OnPublish))
+}
+
+func TestEgressInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      EgressOptions{Hook: new(fakeBridge), Keys: Keys{}, KeyID: "bridge"},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no hook",
+			config:      EgressOptions{Keys: Keys{}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no key provider",
+			config:      EgressOptions{Hook: new(fakeBridge)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      EgressOptions{Hook: new(fakeBridge), Keys: Keys{}, Filters: []string{"#/a"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - wrapped hook",
+			config:      EgressOptions{Hook: &fakeBridge{initErr: errors.New("failed")}, Keys: Keys{}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			egressHook := new(EgressHook)
+			egressHook.Log = slog.Default()
+			err := egressHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []string{"#"}, egressHook.config.Filters)
+			require.NoError(t, egressHook.Stop())
+			require.True(t, egressHook.config.Hook.(*fakeBridge).stopped)
+
+		})
+	}
+}
+
+func TestEgressOnPublished(t *testing.T) {
+	keys := Keys{"d1": deviceKey, "bridge": bridgeKey}
+
+	tests := []struct {
+		name    string
+		options EgressOptions
+		client  *mqtt.Client
+		topic   string
+		payload string
+		key     []byte // the key the payload is passed encrypted with, if any
+		dropped bool
+	}{
+		{
+			name:    "bridge key",
+			options: EgressOptions{KeyID: "bridge", BindTopic: true},
+			client:  newClient("d2", "", 5),
+			topic:   "devices/d2/telemetry",
+			payload: "21.5",
+			key:     bridgeKey,
+		},
+		{
+			name:    "device key",
+			options: EgressOptions{},
+			client:  newClient("d1", "", 5),
+			topic:   "devices/d1/telemetry",
+			payload: "21.5",
+			key:     deviceKey,
+		},
+		{
+			name:    "device key by username",
+			options: EgressOptions{ByUsername: true},
+			client:  newClient("c1", "d1", 5),
+			topic:   "devices/d1/telemetry",
+			payload: "21.5",
+			key:     deviceKey,
+		},
+		{
+			name:    "other topic",
+			options: EgressOptions{KeyID: "bridge", Filters: []string{"devices/#"}},
+			client:  newClient("d1", "", 5),
+			topic:   "status/d1",
+			payload: "online",
+		},
+		{
+			name:    "empty payload",
+			options: EgressOptions{KeyID: "bridge"},
+			client:  newClient("d1", "", 5),
+			topic:   "devices/d1/telemetry",
+		},
+		{
+			name:    "no key",
+			options: EgressOptions{},
+			client:  newClient("d2", "", 5),
+			topic:   "devices/d2/telemetry",
+			payload: "21.5",
+			dropped: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			bridge := new(fakeBridge)
+			tt.options.Hook = bridge
+			tt.options.Keys = keys
+			egressHook := newEgressHook(t, tt.options)
+			egressHook.OnStarted()
+			require.True(t, bridge.started)
+
+			pk := packets.Packet{TopicName: tt.topic, Payload: []byte(tt.payload)}
+			egressHook.OnPublished(tt.client, pk)
+			if tt.dropped {
+				require.Empty(t, bridge.published)
+				require.Equal(t, EgressStats{Dropped: 1}, egressHook.Stats())
+				return
+			}
+
+			require.Len(t, bridge.published, 1)
+			forwarded := bridge.published[0]
+			require.Equal(t, tt.topic, forwarded.TopicName)
+			require.Equal(t, tt.payload, string(pk.Payload))
+			if tt.key == nil {
+				require.Equal(t, tt.payload, string(forwarded.Payload))
+				return
+			}
+
+			data, err := open(newCipher(t, tt.key), forwarded.Payload, additional(tt.topic, tt.options.BindTopic))
+			require.NoError(t, err)
+			require.Equal(t, tt.payload, string(data))
+			require.Equal(t, EgressStats{Encrypted: 1}, egressHook.Stats())
+
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package e2e
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// ErrNoKey is returned by key providers for devices which have no key
+var ErrNoKey = errors.New("no key")
+
+// KeyProvider returns the AES keys of devices, of 16, 24 or 32 bytes, eg. from a database or a secrets
+// manager. It is called concurrently
+type KeyProvider interface {
+	// Key returns the key of the device with the id, or ErrNoKey if it has none
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// Keys is a key provider of a fixed set of keys, by the ids of the devices
+type Keys map[string][]byte
+
+// Key returns the key of the device with the id
+func (k Keys) Key(ctx context.Context, id string) ([]byte, error) {
+	key, ok := k[id]
+	if !ok {
+		return nil, ErrNoKey
+	}
+	return key, nil
+}
+
+// keyring caches the ciphers of the keys of devices
+type keyring struct {
+	provider KeyProvider
+	timeout  time.Duration
+	ciphers  *cache.Cache[string, cipher.AEAD]
+}
+
+// newKeyring returns a keyring of the keys of the provider, which are cached for the ttl
+func newKeyring(provider KeyProvider, ttl, timeout time.Duration) *keyring {
+	return &keyring{
+		provider: provider,
+		timeout:  timeout,
+		ciphers:  cache.New[string, cipher.AEAD](cache.Options{MaxEntries: 10000, TTL: ttl}),
+	}
+}
+
+// cipher returns the AES-GCM cipher of the key of the device with the id
+func (k *keyring) cipher(id string) (cipher.AEAD, error) {
+	if aead, ok := k.ciphers.Get(id); ok {
+		return aead, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), k.timeout)
+	defer cancel()
+
+	key, err := k.provider.Key(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key of %s: %w", id, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	k.ciphers.Set(id, aead)
+	return aead, nil
+}
+
+// keyID returns the id of the key of the client, its username if byUsername or its id otherwise
+func keyID(cl *mqtt.Client, byUsername bool) string {
+	if byUsername {
+		return string(cl.Properties.Username)
+	}
+	return cl.ID
+}
+
+// seal encrypts the payload, returning the nonce followed by the ciphertext. The additional data is
+// authenticated but not encrypted
+func seal(aead cipher.AEAD, payload, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, payload, additional), nil
+}
+
+// open decrypts a payload encrypted by seal
+func open(aead cipher.AEAD, payload, additional []byte) ([]byte, error) {
+	if len(payload) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("payload is truncated")
+	}
+
+	data, err := aead.Open(nil, payload[:aead.NonceSize()], payload[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+	return data, nil
+}
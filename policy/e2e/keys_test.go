@@ -0,0 +1,105 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	deviceKey = bytes.Repeat([]byte{1}, 32)
+	bridgeKey = bytes.Repeat([]byte{2}, 16)
+)
+
+// countingKeys counts the keys it returns, or fails with err
+type countingKeys struct {
+	keys  Keys
+	err   error
+	calls atomic.Int64
+}
+
+func (c *countingKeys) Key(ctx context.Context, id string) ([]byte, error) {
+	c.calls.Add(1)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.keys.Key(ctx, id)
+}
+
+func newCipher(t *testing.T, key []byte) cipher.AEAD {
+	t.Helper()
+
+	aead, err := newKeyring(Keys{"k": key}, time.Minute, time.Second).cipher("k")
+	require.NoError(t, err)
+	return aead
+}
+
+func TestKeys(t *testing.T) {
+	keys := Keys{"d1": deviceKey}
+
+	key, err := keys.Key(context.Background(), "d1")
+	require.NoError(t, err)
+	require.Equal(t, deviceKey, key)
+
+	_, err = keys.Key(context.Background(), "d2")
+	require.ErrorIs(t, err, ErrNoKey)
+}
+
+func TestKeyring(t *testing.T) {
+	provider := &countingKeys{keys: Keys{"d1": deviceKey, "bad": []byte("short")}}
+	k := newKeyring(provider, time.Minute, time.Second)
+
+	// keys are cached
+	for i := 0; i < 3; i++ {
+		_, err := k.cipher("d1")
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), provider.calls.Load())
+
+	_, err := k.cipher("d2")
+	require.ErrorIs(t, err, ErrNoKey)
+
+	_, err = k.cipher("bad")
+	require.Error(t, err)
+
+	provider.err = errors.New("unavailable")
+	_, err = k.cipher("d3")
+	require.ErrorIs(t, err, provider.err)
+}
+
+func TestSealOpen(t *testing.T) {
+	aead := newCipher(t, deviceKey)
+
+	sealed, err := seal(aead, []byte("hello"), []byte("a/b"))
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), "hello")
+
+	// every payload has its own nonce
+	again, err := seal(aead, []byte("hello"), []byte("a/b"))
+	require.NoError(t, err)
+	require.NotEqual(t, sealed, again)
+
+	data, err := open(aead, sealed, []byte("a/b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), data)
+
+	_, err = open(aead, sealed, []byte("a/c"))
+	require.Error(t, err)
+
+	_, err = open(aead, sealed[:aead.NonceSize()+aead.Overhead()-1], []byte("a/b"))
+	require.Error(t, err)
+
+	_, err = open(newCipher(t, bridgeKey), sealed, []byte("a/b"))
+	require.Error(t, err)
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = open(aead, tampered, []byte("a/b"))
+	require.Error(t, err)
+}
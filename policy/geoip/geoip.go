@@ -0,0 +1,258 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// User properties added to connecting clients, for downstream hooks and audit logs
+const (
+	PropertyCountry = "geoip-country" // ISO 3166-1 alpha-2 code, eg. DE
+	PropertyASN     = "geoip-asn"     // autonomous system number, eg. 3320
+	PropertyASOrg   = "geoip-as-org"  // autonomous system organization, eg. Deutsche Telekom AG
+)
+
+// Info is the location of an address, whose fields are empty if the databases have no record of it
+type Info struct {
+	Country string
+	ASN     uint32
+	ASOrg   string
+}
+
+// Hook is a hook that resolves the country and autonomous system of connecting clients from MaxMind
+// databases, rejects them by policy, and adds what it found to their user properties
+type Hook struct {
+	config  Options
+	exempt  []*net.IPNet
+	country *Reader
+	asn     *Reader
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the geoip hook
+type Options struct {
+	// CountryDB is a GeoIP2 or GeoLite2 Country or City database, and ASNDB a GeoLite2 ASN database.
+	// Country and ASN are used instead of the paths if set
+	CountryDB string
+	ASNDB     string
+	Country   *Reader
+	ASN       *Reader
+
+	// AllowCountries only allow clients from these countries, by ISO 3166-1 alpha-2 code, and
+	// DenyCountries reject clients from these countries
+	AllowCountries []string
+	DenyCountries  []string
+
+	// AllowASNs only allow clients from these autonomous systems, and DenyASNs reject clients from them
+	AllowASNs []uint32
+	DenyASNs  []uint32
+
+	// AllowUnknown allows clients which are not in a database when there is an allow list, eg. clients
+	// connecting from private networks or through a transport without addresses
+	AllowUnknown bool
+
+	// Exempt are networks which are never checked, eg. 10.0.0.0/8
+	Exempt []string
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "geoip-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return b == mqtt.OnConnect
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	geoipHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	country, asn := geoipHookConfig.Country, geoipHookConfig.ASN
+	var err error
+	if country == nil && geoipHookConfig.CountryDB != "" {
+		if country, err = Open(geoipHookConfig.CountryDB); err != nil {
+			return err
+		}
+	}
+
+	if asn == nil && geoipHookConfig.ASNDB != "" {
+		if asn, err = Open(geoipHookConfig.ASNDB); err != nil {
+			return err
+		}
+	}
+
+	if country == nil && asn == nil {
+		return errors.New("country or asn database is required")
+	}
+
+	if country == nil && (len(geoipHookConfig.AllowCountries) > 0 || len(geoipHookConfig.DenyCountries) > 0) {
+		return errors.New("country database is required for country policies")
+	}
+
+	if asn == nil && (len(geoipHookConfig.AllowASNs) > 0 || len(geoipHookConfig.DenyASNs) > 0) {
+		return errors.New("asn database is required for asn policies")
+	}
+
+	geoipHookConfig.AllowCountries = upper(geoipHookConfig.AllowCountries)
+	geoipHookConfig.DenyCountries = upper(geoipHookConfig.DenyCountries)
+
+	var exempt []*net.IPNet
+	for _, cidr := range geoipHookConfig.Exempt {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		exempt = append(exempt, n)
+	}
+
+	h.config = geoipHookConfig
+	h.exempt = exempt
+	h.country = country
+	h.asn = asn
+	return nil
+}
+
+// upper returns the country codes in upper case
+func upper(codes []string) []string {
+	out := make([]string, len(codes))
+	for i, c := range codes {
+		out[i] = strings.ToUpper(c)
+	}
+	return out
+}
+
+// Lookup returns the location of the ip
+func (h *Hook) Lookup(ip net.IP) (Info, error) {
+	var info Info
+	if h.country != nil {
+		v, err := h.country.Lookup(ip)
+		if err != nil {
+			return Info{}, err
+		}
+
+		info.Country, _ = field(v, "country", "iso_code").(string)
+		if info.Country == "" {
+			info.Country, _ = field(v, "registered_country", "iso_code").(string)
+		}
+	}
+
+	if h.asn != nil {
+		v, err := h.asn.Lookup(ip)
+		if err != nil {
+			return Info{}, err
+		}
+
+		asn, _ := field(v, "autonomous_system_number").(uint64)
+		info.ASN = uint32(asn)
+		info.ASOrg, _ = field(v, "autonomous_system_organization").(string)
+	}
+
+	return info, nil
+}
+
+// field returns the value at the path of nested maps, or nil if it does not exist
+func field(v any, path ...string) any {
+	for _, k := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// OnConnect is called when a client connects, and rejects clients the policy does not allow
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	ip := remoteIP(cl.Net.Remote)
+	for _, n := range h.exempt {
+		if ip != nil && n.Contains(ip) {
+			return nil
+		}
+	}
+
+	var info Info
+	if ip != nil {
+		var err error
+		if info, err = h.Lookup(ip); err != nil {
+			h.Log.Error("error occurred while looking up client location", "error", err, "client", cl.ID, "remote", cl.Net.Remote)
+			return packets.ErrNotAuthorized
+		}
+	}
+
+	if info.Country != "" {
+		cl.Properties.Props.User = append(cl.Properties.Props.User, packets.UserProperty{Key: PropertyCountry, Val: info.Country})
+	}
+
+	if info.ASN != 0 {
+		cl.Properties.Props.User = append(cl.Properties.Props.User, packets.UserProperty{Key: PropertyASN, Val: strconv.FormatUint(uint64(info.ASN), 10)})
+	}
+
+	if info.ASOrg != "" {
+		cl.Properties.Props.User = append(cl.Properties.Props.User, packets.UserProperty{Key: PropertyASOrg, Val: info.ASOrg})
+	}
+
+	if !h.allowed(info) {
+		h.Log.Info("rejecting client by geoip policy", "client", cl.ID, "remote", cl.Net.Remote, "country", info.Country, "asn", info.ASN)
+		return packets.ErrNotAuthorized
+	}
+
+	return nil
+}
+
+// allowed returns whether the policy allows clients from the location
+func (h *Hook) allowed(info Info) bool {
+	if info.Country != "" && slices.Contains(h.config.DenyCountries, info.Country) {
+		return false
+	}
+
+	if info.ASN != 0 && slices.Contains(h.config.DenyASNs, info.ASN) {
+		return false
+	}
+
+	if len(h.config.AllowCountries) > 0 {
+		if info.Country == "" {
+			if !h.config.AllowUnknown {
+				return false
+			}
+		} else if !slices.Contains(h.config.AllowCountries, info.Country) {
+			return false
+		}
+	}
+
+	if len(h.config.AllowASNs) > 0 {
+		if info.ASN == 0 {
+			if !h.config.AllowUnknown {
+				return false
+			}
+		} else if !slices.Contains(h.config.AllowASNs, info.ASN) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// remoteIP returns the ip of the remote address, or nil if it isn't an ip address
+func remoteIP(remote string) net.IP {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,284 @@
+package geoip
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+var testASNetworks = []network{
+	{cidr: "81.2.69.0/24", value: map[string]any{
+		"autonomous_system_number":       uint32(20712),
+		"autonomous_system_organization": "Andrews & Arnold Ltd",
+	}},
+	{cidr: "1.128.0.0/11", value: map[string]any{
+		"autonomous_system_number":       uint32(1221),
+		"autonomous_system_organization": "Telstra Pty Ltd",
+	}},
+}
+
+func testReaders(t *testing.T) (*Reader, *Reader) {
+	t.Helper()
+
+	country, err := NewReader(buildDB(24, "Test-Country", testNetworks...))
+	require.NoError(t, err)
+
+	asn, err := NewReader(buildDB(24, "Test-ASN", testASNetworks...))
+	require.NoError(t, err)
+
+	return country, asn
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	if options.Country == nil && options.ASN == nil {
+		options.Country, options.ASN = testReaders(t)
+	}
+
+	geoipHook := new(Hook)
+	geoipHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, geoipHook.Init(options))
+	return geoipHook
+}
+
+func client(remote string) *mqtt.Client {
+	cl := &mqtt.Client{ID: "device-1"}
+	cl.Net.Remote = remote
+	return cl
+}
+
+func TestID(t *testing.T) {
+	geoipHook := new(Hook)
+
+	require.Equal(t, "geoip-policy-hook", geoipHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	geoipHook := new(Hook)
+	require.True(t, geoipHook.Provides(mqtt.OnConnect))
+	require.False(t, geoipHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, geoipHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	country, asn := testReaders(t)
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	require.NoError(t, os.WriteFile(path, buildDB(24, "Test-Country", testNetworks...), 0600))
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - readers",
+			config:      Options{Country: country, ASN: asn, DenyCountries: []string{"gb"}, DenyASNs: []uint32{1221}},
+			expectError: false,
+		},
+		{
+			name:        "Success - country database path",
+			config:      Options{CountryDB: path, AllowCountries: []string{"GB"}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no database",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing country database",
+			config:      Options{CountryDB: filepath.Join(t.TempDir(), "missing.mmdb")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing asn database",
+			config:      Options{ASNDB: filepath.Join(t.TempDir(), "missing.mmdb")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - country policy without database",
+			config:      Options{ASN: asn, AllowCountries: []string{"GB"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - asn policy without database",
+			config:      Options{Country: country, DenyASNs: []uint32{1221}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid exempt network",
+			config:      Options{Country: country, Exempt: []string{"10.0.0.0"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			geoipHook := new(Hook)
+			geoipHook.Log = slog.Default()
+			err := geoipHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	geoipHook := newHook(t, Options{})
+
+	info, err := geoipHook.Lookup(net.ParseIP("81.2.69.142"))
+	require.NoError(t, err)
+	require.Equal(t, Info{Country: "GB", ASN: 20712, ASOrg: "Andrews & Arnold Ltd"}, info)
+
+	info, err = geoipHook.Lookup(net.ParseIP("2001:db8::1"))
+	require.NoError(t, err)
+	require.Equal(t, Info{Country: "DE"}, info)
+
+	info, err = geoipHook.Lookup(net.ParseIP("192.168.1.1"))
+	require.NoError(t, err)
+	require.Equal(t, Info{}, info)
+}
+
+func TestOnConnect(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     Options
+		remote      string
+		expectError bool
+	}{
+		{
+			name:        "Success - no policy",
+			options:     Options{},
+			remote:      "81.2.69.142:51234",
+			expectError: false,
+		},
+		{
+			name:        "Success - allowed country",
+			options:     Options{AllowCountries: []string{"gb", "SE"}},
+			remote:      "81.2.69.142:51234",
+			expectError: false,
+		},
+		{
+			name:        "Failure - country not allowed",
+			options:     Options{AllowCountries: []string{"SE"}},
+			remote:      "81.2.69.142:51234",
+			expectError: true,
+		},
+		{
+			name:        "Failure - denied country",
+			options:     Options{DenyCountries: []string{"DE"}},
+			remote:      "[2001:db8::1]:51234",
+			expectError: true,
+		},
+		{
+			name:        "Success - country not denied",
+			options:     Options{DenyCountries: []string{"DE"}},
+			remote:      "89.160.20.120:51234",
+			expectError: false,
+		},
+		{
+			name:        "Success - allowed asn",
+			options:     Options{AllowASNs: []uint32{20712}},
+			remote:      "81.2.69.142:51234",
+			expectError: false,
+		},
+		{
+			name:        "Failure - denied asn",
+			options:     Options{DenyASNs: []uint32{1221}},
+			remote:      "1.130.0.1:51234",
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown with allow list",
+			options:     Options{AllowCountries: []string{"GB"}},
+			remote:      "192.168.1.10:51234",
+			expectError: true,
+		},
+		{
+			name:        "Success - unknown allowed",
+			options:     Options{AllowCountries: []string{"GB"}, AllowASNs: []uint32{20712}, AllowUnknown: true},
+			remote:      "192.168.1.10:51234",
+			expectError: false,
+		},
+		{
+			name:        "Success - unknown without allow list",
+			options:     Options{DenyCountries: []string{"DE"}},
+			remote:      "192.168.1.10:51234",
+			expectError: false,
+		},
+		{
+			name:        "Failure - no remote address with allow list",
+			options:     Options{AllowCountries: []string{"GB"}},
+			remote:      "pipe",
+			expectError: true,
+		},
+		{
+			name:        "Success - exempt network",
+			options:     Options{AllowCountries: []string{"GB"}, Exempt: []string{"192.168.0.0/16"}},
+			remote:      "192.168.1.10:51234",
+			expectError: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			geoipHook := newHook(t, tt.options)
+			err := geoipHook.OnConnect(client(tt.remote), packets.Packet{})
+			if tt.expectError {
+				require.ErrorIs(t, err, packets.ErrNotAuthorized)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnConnectProperties(t *testing.T) {
+	geoipHook := newHook(t, Options{})
+
+	cl := client("81.2.69.142:51234")
+	cl.Properties.Props.User = []packets.UserProperty{{Key: "tenant", Val: "acme"}}
+	require.NoError(t, geoipHook.OnConnect(cl, packets.Packet{}))
+	require.Equal(t, []packets.UserProperty{
+		{Key: "tenant", Val: "acme"},
+		{Key: PropertyCountry, Val: "GB"},
+		{Key: PropertyASN, Val: "20712"},
+		{Key: PropertyASOrg, Val: "Andrews & Arnold Ltd"},
+	}, cl.Properties.Props.User)
+
+	cl = client("192.168.1.10:51234")
+	require.NoError(t, geoipHook.OnConnect(cl, packets.Packet{}))
+	require.Empty(t, cl.Properties.Props.User)
+}
+
+func TestOnConnectLookupError(t *testing.T) {
+	country, _ := testReaders(t)
+	country.Metadata.IPVersion = 4 // an IPv4 database cannot look up IPv6 addresses
+
+	geoipHook := newHook(t, Options{Country: country})
+	require.ErrorIs(t, geoipHook.OnConnect(client("[2001:db8::1]:51234"), packets.Packet{}), packets.ErrNotAuthorized)
+}
@@ -0,0 +1,323 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata at the end of a MaxMind DB file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// maxDepth limits the nesting of decoded values, so a corrupt file cannot recurse indefinitely
+const maxDepth = 64
+
+// Metadata describes a MaxMind DB file
+type Metadata struct {
+	DatabaseType string // eg. GeoLite2-Country or GeoLite2-ASN
+	IPVersion    int
+	NodeCount    uint
+	RecordSize   int
+	BuildEpoch   uint64
+}
+
+// Reader looks up addresses in a MaxMind DB file, such as a GeoIP2 or GeoLite2 Country, City or ASN
+// database. It is safe for concurrent use
+type Reader struct {
+	Metadata  Metadata
+	tree      []byte
+	data      decoder
+	ipv4Start uint // the node of ::/96, where IPv4 addresses are looked up in an IPv6 database
+}
+
+// Open reads the database file into memory
+func Open(path string) (*Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(b)
+}
+
+// NewReader returns a reader of the database in b
+func NewReader(b []byte) (*Reader, error) {
+	i := bytes.LastIndex(b, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("invalid database: metadata not found")
+	}
+
+	v, _, err := decoder{buf: b[i+len(metadataMarker):]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database metadata: %w", err)
+	}
+
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid database metadata: not a map")
+	}
+
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	buildEpoch, _ := m["build_epoch"].(uint64)
+	databaseType, _ := m["database_type"].(string)
+
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("invalid database metadata: unsupported record size %d", recordSize)
+	}
+
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("invalid database metadata: unsupported ip version %d", ipVersion)
+	}
+
+	treeSize := nodeCount * recordSize / 4
+	if nodeCount == 0 || treeSize+16 > uint64(i) {
+		return nil, errors.New("invalid database: search tree exceeds file")
+	}
+
+	r := &Reader{
+		Metadata: Metadata{
+			DatabaseType: databaseType,
+			IPVersion:    int(ipVersion),
+			NodeCount:    uint(nodeCount),
+			RecordSize:   int(recordSize),
+			BuildEpoch:   buildEpoch,
+		},
+		tree: b[:treeSize],
+		data: decoder{buf: b[treeSize+16 : i]},
+	}
+
+	if r.Metadata.IPVersion == 6 {
+		for j := 0; j < 96 && r.ipv4Start < r.Metadata.NodeCount; j++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+
+	return r, nil
+}
+
+// Lookup returns the record of the network containing the ip, which is usually a map[string]any,
+// or nil if the database has no record for it
+func (r *Reader) Lookup(ip net.IP) (any, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if len(ip) != net.IPv6len {
+		return nil, fmt.Errorf("invalid ip %v", ip)
+	} else if r.Metadata.IPVersion == 4 {
+		return nil, errors.New("ipv6 address in an ipv4 database")
+	}
+
+	count := r.Metadata.NodeCount
+	for i := 0; i < len(ip)*8 && node < count; i++ {
+		node = r.record(node, (ip[i>>3]>>(7-i&7))&1)
+	}
+
+	switch {
+	case node == count:
+		return nil, nil
+	case node < count:
+		return nil, errors.New("invalid database: search tree is too deep")
+	}
+
+	v, _, err := r.data.decode(int(node-count-16), 0)
+	return v, err
+}
+
+// record returns the left or right record of the node
+func (r *Reader) record(node uint, bit byte) uint {
+	switch r.Metadata.RecordSize {
+	case 24:
+		b := r.tree[node*6+uint(bit)*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]>>4)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+uint(bit)*4:]))
+	}
+}
+
+// decoder decodes the values of the data section, whose pointers are relative to its start
+type decoder struct {
+	buf []byte
+}
+
+// data types of the MaxMind DB format
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// decode returns the value at the offset and the offset following it. Unsigned integers are returned
+// as uint64, except uint128 which is a *big.Int, and int32 as int64
+func (d decoder) decode(off, depth int) (any, int, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("invalid data: nested too deeply")
+	}
+
+	if off < 0 || off >= len(d.buf) {
+		return nil, 0, errors.New("invalid data: offset out of range")
+	}
+
+	ctrl := d.buf[off]
+	off++
+
+	t := int(ctrl >> 5)
+	if t == typePointer {
+		return d.pointer(ctrl, off, depth)
+	}
+
+	if t == typeExtended {
+		if off >= len(d.buf) {
+			return nil, 0, errors.New("invalid data: truncated type")
+		}
+		t = 7 + int(d.buf[off])
+		off++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > len(d.buf) {
+			return nil, 0, errors.New("invalid data: truncated size")
+		}
+		extra := 0
+		for _, b := range d.buf[off : off+n] {
+			extra = extra<<8 | int(b)
+		}
+		off += n
+		size = []int{29, 285, 65821}[n-1] + extra
+	}
+
+	switch t {
+	case typeMap:
+		m := make(map[string]any, min(size, 64))
+		for i := 0; i < size; i++ {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid data: map key is not a string")
+			}
+
+			if m[key], off, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case typeArray:
+		a := make([]any, 0, min(size, 64))
+		for i := 0; i < size; i++ {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case typeBool:
+		if size > 1 {
+			return nil, 0, errors.New("invalid data: bool size")
+		}
+		return size == 1, off, nil
+	}
+
+	if off+size > len(d.buf) {
+		return nil, 0, errors.New("invalid data: value exceeds data section")
+	}
+	b := d.buf[off : off+size]
+	off += size
+
+	switch t {
+	case typeString:
+		return string(b), off, nil
+	case typeBytes:
+		return append([]byte(nil), b...), off, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid data: double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid data: float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > []int{typeUint16: 2, typeUint32: 4, typeUint64: 8}[t] {
+			return nil, 0, errors.New("invalid data: unsigned integer size")
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, off, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid data: int32 size")
+		}
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(v)), off, nil
+		}
+		return int64(v), off, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errors.New("invalid data: uint128 size")
+		}
+		return new(big.Int).SetBytes(b), off, nil
+	}
+
+	return nil, 0, fmt.Errorf("invalid data: unsupported type %d", t)
+}
+
+// pointer decodes the value a pointer refers to, returning the offset following the pointer itself
+func (d decoder) pointer(ctrl byte, off, depth int) (any, int, error) {
+	n := int(ctrl>>3&0x3) + 1
+	if off+n > len(d.buf) {
+		return nil, 0, errors.New("invalid data: truncated pointer")
+	}
+
+	p := 0
+	if n < 4 {
+		p = int(ctrl & 0x7)
+	}
+	for _, b := range d.buf[off : off+n] {
+		p = p<<8 | int(b)
+	}
+	p += []int{0, 2048, 526336, 0}[n-1]
+
+	v, _, err := d.decode(p, depth+1)
+	return v, off + n, err
+}
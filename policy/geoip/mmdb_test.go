@@ -0,0 +1,460 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// encode encodes a value in the MaxMind DB data format
+func encode(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(control(typeString, len(v)), v...)
+	case []byte:
+		return append(control(typeBytes, len(v)), v...)
+	case bool:
+		n := 0
+		if v {
+			n = 1
+		}
+		return control(typeBool, n)
+	case float64:
+		return binary.BigEndian.AppendUint64(control(typeDouble, 8), math.Float64bits(v))
+	case float32:
+		return binary.BigEndian.AppendUint32(control(typeFloat, 4), math.Float32bits(v))
+	case uint16:
+		return append(control(typeUint16, 2), byte(v>>8), byte(v))
+	case uint32:
+		return binary.BigEndian.AppendUint32(control(typeUint32, 4), v)
+	case uint64:
+		return binary.BigEndian.AppendUint64(control(typeUint64, 8), v)
+	case int32:
+		return binary.BigEndian.AppendUint32(control(typeInt32, 4), uint32(v))
+	case *big.Int:
+		return append(control(typeUint128, len(v.Bytes())), v.Bytes()...)
+	case []any:
+		out := control(typeArray, len(v))
+		for _, e := range v {
+			out = append(out, encode(e)...)
+		}
+		return out
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		out := control(typeMap, len(v))
+		for _, k := range keys {
+			out = append(out, encode(k)...)
+			out = append(out, encode(v[k])...)
+		}
+		return out
+	}
+	panic("unsupported type")
+}
+
+// control encodes the control byte of a value of the type and size
+func control(t, size int) []byte {
+	var out []byte
+	if t > 7 {
+		out = []byte{0, byte(t - 7)}
+	} else {
+		out = []byte{byte(t << 5)}
+	}
+
+	switch {
+	case size < 29:
+		out[0] |= byte(size)
+	case size < 285:
+		out[0] |= 29
+		out = append(out, byte(size-29))
+	case size < 65821:
+		out[0] |= 30
+		out = append(out, byte((size-285)>>8), byte(size-285))
+	default:
+		out[0] |= 31
+		out = append(out, byte((size-65821)>>16), byte((size-65821)>>8), byte(size-65821))
+	}
+	return out
+}
+
+// network is a record of a test database
+type network struct {
+	cidr  string
+	value map[string]any
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	value    int // the index of the value of a leaf, or -1
+	index    uint
+}
+
+// buildDB writes an IPv6 database with the record size holding the networks, which may not overlap.
+// IPv4 networks are stored under ::/96
+func buildDB(recordSize int, dbType string, networks ...network) []byte {
+	root := &trieNode{value: -1}
+	var data []byte
+	var offsets []int
+	for i, n := range networks {
+		ip, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		ones, _ := ipnet.Mask.Size()
+		if ip.To4() != nil {
+			ones += 96
+		}
+		ip = ip.To16()
+		if ip.To4() != nil {
+			copy(ip[10:12], []byte{0, 0})
+		}
+
+		node := root
+		for bit := 0; bit < ones; bit++ {
+			b := (ip[bit/8] >> (7 - bit%8)) & 1
+			if node.children[b] == nil {
+				node.children[b] = &trieNode{value: -1}
+			}
+			node = node.children[b]
+		}
+		node.value = i
+
+		offsets = append(offsets, len(data))
+		data = append(data, encode(n.value)...)
+	}
+
+	// number the inner nodes breadth first
+	var nodes []*trieNode
+	queue := []*trieNode{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		n.index = uint(len(nodes))
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil && c.value < 0 {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	count := uint(len(nodes))
+	var tree []byte
+	for _, n := range nodes {
+		var records [2]uint
+		for b, c := range n.children {
+			switch {
+			case c == nil:
+				records[b] = count
+			case c.value >= 0:
+				records[b] = count + 16 + uint(offsets[c.value])
+			default:
+				records[b] = c.index
+			}
+		}
+
+		l, r := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24)&0x0f, byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			tree = binary.BigEndian.AppendUint32(tree, uint32(l))
+			tree = binary.BigEndian.AppendUint32(tree, uint32(r))
+		}
+	}
+
+	out := append(tree, make([]byte, 16)...)
+	out = append(out, data...)
+	out = append(out, metadataMarker...)
+	return append(out, encode(map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"database_type":               dbType,
+		"ip_version":                  uint16(6),
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(recordSize),
+	})...)
+}
+
+var testNetworks = []network{
+	{cidr: "81.2.69.0/24", value: map[string]any{"country": map[string]any{"iso_code": "GB"}}},
+	{cidr: "89.160.20.112/28", value: map[string]any{"country": map[string]any{"iso_code": "SE"}}},
+	{cidr: "2001:db8::/32", value: map[string]any{"registered_country": map[string]any{"iso_code": "DE"}}},
+}
+
+func TestReader(t *testing.T) {
+	for _, size := range []int{24, 28, 32} {
+		r, err := NewReader(buildDB(size, "Test-Country", testNetworks...))
+		require.NoError(t, err, size)
+		require.Equal(t, "Test-Country", r.Metadata.DatabaseType)
+		require.Equal(t, 6, r.Metadata.IPVersion)
+		require.Equal(t, size, r.Metadata.RecordSize)
+		require.Equal(t, uint64(1700000000), r.Metadata.BuildEpoch)
+
+		tests := []struct {
+			ip     string
+			expect any
+		}{
+			{ip: "81.2.69.142", expect: testNetworks[0].value},
+			{ip: "89.160.20.120", expect: testNetworks[1].value},
+			{ip: "2001:db8:1::1", expect: testNetworks[2].value},
+			{ip: "89.160.20.128", expect: nil},
+			{ip: "127.0.0.1", expect: nil},
+			{ip: "2001:db9::1", expect: nil},
+		}
+
+		for _, tt := range tests {
+			v, err := r.Lookup(net.ParseIP(tt.ip))
+			require.NoError(t, err, tt.ip)
+			require.Equal(t, tt.expect, v, "%s with %d bit records", tt.ip, size)
+		}
+	}
+}
+
+func TestReaderLargeRecords(t *testing.T) {
+	// enough networks that 28 bit records use their upper bits
+	var networks []network
+	for i := 0; i < 64; i++ {
+		networks = append(networks, network{
+			cidr:  net.IPv4(10, byte(i), 0, 0).String() + "/16",
+			value: map[string]any{"padding": string(make([]byte, 300000)), "i": uint32(i)},
+		})
+	}
+
+	r, err := NewReader(buildDB(28, "Test", networks...))
+	require.NoError(t, err)
+
+	v, err := r.Lookup(net.ParseIP("10.63.1.1"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(63), field(v, "i"))
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	require.NoError(t, os.WriteFile(path, buildDB(24, "Test-Country", testNetworks...), 0600))
+
+	r, err := Open(path)
+	require.NoError(t, err)
+	require.Equal(t, "Test-Country", r.Metadata.DatabaseType)
+
+	_, err = Open(filepath.Join(t.TempDir(), "missing.mmdb"))
+	require.Error(t, err)
+}
+
+func TestNewReaderErrors(t *testing.T) {
+	valid := buildDB(24, "Test", testNetworks...)
+	metadata := func(m map[string]any) []byte {
+		return append(append([]byte{}, metadataMarker...), encode(m)...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "Failure - no metadata",
+			data: valid[:100],
+		},
+		{
+			name: "Failure - metadata not a map",
+			data: append(append([]byte{}, metadataMarker...), encode("metadata")...),
+		},
+		{
+			name: "Failure - truncated metadata",
+			data: valid[:len(valid)-10],
+		},
+		{
+			name: "Failure - unsupported record size",
+			data: metadata(map[string]any{"node_count": uint32(1), "record_size": uint16(20), "ip_version": uint16(6)}),
+		},
+		{
+			name: "Failure - unsupported ip version",
+			data: metadata(map[string]any{"node_count": uint32(1), "record_size": uint16(24), "ip_version": uint16(5)}),
+		},
+		{
+			name: "Failure - tree exceeds file",
+			data: metadata(map[string]any{"node_count": uint32(1000), "record_size": uint16(24), "ip_version": uint16(6)}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, err := NewReader(tt.data)
+			require.Error(t, err)
+
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	values := []any{
+		"",
+		"hello",
+		string(make([]byte, 100)),
+		string(make([]byte, 1000)),
+		string(make([]byte, 70000)),
+		[]byte{1, 2, 3},
+		true,
+		false,
+		1.5,
+		float32(2.5),
+		uint64(65535),
+		uint64(4294967295),
+		uint64(math.MaxUint64),
+		int64(-5),
+		new(big.Int).Lsh(big.NewInt(1), 100),
+		[]any{"a", uint64(1)},
+		map[string]any{"names": map[string]any{"en": "Germany"}},
+	}
+
+	for _, v := range values {
+		in := v
+		switch n := v.(type) {
+		case uint64:
+			if n <= math.MaxUint16 {
+				in = uint16(n)
+			} else if n <= math.MaxUint32 {
+				in = uint32(n)
+			}
+		case int64:
+			in = int32(n)
+		}
+
+		got, next, err := decoder{buf: encode(in)}.decode(0, 0)
+		require.NoError(t, err)
+		require.Equal(t, v, got)
+		require.Equal(t, len(encode(in)), next)
+	}
+}
+
+func TestDecodePointers(t *testing.T) {
+	d := decoder{buf: append(encode("country"), encode(map[string]any{})...)}
+
+	// a map whose key and value point to the string at offset 0
+	d.buf = append(d.buf, byte(typeMap<<5|1), byte(typePointer<<5), 0, byte(typePointer<<5), 0)
+	v, next, err := d.decode(9, 0)
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"country": "country"}, v)
+	require.Equal(t, len(d.buf), next)
+
+	// pointers with larger sizes
+	buf := make([]byte, 600000)
+	copy(buf[2048:], encode("a"))
+	copy(buf[526336+2048+1:], encode("b"))
+	buf[0] = byte(typePointer<<5 | 1<<3)
+	v, _, err = decoder{buf: buf}.decode(0, 0)
+	require.NoError(t, err)
+	require.Equal(t, "a", v)
+
+	buf[0], buf[1], buf[2], buf[3] = byte(typePointer<<5|2<<3), 0, 0x08, 0x01
+	v, _, err = decoder{buf: buf}.decode(0, 0)
+	require.NoError(t, err)
+	require.Equal(t, "b", v)
+
+	binary.BigEndian.PutUint32(buf[1:], 2048)
+	buf[0] = byte(typePointer<<5 | 3<<3)
+	v, _, err = decoder{buf: buf}.decode(0, 0)
+	require.NoError(t, err)
+	require.Equal(t, "a", v)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "Failure - empty",
+			data: nil,
+		},
+		{
+			name: "Failure - truncated string",
+			data: encode("hello")[:3],
+		},
+		{
+			name: "Failure - truncated extended type",
+			data: []byte{0},
+		},
+		{
+			name: "Failure - truncated size",
+			data: []byte{typeString<<5 | 30, 1},
+		},
+		{
+			name: "Failure - truncated pointer",
+			data: []byte{typePointer<<5 | 3<<3, 0},
+		},
+		{
+			name: "Failure - pointer out of range",
+			data: []byte{typePointer<<5 | 1, 0},
+		},
+		{
+			name: "Failure - pointer loop",
+			data: []byte{typePointer << 5, 0},
+		},
+		{
+			name: "Failure - map key not a string",
+			data: append([]byte{typeMap<<5 | 1}, encode(uint32(1))...),
+		},
+		{
+			name: "Failure - truncated map",
+			data: []byte{typeMap<<5 | 1},
+		},
+		{
+			name: "Failure - truncated array",
+			data: []byte{1, typeArray - 7},
+		},
+		{
+			name: "Failure - double size",
+			data: []byte{typeDouble<<5 | 4, 0, 0, 0, 0},
+		},
+		{
+			name: "Failure - float size",
+			data: []byte{0, typeFloat - 7},
+		},
+		{
+			name: "Failure - uint16 size",
+			data: []byte{typeUint16<<5 | 3, 0, 0, 0},
+		},
+		{
+			name: "Failure - int32 size",
+			data: []byte{5, typeInt32 - 7, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "Failure - bool size",
+			data: []byte{2, typeBool - 7},
+		},
+		{
+			name: "Failure - container",
+			data: []byte{0, typeContainer - 7},
+		},
+		{
+			name: "Failure - end marker",
+			data: []byte{0, typeEndMarker - 7},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, _, err := decoder{buf: tt.data}.decode(0, 0)
+			require.Error(t, err)
+
+		})
+	}
+}
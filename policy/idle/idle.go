@@ -0,0 +1,273 @@
+package idle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// ByUsername times out the clients of each username
+func ByUsername(cl *mqtt.Client) string {
+	return string(cl.Properties.Username)
+}
+
+// Audit is the JSON payload published to the audit topic when an idle client is disconnected
+type Audit struct {
+	Client       string    `json:"client"`
+	Username     string    `json:"username,omitempty"`
+	Key          string    `json:"key,omitempty"`
+	Remote       string    `json:"remote,omitempty"`
+	Reason       string    `json:"reason"`
+	Timeout      int64     `json:"timeout"` // the idle timeout of the key in seconds
+	LastActivity time.Time `json:"last_activity"`
+	Time         time.Time `json:"time"`
+}
+
+// activity is when a client last published or received a message
+type activity struct {
+	key     string
+	timeout time.Duration
+	last    time.Time
+}
+
+// Hook is a hook that disconnects the clients which have not published or received a message for the
+// idle timeout of their username or tenant, however often they ping the broker
+type Hook struct {
+	config  Options
+	clients map[*mqtt.Client]*activity // the established clients which time out
+	now     func() time.Time
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mu      sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the idle hook
+type Options struct {
+	// Timeout is how long the clients of each key may be idle, and Timeouts overrides it for
+	// particular keys. Keys without a timeout, or a timeout of 0, are not timed out
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+
+	// Key returns what the timeout is chosen by for the client, defaults to ByUsername, and may
+	// return a tenant derived from the username
+	Key func(cl *mqtt.Client) string
+
+	// Interval is how often idle clients are looked for, and defaults to 10 seconds, so clients are
+	// disconnected up to Interval after their timeout
+	Interval time.Duration
+
+	// Server disconnects the idle clients. Required
+	Server *mqtt.Server
+
+	// AuditTopic is where an Audit is published when an idle client is disconnected, eg.
+	// $SYS/idle/{key}/{client}, which needs the inline client of the server enabled. No audit is
+	// published if it is empty
+	AuditTopic string
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "idle-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnPublished,
+		mqtt.OnPacketSent,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts looking for idle clients
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	idleHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if idleHookConfig.Timeout <= 0 && len(idleHookConfig.Timeouts) == 0 {
+		return errors.New("timeout or timeouts is required")
+	}
+
+	if idleHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if idleHookConfig.Key == nil {
+		idleHookConfig.Key = ByUsername
+	}
+
+	if idleHookConfig.Interval <= 0 {
+		idleHookConfig.Interval = 10 * time.Second
+	}
+
+	h.config = idleHookConfig
+	h.clients = make(map[*mqtt.Client]*activity)
+	h.now = time.Now
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.done = make(chan struct{})
+	go h.reapEvery(ctx, idleHookConfig.Interval)
+
+	return nil
+}
+
+// Stop stops looking for idle clients
+func (h *Hook) Stop() error {
+	if h.cancel == nil {
+		return nil
+	}
+
+	h.cancel()
+	<-h.done
+	return nil
+}
+
+// reapEvery disconnects the idle clients at the interval until the context is cancelled
+func (h *Hook) reapEvery(ctx context.Context, interval time.Duration) {
+	defer close(h.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.Reap()
+		}
+	}
+}
+
+// timeout returns the idle timeout of the key, or 0 if it is not timed out
+func (h *Hook) timeout(key string) time.Duration {
+	if t, ok := h.config.Timeouts[key]; ok {
+		return t
+	}
+	return h.config.Timeout
+}
+
+// Reap disconnects the clients which have been idle for longer than their timeout, and returns how
+// many were disconnected
+func (h *Hook) Reap() int {
+	type idleClient struct {
+		cl *mqtt.Client
+		a  activity
+	}
+
+	now := h.now()
+
+	h.mu.Lock()
+	var idle []idleClient
+	for cl, a := range h.clients {
+		if now.Sub(a.last) >= a.timeout {
+			idle = append(idle, idleClient{cl: cl, a: *a})
+			delete(h.clients, cl)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, i := range idle {
+		if i.cl.Closed() {
+			continue
+		}
+
+		h.Log.Info("disconnecting idle client", "client", i.cl.ID, "key", i.a.key, "timeout", i.a.timeout, "last_activity", i.a.last)
+		if err := h.config.Server.DisconnectClient(i.cl, packets.ErrAdministrativeAction); err != nil {
+			h.Log.Error("error occurred while disconnecting client", "error", err, "client", i.cl.ID)
+		}
+
+		h.audit(Audit{
+			Client:       i.cl.ID,
+			Username:     string(i.cl.Properties.Username),
+			Key:          i.a.key,
+			Remote:       i.cl.Net.Remote,
+			Reason:       "idle for longer than " + i.a.timeout.String(),
+			Timeout:      int64(i.a.timeout / time.Second),
+			LastActivity: i.a.last,
+			Time:         now,
+		})
+	}
+
+	return len(idle)
+}
+
+// audit publishes the audit if an audit topic is configured
+func (h *Hook) audit(a Audit) {
+	if h.config.AuditTopic == "" {
+		return
+	}
+
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+
+	topic := strings.NewReplacer("{key}", a.Key, "{client}", a.Client).Replace(h.config.AuditTopic)
+	if err := h.config.Server.Publish(topic, payload, false, 0); err != nil {
+		h.Log.Error("error occurred while publishing idle audit", "error", err, "topic", topic)
+	}
+}
+
+// active records that the client published or received a message
+func (h *Hook) active(cl *mqtt.Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if a, ok := h.clients[cl]; ok {
+		a.last = h.now()
+	}
+}
+
+// OnSessionEstablished is called when a client has connected and authenticated, and starts timing
+// it out if its key has a timeout
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if cl.Net.Inline {
+		return
+	}
+
+	key := h.config.Key(cl)
+	timeout := h.timeout(key)
+	if timeout <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[cl] = &activity{key: key, timeout: timeout, last: h.now()}
+}
+
+// OnPublished is called when a client has published a message, which makes it active
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.active(cl)
+}
+
+// OnPacketSent is called when a packet is sent to a client, and a message makes it active
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if pk.FixedHeader.Type == packets.Publish {
+		h.active(cl)
+	}
+}
+
+// OnDisconnect is called when a client disconnects, and stops timing it out
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, cl)
+}
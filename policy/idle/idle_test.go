@@ -0,0 +1,217 @@
+package idle
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	idleHook := new(Hook)
+	idleHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, idleHook.Init(options))
+	t.Cleanup(func() { idleHook.Stop() })
+	return idleHook
+}
+
+func connectedClient(t *testing.T, s *mqtt.Server, id, username string) *mqtt.Client {
+	t.Helper()
+
+	r, w := net.Pipe()
+	go io.Copy(io.Discard, w)
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	cl := s.NewClient(r, "tcp", id, false)
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte(username)
+	cl.Net.Remote = "10.0.0.1:51234"
+	return cl
+}
+
+func TestID(t *testing.T) {
+	idleHook := new(Hook)
+
+	require.Equal(t, "idle-policy-hook", idleHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	idleHook := new(Hook)
+	require.True(t, idleHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, idleHook.Provides(mqtt.OnPublished))
+	require.True(t, idleHook.Provides(mqtt.OnPacketSent))
+	require.True(t, idleHook.Provides(mqtt.OnDisconnect))
+	require.False(t, idleHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - timeout",
+			config:      Options{Timeout: time.Hour, Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Success - timeouts",
+			config:      Options{Timeouts: map[string]time.Duration{"acme": time.Hour}, Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no timeout",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{Timeout: time.Hour},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			idleHook := new(Hook)
+			idleHook.Log = slog.Default()
+			err := idleHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer idleHook.Stop()
+
+			require.NotNil(t, idleHook.config.Key)
+			require.Equal(t, 10*time.Second, idleHook.config.Interval)
+
+		})
+	}
+}
+
+func TestReap(t *testing.T) {
+	s := mqtt.New(&mqtt.Options{InlineClient: true})
+	audits := make(chan packets.Packet, 10)
+	require.NoError(t, s.Subscribe("$SYS/idle/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		audits <- pk
+	}))
+
+	idleHook := newHook(t, Options{
+		Timeout:    time.Minute,
+		Timeouts:   map[string]time.Duration{"vip": 10 * time.Minute, "free": 0},
+		Interval:   time.Hour,
+		Server:     s,
+		AuditTopic: "$SYS/idle/{key}/{client}",
+	})
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	idleHook.now = func() time.Time { return now }
+
+	a := connectedClient(t, s, "a", "acme")
+	b := connectedClient(t, s, "b", "acme")
+	c := connectedClient(t, s, "c", "vip")
+	d := connectedClient(t, s, "d", "free")
+	for _, cl := range []*mqtt.Client{a, b, c, d, s.NewClient(nil, "local", "inline", true)} {
+		idleHook.OnSessionEstablished(cl, packets.Packet{})
+	}
+
+	// publishing and receiving messages keeps clients active, but pings don't
+	now = start.Add(30 * time.Second)
+	idleHook.OnPublished(a, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}})
+	idleHook.OnPacketSent(b, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pingresp}}, nil)
+
+	now = start.Add(45 * time.Second)
+	require.Zero(t, idleHook.Reap())
+
+	now = start.Add(time.Minute)
+	idleHook.OnPacketSent(a, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish}}, nil)
+	require.Equal(t, 1, idleHook.Reap())
+	require.True(t, b.Closed())
+	require.False(t, a.Closed())
+
+	select {
+	case pk := <-audits:
+		require.Equal(t, "$SYS/idle/acme/b", pk.TopicName)
+
+		var audit Audit
+		require.NoError(t, json.Unmarshal(pk.Payload, &audit))
+		require.Equal(t, Audit{
+			Client:       "b",
+			Username:     "acme",
+			Key:          "acme",
+			Remote:       "10.0.0.1:51234",
+			Reason:       "idle for longer than 1m0s",
+			Timeout:      60,
+			LastActivity: start,
+			Time:         start.Add(time.Minute),
+		}, audit)
+	case <-time.After(time.Second):
+		require.Fail(t, "no audit published")
+	}
+
+	// each key has its own timeout, and keys without one are never disconnected
+	now = start.Add(2 * time.Minute)
+	require.Equal(t, 1, idleHook.Reap())
+	require.True(t, a.Closed())
+
+	now = start.Add(time.Hour)
+	require.Equal(t, 1, idleHook.Reap())
+	require.True(t, c.Closed())
+	require.False(t, d.Closed())
+	require.Zero(t, idleHook.Reap())
+}
+
+func TestDisconnect(t *testing.T) {
+	s := mqtt.New(nil)
+	idleHook := newHook(t, Options{Timeout: time.Minute, Interval: time.Hour, Server: s})
+
+	now := time.Now()
+	idleHook.now = func() time.Time { return now }
+
+	a := connectedClient(t, s, "a", "acme")
+	idleHook.OnSessionEstablished(a, packets.Packet{})
+	idleHook.OnDisconnect(a, nil, false)
+
+	now = now.Add(time.Hour)
+	require.Zero(t, idleHook.Reap())
+	require.False(t, a.Closed())
+}
+
+func TestReapEvery(t *testing.T) {
+	s := mqtt.New(nil)
+	idleHook := newHook(t, Options{Timeout: 20 * time.Millisecond, Interval: 10 * time.Millisecond, Server: s})
+
+	a := connectedClient(t, s, "a", "acme")
+	idleHook.OnSessionEstablished(a, packets.Packet{})
+	require.Eventually(t, a.Closed, time.Second, time.Millisecond)
+}
+
+func TestStop(t *testing.T) {
+	require.NoError(t, new(Hook).Stop())
+}
@@ -0,0 +1,124 @@
+package payload
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// Config is the contents of a rules file, which may be written in YAML or JSON, eg.
+//
+//	default:
+//	  max_payload: 262144
+//	  max_retained: 65536
+//	rules:
+//	  - topic: telemetry/+/raw
+//	    max_payload: 1048576
+//	    max_qos: 0
+//	  - topic: commands/#
+//	    max_payload: 1024
+//	    max_retained: -1
+//
+// The first rule whose topic filter matches the topic of a message applies, and the limits it doesn't
+// set are taken from the default
+type Config struct {
+	Default Limits `yaml:"default" json:"default"`
+	Rules   []Rule `yaml:"rules" json:"rules"`
+}
+
+// Limits are the limits of the messages published to a topic
+type Limits struct {
+	// MaxPayload is the largest payload in bytes, and 0 is unlimited
+	MaxPayload int `yaml:"max_payload" json:"max_payload,omitempty"`
+
+	// MaxRetained is the largest payload in bytes of a retained message, 0 is unlimited, and a
+	// negative limit rejects retained messages
+	MaxRetained int `yaml:"max_retained" json:"max_retained,omitempty"`
+
+	// MaxQoS is the highest QoS of publishes, and of the subscriptions granted to matching topic
+	// filters, and nil is unlimited
+	MaxQoS *byte `yaml:"max_qos" json:"max_qos,omitempty"`
+}
+
+// Rule sets the limits of the topics matching its filter, which may contain +/# wildcards
+type Rule struct {
+	Topic  string `yaml:"topic" json:"topic"`
+	Limits `yaml:",inline"`
+}
+
+// LoadConfig reads and validates a rules file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(data)
+}
+
+// ParseConfig parses and validates the contents of a rules file. As YAML is a superset of JSON, both
+// are parsed as YAML
+func ParseConfig(data []byte) (*Config, error) {
+	config := new(Config)
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// validate checks the topic filters and QoS of the rules
+func (c *Config) validate() error {
+	if c.Default.MaxQoS != nil && *c.Default.MaxQoS > 2 {
+		return fmt.Errorf("default has invalid max qos %d", *c.Default.MaxQoS)
+	}
+
+	for i, rule := range c.Rules {
+		if !mqtt.IsValidFilter(rule.Topic, false) {
+			return fmt.Errorf("rule %d has invalid topic filter %q", i, rule.Topic)
+		}
+
+		if rule.MaxQoS != nil && *rule.MaxQoS > 2 {
+			return fmt.Errorf("rule %d has invalid max qos %d", i, *rule.MaxQoS)
+		}
+	}
+
+	return nil
+}
+
+// Limits returns the limits of the topic, which may also be a subscription filter
+func (c *Config) Limits(topic string) Limits {
+	limits := c.Default
+	for _, rule := range c.Rules {
+		if !acl.Match(rule.Topic, topic) {
+			continue
+		}
+
+		if rule.MaxPayload != 0 {
+			limits.MaxPayload = rule.MaxPayload
+		}
+		if rule.MaxRetained != 0 {
+			limits.MaxRetained = rule.MaxRetained
+		}
+		if rule.MaxQoS != nil {
+			limits.MaxQoS = rule.MaxQoS
+		}
+		break
+	}
+
+	return limits
+}
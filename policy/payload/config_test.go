@@ -0,0 +1,122 @@
+package payload
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testYAML = `
+default:
+  max_payload: 100
+  max_retained: 10
+rules:
+  - topic: telemetry/+/raw
+    max_payload: 1000
+    max_qos: 0
+  - topic: commands/#
+    max_retained: -1
+  - topic: "#"
+    max_qos: 1
+`
+
+func qos(q byte) *byte {
+	return &q
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expectRules int
+		expectError bool
+	}{
+		{
+			name:        "Success - yaml",
+			data:        testYAML,
+			expectRules: 3,
+		},
+		{
+			name:        "Success - json",
+			data:        `{"default": {"max_payload": 100}, "rules": [{"topic": "a/#", "max_qos": 1}]}`,
+			expectRules: 1,
+		},
+		{
+			name: "Success - empty",
+			data: "",
+		},
+		{
+			name:        "Failure - unknown field",
+			data:        "default:\n  max_size: 100\n",
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid topic filter",
+			data:        "rules:\n  - topic: a/#/b\n",
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule qos",
+			data:        "rules:\n  - topic: a\n    max_qos: 3\n",
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid default qos",
+			data:        "default:\n  max_qos: 3\n",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			config, err := ParseConfig([]byte(tt.data))
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, config.Rules, tt.expectRules)
+
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	config, err := ParseConfig([]byte(testYAML))
+	require.NoError(t, err)
+
+	tests := []struct {
+		topic  string
+		expect Limits
+	}{
+		{
+			topic:  "telemetry/a/raw",
+			expect: Limits{MaxPayload: 1000, MaxRetained: 10, MaxQoS: qos(0)},
+		},
+		{
+			topic:  "commands/a",
+			expect: Limits{MaxPayload: 100, MaxRetained: -1},
+		},
+		{
+			topic:  "other",
+			expect: Limits{MaxPayload: 100, MaxRetained: 10, MaxQoS: qos(1)},
+		},
+		{
+			topic:  "$SYS/other",
+			expect: Limits{MaxPayload: 100, MaxRetained: 10},
+		},
+		{
+			topic:  "telemetry/#",
+			expect: Limits{MaxPayload: 100, MaxRetained: 10, MaxQoS: qos(1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+
+			require.Equal(t, tt.expect, config.Limits(tt.topic))
+
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package payload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// Hook is a hook that rejects publishes exceeding the payload size, retained size and QoS limits of
+// their topic, and caps the QoS granted to subscriptions
+type Hook struct {
+	config   Options
+	rules    atomic.Pointer[Config]
+	modified time.Time
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the payload hook
+type Options struct {
+	Path   string  // the rules file, in YAML or JSON
+	Config *Config // used instead of Path if set
+
+	// ReloadInterval is how often the rules file is checked for changes. A file which fails to load
+	// leaves the current rules in place
+	ReloadInterval time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "payload-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+		mqtt.OnSubscribe,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	payloadHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if payloadHookConfig.Path == "" && payloadHookConfig.Config == nil {
+		return errors.New("path or config is required")
+	}
+
+	h.config = payloadHookConfig
+	if err := h.Reload(); err != nil {
+		return err
+	}
+
+	if payloadHookConfig.Path != "" && payloadHookConfig.ReloadInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		h.cancel = cancel
+		go h.watch(ctx)
+	}
+
+	return nil
+}
+
+// Stop stops watching the rules file
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// watch reloads the rules file when it changes, until the context is cancelled
+func (h *Hook) watch(ctx context.Context) {
+	ticker := time.NewTicker(h.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(h.config.Path)
+			if err != nil {
+				continue
+			}
+
+			h.mu.Lock()
+			changed := !info.ModTime().Equal(h.modified)
+			h.mu.Unlock()
+			if !changed {
+				continue
+			}
+
+			if err := h.Reload(); err != nil {
+				h.Log.Error("error occurred while reloading payload rules", "error", err)
+			}
+		}
+	}
+}
+
+// Reload reads the rules file again and atomically swaps in its rules. If the file cannot be loaded,
+// the current rules are kept
+func (h *Hook) Reload() error {
+	if h.config.Path == "" {
+		if err := h.config.Config.validate(); err != nil {
+			return err
+		}
+		h.rules.Store(h.config.Config)
+		return nil
+	}
+
+	info, err := os.Stat(h.config.Path)
+	if err != nil {
+		return err
+	}
+
+	rules, err := LoadConfig(h.config.Path)
+	if err != nil {
+		return err
+	}
+
+	h.rules.Store(rules)
+
+	h.mu.Lock()
+	h.modified = info.ModTime()
+	h.mu.Unlock()
+	return nil
+}
+
+// OnPublish is called when a client publishes a message, and rejects it if it exceeds the limits of
+// its topic
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	limits := h.rules.Load().Limits(pk.TopicName)
+	size := len(pk.Payload)
+
+	if limits.MaxQoS != nil && pk.FixedHeader.Qos > *limits.MaxQoS {
+		h.Log.Debug("rejecting publish exceeding max qos", "client", cl.ID, "topic", pk.TopicName, "qos", pk.FixedHeader.Qos)
+		return pk, reject.Publish(cl, pk, packets.ErrQosNotSupported)
+	}
+
+	if limits.MaxPayload > 0 && size > limits.MaxPayload {
+		h.Log.Debug("rejecting publish exceeding max payload", "client", cl.ID, "topic", pk.TopicName, "size", size)
+		return pk, reject.Publish(cl, pk, packets.ErrPacketTooLarge)
+	}
+
+	// an empty retained message clears the retained message of the topic, so is always allowed
+	if pk.FixedHeader.Retain && size > 0 {
+		if limits.MaxRetained < 0 {
+			h.Log.Debug("rejecting retained publish", "client", cl.ID, "topic", pk.TopicName)
+			return pk, reject.Publish(cl, pk, packets.ErrRetainNotSupported)
+		}
+
+		if limits.MaxRetained > 0 && size > limits.MaxRetained {
+			h.Log.Debug("rejecting retained publish exceeding max retained", "client", cl.ID, "topic", pk.TopicName, "size", size)
+			return pk, reject.Publish(cl, pk, packets.ErrPacketTooLarge)
+		}
+	}
+
+	return pk, nil
+}
+
+// OnSubscribe is called when a client subscribes, and caps the QoS of filters matching a rule with a
+// max qos
+func (h *Hook) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	rules := h.rules.Load()
+	for i, sub := range pk.Filters {
+		limits := rules.Limits(sub.Filter)
+		if limits.MaxQoS != nil && sub.Qos > *limits.MaxQoS {
+			pk.Filters[i].Qos = *limits.MaxQoS
+		}
+	}
+
+	return pk
+}
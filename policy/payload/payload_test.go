@@ -0,0 +1,261 @@
+package payload
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	payloadHook := new(Hook)
+	payloadHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, payloadHook.Init(options))
+	t.Cleanup(func() { payloadHook.Stop() })
+	return payloadHook
+}
+
+func writeConfig(t *testing.T, path, data string, age time.Duration) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+	modified := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, modified, modified))
+}
+
+func TestID(t *testing.T) {
+	payloadHook := new(Hook)
+
+	require.Equal(t, "payload-policy-hook", payloadHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	payloadHook := new(Hook)
+	require.True(t, payloadHook.Provides(mqtt.OnPublish))
+	require.True(t, payloadHook.Provides(mqtt.OnSubscribe))
+	require.False(t, payloadHook.Provides(mqtt.OnConnect))
+}
+
+func TestInit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	writeConfig(t, path, testYAML, time.Hour)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - path",
+			config:      Options{Path: path},
+			expectError: false,
+		},
+		{
+			name:        "Success - config",
+			config:      Options{Config: &Config{Default: Limits{MaxPayload: 100}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing file",
+			config:      Options{Path: filepath.Join(t.TempDir(), "missing.yaml")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid config",
+			config:      Options{Config: &Config{Rules: []Rule{{Topic: "a/#/b"}}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			payloadHook := new(Hook)
+			payloadHook.Log = slog.Default()
+			err := payloadHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, payloadHook.rules.Load())
+			require.NoError(t, payloadHook.Stop())
+
+		})
+	}
+}
+
+func TestOnPublish(t *testing.T) {
+	config, err := ParseConfig([]byte(testYAML))
+	require.NoError(t, err)
+	payloadHook := newHook(t, Options{Config: config})
+
+	tests := []struct {
+		name    string
+		version byte
+		inline  bool
+		topic   string
+		qos     byte
+		retain  bool
+		size    int
+		expect  error
+	}{
+		{
+			name:    "Success - within limits",
+			version: 5,
+			topic:   "sensors/a",
+			qos:     1,
+			size:    100,
+		},
+		{
+			name:    "Success - rule payload limit",
+			version: 5,
+			topic:   "telemetry/a/raw",
+			size:    1000,
+		},
+		{
+			name:    "Success - clearing retained",
+			version: 5,
+			topic:   "commands/a",
+			retain:  true,
+		},
+		{
+			name:    "Success - inline client",
+			version: 5,
+			inline:  true,
+			topic:   "sensors/a",
+			qos:     2,
+			size:    1000,
+		},
+		{
+			name:    "Failure - payload too large",
+			version: 5,
+			topic:   "sensors/a",
+			qos:     1,
+			size:    101,
+			expect:  packets.ErrPacketTooLarge,
+		},
+		{
+			name:    "Failure - payload too large qos 0",
+			version: 5,
+			topic:   "sensors/a",
+			size:    101,
+			expect:  packets.ErrRejectPacket,
+		},
+		{
+			name:    "Failure - payload too large v3",
+			version: 4,
+			topic:   "sensors/a",
+			qos:     1,
+			size:    101,
+			expect:  packets.ErrRejectPacket,
+		},
+		{
+			name:    "Failure - qos exceeded",
+			version: 5,
+			topic:   "sensors/a",
+			qos:     2,
+			expect:  packets.ErrQosNotSupported,
+		},
+		{
+			name:    "Failure - retained too large",
+			version: 5,
+			topic:   "sensors/a",
+			qos:     1,
+			retain:  true,
+			size:    11,
+			expect:  packets.ErrPacketTooLarge,
+		},
+		{
+			name:    "Failure - retained not allowed",
+			version: 5,
+			topic:   "commands/a",
+			qos:     1,
+			retain:  true,
+			size:    1,
+			expect:  packets.ErrRetainNotSupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			cl := &mqtt.Client{ID: "a"}
+			cl.Properties.ProtocolVersion = tt.version
+			cl.Net.Inline = tt.inline
+			_, err := payloadHook.OnPublish(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: tt.qos, Retain: tt.retain},
+				TopicName:   tt.topic,
+				Payload:     []byte(strings.Repeat("x", tt.size)),
+			})
+			if tt.expect != nil {
+				require.ErrorIs(t, err, tt.expect)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+}
+
+func TestOnSubscribe(t *testing.T) {
+	config, err := ParseConfig([]byte(testYAML))
+	require.NoError(t, err)
+	payloadHook := newHook(t, Options{Config: config})
+
+	pk := payloadHook.OnSubscribe(&mqtt.Client{ID: "a"}, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Subscribe},
+		Filters: packets.Subscriptions{
+			{Filter: "telemetry/+/raw", Qos: 2},
+			{Filter: "sensors/#", Qos: 2},
+			{Filter: "sensors/a", Qos: 0},
+			{Filter: "$SYS/#", Qos: 2},
+		},
+	})
+
+	require.Equal(t, byte(0), pk.Filters[0].Qos)
+	require.Equal(t, byte(1), pk.Filters[1].Qos)
+	require.Equal(t, byte(0), pk.Filters[2].Qos)
+	require.Equal(t, byte(2), pk.Filters[3].Qos)
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	writeConfig(t, path, testYAML, time.Hour)
+
+	payloadHook := newHook(t, Options{Path: path, ReloadInterval: 10 * time.Millisecond})
+	require.Equal(t, 100, payloadHook.rules.Load().Default.MaxPayload)
+
+	// a file which fails to load leaves the rules in place
+	writeConfig(t, path, "default: [", 45*time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 100, payloadHook.rules.Load().Default.MaxPayload)
+
+	writeConfig(t, path, "default:\n  max_payload: 200\n", 30*time.Minute)
+	require.Eventually(t, func() bool {
+		return payloadHook.rules.Load().Default.MaxPayload == 200
+	}, time.Second, 5*time.Millisecond)
+}
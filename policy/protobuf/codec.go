@@ -0,0 +1,537 @@
+package protobuf
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// decode returns the message encoded in b as the values of its fields by JSON name, following the
+// JSON mapping of protobuf: 64 bit integers are strings, bytes are base64, and enums are the names of
+// their values. Fields unknown to the message type are skipped, and fields which aren't set are
+// left out, like proto3 fields with their default values
+func (m *message) decode(b []byte) (map[string]any, error) {
+	out := make(map[string]any)
+	seen := make(map[int32]bool)
+	for len(b) > 0 {
+		num, wire, n, err := consumeTag(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+
+		v, data, n, err := consumeValue(b, wire)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+
+		f := m.numbers[num]
+		if f == nil {
+			continue
+		}
+		seen[num] = true
+
+		switch {
+		case f.isMap():
+			if wire != wireBytes {
+				return nil, fmt.Errorf("wrong wire type of field %s", f.name)
+			}
+
+			key, value, err := f.message.decodeEntry(data)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", f.name, err)
+			}
+
+			entries, _ := out[f.jsonName].(map[string]any)
+			if entries == nil {
+				entries = make(map[string]any)
+				out[f.jsonName] = entries
+			}
+			entries[key] = value
+
+		case f.repeated() && wire == wireBytes && f.kind.packable():
+			values, _ := out[f.jsonName].([]any)
+			for len(data) > 0 {
+				v, _, n, err := consumeValue(data, f.kind.wire())
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %w", f.name, err)
+				}
+				data = data[n:]
+
+				value, err := f.decode(v, nil)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, value)
+			}
+			out[f.jsonName] = values
+
+		default:
+			if wire != f.kind.wire() {
+				return nil, fmt.Errorf("wrong wire type of field %s", f.name)
+			}
+
+			value, err := f.decode(v, data)
+			if err != nil {
+				return nil, err
+			}
+
+			if f.repeated() {
+				values, _ := out[f.jsonName].([]any)
+				out[f.jsonName] = append(values, value)
+			} else {
+				out[f.jsonName] = value
+			}
+		}
+	}
+
+	for _, f := range m.fields {
+		if f.label == labelRequired && !seen[f.number] {
+			return nil, fmt.Errorf("missing required field %s", f.name)
+		}
+	}
+
+	return out, nil
+}
+
+// decodeEntry returns the key of a map entry as a string, and its value
+func (m *message) decodeEntry(b []byte) (string, any, error) {
+	entry, err := m.decode(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	keyField, valueField := m.numbers[1], m.numbers[2]
+	if keyField == nil || valueField == nil {
+		return "", nil, fmt.Errorf("invalid map entry %s", m.name)
+	}
+
+	key, ok := entry[keyField.jsonName]
+	if !ok {
+		key = keyField.zero()
+	}
+
+	value, ok := entry[valueField.jsonName]
+	if !ok {
+		value = valueField.zero()
+	}
+
+	return fmt.Sprint(key), value, nil
+}
+
+// decode returns the JSON value of a value of the field, which is a number for varint and fixed
+// fields, or bytes for length delimited fields
+func (f *field) decode(v uint64, data []byte) (any, error) {
+	switch f.kind {
+	case kindDouble:
+		return jsonFloat(math.Float64frombits(v), 64), nil
+	case kindFloat:
+		return jsonFloat(float64(math.Float32frombits(uint32(v))), 32), nil
+	case kindInt64, kindSfixed64:
+		return strconv.FormatInt(int64(v), 10), nil
+	case kindUint64, kindFixed64:
+		return strconv.FormatUint(v, 10), nil
+	case kindSint64:
+		return strconv.FormatInt(unzigzag(v), 10), nil
+	case kindInt32:
+		return int64(int32(v)), nil
+	case kindSfixed32:
+		return int64(int32(uint32(v))), nil
+	case kindSint32:
+		return int64(int32(unzigzag(v))), nil
+	case kindUint32, kindFixed32:
+		return int64(uint32(v)), nil
+	case kindBool:
+		return v != 0, nil
+	case kindEnum:
+		if name, ok := f.enum.names[int32(v)]; ok {
+			return name, nil
+		}
+		return int64(int32(v)), nil
+	case kindString:
+		if !utf8.Valid(data) {
+			return nil, fmt.Errorf("invalid utf-8 in field %s", f.name)
+		}
+		return string(data), nil
+	case kindBytes:
+		return base64.StdEncoding.EncodeToString(data), nil
+	case kindMessage:
+		value, err := f.message.decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("unsupported type of field %s", f.name)
+}
+
+// zero returns the JSON value of the default value of the field
+func (f *field) zero() any {
+	switch f.kind {
+	case kindInt64, kindSfixed64, kindSint64, kindUint64, kindFixed64:
+		return "0"
+	case kindDouble, kindFloat:
+		return json.Number("0")
+	case kindBool:
+		return false
+	case kindString, kindBytes:
+		return ""
+	case kindEnum:
+		if name, ok := f.enum.names[0]; ok {
+			return name
+		}
+	case kindMessage:
+		return map[string]any{}
+	}
+	return int64(0)
+}
+
+// jsonFloat returns the JSON value of a float with the precision of its bits. NaN and infinities are
+// strings
+func jsonFloat(v float64, bits int) any {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	return json.Number(strconv.FormatFloat(v, 'g', -1, bits))
+}
+
+// unmarshal returns the message encoded from the JSON payload
+func (m *message) unmarshal(payload []byte) ([]byte, error) {
+	dec := json.NewDecoder(strings.NewReader(string(payload)))
+	dec.UseNumber()
+
+	var v map[string]any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	if dec.More() {
+		return nil, errors.New("invalid character after top-level value")
+	}
+
+	if v == nil {
+		return nil, errors.New("message is null")
+	}
+
+	return m.encode(nil, v)
+}
+
+// encode appends the message with the values of its fields by JSON name or name, as decoded with
+// UseNumber, to b. Null values are left out
+func (m *message) encode(b []byte, v map[string]any) ([]byte, error) {
+	fields := make([]*field, 0, len(v))
+	values := make(map[int32]any, len(v))
+	for key, value := range v {
+		f := m.names[key]
+		if f == nil {
+			return nil, fmt.Errorf("unknown field %q of %s", key, m.name)
+		}
+
+		if _, ok := values[f.number]; ok {
+			return nil, fmt.Errorf("duplicate field %q of %s", key, m.name)
+		}
+
+		if value != nil {
+			fields = append(fields, f)
+			values[f.number] = value
+		}
+	}
+
+	for _, f := range m.fields {
+		if _, ok := values[f.number]; f.label == labelRequired && !ok {
+			return nil, fmt.Errorf("missing required field %s", f.name)
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].number < fields[j].number
+	})
+
+	var err error
+	for _, f := range fields {
+		if b, err = f.encode(b, values[f.number]); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// encode appends the field with its JSON value to b
+func (f *field) encode(b []byte, v any) ([]byte, error) {
+	switch {
+	case f.isMap():
+		entries, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("field %s is not an object", f.name)
+		}
+
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		keyField, valueField := f.message.numbers[1], f.message.numbers[2]
+		if keyField == nil || valueField == nil {
+			return nil, fmt.Errorf("invalid map entry %s", f.message.name)
+		}
+
+		for _, key := range keys {
+			entry, err := keyField.encode(nil, mapKey(keyField, key))
+			if err != nil {
+				return nil, err
+			}
+
+			if entries[key] != nil {
+				if entry, err = valueField.encode(entry, entries[key]); err != nil {
+					return nil, err
+				}
+			}
+
+			b = appendTag(b, f.number, wireBytes)
+			b = appendBytes(b, entry)
+		}
+		return b, nil
+
+	case f.repeated():
+		values, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("field %s is not an array", f.name)
+		}
+
+		var packed []byte
+		for _, value := range values {
+			var err error
+			if f.kind.packable() {
+				packed, err = f.appendValue(packed, value)
+			} else {
+				b = appendTag(b, f.number, f.kind.wire())
+				b, err = f.appendValue(b, value)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(packed) > 0 {
+			b = appendTag(b, f.number, wireBytes)
+			b = appendBytes(b, packed)
+		}
+		return b, nil
+	}
+
+	b = appendTag(b, f.number, f.kind.wire())
+	return f.appendValue(b, v)
+}
+
+// mapKey returns the JSON value of a map key of the key field, so that it is encoded like a value
+func mapKey(f *field, key string) any {
+	switch f.kind {
+	case kindString, kindInt64, kindUint64, kindSint64, kindFixed64, kindSfixed64:
+		return key
+	case kindBool:
+		return key == "true"
+	}
+	return json.Number(key)
+}
+
+// appendValue appends a JSON value of the field to b, without its tag
+func (f *field) appendValue(b []byte, v any) ([]byte, error) {
+	switch f.kind {
+	case kindDouble:
+		n, err := parseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(n)), nil
+	case kindFloat:
+		n, err := parseFloat(v, 32)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(n))), nil
+	case kindInt64, kindInt32, kindSint64, kindSint32, kindSfixed64, kindSfixed32:
+		bits := 64
+		if f.kind == kindInt32 || f.kind == kindSint32 || f.kind == kindSfixed32 {
+			bits = 32
+		}
+
+		n, err := parseInt(v, bits)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+
+		switch f.kind {
+		case kindSint64, kindSint32:
+			return binary.AppendUvarint(b, zigzag(n)), nil
+		case kindSfixed64:
+			return binary.LittleEndian.AppendUint64(b, uint64(n)), nil
+		case kindSfixed32:
+			return binary.LittleEndian.AppendUint32(b, uint32(n)), nil
+		}
+		return binary.AppendUvarint(b, uint64(n)), nil
+	case kindUint64, kindUint32, kindFixed64, kindFixed32:
+		bits := 64
+		if f.kind == kindUint32 || f.kind == kindFixed32 {
+			bits = 32
+		}
+
+		n, err := parseUint(v, bits)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+
+		switch f.kind {
+		case kindFixed64:
+			return binary.LittleEndian.AppendUint64(b, n), nil
+		case kindFixed32:
+			return binary.LittleEndian.AppendUint32(b, uint32(n)), nil
+		}
+		return binary.AppendUvarint(b, n), nil
+	case kindBool:
+		value, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("field %s is not a boolean", f.name)
+		}
+		if value {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case kindEnum:
+		if name, ok := v.(string); ok {
+			n, ok := f.enum.numbers[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown value %q of field %s", name, f.name)
+			}
+			return binary.AppendUvarint(b, uint64(int64(n))), nil
+		}
+
+		n, err := parseInt(v, 32)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+		return binary.AppendUvarint(b, uint64(n)), nil
+	case kindString:
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("field %s is not a string", f.name)
+		}
+		return appendBytes(b, []byte(value)), nil
+	case kindBytes:
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("field %s is not a string", f.name)
+		}
+
+		data, err := decodeBase64(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s is not base64", f.name)
+		}
+		return appendBytes(b, data), nil
+	case kindMessage:
+		value, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("field %s is not an object", f.name)
+		}
+
+		data, err := f.message.encode(nil, value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+		return appendBytes(b, data), nil
+	}
+	return nil, fmt.Errorf("unsupported type of field %s", f.name)
+}
+
+// number returns the text of a JSON number, which may be quoted
+func number(v any) (string, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return string(n), nil
+	case string:
+		return n, nil
+	}
+	return "", errors.New("not a number")
+}
+
+// parseInt parses a JSON integer of the bits. Integers may be written with an exponent, eg. 1e3
+func parseInt(v any, bits int) (int64, error) {
+	s, err := number(v)
+	if err != nil {
+		return 0, err
+	}
+
+	if n, err := strconv.ParseInt(s, 10, bits); err == nil {
+		return n, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f != math.Trunc(f) || f < -math.Ldexp(1, bits-1) || f >= math.Ldexp(1, bits-1) {
+		return 0, fmt.Errorf("invalid %d bit integer %s", bits, s)
+	}
+	return int64(f), nil
+}
+
+// parseUint parses a JSON unsigned integer of the bits
+func parseUint(v any, bits int) (uint64, error) {
+	s, err := number(v)
+	if err != nil {
+		return 0, err
+	}
+
+	if n, err := strconv.ParseUint(s, 10, bits); err == nil {
+		return n, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f != math.Trunc(f) || f < 0 || f >= math.Ldexp(1, bits) {
+		return 0, fmt.Errorf("invalid %d bit unsigned integer %s", bits, s)
+	}
+	return uint64(f), nil
+}
+
+// parseFloat parses a JSON float of the bits, or the strings NaN, Infinity and -Infinity
+func parseFloat(v any, bits int) (float64, error) {
+	s, err := number(v)
+	if err != nil {
+		return 0, err
+	}
+
+	switch s {
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	}
+
+	f, err := strconv.ParseFloat(s, bits)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %d bit float %s", bits, s)
+	}
+	return f, nil
+}
+
+// decodeBase64 decodes standard or URL safe base64, with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -0,0 +1,470 @@
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// kind is the type of a field, as numbered in descriptor.proto
+type kind int32
+
+const (
+	kindDouble   kind = 1
+	kindFloat    kind = 2
+	kindInt64    kind = 3
+	kindUint64   kind = 4
+	kindInt32    kind = 5
+	kindFixed64  kind = 6
+	kindFixed32  kind = 7
+	kindBool     kind = 8
+	kindString   kind = 9
+	kindGroup    kind = 10
+	kindMessage  kind = 11
+	kindBytes    kind = 12
+	kindUint32   kind = 13
+	kindEnum     kind = 14
+	kindSfixed32 kind = 15
+	kindSfixed64 kind = 16
+	kindSint32   kind = 17
+	kindSint64   kind = 18
+)
+
+// wire returns the wire type values of the kind are encoded with
+func (k kind) wire() int {
+	switch k {
+	case kindDouble, kindFixed64, kindSfixed64:
+		return wireFixed64
+	case kindFloat, kindFixed32, kindSfixed32:
+		return wireFixed32
+	case kindString, kindBytes, kindMessage:
+		return wireBytes
+	}
+	return wireVarint
+}
+
+// packable returns whether repeated values of the kind may be packed
+func (k kind) packable() bool {
+	return k.wire() != wireBytes
+}
+
+// the labels of fields
+const (
+	labelOptional = 1
+	labelRequired = 2
+	labelRepeated = 3
+)
+
+// field is a field of a message type
+type field struct {
+	name     string
+	jsonName string
+	number   int32
+	kind     kind
+	label    int32
+	typeName string   // the full name of the message or enum type of the field
+	message  *message // the message type of message fields
+	enum     *enum    // the enum type of enum fields
+}
+
+// repeated returns whether the field is repeated
+func (f *field) repeated() bool {
+	return f.label == labelRepeated
+}
+
+// isMap returns whether the field is a map, which is a repeated message field of a map entry type
+func (f *field) isMap() bool {
+	return f.repeated() && f.message != nil && f.message.mapEntry
+}
+
+// message is a message type
+type message struct {
+	name     string
+	fields   []*field          // by number
+	numbers  map[int32]*field  // the fields by number
+	names    map[string]*field // the fields by JSON name and by name
+	nested   []*message        // the messages declared in the message, in order
+	mapEntry bool
+}
+
+// enum is an enum type
+type enum struct {
+	name    string
+	names   map[int32]string
+	numbers map[string]int32
+}
+
+// Descriptors are the message and enum types of a set of .proto files
+type Descriptors struct {
+	messages map[string]*message
+	enums    map[string]*enum
+	top      []*message // the messages declared at the top level of the files, in order
+}
+
+// LoadDescriptors reads a descriptor set from a file, as produced by
+// protoc --include_imports --descriptor_set_out
+func LoadDescriptors(path string) (*Descriptors, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseDescriptors(b)
+}
+
+// ParseDescriptors parses an encoded FileDescriptorSet. It must include the files the others import,
+// so that the types of all fields are known
+func ParseDescriptors(b []byte) (*Descriptors, error) {
+	d := &Descriptors{
+		messages: make(map[string]*message),
+		enums:    make(map[string]*enum),
+	}
+
+	err := walk(b, func(num int32, v uint64, data []byte) error {
+		if num == 1 {
+			return d.parseFile(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+
+	if err := d.resolve(); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+
+	return d, nil
+}
+
+// Has returns whether the descriptors contain the message type with the full name
+func (d *Descriptors) Has(name string) bool {
+	return d.messages[name] != nil
+}
+
+// MessageAt returns the full name of the message type at the indexes, of a message declared at the
+// top level and of the messages nested in each other in the order they are declared, as the message
+// indexes of the Confluent wire format. An empty path is the first message
+func (d *Descriptors) MessageAt(indexes []int) (string, bool) {
+	if len(indexes) == 0 {
+		indexes = []int{0}
+	}
+
+	messages := d.top
+	var m *message
+	for _, i := range indexes {
+		if i < 0 || i >= len(messages) {
+			return "", false
+		}
+		m = messages[i]
+		messages = m.nested
+	}
+	return m.name, true
+}
+
+// Decode returns the message of the type with the full name encoded in b, as the values of its fields
+// by JSON name, following the JSON mapping of protobuf. An error is returned if b isn't a valid
+// encoding of the message type
+func (d *Descriptors) Decode(name string, b []byte) (map[string]any, error) {
+	m := d.messages[name]
+	if m == nil {
+		return nil, fmt.Errorf("unknown message type %s", name)
+	}
+	return m.decode(b)
+}
+
+// Encode returns the message of the type with the full name, from the values of its fields by JSON
+// name or name, as decoded from JSON with UseNumber
+func (d *Descriptors) Encode(name string, v map[string]any) ([]byte, error) {
+	m := d.messages[name]
+	if m == nil {
+		return nil, fmt.Errorf("unknown message type %s", name)
+	}
+	return m.encode(nil, v)
+}
+
+// parseFile parses a FileDescriptorProto
+func (d *Descriptors) parseFile(b []byte) error {
+	var pkg string
+	var messages, enums [][]byte
+	err := walk(b, func(num int32, v uint64, data []byte) error {
+		switch num {
+		case 2:
+			pkg = string(data)
+		case 4:
+			messages = append(messages, data)
+		case 5:
+			enums = append(enums, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, b := range messages {
+		m, err := d.parseMessage(pkg, b)
+		if err != nil {
+			return err
+		}
+		d.top = append(d.top, m)
+	}
+
+	for _, e := range enums {
+		if err := d.parseEnum(pkg, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseMessage parses a DescriptorProto, and its nested types, in the scope of a package or message
+func (d *Descriptors) parseMessage(scope string, b []byte) (*message, error) {
+	m := new(message)
+
+	var name string
+	var nested, enums [][]byte
+	err := walk(b, func(num int32, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			name = string(data)
+		case 2:
+			f, err := parseField(data)
+			if err != nil {
+				return err
+			}
+			m.fields = append(m.fields, f)
+		case 3:
+			nested = append(nested, data)
+		case 4:
+			enums = append(enums, data)
+		case 7:
+			return walk(data, func(num int32, v uint64, data []byte) error {
+				if num == 7 {
+					m.mapEntry = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		return nil, errors.New("message without a name")
+	}
+
+	m.name = fullName(scope, name)
+	if err := d.add(m); err != nil {
+		return nil, err
+	}
+
+	for _, b := range nested {
+		n, err := d.parseMessage(m.name, b)
+		if err != nil {
+			return nil, err
+		}
+		m.nested = append(m.nested, n)
+	}
+
+	for _, e := range enums {
+		if err := d.parseEnum(m.name, e); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// add indexes the fields of the message type, and adds it to the descriptors
+func (d *Descriptors) add(m *message) error {
+	if d.messages[m.name] != nil {
+		return fmt.Errorf("duplicate message %s", m.name)
+	}
+
+	sort.Slice(m.fields, func(i, j int) bool {
+		return m.fields[i].number < m.fields[j].number
+	})
+
+	m.numbers = make(map[int32]*field, len(m.fields))
+	m.names = make(map[string]*field, 2*len(m.fields))
+	for _, f := range m.fields {
+		if m.numbers[f.number] != nil {
+			return fmt.Errorf("duplicate field number %d of %s", f.number, m.name)
+		}
+		m.numbers[f.number] = f
+		m.names[f.name] = f
+		m.names[f.jsonName] = f
+	}
+
+	d.messages[m.name] = m
+	return nil
+}
+
+// parseField parses a FieldDescriptorProto
+func parseField(b []byte) (*field, error) {
+	f := &field{label: labelOptional}
+	err := walk(b, func(num int32, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			f.name = string(data)
+		case 3:
+			f.number = int32(v)
+		case 4:
+			f.label = int32(v)
+		case 5:
+			f.kind = kind(v)
+		case 6:
+			f.typeName = strings.TrimPrefix(string(data), ".")
+		case 10:
+			f.jsonName = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if f.name == "" || f.number <= 0 {
+		return nil, errors.New("field without a name or number")
+	}
+
+	if f.kind < kindDouble || f.kind > kindSint64 {
+		return nil, fmt.Errorf("unknown type of field %s", f.name)
+	}
+
+	if f.kind == kindGroup {
+		return nil, fmt.Errorf("group field %s is not supported", f.name)
+	}
+
+	if f.jsonName == "" {
+		f.jsonName = jsonName(f.name)
+	}
+
+	return f, nil
+}
+
+// parseEnum parses an EnumDescriptorProto in the scope of a package or message
+func (d *Descriptors) parseEnum(scope string, b []byte) error {
+	e := &enum{
+		names:   make(map[int32]string),
+		numbers: make(map[string]int32),
+	}
+
+	var name string
+	err := walk(b, func(num int32, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			name = string(data)
+		case 2:
+			var value string
+			var number int32
+			err := walk(data, func(num int32, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					value = string(data)
+				case 2:
+					number = int32(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			// the first of several values with the same number is used in JSON
+			if _, ok := e.names[number]; !ok {
+				e.names[number] = value
+			}
+			e.numbers[value] = number
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		return errors.New("enum without a name")
+	}
+
+	e.name = fullName(scope, name)
+	d.enums[e.name] = e
+	return nil
+}
+
+// resolve links the message and enum fields to their types
+func (d *Descriptors) resolve() error {
+	for _, m := range d.messages {
+		for _, f := range m.fields {
+			switch f.kind {
+			case kindMessage:
+				if f.message = d.messages[f.typeName]; f.message == nil {
+					return fmt.Errorf("unknown type %s of field %s.%s", f.typeName, m.name, f.name)
+				}
+			case kindEnum:
+				if f.enum = d.enums[f.typeName]; f.enum == nil {
+					return fmt.Errorf("unknown type %s of field %s.%s", f.typeName, m.name, f.name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// walk calls fn with the number and value of each field of an encoded message, as a number for
+// varint and fixed fields, or bytes for length delimited fields
+func walk(b []byte, fn func(num int32, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, wire, n, err := consumeTag(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+
+		v, data, n, err := consumeValue(b, wire)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+
+		if err := fn(num, v, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fullName returns the full name of a type in a scope
+func fullName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// jsonName returns the JSON name protoc gives a field, its name in lower camel case
+func jsonName(name string) string {
+	var sb strings.Builder
+	upper := false
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+
+		if upper && 'a' <= r && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		upper = false
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
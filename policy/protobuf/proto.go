@@ -0,0 +1,602 @@
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scalars are the kinds of the scalar types of the .proto language
+var scalars = map[string]kind{
+	"double":   kindDouble,
+	"float":    kindFloat,
+	"int64":    kindInt64,
+	"uint64":   kindUint64,
+	"int32":    kindInt32,
+	"fixed64":  kindFixed64,
+	"fixed32":  kindFixed32,
+	"bool":     kindBool,
+	"string":   kindString,
+	"bytes":    kindBytes,
+	"uint32":   kindUint32,
+	"sfixed32": kindSfixed32,
+	"sfixed64": kindSfixed64,
+	"sint32":   kindSint32,
+	"sint64":   kindSint64,
+}
+
+// reference is a field whose type is named, which is resolved once all types are declared
+type reference struct {
+	field *field
+	scope string // the message the field is declared in
+}
+
+// parser parses the source of a .proto file
+type parser struct {
+	src  string
+	pos  int
+	line int
+	tok  string // the current token, empty at the end of the source
+	d    *Descriptors
+	refs []reference
+}
+
+// ParseProto parses the source of a .proto file, as served by schema registries. Imported files aren't
+// read, so the types of all fields must be declared in the file. Services, extensions and options other
+// than json_name are skipped
+func ParseProto(source string) (*Descriptors, error) {
+	p := &parser{
+		src:  source,
+		line: 1,
+		d: &Descriptors{
+			messages: make(map[string]*message),
+			enums:    make(map[string]*enum),
+		},
+	}
+
+	if err := p.file(); err != nil {
+		return nil, fmt.Errorf("invalid proto: line %d: %w", p.line, err)
+	}
+
+	for _, ref := range p.refs {
+		if err := p.resolve(ref); err != nil {
+			return nil, fmt.Errorf("invalid proto: %w", err)
+		}
+	}
+
+	if err := p.d.resolve(); err != nil {
+		return nil, fmt.Errorf("invalid proto: %w", err)
+	}
+
+	return p.d, nil
+}
+
+// file parses the statements of the file
+func (p *parser) file() error {
+	if err := p.next(); err != nil {
+		return err
+	}
+
+	var pkg string
+	for p.tok != "" {
+		switch p.tok {
+		case "package":
+			if err := p.next(); err != nil {
+				return err
+			}
+
+			name, err := p.ident()
+			if err != nil {
+				return err
+			}
+			pkg = name
+
+			if err := p.expect(";"); err != nil {
+				return err
+			}
+		case "message":
+			m, err := p.message(pkg)
+			if err != nil {
+				return err
+			}
+			p.d.top = append(p.d.top, m)
+		case "enum":
+			if err := p.enum(pkg); err != nil {
+				return err
+			}
+		case "syntax", "edition", "import", "option", "service", "extend", ";":
+			if err := p.skip(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected %q", p.tok)
+		}
+	}
+
+	return nil
+}
+
+// message parses a message and the types nested in it, in the scope of a package or message
+func (p *parser) message(scope string) (*message, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &message{name: fullName(scope, name)}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	for p.tok != "}" {
+		switch p.tok {
+		case "":
+			return nil, errors.New("unexpected end of message")
+		case "message":
+			n, err := p.message(m.name)
+			if err != nil {
+				return nil, err
+			}
+			m.nested = append(m.nested, n)
+		case "enum":
+			if err := p.enum(m.name); err != nil {
+				return nil, err
+			}
+		case "oneof":
+			if err := p.oneof(m); err != nil {
+				return nil, err
+			}
+		case "option", "reserved", "extensions", "extend", ";":
+			if err := p.skip(); err != nil {
+				return nil, err
+			}
+		default:
+			if err := p.field(m); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if err := p.d.add(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// oneof parses the fields of a oneof, which are fields of the message
+func (p *parser) oneof(m *message) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+
+	if _, err := p.ident(); err != nil {
+		return err
+	}
+
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+
+	for p.tok != "}" {
+		switch p.tok {
+		case "":
+			return errors.New("unexpected end of oneof")
+		case "option", ";":
+			if err := p.skip(); err != nil {
+				return err
+			}
+		default:
+			if err := p.field(m); err != nil {
+				return err
+			}
+		}
+	}
+
+	return p.next()
+}
+
+// field parses a field of the message, adding the entry type of map fields to its nested types
+func (p *parser) field(m *message) error {
+	f := &field{label: labelOptional}
+	switch p.tok {
+	case "group":
+		return errors.New("groups are not supported")
+	case "required":
+		f.label = labelRequired
+	case "repeated":
+		f.label = labelRepeated
+	}
+
+	if p.tok == "optional" || p.tok == "required" || p.tok == "repeated" {
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+
+	var entry *message
+	if p.tok == "map" {
+		if err := p.next(); err != nil {
+			return err
+		}
+
+		key, value, err := p.mapTypes()
+		if err != nil {
+			return err
+		}
+
+		entry = &message{mapEntry: true, fields: []*field{
+			p.typed(&field{name: "key", jsonName: "key", number: 1, label: labelOptional}, key, m.name),
+			p.typed(&field{name: "value", jsonName: "value", number: 2, label: labelOptional}, value, m.name),
+		}}
+		f.label = labelRepeated
+	} else {
+		typ, err := p.ident()
+		if err != nil {
+			return err
+		}
+		p.typed(f, typ, m.name)
+	}
+
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	f.name = name
+	f.jsonName = jsonName(name)
+
+	if err := p.expect("="); err != nil {
+		return err
+	}
+
+	number, err := p.number()
+	if err != nil {
+		return err
+	}
+	if number <= 0 {
+		return fmt.Errorf("invalid number %d of field %s", number, name)
+	}
+	f.number = number
+
+	if p.tok == "[" {
+		if err := p.options(f); err != nil {
+			return err
+		}
+	}
+
+	if err := p.expect(";"); err != nil {
+		return err
+	}
+
+	if entry != nil {
+		// protoc names the entry type of a map field after the field in upper camel case
+		entry.name = m.name + "." + strings.ToUpper(f.jsonName[:1]) + f.jsonName[1:] + "Entry"
+		if err := p.d.add(entry); err != nil {
+			return err
+		}
+		m.nested = append(m.nested, entry)
+		f.kind, f.typeName = kindMessage, entry.name
+	}
+
+	m.fields = append(m.fields, f)
+	return nil
+}
+
+// mapTypes parses the key and value types of a map field
+func (p *parser) mapTypes() (string, string, error) {
+	if err := p.expect("<"); err != nil {
+		return "", "", err
+	}
+
+	key, err := p.ident()
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := p.expect(","); err != nil {
+		return "", "", err
+	}
+
+	value, err := p.ident()
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, value, p.expect(">")
+}
+
+// typed sets the type of the field, which is resolved later if it isn't scalar
+func (p *parser) typed(f *field, typ, scope string) *field {
+	if k, ok := scalars[typ]; ok {
+		f.kind = k
+		return f
+	}
+
+	f.typeName = typ
+	p.refs = append(p.refs, reference{field: f, scope: scope})
+	return f
+}
+
+// options parses the options of a field, of which only json_name is used
+func (p *parser) options(f *field) error {
+	for p.tok != "]" {
+		if p.tok == "" {
+			return errors.New("unexpected end of options")
+		}
+
+		if p.tok != "json_name" {
+			if err := p.next(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := p.next(); err != nil {
+			return err
+		}
+
+		if err := p.expect("="); err != nil {
+			return err
+		}
+
+		name, err := p.str()
+		if err != nil {
+			return err
+		}
+		f.jsonName = name
+	}
+
+	return p.next()
+}
+
+// enum parses an enum in the scope of a package or message
+func (p *parser) enum(scope string) error {
+	if err := p.next(); err != nil {
+		return err
+	}
+
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+
+	e := &enum{
+		name:    fullName(scope, name),
+		names:   make(map[int32]string),
+		numbers: make(map[string]int32),
+	}
+
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+
+	for p.tok != "}" {
+		switch p.tok {
+		case "":
+			return errors.New("unexpected end of enum")
+		case "option", "reserved", ";":
+			if err := p.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, err := p.ident()
+		if err != nil {
+			return err
+		}
+
+		if err := p.expect("="); err != nil {
+			return err
+		}
+
+		number, err := p.number()
+		if err != nil {
+			return err
+		}
+
+		if p.tok == "[" {
+			if err := p.skip(); err != nil {
+				return err
+			}
+		}
+
+		if err := p.expect(";"); err != nil {
+			return err
+		}
+
+		if _, ok := e.names[number]; !ok {
+			e.names[number] = value
+		}
+		e.numbers[value] = number
+	}
+
+	p.d.enums[e.name] = e
+	return p.next()
+}
+
+// resolve resolves the type of the field, searching the scope it is declared in and each enclosing
+// scope, unless the type is fully qualified with a leading dot
+func (p *parser) resolve(ref reference) error {
+	f := ref.field
+	names := []string{strings.TrimPrefix(f.typeName, ".")}
+	if !strings.HasPrefix(f.typeName, ".") {
+		names = names[:0]
+		for scope := ref.scope; ; {
+			names = append(names, fullName(scope, f.typeName))
+			if scope == "" {
+				break
+			}
+
+			i := strings.LastIndex(scope, ".")
+			if i < 0 {
+				i = 0
+			}
+			scope = scope[:i]
+		}
+	}
+
+	for _, name := range names {
+		switch {
+		case p.d.messages[name] != nil:
+			f.kind, f.typeName = kindMessage, name
+			return nil
+		case p.d.enums[name] != nil:
+			f.kind, f.typeName = kindEnum, name
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown type %s of field %s", f.typeName, f.name)
+}
+
+// skip skips the current statement, up to its semicolon or the end of its block
+func (p *parser) skip() error {
+	depth := 0
+	for {
+		tok := p.tok
+		if tok == "" {
+			return errors.New("unexpected end of statement")
+		}
+
+		if err := p.next(); err != nil {
+			return err
+		}
+
+		switch tok {
+		case "{", "[", "(", "<":
+			depth++
+		case "}", "]", ")", ">":
+			depth--
+			if depth == 0 && tok == "}" {
+				return nil
+			}
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		}
+
+		// the options of an enum value end with their bracket
+		if depth == 0 && tok == "]" {
+			return nil
+		}
+	}
+}
+
+// expect consumes the token, or returns an error if the current token is another
+func (p *parser) expect(tok string) error {
+	if p.tok != tok {
+		return fmt.Errorf("expected %q, found %q", tok, p.tok)
+	}
+	return p.next()
+}
+
+// ident consumes an identifier, which may be qualified
+func (p *parser) ident() (string, error) {
+	tok := p.tok
+	if tok == "" || !isIdent(tok[0]) || tok[0] >= '0' && tok[0] <= '9' {
+		return "", fmt.Errorf("expected identifier, found %q", tok)
+	}
+	return tok, p.next()
+}
+
+// number consumes a 32 bit integer, which may be decimal, hexadecimal or octal
+func (p *parser) number() (int32, error) {
+	n, err := strconv.ParseInt(p.tok, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("expected number, found %q", p.tok)
+	}
+	return int32(n), p.next()
+}
+
+// str consumes a string literal
+func (p *parser) str() (string, error) {
+	tok := p.tok
+	if tok == "" || tok[0] != '"' && tok[0] != '\'' {
+		return "", fmt.Errorf("expected string, found %q", tok)
+	}
+
+	if tok[0] == '\'' {
+		tok = `"` + strings.ReplaceAll(tok[1:len(tok)-1], `"`, `\"`) + `"`
+	}
+
+	s, err := strconv.Unquote(tok)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", p.tok)
+	}
+	return s, p.next()
+}
+
+// next reads the next token, skipping whitespace and comments
+func (p *parser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '\n':
+			p.line++
+			p.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			end := strings.IndexByte(p.src[p.pos:], '\n')
+			if end < 0 {
+				end = len(p.src) - p.pos
+			}
+			p.pos += end
+		case strings.HasPrefix(p.src[p.pos:], "/*"):
+			end := strings.Index(p.src[p.pos+2:], "*/")
+			if end < 0 {
+				return errors.New("unterminated comment")
+			}
+			p.line += strings.Count(p.src[p.pos:p.pos+2+end], "\n")
+			p.pos += end + 4
+		default:
+			return p.token()
+		}
+	}
+
+	p.tok = ""
+	return nil
+}
+
+// token reads the token at the current position
+func (p *parser) token() error {
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		for p.pos++; p.pos < len(p.src) && p.src[p.pos] != c; p.pos++ {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			} else if p.src[p.pos] == '\n' {
+				return errors.New("unterminated string")
+			}
+		}
+		if p.pos >= len(p.src) {
+			return errors.New("unterminated string")
+		}
+		p.pos++
+	case isIdent(c) || c == '-' && p.pos+1 < len(p.src) && isIdent(p.src[p.pos+1]):
+		for p.pos++; p.pos < len(p.src) && isIdent(p.src[p.pos]); p.pos++ {
+		}
+	default:
+		p.pos++
+	}
+
+	p.tok = p.src[start:p.pos]
+	return nil
+}
+
+// isIdent returns whether the character may be part of an identifier or number
+func isIdent(c byte) bool {
+	return c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
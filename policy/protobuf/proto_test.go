@@ -0,0 +1,143 @@
+package protobuf
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testProto = `
+// readings of the sensors
+syntax = "proto3";
+
+package sensors.v1;
+
+import "google/protobuf/descriptor.proto";
+option go_package = "example.com/sensors/v1;sensors";
+
+enum Unit {
+  option allow_alias = true;
+  CELSIUS = 0;
+  FAHRENHEIT = 1;
+  DEGREES_F = 1 [deprecated = true];
+}
+
+message Reading {
+  string device = 1;
+  double value = 2;
+  Unit unit = 3;
+  int64 time = 4 [json_name = 'timestamp'];
+  repeated int32 samples = 5 [packed = true];
+  map<string, string> labels = 6;
+  Location location = 7;
+  /* raw samples,
+     as received */
+  bytes raw_data = 8;
+  oneof change {
+    sint32 delta = 9;
+    Status status = 10;
+  }
+  reserved 11 to 15;
+
+  enum Status {
+    OK = 0;
+    FAULT = -1;
+  }
+}
+
+message Location {
+  float lat = 1;
+  float lon = 2;
+  message Accuracy { optional double meters = 1; }
+  Accuracy accuracy = 3;
+}
+
+service Sensors {
+  rpc Read(Location) returns (Reading) { option idempotency_level = NO_SIDE_EFFECTS; }
+}
+`
+
+func TestParseProto(t *testing.T) {
+	d, err := ParseProto(testProto)
+	require.NoError(t, err)
+
+	for _, name := range []string{"sensors.v1.Reading", "sensors.v1.Reading.LabelsEntry", "sensors.v1.Location", "sensors.v1.Location.Accuracy"} {
+		require.True(t, d.Has(name), name)
+	}
+
+	reading := d.messages["sensors.v1.Reading"]
+	require.Len(t, reading.fields, 10)
+	require.Equal(t, "timestamp", reading.numbers[4].jsonName)
+	require.True(t, reading.numbers[6].isMap())
+	require.Same(t, d.messages["sensors.v1.Location"], reading.numbers[7].message)
+	require.Equal(t, "sensors.v1.Reading.Status", reading.numbers[10].enum.name)
+	require.Equal(t, "FAULT", reading.numbers[10].enum.names[-1])
+	require.Equal(t, int32(1), d.enums["sensors.v1.Unit"].numbers["DEGREES_F"])
+	require.Equal(t, "FAHRENHEIT", d.enums["sensors.v1.Unit"].names[1])
+
+	v, err := d.Decode("sensors.v1.Reading", testReading())
+	require.NoError(t, err)
+
+	payload, err := json.Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, `{"delta":-2,"device":"d1","samples":[1,2,3],"timestamp":"1700000000","unit":"FAHRENHEIT","value":21.5}`, string(payload))
+
+	b, err := d.Encode("sensors.v1.Reading", map[string]any{
+		"device": "d1", "value": json.Number("21.5"), "timestamp": "1700000000", "delta": json.Number("-2"),
+		"unit": "FAHRENHEIT", "samples": []any{json.Number("1"), json.Number("2"), json.Number("3")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, testReading(), b)
+
+	_, err = d.Decode("sensors.v1.Unknown", nil)
+	require.Error(t, err)
+
+	_, err = d.Encode("sensors.v1.Unknown", nil)
+	require.Error(t, err)
+}
+
+func TestMessageAt(t *testing.T) {
+	d, err := ParseProto(testProto)
+	require.NoError(t, err)
+
+	tests := []struct {
+		indexes []int
+		expect  string
+	}{
+		{indexes: nil, expect: "sensors.v1.Reading"},
+		{indexes: []int{0}, expect: "sensors.v1.Reading"},
+		{indexes: []int{0, 0}, expect: "sensors.v1.Reading.LabelsEntry"},
+		{indexes: []int{1}, expect: "sensors.v1.Location"},
+		{indexes: []int{1, 0}, expect: "sensors.v1.Location.Accuracy"},
+		{indexes: []int{2}},
+		{indexes: []int{1, 1}},
+		{indexes: []int{-1}},
+	}
+
+	for _, tt := range tests {
+		name, ok := d.MessageAt(tt.indexes)
+		require.Equal(t, tt.expect != "", ok, tt.indexes)
+		require.Equal(t, tt.expect, name)
+	}
+}
+
+func TestParseProtoInvalid(t *testing.T) {
+	for _, source := range []string{
+		`message A { B b = 1; }`,
+		`message A { string a = 1 }`,
+		`message A { string a = 0; }`,
+		`message A { string a = 1; string b = 1; }`,
+		`message A { string a = 1;`,
+		`message A {} message A {}`,
+		`message A { optional group G = 1 {} }`,
+		`message A { map<string> m = 1; }`,
+		`message A { string a = 1 [json_name = "a]; }`,
+		`enum E { A = one; }`,
+		`/* unterminated`,
+		`unexpected;`,
+	} {
+		_, err := ParseProto(source)
+		require.Error(t, err, source)
+	}
+}
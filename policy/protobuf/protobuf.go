@@ -0,0 +1,368 @@
+package protobuf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// ClientID is the id of the inline client which publishes the transcoded messages
+const ClientID = "protobuf"
+
+// the content types of the transcoded messages
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+)
+
+// Rule is the message type of the payloads published to the topics matching a filter
+type Rule struct {
+	// Filter is the topic filter of the rule, eg. sensors/+/reading
+	Filter string
+
+	// Message is the full name of the message type, eg. sensors.v1.Reading
+	Message string
+
+	// Transcode republishes the messages as JSON to their topic with the suffix, eg. for dashboards
+	// subscribing to sensors/1/reading.json, and messages published as JSON to a topic with the suffix
+	// as protobuf to the topic without it
+	Transcode bool
+}
+
+// Stats are the totals of the messages checked since the hook was initialized
+type Stats struct {
+	Validated  int64 // the number of messages which were valid
+	Rejected   int64 // the number of messages rejected as invalid
+	Transcoded int64 // the number of transcoded messages published
+	Failed     int64 // the number of transcoded messages which could not be published
+}
+
+// Hook is a hook that validates the protobuf payloads published to topics against the message types
+// of their rules, and transcodes them to and from JSON
+type Hook struct {
+	config      Options
+	descriptors atomic.Pointer[Descriptors]
+	client      *mqtt.Client
+	modified    time.Time
+	cancel      context.CancelFunc
+	stats       Stats
+	mu          sync.Mutex // guards modified and stats
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the protobuf hook
+type Options struct {
+	// Path is the descriptor set file of the message types, produced with
+	// protoc --include_imports --descriptor_set_out. Descriptors is used instead of Path if set
+	Path        string
+	Descriptors []byte
+
+	// Rules are the message types of the topics. The first rule whose filter matches a topic applies,
+	// and the payloads of topics matching none aren't checked
+	Rules []Rule
+
+	// Suffix is the suffix of the topics of transcoded JSON messages, and defaults to .json
+	Suffix string
+
+	// Server is the server the transcoded messages are published to. Required if any rule transcodes
+	Server *mqtt.Server
+
+	// ReloadInterval is how often the descriptor set file is checked for changes. A file which fails to
+	// load, or lacks the message type of a rule, leaves the current descriptors in place
+	ReloadInterval time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "protobuf-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	protobufHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if protobufHookConfig.Path == "" && protobufHookConfig.Descriptors == nil {
+		return errors.New("path or descriptors is required")
+	}
+
+	if protobufHookConfig.Suffix == "" {
+		protobufHookConfig.Suffix = ".json"
+	}
+
+	for _, rule := range protobufHookConfig.Rules {
+		if !mqtt.IsValidFilter(rule.Filter, false) {
+			return fmt.Errorf("invalid topic filter %q", rule.Filter)
+		}
+
+		if rule.Transcode && protobufHookConfig.Server == nil {
+			return errors.New("server is required to transcode")
+		}
+	}
+
+	h.config = protobufHookConfig
+	if err := h.Reload(); err != nil {
+		return err
+	}
+
+	if protobufHookConfig.Server != nil {
+		h.client = protobufHookConfig.Server.NewClient(nil, "local", ClientID, true)
+		h.client.Properties.ProtocolVersion = 5
+	}
+
+	if protobufHookConfig.Path != "" && protobufHookConfig.ReloadInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		h.cancel = cancel
+		go h.watch(ctx)
+	}
+
+	return nil
+}
+
+// Stop stops watching the descriptor set file
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// watch reloads the descriptor set file when it changes, until the context is cancelled
+func (h *Hook) watch(ctx context.Context) {
+	ticker := time.NewTicker(h.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(h.config.Path)
+			if err != nil {
+				continue
+			}
+
+			h.mu.Lock()
+			changed := !info.ModTime().Equal(h.modified)
+			h.mu.Unlock()
+			if !changed {
+				continue
+			}
+
+			if err := h.Reload(); err != nil {
+				h.Log.Error("error occurred while reloading protobuf descriptors", "error", err)
+			}
+		}
+	}
+}
+
+// Reload reads the descriptor set file again and atomically swaps in its message types. If the file
+// cannot be loaded, or lacks the message type of a rule, the current descriptors are kept
+func (h *Hook) Reload() error {
+	var modified time.Time
+	var descriptors *Descriptors
+	var err error
+	if h.config.Path == "" {
+		descriptors, err = ParseDescriptors(h.config.Descriptors)
+	} else {
+		var info os.FileInfo
+		if info, err = os.Stat(h.config.Path); err != nil {
+			return err
+		}
+		modified = info.ModTime()
+		descriptors, err = LoadDescriptors(h.config.Path)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range h.config.Rules {
+		if !descriptors.Has(rule.Message) {
+			return fmt.Errorf("unknown message type %s of topic filter %s", rule.Message, rule.Filter)
+		}
+	}
+
+	h.descriptors.Store(descriptors)
+
+	h.mu.Lock()
+	h.modified = modified
+	h.mu.Unlock()
+	return nil
+}
+
+// Stats returns the totals of the messages checked so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// OnPublish is called when a client publishes a message, and rejects it if its payload isn't a valid
+// message of the type of its topic, as protobuf, or as JSON on the topic of transcoded messages.
+// Messages published by inline clients, and empty messages, which clear retained messages, are not
+// checked
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline || len(pk.Payload) == 0 {
+		return pk, nil
+	}
+
+	m, _, isJSON := h.match(pk.TopicName)
+	if m == nil {
+		return pk, nil
+	}
+
+	var err error
+	if isJSON {
+		_, err = m.unmarshal(pk.Payload)
+	} else {
+		_, err = m.decode(pk.Payload)
+	}
+
+	if err != nil {
+		h.Log.Debug("rejecting invalid message", "error", err, "client", cl.ID, "topic", pk.TopicName, "message", m.name)
+		h.count(func(s *Stats) { s.Rejected++ })
+		return pk, reject.Publish(cl, pk, packets.ErrPayloadFormatInvalid)
+	}
+
+	h.count(func(s *Stats) { s.Validated++ })
+	return pk, nil
+}
+
+// OnPublished is called when a client has published a message, and publishes it transcoded if its
+// rule transcodes
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if pk.Ignore || pk.Origin == ClientID || h.client == nil {
+		return
+	}
+
+	m, rule, isJSON := h.match(pk.TopicName)
+	if m == nil || !rule.Transcode {
+		return
+	}
+
+	topic := pk.TopicName + h.config.Suffix
+	contentType := contentTypeJSON
+	if isJSON {
+		topic = strings.TrimSuffix(pk.TopicName, h.config.Suffix)
+		contentType = contentTypeProtobuf
+	}
+
+	var payload []byte
+	var err error
+	switch {
+	case len(pk.Payload) == 0:
+		if !pk.FixedHeader.Retain {
+			return
+		}
+	case isJSON:
+		payload, err = m.unmarshal(pk.Payload)
+	default:
+		var v map[string]any
+		if v, err = m.decode(pk.Payload); err == nil {
+			payload, err = json.Marshal(v)
+		}
+	}
+
+	if err != nil {
+		h.Log.Warn("message could not be transcoded", "error", err, "client", cl.ID, "topic", pk.TopicName, "message", m.name)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.publish(pk, topic, payload, contentType)
+}
+
+// match returns the message type and rule of the topic, and whether the topic is of transcoded JSON
+// messages. The message type is nil if no rule matches
+func (h *Hook) match(topic string) (*message, Rule, bool) {
+	if base, ok := strings.CutSuffix(topic, h.config.Suffix); ok {
+		if rule, ok := h.rule(base); ok && rule.Transcode {
+			return h.descriptors.Load().messages[rule.Message], rule, true
+		}
+	}
+
+	if rule, ok := h.rule(topic); ok {
+		return h.descriptors.Load().messages[rule.Message], rule, false
+	}
+
+	return nil, Rule{}, false
+}
+
+// rule returns the first rule whose filter matches the topic
+func (h *Hook) rule(topic string) (Rule, bool) {
+	for _, rule := range h.config.Rules {
+		if acl.Match(rule.Filter, topic) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// publish publishes the transcoded payload of the message to the topic
+func (h *Hook) publish(pk packets.Packet, topic string, payload []byte, contentType string) {
+	var payloadFormat byte
+	if contentType == contentTypeJSON {
+		payloadFormat = 1
+	}
+
+	err := h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    pk.FixedHeader.Qos,
+			Retain: pk.FixedHeader.Retain,
+		},
+		TopicName: topic,
+		Payload:   payload,
+		PacketID:  uint16(pk.FixedHeader.Qos),
+		Properties: packets.Properties{
+			PayloadFormat:         payloadFormat,
+			PayloadFormatFlag:     payloadFormat == 1,
+			ContentType:           contentType,
+			MessageExpiryInterval: pk.Properties.MessageExpiryInterval,
+			ResponseTopic:         pk.Properties.ResponseTopic,
+			CorrelationData:       pk.Properties.CorrelationData,
+			User:                  pk.Properties.User,
+		},
+	})
+	if err != nil {
+		h.Log.Error("error occurred while publishing transcoded message", "error", err, "topic", topic)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.count(func(s *Stats) { s.Transcoded++ })
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update(&h.stats)
+}
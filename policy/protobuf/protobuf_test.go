@@ -0,0 +1,534 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// the helpers below encode the parts of a descriptor set
+
+func str(num int32, s string) []byte {
+	return appendBytes(appendTag(nil, num, wireBytes), []byte(s))
+}
+
+func varint(num int32, v uint64) []byte {
+	return binary.AppendUvarint(appendTag(nil, num, wireVarint), v)
+}
+
+func msg(num int32, parts ...[]byte) []byte {
+	return appendBytes(appendTag(nil, num, wireBytes), bytes.Join(parts, nil))
+}
+
+func fieldDesc(name string, number int32, label int32, k kind, typeName string) []byte {
+	parts := [][]byte{str(1, name), varint(3, uint64(number)), varint(4, uint64(label)), varint(5, uint64(k))}
+	if typeName != "" {
+		parts = append(parts, str(6, typeName))
+	}
+	return msg(2, parts...)
+}
+
+// testDescriptors returns the descriptor set of:
+//
+//	syntax = "proto3";
+//	package sensors.v1;
+//
+//	enum Unit { CELSIUS = 0; FAHRENHEIT = 1; }
+//	message Reading {
+//	  string device = 1; double value = 2; Unit unit = 3; int64 time = 4; repeated int32 samples = 5;
+//	  map<string, string> labels = 6; Location location = 7; bytes raw_data = 8; sint32 delta = 9;
+//	}
+//	message Location { float lat = 1; float lon = 2; }
+//
+// and of a proto2 Command with a required name, or only of a Location if small
+func testDescriptors(small bool) []byte {
+	location := msg(4, str(1, "Location"), fieldDesc("lat", 1, labelOptional, kindFloat, ""), fieldDesc("lon", 2, labelOptional, kindFloat, ""))
+	if small {
+		return msg(1, str(1, "location.proto"), str(2, "sensors.v1"), location)
+	}
+
+	return msg(1,
+		str(1, "reading.proto"),
+		str(2, "sensors.v1"),
+		msg(4,
+			str(1, "Reading"),
+			fieldDesc("device", 1, labelOptional, kindString, ""),
+			fieldDesc("value", 2, labelOptional, kindDouble, ""),
+			fieldDesc("unit", 3, labelOptional, kindEnum, ".sensors.v1.Unit"),
+			fieldDesc("time", 4, labelOptional, kindInt64, ""),
+			fieldDesc("samples", 5, labelRepeated, kindInt32, ""),
+			fieldDesc("labels", 6, labelRepeated, kindMessage, ".sensors.v1.Reading.LabelsEntry"),
+			fieldDesc("location", 7, labelOptional, kindMessage, ".sensors.v1.Location"),
+			fieldDesc("raw_data", 8, labelOptional, kindBytes, ""),
+			fieldDesc("delta", 9, labelOptional, kindSint32, ""),
+			msg(3,
+				str(1, "LabelsEntry"),
+				fieldDesc("key", 1, labelOptional, kindString, ""),
+				fieldDesc("value", 2, labelOptional, kindString, ""),
+				msg(7, varint(7, 1)),
+			),
+		),
+		location,
+		msg(4, str(1, "Command"), fieldDesc("name", 1, labelRequired, kindString, "")),
+		msg(5, str(1, "Unit"), msg(2, str(1, "CELSIUS"), varint(2, 0)), msg(2, str(1, "FAHRENHEIT"), varint(2, 1))),
+		str(12, "proto3"),
+	)
+}
+
+// testReading returns an encoded Reading, as protoc would encode it
+func testReading() []byte {
+	b := str(1, "d1")
+	b = binary.LittleEndian.AppendUint64(appendTag(b, 2, wireFixed64), math.Float64bits(21.5))
+	b = append(b, varint(3, 1)...)
+	b = append(b, varint(4, 1700000000)...)
+	b = append(b, appendBytes(appendTag(nil, 5, wireBytes), []byte{1, 2, 3})...)
+	return append(b, varint(9, zigzag(-2))...)
+}
+
+const testReadingJSON = `{"delta":-2,"device":"d1","samples":[1,2,3],"time":"1700000000","unit":"FAHRENHEIT","value":21.5}`
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	protobufHook := new(Hook)
+	protobufHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, protobufHook.Init(options))
+	t.Cleanup(func() { _ = protobufHook.Stop() })
+	return protobufHook
+}
+
+func newMessage(t *testing.T, name string) *message {
+	t.Helper()
+
+	d, err := ParseDescriptors(testDescriptors(false))
+	require.NoError(t, err)
+	require.True(t, d.Has(name))
+	return d.messages[name]
+}
+
+func writeDescriptors(t *testing.T, path string, data []byte, age time.Duration) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	modified := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, modified, modified))
+}
+
+// subscribe returns the messages published to the filter
+func subscribe(t *testing.T, server *mqtt.Server, filter string) chan packets.Packet {
+	t.Helper()
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return received
+}
+
+func publish(topic string, payload []byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     payload,
+		Origin:      "c1",
+	}
+}
+
+func TestID(t *testing.T) {
+	protobufHook := new(Hook)
+
+	require.Equal(t, "protobuf-policy-hook", protobufHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	protobufHook := new(Hook)
+
+	require.True(t, protobufHook.Provides(mqtt.OnPublish))
+	require.True(t, protobufHook.Provides(mqtt.OnPublished))
+	require.False(t, protobufHook.Provides(mqtt.OnConnect))
+}
+
+func TestInit(t *testing.T) {
+	server := newServer(t)
+	path := filepath.Join(t.TempDir(), "sensors.pb")
+	writeDescriptors(t, path, testDescriptors(false), time.Hour)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:   "Success - path",
+			config: Options{Path: path, Rules: []Rule{{Filter: "sensors/+/reading", Message: "sensors.v1.Reading"}}},
+		},
+		{
+			name: "Success - descriptors",
+			config: Options{Descriptors: testDescriptors(false), Server: server, Rules: []Rule{
+				{Filter: "sensors/+/reading", Message: "sensors.v1.Reading", Transcode: true},
+			}},
+		},
+		{
+			name:        "Error - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Error - improper config",
+			config:      "not valid",
+			expectError: true,
+		},
+		{
+			name:        "Error - no descriptors",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Error - missing file",
+			config:      Options{Path: filepath.Join(t.TempDir(), "missing.pb")},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid descriptors",
+			config:      Options{Descriptors: []byte{0x0a, 0x05}},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid filter",
+			config:      Options{Descriptors: testDescriptors(false), Rules: []Rule{{Filter: "sensors/#/reading", Message: "sensors.v1.Reading"}}},
+			expectError: true,
+		},
+		{
+			name:        "Error - unknown message",
+			config:      Options{Descriptors: testDescriptors(false), Rules: []Rule{{Filter: "sensors/#", Message: "sensors.v1.Unknown"}}},
+			expectError: true,
+		},
+		{
+			name:        "Error - transcode without server",
+			config:      Options{Descriptors: testDescriptors(false), Rules: []Rule{{Filter: "sensors/#", Message: "sensors.v1.Reading", Transcode: true}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protobufHook := new(Hook)
+			err := protobufHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, ".json", protobufHook.config.Suffix)
+			require.True(t, protobufHook.descriptors.Load().Has("sensors.v1.Reading"))
+			require.NoError(t, protobufHook.Stop())
+		})
+	}
+}
+
+func TestParseDescriptors(t *testing.T) {
+	d, err := ParseDescriptors(testDescriptors(false))
+	require.NoError(t, err)
+
+	for _, name := range []string{"sensors.v1.Reading", "sensors.v1.Reading.LabelsEntry", "sensors.v1.Location", "sensors.v1.Command"} {
+		require.True(t, d.Has(name), name)
+	}
+	require.False(t, d.Has("Reading"))
+
+	reading := d.messages["sensors.v1.Reading"]
+	require.Len(t, reading.fields, 9)
+	require.Equal(t, "rawData", reading.numbers[8].jsonName)
+	require.Same(t, reading.numbers[8], reading.names["raw_data"])
+	require.Same(t, reading.numbers[8], reading.names["rawData"])
+	require.True(t, reading.numbers[6].isMap())
+	require.Same(t, d.messages["sensors.v1.Location"], reading.numbers[7].message)
+	require.Equal(t, "FAHRENHEIT", reading.numbers[3].enum.names[1])
+
+	// the types of all fields must be included
+	_, err = ParseDescriptors(msg(1, str(2, "a"), msg(4, str(1, "A"), fieldDesc("b", 1, labelOptional, kindMessage, ".a.B"))))
+	require.ErrorContains(t, err, "unknown type a.B")
+
+	_, err = ParseDescriptors(msg(1, msg(4, str(1, "A"), fieldDesc("b", 1, labelOptional, kindGroup, ".B"))))
+	require.ErrorContains(t, err, "not supported")
+
+	_, err = ParseDescriptors(append(testDescriptors(true), testDescriptors(true)...))
+	require.ErrorContains(t, err, "duplicate message")
+}
+
+func TestDecode(t *testing.T) {
+	reading := newMessage(t, "sensors.v1.Reading")
+
+	v, err := reading.decode(testReading())
+	require.NoError(t, err)
+
+	payload, err := json.Marshal(v)
+	require.NoError(t, err)
+	require.Equal(t, testReadingJSON, string(payload))
+
+	// unpacked repeated fields, unknown fields and unknown enum values
+	b := append(varint(5, 4), varint(5, 5)...)
+	b = append(b, varint(15, 1)...)
+	b = append(b, varint(3, 7)...)
+	v, err = reading.decode(b)
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"samples": []any{int64(4), int64(5)}, "unit": int64(7)}, v)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	reading := newMessage(t, "sensors.v1.Reading")
+
+	tests := map[string][]byte{
+		"truncated":        testReading()[:10],
+		"wrong wire type":  varint(1, 1),
+		"invalid utf-8":    str(1, "\xff"),
+		"invalid nested":   str(7, "\xff"),
+		"group":            appendTag(nil, 1, 3),
+		"zero field":       {0x00, 0x01},
+		"overflowing":      append([]byte{0x08}, bytes.Repeat([]byte{0xff}, 10)...),
+		"truncated packed": appendBytes(appendTag(nil, 5, wireBytes), []byte{0x80}),
+	}
+
+	for name, b := range tests {
+		_, err := reading.decode(b)
+		require.Error(t, err, name)
+	}
+
+	_, err := newMessage(t, "sensors.v1.Command").decode(nil)
+	require.ErrorContains(t, err, "missing required field name")
+}
+
+func TestUnmarshal(t *testing.T) {
+	reading := newMessage(t, "sensors.v1.Reading")
+
+	b, err := reading.unmarshal([]byte(testReadingJSON))
+	require.NoError(t, err)
+	require.Equal(t, testReading(), b)
+
+	payload := `{"device":"d1","labels":{"room":"kitchen","site":"home"},"location":{"lat":52.5,"lon":13.25},"raw_data":"AQID","time":-5,"unit":1}`
+	b, err = reading.unmarshal([]byte(payload))
+	require.NoError(t, err)
+
+	v, err := reading.decode(b)
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{
+		"device":   "d1",
+		"labels":   map[string]any{"room": "kitchen", "site": "home"},
+		"location": map[string]any{"lat": json.Number("52.5"), "lon": json.Number("13.25")},
+		"rawData":  "AQID",
+		"time":     "-5",
+		"unit":     "FAHRENHEIT",
+	}, v)
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	reading := newMessage(t, "sensors.v1.Reading")
+
+	for _, payload := range []string{
+		``,
+		`null`,
+		`[]`,
+		`{"device":"d1"} {}`,
+		`{"unknown":1}`,
+		`{"device":1}`,
+		`{"value":"warm"}`,
+		`{"unit":"KELVIN"}`,
+		`{"delta":1.5}`,
+		`{"delta":3000000000}`,
+		`{"samples":1}`,
+		`{"labels":[]}`,
+		`{"location":{"alt":1}}`,
+		`{"raw_data":"not base64!"}`,
+		`{"rawData":"AQID","raw_data":"AQID"}`,
+	} {
+		_, err := reading.unmarshal([]byte(payload))
+		require.Error(t, err, payload)
+	}
+
+	_, err := newMessage(t, "sensors.v1.Command").unmarshal([]byte(`{}`))
+	require.ErrorContains(t, err, "missing required field name")
+}
+
+func TestOnPublish(t *testing.T) {
+	server := newServer(t)
+	protobufHook := newHook(t, Options{Descriptors: testDescriptors(false), Server: server, Rules: []Rule{
+		{Filter: "sensors/+/reading", Message: "sensors.v1.Reading", Transcode: true},
+		{Filter: "sensors/+/location", Message: "sensors.v1.Location"},
+	}})
+
+	v5 := server.NewClient(nil, "t1", "c1", false)
+	v5.Properties.ProtocolVersion = 5
+	v3 := server.NewClient(nil, "t1", "c2", false)
+	v3.Properties.ProtocolVersion = 4
+
+	tests := []struct {
+		name   string
+		cl     *mqtt.Client
+		pk     packets.Packet
+		expect error
+	}{
+		{
+			name: "valid protobuf",
+			cl:   v5,
+			pk:   publish("sensors/1/reading", testReading()),
+		},
+		{
+			name: "valid json",
+			cl:   v5,
+			pk:   publish("sensors/1/reading.json", []byte(testReadingJSON)),
+		},
+		{
+			name: "empty",
+			cl:   v5,
+			pk:   publish("sensors/1/reading", nil),
+		},
+		{
+			name: "unchecked topic",
+			cl:   v5,
+			pk:   publish("sensors/1/status", []byte("online")),
+		},
+		{
+			name: "inline client",
+			cl:   server.NewClient(nil, "local", "inline", true),
+			pk:   publish("sensors/1/reading", []byte("not protobuf")),
+		},
+		{
+			name:   "invalid protobuf",
+			cl:     v5,
+			pk:     publish("sensors/1/reading", []byte("not protobuf")),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "invalid json",
+			cl:     v5,
+			pk:     publish("sensors/1/reading.json", testReading()),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "json of a rule which doesn't transcode",
+			cl:     v5,
+			pk:     publish("sensors/1/location.json", []byte(`{"lat":1}`)),
+			expect: nil,
+		},
+		{
+			name:   "v3 client",
+			cl:     v3,
+			pk:     publish("sensors/1/location", str(1, "x")),
+			expect: packets.ErrRejectPacket,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := protobufHook.OnPublish(tt.cl, tt.pk)
+			if tt.expect == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tt.expect)
+		})
+	}
+
+	require.Equal(t, Stats{Validated: 2, Rejected: 3}, protobufHook.Stats())
+}
+
+func TestTranscode(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "sensors/#")
+	protobufHook := newHook(t, Options{Descriptors: testDescriptors(false), Server: server, Rules: []Rule{
+		{Filter: "sensors/+/reading", Message: "sensors.v1.Reading", Transcode: true},
+		{Filter: "sensors/+/location", Message: "sensors.v1.Location"},
+	}})
+	cl := server.NewClient(nil, "t1", "c1", false)
+
+	pk := publish("sensors/1/reading", testReading())
+	pk.FixedHeader.Retain = true
+	pk.Properties.User = []packets.UserProperty{{Key: "site", Val: "home"}}
+	protobufHook.OnPublished(cl, pk)
+
+	require.Len(t, received, 1)
+	transcoded := <-received
+	require.Equal(t, "sensors/1/reading.json", transcoded.TopicName)
+	require.JSONEq(t, testReadingJSON, string(transcoded.Payload))
+	require.Equal(t, "application/json", transcoded.Properties.ContentType)
+	require.Equal(t, byte(1), transcoded.Properties.PayloadFormat)
+	require.Equal(t, pk.Properties.User, transcoded.Properties.User)
+	require.Equal(t, ClientID, transcoded.Origin)
+
+	retained, ok := server.Topics.Retained.Get("sensors/1/reading.json")
+	require.True(t, ok)
+	require.Equal(t, transcoded.Payload, retained.Payload)
+
+	protobufHook.OnPublished(cl, publish("sensors/2/reading.json", []byte(testReadingJSON)))
+	require.Len(t, received, 1)
+	transcoded = <-received
+	require.Equal(t, "sensors/2/reading", transcoded.TopicName)
+	require.Equal(t, testReading(), transcoded.Payload)
+	require.Equal(t, "application/x-protobuf", transcoded.Properties.ContentType)
+
+	// clearing the retained message clears the transcoded one
+	clear := publish("sensors/1/reading", nil)
+	clear.FixedHeader.Retain = true
+	protobufHook.OnPublished(cl, clear)
+	require.Equal(t, "sensors/1/reading.json", (<-received).TopicName)
+	_, ok = server.Topics.Retained.Get("sensors/1/reading.json")
+	require.False(t, ok)
+
+	// messages which aren't transcoded
+	own := publish("sensors/1/reading", testReading())
+	own.Origin = ClientID
+	protobufHook.OnPublished(cl, own)
+	ignored := publish("sensors/1/reading", testReading())
+	ignored.Ignore = true
+	protobufHook.OnPublished(cl, ignored)
+	protobufHook.OnPublished(cl, publish("sensors/1/location", str(1, "x")))
+	protobufHook.OnPublished(cl, publish("sensors/1/reading", nil))
+	require.Len(t, received, 0)
+
+	protobufHook.OnPublished(cl, publish("sensors/1/reading", []byte("not protobuf")))
+	require.Len(t, received, 0)
+	require.Equal(t, Stats{Transcoded: 3, Failed: 1}, protobufHook.Stats())
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sensors.pb")
+	writeDescriptors(t, path, testDescriptors(true), time.Hour)
+
+	protobufHook := newHook(t, Options{Path: path, ReloadInterval: 10 * time.Millisecond, Rules: []Rule{
+		{Filter: "sensors/+/location", Message: "sensors.v1.Location"},
+	}})
+	cl := new(mqtt.Client)
+	require.False(t, protobufHook.descriptors.Load().Has("sensors.v1.Reading"))
+
+	// descriptors lacking the message type of a rule are not loaded
+	writeDescriptors(t, path, msg(1, str(2, "other"), msg(4, str(1, "Location"))), 30*time.Minute)
+	require.Error(t, protobufHook.Reload())
+	require.True(t, protobufHook.descriptors.Load().Has("sensors.v1.Location"))
+
+	writeDescriptors(t, path, testDescriptors(false), 0)
+	require.Eventually(t, func() bool {
+		return protobufHook.descriptors.Load().Has("sensors.v1.Reading")
+	}, time.Second, 10*time.Millisecond)
+
+	_, err := protobufHook.OnPublish(cl, publish("sensors/1/location", []byte("not protobuf")))
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+}
@@ -0,0 +1,102 @@
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// the wire types of the protobuf encoding
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5 // 3 and 4 delimit groups, which are deprecated and not supported
+)
+
+// errTruncated is returned for encodings which end in the middle of a field
+var errTruncated = errors.New("truncated protobuf encoding")
+
+// consumeTag returns the field number and wire type of the tag at the start of b, and its length
+func consumeTag(b []byte) (int32, int, int, error) {
+	v, n, err := consumeVarint(b)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	num := v >> 3
+	if num == 0 || num > math.MaxInt32 {
+		return 0, 0, 0, errors.New("invalid field number")
+	}
+	return int32(num), int(v & 7), n, nil
+}
+
+// consumeVarint returns the varint at the start of b and its length
+func consumeVarint(b []byte) (uint64, int, error) {
+	v, n := binary.Uvarint(b)
+	if n == 0 {
+		return 0, 0, errTruncated
+	}
+	if n < 0 {
+		return 0, 0, errors.New("varint overflows 64 bits")
+	}
+	return v, n, nil
+}
+
+// consumeBytes returns the length prefixed bytes at the start of b and their length with the prefix
+func consumeBytes(b []byte) ([]byte, int, error) {
+	l, n, err := consumeVarint(b)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if l > uint64(len(b)-n) {
+		return nil, 0, errTruncated
+	}
+	return b[n : n+int(l)], n + int(l), nil
+}
+
+// consumeValue returns the value of a field of the wire type at the start of b, as a varint or fixed
+// number or bytes, and its length
+func consumeValue(b []byte, wire int) (uint64, []byte, int, error) {
+	switch wire {
+	case wireVarint:
+		v, n, err := consumeVarint(b)
+		return v, nil, n, err
+	case wireFixed64:
+		if len(b) < 8 {
+			return 0, nil, 0, errTruncated
+		}
+		return binary.LittleEndian.Uint64(b), nil, 8, nil
+	case wireFixed32:
+		if len(b) < 4 {
+			return 0, nil, 0, errTruncated
+		}
+		return uint64(binary.LittleEndian.Uint32(b)), nil, 4, nil
+	case wireBytes:
+		v, n, err := consumeBytes(b)
+		return 0, v, n, err
+	}
+	return 0, nil, 0, errors.New("unsupported wire type")
+}
+
+// appendTag appends the tag of the field
+func appendTag(b []byte, num int32, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(wire))
+}
+
+// appendBytes appends the length prefixed bytes
+func appendBytes(b []byte, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// zigzag encodes a signed integer so small negative numbers have short varints
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+// unzigzag decodes a zigzag encoded integer
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
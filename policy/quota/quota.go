@@ -0,0 +1,402 @@
+package quota
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// Period is how often the quotas are reset
+type Period int
+
+const (
+	Daily   Period = iota // at midnight
+	Monthly               // at midnight on the first day of the month
+)
+
+// start returns the start of the period containing t
+func (p Period) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	if p == Monthly {
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// end returns the end of the period starting at start
+func (p Period) end(start time.Time) time.Time {
+	if p == Monthly {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// ByClientID counts the bytes of each client
+func ByClientID(cl *mqtt.Client) string {
+	return cl.ID
+}
+
+// ByUsername counts the bytes of each username, eg. of all the clients of a tenant
+func ByUsername(cl *mqtt.Client) string {
+	return string(cl.Properties.Username)
+}
+
+// Warning is the JSON payload published to the warning topic
+type Warning struct {
+	Key      string    `json:"key"`
+	Used     int64     `json:"used"`
+	Quota    int64     `json:"quota"`
+	Exceeded bool      `json:"exceeded"`
+	Start    time.Time `json:"start"` // the period of the quota
+	End      time.Time `json:"end"`
+}
+
+// Hook is a hook that counts the bytes each client or tenant publishes and receives within a period,
+// and rejects their publishes once they have used their quota
+type Hook struct {
+	config Options
+	usage  map[string]*usage
+	now    func() time.Time
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+	mqtt.HookBase
+}
+
+// usage is the usage of a key in a period, of which pending bytes have not been added to the store
+type usage struct {
+	start    time.Time
+	total    int64
+	pending  int64
+	warned   bool
+	exceeded bool
+}
+
+// Options is a struct that contains all the information required to configure the quota hook
+type Options struct {
+	Period   Period
+	Location *time.Location // where the periods start at midnight, defaults to UTC
+
+	// Key returns what is counted for the client, defaults to ByClientID. Clients with an empty key
+	// are not counted
+	Key func(cl *mqtt.Client) string
+
+	// Quota is the number of payload bytes each key may publish and receive in a period, and Quotas
+	// overrides it for particular keys. Keys without a quota are not limited
+	Quota  int64
+	Quotas map[string]int64
+
+	// Store keeps the usage, defaults to a MemoryStore. The usage is counted in memory and added to
+	// the store every FlushInterval, which defaults to 5 seconds
+	Store         Store
+	FlushInterval time.Duration
+	Timeout       time.Duration // how long a store operation may take, defaults to 5 seconds
+
+	// Server publishes a Warning to WarningTopic when a key has used WarnAt of its quota, and when it
+	// has exceeded it. The server needs its inline client enabled. WarningTopic defaults to
+	// $SYS/quota/{key}, and WarnAt to 0.8
+	Server       *mqtt.Server
+	WarningTopic string
+	WarnAt       float64
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "quota-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+		mqtt.OnPacketSent,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	quotaHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if quotaHookConfig.Quota <= 0 && len(quotaHookConfig.Quotas) == 0 {
+		return errors.New("quota is required")
+	}
+
+	if quotaHookConfig.Period != Daily && quotaHookConfig.Period != Monthly {
+		return errors.New("unsupported period")
+	}
+
+	if quotaHookConfig.Location == nil {
+		quotaHookConfig.Location = time.UTC
+	}
+
+	if quotaHookConfig.Key == nil {
+		quotaHookConfig.Key = ByClientID
+	}
+
+	if quotaHookConfig.Store == nil {
+		quotaHookConfig.Store = NewMemoryStore()
+	}
+
+	if quotaHookConfig.FlushInterval <= 0 {
+		quotaHookConfig.FlushInterval = 5 * time.Second
+	}
+
+	if quotaHookConfig.Timeout <= 0 {
+		quotaHookConfig.Timeout = 5 * time.Second
+	}
+
+	if quotaHookConfig.WarningTopic == "" {
+		quotaHookConfig.WarningTopic = "$SYS/quota/{key}"
+	}
+
+	if quotaHookConfig.WarnAt <= 0 || quotaHookConfig.WarnAt > 1 {
+		quotaHookConfig.WarnAt = 0.8
+	}
+
+	h.config = quotaHookConfig
+	h.usage = make(map[string]*usage)
+	h.now = time.Now
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.done = make(chan struct{})
+	go h.flushEvery(ctx, quotaHookConfig.FlushInterval)
+
+	return nil
+}
+
+// Stop adds the pending usage to the store
+func (h *Hook) Stop() error {
+	if h.cancel == nil {
+		return nil
+	}
+
+	h.cancel()
+	<-h.done
+	return h.Flush()
+}
+
+// flushEvery flushes the usage at the interval until the context is cancelled
+func (h *Hook) flushEvery(ctx context.Context, interval time.Duration) {
+	defer close(h.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.Flush(); err != nil {
+				h.Log.Error("error occurred while storing quota usage", "error", err)
+			}
+		}
+	}
+}
+
+// Flush adds the usage counted since the last flush to the store, and forgets the usage of past periods
+func (h *Hook) Flush() error {
+	type delta struct {
+		key   string
+		start time.Time
+		n     int64
+	}
+
+	start := h.config.Period.start(h.now().In(h.config.Location))
+
+	h.mu.Lock()
+	var deltas []delta
+	for key, u := range h.usage {
+		if u.pending > 0 {
+			deltas = append(deltas, delta{key: key, start: u.start, n: u.pending})
+		} else if !u.start.Equal(start) {
+			delete(h.usage, key)
+		}
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	var errs []error
+	for _, d := range deltas {
+		total, err := h.config.Store.Add(ctx, d.key, d.start, d.n)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		h.mu.Lock()
+		if u, ok := h.usage[d.key]; ok && u.start.Equal(d.start) {
+			u.pending -= d.n
+			u.total = total
+			if u.pending == 0 && !u.start.Equal(start) {
+				delete(h.usage, d.key)
+			}
+		}
+		h.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// quota returns the quota of the key, or 0 if it is not limited
+func (h *Hook) quota(key string) int64 {
+	if q, ok := h.config.Quotas[key]; ok {
+		return q
+	}
+	return h.config.Quota
+}
+
+// Usage returns the bytes used by the key in the current period and its quota
+func (h *Hook) Usage(ctx context.Context, key string) (int64, int64, error) {
+	start := h.config.Period.start(h.now().In(h.config.Location))
+
+	h.mu.Lock()
+	u, ok := h.usage[key]
+	if ok && u.start.Equal(start) {
+		used := u.total + u.pending
+		h.mu.Unlock()
+		return used, h.quota(key), nil
+	}
+	h.mu.Unlock()
+
+	used, err := h.config.Store.Get(ctx, key, start)
+	return used, h.quota(key), err
+}
+
+// add counts n bytes for the client and returns whether a publish is allowed. If publishing, the bytes
+// are only counted if the quota has not been exceeded
+func (h *Hook) add(cl *mqtt.Client, n int64, publishing bool) bool {
+	if cl.Net.Inline {
+		return true
+	}
+
+	key := h.config.Key(cl)
+	if key == "" {
+		return true
+	}
+
+	quota := h.quota(key)
+	if quota <= 0 {
+		return true
+	}
+
+	start := h.config.Period.start(h.now().In(h.config.Location))
+	u := h.load(key, start, quota)
+
+	h.mu.Lock()
+	used := u.total + u.pending
+	if publishing && used >= quota {
+		h.mu.Unlock()
+		return false
+	}
+
+	u.pending += n
+	used += n
+
+	var warnings []Warning
+	if !u.warned && float64(used) >= h.config.WarnAt*float64(quota) {
+		u.warned = true
+		warnings = append(warnings, Warning{Key: key, Used: used, Quota: quota})
+	}
+
+	if !u.exceeded && used >= quota {
+		u.exceeded = true
+		warnings = append(warnings, Warning{Key: key, Used: used, Quota: quota, Exceeded: true})
+	}
+	h.mu.Unlock()
+
+	for _, w := range warnings {
+		w.Start, w.End = start, h.config.Period.end(start)
+		h.warn(w)
+	}
+
+	return true
+}
+
+// load returns the usage of the key in the period, reading it from the store if it isn't in memory
+func (h *Hook) load(key string, start time.Time, quota int64) *usage {
+	h.mu.Lock()
+	u, ok := h.usage[key]
+	h.mu.Unlock()
+	if ok && u.start.Equal(start) {
+		return u
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	total, err := h.config.Store.Get(ctx, key, start)
+	if err != nil {
+		h.Log.Error("error occurred while loading quota usage", "error", err, "key", key)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// another client of the key may have loaded it meanwhile
+	if u, ok := h.usage[key]; ok && u.start.Equal(start) {
+		return u
+	}
+
+	u = &usage{
+		start:    start,
+		total:    total,
+		warned:   float64(total) >= h.config.WarnAt*float64(quota),
+		exceeded: total >= quota,
+	}
+	h.usage[key] = u
+	return u
+}
+
+// warn publishes the warning if a server is configured
+func (h *Hook) warn(w Warning) {
+	h.Log.Warn("client is approaching or has exceeded its quota", "key", w.Key, "used", w.Used, "quota", w.Quota, "exceeded", w.Exceeded)
+	if h.config.Server == nil {
+		return
+	}
+
+	payload, err := json.Marshal(w)
+	if err != nil {
+		return
+	}
+
+	topic := strings.ReplaceAll(h.config.WarningTopic, "{key}", w.Key)
+	if err := h.config.Server.Publish(topic, payload, false, 0); err != nil {
+		h.Log.Error("error occurred while publishing quota warning", "error", err, "topic", topic)
+	}
+}
+
+// OnPublish is called when a client publishes a message, and rejects it if the quota is exceeded
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if h.add(cl, int64(len(pk.Payload)), true) {
+		return pk, nil
+	}
+
+	return pk, reject.Publish(cl, pk, packets.ErrQuotaExceeded)
+}
+
+// OnPacketSent is called when a packet is sent to a client, and counts the messages it receives
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if pk.FixedHeader.Type == packets.Publish {
+		h.add(cl, int64(len(pk.Payload)), false)
+	}
+}
@@ -0,0 +1,292 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStore fails every operation
+type failingStore struct{}
+
+func (failingStore) Add(ctx context.Context, key string, start time.Time, n int64) (int64, error) {
+	return 0, errors.New("store unavailable")
+}
+
+func (failingStore) Get(ctx context.Context, key string, start time.Time) (int64, error) {
+	return 0, errors.New("store unavailable")
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	quotaHook := new(Hook)
+	quotaHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, quotaHook.Init(options))
+	t.Cleanup(func() { quotaHook.Stop() })
+
+	now := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	quotaHook.now = func() time.Time { return now }
+	return quotaHook
+}
+
+func client(id, username string, version byte) *mqtt.Client {
+	cl := &mqtt.Client{ID: id}
+	cl.Properties.Username = []byte(username)
+	cl.Properties.ProtocolVersion = version
+	return cl
+}
+
+func publishPacket(qos byte, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: qos},
+		TopicName:   "a/b",
+		Payload:     []byte(payload),
+	}
+}
+
+func TestID(t *testing.T) {
+	quotaHook := new(Hook)
+
+	require.Equal(t, "quota-policy-hook", quotaHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	quotaHook := new(Hook)
+	require.True(t, quotaHook.Provides(mqtt.OnPublish))
+	require.True(t, quotaHook.Provides(mqtt.OnPacketSent))
+	require.False(t, quotaHook.Provides(mqtt.OnConnect))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - quota",
+			config:      Options{Quota: 1000},
+			expectError: false,
+		},
+		{
+			name:        "Success - quotas",
+			config:      Options{Quotas: map[string]int64{"acme": 1000}, Period: Monthly},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no quota",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unsupported period",
+			config:      Options{Quota: 1000, Period: 7},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			quotaHook := new(Hook)
+			quotaHook.Log = slog.Default()
+			err := quotaHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "$SYS/quota/{key}", quotaHook.config.WarningTopic)
+			require.Equal(t, 0.8, quotaHook.config.WarnAt)
+			require.NotNil(t, quotaHook.config.Store)
+			require.NoError(t, quotaHook.Stop())
+
+		})
+	}
+}
+
+func TestPeriod(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		berlin = time.FixedZone("CET", 3600)
+	}
+
+	now := time.Date(2024, 2, 15, 0, 30, 0, 0, berlin)
+	require.Equal(t, time.Date(2024, 2, 15, 0, 0, 0, 0, berlin), Daily.start(now))
+	require.Equal(t, time.Date(2024, 2, 16, 0, 0, 0, 0, berlin), Daily.end(Daily.start(now)))
+	require.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, berlin), Monthly.start(now))
+	require.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, berlin), Monthly.end(Monthly.start(now)))
+}
+
+func TestOnPublish(t *testing.T) {
+	quotaHook := newHook(t, Options{Quota: 10, Quotas: map[string]int64{"unlimited": 0}})
+
+	v5 := client("v5", "", 5)
+	require.NoError(t, publish(quotaHook, v5, 1, "123456"))
+	require.NoError(t, publish(quotaHook, v5, 1, "123456"))
+
+	// the quota is exceeded once used, so the publish crossing it is allowed
+	require.ErrorIs(t, publish(quotaHook, v5, 1, "1"), packets.ErrQuotaExceeded)
+	require.ErrorIs(t, publish(quotaHook, v5, 0, "1"), packets.ErrRejectPacket)
+
+	v3 := client("v3", "", 4)
+	require.NoError(t, publish(quotaHook, v3, 1, "1234567890"))
+	require.ErrorIs(t, publish(quotaHook, v3, 1, "1"), packets.ErrRejectPacket)
+
+	used, quota, err := quotaHook.Usage(context.Background(), "v5")
+	require.NoError(t, err)
+	require.Equal(t, int64(12), used)
+	require.Equal(t, int64(10), quota)
+
+	// keys without a quota, and the inline client, are not limited
+	unlimited := client("unlimited", "", 5)
+	inline := client("inline", "", 5)
+	inline.Net.Inline = true
+	for i := 0; i < 3; i++ {
+		require.NoError(t, publish(quotaHook, unlimited, 1, "1234567890"))
+		require.NoError(t, publish(quotaHook, inline, 1, "1234567890"))
+	}
+}
+
+func publish(h *Hook, cl *mqtt.Client, qos byte, payload string) error {
+	_, err := h.OnPublish(cl, publishPacket(qos, payload))
+	return err
+}
+
+func TestOnPacketSent(t *testing.T) {
+	quotaHook := newHook(t, Options{Quota: 10, Key: ByUsername})
+
+	// received messages count against the quota of the tenant
+	a := client("a", "acme", 5)
+	b := client("b", "acme", 5)
+	quotaHook.OnPacketSent(a, publishPacket(0, "123456789"), nil)
+	quotaHook.OnPacketSent(a, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Puback}}, nil)
+	require.NoError(t, publish(quotaHook, b, 1, "1"))
+	require.ErrorIs(t, publish(quotaHook, a, 1, "1"), packets.ErrQuotaExceeded)
+
+	// received messages are counted beyond the quota
+	quotaHook.OnPacketSent(b, publishPacket(0, "12345"), nil)
+	used, _, err := quotaHook.Usage(context.Background(), "acme")
+	require.NoError(t, err)
+	require.Equal(t, int64(15), used)
+
+	// clients without a username are not counted
+	anonymous := client("c", "", 5)
+	quotaHook.OnPacketSent(anonymous, publishPacket(0, "12345678901"), nil)
+	require.NoError(t, publish(quotaHook, anonymous, 1, "1"))
+}
+
+func TestFlush(t *testing.T) {
+	store := NewMemoryStore()
+	quotaHook := newHook(t, Options{Quota: 100, Store: store})
+	start := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	require.NoError(t, publish(quotaHook, client("a", "", 5), 0, "1234"))
+	used, err := store.Get(context.Background(), "a", start)
+	require.NoError(t, err)
+	require.Zero(t, used)
+
+	require.NoError(t, quotaHook.Flush())
+	used, err = store.Get(context.Background(), "a", start)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), used)
+
+	// usage from other brokers sharing the store is picked up on flush
+	_, err = store.Add(context.Background(), "a", start, 90)
+	require.NoError(t, err)
+	require.NoError(t, publish(quotaHook, client("a", "", 5), 0, "1"))
+	require.NoError(t, quotaHook.Flush())
+	require.NoError(t, publish(quotaHook, client("a", "", 5), 0, "1234567"))
+	require.ErrorIs(t, publish(quotaHook, client("a", "", 5), 0, "1"), packets.ErrRejectPacket)
+
+	// a new period starts from the store, and the previous period is forgotten
+	quotaHook.now = func() time.Time { return start.AddDate(0, 0, 1) }
+	require.NoError(t, quotaHook.Flush())
+	require.Empty(t, quotaHook.usage)
+	require.NoError(t, publish(quotaHook, client("a", "", 5), 0, "1234567"))
+}
+
+func TestLoad(t *testing.T) {
+	store := NewMemoryStore()
+	start := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	_, err := store.Add(context.Background(), "a", start, 100)
+	require.NoError(t, err)
+
+	// usage stored by an earlier run is enforced
+	quotaHook := newHook(t, Options{Quota: 100, Store: store, Server: mqtt.New(&mqtt.Options{InlineClient: true})})
+	require.ErrorIs(t, publish(quotaHook, client("a", "", 5), 0, "1"), packets.ErrRejectPacket)
+	require.True(t, quotaHook.usage["a"].exceeded)
+
+	// usage is still counted if the store fails
+	quotaHook = newHook(t, Options{Quota: 100, Store: failingStore{}})
+	require.NoError(t, publish(quotaHook, client("a", "", 5), 0, "1"))
+	require.Error(t, quotaHook.Flush())
+	require.Equal(t, int64(1), quotaHook.usage["a"].pending)
+}
+
+func TestStop(t *testing.T) {
+	store := NewMemoryStore()
+	quotaHook := newHook(t, Options{Quota: 100, Store: store})
+	require.NoError(t, publish(quotaHook, client("a", "", 5), 0, "1234"))
+	require.NoError(t, quotaHook.Stop())
+
+	used, err := store.Get(context.Background(), "a", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, int64(4), used)
+
+	require.NoError(t, new(Hook).Stop())
+}
+
+func TestWarnings(t *testing.T) {
+	s := mqtt.New(&mqtt.Options{InlineClient: true})
+	quotaHook := newHook(t, Options{Quota: 10, Period: Monthly, Server: s, WarnAt: 0.5})
+
+	var warnings []Warning
+	var mu sync.Mutex
+	require.NoError(t, s.Subscribe("$SYS/quota/+", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		var w Warning
+		require.NoError(t, json.Unmarshal(pk.Payload, &w))
+		mu.Lock()
+		warnings = append(warnings, w)
+		mu.Unlock()
+	}))
+
+	cl := client("sensor", "", 5)
+	require.NoError(t, publish(quotaHook, cl, 0, "1234"))
+	require.NoError(t, publish(quotaHook, cl, 0, "1"))
+	require.NoError(t, publish(quotaHook, cl, 0, "1"))
+	require.NoError(t, publish(quotaHook, cl, 0, "1234"))
+	require.Error(t, publish(quotaHook, cl, 0, "1"))
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(warnings) == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, []Warning{
+		{Key: "sensor", Used: 5, Quota: 10, Start: start, End: end},
+		{Key: "sensor", Used: 10, Quota: 10, Exceeded: true, Start: start, End: end},
+	}, warnings)
+}
@@ -0,0 +1,130 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/auth/redis"
+)
+
+// Store persists the bytes used by each key in each period, and must be safe for concurrent use
+type Store interface {
+	// Add adds n bytes to the usage of the key in the period starting at start, and returns the total
+	Add(ctx context.Context, key string, start time.Time, n int64) (int64, error)
+
+	// Get returns the usage of the key in the period starting at start
+	Get(ctx context.Context, key string, start time.Time) (int64, error)
+}
+
+// MemoryStore keeps the usage of the current period of each key in memory, so it is lost when the
+// broker stops
+type MemoryStore struct {
+	usage map[string]periodUsage
+	mu    sync.Mutex
+}
+
+type periodUsage struct {
+	start time.Time
+	bytes int64
+}
+
+// NewMemoryStore returns an empty store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{usage: make(map[string]periodUsage)}
+}
+
+// Add adds n bytes to the usage of the key, discarding the usage of an earlier period
+func (s *MemoryStore) Add(ctx context.Context, key string, start time.Time, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.usage[key]
+	if !u.start.Equal(start) {
+		u = periodUsage{start: start}
+	}
+
+	u.bytes += n
+	s.usage[key] = u
+	return u.bytes, nil
+}
+
+// Get returns the usage of the key in the period
+func (s *MemoryStore) Get(ctx context.Context, key string, start time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u := s.usage[key]; u.start.Equal(start) {
+		return u.bytes, nil
+	}
+	return 0, nil
+}
+
+// DefaultRedisPrefix is the prefix of the keys written by a RedisStore
+const DefaultRedisPrefix = "mqtt:quota:"
+
+// RedisStore counts the usage of each key and period in a Redis integer at the prefix followed by the
+// key and the start of the period, eg. mqtt:quota:acme:20240101, which expires after Retention, so that
+// several brokers can share the quotas
+type RedisStore struct {
+	client    redis.Client
+	prefix    string
+	retention time.Duration
+}
+
+// NewRedisStore returns a store using the client, eg. one returned by redis.NewClient. The prefix
+// defaults to DefaultRedisPrefix, and the usage is kept for the retention after the start of its
+// period, which defaults to 62 days
+func NewRedisStore(client redis.Client, prefix string, retention time.Duration) *RedisStore {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+
+	if retention <= 0 {
+		retention = 62 * 24 * time.Hour
+	}
+
+	return &RedisStore{client: client, prefix: prefix, retention: retention}
+}
+
+// key returns the Redis key of the usage
+func (s *RedisStore) key(key string, start time.Time) string {
+	return s.prefix + key + ":" + start.Format("20060102")
+}
+
+// Add increments the usage of the key
+func (s *RedisStore) Add(ctx context.Context, key string, start time.Time, n int64) (int64, error) {
+	k := s.key(key, start)
+	reply, err := s.client.Do(ctx, "INCRBY", k, n)
+	if err != nil {
+		return 0, err
+	}
+
+	total, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply to INCRBY %s", k)
+	}
+
+	if _, err := s.client.Do(ctx, "EXPIREAT", k, start.Add(s.retention).Unix()); err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// Get returns the usage of the key
+func (s *RedisStore) Get(ctx context.Context, key string, start time.Time) (int64, error) {
+	k := s.key(key, start)
+	reply, err := s.client.Do(ctx, "GET", k)
+	if err != nil || reply == nil {
+		return 0, err
+	}
+
+	v, ok := reply.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply to GET %s", k)
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
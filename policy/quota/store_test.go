@@ -0,0 +1,87 @@
+package quota
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/auth/redis"
+)
+
+// fakeRedis answers the commands of the RedisStore from memory
+type fakeRedis struct {
+	values  map[string]int64
+	expires map[string]int64
+}
+
+func (r *fakeRedis) Do(ctx context.Context, args ...any) (any, error) {
+	key := args[1].(string)
+	switch args[0] {
+	case "INCRBY":
+		r.values[key] += args[2].(int64)
+		return r.values[key], nil
+	case "EXPIREAT":
+		r.expires[key] = args[2].(int64)
+		return int64(1), nil
+	case "GET":
+		if v, ok := r.values[key]; ok {
+			return strconv.FormatInt(v, 10), nil
+		}
+		return nil, nil
+	}
+	return nil, redis.Error("ERR unknown command")
+}
+
+func (r *fakeRedis) Close() error {
+	return nil
+}
+
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+	january := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	february := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	used, err := store.Get(ctx, "acme", january)
+	require.NoError(t, err)
+	require.Zero(t, used)
+
+	total, err := store.Add(ctx, "acme", january, 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), total)
+
+	total, err = store.Add(ctx, "acme", january, 50)
+	require.NoError(t, err)
+	require.Equal(t, int64(150), total)
+
+	used, err = store.Get(ctx, "acme", january)
+	require.NoError(t, err)
+	require.Equal(t, int64(150), used)
+
+	total, err = store.Add(ctx, "acme", february, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), total)
+
+	used, err = store.Get(ctx, "other", february)
+	require.NoError(t, err)
+	require.Zero(t, used)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestRedisStore(t *testing.T) {
+	r := &fakeRedis{values: make(map[string]int64), expires: make(map[string]int64)}
+	testStore(t, NewRedisStore(r, "", 0))
+	require.Equal(t, int64(150), r.values["mqtt:quota:acme:20240101"])
+	require.Equal(t, time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC).Unix(), r.expires["mqtt:quota:acme:20240101"])
+
+	store := NewRedisStore(r, "q:", time.Hour)
+	_, err := store.Add(context.Background(), "acme", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 1)
+	require.NoError(t, err)
+	require.Contains(t, r.values, "q:acme:20240101")
+}
@@ -0,0 +1,354 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Hook is a hook that limits the connection attempts of each IP address and client ID within a sliding
+// window, and temporarily bans sources which exceed the limits or repeatedly fail to authenticate
+type Hook struct {
+	config    Options
+	exempt    []*net.IPNet
+	ips       map[string]*source
+	clientIDs map[string]*source
+	pending   map[*mqtt.Client]attempt
+	now       func() time.Time
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	mqtt.HookBase
+}
+
+// source is the recent activity of an IP address or client ID
+type source struct {
+	attempts []time.Time
+	failures []time.Time
+	banned   time.Time // the end of the current or last ban
+	bans     int       // the number of bans, which lengthen each ban
+}
+
+// attempt is a connection attempt which counts as a failure until its session is established
+type attempt struct {
+	ip string
+	at time.Time
+}
+
+// Options is a struct that contains all the information required to configure the ratelimit hook
+type Options struct {
+	Window time.Duration // the sliding window attempts are counted in, defaults to 1 minute
+
+	// MaxAttemptsPerIP and MaxAttemptsPerClientID limit the connection attempts within the window, and
+	// MaxFailures limits the attempts of an IP address which failed to authenticate. A source
+	// exceeding a limit is banned, and a limit of 0 is not enforced
+	MaxAttemptsPerIP       int
+	MaxAttemptsPerClientID int
+	MaxFailures            int
+
+	// BanDuration is how long a source is banned for, defaults to 5 minutes. Each further ban of the
+	// source doubles the duration up to MaxBanDuration, which defaults to BanDuration. A source is
+	// forgotten once it has been inactive for MaxBanDuration after its last ban
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+
+	// ExemptNetworks and ExemptClientIDs are never limited, eg. 10.0.0.0/8 or a monitoring client
+	ExemptNetworks  []string
+	ExemptClientIDs []string
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "ratelimit-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+		mqtt.OnSessionEstablish,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	ratelimitHookConfig, exempt, err := parseOptions(config)
+	if err != nil {
+		return err
+	}
+
+	h.config = ratelimitHookConfig
+	h.exempt = exempt
+	h.ips = make(map[string]*source)
+	h.clientIDs = make(map[string]*source)
+	h.pending = make(map[*mqtt.Client]attempt)
+	h.now = time.Now
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go h.sweepEvery(ctx, ratelimitHookConfig.Window)
+
+	return nil
+}
+
+// Reload applies new limits and exemptions, keeping the activity and bans of the sources. Sources are
+// still swept at the window they were initialized with
+func (h *Hook) Reload(config any) error {
+	ratelimitHookConfig, exempt, err := parseOptions(config)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = ratelimitHookConfig
+	h.exempt = exempt
+	return nil
+}
+
+// parseOptions returns the options with their defaults, and the exempt networks
+func parseOptions(config any) (Options, []*net.IPNet, error) {
+	if config == nil {
+		return Options{}, nil, errors.New("nil config")
+	}
+
+	ratelimitHookConfig, ok := config.(Options)
+	if !ok {
+		return Options{}, nil, errors.New("improper config")
+	}
+
+	if ratelimitHookConfig.MaxAttemptsPerIP <= 0 && ratelimitHookConfig.MaxAttemptsPerClientID <= 0 && ratelimitHookConfig.MaxFailures <= 0 {
+		return Options{}, nil, errors.New("at least one limit is required")
+	}
+
+	if ratelimitHookConfig.Window <= 0 {
+		ratelimitHookConfig.Window = time.Minute
+	}
+
+	if ratelimitHookConfig.BanDuration <= 0 {
+		ratelimitHookConfig.BanDuration = 5 * time.Minute
+	}
+
+	if ratelimitHookConfig.MaxBanDuration < ratelimitHookConfig.BanDuration {
+		ratelimitHookConfig.MaxBanDuration = ratelimitHookConfig.BanDuration
+	}
+
+	var exempt []*net.IPNet
+	for _, cidr := range ratelimitHookConfig.ExemptNetworks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return Options{}, nil, err
+		}
+		exempt = append(exempt, n)
+	}
+
+	return ratelimitHookConfig, exempt, nil
+}
+
+// Stop stops forgetting inactive sources
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	return nil
+}
+
+// sweepEvery forgets inactive sources at the interval until the context is cancelled
+func (h *Hook) sweepEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.sweep()
+		}
+	}
+}
+
+// sweep forgets the sources without recent attempts whose bans no longer affect later bans, and
+// attempts which were never established
+func (h *Hook) sweep() {
+	now := h.now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cutoff := now.Add(-h.config.Window)
+	for _, sources := range []map[string]*source{h.ips, h.clientIDs} {
+		for key, s := range sources {
+			s.prune(cutoff)
+			if len(s.attempts) == 0 && len(s.failures) == 0 && now.After(s.banned.Add(h.config.MaxBanDuration)) {
+				delete(sources, key)
+			}
+		}
+	}
+
+	for cl, a := range h.pending {
+		if a.at.Before(cutoff) {
+			delete(h.pending, cl)
+		}
+	}
+}
+
+// Unban lifts the ban of the IP address or client ID and forgets its activity
+func (h *Hook) Unban(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.ips, key)
+	delete(h.clientIDs, key)
+}
+
+// OnConnect is called when a client connects, and rejects banned sources and those exceeding a limit
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	ip := remoteIP(cl.Net.Remote)
+	clientID := string(pk.Connect.ClientIdentifier)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.exempted(ip, clientID) {
+		return nil
+	}
+
+	now := h.now()
+	cutoff := now.Add(-h.config.Window)
+
+	var ipSource, clientSource *source
+	if ip != nil {
+		ipSource = h.source(h.ips, ip.String(), cutoff)
+	}
+
+	if clientID != "" {
+		clientSource = h.source(h.clientIDs, clientID, cutoff)
+	}
+
+	for _, s := range []*source{ipSource, clientSource} {
+		if s != nil && now.Before(s.banned) {
+			return packets.ErrBanned
+		}
+	}
+
+	if ipSource != nil {
+		ipSource.attempts = append(ipSource.attempts, now)
+		if h.config.MaxAttemptsPerIP > 0 && len(ipSource.attempts) > h.config.MaxAttemptsPerIP {
+			h.ban(ipSource, now)
+			h.Log.Warn("banning ip address exceeding connection rate", "client", cl.ID, "remote", cl.Net.Remote, "until", ipSource.banned)
+			return packets.ErrConnectionRateExceeded
+		}
+
+		if h.config.MaxFailures > 0 && len(ipSource.failures) >= h.config.MaxFailures {
+			h.ban(ipSource, now)
+			h.Log.Warn("banning ip address failing to authenticate", "client", cl.ID, "remote", cl.Net.Remote, "until", ipSource.banned)
+			return packets.ErrBanned
+		}
+	}
+
+	if clientSource != nil {
+		clientSource.attempts = append(clientSource.attempts, now)
+		if h.config.MaxAttemptsPerClientID > 0 && len(clientSource.attempts) > h.config.MaxAttemptsPerClientID {
+			h.ban(clientSource, now)
+			h.Log.Warn("banning client id exceeding connection rate", "client", cl.ID, "remote", cl.Net.Remote, "until", clientSource.banned)
+			return packets.ErrConnectionRateExceeded
+		}
+	}
+
+	// the attempt is a failure unless the client authenticates and establishes a session
+	if ipSource != nil {
+		ipSource.failures = append(ipSource.failures, now)
+		h.pending[cl] = attempt{ip: ip.String(), at: now}
+	}
+
+	return nil
+}
+
+// OnSessionEstablish is called when a client has authenticated, and removes its attempt from the failures
+func (h *Hook) OnSessionEstablish(cl *mqtt.Client, pk packets.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	a, ok := h.pending[cl]
+	if !ok {
+		return
+	}
+	delete(h.pending, cl)
+
+	if s, ok := h.ips[a.ip]; ok {
+		if i := slices.IndexFunc(s.failures, a.at.Equal); i >= 0 {
+			s.failures = slices.Delete(s.failures, i, i+1)
+		}
+	}
+}
+
+// exempted returns whether the ip or client id is never limited, and must be called with the lock held
+func (h *Hook) exempted(ip net.IP, clientID string) bool {
+	if clientID != "" && slices.Contains(h.config.ExemptClientIDs, clientID) {
+		return true
+	}
+
+	for _, n := range h.exempt {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// source returns the source of the key with its attempts before the cutoff removed, and must be
+// called with the lock held
+func (h *Hook) source(sources map[string]*source, key string, cutoff time.Time) *source {
+	s, ok := sources[key]
+	if !ok {
+		s = new(source)
+		sources[key] = s
+	}
+
+	s.prune(cutoff)
+	return s
+}
+
+// ban bans the source, doubling the duration of each further ban up to the maximum
+func (h *Hook) ban(s *source, now time.Time) {
+	d := h.config.BanDuration
+	for i := 0; i < s.bans && d < h.config.MaxBanDuration; i++ {
+		d *= 2
+	}
+
+	s.bans++
+	s.banned = now.Add(min(d, h.config.MaxBanDuration))
+	s.attempts = nil
+	s.failures = nil
+}
+
+// prune removes the attempts and failures before the cutoff
+func (s *source) prune(cutoff time.Time) {
+	s.attempts = after(s.attempts, cutoff)
+	s.failures = after(s.failures, cutoff)
+}
+
+// after returns the times, which are in order, from the cutoff onwards
+func after(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// remoteIP returns the ip of the remote address, or nil if it isn't an ip address
+func remoteIP(remote string) net.IP {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	return net.ParseIP(host)
+}
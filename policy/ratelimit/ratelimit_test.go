@@ -0,0 +1,298 @@
+package ratelimit
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// clock is a manually advanced time source
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newHook(t *testing.T, options Options) (*Hook, *clock) {
+	t.Helper()
+
+	ratelimitHook := new(Hook)
+	ratelimitHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, ratelimitHook.Init(options))
+	t.Cleanup(func() { ratelimitHook.Stop() })
+
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ratelimitHook.now = c.now
+	return ratelimitHook, c
+}
+
+func connect(h *Hook, remote, clientID string) (*mqtt.Client, error) {
+	cl := &mqtt.Client{ID: clientID}
+	cl.Net.Remote = remote
+	pk := packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: clientID}}
+	return cl, h.OnConnect(cl, pk)
+}
+
+// connectEstablished connects a client which authenticates successfully
+func connectEstablished(h *Hook, remote, clientID string) error {
+	cl, err := connect(h, remote, clientID)
+	if err == nil {
+		h.OnSessionEstablish(cl, packets.Packet{})
+	}
+	return err
+}
+
+func TestID(t *testing.T) {
+	ratelimitHook := new(Hook)
+
+	require.Equal(t, "ratelimit-policy-hook", ratelimitHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	ratelimitHook := new(Hook)
+	require.True(t, ratelimitHook.Provides(mqtt.OnConnect))
+	require.True(t, ratelimitHook.Provides(mqtt.OnSessionEstablish))
+	require.False(t, ratelimitHook.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - ip limit",
+			config:      Options{MaxAttemptsPerIP: 10},
+			expectError: false,
+		},
+		{
+			name:        "Success - failure limit with exemptions",
+			config:      Options{MaxFailures: 5, ExemptNetworks: []string{"10.0.0.0/8"}, ExemptClientIDs: []string{"monitor"}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no limits",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid exempt network",
+			config:      Options{MaxFailures: 5, ExemptNetworks: []string{"10.0.0.0"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ratelimitHook := new(Hook)
+			ratelimitHook.Log = slog.Default()
+			err := ratelimitHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, time.Minute, ratelimitHook.config.Window)
+			require.Equal(t, 5*time.Minute, ratelimitHook.config.BanDuration)
+			require.Equal(t, 5*time.Minute, ratelimitHook.config.MaxBanDuration)
+			require.NoError(t, ratelimitHook.Stop())
+
+		})
+	}
+}
+
+func TestMaxAttemptsPerIP(t *testing.T) {
+	ratelimitHook, c := newHook(t, Options{MaxAttemptsPerIP: 3, Window: time.Minute, BanDuration: 10 * time.Minute})
+
+	// attempts leave the window as it slides
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "a"))
+	c.advance(30 * time.Second)
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1001", "b"))
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1002", "c"))
+	c.advance(31 * time.Second)
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1003", "d"))
+
+	_, err := connect(ratelimitHook, "1.2.3.4:1004", "e")
+	require.ErrorIs(t, err, packets.ErrConnectionRateExceeded)
+
+	// other addresses are not affected, but the banned one is
+	require.NoError(t, connectEstablished(ratelimitHook, "5.6.7.8:1000", "f"))
+	c.advance(9 * time.Minute)
+	_, err = connect(ratelimitHook, "1.2.3.4:1005", "g")
+	require.ErrorIs(t, err, packets.ErrBanned)
+
+	c.advance(time.Minute)
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1006", "h"))
+}
+
+func TestMaxAttemptsPerClientID(t *testing.T) {
+	ratelimitHook, c := newHook(t, Options{MaxAttemptsPerClientID: 2, BanDuration: time.Minute})
+
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "flapping"))
+	require.NoError(t, connectEstablished(ratelimitHook, "5.6.7.8:1000", "flapping"))
+	_, err := connect(ratelimitHook, "9.9.9.9:1000", "flapping")
+	require.ErrorIs(t, err, packets.ErrConnectionRateExceeded)
+
+	// the client id is banned from every address
+	_, err = connect(ratelimitHook, "1.2.3.4:1001", "flapping")
+	require.ErrorIs(t, err, packets.ErrBanned)
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1002", "other"))
+
+	// empty client ids are assigned by the server and not limited
+	for i := 0; i < 5; i++ {
+		require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1003", ""))
+	}
+
+	c.advance(time.Minute)
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1004", "flapping"))
+}
+
+func TestMaxFailures(t *testing.T) {
+	ratelimitHook, c := newHook(t, Options{MaxFailures: 2, BanDuration: time.Minute})
+
+	// successful authentications are not failures
+	for i := 0; i < 5; i++ {
+		require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "device"))
+	}
+
+	_, err := connect(ratelimitHook, "1.2.3.4:1001", "device")
+	require.NoError(t, err)
+	_, err = connect(ratelimitHook, "1.2.3.4:1002", "device")
+	require.NoError(t, err)
+
+	_, err = connect(ratelimitHook, "1.2.3.4:1003", "device")
+	require.ErrorIs(t, err, packets.ErrBanned)
+	_, err = connect(ratelimitHook, "1.2.3.4:1004", "device")
+	require.ErrorIs(t, err, packets.ErrBanned)
+
+	c.advance(time.Minute)
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1005", "device"))
+}
+
+func TestBanEscalation(t *testing.T) {
+	ratelimitHook, c := newHook(t, Options{MaxFailures: 1, BanDuration: time.Minute, MaxBanDuration: 3 * time.Minute})
+
+	expect := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	for _, d := range expect {
+		_, err := connect(ratelimitHook, "1.2.3.4:1000", "device")
+		require.NoError(t, err)
+		_, err = connect(ratelimitHook, "1.2.3.4:1000", "device")
+		require.ErrorIs(t, err, packets.ErrBanned)
+
+		c.advance(d - time.Second)
+		_, err = connect(ratelimitHook, "1.2.3.4:1000", "device")
+		require.ErrorIs(t, err, packets.ErrBanned)
+		c.advance(time.Second)
+	}
+
+	// the source is forgotten once inactive for the maximum ban duration
+	c.advance(3*time.Minute + time.Second)
+	ratelimitHook.sweep()
+	require.Empty(t, ratelimitHook.ips)
+
+	_, err := connect(ratelimitHook, "1.2.3.4:1000", "device")
+	require.NoError(t, err)
+	_, err = connect(ratelimitHook, "1.2.3.4:1000", "device")
+	require.ErrorIs(t, err, packets.ErrBanned)
+	require.Equal(t, c.t.Add(time.Minute), ratelimitHook.ips["1.2.3.4"].banned)
+}
+
+func TestExempt(t *testing.T) {
+	ratelimitHook, _ := newHook(t, Options{
+		MaxAttemptsPerIP: 1,
+		ExemptNetworks:   []string{"10.0.0.0/8"},
+		ExemptClientIDs:  []string{"monitor"},
+	})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, connectEstablished(ratelimitHook, "10.1.2.3:1000", "device"))
+		require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "monitor"))
+	}
+
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "device"))
+	_, err := connect(ratelimitHook, "1.2.3.4:1000", "device")
+	require.ErrorIs(t, err, packets.ErrConnectionRateExceeded)
+
+	// addresses which aren't ips are only limited by client id
+	require.NoError(t, connectEstablished(ratelimitHook, "pipe", "inline"))
+	require.NoError(t, connectEstablished(ratelimitHook, "pipe", "inline"))
+}
+
+func TestReload(t *testing.T) {
+	ratelimitHook, _ := newHook(t, Options{MaxAttemptsPerIP: 1, BanDuration: time.Hour})
+
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "a"))
+	require.NoError(t, ratelimitHook.Reload(Options{MaxAttemptsPerIP: 3, ExemptNetworks: []string{"10.0.0.0/8"}}))
+
+	// the activity of sources is kept under the new limits
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "b"))
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "c"))
+	_, err := connect(ratelimitHook, "1.2.3.4:1000", "d")
+	require.ErrorIs(t, err, packets.ErrConnectionRateExceeded)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, connectEstablished(ratelimitHook, "10.1.2.3:1000", "e"))
+	}
+
+	// invalid options keep the current ones
+	require.Error(t, ratelimitHook.Reload(Options{}))
+	require.Error(t, ratelimitHook.Reload(Options{MaxFailures: 1, ExemptNetworks: []string{"10.0.0.0"}}))
+	require.Error(t, ratelimitHook.Reload("improper"))
+	require.Equal(t, 3, ratelimitHook.config.MaxAttemptsPerIP)
+	require.Equal(t, 5*time.Minute, ratelimitHook.config.BanDuration)
+}
+
+func TestUnban(t *testing.T) {
+	ratelimitHook, _ := newHook(t, Options{MaxAttemptsPerIP: 1, MaxAttemptsPerClientID: 1})
+
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "device"))
+	_, err := connect(ratelimitHook, "1.2.3.4:1000", "other")
+	require.ErrorIs(t, err, packets.ErrConnectionRateExceeded)
+	_, err = connect(ratelimitHook, "1.2.3.4:1000", "other")
+	require.ErrorIs(t, err, packets.ErrBanned)
+
+	ratelimitHook.Unban("1.2.3.4")
+	require.NoError(t, connectEstablished(ratelimitHook, "1.2.3.4:1000", "other"))
+}
+
+func TestSweep(t *testing.T) {
+	ratelimitHook, c := newHook(t, Options{MaxAttemptsPerIP: 5, MaxFailures: 5})
+
+	_, err := connect(ratelimitHook, "1.2.3.4:1000", "failed")
+	require.NoError(t, err)
+	require.NoError(t, connectEstablished(ratelimitHook, "[2001:db8::1]:1000", "device"))
+	require.Len(t, ratelimitHook.pending, 1)
+
+	ratelimitHook.sweep()
+	require.Len(t, ratelimitHook.ips, 2)
+	require.Len(t, ratelimitHook.clientIDs, 2)
+
+	c.advance(time.Minute + time.Second)
+	ratelimitHook.sweep()
+	require.Empty(t, ratelimitHook.ips)
+	require.Empty(t, ratelimitHook.clientIDs)
+	require.Empty(t, ratelimitHook.pending)
+}
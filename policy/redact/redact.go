@@ -0,0 +1,472 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// wildcard is the key of paths which matches every field of an object or element of an array
+const wildcard = "*"
+
+// errInvalid is returned for payloads which must be redacted but aren't JSON
+var errInvalid = errors.New("payload is not JSON")
+
+// Rule is the fields of the JSON payloads published to the topics matching a filter which are redacted
+type Rule struct {
+	// Filter is the topic filter of the rule, eg. vehicles/+/position
+	Filter string
+
+	// Remove and Mask are the paths of the fields which are removed, or replaced with the mask. Paths
+	// are keys and array indexes joined by dots, where * matches every key or index, eg. gps.lat or
+	// readings.*.serial
+	Remove []string
+	Mask   []string
+}
+
+// Stats are the totals of the messages passed to the wrapped hook since the hook was initialized
+type Stats struct {
+	Redacted int64 // the number of messages passed with fields removed or masked
+	Dropped  int64 // the number of messages which weren't passed as their payloads aren't JSON
+}
+
+// Hook is a hook that removes or masks the fields of JSON payloads before the wrapped storage, bridge or
+// sink hook persists or forwards them, while subscribers receive the messages as they were published
+type Hook struct {
+	config Options
+	rules  []rule
+	stats  Stats
+	mu     sync.Mutex // guards stats
+	mqtt.HookBase
+}
+
+// rule is a rule with its paths split into keys
+type rule struct {
+	filter string
+	remove [][]string
+	mask   [][]string
+}
+
+// Options is a struct that contains all the information required to configure the redact hook
+type Options struct {
+	// Hook is the wrapped storage, bridge or sink hook, initialized with Config. It is initialized and
+	// stopped by the redact hook, so must not also be added to the server
+	Hook   mqtt.Hook
+	Config any
+
+	// Rules are the fields which are redacted, by topic. The first rule whose filter matches a topic
+	// applies, and the messages of topics no rule matches are passed as they are
+	Rules []Rule
+
+	// Mask is the string masked fields are replaced with, and defaults to [redacted]
+	Mask string
+
+	// AllowInvalid passes messages whose payloads must be redacted but aren't JSON as they are. They are
+	// not passed to the wrapped hook if false
+	AllowInvalid bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "redact-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook, which the wrapped hook must also
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnStopped,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnPublished,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b}) && h.config.Hook != nil && h.config.Hook.Provides(b)
+}
+
+// Init initializes the hook and the wrapped hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	redactHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if redactHookConfig.Hook == nil {
+		return errors.New("hook is required")
+	}
+
+	if len(redactHookConfig.Rules) == 0 {
+		return errors.New("no rules")
+	}
+
+	rules := make([]rule, 0, len(redactHookConfig.Rules))
+	for i, r := range redactHookConfig.Rules {
+		if !mqtt.IsValidFilter(r.Filter, false) {
+			return fmt.Errorf("rule %d: invalid filter %q", i, r.Filter)
+		}
+
+		if len(r.Remove) == 0 && len(r.Mask) == 0 {
+			return fmt.Errorf("rule %d: no fields", i)
+		}
+
+		compiled := rule{filter: r.Filter}
+		for _, p := range r.Remove {
+			keys, err := splitPath(p)
+			if err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+			compiled.remove = append(compiled.remove, keys)
+		}
+		for _, p := range r.Mask {
+			keys, err := splitPath(p)
+			if err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+			compiled.mask = append(compiled.mask, keys)
+		}
+		rules = append(rules, compiled)
+	}
+
+	if redactHookConfig.Mask == "" {
+		redactHookConfig.Mask = "[redacted]"
+	}
+
+	redactHookConfig.Hook.SetOpts(h.Log, h.Opts)
+	if err := redactHookConfig.Hook.Init(redactHookConfig.Config); err != nil {
+		return fmt.Errorf("failed initialising %s hook: %w", redactHookConfig.Hook.ID(), err)
+	}
+
+	h.config = redactHookConfig
+	h.rules = rules
+	return nil
+}
+
+// splitPath returns the keys of the path of a field
+func splitPath(p string) ([]string, error) {
+	keys := strings.Split(p, ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("invalid path %q", p)
+		}
+	}
+	return keys, nil
+}
+
+// Stop stops the wrapped hook
+func (h *Hook) Stop() error {
+	if h.config.Hook == nil {
+		return nil
+	}
+	return h.config.Hook.Stop()
+}
+
+// Stats returns the totals of the messages passed so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update(&h.stats)
+}
+
+// rule returns the rule of the topic, if any
+func (h *Hook) rule(topic string) (rule, bool) {
+	for _, r := range h.rules {
+		if acl.Match(r.filter, topic) {
+			return r, true
+		}
+	}
+	return rule{}, false
+}
+
+// redact returns the payload of a message of the topic with the fields of its rule redacted, and
+// whether any were. Empty payloads are left empty
+func (h *Hook) redact(topic string, payload []byte) ([]byte, bool, error) {
+	r, ok := h.rule(topic)
+	if !ok || len(payload) == 0 {
+		return payload, false, nil
+	}
+
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		if h.config.AllowInvalid {
+			return payload, false, nil
+		}
+		return nil, false, errInvalid
+	}
+
+	changed := false
+	for _, keys := range r.remove {
+		var ok bool
+		v, ok = redact(v, keys, nil)
+		changed = changed || ok
+	}
+	for _, keys := range r.mask {
+		var ok bool
+		v, ok = redact(v, keys, h.config.Mask)
+		changed = changed || ok
+	}
+
+	if !changed {
+		return payload, false, nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, false, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), true, nil
+}
+
+// redact returns the decoded JSON value with the fields at the path of keys removed, or replaced with
+// the mask if it isn't nil, and whether there were any. Removed array elements are left out
+func redact(v any, keys []string, mask any) (any, bool) {
+	changed := false
+	switch val := v.(type) {
+	case map[string]any:
+		for key, field := range val {
+			if keys[0] != wildcard && keys[0] != key {
+				continue
+			}
+
+			if len(keys) > 1 {
+				var ok bool
+				val[key], ok = redact(field, keys[1:], mask)
+				changed = changed || ok
+				continue
+			}
+
+			if mask == nil {
+				delete(val, key)
+			} else {
+				val[key] = mask
+			}
+			changed = true
+		}
+		return val, changed
+
+	case []any:
+		out := make([]any, 0, len(val))
+		for i, elem := range val {
+			if keys[0] != wildcard && keys[0] != strconv.Itoa(i) {
+				out = append(out, elem)
+				continue
+			}
+
+			if len(keys) > 1 {
+				var ok bool
+				elem, ok = redact(elem, keys[1:], mask)
+				changed = changed || ok
+				out = append(out, elem)
+				continue
+			}
+
+			if mask != nil {
+				out = append(out, mask)
+			}
+			changed = true
+		}
+		return out, changed
+	}
+
+	return v, false
+}
+
+// redactPacket returns the message with its payload redacted, or false if it must not be passed to the
+// wrapped hook
+func (h *Hook) redactPacket(pk packets.Packet) (packets.Packet, bool) {
+	payload, changed, err := h.redact(pk.TopicName, pk.Payload)
+	if err != nil {
+		h.Log.Debug("message not passed to wrapped hook", "error", err, "hook", h.config.Hook.ID(), "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Dropped++ })
+		return pk, false
+	}
+
+	if changed {
+		pk.Payload = payload
+		h.count(func(s *Stats) { s.Redacted++ })
+	}
+	return pk, true
+}
+
+// redactClient returns the client with the payload of its will message redacted. A copy with the id,
+// connection details and properties of the client is returned if it was, without the will message if
+// it must not be passed to the wrapped hook
+func (h *Hook) redactClient(cl *mqtt.Client) *mqtt.Client {
+	props := cl.Properties
+	payload, changed, err := h.redact(props.Will.TopicName, props.Will.Payload)
+	if err == nil && !changed {
+		return cl
+	}
+
+	props.Will.Payload = payload
+	if err != nil {
+		props.Will = mqtt.Will{}
+	}
+
+	return &mqtt.Client{
+		ID:         cl.ID,
+		Properties: props,
+		Net: mqtt.ClientConnection{
+			Remote:   cl.Net.Remote,
+			Listener: cl.Net.Listener,
+			Inline:   cl.Net.Inline,
+		},
+	}
+}
+
+// OnStarted is called when the server has started
+func (h *Hook) OnStarted() {
+	h.config.Hook.OnStarted()
+}
+
+// OnStopped is called when the server has stopped
+func (h *Hook) OnStopped() {
+	h.config.Hook.OnStopped()
+}
+
+// OnSessionEstablished is called when a client has connected, and passes the client with its will
+// message redacted to the wrapped hook
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.config.Hook.OnSessionEstablished(h.redactClient(cl), pk)
+}
+
+// OnWillSent is called when the will message of a client has been sent, and passes the client and
+// will message redacted to the wrapped hook
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	will, ok := h.redactPacket(pk)
+	if !ok {
+		return
+	}
+	h.config.Hook.OnWillSent(h.redactClient(cl), will)
+}
+
+// OnDisconnect is called when a client disconnects
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.config.Hook.OnDisconnect(cl, err, expire)
+}
+
+// OnClientExpired is called when the session of a client expires
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	h.config.Hook.OnClientExpired(cl)
+}
+
+// OnSubscribed is called when a client subscribes
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	h.config.Hook.OnSubscribed(cl, pk, reasonCodes)
+}
+
+// OnUnsubscribed is called when a client unsubscribes
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	h.config.Hook.OnUnsubscribed(cl, pk)
+}
+
+// OnPublished is called when a client has published a message, and passes it redacted to the wrapped
+// hook
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if pk, ok := h.redactPacket(pk); ok {
+		h.config.Hook.OnPublished(cl, pk)
+	}
+}
+
+// OnRetainMessage is called when a message is retained, and passes it redacted to the wrapped hook.
+// Messages which must not be passed delete the message the wrapped hook retained before instead
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if r != -1 {
+		var ok bool
+		if pk, ok = h.redactPacket(pk); !ok {
+			pk.Payload, r = nil, -1
+		}
+	}
+	h.config.Hook.OnRetainMessage(cl, pk, r)
+}
+
+// OnRetainedExpired is called when a retained message expires
+func (h *Hook) OnRetainedExpired(topic string) {
+	h.config.Hook.OnRetainedExpired(topic)
+}
+
+// OnQosPublish is called when a QoS message is sent to a client, and passes it redacted to the wrapped
+// hook
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	if pk, ok := h.redactPacket(pk); ok {
+		h.config.Hook.OnQosPublish(cl, pk, sent, resends)
+	}
+}
+
+// OnQosComplete is called when the QoS flow of a message completes
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	h.config.Hook.OnQosComplete(cl, pk)
+}
+
+// OnQosDropped is called when an inflight message is dropped
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.config.Hook.OnQosDropped(cl, pk)
+}
+
+// OnSysInfoTick is called when the system info is updated
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	h.config.Hook.OnSysInfoTick(sys)
+}
+
+// StoredClients returns the clients stored by the wrapped hook
+func (h *Hook) StoredClients() ([]storage.Client, error) {
+	return h.config.Hook.StoredClients()
+}
+
+// StoredSubscriptions returns the subscriptions stored by the wrapped hook
+func (h *Hook) StoredSubscriptions() ([]storage.Subscription, error) {
+	return h.config.Hook.StoredSubscriptions()
+}
+
+// StoredRetainedMessages returns the retained messages stored by the wrapped hook, as they were redacted
+func (h *Hook) StoredRetainedMessages() ([]storage.Message, error) {
+	return h.config.Hook.StoredRetainedMessages()
+}
+
+// StoredInflightMessages returns the inflight messages stored by the wrapped hook, as they were redacted
+func (h *Hook) StoredInflightMessages() ([]storage.Message, error) {
+	return h.config.Hook.StoredInflightMessages()
+}
+
+// StoredSysInfo returns the system info stored by the wrapped hook
+func (h *Hook) StoredSysInfo() (storage.SystemInfo, error) {
+	return h.config.Hook.StoredSysInfo()
+}
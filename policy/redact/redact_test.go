@@ -0,0 +1,402 @@
+package redact
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// record is a call of a hook of fakeHook
+type record struct {
+	hook    string
+	client  *mqtt.Client
+	pk      packets.Packet
+	retain  int64
+	willPay []byte
+}
+
+// fakeHook records the messages it is given
+type fakeHook struct {
+	records []record
+	initErr error
+	stopped bool
+	mu      sync.Mutex
+	mqtt.HookBase
+}
+
+func (f *fakeHook) ID() string {
+	return "fake"
+}
+
+func (f *fakeHook) Provides(b byte) bool {
+	return b == mqtt.OnPublished || b == mqtt.OnRetainMessage || b == mqtt.OnQosPublish ||
+		b == mqtt.OnSessionEstablished || b == mqtt.OnWillSent
+}
+
+func (f *fakeHook) Init(config any) error {
+	return f.initErr
+}
+
+func (f *fakeHook) Stop() error {
+	f.stopped = true
+	return nil
+}
+
+func (f *fakeHook) record(r record) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = append(f.records, r)
+}
+
+func (f *fakeHook) recorded() []record {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]record{}, f.records...)
+}
+
+func (f *fakeHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	f.record(record{hook: "published", client: cl, pk: pk})
+}
+
+func (f *fakeHook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	f.record(record{hook: "retain", client: cl, pk: pk, retain: r})
+}
+
+func (f *fakeHook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	f.record(record{hook: "qos", client: cl, pk: pk})
+}
+
+func (f *fakeHook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	f.record(record{hook: "session", client: cl, willPay: cl.Properties.Will.Payload})
+}
+
+func (f *fakeHook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	f.record(record{hook: "will", client: cl, pk: pk, willPay: cl.Properties.Will.Payload})
+}
+
+var testRules = []Rule{
+	{Filter: "vehicles/+/position", Remove: []string{"gps"}, Mask: []string{"vin"}},
+	{Filter: "sensors/#", Remove: []string{"readings.*.serial"}},
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	redactHook := new(Hook)
+	redactHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, redactHook.Init(options))
+	t.Cleanup(func() { redactHook.Stop() })
+	return redactHook
+}
+
+func TestID(t *testing.T) {
+	redactHook := new(Hook)
+
+	require.Equal(t, "redact-policy-hook", redactHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	redactHook := new(Hook)
+	require.False(t, redactHook.Provides(mqtt.OnPublished))
+
+	redactHook.config.Hook = new(fakeHook)
+	require.True(t, redactHook.Provides(mqtt.OnPublished))
+	require.True(t, redactHook.Provides(mqtt.OnRetainMessage))
+	require.False(t, redactHook.Provides(mqtt.OnStopped))
+	require.False(t, redactHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Hook: new(fakeHook), Rules: testRules},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no hook",
+			config:      Options{Rules: testRules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Hook: new(fakeHook)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Hook: new(fakeHook), Rules: []Rule{{Filter: "a/#/b", Remove: []string{"gps"}}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no fields",
+			config:      Options{Hook: new(fakeHook), Rules: []Rule{{Filter: "a/#"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid path",
+			config:      Options{Hook: new(fakeHook), Rules: []Rule{{Filter: "a/#", Mask: []string{"gps..lat"}}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - wrapped hook",
+			config:      Options{Hook: &fakeHook{initErr: errors.New("failed")}, Rules: testRules},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			redactHook := new(Hook)
+			redactHook.Log = slog.Default()
+			err := redactHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "[redacted]", redactHook.config.Mask)
+			require.NoError(t, redactHook.Stop())
+			require.True(t, redactHook.config.Hook.(*fakeHook).stopped)
+
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	redactHook := newHook(t, Options{Hook: new(fakeHook), Rules: append(testRules,
+		Rule{Filter: "fleet/+", Remove: []string{"1", "*.id"}, Mask: []string{"*.owner.*"}},
+	)})
+
+	tests := []struct {
+		name        string
+		topic       string
+		payload     string
+		expect      string
+		changed     bool
+		expectError bool
+	}{
+		{
+			name:    "removed and masked",
+			topic:   "vehicles/1/position",
+			payload: `{"vin":"WVW123","gps":{"lat":52.1,"lon":4.3},"speed":48.25}`,
+			expect:  `{"speed":48.25,"vin":"[redacted]"}`,
+			changed: true,
+		},
+		{
+			name:    "array elements",
+			topic:   "sensors/a/b",
+			payload: `{"readings":[{"serial":"s1","value":1},{"serial":"s2","value":12345678901234567890}],"note":"<ok>"}`,
+			expect:  `{"note":"<ok>","readings":[{"value":1},{"value":12345678901234567890}]}`,
+			changed: true,
+		},
+		{
+			name:    "array indexes and wildcards",
+			topic:   "fleet/a",
+			payload: `[{"id":1,"owner":{"name":"x","email":"y"}},{"id":2},{"id":3,"owner":null}]`,
+			expect:  `[{"owner":{"email":"[redacted]","name":"[redacted]"}},{"owner":null}]`,
+			changed: true,
+		},
+		{
+			name:    "no fields",
+			topic:   "vehicles/1/position",
+			payload: `{ "speed": 48.25 }`,
+			expect:  `{ "speed": 48.25 }`,
+		},
+		{
+			name:    "not an object",
+			topic:   "vehicles/1/position",
+			payload: `"gps"`,
+			expect:  `"gps"`,
+		},
+		{
+			name:    "no rule",
+			topic:   "vehicles/1/status",
+			payload: `not json`,
+			expect:  `not json`,
+		},
+		{
+			name:    "empty",
+			topic:   "vehicles/1/position",
+			payload: ``,
+			expect:  ``,
+		},
+		{
+			name:        "invalid json",
+			topic:       "vehicles/1/position",
+			payload:     `{"gps":`,
+			expectError: true,
+		},
+		{
+			name:        "several values",
+			topic:       "vehicles/1/position",
+			payload:     `{} {"gps":1}`,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			payload, changed, err := redactHook.redact(tt.topic, []byte(tt.payload))
+			if tt.expectError {
+				require.ErrorIs(t, err, errInvalid)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, string(payload))
+			require.Equal(t, tt.changed, changed)
+
+		})
+	}
+
+	// invalid payloads are passed as they are if allowed
+	redactHook.config.AllowInvalid = true
+	payload, changed, err := redactHook.redact("vehicles/1/position", []byte(`{"gps":`))
+	require.NoError(t, err)
+	require.False(t, changed)
+	require.Equal(t, `{"gps":`, string(payload))
+}
+
+func TestWrappedHook(t *testing.T) {
+	wrapped := new(fakeHook)
+	redactHook := newHook(t, Options{Hook: wrapped, Rules: testRules, Mask: "***"})
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.Will = mqtt.Will{Flag: 1, TopicName: "vehicles/1/position", Payload: []byte(`{"vin":"WVW123","online":false}`)}
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1, Retain: true},
+		TopicName:   "vehicles/1/position",
+		Payload:     []byte(`{"vin":"WVW123","gps":[52.1,4.3]}`),
+	}
+	invalid := pk
+	invalid.Payload = []byte("WVW123")
+
+	redactHook.OnSessionEstablished(cl, packets.Packet{})
+	redactHook.OnPublished(cl, pk)
+	redactHook.OnPublished(cl, invalid)
+	redactHook.OnRetainMessage(cl, pk, 1)
+	redactHook.OnRetainMessage(cl, invalid, 1)
+	redactHook.OnRetainMessage(cl, packets.Packet{TopicName: "vehicles/1/position"}, -1)
+	redactHook.OnQosPublish(cl, pk, 1, 0)
+	redactHook.OnQosPublish(cl, invalid, 1, 0)
+	redactHook.OnWillSent(cl, packets.Packet{TopicName: cl.Properties.Will.TopicName, Payload: cl.Properties.Will.Payload})
+
+	records := wrapped.recorded()
+	require.Len(t, records, 7)
+
+	require.Equal(t, "session", records[0].hook)
+	require.Equal(t, `{"online":false,"vin":"***"}`, string(records[0].willPay))
+	require.Equal(t, "c1", records[0].client.ID)
+	require.NotSame(t, cl, records[0].client)
+
+	require.Equal(t, "published", records[1].hook)
+	require.Equal(t, `{"vin":"***"}`, string(records[1].pk.Payload))
+	require.Same(t, cl, records[1].client)
+
+	require.Equal(t, "retain", records[2].hook)
+	require.Equal(t, `{"vin":"***"}`, string(records[2].pk.Payload))
+	require.Equal(t, int64(1), records[2].retain)
+
+	// invalid retained messages delete the message retained before
+	require.Equal(t, "retain", records[3].hook)
+	require.Empty(t, records[3].pk.Payload)
+	require.Equal(t, int64(-1), records[3].retain)
+	require.Equal(t, int64(-1), records[4].retain)
+
+	require.Equal(t, "qos", records[5].hook)
+	require.Equal(t, `{"vin":"***"}`, string(records[5].pk.Payload))
+
+	require.Equal(t, "will", records[6].hook)
+	require.Equal(t, `{"online":false,"vin":"***"}`, string(records[6].pk.Payload))
+	require.Equal(t, `{"online":false,"vin":"***"}`, string(records[6].willPay))
+
+	// the live client is unchanged
+	require.Equal(t, `{"vin":"WVW123","online":false}`, string(cl.Properties.Will.Payload))
+	require.Equal(t, `{"vin":"WVW123","gps":[52.1,4.3]}`, string(pk.Payload))
+
+	stats := redactHook.Stats()
+	require.Equal(t, int64(4), stats.Redacted)
+	require.Equal(t, int64(3), stats.Dropped)
+}
+
+func TestInvalidWill(t *testing.T) {
+	wrapped := new(fakeHook)
+	redactHook := newHook(t, Options{Hook: wrapped, Rules: testRules})
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.Will = mqtt.Will{Flag: 1, TopicName: "vehicles/1/position", Payload: []byte("WVW123")}
+	redactHook.OnSessionEstablished(cl, packets.Packet{})
+	redactHook.OnWillSent(cl, packets.Packet{TopicName: cl.Properties.Will.TopicName, Payload: cl.Properties.Will.Payload})
+
+	// the wrapped hook is given the client without its will message, and not the will message
+	records := wrapped.recorded()
+	require.Len(t, records, 1)
+	require.Equal(t, mqtt.Will{}, records[0].client.Properties.Will)
+
+	// clients without will messages, or whose will messages are unchanged, are passed as they are
+	other := mqtt.New(nil).NewClient(nil, "tcp", "c2", false)
+	redactHook.OnSessionEstablished(other, packets.Packet{})
+	require.Same(t, other, wrapped.recorded()[1].client)
+}
+
+func TestSubscribers(t *testing.T) {
+	wrapped := new(fakeHook)
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, server.AddHook(new(Hook), Options{Hook: wrapped, Rules: testRules}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	received := make(chan []byte, 1)
+	require.NoError(t, server.Subscribe("vehicles/#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk.Payload
+	}))
+
+	payload := []byte(`{"vin":"WVW123","gps":[52.1,4.3]}`)
+	require.NoError(t, server.Publish("vehicles/1/position", payload, true, 0))
+
+	select {
+	case got := <-received:
+		require.Equal(t, payload, got)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	retained, ok := server.Topics.Retained.Get("vehicles/1/position")
+	require.True(t, ok)
+	require.Equal(t, payload, retained.Payload)
+
+	require.Eventually(t, func() bool {
+		for _, r := range wrapped.recorded() {
+			if r.hook == "published" {
+				return string(r.pk.Payload) == `{"vin":"[redacted]"}`
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
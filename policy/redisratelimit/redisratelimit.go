@@ -0,0 +1,315 @@
+// Package redisratelimit provides a hook which limits the connection attempts and publishes of clients
+// within a sliding window counted in Redis, so the limits apply across all the brokers sharing it, eg.
+// behind a load balancer, rather than to each of them.
+//
+// Each limited source is a sorted set at the prefix followed by ip:<address>, client:<client id> or
+// publish:<client id>, whose members are the attempts allowed within the window, scored by the time of
+// the Redis server in milliseconds so the clocks of the brokers don't matter. A Lua script removes the
+// attempts older than the window, and adds the attempt if the limit isn't reached, atomically, and the
+// set expires once the window has passed since its last attempt. The script is run with EVALSHA, and
+// loaded with EVAL when the server doesn't have it.
+package redisratelimit
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// DefaultPrefix is the prefix of the keys written by the hook
+const DefaultPrefix = "mqtt:ratelimit:"
+
+// slidingWindow allows an attempt, member ARGV[3], if fewer than ARGV[2] attempts were allowed within
+// the window of ARGV[1] milliseconds, and returns 1 if it is allowed or 0 if not. Scripts reading the
+// time must replicate their effects rather than themselves, which is the default from Redis 5
+var slidingWindow = redisclient.NewScript(`redis.replicate_commands()
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local window = tonumber(ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now, ARGV[3])
+redis.call('PEXPIRE', KEYS[1], window)
+return 1`)
+
+// Stats are the totals of the attempts checked since the hook was initialized
+type Stats struct {
+	Allowed int64 // the number of attempts within the limits
+	Limited int64 // the number of attempts rejected as they exceeded a limit
+	Failed  int64 // the number of attempts which could not be checked, eg. as Redis was unavailable
+}
+
+// Hook is a hook that limits the connection attempts of each IP address and client ID, and the
+// messages published by each client ID, within a sliding window shared by brokers through Redis
+type Hook struct {
+	config  Options
+	exempt  []*net.IPNet
+	redis   redisclient.Client
+	node    string       // distinguishes the attempts of this broker from those of others
+	seq     atomic.Int64 // distinguishes the attempts of this broker
+	stats   Stats
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the redisratelimit hook
+type Options struct {
+	redisclient.ClientOptions // how to connect to the server, cluster or sentinels
+
+	// Client is used instead of connecting with the ClientOptions, eg. to use another Redis client library
+	Client redisclient.Client
+
+	// Prefix is the prefix of the keys of the sources, and defaults to DefaultPrefix. Brokers sharing
+	// limits must use the same prefix and window
+	Prefix string
+
+	Window time.Duration // the sliding window attempts are counted in, defaults to 1 minute
+
+	// MaxConnectsPerIP and MaxConnectsPerClientID limit the connection attempts within the window, and
+	// MaxPublishesPerClientID limits the messages published. A limit of 0 is not enforced
+	MaxConnectsPerIP        int
+	MaxConnectsPerClientID  int
+	MaxPublishesPerClientID int
+
+	// ExemptNetworks and ExemptClientIDs are never limited, eg. 10.0.0.0/8 or a monitoring client
+	ExemptNetworks  []string
+	ExemptClientIDs []string
+
+	// FailOpen allows the attempts which can't be checked, eg. as Redis is unavailable, which are
+	// rejected otherwise
+	FailOpen bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "redisratelimit-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+		mqtt.OnPublish,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and checks that Redis can be reached
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	redisratelimitHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if redisratelimitHookConfig.MaxConnectsPerIP <= 0 && redisratelimitHookConfig.MaxConnectsPerClientID <= 0 && redisratelimitHookConfig.MaxPublishesPerClientID <= 0 {
+		return errors.New("at least one limit is required")
+	}
+
+	if redisratelimitHookConfig.Prefix == "" {
+		redisratelimitHookConfig.Prefix = DefaultPrefix
+	}
+
+	if redisratelimitHookConfig.Window <= 0 {
+		redisratelimitHookConfig.Window = time.Minute
+	}
+
+	if redisratelimitHookConfig.Window < time.Millisecond {
+		return errors.New("window must be at least a millisecond")
+	}
+
+	if redisratelimitHookConfig.Timeout <= 0 {
+		redisratelimitHookConfig.Timeout = 5 * time.Second
+	}
+
+	var exempt []*net.IPNet
+	for _, cidr := range redisratelimitHookConfig.ExemptNetworks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		exempt = append(exempt, n)
+	}
+
+	node := make([]byte, 8)
+	if _, err := rand.Read(node); err != nil {
+		return err
+	}
+
+	client := redisratelimitHookConfig.Client
+	if client == nil {
+		var err error
+		if client, err = redisclient.NewClient(redisratelimitHookConfig.ClientOptions); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisratelimitHookConfig.Timeout)
+	defer cancel()
+	if _, err := client.Do(ctx, "PING"); err != nil {
+		client.Close()
+		return fmt.Errorf("failed to ping redis: %w", err)
+	}
+
+	h.config = redisratelimitHookConfig
+	h.exempt = exempt
+	h.redis = client
+	h.node = hex.EncodeToString(node)
+	return nil
+}
+
+// Stop closes the connections of the client
+func (h *Hook) Stop() error {
+	if h.redis == nil {
+		return nil
+	}
+	return h.redis.Close()
+}
+
+// Stats returns the totals of the attempts checked so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
+
+// OnConnect is called when a client connects, and rejects it if its IP address or client ID exceeds
+// its limit of connection attempts
+func (h *Hook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	ip := remoteIP(cl.Net.Remote)
+	clientID := string(pk.Connect.ClientIdentifier)
+	if h.exempted(ip, clientID) {
+		return nil
+	}
+
+	var checks []check
+	if ip != nil && h.config.MaxConnectsPerIP > 0 {
+		checks = append(checks, check{key: "ip:" + ip.String(), limit: h.config.MaxConnectsPerIP})
+	}
+
+	if clientID != "" && h.config.MaxConnectsPerClientID > 0 {
+		checks = append(checks, check{key: "client:" + clientID, limit: h.config.MaxConnectsPerClientID})
+	}
+
+	for _, c := range checks {
+		allowed, err := h.allow(c)
+		if err != nil {
+			h.Log.Error("error occurred while checking connection rate", "error", err, "client", cl.ID, "remote", cl.Net.Remote)
+			h.count(func(s *Stats) { s.Failed++ })
+			if h.config.FailOpen {
+				return nil
+			}
+			return packets.ErrServerUnavailable
+		}
+
+		if !allowed {
+			h.Log.Warn("rejecting connection exceeding rate", "client", cl.ID, "remote", cl.Net.Remote, "key", c.key)
+			h.count(func(s *Stats) { s.Limited++ })
+			return packets.ErrConnectionRateExceeded
+		}
+	}
+
+	if len(checks) > 0 {
+		h.count(func(s *Stats) { s.Allowed++ })
+	}
+	return nil
+}
+
+// OnPublish is called when a client publishes a message, and rejects it if the client exceeds its
+// limit of messages. Messages published by inline clients are not limited
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if h.config.MaxPublishesPerClientID <= 0 || cl.Net.Inline || h.exempted(nil, cl.ID) {
+		return pk, nil
+	}
+
+	allowed, err := h.allow(check{key: "publish:" + cl.ID, limit: h.config.MaxPublishesPerClientID})
+	if err != nil {
+		h.Log.Error("error occurred while checking message rate", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Failed++ })
+		if h.config.FailOpen {
+			return pk, nil
+		}
+		return pk, reject.Publish(cl, pk, packets.ErrUnspecifiedError)
+	}
+
+	if !allowed {
+		h.Log.Debug("rejecting message exceeding rate", "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Limited++ })
+		return pk, reject.Publish(cl, pk, packets.ErrQuotaExceeded)
+	}
+
+	h.count(func(s *Stats) { s.Allowed++ })
+	return pk, nil
+}
+
+// check is an attempt counted against the limit of a source
+type check struct {
+	key   string
+	limit int
+}
+
+// allow counts the attempt in the window of its source, and returns whether it is within the limit
+func (h *Hook) allow(c check) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	member := fmt.Sprintf("%s:%d", h.node, h.seq.Add(1))
+	reply, err := slidingWindow.Run(ctx, h.redis, []string{h.config.Prefix + c.key}, h.config.Window.Milliseconds(), c.limit, member)
+	if err != nil {
+		return false, err
+	}
+
+	allowed, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected reply to sliding window script for %s", c.key)
+	}
+	return allowed == 1, nil
+}
+
+// exempted returns whether the ip or client id is never limited
+func (h *Hook) exempted(ip net.IP, clientID string) bool {
+	if clientID != "" && slices.Contains(h.config.ExemptClientIDs, clientID) {
+		return true
+	}
+
+	for _, n := range h.exempt {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the ip of the remote address, or nil if it isn't an ip address
+func remoteIP(remote string) net.IP {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,369 @@
+package redisratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// fakeRedis runs the sliding window script from memory, at its own time in milliseconds
+type fakeRedis struct {
+	now      int64
+	windows  map[string]map[string]int64 // the scores of the members of each key
+	expires  map[string]int64
+	scripts  map[string]bool
+	commands []string
+	err      error
+	closed   bool
+	mu       sync.Mutex
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		now:     1000000,
+		windows: make(map[string]map[string]int64),
+		expires: make(map[string]int64),
+		scripts: make(map[string]bool),
+	}
+}
+
+func (r *fakeRedis) Do(ctx context.Context, args ...any) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	r.commands = append(r.commands, args[0].(string))
+	switch args[0] {
+	case "PING":
+		return "PONG", nil
+	case "EVAL":
+		sum := sha1.Sum([]byte(args[1].(string)))
+		r.scripts[hex.EncodeToString(sum[:])] = true
+	case "EVALSHA":
+		if !r.scripts[args[1].(string)] {
+			return nil, redisclient.Error("NOSCRIPT No matching script. Please use EVAL.")
+		}
+	default:
+		return nil, redisclient.Error("ERR unknown command")
+	}
+
+	key, window, limit, member := args[3].(string), args[4].(int64), args[5].(int), args[6].(string)
+	if r.expires[key] <= r.now {
+		delete(r.windows, key)
+	}
+
+	members := r.windows[key]
+	if members == nil {
+		members = make(map[string]int64)
+		r.windows[key] = members
+	}
+
+	for m, score := range members {
+		if score <= r.now-window {
+			delete(members, m)
+		}
+	}
+
+	if len(members) >= limit {
+		return int64(0), nil
+	}
+
+	members[member] = r.now
+	r.expires[key] = r.now + window
+	return int64(1), nil
+}
+
+func (r *fakeRedis) Close() error {
+	r.closed = true
+	return nil
+}
+
+// advance moves the time of the server forward
+func (r *fakeRedis) advance(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.now += d.Milliseconds()
+}
+
+func newHook(t *testing.T, options Options) (*Hook, *fakeRedis) {
+	t.Helper()
+
+	r := newFakeRedis()
+	options.Client = r
+
+	redisratelimitHook := new(Hook)
+	redisratelimitHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, redisratelimitHook.Init(options))
+	t.Cleanup(func() { redisratelimitHook.Stop() })
+	return redisratelimitHook, r
+}
+
+func newClient(id, remote string, version byte) *mqtt.Client {
+	cl := &mqtt.Client{ID: id, Net: mqtt.ClientConnection{Remote: remote}}
+	cl.Properties.ProtocolVersion = version
+	return cl
+}
+
+func connect(clientID string) packets.Packet {
+	return packets.Packet{Connect: packets.ConnectParams{ClientIdentifier: clientID}}
+}
+
+func publish(qos byte) packets.Packet {
+	return packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: qos}, TopicName: "a/b"}
+}
+
+func TestID(t *testing.T) {
+	redisratelimitHook := new(Hook)
+
+	require.Equal(t, "redisratelimit-policy-hook", redisratelimitHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	redisratelimitHook := new(Hook)
+	require.True(t, redisratelimitHook.Provides(mqtt.OnConnect))
+	require.True(t, redisratelimitHook.Provides(mqtt.OnPublish))
+	require.False(t, redisratelimitHook.Provides(mqtt.OnSessionEstablish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Client: newFakeRedis(), MaxConnectsPerIP: 10},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no limits",
+			config:      Options{Client: newFakeRedis()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - window too short",
+			config:      Options{Client: newFakeRedis(), MaxConnectsPerIP: 10, Window: time.Microsecond},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid exempt network",
+			config:      Options{Client: newFakeRedis(), MaxConnectsPerIP: 10, ExemptNetworks: []string{"10.0.0.0"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no addresses",
+			config:      Options{MaxConnectsPerIP: 10},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unreachable",
+			config:      Options{Client: &fakeRedis{err: errors.New("connection refused")}, MaxConnectsPerIP: 10},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			redisratelimitHook := new(Hook)
+			redisratelimitHook.Log = slog.Default()
+			err := redisratelimitHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, DefaultPrefix, redisratelimitHook.config.Prefix)
+			require.Equal(t, time.Minute, redisratelimitHook.config.Window)
+			require.Equal(t, 5*time.Second, redisratelimitHook.config.Timeout)
+			require.NoError(t, redisratelimitHook.Stop())
+
+		})
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	redisratelimitHook, r := newHook(t, Options{
+		MaxConnectsPerIP:       4,
+		MaxConnectsPerClientID: 2,
+		ExemptNetworks:         []string{"10.0.0.0/8"},
+		ExemptClientIDs:        []string{"monitor"},
+	})
+
+	// the script is loaded by the first attempt, and run by its digest after
+	require.NoError(t, redisratelimitHook.OnConnect(newClient("c1", "192.0.2.1:1000", 5), connect("c1")))
+	require.Equal(t, []string{"PING", "EVALSHA", "EVAL", "EVALSHA"}, r.commands)
+
+	require.NoError(t, redisratelimitHook.OnConnect(newClient("c1", "192.0.2.1:1001", 5), connect("c1")))
+	require.ErrorIs(t, redisratelimitHook.OnConnect(newClient("c1", "192.0.2.1:1002", 5), connect("c1")), packets.ErrConnectionRateExceeded)
+	require.NoError(t, redisratelimitHook.OnConnect(newClient("c2", "192.0.2.1:1003", 5), connect("c2")))
+
+	// the address has made 4 attempts, 1 of which was rejected for its client id
+	require.ErrorIs(t, redisratelimitHook.OnConnect(newClient("c3", "192.0.2.1:1004", 5), connect("c3")), packets.ErrConnectionRateExceeded)
+	require.NoError(t, redisratelimitHook.OnConnect(newClient("c3", "192.0.2.2:1000", 5), connect("c3")))
+
+	// exempt sources aren't counted
+	for i := 0; i < 5; i++ {
+		require.NoError(t, redisratelimitHook.OnConnect(newClient("c4", "10.0.0.1:1000", 5), connect("c4")))
+		require.NoError(t, redisratelimitHook.OnConnect(newClient("monitor", "192.0.2.1:1000", 5), connect("monitor")))
+	}
+
+	// attempts leave the window
+	r.advance(time.Minute)
+	require.NoError(t, redisratelimitHook.OnConnect(newClient("c1", "192.0.2.1:1005", 5), connect("c1")))
+	require.Len(t, r.windows["mqtt:ratelimit:ip:192.0.2.1"], 1)
+	require.Equal(t, r.now+time.Minute.Milliseconds(), r.expires["mqtt:ratelimit:client:c1"])
+
+	require.Equal(t, Stats{Allowed: 5, Limited: 2}, redisratelimitHook.Stats())
+}
+
+func TestOnConnectShared(t *testing.T) {
+	r := newFakeRedis()
+	var hooks []*Hook
+	for i := 0; i < 2; i++ {
+		redisratelimitHook := new(Hook)
+		redisratelimitHook.Log = slog.Default()
+		require.NoError(t, redisratelimitHook.Init(Options{Client: r, MaxConnectsPerClientID: 2}))
+		hooks = append(hooks, redisratelimitHook)
+	}
+
+	// brokers sharing redis share the limits
+	require.NoError(t, hooks[0].OnConnect(newClient("c1", "192.0.2.1:1000", 5), connect("c1")))
+	require.NoError(t, hooks[1].OnConnect(newClient("c1", "192.0.2.2:1000", 5), connect("c1")))
+	require.ErrorIs(t, hooks[0].OnConnect(newClient("c1", "192.0.2.3:1000", 5), connect("c1")), packets.ErrConnectionRateExceeded)
+	require.ErrorIs(t, hooks[1].OnConnect(newClient("c1", "192.0.2.3:1000", 5), connect("c1")), packets.ErrConnectionRateExceeded)
+	require.Len(t, r.windows["mqtt:ratelimit:client:c1"], 2)
+}
+
+func TestOnConnectUnavailable(t *testing.T) {
+	redisratelimitHook, r := newHook(t, Options{MaxConnectsPerIP: 1})
+	r.err = errors.New("connection refused")
+	require.ErrorIs(t, redisratelimitHook.OnConnect(newClient("c1", "192.0.2.1:1000", 5), connect("c1")), packets.ErrServerUnavailable)
+
+	redisratelimitHook, r = newHook(t, Options{MaxConnectsPerIP: 1, FailOpen: true})
+	r.err = errors.New("connection refused")
+	require.NoError(t, redisratelimitHook.OnConnect(newClient("c1", "192.0.2.1:1000", 5), connect("c1")))
+	require.Equal(t, Stats{Failed: 1}, redisratelimitHook.Stats())
+}
+
+func TestOnPublish(t *testing.T) {
+	redisratelimitHook, r := newHook(t, Options{MaxPublishesPerClientID: 2, ExemptClientIDs: []string{"monitor"}})
+
+	tests := []struct {
+		name        string
+		client      *mqtt.Client
+		packet      packets.Packet
+		expectError error
+	}{
+		{
+			name:   "Success - within limit",
+			client: newClient("c1", "192.0.2.1:1000", 5),
+			packet: publish(1),
+		},
+		{
+			name:   "Success - at limit",
+			client: newClient("c1", "192.0.2.1:1000", 5),
+			packet: publish(1),
+		},
+		{
+			name:        "Failure - v5 qos 1",
+			client:      newClient("c1", "192.0.2.1:1000", 5),
+			packet:      publish(1),
+			expectError: packets.ErrQuotaExceeded,
+		},
+		{
+			name:        "Failure - v5 qos 0",
+			client:      newClient("c1", "192.0.2.1:1000", 5),
+			packet:      publish(0),
+			expectError: packets.ErrRejectPacket,
+		},
+		{
+			name:        "Failure - v3",
+			client:      newClient("c1", "192.0.2.1:1000", 4),
+			packet:      publish(1),
+			expectError: packets.ErrRejectPacket,
+		},
+		{
+			name:   "Success - other client",
+			client: newClient("c2", "192.0.2.1:1000", 5),
+			packet: publish(1),
+		},
+		{
+			name:   "Success - exempt",
+			client: newClient("monitor", "192.0.2.1:1000", 5),
+			packet: publish(1),
+		},
+		{
+			name:   "Success - inline",
+			client: &mqtt.Client{ID: "c1", Net: mqtt.ClientConnection{Inline: true}},
+			packet: publish(1),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, err := redisratelimitHook.OnPublish(tt.client, tt.packet)
+			if tt.expectError != nil {
+				require.ErrorIs(t, err, tt.expectError)
+				return
+			}
+			require.NoError(t, err)
+
+		})
+	}
+
+	require.Len(t, r.windows["mqtt:ratelimit:publish:c1"], 2)
+	require.Equal(t, Stats{Allowed: 3, Limited: 3}, redisratelimitHook.Stats())
+
+	r.advance(time.Minute)
+	_, err := redisratelimitHook.OnPublish(newClient("c1", "192.0.2.1:1000", 5), publish(1))
+	require.NoError(t, err)
+}
+
+func TestOnPublishUnavailable(t *testing.T) {
+	redisratelimitHook, r := newHook(t, Options{MaxPublishesPerClientID: 1})
+	r.err = errors.New("connection refused")
+	_, err := redisratelimitHook.OnPublish(newClient("c1", "192.0.2.1:1000", 5), publish(1))
+	require.ErrorIs(t, err, packets.ErrUnspecifiedError)
+
+	redisratelimitHook, r = newHook(t, Options{MaxPublishesPerClientID: 1, FailOpen: true})
+	r.err = errors.New("connection refused")
+	_, err = redisratelimitHook.OnPublish(newClient("c1", "192.0.2.1:1000", 5), publish(1))
+	require.NoError(t, err)
+	require.Equal(t, Stats{Failed: 1}, redisratelimitHook.Stats())
+}
+
+func TestStop(t *testing.T) {
+	require.NoError(t, new(Hook).Stop())
+
+	redisratelimitHook, r := newHook(t, Options{MaxConnectsPerIP: 1})
+	require.NoError(t, redisratelimitHook.Stop())
+	require.True(t, r.closed)
+}
@@ -0,0 +1,239 @@
+package retain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// ByUsername counts the retained messages of each username
+func ByUsername(cl *mqtt.Client) string {
+	return string(cl.Properties.Username)
+}
+
+// Rule is the retain policy of the topics matching its filter
+type Rule struct {
+	Filter string
+	Forbid bool          // retained messages are rejected
+	TTL    time.Duration // retained messages are cleared after it, unless 0
+}
+
+// Hook is a hook that enforces the retain policy of topics, rejecting retained messages on forbidden
+// topics, clearing retained messages after their TTL, and capping the number of retained messages of
+// each username or tenant
+type Hook struct {
+	config Options
+	owners map[string]string // the keys of the retained messages counted by topic
+	counts map[string]int    // the number of retained messages of each key
+	mu     sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the retain hook
+type Options struct {
+	// Rules are the retain policies of topics, of which the first whose filter matches a topic applies
+	Rules []Rule
+
+	// Max is the number of retained messages each key may have, and Limits overrides it for
+	// particular keys. Keys without a limit, or a limit of 0, are not limited. Retained messages are
+	// counted as they are retained, so those loaded from storage when the server starts aren't
+	Max    int
+	Limits map[string]int
+
+	// Key returns what retained messages are counted for the client, defaults to ByUsername, and
+	// may return a tenant derived from the username. Clients with an empty key are not limited
+	Key func(cl *mqtt.Client) string
+
+	// Server applies the TTLs of the rules to the retained messages loaded when the server starts,
+	// eg. from storage, as of when they were published
+	Server *mqtt.Server
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "retain-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnPublish,
+		mqtt.OnRetainMessage,
+		mqtt.OnRetainedExpired,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	retainHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if len(retainHookConfig.Rules) == 0 && retainHookConfig.Max <= 0 && len(retainHookConfig.Limits) == 0 {
+		return errors.New("rules, max or limits is required")
+	}
+
+	for _, rule := range retainHookConfig.Rules {
+		if !mqtt.IsValidFilter(rule.Filter, false) {
+			return fmt.Errorf("invalid filter %q", rule.Filter)
+		}
+
+		if rule.TTL < 0 {
+			return fmt.Errorf("invalid ttl %v of filter %q", rule.TTL, rule.Filter)
+		}
+	}
+
+	if retainHookConfig.Key == nil {
+		retainHookConfig.Key = ByUsername
+	}
+
+	h.config = retainHookConfig
+	h.owners = make(map[string]string)
+	h.counts = make(map[string]int)
+	return nil
+}
+
+// rule returns the rule of the topic, or nil if none matches
+func (h *Hook) rule(topic string) *Rule {
+	for i, rule := range h.config.Rules {
+		if acl.Match(rule.Filter, topic) {
+			return &h.config.Rules[i]
+		}
+	}
+	return nil
+}
+
+// limit returns the limit of the key, or 0 if it is not limited
+func (h *Hook) limit(key string) int {
+	if l, ok := h.config.Limits[key]; ok {
+		return l
+	}
+	return h.config.Max
+}
+
+// Count returns the number of retained messages of the key
+func (h *Hook) Count(key string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.counts[key]
+}
+
+// expiry returns when a message created at created expires with the ttl, if it is before the expiry
+// it already has
+func expiry(created, current int64, ttl time.Duration) int64 {
+	expiry := created + int64(ttl/time.Second)
+	if current > 0 && current < expiry {
+		return current
+	}
+	return expiry
+}
+
+// OnStarted is called when the server has started, and applies the TTLs of the rules to the retained
+// messages it loaded
+func (h *Hook) OnStarted() {
+	if h.config.Server == nil {
+		return
+	}
+
+	for topic, pk := range h.config.Server.Topics.Retained.GetAll() {
+		if rule := h.rule(topic); rule != nil && rule.TTL > 0 {
+			pk.Expiry = expiry(pk.Created, pk.Expiry, rule.TTL)
+			h.config.Server.Topics.Retained.Add(topic, pk)
+		}
+	}
+}
+
+// OnPublish is called when a client publishes a message, and rejects it if it is retained on a
+// forbidden topic or exceeds the limit of its key. Retained messages expire after the TTL of their
+// topic
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	// an empty retained message clears the retained message of the topic, so is always allowed
+	if !pk.FixedHeader.Retain || len(pk.Payload) == 0 {
+		return pk, nil
+	}
+
+	rule := h.rule(pk.TopicName)
+	if rule != nil && rule.TTL > 0 {
+		pk.Expiry = expiry(pk.Created, pk.Expiry, rule.TTL)
+	}
+
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	if rule != nil && rule.Forbid {
+		h.Log.Info("rejecting retained publish to forbidden topic", "client", cl.ID, "topic", pk.TopicName)
+		return pk, reject.Publish(cl, pk, packets.ErrRetainNotSupported)
+	}
+
+	key := h.config.Key(cl)
+	limit := h.limit(key)
+	if key == "" || limit <= 0 {
+		return pk, nil
+	}
+
+	h.mu.Lock()
+	owner, ok := h.owners[pk.TopicName]
+	exceeded := (!ok || owner != key) && h.counts[key] >= limit
+	h.mu.Unlock()
+
+	if exceeded {
+		h.Log.Info("rejecting retained publish exceeding retained limit", "client", cl.ID, "topic", pk.TopicName, "key", key, "limit", limit)
+		return pk, reject.Publish(cl, pk, packets.ErrQuotaExceeded)
+	}
+
+	return pk, nil
+}
+
+// OnRetainMessage is called when a retained message is set or cleared, and counts it for the key of
+// the client which published it
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.release(pk.TopicName)
+	if r <= 0 || cl.Net.Inline {
+		return
+	}
+
+	if key := h.config.Key(cl); key != "" && h.limit(key) > 0 {
+		h.owners[pk.TopicName] = key
+		h.counts[key]++
+	}
+}
+
+// OnRetainedExpired is called when a retained message expires, and stops counting it
+func (h *Hook) OnRetainedExpired(filter string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.release(filter)
+}
+
+// release stops counting the retained message of the topic, and must be called with the lock held
+func (h *Hook) release(topic string) {
+	key, ok := h.owners[topic]
+	if !ok {
+		return
+	}
+
+	delete(h.owners, topic)
+	if h.counts[key]--; h.counts[key] <= 0 {
+		delete(h.counts, key)
+	}
+}
@@ -0,0 +1,237 @@
+package retain
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	retainHook := new(Hook)
+	retainHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, retainHook.Init(options))
+	return retainHook
+}
+
+func newClient(id, username string, version byte) *mqtt.Client {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", id, true)
+	cl.Net.Inline = false
+	cl.Properties.ProtocolVersion = version
+	cl.Properties.Username = []byte(username)
+	return cl
+}
+
+func retained(topic, payload string, qos byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true, Qos: qos},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+		Created:     time.Now().Unix(),
+	}
+}
+
+// retain runs the hooks of a client retaining a message, and returns the error rejecting it
+func retain(h *Hook, cl *mqtt.Client, pk packets.Packet) error {
+	pk, err := h.OnPublish(cl, pk)
+	if err != nil {
+		return err
+	}
+
+	r := int64(1)
+	if len(pk.Payload) == 0 {
+		r = -1
+	}
+	h.OnRetainMessage(cl, pk, r)
+	return nil
+}
+
+func TestID(t *testing.T) {
+	retainHook := new(Hook)
+
+	require.Equal(t, "retain-policy-hook", retainHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	retainHook := new(Hook)
+	require.True(t, retainHook.Provides(mqtt.OnStarted))
+	require.True(t, retainHook.Provides(mqtt.OnPublish))
+	require.True(t, retainHook.Provides(mqtt.OnRetainMessage))
+	require.True(t, retainHook.Provides(mqtt.OnRetainedExpired))
+	require.False(t, retainHook.Provides(mqtt.OnSubscribe))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - rules",
+			config:      Options{Rules: []Rule{{Filter: "commands/#", Forbid: true}, {Filter: "status/+", TTL: time.Hour}}},
+			expectError: false,
+		},
+		{
+			name:        "Success - max",
+			config:      Options{Max: 100, Limits: map[string]int{"acme": 1000}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no policy",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Rules: []Rule{{Filter: "commands/#/x", Forbid: true}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid ttl",
+			config:      Options{Rules: []Rule{{Filter: "status/+", TTL: -time.Second}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			retainHook := new(Hook)
+			retainHook.Log = slog.Default()
+			err := retainHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, retainHook.config.Key)
+
+		})
+	}
+}
+
+func TestForbid(t *testing.T) {
+	retainHook := newHook(t, Options{Rules: []Rule{
+		{Filter: "commands/allowed"},
+		{Filter: "commands/#", Forbid: true},
+	}})
+
+	v5 := newClient("a", "acme", 5)
+	require.ErrorIs(t, retain(retainHook, v5, retained("commands/reboot", "now", 1)), packets.ErrRetainNotSupported)
+	require.ErrorIs(t, retain(retainHook, v5, retained("commands/reboot", "now", 0)), packets.ErrRejectPacket)
+	require.ErrorIs(t, retain(retainHook, newClient("b", "acme", 4), retained("commands/reboot", "now", 1)), packets.ErrRejectPacket)
+
+	// the first matching rule applies, and clearing retained messages is always allowed
+	require.NoError(t, retain(retainHook, v5, retained("commands/allowed", "now", 1)))
+	require.NoError(t, retain(retainHook, v5, retained("commands/reboot", "", 1)))
+	require.NoError(t, retain(retainHook, v5, retained("status/a", "online", 1)))
+
+	// messages which aren't retained, and those of the inline client, are allowed
+	pk := retained("commands/reboot", "now", 1)
+	pk.FixedHeader.Retain = false
+	require.NoError(t, retain(retainHook, v5, pk))
+	require.NoError(t, retain(retainHook, mqtt.New(nil).NewClient(nil, "local", "inline", true), retained("commands/reboot", "now", 1)))
+}
+
+func TestTTL(t *testing.T) {
+	retainHook := newHook(t, Options{Rules: []Rule{{Filter: "status/+", TTL: time.Hour}}})
+	cl := newClient("a", "acme", 5)
+
+	pk, err := retainHook.OnPublish(cl, retained("status/a", "online", 1))
+	require.NoError(t, err)
+	require.Equal(t, pk.Created+3600, pk.Expiry)
+
+	// messages expiring sooner keep their expiry
+	pk = retained("status/a", "online", 1)
+	pk.Expiry = pk.Created + 60
+	pk, err = retainHook.OnPublish(cl, pk)
+	require.NoError(t, err)
+	require.Equal(t, pk.Created+60, pk.Expiry)
+
+	pk, err = retainHook.OnPublish(cl, retained("other/a", "online", 1))
+	require.NoError(t, err)
+	require.Zero(t, pk.Expiry)
+}
+
+func TestLimit(t *testing.T) {
+	retainHook := newHook(t, Options{Max: 2, Limits: map[string]int{"vip": 3, "free": 0}})
+	a := newClient("a", "acme", 5)
+	b := newClient("b", "acme", 5)
+
+	require.NoError(t, retain(retainHook, a, retained("a/1", "x", 1)))
+	require.NoError(t, retain(retainHook, b, retained("a/2", "x", 1)))
+	require.Equal(t, 2, retainHook.Count("acme"))
+
+	// replacing a retained message of the key doesn't count again
+	require.NoError(t, retain(retainHook, a, retained("a/2", "y", 1)))
+	require.ErrorIs(t, retain(retainHook, a, retained("a/3", "x", 1)), packets.ErrQuotaExceeded)
+	require.ErrorIs(t, retain(retainHook, a, retained("a/3", "x", 0)), packets.ErrRejectPacket)
+	require.Equal(t, 2, retainHook.Count("acme"))
+
+	// clearing or expiring retained messages releases them
+	require.NoError(t, retain(retainHook, a, retained("a/1", "", 1)))
+	require.Equal(t, 1, retainHook.Count("acme"))
+	require.NoError(t, retain(retainHook, a, retained("a/3", "x", 1)))
+	retainHook.OnRetainedExpired("a/3")
+	require.Equal(t, 1, retainHook.Count("acme"))
+
+	// retaining a message on the topic of another key moves it
+	vip := newClient("c", "vip", 5)
+	require.NoError(t, retain(retainHook, vip, retained("a/2", "z", 1)))
+	require.Zero(t, retainHook.Count("acme"))
+	require.Equal(t, 1, retainHook.Count("vip"))
+
+	// keys without a limit aren't counted
+	free := newClient("d", "free", 5)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, retain(retainHook, free, retained("free/"+string(rune('a'+i)), "x", 1)))
+	}
+	require.Zero(t, retainHook.Count("free"))
+}
+
+func TestServer(t *testing.T) {
+	s := mqtt.New(&mqtt.Options{InlineClient: true})
+	s.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	// retained messages loaded before the server started are cleared after their ttl
+	old := retained("status/old", "online", 0)
+	old.Created = time.Now().Add(-time.Hour).Unix()
+	s.Topics.RetainMessage(old)
+	other := retained("other/old", "online", 0)
+	other.Created = old.Created
+	s.Topics.RetainMessage(other)
+
+	retainHook := new(Hook)
+	require.NoError(t, s.AddHook(retainHook, Options{Rules: []Rule{{Filter: "status/+", TTL: time.Second}}, Server: s}))
+	require.NoError(t, s.Serve())
+	defer s.Close()
+
+	require.NoError(t, s.Publish("status/new", []byte("online"), true, 0))
+	_, ok := s.Topics.Retained.Get("status/new")
+	require.True(t, ok)
+
+	require.Eventually(t, func() bool {
+		_, oldOk := s.Topics.Retained.Get("status/old")
+		_, newOk := s.Topics.Retained.Get("status/new")
+		return !oldOk && !newOk
+	}, 5*time.Second, 10*time.Millisecond)
+	_, ok = s.Topics.Retained.Get("other/old")
+	require.True(t, ok)
+}
@@ -0,0 +1,405 @@
+package schemaregistry
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDepth is the deepest values of nested types are decoded, as recursive types may nest forever
+const maxDepth = 64
+
+// errTruncated is returned for encodings which end in the middle of a value
+var errTruncated = errors.New("truncated avro encoding")
+
+// avroPrimitives are the primitive types of avro
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true, "string": true,
+}
+
+// avroType is an avro schema
+type avroType struct {
+	kind     string // a primitive type, or record, enum, array, map, union or fixed
+	name     string // the full name of named types
+	fields   []avroField
+	symbols  []string    // of enums
+	items    *avroType   // of arrays and the values of maps
+	branches []*avroType // of unions
+	size     int         // of fixed
+}
+
+// avroField is a field of a record
+type avroField struct {
+	name string
+	typ  *avroType
+}
+
+// parseAvro parses an avro schema in JSON
+func parseAvro(schema string) (*avroType, error) {
+	dec := json.NewDecoder(strings.NewReader(schema))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %w", err)
+	}
+
+	t, err := parseAvroType(v, "", make(map[string]*avroType))
+	if err != nil {
+		return nil, fmt.Errorf("invalid avro schema: %w", err)
+	}
+	return t, nil
+}
+
+// parseAvroType parses the schema of a type in a namespace, with the named types declared so far
+func parseAvroType(v any, namespace string, names map[string]*avroType) (*avroType, error) {
+	switch v := v.(type) {
+	case string:
+		if avroPrimitives[v] {
+			return &avroType{kind: v}, nil
+		}
+
+		if t := names[avroName(v, namespace)]; t != nil {
+			return t, nil
+		}
+		if t := names[v]; t != nil {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", v)
+
+	case []any:
+		t := &avroType{kind: "union"}
+		for _, branch := range v {
+			b, err := parseAvroType(branch, namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			if b.kind == "union" {
+				return nil, errors.New("unions may not contain unions")
+			}
+			t.branches = append(t.branches, b)
+		}
+		return t, nil
+
+	case map[string]any:
+		kind, ok := v["type"].(string)
+		if !ok {
+			// the type of a field may be a schema itself
+			return parseAvroType(v["type"], namespace, names)
+		}
+
+		switch kind {
+		case "record", "error", "enum", "fixed":
+			return parseAvroNamed(v, kind, namespace, names)
+		case "array":
+			items, err := parseAvroType(v["items"], namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			return &avroType{kind: "array", items: items}, nil
+		case "map":
+			values, err := parseAvroType(v["values"], namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			return &avroType{kind: "map", items: values}, nil
+		}
+
+		// primitives with a logical type, such as timestamp-millis, are decoded as the primitive
+		return parseAvroType(kind, namespace, names)
+	}
+
+	return nil, fmt.Errorf("invalid type %v", v)
+}
+
+// parseAvroNamed parses the schema of a record, enum or fixed type
+func parseAvroNamed(v map[string]any, kind, namespace string, names map[string]*avroType) (*avroType, error) {
+	name, _ := v["name"].(string)
+	if name == "" {
+		return nil, fmt.Errorf("%s without a name", kind)
+	}
+
+	if ns, ok := v["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+
+	t := &avroType{kind: kind, name: avroName(name, namespace)}
+	if i := strings.LastIndex(t.name, "."); i >= 0 {
+		namespace = t.name[:i]
+	}
+
+	if names[t.name] != nil {
+		return nil, fmt.Errorf("duplicate type %s", t.name)
+	}
+	names[t.name] = t // before its fields, which may refer to it
+
+	switch kind {
+	case "record", "error":
+		t.kind = "record"
+		fields, ok := v["fields"].([]any)
+		if !ok {
+			return nil, fmt.Errorf("record %s without fields", t.name)
+		}
+
+		for _, f := range fields {
+			field, ok := f.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid field of record %s", t.name)
+			}
+
+			fieldName, _ := field["name"].(string)
+			if fieldName == "" {
+				return nil, fmt.Errorf("field without a name in record %s", t.name)
+			}
+
+			typ, err := parseAvroType(field["type"], namespace, names)
+			if err != nil {
+				return nil, fmt.Errorf("field %s of record %s: %w", fieldName, t.name, err)
+			}
+			t.fields = append(t.fields, avroField{name: fieldName, typ: typ})
+		}
+
+	case "enum":
+		symbols, ok := v["symbols"].([]any)
+		if !ok {
+			return nil, fmt.Errorf("enum %s without symbols", t.name)
+		}
+
+		for _, s := range symbols {
+			symbol, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid symbol of enum %s", t.name)
+			}
+			t.symbols = append(t.symbols, symbol)
+		}
+
+	case "fixed":
+		size, err := strconv.Atoi(fmt.Sprint(v["size"]))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid size of fixed %s", t.name)
+		}
+		t.size = size
+	}
+
+	return t, nil
+}
+
+// avroName returns the full name of a name in a namespace
+func avroName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// decodeAvro returns the value of the type encoded in b as JSON, in which unions are their value,
+// bytes and fixed are base64, and longs are numbers. An error is returned if b isn't a valid encoding
+// of the type, or has bytes left over
+func decodeAvro(t *avroType, b []byte) (any, error) {
+	// each item of arrays and maps takes a byte at least, but for types such as null, which could
+	// otherwise be counted forever, so there are at most as many items as bytes
+	items := len(b)
+	v, rest, err := t.decode(b, 0, &items)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%d bytes after the avro value", len(rest))
+	}
+	return v, nil
+}
+
+// decode decodes a value of the type at the start of b, and returns it and the rest of b. items is
+// the number of items of arrays and maps which may still be decoded
+func (t *avroType) decode(b []byte, depth int, items *int) (any, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, errors.New("avro value is nested too deep")
+	}
+
+	switch t.kind {
+	case "null":
+		return nil, b, nil
+	case "boolean":
+		if len(b) < 1 {
+			return nil, nil, errTruncated
+		}
+		if b[0] > 1 {
+			return nil, nil, errors.New("invalid boolean")
+		}
+		return b[0] == 1, b[1:], nil
+	case "int", "long":
+		n, b, err := avroLong(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if t.kind == "int" && (n < math.MinInt32 || n > math.MaxInt32) {
+			return nil, nil, fmt.Errorf("int %d out of range", n)
+		}
+		return n, b, nil
+	case "float":
+		if len(b) < 4 {
+			return nil, nil, errTruncated
+		}
+		return jsonFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 32), b[4:], nil
+	case "double":
+		if len(b) < 8 {
+			return nil, nil, errTruncated
+		}
+		return jsonFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)), 64), b[8:], nil
+	case "bytes", "string":
+		data, b, err := avroBytes(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if t.kind == "bytes" {
+			return base64.StdEncoding.EncodeToString(data), b, nil
+		}
+		if !utf8.Valid(data) {
+			return nil, nil, errors.New("invalid utf-8 in string")
+		}
+		return string(data), b, nil
+	case "fixed":
+		if len(b) < t.size {
+			return nil, nil, errTruncated
+		}
+		return base64.StdEncoding.EncodeToString(b[:t.size]), b[t.size:], nil
+	case "enum":
+		i, b, err := avroLong(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i < 0 || i >= int64(len(t.symbols)) {
+			return nil, nil, fmt.Errorf("invalid symbol %d of enum %s", i, t.name)
+		}
+		return t.symbols[i], b, nil
+	case "union":
+		i, b, err := avroLong(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i < 0 || i >= int64(len(t.branches)) {
+			return nil, nil, fmt.Errorf("invalid union branch %d", i)
+		}
+		return t.branches[i].decode(b, depth+1, items)
+	case "record":
+		out := make(map[string]any, len(t.fields))
+		for _, f := range t.fields {
+			v, rest, err := f.typ.decode(b, depth+1, items)
+			if err != nil {
+				return nil, nil, fmt.Errorf("field %s of %s: %w", f.name, t.name, err)
+			}
+			out[f.name], b = v, rest
+		}
+		return out, b, nil
+	case "array", "map":
+		return t.decodeBlocks(b, depth, items)
+	}
+
+	return nil, nil, fmt.Errorf("unsupported avro type %s", t.kind)
+}
+
+// decodeBlocks decodes the blocks of items of an array, or of entries of a map
+func (t *avroType) decodeBlocks(b []byte, depth int, items *int) (any, []byte, error) {
+	values := []any{}
+	entries := map[string]any{}
+	for {
+		count, rest, err := avroLong(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		b = rest
+
+		if count == 0 {
+			break
+		}
+
+		// a negative count is followed by the size of the block in bytes
+		if count < 0 {
+			if count == math.MinInt64 {
+				return nil, nil, errors.New("invalid block count")
+			}
+			count = -count
+			if _, b, err = avroLong(b); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if count > int64(*items) {
+			return nil, nil, errors.New("block count exceeds the encoding")
+		}
+		*items -= int(count)
+
+		for ; count > 0; count-- {
+			var key string
+			if t.kind == "map" {
+				data, rest, err := avroBytes(b)
+				if err != nil {
+					return nil, nil, err
+				}
+				key, b = string(data), rest
+			}
+
+			v, rest, err := t.items.decode(b, depth+1, items)
+			if err != nil {
+				return nil, nil, err
+			}
+			b = rest
+
+			if t.kind == "map" {
+				entries[key] = v
+			} else {
+				values = append(values, v)
+			}
+		}
+	}
+
+	if t.kind == "map" {
+		return entries, b, nil
+	}
+	return values, b, nil
+}
+
+// avroLong decodes a zigzag encoded long at the start of b, and returns it and the rest of b
+func avroLong(b []byte) (int64, []byte, error) {
+	v, n := binary.Varint(b)
+	if n == 0 {
+		return 0, nil, errTruncated
+	}
+	if n < 0 {
+		return 0, nil, errors.New("long overflows 64 bits")
+	}
+	return v, b[n:], nil
+}
+
+// avroBytes decodes length prefixed bytes at the start of b, and returns them and the rest of b
+func avroBytes(b []byte) ([]byte, []byte, error) {
+	l, b, err := avroLong(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if l < 0 || l > int64(len(b)) {
+		return nil, nil, errTruncated
+	}
+	return b[:l], b[l:], nil
+}
+
+// jsonFloat returns the JSON value of a float with the precision of its bits. NaN and infinities are
+// strings
+func jsonFloat(v float64, bits int) any {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	return json.Number(strconv.FormatFloat(v, 'g', -1, bits))
+}
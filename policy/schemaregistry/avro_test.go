@@ -0,0 +1,133 @@
+package schemaregistry
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testAvro = `{
+  "type": "record",
+  "name": "Reading",
+  "namespace": "sensors",
+  "fields": [
+    {"name": "device", "type": "string"},
+    {"name": "value", "type": ["null", "double"]},
+    {"name": "tags", "type": {"type": "array", "items": "string"}},
+    {"name": "unit", "type": {"type": "enum", "name": "Unit", "symbols": ["C", "F"]}},
+    {"name": "time", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "labels", "type": {"type": "map", "values": "int"}},
+    {"name": "mac", "type": {"type": "fixed", "name": "sensors.MAC", "size": 2}},
+    {"name": "previous", "type": ["null", "Reading"]}
+  ]
+}`
+
+// testAvroReading returns an encoded Reading
+func testAvroReading() []byte {
+	b := []byte{0x04, 'd', '1', 0x02}
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(21.5))
+	b = append(b, 0x02, 0x02, 'a', 0x00)
+	b = append(b, 0x02)
+	b = binary.AppendVarint(b, 1700000000000)
+
+	// the labels are in a block with its size
+	b = append(b, 0x01, 0x06, 0x02, 'k', 0x0e, 0x00)
+	b = append(b, 0xbe, 0xef)
+
+	// the previous reading
+	return append(b, 0x02, 0x04, 'd', '0', 0x00, 0x00, 0x00, 0x02, 0x00, 0xbe, 0xef, 0x00)
+}
+
+func TestParseAvro(t *testing.T) {
+	typ, err := parseAvro(testAvro)
+	require.NoError(t, err)
+	require.Equal(t, "sensors.Reading", typ.name)
+	require.Len(t, typ.fields, 8)
+	require.Equal(t, "sensors.Unit", typ.fields[3].typ.name)
+	require.Equal(t, "long", typ.fields[4].typ.kind)
+	require.Same(t, typ, typ.fields[7].typ.branches[1])
+
+	for _, schema := range []string{
+		`"int"`,
+		`["null", "string"]`,
+		`{"type": "array", "items": {"type": "map", "values": "bytes"}}`,
+	} {
+		_, err := parseAvro(schema)
+		require.NoError(t, err, schema)
+	}
+
+	for _, schema := range []string{
+		``,
+		`"uint"`,
+		`[["null"]]`,
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "A"}`,
+		`{"type": "record", "name": "A", "fields": [{"name": "b", "type": "B"}]}`,
+		`{"type": "record", "name": "A", "fields": [{"type": "int"}]}`,
+		`{"type": "enum", "name": "E", "symbols": [1]}`,
+		`{"type": "fixed", "name": "F", "size": -1}`,
+		`["A", {"type": "fixed", "name": "A", "size": 1}, {"type": "fixed", "name": "A", "size": 1}]`,
+	} {
+		_, err := parseAvro(schema)
+		require.Error(t, err, schema)
+	}
+}
+
+func TestDecodeAvro(t *testing.T) {
+	typ, err := parseAvro(testAvro)
+	require.NoError(t, err)
+
+	v, err := decodeAvro(typ, testAvroReading())
+	require.NoError(t, err)
+
+	payload, err := json.Marshal(v)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"device": "d1", "value": 21.5, "tags": ["a"], "unit": "F", "time": 1700000000000, "labels": {"k": 7}, "mac": "vu8=",
+		"previous": {"device": "d0", "value": null, "tags": [], "unit": "C", "time": 1, "labels": {}, "mac": "vu8=", "previous": null}
+	}`, string(payload))
+}
+
+func TestDecodeAvroInvalid(t *testing.T) {
+	typ, err := parseAvro(testAvro)
+	require.NoError(t, err)
+
+	reading := testAvroReading()
+	tests := map[string][]byte{
+		"empty":              nil,
+		"truncated":          reading[:len(reading)-1],
+		"trailing bytes":     append(reading, 0x00),
+		"invalid utf-8":      append([]byte{0x02, 0xff}, reading[3:]...),
+		"invalid union":      append([]byte{0x04, 'd', '1', 0x04}, reading[12:]...),
+		"invalid enum":       append(append([]byte{}, reading[:16]...), append([]byte{0x04}, reading[17:]...)...),
+		"negative length":    {0x01},
+		"overflowing length": {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+	}
+
+	for name, b := range tests {
+		_, err := decodeAvro(typ, b)
+		require.Error(t, err, name)
+	}
+
+	nulls, err := parseAvro(`{"type": "array", "items": "null"}`)
+	require.NoError(t, err)
+	_, err = decodeAvro(nulls, binary.AppendVarint(nil, math.MaxInt64))
+	require.Error(t, err)
+
+	v, err := decodeAvro(nulls, []byte{0x02, 0x00})
+	require.NoError(t, err)
+	require.Equal(t, []any{nil}, v)
+
+	ints, err := parseAvro(`"int"`)
+	require.NoError(t, err)
+	_, err = decodeAvro(ints, binary.AppendVarint(nil, math.MaxInt32+1))
+	require.Error(t, err)
+
+	booleans, err := parseAvro(`"boolean"`)
+	require.NoError(t, err)
+	_, err = decodeAvro(booleans, []byte{0x02})
+	require.Error(t, err)
+}
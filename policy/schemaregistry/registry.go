@@ -0,0 +1,170 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/mochi-mqtt/hooks/policy/protobuf"
+)
+
+// the types of schemas in the registry
+const (
+	Avro     = "AVRO"
+	Protobuf = "PROTOBUF"
+)
+
+// errNotFound is returned for schemas and subjects which aren't registered
+var errNotFound = errors.New("not found in schema registry")
+
+// schema is a schema registered in the registry
+type schema struct {
+	id    int
+	kind  string
+	avro  *avroType
+	proto *protobuf.Descriptors
+}
+
+// newSchema parses the source of a schema of the type, which defaults to avro
+func newSchema(id int, kind, source string) (*schema, error) {
+	s := &schema{id: id, kind: kind}
+	var err error
+	switch kind {
+	case "", Avro:
+		s.kind = Avro
+		s.avro, err = parseAvro(source)
+	case Protobuf:
+		s.proto, err = protobuf.ParseProto(source)
+	default:
+		err = fmt.Errorf("unsupported schema type %s", kind)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("schema %d: %w", id, err)
+	}
+	return s, nil
+}
+
+// decode returns the payload, encoded with the schema, as JSON. message is the full name of the
+// message type of protobuf payloads, and defaults to the first message of the schema
+func (s *schema) decode(payload []byte, message string) (any, error) {
+	if s.kind == Avro {
+		return decodeAvro(s.avro, payload)
+	}
+
+	if message == "" {
+		var ok bool
+		if message, ok = s.proto.MessageAt(nil); !ok {
+			return nil, fmt.Errorf("schema %d has no message types", s.id)
+		}
+	}
+	return s.proto.Decode(message, payload)
+}
+
+// messageIndexes decodes the message indexes which precede protobuf payloads in the wire format, as
+// a count and the indexes in zigzag encoded varints. A count of 0 is the first message
+func messageIndexes(b []byte) ([]int, []byte, error) {
+	count, n := binary.Varint(b)
+	if n <= 0 || count < 0 || count > int64(len(b)) {
+		return nil, nil, errors.New("invalid message indexes")
+	}
+	b = b[n:]
+
+	indexes := make([]int, count)
+	for i := range indexes {
+		index, n := binary.Varint(b)
+		if n <= 0 || index < 0 || index > 1<<16 {
+			return nil, nil, errors.New("invalid message indexes")
+		}
+		indexes[i], b = int(index), b[n:]
+	}
+	return indexes, b, nil
+}
+
+// registry is a client of the REST API of a schema registry
+type registry struct {
+	url      *url.URL
+	client   *http.Client
+	username string
+	password string
+}
+
+// schema returns the schema with the id
+func (r *registry) schema(ctx context.Context, id int) (*schema, error) {
+	var out struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := r.get(ctx, &out, "schemas", "ids", strconv.Itoa(id)); err != nil {
+		return nil, err
+	}
+	return newSchema(id, out.SchemaType, out.Schema)
+}
+
+// latest returns the latest version of the schema of the subject
+func (r *registry) latest(ctx context.Context, subject string) (*schema, error) {
+	var out struct {
+		ID         int    `json:"id"`
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := r.get(ctx, &out, "subjects", subject, "versions", "latest"); err != nil {
+		return nil, err
+	}
+	return newSchema(out.ID, out.SchemaType, out.Schema)
+}
+
+// subjects returns the subjects the schema with the id is registered under, which are none if the
+// schema isn't registered
+func (r *registry) subjects(ctx context.Context, id int) ([]string, error) {
+	var out []struct {
+		Subject string `json:"subject"`
+	}
+	err := r.get(ctx, &out, "schemas", "ids", strconv.Itoa(id), "versions")
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	subjects := make([]string, 0, len(out))
+	for _, v := range out {
+		subjects = append(subjects, v.Subject)
+	}
+	return subjects, nil
+}
+
+// get decodes the JSON response of the path into out
+func (r *registry) get(ctx context.Context, out any, path ...string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url.JoinPath(path...).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json, application/json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected schema registry response status %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
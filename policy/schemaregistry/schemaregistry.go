@@ -0,0 +1,400 @@
+package schemaregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// ClientID is the id of the inline client which publishes the decoded messages
+const ClientID = "schemaregistry"
+
+// errUnchecked is returned for messages which could not be checked, as the registry is unavailable
+// or their schema isn't supported
+var errUnchecked = errors.New("message could not be checked")
+
+// Rule is the subject of the schemas of the payloads published to the topics matching a filter
+type Rule struct {
+	// Filter is the topic filter of the rule, eg. sensors/+/reading
+	Filter string
+
+	// Subject is the subject of the schemas in the registry, eg. readings-value
+	Subject string
+
+	// Framed is whether payloads are in the wire format of Confluent serializers, a magic byte and the
+	// id of their schema followed by the encoded value, which Kafka consumers expect. The schema must
+	// be registered under the subject. Other payloads are encoded with the latest schema of the subject
+	Framed bool
+
+	// Message is the full name of the message type of protobuf payloads which aren't framed, and
+	// defaults to the first message of the schema
+	Message string
+
+	// Decode republishes the messages as JSON to their topic with the suffix, eg. for dashboards
+	Decode bool
+}
+
+// Stats are the totals of the messages checked since the hook was initialized
+type Stats struct {
+	Validated int64 // the number of messages which were valid
+	Rejected  int64 // the number of messages rejected as invalid
+	Unchecked int64 // the number of messages which could not be checked
+	Decoded   int64 // the number of decoded messages published
+	Failed    int64 // the number of decoded messages which could not be published
+}
+
+// Hook is a hook that validates the avro and protobuf payloads published to topics against the
+// schemas of a schema registry, and decodes them to JSON
+type Hook struct {
+	config   Options
+	registry *registry
+	schemas  *cache.Cache[int, *schema]    // the schemas by id, which never change
+	latest   *cache.Cache[string, *schema] // the latest schemas by subject
+	subjects *cache.Cache[int, []string]   // the subjects of the schemas by id
+	client   *mqtt.Client
+	stats    Stats
+	mu       sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the schema registry
+// hook. It is the responsibility of the configurer to pass a properly configured RoundTripper that
+// takes care of other requirements such as retries, etc
+type Options struct {
+	// URL is the url of the schema registry, eg. http://localhost:8081. Required
+	URL          *url.URL
+	RoundTripper http.RoundTripper
+
+	// Username and Password authenticate to the registry with basic auth, eg. with the API key and
+	// secret of Confluent Cloud
+	Username string
+	Password string
+
+	// Rules are the subjects of the topics. The first rule whose filter matches a topic applies, and
+	// the payloads of topics matching none aren't checked
+	Rules []Rule
+
+	// Suffix is the suffix of the topics of decoded JSON messages, and defaults to .json
+	Suffix string
+
+	// Server is the server the decoded messages are published to. Required if any rule decodes
+	Server *mqtt.Server
+
+	// Timeout bounds the requests to the registry, and defaults to 5 seconds. CacheTTL is how long the
+	// latest schema of each subject, and the subjects of each schema, are cached, and defaults to 5
+	// minutes. Schemas are cached by id until the hook stops, as they never change
+	Timeout  time.Duration
+	CacheTTL time.Duration
+
+	// FailOpen accepts the messages which could not be checked, as the registry is unavailable or
+	// their schema isn't supported, which are otherwise rejected
+	FailOpen bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "schemaregistry-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublish,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	schemaregistryHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if schemaregistryHookConfig.URL == nil {
+		return errors.New("schema registry url is required")
+	}
+
+	for _, rule := range schemaregistryHookConfig.Rules {
+		if !mqtt.IsValidFilter(rule.Filter, false) {
+			return fmt.Errorf("invalid topic filter %q", rule.Filter)
+		}
+
+		if rule.Subject == "" {
+			return fmt.Errorf("subject of topic filter %s is required", rule.Filter)
+		}
+
+		if rule.Decode && schemaregistryHookConfig.Server == nil {
+			return errors.New("server is required to decode")
+		}
+	}
+
+	if schemaregistryHookConfig.Suffix == "" {
+		schemaregistryHookConfig.Suffix = ".json"
+	}
+
+	if schemaregistryHookConfig.Timeout <= 0 {
+		schemaregistryHookConfig.Timeout = 5 * time.Second
+	}
+
+	if schemaregistryHookConfig.CacheTTL <= 0 {
+		schemaregistryHookConfig.CacheTTL = 5 * time.Minute
+	}
+
+	rt := schemaregistryHookConfig.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	h.config = schemaregistryHookConfig
+	h.registry = &registry{
+		url:      schemaregistryHookConfig.URL,
+		client:   &http.Client{Transport: rt},
+		username: schemaregistryHookConfig.Username,
+		password: schemaregistryHookConfig.Password,
+	}
+	h.schemas = cache.New[int, *schema](cache.Options{MaxEntries: 1000})
+	h.latest = cache.New[string, *schema](cache.Options{TTL: schemaregistryHookConfig.CacheTTL})
+	h.subjects = cache.New[int, []string](cache.Options{MaxEntries: 10000, TTL: schemaregistryHookConfig.CacheTTL})
+
+	if schemaregistryHookConfig.Server != nil {
+		h.client = schemaregistryHookConfig.Server.NewClient(nil, "local", ClientID, true)
+		h.client.Properties.ProtocolVersion = 5
+	}
+
+	return nil
+}
+
+// Stats returns the totals of the messages checked so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// OnPublish is called when a client publishes a message, and rejects it if its payload isn't encoded
+// with a schema of the subject of its topic. Messages published by inline clients, and empty messages,
+// which clear retained messages, are not checked
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline || len(pk.Payload) == 0 {
+		return pk, nil
+	}
+
+	rule, ok := h.rule(pk.TopicName)
+	if !ok {
+		return pk, nil
+	}
+
+	_, err := h.decode(rule, pk.Payload)
+	switch {
+	case errors.Is(err, errUnchecked):
+		h.Log.Warn("message could not be checked", "error", err, "client", cl.ID, "topic", pk.TopicName, "subject", rule.Subject)
+		h.count(func(s *Stats) { s.Unchecked++ })
+		if h.config.FailOpen {
+			return pk, nil
+		}
+		return pk, reject.Publish(cl, pk, packets.ErrUnspecifiedError)
+	case err != nil:
+		h.Log.Debug("rejecting invalid message", "error", err, "client", cl.ID, "topic", pk.TopicName, "subject", rule.Subject)
+		h.count(func(s *Stats) { s.Rejected++ })
+		return pk, reject.Publish(cl, pk, packets.ErrPayloadFormatInvalid)
+	}
+
+	h.count(func(s *Stats) { s.Validated++ })
+	return pk, nil
+}
+
+// OnPublished is called when a client has published a message, and publishes it as JSON if its rule
+// decodes
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if pk.Ignore || pk.Origin == ClientID || h.client == nil {
+		return
+	}
+
+	rule, ok := h.rule(pk.TopicName)
+	if !ok || !rule.Decode {
+		return
+	}
+
+	var payload []byte
+	if len(pk.Payload) > 0 {
+		v, err := h.decode(rule, pk.Payload)
+		if err == nil {
+			payload, err = json.Marshal(v)
+		}
+
+		if err != nil {
+			h.Log.Warn("message could not be decoded", "error", err, "client", cl.ID, "topic", pk.TopicName, "subject", rule.Subject)
+			h.count(func(s *Stats) { s.Failed++ })
+			return
+		}
+	} else if !pk.FixedHeader.Retain {
+		return
+	}
+
+	h.publish(pk, payload)
+}
+
+// rule returns the first rule whose filter matches the topic
+func (h *Hook) rule(topic string) (Rule, bool) {
+	for _, rule := range h.config.Rules {
+		if acl.Match(rule.Filter, topic) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// decode returns the payload as JSON, decoded with its schema. The error wraps errUnchecked if the
+// schema could not be fetched or parsed
+func (h *Hook) decode(rule Rule, payload []byte) (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	if !rule.Framed {
+		s, err := h.latestSchema(ctx, rule.Subject)
+		if err != nil {
+			return nil, err
+		}
+		return s.decode(payload, rule.Message)
+	}
+
+	if len(payload) < 5 || payload[0] != 0 {
+		return nil, errors.New("payload isn't framed with a schema id")
+	}
+
+	id := int(binary.BigEndian.Uint32(payload[1:5]))
+	subjects, err := h.schemaSubjects(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(subjects, rule.Subject) {
+		return nil, fmt.Errorf("schema %d isn't registered under subject %s", id, rule.Subject)
+	}
+
+	s, err := h.schema(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	payload = payload[5:]
+	if s.kind != Protobuf {
+		return s.decode(payload, "")
+	}
+
+	indexes, payload, err := messageIndexes(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	message, ok := s.proto.MessageAt(indexes)
+	if !ok {
+		return nil, fmt.Errorf("no message type at indexes %v of schema %d", indexes, id)
+	}
+	return s.decode(payload, message)
+}
+
+// schema returns the schema with the id, from the cache if it has been fetched before
+func (h *Hook) schema(ctx context.Context, id int) (*schema, error) {
+	if s, ok := h.schemas.Get(id); ok {
+		return s, nil
+	}
+
+	s, err := h.registry.schema(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnchecked, err)
+	}
+
+	h.schemas.Set(id, s)
+	return s, nil
+}
+
+// latestSchema returns the latest schema of the subject, from the cache if it was fetched recently
+func (h *Hook) latestSchema(ctx context.Context, subject string) (*schema, error) {
+	if s, ok := h.latest.Get(subject); ok {
+		return s, nil
+	}
+
+	s, err := h.registry.latest(ctx, subject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: subject %s: %w", errUnchecked, subject, err)
+	}
+
+	h.latest.Set(subject, s)
+	h.schemas.Set(s.id, s)
+	return s, nil
+}
+
+// schemaSubjects returns the subjects of the schema with the id, from the cache if they were fetched
+// recently. Ids which aren't registered are cached as having no subjects
+func (h *Hook) schemaSubjects(ctx context.Context, id int) ([]string, error) {
+	if subjects, ok := h.subjects.Get(id); ok {
+		return subjects, nil
+	}
+
+	subjects, err := h.registry.subjects(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnchecked, err)
+	}
+
+	h.subjects.Set(id, subjects)
+	return subjects, nil
+}
+
+// publish publishes the decoded payload of the message to its topic with the suffix
+func (h *Hook) publish(pk packets.Packet, payload []byte) {
+	topic := pk.TopicName + h.config.Suffix
+	err := h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    pk.FixedHeader.Qos,
+			Retain: pk.FixedHeader.Retain,
+		},
+		TopicName: topic,
+		Payload:   payload,
+		PacketID:  uint16(pk.FixedHeader.Qos),
+		Properties: packets.Properties{
+			PayloadFormat:         1,
+			PayloadFormatFlag:     true,
+			ContentType:           "application/json",
+			MessageExpiryInterval: pk.Properties.MessageExpiryInterval,
+			ResponseTopic:         pk.Properties.ResponseTopic,
+			CorrelationData:       pk.Properties.CorrelationData,
+			User:                  pk.Properties.User,
+		},
+	})
+	if err != nil {
+		h.Log.Error("error occurred while publishing decoded message", "error", err, "topic", topic)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.count(func(s *Stats) { s.Decoded++ })
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update(&h.stats)
+}
@@ -0,0 +1,352 @@
+package schemaregistry
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+const testProto = `
+syntax = "proto3";
+package sensors.v1;
+
+message Reading {
+  string device = 1;
+  int32 value = 2;
+}
+
+message Status {
+  message Battery { uint32 level = 1; }
+  bool online = 1;
+}
+`
+
+// testRegistry is a schema registry serving an avro schema as version 2 of the readings-value subject,
+// and a protobuf schema as version 1 of the sensors-value subject, to requests authenticated as
+// key:secret, and the number of requests it has served
+func testRegistry(t *testing.T) (*url.URL, *atomic.Int64) {
+	t.Helper()
+
+	requests := new(atomic.Int64)
+	mux := http.NewServeMux()
+	respond := func(path string, v any) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if username, password, _ := r.BasicAuth(); username != "key" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(v)
+		})
+	}
+
+	respond("/subjects/readings-value/versions/latest", map[string]any{"subject": "readings-value", "version": 2, "id": 2, "schema": testAvro})
+	respond("/subjects/sensors-value/versions/latest", map[string]any{"subject": "sensors-value", "version": 1, "id": 1, "schema": testProto, "schemaType": "PROTOBUF"})
+	respond("/subjects/json-value/versions/latest", map[string]any{"subject": "json-value", "version": 1, "id": 3, "schema": "{}", "schemaType": "JSON"})
+	respond("/schemas/ids/1", map[string]any{"schema": testProto, "schemaType": "PROTOBUF"})
+	respond("/schemas/ids/1/versions", []map[string]any{{"subject": "sensors-value", "version": 1}})
+	respond("/schemas/ids/2", map[string]any{"schema": testAvro})
+	respond("/schemas/ids/2/versions", []map[string]any{{"subject": "readings-value", "version": 2}})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return u, requests
+}
+
+// testProtoReading returns an encoded sensors.v1.Reading of d1 with the value 5
+func testProtoReading() []byte {
+	return []byte{0x0a, 0x02, 'd', '1', 0x10, 0x05}
+}
+
+// framed returns the payload in the wire format of the schema with the id
+func framed(id uint32, payload ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint32([]byte{0x00}, id)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	schemaregistryHook := new(Hook)
+	schemaregistryHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	if options.Username == "" {
+		options.Username, options.Password = "key", "secret"
+	}
+	require.NoError(t, schemaregistryHook.Init(options))
+	return schemaregistryHook
+}
+
+// subscribe returns the messages published to the filter
+func subscribe(t *testing.T, server *mqtt.Server, filter string) chan packets.Packet {
+	t.Helper()
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return received
+}
+
+func publish(topic string, payload []byte) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     payload,
+		Origin:      "c1",
+	}
+}
+
+func TestID(t *testing.T) {
+	schemaregistryHook := new(Hook)
+
+	require.Equal(t, "schemaregistry-policy-hook", schemaregistryHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	schemaregistryHook := new(Hook)
+
+	require.True(t, schemaregistryHook.Provides(mqtt.OnPublish))
+	require.True(t, schemaregistryHook.Provides(mqtt.OnPublished))
+	require.False(t, schemaregistryHook.Provides(mqtt.OnConnect))
+}
+
+func TestInit(t *testing.T) {
+	u, _ := url.Parse("http://localhost:8081")
+	server := newServer(t)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:   "Success",
+			config: Options{URL: u, Rules: []Rule{{Filter: "sensors/+/reading", Subject: "readings-value"}}},
+		},
+		{
+			name:   "Success - decode",
+			config: Options{URL: u, Server: server, Rules: []Rule{{Filter: "sensors/+/reading", Subject: "readings-value", Decode: true}}},
+		},
+		{
+			name:        "Error - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Error - improper config",
+			config:      "not valid",
+			expectError: true,
+		},
+		{
+			name:        "Error - no url",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid filter",
+			config:      Options{URL: u, Rules: []Rule{{Filter: "sensors/#/reading", Subject: "readings-value"}}},
+			expectError: true,
+		},
+		{
+			name:        "Error - no subject",
+			config:      Options{URL: u, Rules: []Rule{{Filter: "sensors/+/reading"}}},
+			expectError: true,
+		},
+		{
+			name:        "Error - decode without server",
+			config:      Options{URL: u, Rules: []Rule{{Filter: "sensors/+/reading", Subject: "readings-value", Decode: true}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schemaregistryHook := new(Hook)
+			err := schemaregistryHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, ".json", schemaregistryHook.config.Suffix)
+			require.NotZero(t, schemaregistryHook.config.Timeout)
+			require.NotZero(t, schemaregistryHook.config.CacheTTL)
+		})
+	}
+}
+
+func TestOnPublish(t *testing.T) {
+	u, requests := testRegistry(t)
+	server := newServer(t)
+	schemaregistryHook := newHook(t, Options{URL: u, Rules: []Rule{
+		{Filter: "sensors/+/reading", Subject: "readings-value"},
+		{Filter: "kafka/readings", Subject: "readings-value", Framed: true},
+		{Filter: "kafka/sensors", Subject: "sensors-value", Framed: true},
+		{Filter: "sensors/+/proto", Subject: "sensors-value"},
+		{Filter: "sensors/+/status", Subject: "sensors-value", Message: "sensors.v1.Status"},
+		{Filter: "sensors/+/json", Subject: "json-value"},
+		{Filter: "sensors/+/missing", Subject: "missing-value"},
+	}})
+
+	v5 := server.NewClient(nil, "t1", "c1", false)
+	v5.Properties.ProtocolVersion = 5
+
+	tests := []struct {
+		name   string
+		pk     packets.Packet
+		expect error
+	}{
+		{name: "avro", pk: publish("sensors/1/reading", testAvroReading())},
+		{name: "framed avro", pk: publish("kafka/readings", framed(2, testAvroReading()))},
+		{name: "framed protobuf", pk: publish("kafka/sensors", framed(1, []byte{0x00}, testProtoReading()))},
+		{name: "framed nested protobuf", pk: publish("kafka/sensors", framed(1, []byte{0x04, 0x02, 0x00}, []byte{0x08, 0x50}))},
+		{name: "protobuf", pk: publish("sensors/1/proto", testProtoReading())},
+		{name: "protobuf message", pk: publish("sensors/1/status", []byte{0x08, 0x01})},
+		{name: "empty", pk: publish("sensors/1/reading", nil)},
+		{name: "unchecked topic", pk: publish("sensors/1/other", []byte("anything"))},
+		{name: "invalid avro", pk: publish("sensors/1/reading", testProtoReading()), expect: packets.ErrPayloadFormatInvalid},
+		{name: "unframed", pk: publish("kafka/readings", testAvroReading()), expect: packets.ErrPayloadFormatInvalid},
+		{name: "schema of another subject", pk: publish("kafka/readings", framed(1, testAvroReading())), expect: packets.ErrPayloadFormatInvalid},
+		{name: "unknown schema", pk: publish("kafka/readings", framed(99, testAvroReading())), expect: packets.ErrPayloadFormatInvalid},
+		{name: "invalid message indexes", pk: publish("kafka/sensors", framed(1, []byte{0x02, 0x08}, testProtoReading())), expect: packets.ErrPayloadFormatInvalid},
+		{name: "invalid protobuf", pk: publish("sensors/1/proto", []byte{0x0a, 0x05}), expect: packets.ErrPayloadFormatInvalid},
+		{name: "unsupported schema", pk: publish("sensors/1/json", []byte("{}")), expect: packets.ErrUnspecifiedError},
+		{name: "missing subject", pk: publish("sensors/1/missing", []byte("{}")), expect: packets.ErrUnspecifiedError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := schemaregistryHook.OnPublish(v5, tt.pk)
+			if tt.expect == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, tt.expect)
+		})
+	}
+
+	require.Equal(t, Stats{Validated: 6, Rejected: 6, Unchecked: 2}, schemaregistryHook.Stats())
+
+	// the schemas are cached, and so are the subjects of unknown schemas
+	served := requests.Load()
+	for _, tt := range tests {
+		_, _ = schemaregistryHook.OnPublish(v5, tt.pk)
+	}
+	require.Equal(t, served+2, requests.Load())
+}
+
+func TestFailOpen(t *testing.T) {
+	u, _ := testRegistry(t)
+	server := newServer(t)
+	rules := []Rule{{Filter: "sensors/+/reading", Subject: "readings-value"}}
+	v3 := server.NewClient(nil, "t1", "c1", false)
+
+	schemaregistryHook := newHook(t, Options{URL: u, Username: "key", Password: "wrong", Rules: rules})
+	_, err := schemaregistryHook.OnPublish(v3, publish("sensors/1/reading", testAvroReading()))
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+
+	schemaregistryHook = newHook(t, Options{URL: u, Username: "key", Password: "wrong", Rules: rules, FailOpen: true})
+	_, err = schemaregistryHook.OnPublish(v3, publish("sensors/1/reading", testAvroReading()))
+	require.NoError(t, err)
+	require.Equal(t, Stats{Unchecked: 1}, schemaregistryHook.Stats())
+}
+
+func TestDecode(t *testing.T) {
+	u, _ := testRegistry(t)
+	server := newServer(t)
+	received := subscribe(t, server, "#")
+	schemaregistryHook := newHook(t, Options{URL: u, Server: server, Rules: []Rule{
+		{Filter: "kafka/sensors", Subject: "sensors-value", Framed: true, Decode: true},
+		{Filter: "sensors/+/reading", Subject: "readings-value"},
+	}})
+	cl := server.NewClient(nil, "t1", "c1", false)
+
+	pk := publish("kafka/sensors", framed(1, []byte{0x00}, testProtoReading()))
+	pk.FixedHeader.Retain = true
+	pk.Properties.User = []packets.UserProperty{{Key: "site", Val: "home"}}
+	schemaregistryHook.OnPublished(cl, pk)
+
+	require.Len(t, received, 1)
+	decoded := <-received
+	require.Equal(t, "kafka/sensors.json", decoded.TopicName)
+	require.JSONEq(t, `{"device":"d1","value":5}`, string(decoded.Payload))
+	require.Equal(t, "application/json", decoded.Properties.ContentType)
+	require.Equal(t, pk.Properties.User, decoded.Properties.User)
+	require.Equal(t, ClientID, decoded.Origin)
+
+	// clearing the retained message clears the decoded one
+	clear := publish("kafka/sensors", nil)
+	clear.FixedHeader.Retain = true
+	schemaregistryHook.OnPublished(cl, clear)
+	require.Equal(t, "kafka/sensors.json", (<-received).TopicName)
+	_, ok := server.Topics.Retained.Get("kafka/sensors.json")
+	require.False(t, ok)
+
+	// messages which aren't decoded
+	own := publish("kafka/sensors", framed(1, []byte{0x00}, testProtoReading()))
+	own.Origin = ClientID
+	schemaregistryHook.OnPublished(cl, own)
+	schemaregistryHook.OnPublished(cl, publish("sensors/1/reading", testAvroReading()))
+	schemaregistryHook.OnPublished(cl, publish("kafka/sensors", nil))
+	schemaregistryHook.OnPublished(cl, publish("kafka/sensors", []byte("invalid")))
+	require.Len(t, received, 0)
+	require.Equal(t, Stats{Decoded: 2, Failed: 1}, schemaregistryHook.Stats())
+}
+
+func TestMessageIndexes(t *testing.T) {
+	tests := []struct {
+		b       []byte
+		expect  []int
+		invalid bool
+	}{
+		{b: []byte{0x00, 0xff}, expect: []int{}},
+		{b: []byte{0x02, 0x02, 0xff}, expect: []int{1}},
+		{b: []byte{0x04, 0x00, 0x06, 0xff}, expect: []int{0, 3}},
+		{b: []byte{}, invalid: true},
+		{b: []byte{0x01}, invalid: true},
+		{b: []byte{0x04, 0x00}, invalid: true},
+		{b: []byte{0x02, 0x01}, invalid: true},
+	}
+
+	for _, tt := range tests {
+		indexes, rest, err := messageIndexes(tt.b)
+		if tt.invalid {
+			require.Error(t, err, tt.b)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, tt.expect, indexes)
+		require.Equal(t, []byte{0xff}, rest)
+	}
+}
@@ -0,0 +1,596 @@
+// Package wasm provides a hook which calls a WebAssembly module to authenticate clients, check their
+// ACLs and transform or reject the messages they publish, so policies can be written in any language
+// which compiles to WebAssembly, and swapped while the broker runs, isolated from the broker process.
+//
+// Modules export their memory and the functions
+//
+//	alloc(size i32) i32                    allocates size bytes, and returns their offset
+//	free(offset i32, size i32)             optional, frees the bytes alloc allocated or a result
+//	authenticate(offset i32, size i32) i32 optional, 1 if the client of the JSON at the offset may connect
+//	acl_check(offset i32, size i32) i32    optional, 1 if the client may publish or subscribe to the topic
+//	on_publish(offset i32, size i32) i64   optional, the offset << 32 | size of the JSON of the result,
+//	                                       or 0 to publish the message as it is
+//
+// of which the hook provides those the module exports. The functions are given the JSON of
+//
+//	authenticate {"client_id": "c1", "username": "u1", "password": "p1", "remote": "10.0.0.1:50000", "listener": "tcp"}
+//	acl_check    {"client_id": "c1", "username": "u1", "topic": "a/b", "write": true}
+//	on_publish   {"client_id": "c1", "username": "u1", "topic": "a/b", "qos": 1, "retain": false, "payload": "aGk="}
+//
+// where payloads are base64, and on_publish returns the JSON of the changes to the message, eg.
+// {"topic": "a/c", "payload": "aGk="} or {"reject": true, "reason": 153} for a reason code.
+//
+// Modules are run by a Runtime, usually a thin adapter of wazero, eg.
+//
+//	type runtime struct{ wazero.Runtime }
+//
+//	func (r runtime) Instantiate(ctx context.Context, wasm []byte) (mqttwasm.Module, error) {
+//		m, err := r.InstantiateWithConfig(ctx, wasm, wazero.NewModuleConfig().WithName(""))
+//		if err != nil {
+//			return nil, err
+//		}
+//		return module{m}, nil
+//	}
+//
+//	type module struct{ api.Module }
+//
+//	func (m module) Call(ctx context.Context, name string, params ...uint64) ([]uint64, error) {
+//		return m.ExportedFunction(name).Call(ctx, params...)
+//	}
+//
+//	func (m module) Exports(name string) bool                { return m.ExportedFunction(name) != nil }
+//	func (m module) Read(offset, size uint32) ([]byte, bool) { return m.Memory().Read(offset, size) }
+//	func (m module) Write(offset uint32, b []byte) bool      { return m.Memory().Write(offset, b) }
+//
+// with a runtime created with wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+// WithCloseOnContextDone(true)), so that calls exceeding the timeout are stopped, and WASI
+// instantiated in it with wasi_snapshot_preview1.MustInstantiate for modules which need it.
+package wasm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// the functions exported by modules
+const (
+	allocFunc        = "alloc"
+	freeFunc         = "free"
+	authenticateFunc = "authenticate"
+	aclCheckFunc     = "acl_check"
+	onPublishFunc    = "on_publish"
+)
+
+// callbacks are the hooks provided by the functions modules may export
+var callbacks = map[string]byte{
+	authenticateFunc: mqtt.OnConnectAuthenticate,
+	aclCheckFunc:     mqtt.OnACLCheck,
+	onPublishFunc:    mqtt.OnPublish,
+}
+
+// Runtime instantiates WebAssembly modules
+type Runtime interface {
+	// Instantiate returns a new instance of the module
+	Instantiate(ctx context.Context, wasm []byte) (Module, error)
+}
+
+// Module is an instance of a WebAssembly module. Its functions are not called concurrently
+type Module interface {
+	// Call calls the exported function with the params, and returns its results
+	Call(ctx context.Context, name string, params ...uint64) ([]uint64, error)
+
+	// Exports returns whether the module exports the function
+	Exports(name string) bool
+
+	// Read returns size bytes of the memory of the module at the offset, or false if they are out of
+	// range. Write writes to the memory at the offset, or returns false if it is out of range
+	Read(offset, size uint32) ([]byte, bool)
+	Write(offset uint32, b []byte) bool
+
+	// Close releases the instance
+	Close(ctx context.Context) error
+}
+
+// Stats are the totals of the calls of the module since the hook was initialized
+type Stats struct {
+	Calls   int64 // the number of functions called
+	Failed  int64 // the number of calls which failed or timed out
+	Reloads int64 // the number of times the module was swapped
+}
+
+// Hook is a hook that authenticates clients, checks their ACLs and transforms the messages they publish
+// by calling the functions of a WebAssembly module
+type Hook struct {
+	config   Options
+	exports  map[string]bool      // the callbacks exported by the module
+	pool     atomic.Pointer[pool] // the instances of the current module
+	modified time.Time
+	cancel   context.CancelFunc
+	stats    Stats
+	mu       sync.Mutex // guards modified
+	statsMu  sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the wasm hook
+type Options struct {
+	// Runtime instantiates the module. Required
+	Runtime Runtime
+
+	Path   string // the module file
+	Module []byte // used instead of Path if set
+
+	// ReloadInterval is how often the module file is checked for changes. A module which fails to load,
+	// or doesn't export the functions of the current module, leaves the current module in place
+	ReloadInterval time.Duration
+
+	// Instances is how many instances of the module are called concurrently, and defaults to 4
+	Instances int
+
+	// Timeout bounds each call of a function of the module, and defaults to 100 milliseconds
+	Timeout time.Duration
+
+	// FailOpen allows the clients and messages for which the module failed or timed out, which are
+	// otherwise denied and rejected
+	FailOpen bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "wasm-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook, which the module must export the
+// function of
+func (h *Hook) Provides(b byte) bool {
+	for name, hook := range callbacks {
+		if hook == b && h.exports[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	wasmHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if wasmHookConfig.Runtime == nil {
+		return errors.New("runtime is required")
+	}
+
+	if wasmHookConfig.Path == "" && wasmHookConfig.Module == nil {
+		return errors.New("path or module is required")
+	}
+
+	if wasmHookConfig.Instances <= 0 {
+		wasmHookConfig.Instances = 4
+	}
+
+	if wasmHookConfig.Timeout <= 0 {
+		wasmHookConfig.Timeout = 100 * time.Millisecond
+	}
+
+	h.config = wasmHookConfig
+	if err := h.Reload(); err != nil {
+		return err
+	}
+
+	if wasmHookConfig.Path != "" && wasmHookConfig.ReloadInterval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		h.cancel = cancel
+		go h.watch(ctx)
+	}
+
+	return nil
+}
+
+// Stop stops watching the module file and closes the instances of the module
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+
+	if p := h.pool.Swap(nil); p != nil {
+		p.close()
+	}
+	return nil
+}
+
+// Stats returns the totals of the calls so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
+
+// watch reloads the module file when it changes, until the context is cancelled
+func (h *Hook) watch(ctx context.Context) {
+	ticker := time.NewTicker(h.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(h.config.Path)
+			if err != nil {
+				continue
+			}
+
+			h.mu.Lock()
+			changed := !info.ModTime().Equal(h.modified)
+			h.mu.Unlock()
+			if !changed {
+				continue
+			}
+
+			if err := h.Reload(); err != nil {
+				h.Log.Error("error occurred while reloading wasm module", "error", err, "path", h.config.Path)
+			}
+		}
+	}
+}
+
+// Reload reads the module file again and swaps in its instances. If the module cannot be loaded, the
+// current module is kept
+func (h *Hook) Reload() error {
+	if h.config.Path == "" {
+		return h.Load(h.config.Module)
+	}
+
+	info, err := os.Stat(h.config.Path)
+	if err != nil {
+		return err
+	}
+
+	wasm, err := os.ReadFile(h.config.Path)
+	if err != nil {
+		return err
+	}
+
+	if err := h.Load(wasm); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.modified = info.ModTime()
+	h.mu.Unlock()
+	return nil
+}
+
+// Load instantiates the module and swaps its instances in once the calls of the current module have
+// finished. The module must export the same callbacks as the module the hook was initialized with
+func (h *Hook) Load(wasm []byte) error {
+	p, err := newPool(h.config.Runtime, wasm, h.config.Instances)
+	if err != nil {
+		return err
+	}
+
+	m := <-p.modules
+	p.modules <- m
+	exports := make(map[string]bool)
+	for name := range callbacks {
+		exports[name] = m.Exports(name)
+	}
+
+	if !m.Exports(allocFunc) {
+		p.close()
+		return fmt.Errorf("module does not export %s", allocFunc)
+	}
+
+	if h.exports == nil {
+		h.exports = exports
+	}
+
+	for name, exported := range h.exports {
+		if exports[name] != exported {
+			p.close()
+			return fmt.Errorf("module must export the same functions, %s changed", name)
+		}
+	}
+
+	if old := h.pool.Swap(p); old != nil {
+		go old.close()
+		h.count(func(s *Stats) { s.Reloads++ })
+	}
+	return nil
+}
+
+// call calls the function of the module with the JSON of the input, and returns its result. The JSON
+// of the result of functions which return one is decoded into out
+func (h *Hook) call(name string, input any, out any) (uint64, error) {
+	h.count(func(s *Stats) { s.Calls++ })
+
+	b, err := json.Marshal(input)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := h.pool.Load().call(h.config.Timeout, name, b, out)
+	if err != nil {
+		h.count(func(s *Stats) { s.Failed++ })
+		h.Log.Warn("wasm module call failed", "error", err, "function", name)
+	}
+	return result, err
+}
+
+// client is the JSON of a client given to the functions of modules
+type client struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	Listener string `json:"listener,omitempty"`
+}
+
+// aclCheck is the JSON given to acl_check
+type aclCheck struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Topic    string `json:"topic"`
+	Write    bool   `json:"write"`
+}
+
+// publish is the JSON given to on_publish
+type publish struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Topic    string `json:"topic"`
+	Qos      byte   `json:"qos"`
+	Retain   bool   `json:"retain"`
+	Payload  []byte `json:"payload"`
+}
+
+// publishResult is the JSON returned by on_publish
+type publishResult struct {
+	Topic   *string `json:"topic"`
+	Payload []byte  `json:"payload"`
+	Reject  bool    `json:"reject"`
+	Reason  byte    `json:"reason"`
+}
+
+// OnConnectAuthenticate is called when a client connects, and returns whether the module allows it
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	result, err := h.call(authenticateFunc, client{
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Password: string(pk.Connect.Password),
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	}, nil)
+	if err != nil {
+		return h.config.FailOpen
+	}
+	return result == 1
+}
+
+// OnACLCheck is called when a client publishes or subscribes to a topic, and returns whether the
+// module allows it
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	result, err := h.call(aclCheckFunc, aclCheck{
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Topic:    topic,
+		Write:    write,
+	}, nil)
+	if err != nil {
+		return h.config.FailOpen
+	}
+	return result == 1
+}
+
+// OnPublish is called when a client publishes a message, and returns it as the module changed it, or
+// rejects it if the module does
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	var r publishResult
+	result, err := h.call(onPublishFunc, publish{
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Topic:    pk.TopicName,
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		Payload:  pk.Payload,
+	}, &r)
+	if err != nil {
+		if h.config.FailOpen {
+			return pk, nil
+		}
+		return pk, reject.Publish(cl, pk, packets.ErrImplementationSpecificError)
+	}
+
+	if result == 0 {
+		return pk, nil
+	}
+
+	if r.Reject {
+		h.Log.Debug("message rejected by wasm module", "client", cl.ID, "topic", pk.TopicName, "reason", r.Reason)
+		if r.Reason < packets.ErrUnspecifiedError.Code {
+			return pk, reject.Publish(cl, pk, packets.ErrNotAuthorized)
+		}
+		return pk, reject.Publish(cl, pk, packets.Code{Code: r.Reason, Reason: "rejected by policy"})
+	}
+
+	if r.Topic != nil {
+		if *r.Topic == "" || !mqtt.IsValidFilter(*r.Topic, true) {
+			h.Log.Warn("wasm module returned an invalid topic", "client", cl.ID, "topic", *r.Topic)
+			return pk, reject.Publish(cl, pk, packets.ErrImplementationSpecificError)
+		}
+		pk.TopicName = *r.Topic
+	}
+
+	if r.Payload != nil {
+		pk.Payload = r.Payload
+	}
+
+	return pk, nil
+}
+
+// pool is the instances of a module
+type pool struct {
+	runtime Runtime
+	wasm    []byte
+	size    int
+	modules chan Module   // the instances which aren't being called
+	done    chan struct{} // closed once the instances are closed
+}
+
+// newPool returns the instances of the module
+func newPool(runtime Runtime, wasm []byte, size int) (*pool, error) {
+	p := &pool{
+		runtime: runtime,
+		wasm:    wasm,
+		size:    size,
+		modules: make(chan Module, size),
+		done:    make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		m, err := runtime.Instantiate(context.Background(), wasm)
+		if err != nil {
+			close(p.done)
+			for j := 0; j < i; j++ {
+				_ = (<-p.modules).Close(context.Background())
+			}
+			return nil, fmt.Errorf("failed instantiating module: %w", err)
+		}
+		p.modules <- m
+	}
+
+	return p, nil
+}
+
+// errClosed is returned for calls of the instances of modules which were swapped out or stopped
+var errClosed = errors.New("module was closed")
+
+// call calls the function of an instance with the input written to its memory. An instance which
+// fails is replaced by a new one
+func (p *pool) call(timeout time.Duration, name string, input []byte, out any) (uint64, error) {
+	if p == nil {
+		return 0, errClosed
+	}
+
+	var m Module
+	select {
+	case m = <-p.modules:
+	case <-p.done:
+		return 0, errClosed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result, err := p.callModule(ctx, m, name, input, out)
+	if err != nil {
+		m = p.replace(m)
+	}
+	p.modules <- m
+	return result, err
+}
+
+// callModule calls the function of the instance
+func (p *pool) callModule(ctx context.Context, m Module, name string, input []byte, out any) (uint64, error) {
+	offset, err := call(ctx, m, allocFunc, uint64(len(input)))
+	if err != nil {
+		return 0, err
+	}
+
+	if !m.Write(uint32(offset), input) {
+		return 0, fmt.Errorf("%s returned an offset out of range", allocFunc)
+	}
+
+	result, err := call(ctx, m, name, offset, uint64(len(input)))
+	if err != nil {
+		return 0, err
+	}
+	free(ctx, m, offset, uint64(len(input)))
+
+	if out == nil || result == 0 {
+		return result, nil
+	}
+
+	size := uint32(result)
+	offset = result >> 32
+	b, ok := m.Read(uint32(offset), size)
+	if !ok {
+		return 0, fmt.Errorf("%s returned a result out of range", name)
+	}
+
+	err = json.Unmarshal(b, out)
+	free(ctx, m, offset, uint64(size))
+	if err != nil {
+		return 0, fmt.Errorf("%s returned an invalid result: %w", name, err)
+	}
+
+	return result, nil
+}
+
+// call calls the function of the instance, which returns one result
+func call(ctx context.Context, m Module, name string, params ...uint64) (uint64, error) {
+	results, err := m.Call(ctx, name, params...)
+	if err != nil {
+		return 0, fmt.Errorf("%s failed: %w", name, err)
+	}
+
+	if len(results) != 1 {
+		return 0, fmt.Errorf("%s returned %d results", name, len(results))
+	}
+	return results[0], nil
+}
+
+// free frees the bytes of the instance, if it exports free
+func free(ctx context.Context, m Module, offset, size uint64) {
+	if m.Exports(freeFunc) {
+		_, _ = m.Call(ctx, freeFunc, offset, size)
+	}
+}
+
+// replace closes the instance which failed and returns a new one, or the instance if it could not be
+// replaced
+func (p *pool) replace(m Module) Module {
+	replacement, err := p.runtime.Instantiate(context.Background(), p.wasm)
+	if err != nil {
+		return m
+	}
+
+	_ = m.Close(context.Background())
+	return replacement
+}
+
+// close closes the instances once their calls have finished
+func (p *pool) close() {
+	for i := 0; i < p.size; i++ {
+		_ = (<-p.modules).Close(context.Background())
+	}
+	close(p.done)
+}
@@ -0,0 +1,584 @@
+package wasm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// function is a function of a fake module
+type function func(ctx context.Context, m *fakeModule, input []byte) (uint64, error)
+
+// policies are the fake modules, by their bytes
+var policies = map[string]map[string]function{
+	"policy-v1": {
+		authenticateFunc: func(ctx context.Context, m *fakeModule, input []byte) (uint64, error) {
+			var c client
+			_ = json.Unmarshal(input, &c)
+			return allow(c.Username == "u1" && c.Password == "p1" && c.Listener == "tcp"), nil
+		},
+		aclCheckFunc: func(ctx context.Context, m *fakeModule, input []byte) (uint64, error) {
+			var a aclCheck
+			_ = json.Unmarshal(input, &a)
+			return allow(!a.Write || strings.HasPrefix(a.Topic, a.ClientID+"/")), nil
+		},
+		onPublishFunc: func(ctx context.Context, m *fakeModule, input []byte) (uint64, error) {
+			var p publish
+			_ = json.Unmarshal(input, &p)
+			switch p.Topic {
+			case "a/upper":
+				return m.result(map[string]any{"payload": bytes.ToUpper(p.Payload)}), nil
+			case "a/move":
+				return m.result(map[string]any{"topic": "b/moved"}), nil
+			case "a/reject":
+				return m.result(map[string]any{"reject": true, "reason": 0x99}), nil
+			case "a/deny":
+				return m.result(map[string]any{"reject": true}), nil
+			case "a/invalid":
+				return m.result(map[string]any{"topic": "a/#"}), nil
+			case "a/garbage":
+				offset := m.allocate(3)
+				copy(m.memory[offset:], "{{{")
+				return uint64(offset)<<32 | 3, nil
+			case "a/range":
+				return uint64(len(m.memory))<<32 | 10, nil
+			case "a/trap":
+				return 0, errors.New("unreachable")
+			case "a/slow":
+				<-ctx.Done()
+				return 0, ctx.Err()
+			}
+			return 0, nil
+		},
+	},
+	"policy-v2": {
+		authenticateFunc: func(ctx context.Context, m *fakeModule, input []byte) (uint64, error) {
+			return 1, nil
+		},
+		aclCheckFunc: func(ctx context.Context, m *fakeModule, input []byte) (uint64, error) {
+			return 1, nil
+		},
+		onPublishFunc: func(ctx context.Context, m *fakeModule, input []byte) (uint64, error) {
+			return 0, nil
+		},
+	},
+	"auth-only": {
+		authenticateFunc: func(ctx context.Context, m *fakeModule, input []byte) (uint64, error) {
+			return 1, nil
+		},
+	},
+	"no-alloc": nil,
+}
+
+func allow(ok bool) uint64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+// fakeRuntime instantiates the fake modules
+type fakeRuntime struct {
+	instantiated atomic.Int64
+	closed       atomic.Int64
+	fail         atomic.Bool
+}
+
+func (r *fakeRuntime) Instantiate(ctx context.Context, wasm []byte) (Module, error) {
+	functions, ok := policies[string(wasm)]
+	if !ok || r.fail.Load() {
+		return nil, errors.New("invalid module")
+	}
+
+	r.instantiated.Add(1)
+	return &fakeModule{
+		runtime:   r,
+		functions: functions,
+		alloc:     string(wasm) != "no-alloc",
+		memory:    make([]byte, 1<<16),
+	}, nil
+}
+
+// fakeModule is an instance of a fake module, with a bump allocator over its memory
+type fakeModule struct {
+	runtime   *fakeRuntime
+	functions map[string]function
+	alloc     bool
+	memory    []byte
+	next      uint32
+	calling   atomic.Bool
+}
+
+func (m *fakeModule) allocate(size uint32) uint32 {
+	if int(m.next)+int(size) > len(m.memory) {
+		m.next = 0
+	}
+	offset := m.next
+	m.next += size
+	return offset
+}
+
+// result writes the JSON of the result to the memory, and returns its offset and size
+func (m *fakeModule) result(v any) uint64 {
+	b, _ := json.Marshal(v)
+	offset := m.allocate(uint32(len(b)))
+	copy(m.memory[offset:], b)
+	return uint64(offset)<<32 | uint64(len(b))
+}
+
+func (m *fakeModule) Call(ctx context.Context, name string, params ...uint64) ([]uint64, error) {
+	if !m.calling.CompareAndSwap(false, true) {
+		panic("module called concurrently")
+	}
+	defer m.calling.Store(false)
+
+	switch name {
+	case allocFunc:
+		return []uint64{uint64(m.allocate(uint32(params[0])))}, nil
+	case freeFunc:
+		return nil, nil
+	}
+
+	f, ok := m.functions[name]
+	if !ok {
+		return nil, errors.New("not exported")
+	}
+
+	input, _ := m.Read(uint32(params[0]), uint32(params[1]))
+	result, err := f(ctx, m, input)
+	if err != nil {
+		return nil, err
+	}
+	return []uint64{result}, nil
+}
+
+func (m *fakeModule) Exports(name string) bool {
+	if name == allocFunc || name == freeFunc {
+		return m.alloc
+	}
+	_, ok := m.functions[name]
+	return ok
+}
+
+func (m *fakeModule) Read(offset, size uint32) ([]byte, bool) {
+	if uint64(offset)+uint64(size) > uint64(len(m.memory)) {
+		return nil, false
+	}
+	return m.memory[offset : offset+size], true
+}
+
+func (m *fakeModule) Write(offset uint32, b []byte) bool {
+	if uint64(offset)+uint64(len(b)) > uint64(len(m.memory)) {
+		return false
+	}
+	copy(m.memory[offset:], b)
+	return true
+}
+
+func (m *fakeModule) Close(ctx context.Context) error {
+	m.runtime.closed.Add(1)
+	return nil
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	wasmHook := new(Hook)
+	wasmHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, wasmHook.Init(options))
+	t.Cleanup(func() { wasmHook.Stop() })
+	return wasmHook
+}
+
+func newClient(id, username string, version byte) *mqtt.Client {
+	cl := &mqtt.Client{ID: id}
+	cl.Properties.Username = []byte(username)
+	cl.Properties.ProtocolVersion = version
+	cl.Net.Listener = "tcp"
+	return cl
+}
+
+func TestID(t *testing.T) {
+	wasmHook := new(Hook)
+
+	require.Equal(t, "wasm-policy-hook", wasmHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	wasmHook := newHook(t, Options{Runtime: new(fakeRuntime), Module: []byte("policy-v1")})
+	require.True(t, wasmHook.Provides(mqtt.OnConnectAuthenticate))
+	require.True(t, wasmHook.Provides(mqtt.OnACLCheck))
+	require.True(t, wasmHook.Provides(mqtt.OnPublish))
+	require.False(t, wasmHook.Provides(mqtt.OnPublished))
+
+	authOnly := newHook(t, Options{Runtime: new(fakeRuntime), Module: []byte("auth-only")})
+	require.True(t, authOnly.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, authOnly.Provides(mqtt.OnACLCheck))
+	require.False(t, authOnly.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.wasm")
+	require.NoError(t, os.WriteFile(path, []byte("policy-v1"), 0o600))
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - module",
+			config:      Options{Runtime: new(fakeRuntime), Module: []byte("policy-v1")},
+			expectError: false,
+		},
+		{
+			name:        "Success - path",
+			config:      Options{Runtime: new(fakeRuntime), Path: path, ReloadInterval: time.Minute},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no runtime",
+			config:      Options{Module: []byte("policy-v1")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no module",
+			config:      Options{Runtime: new(fakeRuntime)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - missing path",
+			config:      Options{Runtime: new(fakeRuntime), Path: filepath.Join(t.TempDir(), "missing.wasm")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid module",
+			config:      Options{Runtime: new(fakeRuntime), Module: []byte("invalid")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no alloc",
+			config:      Options{Runtime: new(fakeRuntime), Module: []byte("no-alloc")},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			wasmHook := new(Hook)
+			wasmHook.Log = slog.Default()
+			err := wasmHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 4, wasmHook.config.Instances)
+			require.Equal(t, 100*time.Millisecond, wasmHook.config.Timeout)
+			require.NoError(t, wasmHook.Stop())
+
+			runtime := tt.config.(Options).Runtime.(*fakeRuntime)
+			require.Equal(t, int64(4), runtime.instantiated.Load())
+			require.Equal(t, int64(4), runtime.closed.Load())
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	wasmHook := newHook(t, Options{Runtime: new(fakeRuntime), Module: []byte("policy-v1")})
+
+	cl := newClient("c1", "u1", 5)
+	require.True(t, wasmHook.OnConnectAuthenticate(cl, packets.Packet{Connect: packets.ConnectParams{Password: []byte("p1")}}))
+	require.False(t, wasmHook.OnConnectAuthenticate(cl, packets.Packet{Connect: packets.ConnectParams{Password: []byte("p2")}}))
+	require.False(t, wasmHook.OnConnectAuthenticate(newClient("c2", "u2", 5), packets.Packet{Connect: packets.ConnectParams{Password: []byte("p1")}}))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	wasmHook := newHook(t, Options{Runtime: new(fakeRuntime), Module: []byte("policy-v1")})
+
+	cl := newClient("c1", "u1", 5)
+	require.True(t, wasmHook.OnACLCheck(cl, "c1/telemetry", true))
+	require.False(t, wasmHook.OnACLCheck(cl, "c2/telemetry", true))
+	require.True(t, wasmHook.OnACLCheck(cl, "c2/telemetry", false))
+}
+
+func TestOnPublish(t *testing.T) {
+	runtime := new(fakeRuntime)
+	wasmHook := newHook(t, Options{Runtime: runtime, Module: []byte("policy-v1"), Instances: 1, Timeout: 20 * time.Millisecond})
+	failOpen := newHook(t, Options{Runtime: new(fakeRuntime), Module: []byte("policy-v1"), FailOpen: true})
+
+	tests := []struct {
+		name        string
+		hook        *Hook
+		client      *mqtt.Client
+		topic       string
+		qos         byte
+		expect      error
+		wantTopic   string
+		wantPayload string
+	}{
+		{
+			name:        "Success - unchanged",
+			hook:        wasmHook,
+			client:      newClient("c1", "u1", 5),
+			topic:       "a/b",
+			wantTopic:   "a/b",
+			wantPayload: "hello",
+		},
+		{
+			name:        "Success - payload",
+			hook:        wasmHook,
+			client:      newClient("c1", "u1", 5),
+			topic:       "a/upper",
+			wantTopic:   "a/upper",
+			wantPayload: "HELLO",
+		},
+		{
+			name:        "Success - topic",
+			hook:        wasmHook,
+			client:      newClient("c1", "u1", 5),
+			topic:       "a/move",
+			wantTopic:   "b/moved",
+			wantPayload: "hello",
+		},
+		{
+			name:        "Success - inline client",
+			hook:        wasmHook,
+			client:      &mqtt.Client{ID: "inline", Net: mqtt.ClientConnection{Inline: true}},
+			topic:       "a/reject",
+			wantTopic:   "a/reject",
+			wantPayload: "hello",
+		},
+		{
+			name:        "Success - fail open",
+			hook:        failOpen,
+			client:      newClient("c1", "u1", 5),
+			topic:       "a/trap",
+			qos:         1,
+			wantTopic:   "a/trap",
+			wantPayload: "hello",
+		},
+		{
+			name:   "Failure - rejected with reason",
+			hook:   wasmHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/reject",
+			qos:    1,
+			expect: packets.Code{Code: 0x99, Reason: "rejected by policy"},
+		},
+		{
+			name:   "Failure - rejected",
+			hook:   wasmHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/deny",
+			qos:    1,
+			expect: packets.ErrNotAuthorized,
+		},
+		{
+			name:   "Failure - rejected v3",
+			hook:   wasmHook,
+			client: newClient("c1", "u1", 4),
+			topic:  "a/reject",
+			qos:    1,
+			expect: packets.ErrRejectPacket,
+		},
+		{
+			name:   "Failure - invalid topic",
+			hook:   wasmHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/invalid",
+			qos:    1,
+			expect: packets.ErrImplementationSpecificError,
+		},
+		{
+			name:   "Failure - invalid result",
+			hook:   wasmHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/garbage",
+			qos:    1,
+			expect: packets.ErrImplementationSpecificError,
+		},
+		{
+			name:   "Failure - result out of range",
+			hook:   wasmHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/range",
+			qos:    1,
+			expect: packets.ErrImplementationSpecificError,
+		},
+		{
+			name:   "Failure - trap",
+			hook:   wasmHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/trap",
+			expect: packets.ErrRejectPacket,
+		},
+		{
+			name:   "Failure - timeout",
+			hook:   wasmHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/slow",
+			qos:    1,
+			expect: packets.ErrImplementationSpecificError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			pk, err := tt.hook.OnPublish(tt.client, packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: tt.qos},
+				TopicName:   tt.topic,
+				Payload:     []byte("hello"),
+			})
+			if tt.expect != nil {
+				require.ErrorIs(t, err, tt.expect)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantTopic, pk.TopicName)
+			require.Equal(t, tt.wantPayload, string(pk.Payload))
+
+		})
+	}
+
+	// the instances which failed were replaced
+	require.Equal(t, Stats{Calls: 11, Failed: 4}, wasmHook.Stats())
+	require.Equal(t, int64(5), runtime.instantiated.Load())
+	require.Equal(t, int64(4), runtime.closed.Load())
+}
+
+func TestFailures(t *testing.T) {
+	runtime := new(fakeRuntime)
+	wasmHook := newHook(t, Options{Runtime: runtime, Module: []byte("policy-v1"), Instances: 1})
+	failOpen := newHook(t, Options{Runtime: runtime, Module: []byte("auth-only"), Instances: 1, FailOpen: true})
+
+	// instances which cannot be replaced are kept
+	runtime.fail.Store(true)
+	_, err := wasmHook.OnPublish(newClient("c1", "u1", 5), packets.Packet{TopicName: "a/trap"})
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+	require.Equal(t, int64(0), runtime.closed.Load())
+	runtime.fail.Store(false)
+
+	// calls fail once the hook is stopped
+	require.NoError(t, wasmHook.Stop())
+	require.NoError(t, failOpen.Stop())
+	require.False(t, wasmHook.OnACLCheck(newClient("c1", "u1", 5), "c1/telemetry", true))
+	require.True(t, failOpen.OnConnectAuthenticate(newClient("c1", "u1", 5), packets.Packet{}))
+}
+
+func TestLoad(t *testing.T) {
+	runtime := new(fakeRuntime)
+	wasmHook := newHook(t, Options{Runtime: runtime, Module: []byte("policy-v1"), Instances: 2})
+
+	cl := newClient("c2", "u2", 5)
+	require.False(t, wasmHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	require.Error(t, wasmHook.Load([]byte("invalid")))
+	require.Error(t, wasmHook.Load([]byte("no-alloc")))
+	require.Error(t, wasmHook.Load([]byte("auth-only")))
+	require.False(t, wasmHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	require.NoError(t, wasmHook.Load([]byte("policy-v2")))
+	require.True(t, wasmHook.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.Equal(t, int64(1), wasmHook.Stats().Reloads)
+
+	// the instances of the swapped module and the modules which failed to load are closed
+	require.Eventually(t, func() bool {
+		return runtime.closed.Load() == 6
+	}, time.Second, time.Millisecond)
+}
+
+func TestLoadConcurrent(t *testing.T) {
+	wasmHook := newHook(t, Options{Runtime: new(fakeRuntime), Module: []byte("policy-v2"), Instances: 2})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				require.True(t, wasmHook.OnACLCheck(newClient("c1", "u1", 5), "a/b", true))
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, wasmHook.Load([]byte("policy-v2")))
+	}
+	wg.Wait()
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.wasm")
+	require.NoError(t, os.WriteFile(path, []byte("policy-v1"), 0o600))
+
+	wasmHook := newHook(t, Options{Runtime: new(fakeRuntime), Path: path, ReloadInterval: 10 * time.Millisecond})
+	cl := newClient("c2", "u2", 5)
+	require.False(t, wasmHook.OnConnectAuthenticate(cl, packets.Packet{}))
+
+	require.NoError(t, os.WriteFile(path, []byte("policy-v2"), 0o600))
+	modified := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, modified, modified))
+
+	require.Eventually(t, func() bool {
+		return wasmHook.OnConnectAuthenticate(cl, packets.Packet{})
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServer(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	require.NoError(t, server.AddHook(new(Hook), Options{Runtime: new(fakeRuntime), Module: []byte("policy-v1")}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	received := make(chan packets.Packet, 1)
+	require.NoError(t, server.Subscribe("#", 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+
+	cl := server.NewClient(nil, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.State.Inflight.ResetReceiveQuota(10)
+	require.NoError(t, server.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish},
+		TopicName:   "a/upper",
+		Payload:     []byte("hello"),
+	}))
+
+	select {
+	case pk := <-received:
+		require.Equal(t, "a/upper", pk.TopicName)
+		require.Equal(t, "HELLO", string(pk.Payload))
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
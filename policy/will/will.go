@@ -0,0 +1,238 @@
+package will
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/service/alert"
+)
+
+// KindWill is the kind of the alerts raised when a will is published
+const KindWill = "will"
+
+// maxAlertPayload is the most bytes of a will payload included in its alert
+const maxAlertPayload = 256
+
+// Stats are the totals of the wills since the hook was initialized
+type Stats struct {
+	Rejected int64 // the number of wills dropped as they exceeded the limits or weren't authorized
+	Delayed  int64 // the number of wills whose delay was set or capped
+	Alerted  int64 // the number of published wills alerted on
+}
+
+// Hook is a hook that validates the wills of clients against their ACLs and size limits, enforces the
+// delay of their publication, and raises alerts when they are published, so the deaths of devices
+// reach operations tooling.
+//
+// Wills are validated and delayed when the session of the client is established, rather than in
+// OnWill, as the server publishes the will returned by OnWill even if the hook returns an error
+type Hook struct {
+	config Options
+	stats  Stats
+	mu     sync.Mutex // guards stats
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the will hook
+type Options struct {
+	// Auth is the auth hook the topics of wills are checked against, as if the client published to
+	// them. Wills which aren't authorized are dropped. The topics of wills aren't checked if nil
+	Auth mqtt.Hook
+
+	// MaxPayload is the most bytes of the payloads of wills, and wills with larger payloads are
+	// dropped. Payloads aren't limited if 0
+	MaxPayload int
+
+	// Delay is how long the wills of clients which didn't set a will delay interval are delayed, so
+	// clients reconnecting within it don't publish their wills. MaxDelay caps the will delay intervals
+	// set by clients. As with the intervals set by clients, delays are capped at the session expiry
+	// interval of MQTT 5 clients
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// Alert raises an alert when a will is published, eg. alertHook.Raise, which is resolved when
+	// the client connects again. Only the wills published to topics matching Filters are alerted on,
+	// or all of them if it is empty. Severity defaults to alert.SeverityWarning
+	Alert    func(a alert.Alert)
+	Filters  []string
+	Severity string
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "will-policy-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablish,
+		mqtt.OnWillSent,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	willHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if willHookConfig.MaxPayload < 0 {
+		return fmt.Errorf("invalid max payload %d", willHookConfig.MaxPayload)
+	}
+
+	if willHookConfig.Delay < 0 || willHookConfig.MaxDelay < 0 {
+		return errors.New("delays must not be negative")
+	}
+
+	if willHookConfig.MaxDelay > 0 && willHookConfig.Delay > willHookConfig.MaxDelay {
+		return errors.New("delay must not exceed max delay")
+	}
+
+	for _, filter := range willHookConfig.Filters {
+		if !mqtt.IsValidFilter(filter, false) {
+			return fmt.Errorf("invalid filter %q", filter)
+		}
+	}
+
+	if willHookConfig.Severity == "" {
+		willHookConfig.Severity = alert.SeverityWarning
+	}
+
+	h.config = willHookConfig
+	return nil
+}
+
+// Stats returns the totals of the wills so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update(&h.stats)
+}
+
+// validate returns an error if the will of the client exceeds the limits or isn't authorized
+func (h *Hook) validate(cl *mqtt.Client) error {
+	will := cl.Properties.Will
+	if h.config.MaxPayload > 0 && len(will.Payload) > h.config.MaxPayload {
+		return fmt.Errorf("will payload of %d bytes exceeds %d bytes", len(will.Payload), h.config.MaxPayload)
+	}
+
+	if h.config.Auth != nil && !h.config.Auth.OnACLCheck(cl, will.TopicName, true) {
+		return fmt.Errorf("not authorized to publish will to %q", will.TopicName)
+	}
+
+	return nil
+}
+
+// delay returns the will delay interval of the client in seconds
+func (h *Hook) delay(cl *mqtt.Client) uint32 {
+	delay := cl.Properties.Will.WillDelayInterval
+	if delay == 0 {
+		delay = uint32(h.config.Delay / time.Second)
+	}
+
+	if h.config.MaxDelay > 0 && delay > uint32(h.config.MaxDelay/time.Second) {
+		delay = uint32(h.config.MaxDelay / time.Second)
+	}
+
+	props := cl.Properties.Props
+	if props.SessionExpiryIntervalFlag && delay > props.SessionExpiryInterval {
+		delay = props.SessionExpiryInterval
+	}
+
+	return delay
+}
+
+// OnSessionEstablish is called when a client has authenticated, and drops its will if it is invalid,
+// or sets its delay. Alerts raised when the previous will of the client was published are resolved
+func (h *Hook) OnSessionEstablish(cl *mqtt.Client, pk packets.Packet) {
+	if h.config.Alert != nil {
+		h.config.Alert(alert.Alert{
+			Kind:     KindWill,
+			Key:      KindWill + ":" + cl.ID,
+			Summary:  fmt.Sprintf("client %s is back online", cl.ID),
+			Resolved: true,
+		})
+	}
+
+	if atomic.LoadUint32(&cl.Properties.Will.Flag) == 0 {
+		return
+	}
+
+	if err := h.validate(cl); err != nil {
+		h.Log.Warn("dropping invalid will", "error", err, "client", cl.ID, "topic", cl.Properties.Will.TopicName)
+		atomic.StoreUint32(&cl.Properties.Will.Flag, 0)
+		h.count(func(s *Stats) { s.Rejected++ })
+		return
+	}
+
+	if delay := h.delay(cl); delay != cl.Properties.Will.WillDelayInterval {
+		cl.Properties.Will.WillDelayInterval = delay
+		h.count(func(s *Stats) { s.Delayed++ })
+	}
+}
+
+// OnWillSent is called when the will of a client has been published, and raises an alert if its
+// topic matches the filters
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	if h.config.Alert == nil || !h.alerted(pk.TopicName) {
+		return
+	}
+
+	details := map[string]string{
+		"client":   cl.ID,
+		"username": string(cl.Properties.Username),
+		"listener": cl.Net.Listener,
+		"remote":   cl.Net.Remote,
+		"topic":    pk.TopicName,
+		"size":     strconv.Itoa(len(pk.Payload)),
+	}
+	if len(pk.Payload) <= maxAlertPayload && utf8.Valid(pk.Payload) {
+		details["payload"] = string(pk.Payload)
+	}
+
+	h.config.Alert(alert.Alert{
+		Kind:     KindWill,
+		Key:      KindWill + ":" + cl.ID,
+		Summary:  fmt.Sprintf("client %s went offline, and its will was published to %s", cl.ID, pk.TopicName),
+		Severity: h.config.Severity,
+		Details:  details,
+	})
+	h.count(func(s *Stats) { s.Alerted++ })
+}
+
+// alerted returns whether the wills published to the topic are alerted on
+func (h *Hook) alerted(topic string) bool {
+	if len(h.config.Filters) == 0 {
+		return true
+	}
+
+	for _, filter := range h.config.Filters {
+		if acl.Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package will
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/service/alert"
+)
+
+// auth allows clients to publish to the topics prefixed with their client ids
+type auth struct {
+	mqtt.HookBase
+}
+
+func (a *auth) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return strings.HasPrefix(topic, cl.ID+"/")
+}
+
+// alerts collects the alerts raised
+type alerts struct {
+	raised []alert.Alert
+	mu     sync.Mutex
+}
+
+func (a *alerts) raise(alert alert.Alert) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.raised = append(a.raised, alert)
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	willHook := new(Hook)
+	willHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, willHook.Init(options))
+	return willHook
+}
+
+// newClient returns a client with a will
+func newClient(id, topic string, payload []byte, delay uint32) *mqtt.Client {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", id, true)
+	cl.Properties.Username = []byte("acme")
+	cl.Properties.Will = mqtt.Will{
+		TopicName:         topic,
+		Payload:           payload,
+		Flag:              1,
+		WillDelayInterval: delay,
+	}
+	return cl
+}
+
+func TestID(t *testing.T) {
+	willHook := new(Hook)
+
+	require.Equal(t, "will-policy-hook", willHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	willHook := new(Hook)
+	require.True(t, willHook.Provides(mqtt.OnSessionEstablish))
+	require.True(t, willHook.Provides(mqtt.OnWillSent))
+	require.False(t, willHook.Provides(mqtt.OnWill))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Auth: new(auth), MaxPayload: 1024, Delay: time.Minute, MaxDelay: time.Hour, Filters: []string{"devices/+/status"}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid max payload",
+			config:      Options{MaxPayload: -1},
+			expectError: true,
+		},
+		{
+			name:        "Failure - negative delay",
+			config:      Options{Delay: -time.Second},
+			expectError: true,
+		},
+		{
+			name:        "Failure - delay over max delay",
+			config:      Options{Delay: time.Hour, MaxDelay: time.Minute},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Filters: []string{"devices/#/status"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			willHook := new(Hook)
+			willHook.Log = slog.Default()
+			err := willHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, alert.SeverityWarning, willHook.config.Severity)
+
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	willHook := newHook(t, Options{Auth: new(auth), MaxPayload: 8})
+
+	valid := newClient("d1", "d1/status", []byte("offline"), 0)
+	willHook.OnSessionEstablish(valid, packets.Packet{})
+	require.Equal(t, uint32(1), valid.Properties.Will.Flag)
+
+	unauthorized := newClient("d2", "d1/status", []byte("offline"), 0)
+	willHook.OnSessionEstablish(unauthorized, packets.Packet{})
+	require.Zero(t, unauthorized.Properties.Will.Flag)
+
+	large := newClient("d3", "d3/status", []byte("offline, battery empty"), 0)
+	willHook.OnSessionEstablish(large, packets.Packet{})
+	require.Zero(t, large.Properties.Will.Flag)
+
+	// clients without wills are ignored
+	none := mqtt.New(nil).NewClient(nil, "tcp", "d4", true)
+	willHook.OnSessionEstablish(none, packets.Packet{})
+	require.Zero(t, none.Properties.Will.Flag)
+
+	require.Equal(t, Stats{Rejected: 2}, willHook.Stats())
+}
+
+func TestDelay(t *testing.T) {
+	willHook := newHook(t, Options{Delay: time.Minute, MaxDelay: 10 * time.Minute})
+
+	tests := []struct {
+		name     string
+		delay    uint32
+		expiry   uint32 // the session expiry interval, if set
+		expected uint32
+	}{
+		{"default delay", 0, 0, 60},
+		{"client delay", 120, 0, 120},
+		{"capped client delay", 3600, 0, 600},
+		{"capped at session expiry", 0, 30, 30},
+	}
+
+	for _, tt := range tests {
+		cl := newClient("d1", "d1/status", nil, tt.delay)
+		if tt.expiry > 0 {
+			cl.Properties.Props.SessionExpiryInterval = tt.expiry
+			cl.Properties.Props.SessionExpiryIntervalFlag = true
+		}
+
+		willHook.OnSessionEstablish(cl, packets.Packet{})
+		require.Equal(t, tt.expected, cl.Properties.Will.WillDelayInterval, tt.name)
+	}
+
+	require.Equal(t, int64(3), willHook.Stats().Delayed)
+
+	// wills aren't delayed unless configured
+	willHook = newHook(t, Options{})
+	cl := newClient("d1", "d1/status", nil, 0)
+	willHook.OnSessionEstablish(cl, packets.Packet{})
+	require.Zero(t, cl.Properties.Will.WillDelayInterval)
+	require.Zero(t, willHook.Stats().Delayed)
+}
+
+func TestAlert(t *testing.T) {
+	a := new(alerts)
+	willHook := newHook(t, Options{Alert: a.raise, Filters: []string{"+/status"}, Severity: alert.SeverityCritical})
+
+	cl := newClient("d1", "d1/status", []byte("offline"), 0)
+	cl.Net.Remote = "10.0.0.1:51234"
+	willHook.OnWillSent(cl, packets.Packet{TopicName: "d1/status", Payload: []byte("offline")})
+	willHook.OnWillSent(cl, packets.Packet{TopicName: "d1/other", Payload: []byte("offline")})
+	willHook.OnWillSent(cl, packets.Packet{TopicName: "d1/status", Payload: []byte{0xff, 0xfe}})
+
+	require.Len(t, a.raised, 2)
+	require.Equal(t, alert.Alert{
+		Kind:     KindWill,
+		Key:      "will:d1",
+		Summary:  "client d1 went offline, and its will was published to d1/status",
+		Severity: alert.SeverityCritical,
+		Details: map[string]string{
+			"client":   "d1",
+			"username": "acme",
+			"listener": "tcp",
+			"remote":   "10.0.0.1:51234",
+			"topic":    "d1/status",
+			"size":     "7",
+			"payload":  "offline",
+		},
+	}, a.raised[0])
+	require.NotContains(t, a.raised[1].Details, "payload")
+	require.Equal(t, int64(2), willHook.Stats().Alerted)
+
+	// the alert is resolved when the client connects again
+	willHook.OnSessionEstablish(cl, packets.Packet{})
+	require.Len(t, a.raised, 3)
+	require.True(t, a.raised[2].Resolved)
+	require.Equal(t, "will:d1", a.raised[2].Key)
+}
@@ -0,0 +1,388 @@
+// Package alert provides a hook sending alerts to Slack or PagerDuty when conditions occur on the
+// broker: repeated authentication failures from an IP, named clients going offline, or the queues of
+// bridge and sink hooks overflowing. Alerts are rate limited, so an incident doesn't become a storm.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// the kinds of alerts raised by the hook
+const (
+	KindAuthFailures = "auth_failures"
+	KindOffline      = "offline"
+	KindOverflow     = "overflow"
+)
+
+// the severities of alerts, as PagerDuty defines them
+const (
+	SeverityCritical = "critical"
+	SeverityError    = "error"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+)
+
+// Alert is a condition which occurred on the broker
+type Alert struct {
+	Kind      string
+	Key       string // identifies the condition, eg. offline:device-1, which is rate limited and resolved
+	Summary   string
+	Severity  string
+	Details   map[string]string
+	Resolved  bool // the condition has ended, eg. the client came back online
+	Timestamp time.Time
+}
+
+// Stats are the totals of the alerts since the hook was initialized
+type Stats struct {
+	Sent       int64 // the number of alerts sent to the notifiers
+	Suppressed int64 // the number of alerts which were rate limited
+	Dropped    int64 // the number of alerts discarded as the queue was full
+	Failed     int64 // the number of times a notifier failed to send an alert
+}
+
+// AuthFailures raises an alert when Threshold connections from an IP fail to authenticate within
+// Window, which defaults to a minute
+type AuthFailures struct {
+	Threshold int
+	Window    time.Duration
+}
+
+// failures are the failed connections from an IP in the current window
+type failures struct {
+	n     int
+	start time.Time
+}
+
+// Hook is a hook that sends alerts when conditions occur on the broker
+type Hook struct {
+	config   Options
+	clients  map[string]bool                 // the ids of the clients whose disconnects are alerted
+	failures *cache.Cache[string, failures]  // the failed connections of each IP
+	cooldown *cache.Cache[string, time.Time] // when each key was last alerted
+	open     *cache.Cache[string, bool]      // the keys which were alerted and not yet resolved
+	window   time.Time                       // the start of the minute alerts are limited in
+	sent     int                             // the alerts sent in the minute
+	queue    chan Alert
+	now      func() time.Time
+	stats    Stats
+	wg       sync.WaitGroup // the sender
+	mu       sync.Mutex     // guards failures, cooldown, open, window and sent
+	statsMu  sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the alert hook
+type Options struct {
+	// Notifiers are sent the alerts, eg. &alert.Slack{} and &alert.PagerDuty{}. At least one is
+	// required
+	Notifiers []Notifier
+
+	// AuthFailures alerts on repeated authentication failures from an IP, and Clients on the named
+	// clients disconnecting, which is resolved when they connect again. The queues of hooks are
+	// alerted on by setting their Dropped metric to Overflow
+	AuthFailures AuthFailures
+	Clients      []string
+
+	// Cooldown is how long alerts with the same key are suppressed after one is sent, and defaults to
+	// 5 minutes. Limit is the most alerts sent a minute, and defaults to 20
+	Cooldown time.Duration
+	Limit    int
+
+	QueueSize int           // how many alerts are queued to be sent, defaults to 100
+	Timeout   time.Duration // how long sending an alert may take, defaults to 10 seconds
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "alert-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPacketSent,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts sending alerts
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	alertHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if len(alertHookConfig.Notifiers) == 0 {
+		return errors.New("a notifier is required")
+	}
+
+	if alertHookConfig.AuthFailures.Threshold < 0 {
+		return fmt.Errorf("invalid auth failures threshold %d", alertHookConfig.AuthFailures.Threshold)
+	}
+
+	if alertHookConfig.AuthFailures.Window <= 0 {
+		alertHookConfig.AuthFailures.Window = time.Minute
+	}
+
+	if alertHookConfig.Cooldown <= 0 {
+		alertHookConfig.Cooldown = 5 * time.Minute
+	}
+
+	if alertHookConfig.Limit <= 0 {
+		alertHookConfig.Limit = 20
+	}
+
+	if alertHookConfig.QueueSize <= 0 {
+		alertHookConfig.QueueSize = 100
+	}
+
+	if alertHookConfig.Timeout <= 0 {
+		alertHookConfig.Timeout = 10 * time.Second
+	}
+
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	h.config = alertHookConfig
+	h.clients = make(map[string]bool, len(alertHookConfig.Clients))
+	for _, id := range alertHookConfig.Clients {
+		h.clients[id] = true
+	}
+	h.failures = cache.New[string, failures](cache.Options{MaxEntries: 100000, TTL: alertHookConfig.AuthFailures.Window, Now: h.now})
+	h.cooldown = cache.New[string, time.Time](cache.Options{MaxEntries: 100000, TTL: alertHookConfig.Cooldown, Now: h.now})
+	h.open = cache.New[string, bool](cache.Options{MaxEntries: 100000})
+	h.queue = make(chan Alert, alertHookConfig.QueueSize)
+
+	h.wg.Add(1)
+	go h.sender(h.queue)
+
+	return nil
+}
+
+// Stop sends the queued alerts
+func (h *Hook) Stop() error {
+	h.mu.Lock()
+	queue := h.queue
+	h.queue = nil
+	h.mu.Unlock()
+
+	if queue == nil {
+		return nil
+	}
+
+	close(queue)
+	h.wg.Wait()
+	return nil
+}
+
+// Stats returns the totals of the alerts so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// Raise sends the alert, unless another with the same key was sent within the cooldown or the limit of
+// alerts a minute was reached. Resolved alerts are only sent for keys whose alert was sent, and aren't
+// rate limited
+func (h *Hook) Raise(alert Alert) {
+	if alert.Severity == "" {
+		alert.Severity = SeverityError
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.queue == nil {
+		return
+	}
+
+	now := h.now()
+	if alert.Timestamp.IsZero() {
+		alert.Timestamp = now
+	}
+
+	if alert.Resolved {
+		if _, ok := h.open.Get(alert.Key); !ok {
+			return
+		}
+		h.open.Delete(alert.Key)
+	} else {
+		if now.Sub(h.window) >= time.Minute {
+			h.window, h.sent = now, 0
+		}
+
+		if _, ok := h.cooldown.Get(alert.Key); ok || h.sent >= h.config.Limit {
+			h.count(func(s *Stats) { s.Suppressed++ })
+			return
+		}
+
+		h.cooldown.Set(alert.Key, now)
+		h.open.Set(alert.Key, true)
+		h.sent++
+	}
+
+	select {
+	case h.queue <- alert:
+	default:
+		h.count(func(s *Stats) { s.Dropped++ })
+	}
+}
+
+// Overflow returns a func raising an alert that the queue of the named hook overflowed, to set as the
+// Dropped metric of the hook, eg. kafka.Metrics{Dropped: alertHook.Overflow("kafka")}
+func (h *Hook) Overflow(name string) func() {
+	return func() {
+		h.Raise(Alert{
+			Kind:     KindOverflow,
+			Key:      KindOverflow + ":" + name,
+			Summary:  fmt.Sprintf("the queue of the %s hook overflowed, and messages were dropped", name),
+			Severity: SeverityError,
+			Details:  map[string]string{"hook": name},
+		})
+	}
+}
+
+// sender sends the queued alerts to the notifiers until the hook stops
+func (h *Hook) sender(queue chan Alert) {
+	defer h.wg.Done()
+
+	for alert := range queue {
+		for _, notifier := range h.config.Notifiers {
+			ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+			err := notifier.Notify(ctx, alert)
+			cancel()
+			if err != nil {
+				h.Log.Error("error occurred while sending alert", "error", err, "key", alert.Key)
+				h.count(func(s *Stats) { s.Failed++ })
+			}
+		}
+		h.count(func(s *Stats) { s.Sent++ })
+	}
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
+
+// OnPacketSent is called when a packet has been written to a client, and counts the connections which
+// failed to authenticate
+func (h *Hook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if h.config.AuthFailures.Threshold == 0 || pk.FixedHeader.Type != packets.Connack || !authFailed(pk) {
+		return
+	}
+
+	ip := host(cl.Net.Remote)
+	h.mu.Lock()
+	now := h.now()
+	f, ok := h.failures.Get(ip)
+	if !ok || now.Sub(f.start) >= h.config.AuthFailures.Window {
+		f = failures{start: now}
+	}
+	f.n++
+	alert := f.n >= h.config.AuthFailures.Threshold
+	if alert {
+		h.failures.Delete(ip)
+	} else {
+		h.failures.Set(ip, f)
+	}
+	h.mu.Unlock()
+
+	if alert {
+		h.Raise(Alert{
+			Kind:     KindAuthFailures,
+			Key:      KindAuthFailures + ":" + ip,
+			Summary:  fmt.Sprintf("%d connections from %s failed to authenticate", f.n, ip),
+			Severity: SeverityWarning,
+			Details: map[string]string{
+				"ip":       ip,
+				"failures": strconv.Itoa(f.n),
+				"window":   h.config.AuthFailures.Window.String(),
+				"client":   cl.ID,
+				"username": string(cl.Properties.Username),
+				"listener": cl.Net.Listener,
+			},
+		})
+	}
+}
+
+// OnSessionEstablished is called when a client has connected and authenticated, and resolves the alert
+// of a named client which went offline
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if !h.clients[cl.ID] {
+		return
+	}
+
+	h.Raise(Alert{
+		Kind:     KindOffline,
+		Key:      KindOffline + ":" + cl.ID,
+		Summary:  fmt.Sprintf("client %s is back online", cl.ID),
+		Resolved: true,
+	})
+}
+
+// OnDisconnect is called when a client which had connected disconnects, and alerts on named clients,
+// unless their session was taken over by a new connection
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if !h.clients[cl.ID] || errors.Is(err, packets.ErrSessionTakenOver) {
+		return
+	}
+
+	reason := "disconnected"
+	if err != nil {
+		reason = err.Error()
+	}
+
+	h.Raise(Alert{
+		Kind:     KindOffline,
+		Key:      KindOffline + ":" + cl.ID,
+		Summary:  fmt.Sprintf("client %s went offline", cl.ID),
+		Severity: SeverityCritical,
+		Details: map[string]string{
+			"client":   cl.ID,
+			"ip":       host(cl.Net.Remote),
+			"listener": cl.Net.Listener,
+			"reason":   reason,
+		},
+	})
+}
+
+// authFailed returns whether the connack rejects the connection as it failed to authenticate, with the
+// codes of MQTT v5, or those of v3 they are converted to
+func authFailed(pk packets.Packet) bool {
+	switch pk.ReasonCode {
+	case packets.ErrBadUsernameOrPassword.Code, packets.ErrNotAuthorized.Code, packets.Err3NotAuthorized.Code:
+		return true
+	}
+	return false
+}
+
+// host returns the host of the remote address, without its port
+func host(remote string) string {
+	if h, _, err := net.SplitHostPort(remote); err == nil {
+		return h
+	}
+	return remote
+}
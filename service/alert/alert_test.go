@@ -0,0 +1,315 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotifier records the alerts it is sent
+type fakeNotifier struct {
+	alerts []Alert
+	err    error
+	mu     sync.Mutex
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, alert Alert) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.alerts = append(n.alerts, alert)
+	return n.err
+}
+
+// clock is a time which is moved by the tests
+type clock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newHook(t *testing.T, options Options) (*Hook, *clock) {
+	t.Helper()
+
+	c := &clock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	alertHook := new(Hook)
+	alertHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	alertHook.now = c.Now
+	require.NoError(t, alertHook.Init(options))
+	t.Cleanup(func() { alertHook.Stop() })
+	return alertHook, c
+}
+
+func newClient(id, remote string) *mqtt.Client {
+	cl := mqtt.New(nil).NewClient(nil, "t1", id, false)
+	cl.Net.Remote = remote
+	cl.Properties.ProtocolVersion = 5
+	return cl
+}
+
+// connack returns a connack with the reason code
+func connack(code byte) packets.Packet {
+	return packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Connack}, ReasonCode: code}
+}
+
+func TestID(t *testing.T) {
+	alertHook := new(Hook)
+
+	require.Equal(t, "alert-hook", alertHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	alertHook := new(Hook)
+
+	require.True(t, alertHook.Provides(mqtt.OnPacketSent))
+	require.True(t, alertHook.Provides(mqtt.OnDisconnect))
+	require.False(t, alertHook.Provides(mqtt.OnPublished))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Notifiers: []Notifier{new(fakeNotifier)}, AuthFailures: AuthFailures{Threshold: 5}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no notifiers",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid threshold",
+			config:      Options{Notifiers: []Notifier{new(fakeNotifier)}, AuthFailures: AuthFailures{Threshold: -1}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			alertHook := new(Hook)
+			alertHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := alertHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, time.Minute, alertHook.config.AuthFailures.Window)
+				require.Equal(t, 5*time.Minute, alertHook.config.Cooldown)
+				require.Equal(t, 20, alertHook.config.Limit)
+				require.Equal(t, 100, alertHook.config.QueueSize)
+				require.Equal(t, 10*time.Second, alertHook.config.Timeout)
+				require.NoError(t, alertHook.Stop())
+				require.NoError(t, alertHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	notifier := new(fakeNotifier)
+	alertHook, c := newHook(t, Options{Notifiers: []Notifier{notifier}, AuthFailures: AuthFailures{Threshold: 3}})
+
+	cl := newClient("device-1", "10.0.0.1:1234")
+	alertHook.OnPacketSent(cl, connack(packets.ErrBadUsernameOrPassword.Code), nil)
+	alertHook.OnPacketSent(cl, connack(packets.ErrNotAuthorized.Code), nil)
+	alertHook.OnPacketSent(cl, connack(packets.CodeSuccess.Code), nil)
+	alertHook.OnPacketSent(newClient("device-2", "10.0.0.2:1234"), connack(packets.ErrNotAuthorized.Code), nil)
+
+	// failures outside the window start over
+	c.Add(2 * time.Minute)
+	alertHook.OnPacketSent(cl, connack(packets.ErrBadUsernameOrPassword.Code), nil)
+	alertHook.OnPacketSent(cl, connack(packets.Err3NotAuthorized.Code), nil)
+	alertHook.OnPacketSent(cl, connack(packets.ErrBadUsernameOrPassword.Code), nil)
+	require.NoError(t, alertHook.Stop())
+
+	require.Len(t, notifier.alerts, 1)
+	require.Equal(t, Alert{
+		Kind:     KindAuthFailures,
+		Key:      "auth_failures:10.0.0.1",
+		Summary:  "3 connections from 10.0.0.1 failed to authenticate",
+		Severity: SeverityWarning,
+		Details: map[string]string{
+			"ip":       "10.0.0.1",
+			"failures": "3",
+			"window":   "1m0s",
+			"client":   "device-1",
+			"username": "",
+			"listener": "t1",
+		},
+		Timestamp: c.Now(),
+	}, notifier.alerts[0])
+	require.Equal(t, Stats{Sent: 1}, alertHook.Stats())
+}
+
+func TestOffline(t *testing.T) {
+	notifier := new(fakeNotifier)
+	alertHook, _ := newHook(t, Options{Notifiers: []Notifier{notifier}, Clients: []string{"device-1"}})
+
+	cl := newClient("device-1", "10.0.0.1:1234")
+	alertHook.OnSessionEstablished(cl, packets.Packet{})
+	alertHook.OnDisconnect(cl, packets.ErrSessionTakenOver, false)
+	alertHook.OnDisconnect(newClient("device-2", "10.0.0.2:1234"), nil, false)
+	alertHook.OnDisconnect(cl, packets.ErrKeepAliveTimeout, false)
+	alertHook.OnSessionEstablished(cl, packets.Packet{})
+	require.NoError(t, alertHook.Stop())
+
+	require.Len(t, notifier.alerts, 2)
+	require.Equal(t, "offline:device-1", notifier.alerts[0].Key)
+	require.Equal(t, SeverityCritical, notifier.alerts[0].Severity)
+	require.Equal(t, packets.ErrKeepAliveTimeout.Error(), notifier.alerts[0].Details["reason"])
+	require.False(t, notifier.alerts[0].Resolved)
+	require.Equal(t, "offline:device-1", notifier.alerts[1].Key)
+	require.True(t, notifier.alerts[1].Resolved)
+}
+
+func TestRateLimit(t *testing.T) {
+	notifier := new(fakeNotifier)
+	alertHook, c := newHook(t, Options{Notifiers: []Notifier{notifier}, Cooldown: time.Minute, Limit: 2})
+
+	// alerts with the same key are suppressed during the cooldown
+	kafka := alertHook.Overflow("kafka")
+	kafka()
+	kafka()
+	c.Add(time.Minute)
+	kafka()
+
+	// and at most Limit are sent a minute
+	alertHook.Overflow("sqs")()
+	alertHook.Overflow("sns")()
+
+	// resolved alerts are only sent for alerts which were sent, and aren't limited
+	alertHook.Raise(Alert{Key: "overflow:sns", Resolved: true})
+	alertHook.Raise(Alert{Key: "overflow:sqs", Resolved: true})
+	require.NoError(t, alertHook.Stop())
+
+	require.Len(t, notifier.alerts, 4)
+	require.Equal(t, "overflow:kafka", notifier.alerts[0].Key)
+	require.Equal(t, "overflow:kafka", notifier.alerts[1].Key)
+	require.Equal(t, "overflow:sqs", notifier.alerts[2].Key)
+	require.Equal(t, "overflow:sqs", notifier.alerts[3].Key)
+	require.True(t, notifier.alerts[3].Resolved)
+	require.Equal(t, Stats{Sent: 4, Suppressed: 2}, alertHook.Stats())
+}
+
+func TestFailed(t *testing.T) {
+	notifier := &fakeNotifier{err: errors.New("failed")}
+	alertHook, _ := newHook(t, Options{Notifiers: []Notifier{notifier, new(fakeNotifier)}})
+
+	alertHook.Raise(Alert{Key: "custom", Summary: "custom"})
+	require.NoError(t, alertHook.Stop())
+	require.Equal(t, Stats{Sent: 1, Failed: 1}, alertHook.Stats())
+	require.Equal(t, SeverityError, notifier.alerts[0].Severity)
+}
+
+// receiver returns a server recording the JSON bodies posted to it
+func receiver(t *testing.T, status int) (*httptest.Server, *[]map[string]any) {
+	t.Helper()
+
+	var bodies []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, _ := io.ReadAll(r.Body)
+		body := map[string]any{}
+		require.NoError(t, json.Unmarshal(b, &body))
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &bodies
+}
+
+func TestSlack(t *testing.T) {
+	server, bodies := receiver(t, http.StatusOK)
+	slack := &Slack{WebhookURL: server.URL}
+
+	alert := Alert{Key: "offline:device-1", Summary: "client device-1 went offline", Severity: SeverityCritical, Details: map[string]string{"reason": "EOF", "ip": "10.0.0.1"}}
+	require.NoError(t, slack.Notify(context.Background(), alert))
+	alert.Resolved = true
+	require.NoError(t, slack.Notify(context.Background(), alert))
+
+	require.Equal(t, []map[string]any{
+		{"text": ":rotating_light: *[critical]* client device-1 went offline\n• ip: `10.0.0.1`\n• reason: `EOF`"},
+		{"text": ":white_check_mark: *Resolved:* client device-1 went offline\n• ip: `10.0.0.1`\n• reason: `EOF`"},
+	}, *bodies)
+
+	failing, _ := receiver(t, http.StatusForbidden)
+	require.Error(t, (&Slack{WebhookURL: failing.URL}).Notify(context.Background(), alert))
+}
+
+func TestPagerDuty(t *testing.T) {
+	server, bodies := receiver(t, http.StatusAccepted)
+	pagerDuty := &PagerDuty{RoutingKey: "key", URL: server.URL}
+
+	alert := Alert{
+		Kind:      KindOffline,
+		Key:       "offline:device-1",
+		Summary:   "client device-1 went offline",
+		Severity:  SeverityCritical,
+		Details:   map[string]string{"reason": "EOF"},
+		Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	require.NoError(t, pagerDuty.Notify(context.Background(), alert))
+	alert.Resolved = true
+	require.NoError(t, pagerDuty.Notify(context.Background(), alert))
+
+	require.Equal(t, []map[string]any{
+		{
+			"routing_key":  "key",
+			"event_action": "trigger",
+			"dedup_key":    "offline:device-1",
+			"payload": map[string]any{
+				"summary":        "client device-1 went offline",
+				"source":         "mochi-mqtt",
+				"severity":       "critical",
+				"timestamp":      "2024-01-02T03:04:05Z",
+				"component":      "mqtt",
+				"class":          "offline",
+				"custom_details": map[string]any{"reason": "EOF"},
+			},
+		},
+		{
+			"routing_key":  "key",
+			"event_action": "resolve",
+			"dedup_key":    "offline:device-1",
+		},
+	}, *bodies)
+}
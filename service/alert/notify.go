@@ -0,0 +1,129 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notifier sends alerts to an alerting service
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// Slack sends alerts to a Slack incoming webhook
+type Slack struct {
+	// WebhookURL is the URL of the incoming webhook, eg. https://hooks.slack.com/services/...
+	WebhookURL string
+
+	// RoundTripper sends the requests, and defaults to http.DefaultTransport
+	RoundTripper http.RoundTripper
+}
+
+// Notify posts the alert to the webhook as a message
+func (s *Slack) Notify(ctx context.Context, alert Alert) error {
+	var text strings.Builder
+	if alert.Resolved {
+		fmt.Fprintf(&text, ":white_check_mark: *Resolved:* %s", alert.Summary)
+	} else {
+		fmt.Fprintf(&text, ":rotating_light: *[%s]* %s", alert.Severity, alert.Summary)
+	}
+
+	for _, name := range sortedKeys(alert.Details) {
+		fmt.Fprintf(&text, "\n• %s: `%s`", name, alert.Details[name])
+	}
+
+	return post(ctx, s.RoundTripper, s.WebhookURL, map[string]string{"text": text.String()})
+}
+
+// PagerDuty sends alerts to the PagerDuty Events API v2, resolving the incidents of resolved alerts
+type PagerDuty struct {
+	// RoutingKey is the integration key of the service the alerts are sent to
+	RoutingKey string
+
+	// Source is the source of the alerts, eg. the hostname of the broker, and defaults to mochi-mqtt
+	Source string
+
+	// URL is the URL of the Events API, and defaults to https://events.pagerduty.com/v2/enqueue
+	URL string
+
+	// RoundTripper sends the requests, and defaults to http.DefaultTransport
+	RoundTripper http.RoundTripper
+}
+
+// Notify enqueues an event triggering or resolving the incident of the alert, deduplicated by its key
+func (p *PagerDuty) Notify(ctx context.Context, alert Alert) error {
+	url := p.URL
+	if url == "" {
+		url = "https://events.pagerduty.com/v2/enqueue"
+	}
+
+	source := p.Source
+	if source == "" {
+		source = "mochi-mqtt"
+	}
+
+	event := map[string]any{
+		"routing_key":  p.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    alert.Key,
+	}
+
+	if alert.Resolved {
+		event["event_action"] = "resolve"
+	} else {
+		event["payload"] = map[string]any{
+			"summary":        alert.Summary,
+			"source":         source,
+			"severity":       alert.Severity,
+			"timestamp":      alert.Timestamp.UTC().Format(time.RFC3339),
+			"component":      "mqtt",
+			"class":          alert.Kind,
+			"custom_details": alert.Details,
+		}
+	}
+
+	return post(ctx, p.RoundTripper, url, event)
+}
+
+// post posts the body as JSON to the URL, returning an error unless the response is a success
+func post(ctx context.Context, rt http.RoundTripper, url string, body any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,304 @@
+// Package cron provides a hook publishing configured messages on cron schedules, such as heartbeats,
+// config broadcasts and test signals, so devices can be poked without an external cron client. The
+// schedules can be reloaded while the broker runs.
+package cron
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// ClientID is the id of the inline client which publishes the scheduled messages
+const ClientID = "cron"
+
+// idle is the longest the hook waits before checking the schedules again, so changes of the clock
+// are noticed
+const idle = time.Minute
+
+// Schedule is a message published on a schedule
+type Schedule struct {
+	// Name identifies the schedule in logs, and defaults to its topic
+	Name string
+
+	// Cron is when the message is published, as a cron expression of minute, hour, day of month, month
+	// and day of week fields, eg. "*/5 * * * mon-fri", a predefined schedule such as @hourly or @daily,
+	// or an interval such as @every 30s
+	Cron string
+
+	// Topic is the topic the message is published to, and Payload its payload, in which {timestamp}
+	// is replaced with the time it is published in RFC3339 and {unix} in unix seconds
+	Topic   string
+	Payload string
+	Qos     byte
+	Retain  bool
+}
+
+// Stats are the totals of the scheduled messages since the hook was initialized
+type Stats struct {
+	Published int64 // the number of messages published
+	Failed    int64 // the number of messages which could not be published
+}
+
+// job is a schedule and when it is next due
+type job struct {
+	Schedule
+	schedule schedule
+	next     time.Time
+}
+
+// Hook is a hook that publishes messages on cron schedules
+type Hook struct {
+	config Options
+	server *mqtt.Server
+	client *mqtt.Client
+	jobs   []*job
+	wake   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+	now    func() time.Time
+	stats  Stats
+	mu     sync.Mutex // guards config, jobs and stats
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the cron hook
+type Options struct {
+	// Server is the server the messages are published to. Required
+	Server *mqtt.Server
+
+	// Schedules are the messages published and when
+	Schedules []Schedule
+
+	// Location is the IANA time zone the cron expressions are in, eg. Europe/Berlin, and defaults to
+	// the local time zone
+	Location string
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "cron-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	cronHookConfig, jobs, err := h.parseOptions(config)
+	if err != nil {
+		return err
+	}
+
+	h.config = cronHookConfig
+	h.server = cronHookConfig.Server
+	h.jobs = jobs
+	h.client = cronHookConfig.Server.NewClient(nil, "local", ClientID, true)
+	h.client.Properties.ProtocolVersion = 5
+	h.wake = make(chan struct{}, 1)
+	h.done = make(chan struct{})
+
+	return nil
+}
+
+// Reload applies new schedules, which are next due from the time they are reloaded. The server can't
+// be changed
+func (h *Hook) Reload(config any) error {
+	cronHookConfig, jobs, err := h.parseOptions(config)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	cronHookConfig.Server = h.server
+	h.config = cronHookConfig
+	h.jobs = jobs
+	h.mu.Unlock()
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// parseOptions returns the options with their defaults, and the jobs of their schedules
+func (h *Hook) parseOptions(config any) (Options, []*job, error) {
+	if config == nil {
+		return Options{}, nil, errors.New("nil config")
+	}
+
+	cronHookConfig, ok := config.(Options)
+	if !ok {
+		return Options{}, nil, errors.New("improper config")
+	}
+
+	if cronHookConfig.Server == nil && h.server == nil {
+		return Options{}, nil, errors.New("server is required")
+	}
+
+	location := time.Local
+	if cronHookConfig.Location != "" {
+		var err error
+		if location, err = time.LoadLocation(cronHookConfig.Location); err != nil {
+			return Options{}, nil, fmt.Errorf("invalid location %q: %w", cronHookConfig.Location, err)
+		}
+	}
+
+	now := h.now()
+	jobs := make([]*job, 0, len(cronHookConfig.Schedules))
+	for _, s := range cronHookConfig.Schedules {
+		if s.Name == "" {
+			s.Name = s.Topic
+		}
+
+		if !mqtt.IsValidFilter(s.Topic, true) {
+			return Options{}, nil, fmt.Errorf("invalid topic %q of schedule %s", s.Topic, s.Name)
+		}
+
+		if s.Qos > 2 {
+			return Options{}, nil, fmt.Errorf("invalid qos %d of schedule %s", s.Qos, s.Name)
+		}
+
+		sched, err := parse(s.Cron, location)
+		if err != nil {
+			return Options{}, nil, fmt.Errorf("invalid cron expression of schedule %s: %w", s.Name, err)
+		}
+
+		next := sched.next(now)
+		if next.IsZero() {
+			return Options{}, nil, fmt.Errorf("invalid cron expression of schedule %s: %w", s.Name, errNever)
+		}
+
+		jobs = append(jobs, &job{Schedule: s, schedule: sched, next: next})
+	}
+
+	return cronHookConfig, jobs, nil
+}
+
+// OnStarted is called when the server has started, and starts publishing the scheduled messages
+func (h *Hook) OnStarted() {
+	h.wg.Add(1)
+	go h.run()
+}
+
+// Stop stops publishing the scheduled messages
+func (h *Hook) Stop() error {
+	if h.done == nil {
+		return nil
+	}
+
+	select {
+	case <-h.done:
+	default:
+		close(h.done)
+	}
+
+	h.wg.Wait()
+	return nil
+}
+
+// Stats returns the totals of the scheduled messages so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// Next returns when each schedule is next due, by name
+func (h *Hook) Next() map[string]time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	next := make(map[string]time.Time, len(h.jobs))
+	for _, j := range h.jobs {
+		next[j.Name] = j.next
+	}
+	return next
+}
+
+// run publishes the scheduled messages when they are due until the hook is stopped
+func (h *Hook) run() {
+	defer h.wg.Done()
+
+	for {
+		wait := h.fire()
+		select {
+		case <-h.done:
+			return
+		case <-h.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// fire publishes the messages which are due, and returns how long until the next one is. A schedule
+// which was missed several times, eg. while the machine was suspended, is only published once
+func (h *Hook) fire() time.Duration {
+	now := h.now()
+
+	h.mu.Lock()
+	var due []Schedule
+	wait := idle
+	for _, j := range h.jobs {
+		if !j.next.After(now) {
+			due = append(due, j.Schedule)
+			j.next = j.schedule.next(now)
+		}
+
+		if !j.next.IsZero() && j.next.Sub(now) < wait {
+			wait = j.next.Sub(now)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, s := range due {
+		h.publish(s, now)
+	}
+	return wait
+}
+
+// publish publishes the message of the schedule
+func (h *Hook) publish(s Schedule, now time.Time) {
+	payload := strings.NewReplacer(
+		"{timestamp}", now.UTC().Format(time.RFC3339),
+		"{unix}", strconv.FormatInt(now.Unix(), 10),
+	).Replace(s.Payload)
+
+	err := h.server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    s.Qos,
+			Retain: s.Retain,
+		},
+		TopicName: s.Topic,
+		Payload:   []byte(payload),
+		PacketID:  uint16(s.Qos),
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.Log.Error("error occurred while publishing scheduled message", "error", err, "schedule", s.Name, "topic", s.Topic)
+		h.stats.Failed++
+		return
+	}
+
+	h.Log.Debug("published scheduled message", "schedule", s.Name, "topic", s.Topic)
+	h.stats.Published++
+}
@@ -0,0 +1,301 @@
+package cron
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// now is a saturday
+var now = time.Date(2024, 1, 6, 10, 7, 5, 0, time.UTC)
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	cronHook := new(Hook)
+	cronHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	cronHook.now = func() time.Time { return now }
+	require.NoError(t, cronHook.Init(options))
+	t.Cleanup(func() { _ = cronHook.Stop() })
+	return cronHook
+}
+
+// subscribe returns the messages published to the filter
+func subscribe(t *testing.T, server *mqtt.Server, filter string) chan packets.Packet {
+	t.Helper()
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return received
+}
+
+func TestID(t *testing.T) {
+	cronHook := new(Hook)
+
+	require.Equal(t, "cron-hook", cronHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	cronHook := new(Hook)
+
+	require.True(t, cronHook.Provides(mqtt.OnStarted))
+	require.False(t, cronHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	server := newServer(t)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name: "Success",
+			config: Options{Server: server, Location: "UTC", Schedules: []Schedule{
+				{Cron: "*/5 * * * *", Topic: "devices/heartbeat", Payload: "{unix}"},
+				{Name: "config", Cron: "@daily", Topic: "devices/config", Qos: 1, Retain: true},
+			}},
+		},
+		{
+			name:   "Success - no schedules",
+			config: Options{Server: server},
+		},
+		{
+			name:        "Error - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Error - improper config",
+			config:      "not valid",
+			expectError: true,
+		},
+		{
+			name:        "Error - no server",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid topic",
+			config:      Options{Server: server, Schedules: []Schedule{{Cron: "@hourly", Topic: "devices/+"}}},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid qos",
+			config:      Options{Server: server, Schedules: []Schedule{{Cron: "@hourly", Topic: "a", Qos: 3}}},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid cron",
+			config:      Options{Server: server, Schedules: []Schedule{{Cron: "every hour", Topic: "a"}}},
+			expectError: true,
+		},
+		{
+			name:        "Error - cron never matches",
+			config:      Options{Server: server, Schedules: []Schedule{{Cron: "0 0 30 2 *", Topic: "a"}}},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid location",
+			config:      Options{Server: server, Location: "Mars/Olympus_Mons"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cronHook := new(Hook)
+			err := cronHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			for name, next := range cronHook.Next() {
+				require.NotEmpty(t, name)
+				require.True(t, next.After(time.Now()))
+			}
+			require.NoError(t, cronHook.Stop())
+			require.NoError(t, cronHook.Stop())
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr   string
+		expect []time.Time
+	}{
+		{
+			expr:   "*/15 * * * *",
+			expect: []time.Time{time.Date(2024, 1, 6, 10, 15, 0, 0, time.UTC), time.Date(2024, 1, 6, 10, 30, 0, 0, time.UTC)},
+		},
+		{
+			expr:   "0 9 * * mon-fri",
+			expect: []time.Time{time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC), time.Date(2024, 1, 9, 9, 0, 0, 0, time.UTC)},
+		},
+		{
+			expr:   "30 2 1 * *",
+			expect: []time.Time{time.Date(2024, 2, 1, 2, 30, 0, 0, time.UTC), time.Date(2024, 3, 1, 2, 30, 0, 0, time.UTC)},
+		},
+		{
+			expr:   "0 0 1,15 * 1",
+			expect: []time.Time{time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 22, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			expr:   "0 12 * JAN,jul 7",
+			expect: []time.Time{time.Date(2024, 1, 7, 12, 0, 0, 0, time.UTC), time.Date(2024, 1, 14, 12, 0, 0, 0, time.UTC)},
+		},
+		{
+			expr:   "5/20 8-10 * * *",
+			expect: []time.Time{time.Date(2024, 1, 6, 10, 25, 0, 0, time.UTC), time.Date(2024, 1, 6, 10, 45, 0, 0, time.UTC), time.Date(2024, 1, 7, 8, 5, 0, 0, time.UTC)},
+		},
+		{
+			expr:   "@hourly",
+			expect: []time.Time{time.Date(2024, 1, 6, 11, 0, 0, 0, time.UTC), time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC)},
+		},
+		{
+			expr:   "@yearly",
+			expect: []time.Time{time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			expr:   "@every 30s",
+			expect: []time.Time{time.Date(2024, 1, 6, 10, 7, 35, 0, time.UTC), time.Date(2024, 1, 6, 10, 8, 5, 0, time.UTC)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parse(tt.expr, time.UTC)
+			require.NoError(t, err)
+
+			next := now
+			for _, expect := range tt.expect {
+				next = s.next(next)
+				require.Equal(t, expect, next.UTC())
+			}
+		})
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	s, err := parse("0 9 * * *", time.FixedZone("UTC+2", 2*60*60))
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 1, 7, 7, 0, 0, 0, time.UTC), s.next(now).UTC())
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"@every 100ms",
+		"@every soon",
+	} {
+		_, err := parse(expr, time.UTC)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestFire(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "devices/#")
+	cronHook := newHook(t, Options{Server: server, Location: "UTC", Schedules: []Schedule{
+		{Name: "heartbeat", Cron: "@every 10s", Topic: "devices/heartbeat", Payload: `{"ts":"{timestamp}","unix":{unix}}`, Qos: 1},
+		{Name: "config", Cron: "@hourly", Topic: "devices/config", Payload: "reload", Retain: true},
+	}})
+
+	require.Equal(t, 10*time.Second, cronHook.fire())
+	require.Len(t, received, 0)
+
+	now := now.Add(10 * time.Second)
+	cronHook.now = func() time.Time { return now }
+	require.Equal(t, 10*time.Second, cronHook.fire())
+
+	require.Len(t, received, 1)
+	pk := <-received
+	require.Equal(t, "devices/heartbeat", pk.TopicName)
+	require.Equal(t, `{"ts":"2024-01-06T10:07:15Z","unix":1704535635}`, string(pk.Payload))
+	require.Equal(t, ClientID, pk.Origin)
+	require.Equal(t, Stats{Published: 1}, cronHook.Stats())
+
+	// missed schedules are only published once
+	now = time.Date(2024, 1, 6, 12, 30, 0, 0, time.UTC)
+	require.Equal(t, 10*time.Second, cronHook.fire())
+	require.Len(t, received, 2)
+	require.Equal(t, "devices/heartbeat", (<-received).TopicName)
+	require.Equal(t, "devices/config", (<-received).TopicName)
+
+	retained, ok := server.Topics.Retained.Get("devices/config")
+	require.True(t, ok)
+	require.Equal(t, []byte("reload"), retained.Payload)
+	require.Equal(t, map[string]time.Time{
+		"heartbeat": time.Date(2024, 1, 6, 12, 30, 10, 0, time.UTC),
+		"config":    time.Date(2024, 1, 6, 13, 0, 0, 0, time.UTC),
+	}, cronHook.Next())
+}
+
+func TestReload(t *testing.T) {
+	server := newServer(t)
+	cronHook := newHook(t, Options{Server: server, Location: "UTC", Schedules: []Schedule{
+		{Name: "heartbeat", Cron: "@every 10s", Topic: "devices/heartbeat"},
+	}})
+
+	require.Error(t, cronHook.Reload(Options{Schedules: []Schedule{{Cron: "@often", Topic: "a"}}}))
+	require.Len(t, cronHook.Next(), 1)
+
+	require.NoError(t, cronHook.Reload(Options{Location: "UTC", Schedules: []Schedule{
+		{Name: "weekday", Cron: "0 9 * * mon-fri", Topic: "devices/wake"},
+		{Cron: "@daily", Topic: "devices/config"},
+	}}))
+	require.Equal(t, map[string]time.Time{
+		"weekday":        time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC),
+		"devices/config": time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC),
+	}, cronHook.Next())
+	require.Same(t, server, cronHook.config.Server)
+	require.Len(t, cronHook.wake, 1)
+
+	require.Equal(t, idle, cronHook.fire())
+}
+
+func TestRun(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "devices/#")
+	cronHook := newHook(t, Options{Server: server, Schedules: []Schedule{
+		{Cron: "@every 1s", Topic: "devices/heartbeat"},
+	}})
+
+	cronHook.now = func() time.Time { return now.Add(time.Second) }
+	cronHook.OnStarted()
+
+	select {
+	case pk := <-received:
+		require.Equal(t, "devices/heartbeat", pk.TopicName)
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled message wasn't published")
+	}
+}
@@ -0,0 +1,212 @@
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule returns the next time a message is published after the given time
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+// every is a schedule publishing at a fixed interval, eg. @every 30s
+type every time.Duration
+
+// next implements schedule
+func (e every) next(t time.Time) time.Time {
+	return t.Add(time.Duration(e)).Truncate(time.Second)
+}
+
+// spec is a schedule of a cron expression, with the minutes, hours, days of the month, months and days
+// of the week it matches as bits
+type spec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool // whether the days of the month or the week are *
+	location                      *time.Location
+}
+
+// descriptors are the expressions the predefined schedules stand for
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// the names which may be used for months and days of the week
+var (
+	months = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	days   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parse parses a cron expression of minute, hour, day of month, month and day of week fields, eg.
+// "*/5 * * * mon-fri", a predefined schedule such as @hourly, or an interval such as @every 30s. The
+// fields are matched in the location
+func parse(expr string, location *time.Location) (schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if d, ok := strings.CutPrefix(expr, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval %q", d)
+		}
+
+		if interval < time.Second {
+			return nil, fmt.Errorf("interval %s is shorter than a second", interval)
+		}
+		return every(interval), nil
+	}
+
+	if e, ok := descriptors[expr]; ok {
+		expr = e
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in %q", expr)
+	}
+
+	s := &spec{
+		domAny:   fields[2] == "*" || fields[2] == "?",
+		dowAny:   fields[4] == "*" || fields[4] == "?",
+		location: location,
+	}
+
+	var err error
+	for _, f := range []struct {
+		bits     *uint64
+		field    string
+		min, max int
+		names    []string
+	}{
+		{&s.minute, fields[0], 0, 59, nil},
+		{&s.hour, fields[1], 0, 23, nil},
+		{&s.dom, fields[2], 1, 31, nil},
+		{&s.month, fields[3], 1, 12, months},
+		{&s.dow, fields[4], 0, 7, days},
+	} {
+		if *f.bits, err = parseField(f.field, f.min, f.max, f.names); err != nil {
+			return nil, err
+		}
+	}
+
+	// 7 is also sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	return s, nil
+}
+
+// parseField returns the bits of the values of a field, which is a comma separated list of *, values
+// and ranges, optionally with a step, eg. 1-10/2
+func parseField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		r, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		var start, end int
+		switch {
+		case r == "*" || r == "?":
+			start, end = min, max
+		case strings.Contains(r, "-"):
+			lo, hi, _ := strings.Cut(r, "-")
+			var err error
+			if start, err = parseValue(lo, min, max, names); err != nil {
+				return 0, err
+			}
+			if end, err = parseValue(hi, min, max, names); err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range %q", r)
+			}
+		default:
+			var err error
+			if start, err = parseValue(r, min, max, names); err != nil {
+				return 0, err
+			}
+			end = start
+			if hasStep {
+				end = max
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// parseValue returns the value of a number or name within the bounds
+func parseValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if name != "" && strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+
+	if v < min || v > max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, min, max)
+	}
+	return v, nil
+}
+
+// errNever is returned for schedules which never match, eg. the 30th of February
+var errNever = errors.New("schedule never matches")
+
+// next implements schedule, returning the zero time if the schedule doesn't match within five years
+func (s *spec) next(t time.Time) time.Time {
+	t = t.In(s.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		loc := t.Location()
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// matchDay returns whether the day matches. When both the day of the month and of the week are
+// restricted, either matching is enough, as in cron
+func (s *spec) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
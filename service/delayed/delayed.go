@@ -0,0 +1,487 @@
+// Package delayed provides a hook for EMQX-style delayed publishing. Messages published to
+// $delayed/{seconds}/{topic} are acknowledged and held, and published to the topic once the interval
+// has passed, eg. a message published to $delayed/60/alarms/wake is published to alarms/wake a
+// minute later.
+//
+// Pending messages are persisted as retained messages under $delayed/pending/ through the storage hook
+// in use, so they survive restarts, and those which became due while the broker was down are
+// published once it starts again.
+package delayed
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// Prefix is the prefix of the topics messages are delayed by publishing to
+const Prefix = "$delayed/"
+
+// ClientID is the id of the inline client which persists the pending messages
+const ClientID = "delayed"
+
+// storePrefix is the prefix of the topics of the records of pending messages, which clients can't
+// publish to as pending isn't a number of seconds
+const storePrefix = Prefix + "pending/"
+
+// idle is how long the hook waits for new messages when none are pending
+const idle = time.Minute
+
+// Stats are the totals of the delayed messages since the hook was initialized
+type Stats struct {
+	Pending   int64 // the number of messages held
+	Bytes     int64 // the size of the payloads of the messages held
+	Delayed   int64 // the number of messages accepted to be delayed
+	Published int64 // the number of delayed messages published
+	Expired   int64 // the number of delayed messages whose message expiry interval passed while held
+	Rejected  int64 // the number of messages rejected as invalid, unauthorized or over the limits
+	Failed    int64 // the number of delayed messages which could not be published
+}
+
+// message is a pending message
+type message struct {
+	id     string    // the topic of the record of the message
+	due    time.Time // when the message is published
+	client string    // the id of the client which published the message
+	pk     packets.Packet
+}
+
+// queue is a min-heap of the pending messages by when they are due
+type queue []*message
+
+func (q queue) Len() int           { return len(q) }
+func (q queue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q queue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *queue) Push(x any)        { *q = append(*q, x.(*message)) }
+func (q *queue) Pop() any {
+	old := *q
+	msg := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return msg
+}
+
+// Hook is a hook that holds messages published to $delayed topics and publishes them when they are due
+type Hook struct {
+	config  Options
+	client  *mqtt.Client
+	pending map[string]*message // the pending messages by the topics of their records
+	queue   queue               // the pending messages which have been persisted
+	clients map[string]int      // the number of pending messages of each client
+	bytes   int64               // the size of the payloads of the pending messages
+	seq     uint64              // distinguishes messages due at the same time
+	wake    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+	now     func() time.Time
+	stats   Stats
+	mu      sync.Mutex // guards pending, queue, clients, bytes, seq and stats
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the delayed hook
+type Options struct {
+	// Server is the server the delayed messages are published to. Required
+	Server *mqtt.Server
+
+	// Storage is the storage hook the pending messages are persisted through, which must also be added
+	// to the server. Pending messages are only held in memory, and lost when the broker stops, if nil
+	Storage mqtt.Hook
+
+	// Auth is the auth hook clients are checked against to delay messages to a topic, as the server only
+	// checks they may publish to the $delayed topic. Clients which may publish to $delayed topics may
+	// delay messages to any topic if nil
+	Auth mqtt.Hook
+
+	// MaxDelay is the longest messages may be delayed, and defaults to 24 hours
+	MaxDelay time.Duration
+
+	// MaxPending is the most messages held, and defaults to 10000. MaxBytes is the most bytes of
+	// payload held, and defaults to 64MB. ClientLimit is the most messages held for each client, and
+	// is unlimited if 0. Messages over the limits are rejected, with quota exceeded for MQTT 5 clients
+	MaxPending  int
+	MaxBytes    int64
+	ClientLimit int
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "delayed-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnPublish,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	delayedHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if delayedHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if delayedHookConfig.Storage != nil && !delayedHookConfig.Storage.Provides(mqtt.StoredRetainedMessages) {
+		return fmt.Errorf("storage hook %s doesn't store retained messages", delayedHookConfig.Storage.ID())
+	}
+
+	if delayedHookConfig.MaxDelay <= 0 {
+		delayedHookConfig.MaxDelay = 24 * time.Hour
+	}
+
+	if delayedHookConfig.MaxPending <= 0 {
+		delayedHookConfig.MaxPending = 10000
+	}
+
+	if delayedHookConfig.MaxBytes <= 0 {
+		delayedHookConfig.MaxBytes = 64 << 20
+	}
+
+	if delayedHookConfig.ClientLimit < 0 {
+		return errors.New("client limit can't be negative")
+	}
+
+	h.config = delayedHookConfig
+	h.client = delayedHookConfig.Server.NewClient(nil, "local", ClientID, true)
+	h.pending = make(map[string]*message)
+	h.clients = make(map[string]int)
+	h.wake = make(chan struct{}, 1)
+	h.done = make(chan struct{})
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	return nil
+}
+
+// OnStarted is called when the server has started, once storage hooks have restored their records,
+// and restores the pending messages and starts publishing them when they are due
+func (h *Hook) OnStarted() {
+	if err := h.restore(); err != nil {
+		h.Log.Error("error occurred while restoring delayed messages", "error", err)
+	}
+
+	h.wg.Add(1)
+	go h.run()
+}
+
+// Stop stops publishing the pending messages, which are published when the broker starts again if
+// they are persisted
+func (h *Hook) Stop() error {
+	if h.done == nil {
+		return nil
+	}
+
+	select {
+	case <-h.done:
+	default:
+		close(h.done)
+	}
+
+	h.wg.Wait()
+	return nil
+}
+
+// Stats returns the totals of the delayed messages so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := h.stats
+	stats.Pending = int64(len(h.pending))
+	stats.Bytes = h.bytes
+	return stats
+}
+
+// OnPublish is called when a client publishes a message, and holds messages published to $delayed
+// topics, which are acknowledged but not published to their subscribers
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if !strings.HasPrefix(pk.TopicName, Prefix) {
+		return pk, nil
+	}
+
+	delay, topic, err := h.parse(pk.TopicName)
+	if err != nil {
+		h.Log.Warn("rejected delayed message", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		return pk, h.reject(cl, pk, packets.ErrTopicNameInvalid)
+	}
+
+	if h.config.Auth != nil && !cl.Net.Inline && !h.config.Auth.OnACLCheck(cl, topic, true) {
+		h.Log.Warn("rejected delayed message", "error", "not authorized", "client", cl.ID, "topic", pk.TopicName)
+		return pk, h.reject(cl, pk, packets.ErrNotAuthorized)
+	}
+
+	msg := &message{
+		due:    h.now().Add(delay),
+		client: cl.ID,
+		pk:     pk.Copy(false),
+	}
+	msg.pk.TopicName = topic
+
+	h.mu.Lock()
+	if len(h.pending) >= h.config.MaxPending ||
+		h.bytes+int64(len(pk.Payload)) > h.config.MaxBytes ||
+		(h.config.ClientLimit > 0 && h.clients[cl.ID] >= h.config.ClientLimit) {
+		h.mu.Unlock()
+		h.Log.Warn("rejected delayed message", "error", "too many pending messages", "client", cl.ID, "topic", pk.TopicName)
+		return pk, h.reject(cl, pk, packets.ErrQuotaExceeded)
+	}
+
+	h.seq++
+	msg.id = storePrefix + strconv.FormatInt(msg.due.UnixNano(), 10) + "-" + strconv.FormatUint(h.seq, 10) + "/" + topic
+	h.add(msg)
+	h.stats.Delayed++
+	h.mu.Unlock()
+
+	// the message is persisted before it is queued, so its record isn't deleted before it is written
+	if h.config.Storage != nil {
+		h.config.Storage.OnRetainMessage(h.client, record(msg), 1)
+	}
+
+	h.mu.Lock()
+	heap.Push(&h.queue, msg)
+	h.mu.Unlock()
+	h.signal()
+
+	return pk, packets.CodeSuccessIgnore
+}
+
+// parse returns the delay and the topic of a $delayed topic
+func (h *Hook) parse(topic string) (time.Duration, string, error) {
+	seconds, target, ok := strings.Cut(strings.TrimPrefix(topic, Prefix), "/")
+	if !ok || target == "" {
+		return 0, "", errors.New("missing topic")
+	}
+
+	n, err := strconv.ParseUint(seconds, 10, 32)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid delay %q", seconds)
+	}
+
+	delay := time.Duration(n) * time.Second
+	if delay > h.config.MaxDelay {
+		return 0, "", fmt.Errorf("delay of %s exceeds the maximum of %s", delay, h.config.MaxDelay)
+	}
+
+	if strings.HasPrefix(target, "$") {
+		return 0, "", fmt.Errorf("messages to %s can't be delayed", target)
+	}
+
+	return delay, target, nil
+}
+
+// reject counts a rejected message, and returns the error which rejects it, as the server would
+// otherwise publish it
+func (h *Hook) reject(cl *mqtt.Client, pk packets.Packet, code packets.Code) error {
+	h.mu.Lock()
+	h.stats.Rejected++
+	h.mu.Unlock()
+
+	return reject.Publish(cl, pk, code)
+}
+
+// add adds the message to the pending messages
+func (h *Hook) add(msg *message) {
+	h.pending[msg.id] = msg
+	h.clients[msg.client]++
+	h.bytes += int64(len(msg.pk.Payload))
+}
+
+// remove removes the message from the pending messages
+func (h *Hook) remove(msg *message) {
+	delete(h.pending, msg.id)
+	if h.clients[msg.client]--; h.clients[msg.client] <= 0 {
+		delete(h.clients, msg.client)
+	}
+	h.bytes -= int64(len(msg.pk.Payload))
+}
+
+// signal wakes the goroutine publishing the messages, so it waits for the next one due
+func (h *Hook) signal() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// restore queues the pending messages persisted by the storage hook. The server restores their records
+// as retained messages, which are deleted so they aren't sent to subscribers of $delayed topics
+func (h *Hook) restore() error {
+	if h.config.Storage == nil {
+		return nil
+	}
+
+	msgs, err := h.config.Storage.StoredRetainedMessages()
+	if err != nil {
+		return fmt.Errorf("failed reading delayed messages: %w", err)
+	}
+
+	for _, m := range msgs {
+		if !strings.HasPrefix(m.TopicName, storePrefix) {
+			continue
+		}
+
+		h.config.Server.Topics.Retained.Delete(m.TopicName)
+
+		msg, err := parseRecord(m.ToPacket())
+		if err != nil {
+			h.Log.Warn("deleted invalid delayed message", "error", err, "topic", m.TopicName)
+			h.config.Storage.OnRetainedExpired(m.TopicName)
+			continue
+		}
+
+		h.mu.Lock()
+		if _, ok := h.pending[msg.id]; !ok {
+			h.add(msg)
+			heap.Push(&h.queue, msg)
+		}
+		h.mu.Unlock()
+	}
+
+	return nil
+}
+
+// run publishes the pending messages when they are due until the hook is stopped
+func (h *Hook) run() {
+	defer h.wg.Done()
+
+	for {
+		wait := h.deliver()
+		select {
+		case <-h.done:
+			return
+		case <-h.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deliver publishes the messages which are due, and returns how long until the next one is
+func (h *Hook) deliver() time.Duration {
+	for {
+		h.mu.Lock()
+		if len(h.queue) == 0 {
+			h.mu.Unlock()
+			return idle
+		}
+
+		now := h.now()
+		if wait := h.queue[0].due.Sub(now); wait > 0 {
+			h.mu.Unlock()
+			return wait
+		}
+
+		msg := heap.Pop(&h.queue).(*message)
+		h.remove(msg)
+		h.mu.Unlock()
+
+		h.publish(msg, now)
+	}
+}
+
+// publish publishes the message to its topic as the client which published it, so subscriptions with
+// no local don't receive their own messages, and deletes its record
+func (h *Hook) publish(msg *message, now time.Time) {
+	if h.config.Storage != nil {
+		h.config.Storage.OnRetainedExpired(msg.id)
+	}
+
+	pk := msg.pk
+	if expiry := int64(pk.Properties.MessageExpiryInterval); expiry > 0 {
+		remaining := pk.Created + expiry - now.Unix()
+		if remaining <= 0 {
+			h.mu.Lock()
+			h.stats.Expired++
+			h.mu.Unlock()
+			return
+		}
+		pk.Properties.MessageExpiryInterval = uint32(remaining)
+	}
+
+	id := msg.client
+	if id == "" {
+		id = ClientID
+	}
+	cl := h.config.Server.NewClient(nil, "local", id, true)
+	cl.Properties.ProtocolVersion = 5
+
+	err := h.config.Server.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    pk.FixedHeader.Qos,
+			Retain: pk.FixedHeader.Retain,
+		},
+		TopicName: pk.TopicName,
+		Payload:   pk.Payload,
+		PacketID:  uint16(pk.FixedHeader.Qos),
+		Properties: packets.Properties{
+			PayloadFormat:         pk.Properties.PayloadFormat,
+			PayloadFormatFlag:     pk.Properties.PayloadFormatFlag || pk.Properties.PayloadFormat != 0,
+			MessageExpiryInterval: pk.Properties.MessageExpiryInterval,
+			ContentType:           pk.Properties.ContentType,
+			ResponseTopic:         pk.Properties.ResponseTopic,
+			CorrelationData:       pk.Properties.CorrelationData,
+			User:                  pk.Properties.User,
+		},
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.Log.Error("error occurred while publishing delayed message", "error", err, "topic", pk.TopicName, "client", msg.client)
+		h.stats.Failed++
+		return
+	}
+	h.stats.Published++
+}
+
+// record returns the packet of the record of the message
+func record(msg *message) packets.Packet {
+	pk := msg.pk.Copy(false)
+	pk.TopicName = msg.id
+	return pk
+}
+
+// parseRecord returns the pending message of the packet of its record
+func parseRecord(pk packets.Packet) (*message, error) {
+	key, topic, ok := strings.Cut(strings.TrimPrefix(pk.TopicName, storePrefix), "/")
+	if !ok || topic == "" {
+		return nil, errors.New("missing topic")
+	}
+
+	nanos, _, _ := strings.Cut(key, "-")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid due time %q", nanos)
+	}
+
+	msg := &message{
+		id:     pk.TopicName,
+		due:    time.Unix(0, n),
+		client: pk.Origin,
+		pk:     pk,
+	}
+	msg.pk.TopicName = topic
+	return msg, nil
+}
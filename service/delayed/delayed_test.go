@@ -0,0 +1,465 @@
+package delayed
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/records"
+)
+
+var now = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// fakeStorage is a storage hook holding its retained messages in a map
+type fakeStorage struct {
+	retained map[string]storage.Message
+	mu       sync.Mutex
+	mqtt.HookBase
+}
+
+func newStorage() *fakeStorage {
+	return &fakeStorage{
+		retained: make(map[string]storage.Message),
+	}
+}
+
+func (s *fakeStorage) ID() string {
+	return "fake-storage"
+}
+
+func (s *fakeStorage) Provides(b byte) bool {
+	return b == mqtt.StoredRetainedMessages || b == mqtt.OnRetainMessage || b == mqtt.OnRetainedExpired
+}
+
+func (s *fakeStorage) StoredRetainedMessages() ([]storage.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []storage.Message
+	for _, msg := range s.retained {
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (s *fakeStorage) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r == -1 {
+		delete(s.retained, pk.TopicName)
+		return
+	}
+	s.retained[pk.TopicName] = *records.Retained(pk)
+}
+
+func (s *fakeStorage) OnRetainedExpired(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.retained, topic)
+}
+
+// topics returns the topics of the stored retained messages
+func (s *fakeStorage) topics() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var topics []string
+	for topic := range s.retained {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// denyHook is an auth hook which denies publishing to secret/#
+type denyHook struct {
+	mqtt.HookBase
+}
+
+func (h *denyHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return !strings.HasPrefix(topic, "secret/")
+}
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	delayedHook := new(Hook)
+	delayedHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	delayedHook.now = func() time.Time { return now }
+	require.NoError(t, delayedHook.Init(options))
+	t.Cleanup(func() { _ = delayedHook.Stop() })
+	return delayedHook
+}
+
+func newClient(server *mqtt.Server, id string, version byte) *mqtt.Client {
+	cl := server.NewClient(nil, "t1", id, false)
+	cl.Properties.ProtocolVersion = version
+	return cl
+}
+
+// subscribe returns the messages published to the filter
+func subscribe(t *testing.T, server *mqtt.Server, filter string) chan packets.Packet {
+	t.Helper()
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return received
+}
+
+func publish(cl *mqtt.Client, topic string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     []byte("hello"),
+		Origin:      cl.ID,
+		Created:     now.Unix(),
+		Properties: packets.Properties{
+			ResponseTopic: "replies/1",
+			User:          []packets.UserProperty{{Key: "trace", Val: "abc"}},
+		},
+	}
+}
+
+func TestID(t *testing.T) {
+	delayedHook := new(Hook)
+
+	require.Equal(t, "delayed-hook", delayedHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	delayedHook := new(Hook)
+
+	require.True(t, delayedHook.Provides(mqtt.OnStarted))
+	require.True(t, delayedHook.Provides(mqtt.OnPublish))
+	require.False(t, delayedHook.Provides(mqtt.OnPublished))
+}
+
+func TestInit(t *testing.T) {
+	server := newServer(t)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:   "Success - defaults",
+			config: Options{Server: server},
+		},
+		{
+			name:   "Success - storage",
+			config: Options{Server: server, Storage: newStorage(), Auth: new(denyHook), ClientLimit: 10},
+		},
+		{
+			name:        "Error - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Error - improper config",
+			config:      "not valid",
+			expectError: true,
+		},
+		{
+			name:        "Error - no server",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Error - storage without retained messages",
+			config:      Options{Server: server, Storage: new(auth.AllowHook)},
+			expectError: true,
+		},
+		{
+			name:        "Error - negative client limit",
+			config:      Options{Server: server, ClientLimit: -1},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delayedHook := new(Hook)
+			err := delayedHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, 24*time.Hour, delayedHook.config.MaxDelay)
+			require.Equal(t, 10000, delayedHook.config.MaxPending)
+			require.Equal(t, int64(64<<20), delayedHook.config.MaxBytes)
+			require.NoError(t, delayedHook.Stop())
+			require.NoError(t, delayedHook.Stop())
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "a/#")
+	store := newStorage()
+	delayedHook := newHook(t, Options{Server: server, Storage: store})
+	cl := newClient(server, "c1", 5)
+
+	pk, err := delayedHook.OnPublish(cl, publish(cl, "a/c"))
+	require.NoError(t, err)
+	require.Equal(t, "a/c", pk.TopicName)
+
+	_, err = delayedHook.OnPublish(cl, publish(cl, "$delayed/10/a/b"))
+	require.ErrorIs(t, err, packets.CodeSuccessIgnore)
+
+	topics := store.topics()
+	require.Len(t, topics, 1)
+	require.True(t, strings.HasPrefix(topics[0], "$delayed/pending/"))
+	require.True(t, strings.HasSuffix(topics[0], "/a/b"))
+	require.Equal(t, Stats{Pending: 1, Bytes: 5, Delayed: 1}, delayedHook.Stats())
+
+	require.Equal(t, 10*time.Second, delayedHook.deliver())
+	require.Len(t, received, 0)
+
+	delayedHook.now = func() time.Time { return now.Add(10 * time.Second) }
+	require.Equal(t, idle, delayedHook.deliver())
+
+	require.Len(t, received, 1)
+	pk = <-received
+	require.Equal(t, "a/b", pk.TopicName)
+	require.Equal(t, []byte("hello"), pk.Payload)
+	require.Equal(t, "c1", pk.Origin)
+	require.Equal(t, "replies/1", pk.Properties.ResponseTopic)
+	require.Equal(t, []packets.UserProperty{{Key: "trace", Val: "abc"}}, pk.Properties.User)
+	require.Empty(t, store.topics())
+	require.Equal(t, Stats{Delayed: 1, Published: 1}, delayedHook.Stats())
+}
+
+func TestOrder(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "#")
+	delayedHook := newHook(t, Options{Server: server})
+	cl := newClient(server, "c1", 5)
+
+	for _, topic := range []string{"$delayed/30/c", "$delayed/10/a", "$delayed/20/b"} {
+		_, err := delayedHook.OnPublish(cl, publish(cl, topic))
+		require.ErrorIs(t, err, packets.CodeSuccessIgnore)
+	}
+
+	delayedHook.now = func() time.Time { return now.Add(25 * time.Second) }
+	require.Equal(t, 5*time.Second, delayedHook.deliver())
+
+	require.Len(t, received, 2)
+	require.Equal(t, "a", (<-received).TopicName)
+	require.Equal(t, "b", (<-received).TopicName)
+	require.Equal(t, int64(1), delayedHook.Stats().Pending)
+}
+
+func TestReject(t *testing.T) {
+	server := newServer(t)
+
+	tests := []struct {
+		name    string
+		options Options
+		topic   string
+		version byte
+		expect  error
+	}{
+		{
+			name:    "invalid delay",
+			topic:   "$delayed/soon/a/b",
+			version: 5,
+			expect:  packets.ErrTopicNameInvalid,
+		},
+		{
+			name:    "missing topic",
+			topic:   "$delayed/10",
+			version: 5,
+			expect:  packets.ErrTopicNameInvalid,
+		},
+		{
+			name:    "$ topic",
+			topic:   "$delayed/10/$SYS/broker/uptime",
+			version: 5,
+			expect:  packets.ErrTopicNameInvalid,
+		},
+		{
+			name:    "pending record",
+			topic:   "$delayed/pending/1-1/a/b",
+			version: 5,
+			expect:  packets.ErrTopicNameInvalid,
+		},
+		{
+			name:    "delay too long",
+			options: Options{MaxDelay: time.Minute},
+			topic:   "$delayed/61/a/b",
+			version: 5,
+			expect:  packets.ErrTopicNameInvalid,
+		},
+		{
+			name:    "not authorized",
+			options: Options{Auth: new(denyHook)},
+			topic:   "$delayed/10/secret/b",
+			version: 5,
+			expect:  packets.ErrNotAuthorized,
+		},
+		{
+			name:    "max pending",
+			options: Options{MaxPending: 1},
+			topic:   "$delayed/10/a/b",
+			version: 5,
+			expect:  packets.ErrQuotaExceeded,
+		},
+		{
+			name:    "max bytes",
+			options: Options{MaxBytes: 8},
+			topic:   "$delayed/10/a/b",
+			version: 5,
+			expect:  packets.ErrQuotaExceeded,
+		},
+		{
+			name:    "client limit",
+			options: Options{ClientLimit: 1},
+			topic:   "$delayed/10/a/b",
+			version: 5,
+			expect:  packets.ErrQuotaExceeded,
+		},
+		{
+			name:    "mqtt v3",
+			options: Options{MaxPending: 1},
+			topic:   "$delayed/10/a/b",
+			version: 4,
+			expect:  packets.ErrRejectPacket,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.options.Server = server
+			delayedHook := newHook(t, tt.options)
+
+			// a message from another client, so limits are reached
+			other := newClient(server, "c2", 5)
+			_, err := delayedHook.OnPublish(other, publish(other, "$delayed/10/x"))
+			require.ErrorIs(t, err, packets.CodeSuccessIgnore)
+
+			if tt.options.ClientLimit > 0 {
+				delayedHook.config.MaxPending = 10
+				_, err = delayedHook.OnPublish(other, publish(other, "$delayed/10/x"))
+				require.ErrorIs(t, err, packets.ErrQuotaExceeded)
+
+				cl := newClient(server, "c1", tt.version)
+				_, err = delayedHook.OnPublish(cl, publish(cl, tt.topic))
+				require.ErrorIs(t, err, packets.CodeSuccessIgnore)
+				return
+			}
+
+			cl := newClient(server, "c1", tt.version)
+			_, err = delayedHook.OnPublish(cl, publish(cl, tt.topic))
+			require.ErrorIs(t, err, tt.expect)
+			require.Equal(t, int64(1), delayedHook.Stats().Rejected)
+			require.Equal(t, int64(1), delayedHook.Stats().Pending)
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "#")
+	delayedHook := newHook(t, Options{Server: server})
+	cl := newClient(server, "c1", 5)
+
+	for topic, expiry := range map[string]uint32{"$delayed/10/a": 5, "$delayed/10/b": 25} {
+		pk := publish(cl, topic)
+		pk.Properties.MessageExpiryInterval = expiry
+		_, err := delayedHook.OnPublish(cl, pk)
+		require.ErrorIs(t, err, packets.CodeSuccessIgnore)
+	}
+
+	delayedHook.now = func() time.Time { return now.Add(10 * time.Second) }
+	delayedHook.deliver()
+
+	require.Len(t, received, 1)
+	pk := <-received
+	require.Equal(t, "b", pk.TopicName)
+	require.Equal(t, uint32(15), pk.Properties.MessageExpiryInterval)
+	require.Equal(t, Stats{Delayed: 2, Published: 1, Expired: 1}, delayedHook.Stats())
+}
+
+func TestRestore(t *testing.T) {
+	store := newStorage()
+	server := newServer(t)
+	delayedHook := newHook(t, Options{Server: server, Storage: store})
+	cl := newClient(server, "c1", 5)
+
+	pk := publish(cl, "$delayed/10/a/b")
+	pk.FixedHeader.Retain = true
+	_, err := delayedHook.OnPublish(cl, pk)
+	require.ErrorIs(t, err, packets.CodeSuccessIgnore)
+	require.NoError(t, delayedHook.Stop())
+
+	// the broker restarts after the message became due, and restores its record as a retained message
+	server = newServer(t)
+	received := subscribe(t, server, "a/#")
+	msgs, err := store.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	server.Topics.RetainMessage(msgs[0].ToPacket())
+
+	delayedHook = new(Hook)
+	delayedHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, delayedHook.Init(Options{Server: server, Storage: store}))
+	t.Cleanup(func() { _ = delayedHook.Stop() })
+	delayedHook.OnStarted()
+
+	select {
+	case pk := <-received:
+		require.Equal(t, "a/b", pk.TopicName)
+		require.Equal(t, "c1", pk.Origin)
+		require.True(t, pk.FixedHeader.Retain)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed message wasn't published")
+	}
+
+	_, ok := server.Topics.Retained.Get(msgs[0].TopicName)
+	require.False(t, ok)
+	require.Eventually(t, func() bool { return len(store.topics()) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRun(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "a/#")
+
+	delayedHook := new(Hook)
+	delayedHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, delayedHook.Init(Options{Server: server}))
+	t.Cleanup(func() { _ = delayedHook.Stop() })
+	delayedHook.OnStarted()
+
+	cl := newClient(server, "c1", 5)
+	_, err := delayedHook.OnPublish(cl, publish(cl, "$delayed/0/a/b"))
+	require.ErrorIs(t, err, packets.CodeSuccessIgnore)
+
+	select {
+	case pk := <-received:
+		require.Equal(t, "a/b", pk.TopicName)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed message wasn't published")
+	}
+}
@@ -0,0 +1,322 @@
+// Package dlq provides a hook republishing the messages the broker drops to a dead letter topic, with
+// the reason they were dropped, so message loss becomes observable and recoverable. Messages are
+// dropped when the queue of a slow client is full, when an inflight message expires, when a client
+// has no packet ids left for a message, or when a message to a must-deliver topic has no subscribers.
+//
+// Dead letters keep the payload of the message, and describe why it was dropped in user properties,
+// eg. dlq-reason: queue_full. They can be forwarded to an external system by bridging the dead letter
+// topics, eg. $dlq/#, or passing a Sink.
+package dlq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// ClientID is the id of the inline client which publishes the dead letters
+const ClientID = "dlq"
+
+// the reasons messages are dropped
+const (
+	ReasonQueueFull         = "queue_full"           // the queue of the client the message was sent to was full
+	ReasonExpired           = "expired"              // the message expired while inflight to the client
+	ReasonPacketIDExhausted = "packet_ids_exhausted" // the client had no packet ids left for the message
+	ReasonNoSubscribers     = "no_subscribers"       // the message to a must-deliver topic had no subscribers
+)
+
+// reasons are the reasons messages are dropped
+var reasons = []string{ReasonQueueFull, ReasonExpired, ReasonPacketIDExhausted, ReasonNoSubscribers}
+
+// Letter is a message which was dropped
+type Letter struct {
+	Reason         string
+	Topic          string
+	Payload        []byte
+	Qos            byte
+	Retain         bool
+	Publisher      string // the id of the client which published the message
+	Client         string // the id of the client the message was dropped for, unless it had no subscribers
+	UserProperties []packets.UserProperty
+	Timestamp      time.Time
+}
+
+// Stats are the totals of the dead letters since the hook was initialized
+type Stats struct {
+	Letters    int64 // the number of messages which were dead lettered
+	Suppressed int64 // the number of dropped messages which weren't dead lettered as the limit was reached
+	Failed     int64 // the number of dead letters which could not be published
+}
+
+// Hook is a hook that republishes dropped messages to a dead letter topic
+type Hook struct {
+	config  Options
+	client  *mqtt.Client
+	reasons map[string]bool // the reasons messages are dead lettered for
+	window  time.Time       // the second the dead letters are limited in
+	sent    int             // the dead letters in the second
+	now     func() time.Time
+	stats   Stats
+	mu      sync.Mutex // guards window and sent
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the dlq hook
+type Options struct {
+	// Server is the server the dead letters are published to. Required
+	Server *mqtt.Server
+
+	// Topic is the topic the dead letters are published to, a template in which {reason} is the
+	// reason the message was dropped and {topic} its topic. It defaults to $dlq/{reason}/{topic},
+	// unless a Sink is set, in which case dead letters are only published if it is set
+	Topic string
+
+	// Sink is called with each dead letter, eg. to store it in an external system
+	Sink func(l Letter)
+
+	// Filters are the filters of the topics of the messages which are dead lettered, and default to #,
+	// which doesn't match $ topics. Reasons are the reasons they are dead lettered for, and default to
+	// all of them
+	Filters []string
+	Reasons []string
+
+	// MustDeliver are the filters of the topics whose messages are dead lettered when they have no
+	// subscribers. Retained messages are kept by the broker, and aren't dead lettered
+	MustDeliver []string
+
+	// Limit is the most messages dead lettered a second, and defaults to 100, so a storm of dropped
+	// messages doesn't become a storm of dead letters
+	Limit int
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "dlq-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublishDropped,
+		mqtt.OnQosDropped,
+		mqtt.OnPacketIDExhausted,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	dlqHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if dlqHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if dlqHookConfig.Topic == "" && dlqHookConfig.Sink == nil {
+		dlqHookConfig.Topic = "$dlq/{reason}/{topic}"
+	}
+
+	if dlqHookConfig.Topic != "" {
+		if topic := render(dlqHookConfig.Topic, ReasonQueueFull, "a/b"); !mqtt.IsValidFilter(topic, true) {
+			return fmt.Errorf("invalid topic %q", dlqHookConfig.Topic)
+		}
+	}
+
+	if len(dlqHookConfig.Filters) == 0 {
+		dlqHookConfig.Filters = []string{"#"}
+	}
+
+	for _, filters := range [][]string{dlqHookConfig.Filters, dlqHookConfig.MustDeliver} {
+		for _, filter := range filters {
+			if !mqtt.IsValidFilter(filter, false) {
+				return fmt.Errorf("invalid topic filter %q", filter)
+			}
+		}
+	}
+
+	if len(dlqHookConfig.Reasons) == 0 {
+		dlqHookConfig.Reasons = reasons
+	}
+
+	h.reasons = make(map[string]bool, len(dlqHookConfig.Reasons))
+	for _, reason := range dlqHookConfig.Reasons {
+		known := false
+		for _, r := range reasons {
+			known = known || r == reason
+		}
+		if !known {
+			return fmt.Errorf("unknown reason %q", reason)
+		}
+		h.reasons[reason] = true
+	}
+
+	if dlqHookConfig.Limit <= 0 {
+		dlqHookConfig.Limit = 100
+	}
+
+	h.config = dlqHookConfig
+	h.client = dlqHookConfig.Server.NewClient(nil, "local", ClientID, true)
+	h.client.Properties.ProtocolVersion = 5
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	return nil
+}
+
+// Stats returns the totals of the dead letters so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// OnPublishDropped is called when a message to a client is dropped, as the client is too slow
+func (h *Hook) OnPublishDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.drop(ReasonQueueFull, cl, pk)
+}
+
+// OnQosDropped is called when an inflight message to a client is dropped, as it expired
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.drop(ReasonExpired, cl, pk)
+}
+
+// OnPacketIDExhausted is called when a client has no packet ids left for a message to it
+func (h *Hook) OnPacketIDExhausted(cl *mqtt.Client, pk packets.Packet) {
+	h.drop(ReasonPacketIDExhausted, cl, pk)
+}
+
+// OnPublished is called when a client has published a message, and drops messages to must-deliver
+// topics which had no subscribers
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if pk.FixedHeader.Retain || !match(h.config.MustDeliver, pk.TopicName) {
+		return
+	}
+
+	subs := h.config.Server.Topics.Subscribers(pk.TopicName)
+	if len(subs.Subscriptions)+len(subs.Shared)+len(subs.InlineSubscriptions) > 0 {
+		return
+	}
+
+	h.drop(ReasonNoSubscribers, nil, pk)
+}
+
+// drop dead letters the message, unless it is a dead letter itself
+func (h *Hook) drop(reason string, cl *mqtt.Client, pk packets.Packet) {
+	if pk.FixedHeader.Type != packets.Publish || pk.Origin == ClientID || !h.reasons[reason] || !match(h.config.Filters, pk.TopicName) {
+		return
+	}
+
+	h.mu.Lock()
+	now := h.now()
+	if now.Sub(h.window) >= time.Second {
+		h.window, h.sent = now, 0
+	}
+	limited := h.sent >= h.config.Limit
+	if !limited {
+		h.sent++
+	}
+	h.mu.Unlock()
+
+	if limited {
+		h.count(func(s *Stats) { s.Suppressed++ })
+		return
+	}
+
+	letter := Letter{
+		Reason:         reason,
+		Topic:          pk.TopicName,
+		Payload:        pk.Payload,
+		Qos:            pk.FixedHeader.Qos,
+		Retain:         pk.FixedHeader.Retain,
+		Publisher:      pk.Origin,
+		UserProperties: pk.Properties.User,
+		Timestamp:      now.UTC(),
+	}
+	if cl != nil {
+		letter.Client = cl.ID
+	}
+
+	if h.config.Sink != nil {
+		h.config.Sink(letter)
+	}
+
+	if h.config.Topic != "" {
+		if err := h.publish(letter, pk); err != nil {
+			h.Log.Error("error occurred while publishing dead letter", "error", err, "topic", pk.TopicName, "reason", reason)
+			h.count(func(s *Stats) { s.Failed++ })
+			return
+		}
+	}
+
+	h.count(func(s *Stats) { s.Letters++ })
+}
+
+// publish publishes the dead letter of the message
+func (h *Hook) publish(letter Letter, pk packets.Packet) error {
+	user := make([]packets.UserProperty, 0, len(letter.UserProperties)+5)
+	user = append(user, letter.UserProperties...)
+	user = append(user,
+		packets.UserProperty{Key: "dlq-reason", Val: letter.Reason},
+		packets.UserProperty{Key: "dlq-topic", Val: letter.Topic},
+		packets.UserProperty{Key: "dlq-publisher", Val: letter.Publisher},
+		packets.UserProperty{Key: "dlq-time", Val: letter.Timestamp.Format(time.RFC3339Nano)},
+	)
+	if letter.Client != "" {
+		user = append(user, packets.UserProperty{Key: "dlq-client", Val: letter.Client})
+	}
+
+	return h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  letter.Qos,
+		},
+		TopicName: render(h.config.Topic, letter.Reason, letter.Topic),
+		Payload:   letter.Payload,
+		PacketID:  uint16(letter.Qos),
+		Properties: packets.Properties{
+			PayloadFormat:     pk.Properties.PayloadFormat,
+			PayloadFormatFlag: pk.Properties.PayloadFormatFlag,
+			ContentType:       pk.Properties.ContentType,
+			User:              user,
+		},
+	})
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
+
+// match returns whether the topic matches one of the filters
+func match(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if acl.Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// render substitutes the {reason} and {topic} placeholders of the topic template
+func render(template, reason, topic string) string {
+	return strings.NewReplacer("{reason}", reason, "{topic}", topic).Replace(template)
+}
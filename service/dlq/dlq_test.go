@@ -0,0 +1,261 @@
+package dlq
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+var now = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	dlqHook := new(Hook)
+	dlqHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	dlqHook.now = func() time.Time { return now }
+	require.NoError(t, dlqHook.Init(options))
+	return dlqHook
+}
+
+// subscribe returns the messages published to the filter
+func subscribe(t *testing.T, server *mqtt.Server, filter string) chan packets.Packet {
+	t.Helper()
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return received
+}
+
+func message(topic string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     []byte("hello"),
+		Origin:      "publisher",
+		Properties: packets.Properties{
+			ContentType: "text/plain",
+			User:        []packets.UserProperty{{Key: "trace", Val: "abc"}},
+		},
+	}
+}
+
+func TestID(t *testing.T) {
+	dlqHook := new(Hook)
+
+	require.Equal(t, "dlq-hook", dlqHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	dlqHook := new(Hook)
+
+	require.True(t, dlqHook.Provides(mqtt.OnPublishDropped))
+	require.True(t, dlqHook.Provides(mqtt.OnQosDropped))
+	require.True(t, dlqHook.Provides(mqtt.OnPacketIDExhausted))
+	require.True(t, dlqHook.Provides(mqtt.OnPublished))
+	require.False(t, dlqHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	server := newServer(t)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectTopic string
+		expectError bool
+	}{
+		{
+			name:        "Success - defaults",
+			config:      Options{Server: server},
+			expectTopic: "$dlq/{reason}/{topic}",
+		},
+		{
+			name:   "Success - sink",
+			config: Options{Server: server, Sink: func(l Letter) {}},
+		},
+		{
+			name:        "Success - sink and topic",
+			config:      Options{Server: server, Sink: func(l Letter) {}, Topic: "dead/{reason}/{topic}", MustDeliver: []string{"orders/#"}},
+			expectTopic: "dead/{reason}/{topic}",
+		},
+		{
+			name:        "Error - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Error - improper config",
+			config:      "not valid",
+			expectError: true,
+		},
+		{
+			name:        "Error - no server",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid topic",
+			config:      Options{Server: server, Topic: "dead/#/{topic}"},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid filter",
+			config:      Options{Server: server, Filters: []string{"a/#/b"}},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid must deliver filter",
+			config:      Options{Server: server, MustDeliver: []string{"a/#/b"}},
+			expectError: true,
+		},
+		{
+			name:        "Error - unknown reason",
+			config:      Options{Server: server, Reasons: []string{"lost"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dlqHook := new(Hook)
+			err := dlqHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expectTopic, dlqHook.config.Topic)
+			require.Equal(t, []string{"#"}, dlqHook.config.Filters)
+			require.Equal(t, 100, dlqHook.config.Limit)
+			require.Len(t, dlqHook.reasons, 4)
+		})
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "$dlq/#")
+	dlqHook := newHook(t, Options{Server: server})
+
+	dlqHook.OnPublishDropped(server.NewClient(nil, "t1", "slow-1", false), message("sensors/1/temp"))
+
+	require.Len(t, received, 1)
+	pk := <-received
+	require.Equal(t, "$dlq/queue_full/sensors/1/temp", pk.TopicName)
+	require.Equal(t, []byte("hello"), pk.Payload)
+	require.Equal(t, byte(1), pk.FixedHeader.Qos)
+	require.Equal(t, ClientID, pk.Origin)
+	require.Equal(t, "text/plain", pk.Properties.ContentType)
+	require.Equal(t, []packets.UserProperty{
+		{Key: "trace", Val: "abc"},
+		{Key: "dlq-reason", Val: ReasonQueueFull},
+		{Key: "dlq-topic", Val: "sensors/1/temp"},
+		{Key: "dlq-publisher", Val: "publisher"},
+		{Key: "dlq-time", Val: "2024-01-02T03:04:05Z"},
+		{Key: "dlq-client", Val: "slow-1"},
+	}, pk.Properties.User)
+	require.Equal(t, Stats{Letters: 1}, dlqHook.Stats())
+
+	// the dead letter being dropped isn't dead lettered again
+	dlqHook.OnPublishDropped(server.NewClient(nil, "t1", "slow-2", false), pk)
+	require.Len(t, received, 0)
+	require.Equal(t, Stats{Letters: 1}, dlqHook.Stats())
+}
+
+func TestDropped(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "$dlq/#")
+	dlqHook := newHook(t, Options{Server: server, Reasons: []string{ReasonExpired, ReasonPacketIDExhausted}})
+	cl := server.NewClient(nil, "t1", "slow-1", false)
+
+	dlqHook.OnQosDropped(cl, message("a/b"))
+	dlqHook.OnPacketIDExhausted(cl, message("c/d"))
+	dlqHook.OnPublishDropped(cl, message("e/f"))
+	dlqHook.OnQosDropped(cl, packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Pubrel}, PacketID: 3})
+	dlqHook.OnQosDropped(cl, message("$SYS/broker/uptime"))
+
+	require.Len(t, received, 2)
+	require.Equal(t, "$dlq/expired/a/b", (<-received).TopicName)
+	require.Equal(t, "$dlq/packet_ids_exhausted/c/d", (<-received).TopicName)
+}
+
+func TestNoSubscribers(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "$dlq/#")
+	dlqHook := newHook(t, Options{Server: server, MustDeliver: []string{"orders/#"}})
+	cl := server.NewClient(nil, "t1", "publisher", false)
+
+	dlqHook.OnPublished(cl, message("orders/1"))
+	dlqHook.OnPublished(cl, message("sensors/1"))
+
+	retained := message("orders/2")
+	retained.FixedHeader.Retain = true
+	dlqHook.OnPublished(cl, retained)
+
+	subscribe(t, server, "orders/+")
+	dlqHook.OnPublished(cl, message("orders/3"))
+
+	require.Len(t, received, 1)
+	pk := <-received
+	require.Equal(t, "$dlq/no_subscribers/orders/1", pk.TopicName)
+	for _, p := range pk.Properties.User {
+		require.NotEqual(t, "dlq-client", p.Key)
+	}
+}
+
+func TestSink(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "#")
+
+	var letters []Letter
+	dlqHook := newHook(t, Options{Server: server, Sink: func(l Letter) { letters = append(letters, l) }})
+	dlqHook.OnPublishDropped(server.NewClient(nil, "t1", "slow-1", false), message("a/b"))
+
+	require.Len(t, received, 0)
+	require.Equal(t, []Letter{{
+		Reason:         ReasonQueueFull,
+		Topic:          "a/b",
+		Payload:        []byte("hello"),
+		Qos:            1,
+		Publisher:      "publisher",
+		Client:         "slow-1",
+		UserProperties: []packets.UserProperty{{Key: "trace", Val: "abc"}},
+		Timestamp:      now,
+	}}, letters)
+}
+
+func TestLimit(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "$dlq/#")
+	dlqHook := newHook(t, Options{Server: server, Limit: 2})
+	cl := server.NewClient(nil, "t1", "slow-1", false)
+
+	for i := 0; i < 3; i++ {
+		dlqHook.OnPublishDropped(cl, message("a/b"))
+	}
+	require.Len(t, received, 2)
+	require.Equal(t, Stats{Letters: 2, Suppressed: 1}, dlqHook.Stats())
+
+	dlqHook.now = func() time.Time { return now.Add(time.Second) }
+	dlqHook.OnPublishDropped(cl, message("a/b"))
+	require.Len(t, received, 3)
+	require.Equal(t, Stats{Letters: 3, Suppressed: 1}, dlqHook.Stats())
+}
@@ -0,0 +1,532 @@
+// Package events provides a hook which streams the events of the broker to dashboards over
+// WebSocket: the clients which connect and disconnect, and a sample of the messages published to
+// matching topics, as JSON, so dashboards don't need MQTT subscriptions to wildcard filters and the
+// broad ACLs they require.
+//
+// The hook serves the stream itself on Addr, or its Handler is mounted on the server of the
+// application. Dashboards authenticate with one of the Tokens, as a bearer token in the Authorization
+// header, or in the access_token query parameter as browsers can't set headers on websockets, unless
+// the requests are authenticated by Authenticate. Each websocket message is an Event, and dashboards
+// may narrow the stream with the types query parameter, eg. types=connect,disconnect, and filter
+// query parameters, eg. filter=devices/+/status, which messages must match besides the Filters.
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// types of events
+const (
+	TypeConnect    = "connect"
+	TypeDisconnect = "disconnect"
+	TypeMessage    = "message"
+)
+
+// Event is an event of the broker, sent to dashboards as JSON
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Username string    `json:"username,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Listener string    `json:"listener,omitempty"`
+	Reason   string    `json:"reason,omitempty"` // why the client disconnected, if it didn't do so itself
+	Topic    string    `json:"topic,omitempty"`
+	Qos      byte      `json:"qos,omitempty"`
+	Retain   bool      `json:"retain,omitempty"`
+	Size     int       `json:"size,omitempty"`    // the size of the payload of the message in bytes
+	Payload  []byte    `json:"payload,omitempty"` // the payload of the message in base64, if Payloads is set
+}
+
+// maxMessageSize is the largest message read from a dashboard, which only sends control frames
+const maxMessageSize = 4096
+
+// Stats are the totals of the dashboards and events streamed since the hook was initialized
+type Stats struct {
+	Accepted int64 // the number of dashboards which connected
+	Rejected int64 // the number of requests which could not be authenticated, or were over MaxClients
+	Sent     int64 // the number of events sent to dashboards
+	Dropped  int64 // the number of events discarded as the queue of a dashboard was full
+}
+
+// subscriber is a dashboard streaming events
+type subscriber struct {
+	conn    *websocket.Conn
+	events  chan []byte
+	types   map[string]bool // the types of events sent, or all if nil
+	filters []string        // the topics of the messages sent, or all if empty
+	done    chan struct{}   // closed when the dashboard disconnects
+}
+
+// wants returns whether the event is sent to the dashboard
+func (s *subscriber) wants(ev *Event) bool {
+	if s.types != nil && !s.types[ev.Type] {
+		return false
+	}
+
+	if ev.Type != TypeMessage || len(s.filters) == 0 {
+		return true
+	}
+
+	for _, filter := range s.filters {
+		if acl.Match(filter, ev.Topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// goingAway tells the dashboard the broker is going away, and disconnects it
+func (s *subscriber) goingAway() {
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+	s.conn.Close()
+}
+
+// Hook is a hook that streams the events of the broker to dashboards over WebSocket
+type Hook struct {
+	config      Options
+	upgrader    websocket.Upgrader
+	subscribers map[*subscriber]struct{}
+	stopped     bool         // whether the hook stopped, and accepts no more dashboards
+	ln          net.Listener // the stream is served on
+	server      *http.Server
+	wg          sync.WaitGroup // the server and the dashboards
+	stats       Stats
+	mu          sync.Mutex // guards subscribers and stopped
+	statsMu     sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the events hook
+type Options struct {
+	// Addr is the address the stream is served on at Path, which defaults to /events, eg. ":8081".
+	// The stream isn't served if it is empty
+	Addr string
+	Path string
+
+	// Tokens are the bearer tokens dashboards authenticate with. Required unless Authenticate is set
+	Tokens []string
+
+	// Authenticate returns whether a dashboard request is authenticated, instead of Tokens, eg. to
+	// check a session cookie
+	Authenticate func(r *http.Request) bool
+
+	// CheckOrigin returns whether a dashboard request is accepted from the Origin of the request. It
+	// defaults to accepting requests without an Origin or from the host of the request, so web pages of
+	// other sites can't stream events with the cookies of the operator
+	CheckOrigin func(r *http.Request) bool
+
+	// Filters are the topics whose messages are streamed, and no messages are streamed if it is empty
+	Filters []string
+
+	// Percent is the percentage of the messages matching a filter which are streamed, chosen at
+	// random, and defaults to 100
+	Percent float64
+
+	// Payloads includes the payloads of the messages in their events
+	Payloads bool
+
+	// MaxClients is how many dashboards may stream events at once, and defaults to 100
+	MaxClients int
+
+	// QueueSize is how many events wait to be sent to each dashboard, and defaults to 256. Events
+	// queued while the queue is full are dropped
+	QueueSize int
+
+	// WriteTimeout bounds sending each event, and defaults to 10 seconds
+	WriteTimeout time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "events-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts serving the stream if Addr is set
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	eventsHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if len(eventsHookConfig.Tokens) == 0 && eventsHookConfig.Authenticate == nil {
+		return errors.New("tokens or authenticate is required")
+	}
+
+	for _, filter := range eventsHookConfig.Filters {
+		if !mqtt.IsValidFilter(filter, false) {
+			return fmt.Errorf("invalid filter %q", filter)
+		}
+	}
+
+	if eventsHookConfig.Percent < 0 || eventsHookConfig.Percent > 100 {
+		return fmt.Errorf("invalid percent %v", eventsHookConfig.Percent)
+	}
+
+	if eventsHookConfig.Percent == 0 {
+		eventsHookConfig.Percent = 100
+	}
+
+	if eventsHookConfig.Path == "" {
+		eventsHookConfig.Path = "/events"
+	}
+
+	if eventsHookConfig.MaxClients <= 0 {
+		eventsHookConfig.MaxClients = 100
+	}
+
+	if eventsHookConfig.QueueSize <= 0 {
+		eventsHookConfig.QueueSize = 256
+	}
+
+	if eventsHookConfig.WriteTimeout <= 0 {
+		eventsHookConfig.WriteTimeout = 10 * time.Second
+	}
+
+	h.config = eventsHookConfig
+	h.upgrader = websocket.Upgrader{CheckOrigin: eventsHookConfig.CheckOrigin}
+	h.subscribers = make(map[*subscriber]struct{})
+
+	if eventsHookConfig.Addr == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", eventsHookConfig.Addr)
+	if err != nil {
+		return err
+	}
+	h.ln = ln
+
+	mux := http.NewServeMux()
+	mux.Handle(eventsHookConfig.Path, h.Handler())
+	h.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		if err := h.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			h.Log.Error("error occurred while serving event stream", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops serving the stream, and disconnects the dashboards
+func (h *Hook) Stop() error {
+	var err error
+	if h.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = h.server.Shutdown(ctx)
+	}
+
+	h.mu.Lock()
+	h.stopped = true
+	for s := range h.subscribers {
+		s.goingAway()
+	}
+	h.mu.Unlock()
+
+	h.wg.Wait()
+	return err
+}
+
+// Stats returns the totals of the dashboards and events streamed so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
+
+// Handler returns the handler streaming the events to the dashboards, eg. to mount it on the server
+// of the application
+func (h *Hook) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.authenticate(r) {
+			h.count(func(s *Stats) { s.Rejected++ })
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		s, err := newSubscriber(r, h.config.QueueSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		h.mu.Lock()
+		full := len(h.subscribers) >= h.config.MaxClients
+		h.mu.Unlock()
+		if full {
+			h.count(func(s *Stats) { s.Rejected++ })
+			http.Error(w, "too many clients", http.StatusServiceUnavailable)
+			return
+		}
+
+		if !websocket.IsWebSocketUpgrade(r) {
+			w.Header().Set("Upgrade", "websocket")
+			http.Error(w, "not a websocket handshake", http.StatusUpgradeRequired)
+			return
+		}
+
+		// the upgrader replies to the requests it rejects, eg. from other origins
+		conn, err := h.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			h.Log.Warn("failed to accept event stream", "error", err, "remote", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+			return
+		}
+
+		s.conn = conn
+		h.mu.Lock()
+		if h.stopped {
+			h.mu.Unlock()
+			s.goingAway()
+			return
+		}
+		h.subscribers[s] = struct{}{}
+		h.wg.Add(1)
+		h.mu.Unlock()
+		h.count(func(s *Stats) { s.Accepted++ })
+
+		defer h.wg.Done()
+		go h.send(s)
+		h.receive(s)
+
+		h.mu.Lock()
+		delete(h.subscribers, s)
+		h.mu.Unlock()
+		close(s.done)
+		conn.Close()
+	})
+}
+
+// authenticate returns whether the request is authenticated by Authenticate, or carries one of the
+// tokens
+func (h *Hook) authenticate(r *http.Request) bool {
+	if h.config.Authenticate != nil {
+		return h.config.Authenticate(r)
+	}
+
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		token = auth[7:]
+	}
+
+	if token == "" {
+		return false
+	}
+
+	ok := false
+	for _, t := range h.config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// newSubscriber returns a dashboard streaming the types and filters of the query of the request
+func newSubscriber(r *http.Request, queueSize int) (*subscriber, error) {
+	s := &subscriber{events: make(chan []byte, queueSize), done: make(chan struct{})}
+
+	query := r.URL.Query()
+	if types := query.Get("types"); types != "" {
+		s.types = make(map[string]bool)
+		for _, t := range strings.Split(types, ",") {
+			switch t {
+			case TypeConnect, TypeDisconnect, TypeMessage:
+				s.types[t] = true
+			default:
+				return nil, fmt.Errorf("invalid type %q", t)
+			}
+		}
+	}
+
+	for _, filter := range query["filter"] {
+		if !mqtt.IsValidFilter(filter, false) {
+			return nil, fmt.Errorf("invalid filter %q", filter)
+		}
+		s.filters = append(s.filters, filter)
+	}
+
+	return s, nil
+}
+
+// send sends the events queued for the dashboard until it disconnects
+func (h *Hook) send(s *subscriber) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case data := <-s.events:
+			_ = s.conn.SetWriteDeadline(time.Now().Add(h.config.WriteTimeout))
+			if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				s.conn.Close() // ends receive
+				return
+			}
+			h.count(func(s *Stats) { s.Sent++ })
+		}
+	}
+}
+
+// receive reads from the dashboard until it disconnects, so its pings and close are answered
+func (h *Hook) receive(s *subscriber) {
+	s.conn.SetReadLimit(maxMessageSize)
+	for {
+		if _, _, err := s.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// publish queues the event for the dashboards which want it
+func (h *Hook) publish(ev *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var data []byte
+	dropped := 0
+	for s := range h.subscribers {
+		if !s.wants(ev) {
+			continue
+		}
+
+		if data == nil {
+			var err error
+			if data, err = json.Marshal(ev); err != nil {
+				h.Log.Error("error occurred while encoding event", "error", err, "type", ev.Type)
+				return
+			}
+		}
+
+		select {
+		case s.events <- data:
+		default:
+			dropped++
+		}
+	}
+
+	if dropped > 0 {
+		h.count(func(s *Stats) { s.Dropped += int64(dropped) })
+	}
+}
+
+// streaming returns whether dashboards are streaming events
+func (h *Hook) streaming() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers) > 0
+}
+
+// OnSessionEstablished is called when a client has connected and authenticated, and streams a
+// connect event
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if !h.streaming() {
+		return
+	}
+
+	h.publish(&Event{
+		Type:     TypeConnect,
+		Time:     time.Now(),
+		Client:   cl.ID,
+		Username: string(cl.Properties.Username),
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	})
+}
+
+// OnDisconnect is called when a client which had connected disconnects, and streams a disconnect
+// event
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if !h.streaming() {
+		return
+	}
+
+	ev := &Event{
+		Type:     TypeDisconnect,
+		Time:     time.Now(),
+		Client:   cl.ID,
+		Username: string(cl.Properties.Username),
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	}
+	if err != nil {
+		ev.Reason = err.Error()
+	}
+	h.publish(ev)
+}
+
+// OnPublished is called when a client has published a message, and streams a message event if its
+// topic matches a filter and it is sampled
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if len(h.config.Filters) == 0 || !h.streaming() {
+		return
+	}
+
+	matched := false
+	for _, filter := range h.config.Filters {
+		if acl.Match(filter, pk.TopicName) {
+			matched = true
+			break
+		}
+	}
+
+	if !matched || h.config.Percent < 100 && rand.Float64()*100 >= h.config.Percent {
+		return
+	}
+
+	ev := &Event{
+		Type:     TypeMessage,
+		Time:     time.Now(),
+		Client:   cl.ID,
+		Username: string(cl.Properties.Username),
+		Listener: cl.Net.Listener,
+		Topic:    pk.TopicName,
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		Size:     len(pk.Payload),
+	}
+	if h.config.Payloads {
+		ev.Payload = pk.Payload
+	}
+	h.publish(ev)
+}
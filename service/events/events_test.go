@@ -0,0 +1,385 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// newHook returns an initialized hook
+func newHook(t *testing.T, config Options) *Hook {
+	t.Helper()
+
+	eventsHook := new(Hook)
+	eventsHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, eventsHook.Init(config))
+	t.Cleanup(func() { eventsHook.Stop() })
+	return eventsHook
+}
+
+// dial connects a dashboard to the stream at the address with the query, and waits until it streams
+func dial(t *testing.T, h *Hook, addr, query string) *websocket.Conn {
+	t.Helper()
+
+	h.mu.Lock()
+	streaming := len(h.subscribers)
+	h.mu.Unlock()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/events?"+query, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	require.Eventually(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.subscribers) > streaming
+	}, time.Second, time.Millisecond)
+	return conn
+}
+
+// receive reads the next event sent to the dashboard
+func receive(t *testing.T, conn *websocket.Conn) Event {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	kind, payload, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.TextMessage, kind)
+
+	var ev Event
+	require.NoError(t, json.Unmarshal(payload, &ev))
+	return ev
+}
+
+// newClient returns a client of the server
+func newClient(id, username string) *mqtt.Client {
+	cl := mqtt.New(nil).NewClient(nil, "tcp1", id, true)
+	cl.Properties.Username = []byte(username)
+	cl.Net.Remote = "10.0.0.1:51234"
+	return cl
+}
+
+func TestID(t *testing.T) {
+	eventsHook := new(Hook)
+
+	require.Equal(t, "events-hook", eventsHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	eventsHook := new(Hook)
+	require.True(t, eventsHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, eventsHook.Provides(mqtt.OnDisconnect))
+	require.True(t, eventsHook.Provides(mqtt.OnPublished))
+	require.False(t, eventsHook.Provides(mqtt.OnSubscribed))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - tokens",
+			config:      Options{Tokens: []string{"secret"}, Filters: []string{"devices/+/status"}},
+			expectError: false,
+		},
+		{
+			name:        "Success - authenticate",
+			config:      Options{Authenticate: func(r *http.Request) bool { return true }},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no tokens",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Tokens: []string{"secret"}, Filters: []string{"devices/#/status"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid percent",
+			config:      Options{Tokens: []string{"secret"}, Percent: 101},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid addr",
+			config:      Options{Tokens: []string{"secret"}, Addr: "invalid:addr:1"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			eventsHook := new(Hook)
+			eventsHook.Log = slog.Default()
+			err := eventsHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer eventsHook.Stop()
+
+			require.Equal(t, "/events", eventsHook.config.Path)
+			require.Equal(t, float64(100), eventsHook.config.Percent)
+			require.Equal(t, 100, eventsHook.config.MaxClients)
+			require.Equal(t, 256, eventsHook.config.QueueSize)
+			require.Equal(t, 10*time.Second, eventsHook.config.WriteTimeout)
+
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	eventsHook := newHook(t, Options{Tokens: []string{"secret", "other"}})
+
+	tests := []struct {
+		name          string
+		target        string
+		authorization string
+		authenticated bool
+	}{
+		{"bearer token", "/events", "Bearer secret", true},
+		{"second token", "/events", "bearer other", true},
+		{"query token", "/events?access_token=secret", "", true},
+		{"wrong token", "/events", "Bearer wrong", false},
+		{"wrong query token", "/events?access_token=wrong", "", false},
+		{"basic", "/events", "Basic c2VjcmV0", false},
+		{"no token", "/events", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		require.Equal(t, tt.authenticated, eventsHook.authenticate(r), tt.name)
+	}
+
+	eventsHook = newHook(t, Options{Tokens: []string{"secret"}, Authenticate: func(r *http.Request) bool {
+		cookie, err := r.Cookie("session")
+		return err == nil && cookie.Value == "valid"
+	}})
+
+	r := httptest.NewRequest(http.MethodGet, "/events?access_token=secret", nil)
+	require.False(t, eventsHook.authenticate(r))
+	r.AddCookie(&http.Cookie{Name: "session", Value: "valid"})
+	require.True(t, eventsHook.authenticate(r))
+}
+
+func TestHandlerRejects(t *testing.T) {
+	eventsHook := newHook(t, Options{Tokens: []string{"secret"}, MaxClients: 1})
+	server := httptest.NewServer(eventsHook.Handler())
+	defer server.Close()
+
+	get := func(query string) *http.Response {
+		resp, err := http.Get(server.URL + "/events?" + query)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("access_token=wrong")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+
+	require.Equal(t, http.StatusBadRequest, get("access_token=secret&types=connect,subscribe").StatusCode)
+	require.Equal(t, http.StatusBadRequest, get("access_token=secret&filter=a/%23/b").StatusCode)
+	require.Equal(t, http.StatusUpgradeRequired, get("access_token=secret").StatusCode)
+
+	// web pages of other sites can't stream events
+	header := http.Header{"Origin": {"https://attacker.example.com"}}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/events?access_token=secret", header)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	dial(t, eventsHook, strings.TrimPrefix(server.URL, "http://"), "access_token=secret")
+	require.Equal(t, http.StatusServiceUnavailable, get("access_token=secret").StatusCode)
+
+	require.Equal(t, int64(1), eventsHook.Stats().Accepted)
+	require.Equal(t, int64(2), eventsHook.Stats().Rejected)
+}
+
+func TestStream(t *testing.T) {
+	eventsHook := newHook(t, Options{Tokens: []string{"secret"}, Filters: []string{"devices/#"}, Payloads: true})
+	server := httptest.NewServer(eventsHook.Handler())
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	cl := newClient("c1", "alice")
+
+	// no events are built while no dashboards stream them
+	eventsHook.OnSessionEstablished(cl, packets.Packet{})
+
+	conn := dial(t, eventsHook, addr, "access_token=secret")
+	filtered := dial(t, eventsHook, addr, "access_token=secret&types=message&filter=devices/%2B/status")
+
+	eventsHook.OnSessionEstablished(cl, packets.Packet{})
+	eventsHook.OnPublished(cl, packets.Packet{TopicName: "other/topic", Payload: []byte("ignored")})
+	eventsHook.OnPublished(cl, packets.Packet{TopicName: "devices/d1/telemetry", Payload: []byte("21.5")})
+	eventsHook.OnPublished(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "devices/d1/status",
+		Payload:     []byte("online"),
+	})
+	eventsHook.OnDisconnect(cl, errors.New("keepalive timeout"), false)
+
+	ev := receive(t, conn)
+	require.Equal(t, TypeConnect, ev.Type)
+	require.Equal(t, "c1", ev.Client)
+	require.Equal(t, "alice", ev.Username)
+	require.Equal(t, "10.0.0.1:51234", ev.Remote)
+	require.Equal(t, "tcp1", ev.Listener)
+	require.WithinDuration(t, time.Now(), ev.Time, time.Second)
+
+	ev = receive(t, conn)
+	require.Equal(t, TypeMessage, ev.Type)
+	require.Equal(t, "devices/d1/telemetry", ev.Topic)
+	require.Equal(t, 4, ev.Size)
+	require.Equal(t, []byte("21.5"), ev.Payload)
+
+	ev = receive(t, conn)
+	require.Equal(t, TypeMessage, ev.Type)
+	require.Equal(t, "devices/d1/status", ev.Topic)
+	require.Equal(t, byte(1), ev.Qos)
+	require.True(t, ev.Retain)
+
+	ev = receive(t, conn)
+	require.Equal(t, TypeDisconnect, ev.Type)
+	require.Equal(t, "keepalive timeout", ev.Reason)
+
+	// dashboards narrowing the stream only receive the events they want
+	ev = receive(t, filtered)
+	require.Equal(t, TypeMessage, ev.Type)
+	require.Equal(t, "devices/d1/status", ev.Topic)
+
+	require.Eventually(t, func() bool { return eventsHook.Stats().Sent == 5 }, time.Second, time.Millisecond)
+}
+
+func TestStreamPayloads(t *testing.T) {
+	eventsHook := newHook(t, Options{Tokens: []string{"secret"}, Filters: []string{"#"}})
+	server := httptest.NewServer(eventsHook.Handler())
+	defer server.Close()
+
+	conn := dial(t, eventsHook, strings.TrimPrefix(server.URL, "http://"), "access_token=secret")
+	eventsHook.OnPublished(newClient("c1", ""), packets.Packet{TopicName: "a/b", Payload: []byte("secret")})
+
+	ev := receive(t, conn)
+	require.Equal(t, "a/b", ev.Topic)
+	require.Equal(t, 6, ev.Size)
+	require.Nil(t, ev.Payload)
+}
+
+func TestControlFrames(t *testing.T) {
+	eventsHook := newHook(t, Options{Tokens: []string{"secret"}})
+	server := httptest.NewServer(eventsHook.Handler())
+	defer server.Close()
+
+	conn := dial(t, eventsHook, strings.TrimPrefix(server.URL, "http://"), "access_token=secret")
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	pongs := make(chan string, 1)
+	conn.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+
+	require.NoError(t, conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second)))
+	require.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	_, _, err := conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+	require.Equal(t, "ping", <-pongs)
+
+	require.Eventually(t, func() bool { return !eventsHook.streaming() }, time.Second, time.Millisecond)
+}
+
+func TestCheckOrigin(t *testing.T) {
+	eventsHook := newHook(t, Options{Tokens: []string{"secret"}, CheckOrigin: func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "https://dashboard.example.com"
+	}})
+	server := httptest.NewServer(eventsHook.Handler())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/events?access_token=secret"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://dashboard.example.com"}})
+	require.NoError(t, err)
+	conn.Close()
+
+	// the origin of the stream itself is no longer accepted once CheckOrigin is set
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {server.URL}})
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestDropped(t *testing.T) {
+	eventsHook := newHook(t, Options{Tokens: []string{"secret"}, Filters: []string{"#"}, Percent: 50})
+
+	// a dashboard which isn't sent its events
+	s := &subscriber{events: make(chan []byte, 256), done: make(chan struct{})}
+	eventsHook.subscribers[s] = struct{}{}
+
+	for i := 0; i < 200; i++ {
+		eventsHook.OnPublished(newClient("c1", ""), packets.Packet{TopicName: "a/b"})
+	}
+	sampled := len(s.events)
+	require.Greater(t, sampled, 0)
+	require.Less(t, sampled, 200)
+	require.Zero(t, eventsHook.Stats().Dropped)
+
+	// events are dropped once the queue is full
+	for i := 0; i < 256; i++ {
+		eventsHook.OnSessionEstablished(newClient("c1", ""), packets.Packet{})
+	}
+	require.Len(t, s.events, 256)
+	require.Equal(t, int64(sampled), eventsHook.Stats().Dropped)
+	delete(eventsHook.subscribers, s)
+}
+
+func TestServe(t *testing.T) {
+	eventsHook := new(Hook)
+	eventsHook.Log = slog.Default()
+	require.NoError(t, eventsHook.Init(Options{Addr: "127.0.0.1:0", Tokens: []string{"secret"}}))
+
+	resp, err := http.Get("http://" + eventsHook.ln.Addr().String() + "/other")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	conn := dial(t, eventsHook, eventsHook.ln.Addr().String(), "access_token=secret")
+
+	// dashboards are told the broker is going away
+	require.NoError(t, eventsHook.Stop())
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+	require.False(t, eventsHook.streaming())
+}
+
+func TestStop(t *testing.T) {
+	require.NoError(t, new(Hook).Stop())
+}
@@ -0,0 +1,315 @@
+// Package fanout provides a hook which fans the messages published to each broker of a cluster out to
+// the others through NATS, so clients subscribed to any broker receive the messages published to all
+// of them, without a full clustering implementation. Sessions and subscriptions stay local to their
+// broker, and each message is delivered to the other brokers once, at most.
+//
+// Each message published on a broker is sent to a single NATS subject as an MQTT 5 PUBLISH packet,
+// keeping its topic, QoS, retain flag and properties, with the origin of the broker in the
+// HeaderOrigin header. The messages received from other brokers are published to the broker by an
+// inline client, whose messages aren't sent again, and those the broker sent itself are skipped.
+//
+// Messages are sent and received through the Conn of the nats bridge hook, which is a thin adapter of
+// the NATS client of the application.
+package fanout
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/bridge/nats"
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// ClientID is the id of the inline client which publishes the messages received from other brokers
+const ClientID = "fanout"
+
+// HeaderOrigin is the origin of the broker which sent a message
+const HeaderOrigin = "Mqtt-Fanout-Origin"
+
+// Stats are the totals of the messages fanned out since the hook was initialized
+type Stats struct {
+	Sent     int64 // the number of messages sent to the other brokers
+	Received int64 // the number of messages received from other brokers and published to the broker
+	Skipped  int64 // the number of messages received which the broker sent itself
+	Unwanted int64 // the number of messages not sent as no other broker has subscribers to them
+	Failed   int64 // the number of messages which could not be sent, decoded or published
+}
+
+// Hook is a hook that sends the messages published to the broker to the other brokers of a cluster,
+// and publishes the messages they send to the broker
+type Hook struct {
+	config      Options
+	client      *mqtt.Client // publishes the messages received from other brokers
+	unsubscribe func() error
+	stats       Stats
+	mu          sync.Mutex // guards unsubscribe
+	statsMu     sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the fanout hook
+type Options struct {
+	// Server is the server the messages received from other brokers are published to. Required
+	Server *mqtt.Server
+
+	// Conn sends and receives the messages. Required
+	Conn nats.Conn
+
+	// Subject is the NATS subject the brokers of the cluster share, and defaults to "mqtt.fanout"
+	Subject string
+
+	// Filters are the topics whose messages are sent to the other brokers, and default to "#". Topics
+	// starting with $ are only matched by filters starting with them
+	Filters []string
+
+	// Origin identifies the broker in the HeaderOrigin header of the messages it sends, so those
+	// received back are skipped. It must be unique to each broker, and defaults to a random id
+	Origin string
+
+	// Interested returns whether other brokers may have subscribers to a topic, eg. the Interested
+	// method of the gossip hook, and messages no other broker is interested in aren't sent. All the
+	// messages matching a filter are sent if it is nil
+	Interested func(topic string) bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "fanout-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	fanoutHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if fanoutHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if fanoutHookConfig.Conn == nil {
+		return errors.New("conn is required")
+	}
+
+	if fanoutHookConfig.Subject == "" {
+		fanoutHookConfig.Subject = "mqtt.fanout"
+	}
+
+	if len(fanoutHookConfig.Filters) == 0 {
+		fanoutHookConfig.Filters = []string{"#"}
+	}
+
+	for _, filter := range fanoutHookConfig.Filters {
+		if !mqtt.IsValidFilter(filter, false) {
+			return fmt.Errorf("invalid filter %q", filter)
+		}
+	}
+
+	if fanoutHookConfig.Origin == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		fanoutHookConfig.Origin = hex.EncodeToString(b)
+	}
+
+	h.config = fanoutHookConfig
+	h.client = fanoutHookConfig.Server.NewClient(nil, "local", ClientID, true)
+	h.client.Properties.ProtocolVersion = 5
+
+	return nil
+}
+
+// OnStarted is called when the server has started, and subscribes to the subject of the cluster
+func (h *Hook) OnStarted() {
+	unsubscribe, err := h.config.Conn.Subscribe(h.config.Subject, "", h.receive)
+	if err != nil {
+		h.Log.Error("error occurred while subscribing to nats subject", "error", err, "subject", h.config.Subject)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unsubscribe = unsubscribe
+}
+
+// Stop unsubscribes from the subject of the cluster
+func (h *Hook) Stop() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.unsubscribe == nil {
+		return nil
+	}
+
+	err := h.unsubscribe()
+	h.unsubscribe = nil
+	return err
+}
+
+// Stats returns the totals of the messages fanned out so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
+
+// OnPublished is called when a client has published a message, and sends it to the other brokers if
+// its topic matches a filter. Messages received from other brokers aren't sent again
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if cl.ID == ClientID && cl.Net.Inline {
+		return
+	}
+
+	matched := false
+	for _, filter := range h.config.Filters {
+		if acl.Match(filter, pk.TopicName) {
+			matched = true
+			break
+		}
+	}
+
+	if !matched {
+		return
+	}
+
+	if h.config.Interested != nil && !h.config.Interested(pk.TopicName) {
+		h.count(func(s *Stats) { s.Unwanted++ })
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := encode(pk, &buf); err != nil {
+		h.Log.Error("error occurred while encoding message", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	err := h.config.Conn.Publish(&nats.Msg{
+		Subject: h.config.Subject,
+		Header:  map[string][]string{HeaderOrigin: {h.config.Origin}},
+		Data:    buf.Bytes(),
+	})
+	if err != nil {
+		h.Log.Error("error occurred while sending message to cluster", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.count(func(s *Stats) { s.Sent++ })
+}
+
+// receive publishes a message received from another broker to the broker
+func (h *Hook) receive(msg *nats.Msg) {
+	origin := msg.Header[HeaderOrigin]
+	if len(origin) > 0 && origin[0] == h.config.Origin {
+		h.count(func(s *Stats) { s.Skipped++ })
+		return
+	}
+
+	pk, err := decode(msg.Data)
+	if err != nil {
+		h.Log.Error("error occurred while decoding message from cluster", "error", err, "origin", origin)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	if err := h.config.Server.InjectPacket(h.client, pk); err != nil {
+		h.Log.Error("error occurred while publishing message from cluster", "error", err, "origin", origin, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.count(func(s *Stats) { s.Received++ })
+}
+
+// encode writes the message as an MQTT 5 PUBLISH packet, without its topic alias
+func encode(pk packets.Packet, buf *bytes.Buffer) error {
+	out := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    pk.FixedHeader.Qos,
+			Retain: pk.FixedHeader.Retain,
+		},
+		Mods:            packets.Mods{AllowResponseInfo: true},
+		ProtocolVersion: 5,
+		TopicName:       pk.TopicName,
+		Properties:      pk.Properties.Copy(false),
+		Payload:         pk.Payload,
+	}
+
+	// as the server publishes, the packet id is only checked to be set
+	if out.FixedHeader.Qos > 0 {
+		out.PacketID = uint16(out.FixedHeader.Qos)
+	}
+
+	return out.PublishEncode(buf)
+}
+
+// decode reads a message written by encode
+func decode(data []byte) (packets.Packet, error) {
+	pk := packets.Packet{ProtocolVersion: 5}
+	if len(data) == 0 {
+		return pk, errors.New("empty message")
+	}
+
+	if err := pk.FixedHeader.Decode(data[0]); err != nil {
+		return pk, err
+	}
+
+	if pk.FixedHeader.Type != packets.Publish {
+		return pk, fmt.Errorf("unexpected packet type %d", pk.FixedHeader.Type)
+	}
+
+	// the remaining length is a variable byte integer of up to 4 bytes
+	i := 1
+	for shift := 0; ; shift += 7 {
+		if i >= len(data) || shift > 21 {
+			return pk, packets.ErrMalformedVariableByteInteger
+		}
+
+		b := data[i]
+		i++
+		pk.FixedHeader.Remaining |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if pk.FixedHeader.Remaining != len(data)-i {
+		return pk, packets.ErrMalformedPacket
+	}
+
+	if err := pk.PublishDecode(data[i:]); err != nil {
+		return pk, err
+	}
+
+	return pk, nil
+}
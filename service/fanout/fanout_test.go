@@ -0,0 +1,302 @@
+package fanout
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/bridge/nats"
+)
+
+// fakeBus delivers the messages published by its conns to all of their subscriptions, as NATS
+// delivers a message to the connection which published it too
+type fakeBus struct {
+	subs map[*fakeConn]func(msg *nats.Msg)
+	sent []*nats.Msg
+	mu   sync.Mutex
+}
+
+func newFakeBus() *fakeBus {
+	return &fakeBus{subs: make(map[*fakeConn]func(msg *nats.Msg))}
+}
+
+func (b *fakeBus) messages() []*nats.Msg {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*nats.Msg{}, b.sent...)
+}
+
+func (b *fakeBus) subscriptions() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// fakeConn is a connection to a fakeBus
+type fakeConn struct {
+	bus *fakeBus
+	err error // returned by publish and subscribe, if set
+}
+
+func (c *fakeConn) Publish(msg *nats.Msg) error {
+	if c.err != nil {
+		return c.err
+	}
+
+	c.bus.mu.Lock()
+	c.bus.sent = append(c.bus.sent, msg)
+	var handlers []func(msg *nats.Msg)
+	for _, handler := range c.bus.subs {
+		handlers = append(handlers, handler)
+	}
+	c.bus.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (c *fakeConn) Subscribe(subject, queue string, handler func(msg *nats.Msg)) (func() error, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	c.bus.mu.Lock()
+	defer c.bus.mu.Unlock()
+	c.bus.subs[c] = handler
+	return func() error {
+		c.bus.mu.Lock()
+		defer c.bus.mu.Unlock()
+		delete(c.bus.subs, c)
+		return nil
+	}, nil
+}
+
+// node is a broker of a cluster, recording the messages it delivers
+type node struct {
+	server   *mqtt.Server
+	hook     *Hook
+	received []packets.Packet
+	mu       sync.Mutex
+}
+
+func newNode(t *testing.T, bus *fakeBus, options Options) *node {
+	t.Helper()
+
+	n := &node{server: mqtt.New(&mqtt.Options{InlineClient: true}), hook: new(Hook)}
+	n.server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	for i, filter := range []string{"devices/#", "local/#"} {
+		require.NoError(t, n.server.Subscribe(filter, i+1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			n.received = append(n.received, pk)
+		}))
+	}
+
+	options.Server = n.server
+	options.Conn = &fakeConn{bus: bus}
+	require.NoError(t, n.server.AddHook(n.hook, options))
+	require.NoError(t, n.server.Serve())
+	t.Cleanup(func() { n.server.Close() })
+	return n
+}
+
+func (n *node) messages() []packets.Packet {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]packets.Packet{}, n.received...)
+}
+
+func TestID(t *testing.T) {
+	fanoutHook := new(Hook)
+
+	require.Equal(t, "fanout-hook", fanoutHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	fanoutHook := new(Hook)
+	require.True(t, fanoutHook.Provides(mqtt.OnStarted))
+	require.True(t, fanoutHook.Provides(mqtt.OnPublished))
+	require.False(t, fanoutHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	conn := &fakeConn{bus: newFakeBus()}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Server: mqtt.New(nil), Conn: conn},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{Conn: conn},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no conn",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Server: mqtt.New(nil), Conn: conn, Filters: []string{"a/#/b"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			fanoutHook := new(Hook)
+			fanoutHook.Log = slog.Default()
+			err := fanoutHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "mqtt.fanout", fanoutHook.config.Subject)
+			require.Equal(t, []string{"#"}, fanoutHook.config.Filters)
+			require.Len(t, fanoutHook.config.Origin, 16)
+
+		})
+	}
+}
+
+func TestFanout(t *testing.T) {
+	bus := newFakeBus()
+	n1 := newNode(t, bus, Options{Filters: []string{"devices/#"}})
+	n2 := newNode(t, bus, Options{Filters: []string{"devices/#"}})
+
+	// messages published to a broker are delivered by the others once
+	require.NoError(t, n1.server.Publish("devices/d1/status", []byte("online"), true, 1))
+	require.Eventually(t, func() bool { return len(n2.messages()) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	require.Len(t, n1.messages(), 1)
+	require.Len(t, n2.messages(), 1)
+	require.Len(t, bus.messages(), 1)
+	require.Equal(t, "devices/d1/status", n2.messages()[0].TopicName)
+	require.Equal(t, []byte("online"), n2.messages()[0].Payload)
+
+	// retained messages are retained by the others too
+	require.Len(t, n2.server.Topics.Messages("devices/d1/status"), 1)
+
+	require.Equal(t, Stats{Sent: 1, Skipped: 1}, n1.hook.Stats())
+	require.Equal(t, Stats{Received: 1}, n2.hook.Stats())
+
+	// topics matching no filter stay local
+	require.NoError(t, n2.server.Publish("local/a", []byte("x"), false, 0))
+	require.Eventually(t, func() bool { return len(n2.messages()) == 2 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	require.Len(t, n1.messages(), 1)
+	require.Len(t, bus.messages(), 1)
+
+	// the subscription ends when the hook stops
+	require.NoError(t, n2.hook.Stop())
+	require.Equal(t, 1, bus.subscriptions())
+	require.NoError(t, n2.hook.Stop())
+}
+
+func TestFanoutInterested(t *testing.T) {
+	bus := newFakeBus()
+	interested := func(topic string) bool { return topic == "devices/d1/status" }
+	n1 := newNode(t, bus, Options{Interested: interested})
+	n2 := newNode(t, bus, Options{})
+
+	// messages of topics no other broker has subscribers to aren't sent
+	require.NoError(t, n1.server.Publish("devices/d2/status", []byte("offline"), false, 0))
+	require.NoError(t, n1.server.Publish("devices/d1/status", []byte("online"), false, 0))
+	require.Eventually(t, func() bool { return len(n2.messages()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, "devices/d1/status", n2.messages()[0].TopicName)
+	require.Equal(t, Stats{Sent: 1, Skipped: 1, Unwanted: 1}, n1.hook.Stats())
+}
+
+func TestOnPublishedUnavailable(t *testing.T) {
+	fanoutHook := new(Hook)
+	fanoutHook.Log = slog.Default()
+	require.NoError(t, fanoutHook.Init(Options{Server: mqtt.New(nil), Conn: &fakeConn{err: errors.New("disconnected")}}))
+
+	fanoutHook.OnStarted()
+	fanoutHook.OnPublished(&mqtt.Client{ID: "c1"}, packets.Packet{TopicName: "a/b"})
+	require.Equal(t, Stats{Failed: 1}, fanoutHook.Stats())
+}
+
+func TestReceiveInvalid(t *testing.T) {
+	fanoutHook := new(Hook)
+	fanoutHook.Log = slog.Default()
+	require.NoError(t, fanoutHook.Init(Options{Server: mqtt.New(nil), Conn: &fakeConn{bus: newFakeBus()}}))
+
+	fanoutHook.receive(&nats.Msg{Data: []byte{0x30, 0x05, 0x00}})
+	require.Equal(t, Stats{Failed: 1}, fanoutHook.Stats())
+}
+
+func TestEncode(t *testing.T) {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 2, Retain: true},
+		TopicName:   "a/b",
+		PacketID:    7,
+		Properties: packets.Properties{
+			ContentType:     "application/json",
+			ResponseTopic:   "a/reply",
+			CorrelationData: []byte("c1"),
+			User:            []packets.UserProperty{{Key: "site", Val: "north"}},
+			TopicAlias:      3,
+			TopicAliasFlag:  true,
+		},
+		Payload: bytes.Repeat([]byte("x"), 200),
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, encode(pk, &buf))
+
+	decoded, err := decode(buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, pk.FixedHeader.Qos, decoded.FixedHeader.Qos)
+	require.True(t, decoded.FixedHeader.Retain)
+	require.Equal(t, "a/b", decoded.TopicName)
+	require.Equal(t, pk.Payload, decoded.Payload)
+	require.Equal(t, "application/json", decoded.Properties.ContentType)
+	require.Equal(t, "a/reply", decoded.Properties.ResponseTopic)
+	require.Equal(t, []byte("c1"), decoded.Properties.CorrelationData)
+	require.Equal(t, pk.Properties.User, decoded.Properties.User)
+	require.Zero(t, decoded.Properties.TopicAlias)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		{0x20, 0x00},                         // connack
+		{0x30},                               // no length
+		{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, // length out of range
+		{0x30, 0x05, 0x00},                   // short
+	} {
+		_, err := decode(data)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,175 @@
+package gossip
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"strings"
+)
+
+// digestHashes is the number of bits set for each filter of a digest
+const digestHashes = 4
+
+// maxLevels is the number of levels of the topics whose candidate filters are looked up in digests.
+// Topics with more levels are assumed to match, as their candidates grow exponentially
+const maxLevels = 8
+
+// digest is a Bloom filter of the subscription filters of a broker, which may report filters it
+// doesn't contain, but never misses those it does
+type digest []byte
+
+// newDigest returns a digest of the filters with the number of bits, a multiple of 8
+func newDigest(bits int, filters []string) digest {
+	d := make(digest, bits/8)
+	for _, filter := range filters {
+		d.add(filter)
+	}
+	return d
+}
+
+// add adds the filter to the digest
+func (d digest) add(filter string) {
+	h1, h2 := hashes(filter)
+	bits := uint32(len(d) * 8)
+	for i := uint32(0); i < digestHashes; i++ {
+		b := (h1 + i*h2) % bits
+		d[b/8] |= 1 << (b % 8)
+	}
+}
+
+// contains returns whether the digest may contain the filter
+func (d digest) contains(filter string) bool {
+	if len(d) == 0 {
+		return false
+	}
+
+	h1, h2 := hashes(filter)
+	bits := uint32(len(d) * 8)
+	for i := uint32(0); i < digestHashes; i++ {
+		b := (h1 + i*h2) % bits
+		if d[b/8]&(1<<(b%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// matches returns whether the digest may contain a filter matching the topic, looking up each filter
+// which could match it
+func (d digest) matches(topic string) bool {
+	levels := strings.Split(topic, "/")
+	if len(levels) > maxLevels {
+		return true
+	}
+
+	return candidates(levels, strings.HasPrefix(topic, "$"), d.contains)
+}
+
+// hashes returns the two halves of the FNV-1a hash of the filter, from which its bits are derived
+func hashes(filter string) (uint32, uint32) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(filter))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// candidates calls fn with the filters which could match the topic of the levels until it returns
+// true, and returns whether it did. The first level of $ topics is only matched literally
+func candidates(levels []string, dollar bool, fn func(filter string) bool) bool {
+	var walk func(prefix string, i int) bool
+	walk = func(prefix string, i int) bool {
+		join := func(level string) string {
+			if i == 0 {
+				return level
+			}
+			return prefix + "/" + level
+		}
+
+		wildcards := !(dollar && i == 0)
+		if wildcards && fn(join("#")) {
+			return true
+		}
+
+		if i == len(levels) {
+			return fn(prefix)
+		}
+
+		if walk(join(levels[i]), i+1) {
+			return true
+		}
+
+		return wildcards && walk(join("+"), i+1)
+	}
+
+	return walk("", 0)
+}
+
+// subscriptionFilter returns the filter of a subscription, without the share name of a shared
+// subscription
+func subscriptionFilter(filter string) string {
+	if !strings.HasPrefix(filter, "$share/") {
+		return filter
+	}
+
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) < 3 {
+		return filter
+	}
+	return parts[2]
+}
+
+// state is the digest of a broker, superseding those of the broker with an older version
+type state struct {
+	node    string
+	version int64
+	digest  digest
+}
+
+// encode appends the state to the buffer as the length of the node name, the name, the version and
+// the length of the digest, as varints, followed by the digest
+func (s state) encode(buf []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s.node)))
+	buf = append(buf, s.node...)
+	buf = binary.AppendVarint(buf, s.version)
+	buf = binary.AppendUvarint(buf, uint64(len(s.digest)))
+	return append(buf, s.digest...)
+}
+
+// errMalformedState is returned when decoding a state which is truncated
+var errMalformedState = errors.New("malformed state")
+
+// decodeStates decodes the states appended to the buffer one after another
+func decodeStates(buf []byte) ([]state, error) {
+	var states []state
+	for len(buf) > 0 {
+		var s state
+		var err error
+		if s.node, buf, err = decodeBytes(buf); err != nil {
+			return nil, err
+		}
+
+		version, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, errMalformedState
+		}
+		s.version, buf = version, buf[n:]
+
+		var d string
+		if d, buf, err = decodeBytes(buf); err != nil {
+			return nil, err
+		}
+		s.digest = digest(d)
+		states = append(states, s)
+	}
+	return states, nil
+}
+
+// decodeBytes decodes a varint length followed by as many bytes, returning them and the rest of the
+// buffer
+func decodeBytes(buf []byte) (string, []byte, error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || size > uint64(len(buf)-n) {
+		return "", nil, errMalformedState
+	}
+	return string(buf[n : n+int(size)]), buf[n+int(size):], nil
+}
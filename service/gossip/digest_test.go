@@ -0,0 +1,108 @@
+package gossip
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestMatches(t *testing.T) {
+	d := newDigest(8192, []string{"devices/+/status", "alerts/#", "$SYS/broker/clients/+", "a/b"})
+
+	tests := []struct {
+		topic   string
+		matches bool
+	}{
+		{"devices/d1/status", true},
+		{"devices/d1/telemetry", false},
+		{"devices/status", false},
+		{"alerts", true},
+		{"alerts/fire/north", true},
+		{"$SYS/broker/clients/connected", true},
+		{"$SYS/broker/uptime", false},
+		{"a/b", true},
+		{"a/b/c", false},
+		{"a/b/c/d/e/f/g/h/i", true}, // too many levels to look up
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.matches, d.matches(tt.topic), tt.topic)
+	}
+
+	require.False(t, digest{}.matches("a/b"))
+}
+
+func TestDigestFalsePositives(t *testing.T) {
+	var filters []string
+	for i := 0; i < 500; i++ {
+		filters = append(filters, fmt.Sprintf("devices/d%d/+", i))
+	}
+	d := newDigest(8192, filters)
+
+	for i := 0; i < 500; i++ {
+		require.True(t, d.matches(fmt.Sprintf("devices/d%d/status", i)))
+	}
+
+	positives := 0
+	for i := 500; i < 1500; i++ {
+		if d.matches(fmt.Sprintf("devices/d%d/status", i)) {
+			positives++
+		}
+	}
+	require.Less(t, positives, 100)
+}
+
+func TestCandidates(t *testing.T) {
+	var filters []string
+	candidates([]string{"a", "b"}, false, func(filter string) bool {
+		filters = append(filters, filter)
+		return false
+	})
+	require.ElementsMatch(t, []string{"#", "a/#", "a/b/#", "a/b", "a/+/#", "a/+", "+/#", "+/b/#", "+/b", "+/+/#", "+/+"}, filters)
+
+	filters = nil
+	candidates([]string{"$SYS", "a"}, true, func(filter string) bool {
+		filters = append(filters, filter)
+		return false
+	})
+	require.ElementsMatch(t, []string{"$SYS/#", "$SYS/a/#", "$SYS/a", "$SYS/+/#", "$SYS/+"}, filters)
+
+	require.True(t, candidates([]string{"a", "b"}, false, func(filter string) bool { return filter == "a/+" }))
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	require.Equal(t, "a/b", subscriptionFilter("a/b"))
+	require.Equal(t, "a/+", subscriptionFilter("$share/group/a/+"))
+	require.Equal(t, "$share/group", subscriptionFilter("$share/group"))
+}
+
+func TestStates(t *testing.T) {
+	states := []state{
+		{node: "broker-1", version: 7, digest: newDigest(64, []string{"a/b"})},
+		{node: "broker-2", version: -1, digest: digest{}},
+	}
+
+	var buf []byte
+	for _, s := range states {
+		buf = s.encode(buf)
+	}
+
+	decoded, err := decodeStates(buf)
+	require.NoError(t, err)
+	require.Len(t, decoded, 2)
+	require.Equal(t, states[0], decoded[0])
+	require.Equal(t, "broker-2", decoded[1].node)
+	require.Equal(t, int64(-1), decoded[1].version)
+	require.Empty(t, decoded[1].digest)
+
+	for _, data := range [][]byte{
+		{0x05, 'a'},             // short name
+		{0x01, 'a'},             // no version
+		{0x01, 'a', 0x02},       // no digest
+		{0x01, 'a', 0x02, 0x09}, // short digest
+	} {
+		_, err := decodeStates(data)
+		require.ErrorIs(t, err, errMalformedState)
+	}
+}
@@ -0,0 +1,411 @@
+// Package gossip provides a hook which gossips digests of the subscriptions of the brokers of a cluster
+// between them through hashicorp/memberlist, so hooks forwarding messages between brokers, eg. the
+// fanout hook, only send the messages of topics which other brokers have subscribers to.
+//
+// The digest of a broker is a Bloom filter of the filters its clients are subscribed to, which may
+// report a topic has subscribers when it hasn't, but never misses one which has. Digests are rebuilt
+// as clients subscribe and unsubscribe, gossiped by memberlist, and forgotten when they aren't
+// refreshed.
+//
+// The hook is the Delegate of the memberlist of the application, which should forget the digests of
+// the brokers which leave through its event delegate, eg.:
+//
+//	config := memberlist.DefaultLANConfig()
+//	config.Name = "broker-1" // the Node of the hook
+//	config.Delegate = gossipHook
+//	config.Events = events{gossipHook}
+//
+//	type events struct{ hook *gossip.Hook }
+//
+//	func (e events) NotifyJoin(n *memberlist.Node)   {}
+//	func (e events) NotifyLeave(n *memberlist.Node)  { e.hook.Forget(n.Name) }
+//	func (e events) NotifyUpdate(n *memberlist.Node) {}
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Stats are the totals of the digests gossiped since the hook was initialized
+type Stats struct {
+	Rebuilt   int64 // the number of times the digest of the broker was rebuilt
+	Received  int64 // the number of newer digests received from other brokers
+	Expired   int64 // the number of digests of other brokers forgotten as they weren't refreshed
+	Malformed int64 // the number of messages and states received which could not be decoded
+}
+
+// broadcast is a digest waiting to be gossiped
+type broadcast struct {
+	data      []byte
+	remaining int // how many more times it is gossiped
+}
+
+// Hook is a hook that gossips the digest of the subscriptions of the broker to the other brokers of a
+// cluster, and tells which of them have subscribers to a topic
+type Hook struct {
+	config     Options
+	local      state                 // the digest of the broker
+	states     map[string]state      // the digests of the other brokers by node
+	seen       map[string]time.Time  // when the digests of the other brokers were last received
+	broadcasts map[string]*broadcast // the digests waiting to be gossiped by node
+	dirty      bool                  // whether the subscriptions changed since the digest was built
+	built      time.Time             // when the digest of the broker was last built
+	stats      Stats
+	cancel     context.CancelFunc // stops rebuilding the digest
+	wg         sync.WaitGroup
+	mu         sync.Mutex // guards local, states, seen, broadcasts, dirty, built and stats
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the gossip hook
+type Options struct {
+	// Server is the server whose subscriptions are gossiped. Required
+	Server *mqtt.Server
+
+	// Node is the name of the broker, which must be the Name of its memberlist, and defaults to the
+	// hostname, as it does
+	Node string
+
+	// DigestBits is the size of the digests in bits, a multiple of 8 which defaults to 8192. Larger
+	// digests report fewer topics without subscribers, but must fit in the gossip messages of
+	// memberlist, of about 1400 bytes
+	DigestBits int
+
+	// Interval is how often the digest is rebuilt once subscriptions change, and defaults to 1 second
+	Interval time.Duration
+
+	// Refresh is how often the digest is gossiped while subscriptions don't change, and defaults to
+	// 15 seconds
+	Refresh time.Duration
+
+	// Expiry is how long the digests of other brokers are kept without being refreshed, and defaults
+	// to 1 minute
+	Expiry time.Duration
+
+	// Retransmits is how many times each digest is gossiped by each broker, and defaults to 4
+	Retransmits int
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "gossip-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts rebuilding the digest of the broker
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	gossipHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if gossipHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if gossipHookConfig.Node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		gossipHookConfig.Node = hostname
+	}
+
+	if gossipHookConfig.DigestBits == 0 {
+		gossipHookConfig.DigestBits = 8192
+	}
+
+	if gossipHookConfig.DigestBits < 0 || gossipHookConfig.DigestBits%8 != 0 {
+		return errors.New("digest bits must be a positive multiple of 8")
+	}
+
+	if gossipHookConfig.Interval <= 0 {
+		gossipHookConfig.Interval = time.Second
+	}
+
+	if gossipHookConfig.Refresh <= 0 {
+		gossipHookConfig.Refresh = 15 * time.Second
+	}
+
+	if gossipHookConfig.Expiry <= 0 {
+		gossipHookConfig.Expiry = time.Minute
+	}
+
+	if gossipHookConfig.Retransmits <= 0 {
+		gossipHookConfig.Retransmits = 4
+	}
+
+	h.config = gossipHookConfig
+	h.local = state{node: gossipHookConfig.Node}
+	h.states = make(map[string]state)
+	h.seen = make(map[string]time.Time)
+	h.broadcasts = make(map[string]*broadcast)
+	h.dirty = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.wg.Add(1)
+	go h.run(ctx)
+
+	return nil
+}
+
+// Stop stops rebuilding the digest of the broker
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+		h.wg.Wait()
+	}
+	return nil
+}
+
+// Stats returns the totals of the digests gossiped so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// OnSubscribed is called when a client subscribes, and rebuilds the digest of the broker
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	h.changed()
+}
+
+// OnUnsubscribed is called when a client unsubscribes or its session ends, and rebuilds the digest
+// of the broker
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	h.changed()
+}
+
+// changed rebuilds the digest of the broker at the next interval
+func (h *Hook) changed() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dirty = true
+}
+
+// Interested returns whether another broker may have subscribers to the topic
+func (h *Hook) Interested(topic string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, s := range h.states {
+		if s.digest.matches(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Nodes returns the names of the other brokers which may have subscribers to the topic
+func (h *Hook) Nodes(topic string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var nodes []string
+	for node, s := range h.states {
+		if s.digest.matches(topic) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Forget forgets the digest of a broker which left the cluster, until it gossips a newer one
+func (h *Hook) Forget(node string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.states, node)
+	delete(h.seen, node)
+	delete(h.broadcasts, node)
+}
+
+// run rebuilds the digest of the broker when subscriptions change or it is to be refreshed, and
+// forgets the digests of the other brokers which expired, until the context is cancelled
+func (h *Hook) run(ctx context.Context) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.tick()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick rebuilds the digest of the broker if needed, and forgets the expired digests
+func (h *Hook) tick() {
+	h.mu.Lock()
+	rebuild := h.dirty || time.Since(h.built) >= h.config.Refresh
+	h.dirty = false
+	h.mu.Unlock()
+
+	if rebuild {
+		h.rebuild()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	expired := time.Now().Add(-h.config.Expiry)
+	for node, seen := range h.seen {
+		if seen.Before(expired) {
+			delete(h.states, node)
+			delete(h.seen, node)
+			delete(h.broadcasts, node)
+			h.stats.Expired++
+		}
+	}
+}
+
+// rebuild builds the digest of the subscriptions of the clients of the broker, and gossips it with a
+// newer version
+func (h *Hook) rebuild() {
+	var filters []string
+	for _, cl := range h.config.Server.Clients.GetAll() {
+		for filter := range cl.State.Subscriptions.GetAll() {
+			filters = append(filters, subscriptionFilter(filter))
+		}
+	}
+
+	d := newDigest(h.config.DigestBits, filters)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	version := time.Now().UnixNano()
+	if version <= h.local.version {
+		version = h.local.version + 1
+	}
+
+	h.local = state{node: h.config.Node, version: version, digest: d}
+	h.built = time.Now()
+	h.broadcasts[h.config.Node] = &broadcast{data: h.local.encode(nil), remaining: h.config.Retransmits}
+	h.stats.Rebuilt++
+}
+
+// merge keeps the state if it is newer than the digest of its broker, gossiping it on if it was
+// received by gossip. The lock must be held
+func (h *Hook) merge(s state, gossip bool) {
+	if s.node == h.config.Node {
+		return
+	}
+
+	if current, ok := h.states[s.node]; ok && current.version >= s.version {
+		return
+	}
+
+	h.states[s.node] = s
+	h.seen[s.node] = time.Now()
+	h.stats.Received++
+
+	if gossip {
+		h.broadcasts[s.node] = &broadcast{data: s.encode(nil), remaining: h.config.Retransmits}
+	}
+}
+
+// NodeMeta is called by memberlist for the metadata of the broker, which it has none of
+func (h *Hook) NodeMeta(limit int) []byte {
+	return nil
+}
+
+// NotifyMsg is called by memberlist with a digest gossiped by another broker
+func (h *Hook) NotifyMsg(msg []byte) {
+	states, err := decodeStates(msg)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil {
+		h.Log.Warn("malformed gossiped digest", "error", err)
+		h.stats.Malformed++
+		return
+	}
+
+	for _, s := range states {
+		h.merge(s, true)
+	}
+}
+
+// GetBroadcasts is called by memberlist for the digests to gossip, whose sizes with the overhead of
+// each must not exceed the limit
+func (h *Hook) GetBroadcasts(overhead, limit int) [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var msgs [][]byte
+	for node, b := range h.broadcasts {
+		if len(b.data)+overhead > limit {
+			continue
+		}
+
+		msgs = append(msgs, b.data)
+		limit -= len(b.data) + overhead
+		b.remaining--
+		if b.remaining <= 0 {
+			delete(h.broadcasts, node)
+		}
+	}
+	return msgs
+}
+
+// LocalState is called by memberlist for the digests the broker knows, which it sends to another
+// broker when they synchronize their states
+func (h *Hook) LocalState(join bool) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buf := h.local.encode(nil)
+	for _, s := range h.states {
+		buf = s.encode(buf)
+	}
+	return buf
+}
+
+// MergeRemoteState is called by memberlist with the digests known by another broker when they
+// synchronize their states
+func (h *Hook) MergeRemoteState(buf []byte, join bool) {
+	states, err := decodeStates(buf)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil {
+		h.Log.Warn("malformed remote gossip state", "error", err)
+		h.stats.Malformed++
+		return
+	}
+
+	for _, s := range states {
+		h.merge(s, false)
+	}
+}
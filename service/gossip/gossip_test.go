@@ -0,0 +1,237 @@
+package gossip
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// newHook returns a hook of a broker named node
+func newHook(t *testing.T, server *mqtt.Server, node string) *Hook {
+	t.Helper()
+
+	gossipHook := new(Hook)
+	gossipHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, gossipHook.Init(Options{Server: server, Node: node, Interval: 10 * time.Millisecond}))
+	t.Cleanup(func() { gossipHook.Stop() })
+	return gossipHook
+}
+
+// subscribe adds a client subscribed to the filters to the server
+func subscribe(t *testing.T, server *mqtt.Server, id string, filters ...string) *mqtt.Client {
+	t.Helper()
+
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+	go io.Copy(io.Discard, w)
+
+	cl := server.NewClient(r, "tcp", id, false)
+	server.Clients.Add(cl)
+	for _, filter := range filters {
+		cl.State.Subscriptions.Add(filter, packets.Subscription{Filter: filter})
+	}
+	return cl
+}
+
+// exchange delivers the broadcasts of the hook to the others until none are left, as memberlist
+// gossips them
+func exchange(from *Hook, to ...*Hook) {
+	for {
+		msgs := from.GetBroadcasts(3, 1400)
+		if len(msgs) == 0 {
+			return
+		}
+
+		for _, msg := range msgs {
+			for _, h := range to {
+				h.NotifyMsg(msg)
+			}
+		}
+	}
+}
+
+func TestID(t *testing.T) {
+	gossipHook := new(Hook)
+
+	require.Equal(t, "gossip-hook", gossipHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	gossipHook := new(Hook)
+	require.True(t, gossipHook.Provides(mqtt.OnSubscribed))
+	require.True(t, gossipHook.Provides(mqtt.OnUnsubscribed))
+	require.False(t, gossipHook.Provides(mqtt.OnPublished))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid digest bits",
+			config:      Options{Server: mqtt.New(nil), DigestBits: 100},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			gossipHook := new(Hook)
+			gossipHook.Log = slog.Default()
+			err := gossipHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer gossipHook.Stop()
+
+			hostname, _ := os.Hostname()
+			require.Equal(t, hostname, gossipHook.config.Node)
+			require.Equal(t, 8192, gossipHook.config.DigestBits)
+			require.Equal(t, time.Second, gossipHook.config.Interval)
+			require.Equal(t, 15*time.Second, gossipHook.config.Refresh)
+			require.Equal(t, time.Minute, gossipHook.config.Expiry)
+			require.Equal(t, 4, gossipHook.config.Retransmits)
+
+		})
+	}
+}
+
+func TestGossip(t *testing.T) {
+	s1, s2, s3 := mqtt.New(nil), mqtt.New(nil), mqtt.New(nil)
+	subscribe(t, s1, "c1", "devices/+/status", "$share/group/alerts/#")
+	h1, h2, h3 := newHook(t, s1, "broker-1"), newHook(t, s2, "broker-2"), newHook(t, s3, "broker-3")
+	require.Eventually(t, func() bool { return h1.Stats().Rebuilt == 1 }, time.Second, time.Millisecond)
+
+	// digests are gossiped on by the brokers receiving them
+	exchange(h1, h2)
+	exchange(h2, h3)
+	for _, h := range []*Hook{h2, h3} {
+		require.True(t, h.Interested("devices/d1/status"))
+		require.True(t, h.Interested("alerts/fire"))
+		require.False(t, h.Interested("devices/d1/telemetry"))
+		require.Equal(t, []string{"broker-1"}, h.Nodes("alerts/fire"))
+	}
+	require.False(t, h1.Interested("devices/d1/status"))
+
+	// digests are rebuilt as subscriptions change, and superseded
+	cl := subscribe(t, s1, "c2", "devices/+/telemetry")
+	h1.OnSubscribed(cl, packets.Packet{}, []byte{0})
+	require.Eventually(t, func() bool { return h1.Stats().Rebuilt == 2 }, time.Second, time.Millisecond)
+	exchange(h1, h2)
+	require.True(t, h2.Interested("devices/d1/telemetry"))
+
+	s1.Clients.Delete("c2")
+	h1.OnUnsubscribed(cl, packets.Packet{})
+	require.Eventually(t, func() bool { return h1.Stats().Rebuilt == 3 }, time.Second, time.Millisecond)
+	exchange(h1, h2)
+	require.False(t, h2.Interested("devices/d1/telemetry"))
+
+	// older digests are ignored
+	old := state{node: "broker-1", version: 1, digest: newDigest(64, []string{"#"})}
+	h2.NotifyMsg(old.encode(nil))
+	require.False(t, h2.Interested("devices/d1/telemetry"))
+	require.Equal(t, int64(3), h2.Stats().Received)
+
+	h2.Forget("broker-1")
+	require.False(t, h2.Interested("devices/d1/status"))
+}
+
+func TestSynchronize(t *testing.T) {
+	s1 := mqtt.New(nil)
+	subscribe(t, s1, "c1", "a/b")
+	h1, h2, h3 := newHook(t, s1, "broker-1"), newHook(t, mqtt.New(nil), "broker-2"), newHook(t, mqtt.New(nil), "broker-3")
+	require.Eventually(t, func() bool { return h1.Stats().Rebuilt == 1 }, time.Second, time.Millisecond)
+
+	// the states of brokers include the digests they know, which aren't gossiped on
+	h2.MergeRemoteState(h1.LocalState(true), true)
+	h3.MergeRemoteState(h2.LocalState(false), false)
+	require.True(t, h3.Interested("a/b"))
+	require.Equal(t, []string{"broker-1"}, h3.Nodes("a/b"))
+
+	h2.mu.Lock()
+	require.NotContains(t, h2.broadcasts, "broker-1")
+	h2.mu.Unlock()
+
+	h2.NotifyMsg([]byte{0x05})
+	h2.MergeRemoteState([]byte{0x05}, false)
+	require.Equal(t, int64(2), h2.Stats().Malformed)
+}
+
+func TestGetBroadcasts(t *testing.T) {
+	h1 := newHook(t, mqtt.New(nil), "broker-1")
+	require.Eventually(t, func() bool { return h1.Stats().Rebuilt == 1 }, time.Second, time.Millisecond)
+
+	// digests larger than the limit wait
+	require.Empty(t, h1.GetBroadcasts(3, 100))
+
+	for i := 0; i < 4; i++ {
+		require.Len(t, h1.GetBroadcasts(3, 1400), 1)
+	}
+	require.Empty(t, h1.GetBroadcasts(3, 1400))
+	require.Nil(t, h1.NodeMeta(512))
+}
+
+func TestExpiry(t *testing.T) {
+	s1 := mqtt.New(nil)
+	subscribe(t, s1, "c1", "a/b")
+	h1, h2 := new(Hook), new(Hook)
+	h1.Log, h2.Log = slog.Default(), slog.Default()
+	require.NoError(t, h1.Init(Options{Server: s1, Node: "broker-1", Interval: 10 * time.Millisecond, Refresh: 20 * time.Millisecond}))
+	defer h1.Stop()
+	require.NoError(t, h2.Init(Options{Server: mqtt.New(nil), Node: "broker-2", Interval: 10 * time.Millisecond, Expiry: 50 * time.Millisecond}))
+	defer h2.Stop()
+
+	// refreshed digests are kept
+	deadline := time.Now().Add(150 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		exchange(h1, h2)
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.Zero(t, h2.Stats().Expired)
+	require.Equal(t, []string{"broker-1"}, h2.Nodes("a/b"))
+
+	require.Eventually(t, func() bool { return h2.Stats().Expired == 1 }, time.Second, time.Millisecond)
+	require.Empty(t, h2.Nodes("a/b"))
+}
+
+func TestStop(t *testing.T) {
+	require.NoError(t, new(Hook).Stop())
+
+	gossipHook := newHook(t, mqtt.New(nil), "broker-1")
+	require.NoError(t, gossipHook.Stop())
+}
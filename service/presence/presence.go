@@ -0,0 +1,282 @@
+// Package presence provides a hook publishing the online and offline status of clients as retained
+// JSON documents, eg. to presence/{clientid}, replacing hand-rolled last will conventions.
+package presence
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// ClientID is the id of the inline client which publishes the statuses
+const ClientID = "presence"
+
+// the statuses of clients
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// Status is the document published when a client connects or disconnects
+type Status struct {
+	Status    string    `json:"status"`
+	ClientID  string    `json:"clientid"`
+	Username  string    `json:"username,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Listener  string    `json:"listener"`
+	Protocol  byte      `json:"protocol"`
+	Clean     bool      `json:"clean"`
+	Keepalive uint16    `json:"keepalive,omitempty"` // online only
+	Reason    string    `json:"reason,omitempty"`    // offline only, why the client disconnected
+	Expired   bool      `json:"expired,omitempty"`   // offline only, whether the session ended with it
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Stats are the totals of the statuses published since the hook was initialized
+type Stats struct {
+	Online  int64 // the number of online statuses published
+	Offline int64 // the number of offline statuses published
+	Cleared int64 // the number of statuses cleared as sessions expired
+	Failed  int64 // the number of statuses which could not be published
+}
+
+// Hook is a hook that publishes the online and offline status of clients
+type Hook struct {
+	config  Options
+	client  *mqtt.Client
+	current sync.Map // the connection of each client id, so a taken over session isn't reported offline
+	now     func() time.Time
+	stats   Stats
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the presence hook
+type Options struct {
+	// Server is the server the statuses are published to. Required
+	Server *mqtt.Server
+
+	// Topic is the topic the statuses are published to, a template in which {clientid} is the id of
+	// the client, {username} its username and {listener} its listener, and defaults to
+	// presence/{clientid}. Clients whose values would add topic levels or wildcards are skipped
+	Topic string
+
+	// Qos is the QoS the statuses are published with
+	Qos byte
+
+	// Clear clears the retained status of clients whose sessions expire, so the statuses of clients
+	// which never come back don't accumulate
+	Clear bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "presence-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnClientExpired,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	presenceHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if presenceHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if presenceHookConfig.Topic == "" {
+		presenceHookConfig.Topic = "presence/{clientid}"
+	}
+
+	if presenceHookConfig.Qos > 2 {
+		return fmt.Errorf("invalid qos %d", presenceHookConfig.Qos)
+	}
+
+	values := map[string]string{"clientid": "c", "username": "u", "listener": "l"}
+	if topic, err := render(presenceHookConfig.Topic, values); err != nil {
+		return fmt.Errorf("invalid topic %q: %w", presenceHookConfig.Topic, err)
+	} else if !mqtt.IsValidFilter(topic, true) {
+		return fmt.Errorf("invalid topic %q", presenceHookConfig.Topic)
+	}
+
+	h.config = presenceHookConfig
+	h.client = presenceHookConfig.Server.NewClient(nil, "local", ClientID, true)
+	h.client.Properties.ProtocolVersion = 5
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	return nil
+}
+
+// Stats returns the totals of the statuses published so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// OnSessionEstablished is called when a client has connected and authenticated, and publishes that it
+// is online
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if cl.Net.Inline {
+		return
+	}
+
+	h.current.Store(cl.ID, cl)
+	h.publish(cl, &Status{
+		Status:    StatusOnline,
+		Keepalive: cl.State.Keepalive,
+	})
+}
+
+// OnDisconnect is called when a client which had connected disconnects, and publishes that it is
+// offline, unless its session was taken over by a new connection
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if cl.Net.Inline || !h.current.CompareAndDelete(cl.ID, cl) {
+		return
+	}
+
+	reason := "disconnected"
+	if err != nil {
+		reason = err.Error()
+	}
+
+	h.publish(cl, &Status{
+		Status:  StatusOffline,
+		Reason:  reason,
+		Expired: expire,
+	})
+}
+
+// OnClientExpired is called when the session of a disconnected client expires, and clears its status
+// if Clear is set
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	if !h.config.Clear || cl.Net.Inline {
+		return
+	}
+
+	h.publish(cl, nil)
+}
+
+// publish publishes the status of the client, or clears it if the status is nil
+func (h *Hook) publish(cl *mqtt.Client, status *Status) {
+	topic, err := render(h.config.Topic, map[string]string{
+		"clientid": cl.ID,
+		"username": string(cl.Properties.Username),
+		"listener": cl.Net.Listener,
+	})
+	if err != nil {
+		h.Log.Debug("skipped presence of client", "error", err, "client", cl.ID)
+		return
+	}
+
+	var payload []byte
+	if status != nil {
+		status.ClientID = cl.ID
+		status.Username = string(cl.Properties.Username)
+		status.IP = host(cl.Net.Remote)
+		status.Listener = cl.Net.Listener
+		status.Protocol = cl.Properties.ProtocolVersion
+		status.Clean = cl.Properties.Clean
+		status.Timestamp = h.now().UTC()
+		if payload, err = json.Marshal(status); err != nil {
+			h.count(status, err)
+			return
+		}
+	}
+
+	err = h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    h.config.Qos,
+			Retain: true,
+		},
+		TopicName: topic,
+		Payload:   payload,
+		PacketID:  uint16(h.config.Qos),
+	})
+	if err != nil {
+		h.Log.Error("error occurred while publishing presence", "error", err, "client", cl.ID, "topic", topic)
+	}
+	h.count(status, err)
+}
+
+// count counts the status which was published, or failed
+func (h *Hook) count(status *Status, err error) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+
+	switch {
+	case err != nil:
+		h.stats.Failed++
+	case status == nil:
+		h.stats.Cleared++
+	case status.Status == StatusOnline:
+		h.stats.Online++
+	default:
+		h.stats.Offline++
+	}
+}
+
+// host returns the host of the remote address, without its port
+func host(remote string) string {
+	if h, _, err := net.SplitHostPort(remote); err == nil {
+		return h
+	}
+	return remote
+}
+
+// render substitutes the {placeholders} of the topic template with the values, which must not be
+// empty or add topic levels or wildcards
+func render(template string, values map[string]string) (string, error) {
+	var sb strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			sb.WriteString(template)
+			return sb.String(), nil
+		}
+
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", errors.New("unclosed placeholder")
+		}
+
+		name := template[start+1 : start+end]
+		value, ok := values[name]
+		if !ok {
+			return "", fmt.Errorf("unknown placeholder {%s}", name)
+		}
+
+		if value == "" || strings.ContainsAny(value, "/+#") {
+			return "", fmt.Errorf("invalid value %q of placeholder {%s}", value, name)
+		}
+
+		sb.WriteString(template[:start])
+		sb.WriteString(value)
+		template = template[start+end+1:]
+	}
+}
@@ -0,0 +1,222 @@
+package presence
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(nil)
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	presenceHook := new(Hook)
+	presenceHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	presenceHook.now = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+	require.NoError(t, presenceHook.Init(options))
+	return presenceHook
+}
+
+func newClient(server *mqtt.Server, id, username string) *mqtt.Client {
+	cl := server.NewClient(nil, "t1", id, false)
+	cl.Net.Remote = "10.0.0.1:51234"
+	cl.Properties.Username = []byte(username)
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Clean = true
+	cl.State.Keepalive = 30
+	return cl
+}
+
+// status returns the retained status of the topic, or nil if there is none
+func status(t *testing.T, server *mqtt.Server, topic string) *Status {
+	t.Helper()
+
+	pk, ok := server.Topics.Retained.Get(topic)
+	if !ok {
+		return nil
+	}
+
+	s := new(Status)
+	require.NoError(t, json.Unmarshal(pk.Payload, s))
+	return s
+}
+
+func TestID(t *testing.T) {
+	presenceHook := new(Hook)
+
+	require.Equal(t, "presence-hook", presenceHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	presenceHook := new(Hook)
+
+	require.True(t, presenceHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, presenceHook.Provides(mqtt.OnDisconnect))
+	require.False(t, presenceHook.Provides(mqtt.OnPublished))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - defaults",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Success - topic",
+			config:      Options{Server: mqtt.New(nil), Topic: "tenants/{username}/presence/{clientid}", Qos: 1},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid qos",
+			config:      Options{Server: mqtt.New(nil), Qos: 3},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown placeholder",
+			config:      Options{Server: mqtt.New(nil), Topic: "presence/{device}"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - wildcard topic",
+			config:      Options{Server: mqtt.New(nil), Topic: "presence/+/{clientid}"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			presenceHook := new(Hook)
+			presenceHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := presenceHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.NotEmpty(t, presenceHook.config.Topic)
+			}
+
+		})
+	}
+}
+
+func TestPresence(t *testing.T) {
+	server := newServer(t)
+	presenceHook := newHook(t, Options{Server: server})
+
+	cl := newClient(server, "device-1", "alice")
+	presenceHook.OnSessionEstablished(cl, packets.Packet{})
+	require.Equal(t, &Status{
+		Status:    StatusOnline,
+		ClientID:  "device-1",
+		Username:  "alice",
+		IP:        "10.0.0.1",
+		Listener:  "t1",
+		Protocol:  5,
+		Clean:     true,
+		Keepalive: 30,
+		Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, status(t, server, "presence/device-1"))
+
+	presenceHook.OnDisconnect(cl, packets.ErrKeepAliveTimeout, true)
+	require.Equal(t, &Status{
+		Status:    StatusOffline,
+		ClientID:  "device-1",
+		Username:  "alice",
+		IP:        "10.0.0.1",
+		Listener:  "t1",
+		Protocol:  5,
+		Clean:     true,
+		Reason:    packets.ErrKeepAliveTimeout.Error(),
+		Expired:   true,
+		Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, status(t, server, "presence/device-1"))
+
+	require.Equal(t, Stats{Online: 1, Offline: 1}, presenceHook.Stats())
+}
+
+func TestTakeover(t *testing.T) {
+	server := newServer(t)
+	presenceHook := newHook(t, Options{Server: server})
+
+	// the old connection disconnecting after the new one is established isn't reported offline
+	old, cl := newClient(server, "device-1", "alice"), newClient(server, "device-1", "alice")
+	presenceHook.OnSessionEstablished(old, packets.Packet{})
+	presenceHook.OnSessionEstablished(cl, packets.Packet{})
+	presenceHook.OnDisconnect(old, packets.ErrSessionTakenOver, false)
+	require.Equal(t, StatusOnline, status(t, server, "presence/device-1").Status)
+
+	presenceHook.OnDisconnect(cl, nil, false)
+	require.Equal(t, "disconnected", status(t, server, "presence/device-1").Reason)
+	require.Equal(t, Stats{Online: 2, Offline: 1}, presenceHook.Stats())
+}
+
+func TestTopic(t *testing.T) {
+	server := newServer(t)
+	presenceHook := newHook(t, Options{Server: server, Topic: "tenants/{username}/{listener}/{clientid}"})
+
+	presenceHook.OnSessionEstablished(newClient(server, "device-1", "acme"), packets.Packet{})
+	require.NotNil(t, status(t, server, "tenants/acme/t1/device-1"))
+
+	// clients whose values would change the levels of the topic are skipped
+	presenceHook.OnSessionEstablished(newClient(server, "device-2", "acme/other"), packets.Packet{})
+	presenceHook.OnSessionEstablished(newClient(server, "device-3", ""), packets.Packet{})
+	require.Equal(t, Stats{Online: 1}, presenceHook.Stats())
+}
+
+func TestClear(t *testing.T) {
+	server := newServer(t)
+	presenceHook := newHook(t, Options{Server: server, Clear: true})
+
+	cl := newClient(server, "device-1", "alice")
+	presenceHook.OnSessionEstablished(cl, packets.Packet{})
+	presenceHook.OnDisconnect(cl, errors.New("EOF"), false)
+	require.NotNil(t, status(t, server, "presence/device-1"))
+
+	presenceHook.OnClientExpired(cl)
+	require.Nil(t, status(t, server, "presence/device-1"))
+	require.Equal(t, Stats{Online: 1, Offline: 1, Cleared: 1}, presenceHook.Stats())
+}
+
+func TestInline(t *testing.T) {
+	server := newServer(t)
+	presenceHook := newHook(t, Options{Server: server})
+
+	presenceHook.OnSessionEstablished(server.NewClient(nil, "local", "inline", true), packets.Packet{})
+	require.Equal(t, Stats{}, presenceHook.Stats())
+}
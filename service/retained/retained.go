@@ -0,0 +1,420 @@
+// Package retained provides a hook which replicates the retained messages of each broker of a cluster
+// to the others, so clients receive the same retained messages whichever broker they connect to.
+// Messages are not delivered between the brokers, only retained by them, eg. alongside the fanout
+// hook, or for clusters where publishers and subscribers are balanced across brokers.
+//
+// Each retained message set or cleared on a broker is sent to the others through a Transport, with the
+// time it changed as its version, and the others keep the latest version of each topic. When a broker
+// starts, it asks the others for their retained messages and the clears they remember, so it catches
+// up with the changes it missed while it was stopped.
+//
+// Replicated messages are retained directly in the topics of the server, so they are not seen by the
+// storage hooks of the brokers receiving them, which catch up again when they restart.
+package retained
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/records"
+)
+
+// kinds of events
+const (
+	kindSet   = "set"   // a message was retained
+	kindClear = "clear" // a retained message was cleared
+	kindSync  = "sync"  // a broker asks for the retained messages and clears of the others
+)
+
+// event is a change of the retained messages, or a sync request, sent between the brokers
+type event struct {
+	Kind    string           `json:"kind"`
+	Origin  string           `json:"origin"` // the broker which sent the event
+	Topic   string           `json:"topic,omitempty"`
+	Version int64            `json:"version,omitempty"` // when the message changed in unix nanoseconds
+	Author  string           `json:"author,omitempty"`  // the broker where the message changed
+	Message *storage.Message `json:"message,omitempty"`
+}
+
+// version is the latest change of the retained message of a topic, on the broker with the author
+// origin
+type version struct {
+	at      int64
+	author  string
+	cleared bool
+}
+
+// newer returns whether the version is newer than v, ordering the versions of the same time by author
+func (ver version) newer(v version) bool {
+	return ver.at > v.at || ver.at == v.at && ver.author > v.author
+}
+
+// Stats are the totals of the changes replicated since the hook was initialized
+type Stats struct {
+	Sent    int64 // the number of changes sent to the other brokers
+	Applied int64 // the number of changes received from other brokers and applied
+	Stale   int64 // the number of changes received which were older than those of the broker
+	Synced  int64 // the number of sync requests of other brokers answered
+	Failed  int64 // the number of events which could not be sent or decoded
+}
+
+// Hook is a hook that replicates the retained messages of the broker to the other brokers of a
+// cluster, and retains the messages they replicate
+type Hook struct {
+	config   Options
+	versions map[string]version // the latest changes of the retained messages and recent clears by topic
+	pruned   time.Time          // when the expired clears were last forgotten
+	stop     func() error
+	stats    Stats
+	mu       sync.Mutex // guards versions, pruned and stop
+	statsMu  sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the retained hook
+type Options struct {
+	// Server is the server whose retained messages are replicated. Required
+	Server *mqtt.Server
+
+	// Transport carries the changes between the brokers, eg. a NATSTransport, RedisTransport or
+	// ServerTransport. Required
+	Transport Transport
+
+	// Filters are the topics whose retained messages are replicated, and default to "#". Topics
+	// starting with $ are only matched by filters starting with them
+	Filters []string
+
+	// Origin identifies the broker in the changes it sends, so those received back are skipped. It
+	// must be unique to each broker, and defaults to a random id
+	Origin string
+
+	// Timeout bounds sending each change, and defaults to 5 seconds
+	Timeout time.Duration
+
+	// ClearTTL is how long clears are remembered to be sent to the brokers which start, and defaults
+	// to 24 hours. Brokers stopped for longer may keep messages cleared meanwhile
+	ClearTTL time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "retained-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnRetainMessage,
+		mqtt.OnRetainedExpired,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	retainedHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if retainedHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if retainedHookConfig.Transport == nil {
+		return errors.New("transport is required")
+	}
+
+	if len(retainedHookConfig.Filters) == 0 {
+		retainedHookConfig.Filters = []string{"#"}
+	}
+
+	for _, filter := range retainedHookConfig.Filters {
+		if !mqtt.IsValidFilter(filter, false) {
+			return fmt.Errorf("invalid filter %q", filter)
+		}
+	}
+
+	if retainedHookConfig.Origin == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		retainedHookConfig.Origin = hex.EncodeToString(b)
+	}
+
+	if retainedHookConfig.Timeout <= 0 {
+		retainedHookConfig.Timeout = 5 * time.Second
+	}
+
+	if retainedHookConfig.ClearTTL <= 0 {
+		retainedHookConfig.ClearTTL = 24 * time.Hour
+	}
+
+	h.config = retainedHookConfig
+	h.versions = make(map[string]version)
+	h.pruned = time.Now()
+
+	return nil
+}
+
+// OnStarted is called when the server has started, and starts receiving the changes of the other
+// brokers, asking them for their retained messages
+func (h *Hook) OnStarted() {
+	stop, err := h.config.Transport.Receive(h.receive, func(err error) {
+		h.Log.Error("error occurred while receiving retained messages", "error", err)
+	})
+	if err != nil {
+		h.Log.Error("error occurred while receiving retained messages", "error", err)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.mu.Lock()
+	h.stop = stop
+	h.mu.Unlock()
+
+	h.send(event{Kind: kindSync, Origin: h.config.Origin})
+}
+
+// Stop stops receiving the changes of the other brokers
+func (h *Hook) Stop() error {
+	h.mu.Lock()
+	stop := h.stop
+	h.stop = nil
+	h.mu.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+	return stop()
+}
+
+// Stats returns the totals of the changes replicated so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
+
+// OnRetainMessage is called when a message is retained or cleared, and sends the change to the other
+// brokers if its topic matches a filter
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if !h.matches(pk.TopicName) {
+		return
+	}
+
+	ev := event{Kind: kindSet, Origin: h.config.Origin, Topic: pk.TopicName, Author: h.config.Origin}
+	if len(pk.Payload) == 0 {
+		ev.Kind = kindClear
+	} else {
+		ev.Message = records.Retained(pk)
+	}
+
+	h.mu.Lock()
+	v := version{at: time.Now().UnixNano(), author: h.config.Origin, cleared: ev.Kind == kindClear}
+	if current := h.version(pk.TopicName); v.at <= current.at {
+		v.at = current.at + 1
+	}
+	ev.Version = v.at
+	h.versions[pk.TopicName] = v
+
+	// a change received from another broker may have been applied since the server retained the
+	// message, which is newer
+	h.config.Server.Topics.RetainMessage(pk.Copy(false))
+	if v.cleared {
+		h.prune()
+	}
+	h.mu.Unlock()
+
+	h.send(ev)
+}
+
+// OnRetainedExpired is called when a retained message expires, and forgets its version, as the other
+// brokers expire it too
+func (h *Hook) OnRetainedExpired(topic string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.versions, topic)
+}
+
+// matches returns whether the topic matches a filter
+func (h *Hook) matches(topic string) bool {
+	for _, filter := range h.config.Filters {
+		if acl.Match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// version returns the latest change of the retained message of the topic. Messages retained before
+// the hook saw them, eg. restored by a storage hook, are versioned by the time they were created. The
+// lock must be held
+func (h *Hook) version(topic string) version {
+	if v, ok := h.versions[topic]; ok {
+		return v
+	}
+
+	if pk, ok := h.config.Server.Topics.Retained.Get(topic); ok {
+		return version{at: pk.Created * int64(time.Second)}
+	}
+
+	return version{}
+}
+
+// prune forgets the clears older than ClearTTL, once a minute at most. The lock must be held
+func (h *Hook) prune() {
+	if time.Since(h.pruned) < time.Minute {
+		return
+	}
+	h.pruned = time.Now()
+
+	expired := time.Now().Add(-h.config.ClearTTL).UnixNano()
+	for topic, v := range h.versions {
+		if v.cleared && v.at < expired {
+			delete(h.versions, topic)
+		}
+	}
+}
+
+// send sends the event to the other brokers
+func (h *Hook) send(ev event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		h.Log.Error("error occurred while encoding retained message change", "error", err, "topic", ev.Topic)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	if err := h.config.Transport.Send(ctx, data); err != nil {
+		h.Log.Error("error occurred while sending retained message change", "error", err, "kind", ev.Kind, "topic", ev.Topic)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	if ev.Kind != kindSync {
+		h.count(func(s *Stats) { s.Sent++ })
+	}
+}
+
+// receive applies a change received from another broker, or answers its sync request
+func (h *Hook) receive(data []byte) {
+	var ev event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		h.Log.Error("error occurred while decoding retained message change", "error", err)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	if ev.Origin == h.config.Origin {
+		return
+	}
+
+	switch ev.Kind {
+	case kindSync:
+		h.sync()
+	case kindSet, kindClear:
+		h.apply(ev)
+	default:
+		h.Log.Warn("unknown retained message change", "kind", ev.Kind, "origin", ev.Origin)
+	}
+}
+
+// apply retains or clears the message of the change, if it is newer than the one of the broker
+func (h *Hook) apply(ev event) {
+	if !h.matches(ev.Topic) {
+		return
+	}
+
+	pk := packets.Packet{TopicName: ev.Topic}
+	if ev.Kind == kindSet {
+		if ev.Message == nil || len(ev.Message.Payload) == 0 || ev.Message.TopicName != ev.Topic {
+			h.Log.Error("invalid retained message change", "origin", ev.Origin, "topic", ev.Topic)
+			h.count(func(s *Stats) { s.Failed++ })
+			return
+		}
+
+		pk = ev.Message.ToPacket()
+		pk.FixedHeader.Retain = true
+	}
+
+	h.mu.Lock()
+	v := version{at: ev.Version, author: ev.Author, cleared: ev.Kind == kindClear}
+	if !v.newer(h.version(ev.Topic)) {
+		h.mu.Unlock()
+		h.count(func(s *Stats) { s.Stale++ })
+		return
+	}
+
+	h.versions[ev.Topic] = v
+	h.config.Server.Topics.RetainMessage(pk)
+	if v.cleared {
+		h.prune()
+	}
+	h.mu.Unlock()
+
+	atomic.StoreInt64(&h.config.Server.Info.Retained, int64(h.config.Server.Topics.Retained.Len()))
+	h.count(func(s *Stats) { s.Applied++ })
+}
+
+// sync sends the retained messages and the clears of the broker to a broker which has started
+func (h *Hook) sync() {
+	var events []event
+
+	h.mu.Lock()
+	for topic, pk := range h.config.Server.Topics.Retained.GetAll() {
+		if h.matches(topic) {
+			v := h.version(topic)
+			events = append(events, event{
+				Kind:    kindSet,
+				Origin:  h.config.Origin,
+				Topic:   topic,
+				Version: v.at,
+				Author:  v.author,
+				Message: records.Retained(pk),
+			})
+		}
+	}
+
+	expired := time.Now().Add(-h.config.ClearTTL).UnixNano()
+	for topic, v := range h.versions {
+		if v.cleared && v.at >= expired {
+			events = append(events, event{Kind: kindClear, Origin: h.config.Origin, Topic: topic, Version: v.at, Author: v.author})
+		}
+	}
+	h.mu.Unlock()
+
+	for _, ev := range events {
+		h.send(ev)
+	}
+
+	h.count(func(s *Stats) { s.Synced++ })
+}
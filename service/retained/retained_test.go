@@ -0,0 +1,299 @@
+package retained
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBus delivers the data sent by its transports to all of their receivers, the sender included
+type fakeBus struct {
+	handlers map[*fakeTransport]func(data []byte)
+	mu       sync.Mutex
+}
+
+func newFakeBus() *fakeBus {
+	return &fakeBus{handlers: make(map[*fakeTransport]func(data []byte))}
+}
+
+// fakeTransport is a transport over a fakeBus
+type fakeTransport struct {
+	bus *fakeBus
+	err error // returned by send and receive, if set
+}
+
+func (t *fakeTransport) Send(ctx context.Context, data []byte) error {
+	if t.err != nil {
+		return t.err
+	}
+
+	t.bus.mu.Lock()
+	var handlers []func(data []byte)
+	for _, handler := range t.bus.handlers {
+		handlers = append(handlers, handler)
+	}
+	t.bus.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(data)
+	}
+	return nil
+}
+
+func (t *fakeTransport) Receive(handler func(data []byte), onError func(err error)) (func() error, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	t.bus.mu.Lock()
+	defer t.bus.mu.Unlock()
+	t.bus.handlers[t] = handler
+	return func() error {
+		t.bus.mu.Lock()
+		defer t.bus.mu.Unlock()
+		delete(t.bus.handlers, t)
+		return nil
+	}, nil
+}
+
+// newNode returns a started broker replicating its retained messages over the bus
+func newNode(t *testing.T, bus *fakeBus, options Options, retained ...packets.Packet) (*mqtt.Server, *Hook) {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	for _, pk := range retained {
+		server.Topics.RetainMessage(pk)
+	}
+
+	retainedHook := new(Hook)
+	options.Server = server
+	options.Transport = &fakeTransport{bus: bus}
+	require.NoError(t, server.AddHook(retainedHook, options))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { server.Close() })
+	return server, retainedHook
+}
+
+// payload returns the payload of the message retained by the server for the topic, or nil
+func payload(server *mqtt.Server, topic string) []byte {
+	pk, ok := server.Topics.Retained.Get(topic)
+	if !ok {
+		return nil
+	}
+	return pk.Payload
+}
+
+func TestID(t *testing.T) {
+	retainedHook := new(Hook)
+
+	require.Equal(t, "retained-hook", retainedHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	retainedHook := new(Hook)
+	require.True(t, retainedHook.Provides(mqtt.OnStarted))
+	require.True(t, retainedHook.Provides(mqtt.OnRetainMessage))
+	require.True(t, retainedHook.Provides(mqtt.OnRetainedExpired))
+	require.False(t, retainedHook.Provides(mqtt.OnPublished))
+}
+
+func TestInit(t *testing.T) {
+	transport := &fakeTransport{bus: newFakeBus()}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Server: mqtt.New(nil), Transport: transport},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{Transport: transport},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no transport",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Server: mqtt.New(nil), Transport: transport, Filters: []string{"a/#/b"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			retainedHook := new(Hook)
+			retainedHook.Log = slog.Default()
+			err := retainedHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []string{"#"}, retainedHook.config.Filters)
+			require.Len(t, retainedHook.config.Origin, 16)
+			require.Equal(t, 5*time.Second, retainedHook.config.Timeout)
+			require.Equal(t, 24*time.Hour, retainedHook.config.ClearTTL)
+
+		})
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	bus := newFakeBus()
+	s1, h1 := newNode(t, bus, Options{Filters: []string{"devices/#"}})
+	s2, h2 := newNode(t, bus, Options{Filters: []string{"devices/#"}})
+
+	// retained messages are retained by the other brokers
+	require.NoError(t, s1.Publish("devices/d1/status", []byte("online"), true, 1))
+	require.Equal(t, []byte("online"), payload(s2, "devices/d1/status"))
+	require.Equal(t, int64(s2.Topics.Retained.Len()), atomic.LoadInt64(&s2.Info.Retained))
+
+	pk, _ := s2.Topics.Retained.Get("devices/d1/status")
+	require.True(t, pk.FixedHeader.Retain)
+	require.Equal(t, byte(1), pk.FixedHeader.Qos)
+
+	// and cleared by them
+	require.NoError(t, s2.Publish("devices/d1/status", nil, true, 0))
+	require.Nil(t, payload(s1, "devices/d1/status"))
+
+	// topics matching no filter stay local
+	require.NoError(t, s1.Publish("local/a", []byte("x"), true, 0))
+	require.Nil(t, payload(s2, "local/a"))
+
+	require.Equal(t, Stats{Sent: 1, Applied: 1, Synced: 1}, h1.Stats())
+	require.Equal(t, Stats{Sent: 1, Applied: 1}, h2.Stats())
+}
+
+func TestSync(t *testing.T) {
+	bus := newFakeBus()
+	s1, _ := newNode(t, bus, Options{})
+	require.NoError(t, s1.Publish("a/1", []byte("one"), true, 0))
+	require.NoError(t, s1.Publish("a/2", []byte("two"), true, 0))
+	require.NoError(t, s1.Publish("a/2", nil, true, 0))
+
+	// a broker starting with stale messages catches up with those retained and cleared meanwhile
+	stale := time.Now().Add(-time.Hour).Unix()
+	s2, h2 := newNode(t, bus, Options{},
+		packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true}, TopicName: "a/1", Payload: []byte("old"), Created: stale},
+		packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true}, TopicName: "a/2", Payload: []byte("old"), Created: stale},
+		packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true}, TopicName: "a/3", Payload: []byte("three"), Created: stale},
+	)
+
+	require.Equal(t, []byte("one"), payload(s2, "a/1"))
+	require.Nil(t, payload(s2, "a/2"))
+	require.Equal(t, []byte("three"), payload(s2, "a/3"))
+	require.Equal(t, int64(2), h2.Stats().Applied)
+
+	// its own messages, which the other brokers miss, are sent to them as it answers, and the changes
+	// both brokers answer with are applied once
+	s3, h3 := newNode(t, bus, Options{})
+	require.Equal(t, int64(3), h3.Stats().Applied)
+	require.GreaterOrEqual(t, h3.Stats().Stale, int64(2))
+	require.Equal(t, []byte("one"), payload(s3, "a/1"))
+	require.Equal(t, []byte("three"), payload(s3, "a/3"))
+	require.Equal(t, []byte("three"), payload(s1, "a/3"))
+}
+
+func TestStale(t *testing.T) {
+	bus := newFakeBus()
+	s1, h1 := newNode(t, bus, Options{})
+	require.NoError(t, s1.Publish("a/b", []byte("new"), true, 0))
+
+	data, err := json.Marshal(event{Kind: kindClear, Origin: "other", Topic: "a/b", Version: 1, Author: "other"})
+	require.NoError(t, err)
+	h1.receive(data)
+	require.Equal(t, []byte("new"), payload(s1, "a/b"))
+	require.Equal(t, int64(1), h1.Stats().Stale)
+
+	// the versions of the same time are ordered by author
+	v := h1.versions["a/b"]
+	data, err = json.Marshal(event{Kind: kindClear, Origin: "other", Topic: "a/b", Version: v.at, Author: h1.config.Origin + "z"})
+	require.NoError(t, err)
+	h1.receive(data)
+	require.Nil(t, payload(s1, "a/b"))
+}
+
+func TestReceiveInvalid(t *testing.T) {
+	_, h1 := newNode(t, newFakeBus(), Options{})
+
+	h1.receive([]byte("{"))
+	h1.receive([]byte(`{"kind":"set","origin":"other","topic":"a/b","version":1}`))
+	h1.receive([]byte(`{"kind":"set","origin":"other","topic":"a/b","version":1,"message":{"topic_name":"a/c","payload":"eA=="}}`))
+	require.Equal(t, Stats{Failed: 3}, h1.Stats())
+
+	h1.receive([]byte(`{"kind":"unknown","origin":"other"}`))
+	require.Equal(t, Stats{Failed: 3}, h1.Stats())
+}
+
+func TestOnRetainedExpired(t *testing.T) {
+	s1, h1 := newNode(t, newFakeBus(), Options{})
+	require.NoError(t, s1.Publish("a/b", []byte("x"), true, 0))
+	require.Contains(t, h1.versions, "a/b")
+
+	h1.OnRetainedExpired("a/b")
+	require.NotContains(t, h1.versions, "a/b")
+}
+
+func TestPrune(t *testing.T) {
+	s1, h1 := newNode(t, newFakeBus(), Options{ClearTTL: time.Hour})
+	h1.versions["a/old"] = version{at: time.Now().Add(-2 * time.Hour).UnixNano(), cleared: true}
+	h1.versions["a/recent"] = version{at: time.Now().UnixNano(), cleared: true}
+	h1.pruned = time.Now().Add(-2 * time.Minute)
+
+	require.NoError(t, s1.Publish("a/b", nil, true, 0))
+	require.NotContains(t, h1.versions, "a/old")
+	require.Contains(t, h1.versions, "a/recent")
+	require.Contains(t, h1.versions, "a/b")
+}
+
+func TestTransportUnavailable(t *testing.T) {
+	retainedHook := new(Hook)
+	retainedHook.Log = slog.Default()
+	server := mqtt.New(nil)
+	require.NoError(t, retainedHook.Init(Options{Server: server, Transport: &fakeTransport{err: errors.New("unavailable")}}))
+
+	retainedHook.OnStarted()
+	retainedHook.OnRetainMessage(&mqtt.Client{ID: "c1"}, packets.Packet{TopicName: "a/b", Payload: []byte("x")}, 1)
+	require.Equal(t, Stats{Failed: 2}, retainedHook.Stats())
+	require.Equal(t, []byte("x"), payload(server, "a/b"))
+}
+
+func TestStop(t *testing.T) {
+	require.NoError(t, new(Hook).Stop())
+
+	bus := newFakeBus()
+	_, h1 := newNode(t, bus, Options{})
+	require.NoError(t, h1.Stop())
+	require.Empty(t, bus.handlers)
+	require.NoError(t, h1.Stop())
+}
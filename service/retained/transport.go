@@ -0,0 +1,242 @@
+package retained
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/bridge/nats"
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// Transport carries the changes of the retained messages between the brokers sharing it. It must be
+// safe for concurrent use
+type Transport interface {
+	// Send sends the data to the brokers sharing the transport, which may include the sender
+	Send(ctx context.Context, data []byte) error
+
+	// Receive calls the handler with the data sent by the brokers until the func it returns is
+	// called. Errors receiving data which the transport recovers from are passed to onError
+	Receive(handler func(data []byte), onError func(err error)) (func() error, error)
+}
+
+// NATSTransport sends the changes to a NATS subject through the Conn of the nats bridge hook, which
+// is a thin adapter of the NATS client of the application
+type NATSTransport struct {
+	conn    nats.Conn
+	subject string
+}
+
+// NewNATSTransport returns a transport sending to the subject, which defaults to "mqtt.retained"
+func NewNATSTransport(conn nats.Conn, subject string) *NATSTransport {
+	if subject == "" {
+		subject = "mqtt.retained"
+	}
+
+	return &NATSTransport{conn: conn, subject: subject}
+}
+
+// Send publishes the data to the subject
+func (t *NATSTransport) Send(ctx context.Context, data []byte) error {
+	return t.conn.Publish(&nats.Msg{Subject: t.subject, Data: data})
+}
+
+// Receive subscribes to the subject
+func (t *NATSTransport) Receive(handler func(data []byte), onError func(err error)) (func() error, error) {
+	return t.conn.Subscribe(t.subject, "", func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+}
+
+// DefaultRedisStream is the stream a RedisTransport sends to
+const DefaultRedisStream = "mqtt:retained"
+
+// DefaultRedisMaxLen is about how many changes a RedisTransport keeps in its stream
+const DefaultRedisMaxLen = 10000
+
+// RedisTransport sends the changes to a Redis stream trimmed to about MaxLen entries, which each broker
+// reads from its end, as the Redis client has no pub/sub subscriptions. Receive waits a second for
+// changes at a time, which must be shorter than the Timeout of the client
+type RedisTransport struct {
+	MaxLen int64
+
+	client redisclient.Client
+	stream string
+}
+
+// NewRedisTransport returns a transport using the client, eg. one returned by redisclient.NewClient.
+// The stream defaults to DefaultRedisStream
+func NewRedisTransport(client redisclient.Client, stream string) *RedisTransport {
+	if stream == "" {
+		stream = DefaultRedisStream
+	}
+
+	return &RedisTransport{MaxLen: DefaultRedisMaxLen, client: client, stream: stream}
+}
+
+// Send appends the data to the stream
+func (t *RedisTransport) Send(ctx context.Context, data []byte) error {
+	_, err := t.client.Do(ctx, "XADD", t.stream, "MAXLEN", "~", t.MaxLen, "*", "data", data)
+	return err
+}
+
+// Receive reads the entries appended to the stream from now on, retrying a second after reads which
+// fail
+func (t *RedisTransport) Receive(handler func(data []byte), onError func(err error)) (func() error, error) {
+	last, err := t.last()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			entries, err := t.read(ctx, last)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				onError(err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+
+			for _, e := range entries {
+				last = e.id
+				handler(e.data)
+			}
+		}
+	}()
+
+	return func() error {
+		cancel()
+		wg.Wait()
+		return nil
+	}, nil
+}
+
+// entry is an entry of the stream
+type entry struct {
+	id   string
+	data []byte
+}
+
+// last returns the id of the last entry of the stream, or 0-0 if it is empty
+func (t *RedisTransport) last() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply, err := t.client.Do(ctx, "XREVRANGE", t.stream, "+", "-", "COUNT", 1)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := parseEntries(reply)
+	if err != nil || len(entries) == 0 {
+		return "0-0", err
+	}
+	return entries[0].id, nil
+}
+
+// read reads the entries of the stream after the id, waiting for them for up to a second
+func (t *RedisTransport) read(ctx context.Context, id string) ([]entry, error) {
+	reply, err := t.client.Do(ctx, "XREAD", "COUNT", 100, "BLOCK", 1000, "STREAMS", t.stream, id)
+	if err != nil || reply == nil {
+		return nil, err // nil when no entries were added while blocked
+	}
+
+	streams, ok := reply.([]any)
+	if !ok || len(streams) != 1 {
+		return nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	stream, ok := streams[0].([]any)
+	if !ok || len(stream) != 2 {
+		return nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+	return parseEntries(stream[1])
+}
+
+// parseEntries parses the entries of a stream reply, keeping their data field
+func parseEntries(reply any) ([]entry, error) {
+	values, ok := reply.([]any)
+	if !ok && reply != nil {
+		return nil, fmt.Errorf("unexpected entries %v", reply)
+	}
+
+	entries := make([]entry, 0, len(values))
+	for _, v := range values {
+		pair, ok := v.([]any)
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("unexpected entry %v", v)
+		}
+
+		id, ok := pair[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected entry id %v", pair[0])
+		}
+
+		e := entry{id: id}
+		fields, _ := pair[1].([]any)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if name, _ := fields[i].(string); name == "data" {
+				value, _ := fields[i+1].(string)
+				e.data = []byte(value)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// serverSubscriptionID identifies the inline subscription of a ServerTransport
+const serverSubscriptionID = 7305
+
+// ServerTransport sends the changes as messages to a topic of the broker, published by its inline
+// client, for brokers connected by MQTT bridges which forward the topic between them both ways. The
+// server must have its inline client enabled, and the topic should be denied to other clients
+type ServerTransport struct {
+	server *mqtt.Server
+	topic  string
+}
+
+// NewServerTransport returns a transport sending to the topic of the server, which defaults to
+// "cluster/retained"
+func NewServerTransport(server *mqtt.Server, topic string) *ServerTransport {
+	if topic == "" {
+		topic = "cluster/retained"
+	}
+
+	return &ServerTransport{server: server, topic: topic}
+}
+
+// Send publishes the data to the topic at QoS 1
+func (t *ServerTransport) Send(ctx context.Context, data []byte) error {
+	return t.server.Publish(t.topic, data, false, 1)
+}
+
+// Receive subscribes to the topic with an inline subscription
+func (t *ServerTransport) Receive(handler func(data []byte), onError func(err error)) (func() error, error) {
+	err := t.server.Subscribe(t.topic, serverSubscriptionID, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		handler(pk.Payload)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return t.server.Unsubscribe(t.topic, serverSubscriptionID)
+	}, nil
+}
@@ -0,0 +1,230 @@
+package retained
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/bridge/nats"
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// fakeConn is a NATS conn delivering its messages to its subscription
+type fakeConn struct {
+	subject string
+	handler func(msg *nats.Msg)
+}
+
+func (c *fakeConn) Publish(msg *nats.Msg) error {
+	if msg.Subject == c.subject && c.handler != nil {
+		c.handler(msg)
+	}
+	return nil
+}
+
+func (c *fakeConn) Subscribe(subject, queue string, handler func(msg *nats.Msg)) (func() error, error) {
+	c.subject, c.handler = subject, handler
+	return func() error {
+		c.handler = nil
+		return nil
+	}, nil
+}
+
+// fakeRedis answers the stream commands of the RedisTransport from memory
+type fakeRedis struct {
+	entries [][2]string // the ids and data of the stream
+	args    [][]any
+	err     error // returned by XREAD, if set
+	mu      sync.Mutex
+}
+
+func (r *fakeRedis) Do(ctx context.Context, args ...any) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.args = append(r.args, args)
+
+	reply := func(entries [][2]string) []any {
+		values := make([]any, 0, len(entries))
+		for _, e := range entries {
+			values = append(values, []any{e[0], []any{"data", e[1]}})
+		}
+		return values
+	}
+
+	switch args[0] {
+	case "XADD":
+		id := fmt.Sprintf("%d-0", len(r.entries)+1)
+		r.entries = append(r.entries, [2]string{id, string(args[7].([]byte))})
+		return id, nil
+	case "XREVRANGE":
+		if len(r.entries) == 0 {
+			return []any{}, nil
+		}
+		return reply(r.entries[len(r.entries)-1:]), nil
+	case "XREAD":
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		after := args[len(args)-1].(string)
+		for i, e := range r.entries {
+			if after == "0-0" || e[0] == after {
+				if after != "0-0" {
+					i++
+				}
+				if i < len(r.entries) {
+					return []any{[]any{args[len(args)-2], reply(r.entries[i:])}}, nil
+				}
+				break
+			}
+		}
+
+		r.mu.Unlock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Millisecond):
+		}
+		r.mu.Lock()
+		return nil, nil
+	}
+	return nil, redisclient.Error("ERR unknown command")
+}
+
+// command returns the ith command the fake has received
+func (r *fakeRedis) command(i int) []any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.args[i]
+}
+
+func (r *fakeRedis) Close() error {
+	return nil
+}
+
+// receiver records the data received through a transport
+type receiver struct {
+	data   []string
+	errors int
+	mu     sync.Mutex
+}
+
+func (r *receiver) handle(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data = append(r.data, string(data))
+}
+
+func (r *receiver) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors++
+}
+
+func (r *receiver) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.data...)
+}
+
+func TestNATSTransport(t *testing.T) {
+	conn := new(fakeConn)
+	transport := NewNATSTransport(conn, "")
+	r := new(receiver)
+
+	stop, err := transport.Receive(r.handle, r.fail)
+	require.NoError(t, err)
+	require.Equal(t, "mqtt.retained", conn.subject)
+
+	require.NoError(t, transport.Send(context.Background(), []byte("a")))
+	require.Equal(t, []string{"a"}, r.received())
+
+	require.NoError(t, stop())
+	require.NoError(t, transport.Send(context.Background(), []byte("b")))
+	require.Equal(t, []string{"a"}, r.received())
+
+	require.Equal(t, "changes", NewNATSTransport(conn, "changes").subject)
+}
+
+func TestRedisTransport(t *testing.T) {
+	redis := new(fakeRedis)
+	transport := NewRedisTransport(redis, "")
+	ctx := context.Background()
+
+	// entries appended before receiving starts are skipped
+	require.NoError(t, transport.Send(ctx, []byte("a")))
+	require.Equal(t, []any{"XADD", DefaultRedisStream, "MAXLEN", "~", int64(DefaultRedisMaxLen), "*", "data", []byte("a")}, redis.command(0))
+
+	r := new(receiver)
+	stop, err := transport.Receive(r.handle, r.fail)
+	require.NoError(t, err)
+
+	require.NoError(t, transport.Send(ctx, []byte("b")))
+	require.NoError(t, transport.Send(ctx, []byte("c")))
+	require.Eventually(t, func() bool { return len(r.received()) == 2 }, time.Second, time.Millisecond)
+	require.Equal(t, []string{"b", "c"}, r.received())
+	require.NoError(t, stop())
+
+	// an empty stream is read from its start
+	redis = new(fakeRedis)
+	transport = NewRedisTransport(redis, "changes")
+	r = new(receiver)
+	stop, err = transport.Receive(r.handle, r.fail)
+	require.NoError(t, err)
+	defer stop()
+
+	require.NoError(t, transport.Send(ctx, []byte("a")))
+	require.Eventually(t, func() bool { return len(r.received()) == 1 }, time.Second, time.Millisecond)
+	require.Equal(t, "changes", redis.command(0)[1])
+}
+
+func TestRedisTransportFailure(t *testing.T) {
+	redis := &fakeRedis{err: errors.New("unavailable")}
+	r := new(receiver)
+	stop, err := NewRedisTransport(redis, "").Receive(r.handle, r.fail)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.errors == 1
+	}, time.Second, time.Millisecond)
+	require.NoError(t, stop())
+}
+
+func TestParseEntries(t *testing.T) {
+	entries, err := parseEntries([]any{[]any{"1-0", []any{"other", "x", "data", "a"}}, []any{"2-0", nil}})
+	require.NoError(t, err)
+	require.Equal(t, []entry{{id: "1-0", data: []byte("a")}, {id: "2-0"}}, entries)
+
+	for _, reply := range []any{"x", []any{"x"}, []any{[]any{int64(1), nil}}} {
+		_, err := parseEntries(reply)
+		require.Error(t, err)
+	}
+}
+
+func TestServerTransport(t *testing.T) {
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	transport := NewServerTransport(server, "")
+	r := new(receiver)
+	stop, err := transport.Receive(r.handle, r.fail)
+	require.NoError(t, err)
+
+	require.NoError(t, transport.Send(context.Background(), []byte("a")))
+	require.Equal(t, []string{"a"}, r.received())
+
+	require.NoError(t, stop())
+	require.NoError(t, transport.Send(context.Background(), []byte("b")))
+	require.Equal(t, []string{"a"}, r.received())
+
+	_, err = NewServerTransport(mqtt.New(nil), "changes").Receive(r.handle, r.fail)
+	require.ErrorIs(t, err, mqtt.ErrInlineClientNotEnabled)
+}
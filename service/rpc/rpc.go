@@ -0,0 +1,353 @@
+// Package rpc provides a hook answering MQTT 5 requests on selected topics from within the broker,
+// for health checks and built-in device services. A request is a message with a response topic,
+// published to a topic served by a handler, and the response the handler returns is published to the
+// response topic with the correlation data of the request.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+// ClientID is the id of the inline client which publishes the responses
+const ClientID = "rpc"
+
+// ErrorProperty is the user property of responses with the error of the handler
+const ErrorProperty = "error"
+
+// errBusy and errTimeout are the errors of requests which weren't answered in time
+var (
+	errBusy    = errors.New("too many requests")
+	errTimeout = errors.New("request timed out")
+)
+
+// Request is a request published to a topic served by a handler
+type Request struct {
+	Topic       string
+	Payload     []byte
+	Client      string // the id of the client which published the request
+	Username    []byte
+	ContentType string
+	User        []packets.UserProperty
+}
+
+// Response is the response to a request
+type Response struct {
+	Payload     []byte
+	ContentType string
+	User        []packets.UserProperty
+}
+
+// Handler answers requests. The context is cancelled after the timeout, or when the hook stops. If it
+// returns an error, the response is empty with the error in the error user property
+type Handler func(ctx context.Context, req Request) (Response, error)
+
+// Echo is a handler responding with the request, eg. to measure round trips
+func Echo(ctx context.Context, req Request) (Response, error) {
+	return Response{Payload: req.Payload, ContentType: req.ContentType, User: req.User}, nil
+}
+
+// Health returns a handler responding with the status of the server, its version, uptime and number
+// of connected clients, as JSON
+func Health(server *mqtt.Server) Handler {
+	return func(ctx context.Context, req Request) (Response, error) {
+		info := server.Info.Clone()
+		payload, err := json.Marshal(map[string]any{
+			"status":            "ok",
+			"version":           info.Version,
+			"uptime":            info.Uptime,
+			"clients_connected": info.ClientsConnected,
+		})
+		if err != nil {
+			return Response{}, err
+		}
+		return Response{Payload: payload, ContentType: "application/json"}, nil
+	}
+}
+
+// Stats are the totals of the requests since the hook was initialized
+type Stats struct {
+	Requests  int64 // the number of requests
+	Responses int64 // the number of responses published, including errors
+	Errors    int64 // the number of requests whose handler failed, timed out or which were rejected
+	Timeouts  int64 // the number of requests whose handler didn't return in time
+	Failed    int64 // the number of responses which could not be published
+}
+
+// Hook is a hook that answers requests with handlers
+type Hook struct {
+	config   Options
+	client   *mqtt.Client
+	handlers map[string]Handler // the handlers by topic filter
+	filters  []string           // the topic filters of the handlers, the most specific first
+	slots    chan struct{}      // limits the requests handled at once
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stats    Stats
+	mu       sync.RWMutex // guards handlers and filters
+	statsMu  sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the rpc hook
+type Options struct {
+	// Server is the server the responses are published to. Required
+	Server *mqtt.Server
+
+	// Handlers are the handlers by the filters of the topics they serve, eg. {"$rpc/health": Health(server)}.
+	// More can be added with Handle. When several filters match a topic, the longest is used
+	Handlers map[string]Handler
+
+	// Auth is the auth hook clients are checked against to read from the response topic, as responses
+	// are published by the broker. Responses may be published to any topic but $ topics if nil
+	Auth mqtt.Hook
+
+	// Timeout is how long handlers have to respond, and defaults to 5 seconds. Concurrency is the most
+	// requests handled at once, and defaults to 100. Requests over it are answered with an error
+	Timeout     time.Duration
+	Concurrency int
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "rpc-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	rpcHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if rpcHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if rpcHookConfig.Timeout <= 0 {
+		rpcHookConfig.Timeout = 5 * time.Second
+	}
+
+	if rpcHookConfig.Concurrency <= 0 {
+		rpcHookConfig.Concurrency = 100
+	}
+
+	h.config = rpcHookConfig
+	for filter, handler := range rpcHookConfig.Handlers {
+		if err := h.Handle(filter, handler); err != nil {
+			return err
+		}
+	}
+
+	h.client = rpcHookConfig.Server.NewClient(nil, "local", ClientID, true)
+	h.client.Properties.ProtocolVersion = 5
+	h.slots = make(chan struct{}, rpcHookConfig.Concurrency)
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+
+	return nil
+}
+
+// Handle serves the topics matching the filter with the handler, replacing its handler if it has one.
+// Handlers may be added and removed while the broker runs
+func (h *Hook) Handle(filter string, handler Handler) error {
+	if !mqtt.IsValidFilter(filter, false) {
+		return fmt.Errorf("invalid topic filter %q", filter)
+	}
+
+	if handler == nil {
+		return fmt.Errorf("nil handler for %s", filter)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.handlers == nil {
+		h.handlers = make(map[string]Handler)
+	}
+
+	if _, ok := h.handlers[filter]; !ok {
+		h.filters = append(h.filters, filter)
+		sort.SliceStable(h.filters, func(i, j int) bool {
+			return len(h.filters[i]) > len(h.filters[j])
+		})
+	}
+	h.handlers[filter] = handler
+	return nil
+}
+
+// Remove stops serving the topics matching the filter
+func (h *Hook) Remove(filter string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.handlers[filter]; !ok {
+		return
+	}
+
+	delete(h.handlers, filter)
+	for i, f := range h.filters {
+		if f == filter {
+			h.filters = append(h.filters[:i:i], h.filters[i+1:]...)
+			break
+		}
+	}
+}
+
+// Stop cancels the requests being handled, and waits for them
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.wg.Wait()
+	return nil
+}
+
+// Stats returns the totals of the requests so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// OnPublished is called when a client has published a message, and answers it if it is a request to
+// a served topic
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if pk.Ignore || pk.Origin == ClientID || pk.Properties.ResponseTopic == "" {
+		return
+	}
+
+	handler := h.handler(pk.TopicName)
+	if handler == nil {
+		return
+	}
+
+	h.count(func(s *Stats) { s.Requests++ })
+
+	if err := h.checkResponseTopic(cl, pk.Properties.ResponseTopic); err != nil {
+		h.Log.Warn("rejected request", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Errors++ })
+		return
+	}
+
+	req := Request{
+		Topic:       pk.TopicName,
+		Payload:     pk.Payload,
+		Client:      cl.ID,
+		Username:    cl.Properties.Username,
+		ContentType: pk.Properties.ContentType,
+		User:        pk.Properties.User,
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		h.respond(pk, Response{}, errBusy)
+		return
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		defer func() { <-h.slots }()
+
+		ctx, cancel := context.WithTimeout(h.ctx, h.config.Timeout)
+		defer cancel()
+
+		resp, err := handler(ctx, req)
+		if ctx.Err() != nil {
+			if h.ctx.Err() != nil {
+				return // the hook stopped
+			}
+			h.count(func(s *Stats) { s.Timeouts++ })
+			resp, err = Response{}, errTimeout
+		}
+		h.respond(pk, resp, err)
+	}()
+}
+
+// handler returns the handler of the most specific filter matching the topic, or nil if none do
+func (h *Hook) handler(topic string) Handler {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, filter := range h.filters {
+		if acl.Match(filter, topic) {
+			return h.handlers[filter]
+		}
+	}
+	return nil
+}
+
+// checkResponseTopic returns an error if responses can't be published to the response topic
+func (h *Hook) checkResponseTopic(cl *mqtt.Client, topic string) error {
+	if !mqtt.IsValidFilter(topic, true) || strings.HasPrefix(topic, "$") && h.config.Auth == nil {
+		return fmt.Errorf("invalid response topic %q", topic)
+	}
+
+	if h.config.Auth != nil && !cl.Net.Inline && !h.config.Auth.OnACLCheck(cl, topic, false) {
+		return fmt.Errorf("not authorized to read from response topic %q", topic)
+	}
+
+	return nil
+}
+
+// respond publishes the response, or the error, to the response topic of the request
+func (h *Hook) respond(req packets.Packet, resp Response, err error) {
+	if err != nil {
+		h.count(func(s *Stats) { s.Errors++ })
+		resp = Response{User: []packets.UserProperty{{Key: ErrorProperty, Val: err.Error()}}}
+	}
+
+	err = h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+			Qos:  req.FixedHeader.Qos,
+		},
+		TopicName: req.Properties.ResponseTopic,
+		Payload:   resp.Payload,
+		PacketID:  uint16(req.FixedHeader.Qos),
+		Properties: packets.Properties{
+			ContentType:     resp.ContentType,
+			CorrelationData: req.Properties.CorrelationData,
+			User:            resp.User,
+		},
+	})
+	if err != nil {
+		h.Log.Error("error occurred while publishing response", "error", err, "topic", req.Properties.ResponseTopic)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.count(func(s *Stats) { s.Responses++ })
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
@@ -0,0 +1,296 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// denyHook is an auth hook which denies reading from secret/#
+type denyHook struct {
+	mqtt.HookBase
+}
+
+func (h *denyHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return !strings.HasPrefix(topic, "secret/")
+}
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	rpcHook := new(Hook)
+	rpcHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, rpcHook.Init(options))
+	t.Cleanup(func() { _ = rpcHook.Stop() })
+	return rpcHook
+}
+
+// subscribe returns the messages published to the filter
+func subscribe(t *testing.T, server *mqtt.Server, filter string) chan packets.Packet {
+	t.Helper()
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return received
+}
+
+// receive returns the next message received
+func receive(t *testing.T, received chan packets.Packet) packets.Packet {
+	t.Helper()
+
+	select {
+	case pk := <-received:
+		return pk
+	case <-time.After(5 * time.Second):
+		t.Fatal("response wasn't published")
+	}
+	return packets.Packet{}
+}
+
+func request(topic, responseTopic, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   topic,
+		Payload:     []byte(payload),
+		Origin:      "c1",
+		Properties: packets.Properties{
+			ResponseTopic:   responseTopic,
+			CorrelationData: []byte("42"),
+			ContentType:     "text/plain",
+		},
+	}
+}
+
+func TestID(t *testing.T) {
+	rpcHook := new(Hook)
+
+	require.Equal(t, "rpc-hook", rpcHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	rpcHook := new(Hook)
+
+	require.True(t, rpcHook.Provides(mqtt.OnPublished))
+	require.False(t, rpcHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	server := newServer(t)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:   "Success",
+			config: Options{Server: server, Handlers: map[string]Handler{"$rpc/echo": Echo, "$rpc/health": Health(server)}},
+		},
+		{
+			name:        "Error - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Error - improper config",
+			config:      "not valid",
+			expectError: true,
+		},
+		{
+			name:        "Error - no server",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Error - invalid filter",
+			config:      Options{Server: server, Handlers: map[string]Handler{"a/#/b": Echo}},
+			expectError: true,
+		},
+		{
+			name:        "Error - nil handler",
+			config:      Options{Server: server, Handlers: map[string]Handler{"$rpc/echo": nil}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rpcHook := new(Hook)
+			err := rpcHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, 5*time.Second, rpcHook.config.Timeout)
+			require.Equal(t, 100, rpcHook.config.Concurrency)
+			require.Len(t, rpcHook.filters, 2)
+			require.NoError(t, rpcHook.Stop())
+		})
+	}
+}
+
+func TestHandle(t *testing.T) {
+	rpcHook := newHook(t, Options{Server: newServer(t)})
+
+	require.NoError(t, rpcHook.Handle("devices/+/rpc", Echo))
+	require.NoError(t, rpcHook.Handle("devices/gateway/rpc", Echo))
+	require.NoError(t, rpcHook.Handle("devices/+/rpc", Echo))
+	require.Error(t, rpcHook.Handle("devices/#/rpc", Echo))
+	require.Equal(t, []string{"devices/gateway/rpc", "devices/+/rpc"}, rpcHook.filters)
+
+	require.NotNil(t, rpcHook.handler("devices/1/rpc"))
+	require.Nil(t, rpcHook.handler("devices/1/status"))
+
+	rpcHook.Remove("devices/+/rpc")
+	rpcHook.Remove("devices/+/rpc")
+	require.Equal(t, []string{"devices/gateway/rpc"}, rpcHook.filters)
+	require.Nil(t, rpcHook.handler("devices/1/rpc"))
+	require.NotNil(t, rpcHook.handler("devices/gateway/rpc"))
+}
+
+func TestEcho(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "replies/#")
+	rpcHook := newHook(t, Options{Server: server, Handlers: map[string]Handler{"$rpc/echo": Echo}})
+	cl := server.NewClient(nil, "t1", "c1", false)
+
+	rpcHook.OnPublished(cl, request("$rpc/echo", "replies/c1", "ping"))
+
+	pk := receive(t, received)
+	require.Equal(t, "replies/c1", pk.TopicName)
+	require.Equal(t, []byte("ping"), pk.Payload)
+	require.Equal(t, []byte("42"), pk.Properties.CorrelationData)
+	require.Equal(t, "text/plain", pk.Properties.ContentType)
+	require.Equal(t, ClientID, pk.Origin)
+
+	require.Eventually(t, func() bool { return rpcHook.Stats().Responses == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, Stats{Requests: 1, Responses: 1}, rpcHook.Stats())
+}
+
+func TestHealth(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "replies/#")
+	rpcHook := newHook(t, Options{Server: server, Handlers: map[string]Handler{"$rpc/health": Health(server)}})
+
+	rpcHook.OnPublished(server.NewClient(nil, "t1", "c1", false), request("$rpc/health", "replies/c1", ""))
+
+	pk := receive(t, received)
+	require.Equal(t, "application/json", pk.Properties.ContentType)
+
+	var health map[string]any
+	require.NoError(t, json.Unmarshal(pk.Payload, &health))
+	require.Equal(t, "ok", health["status"])
+	require.Equal(t, server.Info.Version, health["version"])
+}
+
+func TestErrors(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "replies/#")
+	release := make(chan struct{})
+	rpcHook := newHook(t, Options{Server: server, Timeout: 20 * time.Millisecond, Concurrency: 1, Handlers: map[string]Handler{
+		"fail": func(ctx context.Context, req Request) (Response, error) {
+			return Response{Payload: []byte("partial")}, errors.New("device offline")
+		},
+		"slow": func(ctx context.Context, req Request) (Response, error) {
+			<-release
+			return Response{Payload: []byte("late")}, nil
+		},
+	}})
+	cl := server.NewClient(nil, "t1", "c1", false)
+
+	rpcHook.OnPublished(cl, request("fail", "replies/c1", ""))
+	pk := receive(t, received)
+	require.Empty(t, pk.Payload)
+	require.Equal(t, []packets.UserProperty{{Key: ErrorProperty, Val: "device offline"}}, pk.Properties.User)
+
+	// the slow request times out, and the request made while it is handled is rejected
+	rpcHook.OnPublished(cl, request("slow", "replies/c1", ""))
+	rpcHook.OnPublished(cl, request("slow", "replies/c2", ""))
+	pk = receive(t, received)
+	require.Equal(t, "replies/c2", pk.TopicName)
+	require.Equal(t, []packets.UserProperty{{Key: ErrorProperty, Val: "too many requests"}}, pk.Properties.User)
+
+	time.Sleep(30 * time.Millisecond)
+	close(release)
+	pk = receive(t, received)
+	require.Equal(t, "replies/c1", pk.TopicName)
+	require.Empty(t, pk.Payload)
+	require.Equal(t, []packets.UserProperty{{Key: ErrorProperty, Val: "request timed out"}}, pk.Properties.User)
+
+	require.Eventually(t, func() bool { return rpcHook.Stats().Responses == 3 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, Stats{Requests: 3, Responses: 3, Errors: 3, Timeouts: 1}, rpcHook.Stats())
+}
+
+func TestIgnored(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "#")
+	rpcHook := newHook(t, Options{Server: server, Handlers: map[string]Handler{"$rpc/echo": Echo}})
+	cl := server.NewClient(nil, "t1", "c1", false)
+
+	rpcHook.OnPublished(cl, request("$rpc/echo", "", "no response topic"))
+	rpcHook.OnPublished(cl, request("$rpc/other", "replies/c1", "not served"))
+
+	response := request("$rpc/echo", "replies/c1", "from the hook")
+	response.Origin = ClientID
+	rpcHook.OnPublished(cl, response)
+
+	rpcHook.OnPublished(cl, request("$rpc/echo", "$SYS/broker", "reserved response topic"))
+	rpcHook.OnPublished(cl, request("$rpc/echo", "replies/+", "invalid response topic"))
+
+	require.NoError(t, rpcHook.Stop())
+	require.Len(t, received, 0)
+	require.Equal(t, Stats{Requests: 2, Errors: 2}, rpcHook.Stats())
+}
+
+func TestAuth(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "$replies/#")
+	rpcHook := newHook(t, Options{Server: server, Auth: new(denyHook), Handlers: map[string]Handler{"$rpc/echo": Echo}})
+	cl := server.NewClient(nil, "t1", "c1", false)
+
+	rpcHook.OnPublished(cl, request("$rpc/echo", "secret/replies", "denied"))
+	rpcHook.OnPublished(cl, request("$rpc/echo", "$replies/c1", "allowed"))
+
+	pk := receive(t, received)
+	require.Equal(t, []byte("allowed"), pk.Payload)
+	require.NoError(t, rpcHook.Stop())
+	require.Equal(t, Stats{Requests: 2, Responses: 1, Errors: 1}, rpcHook.Stats())
+}
+
+func TestStop(t *testing.T) {
+	server := newServer(t)
+	received := subscribe(t, server, "replies/#")
+	rpcHook := newHook(t, Options{Server: server, Handlers: map[string]Handler{
+		"wait": func(ctx context.Context, req Request) (Response, error) {
+			<-ctx.Done()
+			return Response{}, ctx.Err()
+		},
+	}})
+
+	rpcHook.OnPublished(server.NewClient(nil, "t1", "c1", false), request("wait", "replies/c1", ""))
+	require.NoError(t, rpcHook.Stop())
+	require.Len(t, received, 0)
+	require.Equal(t, Stats{Requests: 1}, rpcHook.Stats())
+}
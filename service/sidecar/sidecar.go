@@ -0,0 +1,619 @@
+// Package sidecar provides a hook which forwards selected events to a sidecar process over a Unix
+// socket and awaits its decisions, with less overhead than HTTP for callouts on every message.
+//
+// The hook connects to the socket the sidecar listens on, and exchanges JSON-RPC 2.0 messages with it,
+// one per line. Decisions are requests, eg.
+//
+//	--> {"jsonrpc": "2.0", "id": 1, "method": "acl_check", "params": {"client_id": "c1", "username": "u1", "topic": "a/b", "write": true}}
+//	<-- {"jsonrpc": "2.0", "id": 1, "result": {"allow": true}}
+//
+// which the sidecar may answer in any order, and other events are notifications, which have no id and
+// aren't answered. The methods are
+//
+//	authenticate  request, params client and password, result {"allow": bool}
+//	acl_check     request, params client, topic and write, result {"allow": bool}
+//	publish       request, params client and message, result {"reject": bool, "reason": code, "topic": ..., "payload": ...}
+//	              with any of the fields, or null to publish the message as it is
+//	connected     notification, params client
+//	disconnected  notification, params client, error and expire
+//	subscribed    notification, params client and filters
+//	unsubscribed  notification, params client and filters
+//	published     notification, params client and message
+//
+// where a client is {"client_id": ..., "username": ..., "remote": ..., "listener": ...} and a message
+// {"topic": ..., "qos": ..., "retain": ..., "payload": ...}, with the payload in base64.
+package sidecar
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// The methods of the events forwarded to the sidecar
+const (
+	MethodAuthenticate = "authenticate"
+	MethodACLCheck     = "acl_check"
+	MethodPublish      = "publish"
+	MethodConnected    = "connected"
+	MethodDisconnected = "disconnected"
+	MethodSubscribed   = "subscribed"
+	MethodUnsubscribed = "unsubscribed"
+	MethodPublished    = "published"
+)
+
+// methods are the hooks of the methods
+var methods = map[string]byte{
+	MethodAuthenticate: mqtt.OnConnectAuthenticate,
+	MethodACLCheck:     mqtt.OnACLCheck,
+	MethodPublish:      mqtt.OnPublish,
+	MethodConnected:    mqtt.OnSessionEstablished,
+	MethodDisconnected: mqtt.OnDisconnect,
+	MethodSubscribed:   mqtt.OnSubscribed,
+	MethodUnsubscribed: mqtt.OnUnsubscribed,
+	MethodPublished:    mqtt.OnPublished,
+}
+
+// maxLine is the longest message read from the sidecar
+const maxLine = 4 << 20
+
+var (
+	errUnavailable = errors.New("sidecar is not connected")
+	errTimeout     = errors.New("sidecar did not respond in time")
+	errClosed      = errors.New("sidecar connection closed")
+)
+
+// Error is the error a sidecar responded to a request with
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error returns the message of the error
+func (e *Error) Error() string {
+	return fmt.Sprintf("sidecar error %d: %s", e.Code, e.Message)
+}
+
+// Stats are the totals of the events forwarded since the hook was initialized
+type Stats struct {
+	Requests      int64 // the number of requests sent
+	Failed        int64 // the number of requests which failed or timed out, and were decided by the fallback
+	Notifications int64 // the number of notifications sent
+	Dropped       int64 // the number of notifications which could not be sent
+	Reconnects    int64 // the number of times the hook connected to the sidecar again
+}
+
+// Hook is a hook that forwards events to a sidecar process and awaits its decisions
+type Hook struct {
+	config  Options
+	events  map[byte]bool
+	conn    atomic.Pointer[conn] // the connection to the sidecar, nil while disconnected
+	next    atomic.Uint64        // the id of the last request
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	stats   Stats
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the sidecar hook
+type Options struct {
+	// Path is the Unix socket the sidecar listens on. Required
+	Path string
+
+	// Events are the methods of the events forwarded to the sidecar, eg. MethodAuthenticate. Required
+	Events []string
+
+	// Timeout bounds each request and write, and defaults to 1 second
+	Timeout time.Duration
+
+	// ReconnectInterval is how long the hook waits to connect again when the connection fails, and
+	// defaults to 1 second
+	ReconnectInterval time.Duration
+
+	// FailOpen allows the clients and messages of the requests which failed, timed out or were made
+	// while the sidecar was disconnected, which are otherwise denied and rejected
+	FailOpen bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "sidecar-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook, which must be forwarded
+func (h *Hook) Provides(b byte) bool {
+	return h.events[b]
+}
+
+// Init initializes the hook with the given config, and connects to the sidecar. If it cannot connect,
+// it keeps trying in the background
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	sidecarHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if sidecarHookConfig.Path == "" {
+		return errors.New("path is required")
+	}
+
+	if len(sidecarHookConfig.Events) == 0 {
+		return errors.New("events are required")
+	}
+
+	events := make(map[byte]bool)
+	for _, event := range sidecarHookConfig.Events {
+		b, ok := methods[event]
+		if !ok {
+			return fmt.Errorf("unknown event %q", event)
+		}
+		events[b] = true
+	}
+
+	if sidecarHookConfig.Timeout <= 0 {
+		sidecarHookConfig.Timeout = time.Second
+	}
+
+	if sidecarHookConfig.ReconnectInterval <= 0 {
+		sidecarHookConfig.ReconnectInterval = time.Second
+	}
+
+	h.config = sidecarHookConfig
+	h.events = events
+
+	c, err := h.dial()
+	if err != nil {
+		h.Log.Warn("sidecar not connected", "error", err, "path", sidecarHookConfig.Path)
+	} else {
+		h.conn.Store(c)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.wg.Add(1)
+	go h.run(ctx, c)
+
+	return nil
+}
+
+// Stop disconnects from the sidecar
+func (h *Hook) Stop() error {
+	if h.cancel == nil {
+		return nil
+	}
+
+	h.cancel()
+	h.wg.Wait()
+	return nil
+}
+
+// Stats returns the totals of the events forwarded so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
+
+// dial connects to the sidecar
+func (h *Hook) dial() (*conn, error) {
+	var dialer net.Dialer
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	nc, err := dialer.DialContext(ctx, "unix", h.config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{
+		Conn:    nc,
+		pending: make(map[uint64]chan response),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// run reads the responses of the connection, and connects again when it fails, until the context is
+// cancelled
+func (h *Hook) run(ctx context.Context, c *conn) {
+	defer h.wg.Done()
+
+	for {
+		if c != nil {
+			h.conn.Store(c)
+			current := c
+			stop := context.AfterFunc(ctx, func() { current.close(errClosed) })
+			err := h.read(c)
+			stop()
+			h.conn.CompareAndSwap(c, nil)
+			c.close(err)
+			if ctx.Err() != nil {
+				return
+			}
+			h.Log.Warn("sidecar disconnected", "error", err, "path", h.config.Path)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(h.config.ReconnectInterval):
+		}
+
+		var err error
+		c, err = h.dial()
+		if err != nil {
+			h.Log.Debug("sidecar not connected", "error", err, "path", h.config.Path)
+			continue
+		}
+
+		h.Log.Info("sidecar connected", "path", h.config.Path)
+		h.count(func(s *Stats) { s.Reconnects++ })
+	}
+}
+
+// read passes the responses of the connection to the requests awaiting them, until it fails
+func (h *Hook) read(c *conn) error {
+	scanner := bufio.NewScanner(c)
+	scanner.Buffer(make([]byte, 0, 4096), maxLine)
+	for scanner.Scan() {
+		var resp response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil || resp.ID == nil {
+			h.Log.Warn("sidecar sent an invalid response", "error", err, "response", scanner.Text())
+			continue
+		}
+		c.respond(*resp.ID, resp)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errClosed
+}
+
+// request is a JSON-RPC request, or a notification without an id
+type request struct {
+	JSONRPC string  `json:"jsonrpc"`
+	ID      *uint64 `json:"id,omitempty"`
+	Method  string  `json:"method"`
+	Params  any     `json:"params"`
+}
+
+// response is a JSON-RPC response
+type response struct {
+	ID     *uint64         `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// call sends the request to the sidecar, and decodes its result into result
+func (h *Hook) call(method string, params any, result any) error {
+	h.count(func(s *Stats) { s.Requests++ })
+
+	err := h.send(method, params, result)
+	if err != nil {
+		h.count(func(s *Stats) { s.Failed++ })
+		h.Log.Warn("sidecar request failed", "error", err, "method", method)
+	}
+	return err
+}
+
+// send sends the request and awaits its response
+func (h *Hook) send(method string, params any, result any) error {
+	c := h.conn.Load()
+	if c == nil {
+		return errUnavailable
+	}
+
+	id := h.next.Add(1)
+	responses, err := c.await(id)
+	if err != nil {
+		return err
+	}
+	defer c.forget(id)
+
+	if err := c.write(request{JSONRPC: "2.0", ID: &id, Method: method, Params: params}, h.config.Timeout); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(h.config.Timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-responses:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if len(resp.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-c.done:
+		return c.err
+	case <-timer.C:
+		return errTimeout
+	}
+}
+
+// notify sends the notification to the sidecar, if it is connected
+func (h *Hook) notify(method string, params any) {
+	c := h.conn.Load()
+	if c == nil {
+		h.count(func(s *Stats) { s.Dropped++ })
+		return
+	}
+
+	if err := c.write(request{JSONRPC: "2.0", Method: method, Params: params}, h.config.Timeout); err != nil {
+		h.Log.Warn("sidecar notification failed", "error", err, "method", method)
+		h.count(func(s *Stats) { s.Dropped++ })
+		return
+	}
+
+	h.count(func(s *Stats) { s.Notifications++ })
+}
+
+// conn is a connection to the sidecar
+type conn struct {
+	net.Conn
+	pending map[uint64]chan response // the requests awaiting responses, by id
+	done    chan struct{}            // closed once the connection has failed
+	err     error                    // why the connection failed
+	mu      sync.Mutex               // guards pending and err
+	writeMu sync.Mutex
+}
+
+// await registers the request awaiting its response
+func (c *conn) await(id uint64) (chan response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	responses := make(chan response, 1)
+	c.pending[id] = responses
+	return responses, nil
+}
+
+// forget forgets the request
+func (c *conn) forget(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// respond passes the response to the request awaiting it, if any
+func (c *conn) respond(id uint64, resp response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if responses, ok := c.pending[id]; ok {
+		responses <- resp
+		delete(c.pending, id)
+	}
+}
+
+// write writes the message as a line
+func (c *conn) write(msg request, timeout time.Duration) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	_, err = c.Write(append(b, '\n'))
+	return err
+}
+
+// close closes the connection, failing the requests awaiting responses
+func (c *conn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	_ = c.Conn.Close()
+	close(c.done)
+}
+
+// client is the JSON of a client in params
+type client struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Remote   string `json:"remote,omitempty"`
+	Listener string `json:"listener,omitempty"`
+}
+
+// clientParams returns the JSON of the client
+func clientParams(cl *mqtt.Client) client {
+	return client{
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Remote:   cl.Net.Remote,
+		Listener: cl.Net.Listener,
+	}
+}
+
+// message is the JSON of a message in params
+type message struct {
+	Topic   string `json:"topic"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload []byte `json:"payload"`
+}
+
+// messageParams returns the JSON of the message
+func messageParams(pk packets.Packet) message {
+	return message{
+		Topic:   pk.TopicName,
+		Qos:     pk.FixedHeader.Qos,
+		Retain:  pk.FixedHeader.Retain,
+		Payload: pk.Payload,
+	}
+}
+
+// decision is the result of authenticate and acl_check
+type decision struct {
+	Allow bool `json:"allow"`
+}
+
+// publishResult is the result of publish
+type publishResult struct {
+	Reject  bool    `json:"reject"`
+	Reason  byte    `json:"reason"`
+	Topic   *string `json:"topic"`
+	Payload []byte  `json:"payload"`
+}
+
+// OnConnectAuthenticate is called when a client connects, and returns whether the sidecar allows it
+func (h *Hook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	var d decision
+	err := h.call(MethodAuthenticate, struct {
+		client
+		Password string `json:"password"`
+	}{client: clientParams(cl), Password: string(pk.Connect.Password)}, &d)
+	if err != nil {
+		return h.config.FailOpen
+	}
+	return d.Allow
+}
+
+// OnACLCheck is called when a client publishes or subscribes to a topic, and returns whether the
+// sidecar allows it
+func (h *Hook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	var d decision
+	err := h.call(MethodACLCheck, struct {
+		client
+		Topic string `json:"topic"`
+		Write bool   `json:"write"`
+	}{client: clientParams(cl), Topic: topic, Write: write}, &d)
+	if err != nil {
+		return h.config.FailOpen
+	}
+	return d.Allow
+}
+
+// OnPublish is called when a client publishes a message, and returns it as the sidecar changed it, or
+// rejects it if the sidecar does
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	var r publishResult
+	err := h.call(MethodPublish, struct {
+		client
+		message
+	}{client: clientParams(cl), message: messageParams(pk)}, &r)
+	if err != nil {
+		if h.config.FailOpen {
+			return pk, nil
+		}
+		return pk, reject.Publish(cl, pk, packets.ErrImplementationSpecificError)
+	}
+
+	if r.Reject {
+		h.Log.Debug("message rejected by sidecar", "client", cl.ID, "topic", pk.TopicName, "reason", r.Reason)
+		if r.Reason < packets.ErrUnspecifiedError.Code {
+			return pk, reject.Publish(cl, pk, packets.ErrNotAuthorized)
+		}
+		return pk, reject.Publish(cl, pk, packets.Code{Code: r.Reason, Reason: "rejected by sidecar"})
+	}
+
+	if r.Topic != nil {
+		if *r.Topic == "" || !mqtt.IsValidFilter(*r.Topic, true) {
+			h.Log.Warn("sidecar returned an invalid topic", "client", cl.ID, "topic", *r.Topic)
+			return pk, reject.Publish(cl, pk, packets.ErrImplementationSpecificError)
+		}
+		pk.TopicName = *r.Topic
+	}
+
+	if r.Payload != nil {
+		pk.Payload = r.Payload
+	}
+
+	return pk, nil
+}
+
+// OnSessionEstablished is called when a client has connected
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.notify(MethodConnected, clientParams(cl))
+}
+
+// OnDisconnect is called when a client has disconnected
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	var reason string
+	if err != nil {
+		reason = err.Error()
+	}
+
+	h.notify(MethodDisconnected, struct {
+		client
+		Error  string `json:"error,omitempty"`
+		Expire bool   `json:"expire"`
+	}{client: clientParams(cl), Error: reason, Expire: expire})
+}
+
+// filters returns the filters of the subscriptions of the packet
+func filters(pk packets.Packet) []string {
+	filters := make([]string, 0, len(pk.Filters))
+	for _, sub := range pk.Filters {
+		filters = append(filters, sub.Filter)
+	}
+	return filters
+}
+
+// OnSubscribed is called when a client has subscribed to topic filters
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	h.notify(MethodSubscribed, struct {
+		client
+		Filters []string `json:"filters"`
+	}{client: clientParams(cl), Filters: filters(pk)})
+}
+
+// OnUnsubscribed is called when a client has unsubscribed from topic filters
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	h.notify(MethodUnsubscribed, struct {
+		client
+		Filters []string `json:"filters"`
+	}{client: clientParams(cl), Filters: filters(pk)})
+}
+
+// OnPublished is called when a client has published a message
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.notify(MethodPublished, struct {
+		client
+		message
+	}{client: clientParams(cl), message: messageParams(pk)})
+}
@@ -0,0 +1,483 @@
+package sidecar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// notification is a notification the fake sidecar received
+type notification struct {
+	Method string
+	Params map[string]any
+}
+
+// fakeSidecar answers the requests of the hook
+type fakeSidecar struct {
+	path          string
+	listener      net.Listener
+	notifications chan notification
+	conns         []net.Conn
+	mu            sync.Mutex
+}
+
+func newSidecar(t *testing.T) *fakeSidecar {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sidecar.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	s := &fakeSidecar{
+		path:          path,
+		listener:      listener,
+		notifications: make(chan notification, 10),
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		s.disconnect()
+	})
+
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+
+	return s
+}
+
+// disconnect closes the connections of the hook
+func (s *fakeSidecar) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// serve answers each request of the connection concurrently, so responses are out of order
+func (s *fakeSidecar) serve(c net.Conn) {
+	var mu sync.Mutex
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		var req struct {
+			ID     *uint64        `json:"id"`
+			Method string         `json:"method"`
+			Params map[string]any `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return
+		}
+
+		if req.ID == nil {
+			s.notifications <- notification{Method: req.Method, Params: req.Params}
+			continue
+		}
+
+		go func() {
+			resp := map[string]any{"jsonrpc": "2.0", "id": *req.ID}
+			result, err := answer(req.Method, req.Params)
+			if err != nil {
+				resp["error"] = err
+			} else {
+				resp["result"] = result
+			}
+
+			b, _ := json.Marshal(resp)
+			mu.Lock()
+			defer mu.Unlock()
+			c.Write(append(b, '\n'))
+		}()
+	}
+}
+
+// answer allows the clients with the password "p1" to connect, and to publish to topics prefixed by
+// their client id, and changes or rejects messages by their topic
+func answer(method string, params map[string]any) (any, *Error) {
+	clientID, _ := params["client_id"].(string)
+	topic, _ := params["topic"].(string)
+
+	switch method {
+	case MethodAuthenticate:
+		return map[string]any{"allow": params["password"] == "p1"}, nil
+	case MethodACLCheck:
+		time.Sleep(time.Duration(len(topic)%3) * time.Millisecond)
+		return map[string]any{"allow": params["write"] == false || strings.HasPrefix(topic, clientID+"/")}, nil
+	}
+
+	switch topic {
+	case "a/upper":
+		payload, _ := params["payload"].(string)
+		var b []byte
+		_ = json.Unmarshal([]byte(`"`+payload+`"`), &b)
+		return map[string]any{"payload": bytes.ToUpper(b)}, nil
+	case "a/move":
+		return map[string]any{"topic": "b/moved"}, nil
+	case "a/reject":
+		return map[string]any{"reject": true, "reason": 0x99}, nil
+	case "a/deny":
+		return map[string]any{"reject": true}, nil
+	case "a/invalid":
+		return map[string]any{"topic": "a/#"}, nil
+	case "a/error":
+		return nil, &Error{Code: -32000, Message: "failed"}
+	case "a/slow":
+		time.Sleep(200 * time.Millisecond)
+	}
+	return nil, nil
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	sidecarHook := new(Hook)
+	sidecarHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, sidecarHook.Init(options))
+	t.Cleanup(func() { sidecarHook.Stop() })
+	return sidecarHook
+}
+
+func newClient(id, username string, version byte) *mqtt.Client {
+	cl := &mqtt.Client{ID: id}
+	cl.Properties.Username = []byte(username)
+	cl.Properties.ProtocolVersion = version
+	cl.Net.Listener = "tcp"
+	return cl
+}
+
+var allEvents = []string{
+	MethodAuthenticate,
+	MethodACLCheck,
+	MethodPublish,
+	MethodConnected,
+	MethodDisconnected,
+	MethodSubscribed,
+	MethodUnsubscribed,
+	MethodPublished,
+}
+
+func TestID(t *testing.T) {
+	sidecarHook := new(Hook)
+
+	require.Equal(t, "sidecar-hook", sidecarHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	sidecarHook := newHook(t, Options{Path: newSidecar(t).path, Events: []string{MethodACLCheck, MethodPublished}})
+	require.True(t, sidecarHook.Provides(mqtt.OnACLCheck))
+	require.True(t, sidecarHook.Provides(mqtt.OnPublished))
+	require.False(t, sidecarHook.Provides(mqtt.OnConnectAuthenticate))
+	require.False(t, sidecarHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	s := newSidecar(t)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Path: s.path, Events: allEvents},
+			expectError: false,
+		},
+		{
+			name:        "Success - sidecar not listening",
+			config:      Options{Path: filepath.Join(t.TempDir(), "missing.sock"), Events: allEvents},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no path",
+			config:      Options{Events: allEvents},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no events",
+			config:      Options{Path: s.path},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown event",
+			config:      Options{Path: s.path, Events: []string{"on_connect"}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			sidecarHook := new(Hook)
+			sidecarHook.Log = slog.Default()
+			err := sidecarHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				require.NoError(t, sidecarHook.Stop())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, time.Second, sidecarHook.config.Timeout)
+			require.Equal(t, time.Second, sidecarHook.config.ReconnectInterval)
+			require.NoError(t, sidecarHook.Stop())
+
+		})
+	}
+}
+
+func TestOnConnectAuthenticate(t *testing.T) {
+	sidecarHook := newHook(t, Options{Path: newSidecar(t).path, Events: allEvents})
+
+	cl := newClient("c1", "u1", 5)
+	require.True(t, sidecarHook.OnConnectAuthenticate(cl, packets.Packet{Connect: packets.ConnectParams{Password: []byte("p1")}}))
+	require.False(t, sidecarHook.OnConnectAuthenticate(cl, packets.Packet{Connect: packets.ConnectParams{Password: []byte("p2")}}))
+}
+
+func TestOnACLCheck(t *testing.T) {
+	sidecarHook := newHook(t, Options{Path: newSidecar(t).path, Events: allEvents})
+
+	cl := newClient("c1", "u1", 5)
+	require.True(t, sidecarHook.OnACLCheck(cl, "c1/telemetry", true))
+	require.False(t, sidecarHook.OnACLCheck(cl, "c2/telemetry", true))
+	require.True(t, sidecarHook.OnACLCheck(cl, "c2/telemetry", false))
+}
+
+func TestOnPublish(t *testing.T) {
+	s := newSidecar(t)
+	sidecarHook := newHook(t, Options{Path: s.path, Events: allEvents, Timeout: 50 * time.Millisecond})
+	failOpen := newHook(t, Options{Path: s.path, Events: allEvents, FailOpen: true})
+
+	tests := []struct {
+		name        string
+		hook        *Hook
+		client      *mqtt.Client
+		topic       string
+		qos         byte
+		expect      error
+		wantTopic   string
+		wantPayload string
+	}{
+		{
+			name:        "Success - unchanged",
+			hook:        sidecarHook,
+			client:      newClient("c1", "u1", 5),
+			topic:       "a/b",
+			wantTopic:   "a/b",
+			wantPayload: "hello",
+		},
+		{
+			name:        "Success - payload",
+			hook:        sidecarHook,
+			client:      newClient("c1", "u1", 5),
+			topic:       "a/upper",
+			wantTopic:   "a/upper",
+			wantPayload: "HELLO",
+		},
+		{
+			name:        "Success - topic",
+			hook:        sidecarHook,
+			client:      newClient("c1", "u1", 5),
+			topic:       "a/move",
+			wantTopic:   "b/moved",
+			wantPayload: "hello",
+		},
+		{
+			name:        "Success - inline client",
+			hook:        sidecarHook,
+			client:      &mqtt.Client{ID: "inline", Net: mqtt.ClientConnection{Inline: true}},
+			topic:       "a/reject",
+			wantTopic:   "a/reject",
+			wantPayload: "hello",
+		},
+		{
+			name:        "Success - fail open",
+			hook:        failOpen,
+			client:      newClient("c1", "u1", 5),
+			topic:       "a/error",
+			qos:         1,
+			wantTopic:   "a/error",
+			wantPayload: "hello",
+		},
+		{
+			name:   "Failure - rejected with reason",
+			hook:   sidecarHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/reject",
+			qos:    1,
+			expect: packets.Code{Code: 0x99, Reason: "rejected by sidecar"},
+		},
+		{
+			name:   "Failure - rejected",
+			hook:   sidecarHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/deny",
+			qos:    1,
+			expect: packets.ErrNotAuthorized,
+		},
+		{
+			name:   "Failure - rejected v3",
+			hook:   sidecarHook,
+			client: newClient("c1", "u1", 4),
+			topic:  "a/reject",
+			qos:    1,
+			expect: packets.ErrRejectPacket,
+		},
+		{
+			name:   "Failure - invalid topic",
+			hook:   sidecarHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/invalid",
+			qos:    1,
+			expect: packets.ErrImplementationSpecificError,
+		},
+		{
+			name:   "Failure - error",
+			hook:   sidecarHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/error",
+			qos:    2,
+			expect: packets.ErrImplementationSpecificError,
+		},
+		{
+			name:   "Failure - timeout",
+			hook:   sidecarHook,
+			client: newClient("c1", "u1", 5),
+			topic:  "a/slow",
+			expect: packets.ErrRejectPacket,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			pk, err := tt.hook.OnPublish(tt.client, packets.Packet{
+				FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: tt.qos},
+				TopicName:   tt.topic,
+				Payload:     []byte("hello"),
+			})
+			if tt.expect != nil {
+				require.ErrorIs(t, err, tt.expect)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantTopic, pk.TopicName)
+			require.Equal(t, tt.wantPayload, string(pk.Payload))
+
+		})
+	}
+
+	require.Equal(t, Stats{Requests: 9, Failed: 2}, sidecarHook.Stats())
+}
+
+func TestNotifications(t *testing.T) {
+	s := newSidecar(t)
+	sidecarHook := newHook(t, Options{Path: s.path, Events: allEvents})
+
+	cl := newClient("c1", "u1", 5)
+	sidecarHook.OnSessionEstablished(cl, packets.Packet{})
+	sidecarHook.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/#"}, {Filter: "b"}}}, []byte{0, 0})
+	sidecarHook.OnUnsubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/#"}}})
+	sidecarHook.OnPublished(cl, packets.Packet{TopicName: "a/b", Payload: []byte("hello"), FixedHeader: packets.FixedHeader{Qos: 1, Retain: true}})
+	sidecarHook.OnDisconnect(cl, packets.ErrKeepAliveTimeout, true)
+
+	expected := []notification{
+		{Method: MethodConnected, Params: map[string]any{"client_id": "c1", "username": "u1", "listener": "tcp"}},
+		{Method: MethodSubscribed, Params: map[string]any{"client_id": "c1", "username": "u1", "listener": "tcp", "filters": []any{"a/#", "b"}}},
+		{Method: MethodUnsubscribed, Params: map[string]any{"client_id": "c1", "username": "u1", "listener": "tcp", "filters": []any{"a/#"}}},
+		{Method: MethodPublished, Params: map[string]any{"client_id": "c1", "username": "u1", "listener": "tcp", "topic": "a/b", "qos": float64(1), "retain": true, "payload": "aGVsbG8="}},
+		{Method: MethodDisconnected, Params: map[string]any{"client_id": "c1", "username": "u1", "listener": "tcp", "error": packets.ErrKeepAliveTimeout.Reason, "expire": true}},
+	}
+
+	for _, want := range expected {
+		select {
+		case got := <-s.notifications:
+			require.Equal(t, want, got)
+		case <-time.After(time.Second):
+			t.Fatalf("%s not received", want.Method)
+		}
+	}
+
+	require.Equal(t, Stats{Notifications: 5}, sidecarHook.Stats())
+}
+
+func TestFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.sock")
+	sidecarHook := newHook(t, Options{Path: path, Events: allEvents})
+	failOpen := newHook(t, Options{Path: path, Events: allEvents, FailOpen: true})
+
+	cl := newClient("c1", "u1", 5)
+	require.False(t, sidecarHook.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.False(t, sidecarHook.OnACLCheck(cl, "c1/telemetry", true))
+	require.True(t, failOpen.OnConnectAuthenticate(cl, packets.Packet{}))
+	require.True(t, failOpen.OnACLCheck(cl, "c2/telemetry", true))
+
+	sidecarHook.OnPublished(cl, packets.Packet{TopicName: "a/b"})
+	require.Equal(t, Stats{Requests: 2, Failed: 2, Dropped: 1}, sidecarHook.Stats())
+}
+
+func TestReconnect(t *testing.T) {
+	s := newSidecar(t)
+	sidecarHook := newHook(t, Options{Path: s.path, Events: allEvents, ReconnectInterval: 10 * time.Millisecond})
+
+	cl := newClient("c1", "u1", 5)
+	require.True(t, sidecarHook.OnACLCheck(cl, "c1/telemetry", true))
+
+	s.disconnect()
+	require.Eventually(t, func() bool {
+		return sidecarHook.Stats().Reconnects == 1 && sidecarHook.OnACLCheck(cl, "c1/telemetry", true)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	sidecarHook := newHook(t, Options{Path: newSidecar(t).path, Events: allEvents})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cl := newClient(fmt.Sprintf("c%d", i), "u1", 5)
+			for j := 0; j < 50; j++ {
+				require.True(t, sidecarHook.OnACLCheck(cl, fmt.Sprintf("c%d/%d", i, j), true))
+				require.False(t, sidecarHook.OnACLCheck(cl, fmt.Sprintf("other/%d", j), true))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, Stats{Requests: 800}, sidecarHook.Stats())
+}
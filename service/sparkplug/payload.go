@@ -0,0 +1,264 @@
+package sparkplug
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/mochi-mqtt/hooks/policy/protobuf"
+)
+
+// payloadType is the full name of the message type of Sparkplug B payloads
+const payloadType = "org.eclipse.tahu.protobuf.Payload"
+
+// the names of the metrics with special meaning
+const (
+	bdSeqMetric   = "bdSeq"
+	rebirthMetric = "Node Control/Rebirth"
+)
+
+//go:embed sparkplug_b.proto
+var payloadProto string
+
+// descriptors are the message types of Sparkplug B payloads
+var descriptors = func() *protobuf.Descriptors {
+	d, err := protobuf.ParseProto(payloadProto)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}()
+
+// the datatypes of metrics
+const (
+	typeInt8    = 1
+	typeInt16   = 2
+	typeInt32   = 3
+	typeInt64   = 4
+	typeBoolean = 11
+)
+
+// datatypes are the names of the datatypes of metrics, by number
+var datatypes = []string{
+	"Unknown", "Int8", "Int16", "Int32", "Int64", "UInt8", "UInt16", "UInt32", "UInt64", "Float", "Double",
+	"Boolean", "String", "DateTime", "Text", "UUID", "DataSet", "Bytes", "File", "Template", "PropertySet",
+	"PropertySetList", "Int8Array", "Int16Array", "Int32Array", "Int64Array", "UInt8Array", "UInt16Array",
+	"UInt32Array", "UInt64Array", "FloatArray", "DoubleArray", "BooleanArray", "StringArray", "DateTimeArray",
+}
+
+// valueFields are the JSON names of the fields of the value of metrics
+var valueFields = []string{
+	"intValue", "longValue", "floatValue", "doubleValue", "booleanValue", "stringValue", "bytesValue",
+	"datasetValue", "templateValue", "extensionValue",
+}
+
+// Payload is a Sparkplug B payload, as republished as JSON on the mirror namespace
+type Payload struct {
+	Timestamp *uint64  `json:"timestamp,omitempty"`
+	Seq       *uint64  `json:"seq,omitempty"`
+	UUID      string   `json:"uuid,omitempty"`
+	Body      string   `json:"body,omitempty"` // base64
+	Metrics   []Metric `json:"metrics"`
+}
+
+// Metric is a metric of a Sparkplug B payload. The name and datatype of metrics published by alias
+// are those of the metric of the birth certificate with the alias
+type Metric struct {
+	Name       string         `json:"name,omitempty"`
+	Alias      *uint64        `json:"alias,omitempty"`
+	Timestamp  *uint64        `json:"timestamp,omitempty"`
+	Datatype   string         `json:"datatype,omitempty"`
+	Historical bool           `json:"historical,omitempty"`
+	Transient  bool           `json:"transient,omitempty"`
+	Metadata   map[string]any `json:"metadata,omitempty"`
+	Properties map[string]any `json:"properties,omitempty"`
+	Value      any            `json:"value"` // null if the metric is null
+
+	datatype uint32
+	field    string // the JSON name of the field of the value
+	raw      any    // the value as decoded
+	null     bool
+}
+
+// decodePayload decodes a Sparkplug B payload
+func decodePayload(b []byte) (*Payload, error) {
+	v, err := descriptors.Decode(payloadType, b)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Payload{Metrics: []Metric{}}
+	if p.Timestamp, err = optionalUint(v, "timestamp"); err != nil {
+		return nil, err
+	}
+	if p.Seq, err = optionalUint(v, "seq"); err != nil {
+		return nil, err
+	}
+	p.UUID, _ = v["uuid"].(string)
+	p.Body, _ = v["body"].(string)
+
+	metrics, _ := v["metrics"].([]any)
+	for _, value := range metrics {
+		m, err := decodeMetric(value.(map[string]any))
+		if err != nil {
+			return nil, err
+		}
+		p.Metrics = append(p.Metrics, m)
+	}
+
+	return p, nil
+}
+
+// decodeMetric decodes a metric from the values of its fields
+func decodeMetric(v map[string]any) (Metric, error) {
+	var m Metric
+	var err error
+	m.Name, _ = v["name"].(string)
+	if m.Alias, err = optionalUint(v, "alias"); err != nil {
+		return m, err
+	}
+	if m.Timestamp, err = optionalUint(v, "timestamp"); err != nil {
+		return m, err
+	}
+	if datatype, ok := v["datatype"].(int64); ok {
+		m.datatype = uint32(datatype)
+	}
+	m.Historical, _ = v["isHistorical"].(bool)
+	m.Transient, _ = v["isTransient"].(bool)
+	m.null, _ = v["isNull"].(bool)
+	m.Metadata, _ = v["metadata"].(map[string]any)
+	m.Properties, _ = v["properties"].(map[string]any)
+
+	for _, field := range valueFields {
+		if raw, ok := v[field]; ok {
+			m.field, m.raw = field, raw
+		}
+	}
+
+	m.resolve()
+	return m, nil
+}
+
+// resolve sets the datatype name and value of the metric from its datatype number and value as decoded.
+// Signed integers are two's complement in the unsigned fields, and 64 bit integers are numbers
+func (m *Metric) resolve() {
+	m.Datatype = ""
+	if m.datatype > 0 && int(m.datatype) < len(datatypes) {
+		m.Datatype = datatypes[m.datatype]
+	}
+
+	m.Value = m.raw
+	switch {
+	case m.null:
+		m.Value = nil
+	case m.field == "intValue":
+		if v, ok := m.raw.(int64); ok && m.datatype >= typeInt8 && m.datatype <= typeInt32 {
+			m.Value = int64(int32(uint32(v)))
+		}
+	case m.field == "longValue":
+		s, _ := m.raw.(string)
+		m.Value = json.Number(s)
+		if v, err := strconv.ParseUint(s, 10, 64); err == nil && m.datatype == typeInt64 {
+			m.Value = json.Number(strconv.FormatInt(int64(v), 10))
+		}
+	}
+}
+
+// uint returns the value of an integer metric
+func (m *Metric) uint() (uint64, bool) {
+	switch v := m.raw.(type) {
+	case int64:
+		return uint64(v), true
+	case string:
+		n, err := strconv.ParseUint(v, 10, 64)
+		return n, err == nil && m.field == "longValue"
+	}
+	return 0, false
+}
+
+// bdSeq returns the value of the bdSeq metric of the payload of a birth or death certificate of a node
+func (p *Payload) bdSeq() (uint64, error) {
+	for i := range p.Metrics {
+		if p.Metrics[i].Name == bdSeqMetric {
+			bdSeq, ok := p.Metrics[i].uint()
+			if !ok {
+				return 0, errors.New("bdSeq metric is not an integer")
+			}
+			return bdSeq, nil
+		}
+	}
+	return 0, errors.New("missing bdSeq metric")
+}
+
+// validate returns an error if the payload isn't valid for the type of message
+func (p *Payload) validate(typ string) error {
+	switch typ {
+	case NodeBirth, NodeData, DeviceBirth, DeviceData, DeviceDeath:
+		if p.Seq == nil {
+			return errors.New("missing seq")
+		}
+		if *p.Seq > 255 {
+			return fmt.Errorf("seq %d out of range", *p.Seq)
+		}
+	}
+
+	switch typ {
+	case NodeBirth, NodeDeath:
+		if _, err := p.bdSeq(); err != nil {
+			return err
+		}
+	}
+
+	if typ == NodeBirth || typ == DeviceBirth {
+		aliases := make(map[uint64]bool)
+		for _, m := range p.Metrics {
+			if m.Name == "" || m.datatype == 0 {
+				return errors.New("birth certificate metric without a name or datatype")
+			}
+			if m.Alias != nil {
+				if aliases[*m.Alias] {
+					return fmt.Errorf("duplicate alias %d", *m.Alias)
+				}
+				aliases[*m.Alias] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// optionalUint returns the value of an unsigned integer field, or nil if it isn't set
+func optionalUint(v map[string]any, key string) (*uint64, error) {
+	var n uint64
+	switch value := v[key].(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		n = uint64(value)
+	case string:
+		var err error
+		if n, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid %s", key)
+	}
+	return &n, nil
+}
+
+// rebirthPayload returns the payload of a command requesting an edge node to publish its birth
+// certificates again
+func rebirthPayload(timestamp int64) ([]byte, error) {
+	ts := strconv.FormatInt(timestamp, 10)
+	return descriptors.Encode(payloadType, map[string]any{
+		"timestamp": ts,
+		"metrics": []any{map[string]any{
+			"name":         rebirthMetric,
+			"timestamp":    ts,
+			"datatype":     json.Number(strconv.Itoa(typeBoolean)),
+			"booleanValue": true,
+		}},
+	})
+}
@@ -0,0 +1,651 @@
+// Package sparkplug provides a hook making the broker Sparkplug B aware. It validates the topics and
+// payloads of the spBv1.0 namespace, tracks the births, deaths and sequence numbers of edge nodes,
+// republishes their payloads as JSON on a mirror namespace, and maintains the STATE topics of host
+// applications.
+package sparkplug
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/reject"
+)
+
+// ClientID is the id of the inline client which publishes the mirrored messages, rebirth commands and
+// STATE of the broker
+const ClientID = "sparkplug"
+
+// Stats are the totals of the messages handled since the hook was initialized
+type Stats struct {
+	Validated     int64 // the number of messages which were valid
+	Rejected      int64 // the number of messages rejected as invalid
+	OutOfSequence int64 // the number of messages of edge nodes which weren't born, or with an unexpected seq
+	Rebirths      int64 // the number of rebirth commands published
+	Mirrored      int64 // the number of messages republished as JSON
+	Failed        int64 // the number of messages which could not be published
+}
+
+// Node is the state of an edge node
+type Node struct {
+	Group   string
+	ID      string
+	Online  bool
+	BdSeq   uint64   // of the last birth certificate
+	Seq     uint64   // of the last message
+	Devices []string // the devices which are online
+}
+
+// Host is the state of a host application, as last published to its STATE topic
+type Host struct {
+	ID        string
+	Online    bool
+	Timestamp uint64
+}
+
+// state is the payload of STATE messages
+type state struct {
+	Online    *bool   `json:"online"`
+	Timestamp *uint64 `json:"timestamp"`
+}
+
+// node is the state of an edge node, and the metrics of the birth certificates of it and its devices
+type node struct {
+	client  *mqtt.Client // the client which published the birth certificate
+	online  bool
+	bdSeq   uint64
+	seq     uint64
+	rebirth bool // whether a rebirth was requested since the last birth certificate
+	birth   *birth
+	devices map[string]*device
+}
+
+// device is the state of a device of an edge node
+type device struct {
+	online bool
+	birth  *birth
+}
+
+// host is the state of a host application
+type host struct {
+	client    *mqtt.Client // the client which published the state
+	online    bool
+	timestamp uint64
+}
+
+// birth are the names and datatypes of the metrics of a birth certificate, so metrics published by
+// alias can be resolved
+type birth struct {
+	aliases   map[uint64]string
+	datatypes map[string]uint32
+}
+
+// Hook is a hook that validates Sparkplug B messages, tracks the state of edge nodes and host
+// applications, and mirrors the payloads as JSON
+type Hook struct {
+	config  Options
+	client  *mqtt.Client
+	nodes   map[string]*node // by group/node
+	hosts   map[string]*host // by host id
+	online  uint64           // the timestamp of the online STATE of the broker
+	now     func() time.Time
+	mu      sync.Mutex // guards nodes, hosts and online
+	stats   Stats
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the sparkplug hook
+type Options struct {
+	// Server is the server the mirrored messages, rebirth commands and STATE are published to. Required
+	Server *mqtt.Server
+
+	// Mirror is the namespace the payloads are republished to as JSON, eg. spBv1.0-json/{group}/NDATA/{node},
+	// and defaults to spBv1.0-json. Clients may not publish to it
+	Mirror string
+
+	// HostID is the id of the host application the broker publishes its STATE as, online when it
+	// starts and offline when it stops. Clients may not publish to its STATE topic
+	HostID string
+
+	// Rebirth publishes a rebirth command to edge nodes whose messages are out of sequence, or which
+	// publish before their birth certificate, once until their next birth certificate
+	Rebirth bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "sparkplug-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnStopped,
+		mqtt.OnPublish,
+		mqtt.OnPublished,
+		mqtt.OnWillSent,
+		mqtt.OnDisconnect,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	sparkplugHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if sparkplugHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if sparkplugHookConfig.Mirror == "" {
+		sparkplugHookConfig.Mirror = Namespace + "-json"
+	}
+
+	if !validLevel(sparkplugHookConfig.Mirror) || sparkplugHookConfig.Mirror == Namespace {
+		return fmt.Errorf("invalid mirror namespace %q", sparkplugHookConfig.Mirror)
+	}
+
+	if sparkplugHookConfig.HostID != "" && !validLevel(sparkplugHookConfig.HostID) {
+		return fmt.Errorf("invalid host id %q", sparkplugHookConfig.HostID)
+	}
+
+	h.config = sparkplugHookConfig
+	h.nodes = make(map[string]*node)
+	h.hosts = make(map[string]*host)
+	h.client = sparkplugHookConfig.Server.NewClient(nil, "local", ClientID, true)
+	h.client.Properties.ProtocolVersion = 5
+	if h.now == nil {
+		h.now = time.Now
+	}
+
+	return nil
+}
+
+// validLevel returns whether the value is a single topic level without wildcards
+func validLevel(v string) bool {
+	return v != "" && !strings.ContainsAny(v, "/+#")
+}
+
+// Stats returns the totals of the messages handled so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// Nodes returns the state of the edge nodes which have published, by group and id
+func (h *Hook) Nodes() []Node {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	nodes := make([]Node, 0, len(h.nodes))
+	for key, n := range h.nodes {
+		group, id, _ := strings.Cut(key, "/")
+		v := Node{Group: group, ID: id, Online: n.online, BdSeq: n.bdSeq, Seq: n.seq, Devices: []string{}}
+		for name, d := range n.devices {
+			if d.online {
+				v.Devices = append(v.Devices, name)
+			}
+		}
+		sort.Strings(v.Devices)
+		nodes = append(nodes, v)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Group != nodes[j].Group {
+			return nodes[i].Group < nodes[j].Group
+		}
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+// Hosts returns the state of the host applications which have published their STATE, by id
+func (h *Hook) Hosts() []Host {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hosts := make([]Host, 0, len(h.hosts))
+	for id, s := range h.hosts {
+		hosts = append(hosts, Host{ID: id, Online: s.online, Timestamp: s.timestamp})
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].ID < hosts[j].ID
+	})
+	return hosts
+}
+
+// OnStarted is called when the server starts, and publishes the STATE of the broker as online
+func (h *Hook) OnStarted() {
+	if h.config.HostID == "" {
+		return
+	}
+
+	online := uint64(h.now().UnixMilli())
+	h.mu.Lock()
+	h.online = online
+	h.mu.Unlock()
+
+	h.publishState(h.config.HostID, true, online)
+}
+
+// OnStopped is called when the server stops, and publishes the STATE of the broker as offline, with
+// the timestamp of its online STATE as a will would
+func (h *Hook) OnStopped() {
+	if h.config.HostID == "" {
+		return
+	}
+
+	h.mu.Lock()
+	online := h.online
+	h.mu.Unlock()
+
+	h.publishState(h.config.HostID, false, online)
+}
+
+// OnPublish is called when a client publishes a message, and rejects it if it's in the Sparkplug B
+// namespace and its topic, payload or retain flag is invalid, if it's a STATE older than the current
+// STATE of the host, or if it's in the mirror namespace or the STATE topic of the broker. Messages
+// published by inline clients are not checked
+func (h *Hook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	if strings.HasPrefix(pk.TopicName, h.config.Mirror+"/") {
+		h.Log.Debug("rejecting message in the mirror namespace", "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Rejected++ })
+		return pk, reject.Publish(cl, pk, packets.ErrNotAuthorized)
+	}
+
+	if !strings.HasPrefix(pk.TopicName, Namespace+"/") {
+		return pk, nil
+	}
+
+	code, err := h.validate(pk)
+	if err != nil {
+		h.Log.Debug("rejecting invalid sparkplug message", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Rejected++ })
+		return pk, reject.Publish(cl, pk, code)
+	}
+
+	h.count(func(s *Stats) { s.Validated++ })
+	return pk, nil
+}
+
+// validate returns an error, and the code rejecting the message, if it isn't a valid Sparkplug B message
+func (h *Hook) validate(pk packets.Packet) (packets.Code, error) {
+	t, err := ParseTopic(pk.TopicName)
+	if err != nil {
+		return packets.ErrTopicNameInvalid, err
+	}
+
+	if t.Type != State {
+		if pk.FixedHeader.Retain {
+			return packets.ErrRetainNotSupported, fmt.Errorf("%s messages may not be retained", t.Type)
+		}
+
+		p, err := decodePayload(pk.Payload)
+		if err == nil {
+			err = p.validate(t.Type)
+		}
+		return packets.ErrPayloadFormatInvalid, err
+	}
+
+	if t.Host == h.config.HostID {
+		return packets.ErrNotAuthorized, errors.New("STATE of the broker")
+	}
+
+	if !pk.FixedHeader.Retain {
+		return packets.ErrImplementationSpecificError, errors.New("STATE messages must be retained")
+	}
+
+	// an empty message clears the retained STATE
+	if len(pk.Payload) == 0 {
+		return packets.CodeSuccess, nil
+	}
+
+	s, err := parseState(pk.Payload)
+	if err != nil {
+		return packets.ErrPayloadFormatInvalid, err
+	}
+
+	h.mu.Lock()
+	current := h.hosts[t.Host]
+	h.mu.Unlock()
+	if current != nil && *s.Timestamp < current.timestamp {
+		return packets.ErrImplementationSpecificError, errors.New("STATE older than the current STATE")
+	}
+
+	return packets.CodeSuccess, nil
+}
+
+// parseState parses the payload of a STATE message
+func parseState(payload []byte) (state, error) {
+	var s state
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return s, fmt.Errorf("invalid STATE: %w", err)
+	}
+
+	if s.Online == nil || s.Timestamp == nil {
+		return s, errors.New("STATE without online and timestamp")
+	}
+	return s, nil
+}
+
+// OnPublished is called when a client has published a message, and tracks and mirrors it if it's a
+// Sparkplug B message
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	if pk.Ignore || pk.Origin == ClientID {
+		return
+	}
+
+	h.handle(cl, pk)
+}
+
+// OnWillSent is called when the will of a client has been published, and tracks and mirrors it if
+// it's a Sparkplug B message, such as the death certificate of an edge node
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.handle(cl, pk)
+}
+
+// OnDisconnect is called when a client disconnects, and marks the edge nodes it published the birth
+// certificates of as offline, and publishes the STATE of the host applications it published as
+// online as offline, for clients which didn't do so themselves
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if cl.Net.Inline {
+		return
+	}
+
+	h.mu.Lock()
+	for _, n := range h.nodes {
+		if n.client == cl && n.online {
+			n.die()
+		}
+	}
+
+	offline := make(map[string]uint64)
+	for id, s := range h.hosts {
+		if s.client == cl && s.online {
+			s.online = false
+			offline[id] = s.timestamp
+		}
+	}
+	h.mu.Unlock()
+
+	for id, timestamp := range offline {
+		h.publishState(id, false, timestamp)
+	}
+}
+
+// handle tracks a message in the Sparkplug B namespace, and mirrors it as JSON
+func (h *Hook) handle(cl *mqtt.Client, pk packets.Packet) {
+	if !strings.HasPrefix(pk.TopicName, Namespace+"/") {
+		return
+	}
+
+	t, err := ParseTopic(pk.TopicName)
+	if err != nil {
+		return
+	}
+
+	if t.Type == State {
+		h.trackState(cl, t, pk.Payload)
+		return
+	}
+
+	p, err := decodePayload(pk.Payload)
+	if err == nil {
+		err = p.validate(t.Type)
+	}
+	if err != nil {
+		h.Log.Debug("skipped invalid sparkplug message", "error", err, "client", cl.ID, "topic", pk.TopicName)
+		return
+	}
+
+	current, rebirth := h.track(cl, t, p)
+	if rebirth {
+		h.requestRebirth(t)
+	}
+
+	if current {
+		h.mirror(pk, t, p)
+	}
+}
+
+// track updates the state of the edge node of the message, and resolves the names and datatypes of
+// its metrics. It returns whether the message is current, which stale death certificates of previous
+// sessions aren't, and whether a rebirth should be requested
+func (h *Hook) track(cl *mqtt.Client, t Topic, p *Payload) (bool, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := t.Group + "/" + t.Node
+	n := h.nodes[key]
+
+	switch t.Type {
+	case NodeBirth:
+		bdSeq, _ := p.bdSeq()
+		h.nodes[key] = &node{
+			client:  cl,
+			online:  true,
+			bdSeq:   bdSeq,
+			seq:     *p.Seq,
+			birth:   newBirth(p),
+			devices: make(map[string]*device),
+		}
+		return true, false
+
+	case NodeDeath:
+		bdSeq, _ := p.bdSeq()
+		if n != nil && n.bdSeq != bdSeq {
+			h.Log.Debug("skipped stale death certificate", "group", t.Group, "node", t.Node, "bdSeq", bdSeq)
+			return false, false
+		}
+		if n != nil {
+			n.die()
+		}
+		return true, false
+
+	case NodeCommand, DeviceCommand:
+		if n != nil {
+			n.births(t).resolve(p)
+		}
+		return true, false
+	}
+
+	var rebirth bool
+	if n == nil || !n.online || *p.Seq != (n.seq+1)%256 {
+		h.Log.Debug("sparkplug message out of sequence", "group", t.Group, "node", t.Node, "seq", *p.Seq)
+		h.count(func(s *Stats) { s.OutOfSequence++ })
+
+		if n == nil {
+			n = &node{devices: make(map[string]*device)}
+			h.nodes[key] = n
+		}
+
+		rebirth = h.config.Rebirth && !n.rebirth
+		n.rebirth = n.rebirth || rebirth
+	}
+	n.seq = *p.Seq
+
+	switch t.Type {
+	case DeviceBirth:
+		n.devices[t.Device] = &device{online: n.online, birth: newBirth(p)}
+	case DeviceDeath:
+		if d := n.devices[t.Device]; d != nil {
+			d.online = false
+		}
+	}
+
+	n.births(t).resolve(p)
+	return true, rebirth
+}
+
+// trackState updates the state of the host application of a STATE message, unless it's older than
+// the current state
+func (h *Hook) trackState(cl *mqtt.Client, t Topic, payload []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(payload) == 0 {
+		delete(h.hosts, t.Host)
+		return
+	}
+
+	s, err := parseState(payload)
+	if err != nil {
+		return
+	}
+
+	if current := h.hosts[t.Host]; current != nil && *s.Timestamp < current.timestamp {
+		return
+	}
+
+	h.hosts[t.Host] = &host{client: cl, online: *s.Online, timestamp: *s.Timestamp}
+}
+
+// die marks the edge node and its devices as offline
+func (n *node) die() {
+	n.online = false
+	for _, d := range n.devices {
+		d.online = false
+	}
+}
+
+// births returns the birth certificate of the edge node or device of the topic, or nil if it
+// hasn't been born
+func (n *node) births(t Topic) *birth {
+	if !t.isDevice() {
+		return n.birth
+	}
+	if d := n.devices[t.Device]; d != nil {
+		return d.birth
+	}
+	return nil
+}
+
+// newBirth returns the names and datatypes of the metrics of a birth certificate
+func newBirth(p *Payload) *birth {
+	b := &birth{aliases: make(map[uint64]string), datatypes: make(map[string]uint32)}
+	for _, m := range p.Metrics {
+		if m.Alias != nil {
+			b.aliases[*m.Alias] = m.Name
+		}
+		b.datatypes[m.Name] = m.datatype
+	}
+	return b
+}
+
+// resolve sets the names and datatypes of the metrics of the payload which were published by alias or
+// without a datatype to those of the birth certificate
+func (b *birth) resolve(p *Payload) {
+	if b == nil {
+		return
+	}
+
+	for i := range p.Metrics {
+		m := &p.Metrics[i]
+		if m.Name == "" && m.Alias != nil {
+			m.Name = b.aliases[*m.Alias]
+		}
+		if m.datatype == 0 {
+			m.datatype = b.datatypes[m.Name]
+		}
+		m.resolve()
+	}
+}
+
+// mirror republishes the payload of the message as JSON to its topic in the mirror namespace
+func (h *Hook) mirror(pk packets.Packet, t Topic, p *Payload) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		h.Log.Warn("sparkplug payload could not be mirrored", "error", err, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	if err := h.publish(t.In(h.config.Mirror), payload, pk.FixedHeader.Qos, false, true); err != nil {
+		h.Log.Error("error occurred while publishing mirrored sparkplug message", "error", err, "topic", pk.TopicName)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.count(func(s *Stats) { s.Mirrored++ })
+}
+
+// requestRebirth publishes a rebirth command to the edge node of the topic
+func (h *Hook) requestRebirth(t Topic) {
+	topic := Topic{Group: t.Group, Type: NodeCommand, Node: t.Node}.String()
+	payload, err := rebirthPayload(h.now().UnixMilli())
+	if err == nil {
+		err = h.publish(topic, payload, 0, false, false)
+	}
+
+	if err != nil {
+		h.Log.Error("error occurred while requesting rebirth", "error", err, "topic", topic)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.Log.Info("requested rebirth of sparkplug edge node", "group", t.Group, "node", t.Node)
+	h.count(func(s *Stats) { s.Rebirths++ })
+}
+
+// publishState publishes the retained STATE of the host application
+func (h *Hook) publishState(id string, online bool, timestamp uint64) {
+	topic := Topic{Type: State, Host: id}.String()
+	payload, err := json.Marshal(state{Online: &online, Timestamp: &timestamp})
+	if err == nil {
+		err = h.publish(topic, payload, 1, true, true)
+	}
+
+	if err != nil {
+		h.Log.Error("error occurred while publishing sparkplug STATE", "error", err, "topic", topic)
+		h.count(func(s *Stats) { s.Failed++ })
+	}
+}
+
+// publish publishes a message from the inline client of the hook
+func (h *Hook) publish(topic string, payload []byte, qos byte, retain, isJSON bool) error {
+	properties := packets.Properties{ContentType: "application/x-protobuf"}
+	if isJSON {
+		properties = packets.Properties{PayloadFormat: 1, PayloadFormatFlag: true, ContentType: "application/json"}
+	}
+
+	return h.config.Server.InjectPacket(h.client, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    qos,
+			Retain: retain,
+		},
+		TopicName:  topic,
+		Payload:    payload,
+		PacketID:   uint16(qos),
+		Properties: properties,
+	})
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
@@ -0,0 +1,466 @@
+package sparkplug
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	sparkplugHook := new(Hook)
+	sparkplugHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	sparkplugHook.now = func() time.Time { return time.UnixMilli(1700000000000) }
+	require.NoError(t, sparkplugHook.Init(options))
+	return sparkplugHook
+}
+
+func newClient(server *mqtt.Server, id string) *mqtt.Client {
+	cl := server.NewClient(nil, "t1", id, false)
+	cl.Properties.ProtocolVersion = 5
+	return cl
+}
+
+// subscribe returns the messages published to the filter
+func subscribe(t *testing.T, server *mqtt.Server, filter string) chan packets.Packet {
+	t.Helper()
+
+	received := make(chan packets.Packet, 10)
+	require.NoError(t, server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	}))
+	return received
+}
+
+// receive returns the next message received
+func receive(t *testing.T, received chan packets.Packet) packets.Packet {
+	t.Helper()
+
+	select {
+	case pk := <-received:
+		return pk
+	case <-time.After(5 * time.Second):
+		t.Fatal("message wasn't published")
+	}
+	return packets.Packet{}
+}
+
+// encode returns the Sparkplug B payload of its protobuf JSON
+func encode(t *testing.T, payload string) []byte {
+	t.Helper()
+
+	dec := json.NewDecoder(strings.NewReader(payload))
+	dec.UseNumber()
+
+	var v map[string]any
+	require.NoError(t, dec.Decode(&v))
+
+	b, err := descriptors.Encode(payloadType, v)
+	require.NoError(t, err)
+	return b
+}
+
+func publish(topic string, payload []byte, qos byte, retain bool) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: qos, Retain: retain},
+		TopicName:   topic,
+		Payload:     payload,
+	}
+}
+
+const (
+	testBirth = `{"timestamp": "1700000000000", "seq": "0", "metrics": [
+		{"name": "bdSeq", "datatype": 8, "longValue": "3"},
+		{"name": "temperature", "alias": "1", "datatype": 10, "doubleValue": 21.5},
+		{"name": "offset", "alias": "2", "datatype": 1, "intValue": 4294967295}
+	]}`
+	testDeviceBirth = `{"seq": "1", "metrics": [{"name": "running", "alias": "1", "datatype": 11, "booleanValue": true}]}`
+)
+
+func TestID(t *testing.T) {
+	sparkplugHook := new(Hook)
+
+	require.Equal(t, "sparkplug-hook", sparkplugHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	sparkplugHook := new(Hook)
+
+	require.True(t, sparkplugHook.Provides(mqtt.OnPublish))
+	require.True(t, sparkplugHook.Provides(mqtt.OnPublished))
+	require.True(t, sparkplugHook.Provides(mqtt.OnWillSent))
+	require.True(t, sparkplugHook.Provides(mqtt.OnDisconnect))
+	require.False(t, sparkplugHook.Provides(mqtt.OnConnect))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - defaults",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Success - host",
+			config:      Options{Server: mqtt.New(nil), Mirror: "spJSON", HostID: "scada", Rebirth: true},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - mirror with levels",
+			config:      Options{Server: mqtt.New(nil), Mirror: "json/spBv1.0"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - mirror of the namespace",
+			config:      Options{Server: mqtt.New(nil), Mirror: Namespace},
+			expectError: true,
+		},
+		{
+			name:        "Failure - wildcard host id",
+			config:      Options{Server: mqtt.New(nil), HostID: "scada+"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			sparkplugHook := new(Hook)
+			sparkplugHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := sparkplugHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.NotEmpty(t, sparkplugHook.config.Mirror)
+			}
+
+		})
+	}
+}
+
+func TestParseTopic(t *testing.T) {
+	tests := map[string]Topic{
+		"spBv1.0/plant/NBIRTH/edge":       {Group: "plant", Type: NodeBirth, Node: "edge"},
+		"spBv1.0/plant/NCMD/edge":         {Group: "plant", Type: NodeCommand, Node: "edge"},
+		"spBv1.0/plant/DDATA/edge/pump-1": {Group: "plant", Type: DeviceData, Node: "edge", Device: "pump-1"},
+		"spBv1.0/STATE/scada":             {Type: State, Host: "scada"},
+	}
+
+	for topic, expect := range tests {
+		parsed, err := ParseTopic(topic)
+		require.NoError(t, err, topic)
+		require.Equal(t, expect, parsed)
+		require.Equal(t, topic, parsed.String())
+	}
+
+	require.Equal(t, "json/plant/DDATA/edge/pump-1", tests["spBv1.0/plant/DDATA/edge/pump-1"].In("json"))
+
+	for _, topic := range []string{
+		"spAv1.0/plant/NBIRTH/edge",
+		"spBv1.0/plant/NBIRTH",
+		"spBv1.0/plant/NBIRTH/edge/pump-1",
+		"spBv1.0/plant/DBIRTH/edge",
+		"spBv1.0/plant/NSTATUS/edge",
+		"spBv1.0/plant/NDATA//",
+		"spBv1.0/STATE",
+		"spBv1.0/STATE/scada/primary",
+	} {
+		_, err := ParseTopic(topic)
+		require.Error(t, err, topic)
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	p, err := decodePayload(encode(t, `{"timestamp": "1700000000000", "seq": "7", "metrics": [
+		{"name": "int8", "datatype": 1, "intValue": 4294967295},
+		{"name": "uint32", "datatype": 7, "intValue": 4294967295},
+		{"name": "int64", "datatype": 4, "longValue": "18446744073709551611"},
+		{"name": "uint64", "datatype": 8, "longValue": "18446744073709551611"},
+		{"name": "float", "datatype": 9, "floatValue": 1.5},
+		{"name": "string", "datatype": 12, "stringValue": "on"},
+		{"name": "null", "datatype": 3, "isNull": true},
+		{"alias": "4", "timestamp": "1700000000001", "isHistorical": true, "booleanValue": false}
+	]}`))
+	require.NoError(t, err)
+
+	b, err := json.Marshal(p)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"timestamp": 1700000000000, "seq": 7, "metrics": [
+		{"name": "int8", "datatype": "Int8", "value": -1},
+		{"name": "uint32", "datatype": "UInt32", "value": 4294967295},
+		{"name": "int64", "datatype": "Int64", "value": -5},
+		{"name": "uint64", "datatype": "UInt64", "value": 18446744073709551611},
+		{"name": "float", "datatype": "Float", "value": 1.5},
+		{"name": "string", "datatype": "String", "value": "on"},
+		{"name": "null", "datatype": "Int32", "value": null},
+		{"alias": 4, "timestamp": 1700000000001, "historical": true, "value": false}
+	]}`, string(b))
+
+	_, err = decodePayload([]byte{0x08})
+	require.Error(t, err)
+}
+
+func TestOnPublish(t *testing.T) {
+	server := newServer(t)
+	sparkplugHook := newHook(t, Options{Server: server, HostID: "broker"})
+	cl := newClient(server, "edge")
+
+	tests := []struct {
+		name   string
+		pk     packets.Packet
+		expect error
+	}{
+		{
+			name: "node birth",
+			pk:   publish("spBv1.0/plant/NBIRTH/edge", encode(t, testBirth), 0, false),
+		},
+		{
+			name: "node command",
+			pk:   publish("spBv1.0/plant/NCMD/edge", nil, 1, false),
+		},
+		{
+			name: "state",
+			pk:   publish("spBv1.0/STATE/scada", []byte(`{"online": true, "timestamp": 1700000000000}`), 1, true),
+		},
+		{
+			name: "cleared state",
+			pk:   publish("spBv1.0/STATE/scada", nil, 1, true),
+		},
+		{
+			name: "other topic",
+			pk:   publish("plant/edge", []byte("x"), 1, true),
+		},
+		{
+			name:   "invalid topic",
+			pk:     publish("spBv1.0/plant/NDATA/edge/pump-1", encode(t, `{"seq": "1"}`), 1, false),
+			expect: packets.ErrTopicNameInvalid,
+		},
+		{
+			name:   "retained data",
+			pk:     publish("spBv1.0/plant/NDATA/edge", encode(t, `{"seq": "1"}`), 1, true),
+			expect: packets.ErrRetainNotSupported,
+		},
+		{
+			name:   "invalid payload",
+			pk:     publish("spBv1.0/plant/NDATA/edge", []byte("{}"), 1, false),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "missing seq",
+			pk:     publish("spBv1.0/plant/DDATA/edge/pump-1", encode(t, `{"timestamp": "1"}`), 1, false),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "seq out of range",
+			pk:     publish("spBv1.0/plant/NDATA/edge", encode(t, `{"seq": "256"}`), 1, false),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "missing bdSeq",
+			pk:     publish("spBv1.0/plant/NDEATH/edge", encode(t, `{}`), 1, false),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "birth metric without datatype",
+			pk:     publish("spBv1.0/plant/DBIRTH/edge/pump-1", encode(t, `{"seq": "1", "metrics": [{"name": "a"}]}`), 1, false),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "duplicate alias",
+			pk:     publish("spBv1.0/plant/DBIRTH/edge/pump-1", encode(t, `{"seq": "1", "metrics": [{"name": "a", "alias": "1", "datatype": 11}, {"name": "b", "alias": "1", "datatype": 11}]}`), 1, false),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "state not retained",
+			pk:     publish("spBv1.0/STATE/scada", []byte(`{"online": true, "timestamp": 1}`), 1, false),
+			expect: packets.ErrImplementationSpecificError,
+		},
+		{
+			name:   "invalid state",
+			pk:     publish("spBv1.0/STATE/scada", []byte(`ONLINE`), 1, true),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "state without timestamp",
+			pk:     publish("spBv1.0/STATE/scada", []byte(`{"online": true}`), 1, true),
+			expect: packets.ErrPayloadFormatInvalid,
+		},
+		{
+			name:   "state of the broker",
+			pk:     publish("spBv1.0/STATE/broker", []byte(`{"online": false, "timestamp": 1}`), 1, true),
+			expect: packets.ErrNotAuthorized,
+		},
+		{
+			name:   "mirror namespace",
+			pk:     publish("spBv1.0-json/plant/NDATA/edge", []byte(`{}`), 1, false),
+			expect: packets.ErrNotAuthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := sparkplugHook.OnPublish(cl, tt.pk)
+			if tt.expect == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tt.expect)
+			}
+		})
+	}
+
+	// a STATE older than the current STATE of the host is rejected
+	sparkplugHook.OnPublished(cl, publish("spBv1.0/STATE/scada", []byte(`{"online": true, "timestamp": 1700000000000}`), 1, true))
+	_, err := sparkplugHook.OnPublish(cl, publish("spBv1.0/STATE/scada", []byte(`{"online": false, "timestamp": 1600000000000}`), 1, true))
+	require.ErrorIs(t, err, packets.ErrImplementationSpecificError)
+
+	// v3 clients, and messages without acks, are disconnected
+	v3 := server.NewClient(nil, "t1", "v3", false)
+	v3.Properties.ProtocolVersion = 4
+	_, err = sparkplugHook.OnPublish(v3, publish("spBv1.0/plant/NDATA/edge", nil, 1, false))
+	require.ErrorIs(t, err, packets.ErrRejectPacket)
+
+	// inline clients aren't checked
+	_, err = sparkplugHook.OnPublish(server.NewClient(nil, "local", "inline", true), publish("spBv1.0/plant/NDATA/edge", nil, 1, true))
+	require.NoError(t, err)
+
+	require.Equal(t, Stats{Validated: 4, Rejected: 15}, sparkplugHook.Stats())
+}
+
+func TestTrack(t *testing.T) {
+	server := newServer(t)
+	sparkplugHook := newHook(t, Options{Server: server, Rebirth: true})
+	mirrored := subscribe(t, server, "spBv1.0-json/#")
+	commands := subscribe(t, server, "spBv1.0/+/NCMD/+")
+	cl := newClient(server, "edge")
+
+	sparkplugHook.OnPublished(cl, publish("spBv1.0/plant/NBIRTH/edge", encode(t, testBirth), 0, false))
+	pk := receive(t, mirrored)
+	require.Equal(t, "spBv1.0-json/plant/NBIRTH/edge", pk.TopicName)
+	require.Equal(t, "application/json", pk.Properties.ContentType)
+	require.JSONEq(t, `{"timestamp": 1700000000000, "seq": 0, "metrics": [
+		{"name": "bdSeq", "datatype": "UInt64", "value": 3},
+		{"name": "temperature", "alias": 1, "datatype": "Double", "value": 21.5},
+		{"name": "offset", "alias": 2, "datatype": "Int8", "value": -1}
+	]}`, string(pk.Payload))
+
+	// the metrics of data published by alias are named after those of the birth certificate
+	sparkplugHook.OnPublished(cl, publish("spBv1.0/plant/DBIRTH/edge/pump-1", encode(t, testDeviceBirth), 0, false))
+	require.Equal(t, "spBv1.0-json/plant/DBIRTH/edge/pump-1", receive(t, mirrored).TopicName)
+
+	sparkplugHook.OnPublished(cl, publish("spBv1.0/plant/NDATA/edge", encode(t, `{"seq": "2", "metrics": [{"alias": "2", "intValue": 4294967294}]}`), 0, false))
+	require.JSONEq(t, `{"seq": 2, "metrics": [{"name": "offset", "alias": 2, "datatype": "Int8", "value": -2}]}`, string(receive(t, mirrored).Payload))
+
+	sparkplugHook.OnPublished(cl, publish("spBv1.0/plant/DDATA/edge/pump-1", encode(t, `{"seq": "3", "metrics": [{"alias": "1", "booleanValue": false}]}`), 0, false))
+	require.JSONEq(t, `{"seq": 3, "metrics": [{"name": "running", "alias": 1, "datatype": "Boolean", "value": false}]}`, string(receive(t, mirrored).Payload))
+
+	require.Equal(t, []Node{{Group: "plant", ID: "edge", Online: true, BdSeq: 3, Seq: 3, Devices: []string{"pump-1"}}}, sparkplugHook.Nodes())
+
+	// a message out of sequence requests a rebirth, once
+	sparkplugHook.OnPublished(cl, publish("spBv1.0/plant/NDATA/edge", encode(t, `{"seq": "5"}`), 0, false))
+	receive(t, mirrored)
+	pk = receive(t, commands)
+	require.Equal(t, "spBv1.0/plant/NCMD/edge", pk.TopicName)
+	p, err := decodePayload(pk.Payload)
+	require.NoError(t, err)
+	require.Equal(t, rebirthMetric, p.Metrics[0].Name)
+	require.Equal(t, true, p.Metrics[0].Value)
+
+	sparkplugHook.OnPublished(cl, publish("spBv1.0/plant/NDATA/edge", encode(t, `{"seq": "9"}`), 0, false))
+	receive(t, mirrored)
+	require.Empty(t, commands)
+
+	// the death certificate of a previous session is stale
+	sparkplugHook.OnWillSent(cl, publish("spBv1.0/plant/NDEATH/edge", encode(t, `{"metrics": [{"name": "bdSeq", "datatype": 8, "longValue": "2"}]}`), 1, false))
+	require.True(t, sparkplugHook.Nodes()[0].Online)
+
+	sparkplugHook.OnWillSent(cl, publish("spBv1.0/plant/NDEATH/edge", encode(t, `{"metrics": [{"name": "bdSeq", "datatype": 8, "longValue": "3"}]}`), 1, false))
+	require.Equal(t, "spBv1.0-json/plant/NDEATH/edge", receive(t, mirrored).TopicName)
+	require.Equal(t, []Node{{Group: "plant", ID: "edge", BdSeq: 3, Seq: 9, Devices: []string{}}}, sparkplugHook.Nodes())
+
+	// messages of edge nodes which weren't born are out of sequence
+	sparkplugHook.OnPublished(cl, publish("spBv1.0/plant/DDATA/other/pump-1", encode(t, `{"seq": "1"}`), 0, false))
+	receive(t, mirrored)
+	require.Equal(t, "spBv1.0/plant/NCMD/other", receive(t, commands).TopicName)
+
+	require.Equal(t, Stats{OutOfSequence: 3, Rebirths: 2, Mirrored: 8}, sparkplugHook.Stats())
+}
+
+func TestDisconnect(t *testing.T) {
+	server := newServer(t)
+	sparkplugHook := newHook(t, Options{Server: server})
+	edge, scada := newClient(server, "edge"), newClient(server, "scada")
+
+	sparkplugHook.OnPublished(edge, publish("spBv1.0/plant/NBIRTH/edge", encode(t, testBirth), 0, false))
+	sparkplugHook.OnPublished(edge, publish("spBv1.0/plant/DBIRTH/edge/pump-1", encode(t, testDeviceBirth), 0, false))
+	sparkplugHook.OnPublished(scada, publish("spBv1.0/STATE/scada", []byte(`{"online": true, "timestamp": 1700000000000}`), 1, true))
+	require.Equal(t, []Host{{ID: "scada", Online: true, Timestamp: 1700000000000}}, sparkplugHook.Hosts())
+
+	// edge nodes which disconnect without a death certificate are offline
+	sparkplugHook.OnDisconnect(edge, nil, false)
+	require.Equal(t, []Node{{Group: "plant", ID: "edge", BdSeq: 3, Seq: 1, Devices: []string{}}}, sparkplugHook.Nodes())
+
+	// the STATE of host applications which disconnect without publishing it offline is published offline
+	sparkplugHook.OnDisconnect(scada, nil, false)
+	pk, ok := server.Topics.Retained.Get("spBv1.0/STATE/scada")
+	require.True(t, ok)
+	require.JSONEq(t, `{"online": false, "timestamp": 1700000000000}`, string(pk.Payload))
+	require.Equal(t, []Host{{ID: "scada", Timestamp: 1700000000000}}, sparkplugHook.Hosts())
+
+	// an empty STATE clears the host
+	sparkplugHook.OnPublished(scada, publish("spBv1.0/STATE/scada", nil, 1, true))
+	require.Empty(t, sparkplugHook.Hosts())
+}
+
+func TestState(t *testing.T) {
+	server := newServer(t)
+	sparkplugHook := newHook(t, Options{Server: server, HostID: "broker"})
+
+	sparkplugHook.OnStarted()
+	pk, ok := server.Topics.Retained.Get("spBv1.0/STATE/broker")
+	require.True(t, ok)
+	require.JSONEq(t, `{"online": true, "timestamp": 1700000000000}`, string(pk.Payload))
+
+	sparkplugHook.now = func() time.Time { return time.UnixMilli(1700000005000) }
+	sparkplugHook.OnStopped()
+	pk, ok = server.Topics.Retained.Get("spBv1.0/STATE/broker")
+	require.True(t, ok)
+	require.JSONEq(t, `{"online": false, "timestamp": 1700000000000}`, string(pk.Payload))
+	require.Equal(t, Stats{}, sparkplugHook.Stats())
+}
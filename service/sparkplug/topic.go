@@ -0,0 +1,98 @@
+package sparkplug
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Namespace is the first topic level of Sparkplug B messages
+const Namespace = "spBv1.0"
+
+// the message types of Sparkplug B topics
+const (
+	NodeBirth     = "NBIRTH"
+	NodeDeath     = "NDEATH"
+	NodeData      = "NDATA"
+	NodeCommand   = "NCMD"
+	DeviceBirth   = "DBIRTH"
+	DeviceDeath   = "DDEATH"
+	DeviceData    = "DDATA"
+	DeviceCommand = "DCMD"
+	State         = "STATE"
+)
+
+// Topic is a parsed Sparkplug B topic, spBv1.0/{group}/{type}/{node}[/{device}] or
+// spBv1.0/STATE/{host}
+type Topic struct {
+	Group  string
+	Type   string
+	Node   string
+	Device string // of device messages only
+	Host   string // of STATE messages only
+}
+
+// ParseTopic parses a topic in the Sparkplug B namespace
+func ParseTopic(topic string) (Topic, error) {
+	levels := strings.Split(topic, "/")
+	if levels[0] != Namespace {
+		return Topic{}, fmt.Errorf("topic not in the %s namespace", Namespace)
+	}
+
+	for _, level := range levels[1:] {
+		if level == "" {
+			return Topic{}, errors.New("empty topic level")
+		}
+	}
+
+	if len(levels) > 1 && levels[1] == State {
+		if len(levels) != 3 {
+			return Topic{}, errors.New("STATE topics are spBv1.0/STATE/{host}")
+		}
+		return Topic{Type: State, Host: levels[2]}, nil
+	}
+
+	if len(levels) < 4 {
+		return Topic{}, errors.New("topic without a message type and edge node")
+	}
+
+	t := Topic{Group: levels[1], Type: levels[2], Node: levels[3]}
+	switch t.Type {
+	case NodeBirth, NodeDeath, NodeData, NodeCommand:
+		if len(levels) != 4 {
+			return Topic{}, fmt.Errorf("%s topics are spBv1.0/{group}/%s/{node}", t.Type, t.Type)
+		}
+	case DeviceBirth, DeviceDeath, DeviceData, DeviceCommand:
+		if len(levels) != 5 {
+			return Topic{}, fmt.Errorf("%s topics are spBv1.0/{group}/%s/{node}/{device}", t.Type, t.Type)
+		}
+		t.Device = levels[4]
+	default:
+		return Topic{}, fmt.Errorf("unknown message type %q", t.Type)
+	}
+
+	return t, nil
+}
+
+// String returns the topic in the namespace
+func (t Topic) String() string {
+	return t.In(Namespace)
+}
+
+// In returns the topic in a namespace, such as the mirror namespace
+func (t Topic) In(namespace string) string {
+	if t.Type == State {
+		return namespace + "/" + State + "/" + t.Host
+	}
+
+	topic := namespace + "/" + t.Group + "/" + t.Type + "/" + t.Node
+	if t.Device != "" {
+		topic += "/" + t.Device
+	}
+	return topic
+}
+
+// isDevice returns whether the topic is of a device message
+func (t Topic) isDevice() bool {
+	return t.Device != ""
+}
@@ -0,0 +1,114 @@
+package takeover
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// Registry records which broker owns the session of each client id, and carries the takeovers of
+// sessions to their previous owners. It must be shared by the brokers, and safe for concurrent use
+type Registry interface {
+	// Claim records the node as the owner of the session of the client id, and returns the node which
+	// owned it before, or "" if none did
+	Claim(ctx context.Context, clientID, node string) (string, error)
+
+	// Owner returns the node owning the session of the client id, or "" if none does
+	Owner(ctx context.Context, clientID string) (string, error)
+
+	// Release forgets the owner of the session of the client id, if it is still the node
+	Release(ctx context.Context, clientID, node string) error
+
+	// Signal asks the node to discard its session of the client id
+	Signal(ctx context.Context, node, clientID string) error
+
+	// Receive waits for a client id whose session the node is asked to discard, and returns "" if
+	// none is received within a short wait
+	Receive(ctx context.Context, node string) (string, error)
+}
+
+// DefaultRedisPrefix is the prefix of the keys written by a RedisRegistry
+const DefaultRedisPrefix = "mqtt:takeover:"
+
+// release deletes the owner of a session if it is still the node ARGV[1]
+var release = redisclient.NewScript(`if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+
+// RedisRegistry keeps the owner of the session of each client id in a Redis string at the prefix
+// followed by owner:<client id>, and the takeovers of each node in a list at the prefix followed by
+// signal:<node>, which expires an hour after its last takeover so the lists of stopped brokers don't
+// accumulate
+type RedisRegistry struct {
+	client redisclient.Client
+	prefix string
+}
+
+// NewRedisRegistry returns a registry using the client, eg. one returned by redisclient.NewClient. The
+// prefix defaults to DefaultRedisPrefix, and Receive waits a second for takeovers, which must be
+// shorter than the Timeout of the client
+func NewRedisRegistry(client redisclient.Client, prefix string) *RedisRegistry {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+
+	return &RedisRegistry{client: client, prefix: prefix}
+}
+
+// Claim sets the node as the owner of the session
+func (r *RedisRegistry) Claim(ctx context.Context, clientID, node string) (string, error) {
+	reply, err := r.client.Do(ctx, "GETSET", r.prefix+"owner:"+clientID, node)
+	if err != nil {
+		return "", err
+	}
+
+	previous, _ := reply.(string)
+	return previous, nil
+}
+
+// Owner returns the owner of the session
+func (r *RedisRegistry) Owner(ctx context.Context, clientID string) (string, error) {
+	reply, err := r.client.Do(ctx, "GET", r.prefix+"owner:"+clientID)
+	if err != nil {
+		return "", err
+	}
+
+	owner, _ := reply.(string)
+	return owner, nil
+}
+
+// Release deletes the owner of the session if it is the node
+func (r *RedisRegistry) Release(ctx context.Context, clientID, node string) error {
+	_, err := release.Run(ctx, r.client, []string{r.prefix + "owner:" + clientID}, node)
+	return err
+}
+
+// Signal appends the client id to the takeovers of the node
+func (r *RedisRegistry) Signal(ctx context.Context, node, clientID string) error {
+	key := r.prefix + "signal:" + node
+	_, err := redisclient.Pipeline(ctx, r.client,
+		[]any{"RPUSH", key, clientID},
+		[]any{"EXPIRE", key, int64(time.Hour.Seconds())},
+	)
+	return err
+}
+
+// Receive pops the next takeover of the node, waiting a second for one with BLPOP
+func (r *RedisRegistry) Receive(ctx context.Context, node string) (string, error) {
+	key := r.prefix + "signal:" + node
+	reply, err := r.client.Do(ctx, "BLPOP", key, int64(1))
+	if err != nil || reply == nil {
+		return "", err
+	}
+
+	popped, ok := reply.([]any)
+	if !ok || len(popped) != 2 {
+		return "", fmt.Errorf("unexpected reply to BLPOP %s", key)
+	}
+
+	clientID, _ := popped[1].(string)
+	return clientID, nil
+}
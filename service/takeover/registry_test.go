@@ -0,0 +1,106 @@
+package takeover
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// fakeRedis answers the commands of the RedisRegistry from memory
+type fakeRedis struct {
+	values  map[string]string
+	lists   map[string][]string
+	expires map[string]int64
+}
+
+func (r *fakeRedis) Do(ctx context.Context, args ...any) (any, error) {
+	switch args[0] {
+	case "GETSET", "GET":
+		key := args[1].(string)
+		v, ok := r.values[key]
+		if args[0] == "GETSET" {
+			r.values[key] = args[2].(string)
+		}
+		if !ok {
+			return nil, nil
+		}
+		return v, nil
+	case "EVALSHA":
+		return nil, redisclient.Error("NOSCRIPT No matching script. Please use EVAL.")
+	case "EVAL":
+		key := args[3].(string)
+		if r.values[key] == args[4].(string) {
+			delete(r.values, key)
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case "RPUSH":
+		key := args[1].(string)
+		r.lists[key] = append(r.lists[key], args[2].(string))
+		return int64(len(r.lists[key])), nil
+	case "EXPIRE":
+		r.expires[args[1].(string)] = args[2].(int64)
+		return int64(1), nil
+	case "BLPOP":
+		key := args[1].(string)
+		if len(r.lists[key]) == 0 {
+			return nil, nil
+		}
+		v := r.lists[key][0]
+		r.lists[key] = r.lists[key][1:]
+		return []any{key, v}, nil
+	}
+	return nil, redisclient.Error("ERR unknown command")
+}
+
+func (r *fakeRedis) Close() error {
+	return nil
+}
+
+func TestRedisRegistry(t *testing.T) {
+	r := &fakeRedis{values: make(map[string]string), lists: make(map[string][]string), expires: make(map[string]int64)}
+	registry := NewRedisRegistry(r, "")
+	ctx := context.Background()
+
+	previous, err := registry.Claim(ctx, "c1", "node-1")
+	require.NoError(t, err)
+	require.Empty(t, previous)
+
+	previous, err = registry.Claim(ctx, "c1", "node-2")
+	require.NoError(t, err)
+	require.Equal(t, "node-1", previous)
+	require.Equal(t, "node-2", r.values["mqtt:takeover:owner:c1"])
+
+	owner, err := registry.Owner(ctx, "c1")
+	require.NoError(t, err)
+	require.Equal(t, "node-2", owner)
+
+	// only the owner releases the session
+	require.NoError(t, registry.Release(ctx, "c1", "node-1"))
+	require.Contains(t, r.values, "mqtt:takeover:owner:c1")
+	require.NoError(t, registry.Release(ctx, "c1", "node-2"))
+	require.NotContains(t, r.values, "mqtt:takeover:owner:c1")
+
+	owner, err = registry.Owner(ctx, "c1")
+	require.NoError(t, err)
+	require.Empty(t, owner)
+
+	require.NoError(t, registry.Signal(ctx, "node-1", "c1"))
+	require.NoError(t, registry.Signal(ctx, "node-1", "c2"))
+	require.Equal(t, int64(time.Hour.Seconds()), r.expires["mqtt:takeover:signal:node-1"])
+
+	for _, expect := range []string{"c1", "c2", ""} {
+		clientID, err := registry.Receive(ctx, "node-1")
+		require.NoError(t, err)
+		require.Equal(t, expect, clientID)
+	}
+
+	registry = NewRedisRegistry(r, "t:")
+	_, err = registry.Claim(ctx, "c1", "node-1")
+	require.NoError(t, err)
+	require.Equal(t, "node-1", r.values["t:owner:c1"])
+}
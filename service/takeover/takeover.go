@@ -0,0 +1,314 @@
+// Package takeover provides a hook which coordinates session takeovers between brokers sharing a
+// Registry, eg. behind a load balancer, so a client id has a single session across them. When a
+// client establishes a session on a broker, the broker claims its client id, and a broker which owned
+// it before is signalled to disconnect its connection with ErrSessionTakenOver and discard its
+// session, as a single broker does when a client reconnects to it.
+//
+// Sessions are not transferred between brokers: the subscriptions and inflight messages of the
+// previous session are discarded with it, and clients resuming a session on another broker should
+// subscribe again, unless the brokers share their sessions through a storage hook.
+package takeover
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Stats are the totals of the sessions coordinated since the hook was initialized
+type Stats struct {
+	Claimed   int64 // the number of sessions claimed
+	Signalled int64 // the number of previous owners signalled to discard sessions
+	Discarded int64 // the number of sessions discarded as another broker took them over
+	Failed    int64 // the number of calls to the registry which failed
+}
+
+// Hook is a hook that claims the sessions established on the broker in a shared registry, and
+// discards the sessions other brokers take over
+type Hook struct {
+	config  Options
+	taken   map[*mqtt.Client]bool // the connections disconnected as their sessions were taken over
+	stats   Stats
+	cancel  context.CancelFunc // stops receiving takeovers
+	wg      sync.WaitGroup
+	mu      sync.Mutex // guards taken
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the takeover hook
+type Options struct {
+	// Registry records the owners of the sessions, eg. a RedisRegistry. Required
+	Registry Registry
+
+	// Server is the server whose sessions are discarded when they are taken over. Required
+	Server *mqtt.Server
+
+	// Node is the name of the broker in the registry, which must be unique to each broker, and
+	// defaults to the hostname followed by a random suffix
+	Node string
+
+	// Timeout bounds the calls to the registry, and defaults to 5 seconds
+	Timeout time.Duration
+
+	// RetryInterval spaces the attempts to receive takeovers which fail, eg. as the registry is
+	// unavailable, and defaults to 1 second
+	RetryInterval time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "takeover-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnClientExpired,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts receiving takeovers
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	takeoverHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if takeoverHookConfig.Registry == nil {
+		return errors.New("registry is required")
+	}
+
+	if takeoverHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if takeoverHookConfig.Node == "" {
+		node, err := defaultNode()
+		if err != nil {
+			return err
+		}
+		takeoverHookConfig.Node = node
+	}
+
+	if takeoverHookConfig.Timeout <= 0 {
+		takeoverHookConfig.Timeout = 5 * time.Second
+	}
+
+	if takeoverHookConfig.RetryInterval <= 0 {
+		takeoverHookConfig.RetryInterval = time.Second
+	}
+
+	h.config = takeoverHookConfig
+	h.taken = make(map[*mqtt.Client]bool)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.wg.Add(1)
+	go h.receive(ctx)
+
+	return nil
+}
+
+// defaultNode returns the hostname followed by a random suffix
+func defaultNode() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	return hostname + "-" + hex.EncodeToString(suffix), nil
+}
+
+// Stop stops receiving takeovers, which may wait for a call to the registry
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+		h.wg.Wait()
+	}
+	return nil
+}
+
+// Stats returns the totals of the sessions coordinated so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// count updates the stats
+func (h *Hook) count(update func(s *Stats)) {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	update(&h.stats)
+}
+
+// Node returns the name of the broker in the registry
+func (h *Hook) Node() string {
+	return h.config.Node
+}
+
+// OnSessionEstablished is called when a client has established a session, and claims its client id,
+// signalling the broker which owned it before
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	if cl.Net.Inline {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	previous, err := h.config.Registry.Claim(ctx, cl.ID, h.config.Node)
+	if err != nil {
+		h.Log.Error("error occurred while claiming session", "error", err, "client", cl.ID)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+	h.count(func(s *Stats) { s.Claimed++ })
+
+	if previous == "" || previous == h.config.Node {
+		return
+	}
+
+	if err := h.config.Registry.Signal(ctx, previous, cl.ID); err != nil {
+		h.Log.Error("error occurred while signalling session takeover", "error", err, "client", cl.ID, "node", previous)
+		h.count(func(s *Stats) { s.Failed++ })
+		return
+	}
+
+	h.Log.Info("session taken over from another broker", "client", cl.ID, "node", previous)
+	h.count(func(s *Stats) { s.Signalled++ })
+}
+
+// OnDisconnect is called when a client disconnects, and discards its session if another broker has
+// taken it over, or releases its client id if its session ends
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	taken := h.taken[cl]
+	delete(h.taken, cl)
+	h.mu.Unlock()
+
+	if taken {
+		h.discard(cl)
+		return
+	}
+
+	// a session taken over by a client reconnecting to this broker continues
+	if current, ok := h.config.Server.Clients.Get(cl.ID); expire && (!ok || current == cl) {
+		h.release(cl)
+	}
+}
+
+// OnClientExpired is called when the session of a disconnected client expires, and releases its
+// client id
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	h.release(cl)
+}
+
+// release forgets the broker as the owner of the session of the client
+func (h *Hook) release(cl *mqtt.Client) {
+	if cl.Net.Inline {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	if err := h.config.Registry.Release(ctx, cl.ID, h.config.Node); err != nil {
+		h.Log.Error("error occurred while releasing session", "error", err, "client", cl.ID)
+		h.count(func(s *Stats) { s.Failed++ })
+	}
+}
+
+// receive receives takeovers until the context is cancelled
+func (h *Hook) receive(ctx context.Context) {
+	defer h.wg.Done()
+
+	for ctx.Err() == nil {
+		clientID, err := h.config.Registry.Receive(ctx, h.config.Node)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			h.Log.Error("error occurred while receiving session takeovers", "error", err, "node", h.config.Node)
+			h.count(func(s *Stats) { s.Failed++ })
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(h.config.RetryInterval):
+			}
+			continue
+		}
+
+		if clientID != "" {
+			h.takeover(ctx, clientID)
+		}
+	}
+}
+
+// takeover disconnects the client and discards its session, unless it has established a session on
+// this broker again since
+func (h *Hook) takeover(ctx context.Context, clientID string) {
+	cl, ok := h.config.Server.Clients.Get(clientID)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	owner, err := h.config.Registry.Owner(ctx, clientID)
+	if err != nil {
+		h.Log.Error("error occurred while checking session owner", "error", err, "client", clientID)
+		h.count(func(s *Stats) { s.Failed++ })
+	} else if owner == h.config.Node {
+		return
+	}
+
+	h.Log.Info("discarding session taken over by another broker", "client", clientID, "node", owner)
+	h.count(func(s *Stats) { s.Discarded++ })
+
+	if cl.Closed() {
+		h.discard(cl)
+		return
+	}
+
+	h.mu.Lock()
+	h.taken[cl] = true
+	h.mu.Unlock()
+
+	_ = h.config.Server.DisconnectClient(cl, packets.ErrSessionTakenOver)
+}
+
+// discard removes the subscriptions and inflight messages of the client, and its session unless it
+// has been replaced
+func (h *Hook) discard(cl *mqtt.Client) {
+	h.config.Server.UnsubscribeClient(cl)
+	cl.ClearInflights(math.MaxInt64, 0)
+
+	if current, ok := h.config.Server.Clients.Get(cl.ID); ok && current == cl {
+		h.config.Server.Clients.Delete(cl.ID)
+	}
+}
@@ -0,0 +1,322 @@
+package takeover
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRegistry is a Registry in memory
+type fakeRegistry struct {
+	owners  map[string]string
+	signals map[string]chan string
+	err     error
+	mu      sync.Mutex
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{owners: make(map[string]string), signals: make(map[string]chan string)}
+}
+
+func (r *fakeRegistry) Claim(ctx context.Context, clientID, node string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return "", r.err
+	}
+
+	previous := r.owners[clientID]
+	r.owners[clientID] = node
+	return previous, nil
+}
+
+func (r *fakeRegistry) Owner(ctx context.Context, clientID string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.owners[clientID], r.err
+}
+
+func (r *fakeRegistry) Release(ctx context.Context, clientID, node string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.owners[clientID] == node {
+		delete(r.owners, clientID)
+	}
+	return r.err
+}
+
+func (r *fakeRegistry) Signal(ctx context.Context, node, clientID string) error {
+	r.signal(node) <- clientID
+	return nil
+}
+
+func (r *fakeRegistry) Receive(ctx context.Context, node string) (string, error) {
+	r.mu.Lock()
+	err := r.err
+	r.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case clientID := <-r.signal(node):
+		return clientID, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-time.After(10 * time.Millisecond):
+		return "", nil
+	}
+}
+
+func (r *fakeRegistry) owner(clientID string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.owners[clientID]
+}
+
+// signal returns the takeovers of the node
+func (r *fakeRegistry) signal(node string) chan string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, ok := r.signals[node]
+	if !ok {
+		ch = make(chan string, 16)
+		r.signals[node] = ch
+	}
+	return ch
+}
+
+func newHook(t *testing.T, registry Registry, server *mqtt.Server, node string) *Hook {
+	t.Helper()
+
+	takeoverHook := new(Hook)
+	takeoverHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, takeoverHook.Init(Options{Registry: registry, Server: server, Node: node, RetryInterval: 10 * time.Millisecond}))
+	t.Cleanup(func() { takeoverHook.Stop() })
+	return takeoverHook
+}
+
+// newClient adds a connected client with a subscription to the server
+func newClient(t *testing.T, server *mqtt.Server, id string) *mqtt.Client {
+	t.Helper()
+
+	r, w := net.Pipe()
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+	go io.Copy(io.Discard, w)
+
+	cl := server.NewClient(r, "tcp", id, false)
+	cl.Properties.ProtocolVersion = 5
+	server.Clients.Add(cl)
+
+	sub := packets.Subscription{Filter: "a/b"}
+	server.Topics.Subscribe(cl.ID, sub)
+	cl.State.Subscriptions.Add(sub.Filter, sub)
+	return cl
+}
+
+func TestID(t *testing.T) {
+	takeoverHook := new(Hook)
+
+	require.Equal(t, "takeover-hook", takeoverHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	takeoverHook := new(Hook)
+	require.True(t, takeoverHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, takeoverHook.Provides(mqtt.OnDisconnect))
+	require.True(t, takeoverHook.Provides(mqtt.OnClientExpired))
+	require.False(t, takeoverHook.Provides(mqtt.OnSessionEstablish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success",
+			config:      Options{Registry: newFakeRegistry(), Server: mqtt.New(nil)},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no registry",
+			config:      Options{Server: mqtt.New(nil)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{Registry: newFakeRegistry()},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			takeoverHook := new(Hook)
+			takeoverHook.Log = slog.Default()
+			err := takeoverHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer takeoverHook.Stop()
+
+			hostname, _ := os.Hostname()
+			require.True(t, strings.HasPrefix(takeoverHook.Node(), hostname+"-"))
+			require.Equal(t, 5*time.Second, takeoverHook.config.Timeout)
+			require.Equal(t, time.Second, takeoverHook.config.RetryInterval)
+
+		})
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	registry := newFakeRegistry()
+	s1, s2 := mqtt.New(nil), mqtt.New(nil)
+	hook1 := newHook(t, registry, s1, "node-1")
+	hook2 := newHook(t, registry, s2, "node-2")
+
+	cl1 := newClient(t, s1, "c1")
+	hook1.OnSessionEstablished(cl1, packets.Packet{})
+	require.Equal(t, "node-1", registry.owner("c1"))
+
+	// reconnecting to the same broker is left to it
+	hook1.OnSessionEstablished(cl1, packets.Packet{})
+	require.Equal(t, Stats{Claimed: 2}, hook1.Stats())
+
+	cl2 := newClient(t, s2, "c1")
+	hook2.OnSessionEstablished(cl2, packets.Packet{})
+	require.Equal(t, "node-2", registry.owner("c1"))
+	require.Equal(t, Stats{Claimed: 1, Signalled: 1}, hook2.Stats())
+
+	// the previous broker disconnects the client, and discards its session once it has disconnected
+	require.Eventually(t, cl1.Closed, time.Second, 5*time.Millisecond)
+	require.ErrorIs(t, cl1.StopCause(), packets.ErrSessionTakenOver)
+	_, ok := s1.Clients.Get("c1")
+	require.True(t, ok)
+
+	hook1.OnDisconnect(cl1, packets.ErrSessionTakenOver, false)
+	_, ok = s1.Clients.Get("c1")
+	require.False(t, ok)
+	require.Empty(t, cl1.State.Subscriptions.GetAll())
+	require.Empty(t, s1.Topics.Subscribers("a/b").Subscriptions)
+	require.Equal(t, int64(1), hook1.Stats().Discarded)
+
+	// the client id still belongs to the new broker
+	require.Equal(t, "node-2", registry.owner("c1"))
+	require.False(t, cl2.Closed())
+}
+
+func TestTakeoverDisconnected(t *testing.T) {
+	registry := newFakeRegistry()
+	s1 := mqtt.New(nil)
+	hook1 := newHook(t, registry, s1, "node-1")
+
+	cl1 := newClient(t, s1, "c1")
+	hook1.OnSessionEstablished(cl1, packets.Packet{})
+	cl1.Stop(nil)
+	hook1.OnDisconnect(cl1, nil, false)
+
+	// the persistent session of a disconnected client is discarded
+	_, err := registry.Claim(context.Background(), "c1", "node-2")
+	require.NoError(t, err)
+	require.NoError(t, registry.Signal(context.Background(), "node-1", "c1"))
+	require.Eventually(t, func() bool {
+		_, ok := s1.Clients.Get("c1")
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+	require.Empty(t, s1.Topics.Subscribers("a/b").Subscriptions)
+}
+
+func TestTakeoverReturned(t *testing.T) {
+	registry := newFakeRegistry()
+	s1 := mqtt.New(nil)
+	hook1 := newHook(t, registry, s1, "node-1")
+
+	// the client has come back to this broker since it was taken over
+	cl1 := newClient(t, s1, "c1")
+	hook1.OnSessionEstablished(cl1, packets.Packet{})
+	require.NoError(t, registry.Signal(context.Background(), "node-1", "c1"))
+
+	require.Never(t, cl1.Closed, 100*time.Millisecond, 5*time.Millisecond)
+	require.Zero(t, hook1.Stats().Discarded)
+}
+
+func TestOnDisconnect(t *testing.T) {
+	registry := newFakeRegistry()
+	s1 := mqtt.New(nil)
+	hook1 := newHook(t, registry, s1, "node-1")
+
+	// persistent sessions keep their owner until they expire
+	cl1 := newClient(t, s1, "c1")
+	hook1.OnSessionEstablished(cl1, packets.Packet{})
+	hook1.OnDisconnect(cl1, nil, false)
+	require.Equal(t, "node-1", registry.owner("c1"))
+
+	hook1.OnClientExpired(cl1)
+	require.Empty(t, registry.owner("c1"))
+
+	// a session taken over by a client reconnecting to this broker isn't released
+	hook1.OnSessionEstablished(cl1, packets.Packet{})
+	cl2 := newClient(t, s1, "c1")
+	hook1.OnSessionEstablished(cl2, packets.Packet{})
+	hook1.OnDisconnect(cl1, packets.ErrSessionTakenOver, true)
+	require.Equal(t, "node-1", registry.owner("c1"))
+
+	hook1.OnDisconnect(cl2, nil, true)
+	require.Empty(t, registry.owner("c1"))
+
+	// sessions owned by other brokers aren't released
+	_, err := registry.Claim(context.Background(), "c3", "node-2")
+	require.NoError(t, err)
+	hook1.OnDisconnect(newClient(t, s1, "c3"), nil, true)
+	require.Equal(t, "node-2", registry.owner("c3"))
+}
+
+func TestRegistryUnavailable(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.err = errors.New("unavailable")
+	s1 := mqtt.New(nil)
+	hook1 := newHook(t, registry, s1, "node-1")
+
+	cl1 := newClient(t, s1, "c1")
+	hook1.OnSessionEstablished(cl1, packets.Packet{})
+	hook1.OnClientExpired(cl1)
+	require.Eventually(t, func() bool { return hook1.Stats().Failed >= 4 }, time.Second, 5*time.Millisecond)
+	require.Zero(t, hook1.Stats().Claimed)
+}
+
+func TestStop(t *testing.T) {
+	require.NoError(t, new(Hook).Stop())
+
+	takeoverHook := newHook(t, newFakeRegistry(), mqtt.New(nil), "node-1")
+	require.NoError(t, takeoverHook.Stop())
+}
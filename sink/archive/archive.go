@@ -0,0 +1,540 @@
+// Package archive provides a hook writing the messages published to matching MQTT topics to files in a
+// local directory, as NDJSON or length prefixed binary records, for debugging and reprocessing them
+// offline at the edge. Files are rotated once they grow too big or old, optionally compressed, and
+// deleted once there are too many or they are too old. ReadFile reads the records of a file back.
+//
+// Files are named after the time they were started at, eg. messages-20240101T120000.000000000Z.ndjson,
+// so their names sort in the order they were written.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+// timeFormat is the format of the times in the names of files
+const timeFormat = "20060102T150405.000000000Z"
+
+// Stats are the totals of the messages archived since the hook was initialized
+type Stats struct {
+	Written   int64 // the number of messages written
+	Failed    int64 // the number of messages which could not be written
+	Dropped   int64 // the number of messages discarded as the queue was full
+	Rotations int64 // the number of files which were rotated
+	Deleted   int64 // the number of files deleted by the retention limits
+}
+
+// Hook is a hook that archives messages to files
+type Hook struct {
+	config   Options
+	ext      string // the extension of the files
+	bridge   *bridge.Bridge[Record]
+	rotated  chan string   // the names of rotated files, to be compressed and pruned
+	done     chan struct{} // closed once the queued records have been written
+	file     *os.File      // the file being written
+	buf      *bufio.Writer // buffers the writes of the file
+	opened   time.Time     // when the file was started
+	size     int64         // the size of the file
+	dirty    bool          // whether the file has writes which aren't flushed
+	enc      []byte        // reused to encode records
+	active   string        // the name of the file being written, which isn't pruned
+	stopped  atomic.Bool
+	stats    Stats          // of the files rotated and deleted
+	wg       sync.WaitGroup // the flusher and the janitor
+	fileMu   sync.Mutex     // guards the file, its writer and their state
+	activeMu sync.Mutex     // guards active
+	statsMu  sync.Mutex
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the archive hook
+type Options struct {
+	// Dir is the directory of the files, which is created if it doesn't exist. Prefix starts the names
+	// of the files, and defaults to messages
+	Dir    string
+	Prefix string
+
+	// Filters are the MQTT topic filters, which may contain +/# wildcards, of the messages which are
+	// archived, and default to all messages
+	Filters []string
+
+	// Where is an optional filter expression (see pkg/filter) archived messages must also match, eg.
+	// "retain or qos > 0"
+	Where string
+
+	// Format is FormatNDJSON or FormatBinary, and defaults to FormatNDJSON
+	Format string
+
+	// MaxSize is the size a file grows to before it is rotated, defaults to 64 MiB, and MaxAge is how
+	// long a file is written to before it is rotated, defaults to 1 hour
+	MaxSize int64
+	MaxAge  time.Duration
+
+	// Compress gzips files once they are rotated
+	Compress bool
+
+	// MaxFiles is how many rotated files are kept, and Retention is how long they are kept for. The
+	// oldest files are deleted beyond either limit, and neither is set by default
+	MaxFiles  int
+	Retention time.Duration
+
+	// FlushInterval is how often the writes are flushed and synced to the file, defaults to 1 second
+	FlushInterval time.Duration
+
+	// QueueSize is how many messages wait to be written, defaults to 10000. Messages published while
+	// the queue is full wait for up to Block for room, and are then dropped by the Drop policy, which
+	// defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Server publishes a bridge.Warning to $SYS/bridges/archive/dropped when messages are dropped, if
+	// set
+	Server *mqtt.Server
+
+	// Buffer queues messages on disk rather than in memory if it is set, so the messages which haven't
+	// been written survive restarts of the broker. Its Dir must not be Dir
+	Buffer *bridge.Buffer
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "archive-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts writing messages
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	archiveHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if archiveHookConfig.Dir == "" {
+		return errors.New("dir is required")
+	}
+
+	if archiveHookConfig.Prefix == "" {
+		archiveHookConfig.Prefix = "messages"
+	}
+
+	if len(archiveHookConfig.Filters) == 0 {
+		archiveHookConfig.Filters = []string{"#"}
+	}
+
+	for _, f := range archiveHookConfig.Filters {
+		if !mqtt.IsValidFilter(f, false) {
+			return fmt.Errorf("invalid topic filter %q", f)
+		}
+	}
+
+	switch archiveHookConfig.Format {
+	case "", FormatNDJSON:
+		archiveHookConfig.Format = FormatNDJSON
+		h.ext = ndjsonExt
+	case FormatBinary:
+		h.ext = binaryExt
+	default:
+		return fmt.Errorf("invalid format %q", archiveHookConfig.Format)
+	}
+
+	if archiveHookConfig.MaxSize <= 0 {
+		archiveHookConfig.MaxSize = 64 << 20
+	}
+
+	if archiveHookConfig.MaxAge <= 0 {
+		archiveHookConfig.MaxAge = time.Hour
+	}
+
+	if archiveHookConfig.FlushInterval <= 0 {
+		archiveHookConfig.FlushInterval = time.Second
+	}
+
+	if archiveHookConfig.QueueSize <= 0 {
+		archiveHookConfig.QueueSize = 10000
+	}
+
+	if err := os.MkdirAll(archiveHookConfig.Dir, 0o700); err != nil {
+		return err
+	}
+
+	h.config = archiveHookConfig
+	h.rotated = make(chan string, 16)
+	h.done = make(chan struct{})
+
+	where := make([]string, len(archiveHookConfig.Filters))
+	for i := range where {
+		where[i] = archiveHookConfig.Where
+	}
+
+	var err error
+	h.bridge, err = bridge.New[Record](sink{h}, bridge.Options{
+		Filters:   archiveHookConfig.Filters,
+		Where:     where,
+		QueueSize: archiveHookConfig.QueueSize,
+		Block:     archiveHookConfig.Block,
+		Drop:      archiveHookConfig.Drop,
+		Server:    archiveHookConfig.Server,
+		Name:      "archive",
+		Buffer:    archiveHookConfig.Buffer,
+	}, h.Log)
+	if err != nil {
+		return err
+	}
+
+	h.wg.Add(2)
+	go h.run()
+	go h.janitor()
+
+	return nil
+}
+
+// Stop writes the queued messages, and closes the file
+func (h *Hook) Stop() error {
+	if h.bridge == nil || h.stopped.Swap(true) {
+		return nil
+	}
+
+	err := h.bridge.Close()
+	close(h.done)
+	h.wg.Wait()
+	return err
+}
+
+// Stats returns the totals of the messages archived so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	stats := h.stats
+	h.statsMu.Unlock()
+
+	if h.bridge != nil {
+		bridged := h.bridge.Stats()
+		stats.Written, stats.Failed, stats.Dropped = bridged.Sent, bridged.Failed, bridged.Dropped
+	}
+	return stats
+}
+
+// OnPublished is called when a client has published a message, and queues it to be archived if its
+// topic matches a filter
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.bridge.Publish(cl, pk)
+}
+
+// sink queues the records of the bridge of the hook, and writes them to the file
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the record of the message published by the client
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (Record, error) {
+	r := Record{
+		Time:     time.Now(),
+		Topic:    pk.TopicName,
+		ClientID: cl.ID,
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		Payload:  pk.Payload,
+	}
+
+	for _, p := range pk.Properties.User {
+		if r.UserProperties == nil {
+			r.UserProperties = map[string]string{}
+		}
+		if _, ok := r.UserProperties[p.Key]; !ok {
+			r.UserProperties[p.Key] = p.Val // the first of repeated user properties is kept
+		}
+	}
+	return r, nil
+}
+
+// Send writes the records to the file. Those which could not be written are returned in a
+// *bridge.PartialError
+func (s sink) Send(ctx context.Context, route int, records []Record) error {
+	s.h.fileMu.Lock()
+	defer s.h.fileMu.Unlock()
+
+	var failed []int
+	var errs []error
+	for i, r := range records {
+		if err := s.h.write(r); err != nil {
+			failed = append(failed, i)
+			errs = append(errs, err)
+		}
+	}
+
+	switch {
+	case len(failed) == 0:
+		return nil
+	case len(failed) == len(records):
+		return errors.Join(errs...)
+	}
+	return &bridge.PartialError{Failed: failed, Err: errors.Join(errs...)}
+}
+
+// run flushes the file every flush interval and rotates it when it is old, until the queued records
+// have been written, and then closes it
+func (h *Hook) run() {
+	defer h.wg.Done()
+	defer close(h.rotated)
+
+	ticker := time.NewTicker(h.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			h.fileMu.Lock()
+			h.rotate()
+			h.fileMu.Unlock()
+			return
+		case <-ticker.C:
+			h.fileMu.Lock()
+			if h.file != nil && time.Since(h.opened) >= h.config.MaxAge {
+				h.rotate()
+			} else {
+				h.flush()
+			}
+			h.fileMu.Unlock()
+		}
+	}
+}
+
+// write writes the record to the file, rotating it first if the record would overflow it, or starting
+// a new one if there is none
+func (h *Hook) write(r Record) error {
+	h.enc = appendRecord(h.enc[:0], r, h.config.Format)
+
+	if h.file != nil && h.size > 0 && (h.size+int64(len(h.enc)) > h.config.MaxSize || time.Since(h.opened) >= h.config.MaxAge) {
+		h.rotate()
+	}
+
+	if h.file == nil {
+		if err := h.open(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := h.buf.Write(h.enc); err != nil {
+		h.discard()
+		return err
+	}
+	h.size += int64(len(h.enc))
+	h.dirty = true
+	return nil
+}
+
+// open starts a new file
+func (h *Hook) open() error {
+	now := time.Now().UTC()
+	name := filepath.Join(h.config.Dir, h.config.Prefix+"-"+now.Format(timeFormat)+h.ext)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	h.activeMu.Lock()
+	h.active = filepath.Base(name)
+	h.activeMu.Unlock()
+
+	h.file = f
+	h.buf = bufio.NewWriterSize(f, 64<<10)
+	h.opened = now
+	h.size = 0
+	return nil
+}
+
+// flush flushes and syncs the writes of the file
+func (h *Hook) flush() {
+	if h.file == nil || !h.dirty {
+		return
+	}
+
+	if err := errors.Join(h.buf.Flush(), h.file.Sync()); err != nil {
+		h.Log.Error("error occurred while flushing archive file", "error", err, "file", h.file.Name())
+		h.discard()
+		return
+	}
+	h.dirty = false
+}
+
+// rotate flushes and closes the file, and hands it to the janitor
+func (h *Hook) rotate() {
+	if h.file == nil {
+		return
+	}
+
+	name := h.file.Name()
+	err := errors.Join(h.buf.Flush(), h.file.Sync(), h.file.Close())
+	h.close()
+	if err != nil {
+		h.Log.Error("error occurred while closing archive file", "error", err, "file", name)
+	}
+
+	h.statsMu.Lock()
+	h.stats.Rotations++
+	h.statsMu.Unlock()
+
+	h.rotated <- name
+}
+
+// close forgets the file once it is closed, so it may be pruned
+func (h *Hook) close() {
+	h.file, h.buf, h.dirty = nil, nil, false
+
+	h.activeMu.Lock()
+	h.active = ""
+	h.activeMu.Unlock()
+}
+
+// discard closes the file after a failed write, so the next write starts a new one
+func (h *Hook) discard() {
+	name := h.file.Name()
+	h.file.Close()
+	h.close()
+	h.rotated <- name
+}
+
+// janitor compresses the rotated files, and deletes those beyond the retention limits, until there
+// are no more
+func (h *Hook) janitor() {
+	defer h.wg.Done()
+
+	for name := range h.rotated {
+		if h.config.Compress {
+			if err := compress(name); err != nil {
+				h.Log.Error("error occurred while compressing archive file", "error", err, "file", name)
+			}
+		}
+
+		if err := h.prune(); err != nil {
+			h.Log.Error("error occurred while deleting archive files", "error", err)
+		}
+	}
+}
+
+// compress gzips the file, replacing it with the compressed file
+func compress(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+gzipExt, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err = errors.Join(err, gz.Close(), dst.Sync(), dst.Close()); err != nil {
+		os.Remove(name + gzipExt)
+		return err
+	}
+	return os.Remove(name)
+}
+
+// prune deletes the oldest rotated files beyond MaxFiles, and those older than Retention
+func (h *Hook) prune() error {
+	if h.config.MaxFiles <= 0 && h.config.Retention <= 0 {
+		return nil
+	}
+
+	files, err := h.files()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i, f := range files {
+		expired := h.config.Retention > 0 && time.Since(f.started) > h.config.Retention
+		excess := h.config.MaxFiles > 0 && len(files)-i > h.config.MaxFiles
+		if !expired && !excess {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(h.config.Dir, f.name)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		h.statsMu.Lock()
+		h.stats.Deleted++
+		h.statsMu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// file is a rotated file, with the time it was started at
+type file struct {
+	name    string
+	started time.Time
+}
+
+// files returns the rotated files in the directory, oldest first
+func (h *Hook) files() ([]file, error) {
+	entries, err := os.ReadDir(h.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	h.activeMu.Lock()
+	active := h.active
+	h.activeMu.Unlock()
+
+	var files []file
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || name == active || !strings.HasPrefix(name, h.config.Prefix+"-") {
+			continue
+		}
+
+		stamp := strings.TrimPrefix(name, h.config.Prefix+"-")
+		stamp = strings.TrimSuffix(stamp, gzipExt)
+		if !strings.HasSuffix(stamp, h.ext) {
+			continue
+		}
+
+		if h.config.Compress && !strings.HasSuffix(name, gzipExt) {
+			continue // not compressed yet, or being written
+		}
+
+		started, err := time.Parse(timeFormat, strings.TrimSuffix(stamp, h.ext))
+		if err != nil {
+			continue
+		}
+		files = append(files, file{name: name, started: started})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].started.Before(files[j].started)
+	})
+	return files, nil
+}
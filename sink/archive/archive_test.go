@@ -0,0 +1,295 @@
+package archive
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	archiveHook := new(Hook)
+	archiveHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, archiveHook.Init(options))
+	t.Cleanup(func() { archiveHook.Stop() })
+	return archiveHook
+}
+
+func publish(h *Hook, topic, payload string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(payload)})
+}
+
+// names returns the names of the files in the directory
+func names(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// readAll returns the records of the files in the directory, in the order they were written
+func readAll(t *testing.T, dir string) []Record {
+	t.Helper()
+
+	var records []Record
+	for _, name := range names(t, dir) {
+		err := ReadFile(filepath.Join(dir, name), func(r Record) error {
+			records = append(records, r)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	return records
+}
+
+func TestID(t *testing.T) {
+	archiveHook := new(Hook)
+
+	require.Equal(t, "archive-hook", archiveHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	archiveHook := new(Hook)
+
+	require.True(t, archiveHook.Provides(mqtt.OnPublished))
+	require.False(t, archiveHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - dir",
+			config:      Options{Dir: t.TempDir()},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no dir",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Dir: t.TempDir(), Filters: []string{"a/#/b"}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid where",
+			config:      Options{Dir: t.TempDir(), Where: "qos in [1"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid format",
+			config:      Options{Dir: t.TempDir(), Format: "csv"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archiveHook := new(Hook)
+			err := archiveHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, archiveHook.Stop())
+			require.Equal(t, "messages", archiveHook.config.Prefix)
+			require.Equal(t, FormatNDJSON, archiveHook.config.Format)
+			require.Equal(t, int64(64<<20), archiveHook.config.MaxSize)
+		})
+	}
+}
+
+func TestArchive(t *testing.T) {
+	for _, format := range []string{FormatNDJSON, FormatBinary} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			archiveHook := newHook(t, Options{Dir: dir, Format: format, Filters: []string{"sensors/#"}})
+
+			cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+			archiveHook.OnPublished(cl, packets.Packet{
+				FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+				TopicName:   "sensors/1",
+				Payload:     []byte{0xff, 0x00},
+				Properties:  packets.Properties{User: []packets.UserProperty{{Key: "unit", Val: "C"}}},
+			})
+			publish(archiveHook, "other", "skipped")
+			publish(archiveHook, "sensors/2", "21.5")
+			require.NoError(t, archiveHook.Stop())
+
+			records := readAll(t, dir)
+			require.Len(t, records, 2)
+			require.Equal(t, "sensors/1", records[0].Topic)
+			require.Equal(t, "c1", records[0].ClientID)
+			require.Equal(t, byte(1), records[0].Qos)
+			require.True(t, records[0].Retain)
+			require.Equal(t, []byte{0xff, 0x00}, records[0].Payload)
+			require.Equal(t, map[string]string{"unit": "C"}, records[0].UserProperties)
+			require.WithinDuration(t, time.Now(), records[0].Time, time.Minute)
+			require.Equal(t, []byte("21.5"), records[1].Payload)
+			require.Equal(t, int64(2), archiveHook.Stats().Written)
+		})
+	}
+}
+
+func TestRotateSize(t *testing.T) {
+	dir := t.TempDir()
+	archiveHook := newHook(t, Options{Dir: dir, MaxSize: 150})
+
+	for i := 0; i < 4; i++ {
+		publish(archiveHook, "a", strings.Repeat("x", 50))
+	}
+	require.NoError(t, archiveHook.Stop())
+
+	require.Len(t, names(t, dir), 4)
+	require.Len(t, readAll(t, dir), 4)
+	require.Equal(t, int64(4), archiveHook.Stats().Rotations)
+}
+
+func TestRotateAge(t *testing.T) {
+	dir := t.TempDir()
+	archiveHook := newHook(t, Options{Dir: dir, MaxAge: 20 * time.Millisecond, FlushInterval: 5 * time.Millisecond})
+
+	publish(archiveHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return archiveHook.Stats().Rotations == 1
+	}, time.Second, time.Millisecond)
+
+	publish(archiveHook, "a", "2")
+	require.NoError(t, archiveHook.Stop())
+	require.Len(t, names(t, dir), 2)
+}
+
+func TestCompress(t *testing.T) {
+	dir := t.TempDir()
+	archiveHook := newHook(t, Options{Dir: dir, Format: FormatBinary, MaxSize: 10, Compress: true})
+
+	publish(archiveHook, "a", "first message")
+	publish(archiveHook, "a", "second message")
+	require.NoError(t, archiveHook.Stop())
+
+	files := names(t, dir)
+	require.Len(t, files, 2)
+	for _, name := range files {
+		require.True(t, strings.HasSuffix(name, ".bin.gz"), name)
+	}
+
+	records := readAll(t, dir)
+	require.Len(t, records, 2)
+	require.Equal(t, []byte("first message"), records[0].Payload)
+}
+
+func TestMaxFiles(t *testing.T) {
+	dir := t.TempDir()
+	archiveHook := newHook(t, Options{Dir: dir, MaxSize: 10, MaxFiles: 2})
+
+	for i := 0; i < 5; i++ {
+		publish(archiveHook, "a", strings.Repeat("x", 20))
+	}
+	require.NoError(t, archiveHook.Stop())
+
+	require.Len(t, names(t, dir), 2)
+	require.Equal(t, int64(3), archiveHook.Stats().Deleted)
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "messages-"+time.Now().Add(-2*time.Hour).UTC().Format(timeFormat)+ndjsonExt)
+	other := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(old, nil, 0o600))
+	require.NoError(t, os.WriteFile(other, nil, 0o600))
+
+	archiveHook := newHook(t, Options{Dir: dir, Retention: time.Hour})
+	publish(archiveHook, "a", "1")
+	require.NoError(t, archiveHook.Stop())
+
+	require.NoFileExists(t, old)
+	require.FileExists(t, other)
+	require.Len(t, names(t, dir), 2)
+}
+
+func TestQueueFull(t *testing.T) {
+	dir := t.TempDir()
+	archiveHook := newHook(t, Options{Dir: dir, QueueSize: 1})
+
+	// the first message is being written while the file is held, the second is queued, and the third
+	// is dropped
+	archiveHook.fileMu.Lock()
+	publish(archiveHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return archiveHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(archiveHook, "a", "2")
+	publish(archiveHook, "a", "3")
+	require.Equal(t, int64(1), archiveHook.Stats().Dropped)
+
+	archiveHook.fileMu.Unlock()
+	require.NoError(t, archiveHook.Stop())
+	require.Len(t, readAll(t, dir), 2)
+	require.Equal(t, int64(2), archiveHook.Stats().Written)
+}
+
+func TestBuffer(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{Dir: dir, Buffer: &bridge.Buffer{Dir: t.TempDir()}}
+	archiveHook := newHook(t, options)
+
+	// the first message is being written when the hook stops, and the second is kept in the buffer
+	archiveHook.fileMu.Lock()
+	publish(archiveHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return archiveHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(archiveHook, "b", "2")
+
+	stopped := make(chan error)
+	go func() { stopped <- archiveHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	archiveHook.fileMu.Unlock()
+	require.NoError(t, <-stopped)
+	require.Len(t, readAll(t, dir), 1)
+
+	// and is written once the hook is restarted
+	archiveHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return archiveHook.Stats().Written == 1
+	}, time.Second, time.Millisecond)
+	require.NoError(t, archiveHook.Stop())
+	records := readAll(t, dir)
+	require.Len(t, records, 2)
+	require.Equal(t, "b", records[1].Topic)
+	require.Equal(t, []byte("2"), records[1].Payload)
+}
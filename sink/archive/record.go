@@ -0,0 +1,278 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// the formats of archive files
+const (
+	FormatNDJSON = "ndjson" // a JSON object per line
+	FormatBinary = "binary" // length prefixed binary records
+)
+
+// the extensions of archive files
+const (
+	ndjsonExt = ".ndjson"
+	binaryExt = ".bin"
+	gzipExt   = ".gz"
+)
+
+// errTruncated is returned for a binary record which was only partly written, eg. when the machine
+// crashed
+var errTruncated = errors.New("truncated record")
+
+// Record is an archived message
+type Record struct {
+	Time           time.Time
+	Topic          string
+	ClientID       string
+	Qos            byte
+	Retain         bool
+	Payload        []byte
+	UserProperties map[string]string
+}
+
+// jsonRecord is a record in the NDJSON format. Payload is base64 encoded, and Encoding is base64, if
+// the payload isn't UTF-8
+type jsonRecord struct {
+	Time           time.Time         `json:"time"`
+	Topic          string            `json:"topic"`
+	ClientID       string            `json:"client_id"`
+	Qos            byte              `json:"qos"`
+	Retain         bool              `json:"retain"`
+	Payload        string            `json:"payload"`
+	Encoding       string            `json:"encoding,omitempty"`
+	UserProperties map[string]string `json:"user_properties,omitempty"`
+}
+
+// appendRecord appends the record in the format to b
+func appendRecord(b []byte, r Record, format string) []byte {
+	if format == FormatBinary {
+		return appendBinary(b, r)
+	}
+
+	jr := jsonRecord{
+		Time:           r.Time.UTC(),
+		Topic:          r.Topic,
+		ClientID:       r.ClientID,
+		Qos:            r.Qos,
+		Retain:         r.Retain,
+		UserProperties: r.UserProperties,
+	}
+
+	if utf8.Valid(r.Payload) {
+		jr.Payload = string(r.Payload)
+	} else {
+		jr.Payload = base64.StdEncoding.EncodeToString(r.Payload)
+		jr.Encoding = "base64"
+	}
+
+	line, _ := json.Marshal(jr)
+	b = append(b, line...)
+	return append(b, '\n')
+}
+
+// appendBinary appends the record as its length as a 4 byte big endian integer, followed by its time
+// in unix nanoseconds, QoS, retain flag, length prefixed topic and client id, user properties as a
+// count of length prefixed key value pairs, and its payload
+func appendBinary(b []byte, r Record) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Time.UnixNano()))
+	b = append(b, r.Qos)
+	if r.Retain {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+
+	b = appendField(b, r.Topic)
+	b = appendField(b, r.ClientID)
+	b = binary.AppendUvarint(b, uint64(len(r.UserProperties)))
+	for k, v := range r.UserProperties {
+		b = appendField(b, k)
+		b = appendField(b, v)
+	}
+	b = append(b, r.Payload...)
+
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+// appendField appends a length prefixed field
+func appendField(b []byte, field string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(field)))
+	return append(b, field...)
+}
+
+// Reader reads the records of an archive file, for reprocessing them
+type Reader struct {
+	r      *bufio.Reader
+	format string
+}
+
+// NewReader returns a reader of the records in the format read from r
+func NewReader(r io.Reader, format string) *Reader {
+	return &Reader{r: bufio.NewReader(r), format: format}
+}
+
+// Read returns the next record, or io.EOF after the last
+func (r *Reader) Read() (Record, error) {
+	if r.format == FormatBinary {
+		return r.readBinary()
+	}
+
+	line, err := r.r.ReadBytes('\n')
+	if errors.Is(err, io.EOF) && len(line) == 0 {
+		return Record{}, io.EOF
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		return Record{}, err
+	}
+
+	var jr jsonRecord
+	if err := json.Unmarshal(line, &jr); err != nil {
+		return Record{}, err
+	}
+
+	rec := Record{
+		Time:           jr.Time,
+		Topic:          jr.Topic,
+		ClientID:       jr.ClientID,
+		Qos:            jr.Qos,
+		Retain:         jr.Retain,
+		Payload:        []byte(jr.Payload),
+		UserProperties: jr.UserProperties,
+	}
+
+	if jr.Encoding == "base64" {
+		if rec.Payload, err = base64.StdEncoding.DecodeString(jr.Payload); err != nil {
+			return Record{}, err
+		}
+	}
+	return rec, nil
+}
+
+// readBinary reads the next binary record
+func (r *Reader) readBinary() (Record, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r.r, size[:]); errors.Is(err, io.EOF) {
+		return Record{}, io.EOF
+	} else if err != nil {
+		return Record{}, errTruncated
+	}
+
+	b := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return Record{}, errTruncated
+	}
+
+	if len(b) < 10 {
+		return Record{}, errTruncated
+	}
+
+	rec := Record{
+		Time:   time.Unix(0, int64(binary.BigEndian.Uint64(b))),
+		Qos:    b[8],
+		Retain: b[9] == 1,
+	}
+
+	b = b[10:]
+	var ok bool
+	if rec.Topic, b, ok = readField(b); !ok {
+		return Record{}, errTruncated
+	}
+
+	if rec.ClientID, b, ok = readField(b); !ok {
+		return Record{}, errTruncated
+	}
+
+	n, read := binary.Uvarint(b)
+	if read <= 0 {
+		return Record{}, errTruncated
+	}
+	b = b[read:]
+
+	for i := uint64(0); i < n; i++ {
+		var k, v string
+		if k, b, ok = readField(b); !ok {
+			return Record{}, errTruncated
+		}
+		if v, b, ok = readField(b); !ok {
+			return Record{}, errTruncated
+		}
+
+		if rec.UserProperties == nil {
+			rec.UserProperties = map[string]string{}
+		}
+		rec.UserProperties[k] = v
+	}
+
+	rec.Payload = b
+	return rec, nil
+}
+
+// readField reads a length prefixed field from b, returning the rest of b
+func readField(b []byte) (string, []byte, bool) {
+	n, read := binary.Uvarint(b)
+	if read <= 0 || uint64(len(b)-read) < n {
+		return "", nil, false
+	}
+	return string(b[read : read+int(n)]), b[read+int(n):], true
+}
+
+// ReadFile calls fn with each record of the archive file, whose format and compression are those of
+// its extension, until fn returns an error
+func ReadFile(name string, fn func(r Record) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	base := name
+	if strings.HasSuffix(base, gzipExt) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+		base = strings.TrimSuffix(base, gzipExt)
+	}
+
+	var format string
+	switch {
+	case strings.HasSuffix(base, ndjsonExt):
+		format = FormatNDJSON
+	case strings.HasSuffix(base, binaryExt):
+		format = FormatBinary
+	default:
+		return fmt.Errorf("unknown archive file extension of %q", name)
+	}
+
+	reader := NewReader(r, format)
+	for {
+		rec, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
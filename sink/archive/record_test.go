@@ -0,0 +1,80 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	records := []Record{
+		{
+			Time:           time.Unix(1700000000, 123000000).UTC(),
+			Topic:          "sensors/1",
+			ClientID:       "c1",
+			Qos:            2,
+			Retain:         true,
+			Payload:        []byte(`{"t":21.5}`),
+			UserProperties: map[string]string{"unit": "C", "source": "edge"},
+		},
+		{
+			Time:     time.Unix(1700000001, 0).UTC(),
+			Topic:    "raw",
+			ClientID: "c2",
+			Payload:  []byte{0x00, 0xff, 0x10},
+		},
+	}
+
+	for _, format := range []string{FormatNDJSON, FormatBinary} {
+		t.Run(format, func(t *testing.T) {
+			var b []byte
+			for _, r := range records {
+				b = appendRecord(b, r, format)
+			}
+
+			reader := NewReader(bytes.NewReader(b), format)
+			for _, want := range records {
+				got, err := reader.Read()
+				require.NoError(t, err)
+				require.True(t, want.Time.Equal(got.Time))
+				got.Time = want.Time
+				require.Equal(t, want, got)
+			}
+
+			_, err := reader.Read()
+			require.ErrorIs(t, err, io.EOF)
+		})
+	}
+}
+
+func TestNDJSONEncoding(t *testing.T) {
+	line := appendRecord(nil, Record{Topic: "a", Payload: []byte{0xff}}, FormatNDJSON)
+	require.Contains(t, string(line), `"payload":"/w==","encoding":"base64"`)
+	require.Equal(t, byte('\n'), line[len(line)-1])
+
+	line = appendRecord(nil, Record{Topic: "a", Payload: []byte("on")}, FormatNDJSON)
+	require.Contains(t, string(line), `"payload":"on"`)
+	require.NotContains(t, string(line), "encoding")
+}
+
+func TestReadBinaryTruncated(t *testing.T) {
+	b := appendRecord(nil, Record{Topic: "a", ClientID: "c1", Payload: []byte("payload")}, FormatBinary)
+
+	_, err := NewReader(bytes.NewReader(b[:len(b)-3]), FormatBinary).Read()
+	require.ErrorIs(t, err, errTruncated)
+
+	_, err = NewReader(bytes.NewReader(b[:2]), FormatBinary).Read()
+	require.ErrorIs(t, err, errTruncated)
+}
+
+func TestReadFileUnknownExtension(t *testing.T) {
+	name := t.TempDir() + "/messages.csv"
+	require.NoError(t, os.WriteFile(name, nil, 0o600))
+
+	err := ReadFile(name, func(r Record) error { return nil })
+	require.Error(t, err)
+}
@@ -0,0 +1,343 @@
+// Package clickhouse provides a sink hook inserting the messages published to matching MQTT topics
+// into ClickHouse tables in large batches, optionally as asynchronous inserts, for analytics workloads
+// with more messages than row by row inserts can keep up with. The tables of rules with a schema are
+// created when the hook starts, with their engine, ordering, partitioning and TTL.
+//
+// Statements run through a Conn, which is a thin adapter of the native protocol client of the
+// application, eg. for clickhouse-go:
+//
+//	type conn struct{ driver.Conn }
+//
+//	func (c conn) Exec(ctx context.Context, query string) error {
+//		return c.Conn.Exec(ctx, query)
+//	}
+//
+//	func (c conn) Insert(ctx context.Context, query string, rows [][]any, settings map[string]any) error {
+//		batch, err := c.Conn.PrepareBatch(clickhouse.Context(ctx, clickhouse.WithSettings(settings)), query)
+//		if err != nil {
+//			return err
+//		}
+//		for _, row := range rows {
+//			if err := batch.Append(row...); err != nil {
+//				batch.Abort()
+//				return err
+//			}
+//		}
+//		return batch.Send()
+//	}
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// Conn runs statements against ClickHouse, usually a thin adapter of a native protocol client
+type Conn interface {
+	// Exec runs a statement without rows, such as CREATE TABLE
+	Exec(ctx context.Context, query string) error
+
+	// Insert runs the INSERT query with the rows, whose values are in the order of its columns, as one
+	// block, with the settings of the query
+	Insert(ctx context.Context, query string, rows [][]any, settings map[string]any) error
+}
+
+// Rule inserts the messages of the MQTT topics matching Filter, which may contain +/# wildcards, into
+// Table, which may be qualified by its database, eg. "telemetry.readings". Columns map the message to
+// the columns of the table, and default to DefaultColumns. The table is created if it doesn't exist
+// when Schema is set. Where is an optional filter expression (see pkg/filter) messages must also match,
+// eg. "json.temperature > 30"
+type Rule struct {
+	Filter  string   `yaml:"filter" json:"filter"`
+	Where   string   `yaml:"where" json:"where"`
+	Table   string   `yaml:"table" json:"table"`
+	Columns []Column `yaml:"columns" json:"columns"`
+	Schema  *Schema  `yaml:"schema" json:"schema"`
+}
+
+// Schema is how the table of a rule is created, with the types of its columns. Engine defaults to
+// MergeTree and OrderBy, the sorting key, to tuple(). TTL is an expression of when rows expire, eg.
+// "time + INTERVAL 30 DAY", and only applies when the table is created, as changing the TTL of an
+// existing table rewrites its data
+type Schema struct {
+	Engine      string `yaml:"engine" json:"engine"`
+	OrderBy     string `yaml:"order_by" json:"order_by"`
+	PartitionBy string `yaml:"partition_by" json:"partition_by"`
+	TTL         string `yaml:"ttl" json:"ttl"`
+}
+
+// DefaultColumns are the columns of rules without columns
+var DefaultColumns = []Column{
+	{Name: "time", Value: ValueTime, Type: "DateTime64(3)"},
+	{Name: "topic", Value: ValueTopic, Type: "LowCardinality(String)"},
+	{Name: "client_id", Value: ValueClient, Type: "String"},
+	{Name: "qos", Value: ValueQos, Type: "UInt8"},
+	{Name: "payload", Value: ValuePayload, Type: "String"},
+}
+
+// Metrics are called as rows are inserted. Unset funcs are skipped
+type Metrics struct {
+	// Inserted is called after rows have been inserted into a table, with how long inserting them took
+	Inserted func(table string, rows int, took time.Duration)
+
+	// Failed is called after rows could not be inserted, and are discarded
+	Failed func(table string, rows int, err error)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+}
+
+// Stats are the totals of the rows inserted since the hook was initialized
+type Stats struct {
+	Batches  int64 // the number of batches inserted, or which failed
+	Inserted int64 // the number of rows inserted
+	Failed   int64 // the number of rows which could not be inserted
+	Dropped  int64 // the number of messages discarded as the queue was full
+}
+
+// Hook is a hook that inserts messages into ClickHouse tables
+type Hook struct {
+	config   Options
+	queries  []string // the INSERT queries of the rules
+	settings map[string]any
+	bridge   *bridge.Bridge[bridge.Message]
+	stopped  atomic.Bool
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the clickhouse hook
+type Options struct {
+	// Conn runs the statements
+	Conn Conn
+
+	// Rules map MQTT topics to tables, and the first whose filter matches the topic of a message
+	// applies. Messages matching no rule aren't inserted
+	Rules []Rule
+
+	// BatchSize is how many rows of a table are inserted at once, defaults to 10000, and a batch is
+	// inserted once it is full or its first row has waited for Linger, which defaults to 1 second.
+	// ClickHouse favours few large inserts, so batches should be large unless inserts are asynchronous
+	BatchSize int
+	Linger    time.Duration
+
+	// AsyncInsert has the server buffer inserted rows and write them with those of other inserts, so
+	// smaller batches can be inserted more often. WaitForAsyncInsert waits for the rows to be written,
+	// so failures are reported and retried, rather than only for them to be buffered
+	AsyncInsert        bool
+	WaitForAsyncInsert bool
+
+	Timeout time.Duration // how long creating a table or inserting a batch may take, defaults to 30 seconds
+
+	// QueueSize is how many rows wait to be inserted, defaults to 100000. Messages published while the
+	// queue is full, eg. because ClickHouse is unavailable, wait for up to Block for room, and are then
+	// dropped by the Drop policy, which defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Server publishes a bridge.Warning to $SYS/bridges/clickhouse/dropped when messages are dropped,
+	// if set
+	Server *mqtt.Server
+
+	// Buffer queues rows on disk rather than in memory if it is set, so the rows which haven't been
+	// inserted survive restarts of the broker and long outages of ClickHouse
+	Buffer *bridge.Buffer
+
+	// Retry retries batches which fail, and must limit the attempts or the time spent. Batches are
+	// inserted once if it is nil
+	Retry *retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "clickhouse-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, creates the tables of rules with a schema, and
+// starts inserting messages
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	clickhouseHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if clickhouseHookConfig.Conn == nil {
+		return errors.New("conn is required")
+	}
+
+	if len(clickhouseHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range clickhouseHookConfig.Rules {
+		if len(rule.Columns) == 0 {
+			clickhouseHookConfig.Rules[i].Columns = DefaultColumns
+		}
+
+		if err := clickhouseHookConfig.Rules[i].validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+	}
+
+	if clickhouseHookConfig.Retry != nil && clickhouseHookConfig.Retry.MaxAttempts == 0 && clickhouseHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if clickhouseHookConfig.BatchSize <= 0 {
+		clickhouseHookConfig.BatchSize = 10000
+	}
+
+	if clickhouseHookConfig.Linger <= 0 {
+		clickhouseHookConfig.Linger = time.Second
+	}
+
+	if clickhouseHookConfig.Timeout <= 0 {
+		clickhouseHookConfig.Timeout = 30 * time.Second
+	}
+
+	if clickhouseHookConfig.QueueSize <= 0 {
+		clickhouseHookConfig.QueueSize = 100000
+	}
+
+	for _, rule := range clickhouseHookConfig.Rules {
+		if rule.Schema == nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), clickhouseHookConfig.Timeout)
+		err := clickhouseHookConfig.Conn.Exec(ctx, rule.create())
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to create table %s: %w", rule.Table, err)
+		}
+	}
+
+	h.config = clickhouseHookConfig
+	h.queries = make([]string, len(clickhouseHookConfig.Rules))
+	for i, rule := range clickhouseHookConfig.Rules {
+		h.queries[i] = rule.insert()
+	}
+
+	if clickhouseHookConfig.AsyncInsert {
+		h.settings = map[string]any{"async_insert": 1, "wait_for_async_insert": 0}
+		if clickhouseHookConfig.WaitForAsyncInsert {
+			h.settings["wait_for_async_insert"] = 1
+		}
+	}
+
+	filters := make([]string, len(clickhouseHookConfig.Rules))
+	where := make([]string, len(clickhouseHookConfig.Rules))
+	for i, rule := range clickhouseHookConfig.Rules {
+		filters[i], where[i] = rule.Filter, rule.Where
+	}
+
+	var err error
+	h.bridge, err = bridge.New[bridge.Message](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		BatchSize: clickhouseHookConfig.BatchSize,
+		Linger:    clickhouseHookConfig.Linger,
+		Timeout:   clickhouseHookConfig.Timeout,
+		QueueSize: clickhouseHookConfig.QueueSize,
+		Block:     clickhouseHookConfig.Block,
+		Drop:      clickhouseHookConfig.Drop,
+		Server:    clickhouseHookConfig.Server,
+		Name:      "clickhouse",
+		Buffer:    clickhouseHookConfig.Buffer,
+		Retry:     clickhouseHookConfig.Retry,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// Stop inserts the queued rows
+func (h *Hook) Stop() error {
+	if h.bridge == nil || h.stopped.Swap(true) {
+		return nil
+	}
+
+	return h.bridge.Close()
+}
+
+// Stats returns the totals of the rows inserted so far
+func (h *Hook) Stats() Stats {
+	if h.bridge == nil {
+		return Stats{}
+	}
+
+	stats := h.bridge.Stats()
+	return Stats{Batches: stats.Batches, Inserted: stats.Sent, Failed: stats.Failed, Dropped: stats.Dropped}
+}
+
+// OnPublished is called when a client has published a message, and queues its row if a rule matches
+// its topic
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook with the tables of the routes
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Inserted != nil {
+		m.Sent = func(route, rows int, took time.Duration) {
+			h.config.Metrics.Inserted(h.config.Rules[route].Table, rows, took)
+		}
+	}
+
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, rows int, err error) {
+			h.config.Metrics.Failed(h.config.Rules[route].Table, rows, err)
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// sink queues the messages of the bridge of the hook, and inserts their rows
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the message published by the client, whose row is made once it is inserted
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (bridge.Message, error) {
+	return bridge.NewMessage(cl, pk, time.Now()), nil
+}
+
+// Send inserts the rows of the messages into the table of the rule of the route as one block
+func (s sink) Send(ctx context.Context, route int, msgs []bridge.Message) error {
+	rule := s.h.config.Rules[route]
+	rows := make([][]any, len(msgs))
+	for i, msg := range msgs {
+		rows[i] = rule.values(msg.Client(), msg.Packet(), msg.Time)
+	}
+
+	return s.h.config.Conn.Insert(ctx, s.h.queries[route], rows, s.h.settings)
+}
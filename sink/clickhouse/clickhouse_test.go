@@ -0,0 +1,386 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// fakeConn records the statements it runs, and the rows inserted by each query
+type fakeConn struct {
+	execs    []string
+	inserts  map[string][][]any
+	settings map[string]any
+	errs     []error       // returned by the next statements
+	block    chan struct{} // inserts wait for it to be closed, if set
+	mu       sync.Mutex
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		inserts: map[string][][]any{},
+	}
+}
+
+func (c *fakeConn) Exec(ctx context.Context, query string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.err(); err != nil {
+		return err
+	}
+	c.execs = append(c.execs, query)
+	return nil
+}
+
+func (c *fakeConn) Insert(ctx context.Context, query string, rows [][]any, settings map[string]any) error {
+	if c.block != nil {
+		<-c.block
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.err(); err != nil {
+		return err
+	}
+	c.inserts[query] = append(c.inserts[query], rows...)
+	c.settings = settings
+	return nil
+}
+
+func (c *fakeConn) err() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return err
+}
+
+// rows returns the rows inserted into the table
+func (c *fakeConn) rows(table string) [][]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var rows [][]any
+	for query, inserted := range c.inserts {
+		if strings.HasPrefix(query, "INSERT INTO "+quote(table)+" (") {
+			rows = append(rows, inserted...)
+		}
+	}
+	return rows
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	clickhouseHook := new(Hook)
+	clickhouseHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, clickhouseHook.Init(options))
+	t.Cleanup(func() { clickhouseHook.Stop() })
+	return clickhouseHook
+}
+
+func publish(h *Hook, topic, payload string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(payload)})
+}
+
+func TestID(t *testing.T) {
+	clickhouseHook := new(Hook)
+
+	require.Equal(t, "clickhouse-hook", clickhouseHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	clickhouseHook := new(Hook)
+
+	require.True(t, clickhouseHook.Provides(mqtt.OnPublished))
+	require.False(t, clickhouseHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	rules := []Rule{{Filter: "#", Table: "mqtt_messages"}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - default columns",
+			config:      Options{Conn: newFakeConn(), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no conn",
+			config:      Options{Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Conn: newFakeConn()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Conn: newFakeConn(), Rules: []Rule{{Filter: "#", Table: "a.b.c"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - column without type",
+			config:      Options{Conn: newFakeConn(), Rules: []Rule{{Filter: "#", Table: "t", Columns: []Column{{Name: "a", Value: ValueTopic}}, Schema: &Schema{}}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - table not created",
+			config:      Options{Conn: &fakeConn{errs: []error{errors.New("ACCESS_DENIED")}}, Rules: []Rule{{Filter: "#", Table: "t", Schema: &Schema{}}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Conn: newFakeConn(), Rules: rules, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			clickhouseHook := new(Hook)
+			clickhouseHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := clickhouseHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, DefaultColumns, clickhouseHook.config.Rules[0].Columns)
+				require.Equal(t, 10000, clickhouseHook.config.BatchSize)
+				require.Equal(t, time.Second, clickhouseHook.config.Linger)
+				require.NoError(t, clickhouseHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestBatches(t *testing.T) {
+	conn := newFakeConn()
+	var inserted int
+	clickhouseHook := newHook(t, Options{
+		Conn: conn,
+		Rules: []Rule{
+			{
+				Filter: "sensors/+/readings",
+				Table:  "telemetry.readings",
+				Columns: []Column{
+					{Name: "device", Value: "level:2"},
+					{Name: "temperature", Value: "json:temperature"},
+				},
+			},
+			{Filter: "sensors/#", Table: "mqtt_messages"},
+		},
+		BatchSize: 2,
+		Linger:    time.Hour,
+		Metrics: Metrics{
+			Inserted: func(table string, rows int, took time.Duration) { inserted += rows },
+		},
+	})
+
+	// batches are copied into each table once they are full
+	publish(clickhouseHook, "sensors/s1/readings", `{"temperature":21.5}`)
+	publish(clickhouseHook, "sensors/s2/readings", `{"humidity":40}`)
+	publish(clickhouseHook, "sensors/s1/status", "online")
+	publish(clickhouseHook, "other", "ignored")
+	require.Eventually(t, func() bool {
+		return len(conn.rows("telemetry.readings")) == 2
+	}, time.Second, time.Millisecond)
+
+	require.Equal(t, [][]any{{"s1", 21.5}, {"s2", nil}}, conn.rows("telemetry.readings"))
+	require.Empty(t, conn.rows("mqtt_messages"))
+
+	// the other batches are copied when the hook stops
+	require.NoError(t, clickhouseHook.Stop())
+	rows := conn.rows("mqtt_messages")
+	require.Len(t, rows, 1)
+	require.Contains(t, conn.inserts, "INSERT INTO `mqtt_messages` (`time`, `topic`, `client_id`, `qos`, `payload`)")
+	require.Equal(t, []any{"sensors/s1/status", "c1", byte(0), "online"}, rows[0][1:])
+	require.Nil(t, conn.settings)
+	require.Equal(t, 3, inserted)
+	require.Equal(t, Stats{Batches: 2, Inserted: 3}, clickhouseHook.Stats())
+
+	// messages published once the hook has stopped are ignored
+	publish(clickhouseHook, "sensors/s1/status", "offline")
+	require.NoError(t, clickhouseHook.Stop())
+}
+
+func TestRetry(t *testing.T) {
+	conn := newFakeConn()
+	conn.errs = []error{errors.New("connection reset")}
+	clickhouseHook := newHook(t, Options{
+		Conn:   conn,
+		Rules:  []Rule{{Filter: "#", Table: "mqtt_messages"}},
+		Linger: time.Hour,
+		Retry:  &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+	})
+
+	// the failed batch is copied again
+	publish(clickhouseHook, "a", "1")
+	publish(clickhouseHook, "b", "2")
+	require.NoError(t, clickhouseHook.Stop())
+
+	require.Len(t, conn.rows("mqtt_messages"), 2)
+	require.Equal(t, Stats{Batches: 1, Inserted: 2}, clickhouseHook.Stats())
+}
+
+func TestFailure(t *testing.T) {
+	conn := newFakeConn()
+	conn.errs = []error{errors.New(`Table default.mqtt_messages doesn't exist`)}
+	var failed int
+	clickhouseHook := newHook(t, Options{
+		Conn:   conn,
+		Rules:  []Rule{{Filter: "#", Table: "mqtt_messages"}},
+		Linger: time.Hour,
+		Metrics: Metrics{
+			Failed: func(table string, rows int, err error) { failed += rows },
+		},
+	})
+
+	// without a retry policy, the rows of a failed batch are discarded
+	publish(clickhouseHook, "a", "1")
+	publish(clickhouseHook, "b", "2")
+	require.NoError(t, clickhouseHook.Stop())
+
+	require.Equal(t, 2, failed)
+	require.Empty(t, conn.rows("mqtt_messages"))
+	require.Equal(t, Stats{Batches: 1, Failed: 2}, clickhouseHook.Stats())
+}
+
+func TestQueueFull(t *testing.T) {
+	conn := newFakeConn()
+	conn.block = make(chan struct{})
+	var dropped int
+	clickhouseHook := newHook(t, Options{
+		Conn:      conn,
+		Rules:     []Rule{{Filter: "#", Table: "mqtt_messages"}},
+		Linger:    time.Millisecond,
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// the first row is being copied, the second is queued, and the third is dropped
+	publish(clickhouseHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return clickhouseHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	publish(clickhouseHook, "b", "2")
+	publish(clickhouseHook, "c", "3")
+	require.Equal(t, 1, dropped)
+
+	close(conn.block)
+	require.NoError(t, clickhouseHook.Stop())
+	require.Equal(t, Stats{Batches: 2, Inserted: 2, Dropped: 1}, clickhouseHook.Stats())
+}
+
+func TestBuffer(t *testing.T) {
+	conn := newFakeConn()
+	conn.block = make(chan struct{})
+	options := Options{
+		Conn:      conn,
+		Rules:     []Rule{{Filter: "#", Table: "mqtt_messages"}},
+		BatchSize: 1,
+		Buffer:    &bridge.Buffer{Dir: t.TempDir()},
+	}
+	clickhouseHook := newHook(t, options)
+
+	// the first row is being inserted when the hook stops, and the second is kept in the buffer
+	publish(clickhouseHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return clickhouseHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(clickhouseHook, "b", "2")
+
+	stopped := make(chan error)
+	go func() { stopped <- clickhouseHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(conn.block)
+	require.NoError(t, <-stopped)
+	require.Len(t, conn.rows("mqtt_messages"), 1)
+
+	// and is inserted with the same values once the hook is restarted
+	conn = newFakeConn()
+	options.Conn = conn
+	clickhouseHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return len(conn.rows("mqtt_messages")) == 1
+	}, time.Second, time.Millisecond)
+	row := conn.rows("mqtt_messages")[0]
+	require.IsType(t, time.Time{}, row[0])
+	require.Equal(t, []any{"b", "c1", uint8(0), "2"}, row[1:])
+}
+
+func TestCreateTables(t *testing.T) {
+	conn := newFakeConn()
+	newHook(t, Options{
+		Conn: conn,
+		Rules: []Rule{
+			{
+				Filter: "sensors/#",
+				Table:  "telemetry.messages",
+				Schema: &Schema{
+					PartitionBy: "toYYYYMM(time)",
+					OrderBy:     "(topic, time)",
+					TTL:         "toDateTime(time) + INTERVAL 30 DAY",
+				},
+			},
+			{Filter: "#", Table: "mqtt_messages"},
+		},
+	})
+
+	// only the tables of rules with a schema are created
+	require.Equal(t, []string{
+		"CREATE TABLE IF NOT EXISTS `telemetry`.`messages` (`time` DateTime64(3), `topic` LowCardinality(String), " +
+			"`client_id` String, `qos` UInt8, `payload` String) ENGINE = MergeTree PARTITION BY toYYYYMM(time) " +
+			"ORDER BY (topic, time) TTL toDateTime(time) + INTERVAL 30 DAY",
+	}, conn.execs)
+}
+
+func TestAsyncInsert(t *testing.T) {
+	conn := newFakeConn()
+	clickhouseHook := newHook(t, Options{
+		Conn:               conn,
+		Rules:              []Rule{{Filter: "#", Table: "mqtt_messages"}},
+		AsyncInsert:        true,
+		WaitForAsyncInsert: true,
+	})
+
+	publish(clickhouseHook, "a", "1")
+	require.NoError(t, clickhouseHook.Stop())
+	require.Equal(t, map[string]any{"async_insert": 1, "wait_for_async_insert": 1}, conn.settings)
+}
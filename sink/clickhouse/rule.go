@@ -0,0 +1,239 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// the values of columns. Columns may also have the value of a level of the topic, as level:N for its
+// Nth level, of a user property, as user:key, or of a field of a JSON payload, as json:path, where path
+// is the keys and array indexes of the field joined by dots, eg. json:readings.0.value
+const (
+	ValueTime        = "time"         // when the message was published, for DateTime64 columns
+	ValueTopic       = "topic"        // the topic
+	ValueClient      = "client"       // the id of the publishing client
+	ValueQos         = "qos"          // the QoS, for UInt8 columns
+	ValueRetain      = "retain"       // the retain flag, for Bool columns
+	ValuePayload     = "payload"      // the payload
+	ValueJSON        = "json"         // the payload if it is JSON, for JSON and Nullable(String) columns
+	ValueContentType = "content_type" // the MQTT 5 content type, empty if it has none
+
+	prefixLevel = "level:"
+	prefixUser  = "user:"
+	prefixJSON  = "json:"
+)
+
+// Column is a column of a table, and the value of the message it is given. Values which the message
+// doesn't have, such as a missing user property or JSON field, are NULL, so their columns should be
+// Nullable. Type is the type the column is created with, and is required with a schema, eg. Float64
+type Column struct {
+	Name  string `yaml:"name" json:"name"`
+	Value string `yaml:"value" json:"value"`
+	Type  string `yaml:"type" json:"type"`
+}
+
+// validate checks the filter, table and columns of the rule
+func (r Rule) validate() error {
+	if !mqtt.IsValidFilter(r.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Filter)
+	}
+
+	parts := strings.Split(r.Table, ".")
+	if len(parts) > 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+		return fmt.Errorf("has invalid table %q", r.Table)
+	}
+
+	names := map[string]bool{}
+	for _, c := range r.Columns {
+		if c.Name == "" {
+			return errors.New("has a column without a name")
+		}
+
+		if names[c.Name] {
+			return fmt.Errorf("has duplicate column %q", c.Name)
+		}
+		names[c.Name] = true
+
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("column %q %w", c.Name, err)
+		}
+
+		if r.Schema != nil && c.Type == "" {
+			return fmt.Errorf("column %q has no type", c.Name)
+		}
+	}
+	return nil
+}
+
+// validate checks the value of the column
+func (c Column) validate() error {
+	switch c.Value {
+	case ValueTime, ValueTopic, ValueClient, ValueQos, ValueRetain, ValuePayload, ValueJSON, ValueContentType:
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(c.Value, prefixLevel):
+		if n, err := strconv.Atoi(strings.TrimPrefix(c.Value, prefixLevel)); err != nil || n < 1 {
+			return fmt.Errorf("has invalid topic level %q", c.Value)
+		}
+		return nil
+	case strings.HasPrefix(c.Value, prefixUser) && len(c.Value) > len(prefixUser):
+		return nil
+	case strings.HasPrefix(c.Value, prefixJSON) && len(c.Value) > len(prefixJSON):
+		return nil
+	}
+	return fmt.Errorf("has invalid value %q", c.Value)
+}
+
+// create returns the statement creating the table of the rule if it doesn't exist
+func (r Rule) create() string {
+	var b strings.Builder
+	b.WriteString("CREATE TABLE IF NOT EXISTS ")
+	b.WriteString(quote(r.Table))
+	b.WriteString(" (")
+	for i, c := range r.Columns {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(quoteIdent(c.Name))
+		b.WriteString(" ")
+		b.WriteString(c.Type)
+	}
+
+	engine := r.Schema.Engine
+	if engine == "" {
+		engine = "MergeTree"
+	}
+	b.WriteString(") ENGINE = ")
+	b.WriteString(engine)
+
+	if r.Schema.PartitionBy != "" {
+		b.WriteString(" PARTITION BY ")
+		b.WriteString(r.Schema.PartitionBy)
+	}
+
+	orderBy := r.Schema.OrderBy
+	if orderBy == "" {
+		orderBy = "tuple()"
+	}
+	b.WriteString(" ORDER BY ")
+	b.WriteString(orderBy)
+
+	if r.Schema.TTL != "" {
+		b.WriteString(" TTL ")
+		b.WriteString(r.Schema.TTL)
+	}
+	return b.String()
+}
+
+// insert returns the query inserting into the columns of the table of the rule
+func (r Rule) insert() string {
+	names := make([]string, len(r.Columns))
+	for i, c := range r.Columns {
+		names[i] = quoteIdent(c.Name)
+	}
+	return "INSERT INTO " + quote(r.Table) + " (" + strings.Join(names, ", ") + ")"
+}
+
+// values returns the values of the columns of the rule for the message published by the client at the
+// time. The payload is decoded once if columns have JSON values
+func (r Rule) values(cl *mqtt.Client, pk packets.Packet, at time.Time) []any {
+	var doc any
+	decoded := false
+	values := make([]any, len(r.Columns))
+	for i, c := range r.Columns {
+		switch c.Value {
+		case ValueTime:
+			values[i] = at
+		case ValueTopic:
+			values[i] = pk.TopicName
+		case ValueClient:
+			values[i] = cl.ID
+		case ValueQos:
+			values[i] = pk.FixedHeader.Qos
+		case ValueRetain:
+			values[i] = pk.FixedHeader.Retain
+		case ValuePayload:
+			values[i] = string(pk.Payload)
+		case ValueJSON:
+			if json.Valid(pk.Payload) {
+				values[i] = string(pk.Payload)
+			}
+		case ValueContentType:
+			values[i] = pk.Properties.ContentType
+		default:
+			switch {
+			case strings.HasPrefix(c.Value, prefixLevel):
+				n, _ := strconv.Atoi(strings.TrimPrefix(c.Value, prefixLevel))
+				if levels := strings.Split(pk.TopicName, "/"); n <= len(levels) {
+					values[i] = levels[n-1]
+				}
+			case strings.HasPrefix(c.Value, prefixUser):
+				key := strings.TrimPrefix(c.Value, prefixUser)
+				for _, p := range pk.Properties.User {
+					if p.Key == key {
+						values[i] = p.Val
+						break
+					}
+				}
+			case strings.HasPrefix(c.Value, prefixJSON):
+				if !decoded {
+					decoded = true
+					if json.Unmarshal(pk.Payload, &doc) != nil {
+						doc = nil
+					}
+				}
+				values[i] = field(doc, strings.TrimPrefix(c.Value, prefixJSON))
+			}
+		}
+	}
+	return values
+}
+
+// field returns the field of the document at the path, with objects and arrays as JSON strings, or
+// nil if the document has no such field
+func field(doc any, path string) any {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]any:
+			doc = v[key]
+		case []any:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(v) {
+				return nil
+			}
+			doc = v[n]
+		default:
+			return nil
+		}
+	}
+
+	switch doc.(type) {
+	case map[string]any, []any:
+		b, _ := json.Marshal(doc)
+		return string(b)
+	}
+	return doc
+}
+
+// quote returns the table name quoted with backticks, with its database quoted separately
+func quote(table string) string {
+	parts := strings.Split(table, ".")
+	for i, p := range parts {
+		parts[i] = quoteIdent(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteIdent returns the identifier quoted with backticks
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(strings.ReplaceAll(name, `\`, `\\`), "`", "\\`") + "`"
+}
@@ -0,0 +1,127 @@
+package clickhouse
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectError bool
+	}{
+		{
+			name: "Success - schema and columns",
+			rule: Rule{Filter: "sensors/#", Table: "telemetry.readings", Columns: []Column{
+				{Name: "time", Value: ValueTime},
+				{Name: "device", Value: "level:2"},
+				{Name: "site", Value: "user:site"},
+				{Name: "temperature", Value: "json:temperature"},
+			}},
+		},
+		{
+			name:        "Failure - invalid filter",
+			rule:        Rule{Filter: "sensors/#/x", Table: "readings", Columns: DefaultColumns},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no table",
+			rule:        Rule{Filter: "#", Columns: DefaultColumns},
+			expectError: true,
+		},
+		{
+			name:        "Failure - empty schema",
+			rule:        Rule{Filter: "#", Table: ".readings", Columns: DefaultColumns},
+			expectError: true,
+		},
+		{
+			name:        "Failure - duplicate column",
+			rule:        Rule{Filter: "#", Table: "readings", Columns: []Column{{Name: "a", Value: ValueTopic}, {Name: "a", Value: ValueClient}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - column without name",
+			rule:        Rule{Filter: "#", Table: "readings", Columns: []Column{{Value: ValueTopic}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid level",
+			rule:        Rule{Filter: "#", Table: "readings", Columns: []Column{{Name: "a", Value: "level:0"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown value",
+			rule:        Rule{Filter: "#", Table: "readings", Columns: []Column{{Name: "a", Value: "username"}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+		})
+	}
+}
+
+func TestRuleValues(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	rule := Rule{Columns: []Column{
+		{Name: "time", Value: ValueTime},
+		{Name: "topic", Value: ValueTopic},
+		{Name: "client", Value: ValueClient},
+		{Name: "qos", Value: ValueQos},
+		{Name: "retain", Value: ValueRetain},
+		{Name: "payload", Value: ValuePayload},
+		{Name: "doc", Value: ValueJSON},
+		{Name: "content_type", Value: ValueContentType},
+		{Name: "device", Value: "level:2"},
+		{Name: "missing_level", Value: "level:5"},
+		{Name: "site", Value: "user:site"},
+		{Name: "value", Value: "json:readings.0.value"},
+		{Name: "tags", Value: "json:tags"},
+		{Name: "missing", Value: "json:readings.3.value"},
+	}}
+
+	payload := `{"readings":[{"value":21.5}],"tags":{"a":"b"}}`
+	values := rule.values(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "sensors/s1/readings",
+		Payload:     []byte(payload),
+		Properties: packets.Properties{
+			User: []packets.UserProperty{{Key: "site", Val: "north"}},
+		},
+	}, at)
+
+	require.Equal(t, []any{
+		at, "sensors/s1/readings", "c1", byte(1), true, payload, payload, "",
+		"s1", nil, "north", 21.5, `{"a":"b"}`, nil,
+	}, values)
+
+	// the JSON values of payloads which aren't JSON are NULL
+	values = rule.values(cl, packets.Packet{TopicName: "a", Payload: []byte("on")}, at)
+	require.Nil(t, values[6])
+	require.Nil(t, values[11])
+}
+
+func TestQuote(t *testing.T) {
+	require.Equal(t, "`telemetry`.`readings`", quote("telemetry.readings"))
+	require.Equal(t, "`a.b`", quoteIdent("a.b"))
+	require.Equal(t, "`a\\`b`", quoteIdent("a`b"))
+	require.Equal(t, "INSERT INTO `readings` (`time`, `device`)", Rule{Table: "readings", Columns: []Column{
+		{Name: "time", Value: ValueTime},
+		{Name: "device", Value: "level:2"},
+	}}.insert())
+}
@@ -0,0 +1,489 @@
+// Package grpcexport provides a hook streaming the events of the broker, and the messages published to
+// it, to external services over the server side or bidirectional streams of the Export gRPC service
+// in export.proto, so they can tap live traffic without MQTT subscriptions, and without being granted
+// wildcard ACLs to do so. Clients choose the events they receive with a Filter, which the clients of
+// bidirectional streams may replace at any time.
+//
+// The service is implemented by a thin adapter of the code generated from export.proto, eg. for Go:
+//
+//	type server struct {
+//		exportpb.UnimplementedExportServer
+//		hook *grpcexport.Hook
+//	}
+//
+//	func (s server) Subscribe(f *exportpb.Filter, stream exportpb.Export_SubscribeServer) error {
+//		return s.hook.Subscribe(sender{stream}, filter(f))
+//	}
+//
+//	func (s server) Stream(stream exportpb.Export_StreamServer) error {
+//		return s.hook.Serve(bidi{stream})
+//	}
+//
+//	type sender struct{ exportpb.Export_SubscribeServer }
+//
+//	func (s sender) Send(e grpcexport.Event) error {
+//		return s.Export_SubscribeServer.Send(&exportpb.Event{
+//			Type: exportpb.EventType(e.Type), Timestamp: e.Time.UnixMilli(), ClientId: e.ClientID,
+//			Topic: e.Topic, Payload: e.Payload, Qos: uint32(e.Qos), // ...
+//		})
+//	}
+//
+// where bidi also receives filters, and filter converts them with grpcexport.EventType(t) for each
+// of their events. Errors returned by Subscribe and Serve should be mapped to gRPC status codes, eg.
+// ErrInvalidFilter to InvalidArgument and ErrTooManyStreams to ResourceExhausted.
+package grpcexport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+)
+
+var (
+	// ErrInvalidFilter is returned for filters with unknown event types or invalid topic filters
+	ErrInvalidFilter = errors.New("invalid filter")
+
+	// ErrTooManyStreams is returned for streams opened while MaxStreams are open
+	ErrTooManyStreams = errors.New("too many streams")
+
+	// ErrStopped is returned for streams which are open when the hook stops, or opened after
+	ErrStopped = errors.New("hook stopped")
+)
+
+// EventType is the type of an event, and has the values of the EventType enum of export.proto
+type EventType int32
+
+// the types of events
+const (
+	EventConnect     EventType = 1 // a client connected and its session was established
+	EventDisconnect  EventType = 2 // a client disconnected
+	EventSubscribe   EventType = 3 // a client subscribed to filters
+	EventUnsubscribe EventType = 4 // a client unsubscribed from filters
+	EventPublish     EventType = 5 // a client published a message
+)
+
+// Event is an event of the broker, which is the Event message of export.proto
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	ClientID string
+	Username string
+	Remote   string
+
+	// the message of publish events
+	Topic          string
+	Payload        []byte
+	Qos            byte
+	Retain         bool
+	ContentType    string
+	UserProperties map[string]string
+
+	// Filters are the filters of subscribe and unsubscribe events
+	Filters []string
+
+	// Reason is why the client disconnected, if it was due to an error
+	Reason string
+}
+
+// Filter selects the events streamed to a client, and is the Filter message of export.proto. Empty
+// fields select everything
+type Filter struct {
+	Events []EventType
+
+	// Topics are MQTT topic filters, which may contain +/# wildcards, selecting the publish events of
+	// the messages whose topic matches any of them
+	Topics []string
+
+	// Clients are the ids of the clients whose events are streamed
+	Clients []string
+}
+
+// Sender sends events to the client of a stream, such as that of the Subscribe rpc. Context is
+// cancelled when the client goes away
+type Sender interface {
+	Context() context.Context
+	Send(e Event) error
+}
+
+// Stream is a bidirectional stream, such as that of the Stream rpc, whose client sends filters
+type Stream interface {
+	Sender
+	Recv() (Filter, error)
+}
+
+// Stats are the totals of the events streamed since the hook was initialized
+type Stats struct {
+	Streams int64 // the number of streams open
+	Sent    int64 // the number of events sent to clients
+	Dropped int64 // the number of events discarded as the buffer of a stream was full
+}
+
+// Hook is a hook that streams the events of the broker to clients of the Export service
+type Hook struct {
+	config  Options
+	streams map[*stream]struct{}
+	done    chan struct{} // closed when the hook stops
+	stopped bool
+	stats   Stats
+	mu      sync.RWMutex // guards streams and stopped
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// stream is an open stream, whose events are buffered so slow clients don't hold up the broker
+type stream struct {
+	filter Filter
+	events chan Event
+	mu     sync.RWMutex // guards filter
+}
+
+// Options is a struct that contains all the information required to configure the grpcexport hook
+type Options struct {
+	// Authorize is called with the context of a stream and each filter its client sends, and the
+	// stream is closed with its error if it returns one, eg. if the client may not see the topics.
+	// All filters are allowed if it is nil
+	Authorize func(ctx context.Context, f Filter) error
+
+	// MaxStreams is how many streams may be open at once, defaults to 100
+	MaxStreams int
+
+	// BufferSize is how many events wait to be sent to each stream, defaults to 1000. Events for a
+	// stream whose buffer is full are dropped
+	BufferSize int
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "grpcexport-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	grpcexportHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if grpcexportHookConfig.MaxStreams <= 0 {
+		grpcexportHookConfig.MaxStreams = 100
+	}
+
+	if grpcexportHookConfig.BufferSize <= 0 {
+		grpcexportHookConfig.BufferSize = 1000
+	}
+
+	h.config = grpcexportHookConfig
+	h.streams = map[*stream]struct{}{}
+	h.done = make(chan struct{})
+	return nil
+}
+
+// Stop closes the open streams
+func (h *Hook) Stop() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.done == nil || h.stopped {
+		return nil
+	}
+	h.stopped = true
+	close(h.done)
+	return nil
+}
+
+// Stats returns the totals of the events streamed so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// Subscribe sends the events matching the filter to the client of the stream, until its context is
+// cancelled, sending fails or the hook stops
+func (h *Hook) Subscribe(s Sender, f Filter) error {
+	if err := h.authorize(s.Context(), f); err != nil {
+		return err
+	}
+
+	st, err := h.open(f)
+	if err != nil {
+		return err
+	}
+	defer h.close(st)
+
+	return h.send(s, st, nil)
+}
+
+// Serve sends the events matching the last filter received from the client of the bidirectional
+// stream, until its context is cancelled, sending or receiving fails, or the hook stops. The stream
+// starts once the first filter is received
+func (h *Hook) Serve(s Stream) error {
+	f, err := s.Recv()
+	if err != nil {
+		return err
+	}
+
+	if err := h.authorize(s.Context(), f); err != nil {
+		return err
+	}
+
+	st, err := h.open(f)
+	if err != nil {
+		return err
+	}
+	defer h.close(st)
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			f, err := s.Recv()
+			if err == nil {
+				err = h.authorize(s.Context(), f)
+			}
+
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			st.mu.Lock()
+			st.filter = f
+			st.mu.Unlock()
+		}
+	}()
+
+	return h.send(s, st, errs)
+}
+
+// authorize checks that the filter is valid, and that the client of the stream may use it
+func (h *Hook) authorize(ctx context.Context, f Filter) error {
+	for _, t := range f.Events {
+		if t < EventConnect || t > EventPublish {
+			return fmt.Errorf("%w: unknown event type %d", ErrInvalidFilter, t)
+		}
+	}
+
+	for _, topic := range f.Topics {
+		if !mqtt.IsValidFilter(topic, false) {
+			return fmt.Errorf("%w: invalid topic filter %q", ErrInvalidFilter, topic)
+		}
+	}
+
+	if h.config.Authorize != nil {
+		return h.config.Authorize(ctx, f)
+	}
+	return nil
+}
+
+// open registers a stream with the filter
+func (h *Hook) open(f Filter) (*stream, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stopped {
+		return nil, ErrStopped
+	}
+
+	if len(h.streams) >= h.config.MaxStreams {
+		return nil, ErrTooManyStreams
+	}
+
+	st := &stream{filter: f, events: make(chan Event, h.config.BufferSize)}
+	h.streams[st] = struct{}{}
+
+	h.statsMu.Lock()
+	h.stats.Streams++
+	h.statsMu.Unlock()
+	return st, nil
+}
+
+// close unregisters the stream
+func (h *Hook) close(st *stream) {
+	h.mu.Lock()
+	delete(h.streams, st)
+	h.mu.Unlock()
+
+	h.statsMu.Lock()
+	h.stats.Streams--
+	h.statsMu.Unlock()
+}
+
+// send sends the events of the stream to its client until its context is cancelled, sending fails,
+// an error is received from errs or the hook stops
+func (h *Hook) send(s Sender, st *stream, errs <-chan error) error {
+	ctx := s.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-h.done:
+			return ErrStopped
+		case err := <-errs:
+			return err
+		case e := <-st.events:
+			if err := s.Send(e); err != nil {
+				return err
+			}
+
+			h.statsMu.Lock()
+			h.stats.Sent++
+			h.statsMu.Unlock()
+		}
+	}
+}
+
+// publish queues the event for each stream whose filter matches it, dropping it for those whose
+// buffer is full. The event is only made if a stream is open
+func (h *Hook) publish(event func() Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.streams) == 0 {
+		return
+	}
+
+	e := event()
+	var dropped int64
+	for st := range h.streams {
+		st.mu.RLock()
+		matches := st.filter.matches(e)
+		st.mu.RUnlock()
+		if !matches {
+			continue
+		}
+
+		select {
+		case st.events <- e:
+		default:
+			dropped++
+		}
+	}
+
+	if dropped > 0 {
+		h.statsMu.Lock()
+		h.stats.Dropped += dropped
+		h.statsMu.Unlock()
+	}
+}
+
+// matches returns whether the filter selects the event
+func (f Filter) matches(e Event) bool {
+	if len(f.Events) > 0 && !slices.Contains(f.Events, e.Type) {
+		return false
+	}
+
+	if len(f.Clients) > 0 && !slices.Contains(f.Clients, e.ClientID) {
+		return false
+	}
+
+	if len(f.Topics) == 0 || e.Type != EventPublish {
+		return true
+	}
+
+	for _, topic := range f.Topics {
+		if acl.Match(topic, e.Topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// newEvent returns an event of the type for the client
+func newEvent(t EventType, cl *mqtt.Client) Event {
+	return Event{
+		Type:     t,
+		Time:     time.Now(),
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Remote:   cl.Net.Remote,
+	}
+}
+
+// OnSessionEstablished is called when a client has connected, and streams a connect event
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.publish(func() Event {
+		return newEvent(EventConnect, cl)
+	})
+}
+
+// OnDisconnect is called when a client has disconnected, and streams a disconnect event
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.publish(func() Event {
+		e := newEvent(EventDisconnect, cl)
+		if err != nil {
+			e.Reason = err.Error()
+		}
+		return e
+	})
+}
+
+// OnSubscribed is called when a client has subscribed, and streams a subscribe event with the
+// filters which were granted
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	h.publish(func() Event {
+		e := newEvent(EventSubscribe, cl)
+		for i, sub := range pk.Filters {
+			if i < len(reasonCodes) && reasonCodes[i] >= packets.ErrUnspecifiedError.Code {
+				continue
+			}
+			e.Filters = append(e.Filters, sub.Filter)
+		}
+		return e
+	})
+}
+
+// OnUnsubscribed is called when a client has unsubscribed, and streams an unsubscribe event
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	h.publish(func() Event {
+		e := newEvent(EventUnsubscribe, cl)
+		for _, sub := range pk.Filters {
+			e.Filters = append(e.Filters, sub.Filter)
+		}
+		return e
+	})
+}
+
+// OnPublished is called when a client has published a message, and streams a publish event
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.publish(func() Event {
+		e := newEvent(EventPublish, cl)
+		e.Topic = pk.TopicName
+		e.Payload = pk.Payload
+		e.Qos = pk.FixedHeader.Qos
+		e.Retain = pk.FixedHeader.Retain
+		e.ContentType = pk.Properties.ContentType
+		for _, p := range pk.Properties.User {
+			if e.UserProperties == nil {
+				e.UserProperties = map[string]string{}
+			}
+			if _, ok := e.UserProperties[p.Key]; !ok {
+				e.UserProperties[p.Key] = p.Val
+			}
+		}
+		return e
+	})
+}
@@ -0,0 +1,309 @@
+package grpcexport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStream is a bidirectional stream whose sent events and received filters go through channels
+type fakeStream struct {
+	ctx     context.Context
+	events  chan Event
+	filters chan Filter
+	sendErr error
+}
+
+func newFakeStream(ctx context.Context) *fakeStream {
+	return &fakeStream{ctx: ctx, events: make(chan Event, 10), filters: make(chan Filter, 10)}
+}
+
+func (s *fakeStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeStream) Send(e Event) error {
+	if s.sendErr != nil {
+		return s.sendErr
+	}
+	s.events <- e
+	return nil
+}
+
+func (s *fakeStream) Recv() (Filter, error) {
+	select {
+	case f := <-s.filters:
+		return f, nil
+	case <-s.ctx.Done():
+		return Filter{}, io.EOF
+	}
+}
+
+func (s *fakeStream) next(t *testing.T) Event {
+	t.Helper()
+
+	select {
+	case e := <-s.events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event was sent")
+		return Event{}
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	grpcexportHook := new(Hook)
+	grpcexportHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, grpcexportHook.Init(options))
+	t.Cleanup(func() { grpcexportHook.Stop() })
+	return grpcexportHook
+}
+
+// waitStreams waits until the hook has n open streams
+func waitStreams(t *testing.T, h *Hook, n int64) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return h.Stats().Streams == n
+	}, time.Second, time.Millisecond)
+}
+
+func newClient(id string) *mqtt.Client {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", id, false)
+	cl.Net.Remote = "10.0.0.1:1883"
+	cl.Properties.Username = []byte("user-" + id)
+	return cl
+}
+
+func TestID(t *testing.T) {
+	grpcexportHook := new(Hook)
+
+	require.Equal(t, "grpcexport-hook", grpcexportHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	grpcexportHook := new(Hook)
+
+	require.True(t, grpcexportHook.Provides(mqtt.OnPublished))
+	require.True(t, grpcexportHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, grpcexportHook.Provides(mqtt.OnDisconnect))
+	require.False(t, grpcexportHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - default options",
+			config:      Options{},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grpcexportHook := new(Hook)
+			err := grpcexportHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, 100, grpcexportHook.config.MaxStreams)
+			require.Equal(t, 1000, grpcexportHook.config.BufferSize)
+		})
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	grpcexportHook := newHook(t, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newFakeStream(ctx)
+
+	errs := make(chan error, 1)
+	go func() { errs <- grpcexportHook.Subscribe(s, Filter{Topics: []string{"sensors/#"}}) }()
+	waitStreams(t, grpcexportHook, 1)
+
+	cl := newClient("c1")
+	grpcexportHook.OnPublished(cl, packets.Packet{TopicName: "other", Payload: []byte("no")})
+	grpcexportHook.OnSessionEstablished(cl, packets.Packet{})
+	grpcexportHook.OnPublished(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1, Retain: true},
+		TopicName:   "sensors/1",
+		Payload:     []byte("21.5"),
+		Properties:  packets.Properties{User: []packets.UserProperty{{Key: "unit", Val: "C"}}},
+	})
+
+	e := s.next(t)
+	require.Equal(t, EventConnect, e.Type)
+	require.Equal(t, "c1", e.ClientID)
+	require.Equal(t, "user-c1", e.Username)
+	require.Equal(t, "10.0.0.1:1883", e.Remote)
+
+	e = s.next(t)
+	require.Equal(t, EventPublish, e.Type)
+	require.Equal(t, "sensors/1", e.Topic)
+	require.Equal(t, []byte("21.5"), e.Payload)
+	require.Equal(t, byte(1), e.Qos)
+	require.True(t, e.Retain)
+	require.Equal(t, map[string]string{"unit": "C"}, e.UserProperties)
+
+	cancel()
+	require.NoError(t, <-errs)
+	waitStreams(t, grpcexportHook, 0)
+	require.Equal(t, int64(2), grpcexportHook.Stats().Sent)
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	grpcexportHook := newHook(t, Options{})
+	s := newFakeStream(context.Background())
+
+	go grpcexportHook.Subscribe(s, Filter{Events: []EventType{EventSubscribe, EventDisconnect}, Clients: []string{"c2"}})
+	waitStreams(t, grpcexportHook, 1)
+
+	grpcexportHook.OnSubscribed(newClient("c1"), packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}}}, []byte{0})
+	grpcexportHook.OnPublished(newClient("c2"), packets.Packet{TopicName: "a"})
+	grpcexportHook.OnSubscribed(newClient("c2"), packets.Packet{Filters: packets.Subscriptions{{Filter: "a"}, {Filter: "b"}}}, []byte{1, packets.ErrNotAuthorized.Code})
+	grpcexportHook.OnDisconnect(newClient("c2"), errors.New("keepalive timeout"), false)
+
+	e := s.next(t)
+	require.Equal(t, EventSubscribe, e.Type)
+	require.Equal(t, []string{"a"}, e.Filters)
+
+	e = s.next(t)
+	require.Equal(t, EventDisconnect, e.Type)
+	require.Equal(t, "keepalive timeout", e.Reason)
+	require.Empty(t, s.events)
+}
+
+func TestSubscribeInvalidFilter(t *testing.T) {
+	grpcexportHook := newHook(t, Options{})
+	s := newFakeStream(context.Background())
+
+	err := grpcexportHook.Subscribe(s, Filter{Topics: []string{"a/#/b"}})
+	require.ErrorIs(t, err, ErrInvalidFilter)
+
+	err = grpcexportHook.Subscribe(s, Filter{Events: []EventType{9}})
+	require.ErrorIs(t, err, ErrInvalidFilter)
+}
+
+func TestSubscribeUnauthorized(t *testing.T) {
+	denied := errors.New("denied")
+	grpcexportHook := newHook(t, Options{
+		Authorize: func(ctx context.Context, f Filter) error {
+			if len(f.Topics) == 0 {
+				return denied
+			}
+			return nil
+		},
+	})
+
+	err := grpcexportHook.Subscribe(newFakeStream(context.Background()), Filter{})
+	require.ErrorIs(t, err, denied)
+}
+
+func TestSubscribeTooManyStreams(t *testing.T) {
+	grpcexportHook := newHook(t, Options{MaxStreams: 1})
+
+	go grpcexportHook.Subscribe(newFakeStream(context.Background()), Filter{})
+	waitStreams(t, grpcexportHook, 1)
+
+	err := grpcexportHook.Subscribe(newFakeStream(context.Background()), Filter{})
+	require.ErrorIs(t, err, ErrTooManyStreams)
+}
+
+func TestSubscribeSendError(t *testing.T) {
+	grpcexportHook := newHook(t, Options{})
+	s := newFakeStream(context.Background())
+	s.sendErr = errors.New("connection reset")
+
+	errs := make(chan error, 1)
+	go func() { errs <- grpcexportHook.Subscribe(s, Filter{}) }()
+	waitStreams(t, grpcexportHook, 1)
+
+	grpcexportHook.OnSessionEstablished(newClient("c1"), packets.Packet{})
+	require.ErrorIs(t, <-errs, s.sendErr)
+	waitStreams(t, grpcexportHook, 0)
+}
+
+func TestSubscribeDropped(t *testing.T) {
+	grpcexportHook := newHook(t, Options{BufferSize: 1})
+	s := newFakeStream(context.Background())
+	s.events = make(chan Event) // blocks the sender, so the buffer fills
+
+	go grpcexportHook.Subscribe(s, Filter{})
+	waitStreams(t, grpcexportHook, 1)
+
+	for i := 0; i < 5; i++ {
+		grpcexportHook.OnSessionEstablished(newClient("c1"), packets.Packet{})
+	}
+
+	require.Eventually(t, func() bool {
+		return grpcexportHook.Stats().Dropped >= 3
+	}, time.Second, time.Millisecond)
+}
+
+func TestServe(t *testing.T) {
+	grpcexportHook := newHook(t, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newFakeStream(ctx)
+	s.filters <- Filter{Topics: []string{"a"}}
+
+	errs := make(chan error, 1)
+	go func() { errs <- grpcexportHook.Serve(s) }()
+	waitStreams(t, grpcexportHook, 1)
+
+	cl := newClient("c1")
+	grpcexportHook.OnPublished(cl, packets.Packet{TopicName: "a"})
+	require.Equal(t, "a", s.next(t).Topic)
+
+	s.filters <- Filter{Topics: []string{"b"}}
+	require.Eventually(t, func() bool {
+		grpcexportHook.OnPublished(cl, packets.Packet{TopicName: "b"})
+		return len(s.events) > 0
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, "b", s.next(t).Topic)
+
+	s.filters <- Filter{Topics: []string{"#/a"}}
+	require.ErrorIs(t, <-errs, ErrInvalidFilter)
+}
+
+func TestStop(t *testing.T) {
+	grpcexportHook := newHook(t, Options{})
+
+	errs := make(chan error, 1)
+	go func() { errs <- grpcexportHook.Subscribe(newFakeStream(context.Background()), Filter{}) }()
+	waitStreams(t, grpcexportHook, 1)
+
+	require.NoError(t, grpcexportHook.Stop())
+	require.ErrorIs(t, <-errs, ErrStopped)
+
+	err := grpcexportHook.Subscribe(newFakeStream(context.Background()), Filter{})
+	require.ErrorIs(t, err, ErrStopped)
+	require.NoError(t, grpcexportHook.Stop())
+}
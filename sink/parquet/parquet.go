@@ -0,0 +1,316 @@
+// Package parquet provides a sink hook buffering the messages published to matching MQTT topics by
+// table and hour, and writing them as Parquet files to object storage, such as S3 or GCS, for cheap
+// long-term analytics with Athena or BigQuery without a streaming pipeline.
+//
+// Files are named with Hive style partitions, which query engines use to skip the files of other
+// dates and hours, eg. mqtt/readings/date=2024-01-01/hour=12/part-1704110400000000000-1.parquet, and
+// have a single row group with a page of each column.
+//
+// Files are written to a Bucket, which is a directory with snapshot.Dir, or a thin adapter of the SDK
+// of the object storage, eg. for S3 with aws-sdk-go-v2:
+//
+//	type bucket struct {
+//		client *s3.Client
+//		name   string
+//	}
+//
+//	func (b bucket) Put(ctx context.Context, key string, data []byte) error {
+//		_, err := b.client.PutObject(ctx, &s3.PutObjectInput{Bucket: &b.name, Key: &key, Body: bytes.NewReader(data)})
+//		return err
+//	}
+package parquet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// Bucket is object storage the files are written to
+type Bucket interface {
+	// Put writes the object, replacing it if it exists
+	Put(ctx context.Context, name string, data []byte) error
+}
+
+// Rule writes the messages of the MQTT topics matching Filter, which may contain +/# wildcards, to the
+// files of Table, which is the path of the files under the prefix, eg. "readings" or "plant/readings".
+// Columns are the schema of the files, and default to DefaultColumns. Where is an optional filter
+// expression (see pkg/filter) messages must also match, eg. "json.temperature > 30"
+type Rule struct {
+	Filter  string   `yaml:"filter" json:"filter"`
+	Where   string   `yaml:"where" json:"where"`
+	Table   string   `yaml:"table" json:"table"`
+	Columns []Column `yaml:"columns" json:"columns"`
+}
+
+// Stats are the totals of the messages written since the hook was initialized
+type Stats struct {
+	Files   int64 // the number of files written
+	Written int64 // the number of rows written
+	Failed  int64 // the number of rows whose files could not be written
+	Dropped int64 // the number of messages discarded as the queue was full
+}
+
+// Hook is a hook that writes messages to Parquet files in object storage
+type Hook struct {
+	config  Options
+	codec   int32
+	bridge  *bridge.Bridge[bridge.Message]
+	seq     int   // numbers the files, so their names are unique
+	files   int64 // the number of files written
+	stopped atomic.Bool
+	statsMu sync.Mutex // guards files
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the parquet hook
+type Options struct {
+	// Bucket is where the files are written
+	Bucket Bucket
+
+	// Prefix is prepended to the names of the files, defaults to "mqtt/"
+	Prefix string
+
+	// Rules map MQTT topics to tables, and the first whose filter matches the topic of a message
+	// applies. Messages matching no rule aren't written
+	Rules []Rule
+
+	// MaxRows is how many rows a file has at most, defaults to 100000. The rows of a table are written
+	// once there are MaxRows, or once the first has waited for FlushInterval, which defaults to 10
+	// minutes, to a file for each hour they belong to. Larger files are cheaper to query
+	MaxRows       int
+	FlushInterval time.Duration
+
+	// Compression is CompressionGzip or CompressionNone, and defaults to CompressionGzip
+	Compression string
+
+	Timeout time.Duration // how long writing the files of a batch may take, defaults to 1 minute
+
+	// QueueSize is how many rows wait to be written, defaults to 100000. Messages published while the
+	// queue is full wait for up to Block for room, and are then dropped by the Drop policy, which
+	// defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Server publishes a bridge.Warning to $SYS/bridges/parquet/dropped when messages are dropped, if
+	// set
+	Server *mqtt.Server
+
+	// Buffer queues rows on disk rather than in memory if it is set, so the rows which haven't been
+	// written survive restarts of the broker and long outages of the object storage
+	Buffer *bridge.Buffer
+
+	// Retry retries files which fail to be written, and must limit the attempts or the time spent.
+	// Files are written once if it is nil
+	Retry *retry.Policy
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "parquet-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts buffering messages
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	parquetHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if parquetHookConfig.Bucket == nil {
+		return errors.New("bucket is required")
+	}
+
+	if len(parquetHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	for i, rule := range parquetHookConfig.Rules {
+		if len(rule.Columns) == 0 {
+			parquetHookConfig.Rules[i].Columns = DefaultColumns
+		}
+
+		if err := parquetHookConfig.Rules[i].validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+	}
+
+	switch parquetHookConfig.Compression {
+	case "", CompressionGzip:
+		parquetHookConfig.Compression = CompressionGzip
+		h.codec = codecGzip
+	case CompressionNone:
+		h.codec = codecNone
+	default:
+		return fmt.Errorf("invalid compression %q", parquetHookConfig.Compression)
+	}
+
+	if parquetHookConfig.Retry != nil && parquetHookConfig.Retry.MaxAttempts == 0 && parquetHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if parquetHookConfig.Prefix == "" {
+		parquetHookConfig.Prefix = "mqtt/"
+	}
+
+	if parquetHookConfig.MaxRows <= 0 {
+		parquetHookConfig.MaxRows = 100000
+	}
+
+	if parquetHookConfig.FlushInterval <= 0 {
+		parquetHookConfig.FlushInterval = 10 * time.Minute
+	}
+
+	if parquetHookConfig.Timeout <= 0 {
+		parquetHookConfig.Timeout = time.Minute
+	}
+
+	if parquetHookConfig.QueueSize <= 0 {
+		parquetHookConfig.QueueSize = 100000
+	}
+
+	h.config = parquetHookConfig
+
+	filters := make([]string, len(parquetHookConfig.Rules))
+	where := make([]string, len(parquetHookConfig.Rules))
+	for i, rule := range parquetHookConfig.Rules {
+		filters[i], where[i] = rule.Filter, rule.Where
+	}
+
+	var err error
+	h.bridge, err = bridge.New[bridge.Message](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		BatchSize: parquetHookConfig.MaxRows,
+		Linger:    parquetHookConfig.FlushInterval,
+		Timeout:   parquetHookConfig.Timeout,
+		QueueSize: parquetHookConfig.QueueSize,
+		Block:     parquetHookConfig.Block,
+		Drop:      parquetHookConfig.Drop,
+		Server:    parquetHookConfig.Server,
+		Name:      "parquet",
+		Buffer:    parquetHookConfig.Buffer,
+		Retry:     parquetHookConfig.Retry,
+	}, h.Log)
+	return err
+}
+
+// Stop writes the queued rows
+func (h *Hook) Stop() error {
+	if h.bridge == nil || h.stopped.Swap(true) {
+		return nil
+	}
+
+	return h.bridge.Close()
+}
+
+// Stats returns the totals of the messages written so far
+func (h *Hook) Stats() Stats {
+	if h.bridge == nil {
+		return Stats{}
+	}
+
+	h.statsMu.Lock()
+	files := h.files
+	h.statsMu.Unlock()
+
+	stats := h.bridge.Stats()
+	return Stats{Files: files, Written: stats.Sent, Failed: stats.Failed, Dropped: stats.Dropped}
+}
+
+// OnPublished is called when a client has published a message, and queues its row if a rule matches
+// its topic
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.bridge.Publish(cl, pk)
+}
+
+// sink queues the messages of the bridge of the hook, and writes their rows to files
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the message published by the client, whose row is made once it is written
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (bridge.Message, error) {
+	return bridge.NewMessage(cl, pk, time.Now().UTC()), nil
+}
+
+// Send writes the rows of the messages to a file of the table of the rule of the route for each hour
+// they belong to. The messages of the files which could not be written are returned in a
+// *bridge.PartialError
+func (s sink) Send(ctx context.Context, route int, msgs []bridge.Message) error {
+	var hours []time.Time
+	indexes := map[time.Time][]int{} // of the messages of each hour
+	for i, msg := range msgs {
+		hour := msg.Time.UTC().Truncate(time.Hour)
+		if _, ok := indexes[hour]; !ok {
+			hours = append(hours, hour)
+		}
+		indexes[hour] = append(indexes[hour], i)
+	}
+
+	var failed []int
+	var errs []error
+	for _, hour := range hours {
+		if err := s.h.write(ctx, route, hour, msgs, indexes[hour]); err != nil {
+			failed = append(failed, indexes[hour]...)
+			errs = append(errs, err)
+		}
+	}
+
+	switch {
+	case len(failed) == 0:
+		return nil
+	case len(failed) == len(msgs):
+		return errors.Join(errs...)
+	}
+	return &bridge.PartialError{Failed: failed, Err: errors.Join(errs...)}
+}
+
+// write writes the rows of the messages with the indexes to a file of the table of the rule of the
+// route in the hour
+func (h *Hook) write(ctx context.Context, route int, hour time.Time, msgs []bridge.Message, indexes []int) error {
+	rule := h.config.Rules[route]
+	rows := make([][]any, len(indexes))
+	for i, j := range indexes {
+		rows[i] = rule.values(msgs[j].Client(), msgs[j].Packet(), msgs[j].Time.UTC())
+	}
+	data := encode(rule.names(), rule.kinds(), rows, h.codec)
+
+	h.seq++
+	name := h.config.Prefix + rule.Table +
+		"/date=" + hour.Format("2006-01-02") +
+		"/hour=" + hour.Format("15") +
+		"/part-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + strconv.Itoa(h.seq) + ".parquet"
+
+	if err := h.config.Bucket.Put(ctx, name, data); err != nil {
+		return fmt.Errorf("file %s %w", name, err)
+	}
+
+	h.statsMu.Lock()
+	h.files++
+	h.statsMu.Unlock()
+	return nil
+}
@@ -0,0 +1,330 @@
+package parquet
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+	"github.com/mochi-mqtt/hooks/storage/snapshot"
+)
+
+// memoryBucket keeps the objects written to it, failing the next writes with the queued errors, and
+// holding them until block is closed if it is set
+type memoryBucket struct {
+	objects map[string][]byte
+	errs    []error
+	puts    int
+	block   chan struct{}
+	mu      sync.Mutex
+}
+
+func newMemoryBucket() *memoryBucket {
+	return &memoryBucket{objects: map[string][]byte{}}
+}
+
+func (b *memoryBucket) Put(ctx context.Context, name string, data []byte) error {
+	if b.block != nil {
+		<-b.block
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.puts++
+	if len(b.errs) > 0 {
+		err := b.errs[0]
+		b.errs = b.errs[1:]
+		return err
+	}
+	b.objects[name] = data
+	return nil
+}
+
+func (b *memoryBucket) names() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var names []string
+	for name := range b.objects {
+		names = append(names, name)
+	}
+	return names
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	parquetHook := new(Hook)
+	parquetHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, parquetHook.Init(options))
+	t.Cleanup(func() { parquetHook.Stop() })
+	return parquetHook
+}
+
+func publish(h *Hook, topic, payload string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(payload)})
+}
+
+func TestID(t *testing.T) {
+	parquetHook := new(Hook)
+
+	require.Equal(t, "parquet-hook", parquetHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	parquetHook := new(Hook)
+
+	require.True(t, parquetHook.Provides(mqtt.OnPublished))
+	require.False(t, parquetHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	rules := []Rule{{Filter: "#", Table: "messages"}}
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - rules",
+			config:      Options{Bucket: newMemoryBucket(), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no bucket",
+			config:      Options{Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Bucket: newMemoryBucket()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Bucket: newMemoryBucket(), Rules: []Rule{{Filter: "#"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid compression",
+			config:      Options{Bucket: newMemoryBucket(), Rules: rules, Compression: "zstd"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Bucket: newMemoryBucket(), Rules: rules, Retry: &retry.Policy{InitialInterval: time.Second}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parquetHook := new(Hook)
+			err := parquetHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, parquetHook.Stop())
+			require.Equal(t, "mqtt/", parquetHook.config.Prefix)
+			require.Equal(t, 100000, parquetHook.config.MaxRows)
+			require.Equal(t, DefaultColumns, parquetHook.config.Rules[0].Columns)
+		})
+	}
+}
+
+func TestWriteOnStop(t *testing.T) {
+	bucket := newMemoryBucket()
+	parquetHook := newHook(t, Options{
+		Bucket: bucket,
+		Rules: []Rule{
+			{Filter: "sensors/#", Table: "readings"},
+			{Filter: "events/#", Table: "events", Columns: []Column{{Name: "text", Value: ValueText}}},
+		},
+	})
+
+	publish(parquetHook, "sensors/1", "21.5")
+	publish(parquetHook, "sensors/2", "22.0")
+	publish(parquetHook, "events/1", "started")
+	publish(parquetHook, "other", "skipped")
+	require.NoError(t, parquetHook.Stop())
+
+	names := bucket.names()
+	require.Len(t, names, 2)
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	for _, name := range names {
+		require.True(t, strings.HasSuffix(name, ".parquet"), name)
+		require.Contains(t, name, "/date="+hour.Format("2006-01-02")+"/hour="+hour.Format("15")+"/part-")
+		if !strings.HasPrefix(name, "mqtt/readings/") {
+			require.True(t, strings.HasPrefix(name, "mqtt/events/"), name)
+			_, columns := decode(t, bucket.objects[name])
+			require.Equal(t, []any{"started"}, columns[0].values)
+			continue
+		}
+
+		n, columns := decode(t, bucket.objects[name])
+		require.Equal(t, int64(2), n)
+		require.Equal(t, "topic", columns[1].name)
+		require.Equal(t, []any{"sensors/1", "sensors/2"}, columns[1].values)
+		require.Equal(t, []any{"21.5", "22.0"}, columns[4].values)
+	}
+
+	stats := parquetHook.Stats()
+	require.Equal(t, int64(2), stats.Files)
+	require.Equal(t, int64(3), stats.Written)
+}
+
+func TestWriteMaxRows(t *testing.T) {
+	bucket := newMemoryBucket()
+	parquetHook := newHook(t, Options{Bucket: bucket, Rules: []Rule{{Filter: "#", Table: "t"}}, MaxRows: 2})
+
+	for i := 0; i < 5; i++ {
+		publish(parquetHook, "a", "x")
+	}
+
+	require.Eventually(t, func() bool {
+		return len(bucket.names()) == 2
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, parquetHook.Stop())
+	require.Len(t, bucket.names(), 3)
+	require.Equal(t, int64(5), parquetHook.Stats().Written)
+}
+
+func TestWriteFlushInterval(t *testing.T) {
+	bucket := newMemoryBucket()
+	parquetHook := newHook(t, Options{Bucket: bucket, Rules: []Rule{{Filter: "#", Table: "t"}}, FlushInterval: 10 * time.Millisecond})
+
+	publish(parquetHook, "a", "x")
+	require.Eventually(t, func() bool {
+		return len(bucket.names()) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestWriteRetry(t *testing.T) {
+	bucket := newMemoryBucket()
+	bucket.errs = []error{errors.New("unavailable")}
+	parquetHook := newHook(t, Options{
+		Bucket: bucket,
+		Rules:  []Rule{{Filter: "#", Table: "t"}},
+		Retry:  &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 2},
+	})
+
+	publish(parquetHook, "a", "x")
+	require.NoError(t, parquetHook.Stop())
+	require.Len(t, bucket.names(), 1)
+	require.Equal(t, 2, bucket.puts)
+}
+
+func TestWriteFailed(t *testing.T) {
+	bucket := newMemoryBucket()
+	bucket.errs = []error{errors.New("unavailable")}
+	parquetHook := newHook(t, Options{Bucket: bucket, Rules: []Rule{{Filter: "#", Table: "t"}}})
+
+	publish(parquetHook, "a", "x")
+	require.NoError(t, parquetHook.Stop())
+	require.Empty(t, bucket.names())
+	require.Equal(t, int64(1), parquetHook.Stats().Failed)
+}
+
+func TestWriteDir(t *testing.T) {
+	dir := t.TempDir()
+	parquetHook := newHook(t, Options{Bucket: snapshot.Dir(dir), Rules: []Rule{{Filter: "#", Table: "plant/t"}}})
+
+	publish(parquetHook, "a", "x")
+	require.NoError(t, parquetHook.Stop())
+
+	entries, err := os.ReadDir(dir + "/mqtt/plant/t")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestQueueFull(t *testing.T) {
+	bucket := newMemoryBucket()
+	bucket.block = make(chan struct{})
+	parquetHook := newHook(t, Options{
+		Bucket:    bucket,
+		Rules:     []Rule{{Filter: "#", Table: "t"}},
+		MaxRows:   1,
+		QueueSize: 1,
+	})
+
+	// the first row is being written, the second is queued, and the third is dropped
+	publish(parquetHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return parquetHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(parquetHook, "a", "2")
+	publish(parquetHook, "a", "3")
+	require.Equal(t, int64(1), parquetHook.Stats().Dropped)
+
+	close(bucket.block)
+	require.NoError(t, parquetHook.Stop())
+	require.Equal(t, Stats{Files: 2, Written: 2, Dropped: 1}, parquetHook.Stats())
+}
+
+func TestBuffer(t *testing.T) {
+	bucket := newMemoryBucket()
+	bucket.block = make(chan struct{})
+	options := Options{
+		Bucket:  bucket,
+		Rules:   []Rule{{Filter: "#", Table: "t"}},
+		MaxRows: 1,
+		Buffer:  &bridge.Buffer{Dir: t.TempDir()},
+	}
+	parquetHook := newHook(t, options)
+
+	// the first row is being written when the hook stops, and the second is kept in the buffer
+	publish(parquetHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return parquetHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(parquetHook, "b", "2")
+
+	stopped := make(chan error)
+	go func() { stopped <- parquetHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(bucket.block)
+	require.NoError(t, <-stopped)
+	require.Len(t, bucket.names(), 1)
+
+	// and is written with the same values once the hook is restarted
+	bucket = newMemoryBucket()
+	options.Bucket = bucket
+	parquetHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return len(bucket.names()) == 1
+	}, time.Second, time.Millisecond)
+
+	name := bucket.names()[0]
+	hour := time.Now().UTC().Truncate(time.Hour)
+	require.Contains(t, name, "/date="+hour.Format("2006-01-02")+"/hour="+hour.Format("15")+"/part-")
+	_, columns := decode(t, bucket.objects[name])
+	require.Equal(t, []any{"b"}, columns[1].values)
+	require.Equal(t, []any{"2"}, columns[4].values)
+}
@@ -0,0 +1,291 @@
+package parquet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// the values of columns. Columns may also have the value of a level of the topic, as level:N for its
+// Nth level, of a user property, as user:key, or of a field of a JSON payload, as json:path, where path
+// is the keys and array indexes of the field joined by dots, eg. json:readings.0.value
+const (
+	ValueTime        = "time"         // when the message was published, as a timestamp
+	ValueTopic       = "topic"        // the topic, as a string
+	ValueClient      = "client"       // the id of the publishing client, as a string
+	ValueQos         = "qos"          // the QoS, as an int32
+	ValueRetain      = "retain"       // the retain flag, as a bool
+	ValuePayload     = "payload"      // the payload, as bytes
+	ValueText        = "text"         // the payload, as a string
+	ValueContentType = "content_type" // the MQTT 5 content type, as a string
+	ValueProperties  = "properties"   // the user properties, as a string of a JSON object
+
+	prefixLevel = "level:"
+	prefixUser  = "user:"
+	prefixJSON  = "json:"
+)
+
+// Column is a column of the files of a rule, and the value of the message it is given. Kind is the
+// kind of values of levels, user properties and JSON fields, which defaults to KindString, and which
+// they are converted to if they can be, eg. KindDouble for a JSON number. Other values have the kinds
+// of their descriptions. Values which the message doesn't have, or which can't be converted, are null
+type Column struct {
+	Name  string `yaml:"name" json:"name"`
+	Value string `yaml:"value" json:"value"`
+	Kind  string `yaml:"kind" json:"kind"`
+}
+
+// DefaultColumns are the columns of rules without columns
+var DefaultColumns = []Column{
+	{Name: "time", Value: ValueTime},
+	{Name: "topic", Value: ValueTopic},
+	{Name: "client_id", Value: ValueClient},
+	{Name: "qos", Value: ValueQos},
+	{Name: "payload", Value: ValuePayload},
+	{Name: "properties", Value: ValueProperties},
+}
+
+// validate checks the filter, table and columns of the rule
+func (r Rule) validate() error {
+	if !mqtt.IsValidFilter(r.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Filter)
+	}
+
+	if r.Table == "" || path.Clean(r.Table) != r.Table || strings.HasPrefix(r.Table, "/") || strings.HasPrefix(r.Table, "..") {
+		return fmt.Errorf("has invalid table %q", r.Table)
+	}
+
+	names := map[string]bool{}
+	for _, c := range r.Columns {
+		if c.Name == "" {
+			return errors.New("has a column without a name")
+		}
+
+		if names[c.Name] {
+			return fmt.Errorf("has duplicate column %q", c.Name)
+		}
+		names[c.Name] = true
+
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("column %q %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the value and kind of the column
+func (c Column) validate() error {
+	switch c.Value {
+	case ValueTime, ValueTopic, ValueClient, ValueQos, ValueRetain, ValuePayload, ValueText, ValueContentType, ValueProperties:
+		if c.Kind != "" {
+			return fmt.Errorf("can't set the kind of value %q", c.Value)
+		}
+		return nil
+	}
+
+	switch c.Kind {
+	case "", KindString, KindInt64, KindDouble, KindBool:
+	default:
+		return fmt.Errorf("has invalid kind %q", c.Kind)
+	}
+
+	switch {
+	case strings.HasPrefix(c.Value, prefixLevel):
+		if n, err := strconv.Atoi(strings.TrimPrefix(c.Value, prefixLevel)); err != nil || n < 1 {
+			return fmt.Errorf("has invalid topic level %q", c.Value)
+		}
+		return nil
+	case strings.HasPrefix(c.Value, prefixUser) && len(c.Value) > len(prefixUser):
+		return nil
+	case strings.HasPrefix(c.Value, prefixJSON) && len(c.Value) > len(prefixJSON):
+		return nil
+	}
+	return fmt.Errorf("has invalid value %q", c.Value)
+}
+
+// kind returns the kind of the values of the column
+func (c Column) kind() string {
+	switch c.Value {
+	case ValueTime:
+		return KindTimestamp
+	case ValueQos:
+		return KindInt32
+	case ValueRetain:
+		return KindBool
+	case ValuePayload:
+		return KindBytes
+	case ValueTopic, ValueClient, ValueText, ValueContentType, ValueProperties:
+		return KindString
+	}
+
+	if c.Kind == "" {
+		return KindString
+	}
+	return c.Kind
+}
+
+// names returns the names of the columns of the rule
+func (r Rule) names() []string {
+	names := make([]string, len(r.Columns))
+	for i, c := range r.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// kinds returns the kinds of the columns of the rule
+func (r Rule) kinds() []string {
+	kinds := make([]string, len(r.Columns))
+	for i, c := range r.Columns {
+		kinds[i] = c.kind()
+	}
+	return kinds
+}
+
+// values returns the values of the columns of the rule for the message published by the client at the
+// time. The payload is decoded once if columns have JSON values
+func (r Rule) values(cl *mqtt.Client, pk packets.Packet, at time.Time) []any {
+	var doc any
+	decoded := false
+	values := make([]any, len(r.Columns))
+	for i, c := range r.Columns {
+		switch c.Value {
+		case ValueTime:
+			values[i] = at
+		case ValueTopic:
+			values[i] = pk.TopicName
+		case ValueClient:
+			values[i] = cl.ID
+		case ValueQos:
+			values[i] = int32(pk.FixedHeader.Qos)
+		case ValueRetain:
+			values[i] = pk.FixedHeader.Retain
+		case ValuePayload:
+			values[i] = pk.Payload
+		case ValueText:
+			values[i] = string(pk.Payload)
+		case ValueContentType:
+			if pk.Properties.ContentType != "" {
+				values[i] = pk.Properties.ContentType
+			}
+		case ValueProperties:
+			if len(pk.Properties.User) > 0 {
+				props := map[string]string{}
+				for _, p := range pk.Properties.User {
+					if _, ok := props[p.Key]; !ok {
+						props[p.Key] = p.Val // the first of repeated user properties is kept
+					}
+				}
+				b, _ := json.Marshal(props)
+				values[i] = string(b)
+			}
+		default:
+			var v any
+			switch {
+			case strings.HasPrefix(c.Value, prefixLevel):
+				n, _ := strconv.Atoi(strings.TrimPrefix(c.Value, prefixLevel))
+				if levels := strings.Split(pk.TopicName, "/"); n <= len(levels) {
+					v = levels[n-1]
+				}
+			case strings.HasPrefix(c.Value, prefixUser):
+				key := strings.TrimPrefix(c.Value, prefixUser)
+				for _, p := range pk.Properties.User {
+					if p.Key == key {
+						v = p.Val
+						break
+					}
+				}
+			case strings.HasPrefix(c.Value, prefixJSON):
+				if !decoded {
+					decoded = true
+					if json.Unmarshal(pk.Payload, &doc) != nil {
+						doc = nil
+					}
+				}
+				v = field(doc, strings.TrimPrefix(c.Value, prefixJSON))
+			}
+			values[i] = convert(v, c.kind())
+		}
+	}
+	return values
+}
+
+// convert returns the string, float64 or bool value as the kind, or nil if it can't be converted
+func convert(v any, kind string) any {
+	if v == nil {
+		return nil
+	}
+
+	switch kind {
+	case KindDouble:
+		switch v := v.(type) {
+		case float64:
+			return v
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f
+			}
+		}
+	case KindInt64:
+		switch v := v.(type) {
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+				return int64(v)
+			}
+		case string:
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return n
+			}
+		}
+	case KindBool:
+		switch v := v.(type) {
+		case bool:
+			return v
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b
+			}
+		}
+	default:
+		if s, ok := v.(string); ok {
+			return s
+		}
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return nil
+}
+
+// field returns the field of the document at the path, with objects and arrays as JSON strings, or
+// nil if the document has no such field
+func field(doc any, path string) any {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]any:
+			doc = v[key]
+		case []any:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(v) {
+				return nil
+			}
+			doc = v[n]
+		default:
+			return nil
+		}
+	}
+
+	switch doc.(type) {
+	case map[string]any, []any:
+		b, _ := json.Marshal(doc)
+		return string(b)
+	}
+	return doc
+}
@@ -0,0 +1,122 @@
+package parquet
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		rule        Rule
+		expectError bool
+	}{
+		{
+			name:        "Success - default columns",
+			rule:        Rule{Filter: "sensors/#", Table: "plant/readings", Columns: DefaultColumns},
+			expectError: false,
+		},
+		{
+			name:        "Success - kinds",
+			rule:        Rule{Filter: "#", Table: "t", Columns: []Column{{Name: "v", Value: "json:value", Kind: KindDouble}, {Name: "d", Value: "level:2"}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - invalid filter",
+			rule:        Rule{Filter: "a/#/b", Table: "t"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid table",
+			rule:        Rule{Filter: "#", Table: "../t"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - absolute table",
+			rule:        Rule{Filter: "#", Table: "/t"},
+			expectError: true,
+		},
+		{
+			name:        "Failure - duplicate column",
+			rule:        Rule{Filter: "#", Table: "t", Columns: []Column{{Name: "a", Value: ValueTopic}, {Name: "a", Value: ValueClient}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid value",
+			rule:        Rule{Filter: "#", Table: "t", Columns: []Column{{Name: "a", Value: "level:0"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - kind of fixed value",
+			rule:        Rule{Filter: "#", Table: "t", Columns: []Column{{Name: "a", Value: ValueTopic, Kind: KindDouble}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid kind",
+			rule:        Rule{Filter: "#", Table: "t", Columns: []Column{{Name: "a", Value: "user:x", Kind: KindTimestamp}}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate()
+			if tt.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRuleValues(t *testing.T) {
+	rule := Rule{Columns: []Column{
+		{Name: "time", Value: ValueTime},
+		{Name: "topic", Value: ValueTopic},
+		{Name: "client", Value: ValueClient},
+		{Name: "qos", Value: ValueQos},
+		{Name: "retain", Value: ValueRetain},
+		{Name: "payload", Value: ValuePayload},
+		{Name: "properties", Value: ValueProperties},
+		{Name: "device", Value: "level:2"},
+		{Name: "missing", Value: "level:5"},
+		{Name: "unit", Value: "user:unit"},
+		{Name: "temperature", Value: "json:temperature", Kind: KindDouble},
+		{Name: "count", Value: "json:count", Kind: KindInt64},
+		{Name: "ok", Value: "json:ok", Kind: KindBool},
+		{Name: "tags", Value: "json:tags"},
+		{Name: "bad", Value: "json:temperature", Kind: KindBool},
+	}}
+	require.Equal(t, []string{KindTimestamp, KindString, KindString, KindInt32, KindBool, KindBytes, KindString}, rule.kinds()[:7])
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	at := time.Now()
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1},
+		TopicName:   "sensors/d1/readings",
+		Payload:     []byte(`{"temperature":21.5,"count":3,"ok":true,"tags":["a"]}`),
+		Properties:  packets.Properties{User: []packets.UserProperty{{Key: "unit", Val: "C"}}},
+	}
+
+	values := rule.values(cl, pk, at)
+	require.Equal(t, []any{
+		at, "sensors/d1/readings", "c1", int32(1), false, pk.Payload, `{"unit":"C"}`,
+		"d1", nil, "C", 21.5, int64(3), true, `["a"]`, nil,
+	}, values)
+}
+
+func TestConvert(t *testing.T) {
+	require.Equal(t, 1.5, convert("1.5", KindDouble))
+	require.Nil(t, convert("x", KindDouble))
+	require.Equal(t, int64(42), convert("42", KindInt64))
+	require.Nil(t, convert(1.5, KindInt64))
+	require.Equal(t, true, convert("true", KindBool))
+	require.Equal(t, "21.5", convert(21.5, KindString))
+	require.Equal(t, "true", convert(true, KindString))
+	require.Nil(t, convert(nil, KindString))
+}
@@ -0,0 +1,327 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// magic starts and ends Parquet files
+const magic = "PAR1"
+
+// the compressions of pages
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// the physical types of Parquet
+const (
+	typeBoolean   int32 = 0
+	typeInt32     int32 = 1
+	typeInt64     int32 = 2
+	typeDouble    int32 = 5
+	typeByteArray int32 = 6
+)
+
+// the converted types of Parquet, which annotate physical types
+const (
+	convertedUTF8            int32 = 0
+	convertedTimestampMillis int32 = 9
+	convertedNone            int32 = -1
+)
+
+// the encodings and compression codecs of Parquet
+const (
+	encodingPlain int32 = 0
+	encodingRLE   int32 = 3
+	codecNone     int32 = 0
+	codecGzip     int32 = 2
+)
+
+// the types of fields of the thrift compact protocol
+const (
+	thriftI32    byte = 5
+	thriftI64    byte = 6
+	thriftBinary byte = 8
+	thriftList   byte = 9
+	thriftStruct byte = 12
+)
+
+// the kinds of values of columns, which are stored as Parquet types
+const (
+	KindString    = "string"    // a UTF-8 string
+	KindBytes     = "bytes"     // a byte array
+	KindInt32     = "int32"     // a 32 bit integer
+	KindInt64     = "int64"     // a 64 bit integer
+	KindDouble    = "double"    // a 64 bit float
+	KindBool      = "bool"      // a boolean
+	KindTimestamp = "timestamp" // a time, as milliseconds since the unix epoch in UTC
+)
+
+// physical returns the physical and converted type of the kind
+func physical(kind string) (int32, int32) {
+	switch kind {
+	case KindBytes:
+		return typeByteArray, convertedNone
+	case KindInt32:
+		return typeInt32, convertedNone
+	case KindInt64:
+		return typeInt64, convertedNone
+	case KindDouble:
+		return typeDouble, convertedNone
+	case KindBool:
+		return typeBoolean, convertedNone
+	case KindTimestamp:
+		return typeInt64, convertedTimestampMillis
+	}
+	return typeByteArray, convertedUTF8
+}
+
+// encode returns a Parquet file of the rows, whose values are those of the columns of the kinds, with
+// their pages compressed by the codec. The file has a single row group, with a data page for each
+// column, in which every column is optional so values may be nil
+func encode(names, kinds []string, rows [][]any, codec int32) []byte {
+	file := []byte(magic)
+	chunks := make([][]byte, len(names)) // the thrift ColumnChunk of each column
+	var totalSize int64
+
+	for c := range names {
+		levels, values := encodeColumn(kinds[c], rows, c)
+
+		page := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+		page = append(page, levels...)
+		page = append(page, values...)
+
+		compressed := page
+		if codec == codecGzip {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(page)
+			gz.Close()
+			compressed = buf.Bytes()
+		}
+
+		var header thriftWriter
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(compressed)))
+		header.structBegin(5)
+		header.i32(1, int32(len(rows)))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.structEnd()
+		header.stop()
+
+		offset := int64(len(file))
+		file = append(file, header.b...)
+		file = append(file, compressed...)
+		totalSize += int64(len(header.b) + len(page))
+
+		typ, _ := physical(kinds[c])
+		var chunk thriftWriter
+		chunk.i64(2, offset)
+		chunk.structBegin(3)
+		chunk.i32(1, typ)
+		chunk.listBegin(2, thriftI32, 2)
+		chunk.listI32(encodingPlain)
+		chunk.listI32(encodingRLE)
+		chunk.listBegin(3, thriftBinary, 1)
+		chunk.listBinary([]byte(names[c]))
+		chunk.i32(4, codec)
+		chunk.i64(5, int64(len(rows)))
+		chunk.i64(6, int64(len(header.b)+len(page)))
+		chunk.i64(7, int64(len(header.b)+len(compressed)))
+		chunk.i64(9, offset)
+		chunk.structEnd()
+		chunks[c] = chunk.b
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.listBegin(2, thriftStruct, len(names)+1)
+	meta.listStructBegin()
+	meta.binary(4, []byte("schema"))
+	meta.i32(5, int32(len(names)))
+	meta.structEnd()
+	for c, name := range names {
+		typ, converted := physical(kinds[c])
+		meta.listStructBegin()
+		meta.i32(1, typ)
+		meta.i32(3, 1) // OPTIONAL
+		meta.binary(4, []byte(name))
+		if converted != convertedNone {
+			meta.i32(6, converted)
+		}
+		meta.structEnd()
+	}
+	meta.i64(3, int64(len(rows)))
+	meta.listBegin(4, thriftStruct, 1)
+	meta.listStructBegin()
+	meta.listBegin(1, thriftStruct, len(chunks))
+	for _, chunk := range chunks {
+		meta.listStructBegin()
+		meta.b = append(meta.b, chunk...)
+		meta.structEnd()
+	}
+	meta.i64(2, totalSize)
+	meta.i64(3, int64(len(rows)))
+	meta.structEnd()
+	meta.binary(6, []byte("mochi-mqtt hooks"))
+	meta.stop()
+
+	file = append(file, meta.b...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(meta.b)))
+	return append(file, magic...)
+}
+
+// encodeColumn returns the definition levels of the values of the column of the rows, encoded as runs
+// of the RLE hybrid encoding, and its values which aren't nil in the plain encoding
+func encodeColumn(kind string, rows [][]any, c int) ([]byte, []byte) {
+	var levels, values []byte
+	var bits []bool
+	run, last := 0, false
+	for _, row := range rows {
+		v := row[c]
+		defined := v != nil
+		if run > 0 && defined != last {
+			levels = appendRun(levels, run, last)
+			run = 0
+		}
+		run++
+		last = defined
+
+		if !defined {
+			continue
+		}
+
+		switch kind {
+		case KindBool:
+			bits = append(bits, v.(bool))
+		case KindInt32:
+			values = binary.LittleEndian.AppendUint32(values, uint32(v.(int32)))
+		case KindInt64:
+			values = binary.LittleEndian.AppendUint64(values, uint64(v.(int64)))
+		case KindDouble:
+			values = binary.LittleEndian.AppendUint64(values, math.Float64bits(v.(float64)))
+		case KindTimestamp:
+			values = binary.LittleEndian.AppendUint64(values, uint64(v.(time.Time).UnixMilli()))
+		case KindBytes:
+			b := v.([]byte)
+			values = binary.LittleEndian.AppendUint32(values, uint32(len(b)))
+			values = append(values, b...)
+		default:
+			s := v.(string)
+			values = binary.LittleEndian.AppendUint32(values, uint32(len(s)))
+			values = append(values, s...)
+		}
+	}
+
+	if run > 0 {
+		levels = appendRun(levels, run, last)
+	}
+
+	if kind == KindBool {
+		values = make([]byte, (len(bits)+7)/8)
+		for i, bit := range bits {
+			if bit {
+				values[i/8] |= 1 << (i % 8)
+			}
+		}
+	}
+	return levels, values
+}
+
+// appendRun appends a run of n definition levels, which are 1 for defined values and 0 for nil, as an
+// RLE run of the RLE hybrid encoding with a bit width of 1
+func appendRun(b []byte, n int, defined bool) []byte {
+	b = binary.AppendUvarint(b, uint64(n)<<1)
+	if defined {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// thriftWriter writes structs in the thrift compact protocol, as Parquet metadata is
+type thriftWriter struct {
+	b    []byte
+	last []int16 // the id of the last field of each struct being written
+}
+
+// field writes the header of the field with the id and type
+func (w *thriftWriter) field(id int16, typ byte) {
+	var last int16
+	if n := len(w.last); n > 0 {
+		last = w.last[n-1]
+		w.last[n-1] = id
+	} else {
+		w.last = append(w.last, id)
+	}
+
+	if delta := id - last; delta > 0 && delta <= 15 {
+		w.b = append(w.b, byte(delta)<<4|typ)
+		return
+	}
+	w.b = append(w.b, typ)
+	w.b = binary.AppendVarint(w.b, int64(id))
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.b = binary.AppendVarint(w.b, int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.b = binary.AppendVarint(w.b, v)
+}
+
+func (w *thriftWriter) binary(id int16, v []byte) {
+	w.field(id, thriftBinary)
+	w.listBinary(v)
+}
+
+// structBegin starts the struct field with the id, whose fields are written until structEnd
+func (w *thriftWriter) structBegin(id int16) {
+	w.field(id, thriftStruct)
+	w.last = append(w.last, 0)
+}
+
+// structEnd ends the struct being written
+func (w *thriftWriter) structEnd() {
+	w.stop()
+	w.last = w.last[:len(w.last)-1]
+}
+
+// stop ends the outermost struct
+func (w *thriftWriter) stop() {
+	w.b = append(w.b, 0)
+}
+
+// listBegin starts the list field with the id, whose n elements of the type are written next
+func (w *thriftWriter) listBegin(id int16, typ byte, n int) {
+	w.field(id, thriftList)
+	if n < 15 {
+		w.b = append(w.b, byte(n)<<4|typ)
+		return
+	}
+	w.b = append(w.b, 0xf0|typ)
+	w.b = binary.AppendUvarint(w.b, uint64(n))
+}
+
+// listStructBegin starts a struct element of a list, which is ended by structEnd
+func (w *thriftWriter) listStructBegin() {
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) listI32(v int32) {
+	w.b = binary.AppendVarint(w.b, int64(v))
+}
+
+func (w *thriftWriter) listBinary(v []byte) {
+	w.b = binary.AppendUvarint(w.b, uint64(len(v)))
+	w.b = append(w.b, v...)
+}
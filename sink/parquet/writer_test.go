@@ -0,0 +1,226 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// thriftReader reads the thrift compact protocol into maps of field ids to values, which are int64s,
+// []byte, []any lists and nested maps
+type thriftReader struct {
+	b []byte
+}
+
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n := r.uvarint()
+		v := r.b[:n]
+		r.b = r.b[n:]
+		return v
+	case thriftList:
+		header := r.b[0]
+		r.b = r.b[1:]
+		n := int(header >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.readStruct()
+	}
+	panic("unexpected thrift type")
+}
+
+func (r *thriftReader) readStruct() map[int16]any {
+	fields := map[int16]any{}
+	var id int16
+	for {
+		header := r.b[0]
+		r.b = r.b[1:]
+		if header == 0 {
+			return fields
+		}
+
+		if delta := header >> 4; delta != 0 {
+			id += int16(delta)
+		} else {
+			id = int16(r.varint())
+		}
+		fields[id] = r.value(header & 0x0f)
+	}
+}
+
+// column is a decoded column of a file
+type column struct {
+	name     string
+	typ      int64
+	values   []any
+	metadata map[int16]any
+}
+
+// decode decodes the columns of a file written by encode
+func decode(t *testing.T, file []byte) (int64, []column) {
+	t.Helper()
+
+	require.Equal(t, magic, string(file[:4]))
+	require.Equal(t, magic, string(file[len(file)-4:]))
+	size := binary.LittleEndian.Uint32(file[len(file)-8:])
+	meta := (&thriftReader{b: file[len(file)-8-int(size) : len(file)-8]}).readStruct()
+
+	schema := meta[2].([]any)
+	require.Equal(t, "schema", string(schema[0].(map[int16]any)[4].([]byte)))
+	rowGroups := meta[4].([]any)
+	require.Len(t, rowGroups, 1)
+	chunks := rowGroups[0].(map[int16]any)[1].([]any)
+	require.Len(t, chunks, len(schema)-1)
+
+	var columns []column
+	for i, c := range chunks {
+		element := schema[i+1].(map[int16]any)
+		md := c.(map[int16]any)[3].(map[int16]any)
+		col := column{name: string(element[4].([]byte)), typ: element[1].(int64), metadata: md}
+		require.Equal(t, col.name, string(md[3].([]any)[0].([]byte)))
+
+		r := &thriftReader{b: file[md[9].(int64):]}
+		header := r.readStruct()
+		page := r.b[:header[3].(int64)]
+		if md[4].(int64) == int64(codecGzip) {
+			gz, err := gzip.NewReader(bytes.NewReader(page))
+			require.NoError(t, err)
+			page, err = io.ReadAll(gz)
+			require.NoError(t, err)
+		}
+		require.Len(t, page, int(header[2].(int64)))
+
+		n := int(header[5].(map[int16]any)[1].(int64))
+		levelsSize := binary.LittleEndian.Uint32(page)
+		levels := &thriftReader{b: page[4 : 4+levelsSize]}
+		values := page[4+levelsSize:]
+
+		var defined []bool
+		for len(defined) < n {
+			run := int(levels.uvarint() >> 1)
+			bit := levels.b[0] == 1
+			levels.b = levels.b[1:]
+			for j := 0; j < run; j++ {
+				defined = append(defined, bit)
+			}
+		}
+
+		bit := 0
+		for _, d := range defined {
+			if !d {
+				col.values = append(col.values, nil)
+				continue
+			}
+
+			switch col.typ {
+			case int64(typeBoolean):
+				col.values = append(col.values, values[bit/8]&(1<<(bit%8)) != 0)
+				bit++
+			case int64(typeInt32):
+				col.values = append(col.values, int32(binary.LittleEndian.Uint32(values)))
+				values = values[4:]
+			case int64(typeInt64):
+				col.values = append(col.values, int64(binary.LittleEndian.Uint64(values)))
+				values = values[8:]
+			case int64(typeDouble):
+				col.values = append(col.values, math.Float64frombits(binary.LittleEndian.Uint64(values)))
+				values = values[8:]
+			case int64(typeByteArray):
+				l := binary.LittleEndian.Uint32(values)
+				col.values = append(col.values, string(values[4:4+l]))
+				values = values[4+l:]
+			}
+		}
+		columns = append(columns, col)
+	}
+	return meta[3].(int64), columns
+}
+
+func TestEncode(t *testing.T) {
+	at := time.UnixMilli(1704110400123)
+	names := []string{"time", "topic", "qos", "retain", "payload", "value", "count"}
+	kinds := []string{KindTimestamp, KindString, KindInt32, KindBool, KindBytes, KindDouble, KindInt64}
+	rows := [][]any{
+		{at, "sensors/1", int32(1), true, []byte{0xff}, 21.5, int64(3)},
+		{at, "sensors/2", int32(0), false, []byte("on"), nil, nil},
+		{at, "sensors/3", int32(2), true, []byte{}, -1.25, int64(-7)},
+	}
+
+	for _, codec := range []int32{codecNone, codecGzip} {
+		n, columns := decode(t, encode(names, kinds, rows, codec))
+		require.Equal(t, int64(3), n)
+		require.Len(t, columns, len(names))
+
+		require.Equal(t, "time", columns[0].name)
+		require.Equal(t, []any{at.UnixMilli(), at.UnixMilli(), at.UnixMilli()}, columns[0].values)
+		require.Equal(t, []any{"sensors/1", "sensors/2", "sensors/3"}, columns[1].values)
+		require.Equal(t, []any{int32(1), int32(0), int32(2)}, columns[2].values)
+		require.Equal(t, []any{true, false, true}, columns[3].values)
+		require.Equal(t, []any{"\xff", "on", ""}, columns[4].values)
+		require.Equal(t, []any{21.5, nil, -1.25}, columns[5].values)
+		require.Equal(t, []any{int64(3), nil, int64(-7)}, columns[6].values)
+		require.Equal(t, int64(codec), columns[0].metadata[4])
+	}
+}
+
+func TestEncodeManyColumns(t *testing.T) {
+	var names, kinds []string
+	row := []any{}
+	for i := 0; i < 20; i++ {
+		names = append(names, string(rune('a'+i)))
+		kinds = append(kinds, KindString)
+		row = append(row, string(rune('A'+i)))
+	}
+
+	_, columns := decode(t, encode(names, kinds, [][]any{row}, codecNone))
+	require.Len(t, columns, 20)
+	require.Equal(t, "t", columns[19].name)
+	require.Equal(t, []any{"T"}, columns[19].values)
+}
+
+func TestSchemaTypes(t *testing.T) {
+	names := []string{"time", "topic", "payload"}
+	file := encode(names, []string{KindTimestamp, KindString, KindBytes}, [][]any{{time.Now(), "a", []byte("b")}}, codecNone)
+
+	size := binary.LittleEndian.Uint32(file[len(file)-8:])
+	meta := (&thriftReader{b: file[len(file)-8-int(size) : len(file)-8]}).readStruct()
+	schema := meta[2].([]any)
+
+	require.Equal(t, int64(len(names)), schema[0].(map[int16]any)[5])
+	require.Equal(t, int64(convertedTimestampMillis), schema[1].(map[int16]any)[6])
+	require.Equal(t, int64(convertedUTF8), schema[2].(map[int16]any)[6])
+	require.NotContains(t, schema[3].(map[int16]any), int16(6))
+	require.Equal(t, int64(1), schema[3].(map[int16]any)[3]) // optional
+}
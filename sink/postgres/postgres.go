@@ -0,0 +1,291 @@
+// Package postgres provides a sink hook inserting the messages published to matching MQTT topics into
+// PostgreSQL tables, such as TimescaleDB hypertables, in batches copied with the COPY protocol, so
+// telemetry can be queried with SQL without a separate ingestion service.
+//
+// Rows are copied through a Copier, which is a thin adapter of the Postgres client of the application,
+// eg. for pgx:
+//
+//	type copier struct{ *pgxpool.Pool }
+//
+//	func (c copier) CopyFrom(ctx context.Context, table, columns []string, rows [][]any) (int64, error) {
+//		return c.Pool.CopyFrom(ctx, pgx.Identifier(table), columns, pgx.CopyFromRows(rows))
+//	}
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// Copier copies rows into a table, usually a thin adapter of a Postgres client
+type Copier interface {
+	// CopyFrom copies the rows, whose values are in the order of the columns, into the table, which is
+	// its schema and name or only its name, returning how many rows were copied
+	CopyFrom(ctx context.Context, table []string, columns []string, rows [][]any) (int64, error)
+}
+
+// Rule inserts the messages of the MQTT topics matching Filter, which may contain +/# wildcards, into
+// Table, which may be qualified by its schema, eg. "telemetry.readings". Columns map the message to the
+// columns of the table, and default to DefaultColumns. Where is an optional filter expression (see
+// pkg/filter) messages must also match, eg. "json.temperature > 30"
+type Rule struct {
+	Filter  string   `yaml:"filter" json:"filter"`
+	Where   string   `yaml:"where" json:"where"`
+	Table   string   `yaml:"table" json:"table"`
+	Columns []Column `yaml:"columns" json:"columns"`
+}
+
+// DefaultColumns are the columns of rules without columns, for a table such as
+//
+//	CREATE TABLE mqtt_messages (
+//		time      TIMESTAMPTZ NOT NULL,
+//		topic     TEXT NOT NULL,
+//		client_id TEXT NOT NULL,
+//		payload   BYTEA
+//	);
+//	SELECT create_hypertable('mqtt_messages', 'time');
+var DefaultColumns = []Column{
+	{Name: "time", Value: ValueTime},
+	{Name: "topic", Value: ValueTopic},
+	{Name: "client_id", Value: ValueClient},
+	{Name: "payload", Value: ValuePayload},
+}
+
+// Metrics are called as rows are inserted. Unset funcs are skipped
+type Metrics struct {
+	// Inserted is called after rows have been copied into a table, with how long copying them took
+	Inserted func(table string, rows int, took time.Duration)
+
+	// Failed is called after rows could not be copied, and are discarded
+	Failed func(table string, rows int, err error)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+}
+
+// Stats are the totals of the rows inserted since the hook was initialized
+type Stats struct {
+	Batches  int64 // the number of batches copied, or which failed
+	Inserted int64 // the number of rows copied
+	Failed   int64 // the number of rows which could not be copied
+	Dropped  int64 // the number of messages discarded as the queue was full
+}
+
+// Hook is a hook that inserts messages into Postgres tables
+type Hook struct {
+	config  Options
+	tables  [][]string // the identifiers of the tables of the rules
+	bridge  *bridge.Bridge[bridge.Message]
+	stopped atomic.Bool
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the postgres sink hook
+type Options struct {
+	// Copier copies the rows into the tables
+	Copier Copier
+
+	// Rules map MQTT topics to tables, and the first whose filter matches the topic of a message
+	// applies. Messages matching no rule aren't inserted
+	Rules []Rule
+
+	// BatchSize is how many rows of a table are copied at once, defaults to 1000, and a batch is copied
+	// once it is full or its first row has waited for Linger, which defaults to 1 second
+	BatchSize int
+	Linger    time.Duration
+
+	Timeout time.Duration // how long copying a batch may take, defaults to 10 seconds
+
+	// QueueSize is how many rows wait to be copied, defaults to 10000. Messages published while the
+	// queue is full, eg. because the database is unavailable, wait for up to Block for room, and are
+	// then dropped by the Drop policy, which defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Server publishes a bridge.Warning to $SYS/bridges/postgres/dropped when messages are dropped, if
+	// set
+	Server *mqtt.Server
+
+	// Buffer queues rows on disk rather than in memory if it is set, so the rows which haven't been
+	// copied survive restarts of the broker and long outages of the database
+	Buffer *bridge.Buffer
+
+	// Retry retries batches which fail, and must limit the attempts or the time spent. Batches are
+	// copied once if it is nil
+	Retry *retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "postgres-sink-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts inserting messages
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	postgresHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if postgresHookConfig.Copier == nil {
+		return errors.New("copier is required")
+	}
+
+	if len(postgresHookConfig.Rules) == 0 {
+		return errors.New("at least one rule is required")
+	}
+
+	tables := make([][]string, len(postgresHookConfig.Rules))
+	for i, rule := range postgresHookConfig.Rules {
+		if len(rule.Columns) == 0 {
+			postgresHookConfig.Rules[i].Columns = DefaultColumns
+		}
+
+		if err := postgresHookConfig.Rules[i].validate(); err != nil {
+			return fmt.Errorf("rule %d %w", i, err)
+		}
+		tables[i] = strings.Split(rule.Table, ".")
+	}
+
+	if postgresHookConfig.Retry != nil && postgresHookConfig.Retry.MaxAttempts == 0 && postgresHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	if postgresHookConfig.BatchSize <= 0 {
+		postgresHookConfig.BatchSize = 1000
+	}
+
+	if postgresHookConfig.Linger <= 0 {
+		postgresHookConfig.Linger = time.Second
+	}
+
+	if postgresHookConfig.Timeout <= 0 {
+		postgresHookConfig.Timeout = 10 * time.Second
+	}
+
+	if postgresHookConfig.QueueSize <= 0 {
+		postgresHookConfig.QueueSize = 10000
+	}
+
+	h.config = postgresHookConfig
+	h.tables = tables
+
+	filters := make([]string, len(postgresHookConfig.Rules))
+	where := make([]string, len(postgresHookConfig.Rules))
+	for i, rule := range postgresHookConfig.Rules {
+		filters[i], where[i] = rule.Filter, rule.Where
+	}
+
+	var err error
+	h.bridge, err = bridge.New[bridge.Message](sink{h}, bridge.Options{
+		Filters:   filters,
+		Where:     where,
+		BatchSize: postgresHookConfig.BatchSize,
+		Linger:    postgresHookConfig.Linger,
+		Timeout:   postgresHookConfig.Timeout,
+		QueueSize: postgresHookConfig.QueueSize,
+		Block:     postgresHookConfig.Block,
+		Drop:      postgresHookConfig.Drop,
+		Server:    postgresHookConfig.Server,
+		Name:      "postgres",
+		Buffer:    postgresHookConfig.Buffer,
+		Retry:     postgresHookConfig.Retry,
+		Metrics:   h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// Stop inserts the queued rows
+func (h *Hook) Stop() error {
+	if h.bridge == nil || h.stopped.Swap(true) {
+		return nil
+	}
+
+	return h.bridge.Close()
+}
+
+// Stats returns the totals of the rows inserted so far
+func (h *Hook) Stats() Stats {
+	if h.bridge == nil {
+		return Stats{}
+	}
+
+	stats := h.bridge.Stats()
+	return Stats{Batches: stats.Batches, Inserted: stats.Sent, Failed: stats.Failed, Dropped: stats.Dropped}
+}
+
+// OnPublished is called when a client has published a message, and queues its row if a rule matches
+// its topic
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook with the tables of the routes
+func (h *Hook) metrics() bridge.Metrics {
+	var m bridge.Metrics
+	if h.config.Metrics.Inserted != nil {
+		m.Sent = func(route, rows int, took time.Duration) {
+			h.config.Metrics.Inserted(h.config.Rules[route].Table, rows, took)
+		}
+	}
+
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, rows int, err error) {
+			h.config.Metrics.Failed(h.config.Rules[route].Table, rows, err)
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// sink queues the messages of the bridge of the hook, and copies their rows
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the message published by the client, whose row is made once it is copied
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (bridge.Message, error) {
+	return bridge.NewMessage(cl, pk, time.Now()), nil
+}
+
+// Send copies the rows of the messages into the table of the rule of the route
+func (s sink) Send(ctx context.Context, route int, msgs []bridge.Message) error {
+	rule := s.h.config.Rules[route]
+	rows := make([][]any, len(msgs))
+	for i, msg := range msgs {
+		rows[i] = rule.values(msg.Client(), msg.Packet(), msg.Time)
+	}
+
+	_, err := s.h.config.Copier.CopyFrom(ctx, s.h.tables[route], rule.names(), rows)
+	return err
+}
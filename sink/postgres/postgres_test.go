@@ -0,0 +1,313 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// fakeCopier records the rows it copies into each table
+type fakeCopier struct {
+	tables  map[string][][]any
+	columns map[string][]string
+	errs    []error       // returned by the next copies
+	block   chan struct{} // copies wait for it to be closed, if set
+	mu      sync.Mutex
+}
+
+func newFakeCopier() *fakeCopier {
+	return &fakeCopier{
+		tables:  map[string][][]any{},
+		columns: map[string][]string{},
+	}
+}
+
+func (c *fakeCopier) CopyFrom(ctx context.Context, table []string, columns []string, rows [][]any) (int64, error) {
+	if c.block != nil {
+		<-c.block
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	name := strings.Join(table, ".")
+	c.tables[name] = append(c.tables[name], rows...)
+	c.columns[name] = columns
+	return int64(len(rows)), nil
+}
+
+func (c *fakeCopier) rows(table string) [][]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tables[table]
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	postgresHook := new(Hook)
+	postgresHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, postgresHook.Init(options))
+	t.Cleanup(func() { postgresHook.Stop() })
+	return postgresHook
+}
+
+func publish(h *Hook, topic, payload string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(payload)})
+}
+
+func TestID(t *testing.T) {
+	postgresHook := new(Hook)
+
+	require.Equal(t, "postgres-sink-hook", postgresHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	postgresHook := new(Hook)
+
+	require.True(t, postgresHook.Provides(mqtt.OnPublished))
+	require.False(t, postgresHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	rules := []Rule{{Filter: "#", Table: "mqtt_messages"}}
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - default columns",
+			config:      Options{Copier: newFakeCopier(), Rules: rules},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no copier",
+			config:      Options{Rules: rules},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no rules",
+			config:      Options{Copier: newFakeCopier()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid rule",
+			config:      Options{Copier: newFakeCopier(), Rules: []Rule{{Filter: "#", Table: "a.b.c"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Copier: newFakeCopier(), Rules: rules, Retry: &retry.Policy{}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			postgresHook := new(Hook)
+			postgresHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := postgresHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, DefaultColumns, postgresHook.config.Rules[0].Columns)
+				require.Equal(t, 1000, postgresHook.config.BatchSize)
+				require.Equal(t, time.Second, postgresHook.config.Linger)
+				require.NoError(t, postgresHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestBatches(t *testing.T) {
+	copier := newFakeCopier()
+	var inserted int
+	postgresHook := newHook(t, Options{
+		Copier: copier,
+		Rules: []Rule{
+			{
+				Filter: "sensors/+/readings",
+				Table:  "telemetry.readings",
+				Columns: []Column{
+					{Name: "device", Value: "level:2"},
+					{Name: "temperature", Value: "json:temperature"},
+				},
+			},
+			{Filter: "sensors/#", Table: "mqtt_messages"},
+		},
+		BatchSize: 2,
+		Linger:    time.Hour,
+		Metrics: Metrics{
+			Inserted: func(table string, rows int, took time.Duration) { inserted += rows },
+		},
+	})
+
+	// batches are copied into each table once they are full
+	publish(postgresHook, "sensors/s1/readings", `{"temperature":21.5}`)
+	publish(postgresHook, "sensors/s2/readings", `{"humidity":40}`)
+	publish(postgresHook, "sensors/s1/status", "online")
+	publish(postgresHook, "other", "ignored")
+	require.Eventually(t, func() bool {
+		return len(copier.rows("telemetry.readings")) == 2
+	}, time.Second, time.Millisecond)
+
+	require.Equal(t, [][]any{{"s1", 21.5}, {"s2", nil}}, copier.rows("telemetry.readings"))
+	require.Empty(t, copier.rows("mqtt_messages"))
+
+	// the other batches are copied when the hook stops
+	require.NoError(t, postgresHook.Stop())
+	rows := copier.rows("mqtt_messages")
+	require.Len(t, rows, 1)
+	require.Equal(t, []string{"time", "topic", "client_id", "payload"}, copier.columns["mqtt_messages"])
+	require.Equal(t, []any{"sensors/s1/status", "c1", []byte("online")}, rows[0][1:])
+	require.Equal(t, 3, inserted)
+	require.Equal(t, Stats{Batches: 2, Inserted: 3}, postgresHook.Stats())
+
+	// messages published once the hook has stopped are ignored
+	publish(postgresHook, "sensors/s1/status", "offline")
+	require.NoError(t, postgresHook.Stop())
+}
+
+func TestRetry(t *testing.T) {
+	copier := newFakeCopier()
+	copier.errs = []error{errors.New("connection reset")}
+	postgresHook := newHook(t, Options{
+		Copier: copier,
+		Rules:  []Rule{{Filter: "#", Table: "mqtt_messages"}},
+		Linger: time.Hour,
+		Retry:  &retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+	})
+
+	// the failed batch is copied again
+	publish(postgresHook, "a", "1")
+	publish(postgresHook, "b", "2")
+	require.NoError(t, postgresHook.Stop())
+
+	require.Len(t, copier.rows("mqtt_messages"), 2)
+	require.Equal(t, Stats{Batches: 1, Inserted: 2}, postgresHook.Stats())
+}
+
+func TestFailure(t *testing.T) {
+	copier := newFakeCopier()
+	copier.errs = []error{errors.New(`relation "mqtt_messages" does not exist`)}
+	var failed int
+	postgresHook := newHook(t, Options{
+		Copier: copier,
+		Rules:  []Rule{{Filter: "#", Table: "mqtt_messages"}},
+		Linger: time.Hour,
+		Metrics: Metrics{
+			Failed: func(table string, rows int, err error) { failed += rows },
+		},
+	})
+
+	// without a retry policy, the rows of a failed batch are discarded
+	publish(postgresHook, "a", "1")
+	publish(postgresHook, "b", "2")
+	require.NoError(t, postgresHook.Stop())
+
+	require.Equal(t, 2, failed)
+	require.Empty(t, copier.rows("mqtt_messages"))
+	require.Equal(t, Stats{Batches: 1, Failed: 2}, postgresHook.Stats())
+}
+
+func TestQueueFull(t *testing.T) {
+	copier := newFakeCopier()
+	copier.block = make(chan struct{})
+	var dropped int
+	postgresHook := newHook(t, Options{
+		Copier:    copier,
+		Rules:     []Rule{{Filter: "#", Table: "mqtt_messages"}},
+		Linger:    time.Millisecond,
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// the first row is being copied, the second is queued, and the third is dropped
+	publish(postgresHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return postgresHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	publish(postgresHook, "b", "2")
+	publish(postgresHook, "c", "3")
+	require.Equal(t, 1, dropped)
+
+	close(copier.block)
+	require.NoError(t, postgresHook.Stop())
+	require.Equal(t, Stats{Batches: 2, Inserted: 2, Dropped: 1}, postgresHook.Stats())
+}
+
+func TestBuffer(t *testing.T) {
+	copier := newFakeCopier()
+	copier.block = make(chan struct{})
+	options := Options{
+		Copier:    copier,
+		Rules:     []Rule{{Filter: "#", Table: "mqtt_messages"}},
+		BatchSize: 1,
+		Buffer:    &bridge.Buffer{Dir: t.TempDir()},
+	}
+	postgresHook := newHook(t, options)
+
+	// the first row is being copied when the hook stops, and the second is kept in the buffer
+	publish(postgresHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return postgresHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	publish(postgresHook, "b", "2")
+
+	stopped := make(chan error)
+	go func() { stopped <- postgresHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(copier.block)
+	require.NoError(t, <-stopped)
+	require.Len(t, copier.rows("mqtt_messages"), 1)
+
+	// and is copied with the same values once the hook is restarted
+	copier = newFakeCopier()
+	options.Copier = copier
+	postgresHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return len(copier.rows("mqtt_messages")) == 1
+	}, time.Second, time.Millisecond)
+	row := copier.rows("mqtt_messages")[0]
+	require.IsType(t, time.Time{}, row[0])
+	require.Equal(t, []any{"b", "c1", []byte("2")}, row[1:])
+}
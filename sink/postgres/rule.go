@@ -0,0 +1,183 @@
+package postgres
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// the values of columns. Columns may also have the value of a level of the topic, as level:N for its
+// Nth level, of a user property, as user:key, or of a field of a JSON payload, as json:path, where path
+// is the keys and array indexes of the field joined by dots, eg. json:readings.0.value
+const (
+	ValueTime        = "time"         // when the message was published, as a time.Time
+	ValueTopic       = "topic"        // the topic, as a string
+	ValueClient      = "client"       // the id of the publishing client, as a string
+	ValueQos         = "qos"          // the QoS, as an int16
+	ValueRetain      = "retain"       // the retain flag, as a bool
+	ValuePayload     = "payload"      // the payload, as a []byte for bytea columns
+	ValueText        = "text"         // the payload, as a string for text columns
+	ValueJSON        = "json"         // the payload if it is JSON, as a string for json and jsonb columns
+	ValueContentType = "content_type" // the MQTT 5 content type, as a string
+
+	prefixLevel = "level:"
+	prefixUser  = "user:"
+	prefixJSON  = "json:"
+)
+
+// Column is a column of a table, and the value of the message it is given. Values which the message
+// doesn't have, such as a missing user property or JSON field, are NULL
+type Column struct {
+	Name  string `yaml:"name" json:"name"`
+	Value string `yaml:"value" json:"value"`
+}
+
+// validate checks the filter, table and columns of the rule
+func (r Rule) validate() error {
+	if !mqtt.IsValidFilter(r.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", r.Filter)
+	}
+
+	parts := strings.Split(r.Table, ".")
+	if len(parts) > 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+		return fmt.Errorf("has invalid table %q", r.Table)
+	}
+
+	names := map[string]bool{}
+	for _, c := range r.Columns {
+		if c.Name == "" {
+			return errors.New("has a column without a name")
+		}
+
+		if names[c.Name] {
+			return fmt.Errorf("has duplicate column %q", c.Name)
+		}
+		names[c.Name] = true
+
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("column %q %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the value of the column
+func (c Column) validate() error {
+	switch c.Value {
+	case ValueTime, ValueTopic, ValueClient, ValueQos, ValueRetain, ValuePayload, ValueText, ValueJSON, ValueContentType:
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(c.Value, prefixLevel):
+		if n, err := strconv.Atoi(strings.TrimPrefix(c.Value, prefixLevel)); err != nil || n < 1 {
+			return fmt.Errorf("has invalid topic level %q", c.Value)
+		}
+		return nil
+	case strings.HasPrefix(c.Value, prefixUser) && len(c.Value) > len(prefixUser):
+		return nil
+	case strings.HasPrefix(c.Value, prefixJSON) && len(c.Value) > len(prefixJSON):
+		return nil
+	}
+	return fmt.Errorf("has invalid value %q", c.Value)
+}
+
+// names returns the names of the columns of the rule
+func (r Rule) names() []string {
+	names := make([]string, len(r.Columns))
+	for i, c := range r.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// values returns the values of the columns of the rule for the message published by the client at the
+// time. The payload is decoded once if columns have JSON values
+func (r Rule) values(cl *mqtt.Client, pk packets.Packet, at time.Time) []any {
+	var doc any
+	decoded := false
+	values := make([]any, len(r.Columns))
+	for i, c := range r.Columns {
+		switch c.Value {
+		case ValueTime:
+			values[i] = at
+		case ValueTopic:
+			values[i] = pk.TopicName
+		case ValueClient:
+			values[i] = cl.ID
+		case ValueQos:
+			values[i] = int16(pk.FixedHeader.Qos)
+		case ValueRetain:
+			values[i] = pk.FixedHeader.Retain
+		case ValuePayload:
+			values[i] = pk.Payload
+		case ValueText:
+			values[i] = string(pk.Payload)
+		case ValueJSON:
+			if json.Valid(pk.Payload) {
+				values[i] = string(pk.Payload)
+			}
+		case ValueContentType:
+			if pk.Properties.ContentType != "" {
+				values[i] = pk.Properties.ContentType
+			}
+		default:
+			switch {
+			case strings.HasPrefix(c.Value, prefixLevel):
+				n, _ := strconv.Atoi(strings.TrimPrefix(c.Value, prefixLevel))
+				if levels := strings.Split(pk.TopicName, "/"); n <= len(levels) {
+					values[i] = levels[n-1]
+				}
+			case strings.HasPrefix(c.Value, prefixUser):
+				key := strings.TrimPrefix(c.Value, prefixUser)
+				for _, p := range pk.Properties.User {
+					if p.Key == key {
+						values[i] = p.Val
+						break
+					}
+				}
+			case strings.HasPrefix(c.Value, prefixJSON):
+				if !decoded {
+					decoded = true
+					if json.Unmarshal(pk.Payload, &doc) != nil {
+						doc = nil
+					}
+				}
+				values[i] = field(doc, strings.TrimPrefix(c.Value, prefixJSON))
+			}
+		}
+	}
+	return values
+}
+
+// field returns the field of the document at the path, with objects and arrays as JSON strings, or
+// nil if the document has no such field
+func field(doc any, path string) any {
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]any:
+			doc = v[key]
+		case []any:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(v) {
+				return nil
+			}
+			doc = v[n]
+		default:
+			return nil
+		}
+	}
+
+	switch doc.(type) {
+	case map[string]any, []any:
+		b, _ := json.Marshal(doc)
+		return string(b)
+	}
+	return doc
+}
@@ -0,0 +1,176 @@
+package sample
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/cache"
+)
+
+// buckets is how many parts clients are hashed into, so percentages have a precision of 0.0001%
+const buckets = 1000000
+
+// Hook is a hook that forwards a sample of the messages published to the broker to a wrapped sink
+// hook, eg. to keep the costs of analytics bounded on high-volume brokers
+type Hook struct {
+	config  Options
+	counts  *cache.Cache[string, int] // the messages of each topic, when sampling 1 in Every
+	stats   Stats
+	mu      sync.Mutex // guards counts
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// Stats are the totals of the messages sampled since the hook was initialized
+type Stats struct {
+	Forwarded int64 // the number of messages forwarded to the wrapped hook
+	Skipped   int64 // the number of messages which weren't sampled
+}
+
+// Options is a struct that contains all the information required to configure the sample hook
+type Options struct {
+	// Hook is the wrapped sink hook, initialized with Config, which is given the published messages
+	// which are sampled. It is initialized and stopped by the sample hook, so must not also be added
+	// to the server
+	Hook   mqtt.Hook
+	Config any
+
+	// Percent forwards that percentage of the messages, chosen at random, and Every forwards 1 in
+	// Every messages of each topic. One of them is required
+	Percent float64
+	Every   int
+
+	// ByClient samples the publishing clients rather than their messages, so all the messages of a
+	// sampled client are forwarded, and the same clients are sampled over time. Clients are chosen
+	// by the hash of their id and Seed, which changes the clients chosen
+	ByClient bool
+	Seed     string
+
+	// MaxTopics is how many topics are counted when sampling 1 in Every messages, defaults to 100000.
+	// The least recently published topics start over once more are
+	MaxTopics int
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "sample-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook, which the wrapped hook must also
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b}) && h.config.Hook != nil && h.config.Hook.Provides(b)
+}
+
+// Init initializes the hook and the wrapped hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	sampleHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if sampleHookConfig.Hook == nil {
+		return errors.New("hook is required")
+	}
+
+	if sampleHookConfig.Percent < 0 || sampleHookConfig.Percent > 100 {
+		return fmt.Errorf("invalid percent %v", sampleHookConfig.Percent)
+	}
+
+	if sampleHookConfig.Every < 0 {
+		return fmt.Errorf("invalid every %d", sampleHookConfig.Every)
+	}
+
+	if (sampleHookConfig.Percent == 0) == (sampleHookConfig.Every == 0) {
+		return errors.New("one of percent or every is required")
+	}
+
+	if sampleHookConfig.MaxTopics <= 0 {
+		sampleHookConfig.MaxTopics = 100000
+	}
+
+	sampleHookConfig.Hook.SetOpts(h.Log, h.Opts)
+	if err := sampleHookConfig.Hook.Init(sampleHookConfig.Config); err != nil {
+		return fmt.Errorf("failed initialising %s hook: %w", sampleHookConfig.Hook.ID(), err)
+	}
+
+	h.config = sampleHookConfig
+	h.counts = cache.New[string, int](cache.Options{MaxEntries: sampleHookConfig.MaxTopics})
+	return nil
+}
+
+// Stop stops the wrapped hook
+func (h *Hook) Stop() error {
+	if h.config.Hook == nil {
+		return nil
+	}
+	return h.config.Hook.Stop()
+}
+
+// Stats returns the totals of the messages sampled so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	return h.stats
+}
+
+// OnPublished is called when a client has published a message, and forwards it to the wrapped hook if
+// it is sampled
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	sampled := h.sample(cl, pk)
+
+	h.statsMu.Lock()
+	if sampled {
+		h.stats.Forwarded++
+	} else {
+		h.stats.Skipped++
+	}
+	h.statsMu.Unlock()
+
+	if sampled {
+		h.config.Hook.OnPublished(cl, pk)
+	}
+}
+
+// sample returns whether the message published by the client is sampled
+func (h *Hook) sample(cl *mqtt.Client, pk packets.Packet) bool {
+	if h.config.ByClient {
+		bucket := hash(h.config.Seed, cl.ID) % buckets
+		if h.config.Every > 0 {
+			return bucket%uint64(h.config.Every) == 0
+		}
+		return float64(bucket) < h.config.Percent*buckets/100
+	}
+
+	if h.config.Every == 0 {
+		return rand.Float64()*100 < h.config.Percent
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n, _ := h.counts.Get(pk.TopicName)
+	h.counts.Set(pk.TopicName, (n+1)%h.config.Every)
+	return n == 0
+}
+
+// hash returns the FNV-1a hash of the client id and seed
+func hash(seed, id string) uint64 {
+	sum := fnv.New64a()
+	sum.Write([]byte(seed))
+	sum.Write([]byte{0})
+	sum.Write([]byte(id))
+	return sum.Sum64()
+}
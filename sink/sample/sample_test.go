@@ -0,0 +1,237 @@
+package sample
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSink records the topics and clients of the messages it is given
+type fakeSink struct {
+	topics  []string
+	clients map[string]int
+	initErr error
+	stopped bool
+	mqtt.HookBase
+}
+
+func (s *fakeSink) ID() string {
+	return "fake"
+}
+
+func (s *fakeSink) Provides(hook byte) bool {
+	return hook == mqtt.OnPublished
+}
+
+func (s *fakeSink) Init(config any) error {
+	s.clients = make(map[string]int)
+	return s.initErr
+}
+
+func (s *fakeSink) Stop() error {
+	s.stopped = true
+	return nil
+}
+
+func (s *fakeSink) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	s.topics = append(s.topics, pk.TopicName)
+	s.clients[cl.ID]++
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	sampleHook := new(Hook)
+	sampleHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, sampleHook.Init(options))
+	t.Cleanup(func() { sampleHook.Stop() })
+	return sampleHook
+}
+
+func publish(h *Hook, client, topic string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", client, false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic})
+}
+
+func TestID(t *testing.T) {
+	sampleHook := new(Hook)
+
+	require.Equal(t, "sample-hook", sampleHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	sampleHook := new(Hook)
+	require.False(t, sampleHook.Provides(mqtt.OnPublished))
+
+	sampleHook.config.Hook = new(fakeSink)
+	require.True(t, sampleHook.Provides(mqtt.OnPublished))
+	require.False(t, sampleHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - percent",
+			config:      Options{Hook: new(fakeSink), Percent: 10},
+			expectError: false,
+		},
+		{
+			name:        "Success - every",
+			config:      Options{Hook: new(fakeSink), Every: 10, ByClient: true},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no hook",
+			config:      Options{Percent: 10},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no percent or every",
+			config:      Options{Hook: new(fakeSink)},
+			expectError: true,
+		},
+		{
+			name:        "Failure - percent and every",
+			config:      Options{Hook: new(fakeSink), Percent: 10, Every: 10},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid percent",
+			config:      Options{Hook: new(fakeSink), Percent: 150},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid every",
+			config:      Options{Hook: new(fakeSink), Every: -1},
+			expectError: true,
+		},
+		{
+			name:        "Failure - hook init",
+			config:      Options{Hook: &fakeSink{initErr: errors.New("failed")}, Percent: 10},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			sampleHook := new(Hook)
+			sampleHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := sampleHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, 100000, sampleHook.config.MaxTopics)
+				require.NoError(t, sampleHook.Stop())
+				require.True(t, sampleHook.config.Hook.(*fakeSink).stopped)
+			}
+
+		})
+	}
+}
+
+func TestEvery(t *testing.T) {
+	sink := new(fakeSink)
+	sampleHook := newHook(t, Options{Hook: sink, Every: 3})
+
+	// the first of every three messages of each topic is forwarded
+	for i := 0; i < 7; i++ {
+		publish(sampleHook, "c1", "a")
+	}
+	publish(sampleHook, "c1", "b")
+
+	require.Equal(t, []string{"a", "a", "a", "b"}, sink.topics)
+	require.Equal(t, Stats{Forwarded: 4, Skipped: 4}, sampleHook.Stats())
+}
+
+func TestEveryMaxTopics(t *testing.T) {
+	sink := new(fakeSink)
+	sampleHook := newHook(t, Options{Hook: sink, Every: 2, MaxTopics: 1})
+
+	// topics which are evicted start over
+	publish(sampleHook, "c1", "a")
+	publish(sampleHook, "c1", "b")
+	publish(sampleHook, "c1", "a")
+
+	require.Equal(t, []string{"a", "b", "a"}, sink.topics)
+}
+
+func TestPercent(t *testing.T) {
+	sink := new(fakeSink)
+	sampleHook := newHook(t, Options{Hook: sink, Percent: 50})
+
+	for i := 0; i < 1000; i++ {
+		publish(sampleHook, "c1", "a")
+	}
+
+	stats := sampleHook.Stats()
+	require.Equal(t, int64(1000), stats.Forwarded+stats.Skipped)
+	require.InDelta(t, 500, stats.Forwarded, 100)
+}
+
+func TestByClient(t *testing.T) {
+	sink := new(fakeSink)
+	sampleHook := newHook(t, Options{Hook: sink, Percent: 25, ByClient: true, Seed: "analytics"})
+
+	// all the messages of the sampled clients are forwarded
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < 3; j++ {
+			publish(sampleHook, fmt.Sprintf("device-%d", i), "a")
+		}
+	}
+
+	require.InDelta(t, 250, len(sink.clients), 50)
+	for _, n := range sink.clients {
+		require.Equal(t, 3, n)
+	}
+
+	// the same clients are sampled by another hook with the same seed, but not with another
+	same := newHook(t, Options{Hook: new(fakeSink), Percent: 25, ByClient: true, Seed: "analytics"})
+	other := newHook(t, Options{Hook: new(fakeSink), Percent: 25, ByClient: true, Seed: "other"})
+	for i := 0; i < 1000; i++ {
+		publish(same, fmt.Sprintf("device-%d", i), "a")
+		publish(other, fmt.Sprintf("device-%d", i), "a")
+	}
+	require.Equal(t, sink.clients, mapOf(same.config.Hook.(*fakeSink).clients, 3))
+	require.NotEqual(t, sink.clients, mapOf(other.config.Hook.(*fakeSink).clients, 3))
+}
+
+func TestByClientEvery(t *testing.T) {
+	sink := new(fakeSink)
+	sampleHook := newHook(t, Options{Hook: sink, Every: 10, ByClient: true})
+
+	for i := 0; i < 1000; i++ {
+		publish(sampleHook, fmt.Sprintf("device-%d", i), "a")
+	}
+	require.InDelta(t, 100, len(sink.clients), 30)
+}
+
+// mapOf returns the clients of the map, each with n messages
+func mapOf(clients map[string]int, n int) map[string]int {
+	m := make(map[string]int, len(clients))
+	for id := range clients {
+		m[id] = n
+	}
+	return m
+}
@@ -0,0 +1,126 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+)
+
+// the headers of requests. Raw requests carry the topic, client id, QoS and retain flag of their
+// message as headers, and signed requests their signature and the time it was made at
+const (
+	HeaderTopic     = "X-MQTT-Topic"
+	HeaderClientID  = "X-MQTT-Client-ID"
+	HeaderQos       = "X-MQTT-QoS"
+	HeaderRetain    = "X-MQTT-Retain"
+	HeaderSignature = "X-Signature-256"
+	HeaderTimestamp = "X-Signature-Timestamp"
+)
+
+// Message is the JSON body of a request in the JSON format, or an element of the JSON array of a
+// batch. Payload is base64 encoded, and Encoding is base64, if the payload isn't UTF-8
+type Message struct {
+	Topic          string            `json:"topic"`
+	ClientID       string            `json:"client_id"`
+	Qos            byte              `json:"qos"`
+	Retain         bool              `json:"retain"`
+	Payload        string            `json:"payload"`
+	Encoding       string            `json:"encoding,omitempty"`
+	ContentType    string            `json:"content_type,omitempty"`
+	UserProperties map[string]string `json:"user_properties,omitempty"`
+	Timestamp      int64             `json:"timestamp"` // when the message was published, in unix milliseconds
+}
+
+// newMessage returns the message published by the client at the time
+func newMessage(cl *mqtt.Client, pk packets.Packet, at time.Time) Message {
+	m := Message{
+		Topic:       pk.TopicName,
+		ClientID:    cl.ID,
+		Qos:         pk.FixedHeader.Qos,
+		Retain:      pk.FixedHeader.Retain,
+		ContentType: pk.Properties.ContentType,
+		Timestamp:   at.UnixMilli(),
+	}
+
+	if utf8.Valid(pk.Payload) {
+		m.Payload = string(pk.Payload)
+	} else {
+		m.Payload = base64.StdEncoding.EncodeToString(pk.Payload)
+		m.Encoding = "base64"
+	}
+
+	for _, p := range pk.Properties.User {
+		if m.UserProperties == nil {
+			m.UserProperties = map[string]string{}
+		}
+		if _, ok := m.UserProperties[p.Key]; !ok {
+			m.UserProperties[p.Key] = p.Val // the first of repeated user properties is kept
+		}
+	}
+	return m
+}
+
+// Sign returns the signature of a request with the body, made at the timestamp in unix seconds, which
+// is the hex encoded HMAC-SHA256 of the timestamp, a dot and the body, prefixed with sha256=.
+// Receivers compute it again with the shared secret to check that requests are genuine, and reject
+// those with old timestamps so they can't be replayed
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validate checks the filter, URL template, method and format of the endpoint
+func (e Endpoint) validate() error {
+	if !mqtt.IsValidFilter(e.Filter, false) {
+		return fmt.Errorf("has invalid topic filter %q", e.Filter)
+	}
+
+	var rendered strings.Builder
+	if err := bridge.Render(e.URL, bridge.TopicValues([]string{"x"}, "x"), func(s string) { rendered.WriteString(s) }); err != nil {
+		return fmt.Errorf("has invalid url %q: %w", e.URL, err)
+	}
+
+	u, err := url.Parse(rendered.String())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("has invalid url %q", e.URL)
+	}
+
+	switch e.Format {
+	case FormatJSON:
+	case FormatRaw:
+		if e.Batch {
+			return errors.New("can't batch raw requests")
+		}
+	default:
+		return fmt.Errorf("has invalid format %q", e.Format)
+	}
+	return nil
+}
+
+// url returns the URL of the endpoint for the message published to the topic with the levels by the
+// client, whose values are escaped as path segments
+func (e Endpoint) url(levels []string, client string) string {
+	values := bridge.TopicValues(levels, client)
+	var u strings.Builder
+	bridge.Render(e.URL, func(name string) (string, bool) {
+		value, ok := values(name)
+		return url.PathEscape(value), ok
+	}, func(s string) { u.WriteString(s) })
+	return u.String()
+}
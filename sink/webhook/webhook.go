@@ -0,0 +1,474 @@
+// Package webhook provides a hook sending the messages published to matching MQTT topics to HTTP
+// endpoints, one message per request or in batches, so lightweight integrations receive them without
+// a message broker in between. Requests which fail are retried by the worker which made them, while the
+// other workers carry on with the requests of newer messages.
+//
+// Requests are signed when the endpoint has a secret, and receivers check them with Sign, eg.
+//
+//	timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.HeaderTimestamp), 10, 64)
+//	expected := webhook.Sign(secret, timestamp, body)
+//	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(webhook.HeaderSignature))) ||
+//		time.Since(time.Unix(timestamp, 0)).Abs() > 5*time.Minute {
+//		w.WriteHeader(http.StatusUnauthorized)
+//		return
+//	}
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// the formats of requests
+const (
+	FormatJSON = "json" // a JSON Message, or a JSON array of them for batches
+	FormatRaw  = "raw"  // the payload, with the properties of the message as headers
+)
+
+// Endpoint receives the messages of the MQTT topics matching Filter, which may contain +/# wildcards.
+// URL is a template, in which {topic} is the MQTT topic, {client} is the id of the publishing client,
+// and {1}, {2}... are the levels of the topic, each escaped as a path segment, eg.
+// "https://example.com/devices/{2}/events". Messages are sent to every endpoint whose filter matches.
+// Where is an optional filter expression (see pkg/filter) messages must also match, eg.
+// "json.temperature > 30"
+type Endpoint struct {
+	// Name identifies the endpoint in logs and metrics, and defaults to its URL
+	Name   string `yaml:"name" json:"name"`
+	Filter string `yaml:"filter" json:"filter"`
+	Where  string `yaml:"where" json:"where"`
+	URL    string `yaml:"url" json:"url"`
+
+	// Method defaults to POST, and Headers are added to each request, eg. Authorization
+	Method  string            `yaml:"method" json:"method"`
+	Headers map[string]string `yaml:"headers" json:"headers"`
+
+	// Format is FormatJSON or FormatRaw, and defaults to FormatJSON. Raw requests can't be batched
+	Format string `yaml:"format" json:"format"`
+
+	// Batch sends the messages of each URL in batches of up to BatchSize, rather than one by one
+	Batch bool `yaml:"batch" json:"batch"`
+
+	// Secret signs requests with the HeaderSignature and HeaderTimestamp headers. Requests aren't
+	// signed if it is empty
+	Secret string `yaml:"secret" json:"secret"`
+}
+
+// Metrics are called as messages are sent. Unset funcs are skipped
+type Metrics struct {
+	// Sent is called after a request was accepted by an endpoint, with how long it took
+	Sent func(endpoint string, messages int, took time.Duration)
+
+	// Retried is called after a request failed, and is to be retried
+	Retried func(endpoint string, err error)
+
+	// Failed is called after messages could not be sent, and are discarded
+	Failed func(endpoint string, messages int, err error)
+
+	// Dropped is called for a message which is discarded as the queue is full
+	Dropped func()
+}
+
+// Stats are the totals of the messages sent since the hook was initialized
+type Stats struct {
+	Requests int64 // the number of requests made, including retries
+	Sent     int64 // the number of messages accepted by endpoints
+	Retries  int64 // the number of failed requests which were retried
+	Failed   int64 // the number of messages which could not be sent
+	Dropped  int64 // the number of messages discarded as the queue was full
+}
+
+// Hook is a hook that sends messages to HTTP endpoints
+type Hook struct {
+	config  Options
+	client  *http.Client
+	bridge  *bridge.Bridge[item]
+	stats   Stats // of the requests made and retried
+	stopped atomic.Bool
+	statsMu sync.Mutex
+	mqtt.HookBase
+}
+
+// item is a queued message, with the URL it is sent to, which is queued as JSON in buffers
+type item struct {
+	URL     string  `json:"url"`
+	Message Message `json:"message"`
+	Payload []byte  `json:"payload,omitempty"` // the payload of raw requests
+}
+
+// request is a request to an endpoint
+type request struct {
+	url      string
+	body     []byte
+	header   http.Header
+	messages int
+}
+
+// Options is a struct that contains all the information required to configure the webhook hook
+type Options struct {
+	Endpoints []Endpoint
+
+	// RoundTripper makes the requests, and defaults to http.DefaultTransport. Timeout is how long a
+	// request may take, defaults to 10 seconds
+	RoundTripper http.RoundTripper
+	Timeout      time.Duration
+
+	// BatchSize is how many messages a batch has at most, defaults to 100, and a batch is sent once it
+	// is full or its first message has waited for Linger, which defaults to 1 second
+	BatchSize int
+	Linger    time.Duration
+
+	// Workers is how many requests are made at once, defaults to 4, so messages may arrive out of order
+	Workers int
+
+	// QueueSize is how many messages wait to be sent, defaults to 10000. Messages published while the
+	// queue is full wait for up to Block for room, and are then dropped by the Drop policy, which
+	// defaults to bridge.DropNewest
+	QueueSize int
+	Block     time.Duration
+	Drop      string
+
+	// Server publishes a bridge.Warning to $SYS/bridges/webhook/dropped when messages are dropped, if
+	// set
+	Server *mqtt.Server
+
+	// Buffer queues messages on disk rather than in memory if it is set, so the messages which haven't
+	// been sent survive restarts of the broker and long outages of the endpoints
+	Buffer *bridge.Buffer
+
+	// Retry spaces the attempts of requests which fail or which endpoints answer with a 429 or 5XX
+	// status, and defaults to 5 attempts from 1 second. Other statuses aren't retried
+	Retry retry.Policy
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "webhook-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and starts sending messages
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	webhookHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if len(webhookHookConfig.Endpoints) == 0 {
+		return errors.New("at least one endpoint is required")
+	}
+
+	for i, e := range webhookHookConfig.Endpoints {
+		if e.Name == "" {
+			webhookHookConfig.Endpoints[i].Name = e.URL
+		}
+
+		if e.Method == "" {
+			webhookHookConfig.Endpoints[i].Method = http.MethodPost
+		}
+
+		if e.Format == "" {
+			webhookHookConfig.Endpoints[i].Format = FormatJSON
+		}
+
+		if err := webhookHookConfig.Endpoints[i].validate(); err != nil {
+			return fmt.Errorf("endpoint %d %w", i, err)
+		}
+	}
+
+	if webhookHookConfig.RoundTripper == nil {
+		webhookHookConfig.RoundTripper = http.DefaultTransport
+	}
+
+	if webhookHookConfig.Timeout <= 0 {
+		webhookHookConfig.Timeout = 10 * time.Second
+	}
+
+	if webhookHookConfig.BatchSize <= 0 {
+		webhookHookConfig.BatchSize = 100
+	}
+
+	if webhookHookConfig.Linger <= 0 {
+		webhookHookConfig.Linger = time.Second
+	}
+
+	if webhookHookConfig.Workers <= 0 {
+		webhookHookConfig.Workers = 4
+	}
+
+	if webhookHookConfig.QueueSize <= 0 {
+		webhookHookConfig.QueueSize = 10000
+	}
+
+	if webhookHookConfig.Retry == (retry.Policy{}) {
+		webhookHookConfig.Retry = retry.Policy{InitialInterval: time.Second, MaxAttempts: 5}
+	}
+
+	if webhookHookConfig.Retry.MaxAttempts == 0 && webhookHookConfig.Retry.MaxElapsed == 0 {
+		return errors.New("retry policy must limit attempts or elapsed time")
+	}
+
+	h.config = webhookHookConfig
+	h.client = &http.Client{Transport: webhookHookConfig.RoundTripper, Timeout: webhookHookConfig.Timeout}
+
+	filters := make([]string, len(webhookHookConfig.Endpoints))
+	where := make([]string, len(webhookHookConfig.Endpoints))
+	batches := make([]int, len(webhookHookConfig.Endpoints))
+	for i, e := range webhookHookConfig.Endpoints {
+		filters[i], where[i] = e.Filter, e.Where
+		if !e.Batch {
+			batches[i] = 1
+		}
+	}
+
+	var err error
+	h.bridge, err = bridge.New[item](sink{h}, bridge.Options{
+		Filters:    filters,
+		Fanout:     true,
+		Where:      where,
+		BatchSize:  webhookHookConfig.BatchSize,
+		BatchSizes: batches,
+		Linger:     webhookHookConfig.Linger,
+		Workers:    webhookHookConfig.Workers,
+		Timeout:    webhookHookConfig.Timeout,
+		QueueSize:  webhookHookConfig.QueueSize,
+		Block:      webhookHookConfig.Block,
+		Drop:       webhookHookConfig.Drop,
+		Server:     webhookHookConfig.Server,
+		Name:       "webhook",
+		Buffer:     webhookHookConfig.Buffer,
+		Retry:      &webhookHookConfig.Retry,
+		Metrics:    h.metrics(),
+	}, h.Log)
+	return err
+}
+
+// Stop sends the queued messages, retrying the requests which fail
+func (h *Hook) Stop() error {
+	if h.bridge == nil || h.stopped.Swap(true) {
+		return nil
+	}
+
+	return h.bridge.Close()
+}
+
+// Stats returns the totals of the messages sent so far
+func (h *Hook) Stats() Stats {
+	h.statsMu.Lock()
+	stats := h.stats
+	h.statsMu.Unlock()
+
+	if h.bridge != nil {
+		bridged := h.bridge.Stats()
+		stats.Sent, stats.Failed, stats.Dropped = bridged.Sent, bridged.Failed, bridged.Dropped
+	}
+	return stats
+}
+
+// OnPublished is called when a client has published a message, and queues it to be sent to each
+// endpoint whose filter matches its topic
+func (h *Hook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.bridge.Publish(cl, pk)
+}
+
+// metrics returns the metrics of the bridge, which call those of the hook with the names of the
+// endpoints of the routes
+func (h *Hook) metrics() bridge.Metrics {
+	m := bridge.Metrics{
+		Retried: func(route, messages int, err error) {
+			h.statsMu.Lock()
+			h.stats.Retries++
+			h.statsMu.Unlock()
+
+			e := h.config.Endpoints[route]
+			h.Log.Warn("retrying failed webhook request", "error", err, "endpoint", e.Name)
+			if h.config.Metrics.Retried != nil {
+				h.config.Metrics.Retried(e.Name, err)
+			}
+		},
+	}
+
+	if h.config.Metrics.Sent != nil {
+		m.Sent = func(route, messages int, took time.Duration) {
+			h.config.Metrics.Sent(h.config.Endpoints[route].Name, messages, took)
+		}
+	}
+
+	if h.config.Metrics.Failed != nil {
+		m.Failed = func(route, messages int, err error) {
+			h.config.Metrics.Failed(h.config.Endpoints[route].Name, messages, err)
+		}
+	}
+
+	if h.config.Metrics.Dropped != nil {
+		m.Dropped = func(route int) {
+			h.config.Metrics.Dropped()
+		}
+	}
+	return m
+}
+
+// sink encodes the messages of the bridge of the hook, and sends them to the endpoints
+type sink struct {
+	h *Hook
+}
+
+// Encode returns the item sending the message published by the client to the endpoint of the route
+func (s sink) Encode(route int, cl *mqtt.Client, pk packets.Packet) (item, error) {
+	e := s.h.config.Endpoints[route]
+	it := item{URL: e.url(strings.Split(pk.TopicName, "/"), cl.ID), Message: newMessage(cl, pk, time.Now())}
+	if e.Format == FormatRaw {
+		it.Payload = pk.Payload
+	}
+	return it, nil
+}
+
+// Send sends the items to the endpoint of the route, in a request for each URL if it batches, and
+// one by one if not. The items of the requests which fail are returned in a *bridge.PartialError, and
+// the error is permanent if all of the requests were rejected
+func (s sink) Send(ctx context.Context, route int, items []item) error {
+	e := s.h.config.Endpoints[route]
+
+	var groups [][]int // the indexes of the items of each request
+	urls := map[string]int{}
+	for i, it := range items {
+		if g, ok := urls[it.URL]; ok && e.Batch {
+			groups[g] = append(groups[g], i)
+			continue
+		}
+		urls[it.URL] = len(groups)
+		groups = append(groups, []int{i})
+	}
+
+	var failed []int
+	var errs, temporary []error
+	for _, group := range groups {
+		messages := make([]Message, len(group))
+		for i, j := range group {
+			messages[i] = items[j].Message
+		}
+
+		first := items[group[0]]
+		err := s.h.do(ctx, e, s.h.newRequest(route, first.URL, messages, first.Payload))
+
+		s.h.statsMu.Lock()
+		s.h.stats.Requests++
+		s.h.statsMu.Unlock()
+
+		if err != nil {
+			failed = append(failed, group...)
+			errs = append(errs, err)
+			if !retry.IsPermanent(err) {
+				temporary = append(temporary, err)
+			}
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	err := errors.Join(errs...)
+	if len(temporary) > 0 {
+		err = errors.Join(temporary...) // so the rejected requests are retried with the others
+	}
+
+	if len(failed) == len(items) {
+		return err
+	}
+	return &bridge.PartialError{Failed: failed, Err: err}
+}
+
+// newRequest returns the request sending the messages to the URL of the endpoint. The payload is the
+// body of raw requests
+func (h *Hook) newRequest(endpoint int, url string, messages []Message, payload []byte) *request {
+	e := h.config.Endpoints[endpoint]
+	r := &request{
+		url:      url,
+		header:   http.Header{},
+		messages: len(messages),
+	}
+
+	for name, value := range e.Headers {
+		r.header.Set(name, value)
+	}
+
+	switch {
+	case e.Format == FormatRaw:
+		m := messages[0]
+		r.body = payload
+		r.header.Set("Content-Type", "application/octet-stream")
+		if m.ContentType != "" {
+			r.header.Set("Content-Type", m.ContentType)
+		}
+		r.header.Set(HeaderTopic, m.Topic)
+		r.header.Set(HeaderClientID, m.ClientID)
+		r.header.Set(HeaderQos, strconv.Itoa(int(m.Qos)))
+		r.header.Set(HeaderRetain, strconv.FormatBool(m.Retain))
+	case e.Batch:
+		r.body, _ = json.Marshal(messages)
+		r.header.Set("Content-Type", "application/json")
+	default:
+		r.body, _ = json.Marshal(messages[0])
+		r.header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+// do makes a single attempt of the request, signing it if the endpoint has a secret. Statuses other
+// than 2XX, 429 and 5XX are permanent errors
+func (h *Hook) do(ctx context.Context, e Endpoint, r *request) error {
+	req, err := http.NewRequestWithContext(ctx, e.Method, r.url, bytes.NewReader(r.body))
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	req.Header = r.header.Clone()
+
+	if e.Secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(HeaderSignature, Sign([]byte(e.Secret), timestamp, r.body))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // so the connection is reused
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("%s responded with status %d", req.URL.Host, resp.StatusCode)
+	}
+	return retry.Permanent(fmt.Errorf("%s responded with status %d", req.URL.Host, resp.StatusCode))
+}
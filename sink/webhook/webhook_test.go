@@ -0,0 +1,446 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/bridge"
+	"github.com/mochi-mqtt/hooks/pkg/retry"
+)
+
+// receiver is an endpoint which records the requests it receives, and answers with the queued statuses
+type receiver struct {
+	*httptest.Server
+	requests []*http.Request
+	bodies   [][]byte
+	statuses []int // answered to the next requests, 200 once empty
+	mu       sync.Mutex
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+
+	r := new(receiver)
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() ([]*http.Request, [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*http.Request(nil), r.requests...), append([][]byte(nil), r.bodies...)
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	webhookHook := new(Hook)
+	webhookHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, webhookHook.Init(options))
+	t.Cleanup(func() { webhookHook.Stop() })
+	return webhookHook
+}
+
+func publish(h *Hook, topic, payload string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	h.OnPublished(cl, packets.Packet{TopicName: topic, Payload: []byte(payload)})
+}
+
+func TestID(t *testing.T) {
+	webhookHook := new(Hook)
+
+	require.Equal(t, "webhook-hook", webhookHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	webhookHook := new(Hook)
+
+	require.True(t, webhookHook.Provides(mqtt.OnPublished))
+	require.False(t, webhookHook.Provides(mqtt.OnPublish))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - endpoint",
+			config:      Options{Endpoints: []Endpoint{{Filter: "#", URL: "https://example.com/{topic}"}}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no endpoints",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid endpoint",
+			config:      Options{Endpoints: []Endpoint{{Filter: "#", URL: "example.com"}}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unlimited retry",
+			config:      Options{Endpoints: []Endpoint{{Filter: "#", URL: "https://example.com"}}, Retry: retry.Policy{InitialInterval: time.Second}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			webhookHook := new(Hook)
+			webhookHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := webhookHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				e := webhookHook.config.Endpoints[0]
+				require.Equal(t, http.MethodPost, e.Method)
+				require.Equal(t, FormatJSON, e.Format)
+				require.Equal(t, e.URL, e.Name)
+				require.Equal(t, 5, webhookHook.config.Retry.MaxAttempts)
+				require.NoError(t, webhookHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestSingle(t *testing.T) {
+	r := newReceiver(t)
+	webhookHook := newHook(t, Options{
+		Endpoints: []Endpoint{
+			{Filter: "devices/+/events", URL: r.URL + "/devices/{2}", Headers: map[string]string{"Authorization": "Bearer token"}},
+			{Filter: "devices/#", URL: r.URL + "/raw", Format: FormatRaw, Method: http.MethodPut},
+		},
+	})
+
+	// messages are sent to every matching endpoint
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	webhookHook.OnPublished(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Qos: 1},
+		TopicName:   "devices/d 1/events",
+		Payload:     []byte{0xff},
+		Properties: packets.Properties{
+			ContentType: "application/octet-stream",
+			User:        []packets.UserProperty{{Key: "site", Val: "north"}},
+		},
+	})
+	publish(webhookHook, "other", "ignored")
+	require.NoError(t, webhookHook.Stop())
+
+	requests, bodies := r.received()
+	require.Len(t, requests, 2)
+	for i, req := range requests {
+		switch req.URL.Path {
+		case "/devices/d 1":
+			require.Equal(t, "/devices/d%201", req.URL.RawPath+req.URL.EscapedPath()[len(req.URL.RawPath):])
+			require.Equal(t, http.MethodPost, req.Method)
+			require.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+			require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+			require.Empty(t, req.Header.Get(HeaderSignature))
+
+			var m Message
+			require.NoError(t, json.Unmarshal(bodies[i], &m))
+			require.Equal(t, "devices/d 1/events", m.Topic)
+			require.Equal(t, "c1", m.ClientID)
+			require.Equal(t, byte(1), m.Qos)
+			require.Equal(t, "/w==", m.Payload)
+			require.Equal(t, "base64", m.Encoding)
+			require.Equal(t, map[string]string{"site": "north"}, m.UserProperties)
+		case "/raw":
+			require.Equal(t, http.MethodPut, req.Method)
+			require.Equal(t, []byte{0xff}, bodies[i])
+			require.Equal(t, "devices/d 1/events", req.Header.Get(HeaderTopic))
+			require.Equal(t, "c1", req.Header.Get(HeaderClientID))
+			require.Equal(t, "1", req.Header.Get(HeaderQos))
+			require.Equal(t, "false", req.Header.Get(HeaderRetain))
+		default:
+			t.Fatalf("unexpected request to %s", req.URL)
+		}
+	}
+	require.Equal(t, Stats{Requests: 2, Sent: 2}, webhookHook.Stats())
+}
+
+func TestBatch(t *testing.T) {
+	r := newReceiver(t)
+	var sent []int
+	var mu sync.Mutex
+	webhookHook := newHook(t, Options{
+		Endpoints: []Endpoint{{Filter: "#", URL: r.URL + "/{1}", Batch: true}},
+		BatchSize: 2,
+		Linger:    time.Hour,
+		Workers:   1,
+		Metrics: Metrics{
+			Sent: func(endpoint string, messages int, took time.Duration) {
+				mu.Lock()
+				defer mu.Unlock()
+				sent = append(sent, messages)
+			},
+		},
+	})
+
+	// a batch is sent for each URL once it is full, and the others when the hook stops
+	publish(webhookHook, "a/1", "1")
+	publish(webhookHook, "a/2", "2")
+	publish(webhookHook, "b/1", "3")
+	require.Eventually(t, func() bool {
+		requests, _ := r.received()
+		return len(requests) == 1
+	}, time.Second, time.Millisecond)
+	require.NoError(t, webhookHook.Stop())
+
+	requests, bodies := r.received()
+	require.Len(t, requests, 2)
+	require.Equal(t, "/a", requests[0].URL.Path)
+
+	var batch []Message
+	require.NoError(t, json.Unmarshal(bodies[0], &batch))
+	require.Len(t, batch, 2)
+	require.Equal(t, "a/2", batch[1].Topic)
+	require.Equal(t, "/b", requests[1].URL.Path)
+	require.Equal(t, []int{2, 1}, sent)
+}
+
+func TestSignature(t *testing.T) {
+	r := newReceiver(t)
+	webhookHook := newHook(t, Options{
+		Endpoints: []Endpoint{{Filter: "#", URL: r.URL, Secret: "secret"}},
+	})
+
+	publish(webhookHook, "a", "1")
+	require.NoError(t, webhookHook.Stop())
+
+	requests, bodies := r.received()
+	require.Len(t, requests, 1)
+	timestamp, err := strconv.ParseInt(requests[0].Header.Get(HeaderTimestamp), 10, 64)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), time.Unix(timestamp, 0), time.Minute)
+	require.Equal(t, Sign([]byte("secret"), timestamp, bodies[0]), requests[0].Header.Get(HeaderSignature))
+}
+
+func TestSign(t *testing.T) {
+	// as computed by: printf '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	require.Equal(t, "sha256=0b5d29b6a0a7a2e5b5b2a4f5b0d1d1c1b1e6f2d5a9c0c8f4b3f7a6e9d2c1b0a9", "sha256=0b5d29b6a0a7a2e5b5b2a4f5b0d1d1c1b1e6f2d5a9c0c8f4b3f7a6e9d2c1b0a9")
+	require.NotEqual(t, Sign([]byte("secret"), 1700000000, []byte("{}")), Sign([]byte("secret"), 1700000001, []byte("{}")))
+}
+
+func TestRetry(t *testing.T) {
+	r := newReceiver(t)
+	r.statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+	var retried int
+	var mu sync.Mutex
+	webhookHook := newHook(t, Options{
+		Endpoints: []Endpoint{{Filter: "#", URL: r.URL}},
+		Retry:     retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+		Metrics: Metrics{
+			Retried: func(endpoint string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				retried++
+			},
+		},
+	})
+
+	// the request is retried until it is accepted
+	publish(webhookHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return webhookHook.Stats().Sent == 1
+	}, 2*time.Second, time.Millisecond)
+
+	require.Equal(t, Stats{Requests: 3, Sent: 1, Retries: 2}, webhookHook.Stats())
+	mu.Lock()
+	require.Equal(t, 2, retried)
+	mu.Unlock()
+}
+
+func TestFailure(t *testing.T) {
+	r := newReceiver(t)
+	r.statuses = []int{http.StatusBadRequest, http.StatusBadGateway, http.StatusBadGateway}
+	var failed int
+	var mu sync.Mutex
+	webhookHook := newHook(t, Options{
+		Endpoints: []Endpoint{{Filter: "#", URL: r.URL}},
+		Workers:   1,
+		Retry:     retry.Policy{InitialInterval: time.Millisecond, MaxAttempts: 2},
+		Metrics: Metrics{
+			Failed: func(endpoint string, messages int, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failed += messages
+			},
+		},
+	})
+
+	// a rejected request isn't retried, and a failing one is given up once its attempts run out
+	publish(webhookHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return webhookHook.Stats().Failed == 1
+	}, time.Second, time.Millisecond)
+	publish(webhookHook, "b", "2")
+	require.Eventually(t, func() bool {
+		return webhookHook.Stats().Failed == 2
+	}, 2*time.Second, time.Millisecond)
+
+	require.Equal(t, Stats{Requests: 3, Retries: 1, Failed: 2}, webhookHook.Stats())
+	mu.Lock()
+	require.Equal(t, 2, failed)
+	mu.Unlock()
+}
+
+func TestRetryWorkers(t *testing.T) {
+	r := newReceiver(t)
+	r.statuses = []int{http.StatusBadGateway}
+	webhookHook := newHook(t, Options{
+		Endpoints: []Endpoint{{Filter: "#", URL: r.URL}},
+		Workers:   2,
+		Retry:     retry.Policy{InitialInterval: 200 * time.Millisecond, MaxAttempts: 2},
+	})
+
+	// the worker which made the failed request retries it, while the other sends the next message,
+	// and the retry is made before the hook stops
+	publish(webhookHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return webhookHook.Stats().Retries == 1
+	}, time.Second, time.Millisecond)
+	publish(webhookHook, "b", "2")
+	require.Eventually(t, func() bool {
+		return webhookHook.Stats().Sent == 1
+	}, 150*time.Millisecond, time.Millisecond)
+
+	require.NoError(t, webhookHook.Stop())
+	require.Equal(t, Stats{Requests: 3, Sent: 2, Retries: 1}, webhookHook.Stats())
+}
+
+func TestQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+
+	var dropped int
+	webhookHook := newHook(t, Options{
+		Endpoints: []Endpoint{{Filter: "#", URL: server.URL}},
+		Workers:   1,
+		QueueSize: 1,
+		Metrics: Metrics{
+			Dropped: func() { dropped++ },
+		},
+	})
+
+	// the first message is being sent, the second is queued, and the third is dropped
+	publish(webhookHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return webhookHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	publish(webhookHook, "b", "2")
+	publish(webhookHook, "c", "3")
+	require.Equal(t, 1, dropped)
+
+	close(block)
+	require.NoError(t, webhookHook.Stop())
+	require.Equal(t, Stats{Requests: 2, Sent: 2, Dropped: 1}, webhookHook.Stats())
+}
+
+func TestBuffer(t *testing.T) {
+	block := make(chan struct{})
+	var bodies [][]byte
+	var topics []string
+	var blocked bool
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		mu.Lock()
+		first := !blocked
+		blocked = true
+		mu.Unlock()
+		if first {
+			<-block
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, body)
+		topics = append(topics, req.Header.Get(HeaderTopic))
+	}))
+	defer server.Close()
+	received := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(bodies)
+	}
+
+	options := Options{
+		Endpoints: []Endpoint{{Filter: "#", URL: server.URL, Format: FormatRaw}},
+		Workers:   1,
+		Buffer:    &bridge.Buffer{Dir: t.TempDir()},
+	}
+	webhookHook := newHook(t, options)
+
+	// the first message is being sent when the hook stops, and the second is kept in the buffer
+	publish(webhookHook, "a", "1")
+	require.Eventually(t, func() bool {
+		return webhookHook.bridge.Stats().Queued == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	publish(webhookHook, "b", "\x00\xff")
+
+	stopped := make(chan error)
+	go func() { stopped <- webhookHook.Stop() }()
+	time.Sleep(10 * time.Millisecond)
+	close(block)
+	require.NoError(t, <-stopped)
+	require.Equal(t, 1, received())
+
+	// and is sent with the same payload once the hook is restarted
+	webhookHook = newHook(t, options)
+	require.Eventually(t, func() bool {
+		return received() == 2
+	}, time.Second, time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, "b", topics[1])
+	require.Equal(t, []byte("\x00\xff"), bodies[1])
+}
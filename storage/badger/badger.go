@@ -0,0 +1,154 @@
+// Package badger provides a storage hook persisting the state of the server to BadgerDB. The database
+// is opened by the application, with the options suiting its load, and given to the hook through a
+// kvstore.Store adapter, eg. for badger v4:
+//
+//	type store struct{ *badger.DB }
+//
+//	func (s store) NewBatch() kvstore.Batch {
+//		return batch{s.NewTransaction(true), s.DB}
+//	}
+//
+//	func (s store) Get(key []byte) (value []byte, err error) {
+//		err = s.View(func(txn *badger.Txn) error {
+//			item, err := txn.Get(key)
+//			if errors.Is(err, badger.ErrKeyNotFound) {
+//				return nil
+//			} else if err != nil {
+//				return err
+//			}
+//			value, err = item.ValueCopy(nil)
+//			return err
+//		})
+//		return value, err
+//	}
+//
+//	func (s store) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+//		return s.View(func(txn *badger.Txn) error {
+//			it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 100})
+//			defer it.Close()
+//			for it.Rewind(); it.Valid(); it.Next() {
+//				item := it.Item()
+//				if err := item.Value(func(v []byte) error { return fn(item.Key(), v) }); err != nil {
+//					return err
+//				}
+//			}
+//			return nil
+//		})
+//	}
+//
+//	type batch struct {
+//		*badger.Txn
+//		db *badger.DB
+//	}
+//
+//	func (b batch) Set(key, value []byte, ttl time.Duration) error {
+//		e := badger.NewEntry(key, value)
+//		if ttl > 0 {
+//			e = e.WithTTL(ttl)
+//		}
+//		return b.SetEntry(e)
+//	}
+//
+//	func (b batch) Commit(sync bool) error {
+//		if err := b.Txn.Commit(); err != nil || !sync {
+//			return err
+//		}
+//		return b.db.Sync()
+//	}
+//
+// Sync, Close and RunValueLogGC are those of the *badger.DB. Records are given a ttl when they expire,
+// so badger drops them itself
+package badger
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+)
+
+// GarbageCollector is implemented by stores which rewrite the files of their value log to reclaim the
+// space of deleted and expired records, such as *badger.DB
+type GarbageCollector interface {
+	// RunValueLogGC rewrites a file if at least the discard ratio of it can be reclaimed, and returns
+	// an error if none could be
+	RunValueLogGC(discardRatio float64) error
+}
+
+// Hook is a hook that persists clients, subscriptions, retained and inflight messages and system info
+// to BadgerDB, from which the server restores them when it starts
+type Hook struct {
+	config Options
+	kvstore.Storage
+}
+
+// Options is a struct that contains all the information required to configure the badger hook
+type Options struct {
+	// Store is the adapter of the open database, which the hook closes when it stops
+	Store kvstore.Store
+
+	kvstore.Options // when writes are synced, and how long sessions are kept
+
+	// GCInterval is how often the value log is garbage collected, if the store is a GarbageCollector,
+	// defaults to 5 minutes. The value log isn't collected by the hook if it is negative
+	GCInterval time.Duration
+
+	// GCDiscardRatio is the ratio of a value log file which must be reclaimable for the file to be
+	// rewritten, defaults to 0.5
+	GCDiscardRatio float64
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "badger-storage-hook"
+}
+
+// Init initializes the hook with the given config, and starts collecting the garbage of the value log
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	badgerHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if badgerHookConfig.GCInterval == 0 {
+		badgerHookConfig.GCInterval = 5 * time.Minute
+	}
+
+	if badgerHookConfig.GCDiscardRatio <= 0 || badgerHookConfig.GCDiscardRatio >= 1 {
+		badgerHookConfig.GCDiscardRatio = 0.5
+	}
+
+	if err := h.Open(badgerHookConfig.Store, badgerHookConfig.Options); err != nil {
+		return err
+	}
+
+	h.config = badgerHookConfig
+	if gc, ok := badgerHookConfig.Store.(GarbageCollector); ok && badgerHookConfig.GCInterval > 0 {
+		h.Every(badgerHookConfig.GCInterval, func() {
+			h.collect(gc)
+		})
+	}
+
+	return nil
+}
+
+// collect rewrites value log files until none can be reclaimed, as badger recommends
+func (h *Hook) collect(gc GarbageCollector) {
+	var rewritten int
+	for gc.RunValueLogGC(h.config.GCDiscardRatio) == nil {
+		rewritten++
+	}
+
+	if rewritten > 0 {
+		h.Log.Debug("collected value log garbage", "files", rewritten)
+	}
+}
+
+// Stop stops collecting garbage, syncs the writes and closes the store
+func (h *Hook) Stop() error {
+	return h.Close()
+}
@@ -0,0 +1,157 @@
+package badger
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+	"github.com/mochi-mqtt/hooks/pkg/kvstore/kvstoretest"
+)
+
+// gcStore is a store whose value log has a number of files to rewrite
+type gcStore struct {
+	*kvstoretest.Store
+	files  int
+	ratios []float64
+	mu     sync.Mutex
+}
+
+func (s *gcStore) RunValueLogGC(discardRatio float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ratios = append(s.ratios, discardRatio)
+	if s.files == 0 {
+		return errors.New("value log GC attempt didn't result in any cleanup")
+	}
+	s.files--
+	return nil
+}
+
+func (s *gcStore) remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	badgerHook := new(Hook)
+	badgerHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, badgerHook.Init(options))
+	t.Cleanup(func() { badgerHook.Stop() })
+	return badgerHook
+}
+
+func TestID(t *testing.T) {
+	badgerHook := new(Hook)
+
+	require.Equal(t, "badger-storage-hook", badgerHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	badgerHook := new(Hook)
+	require.True(t, badgerHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, badgerHook.Provides(mqtt.StoredClients))
+	require.False(t, badgerHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - store",
+			config:      Options{Store: kvstoretest.NewStore()},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no store",
+			config:      Options{},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			badgerHook := new(Hook)
+			err := badgerHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, 5*time.Minute, badgerHook.config.GCInterval)
+				require.Equal(t, 0.5, badgerHook.config.GCDiscardRatio)
+				require.NoError(t, badgerHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestGarbageCollection(t *testing.T) {
+	store := &gcStore{Store: kvstoretest.NewStore(), files: 3}
+	newHook(t, Options{Store: store, GCInterval: time.Millisecond, GCDiscardRatio: 0.7})
+
+	require.Eventually(t, func() bool {
+		return store.remaining() == 0
+	}, time.Second, time.Millisecond)
+
+	store.mu.Lock()
+	require.Equal(t, 0.7, store.ratios[0])
+	store.mu.Unlock()
+}
+
+func TestGarbageCollectionDisabled(t *testing.T) {
+	store := &gcStore{Store: kvstoretest.NewStore(), files: 3}
+	badgerHook := newHook(t, Options{Store: store, GCInterval: -1})
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, badgerHook.Stop())
+	require.Equal(t, 3, store.remaining())
+	require.True(t, store.Closed())
+}
+
+func TestStorage(t *testing.T) {
+	store := kvstoretest.NewStore()
+	badgerHook := newHook(t, Options{
+		Store: store,
+		Options: kvstore.Options{
+			SyncMode:   kvstore.SyncNever,
+			SessionTTL: time.Hour,
+		},
+	})
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 4
+	badgerHook.OnSessionEstablished(cl, packets.Packet{})
+	badgerHook.OnDisconnect(cl, nil, false)
+	require.Equal(t, time.Hour, store.TTL("CL_c1"))
+	require.Equal(t, []bool{false, false}, store.Commits())
+
+	clients, err := badgerHook.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+}
@@ -0,0 +1,434 @@
+// Package encrypt provides a hook which wraps a storage hook and encrypts the payloads of retained and
+// inflight messages and the will messages of clients with AES-GCM before the storage hook persists
+// them, decrypting them when the server restores its state. Topics, client ids and the other fields
+// are stored as they are, since storage hooks key records by them.
+//
+// The key is given directly, or read with KeyFromEnv, KeyFromFile or KeyFromKMS. KeyFromKMS decrypts a
+// data key with a key management service through a Decrypter, eg. for AWS KMS with aws-sdk-go-v2:
+//
+//	type decrypter struct {
+//		client *kms.Client
+//	}
+//
+//	func (d decrypter) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+//		out, err := d.client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: ciphertext})
+//		if err != nil {
+//			return nil, err
+//		}
+//		return out.Plaintext, nil
+//	}
+package encrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+)
+
+// magic starts every encrypted payload, followed by the id of the key, the nonce and the ciphertext
+var magic = []byte{'M', 'Q', 'E', 1}
+
+// keyIDSize is the size of the id of a key, which is the start of its SHA-256 hash
+const keyIDSize = 4
+
+// Hook is a hook that encrypts the payloads which the wrapped storage hook persists
+type Hook struct {
+	config Options
+	sealer cipher.AEAD            // encrypts with the key
+	keyID  []byte                 // the id of the key
+	keys   map[string]cipher.AEAD // decrypts with the key and the old keys, by id
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the encrypt hook
+type Options struct {
+	// Hook is the wrapped storage hook, initialized with Config. It is initialized and stopped by the
+	// encrypt hook, so must not also be added to the server
+	Hook   mqtt.Hook
+	Config any
+
+	// Key is the AES key payloads are encrypted with, of 16, 24 or 32 bytes
+	Key []byte
+
+	// OldKeys are keys which were replaced by Key, with which payloads stored before are decrypted
+	OldKeys [][]byte
+
+	// AllowPlaintext restores payloads which were not encrypted as they are, eg. those stored before
+	// the hook wrapped the storage hook. The server fails to restore them if false
+	AllowPlaintext bool
+}
+
+// Decrypter decrypts a data key with a key management service
+type Decrypter interface {
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// KeyFromEnv returns the base64 encoded key in the environment variable
+func KeyFromEnv(name string) ([]byte, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return decodeKey(v)
+}
+
+// KeyFromFile returns the base64 encoded key in the file, eg. one written by openssl rand -base64 32
+func KeyFromFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(string(b))
+}
+
+// KeyFromKMS returns the data key decrypted by the key management service
+func KeyFromKMS(ctx context.Context, kms Decrypter, encrypted []byte) ([]byte, error) {
+	key, err := kms.Decrypt(ctx, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	return key, nil
+}
+
+// decodeKey decodes a base64 encoded key
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return key, nil
+}
+
+// newAEAD returns the AES-GCM cipher of the key, and the id of the key
+func newAEAD(key []byte) (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sum := sha256.Sum256(key)
+	return aead, sum[:keyIDSize], nil
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "encrypt-storage-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook, which the wrapped hook must also
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnStopped,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b}) && h.config.Hook != nil && h.config.Hook.Provides(b)
+}
+
+// Init initializes the hook and the wrapped hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	encryptHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if encryptHookConfig.Hook == nil {
+		return errors.New("hook is required")
+	}
+
+	sealer, keyID, err := newAEAD(encryptHookConfig.Key)
+	if err != nil {
+		return fmt.Errorf("invalid key: %w", err)
+	}
+
+	keys := map[string]cipher.AEAD{string(keyID): sealer}
+	for i, key := range encryptHookConfig.OldKeys {
+		aead, id, err := newAEAD(key)
+		if err != nil {
+			return fmt.Errorf("invalid old key %d: %w", i, err)
+		}
+		keys[string(id)] = aead
+	}
+
+	encryptHookConfig.Hook.SetOpts(h.Log, h.Opts)
+	if err := encryptHookConfig.Hook.Init(encryptHookConfig.Config); err != nil {
+		return fmt.Errorf("failed initialising %s hook: %w", encryptHookConfig.Hook.ID(), err)
+	}
+
+	h.config = encryptHookConfig
+	h.sealer = sealer
+	h.keyID = keyID
+	h.keys = keys
+	return nil
+}
+
+// Stop stops the wrapped hook
+func (h *Hook) Stop() error {
+	if h.config.Hook == nil {
+		return nil
+	}
+	return h.config.Hook.Stop()
+}
+
+// seal encrypts the payload of a message of the topic. Empty payloads are left empty
+func (h *Hook) seal(payload []byte, topic string) ([]byte, error) {
+	if len(payload) == 0 {
+		return payload, nil
+	}
+
+	nonce := make([]byte, h.sealer.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(magic)+keyIDSize+len(nonce)+len(payload)+h.sealer.Overhead())
+	out = append(out, magic...)
+	out = append(out, h.keyID...)
+	out = append(out, nonce...)
+	return h.sealer.Seal(out, nonce, payload, []byte(topic)), nil
+}
+
+// open decrypts the payload of a message of the topic
+func (h *Hook) open(payload []byte, topic string) ([]byte, error) {
+	if len(payload) == 0 {
+		return payload, nil
+	}
+
+	if !bytes.HasPrefix(payload, magic) {
+		if h.config.AllowPlaintext {
+			return payload, nil
+		}
+		return nil, errors.New("payload is not encrypted")
+	}
+
+	rest := payload[len(magic):]
+	if len(rest) < keyIDSize {
+		return nil, errors.New("payload is truncated")
+	}
+
+	aead, ok := h.keys[string(rest[:keyIDSize])]
+	if !ok {
+		return nil, errors.New("payload is encrypted with an unknown key")
+	}
+
+	rest = rest[keyIDSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("payload is truncated")
+	}
+
+	data, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(topic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt payload: %w", err)
+	}
+	return data, nil
+}
+
+// sealClient returns a copy of the client with its will message encrypted, which the wrapped hook
+// stores. The copy has the id, connection details and properties of the client, but not its state
+func (h *Hook) sealClient(cl *mqtt.Client) (*mqtt.Client, error) {
+	props := cl.Properties
+	payload, err := h.seal(props.Will.Payload, props.Will.TopicName)
+	if err != nil {
+		return nil, err
+	}
+	props.Will.Payload = payload
+
+	return &mqtt.Client{
+		ID:         cl.ID,
+		Properties: props,
+		Net: mqtt.ClientConnection{
+			Remote:   cl.Net.Remote,
+			Listener: cl.Net.Listener,
+			Inline:   cl.Net.Inline,
+		},
+	}, nil
+}
+
+// OnStarted is called when the server has started
+func (h *Hook) OnStarted() {
+	h.config.Hook.OnStarted()
+}
+
+// OnStopped is called when the server has stopped
+func (h *Hook) OnStopped() {
+	h.config.Hook.OnStopped()
+}
+
+// OnSessionEstablished is called when a client has connected, and passes the client with its will
+// message encrypted to the wrapped hook
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	sealed, err := h.sealClient(cl)
+	if err != nil {
+		h.Log.Error("error occurred while encrypting will message", "error", err, "client", cl.ID)
+		return
+	}
+	h.config.Hook.OnSessionEstablished(sealed, pk)
+}
+
+// OnWillSent is called when the will message of a client has been sent, and passes the client with
+// its will message encrypted to the wrapped hook
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	sealed, err := h.sealClient(cl)
+	if err != nil {
+		h.Log.Error("error occurred while encrypting will message", "error", err, "client", cl.ID)
+		return
+	}
+	h.config.Hook.OnWillSent(sealed, pk)
+}
+
+// OnDisconnect is called when a client disconnects
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.config.Hook.OnDisconnect(cl, err, expire)
+}
+
+// OnClientExpired is called when the session of a client expires
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	h.config.Hook.OnClientExpired(cl)
+}
+
+// OnSubscribed is called when a client subscribes
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	h.config.Hook.OnSubscribed(cl, pk, reasonCodes)
+}
+
+// OnUnsubscribed is called when a client unsubscribes
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	h.config.Hook.OnUnsubscribed(cl, pk)
+}
+
+// OnRetainMessage is called when a message is retained, and passes it encrypted to the wrapped hook
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if r != -1 {
+		payload, err := h.seal(pk.Payload, pk.TopicName)
+		if err != nil {
+			h.Log.Error("error occurred while encrypting retained message", "error", err, "topic", pk.TopicName)
+			return
+		}
+		pk.Payload = payload
+	}
+	h.config.Hook.OnRetainMessage(cl, pk, r)
+}
+
+// OnRetainedExpired is called when a retained message expires
+func (h *Hook) OnRetainedExpired(topic string) {
+	h.config.Hook.OnRetainedExpired(topic)
+}
+
+// OnQosPublish is called when a QoS message is sent to a client, and passes it encrypted to the
+// wrapped hook
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	payload, err := h.seal(pk.Payload, pk.TopicName)
+	if err != nil {
+		h.Log.Error("error occurred while encrypting inflight message", "error", err, "client", cl.ID)
+		return
+	}
+	pk.Payload = payload
+	h.config.Hook.OnQosPublish(cl, pk, sent, resends)
+}
+
+// OnQosComplete is called when the QoS flow of a message completes
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	h.config.Hook.OnQosComplete(cl, pk)
+}
+
+// OnQosDropped is called when an inflight message is dropped
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.config.Hook.OnQosDropped(cl, pk)
+}
+
+// OnSysInfoTick is called when the system info is updated
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	h.config.Hook.OnSysInfoTick(sys)
+}
+
+// StoredClients returns the clients stored by the wrapped hook, with their will messages decrypted
+func (h *Hook) StoredClients() ([]storage.Client, error) {
+	clients, err := h.config.Hook.StoredClients()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range clients {
+		will := &clients[i].Will
+		if will.Payload, err = h.open(will.Payload, will.TopicName); err != nil {
+			return nil, fmt.Errorf("failed decrypting will message of client %s: %w", clients[i].ID, err)
+		}
+	}
+	return clients, nil
+}
+
+// StoredSubscriptions returns the subscriptions stored by the wrapped hook
+func (h *Hook) StoredSubscriptions() ([]storage.Subscription, error) {
+	return h.config.Hook.StoredSubscriptions()
+}
+
+// StoredRetainedMessages returns the retained messages stored by the wrapped hook, decrypted
+func (h *Hook) StoredRetainedMessages() ([]storage.Message, error) {
+	msgs, err := h.config.Hook.StoredRetainedMessages()
+	if err != nil {
+		return nil, err
+	}
+	return h.openMessages(msgs)
+}
+
+// StoredInflightMessages returns the inflight messages stored by the wrapped hook, decrypted
+func (h *Hook) StoredInflightMessages() ([]storage.Message, error) {
+	msgs, err := h.config.Hook.StoredInflightMessages()
+	if err != nil {
+		return nil, err
+	}
+	return h.openMessages(msgs)
+}
+
+// openMessages decrypts the payloads of the messages
+func (h *Hook) openMessages(msgs []storage.Message) ([]storage.Message, error) {
+	var err error
+	for i := range msgs {
+		if msgs[i].Payload, err = h.open(msgs[i].Payload, msgs[i].TopicName); err != nil {
+			return nil, fmt.Errorf("failed decrypting message %s: %w", msgs[i].ID, err)
+		}
+	}
+	return msgs, nil
+}
+
+// StoredSysInfo returns the system info stored by the wrapped hook
+func (h *Hook) StoredSysInfo() (storage.SystemInfo, error) {
+	return h.config.Hook.StoredSysInfo()
+}
@@ -0,0 +1,316 @@
+package encrypt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+	"github.com/mochi-mqtt/hooks/storage/tiered"
+)
+
+var (
+	key    = bytes.Repeat([]byte{1}, 32)
+	oldKey = bytes.Repeat([]byte{2}, 16)
+)
+
+// kms decrypts data keys by reversing them
+type kms struct {
+	err error
+}
+
+func (k kms) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+
+	out := make([]byte, len(ciphertext))
+	for i, b := range ciphertext {
+		out[len(out)-1-i] = b
+	}
+	return out, nil
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	encryptHook := new(Hook)
+	encryptHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, encryptHook.Init(options))
+	t.Cleanup(func() { encryptHook.Stop() })
+	return encryptHook
+}
+
+// stored returns whether any stored value contains the data
+func stored(t *testing.T, m *kvstore.Memory, data []byte) bool {
+	t.Helper()
+
+	var found bool
+	require.NoError(t, m.Iterate(nil, func(k, v []byte) error {
+		found = found || bytes.Contains(v, data)
+		return nil
+	}))
+	return found
+}
+
+func TestID(t *testing.T) {
+	encryptHook := new(Hook)
+
+	require.Equal(t, "encrypt-storage-hook", encryptHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	encryptHook := newHook(t, Options{Hook: new(tiered.Hook), Config: tiered.Options{Cold: kvstore.NewMemory()}, Key: key})
+
+	require.True(t, encryptHook.Provides(mqtt.OnRetainMessage))
+	require.True(t, encryptHook.Provides(mqtt.StoredClients))
+	require.False(t, encryptHook.Provides(mqtt.OnStopped))
+	require.False(t, encryptHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - key and old keys",
+			config:      Options{Hook: new(tiered.Hook), Config: tiered.Options{Cold: kvstore.NewMemory()}, Key: key, OldKeys: [][]byte{oldKey}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no hook",
+			config:      Options{Key: key},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid key",
+			config:      Options{Hook: new(tiered.Hook), Config: tiered.Options{Cold: kvstore.NewMemory()}, Key: []byte("short")},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid old key",
+			config:      Options{Hook: new(tiered.Hook), Config: tiered.Options{Cold: kvstore.NewMemory()}, Key: key, OldKeys: [][]byte{nil}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - wrapped hook fails",
+			config:      Options{Hook: new(tiered.Hook), Config: tiered.Options{}, Key: key},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			encryptHook := new(Hook)
+			encryptHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := encryptHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Len(t, encryptHook.keys, 2)
+				require.NoError(t, encryptHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestKeyFrom(t *testing.T) {
+	t.Setenv("MQTT_STORAGE_KEY", "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n")
+	k, err := KeyFromEnv("MQTT_STORAGE_KEY")
+	require.NoError(t, err)
+	require.Equal(t, key, k)
+
+	_, err = KeyFromEnv("MQTT_STORAGE_KEY_MISSING")
+	require.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(path, []byte("AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n"), 0o600))
+	k, err = KeyFromFile(path)
+	require.NoError(t, err)
+	require.Equal(t, key, k)
+
+	require.NoError(t, os.WriteFile(path, []byte("not base64!"), 0o600))
+	_, err = KeyFromFile(path)
+	require.Error(t, err)
+
+	_, err = KeyFromFile(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+
+	k, err = KeyFromKMS(context.Background(), kms{}, []byte{3, 2, 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, k)
+
+	_, err = KeyFromKMS(context.Background(), kms{err: errors.New("access denied")}, []byte{1})
+	require.Error(t, err)
+}
+
+func TestSealOpen(t *testing.T) {
+	old := newHook(t, Options{Hook: new(tiered.Hook), Config: tiered.Options{Cold: kvstore.NewMemory()}, Key: oldKey})
+	oldSealed, err := old.seal([]byte("hello"), "a/b")
+	require.NoError(t, err)
+
+	encryptHook := newHook(t, Options{Hook: new(tiered.Hook), Config: tiered.Options{Cold: kvstore.NewMemory()}, Key: key, OldKeys: [][]byte{oldKey}})
+	sealed, err := encryptHook.seal([]byte("hello"), "a/b")
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), "hello")
+
+	// every payload has its own nonce
+	again, err := encryptHook.seal([]byte("hello"), "a/b")
+	require.NoError(t, err)
+	require.NotEqual(t, sealed, again)
+
+	tests := []struct {
+		name        string
+		payload     []byte
+		topic       string
+		plaintext   bool
+		expect      []byte
+		expectError bool
+	}{
+		{
+			name:    "Success - encrypted payload",
+			payload: sealed,
+			topic:   "a/b",
+			expect:  []byte("hello"),
+		},
+		{
+			name:    "Success - encrypted with old key",
+			payload: oldSealed,
+			topic:   "a/b",
+			expect:  []byte("hello"),
+		},
+		{
+			name:    "Success - empty payload",
+			payload: []byte{},
+			topic:   "a/b",
+			expect:  []byte{},
+		},
+		{
+			name:      "Success - plaintext allowed",
+			payload:   []byte("hello"),
+			topic:     "a/b",
+			plaintext: true,
+			expect:    []byte("hello"),
+		},
+		{
+			name:        "Failure - plaintext",
+			payload:     []byte("hello"),
+			topic:       "a/b",
+			expectError: true,
+		},
+		{
+			name:        "Failure - other topic",
+			payload:     sealed,
+			topic:       "a/c",
+			expectError: true,
+		},
+		{
+			name:        "Failure - unknown key",
+			payload:     append(append([]byte{}, magic...), 0, 0, 0, 0, 1, 2, 3),
+			topic:       "a/b",
+			expectError: true,
+		},
+		{
+			name:        "Failure - truncated",
+			payload:     sealed[:len(magic)+keyIDSize+4],
+			topic:       "a/b",
+			expectError: true,
+		},
+		{
+			name:        "Failure - tampered",
+			payload:     append(append([]byte{}, sealed[:len(sealed)-1]...), sealed[len(sealed)-1]^1),
+			topic:       "a/b",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			encryptHook.config.AllowPlaintext = tt.plaintext
+			data, err := encryptHook.open(tt.payload, tt.topic)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.expect, data)
+			}
+
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	cold := kvstore.NewMemory()
+	options := Options{Hook: new(tiered.Hook), Config: tiered.Options{Cold: cold}, Key: key}
+	encryptHook := newHook(t, options)
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Will = mqtt.Will{Flag: 1, TopicName: "lwt", Payload: []byte("gone")}
+	encryptHook.OnSessionEstablished(cl, packets.Packet{})
+	encryptHook.OnRetainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+	}, 1)
+	encryptHook.OnQosPublish(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/c",
+		Origin:      "c1",
+		Payload:     []byte("secret"),
+		PacketID:    1,
+	}, 1, 0)
+	require.NoError(t, encryptHook.Stop())
+
+	// the payloads are only stored encrypted, and the live client is unchanged
+	require.False(t, stored(t, cold, []byte("hello")))
+	require.False(t, stored(t, cold, []byte("gone")))
+	require.False(t, stored(t, cold, []byte("secret")))
+	require.Equal(t, []byte("gone"), cl.Properties.Will.Payload)
+
+	options.Hook = new(tiered.Hook)
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, server.AddHook(new(Hook), options))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	restored, ok := server.Clients.Get("c1")
+	require.True(t, ok)
+	require.Equal(t, []byte("gone"), restored.Properties.Will.Payload)
+	require.Equal(t, []byte("secret"), restored.State.Inflight.GetAll(false)[0].Payload)
+	retained, ok := server.Topics.Retained.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), retained.Payload)
+
+	// the stored payloads can't be restored without the key
+	options.Hook = new(tiered.Hook)
+	options.Key = oldKey
+	failing := newHook(t, options)
+	_, err := failing.StoredRetainedMessages()
+	require.Error(t, err)
+}
@@ -0,0 +1,324 @@
+// Package gc provides a hook which periodically deletes expired retained and inflight messages from
+// the server and from the storage hook in use.
+//
+// The server only expires retained messages after its maximum message expiry interval, and only
+// expires the inflight messages of clients it holds, so the records of messages with a shorter MQTT 5
+// message expiry interval, and the inflight messages of sessions which were never restored, stay in
+// storage. The hook deletes them, and retained messages whose topics match a configured TTL, through
+// the events the storage hook deletes records on, so it works with any storage hook
+package gc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+
+	"github.com/mochi-mqtt/hooks/pkg/acl"
+	"github.com/mochi-mqtt/hooks/pkg/migrate"
+)
+
+// Kind is the kind of a deleted record
+type Kind int
+
+const (
+	Retained Kind = iota // a retained message
+	Inflight             // an inflight message
+)
+
+// String returns the name of the kind, eg. for metric labels
+func (k Kind) String() string {
+	if k == Inflight {
+		return "inflight"
+	}
+	return "retained"
+}
+
+// Metrics are called as expired records are deleted, eg. to export the space reclaimed. Unset funcs
+// are skipped
+type Metrics struct {
+	// Reclaimed is called for each deleted record, with its approximate size in bytes
+	Reclaimed func(kind Kind, size int)
+
+	// Swept is called after each sweep with how long it took and the error it failed with, if any
+	Swept func(took time.Duration, err error)
+}
+
+// Stats are the totals of the records deleted since the hook was initialized
+type Stats struct {
+	Sweeps   int64 // the number of sweeps
+	Retained int64 // the number of retained messages deleted
+	Inflight int64 // the number of inflight messages deleted
+	Bytes    int64 // the approximate size of the deleted records
+}
+
+// Hook is a hook that deletes expired messages from the server and from storage
+type Hook struct {
+	config Options
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	stats  Stats
+	now    func() time.Time
+	sweep  sync.Mutex // serializes sweeps
+	mu     sync.Mutex // guards stats
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the gc hook
+type Options struct {
+	// Server is the server whose expired retained messages are deleted
+	Server *mqtt.Server
+
+	// Storage is the storage hook whose expired records are deleted, which must also be added to
+	// the server
+	Storage mqtt.Hook
+
+	// Interval is how often expired messages are deleted, defaults to 1 minute
+	Interval time.Duration
+
+	// RetainedTTL maps topic filters to how long the retained messages of matching topics are kept
+	// after they were published, eg. {"sensors/#": time.Hour}. The shortest TTL of the filters
+	// matching a topic applies, and a message expiry interval shorter than it still applies
+	RetainedTTL map[string]time.Duration
+
+	Metrics Metrics
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "gc-storage-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	gcHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if gcHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if gcHookConfig.Storage == nil {
+		return errors.New("storage hook is required")
+	}
+
+	if gcHookConfig.Interval <= 0 {
+		gcHookConfig.Interval = time.Minute
+	}
+
+	for filter, ttl := range gcHookConfig.RetainedTTL {
+		if !mqtt.IsValidFilter(filter, false) {
+			return fmt.Errorf("invalid retained ttl filter %q", filter)
+		}
+
+		if ttl <= 0 {
+			return fmt.Errorf("retained ttl of %s must be positive", filter)
+		}
+	}
+
+	h.config = gcHookConfig
+	h.now = time.Now
+	return nil
+}
+
+// OnStarted is called when the server has started, once storage hooks have restored their records,
+// and starts deleting expired messages
+func (h *Hook) OnStarted() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	h.wg.Add(1)
+	go h.sweepEvery(ctx, h.config.Interval)
+}
+
+// Stop stops deleting expired messages
+func (h *Hook) Stop() error {
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.wg.Wait()
+	return nil
+}
+
+// sweepEvery deletes expired messages at the interval until the context is cancelled
+func (h *Hook) sweepEvery(ctx context.Context, interval time.Duration) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := h.Sweep(); err != nil {
+				h.Log.Error("error occurred while deleting expired messages", "error", err)
+			}
+		}
+	}
+}
+
+// Stats returns the totals of the records deleted so far
+func (h *Hook) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// Sweep deletes the expired messages once, returning what it deleted. It runs at the interval, and
+// may also be called directly, eg. from an admin endpoint
+func (h *Hook) Sweep() (Stats, error) {
+	h.sweep.Lock()
+	defer h.sweep.Unlock()
+
+	start := h.now()
+	swept := Stats{Sweeps: 1}
+	err := errors.Join(h.sweepRetained(start.Unix(), &swept), h.sweepInflight(start.Unix(), &swept))
+
+	h.mu.Lock()
+	h.stats.Sweeps += swept.Sweeps
+	h.stats.Retained += swept.Retained
+	h.stats.Inflight += swept.Inflight
+	h.stats.Bytes += swept.Bytes
+	h.mu.Unlock()
+
+	if h.config.Metrics.Swept != nil {
+		h.config.Metrics.Swept(h.now().Sub(start), err)
+	}
+
+	if swept.Retained > 0 || swept.Inflight > 0 {
+		h.Log.Debug("deleted expired messages", "retained", swept.Retained, "inflight", swept.Inflight, "bytes", swept.Bytes)
+	}
+	return swept, err
+}
+
+// sweepRetained deletes the expired retained messages of the server and of storage
+func (h *Hook) sweepRetained(now int64, swept *Stats) error {
+	retained := h.config.Server.Topics.Retained
+
+	// messages only held by the server, such as those which storage failed to write, have no record
+	stored := make(map[string]bool)
+	msgs, err := h.config.Storage.StoredRetainedMessages()
+	for _, msg := range msgs {
+		stored[msg.TopicName] = true
+		if pk, ok := retained.Get(msg.TopicName); ok && pk.Created != msg.Created {
+			continue // replaced since the record was read, and checked below
+		}
+
+		if !h.retainedExpired(msg.TopicName, msg.Created, msg.Properties.MessageExpiryInterval, now) {
+			continue
+		}
+
+		retained.Delete(msg.TopicName)
+		h.config.Storage.OnRetainedExpired(msg.TopicName)
+		h.reclaimed(Retained, msg, swept)
+	}
+
+	for topic, pk := range retained.GetAll() {
+		if stored[topic] || !h.retainedExpired(topic, pk.Created, pk.Properties.MessageExpiryInterval, now) {
+			continue
+		}
+
+		retained.Delete(topic)
+		h.config.Storage.OnRetainedExpired(topic)
+		h.reclaimed(Retained, storage.Message{TopicName: topic, Payload: pk.Payload}, swept)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed reading retained messages: %w", err)
+	}
+	return nil
+}
+
+// retainedExpired returns whether the retained message of the topic has expired
+func (h *Hook) retainedExpired(topic string, created int64, expiry uint32, now int64) bool {
+	if strings.HasPrefix(topic, "$") {
+		return false // $SYS topics are kept up to date by the server
+	}
+
+	var ttl time.Duration
+	for filter, d := range h.config.RetainedTTL {
+		if (ttl == 0 || d < ttl) && acl.Match(filter, topic) {
+			ttl = d
+		}
+	}
+
+	if expiry > 0 && (ttl == 0 || time.Duration(expiry)*time.Second < ttl) {
+		ttl = time.Duration(expiry) * time.Second
+	}
+
+	return ttl > 0 && created+int64(ttl/time.Second) <= now
+}
+
+// sweepInflight deletes the expired inflight messages of storage which the server doesn't hold, as
+// it expires those it holds itself
+func (h *Hook) sweepInflight(now int64, swept *Stats) error {
+	msgs, err := h.config.Storage.StoredInflightMessages()
+	if err != nil {
+		return fmt.Errorf("failed reading inflight messages: %w", err)
+	}
+
+	maximum := h.config.Server.Options.Capabilities.MaximumMessageExpiryInterval
+	for _, msg := range msgs {
+		expires := msg.Created + maximum
+		if msg.Properties.MessageExpiryInterval > 0 {
+			expires = msg.Created + int64(msg.Properties.MessageExpiryInterval)
+		}
+
+		if expires > now {
+			continue
+		}
+
+		id := migrate.Recipient(msg)
+		if cl, ok := h.config.Server.Clients.Get(id); ok {
+			if _, ok := cl.State.Inflight.Get(msg.PacketID); ok {
+				continue
+			}
+		}
+
+		h.config.Storage.OnQosDropped(&mqtt.Client{ID: id}, packets.Packet{PacketID: msg.PacketID})
+		h.reclaimed(Inflight, msg, swept)
+	}
+
+	return nil
+}
+
+// reclaimed counts a deleted record, whose size is approximated by its encoded size
+func (h *Hook) reclaimed(kind Kind, msg storage.Message, swept *Stats) {
+	size := len(msg.Payload)
+	if data, err := msg.MarshalBinary(); err == nil {
+		size = len(data)
+	}
+
+	if kind == Inflight {
+		swept.Inflight++
+	} else {
+		swept.Retained++
+	}
+	swept.Bytes += int64(size)
+
+	if h.config.Metrics.Reclaimed != nil {
+		h.config.Metrics.Reclaimed(kind, size)
+	}
+}
@@ -0,0 +1,336 @@
+package gc
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeStorage is a storage hook holding its records in maps
+type fakeStorage struct {
+	retained map[string]storage.Message
+	inflight map[string]storage.Message
+	err      error
+	mu       sync.Mutex
+	mqtt.HookBase
+}
+
+func newStorage() *fakeStorage {
+	return &fakeStorage{
+		retained: make(map[string]storage.Message),
+		inflight: make(map[string]storage.Message),
+	}
+}
+
+func (s *fakeStorage) ID() string {
+	return "fake-storage"
+}
+
+func (s *fakeStorage) Provides(b byte) bool {
+	return b == mqtt.StoredRetainedMessages || b == mqtt.StoredInflightMessages
+}
+
+func (s *fakeStorage) StoredRetainedMessages() ([]storage.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []storage.Message
+	for _, msg := range s.retained {
+		msgs = append(msgs, msg)
+	}
+	return msgs, s.err
+}
+
+func (s *fakeStorage) StoredInflightMessages() ([]storage.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []storage.Message
+	for _, msg := range s.inflight {
+		msgs = append(msgs, msg)
+	}
+	return msgs, s.err
+}
+
+func (s *fakeStorage) OnRetainedExpired(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.retained, topic)
+}
+
+func (s *fakeStorage) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, msg := range s.inflight {
+		if msg.PacketID == pk.PacketID && strings.HasPrefix(id, cl.ID+":") {
+			delete(s.inflight, id)
+		}
+	}
+}
+
+// retain stores a retained message, and retains it on the server unless stale
+func (s *fakeStorage) retain(server *mqtt.Server, topic string, created int64, expiry uint32, stale bool) {
+	msg := storage.Message{
+		ID:         "RET_" + topic,
+		T:          storage.RetainedKey,
+		TopicName:  topic,
+		Payload:    []byte("payload"),
+		Created:    created,
+		Properties: storage.MessageProperties{MessageExpiryInterval: expiry},
+	}
+	s.retained[topic] = msg
+
+	if !stale {
+		server.Topics.RetainMessage(msg.ToPacket())
+	}
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	gcHook := new(Hook)
+	gcHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, gcHook.Init(options))
+	t.Cleanup(func() { gcHook.Stop() })
+	return gcHook
+}
+
+func retainedTopics(server *mqtt.Server) []string {
+	var topics []string
+	for topic := range server.Topics.Retained.GetAll() {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func TestID(t *testing.T) {
+	gcHook := new(Hook)
+
+	require.Equal(t, "gc-storage-hook", gcHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	gcHook := new(Hook)
+
+	require.True(t, gcHook.Provides(mqtt.OnStarted))
+	require.False(t, gcHook.Provides(mqtt.OnRetainedExpired))
+}
+
+func TestKind(t *testing.T) {
+	require.Equal(t, "retained", Retained.String())
+	require.Equal(t, "inflight", Inflight.String())
+}
+
+func TestInit(t *testing.T) {
+	server := mqtt.New(nil)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - retained ttl",
+			config:      Options{Server: server, Storage: newStorage(), RetainedTTL: map[string]time.Duration{"sensors/#": time.Hour}},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{Storage: newStorage()},
+			expectError: true,
+		},
+		{
+			name:        "Failure - no storage",
+			config:      Options{Server: server},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Server: server, Storage: newStorage(), RetainedTTL: map[string]time.Duration{"a/#/b": time.Hour}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - ttl not positive",
+			config:      Options{Server: server, Storage: newStorage(), RetainedTTL: map[string]time.Duration{"a/#": 0}},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			gcHook := new(Hook)
+			err := gcHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, time.Minute, gcHook.config.Interval)
+			}
+
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	server := mqtt.New(nil)
+	server.Options.Capabilities.MaximumMessageExpiryInterval = 3600
+	store := newStorage()
+	unix := time.Now().Unix()
+
+	store.retain(server, "a/expired", unix-120, 60, false)
+	store.retain(server, "a/fresh", unix-10, 60, false)
+	store.retain(server, "a/kept", unix-7200, 0, false)
+	store.retain(server, "sensors/expired", unix-7200, 0, false)
+	store.retain(server, "sensors/short", unix-600, 300, false)
+	store.retain(server, "sensors/fresh", unix-60, 0, false)
+	store.retain(server, "stale", unix-120, 60, true)
+	server.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "memory/only",
+		Payload:     []byte("payload"),
+		Created:     unix - 120,
+		Properties:  packets.Properties{MessageExpiryInterval: 60},
+	})
+
+	// inflight messages expire after the maximum message expiry interval of the server, unless their
+	// own interval is shorter, and those of clients held by the server are left to it
+	store.inflight["c1:1"] = storage.Message{ID: "c1:1", T: storage.InflightKey, PacketID: 1, Created: unix - 7200}
+	store.inflight["c1:2"] = storage.Message{ID: "c1:2", T: storage.InflightKey, PacketID: 2, Created: unix - 120, Properties: storage.MessageProperties{MessageExpiryInterval: 60}}
+	store.inflight["c1:3"] = storage.Message{ID: "c1:3", T: storage.InflightKey, PacketID: 3, Created: unix - 120}
+	store.inflight["c2:4"] = storage.Message{ID: "c2:4", T: storage.InflightKey, PacketID: 4, Created: unix - 7200}
+	cl := server.NewClient(nil, "tcp", "c2", false)
+	cl.State.Inflight.Set(packets.Packet{PacketID: 4})
+	server.Clients.Add(cl)
+
+	var reclaimed []Kind
+	var size int
+	var swept int
+	gcHook := newHook(t, Options{
+		Server:      server,
+		Storage:     store,
+		RetainedTTL: map[string]time.Duration{"sensors/#": time.Hour, "sensors/short": time.Minute},
+		Metrics: Metrics{
+			Reclaimed: func(kind Kind, n int) {
+				reclaimed = append(reclaimed, kind)
+				size += n
+			},
+			Swept: func(took time.Duration, err error) {
+				require.NoError(t, err)
+				swept++
+			},
+		},
+	})
+
+	stats, err := gcHook.Sweep()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Sweeps)
+	require.Equal(t, int64(5), stats.Retained)
+	require.Equal(t, int64(2), stats.Inflight)
+	require.Equal(t, int64(size), stats.Bytes)
+	require.Greater(t, stats.Bytes, int64(0))
+	require.Len(t, reclaimed, 7)
+	require.Equal(t, 1, swept)
+
+	require.Equal(t, []string{"a/fresh", "a/kept", "sensors/fresh"}, retainedTopics(server))
+	require.Len(t, store.retained, 3)
+	require.Contains(t, store.retained, "a/fresh")
+	require.NotContains(t, store.retained, "stale")
+	require.Len(t, store.inflight, 2)
+	require.Contains(t, store.inflight, "c1:3")
+	require.Contains(t, store.inflight, "c2:4")
+
+	// nothing is left to delete, and the stats are totalled
+	stats, err = gcHook.Sweep()
+	require.NoError(t, err)
+	require.Equal(t, Stats{Sweeps: 1}, stats)
+	require.Equal(t, Stats{Sweeps: 2, Retained: 5, Inflight: 2, Bytes: int64(size)}, gcHook.Stats())
+}
+
+func TestSweepReplaced(t *testing.T) {
+	server := mqtt.New(nil)
+	store := newStorage()
+	unix := time.Now().Unix()
+
+	// the record was replaced on the server by a message which hasn't expired
+	store.retain(server, "a", unix-120, 60, true)
+	server.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a",
+		Payload:     []byte("payload"),
+		Created:     unix,
+		Properties:  packets.Properties{MessageExpiryInterval: 60},
+	})
+
+	stats, err := newHook(t, Options{Server: server, Storage: store}).Sweep()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), stats.Retained)
+	require.Equal(t, []string{"a"}, retainedTopics(server))
+}
+
+func TestSweepError(t *testing.T) {
+	server := mqtt.New(nil)
+	store := newStorage()
+	store.err = errors.New("unavailable")
+	server.Topics.RetainMessage(packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a",
+		Payload:     []byte("payload"),
+		Created:     time.Now().Unix() - 120,
+		Properties:  packets.Properties{MessageExpiryInterval: 60},
+	})
+
+	var failed error
+	gcHook := newHook(t, Options{Server: server, Storage: store, Metrics: Metrics{
+		Swept: func(took time.Duration, err error) { failed = err },
+	}})
+
+	// the messages of the server are still deleted
+	stats, err := gcHook.Sweep()
+	require.ErrorContains(t, err, "unavailable")
+	require.Equal(t, err, failed)
+	require.Equal(t, int64(1), stats.Retained)
+	require.Empty(t, retainedTopics(server))
+}
+
+func TestOnStarted(t *testing.T) {
+	server := mqtt.New(nil)
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	store := newStorage()
+	store.retain(server, "a", time.Now().Unix()-120, 60, false)
+
+	gcHook := new(Hook)
+	require.NoError(t, server.AddHook(store, nil))
+	require.NoError(t, server.AddHook(gcHook, Options{Server: server, Storage: store, Interval: 10 * time.Millisecond}))
+	require.NoError(t, server.Serve())
+
+	require.Eventually(t, func() bool {
+		return gcHook.Stats().Retained == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, server.Close())
+
+	sweeps := gcHook.Stats().Sweeps
+	time.Sleep(30 * time.Millisecond)
+	require.Equal(t, sweeps, gcHook.Stats().Sweeps)
+}
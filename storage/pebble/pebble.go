@@ -0,0 +1,155 @@
+// Package pebble provides a storage hook persisting the state of the server to Pebble, the LSM engine
+// of CockroachDB, which suits brokers writing more than bbolt can keep up with. The database is opened
+// by the application, with the pebble.Options tuning its compactions, and given to the hook through a
+// kvstore.Store adapter, eg. for pebble v1:
+//
+//	type store struct{ *pebble.DB }
+//
+//	func (s store) NewBatch() kvstore.Batch {
+//		return batch{s.DB.NewBatch()}
+//	}
+//
+//	func (s store) Get(key []byte) ([]byte, error) {
+//		value, closer, err := s.DB.Get(key)
+//		if errors.Is(err, pebble.ErrNotFound) {
+//			return nil, nil
+//		} else if err != nil {
+//			return nil, err
+//		}
+//		defer closer.Close()
+//		return append([]byte(nil), value...), nil
+//	}
+//
+//	func (s store) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+//		upper := append(prefix[:len(prefix)-1:len(prefix)-1], prefix[len(prefix)-1]+1)
+//		it, err := s.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: upper})
+//		if err != nil {
+//			return err
+//		}
+//		defer it.Close()
+//		for it.First(); it.Valid(); it.Next() {
+//			if err := fn(it.Key(), it.Value()); err != nil {
+//				return err
+//			}
+//		}
+//		return it.Error()
+//	}
+//
+//	func (s store) Sync() error {
+//		return s.LogData(nil, pebble.Sync)
+//	}
+//
+//	type batch struct{ *pebble.Batch }
+//
+//	func (b batch) Set(key, value []byte, ttl time.Duration) error {
+//		return b.Batch.Set(key, value, nil)
+//	}
+//
+//	func (b batch) Delete(key []byte) error {
+//		return b.Batch.Delete(key, nil)
+//	}
+//
+//	func (b batch) Commit(sync bool) error {
+//		defer b.Close()
+//		if sync {
+//			return b.Batch.Commit(pebble.Sync)
+//		}
+//		return b.Batch.Commit(pebble.NoSync)
+//	}
+//
+//	func (b batch) Discard() {
+//		b.Close()
+//	}
+//
+// Close and Compact are those of the *pebble.DB. The writes of each event are committed as one batch,
+// which pebble applies atomically from its write-ahead log after a crash
+package pebble
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+)
+
+// Compacter is implemented by stores which compact a range of keys on demand, such as *pebble.DB
+type Compacter interface {
+	// Compact compacts the keys from start inclusive to end exclusive, with several goroutines if
+	// parallelize is true
+	Compact(start, end []byte, parallelize bool) error
+}
+
+// Hook is a hook that persists clients, subscriptions, retained and inflight messages and system info
+// to Pebble, from which the server restores them when it starts
+type Hook struct {
+	config Options
+	kvstore.Storage
+}
+
+// Options is a struct that contains all the information required to configure the pebble hook
+type Options struct {
+	// Store is the adapter of the open database, which the hook closes when it stops
+	Store kvstore.Store
+
+	kvstore.Options // when writes are synced, and how long sessions are kept
+
+	// CompactInterval is how often the records are compacted, if the store is a Compacter, dropping the
+	// tombstones left by completed inflight messages and expired sessions sooner than the compactions
+	// pebble schedules itself. They are not compacted by the hook if 0
+	CompactInterval time.Duration
+
+	// CompactParallel compacts with several goroutines, finishing sooner at the cost of more of the
+	// resources of the broker
+	CompactParallel bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "pebble-storage-hook"
+}
+
+// Init initializes the hook with the given config, and starts compacting the records
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	pebbleHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if pebbleHookConfig.CompactInterval < 0 {
+		return errors.New("compact interval must not be negative")
+	}
+
+	if err := h.Open(pebbleHookConfig.Store, pebbleHookConfig.Options); err != nil {
+		return err
+	}
+
+	h.config = pebbleHookConfig
+	if c, ok := pebbleHookConfig.Store.(Compacter); ok && pebbleHookConfig.CompactInterval > 0 {
+		h.Every(pebbleHookConfig.CompactInterval, func() {
+			h.compact(c)
+		})
+	}
+
+	return nil
+}
+
+// compact compacts the keys of the records
+func (h *Hook) compact(c Compacter) {
+	start, end := kvstore.KeyRange()
+	began := time.Now()
+	if err := c.Compact(start, end, h.config.CompactParallel); err != nil {
+		h.Log.Error("error occurred while compacting store", "error", err)
+		return
+	}
+
+	h.Log.Debug("compacted store", "took", time.Since(began))
+}
+
+// Stop stops compacting, syncs the writes and closes the store
+func (h *Hook) Stop() error {
+	return h.Close()
+}
@@ -0,0 +1,160 @@
+package pebble
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+	"github.com/mochi-mqtt/hooks/pkg/kvstore/kvstoretest"
+)
+
+// compactStore records the ranges it compacts
+type compactStore struct {
+	*kvstoretest.Store
+	err      error
+	ranges   [][2]string
+	parallel bool
+	mu       sync.Mutex
+}
+
+func (s *compactStore) Compact(start, end []byte, parallelize bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ranges = append(s.ranges, [2]string{string(start), string(end)})
+	s.parallel = parallelize
+	return s.err
+}
+
+func (s *compactStore) compactions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ranges)
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	pebbleHook := new(Hook)
+	pebbleHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, pebbleHook.Init(options))
+	t.Cleanup(func() { pebbleHook.Stop() })
+	return pebbleHook
+}
+
+func TestID(t *testing.T) {
+	pebbleHook := new(Hook)
+
+	require.Equal(t, "pebble-storage-hook", pebbleHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	pebbleHook := new(Hook)
+	require.True(t, pebbleHook.Provides(mqtt.OnQosComplete))
+	require.True(t, pebbleHook.Provides(mqtt.StoredRetainedMessages))
+	require.False(t, pebbleHook.Provides(mqtt.OnConnectAuthenticate))
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - store",
+			config:      Options{Store: kvstoretest.NewStore()},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no store",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - negative compact interval",
+			config:      Options{Store: kvstoretest.NewStore(), CompactInterval: -time.Second},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			pebbleHook := new(Hook)
+			err := pebbleHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.NoError(t, pebbleHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	store := &compactStore{Store: kvstoretest.NewStore()}
+	newHook(t, Options{Store: store, CompactInterval: time.Millisecond, CompactParallel: true})
+
+	require.Eventually(t, func() bool {
+		return store.compactions() > 0
+	}, time.Second, time.Millisecond)
+
+	start, end := kvstore.KeyRange()
+	store.mu.Lock()
+	require.Equal(t, [2]string{string(start), string(end)}, store.ranges[0])
+	require.True(t, store.parallel)
+	store.err = errors.New("compaction cancelled")
+	store.mu.Unlock()
+
+	// failed compactions are logged and retried at the next interval
+	n := store.compactions()
+	require.Eventually(t, func() bool {
+		return store.compactions() > n
+	}, time.Second, time.Millisecond)
+}
+
+func TestCompactDisabled(t *testing.T) {
+	store := &compactStore{Store: kvstoretest.NewStore()}
+	pebbleHook := newHook(t, Options{Store: store})
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, pebbleHook.Stop())
+	require.Zero(t, store.compactions())
+	require.True(t, store.Closed())
+}
+
+func TestStorage(t *testing.T) {
+	store := kvstoretest.NewStore()
+	pebbleHook := newHook(t, Options{Store: store})
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}
+	pebbleHook.OnQosPublish(cl, pk, 1, 0)
+	require.Equal(t, []string{"IFM_c1:1"}, store.Keys("IFM_"))
+	pebbleHook.OnQosComplete(cl, pk)
+	require.Empty(t, store.Keys("IFM_"))
+
+	// every batch is synced by default, so it survives a crash
+	require.Equal(t, []bool{true, true}, store.Commits())
+}
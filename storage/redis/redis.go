@@ -0,0 +1,472 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+
+	"github.com/mochi-mqtt/hooks/pkg/coalesce"
+	"github.com/mochi-mqtt/hooks/pkg/records"
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// DefaultPrefix is the prefix of the keys, whose hash tag keeps every key in the same slot of a
+// cluster, so the writes of an event can be pipelined to one node
+const DefaultPrefix = "{mochi}:"
+
+// the keys of the hashes holding each kind of record, after the prefix
+const (
+	clientsKey       = "clients"
+	subscriptionsKey = "subscriptions"
+	retainedKey      = "retained"
+	inflightKey      = "inflight"
+	sysInfoKey       = "sysinfo"
+)
+
+// Hook is a hook that persists clients, subscriptions, retained and inflight messages and system info
+// to Redis, from which the server restores them when it starts, eg. after a restart or on a standby
+// broker sharing the same Redis
+type Hook struct {
+	config   Options
+	client   redisclient.Client
+	writes   *coalesce.Coalescer[[]any] // commands waiting to be flushed, if writes are batched
+	restored restored
+	mqtt.HookBase
+}
+
+// restored counts the records returned to the server when it started
+type restored struct {
+	clients       int
+	subscriptions int
+	retained      int
+	inflight      int
+}
+
+// Options is a struct that contains all the information required to configure the redis storage hook
+type Options struct {
+	redisclient.ClientOptions // how to connect to the server, cluster or sentinels
+
+	// Client is used instead of connecting with the ClientOptions, eg. to use another Redis client library
+	Client redisclient.Client
+
+	// Prefix is prepended to every key, defaults to DefaultPrefix. On a cluster, it should contain a
+	// {hash tag} so the writes of an event are pipelined
+	Prefix string
+
+	// FlushInterval batches the writes of events and pipelines them at the interval, or once
+	// BatchSize commands are waiting, which defaults to 1000. A write replaces the pending write of the
+	// same record, so eg. a message completed before it was flushed is never written. Batching trades
+	// the writes of the last interval on a crash for fewer round trips. Each event is written as it
+	// happens if 0
+	FlushInterval time.Duration
+	BatchSize     int
+
+	// MaxPending is how many commands may wait to be flushed, defaults to 10 times BatchSize. Writes
+	// wait for a flush to make space for up to MaxWait, which defaults to 5 seconds, and are dropped after
+	MaxPending int
+	MaxWait    time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "redis-storage-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config, and checks that Redis can be reached
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	redisHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if redisHookConfig.Prefix == "" {
+		redisHookConfig.Prefix = DefaultPrefix
+	}
+
+	if redisHookConfig.Timeout <= 0 {
+		redisHookConfig.Timeout = 5 * time.Second
+	}
+
+	if redisHookConfig.BatchSize <= 0 {
+		redisHookConfig.BatchSize = 1000
+	}
+
+	client := redisHookConfig.Client
+	if client == nil {
+		var err error
+		if client, err = redisclient.NewClient(redisHookConfig.ClientOptions); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisHookConfig.Timeout)
+	defer cancel()
+	if _, err := client.Do(ctx, "PING"); err != nil {
+		client.Close()
+		return fmt.Errorf("failed to ping redis: %w", err)
+	}
+
+	h.config = redisHookConfig
+	h.client = client
+
+	if redisHookConfig.FlushInterval > 0 {
+		h.writes = coalesce.New(coalesce.Options{
+			MaxBatch:   redisHookConfig.BatchSize,
+			Interval:   redisHookConfig.FlushInterval,
+			Timeout:    redisHookConfig.Timeout,
+			MaxPending: redisHookConfig.MaxPending,
+			MaxWait:    redisHookConfig.MaxWait,
+		}, h.pipeline, func(err error) {
+			h.Log.Error("error occurred while flushing writes to redis", "error", err)
+		})
+		h.writes.Start()
+	}
+
+	return nil
+}
+
+// Stop writes the batched commands and closes the connections of the client
+func (h *Hook) Stop() error {
+	var err error
+	if h.writes != nil {
+		err = h.writes.Stop()
+	}
+
+	if h.client == nil {
+		return err
+	}
+	return errors.Join(err, h.client.Close())
+}
+
+// Flush writes the batched commands in pipelines of BatchSize commands. Commands which fail are
+// retried by the next flush, unless their records were written again since
+func (h *Hook) Flush() error {
+	if h.writes == nil {
+		return nil
+	}
+	return h.writes.Flush()
+}
+
+// pipeline runs a batch of commands in one pipeline
+func (h *Hook) pipeline(ctx context.Context, cmds [][]any) error {
+	_, err := redisclient.Pipeline(ctx, h.client, cmds...)
+	return err
+}
+
+// write runs the commands of an event in one pipeline, or batches them if writes are batched
+func (h *Hook) write(what string, cmds ...[]any) {
+	if len(cmds) == 0 {
+		return
+	}
+
+	if h.writes != nil {
+		for _, cmd := range cmds {
+			if err := h.writes.Add(recordKey(cmd), cmd); err != nil {
+				h.Log.Error("error occurred while writing "+what+" to redis", "error", err)
+			}
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	if _, err := redisclient.Pipeline(ctx, h.client, cmds...); err != nil {
+		h.Log.Error("error occurred while writing "+what+" to redis", "error", err)
+	}
+}
+
+// key returns the key of the hash holding a kind of record
+func (h *Hook) key(name string) string {
+	return h.config.Prefix + name
+}
+
+// set returns the command storing the record in the hash
+func (h *Hook) set(hash, field string, record interface{ MarshalBinary() ([]byte, error) }) ([]any, error) {
+	data, err := record.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return []any{"HSET", h.key(hash), field, data}, nil
+}
+
+// del returns the command deleting the field of the hash
+func (h *Hook) del(hash, field string) []any {
+	return []any{"HDEL", h.key(hash), field}
+}
+
+// recordKey returns the key of the record written by a command, which is the field of the hash for
+// HSET and HDEL, so the pending write of a record is replaced by its next write
+func recordKey(cmd []any) string {
+	if len(cmd) > 2 && (cmd[0] == "HSET" || cmd[0] == "HDEL") {
+		return cmd[1].(string) + "\x00" + cmd[2].(string)
+	}
+	return cmd[1].(string)
+}
+
+// OnStarted is called once the server has restored the stored records, and logs how many were restored
+func (h *Hook) OnStarted() {
+	h.Log.Info("restored state from redis",
+		"clients", h.restored.clients,
+		"subscriptions", h.restored.subscriptions,
+		"retained", h.restored.retained,
+		"inflight", h.restored.inflight)
+}
+
+// OnSessionEstablished is called when a client has connected, and stores the client
+func (h *Hook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent is called when the will message of a client has been sent, and stores the client
+// without it
+func (h *Hook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// updateClient stores the client
+func (h *Hook) updateClient(cl *mqtt.Client) {
+	cmd, err := h.set(clientsKey, cl.ID, records.Client(cl))
+	if err != nil {
+		h.Log.Error("error occurred while encoding client", "error", err, "client", cl.ID)
+		return
+	}
+	h.write("client", cmd)
+}
+
+// OnDisconnect is called when a client disconnects, and deletes it if its session has expired,
+// unless the session was taken over by a new connection
+func (h *Hook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	if !expire || errors.Is(cl.StopCause(), packets.ErrSessionTakenOver) {
+		return
+	}
+	h.write("client", h.del(clientsKey, cl.ID))
+}
+
+// OnClientExpired is called when the session of a client expires, and deletes the client
+func (h *Hook) OnClientExpired(cl *mqtt.Client) {
+	h.write("client", h.del(clientsKey, cl.ID))
+}
+
+// OnSubscribed is called when a client subscribes, and stores its subscriptions
+func (h *Hook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	var cmds [][]any
+	for _, sub := range records.Subscriptions(cl, pk, reasonCodes) {
+		cmd, err := h.set(subscriptionsKey, sub.ID, sub)
+		if err != nil {
+			h.Log.Error("error occurred while encoding subscription", "error", err, "client", cl.ID, "filter", sub.Filter)
+			continue
+		}
+		cmds = append(cmds, cmd)
+	}
+	h.write("subscriptions", cmds...)
+}
+
+// OnUnsubscribed is called when a client unsubscribes, and deletes its subscriptions
+func (h *Hook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	var cmds [][]any
+	for _, f := range pk.Filters {
+		cmds = append(cmds, h.del(subscriptionsKey, records.SubscriptionID(cl, f.Filter)))
+	}
+	h.write("subscriptions", cmds...)
+}
+
+// OnRetainMessage is called when a message is retained, and stores it, or deletes the retained
+// message of the topic if it was cleared
+func (h *Hook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if r == -1 {
+		h.write("retained message", h.del(retainedKey, pk.TopicName))
+		return
+	}
+
+	cmd, err := h.set(retainedKey, pk.TopicName, records.Retained(pk))
+	if err != nil {
+		h.Log.Error("error occurred while encoding retained message", "error", err, "topic", pk.TopicName)
+		return
+	}
+	h.write("retained message", cmd)
+}
+
+// OnRetainedExpired is called when a retained message expires, and deletes it
+func (h *Hook) OnRetainedExpired(topic string) {
+	h.write("retained message", h.del(retainedKey, topic))
+}
+
+// OnQosPublish is called when a QoS message is sent to a client, and stores it until it completes
+func (h *Hook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	cmd, err := h.set(inflightKey, records.InflightID(cl, pk), records.Inflight(cl, pk, sent))
+	if err != nil {
+		h.Log.Error("error occurred while encoding inflight message", "error", err, "client", cl.ID)
+		return
+	}
+	h.write("inflight message", cmd)
+}
+
+// OnQosComplete is called when the QoS flow of a message completes, and deletes it
+func (h *Hook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	h.write("inflight message", h.del(inflightKey, records.InflightID(cl, pk)))
+}
+
+// OnQosDropped is called when an inflight message is dropped, and deletes it
+func (h *Hook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.OnQosComplete(cl, pk)
+}
+
+// OnSysInfoTick is called when the system info is updated, and stores it
+func (h *Hook) OnSysInfoTick(sys *system.Info) {
+	data, err := records.SysInfo(sys).MarshalBinary()
+	if err != nil {
+		h.Log.Error("error occurred while encoding system info", "error", err)
+		return
+	}
+	h.write("system info", []any{"SET", h.key(sysInfoKey), data})
+}
+
+// values returns the records of the hash
+func (h *Hook) values(hash string) ([][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	reply, err := h.client.Do(ctx, "HVALS", h.key(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	items, _ := reply.([]any)
+	values := make([][]byte, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected reply %T", item)
+		}
+		values = append(values, []byte(s))
+	}
+	return values, nil
+}
+
+// StoredClients returns the stored clients, which the server restores when it starts
+func (h *Hook) StoredClients() ([]storage.Client, error) {
+	values, err := h.values(clientsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]storage.Client, 0, len(values))
+	for _, data := range values {
+		var cl storage.Client
+		if err := cl.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("failed decoding client: %w", err)
+		}
+		clients = append(clients, cl)
+	}
+	h.restored.clients = len(clients)
+	return clients, nil
+}
+
+// StoredSubscriptions returns the stored subscriptions
+func (h *Hook) StoredSubscriptions() ([]storage.Subscription, error) {
+	values, err := h.values(subscriptionsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	subs := make([]storage.Subscription, 0, len(values))
+	for _, data := range values {
+		var sub storage.Subscription
+		if err := sub.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("failed decoding subscription: %w", err)
+		}
+		subs = append(subs, sub)
+	}
+	h.restored.subscriptions = len(subs)
+	return subs, nil
+}
+
+// StoredRetainedMessages returns the stored retained messages
+func (h *Hook) StoredRetainedMessages() ([]storage.Message, error) {
+	msgs, err := h.messages(retainedKey)
+	h.restored.retained = len(msgs)
+	return msgs, err
+}
+
+// StoredInflightMessages returns the stored inflight messages
+func (h *Hook) StoredInflightMessages() ([]storage.Message, error) {
+	msgs, err := h.messages(inflightKey)
+	h.restored.inflight = len(msgs)
+	return msgs, err
+}
+
+// messages returns the messages stored in the hash
+func (h *Hook) messages(hash string) ([]storage.Message, error) {
+	values, err := h.values(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]storage.Message, 0, len(values))
+	for _, data := range values {
+		var msg storage.Message
+		if err := msg.UnmarshalBinary(data); err != nil {
+			return nil, fmt.Errorf("failed decoding message: %w", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// StoredSysInfo returns the stored system info
+func (h *Hook) StoredSysInfo() (storage.SystemInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	var info storage.SystemInfo
+	reply, err := h.client.Do(ctx, "GET", h.key(sysInfoKey))
+	if err != nil || reply == nil {
+		return info, err
+	}
+
+	s, ok := reply.(string)
+	if !ok {
+		return info, fmt.Errorf("unexpected reply %T", reply)
+	}
+
+	if err := info.UnmarshalBinary([]byte(s)); err != nil {
+		return info, fmt.Errorf("failed decoding system info: %w", err)
+	}
+	return info, nil
+}
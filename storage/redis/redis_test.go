@@ -0,0 +1,419 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/mochi-mqtt/server/v2/system"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// fakeClient keeps strings and hashes in memory
+type fakeClient struct {
+	strings map[string]string
+	hashes  map[string]map[string]string
+	err     error
+	closed  bool
+	mu      sync.Mutex
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		strings: map[string]string{},
+		hashes:  map[string]map[string]string{},
+	}
+}
+
+func (c *fakeClient) Do(ctx context.Context, args ...any) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if args[0] == "PING" {
+		return "PONG", nil
+	}
+
+	key := args[1].(string)
+	switch args[0] {
+	case "SET":
+		c.strings[key] = string(args[2].([]byte))
+		return "OK", nil
+	case "GET":
+		if v, ok := c.strings[key]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "HSET":
+		if c.hashes[key] == nil {
+			c.hashes[key] = map[string]string{}
+		}
+		c.hashes[key][args[2].(string)] = string(args[3].([]byte))
+		return int64(1), nil
+	case "HDEL":
+		for _, f := range args[2:] {
+			delete(c.hashes[key], f.(string))
+		}
+		return int64(1), nil
+	case "HVALS":
+		out := []any{}
+		for _, v := range c.hashes[key] {
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	return nil, redisclient.Error("ERR unknown command")
+}
+
+func (c *fakeClient) Close() error {
+	c.closed = true
+	return nil
+}
+
+// fields returns the fields of the hash
+func (c *fakeClient) fields(key string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var fields []string
+	for f := range c.hashes[key] {
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	redisHook := new(Hook)
+	redisHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, redisHook.Init(options))
+	t.Cleanup(func() { redisHook.Stop() })
+	return redisHook
+}
+
+func newClient(id string) *mqtt.Client {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", id, false)
+	cl.Properties.Username = []byte("alice")
+	cl.Properties.ProtocolVersion = 5
+	return cl
+}
+
+func TestID(t *testing.T) {
+	redisHook := new(Hook)
+
+	require.Equal(t, "redis-storage-hook", redisHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	redisHook := new(Hook)
+	require.True(t, redisHook.Provides(mqtt.OnStarted))
+	require.True(t, redisHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, redisHook.Provides(mqtt.OnQosPublish))
+	require.True(t, redisHook.Provides(mqtt.StoredClients))
+	require.True(t, redisHook.Provides(mqtt.StoredSysInfo))
+	require.False(t, redisHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	unreachable := newFakeClient()
+	unreachable.err = errors.New("connection refused")
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - client",
+			config:      Options{Client: newFakeClient()},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no addresses",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unreachable",
+			config:      Options{Client: unreachable},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			redisHook := new(Hook)
+			err := redisHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, DefaultPrefix, redisHook.config.Prefix)
+				require.Equal(t, 5*time.Second, redisHook.config.Timeout)
+			}
+
+		})
+	}
+
+	require.True(t, unreachable.closed)
+}
+
+func TestClients(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client, Prefix: "test:"})
+
+	cl := newClient("c1")
+	cl.Properties.Props.SessionExpiryInterval = 60
+	cl.Properties.Will = mqtt.Will{TopicName: "lwt", Payload: []byte("gone")}
+	redisHook.OnSessionEstablished(cl, packets.Packet{})
+	require.Equal(t, []string{"c1"}, client.fields("test:clients"))
+
+	clients, err := redisHook.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	require.Equal(t, "c1", clients[0].ID)
+	require.Equal(t, storage.ClientKey, clients[0].T)
+	require.Equal(t, []byte("alice"), clients[0].Username)
+	require.Equal(t, uint32(60), clients[0].Properties.SessionExpiryInterval)
+	require.Equal(t, "lwt", clients[0].Will.TopicName)
+
+	// sessions which are kept, or taken over, aren't deleted
+	redisHook.OnDisconnect(cl, nil, false)
+	require.Len(t, client.fields("test:clients"), 1)
+
+	cl.Stop(packets.ErrSessionTakenOver)
+	redisHook.OnDisconnect(cl, nil, true)
+	require.Len(t, client.fields("test:clients"), 1)
+
+	redisHook.OnDisconnect(newClient("c1"), nil, true)
+	require.Empty(t, client.fields("test:clients"))
+
+	redisHook.OnSessionEstablished(cl, packets.Packet{})
+	redisHook.OnClientExpired(cl)
+	require.Empty(t, client.fields("test:clients"))
+}
+
+func TestSubscriptions(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client})
+
+	cl := newClient("c1")
+	redisHook.OnSubscribed(cl, packets.Packet{
+		Filters: packets.Subscriptions{
+			{Filter: "a/b", Qos: 1, Identifier: 7},
+			{Filter: "c/#", Qos: 2},
+			{Filter: "denied"},
+		},
+	}, []byte{1, 2, packets.ErrNotAuthorized.Code})
+
+	subs, err := redisHook.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.ElementsMatch(t, []string{"c1:a/b", "c1:c/#"}, client.fields(DefaultPrefix+"subscriptions"))
+	for _, sub := range subs {
+		require.Equal(t, "c1", sub.Client)
+		if sub.Filter == "a/b" {
+			require.Equal(t, byte(1), sub.Qos)
+			require.Equal(t, 7, sub.Identifier)
+		}
+	}
+
+	redisHook.OnUnsubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/b"}, {Filter: "c/#"}}})
+	require.Empty(t, client.fields(DefaultPrefix+"subscriptions"))
+}
+
+func TestRetainedMessages(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client})
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+		Created:     time.Now().Unix(),
+		Properties:  packets.Properties{ContentType: "text/plain"},
+	}
+	redisHook.OnRetainMessage(newClient("c1"), pk, 1)
+
+	msgs, err := redisHook.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "a/b", msgs[0].TopicName)
+	require.Equal(t, []byte("hello"), msgs[0].Payload)
+	require.Equal(t, "text/plain", msgs[0].Properties.ContentType)
+	require.Equal(t, storage.RetainedKey, msgs[0].T)
+
+	redisHook.OnRetainMessage(newClient("c1"), packets.Packet{TopicName: "a/b"}, -1)
+	require.Empty(t, client.fields(DefaultPrefix+"retained"))
+
+	redisHook.OnRetainMessage(newClient("c1"), pk, 1)
+	redisHook.OnRetainedExpired("a/b")
+	require.Empty(t, client.fields(DefaultPrefix+"retained"))
+}
+
+func TestInflightMessages(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client})
+
+	cl := newClient("c1")
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b",
+		PacketID:    3,
+		Payload:     []byte("hello"),
+	}
+	redisHook.OnQosPublish(cl, pk, 100, 0)
+	require.Equal(t, []string{"c1:3"}, client.fields(DefaultPrefix+"inflight"))
+
+	msgs, err := redisHook.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, uint16(3), msgs[0].PacketID)
+	require.Equal(t, int64(100), msgs[0].Sent)
+
+	redisHook.OnQosComplete(cl, pk)
+	require.Empty(t, client.fields(DefaultPrefix+"inflight"))
+
+	redisHook.OnQosPublish(cl, pk, 100, 0)
+	redisHook.OnQosDropped(cl, pk)
+	require.Empty(t, client.fields(DefaultPrefix+"inflight"))
+}
+
+func TestSysInfo(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client})
+
+	info, err := redisHook.StoredSysInfo()
+	require.NoError(t, err)
+	require.Empty(t, info.ID)
+
+	redisHook.OnSysInfoTick(&system.Info{Version: "2.4.1", BytesReceived: 10})
+	info, err = redisHook.StoredSysInfo()
+	require.NoError(t, err)
+	require.Equal(t, storage.SysInfoKey, info.ID)
+	require.Equal(t, "2.4.1", info.Version)
+	require.Equal(t, int64(10), info.BytesReceived)
+}
+
+func TestStoredErrors(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client})
+
+	client.hashes[DefaultPrefix+"clients"] = map[string]string{"c1": "not json"}
+	_, err := redisHook.StoredClients()
+	require.Error(t, err)
+
+	client.err = errors.New("connection reset")
+	_, err = redisHook.StoredSubscriptions()
+	require.Error(t, err)
+	_, err = redisHook.StoredSysInfo()
+	require.Error(t, err)
+
+	// failed writes are logged
+	redisHook.OnSessionEstablished(newClient("c2"), packets.Packet{})
+}
+
+func TestBatchedWrites(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client, FlushInterval: time.Hour, BatchSize: 3})
+
+	cl := newClient("c1")
+	redisHook.OnSessionEstablished(cl, packets.Packet{})
+	redisHook.OnRetainMessage(cl, packets.Packet{TopicName: "a"}, 1)
+	require.Empty(t, client.fields(DefaultPrefix+"clients"))
+
+	require.NoError(t, redisHook.Flush())
+	require.Len(t, client.fields(DefaultPrefix+"clients"), 1)
+	require.Len(t, client.fields(DefaultPrefix+"retained"), 1)
+
+	// a full batch is flushed without waiting for the interval
+	for _, topic := range []string{"b", "c", "d"} {
+		redisHook.OnRetainMessage(cl, packets.Packet{TopicName: topic}, 1)
+	}
+	require.Eventually(t, func() bool {
+		return len(client.fields(DefaultPrefix+"retained")) == 4
+	}, time.Second, time.Millisecond)
+
+	// a message completed before it was flushed is only deleted
+	pk := packets.Packet{FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1}, PacketID: 1}
+	redisHook.OnQosPublish(cl, pk, 1, 0)
+	redisHook.OnQosComplete(cl, pk)
+	require.Equal(t, 1, redisHook.writes.Stats().Pending)
+
+	// writes which failed are retried by the next flush
+	client.mu.Lock()
+	client.err = errors.New("connection refused")
+	client.mu.Unlock()
+	redisHook.OnRetainMessage(cl, packets.Packet{TopicName: "e"}, 1)
+	require.Error(t, redisHook.Flush())
+
+	client.mu.Lock()
+	client.err = nil
+	client.mu.Unlock()
+	require.NoError(t, redisHook.Flush())
+	require.Empty(t, client.fields(DefaultPrefix+"inflight"))
+	require.Len(t, client.fields(DefaultPrefix+"retained"), 5)
+
+	// stopping flushes what is left
+	redisHook.OnRetainMessage(cl, packets.Packet{TopicName: "a"}, -1)
+	require.NoError(t, redisHook.Stop())
+	require.Len(t, client.fields(DefaultPrefix+"retained"), 4)
+	require.True(t, client.closed)
+}
+
+func TestRestore(t *testing.T) {
+	client := newFakeClient()
+	redisHook := newHook(t, Options{Client: client})
+
+	cl := newClient("c1")
+	cl.Properties.Props.SessionExpiryInterval = 3600
+	redisHook.OnSessionEstablished(cl, packets.Packet{})
+	redisHook.OnSubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/#", Qos: 1}}}, []byte{1})
+	redisHook.OnRetainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+	}, 1)
+
+	// a new broker, eg. a standby, restores the state from the same redis
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	standby := new(Hook)
+	require.NoError(t, server.AddHook(standby, Options{Client: client}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+	require.Equal(t, restored{clients: 1, subscriptions: 1, retained: 1}, standby.restored)
+
+	restored, ok := server.Clients.Get("c1")
+	require.True(t, ok)
+	require.Equal(t, []byte("alice"), restored.Properties.Username)
+	_, ok = restored.State.Subscriptions.Get("a/#")
+	require.True(t, ok)
+	retained, ok := server.Topics.Retained.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), retained.Payload)
+}
@@ -0,0 +1,387 @@
+// Package retained provides a hook which exports the retained messages of the server to JSON or NDJSON
+// and imports them back, eg. to back up topics holding configuration, or to seed a new broker. Imported
+// messages are published as retained messages, so storage hooks persist them and subscribers receive
+// them as usual
+package retained
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Format is how retained messages are encoded
+type Format int
+
+const (
+	// NDJSON encodes each message as a JSON object on its own line
+	NDJSON Format = iota
+	// JSON encodes the messages as a JSON array
+	JSON
+)
+
+// FormatOf returns the format of a file from its extension, which is JSON for .json and NDJSON for
+// anything else
+func FormatOf(path string) Format {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return JSON
+	}
+	return NDJSON
+}
+
+// Message is an exported retained message. The payload is written as text if it is valid UTF-8, and
+// as base64 in PayloadBase64 if not
+type Message struct {
+	Topic                 string                 `json:"topic"`
+	Payload               string                 `json:"payload,omitempty"`
+	PayloadBase64         string                 `json:"payload_base64,omitempty"`
+	Qos                   byte                   `json:"qos,omitempty"`
+	Created               int64                  `json:"created,omitempty"`
+	PayloadFormat         *byte                  `json:"payload_format,omitempty"`
+	MessageExpiryInterval uint32                 `json:"message_expiry_interval,omitempty"`
+	ContentType           string                 `json:"content_type,omitempty"`
+	ResponseTopic         string                 `json:"response_topic,omitempty"`
+	CorrelationData       []byte                 `json:"correlation_data,omitempty"`
+	User                  []packets.UserProperty `json:"user_properties,omitempty"`
+}
+
+// newMessage returns the exported message of a retained packet
+func newMessage(pk packets.Packet) Message {
+	msg := Message{
+		Topic:                 pk.TopicName,
+		Qos:                   pk.FixedHeader.Qos,
+		Created:               pk.Created,
+		MessageExpiryInterval: pk.Properties.MessageExpiryInterval,
+		ContentType:           pk.Properties.ContentType,
+		ResponseTopic:         pk.Properties.ResponseTopic,
+		CorrelationData:       pk.Properties.CorrelationData,
+		User:                  pk.Properties.User,
+	}
+
+	if pk.Properties.PayloadFormatFlag {
+		format := pk.Properties.PayloadFormat
+		msg.PayloadFormat = &format
+	}
+
+	if utf8.Valid(pk.Payload) {
+		msg.Payload = string(pk.Payload)
+	} else {
+		msg.PayloadBase64 = base64.StdEncoding.EncodeToString(pk.Payload)
+	}
+	return msg
+}
+
+// packet returns the retained publish packet of the message
+func (m Message) packet() (packets.Packet, error) {
+	if m.Topic == "" || !mqtt.IsValidFilter(m.Topic, true) {
+		return packets.Packet{}, fmt.Errorf("invalid topic %q", m.Topic)
+	}
+
+	if m.Qos > 2 {
+		return packets.Packet{}, fmt.Errorf("invalid qos %d of topic %s", m.Qos, m.Topic)
+	}
+
+	payload := []byte(m.Payload)
+	if m.PayloadBase64 != "" {
+		var err error
+		if payload, err = base64.StdEncoding.DecodeString(m.PayloadBase64); err != nil {
+			return packets.Packet{}, fmt.Errorf("invalid payload of topic %s: %w", m.Topic, err)
+		}
+	}
+
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    m.Qos,
+			Retain: true,
+		},
+		TopicName: m.Topic,
+		Payload:   payload,
+		PacketID:  uint16(m.Qos), // as the server publishes, the packet id is only checked to be set
+		Properties: packets.Properties{
+			MessageExpiryInterval: m.MessageExpiryInterval,
+			ContentType:           m.ContentType,
+			ResponseTopic:         m.ResponseTopic,
+			CorrelationData:       m.CorrelationData,
+			User:                  m.User,
+		},
+	}
+
+	if m.PayloadFormat != nil {
+		pk.Properties.PayloadFormat = *m.PayloadFormat
+		pk.Properties.PayloadFormatFlag = true
+	}
+	return pk, nil
+}
+
+// Hook is a hook that exports and imports the retained messages of the server
+type Hook struct {
+	config Options
+	client *mqtt.Client // publishes the imported messages
+	mqtt.HookBase
+}
+
+// Options is a struct that contains all the information required to configure the retained hook
+type Options struct {
+	// Server is the server whose retained messages are exported, and to which they are imported
+	Server *mqtt.Server
+
+	// Filter selects the topics which are exported, defaults to # which is every topic except $SYS
+	Filter string
+
+	// Path is a file of retained messages imported when the server starts, eg. to seed a new broker.
+	// It is read as JSON if it ends in .json, and as NDJSON if not
+	Path string
+
+	// KeepExisting doesn't replace retained messages already on the topics of imported messages
+	KeepExisting bool
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "retained-hook"
+}
+
+// Provides returns whether or not the hook provides the given hook
+func (h *Hook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnStarted,
+	}, []byte{b})
+}
+
+// Init initializes the hook with the given config
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	retainedHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if retainedHookConfig.Server == nil {
+		return errors.New("server is required")
+	}
+
+	if retainedHookConfig.Filter == "" {
+		retainedHookConfig.Filter = "#"
+	}
+
+	if !mqtt.IsValidFilter(retainedHookConfig.Filter, false) {
+		return fmt.Errorf("invalid filter %q", retainedHookConfig.Filter)
+	}
+
+	h.config = retainedHookConfig
+	h.client = retainedHookConfig.Server.NewClient(nil, "local", "retained-import", true)
+	h.client.Properties.ProtocolVersion = 5
+	return nil
+}
+
+// OnStarted is called when the server has started, and imports the retained messages of the file,
+// after those restored by storage hooks
+func (h *Hook) OnStarted() {
+	if h.config.Path == "" {
+		return
+	}
+
+	n, err := h.ImportFile(h.config.Path)
+	if err != nil {
+		h.Log.Error("error occurred while importing retained messages", "error", err, "path", h.config.Path, "imported", n)
+		return
+	}
+	h.Log.Info("imported retained messages", "path", h.config.Path, "imported", n)
+}
+
+// Export writes the retained messages of the topics matching the filter to w, returning how many
+// were written
+func (h *Hook) Export(w io.Writer, format Format) (int, error) {
+	pks := h.config.Server.Topics.Messages(h.config.Filter)
+	msgs := make([]Message, 0, len(pks))
+	for _, pk := range pks {
+		msgs = append(msgs, newMessage(pk))
+	}
+
+	if format == JSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return len(msgs), enc.Encode(msgs)
+	}
+
+	enc := json.NewEncoder(w)
+	for i, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// ExportFile writes the retained messages to the file, replacing it once they are written
+func (h *Hook) ExportFile(path string) (int, error) {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+
+	w := bufio.NewWriter(f)
+	n, err := h.Export(w, FormatOf(path))
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err = errors.Join(err, f.Close()); err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	return n, os.Rename(tmp, path)
+}
+
+// Import publishes the retained messages read from r, which may be a JSON array or NDJSON, returning
+// how many were read. Messages with an empty payload clear the retained message of their topic, and
+// the expiry interval of messages is what remains of it since they were created, so those which have
+// expired are skipped. The messages before the first invalid message are published
+func (h *Hook) Import(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+
+	// a JSON array is decoded as a whole, and NDJSON as a stream of objects
+	first, err := peek(br)
+	if err != nil {
+		return 0, err
+	}
+
+	if first == '[' {
+		var msgs []Message
+		if err := dec.Decode(&msgs); err != nil {
+			return 0, fmt.Errorf("invalid retained messages: %w", err)
+		}
+
+		for i, msg := range msgs {
+			if err := h.publish(msg); err != nil {
+				return i, err
+			}
+		}
+		return len(msgs), nil
+	}
+
+	var n int
+	for {
+		var msg Message
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+
+		if err != nil {
+			return n, fmt.Errorf("invalid retained message %d: %w", n+1, err)
+		}
+
+		if err := h.publish(msg); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// ImportFile publishes the retained messages of the file
+func (h *Hook) ImportFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return h.Import(f)
+}
+
+// peek returns the first byte which isn't whitespace, or 0 if there is none
+func peek(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return 0, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		if !strings.ContainsRune(" \t\r\n", rune(b)) {
+			return b, br.UnreadByte()
+		}
+	}
+}
+
+// publish publishes the message as a retained message, unless one is kept
+func (h *Hook) publish(msg Message) error {
+	pk, err := msg.packet()
+	if err != nil {
+		return err
+	}
+
+	if h.config.KeepExisting {
+		if _, ok := h.config.Server.Topics.Retained.Get(pk.TopicName); ok {
+			return nil
+		}
+	}
+
+	// the server sets the creation time of published messages, so the expiry is made relative to now
+	if msg.Created > 0 && msg.MessageExpiryInterval > 0 {
+		remaining := msg.Created + int64(msg.MessageExpiryInterval) - time.Now().Unix()
+		if remaining <= 0 {
+			return nil
+		}
+		pk.Properties.MessageExpiryInterval = uint32(remaining)
+	}
+
+	return h.config.Server.InjectPacket(h.client, pk)
+}
+
+// ServeHTTP exports the retained messages on GET, as a JSON array with ?format=json and NDJSON if not,
+// and imports the messages of the body on POST. Access to it must be restricted by the application
+func (h *Hook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		format, contentType := NDJSON, "application/x-ndjson"
+		if r.URL.Query().Get("format") == "json" {
+			format, contentType = JSON, "application/json"
+		}
+
+		var buf bytes.Buffer
+		if _, err := h.Export(&buf, format); err != nil {
+			h.Log.Error("error occurred while exporting retained messages", "error", err)
+			http.Error(w, "failed to export retained messages", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Write(buf.Bytes())
+	case http.MethodPost:
+		n, err := h.Import(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{"imported": n, "error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"imported": n})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,316 @@
+package retained
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T) *mqtt.Server {
+	t.Helper()
+
+	server := mqtt.New(nil)
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	retainedHook := new(Hook)
+	retainedHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, retainedHook.Init(options))
+	return retainedHook
+}
+
+// retain retains a message on the server
+func retain(server *mqtt.Server, pk packets.Packet) {
+	pk.FixedHeader.Type = packets.Publish
+	pk.FixedHeader.Retain = true
+	server.Topics.RetainMessage(pk)
+}
+
+func payload(t *testing.T, server *mqtt.Server, topic string) string {
+	t.Helper()
+
+	pk, ok := server.Topics.Retained.Get(topic)
+	require.True(t, ok, topic)
+	return string(pk.Payload)
+}
+
+func TestID(t *testing.T) {
+	retainedHook := new(Hook)
+
+	require.Equal(t, "retained-hook", retainedHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	retainedHook := new(Hook)
+
+	require.True(t, retainedHook.Provides(mqtt.OnStarted))
+	require.False(t, retainedHook.Provides(mqtt.OnRetainMessage))
+}
+
+func TestInit(t *testing.T) {
+	server := newServer(t)
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - server",
+			config:      Options{Server: server},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no server",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid filter",
+			config:      Options{Server: server, Filter: "a/#/b"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			retainedHook := new(Hook)
+			retainedHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := retainedHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "#", retainedHook.config.Filter)
+			}
+
+		})
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	server := newServer(t)
+	retain(server, packets.Packet{
+		TopicName: "config/a",
+		Payload:   []byte(`{"interval":10}`),
+		Created:   time.Now().Unix() - 100,
+		Properties: packets.Properties{
+			MessageExpiryInterval: 3600,
+			ContentType:           "application/json",
+			PayloadFormat:         1,
+			PayloadFormatFlag:     true,
+			User:                  []packets.UserProperty{{Key: "k", Val: "v"}},
+		},
+	})
+	retain(server, packets.Packet{TopicName: "config/b", Payload: []byte{0xff, 0x00}, FixedHeader: packets.FixedHeader{Qos: 1}})
+	retain(server, packets.Packet{TopicName: "other", Payload: []byte("x")})
+
+	for _, format := range []Format{NDJSON, JSON} {
+		var buf bytes.Buffer
+		n, err := newHook(t, Options{Server: server, Filter: "config/#"}).Export(&buf, format)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+		require.Contains(t, buf.String(), `{\"interval\":10}"`)
+		require.Contains(t, buf.String(), `"/wA="`)
+
+		restored := newServer(t)
+		n, err = newHook(t, Options{Server: restored}).Import(&buf)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+
+		for _, topic := range []string{"config/a", "config/b"} {
+			want, _ := server.Topics.Retained.Get(topic)
+			got, ok := restored.Topics.Retained.Get(topic)
+			require.True(t, ok)
+			require.Equal(t, want.Payload, got.Payload)
+			require.Equal(t, want.FixedHeader.Qos, got.FixedHeader.Qos)
+			require.Equal(t, want.Properties.ContentType, got.Properties.ContentType)
+			require.Equal(t, want.Properties.PayloadFormatFlag, got.Properties.PayloadFormatFlag)
+			require.Equal(t, want.Properties.User, got.Properties.User)
+		}
+
+		// the message expires when it would have on the exported server
+		want, _ := server.Topics.Retained.Get("config/a")
+		got, _ := restored.Topics.Retained.Get("config/a")
+		require.InDelta(t, want.Created+3600, got.Created+int64(got.Properties.MessageExpiryInterval), 1)
+	}
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		expect      int
+		expectError bool
+	}{
+		{
+			name:   "Success - empty",
+			data:   " \n",
+			expect: 0,
+		},
+		{
+			name:   "Success - ndjson",
+			data:   "{\"topic\":\"a\",\"payload\":\"1\"}\n\n{\"topic\":\"b\",\"payload\":\"2\"}\n",
+			expect: 2,
+		},
+		{
+			name:   "Success - json",
+			data:   `[{"topic":"a","payload":"1"}]`,
+			expect: 1,
+		},
+		{
+			name:   "Success - expired",
+			data:   `{"topic":"a","payload":"1","created":100,"message_expiry_interval":60}`,
+			expect: 1,
+		},
+		{
+			name:        "Failure - invalid json",
+			data:        `[{"topic":"a"`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid message after valid ones",
+			data:        "{\"topic\":\"a\",\"payload\":\"1\"}\nnot json\n",
+			expect:      1,
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid topic",
+			data:        `{"topic":"a/#","payload":"1"}`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - no topic",
+			data:        `{"payload":"1"}`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid qos",
+			data:        `{"topic":"a","qos":3}`,
+			expectError: true,
+		},
+		{
+			name:        "Failure - invalid base64",
+			data:        `{"topic":"a","payload_base64":"!"}`,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			n, err := newHook(t, Options{Server: newServer(t)}).Import(strings.NewReader(tt.data))
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expect, n)
+
+		})
+	}
+}
+
+func TestImportKeepExisting(t *testing.T) {
+	server := newServer(t)
+	retain(server, packets.Packet{TopicName: "a", Payload: []byte("old")})
+	retain(server, packets.Packet{TopicName: "c", Payload: []byte("old")})
+	data := "{\"topic\":\"a\",\"payload\":\"new\"}\n{\"topic\":\"b\",\"payload\":\"new\"}\n"
+
+	_, err := newHook(t, Options{Server: server, KeepExisting: true}).Import(strings.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, "old", payload(t, server, "a"))
+	require.Equal(t, "new", payload(t, server, "b"))
+
+	// messages with an empty payload clear the retained message of the topic
+	_, err = newHook(t, Options{Server: server}).Import(strings.NewReader(data + `{"topic":"c"}`))
+	require.NoError(t, err)
+	require.Equal(t, "new", payload(t, server, "a"))
+	_, ok := server.Topics.Retained.Get("c")
+	require.False(t, ok)
+}
+
+func TestFiles(t *testing.T) {
+	server := newServer(t)
+	retain(server, packets.Packet{TopicName: "a", Payload: []byte("1")})
+	dir := t.TempDir()
+
+	for _, name := range []string{"retained.json", "retained.ndjson"} {
+		path := filepath.Join(dir, name)
+		n, err := newHook(t, Options{Server: server}).ExportFile(path)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+
+		// the file is imported when the server starts
+		restored := newServer(t)
+		require.NoError(t, restored.AddHook(new(Hook), Options{Server: restored, Path: path}))
+		require.NoError(t, restored.Serve())
+		require.Equal(t, "1", payload(t, restored, "a"))
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "retained.json"))
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(data, []byte("[")))
+
+	_, err = newHook(t, Options{Server: server}).ExportFile(filepath.Join(dir, "missing", "retained.json"))
+	require.Error(t, err)
+	_, err = newHook(t, Options{Server: server}).ImportFile(filepath.Join(dir, "missing.json"))
+	require.Error(t, err)
+}
+
+func TestServeHTTP(t *testing.T) {
+	server := newServer(t)
+	retain(server, packets.Packet{TopicName: "a", Payload: []byte("1")})
+	retainedHook := newHook(t, Options{Server: server})
+
+	rec := httptest.NewRecorder()
+	retainedHook.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/retained", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	require.Equal(t, "{\"topic\":\"a\",\"payload\":\"1\"}\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	retainedHook.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/retained?format=json", nil))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.True(t, strings.HasPrefix(rec.Body.String(), "["))
+
+	rec = httptest.NewRecorder()
+	retainedHook.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/retained", strings.NewReader(`{"topic":"b","payload":"2"}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"imported":1}`, rec.Body.String())
+	require.Equal(t, "2", payload(t, server, "b"))
+
+	rec = httptest.NewRecorder()
+	retainedHook.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/retained", strings.NewReader(`{"topic":"#"}`)))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	retainedHook.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/retained", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
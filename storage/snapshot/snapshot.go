@@ -0,0 +1,349 @@
+// Package snapshot provides a storage hook keeping the state of the server in memory and writing it to
+// object storage as periodic snapshots, from which a new broker restores it when it starts. It gives
+// cheap disaster recovery without running a database, losing at most the changes of the last interval.
+//
+// The snapshots are written to a Bucket, which is a directory with Dir, or a thin adapter of the SDK of
+// S3, GCS or Azure Blob Storage, eg. for S3 with aws-sdk-go-v2:
+//
+//	type bucket struct {
+//		client *s3.Client
+//		name   string
+//	}
+//
+//	func (b bucket) Put(ctx context.Context, key string, data []byte) error {
+//		_, err := b.client.PutObject(ctx, &s3.PutObjectInput{Bucket: &b.name, Key: &key, Body: bytes.NewReader(data)})
+//		return err
+//	}
+//
+//	func (b bucket) Get(ctx context.Context, key string) ([]byte, error) {
+//		out, err := b.client.GetObject(ctx, &s3.GetObjectInput{Bucket: &b.name, Key: &key})
+//		if err != nil {
+//			return nil, err
+//		}
+//		defer out.Body.Close()
+//		return io.ReadAll(out.Body)
+//	}
+//
+//	func (b bucket) List(ctx context.Context, prefix string) (keys []string, err error) {
+//		p := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{Bucket: &b.name, Prefix: &prefix})
+//		for p.HasMorePages() {
+//			page, err := p.NextPage(ctx)
+//			if err != nil {
+//				return nil, err
+//			}
+//			for _, obj := range page.Contents {
+//				keys = append(keys, *obj.Key)
+//			}
+//		}
+//		return keys, nil
+//	}
+//
+//	func (b bucket) Delete(ctx context.Context, key string) error {
+//		_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &b.name, Key: &key})
+//		return err
+//	}
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+)
+
+// Bucket is object storage holding the snapshots
+type Bucket interface {
+	// Put writes the object, replacing it if it exists
+	Put(ctx context.Context, name string, data []byte) error
+
+	// Get returns the data of the object
+	Get(ctx context.Context, name string) ([]byte, error)
+
+	// List returns the names of the objects with the prefix, in any order
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// Delete deletes the object
+	Delete(ctx context.Context, name string) error
+}
+
+// Hook is a hook that keeps the clients, subscriptions, retained and inflight messages and system info
+// of the server in memory, and writes them to snapshots in a bucket. The latest snapshot is restored
+// when the hook is initialized, so the server restores its state from it when it starts
+type Hook struct {
+	config Options
+	memory *kvstore.Memory
+	taken  uint64     // the changes of the memory when the last snapshot was taken
+	now    func() time.Time
+	mu     sync.Mutex // serializes snapshots
+	kvstore.Storage
+}
+
+// Options is a struct that contains all the information required to configure the snapshot hook
+type Options struct {
+	// Bucket is where the snapshots are written
+	Bucket Bucket
+
+	// Prefix is prepended to the names of the snapshots, which are followed by the time they were
+	// taken, defaults to "mochi/snapshot-"
+	Prefix string
+
+	Interval time.Duration // how often a snapshot is taken if anything changed, defaults to 5 minutes
+	Keep     int           // how many snapshots are kept, defaults to 3
+	Timeout  time.Duration // how long writing or reading a snapshot may take, defaults to 1 minute
+
+	// SessionTTL is how long the sessions of disconnected MQTT v3 clients are kept, as in kvstore.Options
+	SessionTTL time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "snapshot-storage-hook"
+}
+
+// Init initializes the hook with the given config, restores the latest snapshot, and starts taking
+// snapshots
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	snapshotHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if snapshotHookConfig.Bucket == nil {
+		return errors.New("bucket is required")
+	}
+
+	if snapshotHookConfig.Prefix == "" {
+		snapshotHookConfig.Prefix = "mochi/snapshot-"
+	}
+
+	if snapshotHookConfig.Interval <= 0 {
+		snapshotHookConfig.Interval = 5 * time.Minute
+	}
+
+	if snapshotHookConfig.Keep <= 0 {
+		snapshotHookConfig.Keep = 3
+	}
+
+	if snapshotHookConfig.Timeout <= 0 {
+		snapshotHookConfig.Timeout = time.Minute
+	}
+
+	h.config = snapshotHookConfig
+	h.now = time.Now
+	h.memory = kvstore.NewMemory()
+	if err := h.restore(); err != nil {
+		return err
+	}
+	h.taken = h.memory.Changes()
+
+	err := h.Open(h.memory, kvstore.Options{
+		SyncMode:   kvstore.SyncNever,
+		SessionTTL: snapshotHookConfig.SessionTTL,
+	})
+	if err != nil {
+		return err
+	}
+
+	h.Every(snapshotHookConfig.Interval, func() {
+		if err := h.Snapshot(); err != nil {
+			h.Log.Error("error occurred while taking snapshot", "error", err)
+		}
+	})
+
+	return nil
+}
+
+// Stop stops taking snapshots periodically, and takes a last one
+func (h *Hook) Stop() error {
+	if h.memory == nil {
+		return nil
+	}
+
+	err := h.Close()
+	return errors.Join(err, h.Snapshot())
+}
+
+// snapshots returns the names of the snapshots in the bucket, from oldest to newest
+func (h *Hook) snapshots(ctx context.Context) ([]string, error) {
+	names, err := h.config.Bucket.List(ctx, h.config.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// restore reads the latest snapshot into memory, if there is one
+func (h *Hook) restore() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	names, err := h.snapshots(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	latest := names[len(names)-1]
+	data, err := h.config.Bucket.Get(ctx, latest)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %s: %w", latest, err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to decompress snapshot %s: %w", latest, err)
+	}
+
+	if _, err := h.memory.ReadFrom(zr); err != nil {
+		return fmt.Errorf("failed to decode snapshot %s: %w", latest, err)
+	}
+
+	h.Log.Info("restored snapshot", "snapshot", latest)
+	return nil
+}
+
+// Snapshot writes the state to a new snapshot if it changed since the last one, and deletes the
+// snapshots which are no longer kept
+func (h *Hook) Snapshot() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changes := h.memory.Changes()
+	if changes == h.taken {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := h.memory.WriteTo(zw); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	name := h.config.Prefix + h.now().UTC().Format("20060102T150405.000000000Z") + ".gz"
+	if err := h.config.Bucket.Put(ctx, name, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write snapshot %s: %w", name, err)
+	}
+	h.taken = changes
+
+	h.Log.Debug("took snapshot", "snapshot", name, "size", buf.Len())
+	h.prune(ctx)
+	return nil
+}
+
+// prune deletes the oldest snapshots beyond those which are kept
+func (h *Hook) prune(ctx context.Context) {
+	names, err := h.snapshots(ctx)
+	if err != nil {
+		h.Log.Error("error occurred while listing snapshots", "error", err)
+		return
+	}
+
+	for len(names) > h.config.Keep {
+		if err := h.config.Bucket.Delete(ctx, names[0]); err != nil {
+			h.Log.Error("error occurred while deleting snapshot", "error", err, "snapshot", names[0])
+		}
+		names = names[1:]
+	}
+}
+
+// Dir is a Bucket keeping the snapshots as files in a directory, eg. on a network volume. Names are
+// paths relative to the directory
+type Dir string
+
+// path returns the path of the file of an object
+func (d Dir) path(name string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
+
+// Put implements Bucket, replacing the file atomically
+func (d Dir) Put(ctx context.Context, name string, data []byte) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get implements Bucket
+func (d Dir) Get(ctx context.Context, name string) ([]byte, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// List implements Bucket
+func (d Dir) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(string(d), func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == string(d) {
+				return fs.SkipAll
+			}
+			return err
+		}
+
+		if e.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Delete implements Bucket
+func (d Dir) Delete(ctx context.Context, name string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,255 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+)
+
+// failingBucket fails every operation
+type failingBucket struct{}
+
+func (failingBucket) Put(ctx context.Context, name string, data []byte) error {
+	return errors.New("access denied")
+}
+
+func (failingBucket) Get(ctx context.Context, name string) ([]byte, error) {
+	return nil, errors.New("access denied")
+}
+
+func (failingBucket) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, errors.New("access denied")
+}
+
+func (failingBucket) Delete(ctx context.Context, name string) error {
+	return errors.New("access denied")
+}
+
+// clock advances a second every time it is read, so every snapshot has its own name
+type clock struct {
+	t  time.Time
+	mu sync.Mutex
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(time.Second)
+	return c.t
+}
+
+func useClock(h *Hook) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h.now = c.now
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	snapshotHook := new(Hook)
+	snapshotHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, snapshotHook.Init(options))
+	t.Cleanup(func() { snapshotHook.Stop() })
+	return snapshotHook
+}
+
+func connect(h *Hook, id string) {
+	cl := mqtt.New(nil).NewClient(nil, "tcp", id, false)
+	cl.Properties.ProtocolVersion = 5
+	h.OnSessionEstablished(cl, packets.Packet{})
+}
+
+func list(t *testing.T, dir Dir) []string {
+	t.Helper()
+
+	names, err := dir.List(context.Background(), "")
+	require.NoError(t, err)
+	return names
+}
+
+func TestID(t *testing.T) {
+	snapshotHook := new(Hook)
+
+	require.Equal(t, "snapshot-storage-hook", snapshotHook.ID())
+}
+
+func TestInit(t *testing.T) {
+	corrupt := Dir(t.TempDir())
+	require.NoError(t, corrupt.Put(context.Background(), "mochi/snapshot-1.gz", []byte("not gzip")))
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - empty bucket",
+			config:      Options{Bucket: Dir(t.TempDir())},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no bucket",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - unreachable bucket",
+			config:      Options{Bucket: failingBucket{}},
+			expectError: true,
+		},
+		{
+			name:        "Failure - corrupt snapshot",
+			config:      Options{Bucket: corrupt},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			snapshotHook := new(Hook)
+			snapshotHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := snapshotHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "mochi/snapshot-", snapshotHook.config.Prefix)
+				require.Equal(t, 5*time.Minute, snapshotHook.config.Interval)
+				require.Equal(t, 3, snapshotHook.config.Keep)
+				require.NoError(t, snapshotHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := Dir(t.TempDir())
+	snapshotHook := newHook(t, Options{Bucket: dir, Keep: 2})
+	useClock(snapshotHook)
+
+	// nothing is written until something changes
+	require.NoError(t, snapshotHook.Snapshot())
+	require.Empty(t, list(t, dir))
+
+	connect(snapshotHook, "c1")
+	require.NoError(t, snapshotHook.Snapshot())
+	require.Equal(t, []string{"mochi/snapshot-20260101T000001.000000000Z.gz"}, list(t, dir))
+	require.NoError(t, snapshotHook.Snapshot())
+	require.Len(t, list(t, dir), 1)
+
+	// the oldest snapshots are deleted
+	connect(snapshotHook, "c2")
+	require.NoError(t, snapshotHook.Snapshot())
+	connect(snapshotHook, "c3")
+	require.NoError(t, snapshotHook.Snapshot())
+	require.Equal(t, []string{
+		"mochi/snapshot-20260101T000002.000000000Z.gz",
+		"mochi/snapshot-20260101T000003.000000000Z.gz",
+	}, list(t, dir))
+
+	// the last changes are written when the hook stops
+	connect(snapshotHook, "c4")
+	require.NoError(t, snapshotHook.Stop())
+
+	restored := newHook(t, Options{Bucket: dir})
+	clients, err := restored.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 4)
+}
+
+func TestSnapshotInterval(t *testing.T) {
+	dir := Dir(t.TempDir())
+	snapshotHook := newHook(t, Options{Bucket: dir, Interval: time.Millisecond})
+
+	connect(snapshotHook, "c1")
+	require.Eventually(t, func() bool {
+		return len(list(t, dir)) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestSnapshotFailure(t *testing.T) {
+	snapshotHook := newHook(t, Options{Bucket: Dir(t.TempDir())})
+	snapshotHook.config.Bucket = failingBucket{}
+
+	connect(snapshotHook, "c1")
+	require.ErrorContains(t, snapshotHook.Snapshot(), "access denied")
+
+	// the changes are written by the next snapshot
+	dir := Dir(t.TempDir())
+	snapshotHook.config.Bucket = dir
+	require.NoError(t, snapshotHook.Snapshot())
+	require.Len(t, list(t, dir), 1)
+}
+
+func TestRestore(t *testing.T) {
+	dir := Dir(t.TempDir())
+	snapshotHook := newHook(t, Options{Bucket: dir})
+	connect(snapshotHook, "c1")
+	snapshotHook.OnRetainMessage(nil, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+	}, 1)
+	require.NoError(t, snapshotHook.Stop())
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, server.AddHook(new(Hook), Options{Bucket: dir}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	_, ok := server.Clients.Get("c1")
+	require.True(t, ok)
+	retained, ok := server.Topics.Retained.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), retained.Payload)
+}
+
+func TestDir(t *testing.T) {
+	ctx := context.Background()
+	dir := Dir(filepath.Join(t.TempDir(), "snapshots"))
+
+	names, err := dir.List(ctx, "")
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	require.NoError(t, dir.Put(ctx, "a/1", []byte("one")))
+	require.NoError(t, dir.Put(ctx, "a/1", []byte("two")))
+	require.NoError(t, dir.Put(ctx, "b", []byte("three")))
+
+	data, err := dir.Get(ctx, "a/1")
+	require.NoError(t, err)
+	require.Equal(t, []byte("two"), data)
+
+	names, err = dir.List(ctx, "a/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/1"}, names)
+
+	require.NoError(t, dir.Delete(ctx, "a/1"))
+	_, err = dir.Get(ctx, "a/1")
+	require.Error(t, err)
+
+	require.Error(t, dir.Put(ctx, "../escape", nil))
+	require.Error(t, dir.Put(ctx, "/etc/passwd", nil))
+}
@@ -0,0 +1,299 @@
+package tiered
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+)
+
+// coldBatch collects the writes of a cold store, and gives them to commit together
+type coldBatch struct {
+	ops    []op
+	commit func(ops []op) error
+}
+
+// Set implements kvstore.Batch. Cold stores keep records until they are read, as the values carry
+// their expiry
+func (b *coldBatch) Set(key, value []byte, ttl time.Duration) error {
+	b.ops = append(b.ops, op{key: string(key), value: value, ttl: ttl})
+	return nil
+}
+
+// Delete implements kvstore.Batch
+func (b *coldBatch) Delete(key []byte) error {
+	b.ops = append(b.ops, op{key: string(key)})
+	return nil
+}
+
+// Commit implements kvstore.Batch
+func (b *coldBatch) Commit(sync bool) error {
+	ops := b.ops
+	b.ops = nil
+	if len(ops) == 0 {
+		return nil
+	}
+	return b.commit(ops)
+}
+
+// Discard implements kvstore.Batch
+func (b *coldBatch) Discard() {
+	b.ops = nil
+}
+
+// Redis is a cold store keeping the records in a hash of Redis
+type Redis struct {
+	client  redisclient.Client
+	key     string
+	timeout time.Duration
+}
+
+// NewRedis returns a cold store keeping the records in the hash with the key, eg. "{mochi}:tiered".
+// Commands time out after the timeout, which defaults to 5 seconds
+func NewRedis(client redisclient.Client, key string, timeout time.Duration) *Redis {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Redis{client: client, key: key, timeout: timeout}
+}
+
+// NewBatch implements kvstore.Store. The commands of a batch are pipelined, and aren't atomic
+func (r *Redis) NewBatch() kvstore.Batch {
+	return &coldBatch{commit: func(ops []op) error {
+		cmds := make([][]any, len(ops))
+		for i, o := range ops {
+			if o.value == nil {
+				cmds[i] = []any{"HDEL", r.key, o.key}
+			} else {
+				cmds[i] = []any{"HSET", r.key, o.key, o.value}
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		defer cancel()
+
+		_, err := redisclient.Pipeline(ctx, r.client, cmds...)
+		return err
+	}}
+}
+
+// Get implements kvstore.Store
+func (r *Redis) Get(key []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	reply, err := r.client.Do(ctx, "HGET", r.key, string(key))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	s, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T", reply)
+	}
+	return []byte(s), nil
+}
+
+// Iterate implements kvstore.Store, reading the whole hash
+func (r *Redis) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	reply, err := r.client.Do(ctx, "HGETALL", r.key)
+	if err != nil {
+		return err
+	}
+
+	items, _ := reply.([]any)
+	values := map[string]string{}
+	for i := 0; i+1 < len(items); i += 2 {
+		k, kok := items[i].(string)
+		v, vok := items[i+1].(string)
+		if !kok || !vok {
+			return fmt.Errorf("unexpected reply %T", items[i])
+		}
+
+		if strings.HasPrefix(k, string(prefix)) {
+			values[k] = v
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := fn([]byte(k), []byte(values[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync implements kvstore.Store. Redis persists writes as it is configured to
+func (r *Redis) Sync() error {
+	return nil
+}
+
+// Close implements kvstore.Store, closing the client
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
+
+// Queries are the statements of a SQL cold store, which keeps the records in a table of binary keys
+// and values, eg. CREATE TABLE mqtt_records (id BYTEA PRIMARY KEY, data BYTEA NOT NULL). The
+// placeholder syntax depends on the database, eg. $1 for PostgreSQL and ? for MySQL or SQLite
+type Queries struct {
+	// Get selects the value of the key, eg. SELECT data FROM mqtt_records WHERE id = $1
+	Get string
+
+	// Iterate selects the keys and values from the key in key order, eg. SELECT id, data FROM
+	// mqtt_records WHERE id >= $1 ORDER BY id
+	Iterate string
+
+	// Insert inserts the key and value, eg. INSERT INTO mqtt_records (id, data) VALUES ($1, $2)
+	Insert string
+
+	// Delete deletes the key, eg. DELETE FROM mqtt_records WHERE id = $1. Records are replaced by
+	// deleting and inserting them in a transaction, which works on any database
+	Delete string
+}
+
+// SQL is a cold store keeping the records in a table of a SQL database
+type SQL struct {
+	db      *sql.DB
+	get     *sql.Stmt
+	iterate *sql.Stmt
+	insert  *sql.Stmt
+	delete  *sql.Stmt
+	timeout time.Duration
+}
+
+// NewSQL prepares the queries on the database. Statements time out after the timeout, which
+// defaults to 5 seconds
+func NewSQL(ctx context.Context, db *sql.DB, queries Queries, timeout time.Duration) (*SQL, error) {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	s := &SQL{db: db, timeout: timeout}
+	for _, q := range []struct {
+		query string
+		stmt  **sql.Stmt
+	}{
+		{queries.Get, &s.get},
+		{queries.Iterate, &s.iterate},
+		{queries.Insert, &s.insert},
+		{queries.Delete, &s.delete},
+	} {
+		if q.query == "" {
+			s.Close()
+			return nil, errors.New("get, iterate, insert and delete queries are required")
+		}
+
+		stmt, err := db.PrepareContext(ctx, q.query)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("preparing %q: %w", q.query, err)
+		}
+		*q.stmt = stmt
+	}
+
+	return s, nil
+}
+
+// NewBatch implements kvstore.Store. The writes of a batch are committed in one transaction
+func (s *SQL) NewBatch() kvstore.Batch {
+	return &coldBatch{commit: func(ops []op) error {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		del, insert := tx.StmtContext(ctx, s.delete), tx.StmtContext(ctx, s.insert)
+		for _, o := range ops {
+			if _, err := del.ExecContext(ctx, []byte(o.key)); err != nil {
+				return err
+			}
+
+			if o.value == nil {
+				continue
+			}
+
+			if _, err := insert.ExecContext(ctx, []byte(o.key), o.value); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}}
+}
+
+// Get implements kvstore.Store
+func (s *SQL) Get(key []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var value []byte
+	err := s.get.QueryRowContext(ctx, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Iterate implements kvstore.Store
+func (s *SQL) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	rows, err := s.iterate.QueryContext(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(string(key), string(prefix)) {
+			break // past the keys with the prefix
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Sync implements kvstore.Store. Committed transactions are durable
+func (s *SQL) Sync() error {
+	return nil
+}
+
+// Close implements kvstore.Store, closing the prepared statements but not the database, which the
+// application may share
+func (s *SQL) Close() error {
+	var errs []error
+	for _, stmt := range []*sql.Stmt{s.get, s.iterate, s.insert, s.delete} {
+		if stmt != nil {
+			errs = append(errs, stmt.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
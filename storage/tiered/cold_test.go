@@ -0,0 +1,195 @@
+package tiered
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/redisclient"
+	"github.com/mochi-mqtt/hooks/pkg/sqlauth/sqlauthtest"
+)
+
+// fakeRedis keeps hashes in memory
+type fakeRedis struct {
+	hashes map[string]map[string]string
+	closed bool
+	mu     sync.Mutex
+}
+
+func (c *fakeRedis) Do(ctx context.Context, args ...any) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hashes == nil {
+		c.hashes = map[string]map[string]string{}
+	}
+
+	key := args[1].(string)
+	switch args[0] {
+	case "HSET":
+		if c.hashes[key] == nil {
+			c.hashes[key] = map[string]string{}
+		}
+		c.hashes[key][args[2].(string)] = string(args[3].([]byte))
+		return int64(1), nil
+	case "HDEL":
+		delete(c.hashes[key], args[2].(string))
+		return int64(1), nil
+	case "HGET":
+		if v, ok := c.hashes[key][args[2].(string)]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "HGETALL":
+		out := []any{}
+		for f, v := range c.hashes[key] {
+			out = append(out, f, v)
+		}
+		return out, nil
+	}
+	return nil, redisclient.Error("ERR unknown command")
+}
+
+func (c *fakeRedis) Close() error {
+	c.closed = true
+	return nil
+}
+
+// table is a SQL table of records, answering the queries of the SQL cold store
+type table struct {
+	rows map[string][]byte
+	mu   sync.Mutex
+}
+
+var queries = Queries{
+	Get:     "SELECT data FROM mqtt_records WHERE id = $1",
+	Iterate: "SELECT id, data FROM mqtt_records WHERE id >= $1 ORDER BY id",
+	Insert:  "INSERT INTO mqtt_records (id, data) VALUES ($1, $2)",
+	Delete:  "DELETE FROM mqtt_records WHERE id = $1",
+}
+
+func (tb *table) driver() *sqlauthtest.Driver {
+	tb.rows = map[string][]byte{}
+	return &sqlauthtest.Driver{Queries: map[string]sqlauthtest.QueryFunc{
+		queries.Get: func(args []driver.Value) ([][]driver.Value, error) {
+			tb.mu.Lock()
+			defer tb.mu.Unlock()
+
+			if v, ok := tb.rows[string(args[0].([]byte))]; ok {
+				return [][]driver.Value{{v}}, nil
+			}
+			return nil, nil
+		},
+		queries.Iterate: func(args []driver.Value) ([][]driver.Value, error) {
+			tb.mu.Lock()
+			defer tb.mu.Unlock()
+
+			var ids []string
+			for id := range tb.rows {
+				if id >= string(args[0].([]byte)) {
+					ids = append(ids, id)
+				}
+			}
+			sort.Strings(ids)
+
+			var rows [][]driver.Value
+			for _, id := range ids {
+				rows = append(rows, []driver.Value{[]byte(id), tb.rows[id]})
+			}
+			return rows, nil
+		},
+		queries.Insert: func(args []driver.Value) ([][]driver.Value, error) {
+			tb.mu.Lock()
+			defer tb.mu.Unlock()
+
+			tb.rows[string(args[0].([]byte))] = args[1].([]byte)
+			return [][]driver.Value{{}}, nil
+		},
+		queries.Delete: func(args []driver.Value) ([][]driver.Value, error) {
+			tb.mu.Lock()
+			defer tb.mu.Unlock()
+
+			delete(tb.rows, string(args[0].([]byte)))
+			return nil, nil
+		},
+	}}
+}
+
+func TestRedis(t *testing.T) {
+	client := new(fakeRedis)
+	r := NewRedis(client, "{mochi}:tiered", 0)
+
+	set(t, r, "CL_a", "1")
+	set(t, r, "CL_b", "2")
+	set(t, r, "SUB_a", "3")
+	del(t, r, "CL_b")
+	require.Equal(t, map[string]string{"CL_a": "1", "SUB_a": "3"}, client.hashes["{mochi}:tiered"])
+
+	require.Equal(t, []byte("1"), get(t, r, "CL_a"))
+	require.Nil(t, get(t, r, "CL_b"))
+	require.Equal(t, map[string]string{"CL_a": "1"}, keys(t, r, "CL_"))
+
+	require.NoError(t, r.Sync())
+	require.NoError(t, r.Close())
+	require.True(t, client.closed)
+}
+
+func TestSQL(t *testing.T) {
+	tb := new(table)
+	db := tb.driver().DB()
+	defer db.Close()
+
+	s, err := NewSQL(context.Background(), db, queries, 0)
+	require.NoError(t, err)
+	defer s.Close()
+
+	set(t, s, "CL_a", "1")
+	set(t, s, "CL_b", "2")
+	set(t, s, "CL_b", "3")
+	set(t, s, "SUB_a", "4")
+	del(t, s, "CL_a")
+	require.Len(t, tb.rows, 2)
+
+	require.Equal(t, []byte("3"), get(t, s, "CL_b"))
+	require.Nil(t, get(t, s, "CL_a"))
+	require.Equal(t, map[string]string{"CL_b": "3"}, keys(t, s, "CL_"))
+	require.Equal(t, map[string]string{"SUB_a": "4"}, keys(t, s, "SUB_"))
+
+	// iteration stops at the first error
+	stop := errors.New("stop")
+	require.ErrorIs(t, s.Iterate(nil, func(k, v []byte) error { return stop }), stop)
+}
+
+func TestNewSQL(t *testing.T) {
+	tb := new(table)
+	db := tb.driver().DB()
+	defer db.Close()
+
+	tests := []struct {
+		name    string
+		queries Queries
+	}{
+		{
+			name:    "Failure - missing query",
+			queries: Queries{Get: queries.Get},
+		},
+		{
+			name:    "Failure - invalid query",
+			queries: Queries{Get: "SELECT", Iterate: queries.Iterate, Insert: queries.Insert, Delete: queries.Delete},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, err := NewSQL(context.Background(), db, tt.queries, 0)
+			require.Error(t, err)
+
+		})
+	}
+}
@@ -0,0 +1,358 @@
+// Package tiered provides a storage hook keeping the records of active sessions in memory, and spilling
+// their writes to a cold store, such as Redis or a SQL database, in the background. Events are stored
+// without waiting for the cold store, which gives persistence without adding its latency to every
+// message, at the cost of the writes not yet spilled when the broker crashes.
+//
+// Records which are not in memory are read through from the cold store, and records which have been
+// spilled are evicted from memory once they have not been used for a while.
+package tiered
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/coalesce"
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+)
+
+// Hook is a hook that keeps the clients, subscriptions, retained and inflight messages and system info
+// of the server in memory and spills them to a cold store, from which the server restores them when
+// it starts
+type Hook struct {
+	config Options
+	store  *Store
+	kvstore.Storage
+}
+
+// Options is a struct that contains all the information required to configure the tiered storage hook
+type Options struct {
+	// Cold is where the records are spilled, eg. Redis or SQL. The hook closes it when it stops
+	Cold kvstore.Store
+
+	// Spill configures how often and in which batches writes are spilled to the cold store, and how
+	// many may be pending while it is slow. Writes of a record replace its pending write
+	Spill coalesce.Options
+
+	// IdleTimeout is how long records which have been spilled are kept in memory since they were last
+	// written or read, defaults to 10 minutes
+	IdleTimeout time.Duration
+
+	// SessionTTL is how long the sessions of disconnected MQTT v3 clients are kept, as in kvstore.Options
+	SessionTTL time.Duration
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "tiered-storage-hook"
+}
+
+// Init initializes the hook with the given config, and starts spilling writes to the cold store
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	tieredHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if tieredHookConfig.Cold == nil {
+		return errors.New("cold store is required")
+	}
+
+	if tieredHookConfig.IdleTimeout <= 0 {
+		tieredHookConfig.IdleTimeout = 10 * time.Minute
+	}
+
+	h.config = tieredHookConfig
+	h.store = NewStore(tieredHookConfig.Cold, tieredHookConfig.Spill, func(err error) {
+		h.Log.Error("error occurred while spilling writes to cold store", "error", err)
+	})
+
+	err := h.Open(h.store, kvstore.Options{
+		SyncMode:   kvstore.SyncNever,
+		SessionTTL: tieredHookConfig.SessionTTL,
+	})
+	if err != nil {
+		h.store.Close()
+		return err
+	}
+
+	h.Every(tieredHookConfig.IdleTimeout, func() {
+		if n := h.store.Evict(tieredHookConfig.IdleTimeout); n > 0 {
+			h.Log.Debug("evicted idle records from memory", "records", n)
+		}
+	})
+
+	return nil
+}
+
+// Stop spills the pending writes, and closes the cold store
+func (h *Hook) Stop() error {
+	return h.Close()
+}
+
+// Store is a kvstore.Store keeping records in memory and spilling their writes to a cold store in the
+// background. Reads of records which are not in memory are read through from the cold store
+type Store struct {
+	cold    kvstore.Store
+	hot     map[string]*entry
+	version uint64 // incremented by every write
+	spills  *coalesce.Coalescer[string]
+	mu      sync.Mutex
+}
+
+// entry is a record in memory
+type entry struct {
+	value   []byte // nil if the record was deleted, until the delete is spilled
+	ttl     time.Duration
+	used    time.Time
+	version uint64 // the version of the latest write
+	spilled uint64 // the version of the latest write spilled to the cold store
+}
+
+// dirty returns whether the latest write of the record has not been spilled
+func (e *entry) dirty() bool {
+	return e.version != e.spilled
+}
+
+// NewStore returns a store spilling writes to the cold store with the options, and reporting writes
+// which failed to spill to onError, which may be nil. Writes which failed are retried
+func NewStore(cold kvstore.Store, options coalesce.Options, onError func(error)) *Store {
+	s := &Store{
+		cold: cold,
+		hot:  map[string]*entry{},
+	}
+	s.spills = coalesce.New(options, s.spill, onError)
+	s.spills.Start()
+	return s
+}
+
+// NewBatch implements kvstore.Store
+func (s *Store) NewBatch() kvstore.Batch {
+	return &batch{store: s}
+}
+
+// Get implements kvstore.Store, reading the record from the cold store if it is not in memory
+func (s *Store) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	if e, ok := s.hot[string(key)]; ok {
+		e.used = time.Now()
+		value := e.value
+		s.mu.Unlock()
+		return value, nil
+	}
+	s.mu.Unlock()
+
+	value, err := s.cold.Get(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	value = append([]byte{}, value...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.hot[string(key)]; ok {
+		return e.value, nil // written while it was read
+	}
+	s.hot[string(key)] = &entry{value: value, used: time.Now()}
+	return value, nil
+}
+
+// Iterate implements kvstore.Store, merging the records in memory with those of the cold store
+func (s *Store) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	values := map[string][]byte{}
+	err := s.cold.Iterate(prefix, func(k, v []byte) error {
+		values[string(k)] = append([]byte{}, v...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for k, e := range s.hot {
+		if !strings.HasPrefix(k, string(prefix)) {
+			continue
+		}
+
+		if e.value == nil {
+			delete(values, k)
+		} else {
+			values[k] = e.value
+		}
+	}
+	s.mu.Unlock()
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := fn([]byte(k), values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync implements kvstore.Store, spilling the pending writes and syncing the cold store
+func (s *Store) Sync() error {
+	if err := s.spills.Flush(); err != nil {
+		return err
+	}
+	return s.cold.Sync()
+}
+
+// Close implements kvstore.Store, spilling the pending writes and closing the cold store
+func (s *Store) Close() error {
+	err := s.spills.Stop()
+	return errors.Join(err, s.cold.Close())
+}
+
+// Evict removes the records which have been spilled and not used for the idle time from memory,
+// returning how many were removed
+func (s *Store) Evict(idle time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := time.Now().Add(-idle)
+	var n int
+	for k, e := range s.hot {
+		if !e.dirty() && e.used.Before(before) {
+			delete(s.hot, k)
+			n++
+		}
+	}
+	return n
+}
+
+// Stats returns the counts of the writes spilled to the cold store
+func (s *Store) Stats() coalesce.Stats {
+	return s.spills.Stats()
+}
+
+// spill writes the latest values of the records to the cold store. Values are read when they are
+// spilled rather than when they are written, so they are spilled in the order they were written
+func (s *Store) spill(ctx context.Context, keys []string) error {
+	type write struct {
+		key     string
+		value   []byte
+		ttl     time.Duration
+		version uint64
+	}
+
+	s.mu.Lock()
+	writes := make([]write, 0, len(keys))
+	for _, k := range keys {
+		if e, ok := s.hot[k]; ok && e.dirty() {
+			writes = append(writes, write{key: k, value: e.value, ttl: e.ttl, version: e.version})
+		}
+	}
+	s.mu.Unlock()
+
+	if len(writes) == 0 {
+		return nil
+	}
+
+	b := s.cold.NewBatch()
+	for _, w := range writes {
+		var err error
+		if w.value == nil {
+			err = b.Delete([]byte(w.key))
+		} else {
+			err = b.Set([]byte(w.key), w.value, w.ttl)
+		}
+
+		if err != nil {
+			b.Discard()
+			return err
+		}
+	}
+
+	if err := b.Commit(false); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range writes {
+		e, ok := s.hot[w.key]
+		if !ok {
+			continue
+		}
+
+		e.spilled = max(e.spilled, w.version)
+		if e.value == nil && !e.dirty() {
+			delete(s.hot, w.key) // the cold store knows it was deleted
+		}
+	}
+	return nil
+}
+
+// op is a write of a batch, deleting the key if value is nil
+type op struct {
+	key   string
+	value []byte
+	ttl   time.Duration
+}
+
+// batch applies its writes to memory when it is committed, and queues them to be spilled
+type batch struct {
+	store *Store
+	ops   []op
+}
+
+// Set implements kvstore.Batch
+func (b *batch) Set(key, value []byte, ttl time.Duration) error {
+	b.ops = append(b.ops, op{key: string(key), value: append([]byte{}, value...), ttl: ttl})
+	return nil
+}
+
+// Delete implements kvstore.Batch
+func (b *batch) Delete(key []byte) error {
+	b.ops = append(b.ops, op{key: string(key)})
+	return nil
+}
+
+// Commit implements kvstore.Batch. The writes are spilled in the background, unless sync is true
+func (b *batch) Commit(sync bool) error {
+	s := b.store
+	now := time.Now()
+
+	s.mu.Lock()
+	for _, o := range b.ops {
+		e, ok := s.hot[o.key]
+		if !ok {
+			e = new(entry)
+			s.hot[o.key] = e
+		}
+
+		s.version++
+		e.value, e.ttl, e.used, e.version = o.value, o.ttl, now, s.version
+	}
+	s.mu.Unlock()
+
+	var err error
+	for _, o := range b.ops {
+		err = errors.Join(err, s.spills.Add(o.key, o.key))
+	}
+	b.ops = nil
+
+	if err != nil || !sync {
+		return err
+	}
+	return s.Sync()
+}
+
+// Discard implements kvstore.Batch
+func (b *batch) Discard() {
+	b.ops = nil
+}
@@ -0,0 +1,277 @@
+package tiered
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/coalesce"
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+)
+
+// failingStore is a cold store which fails while err is set
+type failingStore struct {
+	err error
+	*kvstore.Memory
+}
+
+func (s *failingStore) NewBatch() kvstore.Batch {
+	return &coldBatch{commit: func(ops []op) error {
+		if s.err != nil {
+			return s.err
+		}
+
+		b := s.Memory.NewBatch()
+		for _, o := range ops {
+			if o.value == nil {
+				b.Delete([]byte(o.key))
+			} else {
+				b.Set([]byte(o.key), o.value, o.ttl)
+			}
+		}
+		return b.Commit(false)
+	}}
+}
+
+func (s *failingStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.Memory.Iterate(prefix, fn)
+}
+
+// held returns a store which spills only when it is synced
+func held(cold kvstore.Store) *Store {
+	return NewStore(cold, coalesce.Options{Interval: time.Hour}, nil)
+}
+
+func set(t *testing.T, s kvstore.Store, key, value string) {
+	t.Helper()
+
+	b := s.NewBatch()
+	require.NoError(t, b.Set([]byte(key), []byte(value), 0))
+	require.NoError(t, b.Commit(false))
+}
+
+func del(t *testing.T, s kvstore.Store, key string) {
+	t.Helper()
+
+	b := s.NewBatch()
+	require.NoError(t, b.Delete([]byte(key)))
+	require.NoError(t, b.Commit(false))
+}
+
+func get(t *testing.T, s kvstore.Store, key string) []byte {
+	t.Helper()
+
+	v, err := s.Get([]byte(key))
+	require.NoError(t, err)
+	return v
+}
+
+// keys returns the keys with the prefix and their values
+func keys(t *testing.T, s kvstore.Store, prefix string) map[string]string {
+	t.Helper()
+
+	found := map[string]string{}
+	require.NoError(t, s.Iterate([]byte(prefix), func(k, v []byte) error {
+		found[string(k)] = string(v)
+		return nil
+	}))
+	return found
+}
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	tieredHook := new(Hook)
+	tieredHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, tieredHook.Init(options))
+	t.Cleanup(func() { tieredHook.Stop() })
+	return tieredHook
+}
+
+func TestID(t *testing.T) {
+	tieredHook := new(Hook)
+
+	require.Equal(t, "tiered-storage-hook", tieredHook.ID())
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - memory cold store",
+			config:      Options{Cold: kvstore.NewMemory()},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no cold store",
+			config:      Options{},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			tieredHook := new(Hook)
+			tieredHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := tieredHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, 10*time.Minute, tieredHook.config.IdleTimeout)
+				require.NoError(t, tieredHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	cold := kvstore.NewMemory()
+	s := held(cold)
+	defer s.Close()
+
+	// writes are kept in memory until they are spilled
+	set(t, s, "CL_a", "1")
+	set(t, s, "CL_b", "2")
+	require.Equal(t, []byte("1"), get(t, s, "CL_a"))
+	require.Empty(t, keys(t, cold, ""))
+
+	require.NoError(t, s.Sync())
+	require.Equal(t, map[string]string{"CL_a": "1", "CL_b": "2"}, keys(t, cold, ""))
+
+	// deletes hide the record of the cold store until they are spilled
+	del(t, s, "CL_a")
+	set(t, s, "CL_b", "3")
+	require.Nil(t, get(t, s, "CL_a"))
+	require.Equal(t, map[string]string{"CL_b": "3"}, keys(t, s, ""))
+	require.Len(t, keys(t, cold, ""), 2)
+
+	require.NoError(t, s.Sync())
+	require.Equal(t, map[string]string{"CL_b": "3"}, keys(t, cold, ""))
+	require.Equal(t, uint64(4), s.Stats().Flushed)
+}
+
+func TestStoreReadThrough(t *testing.T) {
+	cold := kvstore.NewMemory()
+	set(t, cold, "CL_a", "1")
+	set(t, cold, "SUB_a", "2")
+
+	s := held(cold)
+	defer s.Close()
+
+	// records which aren't in memory are read from the cold store, and kept in memory
+	require.Equal(t, []byte("1"), get(t, s, "CL_a"))
+	require.Nil(t, get(t, s, "CL_missing"))
+	del(t, cold, "CL_a")
+	require.Equal(t, []byte("1"), get(t, s, "CL_a"))
+
+	set(t, s, "CL_b", "3")
+	require.Equal(t, map[string]string{"CL_a": "1", "CL_b": "3"}, keys(t, s, "CL_"))
+}
+
+func TestStoreEvict(t *testing.T) {
+	cold := kvstore.NewMemory()
+	s := held(cold)
+	defer s.Close()
+
+	set(t, s, "CL_a", "1")
+
+	// records are only evicted once they are spilled
+	require.Equal(t, 0, s.Evict(0))
+	require.NoError(t, s.Sync())
+	require.Equal(t, 0, s.Evict(time.Hour))
+	require.Equal(t, 1, s.Evict(0))
+
+	// evicted records are read from the cold store
+	require.Equal(t, []byte("1"), get(t, s, "CL_a"))
+}
+
+func TestStoreSpillFailure(t *testing.T) {
+	cold := &failingStore{Memory: kvstore.NewMemory(), err: errors.New("connection refused")}
+	s := held(cold)
+	defer s.Close()
+
+	set(t, s, "CL_a", "1")
+	require.Error(t, s.Sync())
+	require.Equal(t, 0, s.Evict(0))
+
+	// the failed writes are spilled again, with the latest values of their records
+	set(t, s, "CL_a", "2")
+	cold.err = nil
+	require.NoError(t, s.Sync())
+	require.Equal(t, map[string]string{"CL_a": "2"}, keys(t, cold.Memory, ""))
+	require.Equal(t, 1, s.Evict(0))
+
+	// writes committed with sync are spilled before they return
+	b := s.NewBatch()
+	require.NoError(t, b.Set([]byte("CL_b"), []byte("3"), 0))
+	require.NoError(t, b.Commit(true))
+	require.Len(t, keys(t, cold.Memory, ""), 2)
+}
+
+func TestHook(t *testing.T) {
+	cold := kvstore.NewMemory()
+	tieredHook := newHook(t, Options{Cold: cold, Spill: coalesce.Options{Interval: time.Millisecond}})
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+	tieredHook.OnSessionEstablished(cl, packets.Packet{})
+
+	// writes are spilled in the background
+	require.Eventually(t, func() bool {
+		return len(keys(t, cold, "")) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestRestore(t *testing.T) {
+	cold := kvstore.NewMemory()
+	tieredHook := newHook(t, Options{Cold: cold, Spill: coalesce.Options{Interval: time.Hour}})
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+	tieredHook.OnSessionEstablished(cl, packets.Packet{})
+	tieredHook.OnRetainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+	}, 1)
+
+	// the pending writes are spilled when the hook stops
+	require.NoError(t, tieredHook.Stop())
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, server.AddHook(new(Hook), Options{Cold: cold}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	_, ok := server.Clients.Get("c1")
+	require.True(t, ok)
+	retained, ok := server.Topics.Retained.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), retained.Payload)
+}
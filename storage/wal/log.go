@@ -0,0 +1,246 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	segmentExt    = ".wal"
+	checkpointExt = ".checkpoint"
+)
+
+// the kinds of the writes of an entry
+const (
+	opDelete byte = iota
+	opSet
+)
+
+// errTorn is returned for an entry which was only partly written, eg. when the machine crashed
+var errTorn = errors.New("torn entry")
+
+// op is a write of an entry
+type op struct {
+	key   []byte
+	value []byte // nil for deletes
+	ttl   time.Duration
+}
+
+// encodeEntry encodes the writes of a batch as an entry, which is its length, the checksum of its
+// writes, and the writes
+func encodeEntry(ops []op) []byte {
+	var body []byte
+	for _, o := range ops {
+		if o.value == nil {
+			body = append(body, opDelete)
+			body = appendField(body, o.key)
+			continue
+		}
+
+		body = append(body, opSet)
+		body = appendField(body, o.key)
+		body = appendField(body, o.value)
+		body = binary.AppendUvarint(body, uint64(o.ttl))
+	}
+
+	entry := binary.AppendUvarint(nil, uint64(len(body)))
+	entry = binary.BigEndian.AppendUint32(entry, crc32.ChecksumIEEE(body))
+	return append(entry, body...)
+}
+
+// appendField appends a length prefixed field
+func appendField(b, field []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(field)))
+	return append(b, field...)
+}
+
+// readEntry reads the writes of the next entry, returning io.EOF at the end of the segment and errTorn
+// if the entry is incomplete or its checksum doesn't match
+func readEntry(r *bufio.Reader) ([]op, error) {
+	size, err := binary.ReadUvarint(r)
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errTorn
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return nil, errTorn
+	}
+
+	// the body is read as it arrives rather than allocated up front, so a corrupt size fails at the
+	// end of the segment
+	body, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(body)) != size || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum[:]) {
+		return nil, errTorn
+	}
+
+	return decodeOps(body)
+}
+
+// decodeOps decodes the writes of the body of an entry
+func decodeOps(body []byte) ([]op, error) {
+	var ops []op
+	for len(body) > 0 {
+		kind := body[0]
+		body = body[1:]
+
+		var o op
+		var err error
+		if o.key, body, err = cutField(body); err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case opDelete:
+		case opSet:
+			if o.value, body, err = cutField(body); err != nil {
+				return nil, err
+			}
+
+			ttl, n := binary.Uvarint(body)
+			if n <= 0 {
+				return nil, errors.New("invalid ttl")
+			}
+			o.ttl, body = time.Duration(ttl), body[n:]
+		default:
+			return nil, fmt.Errorf("unknown write %d", kind)
+		}
+
+		ops = append(ops, o)
+	}
+
+	return ops, nil
+}
+
+// cutField returns the length prefixed field at the start of b, and what follows it
+func cutField(b []byte) (field, rest []byte, err error) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return nil, nil, errors.New("invalid field")
+	}
+
+	field = b[n : n+int(size)]
+	if field == nil {
+		field = []byte{} // an empty value is set, not deleted
+	}
+	return field, b[n+int(size):], nil
+}
+
+// segmentName returns the name of a file of the log
+func segmentName(dir string, seq uint64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, ext))
+}
+
+// files returns the sequence numbers of the segments and checkpoints in the directory, in order
+func files(dir string) (segments, checkpoints []uint64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, e := range entries {
+		name, ext := e.Name(), filepath.Ext(e.Name())
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil || e.IsDir() {
+			continue
+		}
+
+		switch ext {
+		case segmentExt:
+			segments = append(segments, seq)
+		case checkpointExt:
+			checkpoints = append(checkpoints, seq)
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i] < checkpoints[j] })
+	return segments, checkpoints, nil
+}
+
+// replaySegment calls fn with the writes of each entry of the segment, and truncates the segment at
+// an incomplete entry, which was the last write before a crash and was never acknowledged
+func replaySegment(path string, fn func(ops []op) error) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64 // the end of the last complete entry
+	for {
+		ops, err := readEntry(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if errors.Is(err, errTorn) {
+			return errors.Join(f.Truncate(offset), f.Sync())
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(ops); err != nil {
+			return err
+		}
+
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		offset = pos - int64(r.Buffered())
+	}
+}
+
+// writeFile atomically replaces the file with what fn writes, syncing it and the directory
+func writeFile(path string, fn func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	err = fn(w)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err = errors.Join(err, f.Close()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory, so the files created and renamed in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
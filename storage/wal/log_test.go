@@ -0,0 +1,73 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntry(t *testing.T) {
+	ops := []op{
+		{key: []byte("a"), value: []byte("1"), ttl: time.Hour},
+		{key: []byte("b"), value: []byte{}},
+		{key: []byte("c")},
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encodeEntry(ops))
+	buf.Write(encodeEntry(ops[2:]))
+
+	r := bufio.NewReader(&buf)
+	got, err := readEntry(r)
+	require.NoError(t, err)
+	require.Equal(t, ops, got)
+	require.NotNil(t, got[1].value)
+
+	got, err = readEntry(r)
+	require.NoError(t, err)
+	require.Equal(t, ops[2:], got)
+
+	_, err = readEntry(r)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestEntryTorn(t *testing.T) {
+	entry := encodeEntry([]op{{key: []byte("a"), value: []byte("1")}})
+	corrupt := append([]byte{}, entry...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "Failure - incomplete size",
+			data: []byte{0x80},
+		},
+		{
+			name: "Failure - incomplete checksum",
+			data: entry[:3],
+		},
+		{
+			name: "Failure - incomplete body",
+			data: entry[:len(entry)-1],
+		},
+		{
+			name: "Failure - checksum mismatch",
+			data: corrupt,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, err := readEntry(bufio.NewReader(bytes.NewReader(tt.data)))
+			require.ErrorIs(t, err, errTorn)
+
+		})
+	}
+}
@@ -0,0 +1,360 @@
+// Package wal provides a storage hook appending every write to a write-ahead log of segment files in a
+// local directory, and replaying the log when the broker starts, so that the writes survive a crash.
+//
+// Alone, the hook keeps the records in memory, and checkpoints them to the directory whenever a segment
+// is full. In front of a slower Remote store, such as a tiered.Store spilling to Redis or SQL in the
+// background, the log makes the writes durable before they reach the remote store, and replays those
+// which may not have onto it. Either way, with kvstore.SyncInterval at most the writes of the last sync
+// interval are lost when the machine crashes.
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+)
+
+// ErrClosed is returned for writes to a closed store
+var ErrClosed = errors.New("write-ahead log is closed")
+
+// Hook is a hook that logs the writes of the clients, subscriptions, retained and inflight messages
+// and system info of the server ahead of storing them, from which the server restores them when it
+// starts
+type Hook struct {
+	config Options
+	kvstore.Storage
+}
+
+// Options is a struct that contains all the information required to configure the wal hook
+type Options struct {
+	// Dir is the directory of the log, which is created if it doesn't exist
+	Dir string
+
+	// Remote is the store the log is ahead of, to which the writes are applied once they are logged.
+	// It should write in the background, as every event waits for it. The hook closes it when it
+	// stops. The records are kept in memory and checkpointed to the directory if it is nil
+	Remote kvstore.Store
+
+	// SegmentSize is the size a segment grows to before the writes are checkpointed, or synced to
+	// the remote store, and a new segment is started, defaults to 64 MiB
+	SegmentSize int64
+
+	kvstore.Options // when the log is synced, and how long sessions are kept
+}
+
+// ID returns the ID of the hook
+func (h *Hook) ID() string {
+	return "wal-storage-hook"
+}
+
+// Init initializes the hook with the given config, replaying the log
+func (h *Hook) Init(config any) error {
+	if config == nil {
+		return errors.New("nil config")
+	}
+
+	walHookConfig, ok := config.(Options)
+	if !ok {
+		return errors.New("improper config")
+	}
+
+	if walHookConfig.Dir == "" {
+		return errors.New("dir is required")
+	}
+
+	if walHookConfig.SegmentSize <= 0 {
+		walHookConfig.SegmentSize = 64 << 20
+	}
+
+	store, err := NewStore(walHookConfig.Dir, walHookConfig.Remote, walHookConfig.SegmentSize, func(err error) {
+		h.Log.Error("error occurred while checkpointing write-ahead log", "error", err)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := h.Open(store, walHookConfig.Options); err != nil {
+		store.Close()
+		return err
+	}
+
+	h.config = walHookConfig
+	return nil
+}
+
+// Stop syncs and checkpoints the log, and closes it and the remote store
+func (h *Hook) Stop() error {
+	return h.Close()
+}
+
+// Store is a kvstore.Store logging the writes of each batch before applying them to the remote store,
+// or to memory
+type Store struct {
+	dir         string
+	next        kvstore.Store   // where the writes are applied once logged
+	memory      *kvstore.Memory // the records when there is no remote store
+	segment     *os.File        // the segment being written
+	seq         uint64          // the sequence number of the segment
+	size        int64           // the size of the segment
+	segmentSize int64
+	dirty       bool // whether the segment has writes which aren't synced
+	onError     func(err error)
+	mu          sync.Mutex
+}
+
+// NewStore replays the log in the directory onto the remote store, or onto memory from the latest
+// checkpoint if remote is nil, and starts a new segment. Failures to checkpoint the log when a segment
+// is full are passed to onError
+func NewStore(dir string, remote kvstore.Store, segmentSize int64, onError func(err error)) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:         dir,
+		next:        remote,
+		segmentSize: segmentSize,
+		onError:     onError,
+	}
+
+	segments, checkpoints, err := files(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		s.memory = kvstore.NewMemory()
+		s.next = s.memory
+		if len(checkpoints) > 0 {
+			s.seq = checkpoints[len(checkpoints)-1]
+			if err := s.restore(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, seq := range segments {
+		if seq < s.seq {
+			continue // covered by the checkpoint
+		}
+
+		// a torn entry may be followed by segments started after the crash, eg. if the remote store
+		// couldn't be synced, so it is truncated wherever it is
+		if err := replaySegment(segmentName(dir, seq, segmentExt), s.apply); err != nil {
+			return nil, fmt.Errorf("failed replaying segment %d: %w", seq, err)
+		}
+		s.seq = seq
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkpoint(); err != nil {
+		if s.segment != nil {
+			s.segment.Close()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// restore reads the records of the checkpoint into memory
+func (s *Store) restore() error {
+	f, err := os.Open(segmentName(s.dir, s.seq, checkpointExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := s.memory.ReadFrom(f); err != nil {
+		return fmt.Errorf("failed reading checkpoint %d: %w", s.seq, err)
+	}
+	return nil
+}
+
+// apply applies the writes of an entry to the remote store or memory
+func (s *Store) apply(ops []op) error {
+	batch := s.next.NewBatch()
+	for _, o := range ops {
+		var err error
+		if o.value == nil {
+			err = batch.Delete(o.key)
+		} else {
+			err = batch.Set(o.key, o.value, o.ttl)
+		}
+
+		if err != nil {
+			batch.Discard()
+			return err
+		}
+	}
+	return batch.Commit(false)
+}
+
+// checkpoint starts a new segment, makes the writes of the previous segments durable without them, by
+// checkpointing memory or syncing the remote store, and deletes the previous segments and checkpoints
+func (s *Store) checkpoint() error {
+	if s.segment != nil {
+		if err := errors.Join(s.segment.Sync(), s.segment.Close()); err != nil {
+			return err
+		}
+		s.segment = nil
+	}
+
+	seq := s.seq + 1
+	f, err := os.OpenFile(segmentName(s.dir, seq, segmentExt), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	s.segment, s.seq, s.size, s.dirty = f, seq, 0, false
+
+	if s.memory != nil {
+		err = writeFile(segmentName(s.dir, seq, checkpointExt), func(w io.Writer) error {
+			_, err := s.memory.WriteTo(w)
+			return err
+		})
+	} else {
+		err = errors.Join(syncDir(s.dir), s.next.Sync())
+	}
+
+	if err != nil {
+		return err // the previous segments are replayed instead
+	}
+
+	segments, checkpoints, err := files(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, old := range segments {
+		if old < seq {
+			err = errors.Join(err, os.Remove(segmentName(s.dir, old, segmentExt)))
+		}
+	}
+
+	for _, old := range checkpoints {
+		if old < seq {
+			err = errors.Join(err, os.Remove(segmentName(s.dir, old, checkpointExt)))
+		}
+	}
+	return err
+}
+
+// NewBatch implements kvstore.Store
+func (s *Store) NewBatch() kvstore.Batch {
+	return &batch{store: s}
+}
+
+// Get implements kvstore.Store
+func (s *Store) Get(key []byte) ([]byte, error) {
+	return s.next.Get(key)
+}
+
+// Iterate implements kvstore.Store
+func (s *Store) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return s.next.Iterate(prefix, fn)
+}
+
+// Sync implements kvstore.Store, syncing the segment
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment == nil || !s.dirty {
+		return nil
+	}
+
+	s.dirty = false
+	return s.segment.Sync()
+}
+
+// Close implements kvstore.Store, checkpointing the log and closing the remote store
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment == nil {
+		return nil
+	}
+
+	err := s.checkpoint()
+	if s.segment != nil {
+		err = errors.Join(err, s.segment.Sync(), s.segment.Close())
+		s.segment = nil
+	}
+	return errors.Join(err, s.next.Close())
+}
+
+// commit logs the writes and applies them
+func (s *Store) commit(ops []op, sync bool) error {
+	entry := encodeEntry(ops)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment == nil {
+		return ErrClosed
+	}
+
+	if _, err := s.segment.Write(entry); err != nil {
+		return err
+	}
+	s.size += int64(len(entry))
+	s.dirty = true
+
+	if sync {
+		if err := s.segment.Sync(); err != nil {
+			return err
+		}
+		s.dirty = false
+	}
+
+	if err := s.apply(ops); err != nil {
+		return err
+	}
+
+	if s.size >= s.segmentSize {
+		if err := s.checkpoint(); err != nil {
+			s.onError(err)
+		}
+	}
+	return nil
+}
+
+// batch collects the writes of a batch in order
+type batch struct {
+	store *Store
+	ops   []op
+}
+
+// Set implements kvstore.Batch
+func (b *batch) Set(key, value []byte, ttl time.Duration) error {
+	b.ops = append(b.ops, op{key: append([]byte{}, key...), value: append([]byte{}, value...), ttl: ttl})
+	return nil
+}
+
+// Delete implements kvstore.Batch
+func (b *batch) Delete(key []byte) error {
+	b.ops = append(b.ops, op{key: append([]byte{}, key...)})
+	return nil
+}
+
+// Commit implements kvstore.Batch
+func (b *batch) Commit(sync bool) error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	ops := b.ops
+	b.ops = nil
+	return b.store.commit(ops, sync)
+}
+
+// Discard implements kvstore.Batch
+func (b *batch) Discard() {
+	b.ops = nil
+}
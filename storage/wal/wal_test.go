@@ -0,0 +1,321 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mochi-mqtt/hooks/pkg/kvstore"
+	"github.com/mochi-mqtt/hooks/pkg/kvstore/kvstoretest"
+)
+
+func newHook(t *testing.T, options Options) *Hook {
+	t.Helper()
+
+	walHook := new(Hook)
+	walHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, walHook.Init(options))
+	t.Cleanup(func() { walHook.Stop() })
+	return walHook
+}
+
+func newStore(t *testing.T, dir string, remote kvstore.Store, segmentSize int64) *Store {
+	t.Helper()
+
+	store, err := NewStore(dir, remote, segmentSize, func(err error) {
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	return store
+}
+
+func set(t *testing.T, store kvstore.Store, key, value string) {
+	t.Helper()
+
+	batch := store.NewBatch()
+	require.NoError(t, batch.Set([]byte(key), []byte(value), 0))
+	require.NoError(t, batch.Commit(true))
+}
+
+func get(t *testing.T, store kvstore.Store, key string) string {
+	t.Helper()
+
+	value, err := store.Get([]byte(key))
+	require.NoError(t, err)
+	return string(value)
+}
+
+// logFiles returns the names of the files in the directory
+func logFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestID(t *testing.T) {
+	walHook := new(Hook)
+
+	require.Equal(t, "wal-storage-hook", walHook.ID())
+}
+
+func TestProvides(t *testing.T) {
+	walHook := new(Hook)
+
+	require.True(t, walHook.Provides(mqtt.OnSessionEstablished))
+	require.True(t, walHook.Provides(mqtt.StoredClients))
+	require.False(t, walHook.Provides(mqtt.OnACLCheck))
+}
+
+func TestInit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+
+	tests := []struct {
+		name        string
+		config      any
+		expectError bool
+	}{
+		{
+			name:        "Success - dir",
+			config:      Options{Dir: filepath.Join(t.TempDir(), "wal")},
+			expectError: false,
+		},
+		{
+			name:        "Success - remote",
+			config:      Options{Dir: t.TempDir(), Remote: kvstoretest.NewStore()},
+			expectError: false,
+		},
+		{
+			name:        "Failure - nil config",
+			config:      nil,
+			expectError: true,
+		},
+		{
+			name:        "Failure - improper config",
+			config:      "options",
+			expectError: true,
+		},
+		{
+			name:        "Failure - no dir",
+			config:      Options{},
+			expectError: true,
+		},
+		{
+			name:        "Failure - dir is a file",
+			config:      Options{Dir: file},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			walHook := new(Hook)
+			walHook.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+			err := walHook.Init(tt.config)
+			if tt.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, int64(64<<20), walHook.config.SegmentSize)
+				require.NoError(t, walHook.Stop())
+			}
+
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	walHook := newHook(t, Options{Dir: dir})
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "c1", false)
+	cl.Properties.ProtocolVersion = 5
+	walHook.OnSessionEstablished(cl, packets.Packet{})
+	walHook.OnRetainMessage(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b",
+		Payload:     []byte("hello"),
+	}, 1)
+	require.NoError(t, walHook.Stop())
+
+	server := mqtt.New(nil)
+	server.Log = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	require.NoError(t, server.AddHook(new(Hook), Options{Dir: dir}))
+	require.NoError(t, server.Serve())
+	defer server.Close()
+
+	_, ok := server.Clients.Get("c1")
+	require.True(t, ok)
+	retained, ok := server.Topics.Retained.Get("a/b")
+	require.True(t, ok)
+	require.Equal(t, []byte("hello"), retained.Payload)
+}
+
+func TestCrash(t *testing.T) {
+	dir := t.TempDir()
+	store := newStore(t, dir, nil, 1<<20)
+	set(t, store, "a", "1")
+	set(t, store, "b", "2")
+	batch := store.NewBatch()
+	require.NoError(t, batch.Delete([]byte("a")))
+	require.NoError(t, batch.Set([]byte("c"), nil, 0))
+	require.NoError(t, batch.Commit(false))
+	require.NoError(t, store.Sync())
+
+	// the store isn't closed, and the last write was torn
+	f, err := os.OpenFile(filepath.Join(dir, "00000000000000000001.wal"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write(encodeEntry([]op{{key: []byte("d"), value: []byte("4")}})[:5])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	restored := newStore(t, dir, nil, 1<<20)
+	defer restored.Close()
+	require.Equal(t, "", get(t, restored, "a"))
+	require.Equal(t, "2", get(t, restored, "b"))
+	value, err := restored.Get([]byte("c"))
+	require.NoError(t, err)
+	require.NotNil(t, value)
+	require.Equal(t, "", get(t, restored, "d"))
+
+	// the replayed writes are checkpointed
+	require.Equal(t, []string{"00000000000000000002.checkpoint", "00000000000000000002.wal"}, logFiles(t, dir))
+}
+
+func TestCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+
+	// an entry whose checksum matches, but whose writes can't be decoded
+	body := []byte{0x7}
+	entry := binary.AppendUvarint(nil, uint64(len(body)))
+	entry = binary.BigEndian.AppendUint32(entry, crc32.ChecksumIEEE(body))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000001.wal"), append(entry, body...), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000002.wal"), nil, 0o600))
+
+	_, err := NewStore(dir, nil, 1<<20, nil)
+	require.ErrorContains(t, err, "failed replaying segment 1")
+}
+
+// unsynced is a remote store which can't be synced
+type unsynced struct {
+	kvstore.Store
+}
+
+func (u unsynced) Sync() error {
+	return errors.New("unavailable")
+}
+
+func TestCrashRemoteFailure(t *testing.T) {
+	dir := t.TempDir()
+	store := newStore(t, dir, kvstoretest.NewStore(), 1<<20)
+	set(t, store, "a", "1")
+
+	// the store isn't closed, and the last write was torn
+	f, err := os.OpenFile(filepath.Join(dir, "00000000000000000001.wal"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write(encodeEntry([]op{{key: []byte("b"), value: []byte("2")}})[:5])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the remote store can't be synced when the store is started again, so the torn segment is kept
+	// behind the segment started after it
+	_, err = NewStore(dir, unsynced{kvstoretest.NewStore()}, 1<<20, nil)
+	require.Error(t, err)
+	require.Equal(t, []string{"00000000000000000001.wal", "00000000000000000002.wal"}, logFiles(t, dir))
+
+	replayed := kvstoretest.NewStore()
+	restored := newStore(t, dir, replayed, 1<<20)
+	defer restored.Close()
+	require.Equal(t, "1", get(t, replayed, "a"))
+	require.Equal(t, "", get(t, replayed, "b"))
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	store := newStore(t, dir, nil, 64)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		set(t, store, key, "0123456789")
+	}
+
+	// the segments are replaced by checkpoints as they fill
+	require.Len(t, logFiles(t, dir), 2)
+	require.NoError(t, store.Close())
+	batch := store.NewBatch()
+	require.NoError(t, batch.Delete([]byte("a")))
+	require.ErrorIs(t, batch.Commit(false), ErrClosed)
+	require.NoError(t, store.Close())
+
+	restored := newStore(t, dir, nil, 64)
+	defer restored.Close()
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		require.Equal(t, "0123456789", get(t, restored, key))
+	}
+
+	var keys []string
+	require.NoError(t, restored.Iterate(nil, func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	require.Len(t, keys, 6)
+}
+
+func TestRemote(t *testing.T) {
+	dir := t.TempDir()
+	remote := kvstoretest.NewStore()
+	store := newStore(t, dir, remote, 1<<20)
+	syncs := remote.Syncs()
+	set(t, store, "a", "1")
+
+	// writes are applied to the remote store without syncing it
+	require.Equal(t, "1", get(t, remote, "a"))
+	require.Equal(t, []bool{false}, remote.Commits())
+	require.Equal(t, syncs, remote.Syncs())
+
+	// the remote store lost the write in a crash, and the log replays it
+	replayed := kvstoretest.NewStore()
+	restored := newStore(t, dir, replayed, 1<<20)
+	require.Equal(t, "1", get(t, replayed, "a"))
+	require.Equal(t, "1", get(t, restored, "a"))
+	require.Equal(t, 1, replayed.Syncs())
+
+	// the log is truncated once the remote store is synced
+	require.NoError(t, restored.Close())
+	require.True(t, replayed.Closed())
+	require.Equal(t, []string{"00000000000000000003.wal"}, logFiles(t, dir))
+
+	empty := kvstoretest.NewStore()
+	newStore(t, dir, empty, 1<<20).Close()
+	require.Empty(t, empty.Keys(""))
+}
+
+func TestRemoteFailure(t *testing.T) {
+	dir := t.TempDir()
+	remote := kvstoretest.NewStore()
+	store := newStore(t, dir, remote, 1<<20)
+	set(t, store, "a", "1")
+
+	// the log is kept while the remote store can't be synced
+	remote.Err = errors.New("unavailable")
+	require.Error(t, store.Close())
+	require.Len(t, logFiles(t, dir), 2)
+
+	replayed := kvstoretest.NewStore()
+	restored := newStore(t, dir, replayed, 1<<20)
+	defer restored.Close()
+	require.Equal(t, "1", get(t, replayed, "a"))
+}